@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/client/awsidentity"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+	"golang.org/x/crypto/ssh"
+)
+
+type hostAgent struct {
+	client         *http.Client
+	keymasterURL   string
+	signer         ssh.Signer
+	certFile       string
+	principals     []string
+	bootstrapToken string
+	useAWS         bool
+}
+
+// loadCertificate returns the certificate in the certificate file if it is
+// a host certificate for the host key and the principals.
+func (a *hostAgent) loadCertificate() (*ssh.Certificate, error) {
+	data, err := ioutil.ReadFile(a.certFile)
+	if err != nil {
+		return nil, err
+	}
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, err
+	}
+	cert, ok := pubKey.(*ssh.Certificate)
+	if !ok || cert.CertType != ssh.HostCert {
+		return nil, fmt.Errorf("%s is not a host certificate", a.certFile)
+	}
+	if !bytes.Equal(cert.Key.Marshal(), a.signer.PublicKey().Marshal()) {
+		return nil, fmt.Errorf("%s is not for the host key", a.certFile)
+	}
+	if len(cert.ValidPrincipals) != len(a.principals) {
+		return nil, fmt.Errorf("%s has other principals", a.certFile)
+	}
+	for index, principal := range cert.ValidPrincipals {
+		if principal != a.principals[index] {
+			return nil, fmt.Errorf("%s has other principals", a.certFile)
+		}
+	}
+	return cert, nil
+}
+
+// needsRenewal returns true once less than half of the lifetime of cert
+// remains.
+func needsRenewal(cert *ssh.Certificate, now time.Time) bool {
+	validAfter := time.Unix(int64(cert.ValidAfter), 0)
+	validBefore := time.Unix(int64(cert.ValidBefore), 0)
+	return now.After(validAfter.Add(validBefore.Sub(validAfter) / 2))
+}
+
+func (a *hostAgent) newRequest() proto.HostCertRequest {
+	return proto.HostCertRequest{
+		PublicKey:  string(ssh.MarshalAuthorizedKey(a.signer.PublicKey())),
+		Principals: a.principals,
+	}
+}
+
+func (a *hostAgent) getRenewalRequest(cert *ssh.Certificate, now time.Time) (
+	proto.HostCertRequest, error) {
+	request := a.newRequest()
+	request.Certificate = string(ssh.MarshalAuthorizedKey(cert))
+	request.Time = now
+	signature, err := a.signer.Sign(rand.Reader, request.RenewalMessage())
+	if err != nil {
+		return request, err
+	}
+	request.Signature = ssh.Marshal(signature)
+	return request, nil
+}
+
+func (a *hostAgent) getBootstrapRequest() (proto.HostCertRequest, error) {
+	request := a.newRequest()
+	if a.bootstrapToken != "" {
+		request.BootstrapToken = a.bootstrapToken
+		return request, nil
+	}
+	if !a.useAWS {
+		return request, errors.New("no bootstrap token or AWS identity")
+	}
+	identity, err := awsidentity.GetIdentity(a.client,
+		awsidentity.DefaultMetadataURL, a.keymasterURL)
+	if err != nil {
+		return request, err
+	}
+	request.AWSIdentityDocument = identity.Document
+	request.AWSIdentitySignature = identity.Signature
+	request.AWSSTSRequest = identity.STSRequest
+	return request, nil
+}
+
+func (a *hostAgent) requestCertificate(request proto.HostCertRequest) (
+	string, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return "", err
+	}
+	resp, err := a.client.Post(a.keymasterURL+proto.HostCertPath,
+		"application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return "", fmt.Errorf("keymaster returned %s: %s", resp.Status,
+			bytes.TrimSpace(message))
+	}
+	var response proto.HostCertResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return "", err
+	}
+	return response.Certificate, nil
+}
+
+func (a *hostAgent) writeCertificate(cert string) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(a.certFile),
+		filepath.Base(a.certFile))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.WriteString(cert + "\n"); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Chmod(0644); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), a.certFile)
+}
+
+// renew writes a new certificate when the current one is missing or is due
+// for renewal, and returns true if it did. A still valid certificate is used
+// to authenticate, otherwise the bootstrap credentials are.
+func (a *hostAgent) renew(now time.Time) (bool, error) {
+	cert, err := a.loadCertificate()
+	if err == nil && !needsRenewal(cert, now) {
+		return false, nil
+	}
+	var newCert string
+	if err == nil && now.Before(time.Unix(int64(cert.ValidBefore), 0)) {
+		request, err := a.getRenewalRequest(cert, now)
+		if err != nil {
+			return false, err
+		}
+		newCert, err = a.requestCertificate(request)
+		if err != nil && a.bootstrapToken == "" && !a.useAWS {
+			return false, fmt.Errorf("cannot renew certificate: %s", err)
+		}
+	}
+	if newCert == "" {
+		request, err := a.getBootstrapRequest()
+		if err != nil {
+			return false, err
+		}
+		newCert, err = a.requestCertificate(request)
+		if err != nil {
+			return false, fmt.Errorf("cannot get certificate: %s", err)
+		}
+	}
+	if err := a.writeCertificate(newCert); err != nil {
+		return false, err
+	}
+	return true, nil
+}
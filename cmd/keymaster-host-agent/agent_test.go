@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/certgen"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// newTestKeymaster returns a server issuing host certificates and recording
+// the requests it received.
+func newTestKeymaster(t *testing.T,
+	requests *[]proto.HostCertRequest) *httptest.Server {
+	caSigner := newTestSigner(t)
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != proto.HostCertPath {
+				http.NotFound(w, r)
+				return
+			}
+			var request proto.HostCertRequest
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				t.Fatal(err)
+			}
+			*requests = append(*requests, request)
+			hostKey, _, _, _, err := ssh.ParseAuthorizedKey(
+				[]byte(request.PublicKey))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cert, _, err := certgen.GenSSHHostCert(hostKey,
+				request.Principals, caSigner, "test", time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			json.NewEncoder(w).Encode(proto.HostCertResponse{Certificate: cert})
+		}))
+}
+
+func TestRenew(t *testing.T) {
+	dir, err := ioutil.TempDir("", "host_agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var requests []proto.HostCertRequest
+	server := newTestKeymaster(t, &requests)
+	defer server.Close()
+	agent := &hostAgent{
+		client:         server.Client(),
+		keymasterURL:   server.URL,
+		signer:         newTestSigner(t),
+		certFile:       filepath.Join(dir, "ssh_host_ed25519_key-cert.pub"),
+		principals:     []string{"host.example.com"},
+		bootstrapToken: "token",
+	}
+	now := time.Now()
+	if renewed, err := agent.renew(now); err != nil || !renewed {
+		t.Fatalf("expected new certificate: %v", err)
+	}
+	if len(requests) != 1 || requests[0].BootstrapToken != "token" {
+		t.Fatal("expected bootstrap request")
+	}
+	if renewed, err := agent.renew(now); err != nil || renewed {
+		t.Fatalf("unexpected renewal: %v", err)
+	}
+	cert, err := agent.loadCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	renewalTime := now.Add(45 * time.Minute)
+	if renewed, err := agent.renew(renewalTime); err != nil || !renewed {
+		t.Fatalf("expected renewed certificate: %v", err)
+	}
+	request := requests[len(requests)-1]
+	if len(requests) != 2 || request.BootstrapToken != "" ||
+		request.Certificate != string(ssh.MarshalAuthorizedKey(cert)) {
+		t.Fatal("expected renewal request")
+	}
+	var signature ssh.Signature
+	if err := ssh.Unmarshal(request.Signature, &signature); err != nil {
+		t.Fatal(err)
+	}
+	err = agent.signer.PublicKey().Verify(request.RenewalMessage(), &signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Expired certificates are replaced using the bootstrap token.
+	if renewed, err := agent.renew(now.Add(3 * time.Hour)); err != nil ||
+		!renewed {
+		t.Fatalf("expected new certificate: %v", err)
+	}
+	if len(requests) != 3 || requests[2].BootstrapToken != "token" {
+		t.Fatal("expected bootstrap request")
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log/cmdlogger"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	Version            = "No version provided"
+	awsIdentity        = flag.Bool("aws", false, "Authenticate with the EC2 instance identity document")
+	bootstrapTokenFile = flag.String("bootstrapTokenFile", "", "File with the bootstrap token used when there is no valid certificate")
+	certFile           = flag.String("certFile", "", "Host certificate file (default: hostKeyFile-cert.pub)")
+	checkInterval      = flag.Duration("checkInterval", 0, "Check the certificate this often (default: check once and exit)")
+	hostKeyFile        = flag.String("hostKeyFile", "/etc/ssh/ssh_host_ed25519_key", "SSH host private key file")
+	keymasterURL       = flag.String("keymasterURL", "", "The URL of keymaster (ex: https://keymaster.example.com)")
+	principals         = flag.String("principals", "", "Comma separated host names to request (default: the hostname)")
+	reloadCommand      = flag.String("reloadCommand", "", "Command run after the certificate was renewed (ex: systemctl reload sshd)")
+	rootCAFilename     = flag.String("rootCAFilename", "", "If present, use this file to verify the keymaster server")
+)
+
+func Usage() {
+	fmt.Fprintf(os.Stderr, "Usage of %s (version %s):\n", os.Args[0], Version)
+	flag.PrintDefaults()
+}
+
+func newHostAgent() (*hostAgent, error) {
+	if *keymasterURL == "" {
+		return nil, errors.New("keymasterURL parameter is required")
+	}
+	keyData, err := ioutil.ReadFile(*hostKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(keyData)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %s", *hostKeyFile, err)
+	}
+	agent := &hostAgent{
+		keymasterURL: strings.TrimSuffix(*keymasterURL, "/"),
+		signer:       signer,
+		certFile:     *certFile,
+		useAWS:       *awsIdentity,
+	}
+	if agent.certFile == "" {
+		agent.certFile = *hostKeyFile + "-cert.pub"
+	}
+	if *principals != "" {
+		agent.principals = strings.Split(*principals, ",")
+	} else {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		agent.principals = []string{hostname}
+	}
+	if *bootstrapTokenFile != "" {
+		token, err := ioutil.ReadFile(*bootstrapTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		agent.bootstrapToken = strings.TrimSpace(string(token))
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if *rootCAFilename != "" {
+		caData, err := ioutil.ReadFile(*rootCAFilename)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caData) {
+			return nil, errors.New("cannot load root CA file")
+		}
+	}
+	agent.client = &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		Timeout:   30 * time.Second,
+	}
+	return agent, nil
+}
+
+func main() {
+	flag.Usage = Usage
+	flag.Parse()
+	logger := cmdlogger.New()
+	agent, err := newHostAgent()
+	if err != nil {
+		logger.Fatal(err)
+	}
+	for {
+		renewed, err := agent.renew(time.Now())
+		if err != nil {
+			if *checkInterval == 0 {
+				logger.Fatal(err)
+			}
+			logger.Println(err)
+		}
+		if renewed {
+			logger.Printf("Wrote new host certificate to %s", agent.certFile)
+			if *reloadCommand != "" {
+				cmd := exec.Command("/bin/sh", "-c", *reloadCommand)
+				cmd.Stdout = os.Stdout
+				cmd.Stderr = os.Stderr
+				if err := cmd.Run(); err != nil {
+					logger.Printf("%s failed: %s", *reloadCommand, err)
+				}
+			}
+		}
+		if *checkInterval == 0 {
+			return
+		}
+		time.Sleep(*checkInterval)
+	}
+}
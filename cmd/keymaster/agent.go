@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"path/filepath"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"github.com/Cloud-Foundations/keymaster/lib/client/config"
+	"github.com/Cloud-Foundations/keymaster/lib/client/retrybudget"
+	"github.com/Cloud-Foundations/keymaster/lib/client/twofa"
+	"github.com/Cloud-Foundations/keymaster/lib/client/util"
+)
+
+const agentCommand = "agent"
+
+type agentConfig struct {
+	renewBefore   time.Duration
+	retryInterval time.Duration
+	socketPath    string
+}
+
+// parseAgentFlags parses the flags of the agent or ssh-agent command. The
+// agent settings of baseConfig replace the default values of the flags.
+func parseAgentFlags(command string, args []string,
+	baseConfig config.BaseConfig) (agentConfig, error) {
+	var agentConf agentConfig
+	renewBefore := 4 * time.Hour
+	if baseConfig.AgentRenewBefore > 0 {
+		renewBefore = baseConfig.AgentRenewBefore
+	}
+	retryInterval := 5 * time.Minute
+	if baseConfig.AgentRetryInterval > 0 {
+		retryInterval = baseConfig.AgentRetryInterval
+	}
+	flagSet := flag.NewFlagSet(command, flag.ContinueOnError)
+	flagSet.DurationVar(&agentConf.renewBefore, "renew-before", renewBefore,
+		"Renew the certificates this long before they expire")
+	flagSet.DurationVar(&agentConf.retryInterval, "retry-interval",
+		retryInterval, "Time to wait after a failed renewal")
+	if command == sshAgentCommand {
+		flagSet.StringVar(&agentConf.socketPath, "socket", "",
+			"Path of the agent socket (default: keymaster-<username>/agent.sock in the runtime or temporary directory)")
+	}
+	if err := flagSet.Parse(args); err != nil {
+		return agentConfig{}, err
+	}
+	if flagSet.NArg() > 0 {
+		return agentConfig{}, fmt.Errorf("unexpected arguments: %v",
+			flagSet.Args())
+	}
+	if agentConf.renewBefore <= 0 || agentConf.renewBefore >= *twofa.Duration {
+		return agentConfig{}, fmt.Errorf(
+			"-renew-before must be positive and less than -duration (%s)",
+			*twofa.Duration)
+	}
+	if agentConf.retryInterval <= 0 {
+		return agentConfig{}, errors.New("-retry-interval must be positive")
+	}
+	return agentConf, nil
+}
+
+// getNextRenewalTime returns when the certificates written under homeDir
+// are due for renewal: renewBefore ahead of whichever expires first.
+func getNextRenewalTime(homeDir string, renewBefore time.Duration) (
+	time.Time, error) {
+	sshCert, err := ioutil.ReadFile(filepath.Join(homeDir,
+		DefaultSSHKeysLocation, FilePrefix+"-cert.pub"))
+	if err != nil {
+		return time.Time{}, err
+	}
+	x509Cert, err := ioutil.ReadFile(filepath.Join(homeDir,
+		DefaultTLSKeysLocation, FilePrefix+".cert"))
+	if err != nil {
+		return time.Time{}, err
+	}
+	expiresAt, _, err := util.GetRenewalTime(1, sshCert, x509Cert)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return expiresAt.Add(-renewBefore), nil
+}
+
+// canReauthenticate returns true if a credential is available which can be
+// read again without a prompt once the session has expired. The x509 cert
+// for -renewWithCert is found under homeDir.
+func canReauthenticate(homeDir string) bool {
+	return *passwordFile != "" || *oidcToken != "" || *oidcTokenFile != "" ||
+		(*renewWithCert && homeDir != "")
+}
+
+// getSessionCertGetter returns a certGetter which reuses the session
+// cookies stored in the cookie jar of the client by an earlier login to
+// server.
+func getSessionCertGetter(userName string, server string,
+	configContents config.AppConfigFile,
+	logger log.DebugLogger) certGetter {
+	return func(signer crypto.Signer, client *http.Client,
+		budget *retrybudget.Budget) ([]byte, []byte, []byte, error) {
+		if server == "" {
+			return nil, nil, nil, errors.New("no session to renew")
+		}
+		if err := budget.Acquire(); err != nil {
+			return nil, nil, nil, err
+		}
+		sshCert, x509Cert, kubernetesCert, err := twofa.GetCertsWithCookies(
+			signer, userName, server, nil, configContents.Base.AddGroups,
+			client, userAgentString, logger)
+		budget.Record(err)
+		return sshCert, x509Cert, kubernetesCert, err
+	}
+}
+
+// certObtainer obtains and installs certificates with getCerts using client
+// and returns the URL of the server which issued them.
+type certObtainer func(client *http.Client, getCerts certGetter) (
+	string, error)
+
+// runAgent obtains certificates and keeps renewing them until the process
+// is stopped.
+func runAgent(args []string, userName string, homeDir string,
+	configContents config.AppConfigFile, client *http.Client,
+	logger log.DebugLogger) error {
+	agentConf, err := parseAgentFlags(agentCommand, args,
+		configContents.Base)
+	if err != nil {
+		return err
+	}
+	return runRenewalLoop(agentConf, userName, homeDir, configContents,
+		client,
+		func(client *http.Client, getCerts certGetter) (string, error) {
+			return obtainCerts(userName, homeDir, configContents, client,
+				getCerts, logger)
+		},
+		func() (time.Time, error) {
+			return getNextRenewalTime(homeDir, agentConf.renewBefore)
+		},
+		logger)
+}
+
+// runRenewalLoop logs in with obtain and then renews the certificates with
+// obtain whenever nextRenewal says they are due. Renewals reuse the session
+// of the last login, which is only kept in memory, and fall back to logging
+// in again when a credential which needs no prompt was given. Without one an
+// error is returned once the session has expired. The x509 cert for
+// -renewWithCert is found under homeDir, which may be empty.
+func runRenewalLoop(agentConf agentConfig, userName string, homeDir string,
+	configContents config.AppConfigFile, client *http.Client,
+	obtain certObtainer, nextRenewal func() (time.Time, error),
+	logger log.DebugLogger) error {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return err
+	}
+	sessionClient := *client
+	sessionClient.Jar = jar
+	loginCertGetter := getLoginCertGetter(userName, homeDir, configContents,
+		logger)
+	server, err := obtain(&sessionClient, loginCertGetter)
+	if err != nil {
+		return err
+	}
+	for {
+		renewAt, err := nextRenewal()
+		if err != nil {
+			logger.Printf("cannot read certificates, renewing now: %s", err)
+		} else {
+			logger.Debugf(0, "Next renewal at %s",
+				renewAt.Format(time.RFC3339))
+			time.Sleep(time.Until(renewAt))
+		}
+		for {
+			newServer, err := obtain(&sessionClient,
+				getSessionCertGetter(userName, server, configContents, logger))
+			var deniedError *twofa.DeniedError
+			if errors.As(err, &deniedError) && canReauthenticate(homeDir) {
+				logger.Printf("session expired, logging in again")
+				newServer, err = obtain(&sessionClient, loginCertGetter)
+			}
+			if err == nil {
+				server = newServer
+				break
+			}
+			if errors.As(err, &deniedError) && !canReauthenticate(homeDir) {
+				return fmt.Errorf("session expired and no credential to log in again: %w",
+					err)
+			}
+			logger.Printf("renewal failed, retrying in %s: %s",
+				agentConf.retryInterval, err)
+			time.Sleep(agentConf.retryInterval)
+		}
+	}
+}
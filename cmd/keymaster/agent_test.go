@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log/testlogger"
+	"github.com/Cloud-Foundations/keymaster/lib/client/config"
+	"github.com/Cloud-Foundations/keymaster/lib/client/retrybudget"
+	"github.com/Cloud-Foundations/keymaster/lib/client/twofa"
+	"github.com/Cloud-Foundations/keymaster/lib/client/util"
+)
+
+func TestParseAgentFlags(t *testing.T) {
+	agentConf, err := parseAgentFlags(agentCommand,
+		[]string{"--renew-before=2h"}, config.BaseConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agentConf.renewBefore != 2*time.Hour ||
+		agentConf.retryInterval != 5*time.Minute {
+		t.Fatalf("unexpected agent config: %+v", agentConf)
+	}
+	agentConf, err = parseAgentFlags(agentCommand, nil,
+		config.BaseConfig{AgentRenewBefore: time.Hour,
+			AgentRetryInterval: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agentConf.renewBefore != time.Hour ||
+		agentConf.retryInterval != time.Minute {
+		t.Fatalf("unexpected agent config: %+v", agentConf)
+	}
+	for _, args := range [][]string{
+		{"-renew-before=0"},
+		{"-renew-before=" + (*twofa.Duration).String()},
+		{"-retry-interval=-1s"},
+		{"extra"},
+	} {
+		if _, err := parseAgentFlags(agentCommand, args,
+			config.BaseConfig{}); err == nil {
+			t.Errorf("expected %v to be rejected", args)
+		}
+	}
+}
+
+func TestGetNextRenewalTime(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "keymaster-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if _, err := getNextRenewalTime(tmpDir, time.Hour); err == nil {
+		t.Fatal("expected error without certificates")
+	}
+	sshCert := genTestSSHCert(t, 1, 8*time.Hour)
+	for _, file := range []struct {
+		location string
+		suffix   string
+		data     []byte
+	}{
+		{DefaultSSHKeysLocation, "-cert.pub", sshCert},
+		{DefaultTLSKeysLocation, ".cert", []byte(rootCAPem)},
+	} {
+		dirPath := filepath.Join(tmpDir, file.location)
+		if err := os.MkdirAll(dirPath, 0700); err != nil {
+			t.Fatal(err)
+		}
+		err := ioutil.WriteFile(filepath.Join(dirPath, FilePrefix+file.suffix),
+			file.data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	renewAt, err := getNextRenewalTime(tmpDir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The SSH cert expires first.
+	expected := time.Now().Add(7 * time.Hour)
+	if renewAt.Before(expected.Add(-time.Minute)) ||
+		renewAt.After(expected.Add(time.Minute)) {
+		t.Fatalf("renewal at %s, expected about %s", renewAt, expected)
+	}
+}
+
+func TestSessionCertGetter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if _, err := r.Cookie("auth"); err != nil {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte("cert"))
+		}))
+	defer server.Close()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := server.Client()
+	client.Jar = jar
+	signer, err := util.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := testlogger.New(t)
+	getCerts := getSessionCertGetter("username", server.URL,
+		config.AppConfigFile{}, logger)
+	_, _, _, err = getCerts(signer, client, retrybudget.New(0, 0))
+	var deniedError *twofa.DeniedError
+	if !errors.As(err, &deniedError) {
+		t.Fatalf("expected *twofa.DeniedError without a session, got %v", err)
+	}
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jar.SetCookies(serverURL, []*http.Cookie{{Name: "auth", Value: "value"}})
+	sshCert, x509Cert, _, err := getCerts(signer, client,
+		retrybudget.New(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(sshCert) != "cert" || string(x509Cert) != "cert" {
+		t.Fatalf("unexpected certs: %q %q", sshCert, x509Cert)
+	}
+	_, _, _, err = getSessionCertGetter("username", "",
+		config.AppConfigFile{}, logger)(signer, client, retrybudget.New(0, 0))
+	if err == nil {
+		t.Fatal("expected error without a server")
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/client/rolesanywhere"
+	"github.com/Cloud-Foundations/keymaster/lib/client/util"
+)
+
+const awsCredentialsCommand = "aws-credentials"
+
+// credentialProcessOutput is the JSON the AWS SDKs read from the
+// credential_process program.
+type credentialProcessOutput struct {
+	Version         int    `json:"Version"`
+	AccessKeyId     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	SessionToken    string `json:"SessionToken"`
+	Expiration      string `json:"Expiration"`
+}
+
+// parseAWSCredentialsFlags parses the flags of the aws-credentials command.
+func parseAWSCredentialsFlags(args []string) (
+	rolesanywhere.SessionRequest, error) {
+	var request rolesanywhere.SessionRequest
+	flagSet := flag.NewFlagSet(awsCredentialsCommand, flag.ContinueOnError)
+	flagSet.StringVar(&request.ProfileArn, "profile-arn", "",
+		"ARN of the IAM Roles Anywhere profile")
+	flagSet.StringVar(&request.RoleArn, "role-arn", "",
+		"ARN of the IAM role to assume")
+	flagSet.StringVar(&request.TrustAnchorArn, "trust-anchor-arn", "",
+		"ARN of the IAM Roles Anywhere trust anchor of the Keymaster CA")
+	flagSet.StringVar(&request.Region, "region", "",
+		"AWS region (default: the region of the trust anchor)")
+	flagSet.DurationVar(&request.Duration, "session-duration", time.Hour,
+		"Lifetime of the AWS credentials")
+	flagSet.StringVar(&request.Endpoint, "endpoint", "",
+		"URL of the IAM Roles Anywhere endpoint (default: that of the region)")
+	if err := flagSet.Parse(args); err != nil {
+		return rolesanywhere.SessionRequest{}, err
+	}
+	if flagSet.NArg() > 0 {
+		return rolesanywhere.SessionRequest{}, fmt.Errorf(
+			"unexpected arguments: %v", flagSet.Args())
+	}
+	if request.ProfileArn == "" || request.RoleArn == "" ||
+		request.TrustAnchorArn == "" {
+		return rolesanywhere.SessionRequest{}, errors.New(
+			"-profile-arn, -role-arn and -trust-anchor-arn are needed")
+	}
+	return request, nil
+}
+
+// loadX509Certificate returns the x509 cert written under homeDir and its
+// key, failing if the cert has expired.
+func loadX509Certificate(homeDir string, now time.Time) (
+	[][]byte, crypto.Signer, error) {
+	tlsKeyPath := filepath.Join(homeDir, DefaultTLSKeysLocation, FilePrefix)
+	cert, err := tls.LoadX509KeyPair(tlsKeyPath+".cert", tlsKeyPath+".key")
+	if err != nil {
+		return nil, nil, err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	if now.After(leaf.NotAfter) {
+		return nil, nil, fmt.Errorf(
+			"x509 certificate expired at %s, run keymaster to renew it",
+			leaf.NotAfter.Format(time.RFC3339))
+	}
+	signer, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, nil, errors.New("private key cannot sign")
+	}
+	return cert.Certificate, signer, nil
+}
+
+// runAWSCredentials exchanges the x509 cert written earlier for AWS
+// credentials with IAM Roles Anywhere and prints them for credential_process.
+// It never prompts, since the AWS SDKs run it in the background.
+func runAWSCredentials(args []string, homeDir string, output io.Writer) error {
+	request, err := parseAWSCredentialsFlags(args)
+	if err != nil {
+		return err
+	}
+	certs, signer, err := loadX509Certificate(homeDir, time.Now())
+	if err != nil {
+		return err
+	}
+	client, err := util.GetHttpClient(
+		&tls.Config{MinVersion: tls.VersionTLS12},
+		&net.Dialer{Timeout: 10 * time.Second})
+	if err != nil {
+		return err
+	}
+	credentials, err := rolesanywhere.CreateSession(client, certs, signer,
+		request)
+	if err != nil {
+		return err
+	}
+	return writeCredentialProcessOutput(output, credentials)
+}
+
+func writeCredentialProcessOutput(output io.Writer,
+	credentials *rolesanywhere.Credentials) error {
+	encoder := json.NewEncoder(output)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(credentialProcessOutput{
+		Version:         1,
+		AccessKeyId:     credentials.AccessKeyId,
+		SecretAccessKey: credentials.SecretAccessKey,
+		SessionToken:    credentials.SessionToken,
+		Expiration:      credentials.Expiration.UTC().Format(time.RFC3339),
+	})
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/client/rolesanywhere"
+)
+
+func TestParseAWSCredentialsFlags(t *testing.T) {
+	if _, err := parseAWSCredentialsFlags(
+		[]string{"-role-arn=arn:aws:iam::1:role/r"}); err == nil {
+		t.Fatal("missing ARNs should fail")
+	}
+	request, err := parseAWSCredentialsFlags([]string{
+		"-profile-arn=p", "-role-arn=r", "-trust-anchor-arn=t",
+		"-session-duration=30m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.Duration != 30*time.Minute || request.TrustAnchorArn != "t" {
+		t.Fatalf("unexpected request %+v", request)
+	}
+}
+
+func TestLoadX509Certificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "awscredentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notAfter := time.Now().Add(time.Hour)
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "username"},
+		NotBefore:    time.Now(),
+		NotAfter:     notAfter,
+	}
+	derCert, err := x509.CreateCertificate(rand.Reader, &template, &template,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	derKey, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsKeyPath := filepath.Join(dir, DefaultTLSKeysLocation, FilePrefix)
+	if err := os.MkdirAll(filepath.Dir(tlsKeyPath), 0700); err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(tlsKeyPath+".cert", pem.EncodeToMemory(
+		&pem.Block{Type: "CERTIFICATE", Bytes: derCert}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(tlsKeyPath+".key", pem.EncodeToMemory(
+		&pem.Block{Type: "EC PRIVATE KEY", Bytes: derKey}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, signer, err := loadX509Certificate(dir, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 1 || !bytes.Equal(certs[0], derCert) || signer == nil {
+		t.Fatal("unexpected certificate")
+	}
+	_, _, err = loadX509Certificate(dir, notAfter.Add(time.Minute))
+	if err == nil {
+		t.Fatal("expired certificate should fail")
+	}
+}
+
+func TestWriteCredentialProcessOutput(t *testing.T) {
+	var buffer bytes.Buffer
+	err := writeCredentialProcessOutput(&buffer, &rolesanywhere.Credentials{
+		AccessKeyId:     "AKID",
+		SecretAccessKey: "secret",
+		SessionToken:    "token",
+		Expiration:      time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output map[string]interface{}
+	if err := json.Unmarshal(buffer.Bytes(), &output); err != nil {
+		t.Fatal(err)
+	}
+	if output["Version"] != float64(1) || output["AccessKeyId"] != "AKID" ||
+		output["Expiration"] != "2030-01-02T03:04:05Z" {
+		t.Fatalf("unexpected output %v", output)
+	}
+}
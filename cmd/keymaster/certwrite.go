@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	atomicNewSuffix = ".keymaster-new"
+	atomicOldSuffix = ".keymaster-old"
+)
+
+// renameFile is replaced in tests to inject failures.
+var renameFile = os.Rename
+
+// atomicFile describes one file of an atomic write. If symlinkTarget is set
+// a symlink is created instead, falling back to writing data where symlinks
+// are not supported.
+type atomicFile struct {
+	path          string
+	data          []byte
+	mode          os.FileMode
+	symlinkTarget string
+}
+
+// renamedFile records a completed rename so it can be undone.
+type renamedFile struct {
+	path      string
+	hadBackup bool
+}
+
+func writeTempFile(file atomicFile) error {
+	tempPath := file.path + atomicNewSuffix
+	os.Remove(tempPath)
+	if file.symlinkTarget != "" {
+		if err := os.Symlink(file.symlinkTarget, tempPath); err == nil {
+			return nil
+		}
+	}
+	return writeSyncedFile(tempPath, file.data, file.mode)
+}
+
+func writeSyncedFile(path string, data []byte, mode os.FileMode) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func syncDir(dirPath string) {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return
+	}
+	defer dir.Close()
+	dir.Sync()
+}
+
+// writeFilesAtomically writes all files as a single unit. All contents are
+// first written and synced to temporary files, then renamed into place. If
+// any step fails, files already renamed are restored so that the previous
+// complete set remains.
+func writeFilesAtomically(files []atomicFile) error {
+	for i, file := range files {
+		if err := writeTempFile(file); err != nil {
+			for _, written := range files[:i+1] {
+				os.Remove(written.path + atomicNewSuffix)
+			}
+			return fmt.Errorf("cannot write %s: %s", file.path, err)
+		}
+	}
+	var renamed []renamedFile
+	for _, file := range files {
+		hadBackup := false
+		if _, err := os.Lstat(file.path); err == nil {
+			err := renameFile(file.path, file.path+atomicOldSuffix)
+			if err != nil {
+				rollbackAtomicWrite(files, renamed)
+				return fmt.Errorf("cannot back up %s: %s", file.path, err)
+			}
+			hadBackup = true
+		}
+		if err := renameFile(file.path+atomicNewSuffix, file.path); err != nil {
+			if hadBackup {
+				os.Rename(file.path+atomicOldSuffix, file.path)
+			}
+			rollbackAtomicWrite(files, renamed)
+			return fmt.Errorf("cannot rename %s: %s", file.path, err)
+		}
+		renamed = append(renamed, renamedFile{path: file.path,
+			hadBackup: hadBackup})
+	}
+	dirs := make(map[string]struct{})
+	for _, file := range files {
+		os.Remove(file.path + atomicOldSuffix)
+		dirs[filepath.Dir(file.path)] = struct{}{}
+	}
+	for dirPath := range dirs {
+		syncDir(dirPath)
+	}
+	return nil
+}
+
+func rollbackAtomicWrite(files []atomicFile, renamed []renamedFile) {
+	for i := len(renamed) - 1; i >= 0; i-- {
+		if renamed[i].hadBackup {
+			os.Rename(renamed[i].path+atomicOldSuffix, renamed[i].path)
+		} else {
+			os.Remove(renamed[i].path)
+		}
+	}
+	for _, file := range files {
+		os.Remove(file.path + atomicNewSuffix)
+	}
+}
+
+// readAtomicFile loads the contents of path so it can be part of an atomic
+// write.
+func readAtomicFile(srcPath string, destPath string,
+	mode os.FileMode) (atomicFile, error) {
+	data, err := ioutil.ReadFile(srcPath)
+	if err != nil {
+		return atomicFile{}, err
+	}
+	return atomicFile{path: destPath, data: data, mode: mode}, nil
+}
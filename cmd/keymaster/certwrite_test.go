@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestFileSet(t *testing.T, dir string, content string) []atomicFile {
+	var files []atomicFile
+	for _, name := range []string{"key", "key-cert.pub", "key.cert"} {
+		files = append(files, atomicFile{
+			path: filepath.Join(dir, name),
+			data: []byte(content + name),
+			mode: 0600,
+		})
+	}
+	return files
+}
+
+func checkTestFileSet(t *testing.T, files []atomicFile, content string) {
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := content + filepath.Base(file.path)
+		if string(data) != expected {
+			t.Fatalf("%s: expected %q, got %q", file.path, expected, data)
+		}
+		if _, err := os.Lstat(file.path + atomicNewSuffix); err == nil {
+			t.Fatalf("temporary file left for %s", file.path)
+		}
+		if _, err := os.Lstat(file.path + atomicOldSuffix); err == nil {
+			t.Fatalf("backup file left for %s", file.path)
+		}
+	}
+}
+
+func TestWriteFilesAtomically(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "keymaster-atomic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	files := writeTestFileSet(t, tmpDir, "old-")
+	if err := writeFilesAtomically(files); err != nil {
+		t.Fatal(err)
+	}
+	checkTestFileSet(t, files, "old-")
+	files = writeTestFileSet(t, tmpDir, "new-")
+	if err := writeFilesAtomically(files); err != nil {
+		t.Fatal(err)
+	}
+	checkTestFileSet(t, files, "new-")
+}
+
+func TestWriteFilesAtomicallyRollsBackOnRenameFailure(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "keymaster-atomic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	oldFiles := writeTestFileSet(t, tmpDir, "old-")
+	if err := writeFilesAtomically(oldFiles); err != nil {
+		t.Fatal(err)
+	}
+	newFiles := writeTestFileSet(t, tmpDir, "new-")
+	// Also include a file that did not exist before.
+	newFiles = append(newFiles, atomicFile{
+		path: filepath.Join(tmpDir, "key-kubernetes.cert"),
+		data: []byte("new-key-kubernetes.cert"),
+		mode: 0600,
+	})
+	lastPath := newFiles[len(newFiles)-1].path
+	defer func() { renameFile = os.Rename }()
+	renameFile = func(oldpath, newpath string) error {
+		if newpath == lastPath {
+			return errors.New("injected failure")
+		}
+		return os.Rename(oldpath, newpath)
+	}
+	if err := writeFilesAtomically(newFiles); err == nil {
+		t.Fatal("expected failure")
+	}
+	checkTestFileSet(t, oldFiles, "old-")
+	if _, err := os.Lstat(lastPath); err == nil {
+		t.Fatal("file from failed write should not exist")
+	}
+	if _, err := os.Lstat(lastPath + atomicNewSuffix); err == nil {
+		t.Fatal("temporary file left behind")
+	}
+}
+
+func TestWriteFilesAtomicallySymlink(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "keymaster-atomic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	keyPath := filepath.Join(tmpDir, "key")
+	linkPath := filepath.Join(tmpDir, "key.key")
+	files := []atomicFile{
+		{path: keyPath, data: []byte("key"), mode: 0600},
+		{path: linkPath, data: []byte("key"), mode: 0600,
+			symlinkTarget: keyPath},
+	}
+	if err := writeFilesAtomically(files); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(linkPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "key" {
+		t.Fatalf("unexpected content %q", data)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"github.com/Cloud-Foundations/keymaster/lib/devicekey"
+	"github.com/Cloud-Foundations/keymaster/lib/pkcs11signer"
+)
+
+const deviceKeyPINEnvVariable = "KEYMASTER_DEVICE_KEY_PIN"
+
+var (
+	deviceKeyFilename = flag.String("deviceKey", "",
+		"File with the key identifying this device to servers with device trust, created if needed (default: device_key.pem next to the config file)")
+	noDeviceKey = flag.Bool("noDeviceKey", false,
+		"If true, do not identify this device to the servers")
+	deviceKeyPKCS11Module = flag.String("deviceKeyPKCS11Module", "",
+		"PKCS#11 module holding the device key instead of the -deviceKey file, such as the tpm2-pkcs11 module for a TPM (PIN in $"+
+			deviceKeyPINEnvVariable+")")
+	deviceKeyPKCS11Token = flag.String("deviceKeyPKCS11Token", "",
+		"Label of the PKCS#11 token holding the device key")
+	deviceKeyPKCS11Key = flag.String("deviceKeyPKCS11Key", "",
+		"Label of the device key in the PKCS#11 token")
+)
+
+// loadDeviceKey returns the device key selected by the flags, or nil if
+// -noDeviceKey is set.
+func loadDeviceKey(logger log.DebugLogger) (*devicekey.Key, error) {
+	if *noDeviceKey {
+		return nil, nil
+	}
+	if *deviceKeyPKCS11Module != "" {
+		signer, err := pkcs11signer.New(pkcs11signer.Config{
+			ModulePath: *deviceKeyPKCS11Module,
+			TokenLabel: *deviceKeyPKCS11Token,
+			PIN:        os.Getenv(deviceKeyPINEnvVariable),
+			KeyLabel:   *deviceKeyPKCS11Key,
+		}, logger)
+		if err != nil {
+			return nil, err
+		}
+		return devicekey.New(signer)
+	}
+	filename := *deviceKeyFilename
+	if filename == "" {
+		filename = filepath.Join(filepath.Dir(*configFilename),
+			"device_key.pem")
+	}
+	return devicekey.LoadOrCreate(filename)
+}
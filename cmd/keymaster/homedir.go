@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+)
+
+// getDefaultHomeFallbackDir returns the fallback directory of userName. It
+// is in the shared temporary directory, where others may create it first,
+// so it must be checked with makePrivateDir.
+func getDefaultHomeFallbackDir(userName string) string {
+	return filepath.Join(os.TempDir(), "keymaster-"+userName)
+}
+
+// makePrivateDir creates dirPath if it does not exist and verifies that it
+// is a directory, not a symbolic link, which is owned by and only accessible
+// to the current user.
+func makePrivateDir(dirPath string) error {
+	if err := os.Mkdir(dirPath, 0700); err != nil && !os.IsExist(err) {
+		return err
+	}
+	fi, err := os.Lstat(dirPath)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dirPath)
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("%s is accessible by other users", dirPath)
+	}
+	return checkDirOwner(dirPath, fi)
+}
+
+// checkHomeDirWritable verifies that the key directories under homeDir can
+// be created and written to.
+func checkHomeDirWritable(homeDir string) error {
+	for _, location := range []string{DefaultSSHKeysLocation,
+		DefaultTLSKeysLocation} {
+		dirPath := filepath.Join(homeDir, location)
+		if err := os.MkdirAll(dirPath, 0700); err != nil {
+			return err
+		}
+		file, err := ioutil.TempFile(dirPath, ".keymaster-probe")
+		if err != nil {
+			return err
+		}
+		file.Close()
+		os.Remove(file.Name())
+	}
+	return nil
+}
+
+// resolveOutputDir returns the directory under which certificates should
+// be written. If homeDir is not usable and fallback is enabled, a local
+// directory keyed by userName is used instead. The returned boolean is true
+// when the fallback directory was selected.
+func resolveOutputDir(homeDir string, userName string, fallback bool,
+	fallbackDir string, logger log.DebugLogger) (string, bool, error) {
+	err := checkHomeDirWritable(homeDir)
+	if err == nil {
+		return homeDir, false, nil
+	}
+	if !fallback {
+		return "", false, err
+	}
+	makeDir := func(dirPath string) error {
+		return os.MkdirAll(dirPath, 0700)
+	}
+	if fallbackDir == "" {
+		fallbackDir = getDefaultHomeFallbackDir(userName)
+		makeDir = makePrivateDir
+	}
+	logger.Printf("home directory %s is unavailable (%s), using %s",
+		homeDir, err, fallbackDir)
+	if err := makeDir(fallbackDir); err != nil {
+		return "", false, err
+	}
+	if err := checkHomeDirWritable(fallbackDir); err != nil {
+		return "", false,
+			fmt.Errorf("fallback directory %s not usable: %s", fallbackDir, err)
+	}
+	return fallbackDir, true, nil
+}
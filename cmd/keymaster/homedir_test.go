@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log/testlogger"
+)
+
+// setupUnwritableHome returns a home path that cannot hold the key
+// directories. A regular file is used so this also holds when running as
+// root.
+func setupUnwritableHome(t *testing.T, parentDir string) string {
+	homePath := filepath.Join(parentDir, "home")
+	if err := ioutil.WriteFile(homePath, []byte("not a dir"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return homePath
+}
+
+func TestResolveOutputDirWritableHome(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "keymaster-home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	outputDir, usedFallback, err := resolveOutputDir(tmpDir, "username",
+		true, filepath.Join(tmpDir, "fallback"), testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usedFallback || outputDir != tmpDir {
+		t.Fatalf("unexpected fallback to %s", outputDir)
+	}
+}
+
+func TestResolveOutputDirUnwritableHomeFallback(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "keymaster-home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	homeDir := setupUnwritableHome(t, tmpDir)
+	fallbackDir := filepath.Join(tmpDir, "fallback")
+	outputDir, usedFallback, err := resolveOutputDir(homeDir, "username",
+		true, fallbackDir, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !usedFallback {
+		t.Fatal("fallback not reported")
+	}
+	if outputDir != fallbackDir {
+		t.Fatalf("expected %s, got %s", fallbackDir, outputDir)
+	}
+	if _, err := os.Stat(filepath.Join(fallbackDir,
+		DefaultSSHKeysLocation)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResolveOutputDirUnwritableHomeNoFallback(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "keymaster-home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	homeDir := setupUnwritableHome(t, tmpDir)
+	_, _, err = resolveOutputDir(homeDir, "username", false, "",
+		testlogger.New(t))
+	if err == nil {
+		t.Fatal("should have failed without fallback")
+	}
+}
+
+func TestMakePrivateDir(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "keymaster-home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	privateDir := filepath.Join(tmpDir, "private")
+	if err := makePrivateDir(privateDir); err != nil {
+		t.Fatal(err)
+	}
+	// An existing private directory is reused.
+	if err := makePrivateDir(privateDir); err != nil {
+		t.Fatal(err)
+	}
+	sharedDir := filepath.Join(tmpDir, "shared")
+	if err := os.Mkdir(sharedDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(sharedDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := makePrivateDir(sharedDir); err == nil {
+		t.Fatal("directory accessible by others accepted")
+	}
+	link := filepath.Join(tmpDir, "link")
+	if err := os.Symlink(privateDir, link); err != nil {
+		t.Fatal(err)
+	}
+	if err := makePrivateDir(link); err == nil {
+		t.Fatal("symbolic link accepted")
+	}
+	if err := makePrivateDir(setupUnwritableHome(t, tmpDir)); err == nil {
+		t.Fatal("file accepted")
+	}
+}
@@ -0,0 +1,11 @@
+package main
+
+import (
+	"os"
+)
+
+// checkDirOwner does nothing: on Windows the temporary directory is in the
+// profile of the user.
+func checkDirOwner(dirPath string, fi os.FileInfo) error {
+	return nil
+}
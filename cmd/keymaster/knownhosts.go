@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"github.com/Cloud-Foundations/keymaster/lib/client/config"
+	"github.com/Cloud-Foundations/keymaster/lib/client/knownhosts"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	knownHostsCommand       = "known-hosts"
+	defaultSystemKnownHosts = "/etc/ssh/ssh_known_hosts"
+	maxPublicDataSize       = 64 << 10
+)
+
+type knownHostsOptions struct {
+	path        string
+	hostPattern string
+	system      bool
+	systemPath  string
+}
+
+// parseKnownHostsFlags parses the flags of the known-hosts command.
+func parseKnownHostsFlags(args []string, homeDir string) (
+	knownHostsOptions, error) {
+	var options knownHostsOptions
+	flagSet := flag.NewFlagSet(knownHostsCommand, flag.ContinueOnError)
+	flagSet.StringVar(&options.path, "known-hosts",
+		filepath.Join(homeDir, ".ssh", "known_hosts"),
+		"Path of the known_hosts file to update")
+	flagSet.StringVar(&options.hostPattern, "host-pattern", "*",
+		"Comma separated patterns of the hosts whose certificates to trust")
+	flagSet.BoolVar(&options.system, "system", false,
+		"Also update the system wide known_hosts file (with sudo)")
+	flagSet.StringVar(&options.systemPath, "system-known-hosts",
+		defaultSystemKnownHosts, "Path of the system wide known_hosts file")
+	if err := flagSet.Parse(args); err != nil {
+		return knownHostsOptions{}, err
+	}
+	if flagSet.NArg() > 0 {
+		return knownHostsOptions{}, fmt.Errorf("unexpected arguments: %v",
+			flagSet.Args())
+	}
+	if options.hostPattern == "" || strings.ContainsAny(options.hostPattern,
+		" \t") {
+		return knownHostsOptions{}, errors.New(
+			"-host-pattern must be a non-empty list without spaces")
+	}
+	return options, nil
+}
+
+// runKnownHosts fetches the public key of the SSH CA and trusts it for host
+// certificates in the known_hosts files. The line is marked with the
+// hostname of the first configured server, so running the command again
+// replaces it.
+func runKnownHosts(args []string, homeDir string,
+	configContents config.AppConfigFile, client *http.Client,
+	logger log.DebugLogger) error {
+	options, err := parseKnownHostsFlags(args, homeDir)
+	if err != nil {
+		return err
+	}
+	targetURLs := strings.Split(configContents.Base.Gen_Cert_URLS, ",")
+	firstURL, err := url.Parse(targetURLs[0])
+	if err != nil {
+		return err
+	}
+	caKey, err := getSSHCAPublicKey(targetURLs, client, logger)
+	if err != nil {
+		return err
+	}
+	line := knownhosts.CertAuthorityLine(options.hostPattern, caKey,
+		"keymaster:"+firstURL.Hostname())
+	changed, err := knownhosts.UpsertFile(options.path, line)
+	if err != nil {
+		return err
+	}
+	logKnownHostsUpdate(options.path, changed, logger)
+	if !options.system {
+		return nil
+	}
+	changed, err = upsertSystemKnownHosts(options.systemPath, line, logger)
+	if err != nil {
+		return err
+	}
+	logKnownHostsUpdate(options.systemPath, changed, logger)
+	return nil
+}
+
+// getSSHCAPublicKey returns the SSH CA public key served by the first of
+// targetURLs which answers.
+func getSSHCAPublicKey(targetURLs []string, client *http.Client,
+	logger log.DebugLogger) (ssh.PublicKey, error) {
+	body, err := getPublicData(targetURLs, proto.SSHCAPath, client, logger)
+	if err != nil {
+		return nil, err
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(body)
+	return key, err
+}
+
+// getPublicData returns the body of a GET of path from the first of
+// targetURLs which answers.
+func getPublicData(targetURLs []string, path string, client *http.Client,
+	logger log.DebugLogger) ([]byte, error) {
+	var lastErr error
+	for _, baseURL := range targetURLs {
+		body, err := fetchPublicData(strings.TrimSuffix(baseURL, "/")+path,
+			client)
+		if err == nil {
+			return body, nil
+		}
+		logger.Debugf(1, "cannot get %s from %s: %s", path, baseURL, err)
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func fetchPublicData(target string, client *http.Client) ([]byte, error) {
+	resp, err := client.Get(target)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", target, resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, maxPublicDataSize))
+}
+
+// upsertSystemKnownHosts updates the system wide known_hosts file. Unless
+// running as root, the new file is installed with sudo, which may prompt
+// for a password.
+func upsertSystemKnownHosts(path string, line string,
+	logger log.DebugLogger) (bool, error) {
+	if os.Geteuid() == 0 {
+		return knownhosts.UpsertFile(path, line)
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	newContents, changed := knownhosts.Upsert(contents, line)
+	if !changed {
+		return false, nil
+	}
+	file, err := ioutil.TempFile("", "keymaster-known-hosts")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(newContents); err != nil {
+		file.Close()
+		return false, err
+	}
+	if err := file.Close(); err != nil {
+		return false, err
+	}
+	logger.Debugf(0, "Running sudo to update %s", path)
+	cmd := exec.Command("sudo", "install", "-m", "0644", file.Name(), path)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return false, fmt.Errorf("cannot install %s: %s", path, err)
+	}
+	return true, nil
+}
+
+func logKnownHostsUpdate(path string, changed bool, logger log.DebugLogger) {
+	if changed {
+		logger.Printf("Updated the keymaster SSH CA in %s", path)
+	} else {
+		logger.Debugf(0, "The keymaster SSH CA in %s is current", path)
+	}
+}
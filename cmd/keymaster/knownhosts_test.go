@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log/testlogger"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseKnownHostsFlags(t *testing.T) {
+	options, err := parseKnownHostsFlags(nil, "/home/user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.path != "/home/user/.ssh/known_hosts" ||
+		options.hostPattern != "*" || options.system ||
+		options.systemPath != defaultSystemKnownHosts {
+		t.Fatalf("unexpected options: %+v", options)
+	}
+	options, err = parseKnownHostsFlags([]string{
+		"-host-pattern=*.example.com,*.example.org", "-system"},
+		"/home/user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.hostPattern != "*.example.com,*.example.org" ||
+		!options.system {
+		t.Fatalf("unexpected options: %+v", options)
+	}
+	for _, args := range [][]string{
+		{"-host-pattern="},
+		{"-host-pattern=a b"},
+		{"extra"},
+	} {
+		if _, err := parseKnownHostsFlags(args, "/home/user"); err == nil {
+			t.Fatalf("%v should be invalid", args)
+		}
+	}
+}
+
+func TestGetSSHCAPublicKey(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caKey, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != proto.SSHCAPath {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(ssh.MarshalAuthorizedKey(caKey))
+		}))
+	defer server.Close()
+	logger := testlogger.New(t)
+	key, err := getSSHCAPublicKey([]string{server.URL + "/bad",
+		server.URL + "/"}, server.Client(), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(key.Marshal()) != string(caKey.Marshal()) {
+		t.Fatal("unexpected CA public key")
+	}
+	if _, err := getSSHCAPublicKey([]string{server.URL + "/bad"},
+		server.Client(), logger); err == nil {
+		t.Fatal("no CA public key expected")
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"github.com/Cloud-Foundations/keymaster/lib/client/config"
+	"github.com/Cloud-Foundations/keymaster/lib/client/retrybudget"
+	"gopkg.in/yaml.v2"
+)
+
+const kubeconfigCommand = "kubeconfig"
+
+type kubeconfigOptions struct {
+	path                 string
+	user                 string
+	cluster              string
+	context              string
+	server               string
+	certificateAuthority string
+}
+
+// getDefaultKubeconfigPath returns the first file in $KUBECONFIG, or else
+// ~/.kube/config, as kubectl does.
+func getDefaultKubeconfigPath(homeDir string) string {
+	for _, path := range filepath.SplitList(os.Getenv("KUBECONFIG")) {
+		if path != "" {
+			return path
+		}
+	}
+	return filepath.Join(homeDir, ".kube", "config")
+}
+
+// parseKubeconfigFlags parses the flags of the kubeconfig command.
+func parseKubeconfigFlags(args []string, homeDir string) (
+	kubeconfigOptions, error) {
+	var options kubeconfigOptions
+	flagSet := flag.NewFlagSet(kubeconfigCommand, flag.ContinueOnError)
+	flagSet.StringVar(&options.path, "kubeconfig",
+		getDefaultKubeconfigPath(homeDir), "Path of the kubeconfig to update")
+	flagSet.StringVar(&options.user, "user", "keymaster",
+		"Name of the user entry to write")
+	flagSet.StringVar(&options.cluster, "cluster", "",
+		"If set, also write a cluster entry of this name and a context for it")
+	flagSet.StringVar(&options.context, "context", "",
+		"Name of the context entry (default: the cluster name)")
+	flagSet.StringVar(&options.server, "server", "",
+		"URL of the API server of the cluster")
+	flagSet.StringVar(&options.certificateAuthority, "certificate-authority",
+		"", "Path of the CA certificate of the API server of the cluster")
+	if err := flagSet.Parse(args); err != nil {
+		return kubeconfigOptions{}, err
+	}
+	if flagSet.NArg() > 0 {
+		return kubeconfigOptions{}, fmt.Errorf("unexpected arguments: %v",
+			flagSet.Args())
+	}
+	if options.user == "" {
+		return kubeconfigOptions{}, errors.New("-user must not be empty")
+	}
+	if options.cluster == "" {
+		if options.context != "" || options.server != "" ||
+			options.certificateAuthority != "" {
+			return kubeconfigOptions{}, errors.New(
+				"-context, -server and -certificate-authority need -cluster")
+		}
+	} else if options.context == "" {
+		options.context = options.cluster
+	}
+	if options.certificateAuthority != "" {
+		path, err := filepath.Abs(options.certificateAuthority)
+		if err != nil {
+			return kubeconfigOptions{}, err
+		}
+		options.certificateAuthority = path
+	}
+	return options, nil
+}
+
+// runKubeconfig obtains certificates and points the user entry of the
+// kubeconfig at the kubernetes cert and its key. Renewals by the agent
+// command replace those files, so the entry stays valid.
+func runKubeconfig(args []string, userName string, homeDir string,
+	configContents config.AppConfigFile, client *http.Client,
+	logger log.DebugLogger) error {
+	options, err := parseKubeconfigFlags(args, homeDir)
+	if err != nil {
+		return err
+	}
+	getCerts := getLoginCertGetter(userName, homeDir, configContents,
+		logger)
+	var kubernetesCert []byte
+	_, err = obtainCerts(userName, homeDir, configContents, client,
+		func(signer crypto.Signer, client *http.Client,
+			budget *retrybudget.Budget) ([]byte, []byte, []byte, error) {
+			sshCert, x509Cert, kubeCert, err := getCerts(signer, client,
+				budget)
+			kubernetesCert = kubeCert
+			return sshCert, x509Cert, kubeCert, err
+		},
+		logger)
+	if err != nil {
+		return err
+	}
+	if kubernetesCert == nil {
+		return errors.New("the server issued no kubernetes certificate")
+	}
+	tlsKeyPath := filepath.Join(homeDir, DefaultTLSKeysLocation, FilePrefix)
+	err = updateKubeconfig(options, tlsKeyPath+"-kubernetes.cert",
+		tlsKeyPath+".key")
+	if err != nil {
+		return err
+	}
+	logger.Debugf(0, "Updated user %s in %s", options.user, options.path)
+	return nil
+}
+
+// getMapSliceValue returns the value of key in mapSlice.
+func getMapSliceValue(mapSlice yaml.MapSlice, key string) (
+	interface{}, bool) {
+	for _, item := range mapSlice {
+		if item.Key == key {
+			return item.Value, true
+		}
+	}
+	return nil, false
+}
+
+// updateMapSlice sets the keys of values in mapSlice, keeping their
+// position if present, and removes the keys in remove.
+func updateMapSlice(mapSlice yaml.MapSlice, values yaml.MapSlice,
+	remove ...string) yaml.MapSlice {
+	var updated yaml.MapSlice
+	for _, item := range mapSlice {
+		if value, ok := getMapSliceValue(values, fmt.Sprint(item.Key)); ok {
+			item.Value = value
+		} else {
+			removed := false
+			for _, key := range remove {
+				if item.Key == key {
+					removed = true
+				}
+			}
+			if removed {
+				continue
+			}
+		}
+		updated = append(updated, item)
+	}
+	for _, item := range values {
+		if _, ok := getMapSliceValue(updated, fmt.Sprint(item.Key)); !ok {
+			updated = append(updated, item)
+		}
+	}
+	return updated
+}
+
+// updateNamedEntry updates the fields of entryKey in the entry named name of
+// the list listKey in kubeconfig, as updateMapSlice does, adding the entry
+// if it is missing.
+func updateNamedEntry(kubeconfig yaml.MapSlice, listKey string, name string,
+	entryKey string, fields yaml.MapSlice,
+	remove ...string) (yaml.MapSlice, error) {
+	value, _ := getMapSliceValue(kubeconfig, listKey)
+	list, ok := value.([]interface{})
+	if value != nil && !ok {
+		return nil, fmt.Errorf("%s is not a list", listKey)
+	}
+	for i, item := range list {
+		entry, ok := item.(yaml.MapSlice)
+		if !ok {
+			return nil, fmt.Errorf("entry of %s is not a mapping", listKey)
+		}
+		if entryName, _ := getMapSliceValue(entry, "name"); entryName != name {
+			continue
+		}
+		value, _ := getMapSliceValue(entry, entryKey)
+		oldFields, ok := value.(yaml.MapSlice)
+		if value != nil && !ok {
+			return nil, fmt.Errorf("%s of %s %s is not a mapping", entryKey,
+				listKey, name)
+		}
+		list[i] = updateMapSlice(entry, yaml.MapSlice{{Key: entryKey,
+			Value: updateMapSlice(oldFields, fields, remove...)}})
+		return kubeconfig, nil
+	}
+	list = append(list, yaml.MapSlice{
+		{Key: "name", Value: name},
+		{Key: entryKey, Value: fields},
+	})
+	return updateMapSlice(kubeconfig, yaml.MapSlice{{Key: listKey,
+		Value: list}}), nil
+}
+
+// updateKubeconfig writes the user entry, and the cluster and context
+// entries if a cluster is given, into the kubeconfig, keeping the other
+// entries.
+func updateKubeconfig(options kubeconfigOptions, certPath string,
+	keyPath string) error {
+	var kubeconfig yaml.MapSlice
+	data, err := ioutil.ReadFile(options.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := yaml.Unmarshal(data, &kubeconfig); err != nil {
+		return fmt.Errorf("cannot parse %s: %s", options.path, err)
+	}
+	kubeconfig = updateMapSlice(yaml.MapSlice{
+		{Key: "apiVersion", Value: "v1"},
+		{Key: "kind", Value: "Config"},
+	}, kubeconfig)
+	// Embedded data would take precedence over the files.
+	kubeconfig, err = updateNamedEntry(kubeconfig, "users", options.user,
+		"user", yaml.MapSlice{
+			{Key: "client-certificate", Value: certPath},
+			{Key: "client-key", Value: keyPath},
+		}, "client-certificate-data", "client-key-data")
+	if err != nil {
+		return err
+	}
+	if options.cluster != "" {
+		var clusterFields yaml.MapSlice
+		if options.server != "" {
+			clusterFields = append(clusterFields,
+				yaml.MapItem{Key: "server", Value: options.server})
+		}
+		var remove []string
+		if options.certificateAuthority != "" {
+			clusterFields = append(clusterFields, yaml.MapItem{
+				Key:   "certificate-authority",
+				Value: options.certificateAuthority,
+			})
+			remove = append(remove, "certificate-authority-data")
+		}
+		kubeconfig, err = updateNamedEntry(kubeconfig, "clusters",
+			options.cluster, "cluster", clusterFields, remove...)
+		if err != nil {
+			return err
+		}
+		kubeconfig, err = updateNamedEntry(kubeconfig, "contexts",
+			options.context, "context", yaml.MapSlice{
+				{Key: "cluster", Value: options.cluster},
+				{Key: "user", Value: options.user},
+			})
+		if err != nil {
+			return err
+		}
+	}
+	data, err = yaml.Marshal(kubeconfig)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(options.path), 0700); err != nil {
+		return err
+	}
+	return writeFilesAtomically([]atomicFile{
+		{path: options.path, data: data, mode: 0600},
+	})
+}
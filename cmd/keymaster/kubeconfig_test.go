@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+type testKubeconfig struct {
+	APIVersion     string `yaml:"apiVersion"`
+	CurrentContext string `yaml:"current-context"`
+	Users          []struct {
+		Name string            `yaml:"name"`
+		User map[string]string `yaml:"user"`
+	} `yaml:"users"`
+	Clusters []struct {
+		Name    string            `yaml:"name"`
+		Cluster map[string]string `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Contexts []struct {
+		Name    string            `yaml:"name"`
+		Context map[string]string `yaml:"context"`
+	} `yaml:"contexts"`
+}
+
+func readTestKubeconfig(t *testing.T, path string) testKubeconfig {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kubeconfig testKubeconfig
+	if err := yaml.Unmarshal(data, &kubeconfig); err != nil {
+		t.Fatal(err)
+	}
+	return kubeconfig
+}
+
+func TestParseKubeconfigFlags(t *testing.T) {
+	os.Setenv("KUBECONFIG", "")
+	options, err := parseKubeconfigFlags(nil, "/home/user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.path != "/home/user/.kube/config" || options.user != "keymaster" {
+		t.Fatalf("unexpected defaults %+v", options)
+	}
+	os.Setenv("KUBECONFIG", "/tmp/a"+string(filepath.ListSeparator)+"/tmp/b")
+	defer os.Unsetenv("KUBECONFIG")
+	options, err = parseKubeconfigFlags([]string{"-cluster=prod"}, "/home/user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.path != "/tmp/a" || options.context != "prod" {
+		t.Fatalf("unexpected options %+v", options)
+	}
+	if _, err := parseKubeconfigFlags([]string{"-server=https://k8s"},
+		"/home/user"); err == nil {
+		t.Fatal("-server without -cluster should fail")
+	}
+}
+
+func TestUpdateKubeconfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubeconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	options := kubeconfigOptions{
+		path:                 filepath.Join(dir, ".kube", "config"),
+		user:                 "keymaster",
+		cluster:              "prod",
+		context:              "prod",
+		server:               "https://k8s.example.com",
+		certificateAuthority: "/etc/k8s-ca.pem",
+	}
+	if err := updateKubeconfig(options, "/c.cert", "/c.key"); err != nil {
+		t.Fatal(err)
+	}
+	kubeconfig := readTestKubeconfig(t, options.path)
+	if kubeconfig.APIVersion != "v1" || len(kubeconfig.Users) != 1 ||
+		kubeconfig.Users[0].User["client-certificate"] != "/c.cert" ||
+		kubeconfig.Users[0].User["client-key"] != "/c.key" {
+		t.Fatalf("unexpected kubeconfig %+v", kubeconfig)
+	}
+	if len(kubeconfig.Clusters) != 1 ||
+		kubeconfig.Clusters[0].Cluster["server"] != options.server ||
+		kubeconfig.Contexts[0].Context["user"] != "keymaster" {
+		t.Fatalf("unexpected kubeconfig %+v", kubeconfig)
+	}
+	// Other entries and fields are kept and embedded credentials removed.
+	err = ioutil.WriteFile(options.path, []byte(`apiVersion: v1
+kind: Config
+current-context: other
+users:
+- name: other
+  user:
+    token: secret
+- name: keymaster
+  user:
+    client-certificate-data: AAAA
+    client-key-data: AAAA
+    username: admin
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options.cluster = ""
+	if err := updateKubeconfig(options, "/c.cert", "/c.key"); err != nil {
+		t.Fatal(err)
+	}
+	kubeconfig = readTestKubeconfig(t, options.path)
+	if kubeconfig.CurrentContext != "other" || len(kubeconfig.Users) != 2 ||
+		kubeconfig.Users[0].User["token"] != "secret" {
+		t.Fatalf("unexpected kubeconfig %+v", kubeconfig)
+	}
+	user := kubeconfig.Users[1].User
+	if len(user) != 3 || user["username"] != "admin" ||
+		user["client-certificate"] != "/c.cert" {
+		t.Fatalf("unexpected user %v", user)
+	}
+}
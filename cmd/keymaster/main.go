@@ -1,12 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"crypto"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -20,18 +21,28 @@ import (
 	"github.com/Cloud-Foundations/Dominator/lib/log"
 	"github.com/Cloud-Foundations/Dominator/lib/log/cmdlogger"
 	"github.com/Cloud-Foundations/Dominator/lib/net/rrdialer"
+	"github.com/Cloud-Foundations/keymaster/lib/client/certstore"
 	"github.com/Cloud-Foundations/keymaster/lib/client/config"
+	"github.com/Cloud-Foundations/keymaster/lib/client/happyeyeballs"
 	libnet "github.com/Cloud-Foundations/keymaster/lib/client/net"
+	"github.com/Cloud-Foundations/keymaster/lib/client/retrybudget"
+	"github.com/Cloud-Foundations/keymaster/lib/client/serverlatency"
 	"github.com/Cloud-Foundations/keymaster/lib/client/sshagent"
 	"github.com/Cloud-Foundations/keymaster/lib/client/twofa"
 	"github.com/Cloud-Foundations/keymaster/lib/client/twofa/u2f"
 	"github.com/Cloud-Foundations/keymaster/lib/client/util"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
 )
 
 const DefaultSSHKeysLocation = "/.ssh/"
 const DefaultTLSKeysLocation = "/.ssl/"
 
+const proxyPasswordEnvVariable = "KEYMASTER_PROXY_PASSWORD"
+
 const userAgentAppName = "keymaster"
+
+// Certs are due for renewal this far through the shorter validity window.
+const renewalFraction = 0.75
 const defaultVersionNumber = "No version provided"
 
 var (
@@ -51,10 +62,79 @@ var (
 	cliFilePrefix    = flag.String("fileprefix", "", "Prefix for the output files")
 	roundRobinDialer = flag.Bool("roundRobinDialer", false,
 		"If true, use the smart round-robin dialer")
+	happyEyeballs = flag.Bool("happyEyeballs", true,
+		"If true, race connections to the addresses of servers (ignored with -roundRobinDialer)")
+	dialAttemptTimeout = flag.Duration("dialAttemptTimeout",
+		happyeyeballs.DefaultAttemptTimeout,
+		"Timeout of each connection attempt to a server address")
+	homeFallback = flag.Bool("homeFallback", false,
+		"If true, write certs to a local directory when home is unavailable")
+	homeFallbackDir = flag.String("homeFallbackDir", "",
+		"Directory used when home is unavailable (default: <tmpdir>/keymaster-<username>)")
+	proxyUsername = flag.String("proxyUsername", "",
+		"Username for Basic authentication to the HTTP proxy. The password is read from $"+
+			proxyPasswordEnvVariable+" or -proxyPasswordFile")
+	proxyPasswordFile = flag.String("proxyPasswordFile", "",
+		"File containing the password for the HTTP proxy")
+	noSSHAgent = flag.Bool("noSSHAgent", false,
+		"If true, do not add the issued SSH cert to the running ssh-agent")
+	tlsDebug = flag.Bool("tls-debug", false,
+		"If true, log the negotiated TLS connection details")
+	retryMaxAttempts = flag.Int("retryMaxAttempts", 0,
+		"Maximum combined attempts across all servers and backends (0 means unlimited)")
+	retryMaxElapsed = flag.Duration("retryMaxElapsed", 0,
+		"Maximum combined time spent on attempts across all servers and backends (0 means unlimited)")
+	minLifetimeFraction = flag.Float64("minLifetimeFraction", 0.5,
+		"Warn if a cert is granted less than this fraction of the requested duration")
+	requireLifetime = flag.Bool("require-lifetime", false,
+		"If true, fail instead of warning when the granted lifetime is too short")
+	intermediateExpiryWarning = flag.Duration("intermediateExpiryWarning",
+		30*24*time.Hour,
+		"Warn if an intermediate CA in the returned chain expires within this window (0 disables)")
+	oidcToken = flag.String("oidc-token", "",
+		"Authenticate non-interactively with this pre-obtained OIDC token")
+	oidcTokenFile = flag.String("oidc-token-file", "",
+		"Authenticate non-interactively with the OIDC token in this file")
+	cloudIdentity = flag.String("cloud-identity", "",
+		"Authenticate non-interactively with the identity of this cloud instance: aws, gcp or azure")
+	serviceAccountTokenFile = flag.String("service-account-token-file", "",
+		"Authenticate non-interactively as a service account with the refresh token in this file, which is rotated in place")
+	renewWithCert = flag.Bool("renewWithCert", false,
+		"If true, first authenticate with the still valid x509 cert of an earlier run over mutual TLS, if the server allows certificate renewal")
+	useKerberos = flag.Bool("kerberos", false,
+		"If true, attempt Kerberos (SPNEGO) authentication with the credential cache before prompting for a password")
+	passwordFile = flag.String("password-file", "",
+		"Read the password from this file instead of prompting (see also $"+
+			passwordFdEnvVariable+")")
+	outputFormat = flag.String("output", outputFormatText,
+		"Output format: text or json (JSON describing the written certificates is printed on stdout)")
+	validityDivergenceWarning = flag.Duration("validityDivergenceWarning", 0,
+		"Warn if the SSH and x509 certs expire more than this apart (0 disables)")
+	keyType = flag.String("keyType", "",
+		"Type of key to generate: rsa, ecdsa (P-256) or ed25519, optionally with a size such as rsa-4096 (default: key_type of the config or rsa)")
+	certStore = flag.Bool("certStore", false,
+		"If true, also import the x509 cert and its key into the Windows certificate store or macOS keychain of the user")
+	exportP12 = flag.Bool("exportP12", false,
+		"If true, also write the x509 cert, its chain and key as a PKCS#12 file for browser import, encrypted with a passphrase prompted for")
+	raceServers = flag.Bool("raceServers", false,
+		"If true, after logging in request the certs from all servers concurrently and use the fastest")
 
 	FilePrefix = "keymaster"
+
+	// Set with -raceServers. A nil value records nothing.
+	serverLatencies *serverlatency.Latencies
+
+	// Type and size of the generated keys, from -keyType or the config.
+	generatedKeyType = proto.KeyTypeRSA
+	generatedKeyBits int
 )
 
+func init() {
+	flag.StringVar(keyType, "key-type", "", "Same as -keyType")
+	flag.BoolVar(certStore, "windowsCertStore", false, "Same as -certStore")
+	flag.BoolVar(exportP12, "export-p12", false, "Same as -exportP12")
+}
+
 func getUserHomeDir() (homeDir string) {
 	homeDir = os.Getenv("HOME")
 	if homeDir != "" {
@@ -64,8 +144,7 @@ func getUserHomeDir() (homeDir string) {
 	if err != nil {
 		return homeDir
 	}
-	// TODO: verify on Windows... see: http://stackoverflow.com/questions/7922270/obtain-users-home-directory
-	homeDir = usr.HomeDir
+	homeDir, _ = util.GetUserHomeDir(usr)
 	return
 }
 
@@ -140,6 +219,22 @@ func loadConfigFile(client *http.Client, logger log.Logger) (
 	return
 }
 
+// loadServerConfig merges the client settings of the server into
+// configContents. They are cached next to the configuration file. Failures
+// are only logged, as the local settings still work.
+func loadServerConfig(configContents config.AppConfigFile,
+	client *http.Client, logger log.DebugLogger) config.AppConfigFile {
+	cacheFilename := filepath.Join(filepath.Dir(*configFilename),
+		"server-config.json")
+	merged, err := config.GetServerConfig(configContents, cacheFilename,
+		client, logger)
+	if err != nil {
+		logger.Printf("cannot get the client settings of the server: %s", err)
+		return configContents
+	}
+	return merged
+}
+
 func preConnectToHost(baseUrl string, client *http.Client, logger log.DebugLogger) error {
 	response, err := client.Get(baseUrl)
 	if err != nil {
@@ -159,11 +254,18 @@ func preConnectToHost(baseUrl string, client *http.Client, logger log.DebugLogge
 	return nil
 }
 
-func backgroundConnectToAnyKeymasterServer(targetUrls []string, client *http.Client, logger log.DebugLogger) error {
+func backgroundConnectToAnyKeymasterServer(targetUrls []string, client *http.Client,
+	budget *retrybudget.Budget, logger log.DebugLogger) error {
 	c := make(chan error, len(targetUrls))
 	for _, baseUrl := range targetUrls {
 		go func(c chan error, baseUrl string, client *http.Client, logger log.DebugLogger) {
-			c <- preConnectToHost(baseUrl, client, logger)
+			if err := budget.Acquire(); err != nil {
+				c <- err
+				return
+			}
+			err := preConnectToHost(baseUrl, client, logger)
+			budget.Record(err)
+			c <- err
 		}(c, baseUrl, client, logger)
 
 	}
@@ -172,6 +274,9 @@ func backgroundConnectToAnyKeymasterServer(targetUrls []string, client *http.Cli
 		err := <-c
 		if err != nil {
 			logger.Debugf(1, "Debug: Error connecting err=%s", err)
+			if _, ok := err.(*retrybudget.ExhaustedError); ok {
+				return err
+			}
 			errorList = append(errorList, err)
 			continue
 		}
@@ -180,7 +285,159 @@ func backgroundConnectToAnyKeymasterServer(targetUrls []string, client *http.Cli
 	for _, capturedErr := range errorList {
 		logger.Printf("Error connecting err=%s", capturedErr)
 	}
-	return fmt.Errorf("Cannot connect to any keymaster Server")
+	return errNoServerReachable
+}
+
+// certGetter obtains certificates for the public key of signer.
+type certGetter func(signer crypto.Signer, client *http.Client,
+	budget *retrybudget.Budget) (sshCert []byte, x509Cert []byte,
+	kubernetesCert []byte, err error)
+
+// loadRenewalCertificate returns the x509 cert written under homeDir by an
+// earlier run and its key, if the cert is still valid.
+func loadRenewalCertificate(homeDir string) (tls.Certificate, error) {
+	tlsKeyPath := filepath.Join(homeDir, DefaultTLSKeysLocation, FilePrefix)
+	certificate, err := tls.LoadX509KeyPair(tlsKeyPath+".cert",
+		tlsKeyPath+".key")
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	cert, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return tls.Certificate{}, fmt.Errorf("%s.cert is not valid now",
+			tlsKeyPath)
+	}
+	return certificate, nil
+}
+
+// getLoginCertGetter returns a certGetter which authenticates with an OIDC
+// token, a cloud instance identity or a service account token, with the
+// x509 cert under homeDir or Kerberos if requested, or with a password and
+// second factor. An empty homeDir disables certificate renewal.
+func getLoginCertGetter(userName string, homeDir string,
+	configContents config.AppConfigFile, logger log.DebugLogger) certGetter {
+	return func(signer crypto.Signer, client *http.Client,
+		budget *retrybudget.Budget) ([]byte, []byte, []byte, error) {
+		oidcToken, err := getOIDCToken()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if oidcToken != nil {
+			// Non-interactive: no password or second factor prompts.
+			return twofa.GetCertFromTargetUrlsWithOIDCToken(
+				signer,
+				userName,
+				oidcToken,
+				strings.Split(configContents.Base.Gen_Cert_URLS, ","),
+				configContents.Base.AddGroups,
+				client,
+				userAgentString,
+				budget,
+				logger)
+		}
+		if *cloudIdentity != "" {
+			return twofa.GetCertFromTargetUrlsWithCloudIdentity(
+				signer,
+				userName,
+				*cloudIdentity,
+				strings.Split(configContents.Base.Gen_Cert_URLS, ","),
+				configContents.Base.AddGroups,
+				client,
+				userAgentString,
+				budget,
+				logger)
+		}
+		if *serviceAccountTokenFile != "" {
+			return twofa.GetCertFromTargetUrlsWithServiceAccountToken(
+				signer,
+				userName,
+				*serviceAccountTokenFile,
+				strings.Split(configContents.Base.Gen_Cert_URLS, ","),
+				configContents.Base.AddGroups,
+				client,
+				userAgentString,
+				budget,
+				logger)
+		}
+		if *renewWithCert && homeDir != "" {
+			sshCert, x509Cert, kubernetesCert, err :=
+				getCertsWithRenewalCertificate(signer, userName, homeDir,
+					configContents, client, budget, logger)
+			if err == nil {
+				return sshCert, x509Cert, kubernetesCert, nil
+			}
+			if _, ok := err.(*retrybudget.ExhaustedError); ok {
+				return nil, nil, nil, err
+			}
+			logger.Printf("certificate renewal failed, falling back: %s", err)
+		}
+		if *useKerberos {
+			sshCert, x509Cert, kubernetesCert, err :=
+				twofa.GetCertFromTargetUrlsWithKerberos(
+					signer,
+					userName,
+					strings.Split(configContents.Base.Gen_Cert_URLS, ","),
+					false,
+					configContents.Base.AddGroups,
+					client,
+					userAgentString,
+					budget,
+					logger)
+			if err == nil {
+				return sshCert, x509Cert, kubernetesCert, nil
+			}
+			if _, ok := err.(*retrybudget.ExhaustedError); ok {
+				return nil, nil, nil, err
+			}
+			logger.Printf("Kerberos authentication failed, falling back to password: %s",
+				err)
+		}
+		// Get user creds
+		password, err := getUserPassword(userName)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		// Get the certs
+		return twofa.GetCertFromTargetUrlsWithBudget(
+			signer,
+			userName,
+			password,
+			strings.Split(configContents.Base.Gen_Cert_URLS, ","),
+			false,
+			configContents.Base.AddGroups,
+			client,
+			userAgentString,
+			budget,
+			logger)
+	}
+}
+
+// getCertsWithRenewalCertificate authenticates with the x509 cert written
+// under homeDir by an earlier run.
+func getCertsWithRenewalCertificate(signer crypto.Signer, userName string,
+	homeDir string, configContents config.AppConfigFile, client *http.Client,
+	budget *retrybudget.Budget, logger log.DebugLogger) (
+	[]byte, []byte, []byte, error) {
+	certificate, err := loadRenewalCertificate(homeDir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return twofa.GetCertFromTargetUrlsWithCertificate(
+		signer,
+		userName,
+		certificate,
+		strings.Split(configContents.Base.Gen_Cert_URLS, ","),
+		false,
+		configContents.Base.AddGroups,
+		client,
+		userAgentString,
+		budget,
+		logger)
 }
 
 func setupCerts(
@@ -188,12 +445,29 @@ func setupCerts(
 	homeDir string,
 	configContents config.AppConfigFile,
 	client *http.Client,
-	logger log.DebugLogger) {
+	logger log.DebugLogger) error {
+	_, err := obtainCerts(userName, homeDir, configContents, client,
+		getLoginCertGetter(userName, homeDir, configContents, logger), logger)
+	return err
+}
+
+// obtainCerts gets certificates with getCerts and writes them under homeDir.
+// The URL of the server which issued them is returned.
+func obtainCerts(
+	userName string,
+	homeDir string,
+	configContents config.AppConfigFile,
+	client *http.Client,
+	getCerts certGetter,
+	logger log.DebugLogger) (string, error) {
 	//initialize the client connection
 	targetURLs := strings.Split(configContents.Base.Gen_Cert_URLS, ",")
-	err := backgroundConnectToAnyKeymasterServer(targetURLs, client, logger)
+	client, certServer := recordCertServer(client)
+	budget := retrybudget.New(*retryMaxAttempts, *retryMaxElapsed)
+	err := backgroundConnectToAnyKeymasterServer(targetURLs, client, budget,
+		logger)
 	if err != nil {
-		logger.Fatal(err)
+		return "", err
 	}
 
 	// create dirs
@@ -201,115 +475,267 @@ func setupCerts(
 	sshConfigPath, _ := filepath.Split(sshKeyPath)
 	err = os.MkdirAll(sshConfigPath, 0700)
 	if err != nil {
-		logger.Fatal(err)
+		return "", err
 	}
 	tlsKeyPath := filepath.Join(homeDir, DefaultTLSKeysLocation, FilePrefix)
 	tlsConfigPath, _ := filepath.Split(tlsKeyPath)
 	err = os.MkdirAll(tlsConfigPath, 0700)
 	if err != nil {
-		logger.Fatal(err)
+		return "", err
 	}
 
 	// get signer
-	tempPrivateKeyPath := filepath.Join(homeDir, DefaultSSHKeysLocation, "keymaster-temp")
-	signer, tempPublicKeyPath, err := util.GenKeyPair(
-		tempPrivateKeyPath, userName+"@keymaster", logger)
+	pivKey, err := openPIVKey(logger)
 	if err != nil {
-		logger.Fatal(err)
+		return "", err
 	}
-	defer os.Remove(tempPrivateKeyPath)
-	defer os.Remove(tempPublicKeyPath)
-	// Get user creds
-	password, err := util.GetUserCreds(userName)
-	if err != nil {
-		logger.Fatal(err)
+	var signer crypto.Signer
+	tempPrivateKeyPath := filepath.Join(homeDir, DefaultSSHKeysLocation, "keymaster-temp")
+	var tempPublicKeyPath string
+	if pivKey != nil {
+		defer pivKey.Close()
+		signer = pivKey
+		twofa.SetKeyAttestation(pivKey.AttestationHeader())
+		defer twofa.SetKeyAttestation("")
+	} else {
+		signer, tempPublicKeyPath, err = util.GenKeyPairWithTypeAndBits(
+			tempPrivateKeyPath, userName+"@keymaster", generatedKeyType,
+			generatedKeyBits, logger)
+		if err != nil {
+			return "", err
+		}
+		defer os.Remove(tempPrivateKeyPath)
+		defer os.Remove(tempPublicKeyPath)
+	}
+	sshCert, x509Cert, kubernetesCert, err := getCerts(signer, client, budget)
+	if err := serverLatencies.Save(); err != nil {
+		logger.Printf("could not save server latencies: %s", err)
 	}
-
-	// Get the certs
-	sshCert, x509Cert, kubernetesCert, err := twofa.GetCertFromTargetUrls(
-		signer,
-		userName,
-		password,
-		strings.Split(configContents.Base.Gen_Cert_URLS, ","),
-		false,
-		configContents.Base.AddGroups,
-		client,
-		userAgentString,
-		logger)
 	if err != nil {
-		logger.Fatal(err)
+		return "", err
 	}
 	if sshCert == nil || x509Cert == nil {
 		err := errors.New("Could not get cert from any url")
-		logger.Fatal(err)
+		return "", err
 	}
 	logger.Debugf(0, "Got Certs from server")
-
-	//rename files to expected paths
-	err = os.Rename(tempPrivateKeyPath, sshKeyPath)
+	err = checkGrantedLifetime(sshCert, x509Cert, *twofa.Duration,
+		*minLifetimeFraction, *requireLifetime, logger)
 	if err != nil {
-		err := errors.New("Could not rename private Key")
-		logger.Fatal(err)
+		return "", err
+	}
+	checkValidityDivergence(sshCert, x509Cert, *validityDivergenceWarning,
+		logger)
+	if *intermediateExpiryWarning > 0 {
+		for _, certPEM := range [][]byte{x509Cert, kubernetesCert} {
+			if certPEM == nil {
+				continue
+			}
+			_, err := util.CheckChainExpiry(certPEM,
+				*intermediateExpiryWarning, logger)
+			if err != nil {
+				logger.Printf("could not check certificate chain: %s", err)
+			}
+		}
 	}
 
-	err = os.Rename(tempPublicKeyPath, sshKeyPath+".pub")
-	if err != nil {
-		err := errors.New("Could not rename public Key")
-		logger.Fatal(err)
+	// Write keys and certs as a single unit so a failure leaves the previous
+	// complete set in place.
+	var files []atomicFile
+	if pivKey != nil {
+		// The private key stays in the YubiKey.
+		publicKeyFile, err := makePublicKeyFile(sshKeyPath+".pub",
+			pivKey.Public(), userName+"@keymaster")
+		if err != nil {
+			return "", err
+		}
+		files = append(files, publicKeyFile)
+	} else {
+		privateKeyFile, err := readAtomicFile(tempPrivateKeyPath, sshKeyPath,
+			0600)
+		if err != nil {
+			return "", err
+		}
+		publicKeyFile, err := readAtomicFile(tempPublicKeyPath,
+			sshKeyPath+".pub", 0644)
+		if err != nil {
+			return "", err
+		}
+		files = append(files,
+			privateKeyFile,
+			publicKeyFile,
+			// Symlinks do not work on windows, so fall back to a copy.
+			atomicFile{
+				path:          tlsKeyPath + ".key",
+				data:          privateKeyFile.data,
+				mode:          0600,
+				symlinkTarget: sshKeyPath,
+			})
+	}
+	files = append(files,
+		atomicFile{path: sshKeyPath + "-cert.pub", data: sshCert, mode: 0644},
+		atomicFile{path: tlsKeyPath + ".cert", data: x509Cert, mode: 0644})
+	if kubernetesCert != nil {
+		files = append(files, atomicFile{
+			path: tlsKeyPath + "-kubernetes.cert",
+			data: kubernetesCert,
+			mode: 0644,
+		})
+	}
+	if *exportP12 && pivKey != nil {
+		logger.Printf("cannot export the key of a YubiKey to a PKCS#12 file")
+	} else if *exportP12 {
+		p12File, err := makeP12File(tlsKeyPath+".p12", x509Cert, signer)
+		if err != nil {
+			return "", err
+		}
+		files = append(files, p12File)
 	}
-	// Now handle the key in the tls directory
-	tlsPrivateKeyName := filepath.Join(homeDir, DefaultTLSKeysLocation, FilePrefix+".key")
-	os.Remove(tlsPrivateKeyName)
-	err = os.Symlink(sshKeyPath, tlsPrivateKeyName)
+	err = writeFilesAtomically(files)
 	if err != nil {
-		// Try to copy instead (windows symlink does not work)
-		from, err := os.Open(sshKeyPath)
-		if err != nil {
-			logger.Fatal(err)
+		return "", err
+	}
+	if pivKey != nil {
+		// Key files of earlier runs without the YubiKey do not match the
+		// new certs.
+		for _, path := range []string{sshKeyPath, tlsKeyPath + ".key"} {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				logger.Printf("cannot remove %s: %s", path, err)
+			}
 		}
-		defer from.Close()
-		to, err := os.OpenFile(tlsPrivateKeyName, os.O_RDWR|os.O_CREATE, 0660)
+	}
+	if *outputFormat == outputFormatJSON {
+		err = writeJSONOutput(os.Stdout, certServer.getServer(), sshKeyPath,
+			sshKeyPath+"-cert.pub", sshCert,
+			tlsKeyPath+".cert", x509Cert,
+			tlsKeyPath+"-kubernetes.cert", kubernetesCert)
 		if err != nil {
-			logger.Fatal(err)
+			return "", err
 		}
-		defer to.Close()
+	}
 
-		_, err = io.Copy(to, from)
+	// TODO eventually we should reorder operations so that we write to the
+	// private key only if we are unable to use the agent
+	// Agents and certificate stores need the private key itself.
+	if !*noSSHAgent && pivKey == nil {
+		addCertToSSHAgent(sshCert, signer, FilePrefix+"-"+userName, logger)
+	}
+	if *certStore && pivKey == nil {
+		err := certstore.ImportCertificate(x509Cert, signer,
+			FilePrefix+"-"+userName)
 		if err != nil {
-			logger.Fatal(err)
+			logger.Printf("could not import cert into the certificate store: %s",
+				err)
+		} else {
+			logger.Debugf(0, "Imported cert into the certificate store")
 		}
 	}
 
-	// now we write the cert file...
-	sshCertPath := sshKeyPath + "-cert.pub"
-	err = ioutil.WriteFile(sshCertPath, sshCert, 0644)
+	logger.Printf("Success")
+	return certServer.getServer(), nil
+}
+
+// setupServerRacing enables racing the servers, ordered by the latencies
+// saved next to the config file.
+func setupServerRacing(logger log.Logger) {
+	latencyFilename := filepath.Join(filepath.Dir(*configFilename),
+		"server_latency.json")
+	latencies, err := serverlatency.Load(latencyFilename)
 	if err != nil {
-		err := errors.New("Could not write ssh cert")
-		logger.Fatal(err)
+		logger.Printf("could not load server latencies, using config order: %s",
+			err)
 	}
-	x509CertPath := tlsKeyPath + ".cert"
-	err = ioutil.WriteFile(x509CertPath, x509Cert, 0644)
+	serverLatencies = latencies
+	twofa.SetServerRacing(true, serverLatencies)
+}
+
+// checkKeyType returns an error if keys of keyType cannot be generated.
+func checkKeyType(keyType string) error {
+	if keyType == "" {
+		return nil
+	}
+	if _, _, err := util.ParseKeyType(keyType); err != nil {
+		return fmt.Errorf("unsupported -keyType: %q", keyType)
+	}
+	return nil
+}
+
+// getKeySpec returns the type and size of the keys to generate. A non-empty
+// flagKeyType overrides the key_type and key_bits of the config.
+func getKeySpec(flagKeyType string, baseConfig config.BaseConfig) (
+	string, int, error) {
+	spec := flagKeyType
+	var bits int
+	if spec == "" {
+		spec = baseConfig.KeyType
+		bits = baseConfig.KeyBits
+	}
+	if spec == "" {
+		spec = proto.KeyTypeRSA
+	}
+	keyType, specBits, err := util.ParseKeyType(spec)
 	if err != nil {
-		err := errors.New("Could not write ssh cert")
-		logger.Fatal(err)
+		return "", 0, err
 	}
-	if kubernetesCert != nil {
-		kubernetesCertPath := tlsKeyPath + "-kubernetes.cert"
-		err = ioutil.WriteFile(kubernetesCertPath, kubernetesCert, 0644)
-		if err != nil {
-			err := errors.New("Could not write ssh cert")
-			logger.Fatal(err)
+	if specBits != 0 {
+		if bits != 0 && bits != specBits {
+			return "", 0, fmt.Errorf("key_bits %d conflicts with key_type %s",
+				bits, spec)
 		}
+		bits = specBits
+	}
+	if err := util.CheckKeySize(keyType, bits); err != nil {
+		return "", 0, err
 	}
+	return keyType, bits, nil
+}
 
-	// TODO eventually we should reorder operations so that we write to the
-	// private key only if we are unable to use the agent
-	err = sshagent.UpsertCertIntoAgent(sshCert, signer, FilePrefix+"-"+userName, uint32((*twofa.Duration).Seconds()), logger)
-	if err != nil {
-		logger.Printf("could not insert into agent natively")
+// addCertToSSHAgent adds the SSH cert and its key to the running ssh-agent
+// until the cert expires, replacing the entry with the same comment.
+// Failures are logged as the cert has already been written to disk.
+func addCertToSSHAgent(sshCert []byte, signer crypto.Signer, comment string,
+	logger log.DebugLogger) {
+	err := sshagent.UpsertCertIntoAgentUntilExpiry(sshCert, signer, comment,
+		logger)
+	if err == sshagent.ErrNoAgent {
+		logger.Debugf(1, "not adding cert to ssh-agent: %s", err)
+	} else if err != nil {
+		logger.Printf("could not add cert to ssh-agent: %s", err)
+	} else {
+		logger.Debugf(0, "Added cert to ssh-agent")
 	}
+}
 
-	logger.Printf("Success")
+// checkGrantedLifetime warns if the certs were granted much less than the
+// requested lifetime. If require is true an error is returned instead.
+func checkGrantedLifetime(sshCert []byte, x509Cert []byte,
+	requested time.Duration, minFraction float64, require bool,
+	logger log.Logger) error {
+	err := util.CheckGrantedLifetime(requested, minFraction, sshCert, x509Cert)
+	if err == nil || require {
+		return err
+	}
+	logger.Printf("WARNING: %s", err)
+	return nil
+}
+
+// checkValidityDivergence logs when the certs should be renewed, based on
+// whichever expires first, and warns if their expiry times are more than
+// threshold apart.
+func checkValidityDivergence(sshCert []byte, x509Cert []byte,
+	threshold time.Duration, logger log.DebugLogger) time.Time {
+	renewAt, divergence, err := util.GetRenewalTime(renewalFraction, sshCert,
+		x509Cert)
+	if err != nil {
+		logger.Printf("could not compute renewal time: %s", err)
+		return time.Time{}
+	}
+	logger.Debugf(0, "Certs should be renewed at %s", renewAt.Format(time.RFC3339))
+	if threshold > 0 && divergence > threshold {
+		logger.Printf("WARNING: SSH and x509 cert expiry times differ by %s",
+			divergence.Round(time.Second))
+	}
+	return renewAt
 }
 
 func computeUserAgent() {
@@ -322,6 +748,13 @@ func computeUserAgent() {
 }
 
 func getHttpClient(rootCAs *x509.CertPool, logger log.DebugLogger) (*http.Client, error) {
+	return getHttpClientWithProxy(rootCAs, config.BaseConfig{}, logger)
+}
+
+// getHttpClientWithProxy is like getHttpClient, but uses the proxy settings
+// of baseConfig instead of the environment if they are set.
+func getHttpClientWithProxy(rootCAs *x509.CertPool,
+	baseConfig config.BaseConfig, logger log.DebugLogger) (*http.Client, error) {
 	var dialer libnet.Dialer
 	rawDialer := &net.Dialer{
 		Timeout:   10 * time.Second,
@@ -335,16 +768,84 @@ func getHttpClient(rootCAs *x509.CertPool, logger log.DebugLogger) (*http.Client
 			defer rrDialer.WaitForBackgroundResults(time.Second)
 			dialer = rrDialer
 		}
+	} else if *happyEyeballs {
+		dialer = happyeyeballs.New(rawDialer,
+			happyeyeballs.Config{AttemptTimeout: *dialAttemptTimeout}, logger)
 	} else {
 		dialer = rawDialer
 	}
 	tlsConfig := &tls.Config{RootCAs: rootCAs, MinVersion: tls.VersionTLS12}
-	return util.GetHttpClient(tlsConfig, dialer)
+	if *tlsDebug {
+		setupTLSDebug(tlsConfig, logger)
+	}
+	proxyConfig := util.ProxyConfig{
+		URL:     baseConfig.Proxy,
+		NoProxy: baseConfig.NoProxy,
+	}
+	if *proxyUsername != "" {
+		password, err := getProxyPassword()
+		if err != nil {
+			return nil, err
+		}
+		proxyConfig.Authenticator = util.NewBasicProxyAuthenticator(
+			*proxyUsername, password)
+	}
+	return util.GetHttpClientWithProxyConfig(tlsConfig, dialer, proxyConfig)
+}
+
+// getOIDCToken returns the OIDC token given with -oidc-token or
+// -oidc-token-file, or nil if neither was given.
+func getOIDCToken() ([]byte, error) {
+	if *oidcToken != "" && *oidcTokenFile != "" {
+		return nil, errors.New("only one of -oidc-token and -oidc-token-file may be given")
+	}
+	if *oidcToken != "" {
+		return []byte(*oidcToken), nil
+	}
+	if *oidcTokenFile == "" {
+		return nil, nil
+	}
+	token, err := ioutil.ReadFile(*oidcTokenFile)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSpace(token), nil
+}
+
+// getProxyPassword reads the proxy password from the environment or from
+// the password file so that it never needs to be stored in the config.
+func getProxyPassword() ([]byte, error) {
+	if password := os.Getenv(proxyPasswordEnvVariable); password != "" {
+		return []byte(password), nil
+	}
+	if *proxyPasswordFile == "" {
+		return nil, fmt.Errorf("no proxy password in $%s or -proxyPasswordFile",
+			proxyPasswordEnvVariable)
+	}
+	password, err := ioutil.ReadFile(*proxyPasswordFile)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(password, "\r\n"), nil
 }
 
 func Usage() {
 	fmt.Fprintf(
 		os.Stderr, "Usage of %s (version %s):\n", os.Args[0], Version)
+	fmt.Fprintf(os.Stderr, "       %s [flags] %s [-renew-before=4h] [-retry-interval=5m]\n",
+		os.Args[0], agentCommand)
+	fmt.Fprintf(os.Stderr, "       %s [flags] %s [-socket=path] [-renew-before=4h] [-retry-interval=5m]\n",
+		os.Args[0], sshAgentCommand)
+	fmt.Fprintf(os.Stderr, "       %s [flags] %s [-kubeconfig=path] [-user=name] [-cluster=name -server=url [-certificate-authority=path] [-context=name]]\n",
+		os.Args[0], kubeconfigCommand)
+	fmt.Fprintf(os.Stderr, "       %s [flags] %s [-address=url] [-mount=cert] [-role=name] [-token-file=path]\n",
+		os.Args[0], vaultCommand)
+	fmt.Fprintf(os.Stderr, "       %s [flags] %s -profile-arn=arn -role-arn=arn -trust-anchor-arn=arn [-session-duration=1h]\n",
+		os.Args[0], awsCredentialsCommand)
+	fmt.Fprintf(os.Stderr, "       %s [flags] %s [-host-pattern=*.example.com] [-known-hosts=path] [-system [-system-known-hosts=path]]\n",
+		os.Args[0], knownHostsCommand)
+	fmt.Fprintf(os.Stderr, "       %s [flags] %s [-output=path] [-ssh-config=path] [-include=false]\n",
+		os.Args[0], sshSetupCommand)
 	flag.PrintDefaults()
 }
 
@@ -352,6 +853,18 @@ func main() {
 	flag.Usage = Usage
 	flag.Parse()
 	logger := cmdlogger.New()
+	if err := checkOutputFormat(*outputFormat); err != nil {
+		logger.Fatal(err)
+	}
+	if err := checkKeyType(*keyType); err != nil {
+		logger.Fatal(err)
+	}
+	if *certStore && runtime.GOOS != "windows" && runtime.GOOS != "darwin" {
+		logger.Fatal("-certStore is only supported on Windows and macOS")
+	}
+	if *exportP12 && isNonInteractive() {
+		logger.Fatal("-exportP12 prompts for a passphrase and cannot be used non-interactively")
+	}
 	rootCAs, err := maybeGetRootCas(*rootCAFilename, logger)
 	if err != nil {
 		logger.Fatal(err)
@@ -365,13 +878,37 @@ func main() {
 		u2f.CheckU2FDevices(logger)
 		return
 	}
+	twofa.SetNonInteractive(isNonInteractive())
 	computeUserAgent()
+	if deviceKey, err := loadDeviceKey(logger); err != nil {
+		logger.Printf("not identifying this device, cannot load device key: %s",
+			err)
+	} else if deviceKey != nil {
+		logger.Debugf(1, "device %s", deviceKey.ID())
+		twofa.SetDeviceKey(deviceKey)
+	}
 
 	userName, homeDir, err := getUserNameAndHomeDir(logger)
 	if err != nil {
 		logger.Fatal(err)
 	}
 	config := loadConfigFile(client, logger)
+	if config.Base.Proxy != "" || config.Base.NoProxy != "" {
+		client, err = getHttpClientWithProxy(rootCAs, config.Base, logger)
+		if err != nil {
+			logger.Fatal(err)
+		}
+	}
+	if config.Base.UseServerConfig {
+		config = loadServerConfig(config, client, logger)
+	}
+	generatedKeyType, generatedKeyBits, err = getKeySpec(*keyType, config.Base)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if *raceServers {
+		setupServerRacing(logger)
+	}
 
 	// Adjust user name
 	if len(config.Base.Username) > 0 {
@@ -389,5 +926,39 @@ func main() {
 		FilePrefix = *cliFilePrefix
 	}
 
-	setupCerts(userName, homeDir, config, client, logger)
+	outputDir, usedFallback, err := resolveOutputDir(homeDir, userName,
+		*homeFallback, *homeFallbackDir, logger)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if flag.NArg() > 0 && flag.Arg(0) == agentCommand {
+		err = runAgent(flag.Args()[1:], userName, outputDir, config, client,
+			logger)
+	} else if flag.NArg() > 0 && flag.Arg(0) == sshAgentCommand {
+		err = runSSHAgent(flag.Args()[1:], userName, config, client, logger)
+	} else if flag.NArg() > 0 && flag.Arg(0) == kubeconfigCommand {
+		err = runKubeconfig(flag.Args()[1:], userName, outputDir, config,
+			client, logger)
+	} else if flag.NArg() > 0 && flag.Arg(0) == vaultCommand {
+		err = runVault(flag.Args()[1:], userName, outputDir, config, client,
+			logger)
+	} else if flag.NArg() > 0 && flag.Arg(0) == awsCredentialsCommand {
+		err = runAWSCredentials(flag.Args()[1:], outputDir, os.Stdout)
+	} else if flag.NArg() > 0 && flag.Arg(0) == knownHostsCommand {
+		err = runKnownHosts(flag.Args()[1:], homeDir, config, client, logger)
+	} else if flag.NArg() > 0 && flag.Arg(0) == sshSetupCommand {
+		err = runSSHSetup(flag.Args()[1:], userName, homeDir, outputDir,
+			config, client, logger)
+	} else if flag.NArg() > 0 {
+		logger.Fatalf("unknown command: %s", flag.Arg(0))
+	} else {
+		err = setupCerts(userName, outputDir, config, client, logger)
+	}
+	if err != nil {
+		exitWithError(err, logger)
+	}
+	if usedFallback {
+		logger.Printf("Certificates written to fallback directory %s",
+			outputDir)
+	}
 }
@@ -1,18 +1,29 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"math/big"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/Cloud-Foundations/Dominator/lib/log/testlogger"
 	"github.com/Cloud-Foundations/keymaster/lib/client/config"
+	"github.com/Cloud-Foundations/keymaster/lib/client/retrybudget"
+	"github.com/Cloud-Foundations/keymaster/lib/client/twofa"
 	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
 )
 
@@ -179,13 +190,13 @@ func TestBackgroundConnectToAnyKeymasterServer(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		err = backgroundConnectToAnyKeymasterServer([]string{localHttpsTarget}, client, logger)
+		err = backgroundConnectToAnyKeymasterServer([]string{localHttpsTarget}, client, nil, logger)
 		if err != nil {
 			t.Fatal(err)
 		}
 		//now with fail:
 		client2, err := getHttpClient(nil, logger)
-		err = backgroundConnectToAnyKeymasterServer([]string{localHttpsTarget}, client2, logger)
+		err = backgroundConnectToAnyKeymasterServer([]string{localHttpsTarget}, client2, nil, logger)
 		if err == nil {
 			t.Fatal("should have failed")
 		}
@@ -194,6 +205,108 @@ func TestBackgroundConnectToAnyKeymasterServer(t *testing.T) {
 
 }
 
+func TestSharedRetryBudgetAcrossServersAndBackends(t *testing.T) {
+	logger := testlogger.New(t)
+	*roundRobinDialer = false
+	client, err := getHttpClient(nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failingTargets := []string{"https://127.0.0.1:1", "https://127.0.0.1:2",
+		"https://127.0.0.1:3"}
+	const maxAttempts = 4
+	budget := retrybudget.New(maxAttempts, 0)
+	err = backgroundConnectToAnyKeymasterServer(failingTargets, client,
+		budget, logger)
+	if err == nil {
+		t.Fatal("should have failed")
+	}
+	signer, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, _, err = twofa.GetCertFromTargetUrlsWithBudget(signer, "username",
+		[]byte("password"), failingTargets, false, false, client,
+		userAgentString, budget, logger)
+	if _, ok := err.(*retrybudget.ExhaustedError); !ok {
+		t.Fatalf("expected exhausted budget error, got %v", err)
+	}
+	if budget.Attempts() > maxAttempts {
+		t.Fatalf("attempts %d exceeded budget %d", budget.Attempts(),
+			maxAttempts)
+	}
+	t.Log(err)
+}
+
+type recordingLogger struct {
+	*testlogger.Logger
+	mutex    sync.Mutex
+	messages []string
+}
+
+func (l *recordingLogger) Printf(format string, v ...interface{}) {
+	l.mutex.Lock()
+	l.messages = append(l.messages, fmt.Sprintf(format, v...))
+	l.mutex.Unlock()
+	l.Logger.Printf(format, v...)
+}
+
+func TestTLSDebugLogsConnectionState(t *testing.T) {
+	certPool := x509.NewCertPool()
+	ok := certPool.AppendCertsFromPEM([]byte(rootCAPem))
+	if !ok {
+		t.Fatal("cannot add certs to certpool")
+	}
+	logger := &recordingLogger{Logger: testlogger.New(t)}
+	*roundRobinDialer = false
+	*tlsDebug = true
+	defer func() { *tlsDebug = false }()
+	client, err := getHttpClient(certPool, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = backgroundConnectToAnyKeymasterServer([]string{localHttpsTarget},
+		client, nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.mutex.Lock()
+	defer logger.mutex.Unlock()
+	var foundVersion, foundPeer bool
+	for _, message := range logger.messages {
+		if strings.Contains(message, "version=TLS1.") &&
+			strings.Contains(message, "cipher=") &&
+			strings.Contains(message, "resumed=") {
+			foundVersion = true
+		}
+		if strings.Contains(message, "subject=") &&
+			strings.Contains(message, "issuer=") {
+			foundPeer = true
+		}
+	}
+	if !foundVersion || !foundPeer {
+		t.Fatalf("TLS details not logged: %v", logger.messages)
+	}
+}
+
+func TestCheckGrantedLifetime(t *testing.T) {
+	// The test root CA is valid for about 20 years.
+	x509Cert := []byte(rootCAPem)
+	logger := &recordingLogger{Logger: testlogger.New(t)}
+	requested := 100 * 365 * 24 * time.Hour
+	err := checkGrantedLifetime(nil, x509Cert, requested, 0.5, false, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logger.messages) != 1 {
+		t.Fatalf("expected a warning, got %v", logger.messages)
+	}
+	err = checkGrantedLifetime(nil, x509Cert, requested, 0.5, true, logger)
+	if err == nil {
+		t.Fatal("should have failed with require-lifetime")
+	}
+}
+
 func pipeToStdin(s string) (int, error) {
 	pipeReader, pipeWriter, err := os.Pipe()
 	if err != nil {
@@ -206,6 +319,56 @@ func pipeToStdin(s string) (int, error) {
 	return w, err
 }
 
+func TestCheckKeyType(t *testing.T) {
+	for _, keyType := range []string{proto.KeyTypeRSA, proto.KeyTypeECDSA,
+		proto.KeyTypeEd25519} {
+		if err := checkKeyType(keyType); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := checkKeyType("dsa"); err == nil {
+		t.Fatal("expected unsupported key type to fail")
+	}
+}
+
+func TestGetKeySpec(t *testing.T) {
+	tests := []struct {
+		flagKeyType string
+		baseConfig  config.BaseConfig
+		keyType     string
+		bits        int
+	}{
+		{"", config.BaseConfig{}, proto.KeyTypeRSA, 0},
+		{"", config.BaseConfig{KeyType: "rsa", KeyBits: 4096},
+			proto.KeyTypeRSA, 4096},
+		{"", config.BaseConfig{KeyType: "ecdsa-p256"}, proto.KeyTypeECDSA, 256},
+		// The flag overrides both config settings.
+		{"ed25519", config.BaseConfig{KeyType: "rsa", KeyBits: 4096},
+			proto.KeyTypeEd25519, 0},
+		{"rsa-3072", config.BaseConfig{KeyType: "rsa-4096"},
+			proto.KeyTypeRSA, 3072},
+	}
+	for _, test := range tests {
+		keyType, bits, err := getKeySpec(test.flagKeyType, test.baseConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keyType != test.keyType || bits != test.bits {
+			t.Fatalf("%+v: got %s %d", test, keyType, bits)
+		}
+	}
+	for _, baseConfig := range []config.BaseConfig{
+		{KeyType: "rsa", KeyBits: 1024},
+		{KeyType: "ed25519", KeyBits: 4096},
+		{KeyType: "rsa-2048", KeyBits: 4096},
+		{KeyType: "dsa"},
+	} {
+		if _, _, err := getKeySpec("", baseConfig); err == nil {
+			t.Fatalf("%+v should fail", baseConfig)
+		}
+	}
+}
+
 func TestMaybeGetRootCas(t *testing.T) {
 	logger := testlogger.New(t)
 	shouldbeNil, err := maybeGetRootCas("", logger)
@@ -266,11 +429,77 @@ func TestMost(t *testing.T) {
 		os.Unsetenv("SSH_AUTH_SOCK")
 		defer os.Setenv("SSH_AUTH_SOCK", oldSSHSock)
 	}
-	setupCerts(
+	err = setupCerts(
 		userName,
 		homeDir,
 		appConfig,
 		client,
 		logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+}
+
+func writeTestRenewalCertificate(t *testing.T, homeDir string,
+	notAfter time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "username"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	derCert, err := x509.CreateCertificate(rand.Reader, template, template,
+		key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	derKey, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsKeyPath := filepath.Join(homeDir, DefaultTLSKeysLocation, FilePrefix)
+	if err := os.MkdirAll(filepath.Dir(tlsKeyPath), 0700); err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(tlsKeyPath+".cert",
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derCert}),
+		0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(tlsKeyPath+".key",
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: derKey}),
+		0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
 
+func TestLoadRenewalCertificate(t *testing.T) {
+	homeDir, err := ioutil.TempDir("", "keymaster-renewal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(homeDir)
+	if _, err := loadRenewalCertificate(homeDir); err == nil {
+		t.Fatal("expected error without certificate")
+	}
+	writeTestRenewalCertificate(t, homeDir, time.Now().Add(time.Hour))
+	certificate, err := loadRenewalCertificate(homeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certificate.Certificate) != 1 {
+		t.Fatalf("unexpected certificate chain length: %d",
+			len(certificate.Certificate))
+	}
+	writeTestRenewalCertificate(t, homeDir, time.Now().Add(-time.Minute))
+	if _, err := loadRenewalCertificate(homeDir); err == nil {
+		t.Fatal("expired certificate should be rejected")
+	}
 }
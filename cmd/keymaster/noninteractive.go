@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"github.com/Cloud-Foundations/keymaster/lib/client/retrybudget"
+	"github.com/Cloud-Foundations/keymaster/lib/client/twofa"
+	"github.com/Cloud-Foundations/keymaster/lib/client/util"
+)
+
+const passwordFdEnvVariable = "KEYMASTER_PASSWORD_FD"
+
+// Exit codes reported on failure so that automation can tell a rejected
+// credential from an unreachable server without parsing log output. They
+// are part of the client interface and must not be renumbered. Exit code 2
+// is left to the flag package for usage errors.
+const (
+	exitCodeFailure                 = 1
+	exitCodeAuthDenied              = 3
+	exitCodeSecondFactorUnavailable = 4
+	exitCodeUnreachable             = 5
+	exitCodeLifetimeTooShort        = 6
+)
+
+var exitCodeNames = map[int]string{
+	exitCodeFailure:                 "failure",
+	exitCodeAuthDenied:              "auth_denied",
+	exitCodeSecondFactorUnavailable: "second_factor_unavailable",
+	exitCodeUnreachable:             "unreachable",
+	exitCodeLifetimeTooShort:        "lifetime_too_short",
+}
+
+var errNoServerReachable = errors.New("Cannot connect to any keymaster Server")
+
+// getExitCode maps err to one of the exitCode* values.
+func getExitCode(err error) int {
+	var deniedError *twofa.DeniedError
+	var exhaustedError *retrybudget.ExhaustedError
+	var lifetimeError *util.LifetimeError
+	switch {
+	case errors.Is(err, twofa.ErrNoUsableFactor):
+		return exitCodeSecondFactorUnavailable
+	case errors.As(err, &deniedError):
+		return exitCodeAuthDenied
+	case errors.Is(err, errNoServerReachable),
+		errors.As(err, &exhaustedError):
+		return exitCodeUnreachable
+	case errors.As(err, &lifetimeError):
+		return exitCodeLifetimeTooShort
+	}
+	return exitCodeFailure
+}
+
+// exitWithError logs err, writes a stable "error_code=<name>" line to
+// stderr (and a JSON error object to stdout with -output=json) and exits
+// with the matching exit code.
+func exitWithError(err error, logger log.Logger) {
+	code := getExitCode(err)
+	logger.Println(err)
+	fmt.Fprintf(os.Stderr, "error_code=%s\n", exitCodeNames[code])
+	if *outputFormat == outputFormatJSON {
+		writeJSONError(os.Stdout, err, code)
+	}
+	os.Exit(code)
+}
+
+// isNonInteractive returns true if the password or token is supplied without
+// a terminal, in which case the client must never prompt.
+func isNonInteractive() bool {
+	return *passwordFile != "" || os.Getenv(passwordFdEnvVariable) != "" ||
+		*oidcToken != "" || *oidcTokenFile != ""
+}
+
+// getUserPassword returns the password from -password-file or from the file
+// descriptor named by $KEYMASTER_PASSWORD_FD, and only prompts for it when
+// neither is given.
+func getUserPassword(userName string) ([]byte, error) {
+	fdText := os.Getenv(passwordFdEnvVariable)
+	if *passwordFile != "" && fdText != "" {
+		return nil, fmt.Errorf("only one of -password-file and $%s may be given",
+			passwordFdEnvVariable)
+	}
+	if *passwordFile != "" {
+		password, err := ioutil.ReadFile(*passwordFile)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.TrimRight(password, "\r\n"), nil
+	}
+	if fdText != "" {
+		return readPasswordFromFd(fdText)
+	}
+	return util.GetUserCreds(userName)
+}
+
+func readPasswordFromFd(fdText string) ([]byte, error) {
+	fd, err := strconv.ParseUint(fdText, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid $%s: %s", passwordFdEnvVariable, err)
+	}
+	file := os.NewFile(uintptr(fd), passwordFdEnvVariable)
+	if file == nil {
+		return nil, fmt.Errorf("invalid $%s: %d", passwordFdEnvVariable, fd)
+	}
+	defer file.Close()
+	password, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(password, "\r\n"), nil
+}
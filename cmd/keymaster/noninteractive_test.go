@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/Cloud-Foundations/keymaster/lib/client/retrybudget"
+	"github.com/Cloud-Foundations/keymaster/lib/client/twofa"
+	"github.com/Cloud-Foundations/keymaster/lib/client/util"
+)
+
+func TestGetExitCode(t *testing.T) {
+	testCases := []struct {
+		err  error
+		code int
+	}{
+		{errors.New("some failure"), exitCodeFailure},
+		{&twofa.DeniedError{Status: "401 Unauthorized"}, exitCodeAuthDenied},
+		{fmt.Errorf("wrapped: %w", &twofa.NoUsableFactorError{}),
+			exitCodeSecondFactorUnavailable},
+		{errNoServerReachable, exitCodeUnreachable},
+		{&retrybudget.ExhaustedError{}, exitCodeUnreachable},
+		{&util.LifetimeError{CertType: "SSH"}, exitCodeLifetimeTooShort},
+	}
+	for _, testCase := range testCases {
+		code := getExitCode(testCase.err)
+		if code != testCase.code {
+			t.Errorf("%v: got exit code %d, expected %d", testCase.err, code,
+				testCase.code)
+		}
+		if exitCodeNames[code] == "" {
+			t.Errorf("exit code %d has no name", code)
+		}
+	}
+}
+
+func TestGetUserPasswordFromFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "keymaster-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	filename := filepath.Join(tmpDir, "password")
+	if err := ioutil.WriteFile(filename, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { *passwordFile = "" }()
+	*passwordFile = filename
+	password, err := getUserPassword("username")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(password) != "secret" {
+		t.Fatalf("unexpected password %q", password)
+	}
+	if !isNonInteractive() {
+		t.Fatal("password file should select non-interactive mode")
+	}
+	os.Setenv(passwordFdEnvVariable, "3")
+	defer os.Unsetenv(passwordFdEnvVariable)
+	if _, err := getUserPassword("username"); err == nil {
+		t.Fatal("expected error when both password sources are given")
+	}
+}
+
+func TestGetUserPasswordFromFd(t *testing.T) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.Write([]byte("secret\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+	os.Setenv(passwordFdEnvVariable, strconv.Itoa(int(reader.Fd())))
+	defer os.Unsetenv(passwordFdEnvVariable)
+	password, err := getUserPassword("username")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(password) != "secret" {
+		t.Fatalf("unexpected password %q", password)
+	}
+	os.Setenv(passwordFdEnvVariable, "notanumber")
+	if _, err := getUserPassword("username"); err == nil {
+		t.Fatal("expected error for invalid file descriptor")
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	outputFormatText = "text"
+	outputFormatJSON = "json"
+)
+
+// certOutput describes one certificate written by the client.
+type certOutput struct {
+	Type      string    `json:"type"`
+	Path      string    `json:"path"`
+	Serial    string    `json:"serial"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+}
+
+// jsonOutput is written to stdout with -output=json after a successful run.
+type jsonOutput struct {
+	Backend        string       `json:"backend"`
+	PrivateKeyPath string       `json:"private_key_path"`
+	Certificates   []certOutput `json:"certificates"`
+}
+
+// jsonErrorOutput is written to stdout with -output=json when the client
+// fails.
+type jsonErrorOutput struct {
+	Error     string `json:"error"`
+	ErrorCode string `json:"error_code"`
+}
+
+func checkOutputFormat(format string) error {
+	switch format {
+	case outputFormatText, outputFormatJSON:
+		return nil
+	}
+	return fmt.Errorf("unsupported -output format: %q", format)
+}
+
+// certServerRecorder wraps an http.RoundTripper and remembers the server
+// which last issued a certificate.
+type certServerRecorder struct {
+	transport http.RoundTripper
+	mutex     sync.Mutex
+	server    string
+}
+
+// recordCertServer returns a copy of client which records the server that
+// issued the certificates.
+func recordCertServer(client *http.Client) (*http.Client, *certServerRecorder) {
+	transport := client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	recorder := &certServerRecorder{transport: transport}
+	newClient := *client
+	newClient.Transport = recorder
+	return &newClient, recorder
+}
+
+func (r *certServerRecorder) RoundTrip(req *http.Request) (*http.Response,
+	error) {
+	resp, err := r.transport.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	if resp.StatusCode == http.StatusOK &&
+		strings.Contains(req.URL.Path, "/certgen/") {
+		r.mutex.Lock()
+		r.server = req.URL.Scheme + "://" + req.URL.Host
+		r.mutex.Unlock()
+	}
+	return resp, nil
+}
+
+func (r *certServerRecorder) getServer() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.server
+}
+
+func getSSHCertOutput(path string, sshCert []byte) (certOutput, error) {
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey(sshCert)
+	if err != nil {
+		return certOutput{}, err
+	}
+	cert, ok := pubKey.(*ssh.Certificate)
+	if !ok {
+		return certOutput{}, errors.New("not an SSH certificate")
+	}
+	return certOutput{
+		Type:      "ssh",
+		Path:      path,
+		Serial:    strconv.FormatUint(cert.Serial, 10),
+		NotBefore: time.Unix(int64(cert.ValidAfter), 0).UTC(),
+		NotAfter:  time.Unix(int64(cert.ValidBefore), 0).UTC(),
+	}, nil
+}
+
+func getX509CertOutput(certType string, path string, x509Cert []byte) (
+	certOutput, error) {
+	block, _ := pem.Decode(x509Cert)
+	if block == nil {
+		return certOutput{}, errors.New("no PEM data in certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return certOutput{}, err
+	}
+	return certOutput{
+		Type:      certType,
+		Path:      path,
+		Serial:    cert.SerialNumber.String(),
+		NotBefore: cert.NotBefore.UTC(),
+		NotAfter:  cert.NotAfter.UTC(),
+	}, nil
+}
+
+// getBackendName returns the name of the server at serverURL, which is its
+// host and any port.
+func getBackendName(serverURL string) (string, error) {
+	parsedURL, err := url.Parse(serverURL)
+	if err != nil {
+		return "", err
+	}
+	return parsedURL.Host, nil
+}
+
+// writeJSONOutput describes the written files, which were issued by the server
+// at serverURL, on writer. A nil kubernetesCert is left out.
+func writeJSONOutput(writer io.Writer, serverURL string, privateKeyPath string,
+	sshCertPath string, sshCert []byte,
+	x509CertPath string, x509Cert []byte,
+	kubernetesCertPath string, kubernetesCert []byte) error {
+	backend, err := getBackendName(serverURL)
+	if err != nil {
+		return err
+	}
+	output := jsonOutput{Backend: backend, PrivateKeyPath: privateKeyPath}
+	sshOutput, err := getSSHCertOutput(sshCertPath, sshCert)
+	if err != nil {
+		return err
+	}
+	x509Output, err := getX509CertOutput("x509", x509CertPath, x509Cert)
+	if err != nil {
+		return err
+	}
+	output.Certificates = append(output.Certificates, sshOutput, x509Output)
+	if kubernetesCert != nil {
+		kubernetesOutput, err := getX509CertOutput("kubernetes",
+			kubernetesCertPath, kubernetesCert)
+		if err != nil {
+			return err
+		}
+		output.Certificates = append(output.Certificates, kubernetesOutput)
+	}
+	return json.NewEncoder(writer).Encode(output)
+}
+
+func writeJSONError(writer io.Writer, err error, code int) error {
+	return json.NewEncoder(writer).Encode(jsonErrorOutput{
+		Error:     err.Error(),
+		ErrorCode: exitCodeNames[code],
+	})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func genTestSSHCert(t *testing.T, serial uint64, lifetime time.Duration) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             signer.PublicKey(),
+		Serial:          serial,
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"username"},
+		ValidAfter:      uint64(now.Unix()),
+		ValidBefore:     uint64(now.Add(lifetime).Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, signer); err != nil {
+		t.Fatal(err)
+	}
+	return ssh.MarshalAuthorizedKey(cert)
+}
+
+func TestWriteJSONOutput(t *testing.T) {
+	sshCert := genTestSSHCert(t, 42, time.Hour)
+	var buffer bytes.Buffer
+	err := writeJSONOutput(&buffer, "https://keymaster.example.com",
+		"/home/user/.ssh/keymaster",
+		"/home/user/.ssh/keymaster-cert.pub", sshCert,
+		"/home/user/.ssl/keymaster.cert", []byte(rootCAPem),
+		"/home/user/.ssl/keymaster-kubernetes.cert", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output jsonOutput
+	if err := json.Unmarshal(buffer.Bytes(), &output); err != nil {
+		t.Fatal(err)
+	}
+	if output.Backend != "keymaster.example.com" {
+		t.Fatalf("unexpected backend %q", output.Backend)
+	}
+	if len(output.Certificates) != 2 {
+		t.Fatalf("expected 2 certificates, got %d", len(output.Certificates))
+	}
+	sshOutput := output.Certificates[0]
+	if sshOutput.Type != "ssh" || sshOutput.Serial != "42" ||
+		sshOutput.Path != "/home/user/.ssh/keymaster-cert.pub" {
+		t.Fatalf("unexpected SSH cert output: %+v", sshOutput)
+	}
+	if sshOutput.NotAfter.Sub(sshOutput.NotBefore) != time.Hour {
+		t.Fatalf("unexpected SSH cert validity: %+v", sshOutput)
+	}
+	x509Output := output.Certificates[1]
+	if x509Output.Type != "x509" || x509Output.Serial != "10" ||
+		x509Output.NotAfter.IsZero() {
+		t.Fatalf("unexpected x509 cert output: %+v", x509Output)
+	}
+}
+
+func TestWriteJSONOutputBadCert(t *testing.T) {
+	var buffer bytes.Buffer
+	err := writeJSONOutput(&buffer, "", "", "", []byte("bad"), "",
+		[]byte(rootCAPem), "", nil)
+	if err == nil {
+		t.Fatal("expected error for a malformed SSH cert")
+	}
+}
+
+func TestWriteJSONError(t *testing.T) {
+	var buffer bytes.Buffer
+	err := writeJSONError(&buffer, errors.New("no servers"),
+		exitCodeUnreachable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output jsonErrorOutput
+	if err := json.Unmarshal(buffer.Bytes(), &output); err != nil {
+		t.Fatal(err)
+	}
+	if output.Error != "no servers" || output.ErrorCode != "unreachable" {
+		t.Fatalf("unexpected error output: %+v", output)
+	}
+}
+
+func TestRecordCertServer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/certgen/fail" {
+				w.WriteHeader(http.StatusForbidden)
+			}
+		}))
+	defer server.Close()
+	client, recorder := recordCertServer(server.Client())
+	for _, path := range []string{"/api/v0/login", "/certgen/fail"} {
+		resp, err := client.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if recorder.getServer() != "" {
+		t.Fatalf("recorded server without a cert: %s", recorder.getServer())
+	}
+	resp, err := client.Get(server.URL + "/certgen/username?type=ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if recorder.getServer() != server.URL {
+		t.Fatalf("recorded %q, expected %q", recorder.getServer(), server.URL)
+	}
+	if err := checkOutputFormat("yaml"); err == nil {
+		t.Fatal("expected unsupported output format to fail")
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"errors"
+	"fmt"
+
+	"github.com/Cloud-Foundations/keymaster/lib/client/pkcs12"
+	"github.com/howeyc/gopass"
+)
+
+// readPassphrase is replaced in tests to script the prompts.
+var readPassphrase = gopass.GetPasswd
+
+// exportPassphrase is kept after the first prompt so that renewals do not
+// prompt again.
+var exportPassphrase []byte
+
+// getExportPassphrase prompts twice for the passphrase of the PKCS#12 file
+// the first time it is called and returns the same passphrase afterwards.
+func getExportPassphrase() ([]byte, error) {
+	if exportPassphrase != nil {
+		return exportPassphrase, nil
+	}
+	fmt.Printf("Export passphrase for the PKCS#12 file: ")
+	passphrase, err := readPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) < 1 {
+		return nil, errors.New("empty export passphrase")
+	}
+	fmt.Printf("Repeat the export passphrase: ")
+	repeated, err := readPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(passphrase, repeated) {
+		return nil, errors.New("export passphrases do not match")
+	}
+	exportPassphrase = passphrase
+	return exportPassphrase, nil
+}
+
+// makeP12File returns the PKCS#12 file at path holding the x509 cert, its
+// chain and signer, encrypted with the export passphrase.
+func makeP12File(path string, x509Cert []byte,
+	signer crypto.Signer) (atomicFile, error) {
+	passphrase, err := getExportPassphrase()
+	if err != nil {
+		return atomicFile{}, err
+	}
+	data, err := pkcs12.Encode(x509Cert, signer, string(passphrase))
+	if err != nil {
+		return atomicFile{}, err
+	}
+	return atomicFile{path: path, data: data, mode: 0600}, nil
+}
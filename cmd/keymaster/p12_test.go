@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	gopkcs12 "software.sslmate.com/src/go-pkcs12"
+)
+
+func scriptPassphrases(t *testing.T, passphrases ...string) {
+	exportPassphrase = nil
+	readPassphrase = func() ([]byte, error) {
+		if len(passphrases) < 1 {
+			t.Fatal("unexpected prompt")
+		}
+		passphrase := passphrases[0]
+		passphrases = passphrases[1:]
+		return []byte(passphrase), nil
+	}
+}
+
+func TestMakeP12File(t *testing.T) {
+	savedReadPassphrase := readPassphrase
+	t.Cleanup(func() {
+		exportPassphrase = nil
+		readPassphrase = savedReadPassphrase
+	})
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "username"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	derCert, err := x509.CreateCertificate(rand.Reader, &template, &template,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x509Cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE",
+		Bytes: derCert})
+	scriptPassphrases(t, "secret", "other")
+	if _, err := makeP12File("keymaster.p12", x509Cert, key); err == nil {
+		t.Fatal("mismatched passphrases should fail")
+	}
+	scriptPassphrases(t, "")
+	if _, err := makeP12File("keymaster.p12", x509Cert, key); err == nil {
+		t.Fatal("empty passphrase should fail")
+	}
+	scriptPassphrases(t, "secret", "secret")
+	file, err := makeP12File("keymaster.p12", x509Cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.path != "keymaster.p12" || file.mode != 0600 {
+		t.Fatalf("unexpected file %s with mode %o", file.path, file.mode)
+	}
+	if _, _, err := gopkcs12.Decode(file.data, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	// Renewals reuse the passphrase without prompting.
+	if _, err := makeP12File("keymaster.p12", x509Cert, key); err != nil {
+		t.Fatal(err)
+	}
+}
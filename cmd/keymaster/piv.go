@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto"
+	"flag"
+	"os"
+	"strings"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"github.com/Cloud-Foundations/keymaster/lib/client/piv"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	pivPINEnvVariable           = "KEYMASTER_PIV_PIN"
+	pivManagementKeyEnvVariable = "KEYMASTER_PIV_MANAGEMENT_KEY"
+)
+
+var (
+	pivSlot = flag.String("pivSlot", "",
+		"Certify the key in this PIV slot of a YubiKey ("+
+			piv.SlotAuthentication+" or "+piv.SlotCardAuthentication+
+			") instead of a generated key file (PIN in $"+
+			pivPINEnvVariable+" or asked for)")
+	pivCard = flag.String("pivCard", "",
+		"Use the smart card whose name contains this (default: the first YubiKey)")
+	pivGenerate = flag.Bool("pivGenerate", false,
+		"If true, generate a key in the -pivSlot if it holds none (management key in $"+
+			pivManagementKeyEnvVariable+", hex encoded, if not the default)")
+	pivTouchPolicy = flag.String("pivTouchPolicy", "cached",
+		"Touch policy of keys generated with -pivGenerate: never, always or cached")
+)
+
+// openPIVKey returns the PIV key selected by the flags, or nil if -pivSlot
+// is not set.
+func openPIVKey(logger log.DebugLogger) (*piv.Key, error) {
+	if *pivSlot == "" {
+		return nil, nil
+	}
+	return piv.Open(piv.Config{
+		Card:          *pivCard,
+		Slot:          *pivSlot,
+		Generate:      *pivGenerate,
+		TouchPolicy:   *pivTouchPolicy,
+		ManagementKey: os.Getenv(pivManagementKeyEnvVariable),
+		PIN:           os.Getenv(pivPINEnvVariable),
+	}, logger)
+}
+
+// makePublicKeyFile returns the SSH public key file of publicKey, written
+// instead of the key files when the key is in a YubiKey.
+func makePublicKeyFile(path string, publicKey crypto.PublicKey,
+	comment string) (atomicFile, error) {
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		return atomicFile{}, err
+	}
+	data := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPublicKey)))
+	return atomicFile{
+		path: path,
+		data: []byte(data + " " + comment + "\n"),
+		mode: 0644,
+	}, nil
+}
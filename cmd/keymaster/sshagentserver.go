@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"github.com/Cloud-Foundations/keymaster/lib/client/config"
+	"github.com/Cloud-Foundations/keymaster/lib/client/keypool"
+	"github.com/Cloud-Foundations/keymaster/lib/client/retrybudget"
+	"github.com/Cloud-Foundations/keymaster/lib/client/twofa"
+	"github.com/Cloud-Foundations/keymaster/lib/client/util"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+const sshAgentCommand = "ssh-agent"
+
+// memoryAgent holds the current SSH cert and its key in an in-memory
+// keyring. Nothing is written to disk.
+type memoryAgent struct {
+	keyring agent.Agent
+	comment string
+	logger  log.DebugLogger
+	keyPool *keypool.Pool // If not nil, RSA keys are taken from it.
+	mutex   sync.Mutex
+	current *ssh.Certificate
+}
+
+func newMemoryAgent(comment string, logger log.DebugLogger) *memoryAgent {
+	return &memoryAgent{
+		keyring: agent.NewKeyring(),
+		comment: comment,
+		logger:  logger,
+	}
+}
+
+// getDefaultAgentSocketPath returns the default socket of userName. Its
+// directory may be in the shared temporary directory, so it must be checked
+// with makePrivateDir.
+func getDefaultAgentSocketPath(userName string) string {
+	dirPath := os.Getenv("XDG_RUNTIME_DIR")
+	if dirPath == "" {
+		dirPath = os.TempDir()
+	}
+	return filepath.Join(dirPath, "keymaster-"+userName, "agent.sock")
+}
+
+// listenAgentSocket listens on a unix socket at socketPath which only the
+// current user can use. A stale socket left by an earlier run is replaced,
+// but not one another agent still listens on.
+func listenAgentSocket(socketPath string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0700); err != nil {
+		return nil, err
+	}
+	if fi, err := os.Lstat(socketPath); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", socketPath)
+		}
+		if conn, err := net.Dial("unix", socketPath); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("an agent is already listening on %s",
+				socketPath)
+		}
+		if err := os.Remove(socketPath); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// generateKey returns the key for a new cert, which is generated ahead of
+// time if the agent has a key pool.
+func (a *memoryAgent) generateKey() (crypto.Signer, error) {
+	if a.keyPool == nil {
+		return util.GenerateKeyWithTypeAndBits(generatedKeyType,
+			generatedKeyBits)
+	}
+	key, err := a.keyPool.Get()
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// obtain gets a new SSH cert for a key generated in memory and replaces the
+// previous one in the keyring. It implements certObtainer.
+func (a *memoryAgent) obtain(client *http.Client, getCerts certGetter) (
+	string, error) {
+	client, certServer := recordCertServer(client)
+	budget := retrybudget.New(*retryMaxAttempts, *retryMaxElapsed)
+	signer, err := a.generateKey()
+	if err != nil {
+		return "", err
+	}
+	sshCertText, _, _, err := getCerts(signer, client, budget)
+	if err != nil {
+		return "", err
+	}
+	if sshCertText == nil {
+		return "", errors.New("Could not get cert from any url")
+	}
+	err = checkGrantedLifetime(sshCertText, nil, *twofa.Duration,
+		*minLifetimeFraction, *requireLifetime, a.logger)
+	if err != nil {
+		return "", err
+	}
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey(sshCertText)
+	if err != nil {
+		return "", err
+	}
+	sshCert, ok := pubKey.(*ssh.Certificate)
+	if !ok {
+		return "", errors.New("not an SSH certificate")
+	}
+	lifetime := time.Until(time.Unix(int64(sshCert.ValidBefore), 0))
+	if lifetime <= 0 {
+		return "", errors.New("issued SSH certificate has already expired")
+	}
+	err = a.keyring.Add(agent.AddedKey{
+		PrivateKey:   signer,
+		Certificate:  sshCert,
+		Comment:      a.comment,
+		LifetimeSecs: uint32(lifetime / time.Second),
+	})
+	if err != nil {
+		return "", err
+	}
+	a.mutex.Lock()
+	previous := a.current
+	a.current = sshCert
+	a.mutex.Unlock()
+	if previous != nil {
+		if err := a.keyring.Remove(previous); err != nil {
+			a.logger.Debugf(1, "cannot remove previous cert: %s", err)
+		}
+	}
+	a.logger.Printf("Loaded cert valid until %s into the agent",
+		time.Unix(int64(sshCert.ValidBefore), 0).Format(time.RFC3339))
+	return certServer.getServer(), nil
+}
+
+// getExpiry returns when the current cert expires.
+func (a *memoryAgent) getExpiry() (time.Time, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.current == nil {
+		return time.Time{}, errors.New("no certificate loaded")
+	}
+	return time.Unix(int64(a.current.ValidBefore), 0), nil
+}
+
+func (a *memoryAgent) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			a.logger.Debugf(1, "agent socket closed: %s", err)
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			err := agent.ServeAgent(a.keyring, conn)
+			if err != nil && err != io.EOF {
+				a.logger.Debugf(1, "agent connection error: %s", err)
+			}
+		}(conn)
+	}
+}
+
+// runSSHAgent serves the SSH agent protocol on a unix socket with a cert
+// which is renewed before it expires. The socket is removed on SIGINT or
+// SIGTERM.
+func runSSHAgent(args []string, userName string,
+	configContents config.AppConfigFile, client *http.Client,
+	logger log.DebugLogger) error {
+	agentConf, err := parseAgentFlags(sshAgentCommand, args,
+		configContents.Base)
+	if err != nil {
+		return err
+	}
+	if agentConf.socketPath == "" {
+		agentConf.socketPath = getDefaultAgentSocketPath(userName)
+		err := makePrivateDir(filepath.Dir(agentConf.socketPath))
+		if err != nil {
+			return err
+		}
+	}
+	listener, err := listenAgentSocket(agentConf.socketPath)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		listener.Close()
+		os.Exit(0)
+	}()
+	memAgent := newMemoryAgent(FilePrefix+"-"+userName, logger)
+	if generatedKeyType == proto.KeyTypeRSA {
+		// RSA keys are slow to generate, so the key for the next cert is
+		// generated while waiting to renew.
+		bits := generatedKeyBits
+		if bits == 0 {
+			bits = util.DefaultRSAKeySize
+		}
+		memAgent.keyPool = keypool.New(1, 1, bits)
+		defer memAgent.keyPool.Close()
+	}
+	go memAgent.serve(listener)
+	fmt.Printf("SSH_AUTH_SOCK=%s; export SSH_AUTH_SOCK;\n",
+		agentConf.socketPath)
+	// The certs are only kept in memory, so there is no x509 cert to
+	// renew with.
+	return runRenewalLoop(agentConf, userName, "", configContents, client,
+		memAgent.obtain,
+		func() (time.Time, error) {
+			expiresAt, err := memAgent.getExpiry()
+			if err != nil {
+				return time.Time{}, err
+			}
+			return expiresAt.Add(-agentConf.renewBefore), nil
+		},
+		logger)
+}
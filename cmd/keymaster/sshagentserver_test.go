@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log/testlogger"
+	"github.com/Cloud-Foundations/keymaster/lib/client/keypool"
+	"github.com/Cloud-Foundations/keymaster/lib/client/retrybudget"
+	"github.com/Cloud-Foundations/keymaster/lib/client/util"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// getTestCertGetter returns a certGetter which issues SSH certs valid for
+// lifetime, signed by a throwaway CA.
+func getTestCertGetter(t *testing.T, lifetime time.Duration) certGetter {
+	caKey, err := util.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	caSigner, err := ssh.NewSignerFromKey(caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func(signer crypto.Signer, client *http.Client,
+		budget *retrybudget.Budget) ([]byte, []byte, []byte, error) {
+		pubKey, err := ssh.NewPublicKey(signer.Public())
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		now := time.Now()
+		cert := &ssh.Certificate{
+			Key:             pubKey,
+			CertType:        ssh.UserCert,
+			ValidPrincipals: []string{"username"},
+			ValidAfter:      uint64(now.Unix()),
+			ValidBefore:     uint64(now.Add(lifetime).Unix()),
+		}
+		if err := cert.SignCert(rand.Reader, caSigner); err != nil {
+			return nil, nil, nil, err
+		}
+		return ssh.MarshalAuthorizedKey(cert), nil, nil, nil
+	}
+}
+
+func TestMemoryAgentObtainReplacesCert(t *testing.T) {
+	memAgent := newMemoryAgent("keymaster-username", testlogger.New(t))
+	if _, err := memAgent.getExpiry(); err == nil {
+		t.Fatal("expected error before a cert is loaded")
+	}
+	getCerts := getTestCertGetter(t, 16*time.Hour)
+	for i := 0; i < 2; i++ {
+		if _, err := memAgent.obtain(http.DefaultClient, getCerts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys, err := memAgent.keyring.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("expected 1 key in the keyring, got %d", len(keys))
+	}
+	if keys[0].Comment != "keymaster-username" {
+		t.Fatalf("unexpected comment %q", keys[0].Comment)
+	}
+	expiresAt, err := memAgent.getExpiry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Until(expiresAt) <= 0 {
+		t.Fatalf("cert already expired at %s", expiresAt)
+	}
+}
+
+func TestMemoryAgentObtainWithKeyPool(t *testing.T) {
+	memAgent := newMemoryAgent("keymaster-username", testlogger.New(t))
+	memAgent.keyPool = keypool.New(1, 1, util.DefaultRSAKeySize)
+	defer memAgent.keyPool.Close()
+	getCerts := getTestCertGetter(t, 16*time.Hour)
+	for i := 0; i < 2; i++ {
+		if _, err := memAgent.obtain(http.DefaultClient, getCerts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys, err := memAgent.keyring.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Type() != ssh.CertAlgoRSAv01 {
+		t.Fatalf("expected 1 RSA cert in the keyring, got %v", keys)
+	}
+	memAgent.keyPool.Close()
+	if _, err := memAgent.obtain(http.DefaultClient, getCerts); err == nil {
+		t.Fatal("expected error once the key pool is closed")
+	}
+}
+
+func TestMemoryAgentServe(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "keymaster-ssh-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	socketPath := filepath.Join(tmpDir, "agent", "agent.sock")
+	listener, err := listenAgentSocket(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected socket permissions %s", fi.Mode())
+	}
+	memAgent := newMemoryAgent("keymaster-username", testlogger.New(t))
+	served := make(chan struct{})
+	go func() {
+		memAgent.serve(listener)
+		close(served)
+	}()
+	defer func() {
+		listener.Close()
+		<-served
+	}()
+	_, err = memAgent.obtain(http.DefaultClient,
+		getTestCertGetter(t, 16*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	keys, err := agent.NewClient(conn).List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("expected 1 key from the agent, got %d", len(keys))
+	}
+}
+
+func TestListenAgentSocketRefusesRegularFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "keymaster-ssh-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	socketPath := filepath.Join(tmpDir, "agent.sock")
+	if err := ioutil.WriteFile(socketPath, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenAgentSocket(socketPath); err == nil {
+		t.Fatal("expected a regular file not to be replaced")
+	}
+}
+
+func TestListenAgentSocketReplacesStaleSocket(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "keymaster-ssh-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	socketPath := filepath.Join(tmpDir, "agent.sock")
+	listener, err := listenAgentSocket(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenAgentSocket(socketPath); err == nil {
+		t.Fatal("expected the socket of a running agent not to be replaced")
+	}
+	// Leave the socket behind, like an agent which was killed.
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	listener, err = listenAgentSocket(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+}
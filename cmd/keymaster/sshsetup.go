@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"github.com/Cloud-Foundations/keymaster/lib/client/config"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+const (
+	sshSetupCommand = "ssh-setup"
+	sshSetupHeader  = "# Written by keymaster ssh-setup; changes are lost when it runs again.\n"
+)
+
+type sshSetupOptions struct {
+	output    string
+	sshConfig string
+	include   bool
+}
+
+// parseSSHSetupFlags parses the flags of the ssh-setup command.
+func parseSSHSetupFlags(args []string, homeDir string) (
+	sshSetupOptions, error) {
+	var options sshSetupOptions
+	flagSet := flag.NewFlagSet(sshSetupCommand, flag.ContinueOnError)
+	flagSet.StringVar(&options.output, "output",
+		filepath.Join(homeDir, ".ssh", "keymaster_config"),
+		"Path of the ssh_config fragment to write")
+	flagSet.StringVar(&options.sshConfig, "ssh-config",
+		filepath.Join(homeDir, ".ssh", "config"),
+		"Path of the ssh_config to include the fragment in")
+	flagSet.BoolVar(&options.include, "include", true,
+		"Add an Include of the fragment to the ssh_config")
+	if err := flagSet.Parse(args); err != nil {
+		return sshSetupOptions{}, err
+	}
+	if flagSet.NArg() > 0 {
+		return sshSetupOptions{}, fmt.Errorf("unexpected arguments: %v",
+			flagSet.Args())
+	}
+	path, err := filepath.Abs(options.output)
+	if err != nil {
+		return sshSetupOptions{}, err
+	}
+	options.output = path
+	return options, nil
+}
+
+// runSSHSetup obtains certificates and writes an ssh_config fragment which
+// uses them for the host domains listed by the server, or for all hosts if
+// there are none, and includes it in the ssh_config of the user.
+func runSSHSetup(args []string, userName string, homeDir string,
+	outputDir string, configContents config.AppConfigFile,
+	client *http.Client, logger log.DebugLogger) error {
+	options, err := parseSSHSetupFlags(args, homeDir)
+	if err != nil {
+		return err
+	}
+	domains := configContents.SSHDomains
+	if domains == nil {
+		targetURLs := strings.Split(configContents.Base.Gen_Cert_URLS, ",")
+		body, err := getPublicData(targetURLs, proto.SSHClientConfigPath,
+			client, logger)
+		if err != nil {
+			return err
+		}
+		var clientConfig proto.SSHClientConfigResponse
+		if err := json.Unmarshal(body, &clientConfig); err != nil {
+			return err
+		}
+		domains = clientConfig.Domains
+	}
+	if err := setupCerts(userName, outputDir, configContents, client,
+		logger); err != nil {
+		return err
+	}
+	sshKeyPath := filepath.Join(outputDir, DefaultSSHKeysLocation, FilePrefix)
+	fragment := makeSSHConfigFragment(domains, userName,
+		sshKeyPath, sshKeyPath+"-cert.pub")
+	if err := os.MkdirAll(filepath.Dir(options.output), 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(options.output, fragment, 0644); err != nil {
+		return err
+	}
+	logger.Printf("Wrote %s", options.output)
+	if !options.include {
+		return nil
+	}
+	changed, err := addSSHConfigInclude(options.sshConfig, options.output)
+	if err != nil {
+		return err
+	}
+	if changed {
+		logger.Printf("Included %s in %s", options.output, options.sshConfig)
+	}
+	return nil
+}
+
+// quoteSSHConfigValue quotes value if it contains spaces.
+func quoteSSHConfigValue(value string) string {
+	if strings.ContainsAny(value, " \t") {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+// makeSSHConfigFragment returns an ssh_config with a Match block for each of
+// domains, or a Host * block if there are none, which uses the key and
+// certificate.
+func makeSSHConfigFragment(domains []proto.SSHClientDomain, userName string,
+	keyPath string, certPath string) []byte {
+	var buffer bytes.Buffer
+	buffer.WriteString(sshSetupHeader)
+	writeIdentity := func() {
+		fmt.Fprintf(&buffer, "    IdentityFile %s\n",
+			quoteSSHConfigValue(keyPath))
+		fmt.Fprintf(&buffer, "    CertificateFile %s\n",
+			quoteSSHConfigValue(certPath))
+	}
+	if len(domains) < 1 {
+		buffer.WriteString("Host *\n")
+		writeIdentity()
+		return buffer.Bytes()
+	}
+	for _, domain := range domains {
+		fmt.Fprintf(&buffer, "Match host %s\n",
+			strings.Join(domain.HostPatterns, ","))
+		if domain.UseKeymasterUsername {
+			fmt.Fprintf(&buffer, "    User %s\n", userName)
+		}
+		if domain.ProxyJump != "" {
+			fmt.Fprintf(&buffer, "    ProxyJump %s\n", domain.ProxyJump)
+		}
+		if domain.Port > 0 {
+			fmt.Fprintf(&buffer, "    Port %d\n", domain.Port)
+		}
+		writeIdentity()
+		buffer.WriteString("    IdentitiesOnly yes\n")
+	}
+	return buffer.Bytes()
+}
+
+// addSSHConfigInclude adds an Include of fragmentPath as the first line of
+// the ssh_config at path, so that it applies to all hosts, unless there is
+// one already. The ssh_config is created if needed.
+func addSSHConfigInclude(path string, fragmentPath string) (bool, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	includeLine := "Include " + quoteSSHConfigValue(fragmentPath)
+	for _, line := range strings.Split(string(contents), "\n") {
+		if strings.TrimSpace(line) == includeLine {
+			return false, nil
+		}
+	}
+	mode := os.FileMode(0600)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return false, err
+	}
+	newContents := []byte(includeLine + "\n")
+	if len(contents) > 0 {
+		newContents = append(append(newContents, '\n'), contents...)
+		if !bytes.HasSuffix(newContents, []byte("\n")) {
+			newContents = append(newContents, '\n')
+		}
+	}
+	if err := ioutil.WriteFile(path, newContents, mode); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+func TestMakeSSHConfigFragment(t *testing.T) {
+	fragment := makeSSHConfigFragment(nil, "alice", "/home/a b/.ssh/key",
+		"/home/a b/.ssh/key-cert.pub")
+	expected := sshSetupHeader + `Host *
+    IdentityFile "/home/a b/.ssh/key"
+    CertificateFile "/home/a b/.ssh/key-cert.pub"
+`
+	if string(fragment) != expected {
+		t.Fatalf("unexpected fragment:\n%s", fragment)
+	}
+	fragment = makeSSHConfigFragment([]proto.SSHClientDomain{
+		{
+			HostPatterns:         []string{"*.example.com", "*.example.org"},
+			UseKeymasterUsername: true,
+			ProxyJump:            "bastion.example.com",
+		},
+		{HostPatterns: []string{"*.lab"}, Port: 2222},
+	}, "alice", "/home/alice/.ssh/key", "/home/alice/.ssh/key-cert.pub")
+	expected = sshSetupHeader + `Match host *.example.com,*.example.org
+    User alice
+    ProxyJump bastion.example.com
+    IdentityFile /home/alice/.ssh/key
+    CertificateFile /home/alice/.ssh/key-cert.pub
+    IdentitiesOnly yes
+Match host *.lab
+    Port 2222
+    IdentityFile /home/alice/.ssh/key
+    CertificateFile /home/alice/.ssh/key-cert.pub
+    IdentitiesOnly yes
+`
+	if string(fragment) != expected {
+		t.Fatalf("unexpected fragment:\n%s", fragment)
+	}
+}
+
+func TestAddSSHConfigInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshsetup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(path, []byte("Host old\n    Port 22"),
+		0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, expectChange := range []bool{true, false} {
+		changed, err := addSSHConfigInclude(path, "/home/alice/.ssh/km")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed != expectChange {
+			t.Fatalf("changed: %v, expected %v", changed, expectChange)
+		}
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "Include /home/alice/.ssh/km\n\nHost old\n    Port 22\n" {
+		t.Fatalf("unexpected contents: %q", contents)
+	}
+	newPath := filepath.Join(dir, "new", "config")
+	if _, err := addSSHConfigInclude(newPath, "/km"); err != nil {
+		t.Fatal(err)
+	}
+	if contents, err := ioutil.ReadFile(newPath); err != nil {
+		t.Fatal(err)
+	} else if string(contents) != "Include /km\n" {
+		t.Fatalf("unexpected contents: %q", contents)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+)
+
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS10: "TLS1.0",
+	tls.VersionTLS11: "TLS1.1",
+	tls.VersionTLS12: "TLS1.2",
+	tls.VersionTLS13: "TLS1.3",
+}
+
+func tlsVersionName(version uint16) string {
+	if name, ok := tlsVersionNames[version]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+func logTLSConnectionState(state tls.ConnectionState, logger log.Logger) {
+	logger.Printf("TLS: server=%s version=%s cipher=%s alpn=%q resumed=%t",
+		state.ServerName, tlsVersionName(state.Version),
+		tls.CipherSuiteName(state.CipherSuite), state.NegotiatedProtocol,
+		state.DidResume)
+	for i, cert := range state.PeerCertificates {
+		logger.Printf("TLS: peer cert[%d] subject=%q issuer=%q notAfter=%s",
+			i, cert.Subject.String(), cert.Issuer.String(), cert.NotAfter)
+	}
+}
+
+// setupTLSDebug makes tlsConfig log the negotiated connection details after
+// every handshake.
+func setupTLSDebug(tlsConfig *tls.Config, logger log.Logger) {
+	tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		logTLSConnectionState(state, logger)
+		return nil
+	}
+}
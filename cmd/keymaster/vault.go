@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"github.com/Cloud-Foundations/keymaster/lib/client/config"
+	"github.com/Cloud-Foundations/keymaster/lib/client/retrybudget"
+	"github.com/Cloud-Foundations/keymaster/lib/client/util"
+)
+
+const vaultCommand = "vault"
+
+type vaultOptions struct {
+	address   string
+	caFile    string
+	mount     string
+	namespace string
+	role      string
+	tokenFile string
+}
+
+// parseVaultFlags parses the flags of the vault command. The defaults
+// follow the environment variables of the vault command.
+func parseVaultFlags(args []string, homeDir string) (vaultOptions, error) {
+	var options vaultOptions
+	flagSet := flag.NewFlagSet(vaultCommand, flag.ContinueOnError)
+	flagSet.StringVar(&options.address, "address", os.Getenv("VAULT_ADDR"),
+		"URL of the Vault server (default: $VAULT_ADDR)")
+	flagSet.StringVar(&options.caFile, "ca-cert", os.Getenv("VAULT_CACERT"),
+		"Path of the CA certificate of the Vault server (default: $VAULT_CACERT)")
+	flagSet.StringVar(&options.mount, "mount", "cert",
+		"Path where the TLS certificate auth method is mounted")
+	flagSet.StringVar(&options.namespace, "namespace",
+		os.Getenv("VAULT_NAMESPACE"),
+		"Vault namespace to log in to (default: $VAULT_NAMESPACE)")
+	flagSet.StringVar(&options.role, "role", "",
+		"Name of the certificate role to log in with (default: any matching role)")
+	flagSet.StringVar(&options.tokenFile, "token-file",
+		filepath.Join(homeDir, ".vault-token"),
+		"Path to write the Vault token to")
+	if err := flagSet.Parse(args); err != nil {
+		return vaultOptions{}, err
+	}
+	if flagSet.NArg() > 0 {
+		return vaultOptions{}, fmt.Errorf("unexpected arguments: %v",
+			flagSet.Args())
+	}
+	if options.address == "" {
+		return vaultOptions{}, errors.New("-address or $VAULT_ADDR is needed")
+	}
+	options.mount = strings.Trim(options.mount, "/")
+	if options.mount == "" {
+		return vaultOptions{}, errors.New("-mount must not be empty")
+	}
+	return options, nil
+}
+
+// runVault obtains certificates and logs in to Vault with the x509 cert,
+// writing the Vault token where the vault command reads it.
+func runVault(args []string, userName string, homeDir string,
+	configContents config.AppConfigFile, client *http.Client,
+	logger log.DebugLogger) error {
+	options, err := parseVaultFlags(args, homeDir)
+	if err != nil {
+		return err
+	}
+	getCerts := getLoginCertGetter(userName, homeDir, configContents,
+		logger)
+	var certSigner crypto.Signer
+	var certPEM []byte
+	_, err = obtainCerts(userName, homeDir, configContents, client,
+		func(signer crypto.Signer, client *http.Client,
+			budget *retrybudget.Budget) ([]byte, []byte, []byte, error) {
+			sshCert, x509Cert, kubernetesCert, err := getCerts(signer, client,
+				budget)
+			certSigner = signer
+			certPEM = x509Cert
+			return sshCert, x509Cert, kubernetesCert, err
+		},
+		logger)
+	if err != nil {
+		return err
+	}
+	token, err := vaultLogin(options, getTLSCertificate(certPEM, certSigner))
+	if err != nil {
+		return err
+	}
+	err = writeFilesAtomically([]atomicFile{
+		{path: options.tokenFile, data: []byte(token), mode: 0600},
+	})
+	if err != nil {
+		return err
+	}
+	logger.Debugf(0, "Wrote Vault token to %s", options.tokenFile)
+	return nil
+}
+
+// getTLSCertificate returns the PEM encoded certificate chain certPEM and
+// its key as a tls.Certificate.
+func getTLSCertificate(certPEM []byte, signer crypto.Signer) tls.Certificate {
+	cert := tls.Certificate{PrivateKey: signer}
+	for {
+		var block *pem.Block
+		block, certPEM = pem.Decode(certPEM)
+		if block == nil {
+			return cert
+		}
+		if block.Type == "CERTIFICATE" {
+			cert.Certificate = append(cert.Certificate, block.Bytes)
+		}
+	}
+}
+
+// vaultLogin logs in to the TLS certificate auth method of Vault with cert
+// and returns the client token.
+func vaultLogin(options vaultOptions, cert tls.Certificate) (string, error) {
+	var rootCAs *x509.CertPool
+	if options.caFile != "" {
+		caData, err := ioutil.ReadFile(options.caFile)
+		if err != nil {
+			return "", err
+		}
+		rootCAs = x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(caData) {
+			return "", fmt.Errorf("no certificates in %s", options.caFile)
+		}
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      rootCAs,
+		MinVersion:   tls.VersionTLS12,
+	}
+	client, err := util.GetHttpClient(tlsConfig,
+		&net.Dialer{Timeout: 10 * time.Second})
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(map[string]string{"name": options.role})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("POST",
+		strings.TrimRight(options.address, "/")+"/v1/auth/"+options.mount+
+			"/login",
+		bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if options.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", options.namespace)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var response struct {
+		Errors []string `json:"errors"`
+		Auth   *struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return "", fmt.Errorf("cannot decode Vault response (%s): %s",
+			resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Vault login failed (%s): %s", resp.Status,
+			strings.Join(response.Errors, ", "))
+	}
+	if response.Auth == nil || response.Auth.ClientToken == "" {
+		return "", errors.New("Vault returned no client token")
+	}
+	return response.Auth.ClientToken, nil
+}
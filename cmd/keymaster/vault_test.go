@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseVaultFlags(t *testing.T) {
+	os.Setenv("VAULT_ADDR", "")
+	if _, err := parseVaultFlags(nil, "/home/user"); err == nil {
+		t.Fatal("missing address should fail")
+	}
+	os.Setenv("VAULT_ADDR", "https://vault.example.com:8200")
+	defer os.Unsetenv("VAULT_ADDR")
+	options, err := parseVaultFlags([]string{"-mount=/auth-cert/"},
+		"/home/user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.address != "https://vault.example.com:8200" ||
+		options.mount != "auth-cert" ||
+		options.tokenFile != "/home/user/.vault-token" {
+		t.Fatalf("unexpected options %+v", options)
+	}
+}
+
+func TestVaultLogin(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "username"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	derCert, err := x509.CreateCertificate(rand.Reader, &template, &template,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			var request map[string]string
+			json.NewDecoder(r.Body).Decode(&request)
+			if r.URL.Path != "/v1/auth/cert/login" ||
+				r.Header.Get("X-Vault-Namespace") != "team" ||
+				request["name"] != "web" ||
+				len(r.TLS.PeerCertificates) != 1 ||
+				r.TLS.PeerCertificates[0].Subject.CommonName != "username" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"errors":["invalid request"]}`))
+				return
+			}
+			w.Write([]byte(`{"auth":{"client_token":"s.token"}}`))
+		}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "vault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	err = ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := vaultOptions{
+		address:   server.URL,
+		caFile:    caFile,
+		mount:     "cert",
+		namespace: "team",
+		role:      "web",
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE",
+		Bytes: derCert})
+	token, err := vaultLogin(options, getTLSCertificate(certPEM, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "s.token" {
+		t.Fatalf("unexpected token %s", token)
+	}
+	options.role = "other"
+	if _, err := vaultLogin(options, getTLSCertificate(certPEM, key)); err == nil {
+		t.Fatal("rejected login should fail")
+	}
+}
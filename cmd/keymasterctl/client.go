@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const adminAPIPath = "/admin/api/v1/"
+
+type adminClient struct {
+	baseURL string
+	client  *http.Client
+}
+
+func newAdminClient() (*adminClient, error) {
+	cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if *rootCAFilename != "" {
+		caData, err := ioutil.ReadFile(*rootCAFilename)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caData) {
+			return nil, errors.New("cannot load root CA file")
+		}
+	}
+	return &adminClient{
+		baseURL: "https://" + *targetHost + ":" + strconv.Itoa(*targetPort),
+		client: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+			Timeout:   30 * time.Second,
+		},
+	}, nil
+}
+
+// call makes an admin API request and decodes the JSON response into
+// response. GET requests send values in the query string, others in the
+// body.
+func (c *adminClient) call(method string, name string, values url.Values,
+	response interface{}) error {
+	requestURL := c.baseURL + adminAPIPath + name
+	var resp *http.Response
+	var err error
+	if method == "GET" {
+		if len(values) > 0 {
+			requestURL += "?" + values.Encode()
+		}
+		resp, err = c.client.Get(requestURL)
+	} else {
+		resp, err = c.client.PostForm(requestURL, values)
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		message := strings.TrimSpace(string(body))
+		if message == "" {
+			message = resp.Status
+		}
+		return fmt.Errorf("%s failed: %s", name, message)
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/issuancelog"
+)
+
+// output is where command results are written.
+var output io.Writer = os.Stdout
+
+type issuanceLogResponse struct {
+	Entries []issuancelog.Entry `json:"entries"`
+}
+
+type revocationResponse struct {
+	CertType string `json:"cert_type"`
+	Serial   string `json:"serial"`
+}
+
+type serviceAccount struct {
+	Name           string     `json:"name"`
+	Groups         []string   `json:"groups"`
+	CertPolicyRule string     `json:"cert_policy_rule"`
+	CreatedBy      string     `json:"created_by"`
+	CreatedAt      time.Time  `json:"created_at"`
+	TokenExpiresAt *time.Time `json:"token_expires_at"`
+}
+
+type localUser struct {
+	User      string    `json:"user"`
+	Groups    []string  `json:"groups"`
+	Disabled  bool      `json:"disabled"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedBy string    `json:"updated_by"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Password  string    `json:"password"`
+}
+
+type principalsResponse struct {
+	User       string   `json:"user"`
+	Groups     []string `json:"groups"`
+	Principals []string `json:"principals"`
+	Mapped     []struct {
+		Group     string `json:"group"`
+		Mapping   string `json:"mapping"`
+		Principal string `json:"principal"`
+	} `json:"mapped"`
+}
+
+type sessionsResponse struct {
+	Username string `json:"username"`
+	Sessions []struct {
+		ID          string    `json:"id"`
+		RemoteAddr  string    `json:"remote_addr"`
+		UserAgent   string    `json:"user_agent"`
+		AuthMethods []string  `json:"auth_methods"`
+		CreatedAt   time.Time `json:"created_at"`
+	} `json:"sessions"`
+}
+
+type devicesResponse struct {
+	User    string `json:"user"`
+	Devices []struct {
+		ID          string    `json:"id"`
+		State       string    `json:"state"`
+		FirstSeen   time.Time `json:"first_seen"`
+		LastSeen    time.Time `json:"last_seen"`
+		LastAddress string    `json:"last_address"`
+		UserAgent   string    `json:"user_agent"`
+		ReviewedBy  string    `json:"reviewed_by"`
+	} `json:"devices"`
+}
+
+type serviceAccountTokenResponse struct {
+	Name      string    `json:"name"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type enrollmentTokenResponse struct {
+	User      string    `json:"user"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// writeServiceAccountToken writes only the token to output, so that it can
+// be redirected to the token file of the service account.
+func writeServiceAccountToken(response serviceAccountTokenResponse) {
+	fmt.Fprintf(os.Stderr, "Refresh token of %s expires at %s\n",
+		response.Name, response.ExpiresAt.Format(time.RFC3339))
+	fmt.Fprintln(output, response.Token)
+}
+
+// localUserCall calls the local user API at path for username with values
+// and writes the resulting user. If the password was generated it is
+// written to output on its own line after the user.
+func localUserCall(client *adminClient, method string, path string,
+	username string, values url.Values) error {
+	if values == nil {
+		values = url.Values{}
+	}
+	values.Set("user", username)
+	var response localUser
+	if err := client.call(method, path, values, &response); err != nil {
+		return err
+	}
+	status := "enabled"
+	if response.Disabled {
+		status = "disabled"
+	}
+	fmt.Fprintf(output, "User: %s (%s)\n", response.User, status)
+	fmt.Fprintf(output, "Groups: %s\n", strings.Join(response.Groups, ","))
+	fmt.Fprintf(output, "Created: %s by %s\n",
+		response.CreatedAt.Format(time.RFC3339), response.CreatedBy)
+	fmt.Fprintf(output, "Updated: %s by %s\n",
+		response.UpdatedAt.Format(time.RFC3339), response.UpdatedBy)
+	if response.Password != "" {
+		fmt.Fprintf(os.Stderr, "Generated password of %s:\n", response.User)
+		fmt.Fprintln(output, response.Password)
+	}
+	return nil
+}
+
+// getLocalUserPasswordValues returns the password read from the file given
+// by -passwordFile, if any.
+func getLocalUserPasswordValues() (url.Values, error) {
+	values := url.Values{}
+	if *passwordFile == "" {
+		return values, nil
+	}
+	password, err := ioutil.ReadFile(*passwordFile)
+	if err != nil {
+		return nil, err
+	}
+	values.Set("password", strings.TrimRight(string(password), "\r\n"))
+	return values, nil
+}
+
+func createLocalUserSubcommand(client *adminClient, args []string) error {
+	values, err := getLocalUserPasswordValues()
+	if err != nil {
+		return err
+	}
+	values["group"] = args[1:]
+	return localUserCall(client, "POST", "local-users", args[0], values)
+}
+
+func deleteLocalUserSubcommand(client *adminClient, args []string) error {
+	return localUserCall(client, "POST", "delete-local-user", args[0], nil)
+}
+
+func disableLocalUserSubcommand(client *adminClient, args []string) error {
+	return localUserCall(client, "POST", "local-user-disabled", args[0],
+		url.Values{"disabled": {"true"}})
+}
+
+func enableLocalUserSubcommand(client *adminClient, args []string) error {
+	return localUserCall(client, "POST", "local-user-disabled", args[0],
+		url.Values{"disabled": {"false"}})
+}
+
+// setDeviceStateSubcommand changes the state of a device and writes the
+// remaining devices.
+func setDeviceStateSubcommand(client *adminClient, args []string) error {
+	var response devicesResponse
+	err := client.call("POST", "set-device-state", url.Values{
+		"user": {args[0]}, "device": {args[1]}, "state": {args[2]}},
+		&response)
+	if err != nil {
+		return err
+	}
+	return writeDevices(response)
+}
+
+func setLocalUserGroupsSubcommand(client *adminClient, args []string) error {
+	return localUserCall(client, "POST", "local-user-groups", args[0],
+		url.Values{"group": args[1:]})
+}
+
+func setLocalUserPasswordSubcommand(client *adminClient, args []string) error {
+	values, err := getLocalUserPasswordValues()
+	if err != nil {
+		return err
+	}
+	return localUserCall(client, "POST", "local-user-password", args[0],
+		values)
+}
+
+func showLocalUserSubcommand(client *adminClient, args []string) error {
+	return localUserCall(client, "GET", "local-users", args[0], nil)
+}
+
+func createServiceAccountSubcommand(client *adminClient, args []string) error {
+	values := url.Values{"name": {args[0]}, "group": args[1:]}
+	if *certPolicyRule != "" {
+		values.Set("cert_policy_rule", *certPolicyRule)
+	}
+	var response serviceAccountTokenResponse
+	err := client.call("POST", "service-accounts", values, &response)
+	if err != nil {
+		return err
+	}
+	writeServiceAccountToken(response)
+	return nil
+}
+
+func deleteServiceAccountSubcommand(client *adminClient, args []string) error {
+	var response serviceAccount
+	err := client.call("POST", "delete-service-account",
+		url.Values{"name": {args[0]}}, &response)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(output, "Deleted service account %s\n", response.Name)
+	return nil
+}
+
+func issueServiceAccountTokenSubcommand(client *adminClient,
+	args []string) error {
+	var response serviceAccountTokenResponse
+	err := client.call("POST", "service-account-token",
+		url.Values{"name": {args[0]}}, &response)
+	if err != nil {
+		return err
+	}
+	writeServiceAccountToken(response)
+	return nil
+}
+
+// issueEnrollmentTokenSubcommand writes only the token to output, so that
+// it can be passed on to the user.
+func issueEnrollmentTokenSubcommand(client *adminClient, args []string) error {
+	var response enrollmentTokenResponse
+	err := client.call("POST", "enrollment-token",
+		url.Values{"user": {args[0]}}, &response)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Enrollment token of %s expires at %s\n",
+		response.User, response.ExpiresAt.Format(time.RFC3339))
+	fmt.Fprintln(output, response.Token)
+	return nil
+}
+
+func issuanceLogSubcommand(client *adminClient, args []string) error {
+	values := url.Values{}
+	if len(args) > 0 {
+		values.Set("user", args[0])
+	}
+	if *since != "" {
+		values.Set("since", *since)
+	}
+	if *until != "" {
+		values.Set("until", *until)
+	}
+	if *limit > 0 {
+		values.Set("limit", strconv.Itoa(*limit))
+	}
+	var response issuanceLogResponse
+	if err := client.call("GET", "issuance-log", values, &response); err != nil {
+		return err
+	}
+	writer := tabwriter.NewWriter(output, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "TIME\tUSER\tTYPE\tSERIAL\tNOT AFTER\tAUTH")
+	for _, entry := range response.Entries {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			entry.Time.Format(time.RFC3339), entry.Username, entry.CertType,
+			entry.Serial, entry.NotAfter.Format(time.RFC3339),
+			strings.Join(entry.AuthMethods, ","))
+	}
+	return writer.Flush()
+}
+
+func listServiceAccountsSubcommand(client *adminClient, args []string) error {
+	var response struct {
+		ServiceAccounts []serviceAccount `json:"service_accounts"`
+	}
+	err := client.call("GET", "service-accounts", nil, &response)
+	if err != nil {
+		return err
+	}
+	writer := tabwriter.NewWriter(output, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "NAME\tGROUPS\tRULE\tCREATED BY\tTOKEN EXPIRES")
+	for _, account := range response.ServiceAccounts {
+		tokenExpires := "-"
+		if account.TokenExpiresAt != nil {
+			tokenExpires = account.TokenExpiresAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", account.Name,
+			strings.Join(account.Groups, ","), account.CertPolicyRule,
+			account.CreatedBy, tokenExpires)
+	}
+	return writer.Flush()
+}
+
+// writeSessions writes the sessions of response as a table.
+func writeSessions(response sessionsResponse) error {
+	writer := tabwriter.NewWriter(output, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tADDRESS\tAUTH\tCREATED\tUSER AGENT")
+	for _, session := range response.Sessions {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", session.ID,
+			session.RemoteAddr, strings.Join(session.AuthMethods, ","),
+			session.CreatedAt.Format(time.RFC3339), session.UserAgent)
+	}
+	return writer.Flush()
+}
+
+// writeDevices writes the devices of response as a table.
+func writeDevices(response devicesResponse) error {
+	writer := tabwriter.NewWriter(output, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tSTATE\tREVIEWED BY\tLAST SEEN\tADDRESS\tUSER AGENT")
+	for _, device := range response.Devices {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\n", device.ID,
+			device.State, device.ReviewedBy,
+			device.LastSeen.Format(time.RFC3339), device.LastAddress,
+			device.UserAgent)
+	}
+	return writer.Flush()
+}
+
+func listDevicesSubcommand(client *adminClient, args []string) error {
+	var response devicesResponse
+	err := client.call("GET", "devices", url.Values{"user": {args[0]}},
+		&response)
+	if err != nil {
+		return err
+	}
+	return writeDevices(response)
+}
+
+func listSessionsSubcommand(client *adminClient, args []string) error {
+	var response sessionsResponse
+	err := client.call("GET", "sessions", url.Values{"user": {args[0]}},
+		&response)
+	if err != nil {
+		return err
+	}
+	return writeSessions(response)
+}
+
+func listUsersSubcommand(client *adminClient, args []string) error {
+	var response struct {
+		Users []string `json:"users"`
+	}
+	if err := client.call("GET", "users", nil, &response); err != nil {
+		return err
+	}
+	for _, user := range response.Users {
+		fmt.Fprintln(output, user)
+	}
+	return nil
+}
+
+func principalsSubcommand(client *adminClient, args []string) error {
+	var response principalsResponse
+	err := client.call("GET", "principals", url.Values{"user": {args[0]}},
+		&response)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(output, "Groups: %s\n", strings.Join(response.Groups, ","))
+	fmt.Fprintf(output, "Principals: %s\n",
+		strings.Join(response.Principals, ","))
+	if len(response.Mapped) < 1 {
+		return nil
+	}
+	writer := tabwriter.NewWriter(output, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "PRINCIPAL\tGROUP\tMAPPING")
+	for _, match := range response.Mapped {
+		fmt.Fprintf(writer, "%s\t%s\t%s\n", match.Principal, match.Group,
+			match.Mapping)
+	}
+	return writer.Flush()
+}
+
+func reencryptStorageSubcommand(client *adminClient, args []string) error {
+	var response struct {
+		CurrentKey string   `json:"current_key"`
+		Users      int      `json:"users"`
+		Resealed   int      `json:"resealed"`
+		Failed     []string `json:"failed"`
+	}
+	err := client.call("POST", "reencrypt-storage", nil, &response)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(output, "Re-encrypted %d of %d profiles with key %s\n",
+		response.Resealed, response.Users, response.CurrentKey)
+	if len(response.Failed) > 0 {
+		return fmt.Errorf("cannot re-encrypt profiles of: %s",
+			strings.Join(response.Failed, ", "))
+	}
+	return nil
+}
+
+func reloadConfigSubcommand(client *adminClient, args []string) error {
+	var response struct {
+		RestartRequired bool `json:"restart_required"`
+	}
+	if err := client.call("POST", "reload-config", nil, &response); err != nil {
+		return err
+	}
+	fmt.Fprintln(output, "Configuration reloaded")
+	if response.RestartRequired {
+		fmt.Fprintln(output,
+			"Some changed settings only take effect after a restart")
+	}
+	return nil
+}
+
+func resetTokensSubcommand(client *adminClient, args []string) error {
+	var response struct {
+		Removed int `json:"removed"`
+	}
+	err := client.call("POST", "reset-tokens",
+		url.Values{"user": {args[0]}, "type": {args[1]}}, &response)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(output, "Removed %d %s registrations of %s\n",
+		response.Removed, args[1], args[0])
+	return nil
+}
+
+// revokeSessionsSubcommand revokes one session, or all if no ID is given,
+// and writes the remaining sessions.
+func revokeSessionsSubcommand(client *adminClient, args []string) error {
+	values := url.Values{"user": {args[0]}}
+	if len(args) > 1 {
+		values.Set("session_id", args[1])
+	}
+	var response sessionsResponse
+	if err := client.call("POST", "revoke-sessions", values,
+		&response); err != nil {
+		return err
+	}
+	return writeSessions(response)
+}
+
+func revokeSubcommand(client *adminClient, args []string) error {
+	values := url.Values{"type": {args[0]}}
+	if *reason != "" {
+		values.Set("reason", *reason)
+	}
+	if args[0] == "ssh-key" {
+		key, err := ioutil.ReadFile(args[1])
+		if err != nil {
+			return err
+		}
+		values.Set("key", string(key))
+	} else {
+		values.Set("serial", args[1])
+	}
+	var response revocationResponse
+	if err := client.call("POST", "revoke", values, &response); err != nil {
+		return err
+	}
+	fmt.Fprintf(output, "Revoked %s %s\n", response.CertType, response.Serial)
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log/cmdlogger"
+)
+
+var (
+	Version        = "No version provided"
+	certFile       = flag.String("cert", "client.pem", "A PEM eoncoded certificate file.")
+	keyFile        = flag.String("key", "key.pem", "A PEM encoded private key file.")
+	certPolicyRule = flag.String("certPolicyRule", "", "Certificate policy rule a new service account is bound to")
+	rootCAFilename = flag.String("rootCAFilename", "", "If present, use this file to verify the keymaster server")
+	targetHost     = flag.String("keymasterHostname", "", "The hostname for keymaster")
+	targetPort     = flag.Int("keymasterPort", 6920, "The port for keymaster control port")
+	limit          = flag.Int("limit", 0, "Maximum number of issuance log entries to show")
+	passwordFile   = flag.String("passwordFile", "", "File with the password of a local user (generated if not given)")
+	reason         = flag.String("reason", "", "Revocation reason (ex: keyCompromise, superseded)")
+	since          = flag.String("since", "", "Show issuance log entries from this RFC 3339 time")
+	until          = flag.String("until", "", "Show issuance log entries before this RFC 3339 time")
+)
+
+type command struct {
+	name        string
+	args        string
+	minArgs     int
+	maxArgs     int
+	description string
+	run         func(client *adminClient, args []string) error
+}
+
+var commands = []command{
+	{"create-local-user", "username [group...]", 1, 100,
+		"Create a local user, printing the password if it was generated",
+		createLocalUserSubcommand},
+	{"create-service-account", "name [group...]", 1, 100,
+		"Create a service account and print its refresh token",
+		createServiceAccountSubcommand},
+	{"delete-local-user", "username", 1, 1, "Delete a local user",
+		deleteLocalUserSubcommand},
+	{"delete-service-account", "name", 1, 1, "Delete a service account",
+		deleteServiceAccountSubcommand},
+	{"disable-local-user", "username", 1, 1, "Disable a local user",
+		disableLocalUserSubcommand},
+	{"enable-local-user", "username", 1, 1, "Enable a local user",
+		enableLocalUserSubcommand},
+	{"issuance-log", "[username]", 0, 1,
+		"Show issued certificates", issuanceLogSubcommand},
+	{"issue-enrollment-token", "username", 1, 1,
+		"Print a token to register a security key without a second factor",
+		issueEnrollmentTokenSubcommand},
+	{"issue-service-account-token", "name", 1, 1,
+		"Revoke the refresh tokens of a service account and print a new one",
+		issueServiceAccountTokenSubcommand},
+	{"list-devices", "username", 1, 1, "List the client devices of a user",
+		listDevicesSubcommand},
+	{"list-service-accounts", "", 0, 0, "List service accounts",
+		listServiceAccountsSubcommand},
+	{"list-sessions", "username", 1, 1, "List the web sessions of a user",
+		listSessionsSubcommand},
+	{"list-users", "", 0, 0, "List users with a profile", listUsersSubcommand},
+	{"principals", "username", 1, 1,
+		"Preview the SSH principals of a user", principalsSubcommand},
+	{"reencrypt-storage", "", 0, 0,
+		"Encrypt all user profiles with the current storage encryption key",
+		reencryptStorageSubcommand},
+	{"reload-config", "", 0, 0, "Reload the server configuration",
+		reloadConfigSubcommand},
+	{"reset-tokens", "username u2f|webauthn|totp|recovery|all", 2, 2,
+		"Remove second factor registrations of a user", resetTokensSubcommand},
+	{"revoke", "x509|ssh serial | ssh-key pubkeyfile", 2, 2,
+		"Revoke a certificate or SSH key", revokeSubcommand},
+	{"revoke-sessions", "username [session-id]", 1, 2,
+		"Revoke a web session of a user, or all of them",
+		revokeSessionsSubcommand},
+	{"set-device-state", "username device-id approved|denied|deleted", 3, 3,
+		"Approve, deny or delete a client device of a user",
+		setDeviceStateSubcommand},
+	{"set-local-user-groups", "username [group...]", 1, 100,
+		"Replace the groups of a local user", setLocalUserGroupsSubcommand},
+	{"set-local-user-password", "username", 1, 1,
+		"Set the password of a local user, printing it if it was generated",
+		setLocalUserPasswordSubcommand},
+	{"show-local-user", "username", 1, 1, "Show a local user",
+		showLocalUserSubcommand},
+}
+
+func Usage() {
+	fmt.Fprintf(os.Stderr, "Usage of %s (version %s):\n", os.Args[0], Version)
+	fmt.Fprintln(os.Stderr, "  keymasterctl [flags...] command [args...]")
+	fmt.Fprintln(os.Stderr, "Common flags:")
+	flag.PrintDefaults()
+	fmt.Fprintln(os.Stderr, "Commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %s %s\n", cmd.name, cmd.args)
+		fmt.Fprintf(os.Stderr, "      %s\n", cmd.description)
+	}
+}
+
+func runCommand(client *adminClient, args []string) error {
+	for _, cmd := range commands {
+		if cmd.name != args[0] {
+			continue
+		}
+		if len(args)-1 < cmd.minArgs || len(args)-1 > cmd.maxArgs {
+			return fmt.Errorf("usage: %s %s", cmd.name, cmd.args)
+		}
+		return cmd.run(client, args[1:])
+	}
+	return fmt.Errorf("unknown command: %s", args[0])
+}
+
+func main() {
+	flag.Usage = Usage
+	flag.Parse()
+	logger := cmdlogger.New()
+	if flag.NArg() < 1 {
+		Usage()
+		os.Exit(2)
+	}
+	if len(*targetHost) < 1 {
+		logger.Fatal("keymasterHostname paramteter  is required")
+	}
+	client, err := newAdminClient()
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if err := runCommand(client, flag.Args()); err != nil {
+		logger.Fatal(err)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/issuancelog"
+)
+
+func newTestClient(t *testing.T) (*adminClient, *bytes.Buffer, func()) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(adminAPIPath+"users", func(w http.ResponseWriter,
+		r *http.Request) {
+		json.NewEncoder(w).Encode(map[string][]string{
+			"users": {"alice", "bob"}})
+	})
+	mux.HandleFunc(adminAPIPath+"issuance-log", func(w http.ResponseWriter,
+		r *http.Request) {
+		if user := r.URL.Query().Get("user"); user != "alice" {
+			t.Errorf("unexpected user: %s", user)
+		}
+		json.NewEncoder(w).Encode(issuanceLogResponse{
+			Entries: []issuancelog.Entry{{
+				Time:        time.Now(),
+				Username:    "alice",
+				CertType:    "ssh",
+				Serial:      "1234",
+				AuthMethods: []string{"password", "U2F"},
+			}}})
+	})
+	mux.HandleFunc(adminAPIPath+"revoke", func(w http.ResponseWriter,
+		r *http.Request) {
+		if r.Method != "POST" {
+			t.Errorf("unexpected method: %s", r.Method)
+		}
+		if r.FormValue("reason") != "superseded" {
+			t.Errorf("unexpected reason: %s", r.FormValue("reason"))
+		}
+		if r.FormValue("serial") == "0" {
+			http.Error(w, "400 Bad Request invalid serial number",
+				http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(revocationResponse{
+			CertType: r.FormValue("type"), Serial: r.FormValue("serial")})
+	})
+	mux.HandleFunc(adminAPIPath+"service-accounts", func(w http.ResponseWriter,
+		r *http.Request) {
+		if r.Method != "POST" {
+			json.NewEncoder(w).Encode(map[string][]serviceAccount{
+				"service_accounts": {{Name: "deploy-bot",
+					Groups: []string{"ci", "deploy"}}}})
+			return
+		}
+		if r.FormValue("cert_policy_rule") != "deploy" ||
+			len(r.Form["group"]) != 2 {
+			t.Errorf("unexpected form: %v", r.Form)
+		}
+		json.NewEncoder(w).Encode(serviceAccountTokenResponse{
+			Name: r.FormValue("name"), Token: "deploy-bot.01.c2VjcmV0"})
+	})
+	mux.HandleFunc(adminAPIPath+"principals", func(w http.ResponseWriter,
+		r *http.Request) {
+		fmt.Fprintf(w, `{"user":%q,"groups":["dba"],`+
+			`"principals":["alice","dbadmin"],"mapped":[`+
+			`{"group":"dba","mapping":"dba","principal":"dbadmin"}]}`,
+			r.FormValue("user"))
+	})
+	mux.HandleFunc(adminAPIPath+"reencrypt-storage", func(w http.ResponseWriter,
+		r *http.Request) {
+		fmt.Fprint(w, `{"current_key":"k2","users":3,"resealed":2,"failed":["carol"]}`)
+	})
+	mux.HandleFunc(adminAPIPath+"local-users", func(w http.ResponseWriter,
+		r *http.Request) {
+		response := localUser{User: r.FormValue("user"), Groups: r.Form["group"]}
+		if r.Method == "POST" && r.FormValue("password") == "" {
+			response.Password = "generated"
+		}
+		json.NewEncoder(w).Encode(response)
+	})
+	mux.HandleFunc(adminAPIPath+"local-user-disabled", func(
+		w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(localUser{User: r.FormValue("user"),
+			Disabled: r.FormValue("disabled") == "true"})
+	})
+	mux.HandleFunc(adminAPIPath+"enrollment-token", func(
+		w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(enrollmentTokenResponse{
+			User: r.FormValue("user"), Token: "dG9rZW4"})
+	})
+	mux.HandleFunc(adminAPIPath+"revoke-sessions", func(
+		w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("session_id") != "" {
+			fmt.Fprint(w, `{"sessions":[{"id":"ab12","remote_addr":"10.0.0.1:443","auth_methods":["password","U2F"]}]}`)
+			return
+		}
+		fmt.Fprint(w, `{"sessions":[]}`)
+	})
+	mux.HandleFunc(adminAPIPath+"set-device-state", func(
+		w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.FormValue("device") != "0a1b" {
+			t.Errorf("unexpected request: %s %v", r.Method, r.Form)
+		}
+		fmt.Fprintf(w, `{"user":"alice","devices":[{"id":"0a1b","state":%q,"reviewed_by":"admin"}]}`,
+			r.FormValue("state"))
+	})
+	server := httptest.NewServer(mux)
+	buffer := &bytes.Buffer{}
+	output = buffer
+	return &adminClient{baseURL: server.URL, client: server.Client()},
+		buffer, server.Close
+}
+
+func TestCommands(t *testing.T) {
+	client, buffer, closeServer := newTestClient(t)
+	defer closeServer()
+	if err := runCommand(client, []string{"list-users"}); err != nil {
+		t.Fatal(err)
+	}
+	if buffer.String() != "alice\nbob\n" {
+		t.Fatalf("unexpected users output: %q", buffer.String())
+	}
+	buffer.Reset()
+	if err := runCommand(client, []string{"issuance-log", "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buffer.String(), "1234") ||
+		!strings.Contains(buffer.String(), "password,U2F") {
+		t.Fatalf("unexpected issuance log output: %q", buffer.String())
+	}
+	buffer.Reset()
+	if err := runCommand(client, []string{"principals", "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buffer.String(), "Principals: alice,dbadmin\n") ||
+		!strings.Contains(buffer.String(), "dbadmin    dba") {
+		t.Fatalf("unexpected principals output: %q", buffer.String())
+	}
+	buffer.Reset()
+	err := runCommand(client, []string{"reencrypt-storage"})
+	if err == nil || !strings.Contains(err.Error(), "carol") {
+		t.Fatalf("expected failed profiles, got %v", err)
+	}
+	if buffer.String() != "Re-encrypted 2 of 3 profiles with key k2\n" {
+		t.Fatalf("unexpected reencrypt output: %q", buffer.String())
+	}
+	buffer.Reset()
+	*reason = "superseded"
+	defer func() { *reason = "" }()
+	if err := runCommand(client, []string{"revoke", "ssh", "42"}); err != nil {
+		t.Fatal(err)
+	}
+	if buffer.String() != "Revoked ssh 42\n" {
+		t.Fatalf("unexpected revoke output: %q", buffer.String())
+	}
+	err = runCommand(client, []string{"revoke", "x509", "0"})
+	if err == nil || !strings.Contains(err.Error(), "invalid serial number") {
+		t.Fatalf("expected server error, got %v", err)
+	}
+}
+
+func TestServiceAccountCommands(t *testing.T) {
+	client, buffer, closeServer := newTestClient(t)
+	defer closeServer()
+	*certPolicyRule = "deploy"
+	defer func() { *certPolicyRule = "" }()
+	err := runCommand(client,
+		[]string{"create-service-account", "deploy-bot", "ci", "deploy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buffer.String() != "deploy-bot.01.c2VjcmV0\n" {
+		t.Fatalf("unexpected token output: %q", buffer.String())
+	}
+	buffer.Reset()
+	if err := runCommand(client, []string{"list-service-accounts"}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buffer.String(), "deploy-bot") ||
+		!strings.Contains(buffer.String(), "ci,deploy") {
+		t.Fatalf("unexpected service accounts output: %q", buffer.String())
+	}
+}
+
+func TestLocalUserCommands(t *testing.T) {
+	client, buffer, closeServer := newTestClient(t)
+	defer closeServer()
+	err := runCommand(client,
+		[]string{"create-local-user", "alice", "ops", "dev"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buffer.String(), "Groups: ops,dev\n") ||
+		!strings.HasSuffix(buffer.String(), "\ngenerated\n") {
+		t.Fatalf("unexpected create output: %q", buffer.String())
+	}
+	buffer.Reset()
+	if err := runCommand(client, []string{"disable-local-user", "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buffer.String(), "User: alice (disabled)\n") {
+		t.Fatalf("unexpected disable output: %q", buffer.String())
+	}
+}
+
+func TestIssueEnrollmentToken(t *testing.T) {
+	client, buffer, closeServer := newTestClient(t)
+	defer closeServer()
+	err := runCommand(client, []string{"issue-enrollment-token", "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buffer.String() != "dG9rZW4\n" {
+		t.Fatalf("unexpected token output: %q", buffer.String())
+	}
+}
+
+func TestRevokeSessions(t *testing.T) {
+	client, buffer, closeServer := newTestClient(t)
+	defer closeServer()
+	err := runCommand(client, []string{"revoke-sessions", "alice", "cd34"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buffer.String(), "ab12") ||
+		!strings.Contains(buffer.String(), "password,U2F") {
+		t.Fatalf("unexpected sessions output: %q", buffer.String())
+	}
+	buffer.Reset()
+	if err := runCommand(client, []string{"revoke-sessions", "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buffer.String(), "ab12") {
+		t.Fatalf("unexpected sessions output: %q", buffer.String())
+	}
+}
+
+func TestSetDeviceState(t *testing.T) {
+	client, buffer, closeServer := newTestClient(t)
+	defer closeServer()
+	err := runCommand(client,
+		[]string{"set-device-state", "alice", "0a1b", "approved"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buffer.String(), "0a1b") ||
+		!strings.Contains(buffer.String(), "approved") {
+		t.Fatalf("unexpected devices output: %q", buffer.String())
+	}
+}
+
+func TestRunCommandUsage(t *testing.T) {
+	for _, args := range [][]string{
+		{"unknown"},
+		{"list-users", "extra"},
+		{"reset-tokens", "alice"},
+	} {
+		if err := runCommand(nil, args); err == nil {
+			t.Fatalf("%v should fail", args)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/authenticators/duo"
+	"github.com/Cloud-Foundations/keymaster/lib/instrumentedwriter"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+	"github.com/Cloud-Foundations/keymaster/proto/eventmon"
+)
+
+// isDuoUser returns true if Duo is enabled for username.
+func (state *RuntimeState) isDuoUser(username string) bool {
+	if state.duoAuthenticator == nil {
+		return false
+	}
+	config := state.Config.Duo
+	if len(config.Users) < 1 && len(config.Groups) < 1 {
+		return true
+	}
+	for _, duoUsername := range config.Users {
+		if duoUsername == username {
+			return true
+		}
+	}
+	if len(config.Groups) < 1 {
+		return false
+	}
+	userGroups, err := state.getUserGroups(username)
+	if err != nil {
+		logger.Printf("cannot get groups of %s for Duo: %s", username, err)
+		return false
+	}
+	for _, duoGroup := range config.Groups {
+		for _, groupName := range userGroups {
+			if groupName == duoGroup {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// getDuoPreauth returns how a user for whom Duo is enabled may authenticate
+// with Duo, or nil.
+func (state *RuntimeState) getDuoPreauth(username string) *duo.PreauthResponse {
+	if !state.isDuoUser(username) {
+		return nil
+	}
+	start := time.Now()
+	preauth, err := state.duoAuthenticator.Preauth(username)
+	if err != nil {
+		logger.Printf("duo preauth error for %s: %s", username, err)
+		return nil
+	}
+	metricLogExternalServiceDuration("duo", time.Since(start))
+	return preauth
+}
+
+// getDuoPushSessionID returns the identifier of the login session of r which
+// Duo pushes are bound to: its web session ID or, if sessions are not
+// tracked, a digest of the auth cookie.
+func (state *RuntimeState) getDuoPushSessionID(r *http.Request) string {
+	if sessionID := state.getRequestWebSessionID(r); sessionID != "" {
+		return sessionID
+	}
+	cookie, err := r.Cookie(authCookieName)
+	if err != nil {
+		return ""
+	}
+	digest := sha256.Sum256([]byte(cookie.Value))
+	return hex.EncodeToString(digest[:])
+}
+
+// duoPushTransaction is a Duo push waiting for an answer, kept in the shared
+// state under the username and push session ID.
+type duoPushTransaction struct {
+	TransactionID string
+}
+
+// checkDuoPush sends a Duo push to username for the login session sessionID,
+// or checks the push sent earlier by any instance, and returns its state.
+func (state *RuntimeState) checkDuoPush(username string, sessionID string) (
+	duo.PushResponse, error) {
+	key := username + "/" + sessionID
+	var push duoPushTransaction
+	ok, err := state.getSharedState(sharedStateDuoPush, key, &push)
+	if err != nil {
+		return duo.PushResponseRejected, err
+	}
+	if !ok {
+		response, txid, err := state.duoAuthenticator.StartPush(username)
+		if err != nil || response != duo.PushResponseWaiting {
+			return response, err
+		}
+		push.TransactionID = txid
+		err = state.putSharedState(sharedStateDuoPush, key, push,
+			time.Now().Add(duo.MaxPushAge))
+		return response, err
+	}
+	response, err := state.duoAuthenticator.CheckPush(username,
+		push.TransactionID)
+	if err != nil || response == duo.PushResponseWaiting {
+		return response, err
+	}
+	if err := state.deleteSharedState(sharedStateDuoPush, key); err != nil {
+		logger.Printf("cannot delete Duo push of %s: %s", username, err)
+	}
+	return response, nil
+}
+
+// checkDuoRequest checks a request to a Duo endpoint. On success it returns
+// the user and their current auth level, otherwise a response has been
+// written.
+func (state *RuntimeState) checkDuoRequest(w http.ResponseWriter,
+	r *http.Request) (string, int, bool) {
+	if state.sendFailureToClientIfLocked(w, r) {
+		return "", AuthTypeNone, false
+	}
+	if r.Method != "POST" {
+		state.writeFailureResponse(w, r, http.StatusMethodNotAllowed, "")
+		return "", AuthTypeNone, false
+	}
+	authUser, currentAuthLevel, err := state.checkAuth(w, r, AuthTypeAny)
+	if err != nil {
+		logger.Debugf(1, "%v", err)
+		return "", AuthTypeNone, false
+	}
+	w.(*instrumentedwriter.LoggingWriter).SetUsername(authUser)
+	if !state.isDuoUser(authUser) {
+		logger.Printf("request for Duo auth, but Duo not enabled for %s",
+			authUser)
+		state.writeFailureResponse(w, r, http.StatusPreconditionFailed,
+			"Duo not enabled")
+		return "", AuthTypeNone, false
+	}
+	return authUser, currentAuthLevel, true
+}
+
+// writeDuoSuccess upgrades the auth cookie after a successful Duo check.
+func (state *RuntimeState) writeDuoSuccess(w http.ResponseWriter,
+	r *http.Request, authUser string, currentAuthLevel int) {
+	eventNotifier.PublishAuthEvent(eventmon.AuthTypeDuo, authUser)
+	_, err := state.updateAuthCookieAuthlevel(w, r,
+		currentAuthLevel|AuthTypeDuo)
+	if err != nil {
+		logger.Printf("Auth Cookie NOT found ? %s", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError,
+			"Failure updating auth cookie")
+		return
+	}
+	switch getPreferredAcceptType(r) {
+	case "text/html":
+		loginDestination := getLoginDestination(r)
+		eventNotifier.PublishWebLoginEvent(authUser)
+		http.Redirect(w, r, loginDestination, 302)
+	default:
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(proto.LoginResponse{Message: "success"})
+	}
+}
+
+func (state *RuntimeState) DuoAuthHandler(w http.ResponseWriter,
+	r *http.Request) {
+	authUser, currentAuthLevel, ok := state.checkDuoRequest(w, r)
+	if !ok {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		logger.Println(err)
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Error parsing form")
+		return
+	}
+	var OTPString string
+	if val, ok := r.Form["OTP"]; ok {
+		if len(val) > 1 {
+			state.writeFailureResponse(w, r, http.StatusBadRequest,
+				"Just one OTP Value allowed")
+			logger.Printf("Login with multiple OTP Values")
+			return
+		}
+		OTPString = val[0]
+	}
+	if OTPString == "" {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Error parsing OTP value")
+		return
+	}
+	attempt := state.checkRateLimit(w, r, authUser, proto.AuthTypeDuo)
+	if attempt == nil {
+		return
+	}
+	defer attempt.release()
+	start := time.Now()
+	valid, err := state.duoAuthenticator.ValidateUserOTP(authUser, OTPString)
+	if err != nil {
+		logger.Println(err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError,
+			"Failure when validating Duo passcode")
+		return
+	}
+	metricLogExternalServiceDuration("duo", time.Since(start))
+	state.logSecondFactorResult(r, authUser, proto.AuthTypeDuo, valid)
+	state.recordRateLimitResult(r, attempt, valid)
+	if !valid {
+		logger.Printf("Invalid Duo passcode login for %s", authUser)
+		state.writeFailureResponse(w, r, http.StatusUnauthorized, "")
+		return
+	}
+	logger.Debugf(1, "Successful Duo passcode auth for user: %s", authUser)
+	state.writeDuoSuccess(w, r, authUser, currentAuthLevel)
+}
+
+func (state *RuntimeState) duoPushHandler(w http.ResponseWriter,
+	r *http.Request) {
+	authUser, currentAuthLevel, ok := state.checkDuoRequest(w, r)
+	if !ok {
+		return
+	}
+	sessionID := state.getDuoPushSessionID(r)
+	if sessionID == "" {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Missing Cookie")
+		return
+	}
+	start := time.Now()
+	response, err := state.checkDuoPush(authUser, sessionID)
+	if err != nil {
+		logger.Println(err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError,
+			"Failure when checking Duo push")
+		return
+	}
+	metricLogExternalServiceDuration("duo", time.Since(start))
+	switch response {
+	case duo.PushResponseWaiting:
+		state.writeFailureResponse(w, r, http.StatusPreconditionFailed,
+			"Duo push pending")
+		return
+	case duo.PushResponseApproved:
+		state.logSecondFactorResult(r, authUser, proto.AuthTypeDuo, true)
+		logger.Debugf(1, "Successful Duo push auth for user: %s", authUser)
+		state.writeDuoSuccess(w, r, authUser, currentAuthLevel)
+	default:
+		state.logSecondFactorResult(r, authUser, proto.AuthTypeDuo, false)
+		logger.Printf("Duo push for %s failed", authUser)
+		state.writeFailureResponse(w, r, http.StatusUnauthorized,
+			"Duo push not approved")
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Cloud-Foundations/keymaster/lib/authenticators/duo"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+// testDuoHandler answers like the Duo Auth API: passcode 123456 is valid and
+// pushes are approved on the first status check.
+func testDuoHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	var response interface{}
+	switch r.URL.Path {
+	case "/auth/v2/preauth":
+		response = map[string]interface{}{
+			"result": "auth",
+			"devices": []map[string]interface{}{
+				{"device": "D1", "capabilities": []string{"push"}},
+			},
+		}
+	case "/auth/v2/auth":
+		switch {
+		case r.Form.Get("factor") == "push":
+			response = map[string]string{"txid": "tx1"}
+		case r.Form.Get("passcode") == "123456":
+			response = map[string]string{"result": "allow"}
+		default:
+			response = map[string]string{"result": "deny"}
+		}
+	case "/auth/v2/auth_status":
+		response = map[string]string{"result": "allow"}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"stat":     "OK",
+		"response": response,
+	})
+}
+
+func TestDuoAuthHandler(t *testing.T) {
+	state, passwdFile, err := setupValidRuntimeStateSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(passwdFile.Name()) // clean up
+	if err := initDB(state); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(testDuoHandler))
+	defer server.Close()
+	state.duoAuthenticator, err = duo.NewTesting(duo.Config{
+		APIHostname:    "api-test.duosecurity.com",
+		IntegrationKey: "integration-key",
+		SecretKey:      "secret-key",
+	}, server.URL, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookieVal, err := state.setNewAuthCookie(nil, nil, "username", AuthTypePassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authCookie := &http.Cookie{Name: authCookieName, Value: cookieVal}
+	otherCookieVal, err := state.setNewAuthCookie(nil, nil, "username",
+		AuthTypePassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCookie := &http.Cookie{Name: authCookieName, Value: otherCookieVal}
+	for otp, expectedStatus := range map[string]int{
+		"000000": http.StatusUnauthorized,
+		"":       http.StatusBadRequest,
+		"123456": http.StatusOK,
+	} {
+		form := url.Values{}
+		form.Set("OTP", otp)
+		req, err := http.NewRequest("POST", proto.DuoAuthPath,
+			strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(authCookie)
+		_, err = checkRequestHandlerCode(req, state.DuoAuthHandler,
+			expectedStatus)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first request sends the push, the second finds it approved. Other
+	// sessions of the user get their own push.
+	for _, test := range []struct {
+		cookie         *http.Cookie
+		expectedStatus int
+	}{
+		{authCookie, http.StatusPreconditionFailed},
+		{otherCookie, http.StatusPreconditionFailed},
+		{authCookie, http.StatusOK},
+	} {
+		req, err := http.NewRequest("POST", proto.DuoPushPath, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.AddCookie(test.cookie)
+		_, err = checkRequestHandlerCode(req, state.duoPushHandler,
+			test.expectedStatus)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDuoPushSharedState(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(testDuoHandler))
+	defer server.Close()
+	var states []*RuntimeState
+	for i := 0; i < 2; i++ {
+		state, passwdFile, err := setupValidRuntimeStateSigner()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(passwdFile.Name()) // clean up
+		if err := initDB(state); err != nil {
+			t.Fatal(err)
+		}
+		state.duoAuthenticator, err = duo.NewTesting(duo.Config{
+			APIHostname:    "api-test.duosecurity.com",
+			IntegrationKey: "integration-key",
+			SecretKey:      "secret-key",
+		}, server.URL, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 {
+			state.sharedState = states[0].sharedState
+		}
+		states = append(states, state)
+	}
+	// The push is sent by one instance and completed by another.
+	if _, err := states[0].checkDuoPush("username", "session1"); err != nil {
+		t.Fatal(err)
+	}
+	response, err := states[1].checkDuoPush("username", "session1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response != duo.PushResponseApproved {
+		t.Fatalf("push not approved: %d", response)
+	}
+	var push duoPushTransaction
+	if ok, _ := states[0].getSharedState(sharedStateDuoPush,
+		"username/session1", &push); ok {
+		t.Fatal("completed push not deleted")
+	}
+}
+
+func TestIsDuoUser(t *testing.T) {
+	state := &RuntimeState{}
+	if state.isDuoUser("username") {
+		t.Fatal("Duo is not enabled")
+	}
+	var err error
+	state.duoAuthenticator, err = duo.New(duo.Config{
+		APIHostname:    "api-test.duosecurity.com",
+		IntegrationKey: "integration-key",
+		SecretKey:      "secret-key",
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !state.isDuoUser("username") {
+		t.Fatal("Duo should be enabled for all users")
+	}
+	state.Config.Duo.Users = []string{"duo-user"}
+	if state.isDuoUser("username") {
+		t.Fatal("Duo should be enabled only for duo-user")
+	}
+	if !state.isDuoUser("duo-user") {
+		t.Fatal("Duo should be enabled for duo-user")
+	}
+}
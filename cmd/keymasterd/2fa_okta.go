@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/authenticators/okta"
+	"github.com/Cloud-Foundations/keymaster/lib/instrumentedwriter"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+	"github.com/Cloud-Foundations/keymaster/proto/eventmon"
+)
+
+const oktaWebAuthnFactorType = "webauthn"
+
+type oktaWebAuthnCredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+type oktaWebAuthnRequestOptions struct {
+	Challenge        string                             `json:"challenge"`
+	RPID             string                             `json:"rpId"`
+	AllowCredentials []oktaWebAuthnCredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                             `json:"userVerification"`
+}
+
+// oktaWebAuthnAssertionOptions are the credential request options for the
+// authenticators a user registered with Okta. As the credentials are scoped
+// to the Okta organisation the client data must name Origin rather than the
+// origin of keymaster, so browsers cannot use them.
+type oktaWebAuthnAssertionOptions struct {
+	PublicKey oktaWebAuthnRequestOptions `json:"publicKey"`
+	Origin    string                     `json:"origin"`
+}
+
+type oktaWebAuthnAssertionResponse struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Response struct {
+		AuthenticatorData string `json:"authenticatorData"`
+		ClientDataJSON    string `json:"clientDataJSON"`
+		Signature         string `json:"signature"`
+	} `json:"response"`
+}
+
+// getOktaUserFactors returns the Okta MFA factors of a user, or nil. With an
+// Okta API token the enrolled factors are listed with the Okta Factors API,
+// otherwise (or if that fails) the factors of a recent Okta password
+// authentication are used.
+func (state *RuntimeState) getOktaUserFactors(username string) []okta.UserFactor {
+	if state.oktaAuthenticator == nil {
+		return nil
+	}
+	if apiToken := state.Config.Okta.APIToken; apiToken != "" {
+		factors, err := state.oktaAuthenticator.GetEnrolledFactors(username,
+			apiToken)
+		if err == nil {
+			return factors
+		}
+		logger.Debugf(1, "cannot list enrolled okta factors for %s: %s",
+			username, err)
+	}
+	factors, err := state.oktaAuthenticator.GetUserFactors(username)
+	if err != nil {
+		logger.Debugf(1, "cannot get okta factors for %s: %s", username, err)
+		return nil
+	}
+	return factors
+}
+
+func (state *RuntimeState) userHasOktaWebAuthn(username string) bool {
+	for _, factor := range state.getOktaUserFactors(username) {
+		if factor.FactorType == oktaWebAuthnFactorType &&
+			(factor.Status == "" || factor.Status == "ACTIVE") {
+			return true
+		}
+	}
+	return false
+}
+
+func (state *RuntimeState) oktaWebAuthnAuthBegin(w http.ResponseWriter,
+	r *http.Request) {
+	if state.sendFailureToClientIfLocked(w, r) {
+		return
+	}
+	if state.oktaAuthenticator == nil {
+		http.Error(w, "okta not configured", http.StatusNotFound)
+		return
+	}
+	authUser, _, err := state.checkAuth(w, r, AuthTypeAny)
+	if err != nil {
+		logger.Debugf(1, "%v", err)
+		return
+	}
+	w.(*instrumentedwriter.LoggingWriter).SetUsername(authUser)
+	start := time.Now()
+	challenge, err := state.oktaAuthenticator.StartWebAuthnVerify(authUser)
+	if err != nil {
+		logger.Printf("okta StartWebAuthnVerify error: %v", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	metricLogExternalServiceDuration("okta", time.Since(start))
+	if challenge == nil {
+		http.Error(w, "no okta WebAuthn factor", http.StatusBadRequest)
+		return
+	}
+	options := oktaWebAuthnAssertionOptions{
+		PublicKey: oktaWebAuthnRequestOptions{
+			Challenge:        challenge.Challenge,
+			RPID:             challenge.RPID,
+			UserVerification: "discouraged",
+		},
+		Origin: challenge.Origin,
+	}
+	for _, credentialId := range challenge.CredentialIds {
+		options.PublicKey.AllowCredentials = append(
+			options.PublicKey.AllowCredentials,
+			oktaWebAuthnCredentialDescriptor{Type: "public-key",
+				ID: credentialId})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(options); err != nil {
+		logger.Printf("json encofing error: %v", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (state *RuntimeState) oktaWebAuthnAuthFinish(w http.ResponseWriter,
+	r *http.Request) {
+	if state.sendFailureToClientIfLocked(w, r) {
+		return
+	}
+	if state.oktaAuthenticator == nil {
+		http.Error(w, "okta not configured", http.StatusNotFound)
+		return
+	}
+	authUser, currentAuthLevel, err := state.checkAuth(w, r, AuthTypeAny)
+	if err != nil {
+		logger.Debugf(1, "%v", err)
+		return
+	}
+	w.(*instrumentedwriter.LoggingWriter).SetUsername(authUser)
+	var assertion oktaWebAuthnAssertionResponse
+	if err := json.NewDecoder(r.Body).Decode(&assertion); err != nil {
+		http.Error(w, "bad assertion", http.StatusBadRequest)
+		return
+	}
+	start := time.Now()
+	valid, err := state.oktaAuthenticator.ValidateWebAuthnAssertion(authUser,
+		okta.WebAuthnAssertion{
+			ClientData:        assertion.Response.ClientDataJSON,
+			AuthenticatorData: assertion.Response.AuthenticatorData,
+			SignatureData:     assertion.Response.Signature,
+		})
+	if err != nil {
+		logger.Printf("okta ValidateWebAuthnAssertion error: %v", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	metricLogExternalServiceDuration("okta", time.Since(start))
+	state.logSecondFactorResult(r, authUser, proto.AuthTypeOkta2FA, valid)
+	if !valid {
+		http.Error(w, "error verifying response", http.StatusUnauthorized)
+		return
+	}
+	eventNotifier.PublishAuthEvent(eventmon.AuthTypeOkta2FA, authUser)
+	_, err = state.updateAuthCookieAuthlevel(w, r,
+		currentAuthLevel|AuthTypeOkta2FA)
+	if err != nil {
+		logger.Printf("Auth Cookie NOT found ? %s", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError,
+			"Failure updating auth cookie")
+		return
+	}
+	w.Write([]byte("success"))
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log/testlogger"
+	"github.com/Cloud-Foundations/keymaster/lib/authenticators/okta"
+)
+
+func TestGetOktaUserFactorsWithAPIToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/api/v1/users/username/factors" ||
+				r.Header.Get("Authorization") != "SSWS test-api-token" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode([]okta.OktaApiMFAFactorsType{{
+				Id:         "webauthn-id",
+				FactorType: oktaWebAuthnFactorType,
+				Provider:   "FIDO",
+				VendorName: "FIDO",
+				Status:     "ACTIVE",
+			}})
+		}))
+	defer server.Close()
+	oktaAuthenticator, err := okta.NewPublicTesting(server.URL+"/api/v1/authn",
+		testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := &RuntimeState{oktaAuthenticator: oktaAuthenticator}
+	// Without an API token only a recent password login has factors.
+	if state.userHasOktaWebAuthn("username") {
+		t.Fatal("factors found without a password login")
+	}
+	state.Config.Okta.APIToken = "test-api-token"
+	if !state.userHasOktaWebAuthn("username") {
+		t.Fatal("enrolled factors not listed")
+	}
+	// Failures fall back to the password login.
+	if factors := state.getOktaUserFactors("unknown"); factors != nil {
+		t.Fatalf("unexpected factors: %+v", factors)
+	}
+}
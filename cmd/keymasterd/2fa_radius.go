@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/instrumentedwriter"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+	"github.com/Cloud-Foundations/keymaster/proto/eventmon"
+)
+
+const maxAgeSecondsRADIUSChallenge = 300
+
+func (state *RuntimeState) writeRADIUSChallenge(w http.ResponseWriter,
+	r *http.Request, username string, message string,
+	radiusState []byte) {
+	key, err := state.putPendingChallenge(sharedStateRADIUS, username,
+		radiusState, maxAgeSecondsRADIUSChallenge*time.Second)
+	if err != nil {
+		logger.Printf("cannot save pending RADIUS challenge: %s", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError,
+			"error internal")
+		return
+	}
+	switch getPreferredAcceptType(r) {
+	case "text/html":
+		displayData := secondFactorAuthTemplateData{
+			Title:            "Keymaster 2FA Auth",
+			ShowRADIUS:       true,
+			RADIUSMessage:    message,
+			RADIUSState:      key,
+			LoginDestination: getLoginDestination(r)}
+		err := state.htmlTemplate.ExecuteTemplate(w, "secondFactorLoginPage",
+			displayData)
+		if err != nil {
+			logger.Printf("Failed to execute %v", err)
+			http.Error(w, "error", http.StatusInternalServerError)
+		}
+	default:
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(proto.RADIUSChallenge{
+			Message: message,
+			State:   key,
+		})
+	}
+}
+
+func (state *RuntimeState) RADIUSAuthHandler(w http.ResponseWriter,
+	r *http.Request) {
+	if state.sendFailureToClientIfLocked(w, r) {
+		return
+	}
+	if r.Method != "POST" {
+		state.writeFailureResponse(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		logger.Println(err)
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Error parsing form")
+		return
+	}
+	authUser, currentAuthLevel, err := state.checkAuth(w, r, AuthTypeAny)
+	if err != nil {
+		logger.Debugf(1, "%v", err)
+		return
+	}
+	w.(*instrumentedwriter.LoggingWriter).SetUsername(authUser)
+	if state.radiusAuthenticator == nil {
+		logger.Printf("request for RADIUS auth, but RADIUS not enabled")
+		state.writeFailureResponse(w, r, http.StatusPreconditionFailed,
+			"RADIUS not enabled")
+		return
+	}
+	var OTPString string
+	if val, ok := r.Form["OTP"]; ok {
+		if len(val) > 1 {
+			state.writeFailureResponse(w, r, http.StatusBadRequest,
+				"Just one OTP Value allowed")
+			logger.Printf("Login with multiple OTP Values")
+			return
+		}
+		OTPString = val[0]
+	}
+	if OTPString == "" {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Missing OTP value")
+		return
+	}
+	var radiusState []byte
+	if key := r.Form.Get("state"); key != "" {
+		var ok bool
+		radiusState, ok = state.takePendingChallenge(sharedStateRADIUS, key,
+			authUser)
+		if !ok {
+			state.writeFailureResponse(w, r, http.StatusBadRequest,
+				"Invalid or expired RADIUS challenge")
+			return
+		}
+	}
+
+	attempt := state.checkRateLimit(w, r, authUser, proto.AuthTypeRADIUS)
+	if attempt == nil {
+		return
+	}
+	defer attempt.release()
+	start := time.Now()
+	response, err := state.radiusAuthenticator.Authenticate(authUser,
+		OTPString, radiusState)
+	if err != nil {
+		logger.Println(err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError,
+			"Failure when validating RADIUS passcode")
+		return
+	}
+	metricLogExternalServiceDuration("radius", time.Since(start))
+	if response.Challenge {
+		logger.Debugf(1, "RADIUS challenge for user: %s", authUser)
+		state.writeRADIUSChallenge(w, r, authUser, response.Message,
+			response.State)
+		return
+	}
+	state.logSecondFactorResult(r, authUser, proto.AuthTypeRADIUS,
+		response.Accepted)
+	state.recordRateLimitResult(r, attempt, response.Accepted)
+	if !response.Accepted {
+		logger.Printf("Invalid RADIUS passcode login for %s", authUser)
+		state.writeFailureResponse(w, r, http.StatusUnauthorized, "")
+		return
+	}
+
+	logger.Debugf(1, "Successful RADIUS auth for user: %s", authUser)
+	eventNotifier.PublishAuthEvent(eventmon.AuthTypeRADIUS, authUser)
+	_, err = state.updateAuthCookieAuthlevel(w, r,
+		currentAuthLevel|AuthTypeRADIUS)
+	if err != nil {
+		logger.Printf("Auth Cookie NOT found ? %s", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError,
+			"Failure updating auth cookie")
+		return
+	}
+	switch getPreferredAcceptType(r) {
+	case "text/html":
+		loginDestination := getLoginDestination(r)
+		eventNotifier.PublishWebLoginEvent(authUser)
+		http.Redirect(w, r, loginDestination, 302)
+	default:
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(proto.RADIUSChallenge{Message: "success"})
+	}
+}
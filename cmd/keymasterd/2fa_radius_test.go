@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Cloud-Foundations/keymaster/lib/authenticators/radius"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+const (
+	testRADIUSSecret = "radius-secret"
+	testRADIUSState  = "next-code"
+)
+
+// startTestRADIUSServer runs a RADIUS server which accepts "123456", and
+// "987654" after challenging "challenge".
+func startTestRADIUSServer(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buffer := make([]byte, 4096)
+		for {
+			nRead, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			request := buffer[:nRead]
+			requestAuthenticator := request[4:20]
+			var password, state []byte
+			for offset := 20; offset+2 <= len(request); {
+				length := int(request[offset+1])
+				if length < 2 || offset+length > len(request) {
+					break
+				}
+				value := request[offset+2 : offset+length]
+				switch request[offset] {
+				case 2: // User-Password.
+					previous := requestAuthenticator
+					for index := 0; index+md5.Size <= len(value); index += md5.Size {
+						sum := md5.Sum(append([]byte(testRADIUSSecret),
+							previous...))
+						for i := range sum {
+							password = append(password, value[index+i]^sum[i])
+						}
+						previous = value[index : index+md5.Size]
+					}
+					password = bytes.TrimRight(password, "\x00")
+				case 24: // State.
+					state = value
+				}
+				offset += length
+			}
+			code := byte(3)
+			var attributes []byte
+			switch {
+			case string(password) == "123456" && state == nil:
+				code = 2
+			case string(password) == "challenge" && state == nil:
+				code = 11
+				attributes = append([]byte{18, 2 + 15}, "Enter next code"...)
+				attributes = append(attributes, 24, 2+byte(len(testRADIUSState)))
+				attributes = append(attributes, testRADIUSState...)
+			case string(password) == "987654" &&
+				string(state) == testRADIUSState:
+				code = 2
+			}
+			response := make([]byte, 20, 20+len(attributes))
+			response[0] = code
+			response[1] = request[1]
+			binary.BigEndian.PutUint16(response[2:4],
+				uint16(20+len(attributes)))
+			copy(response[4:20], requestAuthenticator)
+			response = append(response, attributes...)
+			sum := md5.Sum(append(append([]byte{}, response...),
+				testRADIUSSecret...))
+			copy(response[4:20], sum[:])
+			conn.WriteTo(response, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func postRADIUSAuth(t *testing.T, state *RuntimeState, authCookie *http.Cookie,
+	otp string, challengeState string,
+	expectedStatus int) proto.RADIUSChallenge {
+	form := url.Values{}
+	form.Set("OTP", otp)
+	if challengeState != "" {
+		form.Set("state", challengeState)
+	}
+	req, err := http.NewRequest("POST", proto.RADIUSAuthPath,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.AddCookie(authCookie)
+	rr, err := checkRequestHandlerCode(req, state.RADIUSAuthHandler,
+		expectedStatus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var challenge proto.RADIUSChallenge
+	if expectedStatus == http.StatusOK {
+		if err := json.NewDecoder(rr.Body).Decode(&challenge); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return challenge
+}
+
+func TestRADIUSAuthHandler(t *testing.T) {
+	state, passwdFile, err := setupValidRuntimeStateSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(passwdFile.Name()) // clean up
+	state.radiusAuthenticator, err = radius.New(radius.Config{
+		ServerAddresses: []string{startTestRADIUSServer(t)},
+		SharedSecret:    testRADIUSSecret,
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookieVal, err := state.setNewAuthCookie(nil, nil, "username", AuthTypePassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authCookie := &http.Cookie{Name: authCookieName, Value: cookieVal}
+
+	postRADIUSAuth(t, state, authCookie, "000000", "", http.StatusUnauthorized)
+	response := postRADIUSAuth(t, state, authCookie, "123456", "",
+		http.StatusOK)
+	if response.State != "" {
+		t.Fatalf("unexpected challenge: %+v", response)
+	}
+	challenge := postRADIUSAuth(t, state, authCookie, "challenge", "",
+		http.StatusOK)
+	if challenge.State == "" || challenge.Message != "Enter next code" {
+		t.Fatalf("bad challenge: %+v", challenge)
+	}
+	response = postRADIUSAuth(t, state, authCookie, "987654", challenge.State,
+		http.StatusOK)
+	if response.State != "" {
+		t.Fatalf("unexpected challenge: %+v", response)
+	}
+	// Challenges can only be answered once.
+	postRADIUSAuth(t, state, authCookie, "987654", challenge.State,
+		http.StatusBadRequest)
+}
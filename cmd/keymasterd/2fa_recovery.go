@@ -0,0 +1,276 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/auditlog"
+	"github.com/Cloud-Foundations/keymaster/lib/instrumentedwriter"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+	"github.com/Cloud-Foundations/keymaster/proto/eventmon"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	numRecoveryCodes     = 10
+	recoveryCodeLength   = 10
+	recoveryCodeAlphabet = "23456789abcdefghjkmnpqrstuvwxyz"
+)
+
+// normalizeRecoveryCode lowercases code and removes the dashes and spaces
+// users may type.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// generateRecoveryCodes returns new recovery codes formatted for display
+// and their hashes to be stored in the user profile.
+func generateRecoveryCodes() ([]string, []recoveryCodeData, error) {
+	alphabetSize := big.NewInt(int64(len(recoveryCodeAlphabet)))
+	codes := make([]string, 0, numRecoveryCodes)
+	hashes := make([]recoveryCodeData, 0, numRecoveryCodes)
+	now := time.Now()
+	for i := 0; i < numRecoveryCodes; i++ {
+		code := make([]byte, recoveryCodeLength)
+		for j := range code {
+			n, err := rand.Int(rand.Reader, alphabetSize)
+			if err != nil {
+				return nil, nil, err
+			}
+			code[j] = recoveryCodeAlphabet[n.Int64()]
+		}
+		hash, err := bcrypt.GenerateFromPassword(code, bcrypt.DefaultCost)
+		if err != nil {
+			return nil, nil, err
+		}
+		half := recoveryCodeLength / 2
+		codes = append(codes, string(code[:half])+"-"+string(code[half:]))
+		hashes = append(hashes, recoveryCodeData{Hash: hash, CreatedAt: now})
+	}
+	return codes, hashes, nil
+}
+
+// useRecoveryCode removes the recovery code matching code from profile and
+// returns true, or returns false if no code matches.
+func useRecoveryCode(profile *userProfile, code string) bool {
+	code = normalizeRecoveryCode(code)
+	if len(code) != recoveryCodeLength {
+		return false
+	}
+	for i, data := range profile.RecoveryCodes {
+		if bcrypt.CompareHashAndPassword(data.Hash, []byte(code)) == nil {
+			profile.RecoveryCodes = append(profile.RecoveryCodes[:i],
+				profile.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (state *RuntimeState) userHasRecoveryCodes(username string) bool {
+	if !state.Config.Base.EnableRecoveryCodes {
+		return false
+	}
+	profile, _, _, err := state.LoadUserProfile(username)
+	if err != nil {
+		logger.Printf("loading profile error: %v", err)
+		return false
+	}
+	return len(profile.RecoveryCodes) > 0
+}
+
+func (state *RuntimeState) recoveryCodesHandler(w http.ResponseWriter,
+	r *http.Request) {
+	if state.sendFailureToClientIfLocked(w, r) {
+		return
+	}
+	if r.Method != "POST" {
+		state.writeFailureResponse(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	authUser, loginLevel, err := state.checkAuth(w, r,
+		state.getRequiredWebUIAuthLevel())
+	if err != nil {
+		logger.Debugf(1, "%v", err)
+		return
+	}
+	w.(*instrumentedwriter.LoggingWriter).SetUsername(authUser)
+	if !state.Config.Base.EnableRecoveryCodes {
+		state.writeFailureResponse(w, r, http.StatusPreconditionFailed,
+			"Recovery codes not enabled")
+		return
+	}
+	profile, _, fromCache, err := state.LoadUserProfile(authUser)
+	if err != nil {
+		logger.Printf("loading profile error: %v", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	if fromCache {
+		state.writeFailureResponse(w, r, http.StatusServiceUnavailable,
+			"DB in cached state, cannot create recovery codes now")
+		return
+	}
+	// Recovery codes are a second factor, so a stolen password must not be
+	// enough to create them.
+	usedToken, err := state.checkKeyEnrollment(r, loginLevel, profile,
+		time.Now())
+	if err != nil {
+		state.writeKeyEnrollmentDenial(w, r, authUser, authUser, err)
+		return
+	}
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		logger.Printf("generating recovery codes error: %v", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	profile.RecoveryCodes = hashes
+	if usedToken {
+		profile.EnrollmentToken = nil
+	}
+	if err := state.SaveUserProfile(authUser, profile); err != nil {
+		logger.Printf("Saving profile error: %v", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	state.logAuditEvent(r, auditlog.Event{
+		Type:     auditlog.EventTypeRecoveryCodes,
+		Username: authUser,
+		Success:  true,
+		Method:   "generate",
+		Details:  map[string]string{"count": strconv.Itoa(len(codes))},
+	})
+	switch getPreferredAcceptType(r) {
+	case "text/html":
+		displayData := recoveryCodesPageTemplateData{
+			Title:        "Keymaster Recovery Codes",
+			AuthUsername: authUser,
+			Codes:        codes,
+		}
+		err := state.htmlTemplate.ExecuteTemplate(w, "recoveryCodesPage",
+			displayData)
+		if err != nil {
+			logger.Printf("Failed to execute %v", err)
+			http.Error(w, "error", http.StatusInternalServerError)
+		}
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(proto.RecoveryCodesResponse{Codes: codes})
+	}
+}
+
+func (state *RuntimeState) RecoveryCodeAuthHandler(w http.ResponseWriter,
+	r *http.Request) {
+	if state.sendFailureToClientIfLocked(w, r) {
+		return
+	}
+	if r.Method != "POST" {
+		state.writeFailureResponse(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		logger.Println(err)
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Error parsing form")
+		return
+	}
+	authUser, currentAuthLevel, err := state.checkAuth(w, r, AuthTypeAny)
+	if err != nil {
+		logger.Debugf(1, "%v", err)
+		return
+	}
+	w.(*instrumentedwriter.LoggingWriter).SetUsername(authUser)
+	if !state.Config.Base.EnableRecoveryCodes {
+		state.writeFailureResponse(w, r, http.StatusPreconditionFailed,
+			"Recovery codes not enabled")
+		return
+	}
+	val, ok := r.Form["OTP"]
+	if !ok {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"No recovery code submitted")
+		return
+	}
+	if len(val) > 1 {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Just one OTP Value allowed")
+		logger.Printf("Login with multiple OTP Values")
+		return
+	}
+	_, _, fromCache, err := state.LoadUserProfile(authUser)
+	if err != nil {
+		logger.Printf("loading profile error: %v", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	if fromCache {
+		// A used code could not be invalidated.
+		state.writeFailureResponse(w, r, http.StatusServiceUnavailable,
+			"DB in cached state, cannot use recovery codes now")
+		return
+	}
+	attempt := state.checkRateLimit(w, r, authUser, proto.AuthTypeRecoveryCode)
+	if attempt == nil {
+		return
+	}
+	defer attempt.release()
+	// The code is checked against the latest profile, so that it can only
+	// be used once, even by concurrent requests to several servers.
+	var valid bool
+	var remaining int
+	err = state.UpdateUserProfile(authUser,
+		func(profile *userProfile) (bool, error) {
+			valid = useRecoveryCode(profile, val[0])
+			remaining = len(profile.RecoveryCodes)
+			return valid, nil
+		})
+	if err != nil {
+		logger.Printf("Saving profile error: %v", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	state.logSecondFactorResult(r, authUser, proto.AuthTypeRecoveryCode, valid)
+	state.recordRateLimitResult(r, attempt, valid)
+	if !valid {
+		logger.Printf("Invalid recovery code for %s", authUser)
+		state.writeFailureResponse(w, r, http.StatusUnauthorized,
+			"Invalid recovery code")
+		return
+	}
+	state.logAuditEvent(r, auditlog.Event{
+		Type:     auditlog.EventTypeRecoveryCodes,
+		Username: authUser,
+		Success:  true,
+		Method:   "use",
+		Details: map[string]string{
+			"remaining": strconv.Itoa(remaining),
+		},
+	})
+
+	logger.Debugf(1, "Successful recovery code auth for user: %s", authUser)
+	eventNotifier.PublishAuthEvent(eventmon.AuthTypeRecoveryCode, authUser)
+	_, err = state.updateAuthCookieAuthlevel(w, r,
+		currentAuthLevel|AuthTypeRecoveryCode)
+	if err != nil {
+		logger.Printf("Auth Cookie NOT found ? %s", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError,
+			"Failure updating auth cookie")
+		return
+	}
+	switch getPreferredAcceptType(r) {
+	case "text/html":
+		loginDestination := getLoginDestination(r)
+		eventNotifier.PublishWebLoginEvent(authUser)
+		http.Redirect(w, r, loginDestination, 302)
+	default:
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(proto.LoginResponse{Message: "success"})
+	}
+}
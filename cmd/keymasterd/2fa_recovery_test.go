@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+func setupRecoveryCodesTestState(t *testing.T) (*RuntimeState, *http.Cookie) {
+	var state RuntimeState
+	signer, err := getSignerFromPEMBytes([]byte(testSignerPrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.Signer = signer
+	state.signerPublicKeyToKeymasterKeys()
+	dir, err := ioutil.TempDir("", "recovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	state.Config.Base.DataDirectory = dir
+	state.Config.Base.AllowedAuthBackendsForWebUI = []string{"password"}
+	state.Config.Base.EnableRecoveryCodes = true
+	if err := initDB(&state); err != nil {
+		t.Fatal(err)
+	}
+	cookieVal, err := state.setNewAuthCookie(nil, nil, "username",
+		AuthTypePassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &state, &http.Cookie{Name: authCookieName, Value: cookieVal}
+}
+
+func postRecoveryCode(t *testing.T, state *RuntimeState,
+	authCookie *http.Cookie, code string, expectedStatus int) {
+	form := url.Values{}
+	form.Add("OTP", code)
+	req, err := http.NewRequest("POST", proto.RecoveryCodeAuthPath,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(authCookie)
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	_, err = checkRequestHandlerCode(req, state.RecoveryCodeAuthHandler,
+		expectedStatus)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	state, authCookie := setupRecoveryCodesTestState(t)
+	if state.userHasRecoveryCodes("username") {
+		t.Fatal("user should have no recovery codes")
+	}
+	req, err := http.NewRequest("POST", proto.RecoveryCodesPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(authCookie)
+	rr, err := checkRequestHandlerCode(req, state.recoveryCodesHandler,
+		http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response proto.RecoveryCodesResponse
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Codes) != numRecoveryCodes {
+		t.Fatalf("expected %d codes, got %d", numRecoveryCodes,
+			len(response.Codes))
+	}
+	if !state.userHasRecoveryCodes("username") {
+		t.Fatal("user should have recovery codes")
+	}
+	postRecoveryCode(t, state, authCookie, "aaaaa-aaaaa",
+		http.StatusUnauthorized)
+	// Codes are accepted without the dash and in upper case, but only once.
+	code := strings.ToUpper(strings.Replace(response.Codes[0], "-", "", 1))
+	postRecoveryCode(t, state, authCookie, code, http.StatusOK)
+	postRecoveryCode(t, state, authCookie, response.Codes[0],
+		http.StatusUnauthorized)
+	profile, _, _, err := state.LoadUserProfile("username")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profile.RecoveryCodes) != numRecoveryCodes-1 {
+		t.Fatalf("expected %d codes left, got %d", numRecoveryCodes-1,
+			len(profile.RecoveryCodes))
+	}
+	// Generating new codes invalidates the old ones.
+	_, err = checkRequestHandlerCode(req, state.recoveryCodesHandler,
+		http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	postRecoveryCode(t, state, authCookie, response.Codes[1],
+		http.StatusUnauthorized)
+}
+
+func TestRecoveryCodesDisabled(t *testing.T) {
+	state, authCookie := setupRecoveryCodesTestState(t)
+	state.Config.Base.EnableRecoveryCodes = false
+	req, err := http.NewRequest("POST", proto.RecoveryCodesPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(authCookie)
+	_, err = checkRequestHandlerCode(req, state.recoveryCodesHandler,
+		http.StatusPreconditionFailed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	postRecoveryCode(t, state, authCookie, "aaaaa-aaaaa",
+		http.StatusPreconditionFailed)
+}
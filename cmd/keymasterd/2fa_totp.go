@@ -11,21 +11,24 @@ import (
 	"fmt"
 	"html/template"
 	"image/png"
-	"math"
 	"net/http"
 	"regexp"
 	"strconv"
 	"time"
 
+	"github.com/Cloud-Foundations/keymaster/lib/authenticators/totp"
 	"github.com/Cloud-Foundations/keymaster/lib/instrumentedwriter"
 	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
-	"github.com/pquerna/otp/totp"
+	"github.com/pquerna/otp"
 )
 
 const labelRSA = "totp:rsa:"
 const totpGeneratNewPath = "/totp/GenerateNew/"
 const totpValidateNewPath = "/totp/ValidateNew/"
 
+// totpValidationSkew is the number of periods of clock drift accepted.
+const totpValidationSkew = 1
+
 func (state *RuntimeState) encryptWithPublicKeys(clearTextMessage []byte) ([][]byte, error) {
 	var cipherTexts [][]byte
 	for _, key := range state.KeymasterPublicKeys {
@@ -69,12 +72,74 @@ func (state *RuntimeState) decryptWithPublicKeys(cipherTexts [][]byte) ([]byte,
 	return nil, errors.New("Cannot decrypt Message")
 }
 
+// generatePendingTOTP creates a new key for username and saves it encrypted
+// in profile as the pending secret until it is confirmed.
+func (state *RuntimeState) generatePendingTOTP(username string,
+	profile *userProfile) (*totp.Key, error) {
+	logger.Debugf(2, "%v", profile)
+	key, err := totp.GenerateKey(state.HostIdentity, username)
+	if err != nil {
+		return nil, err
+	}
+	encryptedKeys, err := state.encryptWithPublicKeys([]byte(key.Secret))
+	if err != nil {
+		return nil, err
+	}
+	profile.PendingTOTPSecret = &encryptedKeys
+	if err := state.SaveUserProfile(username, profile); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// confirmPendingTOTP activates the pending secret of username if otpValue,
+// entered in request r, is a current code for it. If usedToken is true the
+// enrollment token of profile is removed.
+func (state *RuntimeState) confirmPendingTOTP(r *http.Request,
+	username string, profile *userProfile, otpValue int,
+	usedToken bool) (bool, error) {
+	if profile.PendingTOTPSecret == nil {
+		return false, errors.New("No pending Secrets")
+	}
+	// TODO: The encrypted value MUST have also an expiration
+	clearTextKey, err := state.decryptWithPublicKeys(*profile.PendingTOTPSecret)
+	if err != nil {
+		return false, err
+	}
+	_, valid, err := totp.Validate(string(clearTextKey),
+		fmt.Sprintf("%06d", otpValue), time.Now(), totpValidationSkew)
+	if err != nil || !valid {
+		return false, err
+	}
+	// TODO: check if same secret already there
+	newTOTPAuthData := totpAuthData{
+		CreatedAt:       time.Now(),
+		EncryptedSecret: *profile.PendingTOTPSecret,
+		ValidatorAddr:   r.RemoteAddr,
+		Enabled:         true,
+	}
+	newIndex := newTOTPAuthData.CreatedAt.Unix()
+	for _, exists := profile.TOTPAuthData[newIndex]; exists; _, exists = profile.TOTPAuthData[newIndex] {
+		newIndex++
+	}
+	profile.TOTPAuthData[newIndex] = &newTOTPAuthData
+	profile.PendingTOTPSecret = nil
+	if usedToken {
+		profile.EnrollmentToken = nil
+	}
+	if err := state.SaveUserProfile(username, profile); err != nil {
+		return false, err
+	}
+	state.logAuditEnrollment(r, username, proto.AuthTypeTOTP)
+	return true, nil
+}
+
 func (state *RuntimeState) GenerateNewTOTP(w http.ResponseWriter, r *http.Request) {
 	if state.sendFailureToClientIfLocked(w, r) {
 		return
 	}
 	// TODO: think if we are going to allow admins to register these tokens
-	authUser, _, err := state.checkAuth(w, r, state.getRequiredWebUIAuthLevel())
+	authUser, loginLevel, err := state.checkAuth(w, r, state.getRequiredWebUIAuthLevel())
 	if err != nil {
 		logger.Debugf(1, "%v", err)
 		return
@@ -96,34 +161,27 @@ func (state *RuntimeState) GenerateNewTOTP(w http.ResponseWriter, r *http.Reques
 		state.writeFailureResponse(w, r, http.StatusServiceUnavailable, "DB in cached state, cannot create new TOTP now")
 		return
 	}
-	logger.Debugf(2, "%v", profile)
-
-	key, err := totp.Generate(totp.GenerateOpts{
-		Issuer:      state.HostIdentity,
-		AccountName: authUser,
-	})
-	if err != nil {
-		logger.Printf("generating new key error: %v", err)
-		http.Error(w, "error", http.StatusInternalServerError)
+	if _, err := state.checkKeyEnrollment(r, loginLevel, profile,
+		time.Now()); err != nil {
+		state.writeKeyEnrollmentDenial(w, r, authUser, authUser, err)
 		return
 	}
-	encryptedKeys, err := state.encryptWithPublicKeys([]byte(key.Secret()))
+	key, err := state.generatePendingTOTP(authUser, profile)
 	if err != nil {
-		logger.Printf("Encrypting key error: %v", err)
+		logger.Printf("generating new key error: %v", err)
 		http.Error(w, "error", http.StatusInternalServerError)
 		return
 	}
-	profile.PendingTOTPSecret = &encryptedKeys
-	err = state.SaveUserProfile(authUser, profile)
+	logger.Debugf(3, "Generate TOTP: profile=%+v", profile)
+	// Convert TOTP key into a PNG
+	var buf bytes.Buffer
+	otpKey, err := otp.NewKeyFromURL(key.URI())
 	if err != nil {
-		logger.Printf("Saving profile error: %v", err)
+		logger.Printf("parsing key URI error: %v", err)
 		http.Error(w, "error", http.StatusInternalServerError)
 		return
 	}
-	logger.Debugf(3, "Generate TOTP: profile=%+v", profile)
-	// Convert TOTP key into a PNG
-	var buf bytes.Buffer
-	img, err := key.Image(200, 200)
+	img, err := otpKey.Image(200, 200)
 	if err != nil {
 		panic(err)
 	}
@@ -135,7 +193,7 @@ func (state *RuntimeState) GenerateNewTOTP(w http.ResponseWriter, r *http.Reques
 	displayData := newTOTPPageTemplateData{
 		AuthUsername:    authUser,
 		Title:           "New TOTP Generation", //TODO: maybe include username?
-		TOTPSecret:      key.Secret(),
+		TOTPSecret:      key.Secret,
 		TOTPBase64Image: template.HTML("<img src=\"data:image/png;base64," + base64Image + "\" alt=\"beastie.png\" scale=\"0\" />"),
 	}
 	returnAcceptType := getPreferredAcceptType(r)
@@ -154,12 +212,11 @@ func (state *RuntimeState) GenerateNewTOTP(w http.ResponseWriter, r *http.Reques
 }
 
 func (state *RuntimeState) validateNewTOTP(w http.ResponseWriter, r *http.Request) {
-	authUser, _, otpValue, err := state.commonTOTPPostHandler(w, r, state.getRequiredWebUIAuthLevel())
+	authUser, loginLevel, otpValue, err := state.commonTOTPPostHandler(w, r, state.getRequiredWebUIAuthLevel())
 	if err != nil {
 		logger.Printf("Error in common Handler")
 		return
 	}
-	OTPString := fmt.Sprintf("%06d", otpValue)
 	profile, _, fromCache, err := state.LoadUserProfile(authUser)
 	if err != nil {
 		logger.Printf("loading profile error: %v", err)
@@ -172,20 +229,24 @@ func (state *RuntimeState) validateNewTOTP(w http.ResponseWriter, r *http.Reques
 		http.Error(w, "db backend is offline for writes", http.StatusServiceUnavailable)
 		return
 	}
+	usedToken, err := state.checkKeyEnrollment(r, loginLevel, profile,
+		time.Now())
+	if err != nil {
+		state.writeKeyEnrollmentDenial(w, r, authUser, authUser, err)
+		return
+	}
 	if profile.PendingTOTPSecret == nil {
 		logger.Printf("No pending Secrets")
 		state.writeFailureResponse(w, r, http.StatusBadRequest, "No pending Secrets")
 		return
 	}
-	// TODO: The encrypted value MUST have also an expiration
-	encryptedKeys := profile.PendingTOTPSecret
-	clearTextKey, err := state.decryptWithPublicKeys(*encryptedKeys)
+	valid, err := state.confirmPendingTOTP(r, authUser, profile, otpValue,
+		usedToken)
 	if err != nil {
-		logger.Printf("Decrypting secret error: %v", err)
+		logger.Printf("Confirming secret error: %v", err)
 		http.Error(w, "error", http.StatusInternalServerError)
 		return
 	}
-	valid := totp.Validate(OTPString, string(clearTextKey))
 	if !valid {
 		//render try again vailidate page, with an error message
 		logger.Printf("Invalid Entry")
@@ -210,24 +271,98 @@ func (state *RuntimeState) validateNewTOTP(w http.ResponseWriter, r *http.Reques
 		return
 
 	}
-	// TODO: check if same secret already there
-	newTOTPAuthData := totpAuthData{
-		CreatedAt:       time.Now(),
-		EncryptedSecret: *profile.PendingTOTPSecret,
-		ValidatorAddr:   r.RemoteAddr,
-		Enabled:         true,
+	//redirect to profile page?
+	http.Redirect(w, r, profilePath, 302)
+}
+
+// totpEnrollHandler is the API equivalent of GenerateNewTOTP. It answers
+// with the otpauth:// URI instead of a rendered QR code.
+func (state *RuntimeState) totpEnrollHandler(w http.ResponseWriter, r *http.Request) {
+	if state.sendFailureToClientIfLocked(w, r) {
+		return
 	}
-	newIndex := newTOTPAuthData.CreatedAt.Unix()
-	profile.TOTPAuthData[newIndex] = &newTOTPAuthData
-	profile.PendingTOTPSecret = nil
-	err = state.SaveUserProfile(authUser, profile)
+	authUser, loginLevel, err := state.checkAuth(w, r, state.getRequiredWebUIAuthLevel())
 	if err != nil {
-		logger.Printf("Saving profile error: %v", err)
+		logger.Debugf(1, "%v", err)
+		return
+	}
+	w.(*instrumentedwriter.LoggingWriter).SetUsername(authUser)
+	if !state.Config.Base.EnableLocalTOTP {
+		state.writeFailureResponse(w, r, http.StatusNotFound, "TOTP is not enabled")
+		return
+	}
+	if r.Method != "POST" {
+		state.writeFailureResponse(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	profile, _, fromCache, err := state.LoadUserProfile(authUser)
+	if err != nil {
+		logger.Printf("loading profile error: %v", err)
 		http.Error(w, "error", http.StatusInternalServerError)
 		return
 	}
-	//redirect to profile page?
-	http.Redirect(w, r, profilePath, 302)
+	if fromCache {
+		logger.Printf("DB is being cached and requesting registration aborting it")
+		state.writeFailureResponse(w, r, http.StatusServiceUnavailable, "DB in cached state, cannot create new TOTP now")
+		return
+	}
+	if _, err := state.checkKeyEnrollment(r, loginLevel, profile,
+		time.Now()); err != nil {
+		state.writeKeyEnrollmentDenial(w, r, authUser, authUser, err)
+		return
+	}
+	key, err := state.generatePendingTOTP(authUser, profile)
+	if err != nil {
+		logger.Printf("generating new key error: %v", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(proto.TOTPEnrollResponse{
+		Secret: key.Secret,
+		URI:    key.URI(),
+	})
+}
+
+func (state *RuntimeState) totpEnrollVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	authUser, loginLevel, otpValue, err := state.commonTOTPPostHandler(w, r, state.getRequiredWebUIAuthLevel())
+	if err != nil {
+		logger.Printf("Error in common Handler")
+		return
+	}
+	profile, _, fromCache, err := state.LoadUserProfile(authUser)
+	if err != nil {
+		logger.Printf("loading profile error: %v", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	if fromCache {
+		http.Error(w, "db backend is offline for writes", http.StatusServiceUnavailable)
+		return
+	}
+	usedToken, err := state.checkKeyEnrollment(r, loginLevel, profile,
+		time.Now())
+	if err != nil {
+		state.writeKeyEnrollmentDenial(w, r, authUser, authUser, err)
+		return
+	}
+	if profile.PendingTOTPSecret == nil {
+		state.writeFailureResponse(w, r, http.StatusBadRequest, "No pending Secrets")
+		return
+	}
+	valid, err := state.confirmPendingTOTP(r, authUser, profile, otpValue,
+		usedToken)
+	if err != nil {
+		logger.Printf("Confirming secret error: %v", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		state.writeFailureResponse(w, r, http.StatusBadRequest, "Invalid TOTP value")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(proto.LoginResponse{Message: "success"})
 }
 
 const totpTokenManagementPath = "/api/v0/manageTOTPToken"
@@ -384,13 +519,6 @@ func (state *RuntimeState) validateUserTOTP(username string, OTPValue int, t tim
 		//return
 	}
 	//Check if value is on blacklist for that user?
-	// Check if there is a value successfully accepted for that counter value
-	const defaultPeriod = 30
-	counter := int64(math.Floor(float64(t.Unix()) / float64(defaultPeriod)))
-	if profile.LastSuccessfullTOTPCounter == counter {
-		logger.Printf("validateUserTOTP: already done TOTP within time period")
-		return false, nil
-	}
 	OTPString := fmt.Sprintf("%06d", OTPValue)
 	//Now iterate
 	for _, deviceInfo := range profile.TOTPAuthData {
@@ -403,17 +531,41 @@ func (state *RuntimeState) validateUserTOTP(username string, OTPValue int, t tim
 			return false, err
 		}
 
-		valid := totp.Validate(OTPString, string(clearTextKey))
+		counter, valid, err := totp.Validate(string(clearTextKey), OTPString,
+			t, totpValidationSkew)
+		if err != nil {
+			logger.Printf("validateUserTOTP: bad secret error: %v", err)
+			continue
+		}
 		if !valid {
 			continue
 		}
+		// Reject reuse of this or an earlier code.
+		if counter <= profile.LastSuccessfullTOTPCounter {
+			logger.Printf("validateUserTOTP: already done TOTP within time period")
+			return false, nil
+		}
 		if !fromCache {
-			profile.LastSuccessfullTOTPCounter = counter
-			err = state.SaveUserProfile(username, profile)
+			// Check the counter again against the latest profile, in case
+			// the code was used concurrently.
+			reused := false
+			err = state.UpdateUserProfile(username,
+				func(profile *userProfile) (bool, error) {
+					if counter <= profile.LastSuccessfullTOTPCounter {
+						reused = true
+						return false, nil
+					}
+					profile.LastSuccessfullTOTPCounter = counter
+					return true, nil
+				})
 			if err != nil {
 				logger.Printf("Saving profile error: %v", err)
 				return false, err
 			}
+			if reused {
+				logger.Printf("validateUserTOTP: already done TOTP within time period")
+				return false, nil
+			}
 		}
 		userRateLimit.failCount = 0
 		userRateLimit.lockoutExpirationTime = time.Now()
@@ -488,12 +640,18 @@ func (state *RuntimeState) verifyTOTPHandler(w http.ResponseWriter, r *http.Requ
 		logger.Printf("Error in common Handler")
 		return
 	}
+	attempt := state.checkRateLimit(w, r, authUser, proto.AuthTypeTOTP)
+	if attempt == nil {
+		return
+	}
+	defer attempt.release()
 	valid, err := state.validateUserTOTP(authUser, otpValue, time.Now())
 	if err != nil {
 		logger.Printf("Error validating UserTOTP. Err: %s", err)
 		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
 		return
 	}
+	state.recordRateLimitResult(r, attempt, valid)
 	// TODO change these for real continuation Messages.
 	if !valid {
 		//Send to contine Page of Error?
@@ -504,7 +662,7 @@ func (state *RuntimeState) verifyTOTPHandler(w http.ResponseWriter, r *http.Requ
 	http.Redirect(w, r, profilePath, 302)
 }
 
-const totpAuthPath = "/api/v0/TOTPAuth"
+const totpAuthPath = proto.TOTPAuthPath
 
 func (state *RuntimeState) TOTPAuthHandler(w http.ResponseWriter, r *http.Request) {
 	logger.Debugf(1, "Top of TOTPAuthHandler")
@@ -518,12 +676,19 @@ func (state *RuntimeState) TOTPAuthHandler(w http.ResponseWriter, r *http.Reques
 	return
 }
 func (state *RuntimeState) internalTOTPAuthHandler(w http.ResponseWriter, r *http.Request, authUser string, currentAuthLevel int, otpValue int) {
+	attempt := state.checkRateLimit(w, r, authUser, proto.AuthTypeTOTP)
+	if attempt == nil {
+		return
+	}
+	defer attempt.release()
 	valid, err := state.validateUserTOTP(authUser, otpValue, time.Now())
 	if err != nil {
 		logger.Printf("Error validating TOTP %s", err)
 		state.writeFailureResponse(w, r, http.StatusInternalServerError, "Failure when validating OTP token")
 		return
 	}
+	state.logSecondFactorResult(r, authUser, proto.AuthTypeTOTP, valid)
+	state.recordRateLimitResult(r, attempt, valid)
 	if !valid {
 		logger.Printf("Invalid OTP value login for %s", authUser)
 		// TODO if client is html then do a redirect back to vipLoginPage
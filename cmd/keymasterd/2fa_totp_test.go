@@ -68,7 +68,7 @@ func TestGenerateNewTOTPSuccess(t *testing.T) {
 		t.Fatal(err)
 		//return nil, err
 	}
-	cookieVal, err := state.setNewAuthCookie(nil, "username", AuthTypeU2F)
+	cookieVal, err := state.setNewAuthCookie(nil, nil, "username", AuthTypeU2F)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -130,6 +130,78 @@ func TestGenerateNewTOTPSuccess(t *testing.T) {
 
 }
 
+func TestTOTPEnrollAPISuccess(t *testing.T) {
+	state, passwdFile, err := setupValidRuntimeStateSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(passwdFile.Name()) // clean up
+
+	state.Config.Base.AllowedAuthBackendsForWebUI = append(state.Config.Base.AllowedAuthBackendsForWebUI, proto.AuthTypeU2F)
+	state.Config.Base.EnableLocalTOTP = true
+
+	state.signerPublicKeyToKeymasterKeys()
+
+	dir, err := ioutil.TempDir("", "example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // clean up
+	state.Config.Base.DataDirectory = dir
+	err = initDB(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.HostIdentity = "testHost"
+
+	// End of setup
+	cookieVal, err := state.setNewAuthCookie(nil, nil, "username", AuthTypeU2F)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authCookie := http.Cookie{Name: authCookieName, Value: cookieVal}
+	req, err := http.NewRequest("POST", proto.TOTPEnrollPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(&authCookie)
+	enrollRR, err := checkRequestHandlerCode(req, state.totpEnrollHandler, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var enrollResponse proto.TOTPEnrollResponse
+	err = json.NewDecoder(enrollRR.Result().Body).Decode(&enrollResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(enrollResponse.URI, "otpauth://totp/testHost:username?") {
+		t.Fatalf("unexpected URI: %s", enrollResponse.URI)
+	}
+	otpValue, err := totp.GenerateCode(enrollResponse.Secret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := url.Values{}
+	data.Set("OTP", otpValue)
+	verifyReq, err := http.NewRequest("POST", proto.TOTPEnrollVerifyPath, bytes.NewBufferString(data.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyReq.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+	verifyReq.AddCookie(&authCookie)
+	_, err = checkRequestHandlerCode(verifyReq, state.totpEnrollVerifyHandler, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile, _, _, err := state.LoadUserProfile("username")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.PendingTOTPSecret != nil || len(profile.TOTPAuthData) != 1 {
+		t.Fatal("TOTP secret not activated")
+	}
+}
+
 func setupTestStateWithTOTPSecret(t *testing.T, state *RuntimeState, cookieAuth int) (*http.Cookie, string, error) {
 
 	authUser := "username"
@@ -161,7 +233,7 @@ func setupTestStateWithTOTPSecret(t *testing.T, state *RuntimeState, cookieAuth
 	if err != nil {
 		t.Fatal(err)
 	}
-	cookieVal, err := state.setNewAuthCookie(nil, "username", cookieAuth)
+	cookieVal, err := state.setNewAuthCookie(nil, nil, "username", cookieAuth)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -283,7 +355,7 @@ func TestTOTPTokenManagerHandlerUpdateSuccess(t *testing.T) {
 		t.Fatal(err)
 	}
 	//
-	cookieVal, err := state.setNewAuthCookie(nil, "username", AuthTypeAny)
+	cookieVal, err := state.setNewAuthCookie(nil, nil, "username", AuthTypeAny)
 	if err != nil {
 		t.Fatal(err)
 	}
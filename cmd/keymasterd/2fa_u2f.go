@@ -71,6 +71,11 @@ func (state *RuntimeState) u2fRegisterRequest(w http.ResponseWriter, r *http.Req
 		http.Error(w, "db backend is offline for writes", http.StatusServiceUnavailable)
 		return
 	}
+	if _, err := state.checkKeyEnrollment(r, loginLevel, profile,
+		time.Now()); err != nil {
+		state.writeKeyEnrollmentDenial(w, r, authUser, assumedUser, err)
+		return
+	}
 
 	c, err := u2f.NewChallenge(u2fAppID, u2fTrustedFacets)
 	if err != nil {
@@ -144,6 +149,12 @@ func (state *RuntimeState) u2fRegisterResponse(w http.ResponseWriter, r *http.Re
 		http.Error(w, "db backend is offline for writes", http.StatusServiceUnavailable)
 		return
 	}
+	usedToken, err := state.checkKeyEnrollment(r, loginLevel, profile,
+		time.Now())
+	if err != nil {
+		state.writeKeyEnrollmentDenial(w, r, authUser, assumedUser, err)
+		return
+	}
 
 	if profile.RegistrationChallenge == nil {
 		http.Error(w, "challenge not found", http.StatusBadRequest)
@@ -174,12 +185,16 @@ func (state *RuntimeState) u2fRegisterResponse(w http.ResponseWriter, r *http.Re
 	logger.Printf("Registration success: %+v", reg)
 
 	profile.RegistrationChallenge = nil
+	if usedToken {
+		profile.EnrollmentToken = nil
+	}
 	err = state.SaveUserProfile(assumedUser, profile)
 	if err != nil {
 		logger.Printf("Saving profile error: %v", err)
 		http.Error(w, "error", http.StatusInternalServerError)
 		return
 	}
+	state.logAuditEnrollment(r, assumedUser, proto.AuthTypeU2F)
 
 	w.Write([]byte("success"))
 }
@@ -230,9 +245,13 @@ func (state *RuntimeState) u2fSignRequest(w http.ResponseWriter, r *http.Request
 	var localAuth localUserData
 	localAuth.U2fAuthChallenge = c
 	localAuth.ExpiresAt = time.Now().Add(maxAgeU2FVerifySeconds * time.Second)
-	state.Mutex.Lock()
-	state.localAuthData[authUser] = localAuth
-	state.Mutex.Unlock()
+	err = state.putSharedState(sharedStateLocalAuth, authUser, localAuth,
+		localAuth.ExpiresAt)
+	if err != nil {
+		logger.Printf("cannot save u2f challenge: %v", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
 
 	req := c.SignRequest(registrations)
 	logger.Debugf(3, "Sign request: %+v", req)
@@ -293,10 +312,14 @@ func (state *RuntimeState) u2fSignResponse(w http.ResponseWriter, r *http.Reques
 		http.Error(w, "registration missing", http.StatusBadRequest)
 		return
 	}
-	state.Mutex.Lock()
-	localAuth, ok := state.localAuthData[authUser]
-	state.Mutex.Unlock()
-	if !ok {
+	var localAuth localUserData
+	ok, err = state.getSharedState(sharedStateLocalAuth, authUser, &localAuth)
+	if err != nil {
+		logger.Printf("cannot get u2f challenge: %v", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	if !ok || localAuth.U2fAuthChallenge == nil {
 		http.Error(w, "challenge missing", http.StatusBadRequest)
 		return
 	}
@@ -306,7 +329,7 @@ func (state *RuntimeState) u2fSignResponse(w http.ResponseWriter, r *http.Reques
 		//newCounter, authErr := u2fReg.Registration.Authenticate(signResp, *profile.U2fAuthChallenge, u2fReg.Counter)
 		newCounter, authErr := u2fReg.Registration.Authenticate(signResp, *localAuth.U2fAuthChallenge, u2fReg.Counter)
 		if authErr == nil {
-			metricLogAuthOperation(getClientType(r), proto.AuthTypeU2F, true)
+			state.logSecondFactorResult(r, authUser, proto.AuthTypeU2F, true)
 
 			logger.Debugf(0, "newCounter: %d", newCounter)
 			//counter = newCounter
@@ -315,7 +338,10 @@ func (state *RuntimeState) u2fSignResponse(w http.ResponseWriter, r *http.Reques
 			u2fReg.Counter = newCounter
 			profile.U2fAuthData[i] = u2fReg
 			//profile.U2fAuthChallenge = nil
-			delete(state.localAuthData, authUser)
+			if err := state.deleteSharedState(sharedStateLocalAuth,
+				authUser); err != nil {
+				logger.Printf("cannot delete u2f challenge: %v", err)
+			}
 
 			eventNotifier.PublishAuthEvent(eventmon.AuthTypeU2F, authUser)
 			_, isXHR := r.Header["X-Requested-With"]
@@ -334,7 +360,7 @@ func (state *RuntimeState) u2fSignResponse(w http.ResponseWriter, r *http.Reques
 			return
 		}
 	}
-	metricLogAuthOperation(getClientType(r), proto.AuthTypeU2F, false)
+	state.logSecondFactorResult(r, authUser, proto.AuthTypeU2F, false)
 
 	logger.Printf("VerifySignResponse error: %v", err)
 	http.Error(w, "error verifying response", http.StatusInternalServerError)
@@ -19,11 +19,8 @@ func (state *RuntimeState) startVIPPush(cookieVal string, username string) error
 		return err
 	}
 	newLocalData := pushPollTransaction{Username: username, TransactionID: transactionId, ExpiresAt: time.Now().Add(maxAgeSecondsVIPCookie * time.Second)}
-	state.Mutex.Lock()
-	defer state.Mutex.Unlock()
-	state.vipPushCookie[cookieVal] = newLocalData
-
-	return nil
+	return state.putSharedState(sharedStateVIPPush, cookieVal, newLocalData,
+		newLocalData.ExpiresAt)
 }
 
 ///
@@ -85,6 +82,11 @@ func (state *RuntimeState) VIPAuthHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	attempt := state.checkRateLimit(w, r, authUser, proto.AuthTypeSymantecVIP)
+	if attempt == nil {
+		return
+	}
+	defer attempt.release()
 	start := time.Now()
 	valid, err := state.Config.SymantecVIP.Client.ValidateUserOTP(authUser, otpValue)
 	if err != nil {
@@ -96,7 +98,8 @@ func (state *RuntimeState) VIPAuthHandler(w http.ResponseWriter, r *http.Request
 	metricLogExternalServiceDuration("vip", time.Since(start))
 
 	//
-	metricLogAuthOperation(getClientType(r), proto.AuthTypeSymantecVIP, valid)
+	state.logSecondFactorResult(r, authUser, proto.AuthTypeSymantecVIP, valid)
+	state.recordRateLimitResult(r, attempt, valid)
 	if !valid {
 		logger.Printf("Invalid VIP OTP value login for %s", authUser)
 		// TODO if client is html then do a redirect back to vipLoginPage
@@ -134,9 +137,12 @@ func (state *RuntimeState) VIPAuthHandler(w http.ResponseWriter, r *http.Request
 }
 
 func (state *RuntimeState) getPushPollTransaction(cookieValue string) (pushPollTransaction, bool) {
-	state.Mutex.Lock()
-	defer state.Mutex.Unlock()
-	value, ok := state.vipPushCookie[cookieValue]
+	var value pushPollTransaction
+	ok, err := state.getSharedState(sharedStateVIPPush, cookieValue, &value)
+	if err != nil {
+		logger.Printf("cannot get VIP push transaction: %s", err)
+		return value, false
+	}
 	return value, ok
 }
 
@@ -259,6 +265,7 @@ func (state *RuntimeState) VIPPollCheckHandler(w http.ResponseWriter, r *http.Re
 	}
 
 	// VIP Push check was  successful
+	state.logSecondFactorResult(r, authUser, proto.AuthTypeSymantecVIP, true)
 	_, err = state.updateAuthCookieAuthlevel(w, r, currentAuthLevel|AuthTypeSymantecVIP)
 	if err != nil {
 		logger.Printf("VIPPollCheckHandler:  Failure to update AuthCookie %s", err)
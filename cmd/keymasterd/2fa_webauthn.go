@@ -0,0 +1,494 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/instrumentedwriter"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+	"github.com/Cloud-Foundations/keymaster/proto/eventmon"
+	"github.com/duo-labs/webauthn/protocol"
+	"github.com/duo-labs/webauthn/webauthn"
+)
+
+// webAuthnUser adapts a userProfile to the webauthn.User interface.
+type webAuthnUser struct {
+	username string
+	profile  *userProfile
+}
+
+func (u *webAuthnUser) WebAuthnID() []byte {
+	id := make([]byte, 8)
+	binary.LittleEndian.PutUint64(id, u.profile.WebauthnID)
+	return id
+}
+
+func (u *webAuthnUser) WebAuthnName() string {
+	return u.username
+}
+
+func (u *webAuthnUser) WebAuthnDisplayName() string {
+	return u.username
+}
+
+func (u *webAuthnUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (u *webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	var credentials []webauthn.Credential
+	for _, data := range u.profile.WebauthnData {
+		if data.Enabled {
+			credentials = append(credentials, data.Credential)
+		}
+	}
+	return credentials
+}
+
+func (u *webAuthnUser) credentialExclusions() []protocol.CredentialDescriptor {
+	var exclusions []protocol.CredentialDescriptor
+	for _, credential := range u.WebAuthnCredentials() {
+		exclusions = append(exclusions, protocol.CredentialDescriptor{
+			Type:         protocol.PublicKeyCredentialType,
+			CredentialID: credential.ID,
+		})
+	}
+	return exclusions
+}
+
+func newWebauthnID() (uint64, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(buf), nil
+}
+
+func (state *RuntimeState) userHasWebauthnCredentials(username string) (
+	bool, error) {
+	profile, ok, _, err := state.LoadUserProfile(username)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, nil
+	}
+	user := webAuthnUser{username: username, profile: profile}
+	return len(user.WebAuthnCredentials()) > 0, nil
+}
+
+func (state *RuntimeState) webauthnBeginRegistration(w http.ResponseWriter,
+	r *http.Request) {
+	if state.sendFailureToClientIfLocked(w, r) {
+		return
+	}
+	if state.webAuthn == nil {
+		http.Error(w, "webauthn not configured", http.StatusNotFound)
+		return
+	}
+	// /webauthn/RegisterBegin/<assumed user>
+	pieces := strings.Split(r.URL.Path, "/")
+	var assumedUser string
+	if len(pieces) >= 4 {
+		assumedUser = pieces[3]
+	} else {
+		http.Error(w, "error", http.StatusBadRequest)
+		return
+	}
+	authUser, loginLevel, err := state.checkAuth(w, r, state.getRequiredWebUIAuthLevel())
+	if err != nil {
+		logger.Debugf(1, "%v", err)
+		return
+	}
+	w.(*instrumentedwriter.LoggingWriter).SetUsername(authUser)
+	// Check that they can change other users
+	if !state.IsAdminUserAndU2F(authUser, loginLevel) && authUser != assumedUser {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	profile, _, fromCache, err := state.LoadUserProfile(assumedUser)
+	if err != nil {
+		logger.Printf("loading profile error: %v", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	if fromCache {
+		logger.Printf("DB is being cached and requesting registration aborting it")
+		http.Error(w, "db backend is offline for writes", http.StatusServiceUnavailable)
+		return
+	}
+	if _, err := state.checkKeyEnrollment(r, loginLevel, profile,
+		time.Now()); err != nil {
+		state.writeKeyEnrollmentDenial(w, r, authUser, assumedUser, err)
+		return
+	}
+	if profile.WebauthnID == 0 {
+		profile.WebauthnID, err = newWebauthnID()
+		if err != nil {
+			logger.Printf("webauthn ID error: %v", err)
+			http.Error(w, "error", http.StatusInternalServerError)
+			return
+		}
+	}
+	user := &webAuthnUser{username: assumedUser, profile: profile}
+	options, sessionData, err := state.webAuthn.BeginRegistration(user,
+		webauthn.WithExclusions(user.credentialExclusions()))
+	if err != nil {
+		logger.Printf("webauthn.BeginRegistration error: %v", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	profile.WebauthnSessionData = sessionData
+	err = state.SaveUserProfile(assumedUser, profile)
+	if err != nil {
+		logger.Printf("Saving profile error: %v", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(options)
+}
+
+func (state *RuntimeState) webauthnFinishRegistration(w http.ResponseWriter,
+	r *http.Request) {
+	if state.sendFailureToClientIfLocked(w, r) {
+		return
+	}
+	if state.webAuthn == nil {
+		http.Error(w, "webauthn not configured", http.StatusNotFound)
+		return
+	}
+	// /webauthn/RegisterFinish/<assumed user>
+	pieces := strings.Split(r.URL.Path, "/")
+	var assumedUser string
+	if len(pieces) >= 4 {
+		assumedUser = pieces[3]
+	} else {
+		http.Error(w, "error", http.StatusBadRequest)
+		return
+	}
+	authUser, loginLevel, err := state.checkAuth(w, r, state.getRequiredWebUIAuthLevel())
+	if err != nil {
+		logger.Debugf(1, "%v", err)
+		return
+	}
+	w.(*instrumentedwriter.LoggingWriter).SetUsername(authUser)
+	if !state.IsAdminUserAndU2F(authUser, loginLevel) && authUser != assumedUser {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	profile, _, fromCache, err := state.LoadUserProfile(assumedUser)
+	if err != nil {
+		logger.Printf("loading profile error: %v", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	if fromCache {
+		logger.Printf("DB is being cached and requesting registration aborting it")
+		http.Error(w, "db backend is offline for writes", http.StatusServiceUnavailable)
+		return
+	}
+	usedToken, err := state.checkKeyEnrollment(r, loginLevel, profile,
+		time.Now())
+	if err != nil {
+		state.writeKeyEnrollmentDenial(w, r, authUser, assumedUser, err)
+		return
+	}
+	if profile.WebauthnSessionData == nil {
+		http.Error(w, "challenge not found", http.StatusBadRequest)
+		return
+	}
+	user := &webAuthnUser{username: assumedUser, profile: profile}
+	parsedResponse, err := protocol.ParseCredentialCreationResponse(r)
+	if err != nil {
+		logger.Printf("protocol.ParseCredentialCreationResponse error: %v", err)
+		http.Error(w, "error verifying response", http.StatusBadRequest)
+		return
+	}
+	credential, err := state.webAuthn.CreateCredential(user,
+		*profile.WebauthnSessionData, parsedResponse)
+	if err != nil {
+		logger.Printf("webauthn.CreateCredential error: %v", err)
+		http.Error(w, "error verifying response", http.StatusBadRequest)
+		return
+	}
+	if state.webAuthnRoots != nil {
+		err := verifyWebAuthnAttestation(
+			parsedResponse.Response.AttestationObject.AttStatement,
+			state.webAuthnRoots)
+		if err != nil {
+			logger.Printf("refusing WebAuthn authenticator of %s: %s",
+				assumedUser, err)
+			http.Error(w, "authenticator attestation not accepted",
+				http.StatusForbidden)
+			return
+		}
+	}
+	if profile.WebauthnData == nil {
+		profile.WebauthnData = make(map[int64]*webauthnAuthData)
+	}
+	newReg := webauthnAuthData{
+		Enabled:     true,
+		CreatedAt:   time.Now(),
+		CreatorAddr: r.RemoteAddr,
+		Credential:  *credential,
+	}
+	newIndex := newReg.CreatedAt.Unix()
+	for _, exists := profile.WebauthnData[newIndex]; exists; _, exists = profile.WebauthnData[newIndex] {
+		newIndex++
+	}
+	profile.WebauthnData[newIndex] = &newReg
+	profile.WebauthnSessionData = nil
+	if usedToken {
+		profile.EnrollmentToken = nil
+	}
+	logger.Printf("Webauthn registration success for %s", assumedUser)
+	err = state.SaveUserProfile(assumedUser, profile)
+	if err != nil {
+		logger.Printf("Saving profile error: %v", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	state.logAuditEnrollment(r, assumedUser, proto.AuthTypeWebAuthn)
+	w.Write([]byte("success"))
+}
+
+func (state *RuntimeState) webauthnAuthBegin(w http.ResponseWriter,
+	r *http.Request) {
+	if state.sendFailureToClientIfLocked(w, r) {
+		return
+	}
+	if state.webAuthn == nil {
+		http.Error(w, "webauthn not configured", http.StatusNotFound)
+		return
+	}
+	authUser, _, err := state.checkAuth(w, r, AuthTypeAny)
+	if err != nil {
+		logger.Debugf(1, "%v", err)
+		return
+	}
+	w.(*instrumentedwriter.LoggingWriter).SetUsername(authUser)
+	profile, ok, _, err := state.LoadUserProfile(authUser)
+	if err != nil {
+		logger.Printf("loading profile error: %v", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "No regstered data", http.StatusBadRequest)
+		return
+	}
+	user := &webAuthnUser{username: authUser, profile: profile}
+	if len(user.WebAuthnCredentials()) < 1 {
+		http.Error(w, "registration missing", http.StatusBadRequest)
+		return
+	}
+	options, sessionData, err := state.webAuthn.BeginLogin(user)
+	if err != nil {
+		logger.Printf("webauthn.BeginLogin error: %v", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	// Keep a pending U2F challenge.
+	var localAuth localUserData
+	_, err = state.getSharedState(sharedStateLocalAuth, authUser, &localAuth)
+	if err != nil {
+		logger.Printf("cannot get u2f challenge: %v", err)
+	}
+	localAuth.WebauthnSessionData = sessionData
+	localAuth.ExpiresAt = time.Now().Add(maxAgeU2FVerifySeconds * time.Second)
+	err = state.putSharedState(sharedStateLocalAuth, authUser, localAuth,
+		localAuth.ExpiresAt)
+	if err != nil {
+		logger.Printf("cannot save webauthn session: %v", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(options); err != nil {
+		logger.Printf("json encofing error: %v", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (state *RuntimeState) webauthnAuthFinish(w http.ResponseWriter,
+	r *http.Request) {
+	if state.sendFailureToClientIfLocked(w, r) {
+		return
+	}
+	if state.webAuthn == nil {
+		http.Error(w, "webauthn not configured", http.StatusNotFound)
+		return
+	}
+	authUser, currentAuthLevel, err := state.checkAuth(w, r, AuthTypeAny)
+	if err != nil {
+		logger.Debugf(1, "%v", err)
+		return
+	}
+	w.(*instrumentedwriter.LoggingWriter).SetUsername(authUser)
+	profile, ok, _, err := state.LoadUserProfile(authUser)
+	if err != nil {
+		logger.Printf("loading profile error: %v", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "No regstered data", http.StatusBadRequest)
+		return
+	}
+	var localAuth localUserData
+	ok, err = state.getSharedState(sharedStateLocalAuth, authUser, &localAuth)
+	if err != nil {
+		logger.Printf("cannot get webauthn session: %v", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	if !ok || localAuth.WebauthnSessionData == nil ||
+		localAuth.ExpiresAt.Before(time.Now()) {
+		http.Error(w, "challenge missing", http.StatusBadRequest)
+		return
+	}
+	user := &webAuthnUser{username: authUser, profile: profile}
+	credential, err := state.webAuthn.FinishLogin(user,
+		*localAuth.WebauthnSessionData, r)
+	if err != nil {
+		state.logSecondFactorResult(r, authUser, proto.AuthTypeWebAuthn, false)
+		logger.Printf("webauthn.FinishLogin error: %v", err)
+		http.Error(w, "error verifying response", http.StatusUnauthorized)
+		return
+	}
+	if credential.Authenticator.CloneWarning {
+		state.logSecondFactorResult(r, authUser, proto.AuthTypeWebAuthn, false)
+		logger.Printf("webauthn credential for %s may have been cloned",
+			authUser)
+		http.Error(w, "error verifying response", http.StatusUnauthorized)
+		return
+	}
+	state.logSecondFactorResult(r, authUser, proto.AuthTypeWebAuthn, true)
+	err = state.deleteSharedState(sharedStateLocalAuth, authUser)
+	if err != nil {
+		logger.Printf("cannot delete webauthn session: %v", err)
+	}
+	// Persist the new signature counter.
+	for _, data := range profile.WebauthnData {
+		if string(data.Credential.ID) == string(credential.ID) {
+			data.Credential.Authenticator.SignCount =
+				credential.Authenticator.SignCount
+		}
+	}
+	if err := state.SaveUserProfile(authUser, profile); err != nil {
+		logger.Printf("Saving profile error: %v", err)
+	}
+	eventNotifier.PublishAuthEvent(eventmon.AuthTypeWebAuthn, authUser)
+	_, isXHR := r.Header["X-Requested-With"]
+	if isXHR {
+		eventNotifier.PublishWebLoginEvent(authUser)
+	}
+	_, err = state.updateAuthCookieAuthlevel(w, r,
+		currentAuthLevel|AuthTypeWebAuthn)
+	if err != nil {
+		logger.Printf("Auth Cookie NOT found ? %s", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError,
+			"Failure updating auth cookie")
+		return
+	}
+	w.Write([]byte("success"))
+}
+
+const webauthnTokenManagementPath = "/api/v0/manageWebAuthnToken"
+
+// webauthnTokenManagerHandler renames, enables, disables and deletes
+// WebAuthn credentials, like u2fTokenManagerHandler.
+func (state *RuntimeState) webauthnTokenManagerHandler(w http.ResponseWriter,
+	r *http.Request) {
+	if state.sendFailureToClientIfLocked(w, r) {
+		return
+	}
+	authUser, loginLevel, err := state.checkAuth(w, r,
+		state.getRequiredWebUIAuthLevel())
+	if err != nil {
+		logger.Debugf(1, "%v", err)
+		return
+	}
+	w.(*instrumentedwriter.LoggingWriter).SetUsername(authUser)
+	if r.Method != "POST" {
+		state.writeFailureResponse(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		logger.Println(err)
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Error parsing form")
+		return
+	}
+	assumedUser := r.Form.Get("username")
+	if assumedUser != authUser &&
+		!state.IsAdminUserAndU2F(authUser, loginLevel) {
+		logger.Printf("bad username authUser=%s requested=%s", authUser,
+			assumedUser)
+		state.writeFailureResponse(w, r, http.StatusUnauthorized, "")
+		return
+	}
+	credentialIndex, err := strconv.ParseInt(r.Form.Get("index"), 10, 64)
+	if err != nil {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"index is not a number")
+		return
+	}
+	profile, _, fromCache, err := state.LoadUserProfile(assumedUser)
+	if err != nil {
+		logger.Printf("loading profile error: %v", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	if fromCache {
+		state.writeFailureResponse(w, r, http.StatusServiceUnavailable,
+			"db backend is offline for writes")
+		return
+	}
+	credential, ok := profile.WebauthnData[credentialIndex]
+	if !ok {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"bad index Value")
+		return
+	}
+	switch r.Form.Get("action") {
+	case "Update":
+		name := r.Form.Get("name")
+		if m, _ := regexp.MatchString("^[-/.a-zA-Z0-9_ ]+$", name); !m {
+			state.writeFailureResponse(w, r, http.StatusBadRequest,
+				"invalidtokenName")
+			return
+		}
+		credential.Name = name
+	case "Disable":
+		credential.Enabled = false
+	case "Enable":
+		credential.Enabled = true
+	case "Delete":
+		delete(profile.WebauthnData, credentialIndex)
+	default:
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Invalid Operation")
+		return
+	}
+	if err := state.SaveUserProfile(assumedUser, profile); err != nil {
+		logger.Printf("Saving profile error: %v", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	switch getPreferredAcceptType(r) {
+	case "text/html":
+		http.Redirect(w, r, profileURI(authUser, assumedUser), 302)
+	default:
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Success!"))
+	}
+}
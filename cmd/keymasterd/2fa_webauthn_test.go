@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/Cloud-Foundations/keymaster/lib/sharedstate"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+	"github.com/duo-labs/webauthn/protocol"
+	"github.com/duo-labs/webauthn/protocol/webauthncbor"
+	"github.com/duo-labs/webauthn/protocol/webauthncose"
+	"github.com/duo-labs/webauthn/webauthn"
+)
+
+const (
+	testWebAuthnRPID   = "keymaster.example.com"
+	testWebAuthnOrigin = "https://keymaster.example.com"
+)
+
+// softwareAuthenticator is a security key which keeps its credential in
+// memory.
+type softwareAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	signCount    uint32
+}
+
+type testAttestationObject struct {
+	Format       string                 `cbor:"fmt"`
+	AttStatement map[string]interface{} `cbor:"attStmt"`
+	AuthData     []byte                 `cbor:"authData"`
+}
+
+func newSoftwareAuthenticator(t *testing.T) *softwareAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentialID := make([]byte, 16)
+	if _, err := rand.Read(credentialID); err != nil {
+		t.Fatal(err)
+	}
+	return &softwareAuthenticator{key: key, credentialID: credentialID}
+}
+
+func (a *softwareAuthenticator) makeAuthData(flags byte,
+	attestedCredential []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(testWebAuthnRPID))
+	authData := append(rpIDHash[:], flags)
+	authData = binary.BigEndian.AppendUint32(authData, a.signCount)
+	return append(authData, attestedCredential...)
+}
+
+func makeTestClientDataJSON(t *testing.T, clientDataType string,
+	challenge protocol.Challenge) []byte {
+	clientDataJSON, err := json.Marshal(protocol.CollectedClientData{
+		Type:      protocol.CeremonyType(clientDataType),
+		Challenge: base64.RawURLEncoding.EncodeToString(challenge),
+		Origin:    testWebAuthnOrigin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return clientDataJSON
+}
+
+// register returns the response to a registration request with options.
+func (a *softwareAuthenticator) register(t *testing.T,
+	options protocol.CredentialCreation) []byte {
+	publicKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  1, // P-256
+		XCoord: a.key.X.FillBytes(make([]byte, 32)),
+		YCoord: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	attestedCredential := make([]byte, 16) // Zero AAGUID.
+	attestedCredential = binary.BigEndian.AppendUint16(attestedCredential,
+		uint16(len(a.credentialID)))
+	attestedCredential = append(attestedCredential, a.credentialID...)
+	attestedCredential = append(attestedCredential, publicKey...)
+	attestationObject, err := webauthncbor.Marshal(testAttestationObject{
+		Format:       "none",
+		AttStatement: map[string]interface{}{},
+		AuthData: a.makeAuthData(byte(protocol.FlagUserPresent|
+			protocol.FlagAttestedCredentialData), attestedCredential),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"id":    base64.RawURLEncoding.EncodeToString(a.credentialID),
+		"rawId": base64.RawURLEncoding.EncodeToString(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"attestationObject": base64.RawURLEncoding.EncodeToString(
+				attestationObject),
+			"clientDataJSON": base64.RawURLEncoding.EncodeToString(
+				makeTestClientDataJSON(t, "webauthn.create",
+					options.Response.Challenge)),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+// assert returns the response to an assertion request with options. The
+// signature counter is incremented first.
+func (a *softwareAuthenticator) assert(t *testing.T,
+	options protocol.CredentialAssertion) []byte {
+	a.signCount++
+	authData := a.makeAuthData(byte(protocol.FlagUserPresent), nil)
+	clientDataJSON := makeTestClientDataJSON(t, "webauthn.get",
+		options.Response.Challenge)
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(authData, clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"id":    base64.RawURLEncoding.EncodeToString(a.credentialID),
+		"rawId": base64.RawURLEncoding.EncodeToString(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"authenticatorData": base64.RawURLEncoding.EncodeToString(
+				authData),
+			"clientDataJSON": base64.RawURLEncoding.EncodeToString(
+				clientDataJSON),
+			"signature": base64.RawURLEncoding.EncodeToString(signature),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func setupWebAuthnTestState(t *testing.T) (*RuntimeState, *http.Cookie) {
+	state, authCookie := setupFactorsTestState(t)
+	state.sharedState = sharedstate.NewMemoryStore()
+	var err error
+	state.webAuthn, err = webauthn.New(&webauthn.Config{
+		RPDisplayName: "Keymaster",
+		RPID:          testWebAuthnRPID,
+		RPOrigin:      testWebAuthnOrigin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state, authCookie
+}
+
+func registerSoftwareAuthenticator(t *testing.T, state *RuntimeState,
+	authCookie *http.Cookie) *softwareAuthenticator {
+	req, err := http.NewRequest("GET", "/webauthn/RegisterBegin/username",
+		nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(authCookie)
+	rr, err := checkRequestHandlerCode(req, state.webauthnBeginRegistration,
+		http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var options protocol.CredentialCreation
+	if err := json.NewDecoder(rr.Body).Decode(&options); err != nil {
+		t.Fatal(err)
+	}
+	authenticator := newSoftwareAuthenticator(t)
+	req, err = http.NewRequest("POST", "/webauthn/RegisterFinish/username",
+		bytes.NewReader(authenticator.register(t, options)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(authCookie)
+	_, err = checkRequestHandlerCode(req, state.webauthnFinishRegistration,
+		http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return authenticator
+}
+
+// authenticate runs a WebAuthn login with authenticator and checks that the
+// finish handler responds with expectedStatus.
+func authenticate(t *testing.T, state *RuntimeState, authCookie *http.Cookie,
+	authenticator *softwareAuthenticator, expectedStatus int) {
+	req, err := http.NewRequest("GET", proto.WebAuthnAuthBeginPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(authCookie)
+	rr, err := checkRequestHandlerCode(req, state.webauthnAuthBegin,
+		http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var options protocol.CredentialAssertion
+	if err := json.NewDecoder(rr.Body).Decode(&options); err != nil {
+		t.Fatal(err)
+	}
+	if len(options.Response.AllowedCredentials) != 1 ||
+		!bytes.Equal(options.Response.AllowedCredentials[0].CredentialID,
+			authenticator.credentialID) {
+		t.Fatalf("unexpected credentials: %v",
+			options.Response.AllowedCredentials)
+	}
+	req, err = http.NewRequest("POST", proto.WebAuthnAuthFinishPath,
+		bytes.NewReader(authenticator.assert(t, options)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(authCookie)
+	_, err = checkRequestHandlerCode(req, state.webauthnAuthFinish,
+		expectedStatus)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getStoredSignCount(t *testing.T, state *RuntimeState) uint32 {
+	profile, _, _, err := state.LoadUserProfile("username")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := webAuthnUser{username: "username", profile: profile}
+	credentials := user.WebAuthnCredentials()
+	if len(credentials) != 1 {
+		t.Fatalf("%d credentials registered", len(credentials))
+	}
+	return credentials[0].Authenticator.SignCount
+}
+
+func TestWebAuthnRegistrationAndLogin(t *testing.T) {
+	state, authCookie := setupWebAuthnTestState(t)
+	// The credential of the fixture has no key.
+	if err := state.SaveUserProfile("username", &userProfile{}); err != nil {
+		t.Fatal(err)
+	}
+	authenticator := registerSoftwareAuthenticator(t, state, authCookie)
+	ok, err := state.userHasWebauthnCredentials("username")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("credential not registered")
+	}
+	authenticate(t, state, authCookie, authenticator, http.StatusOK)
+	authenticate(t, state, authCookie, authenticator, http.StatusOK)
+	if count := getStoredSignCount(t, state); count != 2 {
+		t.Fatalf("stored signature counter is %d", count)
+	}
+	// The session is consumed by the login.
+	req, err := http.NewRequest("POST", proto.WebAuthnAuthFinishPath,
+		bytes.NewReader(authenticator.assert(t, protocol.CredentialAssertion{})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(authCookie)
+	_, err = checkRequestHandlerCode(req, state.webauthnAuthFinish,
+		http.StatusBadRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebAuthnSignCountRegression(t *testing.T) {
+	state, authCookie := setupWebAuthnTestState(t)
+	if err := state.SaveUserProfile("username", &userProfile{}); err != nil {
+		t.Fatal(err)
+	}
+	authenticator := registerSoftwareAuthenticator(t, state, authCookie)
+	authenticator.signCount = 10
+	authenticate(t, state, authCookie, authenticator, http.StatusOK)
+	// A clone of the key still has an older counter.
+	authenticator.signCount = 5
+	authenticate(t, state, authCookie, authenticator, http.StatusUnauthorized)
+	if count := getStoredSignCount(t, state); count != 11 {
+		t.Fatalf("stored signature counter is %d", count)
+	}
+	authenticate(t, state, authCookie, authenticator, http.StatusUnauthorized)
+	authenticator.signCount = 20
+	authenticate(t, state, authCookie, authenticator, http.StatusOK)
+}
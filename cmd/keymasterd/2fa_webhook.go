@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/authenticators/webhook"
+	"github.com/Cloud-Foundations/keymaster/lib/instrumentedwriter"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+	"github.com/Cloud-Foundations/keymaster/proto/eventmon"
+)
+
+const maxAgeSecondsWebhookChallenge = 300
+
+func (state *RuntimeState) writeWebhookChallenge(w http.ResponseWriter,
+	r *http.Request, username string, response *webhook.Response) {
+	key, err := state.putPendingChallenge(sharedStateWebhook, username,
+		[]byte(response.State), maxAgeSecondsWebhookChallenge*time.Second)
+	if err != nil {
+		logger.Printf("cannot save pending webhook challenge: %s", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError,
+			"error internal")
+		return
+	}
+	pending := response.Result == webhook.ResultPending
+	switch getPreferredAcceptType(r) {
+	case "text/html":
+		displayData := secondFactorAuthTemplateData{
+			Title:            "Keymaster 2FA Auth",
+			ShowWebhook:      true,
+			WebhookName:      state.Config.Webhook.DisplayName,
+			WebhookMessage:   response.Message,
+			WebhookState:     key,
+			WebhookPending:   pending,
+			LoginDestination: getLoginDestination(r)}
+		err := state.htmlTemplate.ExecuteTemplate(w, "secondFactorLoginPage",
+			displayData)
+		if err != nil {
+			logger.Printf("Failed to execute %v", err)
+			http.Error(w, "error", http.StatusInternalServerError)
+		}
+	default:
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(proto.WebhookChallenge{
+			Message: response.Message,
+			State:   key,
+			Pending: pending,
+		})
+	}
+}
+
+func (state *RuntimeState) WebhookAuthHandler(w http.ResponseWriter,
+	r *http.Request) {
+	if state.sendFailureToClientIfLocked(w, r) {
+		return
+	}
+	if r.Method != "POST" {
+		state.writeFailureResponse(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		logger.Println(err)
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Error parsing form")
+		return
+	}
+	authUser, currentAuthLevel, err := state.checkAuth(w, r, AuthTypeAny)
+	if err != nil {
+		logger.Debugf(1, "%v", err)
+		return
+	}
+	w.(*instrumentedwriter.LoggingWriter).SetUsername(authUser)
+	if state.webhookAuthenticator == nil {
+		logger.Printf("request for webhook auth, but webhook not enabled")
+		state.writeFailureResponse(w, r, http.StatusPreconditionFailed,
+			"Webhook not enabled")
+		return
+	}
+	var OTPString string
+	if val, ok := r.Form["OTP"]; ok {
+		if len(val) > 1 {
+			state.writeFailureResponse(w, r, http.StatusBadRequest,
+				"Just one OTP Value allowed")
+			logger.Printf("Login with multiple OTP Values")
+			return
+		}
+		OTPString = val[0]
+	}
+	var webhookState string
+	if key := r.Form.Get("state"); key != "" {
+		pendingState, ok := state.takePendingChallenge(sharedStateWebhook,
+			key, authUser)
+		if !ok {
+			state.writeFailureResponse(w, r, http.StatusBadRequest,
+				"Invalid or expired webhook challenge")
+			return
+		}
+		webhookState = string(pendingState)
+	}
+	remoteAddress, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteAddress = r.RemoteAddr
+	}
+
+	attempt := state.checkRateLimit(w, r, authUser, proto.AuthTypeWebhook)
+	if attempt == nil {
+		return
+	}
+	defer attempt.release()
+	start := time.Now()
+	response, err := state.webhookAuthenticator.Authenticate(authUser,
+		remoteAddress, OTPString, webhookState)
+	if err != nil {
+		logger.Println(err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError,
+			"Failure when checking with webhook")
+		return
+	}
+	metricLogExternalServiceDuration("webhook", time.Since(start))
+	switch response.Result {
+	case webhook.ResultChallenge, webhook.ResultPending:
+		logger.Debugf(1, "webhook %s for user: %s", response.Result, authUser)
+		state.writeWebhookChallenge(w, r, authUser, response)
+		return
+	}
+	accepted := response.Result == webhook.ResultAllow
+	state.logSecondFactorResult(r, authUser, proto.AuthTypeWebhook, accepted)
+	state.recordRateLimitResult(r, attempt, accepted)
+	if !accepted {
+		logger.Printf("Webhook denied login for %s: %s", authUser,
+			response.Message)
+		state.writeFailureResponse(w, r, http.StatusUnauthorized,
+			response.Message)
+		return
+	}
+
+	logger.Debugf(1, "Successful webhook auth for user: %s", authUser)
+	eventNotifier.PublishAuthEvent(eventmon.AuthTypeWebhook, authUser)
+	_, err = state.updateAuthCookieAuthlevel(w, r,
+		currentAuthLevel|AuthTypeWebhook)
+	if err != nil {
+		logger.Printf("Auth Cookie NOT found ? %s", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError,
+			"Failure updating auth cookie")
+		return
+	}
+	switch getPreferredAcceptType(r) {
+	case "text/html":
+		loginDestination := getLoginDestination(r)
+		eventNotifier.PublishWebLoginEvent(authUser)
+		http.Redirect(w, r, loginDestination, 302)
+	default:
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(proto.WebhookChallenge{Message: "success"})
+	}
+}
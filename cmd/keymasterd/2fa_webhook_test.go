@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Cloud-Foundations/keymaster/lib/authenticators/webhook"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+// testWebhookHandler asks for the code 424242, then approves after one
+// pending check.
+func testWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var request webhook.Request
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var response webhook.Response
+	switch {
+	case request.State == "":
+		response = webhook.Response{Result: webhook.ResultChallenge,
+			Message: "Enter code", State: "code"}
+	case request.State == "code" && request.Response == "424242":
+		response = webhook.Response{Result: webhook.ResultPending,
+			Message: "Approve on your phone", State: "push"}
+	case request.State == "push":
+		response = webhook.Response{Result: webhook.ResultAllow}
+	default:
+		response = webhook.Response{Result: webhook.ResultDeny}
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+func postWebhookAuth(t *testing.T, state *RuntimeState,
+	authCookie *http.Cookie, otp string, challengeState string,
+	expectedStatus int) proto.WebhookChallenge {
+	form := url.Values{}
+	if otp != "" {
+		form.Set("OTP", otp)
+	}
+	if challengeState != "" {
+		form.Set("state", challengeState)
+	}
+	req, err := http.NewRequest("POST", proto.WebhookAuthPath,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.AddCookie(authCookie)
+	rr, err := checkRequestHandlerCode(req, state.WebhookAuthHandler,
+		expectedStatus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var challenge proto.WebhookChallenge
+	if expectedStatus == http.StatusOK {
+		if err := json.NewDecoder(rr.Body).Decode(&challenge); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return challenge
+}
+
+func TestWebhookAuthHandler(t *testing.T) {
+	state, passwdFile, err := setupValidRuntimeStateSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(passwdFile.Name()) // clean up
+	server := httptest.NewTLSServer(http.HandlerFunc(testWebhookHandler))
+	defer server.Close()
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(server.Certificate())
+	state.webhookAuthenticator, err = webhook.New(webhook.Config{
+		URL:        server.URL,
+		SigningKey: "signing-key",
+		RootCAs:    rootCAs,
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookieVal, err := state.setNewAuthCookie(nil, nil, "username", AuthTypePassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authCookie := &http.Cookie{Name: authCookieName, Value: cookieVal}
+
+	challenge := postWebhookAuth(t, state, authCookie, "", "", http.StatusOK)
+	if challenge.State == "" || challenge.Pending ||
+		challenge.Message != "Enter code" {
+		t.Fatalf("bad challenge: %+v", challenge)
+	}
+	postWebhookAuth(t, state, authCookie, "000000", challenge.State,
+		http.StatusUnauthorized)
+	challenge = postWebhookAuth(t, state, authCookie, "", "", http.StatusOK)
+	pending := postWebhookAuth(t, state, authCookie, "424242",
+		challenge.State, http.StatusOK)
+	if pending.State == "" || !pending.Pending {
+		t.Fatalf("expected pending approval: %+v", pending)
+	}
+	// Challenges can only be answered once.
+	postWebhookAuth(t, state, authCookie, "424242", challenge.State,
+		http.StatusBadRequest)
+	response := postWebhookAuth(t, state, authCookie, "", pending.State,
+		http.StatusOK)
+	if response.State != "" {
+		t.Fatalf("unexpected challenge: %+v", response)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"path/filepath"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/acmeserver"
+	"github.com/Cloud-Foundations/keymaster/lib/certgen"
+)
+
+const (
+	acmePath                    = "/acme"
+	acmeCertType                = "x509-acme"
+	defaultACMEAccountsFilename = "acme-accounts.json"
+)
+
+// acmeIssuer signs the host certificates of the ACME server with the
+// keymaster CA.
+type acmeIssuer struct {
+	state *RuntimeState
+}
+
+func (i acmeIssuer) IssueHostCertificate(keyID string, dnsNames []string,
+	pub interface{}, duration time.Duration) ([][]byte, error) {
+	state := i.state
+	state.Mutex.Lock()
+	signer := state.Signer
+	state.Mutex.Unlock()
+	if signer == nil {
+		return nil, errors.New("signer not loaded")
+	}
+	validKey, err := certgen.ValidatePublicKeyStrength(pub)
+	if err != nil {
+		return nil, err
+	}
+	if !validKey {
+		return nil, errors.New("invalid key strength or type")
+	}
+	caCert, err := x509.ParseCertificate(state.caCertDer)
+	if err != nil {
+		return nil, err
+	}
+	derCert, err := certgen.GenHostX509Cert(dnsNames, pub, caCert, signer,
+		duration)
+	if err != nil {
+		return nil, err
+	}
+	if err := state.logX509Issuance(keyID, acmeCertType, 0, derCert); err != nil {
+		return nil, err
+	}
+	eventNotifier.PublishX509(derCert)
+	return [][]byte{derCert, caCert.Raw}, nil
+}
+
+// getACMEBaseURL returns the URL the ACME server is reached at.
+func (state *RuntimeState) getACMEBaseURL() string {
+	baseURL := "https://" + state.HostIdentity
+	if state.Config.Base.HttpAddress != ":443" {
+		baseURL += state.Config.Base.HttpAddress
+	}
+	return baseURL + acmePath
+}
+
+func (state *RuntimeState) setupACME() error {
+	config := state.Config.ACME.Config
+	if config.AccountsFilename == "" {
+		config.AccountsFilename = filepath.Join(
+			state.Config.Base.DataDirectory, defaultACMEAccountsFilename)
+	}
+	var err error
+	state.acmeServer, err = acmeserver.New(state.getACMEBaseURL(), config,
+		acmeIssuer{state}, logger)
+	if err != nil {
+		return err
+	}
+	logger.Printf("ACME directory at %s/directory", state.getACMEBaseURL())
+	return nil
+}
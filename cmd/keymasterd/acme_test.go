@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestACMEIssuer(t *testing.T) {
+	state, passwdFile, err := setupValidRuntimeStateSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(passwdFile.Name())
+	state.HostIdentity = "keymaster.example.com"
+	state.Config.Base.HttpAddress = ":8443"
+	if baseURL := state.getACMEBaseURL(); baseURL !=
+		"https://keymaster.example.com:8443/acme" {
+		t.Fatalf("unexpected base URL %s", baseURL)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"web.internal.example.com"}
+	derCerts, err := acmeIssuer{state}.IssueHostCertificate("web", names,
+		&key.PublicKey, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(derCerts) != 2 {
+		t.Fatalf("expected 2 certificates, got %d", len(derCerts))
+	}
+	cert, err := x509.ParseCertificate(derCerts[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(derCerts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.CheckSignatureFrom(caCert); err != nil {
+		t.Fatal(err)
+	}
+	if cert.DNSNames[0] != names[0] ||
+		cert.ExtKeyUsage[0] != x509.ExtKeyUsageServerAuth {
+		t.Fatalf("unexpected certificate %v %v", cert.DNSNames,
+			cert.ExtKeyUsage)
+	}
+}
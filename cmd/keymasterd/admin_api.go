@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+
+	"github.com/Cloud-Foundations/keymaster/keymasterd/admincache"
+	"github.com/Cloud-Foundations/keymaster/lib/instrumentedwriter"
+	"gopkg.in/yaml.v2"
+)
+
+// The admin API is served on the admin port and is used by keymasterctl.
+// Clients authenticate with a certificate from the client CA, and the common
+// name of the certificate must be an admin user.
+const (
+	adminAPIUsersPath        = "/admin/api/v1/users"
+	adminAPIResetTokensPath  = "/admin/api/v1/reset-tokens"
+	adminAPIRevokePath       = "/admin/api/v1/revoke"
+	adminAPIIssuanceLogPath  = "/admin/api/v1/issuance-log"
+	adminAPIReloadConfigPath = "/admin/api/v1/reload-config"
+)
+
+type adminUsersResponse struct {
+	Users     []string `json:"users"`
+	FromCache bool     `json:"from_cache,omitempty"`
+}
+
+type adminResetTokensResponse struct {
+	User    string `json:"user"`
+	Removed int    `json:"removed"`
+}
+
+type adminReloadConfigResponse struct {
+	// RestartRequired is true if settings which are only read at startup
+	// changed. These changes are not applied.
+	RestartRequired bool `json:"restart_required"`
+}
+
+// checkAdminAPIAuth returns the admin user of the client certificate of r.
+// On failure, the response is written and ok is false.
+func (state *RuntimeState) checkAdminAPIAuth(w http.ResponseWriter,
+	r *http.Request, method string) (string, bool) {
+	setSecurityHeaders(w)
+	if r.TLS == nil || len(r.TLS.VerifiedChains) < 1 {
+		state.writeFailureResponse(w, r, http.StatusForbidden,
+			"A client certificate is required")
+		return "", false
+	}
+	clientName := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	if lw, ok := w.(*instrumentedwriter.LoggingWriter); ok {
+		lw.SetUsername(clientName)
+	}
+	if !state.IsAdminUser(clientName) {
+		logger.Printf("admin API request from non admin %s", clientName)
+		state.writeFailureResponse(w, r, http.StatusForbidden, "")
+		return "", false
+	}
+	if r.Method != method {
+		state.writeFailureResponse(w, r, http.StatusMethodNotAllowed, "")
+		return "", false
+	}
+	if err := r.ParseForm(); err != nil {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Error parsing form")
+		return "", false
+	}
+	return clientName, true
+}
+
+func writeAdminAPIResponse(w http.ResponseWriter, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (state *RuntimeState) adminAPIUsersHandler(w http.ResponseWriter,
+	r *http.Request) {
+	if _, ok := state.checkAdminAPIAuth(w, r, "GET"); !ok {
+		return
+	}
+	users, fromCache, err := state.GetUsers()
+	if err != nil {
+		logger.Printf("Getting users error: %v", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	writeAdminAPIResponse(w, adminUsersResponse{Users: users,
+		FromCache: fromCache})
+}
+
+// resetTokens removes the second factor registrations of type tokenType
+// ("u2f", "webauthn", "totp", "recovery" or "all") from profile and returns how many
+// were removed.
+func resetTokens(profile *userProfile, tokenType string) (int, error) {
+	var removed int
+	switch tokenType {
+	case "u2f", "webauthn", "totp", "recovery", "all":
+	default:
+		return 0, fmt.Errorf("invalid token type: %s", tokenType)
+	}
+	if tokenType == "u2f" || tokenType == "all" {
+		removed += len(profile.U2fAuthData)
+		profile.U2fAuthData = make(map[int64]*u2fAuthData)
+		profile.RegistrationChallenge = nil
+	}
+	if tokenType == "webauthn" || tokenType == "all" {
+		removed += len(profile.WebauthnData)
+		profile.WebauthnData = make(map[int64]*webauthnAuthData)
+		profile.WebauthnSessionData = nil
+	}
+	if tokenType == "totp" || tokenType == "all" {
+		removed += len(profile.TOTPAuthData)
+		profile.TOTPAuthData = make(map[int64]*totpAuthData)
+		profile.PendingTOTPSecret = nil
+	}
+	if tokenType == "recovery" || tokenType == "all" {
+		removed += len(profile.RecoveryCodes)
+		profile.RecoveryCodes = nil
+	}
+	return removed, nil
+}
+
+// adminAPIResetTokensHandler removes the second factor registrations of the
+// "type" form value from the profile of the "user" form value.
+func (state *RuntimeState) adminAPIResetTokensHandler(w http.ResponseWriter,
+	r *http.Request) {
+	authUser, ok := state.checkAdminAPIAuth(w, r, "POST")
+	if !ok {
+		return
+	}
+	username := r.Form.Get("user")
+	if username == "" {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Missing user")
+		return
+	}
+	var removed int
+	var resetErr error
+	err := state.UpdateUserProfile(username,
+		func(profile *userProfile) (bool, error) {
+			removed, resetErr = resetTokens(profile, r.Form.Get("type"))
+			return resetErr == nil, nil
+		})
+	if err != nil {
+		logger.Printf("Saving profile error: %v", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	if resetErr != nil {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			resetErr.Error())
+		return
+	}
+	logger.Printf("%s reset %s tokens of %s, %d removed", authUser,
+		r.Form.Get("type"), username, removed)
+	state.logAuditAdminAction(r, authUser, "reset-tokens", true,
+		map[string]string{"user": username, "type": r.Form.Get("type")})
+	writeAdminAPIResponse(w, adminResetTokensResponse{User: username,
+		Removed: removed})
+}
+
+func (state *RuntimeState) adminAPIRevokeHandler(w http.ResponseWriter,
+	r *http.Request) {
+	authUser, ok := state.checkAdminAPIAuth(w, r, "POST")
+	if !ok {
+		return
+	}
+	entry, err := getRevocationFromForm(r, authUser)
+	if err != nil {
+		state.writeFailureResponse(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := state.revoke(r, entry); err != nil {
+		logger.Printf("cannot revoke %s %s: %s", entry.CertType, entry.Serial,
+			err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	writeAdminAPIResponse(w, entry)
+}
+
+func (state *RuntimeState) adminAPIIssuanceLogHandler(w http.ResponseWriter,
+	r *http.Request) {
+	if _, ok := state.checkAdminAPIAuth(w, r, "GET"); !ok {
+		return
+	}
+	if state.issuanceLog == nil {
+		state.writeFailureResponse(w, r, http.StatusNotFound, "")
+		return
+	}
+	filter, err := getIssuanceLogFilter(r)
+	if err != nil {
+		state.writeFailureResponse(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	entries, err := state.issuanceLog.Query(filter)
+	if err != nil {
+		logger.Printf("cannot query issuance log: %s", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	writeAdminAPIResponse(w, issuanceLogResponse{Entries: entries})
+}
+
+// copyReloadableConfig copies the settings which are read for each request
+// from source to destination: the allowed auth backends, admin and
+// automation users and groups, X.509 certificate durations, certificate
+// profiles, SSH certificate options, SSH principal mappings and the password
+// backends (see passwordConfigChanged).
+func copyReloadableConfig(destination *AppConfigFile, source AppConfigFile) {
+	destination.Ldap = source.Ldap
+	base := &destination.Base
+	base.ExternalAuthCmd = source.Base.ExternalAuthCmd
+	base.HtpasswdFilename = source.Base.HtpasswdFilename
+	base.PasswordBackends = source.Base.PasswordBackends
+	base.AllowedAuthBackendsForCerts = source.Base.AllowedAuthBackendsForCerts
+	base.AllowedAuthBackendsForWebUI = source.Base.AllowedAuthBackendsForWebUI
+	base.AdminUsers = source.Base.AdminUsers
+	base.AdminGroups = source.Base.AdminGroups
+	base.AutomationUsers = source.Base.AutomationUsers
+	base.AutomationUserGroups = source.Base.AutomationUserGroups
+	base.X509CertDurations = source.Base.X509CertDurations
+	base.CertProfiles = source.Base.CertProfiles
+	base.SSHCertOptions = source.Base.SSHCertOptions
+	base.SSHPrincipalMappings = source.Base.SSHPrincipalMappings
+}
+
+// getConfig returns the configuration with the settings copied by
+// copyReloadableConfig which are in effect. reloadConfig replaces it instead
+// of changing it, so it is read without locking; functions reading these
+// settings load it once, so they see either the previous or the new ones.
+// The other settings do not change after startup and are read from
+// state.Config.
+func (state *RuntimeState) getConfig() *AppConfigFile {
+	if config := state.currentConfig.Load(); config != nil {
+		return config
+	}
+	return &state.Config
+}
+
+// passwordConfigChanged returns true if the settings of the password
+// backends other than Okta differ between a and b.
+func passwordConfigChanged(a, b AppConfigFile) bool {
+	return a.Base.ExternalAuthCmd != b.Base.ExternalAuthCmd ||
+		a.Base.HtpasswdFilename != b.Base.HtpasswdFilename ||
+		!reflect.DeepEqual(a.Base.PasswordBackends, b.Base.PasswordBackends) ||
+		!reflect.DeepEqual(a.Ldap, b.Ldap)
+}
+
+// reloadConfig reads configFilename again and applies the settings copied
+// by copyReloadableConfig, and reloads the certificate policy file. Nothing
+// is applied unless all of them are valid. The settings are published as a
+// new configuration (see getConfig), which requests read without locking.
+// It returns true if other settings changed, which
+// only take effect after a restart.
+func (state *RuntimeState) reloadConfig(configFilename string) (bool, error) {
+	state.configReloadMutex.Lock()
+	defer state.configReloadMutex.Unlock()
+	source, err := ioutil.ReadFile(configFilename)
+	if err != nil {
+		return false, fmt.Errorf("cannot read config file: %s", err)
+	}
+	var newConfig, oldConfig AppConfigFile
+	if err := yaml.Unmarshal(source, &newConfig); err != nil {
+		return false, fmt.Errorf("cannot parse config file: %s", err)
+	}
+	if err := newConfig.Base.X509CertDurations.check(); err != nil {
+		return false, fmt.Errorf("x509_cert_durations: %s", err)
+	}
+	if err := checkCertProfiles(newConfig.Base.CertProfiles); err != nil {
+		return false, fmt.Errorf("cert_profiles: %s", err)
+	}
+	principalMapper, err := newPrincipalMapper(
+		newConfig.Base.SSHPrincipalMappings)
+	if err != nil {
+		return false, fmt.Errorf("ssh_principal_mappings: %s", err)
+	}
+	state.Mutex.Lock()
+	err = yaml.Unmarshal(state.configSource, &oldConfig)
+	passwordChecker := state.passwordChecker
+	state.Mutex.Unlock()
+	if err != nil {
+		return false, err
+	}
+	if passwordConfigChanged(oldConfig, newConfig) {
+		passwordChecker, err = state.newPasswordChecker(newConfig)
+		if err != nil {
+			return false, fmt.Errorf("password backends: %s", err)
+		}
+	}
+	// The policy is applied when it is loaded, so it is loaded last.
+	if state.certPolicy != nil {
+		if _, err := state.certPolicy.Reload(); err != nil {
+			return false, fmt.Errorf("certificate policy: %s", err)
+		}
+	}
+	state.Mutex.Lock()
+	defer state.Mutex.Unlock()
+	config := *state.getConfig()
+	copyReloadableConfig(&config, newConfig)
+	copyReloadableConfig(&oldConfig, newConfig)
+	state.currentConfig.Store(&config)
+	state.configSource = source
+	state.passwordChecker = passwordChecker
+	state.principalMapper = principalMapper
+	state.isAdminCache = admincache.New(adminCacheDuration)
+	return !reflect.DeepEqual(oldConfig, newConfig), nil
+}
+
+// reloadConfigOnSIGHUP reloads configFilename whenever SIGHUP is received.
+func (state *RuntimeState) reloadConfigOnSIGHUP(configFilename string) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	for range sighup {
+		restartRequired, err := state.reloadConfig(configFilename)
+		if err != nil {
+			logger.Printf("cannot reload config on SIGHUP: %s", err)
+			continue
+		}
+		logger.Printf("reloaded the configuration on SIGHUP, restart required: %v",
+			restartRequired)
+	}
+}
+
+func (state *RuntimeState) adminAPIReloadConfigHandler(w http.ResponseWriter,
+	r *http.Request) {
+	authUser, ok := state.checkAdminAPIAuth(w, r, "POST")
+	if !ok {
+		return
+	}
+	restartRequired, err := state.reloadConfig(*configFilename)
+	if err != nil {
+		logger.Printf("cannot reload config: %s", err)
+		state.logAuditAdminAction(r, authUser, "reload-config", false,
+			map[string]string{"error": err.Error()})
+		state.writeFailureResponse(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	logger.Printf("%s reloaded the configuration, restart required: %v",
+		authUser, restartRequired)
+	state.logAuditAdminAction(r, authUser, "reload-config", true, nil)
+	writeAdminAPIResponse(w,
+		adminReloadConfigResponse{RestartRequired: restartRequired})
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResetTokens(t *testing.T) {
+	profile := &userProfile{
+		U2fAuthData:   map[int64]*u2fAuthData{1: {}, 2: {}},
+		TOTPAuthData:  map[int64]*totpAuthData{1: {}},
+		WebauthnData:  map[int64]*webauthnAuthData{1: {}},
+		RecoveryCodes: []recoveryCodeData{{}},
+	}
+	removed, err := resetTokens(profile, "u2f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 || len(profile.U2fAuthData) != 0 ||
+		len(profile.TOTPAuthData) != 1 {
+		t.Fatalf("unexpected result: removed=%d, profile=%+v", removed,
+			profile)
+	}
+	removed, err = resetTokens(profile, "all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 3 || len(profile.TOTPAuthData) != 0 ||
+		len(profile.WebauthnData) != 0 || len(profile.RecoveryCodes) != 0 {
+		t.Fatalf("unexpected result: removed=%d, profile=%+v", removed,
+			profile)
+	}
+	if _, err := resetTokens(profile, "password"); err == nil {
+		t.Fatal("invalid token type should fail")
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload_config_testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFilename := filepath.Join(dir, "config.yml")
+	var state RuntimeState
+	state.configSource = []byte(`
+base:
+  http_address: ":443"
+  admin_users: ["alice"]
+`)
+	state.Config.Base.HttpAddress = ":443"
+	state.Config.Base.AdminUsers = []string{"alice"}
+	config := `
+base:
+  http_address: ":443"
+  admin_users: ["alice", "bob"]
+  x509_cert_durations:
+    users:
+      bob: 1h
+`
+	if err := ioutil.WriteFile(configFilename, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	restartRequired, err := state.reloadConfig(configFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restartRequired {
+		t.Fatal("restart should not be required")
+	}
+	previousConfig := state.getConfig()
+	if len(previousConfig.Base.AdminUsers) != 2 ||
+		previousConfig.Base.X509CertDurations.Users["bob"] != time.Hour {
+		t.Fatalf("config not reloaded: %+v", previousConfig.Base)
+	}
+	config = `
+base:
+  http_address: ":8443"
+  admin_users: ["alice"]
+`
+	if err := ioutil.WriteFile(configFilename, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	restartRequired, err = state.reloadConfig(configFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !restartRequired {
+		t.Fatal("restart should be required")
+	}
+	if newConfig := state.getConfig(); newConfig.Base.HttpAddress != ":443" ||
+		len(newConfig.Base.AdminUsers) != 1 {
+		t.Fatalf("unexpected config: %+v", newConfig.Base)
+	}
+	// Requests still using the previous configuration do not see the reload.
+	if len(previousConfig.Base.AdminUsers) != 2 {
+		t.Fatalf("previous config changed: %+v", previousConfig.Base)
+	}
+	config = `
+base:
+  x509_cert_durations:
+    users:
+      bob: -1h
+`
+	if err := ioutil.WriteFile(configFilename, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := state.reloadConfig(configFilename); err == nil {
+		t.Fatal("invalid config should fail")
+	}
+}
+
+func TestReloadConfigPasswordBackends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload_config_testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	passwdFile, err := setupPasswdFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(passwdFile.Name())
+	configFilename := filepath.Join(dir, "config.yml")
+	var state RuntimeState
+	state.configSource = []byte("base:\n  http_address: \":443\"\n")
+	config := fmt.Sprintf(`
+base:
+  http_address: ":443"
+  htpasswd_filename: %s
+  password_backends:
+    - name: htpasswd
+`, passwdFile.Name())
+	if err := ioutil.WriteFile(configFilename, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	restartRequired, err := state.reloadConfig(configFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restartRequired {
+		t.Fatal("restart should not be required")
+	}
+	passwordChecker := state.passwordChecker
+	if passwordChecker == nil {
+		t.Fatal("password backends not reloaded")
+	}
+	valid, err := passwordChecker.PasswordAuthenticate("username",
+		[]byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !valid {
+		t.Fatal("password should be accepted")
+	}
+	// An invalid backend leaves the previous settings in place.
+	config = `
+base:
+  http_address: ":443"
+  admin_users: ["alice"]
+  password_backends:
+    - name: ldap
+`
+	if err := ioutil.WriteFile(configFilename, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := state.reloadConfig(configFilename); err == nil {
+		t.Fatal("unconfigured password backend should fail")
+	}
+	if state.passwordChecker != passwordChecker ||
+		len(state.getConfig().Base.AdminUsers) > 0 ||
+		state.getConfig().Base.HtpasswdFilename != passwdFile.Name() {
+		t.Fatalf("config should not change: %+v", state.getConfig().Base)
+	}
+}
+
+func TestAdminAPIRequiresClientCert(t *testing.T) {
+	var state RuntimeState
+	req := httptest.NewRequest("GET", adminAPIUsersPath, nil)
+	rr := httptest.NewRecorder()
+	state.adminAPIUsersHandler(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("expected status %d, got %d", http.StatusForbidden, rr.Code)
+	}
+}
@@ -25,6 +25,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Cloud-Foundations/Dominator/lib/log/serverlogger"
@@ -34,16 +35,42 @@ import (
 	"github.com/Cloud-Foundations/golib/pkg/log"
 	"github.com/Cloud-Foundations/keymaster/keymasterd/admincache"
 	"github.com/Cloud-Foundations/keymaster/keymasterd/eventnotifier"
+	"github.com/Cloud-Foundations/keymaster/lib/acmeserver"
+	"github.com/Cloud-Foundations/keymaster/lib/auditlog"
+	"github.com/Cloud-Foundations/keymaster/lib/authenticators/cloudidentity"
+	"github.com/Cloud-Foundations/keymaster/lib/authenticators/duo"
+	"github.com/Cloud-Foundations/keymaster/lib/authenticators/kerberos"
+	"github.com/Cloud-Foundations/keymaster/lib/authenticators/oidc"
+	"github.com/Cloud-Foundations/keymaster/lib/authenticators/okta"
+	"github.com/Cloud-Foundations/keymaster/lib/authenticators/radius"
+	"github.com/Cloud-Foundations/keymaster/lib/authenticators/saml"
+	"github.com/Cloud-Foundations/keymaster/lib/authenticators/webhook"
 	"github.com/Cloud-Foundations/keymaster/lib/authutil"
 	"github.com/Cloud-Foundations/keymaster/lib/certgen"
+	"github.com/Cloud-Foundations/keymaster/lib/certpolicy"
+	"github.com/Cloud-Foundations/keymaster/lib/geoip"
+	"github.com/Cloud-Foundations/keymaster/lib/groupcache"
+	"github.com/Cloud-Foundations/keymaster/lib/healthcheck"
 	"github.com/Cloud-Foundations/keymaster/lib/instrumentedwriter"
+	"github.com/Cloud-Foundations/keymaster/lib/issuancelog"
+	"github.com/Cloud-Foundations/keymaster/lib/notify"
+	"github.com/Cloud-Foundations/keymaster/lib/pkcs11signer"
+	"github.com/Cloud-Foundations/keymaster/lib/principalmap"
 	"github.com/Cloud-Foundations/keymaster/lib/pwauth"
+	"github.com/Cloud-Foundations/keymaster/lib/pwauth/chain"
+	"github.com/Cloud-Foundations/keymaster/lib/pwauth/localusers"
+	"github.com/Cloud-Foundations/keymaster/lib/ratelimit"
+	"github.com/Cloud-Foundations/keymaster/lib/sharedstate"
+	"github.com/Cloud-Foundations/keymaster/lib/simplestorage/dynamostore"
+	"github.com/Cloud-Foundations/keymaster/lib/simplestorage/envelope"
+	"github.com/Cloud-Foundations/keymaster/lib/simplestorage/pgstore"
 	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
 	"github.com/Cloud-Foundations/keymaster/proto/eventmon"
 	"github.com/Cloud-Foundations/tricorder/go/healthserver"
 	"github.com/Cloud-Foundations/tricorder/go/tricorder"
 	"github.com/Cloud-Foundations/tricorder/go/tricorder/units"
 	"github.com/cloudflare/cfssl/revoke"
+	"github.com/duo-labs/webauthn/webauthn"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/tstranex/u2f"
@@ -60,14 +87,41 @@ const (
 	AuthTypeSymantecVIP
 	AuthTypeIPCertificate
 	AuthTypeTOTP
+	AuthTypeWebAuthn
+	AuthTypeOkta2FA
+	AuthTypeRADIUS
+	AuthTypeDuo
+	AuthTypeWebhook
+	AuthTypeRecoveryCode
+	AuthTypeCloudIdentity
+	AuthTypeServiceAccount
+	// Not in AuthTypeAny, so that sessions from certificate renewals can
+	// only be used to get certificates.
+	AuthTypeCertificateRenewal
+	// Not an authentication method: set on sessions of logins from unusual
+	// locations, which need a second factor to get certificates.
+	AuthTypeStepUpRequired
+	// Not an authentication method: set on sessions of break glass
+	// accounts, whose password is enough for certificates while emergency
+	// issuance is active.
+	AuthTypeBreakGlass
+	AuthTypeOIDCToken
 )
 
-const AuthTypeAny = 0xFFFF
+// AuthTypeAny is any of the login methods.
+const AuthTypeAny = AuthTypePassword | AuthTypeFederated | AuthTypeU2F |
+	AuthTypeSymantecVIP | AuthTypeIPCertificate | AuthTypeTOTP |
+	AuthTypeWebAuthn | AuthTypeOkta2FA | AuthTypeRADIUS | AuthTypeDuo |
+	AuthTypeWebhook | AuthTypeRecoveryCode | AuthTypeCloudIdentity |
+	AuthTypeServiceAccount | AuthTypeOIDCToken
 
 type authInfo struct {
 	ExpiresAt time.Time
+	IssuedAt  time.Time
+	AuthTime  time.Time // When the user logged in with credentials.
 	Username  string
 	AuthType  int
+	SessionID string // Empty for cookies issued without session tracking.
 }
 
 type authInfoJWT struct {
@@ -79,6 +133,8 @@ type authInfoJWT struct {
 	IssuedAt   int64    `json:"iat,omitempty"`
 	TokenType  string   `json:"token_type"`
 	AuthType   int      `json:"auth_type"`
+	SessionID  string   `json:"jti,omitempty"`
+	AuthTime   int64    `json:"auth_time,omitempty"`
 }
 
 type storageStringDataJWT struct {
@@ -102,6 +158,14 @@ type u2fAuthData struct {
 	Registration *u2f.Registration
 }
 
+type webauthnAuthData struct {
+	Enabled     bool
+	CreatedAt   time.Time
+	CreatorAddr string
+	Name        string
+	Credential  webauthn.Credential
+}
+
 type totpAuthData struct {
 	Enabled         bool
 	CreatedAt       time.Time
@@ -111,22 +175,38 @@ type totpAuthData struct {
 	ValidatorAddr   string
 }
 
+// recoveryCodeData is an unused recovery code, stored as a bcrypt hash.
+type recoveryCodeData struct {
+	Hash      []byte
+	CreatedAt time.Time
+}
+
 type userProfile struct {
 	U2fAuthData                map[int64]*u2fAuthData
 	RegistrationChallenge      *u2f.Challenge
 	PendingTOTPSecret          *[][]byte
 	LastSuccessfullTOTPCounter int64
 	TOTPAuthData               map[int64]*totpAuthData
+	WebauthnID                 uint64
+	WebauthnData               map[int64]*webauthnAuthData
+	WebauthnSessionData        *webauthn.SessionData
+	RecoveryCodes              []recoveryCodeData
+	EnrollmentToken            *enrollmentToken
+	Devices                    map[string]*deviceInfo
+	LoginAddresses             map[string]time.Time // Time last seen.
+	LoginLocations             []geoip.Login        // Oldest first.
 }
 
 type localUserData struct {
-	U2fAuthChallenge *u2f.Challenge
-	ExpiresAt        time.Time
+	U2fAuthChallenge    *u2f.Challenge
+	WebauthnSessionData *webauthn.SessionData
+	ExpiresAt           time.Time
 }
 
 type pendingAuth2Request struct {
 	ExpiresAt time.Time
 	state     string
+	nonce     string
 	ctx       context.Context
 }
 
@@ -145,31 +225,89 @@ type totpRateLimitInfo struct {
 
 type RuntimeState struct {
 	Config               AppConfigFile
+	configSource         []byte
+	currentConfig        atomic.Pointer[AppConfigFile] // Set by reloadConfig.
 	SSHCARawFileContent  []byte
 	Signer               crypto.Signer
 	ClientCAPool         *x509.CertPool
+	pivAttestationRoots  *x509.CertPool
+	tpmAttestationRoots  *x509.CertPool
 	HostIdentity         string
 	KerberosRealm        *string
 	caCertDer            []byte
-	vipPushCookie        map[string]pushPollTransaction
-	localAuthData        map[string]localUserData
 	SignerIsReady        chan bool
 	oktaUsernameFilterRE *regexp.Regexp
+	ldapRelevantGroupsRE *regexp.Regexp
+	ldapGroupFilterRE    *regexp.Regexp
+	ldapGroupCache       *groupcache.Cache
 	Mutex                sync.Mutex
 	gitDB                *gitdb.UserInfo
 	pendingOauth2        map[string]pendingAuth2Request
 	storageRWMutex       sync.RWMutex
 	db                   *sql.DB
+	pgStore              *pgstore.Store     // Set if storage is PostgreSQL.
+	dynamoStore          *dynamostore.Store // Set if storage is DynamoDB.
+	profileUpdateMutex   sync.Mutex
+	profileKeyring       *envelope.Keyring // Set if storage is encrypted.
+	sharedState          sharedstate.Store // Shared by all instances.
+	healthChecker        *healthcheck.Checker
 	dbType               string
 	cacheDB              *sql.DB
 	remoteDBQueryTimeout time.Duration
 	htmlTemplate         *template.Template
-	passwordChecker      pwauth.PasswordAuthenticator
+	passwordChecker      pwauth.PasswordAuthenticator // Protected by Mutex.
+	configReloadMutex    sync.Mutex                   // Serializes reloads.
 	KeymasterPublicKeys  []crypto.PublicKey
 	isAdminCache         *admincache.Cache
+	certPolicy           *certpolicy.Policy
+	principalMapper      *principalmap.Mapper // Protected by Mutex.
+	pkcs11Signer         *pkcs11signer.Signer
+	issuanceLog          *issuancelog.Log
+	auditLogger          *auditlog.Logger
+	notifier             *notify.Notifier
+	rateLimiter          *ratelimit.Limiter
+	geoLocator           *geoip.Locator
+	acmeServer           *acmeserver.Server
+	hostAWSAuthenticator *cloudidentity.Authenticator
+	serviceAccountMutex  sync.Mutex // Protects token rotation.
+	webSessionsMutex     sync.Mutex // Serializes web session index updates.
+	certApprovalsMutex   sync.Mutex // Serializes cert approval index updates.
+	breakGlassMutex      sync.Mutex // Serializes break glass votes.
+	authCookieKeys       authCookieKeyring
+	localUsers           *localusers.PasswordAuthenticator
+
+	revocationMutex    sync.Mutex
+	revocationSnapshot *revocationSnapshot
+	issuedX509Serials  map[string]time.Time // Protected by revocationMutex.
 
 	totpLocalRateLimit      map[string]totpRateLimitInfo
 	totpLocalTateLimitMutex sync.Mutex
+
+	userGroupsSnapshot      map[string]userGroupsSnapshot
+	userGroupsSnapshotMutex sync.Mutex
+	ldapDiscoveredBaseDNs   map[string]discoveredLdapBaseDNs
+	ldapBaseDNsMutex        sync.Mutex
+	ldapPool                *authutil.LDAPPool
+	ldapPoolMutex           sync.Mutex
+
+	webAuthn          *webauthn.WebAuthn
+	webAuthnRoots     *x509.CertPool // Set if authenticators must be attested.
+	oktaAuthenticator *okta.PasswordAuthenticator
+
+	kerberosAuthenticator      *kerberos.Authenticator
+	cloudIdentityAuthenticator *cloudidentity.Authenticator
+	oidcTokenVerifier          *oidc.RelyingParty
+
+	radiusAuthenticator *radius.Authenticator
+	duoAuthenticator    *duo.Authenticator
+
+	webhookAuthenticator *webhook.Authenticator
+
+	oidcRelyingParty     *oidc.RelyingParty
+	samlServiceProvider  *saml.ServiceProvider
+	pendingSAML          map[string]pendingSAMLRequest
+	federatedGroups      map[string]federatedUserGroups
+	federatedGroupsMutex sync.Mutex
 }
 
 const redirectPath = "/auth/oauth2/callback"
@@ -297,28 +435,15 @@ func (state *RuntimeState) performStateCleanup(secsBetweenCleanup int) {
 			}
 		}
 		finalPendingSize := len(state.pendingOauth2)
-
-		//localAuthData
-		initPendingLocal := len(state.localAuthData)
-		for key, localAuth := range state.localAuthData {
-			if localAuth.ExpiresAt.Before(time.Now()) {
-				delete(state.localAuthData, key)
-			}
-		}
-		finalPendingLocal := len(state.localAuthData)
-
-		for key, vipCookie := range state.vipPushCookie {
-			if vipCookie.ExpiresAt.Before(time.Now()) {
-				delete(state.vipPushCookie, key)
+		for key, samlPending := range state.pendingSAML {
+			if samlPending.ExpiresAt.Before(time.Now()) {
+				delete(state.pendingSAML, key)
 			}
-
 		}
 
 		state.Mutex.Unlock()
 		logger.Debugf(3, "Pending Cookie sizes: before(%d) after(%d)",
 			initPendingSize, finalPendingSize)
-		logger.Debugf(3, "Pending Cookie sizes: before(%d) after(%d)",
-			initPendingLocal, finalPendingLocal)
 		time.Sleep(time.Duration(secsBetweenCleanup) * time.Second)
 	}
 
@@ -329,42 +454,60 @@ func convertToBindDN(username string, bind_pattern string) string {
 }
 
 func checkUserPassword(username string, password string, config AppConfigFile, passwordChecker pwauth.PasswordAuthenticator, r *http.Request) (bool, error) {
+	valid, _, err := checkUserPasswordWithStatus(username, password, config,
+		passwordChecker, r)
+	return valid, err
+}
+
+// checkUserPasswordWithStatus is like checkUserPassword, but also returns
+// the password state reported by the password backend.
+func checkUserPasswordWithStatus(username string, password string,
+	config AppConfigFile, passwordChecker pwauth.PasswordAuthenticator,
+	r *http.Request) (bool, pwauth.PasswordStatus, error) {
 	clientType := getClientType(r)
 	if passwordChecker != nil {
 		logger.Debugf(3, "checking auth with passwordChecker")
-		isLDAP := false
-		if len(config.Ldap.LDAPTargetURLs) > 0 {
-			isLDAP = true
+		var valid bool
+		var status pwauth.PasswordStatus
+		var err error
+		if chained, ok := passwordChecker.(*chain.PasswordAuthenticator); ok {
+			var backend string
+			backend, valid, status, err =
+				chained.PasswordAuthenticateWithBackendAndStatus(username,
+					[]byte(password))
+			if valid {
+				logger.Printf("Password for %s accepted by %s backend",
+					username, backend)
+			}
+		} else {
+			valid, status, err = pwauth.PasswordAuthenticateWithStatus(
+				passwordChecker, username, []byte(password))
 		}
-
-		start := time.Now()
-		valid, err := passwordChecker.PasswordAuthenticate(username, []byte(password))
 		if err != nil {
-			return false, err
-		}
-		if isLDAP {
-			metricLogExternalServiceDuration("ldap", time.Since(start))
+			return false, pwauth.PasswordStatus{}, err
 		}
 		logger.Debugf(3, "pwdChaker output = %d", valid)
 		metricLogAuthOperation(clientType, "password", valid)
-		return valid, nil
+		return valid, status, nil
 	}
 
 	if config.Base.HtpasswdFilename != "" {
 		logger.Debugf(3, "I have htpasswed filename")
 		buffer, err := ioutil.ReadFile(config.Base.HtpasswdFilename)
 		if err != nil {
-			return false, err
+			return false, pwauth.PasswordStatus{}, err
 		}
 		valid, err := authutil.CheckHtpasswdUserPassword(username, password, buffer)
 		if err != nil {
-			return false, err
+			metricLogPasswordLogin("htpasswd", "error")
+			return false, pwauth.PasswordStatus{}, err
 		}
+		metricLogPasswordLogin("htpasswd", strconv.FormatBool(valid))
 		metricLogAuthOperation(clientType, "password", valid)
-		return valid, nil
+		return valid, pwauth.PasswordStatus{}, nil
 	}
 	metricLogAuthOperation(clientType, "password", false)
-	return false, nil
+	return false, pwauth.PasswordStatus{}, nil
 }
 
 // returns application/json or text/html depending on the request. By default we assume the requester wants json
@@ -421,23 +564,52 @@ func getClientType(r *http.Request) string {
 }
 
 func (state *RuntimeState) writeHTML2FAAuthPage(w http.ResponseWriter, r *http.Request,
-	loginDestination string, tryShowU2f bool) error {
+	loginDestination string, authUser string, tryShowU2f bool,
+	tryShowWebAuthn bool, passwordWarning string) error {
 	JSSources := []string{"/static/jquery-3.4.1.min.js", "/static/u2f-api.js"}
 	showU2F := browserSupportsU2F(r) && tryShowU2f
 	if showU2F {
 
 		JSSources = append(JSSources, "/static/webui-2fa-u2f.js")
 	}
+	showWebAuthn := state.webAuthn != nil && tryShowWebAuthn
+	if showWebAuthn {
+		JSSources = append(JSSources, "/static/webui-2fa-webauthn.js")
+	}
 	if state.Config.SymantecVIP.Enabled {
 		JSSources = append(JSSources, "/static/webui-2fa-symc-vip.js")
 	}
+	var showDuo, showDuoPush bool
+	if preauth := state.getDuoPreauth(authUser); preauth != nil {
+		showDuo = preauth.Result == duo.PreauthResultAuth
+		showDuoPush = showDuo && preauth.HasCapability(duo.CapabilityPush)
+	}
+	if showDuoPush {
+		JSSources = append(JSSources, "/static/webui-2fa-duo.js")
+	}
 	displayData := secondFactorAuthTemplateData{
 		Title:            "Keymaster 2FA Auth",
 		JSSources:        JSSources,
 		ShowVIP:          state.Config.SymantecVIP.Enabled,
 		ShowU2F:          showU2F,
 		ShowTOTP:         state.Config.Base.EnableLocalTOTP,
-		LoginDestination: loginDestination}
+		ShowWebAuthn:     showWebAuthn,
+		ShowRADIUS:       state.radiusAuthenticator != nil,
+		ShowDuo:          showDuo,
+		ShowDuoPush:      showDuoPush,
+		ShowWebhook:      state.webhookAuthenticator != nil,
+		ShowRecoveryCode: state.userHasRecoveryCodes(authUser),
+		WebhookName:      state.Config.Webhook.DisplayName,
+		LoginDestination: loginDestination,
+		PasswordWarning:  passwordWarning}
+	for _, factor := range state.getOktaUserFactors(authUser) {
+		displayData.OktaFactors = append(displayData.OktaFactors,
+			oktaFactorDisplayInfo{
+				FactorType: factor.FactorType,
+				Provider:   factor.Provider,
+				Status:     factor.Status,
+			})
+	}
 	err := state.htmlTemplate.ExecuteTemplate(w, "secondFactorLoginPage", displayData)
 	if err != nil {
 		logger.Printf("Failed to execute %v", err)
@@ -453,6 +625,7 @@ func (state *RuntimeState) writeHTMLLoginPage(w http.ResponseWriter, r *http.Req
 	displayData := loginPageTemplateData{
 		Title:            "Keymaster Login",
 		ShowOauth2:       state.Config.Oauth2.Enabled,
+		ShowSAML:         state.samlServiceProvider != nil,
 		HideStdLogin:     state.Config.Base.HideStandardLogin,
 		LoginDestination: loginDestination,
 		ErrorMessage:     errorMessage}
@@ -469,6 +642,9 @@ func (state *RuntimeState) writeFailureResponse(w http.ResponseWriter, r *http.R
 	returnAcceptType := getPreferredAcceptType(r)
 	if code == http.StatusUnauthorized && returnAcceptType != "text/html" {
 		w.Header().Set("WWW-Authenticate", `Basic realm="User Credentials"`)
+		if state.kerberosAuthenticator != nil {
+			w.Header().Add("WWW-Authenticate", kerberos.NegotiateScheme)
+		}
 	}
 	w.WriteHeader(code)
 	publicErrorText := fmt.Sprintf("%d %s %s\n", code, http.StatusText(code), message)
@@ -486,7 +662,8 @@ func (state *RuntimeState) writeFailureResponse(w http.ResponseWriter, r *http.R
 				authCookie = cookie
 			}
 			loginDestnation := profilePath
-			if r.URL.Path == idpOpenIDCAuthorizationPath {
+			if r.URL.Path == idpOpenIDCAuthorizationPath ||
+				r.URL.Path == certRequestPath {
 				loginDestnation = r.URL.String()
 			}
 			if r.Method == "POST" {
@@ -506,12 +683,14 @@ func (state *RuntimeState) writeFailureResponse(w http.ResponseWriter, r *http.R
 				state.writeHTMLLoginPage(w, r, loginDestnation, "")
 				return
 			}
-			if info.ExpiresAt.Before(time.Now()) {
+			if info.ExpiresAt.Before(time.Now()) ||
+				state.checkWebSession(info) != nil {
 				state.writeHTMLLoginPage(w, r, loginDestnation, "")
 				return
 			}
 			if (info.AuthType & AuthTypePassword) == AuthTypePassword {
-				state.writeHTML2FAAuthPage(w, r, loginDestnation, true)
+				state.writeHTML2FAAuthPage(w, r, loginDestnation,
+					info.Username, true, true, "")
 				return
 			}
 			state.writeHTMLLoginPage(w, r, loginDestnation, message)
@@ -525,6 +704,26 @@ func (state *RuntimeState) writeFailureResponse(w http.ResponseWriter, r *http.R
 	}
 }
 
+// writeDenialResponse is like writeFailureResponse, but clients that
+// explicitly accept JSON get a proto.DenialResponse with reasonCode.
+func (state *RuntimeState) writeDenialResponse(w http.ResponseWriter,
+	r *http.Request, code int, reasonCode string, message string) {
+	if !strings.Contains(r.Header.Get("Accept"), "application/json") {
+		state.writeFailureResponse(w, r, code, message)
+		return
+	}
+	if message == "" {
+		message = http.StatusText(code)
+	}
+	setSecurityHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(proto.DenialResponse{
+		ReasonCode: reasonCode,
+		Message:    message,
+	})
+}
+
 func setSecurityHeaders(w http.ResponseWriter) {
 	//all common security headers go here
 	w.Header().Set("Strict-Transport-Security", "max-age=1209600")
@@ -551,13 +750,28 @@ func (state *RuntimeState) sendFailureToClientIfLocked(w http.ResponseWriter, r
 	return false
 }
 
-func (state *RuntimeState) setNewAuthCookie(w http.ResponseWriter, username string, authlevel int) (string, error) {
-	cookieVal, err := state.genNewSerializedAuthJWT(username, authlevel)
+func (state *RuntimeState) setNewAuthCookie(w http.ResponseWriter, r *http.Request, username string, authlevel int) (string, error) {
+	return state.setNewAuthCookieWithAuthTime(w, r, username, authlevel,
+		time.Time{})
+}
+
+// setNewAuthCookieWithAuthTime is like setNewAuthCookie for a session of a
+// user who logged in with credentials at authTime, or now if it is zero.
+func (state *RuntimeState) setNewAuthCookieWithAuthTime(w http.ResponseWriter,
+	r *http.Request, username string, authlevel int,
+	authTime time.Time) (string, error) {
+	expiration := time.Now().Add(time.Duration(maxAgeSecondsAuthCookie) * time.Second)
+	sessionID, err := state.newWebSession(r, username, authlevel, expiration)
+	if err != nil {
+		logger.Println(err)
+		return "", err
+	}
+	cookieVal, err := state.genNewSerializedSessionAuthJWT(username, authlevel,
+		sessionID, authTime)
 	if err != nil {
 		logger.Println(err)
 		return "", err
 	}
-	expiration := time.Now().Add(time.Duration(maxAgeSecondsAuthCookie) * time.Second)
 	authCookie := http.Cookie{Name: authCookieName, Value: cookieVal, Expires: expiration, Path: "/", HttpOnly: true, Secure: true}
 
 	//use handler with original request.
@@ -586,13 +800,17 @@ func (state *RuntimeState) updateAuthCookieAuthlevel(w http.ResponseWriter, r *h
 		return "", err
 	}
 
+	if info, err := state.getAuthInfoFromAuthJWT(cookieVal); err == nil {
+		state.updateWebSessionAuthType(info.SessionID, authlevel)
+	}
 	updatedAuthCookie := http.Cookie{Name: authCookieName, Value: cookieVal, Expires: authCookie.Expires, Path: "/", HttpOnly: true, Secure: true}
 	logger.Debugf(3, "about to update authCookie")
 	http.SetCookie(w, &updatedAuthCookie)
 	return authCookie.Value, nil
 }
 func (state *RuntimeState) isAutomationUser(username string) (bool, error) {
-	for _, automationUsername := range state.Config.Base.AutomationUsers {
+	config := state.getConfig()
+	for _, automationUsername := range config.Base.AutomationUsers {
 		if automationUsername == username {
 			return true, nil
 		}
@@ -601,7 +819,7 @@ func (state *RuntimeState) isAutomationUser(username string) (bool, error) {
 	if err != nil {
 		return false, err
 	}
-	for _, automationGroup := range state.Config.Base.AutomationUserGroups {
+	for _, automationGroup := range config.Base.AutomationUserGroups {
 		for _, groupName := range userGroups {
 			if groupName == automationGroup {
 				return true, nil
@@ -703,10 +921,20 @@ func (state *RuntimeState) checkAuth(w http.ResponseWriter, r *http.Request, req
 			return "", AuthTypeNone, err
 		}
 		state.Mutex.Lock()
-		config := state.Config
+		config := *state.getConfig()
+		passwordChecker := state.passwordChecker
 		state.Mutex.Unlock()
 		user = state.reprocessUsername(user)
-		valid, err := checkUserPassword(user, pass, config, state.passwordChecker, r)
+		attempt := state.checkRateLimit(w, r, user, proto.AuthTypePassword)
+		if attempt == nil {
+			return "", AuthTypeNone, errors.New("too many failed attempts")
+		}
+		defer attempt.release()
+		valid, err := checkUserPassword(user, pass, config, passwordChecker, r)
+		state.logAuditLogin(r, user, proto.AuthTypePassword, valid, err)
+		if err == nil {
+			state.recordRateLimitResult(r, attempt, valid)
+		}
 		if err != nil {
 			state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
 			return "", AuthTypeNone, err
@@ -734,6 +962,14 @@ func (state *RuntimeState) checkAuth(w http.ResponseWriter, r *http.Request, req
 		return "", AuthTypeNone, err
 
 	}
+	if err := state.checkWebSession(info); err != nil {
+		if err == errWebSessionRevoked {
+			state.writeFailureResponse(w, r, http.StatusUnauthorized, "")
+		} else {
+			state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		}
+		return "", AuthTypeNone, err
+	}
 	if (info.AuthType & requiredAuthType) == 0 {
 		state.writeFailureResponse(w, r, http.StatusUnauthorized, "")
 		err := errors.New("Insufficeint Auth Level")
@@ -744,7 +980,7 @@ func (state *RuntimeState) checkAuth(w http.ResponseWriter, r *http.Request, req
 
 func (state *RuntimeState) getRequiredWebUIAuthLevel() int {
 	AuthLevel := 0
-	for _, webUIPref := range state.Config.Base.AllowedAuthBackendsForWebUI {
+	for _, webUIPref := range state.getConfig().Base.AllowedAuthBackendsForWebUI {
 		if webUIPref == proto.AuthTypePassword {
 			AuthLevel |= AuthTypePassword
 		}
@@ -761,6 +997,24 @@ func (state *RuntimeState) getRequiredWebUIAuthLevel() int {
 		if webUIPref == proto.AuthTypeTOTP {
 			AuthLevel |= AuthTypeTOTP
 		}
+		if webUIPref == proto.AuthTypeWebAuthn {
+			AuthLevel |= AuthTypeWebAuthn
+		}
+		if webUIPref == proto.AuthTypeOkta2FA {
+			AuthLevel |= AuthTypeOkta2FA
+		}
+		if webUIPref == proto.AuthTypeRADIUS {
+			AuthLevel |= AuthTypeRADIUS
+		}
+		if webUIPref == proto.AuthTypeDuo {
+			AuthLevel |= AuthTypeDuo
+		}
+		if webUIPref == proto.AuthTypeWebhook {
+			AuthLevel |= AuthTypeWebhook
+		}
+		if webUIPref == proto.AuthTypeRecoveryCode {
+			AuthLevel |= AuthTypeRecoveryCode
+		}
 	}
 	return AuthLevel
 }
@@ -837,6 +1091,7 @@ func (state *RuntimeState) secretInjectorHandler(w http.ResponseWriter, r *http.
 	md, err := openpgp.ReadMessage(armorBlock.Body, nil, prompt, nil)
 	if err != nil {
 		logger.Printf("cannot read message")
+		state.logAuditAdminAction(r, clientName, "unseal", false, nil)
 		state.writeFailureResponse(w, r, http.StatusBadRequest, "Invalid Unlocking key")
 		return
 	}
@@ -870,6 +1125,7 @@ func (state *RuntimeState) secretInjectorHandler(w http.ResponseWriter, r *http.
 	if sendMessage {
 		state.SignerIsReady <- true
 	}
+	state.logAuditAdminAction(r, clientName, "unseal", true, nil)
 
 	// TODO... make success a goroutine
 	w.WriteHeader(200)
@@ -909,6 +1165,12 @@ func (state *RuntimeState) publicPathHandler(w http.ResponseWriter, r *http.Requ
 		w.Header().Set("Content-Disposition", `attachment; filename="id_rsa-cert.pub"`)
 		w.WriteHeader(200)
 		fmt.Fprintf(w, "%s", pemCert)
+	case spiffeBundleTarget:
+		state.writeSPIFFEBundle(w, r)
+	case proto.SSHCAPath[len(publicPath):]:
+		state.writeSSHCAPublicKey(w, r)
+	case proto.SSHClientConfigPath[len(publicPath):]:
+		state.writeSSHClientConfig(w, r)
 	default:
 		state.writeFailureResponse(w, r, http.StatusNotFound, "")
 		return
@@ -996,6 +1258,16 @@ func (state *RuntimeState) loginHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	if state.kerberosAuthenticator != nil &&
+		kerberos.HasNegotiateAuthorization(r) {
+		username, ok := state.checkKerberosAuth(w, r)
+		if !ok {
+			return
+		}
+		state.writeLoginResponse(w, r, username, eventmon.AuthTypeKerberos)
+		return
+	}
+
 	//First headers and then check form
 	username, password, ok := r.BasicAuth()
 	if !ok {
@@ -1024,11 +1296,37 @@ func (state *RuntimeState) loginHandler(w http.ResponseWriter, r *http.Request)
 		}
 	}
 	username = state.reprocessUsername(username)
-	valid, err := checkUserPassword(username, password, state.Config, state.passwordChecker, r)
+	attempt := state.checkRateLimit(w, r, username, proto.AuthTypePassword)
+	if attempt == nil {
+		return
+	}
+	defer attempt.release()
+	// Break glass accounts are checked first, since the identity providers
+	// may be down.
+	if state.breakGlassLogin(w, r, username, password, attempt) {
+		return
+	}
+	state.Mutex.Lock()
+	config := *state.getConfig()
+	passwordChecker := state.passwordChecker
+	state.Mutex.Unlock()
+	valid, passwordStatus, err := checkUserPasswordWithStatus(username,
+		password, config, passwordChecker, r)
+	state.logAuditLogin(r, username, proto.AuthTypePassword, valid, err)
+	if err == nil {
+		// A password which must be changed is still the right one.
+		state.recordRateLimitResult(r, attempt,
+			valid || passwordStatus.MustChange)
+	}
 	if err != nil {
 		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
 		return
 	}
+	if passwordStatus.MustChange {
+		logger.Printf("Password of %s must be changed", username)
+		state.writePasswordMustChangeResponse(w, r, username)
+		return
+	}
 	if !valid {
 		state.writeFailureResponse(w, r, http.StatusUnauthorized, "Invalid Username/Password")
 		logger.Printf("Invalid login for %s", username)
@@ -1038,21 +1336,57 @@ func (state *RuntimeState) loginHandler(w http.ResponseWriter, r *http.Request)
 
 	// AUTHN has passed
 	logger.Debugf(1, "Valid passwd AUTH login for %s\n", username)
+	stepUp, ok := state.checkLoginLocation(w, r, username)
+	if !ok {
+		return
+	}
+	state.recordLoginDevice(r, username)
+	state.checkLoginAddress(r, username)
+	state.writeLoginResponseWithPasswordStatus(w, r, username,
+		eventmon.AuthTypePassword, passwordStatus,
+		getStepUpAuthFlags(stepUp))
+}
+
+// writeLoginResponse sets the auth cookie for a user who has passed the
+// primary (password level) authentication and answers with the login page
+// or the second factors to use.
+func (state *RuntimeState) writeLoginResponse(w http.ResponseWriter,
+	r *http.Request, username string, eventAuthType string) {
+	state.writeLoginResponseWithPasswordStatus(w, r, username, eventAuthType,
+		pwauth.PasswordStatus{}, 0)
+}
+
+// writeLoginResponseWithPasswordStatus is like writeLoginResponse, but also
+// warns about the expiry of the password given by passwordStatus. authFlags
+// are set on the session in addition to AuthTypePassword: with
+// AuthTypeStepUpRequired the password is not enough for certificates or the
+// web UI login, and with AuthTypeBreakGlass it is enough for certificates.
+func (state *RuntimeState) writeLoginResponseWithPasswordStatus(
+	w http.ResponseWriter, r *http.Request, username string,
+	eventAuthType string, passwordStatus pwauth.PasswordStatus,
+	authFlags int) {
+	stepUp := authFlags&AuthTypeStepUpRequired != 0
 	userHasU2FTokens, err := state.userHasU2FTokens(username)
 	if err != nil {
 		state.writeFailureResponse(w, r, http.StatusInternalServerError, "error internal")
 		logger.Println(err)
 		return
 	}
+	userHasWebauthnCredentials, err := state.userHasWebauthnCredentials(username)
+	if err != nil {
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "error internal")
+		logger.Println(err)
+		return
+	}
 
-	//
-	_, err = state.setNewAuthCookie(w, username, AuthTypePassword)
+	authLevel := AuthTypePassword | authFlags
+	_, err = state.setNewAuthCookie(w, r, username, authLevel)
 	if err != nil {
 		state.writeFailureResponse(w, r, http.StatusInternalServerError, "error internal")
 		logger.Println(err)
 		return
 	}
-	eventNotifier.PublishAuthEvent(eventmon.AuthTypePassword, username)
+	eventNotifier.PublishAuthEvent(eventAuthType, username)
 
 	returnAcceptType := "application/json"
 	acceptHeader, ok := r.Header["Accept"]
@@ -1067,8 +1401,8 @@ func (state *RuntimeState) loginHandler(w http.ResponseWriter, r *http.Request)
 
 	// Compute the cert prefs
 	var certBackends []string
-	for _, certPref := range state.Config.Base.AllowedAuthBackendsForCerts {
-		if certPref == proto.AuthTypePassword {
+	for _, certPref := range state.getConfig().Base.AllowedAuthBackendsForCerts {
+		if certPref == proto.AuthTypePassword && !stepUp {
 			certBackends = append(certBackends, proto.AuthTypePassword)
 		}
 		if certPref == proto.AuthTypeU2F && userHasU2FTokens {
@@ -1080,6 +1414,28 @@ func (state *RuntimeState) loginHandler(w http.ResponseWriter, r *http.Request)
 		if certPref == proto.AuthTypeTOTP && state.Config.Base.EnableLocalTOTP {
 			certBackends = append(certBackends, proto.AuthTypeTOTP)
 		}
+		if certPref == proto.AuthTypeWebAuthn && userHasWebauthnCredentials {
+			certBackends = append(certBackends, proto.AuthTypeWebAuthn)
+		}
+		if certPref == proto.AuthTypeOkta2FA && state.userHasOktaWebAuthn(username) {
+			certBackends = append(certBackends, proto.AuthTypeOkta2FA)
+		}
+		if certPref == proto.AuthTypeRADIUS && state.radiusAuthenticator != nil {
+			certBackends = append(certBackends, proto.AuthTypeRADIUS)
+		}
+		if certPref == proto.AuthTypeDuo && state.isDuoUser(username) {
+			certBackends = append(certBackends, proto.AuthTypeDuo)
+		}
+		if certPref == proto.AuthTypeWebhook && state.webhookAuthenticator != nil {
+			certBackends = append(certBackends, proto.AuthTypeWebhook)
+		}
+		if certPref == proto.AuthTypeRecoveryCode && state.userHasRecoveryCodes(username) {
+			certBackends = append(certBackends, proto.AuthTypeRecoveryCode)
+		}
+	}
+	// Break glass accounts have no second factors.
+	if authFlags&AuthTypeBreakGlass != 0 {
+		certBackends = []string{proto.AuthTypePassword}
 	}
 	// logger.Printf("current backends=%+v", certBackends)
 	if len(certBackends) == 0 {
@@ -1088,12 +1444,13 @@ func (state *RuntimeState) loginHandler(w http.ResponseWriter, r *http.Request)
 
 	// TODO: The cert backend should depend also on per user preferences.
 	loginResponse := proto.LoginResponse{Message: "success",
-		CertAuthBackend: certBackends}
+		CertAuthBackend: certBackends, SupportedKeyTypes: supportedKeyTypes,
+		PasswordExpiresIn: int64(passwordStatus.ExpiresIn / time.Second)}
 	switch returnAcceptType {
 	case "text/html":
 		loginDestination := getLoginDestination(r)
 		requiredAuth := state.getRequiredWebUIAuthLevel()
-		if (requiredAuth & AuthTypePassword) != 0 {
+		if (requiredAuth&AuthTypePassword) != 0 && !stepUp {
 			eventNotifier.PublishWebLoginEvent(username)
 			http.Redirect(w, r, loginDestination, 302)
 		} else {
@@ -1110,12 +1467,14 @@ func (state *RuntimeState) loginHandler(w http.ResponseWriter, r *http.Request)
 					http.SetCookie(w, &vipPushCookie)
 				}
 			}
-			state.writeHTML2FAAuthPage(w, r, loginDestination, userHasU2FTokens)
+			state.writeHTML2FAAuthPage(w, r, loginDestination, username,
+				userHasU2FTokens, userHasWebauthnCredentials,
+				passwordExpiryWarning(passwordStatus))
 		}
 	default:
 		// add vippush cookie if we are using VIP
 		usesVIP := false
-		for _, certPref := range state.Config.Base.AllowedAuthBackendsForCerts {
+		for _, certPref := range state.getConfig().Base.AllowedAuthBackendsForCerts {
 			if certPref == proto.AuthTypeSymantecVIP && state.Config.SymantecVIP.Enabled {
 				usesVIP = true
 			}
@@ -1160,6 +1519,14 @@ func (state *RuntimeState) logoutHandler(w http.ResponseWriter, r *http.Request)
 	}
 
 	if authCookie != nil {
+		info, err := state.getAuthInfoFromAuthJWT(authCookie.Value)
+		if err == nil && info.SessionID != "" {
+			if _, err := state.revokeWebSession(info.Username,
+				info.SessionID); err != nil {
+				logger.Printf("cannot end session of %s: %s", info.Username,
+					err)
+			}
+		}
 		expiration := time.Unix(0, 0)
 		updatedAuthCookie := http.Cookie{Name: authCookieName, Value: "", Expires: expiration, Path: "/", HttpOnly: true, Secure: true}
 		http.SetCookie(w, &updatedAuthCookie)
@@ -1171,12 +1538,13 @@ func (state *RuntimeState) logoutHandler(w http.ResponseWriter, r *http.Request)
 ///
 
 func (state *RuntimeState) _IsAdminUser(user string) (bool, error) {
-	for _, adminUser := range state.Config.Base.AdminUsers {
+	config := state.getConfig()
+	for _, adminUser := range config.Base.AdminUsers {
 		if user == adminUser {
 			return true, nil
 		}
 	}
-	if len(state.Config.Base.AdminGroups) > 0 {
+	if len(config.Base.AdminGroups) > 0 {
 		groups, err := state.getUserGroups(user)
 		if err != nil {
 			return false, err
@@ -1189,7 +1557,7 @@ func (state *RuntimeState) _IsAdminUser(user string) (bool, error) {
 		// Check each admin group from config file.
 		// If user belongs to one of these groups then they are an admin
 		// user.
-		for _, adminGroup := range state.Config.Base.AdminGroups {
+		for _, adminGroup := range config.Base.AdminGroups {
 			if _, ok := userGroupSet[adminGroup]; ok {
 				return true, nil
 			}
@@ -1319,6 +1687,10 @@ func (state *RuntimeState) profileHandler(w http.ResponseWriter, r *http.Request
 	if showU2F {
 		JSSources = append(JSSources, "/static/u2f-api.js", "/static/keymaster-u2f.js")
 	}
+	showWebAuthn := state.webAuthn != nil
+	if showWebAuthn {
+		JSSources = append(JSSources, "/static/keymaster-webauthn.js")
+	}
 
 	// TODO: move deviceinfo mapping/sorting to its own function
 	var u2fdevices []registeredU2FTokenDisplayInfo
@@ -1348,7 +1720,44 @@ func (state *RuntimeState) profileHandler(w http.ResponseWriter, r *http.Request
 		}
 		totpdevices = append(totpdevices, deviceData)
 	}
+	var webauthnCredentials []registeredWebAuthnCredentialDisplayInfo
+	for i, credentialInfo := range profile.WebauthnData {
+		credentialData := registeredWebAuthnCredentialDisplayInfo{
+			RegistrationDate: credentialInfo.CreatedAt,
+			DeviceData:       credentialInfo.Credential.AttestationType,
+			Enabled:          credentialInfo.Enabled,
+			Name:             credentialInfo.Name,
+			Index:            i,
+		}
+		webauthnCredentials = append(webauthnCredentials, credentialData)
+	}
+	sort.Slice(webauthnCredentials, func(i, j int) bool {
+		return webauthnCredentials[i].Index < webauthnCredentials[j].Index
+	})
+	sessions, err := state.getWebSessions(assumedUser)
+	if err != nil {
+		logger.Printf("listing sessions error: %v", err)
+	}
+	currentSessionID := state.getRequestWebSessionID(r)
+	var sessionsDisplay []webSessionDisplayInfo
+	for _, session := range sessions {
+		sessionsDisplay = append(sessionsDisplay, webSessionDisplayInfo{
+			ID:          session.ID,
+			RemoteAddr:  session.RemoteAddr,
+			UserAgent:   session.UserAgent,
+			AuthMethods: strings.Join(getAuthMethodNames(session.AuthType), ","),
+			CreatedAt:   session.CreatedAt,
+			Current:     session.ID == currentSessionID,
+		})
+	}
 	showTOTP := state.Config.Base.EnableLocalTOTP
+	var factorPolicyMsg string
+	if err := state.checkEnabledFactors(assumedUser); err != nil {
+		if e, ok := err.(notEnoughFactorsError); ok {
+			factorPolicyMsg = fmt.Sprintf("You need at least %d enabled U2F, WebAuthn or TOTP devices to get certificates.",
+				e.required)
+		}
+	}
 
 	displayData := profilePageTemplateData{
 		Username:             assumedUser,
@@ -1361,6 +1770,15 @@ func (state *RuntimeState) profileHandler(w http.ResponseWriter, r *http.Request
 		RegisteredU2FToken:   u2fdevices,
 		ShowTOTP:             showTOTP,
 		RegisteredTOTPDevice: totpdevices,
+		ShowWebAuthn:         showWebAuthn,
+		RegisteredWebAuthn:   webauthnCredentials,
+		FactorPolicyMsg:      factorPolicyMsg,
+		ShowRecoveryCodes:    state.Config.Base.EnableRecoveryCodes,
+		RecoveryCodesLeft:    len(profile.RecoveryCodes),
+		EnrollmentTokenRequired: state.Config.KeyEnrollment.RequireStepUp &&
+			loginLevel&secondFactorAuthTypes == 0,
+		ShowSessions: state.webSessionStorage() != nil,
+		Sessions:     sessionsDisplay,
 	}
 	logger.Debugf(1, "%v", displayData)
 
@@ -1606,15 +2024,95 @@ func main() {
 	// Expose the registered metrics via HTTP.
 	http.Handle("/", adminDashboard)
 	http.Handle("/prometheus_metrics", promhttp.Handler()) //lint:ignore SA1019 TODO: newer prometheus handler
+	http.Handle(metricsPath, promhttp.Handler())           //lint:ignore SA1019 TODO: newer prometheus handler
 	http.HandleFunc(secretInjectorPath, runtimeState.secretInjectorHandler)
+	http.HandleFunc(adminAPIUsersPath, runtimeState.adminAPIUsersHandler)
+	http.HandleFunc(adminAPIResetTokensPath,
+		runtimeState.adminAPIResetTokensHandler)
+	http.HandleFunc(adminAPIRevokePath, runtimeState.adminAPIRevokeHandler)
+	http.HandleFunc(adminAPIIssuanceLogPath,
+		runtimeState.adminAPIIssuanceLogHandler)
+	http.HandleFunc(adminAPIReloadConfigPath,
+		runtimeState.adminAPIReloadConfigHandler)
+	http.HandleFunc(adminAPIPrincipalsPath,
+		runtimeState.adminAPIPrincipalsHandler)
+	http.HandleFunc(adminAPIReencryptStoragePath,
+		runtimeState.adminAPIReencryptStorageHandler)
+	if runtimeState.Config.ServiceAccounts.Enabled {
+		http.HandleFunc(adminAPIServiceAccountsPath,
+			runtimeState.adminAPIServiceAccountsHandler)
+		http.HandleFunc(adminAPIServiceAccountTokenPath,
+			runtimeState.adminAPIServiceAccountTokenHandler)
+		http.HandleFunc(adminAPIDeleteServiceAccountPath,
+			runtimeState.adminAPIDeleteServiceAccountHandler)
+	}
+	http.HandleFunc(adminAPISessionsPath, runtimeState.adminAPISessionsHandler)
+	http.HandleFunc(adminAPIRevokeSessionsPath,
+		runtimeState.adminAPIRevokeSessionsHandler)
+	http.HandleFunc(adminAPIEnrollmentTokenPath,
+		runtimeState.adminAPIEnrollmentTokenHandler)
+	http.HandleFunc(adminAPIDevicesPath, runtimeState.adminAPIDevicesHandler)
+	http.HandleFunc(adminAPISetDeviceStatePath,
+		runtimeState.adminAPISetDeviceStateHandler)
+	if runtimeState.localUsers != nil {
+		http.HandleFunc(adminAPILocalUsersPath,
+			runtimeState.adminAPILocalUsersHandler)
+		http.HandleFunc(adminAPILocalUserPasswordPath,
+			runtimeState.adminAPILocalUserPasswordHandler)
+		http.HandleFunc(adminAPILocalUserDisabledPath,
+			runtimeState.adminAPILocalUserDisabledHandler)
+		http.HandleFunc(adminAPILocalUserGroupsPath,
+			runtimeState.adminAPILocalUserGroupsHandler)
+		http.HandleFunc(adminAPIDeleteLocalUserPath,
+			runtimeState.adminAPIDeleteLocalUserHandler)
+	}
 
 	serviceMux := http.NewServeMux()
 	serviceMux.HandleFunc(certgenPath, runtimeState.certGenHandler)
 	serviceMux.HandleFunc(publicPath, runtimeState.publicPathHandler)
 	serviceMux.HandleFunc(proto.LoginPath, runtimeState.loginHandler)
+	if runtimeState.cloudIdentityAuthenticator != nil {
+		serviceMux.HandleFunc(proto.CloudIdentityLoginPath,
+			runtimeState.cloudIdentityLoginHandler)
+	}
+	if runtimeState.oidcTokenVerifier != nil {
+		serviceMux.HandleFunc(proto.OIDCTokenLoginPath,
+			runtimeState.oidcTokenLoginHandler)
+	}
+	if runtimeState.Config.ServiceAccounts.Enabled {
+		serviceMux.HandleFunc(proto.ServiceAccountLoginPath,
+			runtimeState.serviceAccountLoginHandler)
+	}
+	if runtimeState.Config.CertRenewal.Enabled {
+		serviceMux.HandleFunc(proto.CertificateRenewalLoginPath,
+			runtimeState.certRenewalLoginHandler)
+	}
+	serviceMux.HandleFunc(proto.ChangePasswordPath,
+		runtimeState.changePasswordHandler)
 	serviceMux.HandleFunc(logoutPath, runtimeState.logoutHandler)
 	serviceMux.HandleFunc(profilePath, runtimeState.profileHandler)
+	serviceMux.HandleFunc(certRequestPath, runtimeState.certRequestHandler)
 	serviceMux.HandleFunc(usersPath, runtimeState.usersHandler)
+	serviceMux.HandleFunc(issuanceLogPath, runtimeState.issuanceLogHandler)
+	serviceMux.HandleFunc(revokePath, runtimeState.revokeHandler)
+	serviceMux.HandleFunc(crlPath, runtimeState.crlHandler)
+	serviceMux.HandleFunc(ocspPath, runtimeState.ocspHandler)
+	serviceMux.HandleFunc(ocspPath+"/", runtimeState.ocspHandler)
+	serviceMux.HandleFunc(sshKRLPath, runtimeState.sshKRLHandler)
+	serviceMux.HandleFunc(proto.ClientConfigPath,
+		runtimeState.clientConfigHandler)
+	if runtimeState.Config.BearerTokens.Enabled {
+		serviceMux.HandleFunc(proto.BearerTokenPath,
+			runtimeState.bearerTokenHandler)
+	}
+	if runtimeState.Config.HostCerts.Enabled {
+		serviceMux.HandleFunc(proto.HostCertPath,
+			runtimeState.hostCertHandler)
+	}
+	if runtimeState.acmeServer != nil {
+		serviceMux.Handle(acmePath+"/",
+			http.StripPrefix(acmePath, runtimeState.acmeServer))
+	}
 
 	serviceMux.HandleFunc(idpOpenIDCConfigurationDocumentPath, runtimeState.idpOpenIDCDiscoveryHandler)
 	serviceMux.HandleFunc(idpOpenIDCJWKSPath, runtimeState.idpOpenIDCJWKSHandler)
@@ -1633,9 +2131,43 @@ func main() {
 	serviceMux.HandleFunc(u2fSignRequestPath, runtimeState.u2fSignRequest)
 	serviceMux.HandleFunc(u2fSignResponsePath, runtimeState.u2fSignResponse)
 	serviceMux.HandleFunc(vipAuthPath, runtimeState.VIPAuthHandler)
+	serviceMux.HandleFunc(proto.RADIUSAuthPath, runtimeState.RADIUSAuthHandler)
+	serviceMux.HandleFunc(proto.DuoAuthPath, runtimeState.DuoAuthHandler)
+	serviceMux.HandleFunc(proto.DuoPushPath, runtimeState.duoPushHandler)
+	serviceMux.HandleFunc(proto.WebhookAuthPath,
+		runtimeState.WebhookAuthHandler)
 	serviceMux.HandleFunc(u2fTokenManagementPath, runtimeState.u2fTokenManagerHandler)
+	serviceMux.HandleFunc(webauthnTokenManagementPath,
+		runtimeState.webauthnTokenManagerHandler)
+	serviceMux.HandleFunc(proto.FactorsPath, runtimeState.factorsHandler)
+	serviceMux.HandleFunc(proto.SessionsPath, runtimeState.sessionsHandler)
+	serviceMux.HandleFunc(proto.CertApprovalsPath,
+		runtimeState.certApprovalsHandler)
+	if len(runtimeState.Config.BreakGlass.Admins) > 0 {
+		serviceMux.HandleFunc(proto.BreakGlassPath,
+			runtimeState.breakGlassHandler)
+	}
+	serviceMux.HandleFunc(proto.RecoveryCodesPath,
+		runtimeState.recoveryCodesHandler)
+	serviceMux.HandleFunc(proto.RecoveryCodeAuthPath,
+		runtimeState.RecoveryCodeAuthHandler)
+	serviceMux.HandleFunc(proto.WebAuthnRegisterBeginPath,
+		runtimeState.webauthnBeginRegistration)
+	serviceMux.HandleFunc(proto.WebAuthnRegisterFinishPath,
+		runtimeState.webauthnFinishRegistration)
+	serviceMux.HandleFunc(proto.WebAuthnAuthBeginPath,
+		runtimeState.webauthnAuthBegin)
+	serviceMux.HandleFunc(proto.WebAuthnAuthFinishPath,
+		runtimeState.webauthnAuthFinish)
+	serviceMux.HandleFunc(proto.OktaWebAuthnAuthBeginPath,
+		runtimeState.oktaWebAuthnAuthBegin)
+	serviceMux.HandleFunc(proto.OktaWebAuthnAuthFinishPath,
+		runtimeState.oktaWebAuthnAuthFinish)
 	serviceMux.HandleFunc(oauth2LoginBeginPath, runtimeState.oauth2DoRedirectoToProviderHandler)
 	serviceMux.HandleFunc(redirectPath, runtimeState.oauth2RedirectPathHandler)
+	serviceMux.HandleFunc(samlLoginPath, runtimeState.samlLoginHandler)
+	serviceMux.HandleFunc(samlACSPath, runtimeState.samlACSHandler)
+	serviceMux.HandleFunc(samlMetadataPath, runtimeState.samlMetadataHandler)
 	serviceMux.HandleFunc(clientConfHandlerPath, runtimeState.serveClientConfHandler)
 	serviceMux.HandleFunc(vipPushStartPath, runtimeState.vipPushStartHandler)
 	serviceMux.HandleFunc(vipPollCheckPath, runtimeState.VIPPollCheckHandler)
@@ -1644,7 +2176,12 @@ func main() {
 	serviceMux.HandleFunc(totpTokenManagementPath, runtimeState.totpTokenManagerHandler)
 	serviceMux.HandleFunc(totpVerifyHandlerPath, runtimeState.verifyTOTPHandler)
 	serviceMux.HandleFunc(totpAuthPath, runtimeState.TOTPAuthHandler)
+	serviceMux.HandleFunc(proto.TOTPEnrollPath, runtimeState.totpEnrollHandler)
+	serviceMux.HandleFunc(proto.TOTPEnrollVerifyPath,
+		runtimeState.totpEnrollVerifyHandler)
 
+	serviceMux.HandleFunc(healthzPath, runtimeState.healthzHandler)
+	serviceMux.HandleFunc(readyzPath, runtimeState.readyzHandler)
 	serviceMux.HandleFunc("/", runtimeState.defaultPathHandler)
 
 	cfg := &tls.Config{
@@ -1694,13 +2231,26 @@ func main() {
 			logger.Fatalf("Cannot update password checker")
 		}
 	}
+	if runtimeState.oktaAuthenticator != nil &&
+		runtimeState.Config.Okta.SharedCache {
+		err = runtimeState.oktaAuthenticator.UpdateStorage(
+			runtimeState.authCacheStorage())
+		if err != nil {
+			logger.Fatalf("Cannot update Okta authenticator storage")
+		}
+	}
+	go runtimeState.reloadConfigOnSIGHUP(*configFilename)
 
 	// Safari in MacOS 10.12.x required a cert to be presented by the user even
 	// when optional.
 	// Our usage shows this is less than 1% of users so we are now mandating
 	// verification on issues we will need to update clientAuth back  to tls.RequestClientCert
+	serviceClientCAs, err := runtimeState.serviceClientCAPool()
+	if err != nil {
+		logger.Fatalf("Cannot make the client CA pool: %s", err)
+	}
 	serviceTLSConfig := &tls.Config{
-		ClientCAs:                runtimeState.ClientCAPool,
+		ClientCAs:                serviceClientCAs,
 		ClientAuth:               tls.VerifyClientCertIfGiven,
 		MinVersion:               tls.VersionTLS12,
 		CurvePreferences:         []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
@@ -1712,15 +2262,25 @@ func main() {
 		},
 	}
 
+	serviceHandler := instrumentedwriter.NewLoggingHandler(serviceMux,
+		serviceHTTPLogger)
 	serviceSrv := &http.Server{
 		Addr:         runtimeState.Config.Base.HttpAddress,
-		Handler:      instrumentedwriter.NewLoggingHandler(serviceMux, serviceHTTPLogger),
+		Handler:      serviceHandler,
 		TLSConfig:    serviceTLSConfig,
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 10 * time.Second,
 		IdleTimeout:  120 * time.Second,
 	}
 
+	if runtimeState.Config.Base.GRPCAddress != "" {
+		go func() {
+			err := runtimeState.serveGRPC(serviceHandler, serviceTLSConfig)
+			if err != nil {
+				logger.Fatalf("Cannot serve the gRPC API: %s", err)
+			}
+		}()
+	}
 	http.Handle(eventmon.HttpPath, eventNotifier)
 	go func() {
 		time.Sleep(time.Millisecond * 10)
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/Cloud-Foundations/keymaster/lib/auditlog"
+)
+
+// logAuditEvent records event in the audit log. If r is not nil the address
+// of its client is added.
+func (state *RuntimeState) logAuditEvent(r *http.Request,
+	event auditlog.Event) {
+	if r != nil {
+		event.RemoteAddr = r.RemoteAddr
+	}
+	state.auditLogger.Log(event)
+	state.notifyAuditEvent(event)
+}
+
+// logAuditEnrollment records the registration of a second factor of method
+// for username.
+func (state *RuntimeState) logAuditEnrollment(r *http.Request,
+	username string, method string) {
+	state.logAuditEvent(r, auditlog.Event{
+		Type:     auditlog.EventTypeEnrollment,
+		Username: username,
+		Success:  true,
+		Method:   method,
+	})
+}
+
+// logAuditLogin records a login attempt with method. A non-nil err is a
+// failure to check the credentials.
+func (state *RuntimeState) logAuditLogin(r *http.Request, username string,
+	method string, valid bool, err error) {
+	event := auditlog.Event{
+		Type:     auditlog.EventTypeLogin,
+		Username: username,
+		Success:  valid && err == nil,
+		Method:   method,
+	}
+	if err != nil {
+		event.Details = map[string]string{"error": err.Error()}
+	}
+	state.logAuditEvent(r, event)
+}
+
+// logSecondFactorResult records the result of a second factor check of
+// authType in the metrics and audit log.
+func (state *RuntimeState) logSecondFactorResult(r *http.Request,
+	username string, authType string, valid bool) {
+	metricLogAuthOperation(getClientType(r), authType, valid)
+	state.logAuditEvent(r, auditlog.Event{
+		Type:     auditlog.EventTypeSecondFactor,
+		Username: username,
+		Success:  valid,
+		Method:   authType,
+	})
+}
+
+// logAuditAdminAction records action by admin. details may be nil.
+func (state *RuntimeState) logAuditAdminAction(r *http.Request, admin string,
+	action string, success bool, details map[string]string) {
+	state.logAuditEvent(r, auditlog.Event{
+		Type:     auditlog.EventTypeAdmin,
+		Username: admin,
+		Success:  success,
+		Method:   action,
+		Details:  details,
+	})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Cloud-Foundations/keymaster/lib/auditlog"
+	"github.com/Cloud-Foundations/keymaster/lib/issuancelog"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit_testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "audit.log")
+	var state RuntimeState
+	state.auditLogger, err = auditlog.New([]auditlog.SinkConfig{
+		{Type: "file", Filename: filename}}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", proto.LoginPath, nil)
+	state.logAuditLogin(r, "username", proto.AuthTypePassword, true, nil)
+	state.logAuditLogin(r, "username", proto.AuthTypePassword, true,
+		errors.New("ldap is down"))
+	state.logSecondFactorResult(r, "username", proto.AuthTypeTOTP, false)
+	err = state.appendIssuanceLog(issuancelog.Entry{Username: "username",
+		CertType: "ssh", Serial: "42"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := state.auditLogger.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []auditlog.Event
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	for decoder.More() {
+		var event auditlog.Event
+		if err := decoder.Decode(&event); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+	expected := []struct {
+		eventType string
+		success   bool
+	}{
+		{auditlog.EventTypeLogin, true},
+		{auditlog.EventTypeLogin, false},
+		{auditlog.EventTypeSecondFactor, false},
+		{auditlog.EventTypeIssue, true},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events, got %d", len(expected), len(events))
+	}
+	for i, event := range events {
+		if event.Type != expected[i].eventType ||
+			event.Success != expected[i].success ||
+			event.Username != "username" {
+			t.Fatalf("unexpected event %d: %+v", i, event)
+		}
+	}
+	if events[0].RemoteAddr != r.RemoteAddr {
+		t.Fatalf("expected remote address %s, got %s", r.RemoteAddr,
+			events[0].RemoteAddr)
+	}
+	if events[1].Details["error"] != "ldap is down" {
+		t.Fatalf("unexpected details: %v", events[1].Details)
+	}
+	if events[3].Details["serial"] != "42" {
+		t.Fatalf("unexpected details: %v", events[3].Details)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/Cloud-Foundations/keymaster/lib/authenticators/cloudidentity"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+	"github.com/Cloud-Foundations/keymaster/proto/eventmon"
+)
+
+// awsSTSURL overrides the STS endpoint AWS identities are verified with.
+// It is replaced in tests.
+var awsSTSURL string
+
+func (state *RuntimeState) setupCloudIdentity() error {
+	config := state.Config.CloudIdentity
+	for _, identity := range config.Identities {
+		if identity.Username == "" || identity.Account == "" {
+			return errors.New("identities need a username and an account")
+		}
+		switch identity.Provider {
+		case cloudidentity.ProviderAWS, cloudidentity.ProviderGCP,
+			cloudidentity.ProviderAzure:
+		default:
+			return fmt.Errorf("unknown provider %q for %s", identity.Provider,
+				identity.Username)
+		}
+	}
+	var err error
+	state.cloudIdentityAuthenticator, err = cloudidentity.New(
+		cloudidentity.Config{
+			AWSCertificateFilename:      config.AWSCertificateFilename,
+			AWSAudiences:                config.AWSAudiences,
+			AWSSTSURL:                   awsSTSURL,
+			GCPAudiences:                config.GCPAudiences,
+			AzureEnabled:                config.AzureEnabled,
+			AzureRootCAFilename:         config.AzureRootCAFilename,
+			AzureIntermediateCAFilename: config.AzureIntermediateCAFilename,
+		}, logger)
+	return err
+}
+
+func stringInList(value string, list []string) bool {
+	for _, entry := range list {
+		if entry == value {
+			return true
+		}
+	}
+	return false
+}
+
+// cloudIdentityAllowed returns true if identity may log in as username.
+func (state *RuntimeState) cloudIdentityAllowed(
+	identity *cloudidentity.Identity, username string) bool {
+	for _, allowed := range state.Config.CloudIdentity.Identities {
+		if allowed.Username != username ||
+			allowed.Provider != identity.Provider ||
+			allowed.Account != identity.Account {
+			continue
+		}
+		if len(allowed.InstanceIDs) > 0 &&
+			!stringInList(identity.InstanceID, allowed.InstanceIDs) {
+			continue
+		}
+		if len(allowed.ServiceAccounts) > 0 &&
+			!stringInList(identity.ServiceAccount, allowed.ServiceAccounts) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// checkCloudIdentityLogin returns an error if the credential in the form of
+// r does not allow logging in as username.
+func (state *RuntimeState) checkCloudIdentityLogin(r *http.Request,
+	username string) error {
+	identity, err := state.cloudIdentityAuthenticator.Authenticate(
+		cloudidentity.Credential{
+			Provider:   r.Form.Get("provider"),
+			Document:   r.Form.Get("document"),
+			Signature:  r.Form.Get("signature"),
+			STSRequest: r.Form.Get("sts_request"),
+			Token:      r.Form.Get("token"),
+		})
+	if err != nil {
+		return err
+	}
+	if !state.cloudIdentityAllowed(identity, username) {
+		return fmt.Errorf("%s instance %s of %s may not log in as %s",
+			identity.Provider, identity.InstanceID, identity.Account, username)
+	}
+	ok, err := state.isAutomationUser(username)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%s is not an automation user", username)
+	}
+	return nil
+}
+
+// cloudIdentityLoginHandler logs in automation users with the identity
+// credentials of cloud instances, as described for
+// proto.CloudIdentityLoginPath.
+func (state *RuntimeState) cloudIdentityLoginHandler(w http.ResponseWriter,
+	r *http.Request) {
+	if state.sendFailureToClientIfLocked(w, r) {
+		return
+	}
+	if r.Method != "POST" {
+		state.writeFailureResponse(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		logger.Println(err)
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Error parsing form")
+		return
+	}
+	username := state.reprocessUsername(r.Form.Get("username"))
+	if username == "" {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Missing username")
+		return
+	}
+	attempt := state.checkRateLimit(w, r, username, proto.AuthTypeCloudIdentity)
+	if attempt == nil {
+		return
+	}
+	defer attempt.release()
+	err := state.checkCloudIdentityLogin(r, username)
+	state.logAuditLogin(r, username, proto.AuthTypeCloudIdentity, err == nil,
+		err)
+	state.recordRateLimitResult(r, attempt, err == nil)
+	if err != nil {
+		logger.Printf("cloud identity login as %s failed: %s", username, err)
+		state.writeFailureResponse(w, r, http.StatusUnauthorized,
+			"Invalid cloud identity")
+		return
+	}
+	_, err = state.setNewAuthCookie(w, r, username, AuthTypeCloudIdentity)
+	if err != nil {
+		state.writeFailureResponse(w, r, http.StatusInternalServerError,
+			"error internal")
+		logger.Println(err)
+		return
+	}
+	eventNotifier.PublishAuthEvent(eventmon.AuthTypeCloudIdentity, username)
+	logger.Debugf(1, "Valid cloud identity login for %s", username)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(proto.LoginResponse{
+		Message:           "success",
+		CertAuthBackend:   []string{proto.AuthTypeCloudIdentity},
+		SupportedKeyTypes: supportedKeyTypes,
+	})
+}
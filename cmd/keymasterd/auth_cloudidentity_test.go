@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Cloud-Foundations/keymaster/lib/authenticators/cloudidentity"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+const testCloudIdentityDocument = `{"accountId":"123456789012","instanceId":"i-0123456789abcdef0","region":"us-west-2"}`
+
+func TestCloudIdentityAllowed(t *testing.T) {
+	var state RuntimeState
+	state.Config.CloudIdentity.Identities = []CloudIdentity{
+		{
+			Username: "svc-deploy",
+			Provider: cloudidentity.ProviderAWS,
+			Account:  "123456789012",
+		},
+		{
+			Username:        "svc-build",
+			Provider:        cloudidentity.ProviderGCP,
+			Account:         "project-1",
+			InstanceIDs:     []string{"1234"},
+			ServiceAccounts: []string{"build@project-1.iam.gserviceaccount.com"},
+		},
+	}
+	for _, test := range []struct {
+		identity cloudidentity.Identity
+		username string
+		allowed  bool
+	}{
+		{cloudidentity.Identity{Provider: "aws", Account: "123456789012",
+			InstanceID: "i-1"}, "svc-deploy", true},
+		{cloudidentity.Identity{Provider: "aws", Account: "123456789012",
+			InstanceID: "i-1"}, "svc-build", false},
+		{cloudidentity.Identity{Provider: "gcp", Account: "123456789012",
+			InstanceID: "i-1"}, "svc-deploy", false},
+		{cloudidentity.Identity{Provider: "gcp", Account: "project-1",
+			InstanceID:     "1234",
+			ServiceAccount: "build@project-1.iam.gserviceaccount.com"},
+			"svc-build", true},
+		{cloudidentity.Identity{Provider: "gcp", Account: "project-1",
+			InstanceID:     "5678",
+			ServiceAccount: "build@project-1.iam.gserviceaccount.com"},
+			"svc-build", false},
+		{cloudidentity.Identity{Provider: "gcp", Account: "project-1",
+			InstanceID: "1234"}, "svc-build", false},
+	} {
+		identity := test.identity
+		if state.cloudIdentityAllowed(&identity, test.username) !=
+			test.allowed {
+			t.Errorf("cloudIdentityAllowed(%+v, %s) != %v", test.identity,
+				test.username, test.allowed)
+		}
+	}
+}
+
+func TestCloudIdentityLogin(t *testing.T) {
+	state, passwdFile, err := setupValidRuntimeStateSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(passwdFile.Name()) // clean up
+	dir, err := ioutil.TempDir("", "cloud_identity_testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	awsCertFilename := filepath.Join(dir, "aws.pem")
+	awsKey := writeTestAWSCertificate(t, awsCertFilename)
+	defer startTestAWSSTS(t)()
+	state.Config.Base.AutomationUsers = []string{"svc-deploy"}
+	state.Config.CloudIdentity = CloudIdentityConfig{
+		Enabled:                true,
+		AWSCertificateFilename: awsCertFilename,
+		AWSAudiences:           []string{testAWSAudience},
+		Identities: []CloudIdentity{
+			{
+				Username: "svc-deploy",
+				Provider: cloudidentity.ProviderAWS,
+				Account:  "123456789012",
+			},
+			{
+				Username: validUsernameConst,
+				Provider: cloudidentity.ProviderAWS,
+				Account:  "123456789012",
+			},
+		},
+	}
+	if err := state.setupCloudIdentity(); err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte(testCloudIdentityDocument))
+	signature, err := awsKey.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newRequest := func(username string) *http.Request {
+		form := url.Values{
+			"username":    {username},
+			"provider":    {cloudidentity.ProviderAWS},
+			"document":    {testCloudIdentityDocument},
+			"signature":   {base64.StdEncoding.EncodeToString(signature)},
+			"sts_request": {newTestAWSSTSRequest(t)},
+		}
+		req, err := http.NewRequest("POST", proto.CloudIdentityLoginPath,
+			strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req
+	}
+	rr, err := checkRequestHandlerCode(newRequest("svc-deploy"),
+		state.cloudIdentityLoginHandler, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !checkValidLoginResponse(rr.Result(), state, "svc-deploy") {
+		t.Fatal("invalid login response")
+	}
+	if !strings.Contains(rr.Body.String(), proto.AuthTypeCloudIdentity) {
+		t.Fatalf("unexpected login response: %s", rr.Body.String())
+	}
+	// Mapped, but not an automation user.
+	_, err = checkRequestHandlerCode(newRequest(validUsernameConst),
+		state.cloudIdentityLoginHandler, http.StatusUnauthorized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = checkRequestHandlerCode(newRequest("svc-other"),
+		state.cloudIdentityLoginHandler, http.StatusUnauthorized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := newRequest("svc-deploy")
+	req.Method = "GET"
+	_, err = checkRequestHandlerCode(req, state.cloudIdentityLoginHandler,
+		http.StatusMethodNotAllowed)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/simplestorage"
+	"github.com/Cloud-Foundations/keymaster/lib/simplestorage/envelope"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	// The keys of encrypted auth cookies are stored with the signed user
+	// data under this name. The data type must differ from the other users
+	// of the storage (see web_sessions.go).
+	authCookieKeysDataType   = 7
+	authCookieKeysStorageKey = "keymaster-auth-cookie-keys"
+
+	defaultAuthCookieKeyRotationInterval = 24 * time.Hour
+	// Cookies with an unknown key reload the keys at most this often.
+	authCookieKeysMinReloadInterval = time.Second
+)
+
+type authCookieKey struct {
+	ID        string
+	Key       []byte
+	CreatedAt time.Time
+}
+
+// authCookieKeyring holds the keys of encrypted auth cookies, newest first.
+type authCookieKeyring struct {
+	mutex    sync.Mutex
+	keys     []authCookieKey
+	loadedAt time.Time
+}
+
+func newAuthCookieKey(now time.Time) (authCookieKey, error) {
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(idBytes); err != nil {
+		return authCookieKey{}, err
+	}
+	key := authCookieKey{
+		ID:        hex.EncodeToString(idBytes),
+		Key:       make([]byte, 32),
+		CreatedAt: now,
+	}
+	if _, err := rand.Read(key.Key); err != nil {
+		return authCookieKey{}, err
+	}
+	return key, nil
+}
+
+// mergeAuthCookieKeys returns the keys of a and b, newest first, without
+// those which no unexpired cookie can use.
+func mergeAuthCookieKeys(a, b []authCookieKey,
+	now time.Time) []authCookieKey {
+	byID := make(map[string]authCookieKey, len(a)+len(b))
+	for _, key := range a {
+		byID[key.ID] = key
+	}
+	for _, key := range b {
+		byID[key.ID] = key
+	}
+	keys := make([]authCookieKey, 0, len(byID))
+	for _, key := range byID {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.After(keys[j].CreatedAt)
+	})
+	maxAge := time.Duration(maxAgeSecondsAuthCookie) * time.Second
+	for i := 1; i < len(keys); i++ {
+		// A key is no longer used once the next key was created.
+		if now.Sub(keys[i-1].CreatedAt) > maxAge {
+			return keys[:i]
+		}
+	}
+	return keys
+}
+
+func (state *RuntimeState) getAuthCookieKeyRotationInterval() time.Duration {
+	if interval := state.Config.AuthCookie.KeyRotationInterval; interval > 0 {
+		return interval
+	}
+	return defaultAuthCookieKeyRotationInterval
+}
+
+// authCookieKeyStorage returns the storage of the auth cookie keys, or nil
+// if they are only kept in memory. The keys are sealed if storage
+// encryption is configured.
+func (state *RuntimeState) authCookieKeyStorage() simplestorage.SimpleStore {
+	storage := state.sharedSignedStorage()
+	if storage == nil || state.profileKeyring == nil {
+		return storage
+	}
+	return envelope.Wrap(storage, state.profileKeyring)
+}
+
+// loadAuthCookieKeys merges the stored keys into the keyring. The mutex of
+// the keyring must be held.
+func (state *RuntimeState) loadAuthCookieKeys(now time.Time) error {
+	keyring := &state.authCookieKeys
+	storage := state.authCookieKeyStorage()
+	if storage == nil {
+		return nil
+	}
+	ok, data, err := storage.GetSigned(authCookieKeysStorageKey,
+		authCookieKeysDataType)
+	if err != nil {
+		return err
+	}
+	keyring.loadedAt = now
+	if !ok {
+		return nil
+	}
+	var keys []authCookieKey
+	if err := json.Unmarshal([]byte(data), &keys); err != nil {
+		return err
+	}
+	keyring.keys = mergeAuthCookieKeys(keyring.keys, keys, now)
+	return nil
+}
+
+// rotateAuthCookieKeys adds a new key to the keyring and stores it. The
+// mutex of the keyring must be held.
+func (state *RuntimeState) rotateAuthCookieKeys(now time.Time) error {
+	keyring := &state.authCookieKeys
+	key, err := newAuthCookieKey(now)
+	if err != nil {
+		return err
+	}
+	keys := mergeAuthCookieKeys(keyring.keys, []authCookieKey{key}, now)
+	storage := state.authCookieKeyStorage()
+	if storage != nil {
+		data, err := json.Marshal(keys)
+		if err != nil {
+			return err
+		}
+		expiresAt := now.Add(state.getAuthCookieKeyRotationInterval() +
+			time.Duration(maxAgeSecondsAuthCookie)*time.Second)
+		err = storage.UpsertSigned(authCookieKeysStorageKey,
+			authCookieKeysDataType, expiresAt.Unix(), string(data))
+		if err != nil {
+			return err
+		}
+	}
+	keyring.keys = keys
+	logger.Printf("new auth cookie key %s", key.ID)
+	return nil
+}
+
+// getAuthCookieEncryptionKey returns the key to encrypt new auth cookies
+// with, rotating the keys if the newest is too old.
+func (state *RuntimeState) getAuthCookieEncryptionKey(now time.Time) (
+	authCookieKey, error) {
+	keyring := &state.authCookieKeys
+	keyring.mutex.Lock()
+	defer keyring.mutex.Unlock()
+	interval := state.getAuthCookieKeyRotationInterval()
+	if len(keyring.keys) < 1 || now.Sub(keyring.keys[0].CreatedAt) > interval {
+		// Another instance may have rotated the keys already.
+		if err := state.loadAuthCookieKeys(now); err != nil {
+			return authCookieKey{}, err
+		}
+		if len(keyring.keys) < 1 ||
+			now.Sub(keyring.keys[0].CreatedAt) > interval {
+			if err := state.rotateAuthCookieKeys(now); err != nil {
+				return authCookieKey{}, err
+			}
+		}
+	}
+	return keyring.keys[0], nil
+}
+
+// getAuthCookieDecryptionKey returns the key with the ID id, loading the
+// stored keys if it is unknown.
+func (state *RuntimeState) getAuthCookieDecryptionKey(id string,
+	now time.Time) ([]byte, error) {
+	keyring := &state.authCookieKeys
+	keyring.mutex.Lock()
+	defer keyring.mutex.Unlock()
+	for attempt := 0; ; attempt++ {
+		for _, key := range keyring.keys {
+			if key.ID == id {
+				return key.Key, nil
+			}
+		}
+		if attempt > 0 ||
+			now.Sub(keyring.loadedAt) < authCookieKeysMinReloadInterval {
+			return nil, errors.New("unknown auth cookie key")
+		}
+		if err := state.loadAuthCookieKeys(now); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// serializeAuthJWT returns the auth cookie value of authToken.
+func (state *RuntimeState) serializeAuthJWT(authToken authInfoJWT) (
+	string, error) {
+	if !state.Config.AuthCookie.Encrypt {
+		signerOptions := (&jose.SignerOptions{}).WithType("JWT")
+		signer, err := state.newJWTSigner(signerOptions)
+		if err != nil {
+			return "", err
+		}
+		return jwt.Signed(signer).Claims(authToken).CompactSerialize()
+	}
+	key, err := state.getAuthCookieEncryptionKey(time.Now())
+	if err != nil {
+		return "", err
+	}
+	encrypter, err := jose.NewEncrypter(jose.A256GCM,
+		jose.Recipient{Algorithm: jose.DIRECT, Key: key.Key, KeyID: key.ID},
+		(&jose.EncrypterOptions{}).WithType("JWT"))
+	if err != nil {
+		return "", err
+	}
+	return jwt.Encrypted(encrypter).Claims(authToken).CompactSerialize()
+}
+
+// parseAuthJWT returns the claims of the auth cookie value serializedToken,
+// which may be signed or, if enabled, encrypted.
+func (state *RuntimeState) parseAuthJWT(serializedToken string) (
+	authInfoJWT, error) {
+	var parsedJWT authInfoJWT
+	// Encrypted JWTs have five parts, signed JWTs three.
+	if strings.Count(serializedToken, ".") == 4 {
+		if !state.Config.AuthCookie.Encrypt {
+			return parsedJWT, errors.New("encrypted auth cookies are disabled")
+		}
+		tok, err := jwt.ParseEncrypted(serializedToken)
+		if err != nil {
+			return parsedJWT, err
+		}
+		if len(tok.Headers) != 1 || tok.Headers[0].Algorithm !=
+			string(jose.DIRECT) {
+			return parsedJWT, errors.New("invalid auth cookie header")
+		}
+		key, err := state.getAuthCookieDecryptionKey(tok.Headers[0].KeyID,
+			time.Now())
+		if err != nil {
+			return parsedJWT, err
+		}
+		if err := tok.Claims(key, &parsedJWT); err != nil {
+			return parsedJWT, err
+		}
+	} else {
+		tok, err := jwt.ParseSigned(serializedToken)
+		if err != nil {
+			return parsedJWT, err
+		}
+		if err := state.JWTClaims(tok, &parsedJWT); err != nil {
+			logger.Printf("err=%s", err)
+			return parsedJWT, err
+		}
+	}
+	// At this stage the token is verified, now check for sane values.
+	issuer := state.idpGetIssuer()
+	if parsedJWT.Issuer != issuer || parsedJWT.TokenType != "keymaster_auth" ||
+		parsedJWT.NotBefore > time.Now().Unix() {
+		return parsedJWT, errors.New("invalid JWT values")
+	}
+	return parsedJWT, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newAuthCookieTestState(t *testing.T, dir string) *RuntimeState {
+	state := &RuntimeState{}
+	signer, err := getSignerFromPEMBytes([]byte(testSignerPrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.Signer = signer
+	state.signerPublicKeyToKeymasterKeys()
+	state.Config.Base.DataDirectory = dir
+	state.Config.AuthCookie.Encrypt = true
+	if err := initDB(state); err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+func TestEncryptedAuthCookie(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authcookie")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	state := newAuthCookieTestState(t, dir)
+	cookieVal, err := state.genNewSerializedAuthJWT("username",
+		AuthTypePassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(cookieVal, ".") != 4 {
+		t.Fatalf("cookie is not encrypted: %s", cookieVal)
+	}
+	info, err := state.getAuthInfoFromAuthJWT(cookieVal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Username != "username" || info.AuthType != AuthTypePassword {
+		t.Fatalf("unexpected auth info: %+v", info)
+	}
+	cookieVal, err = state.updateAuthJWTWithNewAuthLevel(cookieVal,
+		AuthTypePassword|AuthTypeU2F)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Another instance, or a restart, reads the key from the storage.
+	otherState := newAuthCookieTestState(t, dir)
+	info, err = otherState.getAuthInfoFromAuthJWT(cookieVal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.AuthType != AuthTypePassword|AuthTypeU2F {
+		t.Fatalf("unexpected auth type: %d", info.AuthType)
+	}
+	// Cookies encrypted with the previous key are still accepted after a
+	// rotation.
+	if _, err := state.getAuthCookieEncryptionKey(
+		time.Now().Add(25 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	newCookieVal, err := state.genNewSerializedAuthJWT("username",
+		AuthTypePassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.authCookieKeys.keys) != 2 {
+		t.Fatalf("expected 2 keys, got %d", len(state.authCookieKeys.keys))
+	}
+	if _, err := state.getAuthInfoFromAuthJWT(cookieVal); err != nil {
+		t.Fatal(err)
+	}
+	// Unknown keys are loaded at most every second.
+	otherState.authCookieKeys.loadedAt = time.Time{}
+	if _, err := otherState.getAuthInfoFromAuthJWT(newCookieVal); err != nil {
+		t.Fatal(err)
+	}
+	// Signed cookies are still accepted, encrypted cookies only if enabled.
+	otherState.Config.AuthCookie.Encrypt = false
+	signedCookieVal, err := otherState.genNewSerializedAuthJWT("username",
+		AuthTypePassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := state.getAuthInfoFromAuthJWT(signedCookieVal); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := otherState.getAuthInfoFromAuthJWT(newCookieVal); err == nil {
+		t.Fatal("encrypted cookie accepted while disabled")
+	}
+	tampered := newCookieVal[:len(newCookieVal)-2] + "AA"
+	if _, err := state.getAuthInfoFromAuthJWT(tampered); err == nil {
+		t.Fatal("tampered cookie accepted")
+	}
+}
+
+func TestMergeAuthCookieKeys(t *testing.T) {
+	now := time.Now()
+	maxAge := time.Duration(maxAgeSecondsAuthCookie) * time.Second
+	keys := mergeAuthCookieKeys(
+		[]authCookieKey{
+			{ID: "a", CreatedAt: now.Add(-3 * maxAge)},
+			{ID: "c", CreatedAt: now.Add(-maxAge / 2)},
+		},
+		[]authCookieKey{
+			{ID: "b", CreatedAt: now.Add(-2 * maxAge)},
+			{ID: "c", CreatedAt: now.Add(-maxAge / 2)},
+			{ID: "d", CreatedAt: now},
+		}, now)
+	var ids []string
+	for _, key := range keys {
+		ids = append(ids, key.ID)
+	}
+	// b is kept since c is not older than the cookies, a is not.
+	if strings.Join(ids, ",") != "d,c,b" {
+		t.Fatalf("unexpected keys: %v", ids)
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"net/http"
+)
+
+const kerberosAuditMethod = "kerberos"
+
+// checkKerberosAuth verifies the SPNEGO authorization header of r. It returns
+// the username and true on success. On failure a response has been written.
+func (state *RuntimeState) checkKerberosAuth(w http.ResponseWriter,
+	r *http.Request) (string, bool) {
+	principal, err := state.kerberosAuthenticator.Authenticate(r)
+	if err != nil {
+		logger.Printf("kerberos: login failed: %s", err)
+		state.logAuditLogin(r, "", kerberosAuditMethod, false, err)
+		state.writeFailureResponse(w, r, http.StatusUnauthorized,
+			"Invalid Kerberos ticket")
+		return "", false
+	}
+	username := state.reprocessUsername(principal)
+	state.logAuditLogin(r, username, kerberosAuditMethod, true, nil)
+	logger.Debugf(1, "Valid Kerberos login for %s", username)
+	return username, true
+}
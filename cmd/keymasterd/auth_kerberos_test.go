@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/authenticators/kerberos"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+const (
+	testKerberosRealm     = "EXAMPLE.COM"
+	testKerberosPrincipal = "HTTP/keymaster.example.com"
+)
+
+// getTestNegotiateHeader returns an SPNEGO authorization header holding a
+// ticket for username encrypted with the key in kt, as a KDC would issue.
+func getTestNegotiateHeader(t *testing.T, kt *keytab.Keytab,
+	username string) string {
+	cl := client.NewWithPassword(username, testKerberosRealm, "unused",
+		config.New())
+	sname := types.NewPrincipalName(nametype.KRB_NT_SRV_INST,
+		testKerberosPrincipal)
+	now := time.Now().UTC()
+	ticket, sessionKey, err := messages.NewTicket(cl.Credentials.CName(),
+		testKerberosRealm, sname, testKerberosRealm, types.NewKrbFlags(), kt,
+		etypeID.AES256_CTS_HMAC_SHA1_96, 1, now, now, now.Add(time.Hour),
+		now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	negTokenInit, err := spnego.NewNegTokenInitKRB5(cl, ticket, sessionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := spnego.SPNEGOToken{Init: true, NegTokenInit: negTokenInit}
+	data, err := token.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "Negotiate " + base64.StdEncoding.EncodeToString(data)
+}
+
+func TestKerberosLogin(t *testing.T) {
+	state, passwdFile, err := setupValidRuntimeStateSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(passwdFile.Name()) // clean up
+	if err := initDB(state); err != nil {
+		t.Fatal(err)
+	}
+	kt := keytab.New()
+	err = kt.AddEntry(testKerberosPrincipal, testKerberosRealm, "password",
+		time.Now(), 1, etypeID.AES256_CTS_HMAC_SHA1_96)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keytabData, err := kt.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keytabFile, err := ioutil.TempFile("", "keytab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(keytabFile.Name())
+	if _, err := keytabFile.Write(keytabData); err != nil {
+		t.Fatal(err)
+	}
+	keytabFile.Close()
+	state.kerberosAuthenticator, err = kerberos.New(kerberos.Config{
+		KeytabFilename:   keytabFile.Name(),
+		ServicePrincipal: testKerberosPrincipal,
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("POST", proto.LoginPath, strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	rr, err := checkRequestHandlerCode(req, state.loginHandler,
+		http.StatusUnauthorized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	negotiateOffered := false
+	for _, value := range rr.Header()["Www-Authenticate"] {
+		if value == kerberos.NegotiateScheme {
+			negotiateOffered = true
+		}
+	}
+	if !negotiateOffered {
+		t.Fatalf("Negotiate not offered: %v", rr.Header())
+	}
+
+	req.Header.Set("Authorization", "Negotiate bm90IGEgdG9rZW4=")
+	_, err = checkRequestHandlerCode(req, state.loginHandler,
+		http.StatusUnauthorized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization",
+		getTestNegotiateHeader(t, kt, validUsernameConst))
+	rr, err = checkRequestHandlerCode(req, state.loginHandler, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !checkValidLoginResponse(rr.Result(), state, validUsernameConst) {
+		t.Fatal("invalid login response")
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
 	"golang.org/x/net/context"
 )
 
@@ -16,6 +17,11 @@ const redirCookieName = "oauth2_redir"
 
 const oauth2LoginBeginPath = "/auth/oauth2/login"
 
+type federatedUserGroups struct {
+	Groups    []string
+	ExpiresAt time.Time
+}
+
 func (state *RuntimeState) oauth2DoRedirectoToProviderHandler(w http.ResponseWriter, r *http.Request) {
 
 	if state.Config.Oauth2.Config == nil {
@@ -44,6 +50,23 @@ func (state *RuntimeState) oauth2DoRedirectoToProviderHandler(w http.ResponseWri
 		logger.Println(err)
 		return
 	}
+	nonce, err := genRandomString()
+	if err != nil {
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "error internal")
+		logger.Println(err)
+		return
+	}
+	authCodeURL := state.Config.Oauth2.Config.AuthCodeURL(stateString)
+	if state.oidcRelyingParty != nil {
+		authCodeURL, err = state.oidcRelyingParty.AuthCodeURL(stateString,
+			nonce)
+		if err != nil {
+			state.writeFailureResponse(w, r, http.StatusBadGateway,
+				"Cannot contact identity provider")
+			logger.Printf("oidc: %s", err)
+			return
+		}
+	}
 
 	cookie := http.Cookie{Name: redirCookieName, Value: cookieVal,
 		Expires: expiration, Path: "/", HttpOnly: true}
@@ -52,11 +75,12 @@ func (state *RuntimeState) oauth2DoRedirectoToProviderHandler(w http.ResponseWri
 	pending := pendingAuth2Request{
 		ExpiresAt: expiration,
 		state:     stateString,
+		nonce:     nonce,
 		ctx:       context.Background()}
 	state.Mutex.Lock()
 	state.pendingOauth2[cookieVal] = pending
 	state.Mutex.Unlock()
-	http.Redirect(w, r, state.Config.Oauth2.Config.AuthCodeURL(stateString), http.StatusFound)
+	http.Redirect(w, r, authCodeURL, http.StatusFound)
 }
 
 func httpGet(client *http.Client, url string) ([]byte, error) {
@@ -122,6 +146,52 @@ func (state *RuntimeState) oauth2RedirectPathHandler(w http.ResponseWriter, r *h
 		http.Error(w, "state did not match", http.StatusBadRequest)
 		return
 	}
+	var username string
+	if state.oidcRelyingParty != nil {
+		identity, err := state.oidcRelyingParty.Exchange(r.Context(),
+			r.URL.Query().Get("code"), pending.nonce)
+		if err != nil {
+			logger.Printf("oidc: login failed: %s", err)
+			state.logAuditLogin(r, "", proto.AuthTypeFederated, false, err)
+			state.writeFailureResponse(w, r, http.StatusUnauthorized,
+				"Login with identity provider failed")
+			return
+		}
+		username = identity.Username
+		if state.Config.Oauth2.GroupsClaim != "" {
+			state.saveFederatedUserGroups(username, identity.Groups)
+		}
+	} else {
+		username, ok = state.getOauth2Username(w, r, pending)
+		if !ok {
+			return
+		}
+	}
+
+	//Make new auth cookie
+	_, err = state.setNewAuthCookie(w, r, username, AuthTypeFederated)
+	if err != nil {
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "error internal")
+		logger.Println(err)
+		return
+	}
+
+	// delete peding cookie
+	state.Mutex.Lock()
+	delete(state.pendingOauth2, index)
+	state.Mutex.Unlock()
+
+	eventNotifier.PublishWebLoginEvent(username)
+	state.logAuditLogin(r, username, proto.AuthTypeFederated, true, nil)
+	//and redirect to profile page
+	http.Redirect(w, r, profilePath, 302)
+}
+
+// getOauth2Username redeems the authorization code of the request and gets
+// the username from the userinfo URL of the Oauth2 provider. If it fails an
+// error response is written.
+func (state *RuntimeState) getOauth2Username(w http.ResponseWriter,
+	r *http.Request, pending pendingAuth2Request) (string, bool) {
 	//if Debug {
 	//logger.Printf("req : %+v", r)
 	//}
@@ -129,7 +199,7 @@ func (state *RuntimeState) oauth2RedirectPathHandler(w http.ResponseWriter, r *h
 	if err != nil {
 		logger.Printf("failed to get token: ctx: %+v", pending.ctx)
 		http.Error(w, "Failed to exchange token: "+err.Error(), http.StatusInternalServerError)
-		return
+		return "", false
 	}
 	client := state.Config.Oauth2.Config.Client(pending.ctx, oauth2Token)
 	//client.Get("...")
@@ -137,7 +207,7 @@ func (state *RuntimeState) oauth2RedirectPathHandler(w http.ResponseWriter, r *h
 	if err != nil {
 		logger.Printf("fail to fetch %s (%s) ", state.Config.Oauth2.UserinfoUrl, err.Error())
 		http.Error(w, "Failed to get userinfo from url: "+err.Error(), http.StatusInternalServerError)
-		return
+		return "", false
 	}
 
 	var data struct {
@@ -154,7 +224,7 @@ func (state *RuntimeState) oauth2RedirectPathHandler(w http.ResponseWriter, r *h
 	if err != nil {
 		logger.Printf("failed to unmarshall userinfo to fetch %s ", body)
 		http.Error(w, "Failed to get unmarshall userinfo: "+err.Error(), http.StatusInternalServerError)
-		return
+		return "", false
 	}
 
 	// The Name field could also be useful
@@ -169,25 +239,50 @@ func (state *RuntimeState) oauth2RedirectPathHandler(w http.ResponseWriter, r *h
 		components := strings.Split(data.Email, "@")
 		if len(components[0]) < 1 {
 			http.Error(w, "Email from userinfo is invalid: ", http.StatusInternalServerError)
-			return
+			return "", false
 		}
 		username = strings.ToLower(components[0])
 	}
+	return username, true
+}
 
-	//Make new auth cookie
-	_, err = state.setNewAuthCookie(w, username, AuthTypeFederated)
-	if err != nil {
-		state.writeFailureResponse(w, r, http.StatusInternalServerError, "error internal")
-		logger.Println(err)
-		return
+func (state *RuntimeState) saveFederatedUserGroups(username string,
+	groups []string) {
+	state.federatedGroupsMutex.Lock()
+	defer state.federatedGroupsMutex.Unlock()
+	if state.federatedGroups == nil {
+		state.federatedGroups = make(map[string]federatedUserGroups)
+	}
+	state.federatedGroups[username] = federatedUserGroups{
+		Groups:    groups,
+		ExpiresAt: time.Now().Add(maxAgeSecondsAuthCookie * time.Second),
 	}
+}
 
-	// delete peding cookie
-	state.Mutex.Lock()
-	delete(state.pendingOauth2, index)
-	state.Mutex.Unlock()
+// federatedGroupsConfigured returns true if groups are taken from the
+// OpenID Connect or SAML identity provider.
+func (state *RuntimeState) federatedGroupsConfigured() bool {
+	if state.oidcRelyingParty != nil && state.Config.Oauth2.GroupsClaim != "" {
+		return true
+	}
+	return state.samlServiceProvider != nil &&
+		state.Config.SAML.GroupsAttribute != ""
+}
 
-	eventNotifier.PublishWebLoginEvent(username)
-	//and redirect to profile page
-	http.Redirect(w, r, profilePath, 302)
+// getFederatedUserGroups returns the groups of username from its last login
+// with the OpenID Connect or SAML identity provider. Users who have not
+// logged in since keymasterd started, or whose login has expired, have no
+// groups.
+func (state *RuntimeState) getFederatedUserGroups(username string) (
+	bool, []string, error) {
+	if !state.federatedGroupsConfigured() {
+		return false, nil, nil
+	}
+	state.federatedGroupsMutex.Lock()
+	defer state.federatedGroupsMutex.Unlock()
+	groups, ok := state.federatedGroups[username]
+	if !ok || time.Now().After(groups.ExpiresAt) {
+		return true, nil, nil
+	}
+	return true, groups.Groups, nil
 }
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/Cloud-Foundations/Dominator/lib/log/debuglogger"
+	"github.com/Cloud-Foundations/keymaster/lib/authenticators/oidc"
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
 )
@@ -198,3 +199,32 @@ func TestOauth2RedirectPathHandlerSuccess(t *testing.T) {
 	}
 
 }
+
+func TestFederatedUserGroups(t *testing.T) {
+	state := RuntimeState{}
+	state.saveFederatedUserGroups("username", []string{"group1"})
+	if configured, _, _ := state.getFederatedUserGroups("username"); configured {
+		t.Fatal("federated groups used without OpenID Connect provider")
+	}
+	rp, err := oidc.New(oidc.Config{IssuerURL: "https://idp.example.com",
+		ClientID: "keymaster"}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.oidcRelyingParty = rp
+	state.Config.Oauth2.GroupsClaim = "groups"
+	groups, err := state.getUserGroups("username")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 || groups[0] != "group1" {
+		t.Fatalf("unexpected groups %v", groups)
+	}
+	state.federatedGroups["username"] = federatedUserGroups{
+		Groups:    []string{"group1"},
+		ExpiresAt: time.Now().Add(-time.Second),
+	}
+	if groups, _ := state.getUserGroups("username"); groups != nil {
+		t.Fatalf("expired groups returned: %v", groups)
+	}
+}
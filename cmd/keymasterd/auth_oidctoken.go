@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/Cloud-Foundations/keymaster/lib/authenticators/oidc"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+	"github.com/Cloud-Foundations/keymaster/proto/eventmon"
+)
+
+func (state *RuntimeState) setupOIDCToken() error {
+	config := state.Config.OIDCToken
+	if config.Audience == "" {
+		return errors.New("missing audience")
+	}
+	for _, identity := range config.Identities {
+		if identity.Username == "" || len(identity.Subjects) < 1 {
+			return errors.New("identities need a username and subjects")
+		}
+	}
+	var err error
+	state.oidcTokenVerifier, err = oidc.New(oidc.Config{
+		IssuerURL: config.IssuerURL,
+		ClientID:  config.Audience,
+	}, logger)
+	return err
+}
+
+// oidcTokenAllowed returns true if a token for subject may log in as
+// username.
+func (state *RuntimeState) oidcTokenAllowed(subject, username string) bool {
+	for _, allowed := range state.Config.OIDCToken.Identities {
+		if allowed.Username == username &&
+			stringInList(subject, allowed.Subjects) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOIDCTokenLogin returns an error if the token in the form of r does
+// not allow logging in as username.
+func (state *RuntimeState) checkOIDCTokenLogin(r *http.Request,
+	username string) error {
+	identity, err := state.oidcTokenVerifier.VerifyToken(r.Form.Get("token"))
+	if err != nil {
+		return err
+	}
+	if !state.oidcTokenAllowed(identity.Subject, username) {
+		return fmt.Errorf("token for %s may not log in as %s",
+			identity.Subject, username)
+	}
+	ok, err := state.isAutomationUser(username)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%s is not an automation user", username)
+	}
+	return nil
+}
+
+// oidcTokenLoginHandler logs in automation users with OIDC tokens of
+// workloads, as described for proto.OIDCTokenLoginPath.
+func (state *RuntimeState) oidcTokenLoginHandler(w http.ResponseWriter,
+	r *http.Request) {
+	if state.sendFailureToClientIfLocked(w, r) {
+		return
+	}
+	loginResponse := proto.LoginResponse{
+		CertAuthBackend:   []string{proto.AuthTypeOIDCToken},
+		SupportedKeyTypes: supportedKeyTypes,
+	}
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(loginResponse)
+		return
+	case "POST":
+	default:
+		state.writeFailureResponse(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		logger.Println(err)
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Error parsing form")
+		return
+	}
+	username := state.reprocessUsername(r.Form.Get("username"))
+	if username == "" {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Missing username")
+		return
+	}
+	attempt := state.checkRateLimit(w, r, username, proto.AuthTypeOIDCToken)
+	if attempt == nil {
+		return
+	}
+	defer attempt.release()
+	err := state.checkOIDCTokenLogin(r, username)
+	state.logAuditLogin(r, username, proto.AuthTypeOIDCToken, err == nil, err)
+	state.recordRateLimitResult(r, attempt, err == nil)
+	if err != nil {
+		logger.Printf("OIDC token login as %s failed: %s", username, err)
+		state.writeFailureResponse(w, r, http.StatusUnauthorized,
+			"Invalid OIDC token")
+		return
+	}
+	_, err = state.setNewAuthCookie(w, r, username, AuthTypeOIDCToken)
+	if err != nil {
+		state.writeFailureResponse(w, r, http.StatusInternalServerError,
+			"error internal")
+		logger.Println(err)
+		return
+	}
+	eventNotifier.PublishAuthEvent(eventmon.AuthTypeOIDCToken, username)
+	logger.Debugf(1, "Valid OIDC token login for %s", username)
+	loginResponse.Message = "success"
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(loginResponse)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const testOIDCTokenSubject = "repo:example/deploy:ref:refs/heads/main"
+
+// newTestOIDCTokenIssuer starts a workload identity issuer and returns it and
+// a function which signs tokens with the given audience.
+func newTestOIDCTokenIssuer(t *testing.T) (*httptest.Server,
+	func(audience string) string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	mux.HandleFunc("/.well-known/openid-configuration",
+		func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(map[string]string{
+				"issuer":   server.URL,
+				"jwks_uri": server.URL + "/jwks",
+			})
+		})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{
+			Key:       key.Public(),
+			KeyID:     "key1",
+			Algorithm: string(jose.RS256),
+			Use:       "sig",
+		}}})
+	})
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		(&jose.SignerOptions{}).WithHeader("kid", "key1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signToken := func(audience string) string {
+		token, err := jwt.Signed(signer).Claims(jwt.Claims{
+			Issuer:   server.URL,
+			Subject:  testOIDCTokenSubject,
+			Audience: jwt.Audience{audience},
+			Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+			IssuedAt: jwt.NewNumericDate(time.Now()),
+		}).CompactSerialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	return server, signToken
+}
+
+func TestOIDCTokenLogin(t *testing.T) {
+	state, passwdFile, err := setupValidRuntimeStateSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(passwdFile.Name()) // clean up
+	issuer, signToken := newTestOIDCTokenIssuer(t)
+	defer issuer.Close()
+	state.Config.Base.AutomationUsers = []string{"svc-deploy"}
+	state.Config.OIDCToken = OIDCTokenConfig{
+		Enabled:   true,
+		IssuerURL: issuer.URL,
+		Audience:  "https://keymaster.example.com",
+		Identities: []OIDCTokenIdentity{
+			{Username: "svc-deploy", Subjects: []string{testOIDCTokenSubject}},
+			{Username: validUsernameConst,
+				Subjects: []string{testOIDCTokenSubject}},
+		},
+	}
+	if err := state.setupOIDCToken(); err != nil {
+		t.Fatal(err)
+	}
+	newRequest := func(username, token string) *http.Request {
+		form := url.Values{"username": {username}, "token": {token}}
+		req, err := http.NewRequest("POST", proto.OIDCTokenLoginPath,
+			strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req
+	}
+	// The method is advertised before any token is sent.
+	req, err := http.NewRequest("GET", proto.OIDCTokenLoginPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr, err := checkRequestHandlerCode(req, state.oidcTokenLoginHandler,
+		http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(rr.Body.String(), proto.AuthTypeOIDCToken) {
+		t.Fatalf("method not advertised: %s", rr.Body.String())
+	}
+	token := signToken("https://keymaster.example.com")
+	rr, err = checkRequestHandlerCode(newRequest("svc-deploy", token),
+		state.oidcTokenLoginHandler, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !checkValidLoginResponse(rr.Result(), state, "svc-deploy") {
+		t.Fatal("invalid login response")
+	}
+	// Tokens for other audiences are refused.
+	_, err = checkRequestHandlerCode(
+		newRequest("svc-deploy", signToken("https://other.example.com")),
+		state.oidcTokenLoginHandler, http.StatusUnauthorized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Mapped, but not an automation user.
+	_, err = checkRequestHandlerCode(newRequest(validUsernameConst, token),
+		state.oidcTokenLoginHandler, http.StatusUnauthorized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = checkRequestHandlerCode(newRequest("svc-other", token),
+		state.oidcTokenLoginHandler, http.StatusUnauthorized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = checkRequestHandlerCode(newRequest("svc-deploy", "not-a-token"),
+		state.oidcTokenLoginHandler, http.StatusUnauthorized)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetupOIDCTokenErrors(t *testing.T) {
+	for _, config := range []OIDCTokenConfig{
+		{IssuerURL: "https://issuer.example.com"},
+		{IssuerURL: "https://issuer.example.com", Audience: "keymaster",
+			Identities: []OIDCTokenIdentity{{Username: "svc-deploy"}}},
+	} {
+		state := RuntimeState{}
+		state.Config.OIDCToken = config
+		if err := state.setupOIDCToken(); err == nil {
+			t.Errorf("%+v should fail", config)
+		}
+	}
+}
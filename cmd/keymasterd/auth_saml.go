@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/authenticators/saml"
+)
+
+const (
+	samlLoginPath         = "/auth/saml/login"
+	samlACSPath           = "/auth/saml/acs"
+	samlMetadataPath      = "/auth/saml/metadata"
+	samlRequestCookieName = "saml_request"
+	samlAuditMethod       = "saml"
+)
+
+type pendingSAMLRequest struct {
+	ExpiresAt time.Time
+	requestID string
+}
+
+func (state *RuntimeState) newSAMLServiceProvider() (
+	*saml.ServiceProvider, error) {
+	config := state.Config.SAML
+	keyPair, err := tls.LoadX509KeyPair(config.CertificateFilename,
+		config.KeyFilename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load SAML key pair: %s", err)
+	}
+	key, ok := keyPair.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("SAML key must be an RSA key")
+	}
+	cert, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	var idpMetadata []byte
+	if config.IDPMetadataFilename != "" {
+		idpMetadata, err = exitsAndCanRead(config.IDPMetadataFilename,
+			"SAML identity provider metadata")
+		if err != nil {
+			return nil, err
+		}
+	}
+	baseURL := "https://" + state.HostIdentity + state.Config.Base.HttpAddress
+	return saml.New(saml.Config{
+		EntityID:          config.EntityID,
+		MetadataURL:       baseURL + samlMetadataPath,
+		ACSURL:            baseURL + samlACSPath,
+		IDPMetadata:       idpMetadata,
+		IDPMetadataURL:    config.IDPMetadataURL,
+		Certificate:       cert,
+		Key:               key,
+		UsernameAttribute: config.UsernameAttribute,
+		GroupsAttribute:   config.GroupsAttribute,
+	}, logger)
+}
+
+func (state *RuntimeState) samlMetadataHandler(w http.ResponseWriter,
+	r *http.Request) {
+	if state.samlServiceProvider == nil {
+		state.writeFailureResponse(w, r, http.StatusNotFound,
+			"SAML is not enabled for this system")
+		return
+	}
+	metadata, err := state.samlServiceProvider.Metadata()
+	if err != nil {
+		logger.Printf("saml: cannot make metadata: %s", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError,
+			"error internal")
+		return
+	}
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	w.Write(metadata)
+}
+
+func (state *RuntimeState) samlLoginHandler(w http.ResponseWriter,
+	r *http.Request) {
+	if state.samlServiceProvider == nil {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"SAML is not enabled for this system")
+		return
+	}
+	cookieVal, err := genRandomString()
+	if err != nil {
+		state.writeFailureResponse(w, r, http.StatusInternalServerError,
+			"error internal")
+		logger.Println(err)
+		return
+	}
+	redirectURL, requestID, err := state.samlServiceProvider.AuthnRequestURL(
+		"")
+	if err != nil {
+		state.writeFailureResponse(w, r, http.StatusInternalServerError,
+			"error internal")
+		logger.Printf("saml: cannot make authentication request: %s", err)
+		return
+	}
+	expiration := time.Now().Add(
+		time.Duration(maxAgeSecondsRedirCookie) * time.Second)
+	// The response is posted by the identity provider site, so the cookie
+	// must be sent with cross site requests.
+	cookie := http.Cookie{Name: samlRequestCookieName, Value: cookieVal,
+		Expires: expiration, Path: samlACSPath, HttpOnly: true, Secure: true,
+		SameSite: http.SameSiteNoneMode}
+	http.SetCookie(w, &cookie)
+	state.Mutex.Lock()
+	state.pendingSAML[cookieVal] = pendingSAMLRequest{
+		ExpiresAt: expiration,
+		requestID: requestID,
+	}
+	state.Mutex.Unlock()
+	http.Redirect(w, r, redirectURL, http.StatusFound)
+}
+
+func (state *RuntimeState) samlACSHandler(w http.ResponseWriter,
+	r *http.Request) {
+	if state.samlServiceProvider == nil {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"SAML is not enabled for this system")
+		return
+	}
+	if r.Method != "POST" {
+		state.writeFailureResponse(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	requestCookie, err := r.Cookie(samlRequestCookieName)
+	if err != nil {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Missing setup cookie!")
+		return
+	}
+	// Each request may only be answered once.
+	state.Mutex.Lock()
+	pending, ok := state.pendingSAML[requestCookie.Value]
+	delete(state.pendingSAML, requestCookie.Value)
+	state.Mutex.Unlock()
+	if !ok || pending.ExpiresAt.Before(time.Now()) {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Invalid setup cookie!")
+		return
+	}
+	identity, err := state.samlServiceProvider.ParseResponse(r,
+		pending.requestID)
+	if err != nil {
+		logger.Printf("saml: login failed: %s", err)
+		state.logAuditLogin(r, "", samlAuditMethod, false, err)
+		state.writeFailureResponse(w, r, http.StatusUnauthorized,
+			"Login with identity provider failed")
+		return
+	}
+	if state.Config.SAML.GroupsAttribute != "" {
+		state.saveFederatedUserGroups(identity.Username, identity.Groups)
+	}
+	_, err = state.setNewAuthCookie(w, r, identity.Username, AuthTypeFederated)
+	if err != nil {
+		state.writeFailureResponse(w, r, http.StatusInternalServerError,
+			"error internal")
+		logger.Println(err)
+		return
+	}
+	eventNotifier.PublishWebLoginEvent(identity.Username)
+	state.logAuditLogin(r, identity.Username, samlAuditMethod, true, nil)
+	http.Redirect(w, r, profilePath, http.StatusFound)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/xml"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/authenticators/saml"
+	crewjamsaml "github.com/crewjam/saml"
+)
+
+func newTestSAMLServiceProvider(t *testing.T) *saml.ServiceProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template,
+		key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ssoURL, err := url.Parse("https://idp.example.com/sso")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := crewjamsaml.IdentityProvider{Key: key, Certificate: cert,
+		SSOURL: *ssoURL}
+	idpMetadata, err := xml.Marshal(idp.Metadata())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp, err := saml.New(saml.Config{
+		MetadataURL: "https://localhost" + samlMetadataPath,
+		ACSURL:      "https://localhost" + samlACSPath,
+		IDPMetadata: idpMetadata,
+		Certificate: cert,
+		Key:         key,
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sp
+}
+
+func TestSAMLLoginHandlers(t *testing.T) {
+	state, passwdFile, err := setupValidRuntimeStateSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(passwdFile.Name()) // clean up
+	state.pendingSAML = make(map[string]pendingSAMLRequest)
+
+	req, err := http.NewRequest("GET", samlLoginPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// SAML is not enabled.
+	_, err = checkRequestHandlerCode(req, state.samlLoginHandler,
+		http.StatusBadRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.samlServiceProvider = newTestSAMLServiceProvider(t)
+	rr, err := checkRequestHandlerCode(req, state.samlLoginHandler,
+		http.StatusFound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(rr.Header().Get("Location"),
+		"https://idp.example.com/sso?SAMLRequest=") {
+		t.Fatalf("unexpected redirect: %s", rr.Header().Get("Location"))
+	}
+	var requestCookie *http.Cookie
+	for _, cookie := range rr.Result().Cookies() {
+		if cookie.Name == samlRequestCookieName {
+			requestCookie = cookie
+		}
+	}
+	if requestCookie == nil {
+		t.Fatal("no request cookie set")
+	}
+
+	form := url.Values{"SAMLResponse": {"bm90IGEgcmVzcG9uc2U="}}
+	newACSRequest := func() *http.Request {
+		req, err := http.NewRequest("POST", samlACSPath,
+			strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req
+	}
+	// No request cookie.
+	_, err = checkRequestHandlerCode(newACSRequest(), state.samlACSHandler,
+		http.StatusBadRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An invalid response fails and uses up the request.
+	acsReq := newACSRequest()
+	acsReq.AddCookie(requestCookie)
+	_, err = checkRequestHandlerCode(acsReq, state.samlACSHandler,
+		http.StatusUnauthorized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acsReq = newACSRequest()
+	acsReq.AddCookie(requestCookie)
+	_, err = checkRequestHandlerCode(acsReq, state.samlACSHandler,
+		http.StatusBadRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadataReq, err := http.NewRequest("GET", samlMetadataPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr, err = checkRequestHandlerCode(metadataReq, state.samlMetadataHandler,
+		http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(rr.Body.String(), "https://localhost"+samlACSPath) {
+		t.Fatalf("ACS URL missing from metadata: %s", rr.Body.String())
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/instrumentedwriter"
+	"github.com/Cloud-Foundations/keymaster/lib/issuancelog"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	bearerTokenCertType           = "bearer-token"
+	defaultBearerTokenLifetime    = 15 * time.Minute
+	defaultBearerTokenMaxLifetime = time.Hour
+)
+
+var errBearerTokenAudience = errors.New("audience not allowed")
+
+type bearerTokenClaims struct {
+	Issuer      string   `json:"iss"`
+	Subject     string   `json:"sub"`
+	Audience    []string `json:"aud"`
+	IssuedAt    int64    `json:"iat"`
+	NotBefore   int64    `json:"nbf"`
+	Expiration  int64    `json:"exp"`
+	ID          string   `json:"jti"`
+	Email       string   `json:"email,omitempty"`
+	Groups      []string `json:"groups,omitempty"`
+	AuthMethods []string `json:"amr,omitempty"`
+}
+
+// getBearerTokenAudience returns the aud claim for the requested audience,
+// which may be empty for the default.
+func (state *RuntimeState) getBearerTokenAudience(audience string) (
+	string, error) {
+	audiences := state.Config.BearerTokens.Audiences
+	if audience == "" {
+		if len(audiences) > 0 {
+			return audiences[0], nil
+		}
+		return state.idpGetIssuer(), nil
+	}
+	if stringInList(audience, audiences) {
+		return audience, nil
+	}
+	return "", errBearerTokenAudience
+}
+
+// getBearerTokenLifetime returns the lifetime of a token for the requested
+// duration, which may be zero for the default.
+func (state *RuntimeState) getBearerTokenLifetime(
+	duration time.Duration) time.Duration {
+	maxLifetime := state.Config.BearerTokens.MaxLifetime
+	if maxLifetime <= 0 {
+		maxLifetime = defaultBearerTokenMaxLifetime
+	}
+	if duration <= 0 {
+		duration = defaultBearerTokenLifetime
+	}
+	if duration > maxLifetime {
+		duration = maxLifetime
+	}
+	return duration
+}
+
+// newBearerToken returns the claims of a bearer token for username, who
+// authenticated with authLevel, and records its issuance.
+func (state *RuntimeState) newBearerToken(username string, authLevel int,
+	audience string, duration time.Duration) (*bearerTokenClaims, error) {
+	aud, err := state.getBearerTokenAudience(audience)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := state.getUserGroups(username)
+	if err != nil {
+		return nil, err
+	}
+	id, err := genRandomString()
+	if err != nil {
+		return nil, err
+	}
+	email, _ := state.getOpenIDConnectUserClaims(username)
+	now := time.Now()
+	notAfter := now.Add(state.getBearerTokenLifetime(duration))
+	claims := &bearerTokenClaims{
+		Issuer:      state.idpGetIssuer(),
+		Subject:     username,
+		Audience:    []string{aud},
+		IssuedAt:    now.Unix(),
+		NotBefore:   now.Unix(),
+		Expiration:  notAfter.Unix(),
+		ID:          id,
+		Email:       email,
+		Groups:      groups,
+		AuthMethods: getAuthMethodNames(authLevel),
+	}
+	err = state.appendIssuanceLog(issuancelog.Entry{
+		Username:    username,
+		CertType:    bearerTokenCertType,
+		Serial:      id,
+		NotBefore:   now,
+		NotAfter:    notAfter,
+		AuthMethods: claims.AuthMethods,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot record bearer token issuance: %s", err)
+	}
+	return claims, nil
+}
+
+// signBearerToken returns the compact serialization of claims signed with
+// the CA key.
+func (state *RuntimeState) signBearerToken(claims *bearerTokenClaims) (
+	string, error) {
+	kid, err := getKeyFingerprint(state.Signer.Public())
+	if err != nil {
+		return "", err
+	}
+	signer, err := state.newJWTSigner((&jose.SignerOptions{}).WithType(
+		"JWT").WithHeader("kid", kid))
+	if err != nil {
+		return "", err
+	}
+	return jwt.Signed(signer).Claims(claims).CompactSerialize()
+}
+
+// checkBearerTokenRequest applies the restrictions on certificates to the
+// bearer token request r for username: the certificate profile, device
+// trust, hardware key groups, the certificate policy and its approvals. It
+// returns the lifetime of the token, which may be less than duration. If the
+// token may not be issued a response is written and false is returned.
+func (state *RuntimeState) checkBearerTokenRequest(w http.ResponseWriter,
+	r *http.Request, username string, authLevel int,
+	duration time.Duration) (time.Duration, bool) {
+	profile, ok := state.checkCertProfile(w, r, username, authLevel)
+	if !ok {
+		return 0, false
+	}
+	if profile != nil && profile.MaxDuration > 0 &&
+		duration > profile.MaxDuration {
+		duration = profile.MaxDuration
+	}
+	deviceApproved, deviceErr := state.checkCertRequestDevice(r, username)
+	if !deviceApproved && state.Config.DeviceTrust.RequireApprovedDevice {
+		logger.Printf("refusing bearer token for %s: %s", username, deviceErr)
+		state.writeDenialResponse(w, r, http.StatusForbidden,
+			proto.DenialReasonDeviceNotApproved, deviceErr.Error())
+		return 0, false
+	}
+	// Bearer tokens are not bound to a key, so they are never for hardware
+	// keys.
+	required, err := state.requiresHardwareKey(username)
+	if err != nil {
+		logger.Println(err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return 0, false
+	}
+	if required {
+		state.writeDenialResponse(w, r, http.StatusForbidden,
+			proto.DenialReasonHardwareKeyRequired,
+			"bearer tokens are not available to users needing hardware keys")
+		return 0, false
+	}
+	decision, ok := state.checkCertPolicy(w, r, username, authLevel,
+		duration, deviceApproved, false, sshPermissionsRequest{},
+		state.getDefaultSSHPermissions())
+	if !ok {
+		return 0, false
+	}
+	if len(decision.NeedsApproval) > 0 &&
+		!state.checkCertApproval(w, r, username, bearerTokenCertType,
+			decision) {
+		return 0, false
+	}
+	return decision.Duration, true
+}
+
+func (state *RuntimeState) bearerTokenHandler(w http.ResponseWriter,
+	r *http.Request) {
+	if state.sendFailureToClientIfLocked(w, r) {
+		return
+	}
+	if r.Method != "GET" && r.Method != "POST" {
+		state.writeFailureResponse(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	authUser, authLevel, err := state.checkAuth(w, r, AuthTypeAny)
+	if err != nil {
+		logger.Debugf(1, "%v", err)
+		return
+	}
+	w.(*instrumentedwriter.LoggingWriter).SetUsername(authUser)
+	if !state.isSufficientAuthLevelForCerts(authLevel) {
+		state.writeDenialResponse(w, r, http.StatusBadRequest,
+			proto.DenialReasonInsufficientAuthLevel,
+			"Not enough auth level for getting bearer tokens")
+		return
+	}
+	if err := state.checkEnabledFactors(authUser); err != nil &&
+		authLevel&AuthTypeBreakGlass == 0 {
+		if _, ok := err.(notEnoughFactorsError); !ok {
+			logger.Println(err)
+			state.writeFailureResponse(w, r, http.StatusInternalServerError,
+				"")
+			return
+		}
+		state.writeDenialResponse(w, r, http.StatusForbidden,
+			proto.DenialReasonNotEnoughFactors, err.Error())
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Error parsing form")
+		return
+	}
+	var duration time.Duration
+	if value := r.Form.Get("duration"); value != "" {
+		duration, err = time.ParseDuration(value)
+		if err != nil || duration <= 0 {
+			state.writeFailureResponse(w, r, http.StatusBadRequest,
+				"Error parsing form (duration)")
+			return
+		}
+	}
+	duration, ok := state.checkBearerTokenRequest(w, r, authUser, authLevel,
+		state.getBearerTokenLifetime(duration))
+	if !ok {
+		return
+	}
+	claims, err := state.newBearerToken(authUser, authLevel,
+		r.Form.Get("audience"), duration)
+	if err == errBearerTokenAudience {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Audience not allowed")
+		return
+	}
+	if err != nil {
+		logger.Printf("cannot issue bearer token for %s: %s", authUser, err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	token, err := state.signBearerToken(claims)
+	if err != nil {
+		logger.Printf("cannot sign bearer token for %s: %s", authUser, err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	logger.Printf("Generated bearer token for %s", authUser)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(proto.BearerTokenResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(claims.Expiration - claims.IssuedAt),
+	})
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/certpolicy"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func TestGetBearerTokenAudience(t *testing.T) {
+	state := &RuntimeState{HostIdentity: "keymaster.example.com"}
+	state.Config.Base.HttpAddress = ":443"
+	if aud, err := state.getBearerTokenAudience(""); err != nil ||
+		aud != "https://keymaster.example.com" {
+		t.Fatalf("unexpected default audience: %s %v", aud, err)
+	}
+	if _, err := state.getBearerTokenAudience(
+		"https://api.example.com"); err != errBearerTokenAudience {
+		t.Fatalf("audience accepted without configuration: %v", err)
+	}
+	state.Config.BearerTokens.Audiences = []string{"https://api.example.com",
+		"https://grafana.example.com"}
+	if aud, _ := state.getBearerTokenAudience(""); aud != "https://api.example.com" {
+		t.Fatalf("unexpected default audience: %s", aud)
+	}
+	if aud, err := state.getBearerTokenAudience(
+		"https://grafana.example.com"); err != nil ||
+		aud != "https://grafana.example.com" {
+		t.Fatalf("unexpected audience: %s %v", aud, err)
+	}
+	if _, err := state.getBearerTokenAudience(
+		"https://evil.example.com"); err != errBearerTokenAudience {
+		t.Fatalf("unlisted audience accepted: %v", err)
+	}
+}
+
+func TestGetBearerTokenLifetime(t *testing.T) {
+	state := &RuntimeState{}
+	for _, test := range []struct {
+		maxLifetime time.Duration
+		duration    time.Duration
+		expected    time.Duration
+	}{
+		{0, 0, defaultBearerTokenLifetime},
+		{0, 5 * time.Minute, 5 * time.Minute},
+		{0, 24 * time.Hour, defaultBearerTokenMaxLifetime},
+		{10 * time.Minute, 0, 10 * time.Minute},
+		{4 * time.Hour, 2 * time.Hour, 2 * time.Hour},
+	} {
+		state.Config.BearerTokens.MaxLifetime = test.maxLifetime
+		if lifetime := state.getBearerTokenLifetime(
+			test.duration); lifetime != test.expected {
+			t.Errorf("%+v: got %s", test, lifetime)
+		}
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	state, passwdFile, err := setupValidRuntimeStateSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(passwdFile.Name())
+	state.HostIdentity = "keymaster.example.com"
+	state.Config.OpenIDConnectIDP.DefaultEmailDomain = "example.com"
+	claims, err := state.newBearerToken("username",
+		AuthTypePassword|AuthTypeU2F, "", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Expiration-claims.IssuedAt != 60 {
+		t.Fatalf("unexpected lifetime: %+v", claims)
+	}
+	token, err := state.signBearerToken(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := jwt.ParseSigned(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded bearerTokenClaims
+	if err := state.JWTClaims(parsed, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Subject != "username" || decoded.ID == "" ||
+		decoded.Email != "username@example.com" ||
+		len(decoded.Audience) != 1 || decoded.Audience[0] != decoded.Issuer {
+		t.Fatalf("unexpected claims: %+v", decoded)
+	}
+	if len(decoded.AuthMethods) != 2 {
+		t.Fatalf("unexpected auth methods: %v", decoded.AuthMethods)
+	}
+	if len(parsed.Headers) != 1 || parsed.Headers[0].KeyID == "" {
+		t.Fatalf("missing key id: %+v", parsed.Headers)
+	}
+}
+
+func TestBearerTokenHandlerRestrictions(t *testing.T) {
+	state, passwdFile, err := setupValidRuntimeStateSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(passwdFile.Name())
+	dir, err := ioutil.TempDir("", "bearer_token_testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	state.Config.Base.DataDirectory = dir
+	if err := initDB(state); err != nil {
+		t.Fatal(err)
+	}
+	state.HostIdentity = "keymaster.example.com"
+	state.Config.Base.AllowedAuthBackendsForCerts = []string{
+		proto.AuthTypePassword}
+	cookieValue, err := state.setNewAuthCookie(nil, nil, "username",
+		AuthTypePassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// getToken returns the lifetime of the token, or the denial reason.
+	getToken := func(code int, query string) (int, string) {
+		req := httptest.NewRequest("GET", proto.BearerTokenPath+query, nil)
+		req.Header.Set("Accept", "application/json")
+		req.AddCookie(&http.Cookie{Name: authCookieName, Value: cookieValue})
+		rr, err := checkRequestHandlerCode(req, state.bearerTokenHandler, code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != http.StatusOK {
+			var denial proto.DenialResponse
+			json.NewDecoder(rr.Body).Decode(&denial)
+			return 0, denial.ReasonCode
+		}
+		var response proto.BearerTokenResponse
+		if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		return response.ExpiresIn, ""
+	}
+	if lifetime, _ := getToken(http.StatusOK, ""); lifetime != 900 {
+		t.Fatalf("unexpected lifetime: %d", lifetime)
+	}
+	// Profiles and the certificate policy cap the lifetime.
+	state.Config.Base.CertProfiles = map[string]CertProfileConfig{
+		"default": {MaxDuration: 10 * time.Minute}}
+	if lifetime, _ := getToken(http.StatusOK, ""); lifetime != 600 {
+		t.Fatalf("lifetime not capped by profile: %d", lifetime)
+	}
+	state.Config.Base.CertProfiles["default"] = CertProfileConfig{
+		Users: []string{"other"}}
+	if _, reason := getToken(
+		http.StatusForbidden, ""); reason != proto.DenialReasonPolicy {
+		t.Fatalf("profile not applied: %s", reason)
+	}
+	state.Config.Base.CertProfiles = nil
+	state.certPolicy, err = certpolicy.New(certpolicy.Config{
+		Rules: []certpolicy.Rule{
+			{Users: []string{"username"}, MaxDuration: 5 * time.Minute},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lifetime, _ := getToken(http.StatusOK, ""); lifetime != 300 {
+		t.Fatalf("lifetime not capped by policy: %d", lifetime)
+	}
+	state.certPolicy, err = certpolicy.New(certpolicy.Config{
+		Rules: []certpolicy.Rule{
+			{Users: []string{"username"}, Approvers: []string{"alice"},
+				AllowedSSHPrincipals:  []string{"admin"},
+				ApprovalSSHPrincipals: []string{"admin"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lifetime, _ := getToken(http.StatusOK, ""); lifetime != 900 {
+		t.Fatalf("unexpected lifetime: %d", lifetime)
+	}
+	if _, reason := getToken(http.StatusForbidden,
+		"?principals=admin"); reason != proto.DenialReasonApprovalRequired {
+		t.Fatalf("approval not required: %s", reason)
+	}
+	state.certPolicy = nil
+	state.Config.DeviceTrust.RequireApprovedDevice = true
+	if _, reason := getToken(
+		http.StatusForbidden, ""); reason != proto.DenialReasonDeviceNotApproved {
+		t.Fatalf("device not checked: %s", reason)
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/auditlog"
+	"github.com/Cloud-Foundations/keymaster/lib/authutil"
+	"github.com/Cloud-Foundations/keymaster/lib/instrumentedwriter"
+	"github.com/Cloud-Foundations/keymaster/lib/pwauth"
+	"github.com/Cloud-Foundations/keymaster/lib/simplestorage"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+	"github.com/Cloud-Foundations/keymaster/proto/eventmon"
+)
+
+const (
+	// The break glass state is kept with the signed user data, so that all
+	// instances see it. The data type must differ from the other users of
+	// the storage (see web_sessions.go and cert_approvals.go).
+	breakGlassDataType   = 10
+	breakGlassStorageKey = "keymaster-break-glass"
+
+	defaultBreakGlassQuorum       = 2
+	defaultBreakGlassDuration     = time.Hour
+	defaultBreakGlassVoteLifetime = 15 * time.Minute
+)
+
+var (
+	errBreakGlassActive    = errors.New("break glass issuance is already active")
+	errBreakGlassNoStorage = errors.New("break glass issuance needs storage")
+)
+
+// breakGlassState is the stored state of emergency issuance. Votes are
+// only kept while it is not active.
+type breakGlassState struct {
+	Votes       []proto.BreakGlassVote
+	ActivatedAt time.Time
+	ActiveUntil time.Time
+	ActivatedBy []string
+}
+
+func (bgState *breakGlassState) isActive(now time.Time) bool {
+	return now.Before(bgState.ActiveUntil)
+}
+
+func getBreakGlassQuorum(config BreakGlassConfig) int {
+	if config.Quorum > 0 {
+		return config.Quorum
+	}
+	return defaultBreakGlassQuorum
+}
+
+func checkBreakGlassConfig(config BreakGlassConfig) error {
+	quorum := getBreakGlassQuorum(config)
+	if quorum < 2 {
+		return errors.New("quorum must be at least 2")
+	}
+	if quorum > len(config.Admins) {
+		return fmt.Errorf("quorum of %d but only %d admins", quorum,
+			len(config.Admins))
+	}
+	if config.HtpasswdFilename == "" {
+		return errors.New("missing htpasswd_filename")
+	}
+	return nil
+}
+
+func (state *RuntimeState) getBreakGlassTimes() (time.Duration,
+	time.Duration) {
+	duration := state.Config.BreakGlass.Duration
+	if duration <= 0 {
+		duration = defaultBreakGlassDuration
+	}
+	voteLifetime := state.Config.BreakGlass.VoteLifetime
+	if voteLifetime <= 0 {
+		voteLifetime = defaultBreakGlassVoteLifetime
+	}
+	return duration, voteLifetime
+}
+
+func loadBreakGlassState(storage simplestorage.SimpleStore) (
+	*breakGlassState, error) {
+	var bgState breakGlassState
+	_, err := getSignedJSON(storage, breakGlassStorageKey, breakGlassDataType,
+		&bgState)
+	if err != nil {
+		return nil, err
+	}
+	return &bgState, nil
+}
+
+// saveBreakGlassState keeps bgState at least until the votes expire and,
+// for the audit of the expiry, a little after it ends.
+func (state *RuntimeState) saveBreakGlassState(
+	storage simplestorage.SimpleStore, bgState *breakGlassState,
+	now time.Time) error {
+	duration, voteLifetime := state.getBreakGlassTimes()
+	return putSignedJSON(storage, breakGlassStorageKey, breakGlassDataType,
+		bgState, now.Add(duration+voteLifetime))
+}
+
+// isBreakGlassActive returns true while emergency issuance is active.
+func (state *RuntimeState) isBreakGlassActive() bool {
+	if len(state.Config.BreakGlass.Admins) < 1 {
+		return false
+	}
+	storage := state.sharedSignedStorage()
+	if storage == nil {
+		return false
+	}
+	bgState, err := loadBreakGlassState(storage)
+	if err != nil {
+		logger.Printf("cannot load break glass state: %s", err)
+		return false
+	}
+	return bgState.isActive(time.Now())
+}
+
+func (state *RuntimeState) isBreakGlassAdmin(username string) bool {
+	for _, admin := range state.Config.BreakGlass.Admins {
+		if admin == username {
+			return true
+		}
+	}
+	return false
+}
+
+// isHtpasswdUser returns true if username has an entry in the htpasswd
+// data buffer.
+func isHtpasswdUser(buffer []byte, username string) bool {
+	for _, line := range strings.Split(string(buffer), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), username+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// readBreakGlassAccounts returns the htpasswd data of the break glass
+// accounts, or nil if there are none.
+func (state *RuntimeState) readBreakGlassAccounts() ([]byte, error) {
+	if len(state.Config.BreakGlass.Admins) < 1 {
+		return nil, nil
+	}
+	return ioutil.ReadFile(state.Config.BreakGlass.HtpasswdFilename)
+}
+
+// getBreakGlassUserGroups returns the groups of the break glass account
+// username. The bool is false if username is not a break glass account.
+func (state *RuntimeState) getBreakGlassUserGroups(username string) (
+	bool, []string, error) {
+	buffer, err := state.readBreakGlassAccounts()
+	if err != nil {
+		logger.Printf("cannot read break glass accounts: %s", err)
+		return false, nil, nil
+	}
+	if !isHtpasswdUser(buffer, username) {
+		return false, nil, nil
+	}
+	return true, state.Config.BreakGlass.AccountGroups[username], nil
+}
+
+// breakGlassLogin handles the login of username with password if it is a
+// break glass account and emergency issuance is active. It returns false
+// if the login is not handled. The result is recorded for attempt.
+func (state *RuntimeState) breakGlassLogin(w http.ResponseWriter,
+	r *http.Request, username string, password string,
+	attempt *rateLimitAttempt) bool {
+	buffer, err := state.readBreakGlassAccounts()
+	if err != nil {
+		logger.Printf("cannot read break glass accounts: %s", err)
+		return false
+	}
+	if !isHtpasswdUser(buffer, username) || !state.isBreakGlassActive() {
+		return false
+	}
+	valid, err := authutil.CheckHtpasswdUserPassword(username, password,
+		buffer)
+	state.logAuditLogin(r, username, "break_glass", valid, err)
+	if err != nil {
+		logger.Println(err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return true
+	}
+	state.recordRateLimitResult(r, attempt, valid)
+	if !valid {
+		logger.Printf("Invalid break glass login for %s", username)
+		state.writeFailureResponse(w, r, http.StatusUnauthorized,
+			"Invalid Username/Password")
+		return true
+	}
+	logger.Printf("Break glass login of %s", username)
+	state.logAuditBreakGlass(r, username, "login", nil)
+	state.writeLoginResponseWithPasswordStatus(w, r, username,
+		eventmon.AuthTypePassword, pwauth.PasswordStatus{},
+		AuthTypeBreakGlass)
+	return true
+}
+
+// logAuditBreakGlass records action of username on emergency issuance.
+func (state *RuntimeState) logAuditBreakGlass(r *http.Request,
+	username string, action string, details map[string]string) {
+	state.logAuditEvent(r, auditlog.Event{
+		Type:     auditlog.EventTypeBreakGlass,
+		Username: username,
+		Success:  true,
+		Method:   action,
+		Details:  details,
+	})
+}
+
+// voteBreakGlass records the vote of admin for emergency issuance, and
+// starts it if a quorum voted.
+func (state *RuntimeState) voteBreakGlass(r *http.Request, admin string,
+	reason string) (*breakGlassState, error) {
+	storage := state.sharedSignedStorage()
+	if storage == nil {
+		return nil, errBreakGlassNoStorage
+	}
+	state.breakGlassMutex.Lock()
+	defer state.breakGlassMutex.Unlock()
+	bgState, err := loadBreakGlassState(storage)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if bgState.isActive(now) {
+		return bgState, errBreakGlassActive
+	}
+	duration, voteLifetime := state.getBreakGlassTimes()
+	// A new vote of an admin replaces their previous one.
+	var votes []proto.BreakGlassVote
+	for _, vote := range bgState.Votes {
+		if vote.Admin != admin && now.Sub(vote.Time) < voteLifetime {
+			votes = append(votes, vote)
+		}
+	}
+	votes = append(votes,
+		proto.BreakGlassVote{Admin: admin, Time: now, Reason: reason})
+	bgState.Votes = votes
+	activated := len(votes) >= getBreakGlassQuorum(state.Config.BreakGlass)
+	if activated {
+		bgState.ActivatedAt = now
+		bgState.ActiveUntil = now.Add(duration)
+		bgState.ActivatedBy = nil
+		for _, vote := range votes {
+			bgState.ActivatedBy = append(bgState.ActivatedBy, vote.Admin)
+		}
+		bgState.Votes = nil
+	}
+	if err := state.saveBreakGlassState(storage, bgState, now); err != nil {
+		return nil, err
+	}
+	state.logAuditBreakGlass(r, admin, "vote", map[string]string{
+		"reason": reason,
+		"votes":  strconv.Itoa(len(votes)),
+	})
+	if activated {
+		logger.Printf("break glass issuance active until %s",
+			bgState.ActiveUntil.Format(time.RFC3339))
+		state.logAuditBreakGlass(r, admin, "activate", map[string]string{
+			"activated_by": strings.Join(bgState.ActivatedBy, ","),
+			"active_until": bgState.ActiveUntil.Format(time.RFC3339),
+		})
+		state.scheduleBreakGlassExpiry(bgState.ActiveUntil)
+	}
+	return bgState, nil
+}
+
+// scheduleBreakGlassExpiry records the end of the emergency issuance which
+// is active until activeUntil, unless it was ended before.
+func (state *RuntimeState) scheduleBreakGlassExpiry(activeUntil time.Time) {
+	time.AfterFunc(time.Until(activeUntil), func() {
+		bgState, err := loadBreakGlassState(state.sharedSignedStorage())
+		if err != nil {
+			logger.Printf("cannot load break glass state: %s", err)
+			return
+		}
+		if bgState.ActiveUntil.Equal(activeUntil) {
+			logger.Println("break glass issuance ended")
+			state.logAuditBreakGlass(nil, "", "expire", map[string]string{
+				"activated_by": strings.Join(bgState.ActivatedBy, ","),
+			})
+		}
+	})
+}
+
+// deactivateBreakGlass ends emergency issuance on behalf of admin and drops
+// the votes for it. The bool is false if it was not active.
+func (state *RuntimeState) deactivateBreakGlass(r *http.Request,
+	admin string) (*breakGlassState, bool, error) {
+	storage := state.sharedSignedStorage()
+	if storage == nil {
+		return nil, false, errBreakGlassNoStorage
+	}
+	state.breakGlassMutex.Lock()
+	defer state.breakGlassMutex.Unlock()
+	bgState, err := loadBreakGlassState(storage)
+	if err != nil {
+		return nil, false, err
+	}
+	now := time.Now()
+	wasActive := bgState.isActive(now)
+	if wasActive {
+		bgState.ActiveUntil = now
+	}
+	bgState.Votes = nil
+	if err := state.saveBreakGlassState(storage, bgState, now); err != nil {
+		return nil, false, err
+	}
+	if wasActive {
+		logger.Printf("break glass issuance ended by %s", admin)
+		state.logAuditBreakGlass(r, admin, "deactivate", map[string]string{
+			"activated_by": strings.Join(bgState.ActivatedBy, ","),
+		})
+	}
+	return bgState, wasActive, nil
+}
+
+func (state *RuntimeState) getBreakGlassStatus(bgState *breakGlassState,
+	now time.Time) proto.BreakGlassStatus {
+	status := proto.BreakGlassStatus{
+		Active: bgState.isActive(now),
+		Quorum: getBreakGlassQuorum(state.Config.BreakGlass),
+	}
+	if status.Active {
+		status.ActivatedAt = bgState.ActivatedAt
+		status.ActiveUntil = bgState.ActiveUntil
+		status.ActivatedBy = bgState.ActivatedBy
+		return status
+	}
+	_, voteLifetime := state.getBreakGlassTimes()
+	for _, vote := range bgState.Votes {
+		if now.Sub(vote.Time) < voteLifetime {
+			status.Votes = append(status.Votes, vote)
+		}
+	}
+	return status
+}
+
+func (state *RuntimeState) breakGlassHandler(w http.ResponseWriter,
+	r *http.Request) {
+	if state.sendFailureToClientIfLocked(w, r) {
+		return
+	}
+	if r.Method != "GET" && r.Method != "POST" {
+		state.writeFailureResponse(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	// Break glass admins prove their presence with a security key.
+	authUser, _, err := state.checkAuth(w, r, AuthTypeU2F|AuthTypeWebAuthn)
+	if err != nil {
+		logger.Debugf(1, "%v", err)
+		return
+	}
+	w.(*instrumentedwriter.LoggingWriter).SetUsername(authUser)
+	if !state.isBreakGlassAdmin(authUser) {
+		state.writeFailureResponse(w, r, http.StatusForbidden,
+			"Not a break glass admin")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Error parsing form")
+		return
+	}
+	var bgState *breakGlassState
+	if r.Method == "POST" {
+		switch r.Form.Get("action") {
+		case "activate":
+			reason := strings.TrimSpace(r.Form.Get("reason"))
+			if reason == "" {
+				state.writeFailureResponse(w, r, http.StatusBadRequest,
+					"Missing reason")
+				return
+			}
+			bgState, err = state.voteBreakGlass(r, authUser, reason)
+			if err == errBreakGlassActive {
+				state.writeFailureResponse(w, r, http.StatusConflict,
+					err.Error())
+				return
+			}
+		case "deactivate":
+			bgState, _, err = state.deactivateBreakGlass(r, authUser)
+		default:
+			state.writeFailureResponse(w, r, http.StatusBadRequest,
+				"action must be activate or deactivate")
+			return
+		}
+	} else if storage := state.sharedSignedStorage(); storage == nil {
+		err = errBreakGlassNoStorage
+	} else {
+		bgState, err = loadBreakGlassState(storage)
+	}
+	if err == errBreakGlassNoStorage {
+		state.writeFailureResponse(w, r, http.StatusServiceUnavailable,
+			err.Error())
+		return
+	}
+	if err != nil {
+		logger.Printf("break glass error: %v", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state.getBreakGlassStatus(bgState, time.Now()))
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+func TestCheckBreakGlassConfig(t *testing.T) {
+	for _, test := range []struct {
+		config BreakGlassConfig
+		valid  bool
+	}{
+		{BreakGlassConfig{Admins: []string{"alice", "bob"},
+			HtpasswdFilename: "/etc/keymaster/break-glass.htpasswd"}, true},
+		{BreakGlassConfig{Admins: []string{"alice", "bob"}, Quorum: 1,
+			HtpasswdFilename: "/etc/keymaster/break-glass.htpasswd"}, false},
+		{BreakGlassConfig{Admins: []string{"alice", "bob"}, Quorum: 3,
+			HtpasswdFilename: "/etc/keymaster/break-glass.htpasswd"}, false},
+		{BreakGlassConfig{Admins: []string{"alice", "bob"}}, false},
+	} {
+		err := checkBreakGlassConfig(test.config)
+		if test.valid && err != nil {
+			t.Errorf("%+v: %s", test.config, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%+v should be invalid", test.config)
+		}
+	}
+}
+
+func TestBreakGlass(t *testing.T) {
+	state, passwdFile, err := setupValidRuntimeStateSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(passwdFile.Name())
+	dir, err := ioutil.TempDir("", "breakglass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	state.Config.Base.DataDirectory = dir
+	if err := initDB(state); err != nil {
+		t.Fatal(err)
+	}
+	htpasswdFilename := filepath.Join(dir, "break-glass.htpasswd")
+	// The password of emergency is "password".
+	err = ioutil.WriteFile(htpasswdFilename, []byte(
+		"emergency:$2y$05$D4qQmZbWYqfgtGtez2EGdOkcNne40EdEznOqMvZegQypT8Jdz42Jy\n"),
+		0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.Config.BreakGlass = BreakGlassConfig{
+		Admins:           []string{"alice", "bob", "carol"},
+		HtpasswdFilename: htpasswdFilename,
+		AccountGroups:    map[string][]string{"emergency": {"sre"}},
+	}
+	if ok, groups, _ := state.getBreakGlassUserGroups(
+		"emergency"); !ok || len(groups) != 1 {
+		t.Fatalf("unexpected groups of emergency: %v %v", ok, groups)
+	}
+	if ok, _, _ := state.getBreakGlassUserGroups("alice"); ok {
+		t.Fatal("alice is not a break glass account")
+	}
+	req := httptest.NewRequest("POST", proto.BreakGlassPath, nil)
+	bgState, err := state.voteBreakGlass(req, "alice", "LDAP is down")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Voting again does not count twice.
+	bgState, err = state.voteBreakGlass(req, "alice", "LDAP is still down")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := state.getBreakGlassStatus(bgState, time.Now())
+	if status.Active || len(status.Votes) != 1 || status.Quorum != 2 {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+	if state.isBreakGlassActive() {
+		t.Fatal("active without quorum")
+	}
+	if _, err := state.voteBreakGlass(req, "bob", "LDAP is down"); err != nil {
+		t.Fatal(err)
+	}
+	if !state.isBreakGlassActive() {
+		t.Fatal("not active with quorum")
+	}
+	if _, err := state.voteBreakGlass(req, "carol",
+		"LDAP is down"); err != errBreakGlassActive {
+		t.Fatalf("expected errBreakGlassActive, got %v", err)
+	}
+	if _, ok, err := state.deactivateBreakGlass(req, "carol"); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("was active")
+	}
+	if state.isBreakGlassActive() {
+		t.Fatal("still active")
+	}
+	// The votes before the activation do not count again.
+	if _, err := state.voteBreakGlass(req, "bob", "LDAP is down"); err != nil {
+		t.Fatal(err)
+	}
+	if state.isBreakGlassActive() {
+		t.Fatal("active without quorum")
+	}
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/auditlog"
+	"github.com/Cloud-Foundations/keymaster/lib/certpolicy"
+	"github.com/Cloud-Foundations/keymaster/lib/instrumentedwriter"
+	"github.com/Cloud-Foundations/keymaster/lib/simplestorage"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+const (
+	// Certificate requests which need an approval are kept with the signed
+	// user data, keyed by request ID, and listed in an index. The data
+	// types must differ from the other users of the storage (see
+	// web_sessions.go and auth_cookie.go).
+	certApprovalDataType      = 8
+	certApprovalIndexDataType = 9
+	certApprovalIndexKey      = "keymaster-cert-approvals"
+
+	defaultCertApprovalRequestLifetime  = time.Hour
+	defaultCertApprovalApprovalLifetime = time.Hour
+)
+
+var errCertApprovalNotFound = errors.New("unknown or expired request")
+
+// certApproval is a stored approval request. Approvers and ApproverGroups
+// come from the policy rule; admins decide if both are empty.
+type certApproval struct {
+	proto.CertApproval
+	Approvers      []string `json:"approvers,omitempty"`
+	ApproverGroups []string `json:"approver_groups,omitempty"`
+}
+
+// certApprovalIndex lists the stored requests. Key: request ID.
+type certApprovalIndex map[string]time.Time
+
+func (state *RuntimeState) getCertApprovalLifetimes() (time.Duration,
+	time.Duration) {
+	requestLifetime := state.Config.CertApprovals.RequestLifetime
+	if requestLifetime <= 0 {
+		requestLifetime = defaultCertApprovalRequestLifetime
+	}
+	approvalLifetime := state.Config.CertApprovals.ApprovalLifetime
+	if approvalLifetime <= 0 {
+		approvalLifetime = defaultCertApprovalApprovalLifetime
+	}
+	return requestLifetime, approvalLifetime
+}
+
+// getCertApprovalsURL returns the URL of the web UI of the approvals.
+func (state *RuntimeState) getCertApprovalsURL() string {
+	return "https://" + state.HostIdentity + state.Config.Base.HttpAddress +
+		proto.CertApprovalsPath
+}
+
+// getRequestPublicKey returns the uploaded public key of the certificate
+// request r, or nil if there is none.
+func getRequestPublicKey(r *http.Request) []byte {
+	file, _, err := r.FormFile("pubkeyfile")
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// getCertApprovalID returns the ID of the approval request of a
+// certificate. Repeating a request for the same certificate, duration and
+// public key yields the same ID, so that it is issued once approved.
+func getCertApprovalID(username string, certType string,
+	decision *certpolicy.Decision, publicKey []byte) string {
+	hash := sha256.New()
+	for _, value := range []string{username, certType,
+		strings.Join(decision.SSHPrincipals, ","),
+		strings.Join(decision.X509SANs, ","), decision.Duration.String(),
+		string(publicKey)} {
+		fmt.Fprintf(hash, "%d:%s\n", len(value), value)
+	}
+	return hex.EncodeToString(hash.Sum(nil)[:16])
+}
+
+func getCertApproval(storage simplestorage.SimpleStore, id string,
+	now time.Time) (*certApproval, error) {
+	var approval certApproval
+	ok, err := getSignedJSON(storage, id, certApprovalDataType, &approval)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || approval.ID != id || now.After(approval.ExpiresAt) {
+		return nil, nil
+	}
+	return &approval, nil
+}
+
+func getCertApprovalIndex(storage simplestorage.SimpleStore) (
+	certApprovalIndex, error) {
+	index := make(certApprovalIndex)
+	_, err := getSignedJSON(storage, certApprovalIndexKey,
+		certApprovalIndexDataType, &index)
+	if err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// updateCertApprovalIndex sets the expiration of id in the index, or
+// removes it if expiresAt is zero, and drops the expired requests.
+func (state *RuntimeState) updateCertApprovalIndex(
+	storage simplestorage.SimpleStore, id string, expiresAt time.Time) error {
+	state.certApprovalsMutex.Lock()
+	defer state.certApprovalsMutex.Unlock()
+	return updateCertApprovalIndexLocked(storage, id, expiresAt)
+}
+
+// updateCertApprovalIndexLocked is like updateCertApprovalIndex, but the
+// certApprovalsMutex must be held.
+func updateCertApprovalIndexLocked(storage simplestorage.SimpleStore,
+	id string, expiresAt time.Time) error {
+	index, err := getCertApprovalIndex(storage)
+	if err != nil {
+		return err
+	}
+	if expiresAt.IsZero() {
+		delete(index, id)
+	} else {
+		index[id] = expiresAt
+	}
+	now := time.Now()
+	var indexExpiresAt time.Time
+	for id, requestExpiresAt := range index {
+		if now.After(requestExpiresAt) {
+			delete(index, id)
+		} else if requestExpiresAt.After(indexExpiresAt) {
+			indexExpiresAt = requestExpiresAt
+		}
+	}
+	if len(index) < 1 {
+		return storage.DeleteSigned(certApprovalIndexKey,
+			certApprovalIndexDataType)
+	}
+	return putSignedJSON(storage, certApprovalIndexKey,
+		certApprovalIndexDataType, index, indexExpiresAt)
+}
+
+func (state *RuntimeState) saveCertApproval(storage simplestorage.SimpleStore,
+	approval *certApproval) error {
+	err := putSignedJSON(storage, approval.ID, certApprovalDataType, approval,
+		approval.ExpiresAt)
+	if err != nil {
+		return err
+	}
+	return state.updateCertApprovalIndex(storage, approval.ID,
+		approval.ExpiresAt)
+}
+
+// consumeCertApproval deletes the request id and returns it if it has been
+// approved, so that an approval issues one certificate even if it is used
+// concurrently. It returns nil if the request is not approved.
+func (state *RuntimeState) consumeCertApproval(
+	storage simplestorage.SimpleStore, id string, now time.Time) (
+	*certApproval, error) {
+	state.certApprovalsMutex.Lock()
+	defer state.certApprovalsMutex.Unlock()
+	approval, err := getCertApproval(storage, id, now)
+	if err != nil || approval == nil ||
+		approval.State != proto.CertApprovalApproved {
+		return nil, err
+	}
+	if err := storage.DeleteSigned(id, certApprovalDataType); err != nil {
+		return nil, err
+	}
+	return approval, updateCertApprovalIndexLocked(storage, id, time.Time{})
+}
+
+// logAuditCertApproval records action on approval by username.
+func (state *RuntimeState) logAuditCertApproval(r *http.Request,
+	username string, action string, approval *certApproval) {
+	details := map[string]string{
+		"request_id":     approval.ID,
+		"requester":      approval.Username,
+		"cert_type":      approval.CertType,
+		"needs_approval": strings.Join(approval.NeedsApproval, ","),
+	}
+	if action == "request" {
+		details["approval_url"] = state.getCertApprovalsURL()
+	}
+	state.logAuditEvent(r, auditlog.Event{
+		Type:     auditlog.EventTypeCertApproval,
+		Username: username,
+		Success:  true,
+		Method:   action,
+		Details:  details,
+	})
+}
+
+// checkCertApproval returns true if the certificate of decision for
+// username may be issued because another user approved the request r.
+// Otherwise the request is kept pending approval and a denial is written.
+func (state *RuntimeState) checkCertApproval(w http.ResponseWriter,
+	r *http.Request, username string, certType string,
+	decision *certpolicy.Decision) bool {
+	storage := state.sharedSignedStorage()
+	if storage == nil {
+		logger.Printf("refusing certificate for %s: approvals need storage",
+			username)
+		state.writeDenialResponse(w, r, http.StatusForbidden,
+			proto.DenialReasonApprovalRequired,
+			"certificates which need an approval are not available")
+		return false
+	}
+	now := time.Now()
+	id := getCertApprovalID(username, certType, decision,
+		getRequestPublicKey(r))
+	approval, err := state.consumeCertApproval(storage, id, now)
+	if err != nil {
+		logger.Println(err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return false
+	}
+	if approval != nil {
+		state.logAuditCertApproval(r, username, "use", approval)
+		return true
+	}
+	approval, err = getCertApproval(storage, id, now)
+	if err != nil {
+		logger.Println(err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return false
+	}
+	if approval == nil {
+		requestLifetime, _ := state.getCertApprovalLifetimes()
+		approval = &certApproval{
+			CertApproval: proto.CertApproval{
+				ID:            id,
+				Username:      username,
+				CertType:      certType,
+				SSHPrincipals: decision.SSHPrincipals,
+				X509SANs:      decision.X509SANs,
+				NeedsApproval: decision.NeedsApproval,
+				Rule:          decision.Rule,
+				RemoteAddr:    r.RemoteAddr,
+				State:         proto.CertApprovalPending,
+				CreatedAt:     now,
+				ExpiresAt:     now.Add(requestLifetime),
+			},
+			Approvers:      decision.Approvers,
+			ApproverGroups: decision.ApproverGroups,
+		}
+		if err := state.saveCertApproval(storage, approval); err != nil {
+			logger.Println(err)
+			state.writeFailureResponse(w, r, http.StatusInternalServerError,
+				"")
+			return false
+		}
+		state.logAuditCertApproval(r, username, "request", approval)
+	}
+	switch approval.State {
+	case proto.CertApprovalDenied:
+		state.writeDenialResponse(w, r, http.StatusForbidden,
+			proto.DenialReasonApprovalRequired,
+			fmt.Sprintf("certificate request %s was denied by %s", id,
+				approval.DecidedBy))
+	default:
+		state.writeDenialResponse(w, r, http.StatusForbidden,
+			proto.DenialReasonApprovalRequired, fmt.Sprintf(
+				"%s need approval by another user: request %s is pending at %s until %s",
+				strings.Join(approval.NeedsApproval, ", "), id,
+				state.getCertApprovalsURL(),
+				approval.ExpiresAt.Format(time.RFC3339)))
+	}
+	return false
+}
+
+// canDecideCertApproval returns true if username may approve or deny
+// approval.
+func (state *RuntimeState) canDecideCertApproval(username string,
+	approval *certApproval) (bool, error) {
+	if username == approval.Username {
+		return false, nil
+	}
+	if len(approval.Approvers) < 1 && len(approval.ApproverGroups) < 1 {
+		return state.IsAdminUser(username), nil
+	}
+	for _, approver := range approval.Approvers {
+		if approver == username {
+			return true, nil
+		}
+	}
+	if len(approval.ApproverGroups) < 1 {
+		return false, nil
+	}
+	groups, err := state.getUserGroups(username)
+	if err != nil {
+		return false, err
+	}
+	for _, group := range groups {
+		for _, approverGroup := range approval.ApproverGroups {
+			if group == approverGroup {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// listCertApprovals returns the requests of username and those username
+// may decide on, oldest first.
+func (state *RuntimeState) listCertApprovals(username string) (
+	[]proto.CertApproval, error) {
+	storage := state.sharedSignedStorage()
+	if storage == nil {
+		return nil, nil
+	}
+	state.certApprovalsMutex.Lock()
+	index, err := getCertApprovalIndex(storage)
+	state.certApprovalsMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	approvals := make([]proto.CertApproval, 0, len(index))
+	for id := range index {
+		approval, err := getCertApproval(storage, id, now)
+		if err != nil {
+			return nil, err
+		}
+		if approval == nil {
+			continue
+		}
+		ok := approval.Username == username
+		if !ok {
+			ok, err = state.canDecideCertApproval(username, approval)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if ok {
+			approvals = append(approvals, approval.CertApproval)
+		}
+	}
+	sort.Slice(approvals, func(i, j int) bool {
+		return approvals[i].CreatedAt.Before(approvals[j].CreatedAt)
+	})
+	return approvals, nil
+}
+
+// decideCertApproval approves or denies the pending request id on behalf of
+// username. The bool is false if username may not decide on it.
+func (state *RuntimeState) decideCertApproval(r *http.Request,
+	username string, id string, approve bool) (bool, error) {
+	storage := state.sharedSignedStorage()
+	if storage == nil {
+		return false, errCertApprovalNotFound
+	}
+	now := time.Now()
+	approval, err := getCertApproval(storage, id, now)
+	if err != nil {
+		return false, err
+	}
+	if approval == nil || approval.State != proto.CertApprovalPending {
+		return false, errCertApprovalNotFound
+	}
+	ok, err := state.canDecideCertApproval(username, approval)
+	if err != nil || !ok {
+		return false, err
+	}
+	approval.DecidedBy = username
+	approval.DecidedAt = now
+	action := "deny"
+	if approve {
+		_, approvalLifetime := state.getCertApprovalLifetimes()
+		approval.State = proto.CertApprovalApproved
+		approval.ExpiresAt = now.Add(approvalLifetime)
+		action = "approve"
+	} else {
+		// Denials are kept until the request would have expired, so that
+		// repeating the request does not ask again.
+		approval.State = proto.CertApprovalDenied
+	}
+	if err := state.saveCertApproval(storage, approval); err != nil {
+		return true, err
+	}
+	state.logAuditCertApproval(r, username, action, approval)
+	return true, nil
+}
+
+func (state *RuntimeState) certApprovalsHandler(w http.ResponseWriter,
+	r *http.Request) {
+	if state.sendFailureToClientIfLocked(w, r) {
+		return
+	}
+	if r.Method != "GET" && r.Method != "POST" {
+		state.writeFailureResponse(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	authUser, _, err := state.checkAuth(w, r,
+		state.getRequiredWebUIAuthLevel())
+	if err != nil {
+		logger.Debugf(1, "%v", err)
+		return
+	}
+	w.(*instrumentedwriter.LoggingWriter).SetUsername(authUser)
+	if err := r.ParseForm(); err != nil {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Error parsing form")
+		return
+	}
+	if r.Method == "POST" {
+		id := r.Form.Get("id")
+		if id == "" {
+			state.writeFailureResponse(w, r, http.StatusBadRequest,
+				"Missing id")
+			return
+		}
+		var approve bool
+		switch r.Form.Get("action") {
+		case "approve":
+			approve = true
+		case "deny":
+		default:
+			state.writeFailureResponse(w, r, http.StatusBadRequest,
+				"action must be approve or deny")
+			return
+		}
+		ok, err := state.decideCertApproval(r, authUser, id, approve)
+		if err == errCertApprovalNotFound {
+			state.writeFailureResponse(w, r, http.StatusNotFound,
+				"Unknown, expired or already decided request")
+			return
+		}
+		if err != nil {
+			logger.Printf("deciding cert approval error: %v", err)
+			state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+			return
+		}
+		if !ok {
+			state.writeFailureResponse(w, r, http.StatusForbidden,
+				"You may not decide on this request")
+			return
+		}
+		if getPreferredAcceptType(r) == "text/html" {
+			http.Redirect(w, r, proto.CertApprovalsPath, 302)
+			return
+		}
+	}
+	approvals, err := state.listCertApprovals(authUser)
+	if err != nil {
+		logger.Printf("listing cert approvals error: %v", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	if getPreferredAcceptType(r) == "text/html" {
+		state.writeCertApprovalsPage(w, authUser, approvals)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(proto.CertApprovalsResponse{Requests: approvals})
+}
+
+func (state *RuntimeState) writeCertApprovalsPage(w http.ResponseWriter,
+	authUser string, approvals []proto.CertApproval) {
+	displayData := certApprovalsPageTemplateData{
+		Title:        "Keymaster Certificate Approvals",
+		AuthUsername: authUser,
+	}
+	for _, approval := range approvals {
+		displayData.Requests = append(displayData.Requests,
+			certApprovalDisplayInfo{
+				CertApproval: approval,
+				CanDecide: approval.Username != authUser &&
+					approval.State == proto.CertApprovalPending,
+			})
+	}
+	setSecurityHeaders(w)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := state.htmlTemplate.ExecuteTemplate(w, "certApprovalsPage",
+		displayData)
+	if err != nil {
+		logger.Printf("Failed to execute %v", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+	}
+}
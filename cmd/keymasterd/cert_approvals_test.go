@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/certpolicy"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+func TestCertApprovals(t *testing.T) {
+	state, passwdFile, err := setupValidRuntimeStateSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(passwdFile.Name())
+	dir, err := ioutil.TempDir("", "approvals")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	state.Config.Base.DataDirectory = dir
+	if err := initDB(state); err != nil {
+		t.Fatal(err)
+	}
+	decision := &certpolicy.Decision{
+		Rule:          "oncall",
+		SSHPrincipals: []string{"alice", "root"},
+		NeedsApproval: []string{"root"},
+		Approvers:     []string{"alice", "bob"},
+	}
+	checkApproval := func() (bool, int) {
+		req := httptest.NewRequest("GET", certgenPath+"alice", nil)
+		rr := httptest.NewRecorder()
+		ok := state.checkCertApproval(rr, req, "alice", "ssh", decision)
+		return ok, rr.Code
+	}
+	if ok, code := checkApproval(); ok || code != http.StatusForbidden {
+		t.Fatalf("certificate issued without approval: %d", code)
+	}
+	approvals, err := state.listCertApprovals("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(approvals) != 1 ||
+		approvals[0].State != proto.CertApprovalPending {
+		t.Fatalf("unexpected approvals: %+v", approvals)
+	}
+	id := approvals[0].ID
+	// Asking again keeps the same request.
+	checkApproval()
+	if approvals, err := state.listCertApprovals("alice"); err != nil {
+		t.Fatal(err)
+	} else if len(approvals) != 1 {
+		t.Fatalf("unexpected approvals: %+v", approvals)
+	}
+	if approvals, err := state.listCertApprovals("carol"); err != nil {
+		t.Fatal(err)
+	} else if len(approvals) != 0 {
+		t.Fatalf("carol may not see %+v", approvals)
+	}
+	req := httptest.NewRequest("POST", proto.CertApprovalsPath, nil)
+	// Requesters may not approve themselves.
+	if ok, err := state.decideCertApproval(req, "alice", id, true); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("alice approved her own request")
+	}
+	if ok, err := state.decideCertApproval(req, "bob", id, true); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("bob may approve")
+	}
+	if _, err := state.decideCertApproval(req, "bob", id,
+		false); err != errCertApprovalNotFound {
+		t.Fatalf("decided twice: %v", err)
+	}
+	// The approval is only for the requested duration.
+	decision.Duration = time.Hour
+	if ok, _ := checkApproval(); ok {
+		t.Fatal("approval used for another duration")
+	}
+	decision.Duration = 0
+	if ok, code := checkApproval(); !ok {
+		t.Fatalf("approved certificate not issued: %d", code)
+	}
+	// Approvals are used once.
+	if ok, _ := checkApproval(); ok {
+		t.Fatal("approval used twice")
+	}
+	approvals, err = state.listCertApprovals("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The request for the other duration and the new one are pending.
+	if len(approvals) != 2 {
+		t.Fatalf("unexpected approvals: %+v", approvals)
+	}
+	for _, approval := range approvals {
+		if ok, err := state.decideCertApproval(req, "bob", approval.ID,
+			false); err != nil || !ok {
+			t.Fatalf("cannot deny: %v", err)
+		}
+	}
+	if ok, _ := checkApproval(); ok {
+		t.Fatal("denied certificate issued")
+	}
+}
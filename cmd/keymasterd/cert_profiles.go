@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+// defaultCertProfile is used for requests which do not select a profile.
+const defaultCertProfile = "default"
+
+var certProfileExtKeyUsages = map[string]x509.ExtKeyUsage{
+	"clientAuth":      x509.ExtKeyUsageClientAuth,
+	"serverAuth":      x509.ExtKeyUsageServerAuth,
+	"codeSigning":     x509.ExtKeyUsageCodeSigning,
+	"emailProtection": x509.ExtKeyUsageEmailProtection,
+	"ipsecUser":       x509.ExtKeyUsageIPSECUser,
+}
+
+var certProfileAuthMethods = []string{
+	proto.AuthTypePassword,
+	proto.AuthTypeFederated,
+	proto.AuthTypeU2F,
+	proto.AuthTypeSymantecVIP,
+	proto.AuthTypeIPCertificate,
+	proto.AuthTypeTOTP,
+	proto.AuthTypeWebAuthn,
+	proto.AuthTypeOkta2FA,
+	proto.AuthTypeRADIUS,
+	proto.AuthTypeDuo,
+	proto.AuthTypeWebhook,
+	proto.AuthTypeRecoveryCode,
+	proto.AuthTypeCloudIdentity,
+	proto.AuthTypeServiceAccount,
+	proto.AuthTypeOIDCToken,
+	proto.AuthTypeCertificateRenewal,
+}
+
+func checkCertProfiles(profiles map[string]CertProfileConfig) error {
+	for name, profile := range profiles {
+		if name == "" {
+			return fmt.Errorf("profile without a name")
+		}
+		if profile.MaxDuration < 0 {
+			return fmt.Errorf("%s: max_duration must not be negative", name)
+		}
+		if _, err := profile.getExtKeyUsages(); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+		for _, method := range profile.RequiredAuth {
+			if !stringInList(method, certProfileAuthMethods) {
+				return fmt.Errorf("%s: unknown auth method: %q", name, method)
+			}
+		}
+		if err := checkX509SANTemplates(profile.X509SANTemplates); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// getExtKeyUsages returns the extended key usages of the profile, or nil if
+// it keeps the defaults.
+func (profile CertProfileConfig) getExtKeyUsages() ([]x509.ExtKeyUsage,
+	error) {
+	var usages []x509.ExtKeyUsage
+	for _, name := range profile.ExtKeyUsages {
+		usage, ok := certProfileExtKeyUsages[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown extended key usage: %q", name)
+		}
+		usages = append(usages, usage)
+	}
+	return usages, nil
+}
+
+// isCertProfileEntitled returns true if username may use profile.
+func (state *RuntimeState) isCertProfileEntitled(username string,
+	profile CertProfileConfig) (bool, error) {
+	if len(profile.Users) < 1 && len(profile.Groups) < 1 {
+		return true, nil
+	}
+	if stringInList(username, profile.Users) {
+		return true, nil
+	}
+	if len(profile.Groups) < 1 {
+		return false, nil
+	}
+	groups, err := state.getUserGroups(username)
+	if err != nil {
+		return false, err
+	}
+	for _, group := range groups {
+		if stringInList(group, profile.Groups) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// checkCertProfile returns the profile selected with the "profile" form
+// value, or the default profile, or nil if there is neither. If username may
+// not use the profile with authLevel a response is written and false is
+// returned.
+func (state *RuntimeState) checkCertProfile(w http.ResponseWriter,
+	r *http.Request, username string, authLevel int) (
+	*CertProfileConfig, bool) {
+	profiles := state.getConfig().Base.CertProfiles
+	name := r.Form.Get("profile")
+	if name == "" {
+		name = defaultCertProfile
+		if _, ok := profiles[name]; !ok {
+			return nil, true
+		}
+	}
+	profile, ok := profiles[name]
+	if !ok {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			fmt.Sprintf("Unknown certificate profile %q", name))
+		return nil, false
+	}
+	entitled, err := state.isCertProfileEntitled(username, profile)
+	if err != nil {
+		logger.Println(err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return nil, false
+	}
+	if !entitled {
+		logger.Printf("refusing certificate profile %s for %s", name, username)
+		state.writeDenialResponse(w, r, http.StatusForbidden,
+			proto.DenialReasonPolicy,
+			fmt.Sprintf("not entitled to the %s certificate profile", name))
+		return nil, false
+	}
+	if len(profile.RequiredAuth) > 0 {
+		sufficientAuth := false
+		for _, method := range getAuthMethodNames(authLevel) {
+			if stringInList(method, profile.RequiredAuth) {
+				sufficientAuth = true
+				break
+			}
+		}
+		if !sufficientAuth {
+			state.writeDenialResponse(w, r, http.StatusForbidden,
+				proto.DenialReasonInsufficientAuthLevel,
+				fmt.Sprintf("the %s certificate profile requires one of: %v",
+					name, profile.RequiredAuth))
+			return nil, false
+		}
+	}
+	return &profile, true
+}
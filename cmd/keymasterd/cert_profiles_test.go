@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+func TestCheckCertProfiles(t *testing.T) {
+	err := checkCertProfiles(map[string]CertProfileConfig{
+		"default": {MaxDuration: 8 * time.Hour},
+		"vpn": {ExtKeyUsages: []string{"clientAuth", "ipsecUser"},
+			X509SANTemplates: []X509SANTemplate{
+				{Type: "dns", Value: "$USER.vpn.example.com"}}},
+		"admin": {Groups: []string{"sre"},
+			RequiredAuth: []string{proto.AuthTypeU2F, proto.AuthTypeWebAuthn}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, profile := range map[string]CertProfileConfig{
+		"duration": {MaxDuration: -time.Hour},
+		"usage":    {ExtKeyUsages: []string{"anyUsage"}},
+		"auth":     {RequiredAuth: []string{"Yubikey"}},
+		"template": {X509SANTemplates: []X509SANTemplate{{Type: "ip"}}},
+	} {
+		err := checkCertProfiles(map[string]CertProfileConfig{name: profile})
+		if err == nil {
+			t.Errorf("%s: %+v should be invalid", name, profile)
+		}
+	}
+}
+
+func TestCheckCertProfile(t *testing.T) {
+	state := &RuntimeState{}
+	state.Config.Base.CertProfiles = map[string]CertProfileConfig{
+		"admin": {Users: []string{"alice"},
+			RequiredAuth: []string{proto.AuthTypeU2F}},
+		"vpn": {ExtKeyUsages: []string{"ipsecUser"}},
+	}
+	checkProfile := func(name, username string, authLevel int) (
+		*CertProfileConfig, int, string) {
+		req := httptest.NewRequest("GET",
+			certgenPath+username+"?profile="+name, nil)
+		req.Header.Set("Accept", "application/json")
+		if err := req.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		profile, ok := state.checkCertProfile(rr, req, username, authLevel)
+		if ok {
+			return profile, http.StatusOK, ""
+		}
+		var denial proto.DenialResponse
+		json.NewDecoder(rr.Body).Decode(&denial)
+		return nil, rr.Code, denial.ReasonCode
+	}
+	if profile, code, _ := checkProfile("", "bob",
+		AuthTypePassword); code != http.StatusOK || profile != nil {
+		t.Fatalf("unexpected profile without default: %d %+v", code, profile)
+	}
+	state.Config.Base.CertProfiles["default"] = CertProfileConfig{
+		MaxDuration: time.Hour}
+	if profile, _, _ := checkProfile("", "bob",
+		AuthTypePassword); profile == nil || profile.MaxDuration != time.Hour {
+		t.Fatalf("default profile not used: %+v", profile)
+	}
+	if _, code, _ := checkProfile("unknown", "bob",
+		AuthTypePassword); code != http.StatusBadRequest {
+		t.Fatalf("unknown profile: %d", code)
+	}
+	if _, code, reason := checkProfile("admin", "bob",
+		AuthTypeU2F); code != http.StatusForbidden ||
+		reason != proto.DenialReasonPolicy {
+		t.Fatalf("bob is not entitled to admin: %d %s", code, reason)
+	}
+	if _, code, reason := checkProfile("admin", "alice",
+		AuthTypePassword); code != http.StatusForbidden ||
+		reason != proto.DenialReasonInsufficientAuthLevel {
+		t.Fatalf("admin requires U2F: %d %s", code, reason)
+	}
+	if _, code, _ := checkProfile("admin", "alice",
+		AuthTypePassword|AuthTypeU2F); code != http.StatusOK {
+		t.Fatalf("alice may use admin with U2F: %d", code)
+	}
+	profile, code, _ := checkProfile("vpn", "bob", AuthTypePassword)
+	if code != http.StatusOK {
+		t.Fatalf("everyone may use vpn: %d", code)
+	}
+	usages, err := profile.getExtKeyUsages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usages) != 1 || usages[0] != x509.ExtKeyUsageIPSECUser {
+		t.Fatalf("unexpected extended key usages: %v", usages)
+	}
+}
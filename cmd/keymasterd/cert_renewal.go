@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/authutil"
+	"github.com/Cloud-Foundations/keymaster/lib/certgen"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+	"github.com/Cloud-Foundations/keymaster/proto/eventmon"
+)
+
+const defaultCertRenewalMaxLifetime = 30 * 24 * time.Hour
+
+var errNoRenewalCertificate = errors.New("no client certificate")
+
+// serviceClientCAPool returns the CAs of the client certificates accepted on
+// the service port. With certificate renewal this includes the keymaster CA.
+func (state *RuntimeState) serviceClientCAPool() (*x509.CertPool, error) {
+	if !state.Config.CertRenewal.Enabled {
+		return state.ClientCAPool, nil
+	}
+	caCert, err := x509.ParseCertificate(state.caCertDer)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if state.ClientCAPool != nil {
+		pool = state.ClientCAPool.Clone()
+	}
+	pool.AddCert(caCert)
+	return pool, nil
+}
+
+// getRenewalCertificate returns the verified client certificate of r.
+func getRenewalCertificate(r *http.Request) (*x509.Certificate, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) < 1 {
+		return nil, errNoRenewalCertificate
+	}
+	return r.TLS.VerifiedChains[0][0], nil
+}
+
+// getCertRenewalMaxLifetime returns how long after logging in with
+// credentials users may renew their certificates.
+func (state *RuntimeState) getCertRenewalMaxLifetime() time.Duration {
+	if state.Config.CertRenewal.MaxLifetime > 0 {
+		return state.Config.CertRenewal.MaxLifetime
+	}
+	return defaultCertRenewalMaxLifetime
+}
+
+// getCertAuthTime returns the time at which the user of r logged in with
+// credentials, as recorded in X.509 certificates: that of the session if
+// there is one, else now.
+func (state *RuntimeState) getCertAuthTime(r *http.Request) time.Time {
+	for _, cookie := range r.Cookies() {
+		if cookie.Name != authCookieName {
+			continue
+		}
+		if info, err := state.getAuthInfoFromAuthJWT(cookie.Value); err == nil {
+			return info.AuthTime
+		}
+	}
+	return time.Now()
+}
+
+// checkRenewalCertificate returns an error unless cert is a user certificate
+// issued by the keymaster which has not been revoked, for a user who still
+// exists and logged in with credentials less than the maximum lifetime ago.
+// It returns when the user logged in.
+func (state *RuntimeState) checkRenewalCertificate(
+	cert *x509.Certificate) (time.Time, error) {
+	authTime, err := state.checkRenewalCertificateIssuance(cert)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if maxLifetime := state.getCertRenewalMaxLifetime(); time.Since(
+		authTime) > maxLifetime {
+		return time.Time{}, fmt.Errorf(
+			"logged in at %s, more than %s ago", authTime.Format(time.RFC3339),
+			maxLifetime)
+	}
+	return authTime, nil
+}
+
+// checkRenewalCertificateIssuance makes the checks of checkRenewalCertificate
+// on the certificate itself.
+func (state *RuntimeState) checkRenewalCertificateIssuance(
+	cert *x509.Certificate) (time.Time, error) {
+	caCert, err := x509.ParseCertificate(state.caCertDer)
+	if err != nil {
+		return time.Time{}, err
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return time.Time{}, fmt.Errorf("not issued by this keymaster: %s", err)
+	}
+	// IP restricted certificates are renewed by their own policy.
+	if certgen.IsIPRestrictedX509Cert(cert) {
+		return time.Time{}, errors.New(
+			"IP restricted certificates cannot be renewed")
+	}
+	snapshot, err := state.getRevocationSnapshot()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if _, ok := snapshot.revoked[cert.SerialNumber.String()]; ok {
+		return time.Time{}, fmt.Errorf("certificate %s is revoked",
+			cert.SerialNumber)
+	}
+	username := cert.Subject.CommonName
+	if _, err := state.getUserGroups(username); err != nil {
+		if err == authutil.ErrUserNotFound {
+			return time.Time{}, fmt.Errorf("user %s no longer exists", username)
+		}
+		return time.Time{}, err
+	}
+	authTime, err := certgen.GetAuthTime(cert)
+	if err != nil {
+		return time.Time{}, err
+	}
+	// Certificates issued before auth times were recorded.
+	if authTime.IsZero() {
+		authTime = cert.NotBefore
+	}
+	return authTime, nil
+}
+
+// certRenewalLoginHandler logs in users with a valid X.509 certificate
+// issued by the keymaster, as described for
+// proto.CertificateRenewalLoginPath.
+func (state *RuntimeState) certRenewalLoginHandler(w http.ResponseWriter,
+	r *http.Request) {
+	if state.sendFailureToClientIfLocked(w, r) {
+		return
+	}
+	if r.Method != "POST" {
+		state.writeFailureResponse(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	cert, err := getRenewalCertificate(r)
+	if err != nil {
+		state.writeFailureResponse(w, r, http.StatusUnauthorized,
+			"A client certificate is required")
+		return
+	}
+	username := cert.Subject.CommonName
+	if username == "" {
+		state.writeFailureResponse(w, r, http.StatusUnauthorized,
+			"Invalid client certificate")
+		return
+	}
+	attempt := state.checkRateLimit(w, r, username, proto.AuthTypeCertificateRenewal)
+	if attempt == nil {
+		return
+	}
+	defer attempt.release()
+	authTime, err := state.checkRenewalCertificate(cert)
+	state.logAuditLogin(r, username, proto.AuthTypeCertificateRenewal,
+		err == nil, err)
+	state.recordRateLimitResult(r, attempt, err == nil)
+	if err != nil {
+		logger.Printf("certificate renewal login as %s failed: %s", username,
+			err)
+		state.writeFailureResponse(w, r, http.StatusUnauthorized,
+			"Invalid client certificate")
+		return
+	}
+	logger.Debugf(1, "Valid certificate renewal login for %s", username)
+	if state.Config.CertRenewal.RequireSecondFactor {
+		// The certificate replaces the password only.
+		state.writeLoginResponse(w, r, username,
+			eventmon.AuthTypeCertificateRenewal)
+		return
+	}
+	// The new certificates keep the login time of the renewed one.
+	_, err = state.setNewAuthCookieWithAuthTime(w, r, username,
+		AuthTypeCertificateRenewal, authTime)
+	if err != nil {
+		state.writeFailureResponse(w, r, http.StatusInternalServerError,
+			"error internal")
+		logger.Println(err)
+		return
+	}
+	eventNotifier.PublishAuthEvent(eventmon.AuthTypeCertificateRenewal,
+		username)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(proto.LoginResponse{
+		Message:           "success",
+		CertAuthBackend:   []string{proto.AuthTypeCertificateRenewal},
+		SupportedKeyTypes: supportedKeyTypes,
+	})
+}
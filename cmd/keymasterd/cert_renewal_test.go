@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/certgen"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestCertRenewalLogin(t *testing.T) {
+	state, passwdFile, err := setupValidRuntimeStateSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(passwdFile.Name())
+	dir, err := ioutil.TempDir("", "cert_renewal_testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	state.Config.Base.DataDirectory = dir
+	if err := initDB(state); err != nil {
+		t.Fatal(err)
+	}
+	state.Config.CertRenewal.Enabled = true
+	caCert, err := x509.ParseCertificate(state.caCertDer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userPub, _, _ := setupX509Generator(t)
+	newRequest := func(cert *x509.Certificate) *http.Request {
+		req := httptest.NewRequest("POST", proto.CertificateRenewalLoginPath,
+			nil)
+		if cert != nil {
+			req.TLS = &tls.ConnectionState{
+				VerifiedChains: [][]*x509.Certificate{{cert}},
+			}
+		}
+		return req
+	}
+	derCert, err := certgen.GenUserX509Cert("username", userPub, caCert,
+		state.Signer, nil, testDuration, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(derCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr, err := checkRequestHandlerCode(newRequest(cert),
+		state.certRenewalLoginHandler, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !checkValidLoginResponse(rr.Result(), state, "username") {
+		t.Fatal("invalid login response")
+	}
+	var response proto.LoginResponse
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.CertAuthBackend) != 1 ||
+		response.CertAuthBackend[0] != proto.AuthTypeCertificateRenewal {
+		t.Fatalf("unexpected login response: %+v", response)
+	}
+	_, err = checkRequestHandlerCode(newRequest(nil),
+		state.certRenewalLoginHandler, http.StatusUnauthorized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Certificates from other CAs trusted for client authentication.
+	otherCAPriv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherState := RuntimeState{HostIdentity: "other.example.com"}
+	otherCADer, err := generateCADer(&otherState, otherCAPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCACert, err := x509.ParseCertificate(otherCADer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	derCert, err = certgen.GenUserX509Cert("username", userPub, otherCACert,
+		otherCAPriv, nil, testDuration, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCert, err := x509.ParseCertificate(derCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = checkRequestHandlerCode(newRequest(otherCert),
+		state.certRenewalLoginHandler, http.StatusUnauthorized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	derCert, err = certgen.GenIPRestrictedX509Cert("username", userPub,
+		caCert, state.Signer,
+		[]net.IPNet{{IP: net.ParseIP("10.0.0.0"), Mask: net.CIDRMask(8, 32)}},
+		testDuration, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipCert, err := x509.ParseCertificate(derCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = checkRequestHandlerCode(newRequest(ipCert),
+		state.certRenewalLoginHandler, http.StatusUnauthorized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = state.RevokeCertificate(revokedCertificate{
+		CertType:       revokedX509CertType,
+		Serial:         cert.SerialNumber.String(),
+		RevokedBy:      "admin",
+		Reason:         ocsp.KeyCompromise,
+		RevocationTime: time.Now().Truncate(time.Second),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.invalidateRevocationSnapshot()
+	_, err = checkRequestHandlerCode(newRequest(cert),
+		state.certRenewalLoginHandler, http.StatusUnauthorized)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertRenewalSessionOnlyGetsCerts(t *testing.T) {
+	state, passwdFile, err := setupValidRuntimeStateSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(passwdFile.Name())
+	cookieValue, err := state.setNewAuthCookie(nil, nil, "username",
+		AuthTypeCertificateRenewal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newRequest := func() *http.Request {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: authCookieName, Value: cookieValue})
+		return req
+	}
+	rr := httptest.NewRecorder()
+	if _, _, err := state.checkAuth(rr, newRequest(), AuthTypeAny); err == nil {
+		t.Fatal("renewal session should not be accepted for AuthTypeAny")
+	}
+	rr = httptest.NewRecorder()
+	_, authLevel, err := state.checkAuth(rr, newRequest(),
+		AuthTypeAny|AuthTypeCertificateRenewal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authLevel != AuthTypeCertificateRenewal {
+		t.Fatalf("unexpected auth level: %d", authLevel)
+	}
+	for _, handler := range []http.HandlerFunc{
+		state.RecoveryCodeAuthHandler,
+		state.bearerTokenHandler,
+	} {
+		req := httptest.NewRequest("POST", "/", nil)
+		req.AddCookie(&http.Cookie{Name: authCookieName, Value: cookieValue})
+		_, err := checkRequestHandlerCode(req, handler,
+			http.StatusUnauthorized)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCertRenewalMaxLifetime(t *testing.T) {
+	state, passwdFile, err := setupValidRuntimeStateSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(passwdFile.Name())
+	dir, err := ioutil.TempDir("", "cert_renewal_testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	state.Config.Base.DataDirectory = dir
+	if err := initDB(state); err != nil {
+		t.Fatal(err)
+	}
+	state.Config.CertRenewal.Enabled = true
+	state.Config.CertRenewal.MaxLifetime = 7 * 24 * time.Hour
+	caCert, err := x509.ParseCertificate(state.caCertDer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userPub, _, _ := setupX509Generator(t)
+	newRequest := func(authTime time.Time) *http.Request {
+		derCert, err := certgen.GenUserX509CertWithOptions("username",
+			userPub, caCert, state.Signer, testDuration,
+			certgen.UserX509CertOptions{AuthTime: authTime})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(derCert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("POST", proto.CertificateRenewalLoginPath,
+			nil)
+		req.TLS = &tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{cert}},
+		}
+		return req
+	}
+	_, err = checkRequestHandlerCode(newRequest(time.Now().Add(-8*24*time.Hour)),
+		state.certRenewalLoginHandler, http.StatusUnauthorized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authTime := time.Now().Add(-6 * 24 * time.Hour).Truncate(time.Second)
+	rr, err := checkRequestHandlerCode(newRequest(authTime),
+		state.certRenewalLoginHandler, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Certificates issued with the renewal session keep the login time.
+	var req *http.Request
+	for _, cookie := range rr.Result().Cookies() {
+		if cookie.Name == authCookieName {
+			req = httptest.NewRequest("POST", "/", nil)
+			req.AddCookie(cookie)
+		}
+	}
+	if req == nil {
+		t.Fatal("no session cookie")
+	}
+	if certAuthTime := state.getCertAuthTime(req); !certAuthTime.Equal(
+		authTime) {
+		t.Fatalf("auth time %s != %s", certAuthTime, authTime)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/Cloud-Foundations/keymaster/lib/instrumentedwriter"
+)
+
+const certRequestPath = "/certRequest/"
+
+// certRequestHandler serves the page on which a browser generates a key
+// pair and obtains certificates for it from certgenPath, for users who
+// cannot install the client. Users who are not logged in are sent to the
+// login and second factor pages first.
+func (state *RuntimeState) certRequestHandler(w http.ResponseWriter,
+	r *http.Request) {
+	if state.sendFailureToClientIfLocked(w, r) {
+		return
+	}
+	if r.Method != "GET" {
+		state.writeFailureResponse(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	authUser, _, err := state.checkAuth(w, r,
+		state.getRequiredWebUIAuthLevel())
+	if err != nil {
+		logger.Debugf(1, "%v", err)
+		return
+	}
+	w.(*instrumentedwriter.LoggingWriter).SetUsername(authUser)
+	displayData := certRequestPageTemplateData{
+		Title:        "Keymaster Certificate Request",
+		AuthUsername: authUser,
+		JSSources:    []string{"/static/webui-certrequest.js"},
+	}
+	setSecurityHeaders(w)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = state.htmlTemplate.ExecuteTemplate(w, "certRequestPage",
+		displayData)
+	if err != nil {
+		logger.Printf("Failed to execute %v", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+	}
+}
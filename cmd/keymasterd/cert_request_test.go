@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCertRequestHandler(t *testing.T) {
+	state, passwdFile, err := setupValidRuntimeStateSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(passwdFile.Name())
+	dir, err := ioutil.TempDir("", "certrequest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	state.Config.Base.DataDirectory = dir
+	state.Config.Base.AllowedAuthBackendsForWebUI = []string{"password"}
+	if err := initDB(state); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.loadTemplates(); err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("GET", certRequestPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "text/html")
+	// Without a session the login page returns to this page.
+	rr, err := checkRequestHandlerCode(req, state.certRequestHandler,
+		http.StatusUnauthorized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(rr.Body.String(), certRequestPath) {
+		t.Fatal("login page does not return to the certificate request page")
+	}
+	cookieVal, err := state.setNewAuthCookie(nil, nil, "username",
+		AuthTypeAny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(&http.Cookie{Name: authCookieName, Value: cookieVal})
+	rr, err = checkRequestHandlerCode(req, state.certRequestHandler,
+		http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := rr.Body.String()
+	if !strings.Contains(body, "/static/webui-certrequest.js") ||
+		!strings.Contains(body, `data-username="username"`) {
+		t.Fatal("unexpected certificate request page")
+	}
+}
@@ -14,6 +14,7 @@ import (
 
 	"github.com/Cloud-Foundations/keymaster/lib/authutil"
 	"github.com/Cloud-Foundations/keymaster/lib/certgen"
+	"github.com/Cloud-Foundations/keymaster/lib/certpolicy"
 	"github.com/Cloud-Foundations/keymaster/lib/instrumentedwriter"
 	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
 	"golang.org/x/crypto/ssh"
@@ -53,46 +54,44 @@ func (state *RuntimeState) certGenHandler(w http.ResponseWriter, r *http.Request
 	/*
 	 */
 	// TODO(camilo_viecco1): reorder checks so that simple checks are done before checking user creds
-	authUser, authLevel, err := state.checkAuth(w, r, AuthTypeAny)
+	authUser, authLevel, err := state.checkAuth(w, r,
+		AuthTypeAny|AuthTypeCertificateRenewal)
 	if err != nil {
 		logger.Debugf(1, "%v", err)
 		return
 	}
 	w.(*instrumentedwriter.LoggingWriter).SetUsername(authUser)
 
-	sufficientAuthLevel := false
-	// We should do an intersection operation here
-	for _, certPref := range state.Config.Base.AllowedAuthBackendsForCerts {
-		if certPref == proto.AuthTypePassword {
-			sufficientAuthLevel = true
-		}
-		if certPref == proto.AuthTypeU2F && ((authLevel & AuthTypeU2F) == AuthTypeU2F) {
-			sufficientAuthLevel = true
-		}
-		if certPref == proto.AuthTypeSymantecVIP && ((authLevel & AuthTypeSymantecVIP) == AuthTypeSymantecVIP) {
-			sufficientAuthLevel = true
-		}
-		if certPref == proto.AuthTypeIPCertificate && ((authLevel & AuthTypeIPCertificate) == AuthTypeIPCertificate) {
-			sufficientAuthLevel = true
-		}
-	}
-	// if you have u2f you can always get the cert
-	if (authLevel & AuthTypeU2F) == AuthTypeU2F {
-		sufficientAuthLevel = true
-	}
-
-	if !sufficientAuthLevel {
+	if !state.isSufficientAuthLevelForCerts(authLevel) {
 		logger.Printf("Not enough auth level for getting certs")
-		state.writeFailureResponse(w, r, http.StatusBadRequest, "Not enough auth level for getting certs")
+		state.writeDenialResponse(w, r, http.StatusBadRequest,
+			proto.DenialReasonInsufficientAuthLevel,
+			"Not enough auth level for getting certs")
 		return
 	}
 
 	targetUser := r.URL.Path[len(certgenPath):]
 	if authUser != targetUser {
-		state.writeFailureResponse(w, r, http.StatusForbidden, "")
+		state.writeDenialResponse(w, r, http.StatusForbidden,
+			proto.DenialReasonUserMismatch, fmt.Sprintf(
+				"authenticated as %s, cannot get certs for %s",
+				authUser, targetUser))
 		logger.Printf("User %s asking for creds for %s", authUser, targetUser)
 		return
 	}
+	if err := state.checkEnabledFactors(authUser); err != nil &&
+		authLevel&AuthTypeBreakGlass == 0 {
+		if _, ok := err.(notEnoughFactorsError); !ok {
+			logger.Println(err)
+			state.writeFailureResponse(w, r, http.StatusInternalServerError,
+				"")
+			return
+		}
+		logger.Printf("%s: %s", authUser, err)
+		state.writeDenialResponse(w, r, http.StatusForbidden,
+			proto.DenialReasonNotEnoughFactors, err.Error())
+		return
+	}
 	logger.Debugf(3, "auth succedded for %s", authUser)
 
 	switch r.Method {
@@ -141,15 +140,97 @@ func (state *RuntimeState) certGenHandler(w http.ResponseWriter, r *http.Request
 	}
 	logger.Printf("cert type =%s", certType)
 
+	if certType == "x509" || certType == "x509-kubernetes" {
+		maxDuration, err := state.getMaxX509Duration(targetUser)
+		if err != nil {
+			logger.Println(err)
+			state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+			return
+		}
+		if maxDuration > 0 && duration > maxDuration {
+			logger.Debugf(1, "reducing x509 duration for %s to %s",
+				targetUser, maxDuration)
+			duration = maxDuration
+		}
+	}
+
+	profile, ok := state.checkCertProfile(w, r, targetUser, authLevel)
+	if !ok {
+		return
+	}
+	if profile != nil && profile.MaxDuration > 0 &&
+		duration > profile.MaxDuration {
+		logger.Debugf(1, "reducing duration for %s to %s of the profile",
+			targetUser, profile.MaxDuration)
+		duration = profile.MaxDuration
+	}
+	sshRequest, err := parseSSHPermissionsRequest(r)
+	if err != nil {
+		state.writeFailureResponse(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	deviceApproved, deviceErr := state.checkCertRequestDevice(r, targetUser)
+	if !deviceApproved && state.Config.DeviceTrust.RequireApprovedDevice {
+		logger.Printf("refusing certificate for %s: %s", targetUser, deviceErr)
+		state.writeDenialResponse(w, r, http.StatusForbidden,
+			proto.DenialReasonDeviceNotApproved, deviceErr.Error())
+		return
+	}
+	hardwareKey, hardwareKeyErr := state.checkCertRequestHardwareKey(r)
+	if !hardwareKey {
+		required, err := state.requiresHardwareKey(targetUser)
+		if err != nil {
+			logger.Println(err)
+			state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+			return
+		}
+		if required {
+			logger.Printf("refusing certificate for %s: %s", targetUser,
+				hardwareKeyErr)
+			state.writeDenialResponse(w, r, http.StatusForbidden,
+				proto.DenialReasonHardwareKeyRequired, hardwareKeyErr.Error())
+			return
+		}
+	}
+	defaultSSHPermissions := state.getDefaultSSHPermissions()
+	decision, ok := state.checkCertPolicy(w, r, targetUser, authLevel, duration,
+		deviceApproved, hardwareKey, sshRequest, defaultSSHPermissions)
+	if !ok {
+		return
+	}
+	duration = decision.Duration
+	if !hardwareKey {
+		principal := state.getHardwareKeyPrincipal(certType, decision)
+		if principal != "" {
+			logger.Printf("refusing %s for %s: %s", principal, targetUser,
+				hardwareKeyErr)
+			state.writeDenialResponse(w, r, http.StatusForbidden,
+				proto.DenialReasonHardwareKeyRequired,
+				fmt.Sprintf("%s requires a hardware attested key: %s",
+					principal, hardwareKeyErr))
+			return
+		}
+	}
+	if len(decision.NeedsApproval) > 0 &&
+		!state.checkCertApproval(w, r, targetUser, certType, decision) {
+		return
+	}
+
 	switch certType {
 	case "ssh":
-		state.postAuthSSHCertHandler(w, r, targetUser, keySigner, duration)
+		state.postAuthSSHCertHandler(w, r, targetUser, authLevel, keySigner,
+			duration, decision.SSHPrincipals,
+			sshRequest.getSSHPermissions(defaultSSHPermissions, decision))
 		return
 	case "x509":
-		state.postAuthX509CertHandler(w, r, targetUser, keySigner, duration, false)
+		state.postAuthX509CertHandler(w, r, targetUser, authLevel, keySigner,
+			duration, false, decision.X509SANs, profile,
+			state.getCertAuthTime(r))
 		return
 	case "x509-kubernetes":
-		state.postAuthX509CertHandler(w, r, targetUser, keySigner, duration, true)
+		state.postAuthX509CertHandler(w, r, targetUser, authLevel, keySigner,
+			duration, true, decision.X509SANs, profile,
+			state.getCertAuthTime(r))
 		return
 	default:
 		state.writeFailureResponse(w, r, http.StatusBadRequest, "Unrecognized cert type")
@@ -157,6 +238,254 @@ func (state *RuntimeState) certGenHandler(w http.ResponseWriter, r *http.Request
 	}
 }
 
+// isSufficientAuthLevelForCerts returns true if authLevel is enough to get
+// certificates: one of the allowed_auth_backends_for_certs or U2F, and for
+// break glass accounts only during emergency issuance.
+func (state *RuntimeState) isSufficientAuthLevelForCerts(authLevel int) bool {
+	sufficientAuthLevel := false
+	// We should do an intersection operation here
+	for _, certPref := range state.getConfig().Base.AllowedAuthBackendsForCerts {
+		if certPref == proto.AuthTypePassword && !needsStepUp(authLevel) {
+			sufficientAuthLevel = true
+		}
+		if certPref == proto.AuthTypeU2F && ((authLevel & AuthTypeU2F) == AuthTypeU2F) {
+			sufficientAuthLevel = true
+		}
+		if certPref == proto.AuthTypeSymantecVIP && ((authLevel & AuthTypeSymantecVIP) == AuthTypeSymantecVIP) {
+			sufficientAuthLevel = true
+		}
+		if certPref == proto.AuthTypeIPCertificate && ((authLevel & AuthTypeIPCertificate) == AuthTypeIPCertificate) {
+			sufficientAuthLevel = true
+		}
+		if certPref == proto.AuthTypeWebAuthn && ((authLevel & AuthTypeWebAuthn) == AuthTypeWebAuthn) {
+			sufficientAuthLevel = true
+		}
+		if certPref == proto.AuthTypeOkta2FA && ((authLevel & AuthTypeOkta2FA) == AuthTypeOkta2FA) {
+			sufficientAuthLevel = true
+		}
+		if certPref == proto.AuthTypeRADIUS && ((authLevel & AuthTypeRADIUS) == AuthTypeRADIUS) {
+			sufficientAuthLevel = true
+		}
+		if certPref == proto.AuthTypeDuo && ((authLevel & AuthTypeDuo) == AuthTypeDuo) {
+			sufficientAuthLevel = true
+		}
+		if certPref == proto.AuthTypeWebhook && ((authLevel & AuthTypeWebhook) == AuthTypeWebhook) {
+			sufficientAuthLevel = true
+		}
+		if certPref == proto.AuthTypeRecoveryCode && ((authLevel & AuthTypeRecoveryCode) == AuthTypeRecoveryCode) {
+			sufficientAuthLevel = true
+		}
+		if certPref == proto.AuthTypeCloudIdentity && ((authLevel & AuthTypeCloudIdentity) == AuthTypeCloudIdentity) {
+			sufficientAuthLevel = true
+		}
+		if certPref == proto.AuthTypeServiceAccount && ((authLevel & AuthTypeServiceAccount) == AuthTypeServiceAccount) {
+			sufficientAuthLevel = true
+		}
+		if certPref == proto.AuthTypeOIDCToken && ((authLevel & AuthTypeOIDCToken) == AuthTypeOIDCToken) {
+			sufficientAuthLevel = true
+		}
+		if certPref == proto.AuthTypeCertificateRenewal && ((authLevel & AuthTypeCertificateRenewal) == AuthTypeCertificateRenewal) {
+			sufficientAuthLevel = true
+		}
+	}
+	// if you have u2f you can always get the cert
+	if (authLevel & AuthTypeU2F) == AuthTypeU2F {
+		sufficientAuthLevel = true
+	}
+	// Break glass accounts only get certificates during emergency issuance.
+	if authLevel&AuthTypeBreakGlass != 0 {
+		sufficientAuthLevel = state.isBreakGlassActive()
+	}
+	return sufficientAuthLevel
+}
+
+// getMaxX509Duration returns the longest X.509 certificate lifetime set for
+// username in x509_cert_durations, or 0 if none is set.
+func (state *RuntimeState) getMaxX509Duration(username string) (
+	time.Duration, error) {
+	durations := state.getConfig().Base.X509CertDurations
+	if duration, ok := durations.Users[username]; ok {
+		return duration, nil
+	}
+	if len(durations.Groups) < 1 {
+		return 0, nil
+	}
+	groups, err := state.getUserGroups(username)
+	if err != nil {
+		return 0, err
+	}
+	var maxDuration time.Duration
+	for _, group := range groups {
+		duration, ok := durations.Groups[group]
+		if ok && (maxDuration == 0 || duration < maxDuration) {
+			maxDuration = duration
+		}
+	}
+	return maxDuration, nil
+}
+
+// getAuthMethodNames returns the names used in
+// allowed_auth_backends_for_certs of the methods set in authLevel.
+func getAuthMethodNames(authLevel int) []string {
+	var names []string
+	for _, method := range []struct {
+		authType int
+		name     string
+	}{
+		{AuthTypePassword, proto.AuthTypePassword},
+		{AuthTypeFederated, proto.AuthTypeFederated},
+		{AuthTypeU2F, proto.AuthTypeU2F},
+		{AuthTypeSymantecVIP, proto.AuthTypeSymantecVIP},
+		{AuthTypeIPCertificate, proto.AuthTypeIPCertificate},
+		{AuthTypeTOTP, proto.AuthTypeTOTP},
+		{AuthTypeWebAuthn, proto.AuthTypeWebAuthn},
+		{AuthTypeOkta2FA, proto.AuthTypeOkta2FA},
+		{AuthTypeRADIUS, proto.AuthTypeRADIUS},
+		{AuthTypeDuo, proto.AuthTypeDuo},
+		{AuthTypeWebhook, proto.AuthTypeWebhook},
+		{AuthTypeRecoveryCode, proto.AuthTypeRecoveryCode},
+		{AuthTypeCloudIdentity, proto.AuthTypeCloudIdentity},
+		{AuthTypeServiceAccount, proto.AuthTypeServiceAccount},
+		{AuthTypeOIDCToken, proto.AuthTypeOIDCToken},
+		{AuthTypeCertificateRenewal, proto.AuthTypeCertificateRenewal},
+	} {
+		if authLevel&method.authType == method.authType {
+			names = append(names, method.name)
+		}
+	}
+	return names
+}
+
+// getRequestedPrincipals returns the SSH principals requested in the
+// comma separated "principals" form value.
+func getRequestedPrincipals(r *http.Request) []string {
+	var principals []string
+	for _, value := range r.Form["principals"] {
+		for _, principal := range strings.Split(value, ",") {
+			if principal = strings.TrimSpace(principal); principal != "" {
+				principals = append(principals, principal)
+			}
+		}
+	}
+	return principals
+}
+
+// checkCertPolicy returns what may be issued for the certificate request in
+// r, coming from an approved device if deviceApproved. If the request is
+// not permitted a denial is written and false is returned. Without a
+// certificate policy only the username may be requested and SSH extensions
+// may only be dropped.
+func (state *RuntimeState) checkCertPolicy(w http.ResponseWriter,
+	r *http.Request, username string, authLevel int,
+	duration time.Duration, deviceApproved bool, hardwareKey bool,
+	sshRequest sshPermissionsRequest,
+	defaultSSHPermissions ssh.Permissions) (*certpolicy.Decision, bool) {
+	request := certpolicy.Request{
+		Username:       username,
+		AuthMethods:    getAuthMethodNames(authLevel),
+		Duration:       duration,
+		DeviceApproved: deviceApproved,
+		HardwareKey:    hardwareKey,
+		SSHPrincipals:  getRequestedPrincipals(r),
+		X509SANs:       r.Form["san"],
+	}
+	err := sshRequest.addToPolicyRequest(&request, defaultSSHPermissions)
+	if err != nil {
+		state.writeDenialResponse(w, r, http.StatusForbidden,
+			proto.DenialReasonPolicy, err.Error())
+		return nil, false
+	}
+	if authLevel&AuthTypeServiceAccount == AuthTypeServiceAccount {
+		account, ok, err := state.LoadServiceAccount(username)
+		if err != nil {
+			logger.Println(err)
+			state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+			return nil, false
+		}
+		if !ok {
+			state.writeDenialResponse(w, r, http.StatusForbidden,
+				proto.DenialReasonPolicy, "service account was deleted")
+			return nil, false
+		}
+		request.Rule = account.CertPolicyRule
+	}
+	if state.certPolicy == nil && request.Rule != "" {
+		state.writeDenialResponse(w, r, http.StatusForbidden,
+			proto.DenialReasonPolicy,
+			"service account is bound to a rule but there is no certificate policy")
+		return nil, false
+	}
+	mapper := state.getPrincipalMapper()
+	var groups []string
+	if mapper != nil ||
+		(state.certPolicy != nil && state.certPolicy.NeedsGroups()) {
+		groups, err = state.getUserGroups(username)
+		if err != nil {
+			logger.Println(err)
+			state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+			return nil, false
+		}
+	}
+	// Mapped principals are granted whether or not they are requested, so
+	// the policy only decides on the others.
+	mappedPrincipals := mapper.Map(username, groups)
+	request.SSHPrincipals = removeSSHPrincipals(request.SSHPrincipals,
+		mappedPrincipals)
+	if state.certPolicy == nil {
+		for _, principal := range request.SSHPrincipals {
+			if principal != username {
+				state.writeDenialResponse(w, r, http.StatusForbidden,
+					proto.DenialReasonPolicy,
+					"additional SSH principals require a certificate policy")
+				return nil, false
+			}
+		}
+		if len(request.X509SANs) > 0 {
+			state.writeDenialResponse(w, r, http.StatusForbidden,
+				proto.DenialReasonPolicy,
+				"X.509 SANs require a certificate policy")
+			return nil, false
+		}
+		if len(request.SSHCriticalOptions) > 0 ||
+			len(request.SSHExtensions) > 0 {
+			state.writeDenialResponse(w, r, http.StatusForbidden,
+				proto.DenialReasonPolicy,
+				"SSH critical options and additional extensions require a certificate policy")
+			return nil, false
+		}
+		return &certpolicy.Decision{
+			Duration: duration,
+			SSHPrincipals: addSSHPrincipals([]string{username},
+				mappedPrincipals),
+		}, true
+	}
+	request.Groups = groups
+	decision, err := state.certPolicy.Evaluate(request)
+	if err != nil {
+		var deniedError *certpolicy.DeniedError
+		if errors.As(err, &deniedError) {
+			logger.Printf("certificate policy denied %s: %s", username, err)
+			state.writeDenialResponse(w, r, http.StatusForbidden,
+				proto.DenialReasonPolicy, deniedError.Error())
+			return nil, false
+		}
+		logger.Println(err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return nil, false
+	}
+	if decision.Duration != duration {
+		logger.Debugf(1, "certificate policy rule %s reduced duration to %s",
+			decision.Rule, decision.Duration)
+	}
+	decision.SSHPrincipals = addSSHPrincipals(decision.SSHPrincipals,
+		mappedPrincipals)
+	return decision, true
+}
+
+// supportedKeyTypes lists the user key types certificates are issued for.
+var supportedKeyTypes = []string{proto.KeyTypeRSA, proto.KeyTypeECDSA,
+	proto.KeyTypeEd25519}
+
 // returns 3 values, if the key is valid, if the key is not valid, the text reason why and and error if it was an internal error
 func getValidSSHPublicKey(userPubKey string) (ssh.PublicKey, error, error) {
 	validKey, err := regexp.MatchString("^(ssh-rsa|ssh-dss|ecdsa-sha2-nistp256|ssh-ed25519) [a-zA-Z0-9/+]+=?=? ?.{0,512}\n?$", userPubKey)
@@ -186,10 +515,40 @@ func getValidSSHPublicKey(userPubKey string) (ssh.PublicKey, error, error) {
 	return userSSH, nil, nil
 }
 
-func (state *RuntimeState) postAuthSSHCertHandler(
-	w http.ResponseWriter, r *http.Request, targetUser string,
-	keySigner crypto.Signer, duration time.Duration) {
+// sshAlgorithmsSigner is implemented by CA signers which can make only some of
+// the SSH signature algorithms for their key type, such as Cloud KMS keys.
+type sshAlgorithmsSigner interface {
+	SSHAlgorithms() []string
+}
+
+// newSSHSigner returns an SSH signer for the CA signer keySigner, limited to
+// the algorithms it can make.
+func newSSHSigner(keySigner crypto.Signer) (ssh.Signer, error) {
 	signer, err := ssh.NewSignerFromSigner(keySigner)
+	if err != nil {
+		return nil, err
+	}
+	restricted, ok := keySigner.(sshAlgorithmsSigner)
+	if !ok {
+		return signer, nil
+	}
+	algorithms := restricted.SSHAlgorithms()
+	if algorithms == nil {
+		return signer, nil
+	}
+	algorithmSigner, ok := signer.(ssh.AlgorithmSigner)
+	if !ok {
+		return nil, errors.New("signer does not support SSH algorithms")
+	}
+	return ssh.NewSignerWithAlgorithms(algorithmSigner, algorithms)
+}
+
+func (state *RuntimeState) postAuthSSHCertHandler(
+	w http.ResponseWriter, r *http.Request, targetUser string, authLevel int,
+	keySigner crypto.Signer, duration time.Duration, principals []string,
+	permissions ssh.Permissions) {
+	start := time.Now()
+	signer, err := newSSHSigner(keySigner)
 	if err != nil {
 		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
 		logger.Printf("Signer failed to load")
@@ -200,7 +559,14 @@ func (state *RuntimeState) postAuthSSHCertHandler(
 	var certBytes []byte
 	switch r.Method {
 	case "GET":
-		cert, certBytes, err = certgen.GenSSHCertFileStringFromSSSDPublicKey(targetUser, signer, state.HostIdentity, duration)
+		userPubKey, err := certgen.GetUserPubKeyFromSSSD(targetUser)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		cert, certBytes, err = certgen.GenSSHCertFileStringWithPermissions(
+			targetUser, principals, permissions, userPubKey, signer,
+			state.HostIdentity, duration)
 		if err != nil {
 			http.NotFound(w, r)
 			return
@@ -229,7 +595,9 @@ func (state *RuntimeState) postAuthSSHCertHandler(
 			return
 		}
 
-		cert, certBytes, err = certgen.GenSSHCertFileString(targetUser, userPubKey, signer, state.HostIdentity, duration)
+		cert, certBytes, err = certgen.GenSSHCertFileStringWithPermissions(
+			targetUser, principals, permissions, userPubKey, signer,
+			state.HostIdentity, duration)
 		if err != nil {
 			state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
 			logger.Printf("signUserPubkey Err")
@@ -241,8 +609,14 @@ func (state *RuntimeState) postAuthSSHCertHandler(
 		return
 
 	}
+	if err := state.logSSHIssuance(targetUser, authLevel, certBytes); err != nil {
+		logger.Printf("cannot record SSH certificate issuance: %s", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
 	eventNotifier.PublishSSH(certBytes)
 	metricLogCertDuration("ssh", "granted", float64(duration.Seconds()))
+	metricLogCertIssuanceDuration("ssh", time.Since(start))
 
 	w.Header().Set("Content-Disposition", `attachment; filename="id_rsa-cert.pub"`)
 	w.WriteHeader(200)
@@ -272,49 +646,85 @@ func (state *RuntimeState) getGitDbUserGroups(username string) (
 func (state *RuntimeState) getLdapUserGroups(username string) (
 	bool, []string, error) {
 	ldapConfig := state.Config.UserInfo.Ldap
-	var timeoutSecs uint
-	timeoutSecs = 2
+	lookup := state.getLiveLdapUserGroups
+	if state.ldapGroupCache != nil {
+		lookup = state.getCachedLdapUserGroups
+	}
+	configured, groups, fromSnapshot, err :=
+		state.lookupGroupsWithSnapshotFallback(username,
+			ldapConfig.SnapshotLatencyBudget, ldapConfig.SnapshotMaxAge,
+			lookup)
+	if fromSnapshot {
+		logger.Printf("groups for %s are based on cached snapshot data",
+			username)
+	}
+	return configured, groups, err
+}
+
+func (state *RuntimeState) getCachedLdapUserGroups(username string) (
+	bool, []string, error) {
+	if state.Config.UserInfo.Ldap.LDAPTargetURLs == "" {
+		return false, nil, nil
+	}
+	groups, err := state.ldapGroupCache.GetUserGroups(username)
+	return true, groups, err
+}
+
+// lookupLiveLdapUserGroups adapts getLiveLdapUserGroups to
+// groupcache.LookupFunc.
+func (state *RuntimeState) lookupLiveLdapUserGroups(username string) (
+	[]string, error) {
+	_, groups, err := state.getLiveLdapUserGroups(username)
+	return groups, err
+}
+
+func (state *RuntimeState) getLiveLdapUserGroups(username string) (
+	bool, []string, error) {
+	ldapConfig := state.Config.UserInfo.Ldap
 	if ldapConfig.LDAPTargetURLs == "" {
 		return false, nil, nil
 	}
-	for _, ldapUrl := range strings.Split(ldapConfig.LDAPTargetURLs, ",") {
-		if len(ldapUrl) < 1 {
-			continue
-		}
-		u, err := authutil.ParseLDAPURL(ldapUrl)
-		if err != nil {
-			logger.Printf("Failed to parse ldapurl '%s'", ldapUrl)
-			continue
-		}
-		groups, err := authutil.GetLDAPUserGroups(*u,
-			ldapConfig.BindUsername, ldapConfig.BindPassword,
-			timeoutSecs, nil, username,
-			ldapConfig.UserSearchBaseDNs, ldapConfig.UserSearchFilter,
-			ldapConfig.GroupSearchBaseDNs, ldapConfig.GroupSearchFilter)
-		if err != nil {
-			continue
+	groups, _, err := state.getLdapPool().GetUserGroupsWithLimit(username,
+		ldapConfig.UserSearchFilter, ldapConfig.GroupSearchFilter,
+		ldapConfig.MaxGroups, state.ldapRelevantGroupsRE)
+	if err != nil {
+		if err == authutil.ErrUserNotFound {
+			return true, nil, err
 		}
-		return true, prependGroups(groups, ldapConfig.GroupPrepend), nil
-
+		logger.Debugf(1, "Failed to get groups for %s: %s", username, err)
+		return true, nil, errors.New("error getting the groups")
 	}
-	return true, nil, errors.New("error getting the groups")
+	return true, prependGroups(groups, ldapConfig.GroupPrepend), nil
 }
 
 func (state *RuntimeState) getUserGroups(username string) ([]string, error) {
+	if config, groups, err := state.getServiceAccountGroups(username); config {
+		return groups, err
+	}
+	if config, groups, err := state.getBreakGlassUserGroups(username); config {
+		return groups, err
+	}
+	if config, groups, err := state.getLocalUserGroups(username); config {
+		return groups, err
+	}
 	if config, groups, err := state.getLdapUserGroups(username); config {
 		return groups, err
 	}
 	if config, groups, err := state.getGitDbUserGroups(username); config {
 		return groups, err
 	}
+	if config, groups, err := state.getFederatedUserGroups(username); config {
+		return groups, err
+	}
 	return nil, nil
 }
 
 func (state *RuntimeState) postAuthX509CertHandler(
-	w http.ResponseWriter, r *http.Request, targetUser string,
+	w http.ResponseWriter, r *http.Request, targetUser string, authLevel int,
 	keySigner crypto.Signer, duration time.Duration,
-	kubernetesHack bool) {
-
+	kubernetesHack bool, sans []string, profile *CertProfileConfig,
+	authTime time.Time) {
+	start := time.Now()
 	var userGroups, groups []string
 	// Getting user groups can be a failure, in this case we dont want to
 	// abort if we are not explicitly asking for groups in our cert.
@@ -331,6 +741,32 @@ func (state *RuntimeState) postAuthX509CertHandler(
 	if r.Form.Get("addGroups") == "true" {
 		groups = userGroups
 	}
+	sanTemplates := state.Config.Base.X509SANTemplates
+	var extKeyUsages []x509.ExtKeyUsage
+	if profile != nil {
+		if len(profile.X509SANTemplates) > 0 {
+			sanTemplates = profile.X509SANTemplates
+		}
+		var err error
+		extKeyUsages, err = profile.getExtKeyUsages()
+		if err != nil {
+			logger.Println(err)
+			state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+			return
+		}
+	}
+	// Service accounts are not in the directory.
+	if authLevel&AuthTypeServiceAccount == 0 {
+		templatedSANs, err := state.expandX509SANTemplates(targetUser,
+			sanTemplates)
+		if err != nil {
+			logger.Printf("cannot get X.509 SAN attributes of %s: %s",
+				targetUser, err)
+			state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+			return
+		}
+		sans = append(sans, templatedSANs...)
+	}
 	organizations := []string{"keymaster"}
 	if kubernetesHack {
 		organizations = userGroups
@@ -380,13 +816,33 @@ func (state *RuntimeState) postAuthX509CertHandler(
 			logger.Printf("Cannot parse CA Der data")
 			return
 		}
-		derCert, err := certgen.GenUserX509Cert(targetUser, userPub, caCert,
-			keySigner, state.KerberosRealm, duration, groups, organizations)
+		ocspServers, crlDistributionPoints := state.getRevocationURLs()
+		derCert, err := certgen.GenUserX509CertWithOptions(targetUser,
+			userPub, caCert, keySigner, duration, certgen.UserX509CertOptions{
+				KerberosRealm:         state.KerberosRealm,
+				Groups:                groups,
+				Organizations:         organizations,
+				SANs:                  state.addSPIFFEID(sans, targetUser),
+				ExtKeyUsages:          extKeyUsages,
+				AuthTime:              authTime,
+				OCSPServers:           ocspServers,
+				CRLDistributionPoints: crlDistributionPoints,
+			})
 		if err != nil {
 			state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
 			logger.Printf("Cannot Generate x509cert")
 			return
 		}
+		certType := "x509"
+		if kubernetesHack {
+			certType = "x509-kubernetes"
+		}
+		err = state.logX509Issuance(targetUser, certType, authLevel, derCert)
+		if err != nil {
+			logger.Printf("cannot record x509 certificate issuance: %s", err)
+			state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+			return
+		}
 		eventNotifier.PublishX509(derCert)
 		cert = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE",
 			Bytes: derCert}))
@@ -397,6 +853,7 @@ func (state *RuntimeState) postAuthX509CertHandler(
 
 	}
 	metricLogCertDuration("x509", "granted", float64(duration.Seconds()))
+	metricLogCertIssuanceDuration("x509", time.Since(start))
 
 	w.Header().Set("Content-Disposition", `attachment; filename="userCert.pem"`)
 	w.WriteHeader(200)
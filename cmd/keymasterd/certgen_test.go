@@ -2,11 +2,14 @@ package main
 
 import (
 	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"os"
@@ -14,7 +17,9 @@ import (
 	"time"
 
 	"github.com/Cloud-Foundations/keymaster/lib/certgen"
+	"github.com/Cloud-Foundations/keymaster/lib/certpolicy"
 	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+	"golang.org/x/crypto/ssh"
 )
 
 const testSignerX509Cert = `-----BEGIN CERTIFICATE-----
@@ -158,6 +163,27 @@ func TestGetValidSSHPublicKey(t *testing.T) {
 	if userSSH == nil {
 		t.Fatal("the usekey MUst not be null")
 	}
+	for _, keyType := range supportedKeyTypes {
+		if keyType == proto.KeyTypeRSA {
+			continue
+		}
+		signer, _, err := generateCAKey(keyType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sshPub, err := ssh.NewPublicKey(signer.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+		userSSH, userErr, err := getValidSSHPublicKey(
+			string(ssh.MarshalAuthorizedKey(sshPub)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if userSSH == nil {
+			t.Fatalf("%s key rejected: %s", keyType, userErr)
+		}
+	}
 	//invalid key
 	invalidKeys := []string{invalidSSHFileBadKeyData, dsaPublicSSH, testSignerX509Cert}
 	for _, badKey := range invalidKeys {
@@ -171,3 +197,170 @@ func TestGetValidSSHPublicKey(t *testing.T) {
 	}
 
 }
+
+func TestCertGenPolicy(t *testing.T) {
+	state, passwdFile, err := setupValidRuntimeStateSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(passwdFile.Name()) // clean up
+	cookieVal, err := state.setNewAuthCookie(nil, nil, "username", AuthTypeU2F)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authCookie := http.Cookie{Name: authCookieName, Value: cookieVal}
+	doRequest := func(urlStr string, expectedStatus int) *ssh.Certificate {
+		req, err := createKeyBodyRequest("POST", urlStr, testUserSSHPublicKey,
+			"")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.AddCookie(&authCookie)
+		rr, err := checkRequestHandlerCode(req, state.certGenHandler,
+			expectedStatus)
+		if err != nil {
+			t.Fatalf("%s: %s", urlStr, err)
+		}
+		if expectedStatus != http.StatusOK {
+			return nil
+		}
+		pubKey, _, _, _, err := ssh.ParseAuthorizedKey(rr.Body.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pubKey.(*ssh.Certificate)
+	}
+	// Without a policy only the username may be requested.
+	doRequest("/certgen/username?principals=username", http.StatusOK)
+	doRequest("/certgen/username?principals=admin", http.StatusForbidden)
+	state.certPolicy, err = certpolicy.New(certpolicy.Config{
+		Rules: []certpolicy.Rule{
+			{
+				Users:                []string{"username"},
+				MaxDuration:          30 * time.Minute,
+				AllowedSSHPrincipals: []string{"admin"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := doRequest("/certgen/username?principals=admin", http.StatusOK)
+	if len(cert.ValidPrincipals) != 2 ||
+		cert.ValidPrincipals[0] != "username" ||
+		cert.ValidPrincipals[1] != "admin" {
+		t.Fatalf("unexpected principals: %v", cert.ValidPrincipals)
+	}
+	lifetime := time.Duration(cert.ValidBefore-cert.ValidAfter) * time.Second
+	if lifetime > 31*time.Minute {
+		t.Fatalf("lifetime %s not capped by policy", lifetime)
+	}
+	doRequest("/certgen/username?principals=root", http.StatusForbidden)
+	doRequest("/certgen/username?type=x509&san=other.example.com",
+		http.StatusForbidden)
+}
+
+func TestGetMaxX509Duration(t *testing.T) {
+	var state RuntimeState
+	duration, err := state.getMaxX509Duration("username")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if duration != 0 {
+		t.Fatalf("duration without overrides: %s != 0", duration)
+	}
+	state.Config.Base.X509CertDurations = CertDurationConfig{
+		Groups: map[string]time.Duration{"admins": 4 * time.Hour},
+		Users:  map[string]time.Duration{"username": time.Hour},
+	}
+	duration, err = state.getMaxX509Duration("username")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if duration != time.Hour {
+		t.Fatalf("user duration: %s != 1h", duration)
+	}
+	// No group source is configured so other users are in no groups.
+	duration, err = state.getMaxX509Duration("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if duration != 0 {
+		t.Fatalf("duration for other user: %s != 0", duration)
+	}
+	state.Config.Base.X509CertDurations.Groups["admins"] = 0
+	if err := state.Config.Base.X509CertDurations.check(); err == nil {
+		t.Fatal("zero group duration should be rejected")
+	}
+}
+
+// hashOnlySigner signs like a Cloud KMS RSA key, which only makes PKCS #1
+// v1.5 signatures of digests with one hash.
+type hashOnlySigner struct {
+	*rsa.PrivateKey
+	hash      crypto.Hash
+	algorithm string
+}
+
+func (s hashOnlySigner) Sign(rand io.Reader, digest []byte,
+	opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != s.hash {
+		return nil, fmt.Errorf("cannot sign a %v digest", opts.HashFunc())
+	}
+	return s.PrivateKey.Sign(rand, digest, opts)
+}
+
+func (s hashOnlySigner) SSHAlgorithms() []string {
+	return []string{s.algorithm}
+}
+
+func TestNewSSHSignerWithRestrictedAlgorithms(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userSigner, err := ssh.NewSignerFromSigner(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, keySigner := range []hashOnlySigner{
+		{key, crypto.SHA256, ssh.KeyAlgoRSASHA256},
+		{key, crypto.SHA512, ssh.KeyAlgoRSASHA512},
+	} {
+		// The default RSA SSH signature algorithm is ssh-rsa, with SHA-1.
+		unrestricted, err := ssh.NewSignerFromSigner(keySigner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = unrestricted.Sign(rand.Reader, []byte("data"))
+		if err == nil {
+			t.Fatal("unrestricted signer should fail")
+		}
+		signer, err := newSSHSigner(keySigner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert := &ssh.Certificate{
+			Key:             userSigner.PublicKey(),
+			CertType:        ssh.UserCert,
+			ValidPrincipals: []string{"username"},
+			ValidBefore:     ssh.CertTimeInfinity,
+		}
+		if err := cert.SignCert(rand.Reader, signer); err != nil {
+			t.Fatal(err)
+		}
+		if cert.Signature.Format != keySigner.algorithm {
+			t.Fatalf("signed with %s, expected %s", cert.Signature.Format,
+				keySigner.algorithm)
+		}
+		checker := ssh.CertChecker{
+			IsUserAuthority: func(auth ssh.PublicKey) bool {
+				return string(auth.Marshal()) ==
+					string(signer.PublicKey().Marshal())
+			},
+		}
+		if err := checker.CheckCert("username", cert); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
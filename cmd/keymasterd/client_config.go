@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+// checkClientConfigProfile rejects profiles the clients could not use.
+func checkClientConfigProfile(profile ClientConfigProfile) error {
+	if profile.GenCertURLs != "" {
+		for _, target := range strings.Split(profile.GenCertURLs, ",") {
+			u, err := url.Parse(target)
+			if err != nil {
+				return err
+			}
+			if u.Scheme != "https" || u.Host == "" {
+				return fmt.Errorf("%q is not an https URL", target)
+			}
+		}
+	}
+	if profile.KeyBits < 0 {
+		return fmt.Errorf("invalid key_bits %d", profile.KeyBits)
+	}
+	if profile.AgentRenewBefore < 0 || profile.AgentRetryInterval < 0 {
+		return fmt.Errorf("negative agent durations")
+	}
+	return nil
+}
+
+func checkClientConfig(config ClientConfigConfig) error {
+	if err := checkClientConfigProfile(config.ClientConfigProfile); err != nil {
+		return err
+	}
+	for name, profile := range config.Environments {
+		if err := checkClientConfigProfile(profile); err != nil {
+			return fmt.Errorf("environment %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// getClientConfigProfile returns the profile of environment, or the default
+// one if environment is empty, or false if there is no such environment.
+func (state *RuntimeState) getClientConfigProfile(environment string) (
+	ClientConfigProfile, bool) {
+	profile := state.Config.ClientConfig.ClientConfigProfile
+	if environment == "" {
+		return profile, true
+	}
+	envProfile, ok := state.Config.ClientConfig.Environments[environment]
+	if !ok {
+		return ClientConfigProfile{}, false
+	}
+	if envProfile.GenCertURLs != "" {
+		profile.GenCertURLs = envProfile.GenCertURLs
+	}
+	if envProfile.KeyType != "" {
+		profile.KeyType = envProfile.KeyType
+		profile.KeyBits = envProfile.KeyBits
+	} else if envProfile.KeyBits != 0 {
+		profile.KeyBits = envProfile.KeyBits
+	}
+	if envProfile.AddGroups {
+		profile.AddGroups = true
+	}
+	if envProfile.AgentRenewBefore != 0 {
+		profile.AgentRenewBefore = envProfile.AgentRenewBefore
+	}
+	if envProfile.AgentRetryInterval != 0 {
+		profile.AgentRetryInterval = envProfile.AgentRetryInterval
+	}
+	return profile, true
+}
+
+// clientConfigHandler serves the client settings of the environment in the
+// environment query parameter.
+func (state *RuntimeState) clientConfigHandler(w http.ResponseWriter,
+	r *http.Request) {
+	if r.Method != "GET" {
+		state.writeFailureResponse(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	profile, ok := state.getClientConfigProfile(
+		r.URL.Query().Get("environment"))
+	if !ok {
+		state.writeFailureResponse(w, r, http.StatusNotFound,
+			"Unknown environment")
+		return
+	}
+	response := proto.ClientConfigResponse{
+		GenCertURLs:               profile.GenCertURLs,
+		KeyType:                   profile.KeyType,
+		KeyBits:                   profile.KeyBits,
+		AddGroups:                 profile.AddGroups,
+		AgentRenewBeforeSeconds:   int64(profile.AgentRenewBefore.Seconds()),
+		AgentRetryIntervalSeconds: int64(profile.AgentRetryInterval.Seconds()),
+		SSHDomains:                state.getSSHClientDomains(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
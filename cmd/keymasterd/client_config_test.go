@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+func TestCheckClientConfig(t *testing.T) {
+	for _, test := range []struct {
+		config ClientConfigConfig
+		valid  bool
+	}{
+		{ClientConfigConfig{ClientConfigProfile: ClientConfigProfile{
+			GenCertURLs: "https://km1.example.com,https://km2.example.com"}},
+			true},
+		{ClientConfigConfig{ClientConfigProfile: ClientConfigProfile{
+			GenCertURLs: "http://km1.example.com"}}, false},
+		{ClientConfigConfig{Environments: map[string]ClientConfigProfile{
+			"staging": {AgentRenewBefore: -time.Hour}}}, false},
+	} {
+		err := checkClientConfig(test.config)
+		if test.valid && err != nil {
+			t.Errorf("%+v: %s", test.config, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%+v should be invalid", test.config)
+		}
+	}
+}
+
+func TestClientConfigHandler(t *testing.T) {
+	var state RuntimeState
+	state.Config.ClientConfig = ClientConfigConfig{
+		ClientConfigProfile: ClientConfigProfile{
+			GenCertURLs:      "https://km.example.com",
+			KeyType:          proto.KeyTypeEd25519,
+			AgentRenewBefore: 4 * time.Hour,
+		},
+		Environments: map[string]ClientConfigProfile{
+			"staging": {GenCertURLs: "https://km.staging.example.com"},
+		},
+	}
+	state.Config.SSHClientConfig.Domains = []SSHClientDomain{{
+		HostPatterns: []string{"*.example.com"},
+	}}
+	getConfig := func(query string, code int) proto.ClientConfigResponse {
+		rr := httptest.NewRecorder()
+		state.clientConfigHandler(rr, httptest.NewRequest("GET",
+			proto.ClientConfigPath+query, nil))
+		if rr.Code != code {
+			t.Fatalf("%s: unexpected status %d", query, rr.Code)
+		}
+		var response proto.ClientConfigResponse
+		if code == http.StatusOK {
+			if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return response
+	}
+	response := getConfig("", http.StatusOK)
+	if response.GenCertURLs != "https://km.example.com" ||
+		response.KeyType != proto.KeyTypeEd25519 ||
+		response.AgentRenewBeforeSeconds != 4*3600 ||
+		len(response.SSHDomains) != 1 {
+		t.Fatalf("unexpected response %+v", response)
+	}
+	response = getConfig("?environment=staging", http.StatusOK)
+	if response.GenCertURLs != "https://km.staging.example.com" ||
+		response.KeyType != proto.KeyTypeEd25519 {
+		t.Fatalf("unexpected response %+v", response)
+	}
+	getConfig("?environment=prod", http.StatusNotFound)
+}
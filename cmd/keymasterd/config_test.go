@@ -7,6 +7,10 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/pwauth"
+	"github.com/Cloud-Foundations/keymaster/lib/pwauth/command"
 )
 
 func TestGenerateNewConfigInternal(t *testing.T) {
@@ -40,3 +44,39 @@ func TestGenerateNewConfigInternal(t *testing.T) {
 	// TODO: test decrypt file
 
 }
+
+func TestNewPasswordBackendChain(t *testing.T) {
+	falseAuthenticator, err := command.New("false", nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trueAuthenticator, err := command.New("true", nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	available := map[string]pwauth.PasswordAuthenticator{
+		"ldap":    falseAuthenticator,
+		"command": trueAuthenticator,
+	}
+	_, err = newPasswordBackendChain(
+		[]PasswordBackendConfig{{Name: "okta"}}, available, "")
+	if err == nil {
+		t.Fatal("unconfigured backend accepted")
+	}
+	passwordChecker, err := newPasswordBackendChain([]PasswordBackendConfig{
+		{Name: "ldap", Timeout: time.Second},
+		{Name: "command"},
+	}, available, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend, valid, err := passwordChecker.PasswordAuthenticateWithBackend(
+		"username", []byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !valid || backend != "command" {
+		t.Fatalf("expected success from command, got %v from %q",
+			valid, backend)
+	}
+}
@@ -31,6 +31,7 @@ var (
 	)
 	lastSuccessLDAPPasswordTime time.Time
 	lastSuccessLDAPUserInfoTime time.Time
+	lastSuccessPKCS11Time       time.Time
 )
 
 const timeoutSecs = 5
@@ -54,13 +55,15 @@ func init() {
 		"Time since last successful LDAP check for UserInfo(s)")
 }
 
-func checkLDAPURLs(ldapURLs string, name string, rootCAs *x509.CertPool) error {
+func checkLDAPURLs(ldapURLs string, allowStartTLS bool, name string,
+	rootCAs *x509.CertPool) error {
 	if len(ldapURLs) <= 0 {
 		return errors.New("No data to check")
 	}
 	urlList := strings.Split(ldapURLs, ",")
 	for _, stringURL := range urlList {
-		url, err := authutil.ParseLDAPURL(stringURL)
+		url, err := authutil.ParseLDAPURLWithStartTLS(stringURL,
+			allowStartTLS)
 		if err != nil {
 			return err
 		}
@@ -77,7 +80,8 @@ func checkLDAPURLs(ldapURLs string, name string, rootCAs *x509.CertPool) error {
 
 func checkLDAPConfigs(config AppConfigFile, rootCAs *x509.CertPool) {
 	if len(config.Ldap.LDAPTargetURLs) > 0 {
-		err := checkLDAPURLs(config.Ldap.LDAPTargetURLs, "passwd", rootCAs)
+		err := checkLDAPURLs(config.Ldap.LDAPTargetURLs,
+			config.Ldap.AllowStartTLS, "passwd", rootCAs)
 		if err != nil {
 			logger.Debugf(1, "password LDAP check Failed %s", err)
 		} else {
@@ -88,7 +92,8 @@ func checkLDAPConfigs(config AppConfigFile, rootCAs *x509.CertPool) {
 	}
 	ldapConfig := config.UserInfo.Ldap
 	if len(ldapConfig.LDAPTargetURLs) > 0 {
-		err := checkLDAPURLs(ldapConfig.LDAPTargetURLs, "userinfo", rootCAs)
+		err := checkLDAPURLs(ldapConfig.LDAPTargetURLs,
+			ldapConfig.AllowStartTLS, "userinfo", rootCAs)
 		if err != nil {
 			logger.Debugf(1, "userinfo LDAP check Failed %s", err)
 		} else {
@@ -101,7 +106,25 @@ func checkLDAPConfigs(config AppConfigFile, rootCAs *x509.CertPool) {
 
 func (state *RuntimeState) doDependencyMonitoring(secsBetweenChecks int) {
 	for {
-		checkLDAPConfigs(state.Config, nil)
+		checkLDAPConfigs(*state.getConfig(), nil)
+		state.checkPKCS11Signer()
 		time.Sleep(time.Duration(secsBetweenChecks) * time.Second)
 	}
 }
+
+func (state *RuntimeState) checkPKCS11Signer() {
+	if state.pkcs11Signer == nil {
+		return
+	}
+	startTime := time.Now()
+	if err := state.pkcs11Signer.Check(); err != nil {
+		logger.Printf("PKCS#11 token check Failed %s", err)
+	} else {
+		lastSuccessPKCS11Time = time.Now()
+		dependencyLatency.WithLabelValues("pkcs11", "signer",
+			state.Config.PKCS11.ModulePath).Observe(
+			time.Now().Sub(startTime).Seconds())
+	}
+	dependencyLastSuccessSecondsGauge.WithLabelValues("pkcs11", "signer").
+		Set(time.Now().Sub(lastSuccessPKCS11Time).Seconds())
+}
@@ -134,7 +134,8 @@ func TestCheckLDAPURLsSuccess(t *testing.T) {
 	if !ok {
 		t.Fatal("cannot add certs to certpool")
 	}
-	err := checkLDAPURLs("ldaps://localhost:10638", "somename", certPool)
+	err := checkLDAPURLs("ldaps://localhost:10638", false, "somename",
+		certPool)
 	if err != nil {
 		t.Logf("Failed to check ldap url")
 		t.Fatal(err)
@@ -147,7 +148,8 @@ func TestCheckLDAPURLsFailNoValidTargets(t *testing.T) {
 	if !ok {
 		t.Fatal("cannot add certs to certpool")
 	}
-	err := checkLDAPURLs("ldap://localhost:10638", "somename", certPool)
+	err := checkLDAPURLs("ldap://localhost:10638", false, "somename",
+		certPool)
 	if err == nil {
 		t.Fatal("Should have failed")
 	}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/auditlog"
+	"github.com/Cloud-Foundations/keymaster/lib/devicekey"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+const (
+	adminAPIDevicesPath        = "/admin/api/v1/devices"
+	adminAPISetDeviceStatePath = "/admin/api/v1/set-device-state"
+
+	deviceStatePending  = "pending"
+	deviceStateApproved = "approved"
+	deviceStateDenied   = "denied"
+
+	defaultDeviceMaxClockSkew = 5 * time.Minute
+	// LastSeen is only saved if it is older than this, so that every
+	// request does not write the profile.
+	deviceLastSeenUpdateInterval = time.Hour
+	// New devices of a user with this many are not registered.
+	maxUserDevices           = 32
+	maxDeviceUserAgentLength = 256
+)
+
+// deviceInfo is a client device registered in the profile of a user.
+type deviceInfo struct {
+	PublicKey   []byte // PKIX encoded.
+	State       string
+	FirstSeen   time.Time
+	LastSeen    time.Time
+	LastAddress string
+	UserAgent   string
+	ReviewedBy  string
+	ReviewedAt  time.Time
+}
+
+type adminDeviceInfo struct {
+	ID          string    `json:"id"`
+	State       string    `json:"state"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+	LastAddress string    `json:"last_address"`
+	UserAgent   string    `json:"user_agent,omitempty"`
+	ReviewedBy  string    `json:"reviewed_by,omitempty"`
+}
+
+type adminDevicesResponse struct {
+	User    string            `json:"user"`
+	Devices []adminDeviceInfo `json:"devices"`
+}
+
+func (state *RuntimeState) getDeviceMaxClockSkew() time.Duration {
+	if skew := state.Config.DeviceTrust.MaxClockSkew; skew > 0 {
+		return skew
+	}
+	return defaultDeviceMaxClockSkew
+}
+
+// checkRequestDevice verifies the device header of r, which must sign
+// binding, and returns the ID and registration of the device. Unknown
+// devices are registered as pending approval. The ID is empty if r has no
+// device header.
+func (state *RuntimeState) checkRequestDevice(r *http.Request,
+	username string, binding []byte) (string, *deviceInfo, error) {
+	header := r.Header.Get(proto.DeviceHeader)
+	if header == "" {
+		return "", nil, nil
+	}
+	now := time.Now()
+	id, publicKey, err := devicekey.Verify(header, binding, now,
+		state.getDeviceMaxClockSkew())
+	if err != nil {
+		return "", nil, err
+	}
+	profile, _, fromCache, err := state.LoadUserProfile(username)
+	if err != nil {
+		return "", nil, err
+	}
+	device := profile.Devices[id]
+	if device != nil && now.Sub(device.LastSeen) < deviceLastSeenUpdateInterval {
+		return id, device, nil
+	}
+	if fromCache {
+		// Cannot register it now, it is unknown until then.
+		return id, device, nil
+	}
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxDeviceUserAgentLength {
+		userAgent = userAgent[:maxDeviceUserAgentLength]
+	}
+	var registered bool
+	err = state.UpdateUserProfile(username,
+		func(profile *userProfile) (bool, error) {
+			device = profile.Devices[id]
+			registered = false
+			if device == nil {
+				if len(profile.Devices) >= maxUserDevices {
+					return false, fmt.Errorf("%s has too many devices", username)
+				}
+				if profile.Devices == nil {
+					profile.Devices = make(map[string]*deviceInfo)
+				}
+				device = &deviceInfo{
+					PublicKey: publicKey,
+					State:     deviceStatePending,
+					FirstSeen: now,
+				}
+				profile.Devices[id] = device
+				registered = true
+			} else if !bytes.Equal(device.PublicKey, publicKey) {
+				return false, errors.New("device ID collision")
+			}
+			device.LastSeen = now
+			device.LastAddress = r.RemoteAddr
+			device.UserAgent = userAgent
+			return true, nil
+		})
+	if err != nil {
+		return "", nil, err
+	}
+	if registered {
+		logger.Printf("registered device %s of %s", id, username)
+		state.logAuditEvent(r, auditlog.Event{
+			Type:     auditlog.EventTypeDevice,
+			Username: username,
+			Success:  true,
+			Details:  map[string]string{"device": id},
+		})
+	}
+	return id, device, nil
+}
+
+// recordLoginDevice registers or updates the device of the login request r
+// of username. Logins are not refused, only certificates.
+func (state *RuntimeState) recordLoginDevice(r *http.Request,
+	username string) {
+	_, _, err := state.checkRequestDevice(r, username, []byte(username))
+	if err != nil {
+		logger.Printf("cannot check device of %s: %s", username, err)
+	}
+}
+
+// checkCertRequestDevice returns true if the cert request r of username,
+// which must have been parsed, came from an approved device. Otherwise the
+// error explains why not.
+func (state *RuntimeState) checkCertRequestDevice(r *http.Request,
+	username string) (bool, error) {
+	// The device signs the public key to certify. GET requests have none.
+	var binding []byte
+	if r.Method == "POST" {
+		if file, _, err := r.FormFile("pubkeyfile"); err == nil {
+			buf := new(bytes.Buffer)
+			_, err := buf.ReadFrom(file)
+			file.Close()
+			if err != nil {
+				return false, err
+			}
+			binding = buf.Bytes()
+		}
+	}
+	id, device, err := state.checkRequestDevice(r, username, binding)
+	if err != nil {
+		return false, fmt.Errorf("cannot check the device: %s", err)
+	}
+	switch {
+	case id == "":
+		return false, errors.New("the client did not identify its device")
+	case device == nil:
+		return false, fmt.Errorf("device %s is not registered", id)
+	case device.State != deviceStateApproved:
+		return false, fmt.Errorf("device %s is %s", id, device.State)
+	}
+	return true, nil
+}
+
+func getAdminDeviceInfos(devices map[string]*deviceInfo) []adminDeviceInfo {
+	infos := make([]adminDeviceInfo, 0, len(devices))
+	for id, device := range devices {
+		infos = append(infos, adminDeviceInfo{
+			ID:          id,
+			State:       device.State,
+			FirstSeen:   device.FirstSeen,
+			LastSeen:    device.LastSeen,
+			LastAddress: device.LastAddress,
+			UserAgent:   device.UserAgent,
+			ReviewedBy:  device.ReviewedBy,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].FirstSeen.Before(infos[j].FirstSeen)
+	})
+	return infos
+}
+
+// adminAPIDevicesHandler lists the devices of the user of the "user" form
+// value.
+func (state *RuntimeState) adminAPIDevicesHandler(w http.ResponseWriter,
+	r *http.Request) {
+	if _, ok := state.checkAdminAPIAuth(w, r, "GET"); !ok {
+		return
+	}
+	username := r.Form.Get("user")
+	if username == "" {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Missing user")
+		return
+	}
+	profile, _, _, err := state.LoadUserProfile(username)
+	if err != nil {
+		logger.Printf("loading profile error: %v", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	writeAdminAPIResponse(w, adminDevicesResponse{
+		User:    username,
+		Devices: getAdminDeviceInfos(profile.Devices),
+	})
+}
+
+// adminAPISetDeviceStateHandler approves, denies or deletes (the "state"
+// form value: approved, denied or deleted) the device of the "device" form
+// value of the user of the "user" form value.
+func (state *RuntimeState) adminAPISetDeviceStateHandler(
+	w http.ResponseWriter, r *http.Request) {
+	authUser, ok := state.checkAdminAPIAuth(w, r, "POST")
+	if !ok {
+		return
+	}
+	username := r.Form.Get("user")
+	id := r.Form.Get("device")
+	newState := r.Form.Get("state")
+	if username == "" || id == "" {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Missing user or device")
+		return
+	}
+	switch newState {
+	case deviceStateApproved, deviceStateDenied, "deleted":
+	default:
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"state must be approved, denied or deleted")
+		return
+	}
+	var devices map[string]*deviceInfo
+	var found bool
+	err := state.UpdateUserProfile(username,
+		func(profile *userProfile) (bool, error) {
+			devices = profile.Devices
+			device := profile.Devices[id]
+			found = device != nil
+			if !found {
+				return false, nil
+			}
+			if newState == "deleted" {
+				delete(profile.Devices, id)
+			} else {
+				device.State = newState
+				device.ReviewedBy = authUser
+				device.ReviewedAt = time.Now()
+			}
+			return true, nil
+		})
+	if err != nil {
+		logger.Printf("saving profile error: %v", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	if !found {
+		state.writeFailureResponse(w, r, http.StatusNotFound,
+			"Unknown device")
+		return
+	}
+	logger.Printf("%s set device %s of %s to %s", authUser, id, username,
+		newState)
+	state.logAuditAdminAction(r, authUser, "set-device-state", true,
+		map[string]string{"user": username, "device": id, "state": newState})
+	writeAdminAPIResponse(w, adminDevicesResponse{
+		User:    username,
+		Devices: getAdminDeviceInfos(devices),
+	})
+}
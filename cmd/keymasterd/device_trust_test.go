@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/devicekey"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+func newTestCertRequest(t *testing.T, key *devicekey.Key,
+	pubKey []byte, signedKey []byte) *http.Request {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("pubkeyfile", "id_ed25519.pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(pubKey)
+	writer.Close()
+	r := httptest.NewRequest("POST", "/certgen/username", body)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	if key != nil {
+		header, err := key.Header(signedKey, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set(proto.DeviceHeader, header)
+	}
+	if err := r.ParseMultipartForm(1e7); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestCheckCertRequestDevice(t *testing.T) {
+	state, passwdFile, err := setupValidRuntimeStateSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(passwdFile.Name())
+	dir, err := ioutil.TempDir("", "devices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	state.Config.Base.DataDirectory = dir
+	if err := initDB(state); err != nil {
+		t.Fatal(err)
+	}
+	key, err := devicekey.LoadOrCreate(filepath.Join(dir, "device_key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey := []byte("ssh-ed25519 AAAA user@host\n")
+	approved, err := state.checkCertRequestDevice(
+		newTestCertRequest(t, nil, pubKey, nil), "username")
+	if approved || err == nil {
+		t.Fatal("request without a device approved")
+	}
+	approved, err = state.checkCertRequestDevice(
+		newTestCertRequest(t, key, pubKey, []byte("other")), "username")
+	if approved || err == nil {
+		t.Fatal("device signature of another key accepted")
+	}
+	approved, err = state.checkCertRequestDevice(
+		newTestCertRequest(t, key, pubKey, pubKey), "username")
+	if approved || err == nil {
+		t.Fatal("pending device approved")
+	}
+	profile, _, _, err := state.LoadUserProfile("username")
+	if err != nil {
+		t.Fatal(err)
+	}
+	device := profile.Devices[key.ID()]
+	if device == nil || device.State != deviceStatePending {
+		t.Fatalf("device not registered as pending: %+v", profile.Devices)
+	}
+	err = state.UpdateUserProfile("username",
+		func(profile *userProfile) (bool, error) {
+			profile.Devices[key.ID()].State = deviceStateApproved
+			return true, nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	approved, err = state.checkCertRequestDevice(
+		newTestCertRequest(t, key, pubKey, pubKey), "username")
+	if !approved {
+		t.Fatalf("approved device refused: %s", err)
+	}
+	approved, _ = state.checkCertRequestDevice(
+		newTestCertRequest(t, key, pubKey, pubKey), "otheruser")
+	if approved {
+		t.Fatal("device approved for another user")
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/Cloud-Foundations/keymaster/lib/instrumentedwriter"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+// notEnoughFactorsError is returned by checkEnabledFactors when a user is
+// denied certificates by the min_enabled_second_factors policy.
+type notEnoughFactorsError struct {
+	enabled  int
+	required int
+}
+
+func (e notEnoughFactorsError) Error() string {
+	return fmt.Sprintf(
+		"at least %d enabled second factor devices are required to get certificates, found %d",
+		e.required, e.enabled)
+}
+
+// listEnrolledFactors returns the U2F, WebAuthn and TOTP devices of profile
+// sorted by type and index.
+func listEnrolledFactors(profile *userProfile) []proto.EnrolledFactor {
+	var factors []proto.EnrolledFactor
+	for index, data := range profile.U2fAuthData {
+		factors = append(factors, proto.EnrolledFactor{
+			Type:      proto.AuthTypeU2F,
+			Index:     index,
+			Name:      data.Name,
+			Enabled:   data.Enabled,
+			CreatedAt: data.CreatedAt,
+		})
+	}
+	for index, data := range profile.WebauthnData {
+		factors = append(factors, proto.EnrolledFactor{
+			Type:      proto.AuthTypeWebAuthn,
+			Index:     index,
+			Name:      data.Name,
+			Enabled:   data.Enabled,
+			CreatedAt: data.CreatedAt,
+		})
+	}
+	for index, data := range profile.TOTPAuthData {
+		factors = append(factors, proto.EnrolledFactor{
+			Type:      proto.AuthTypeTOTP,
+			Index:     index,
+			Name:      data.Name,
+			Enabled:   data.Enabled,
+			CreatedAt: data.CreatedAt,
+		})
+	}
+	sort.Slice(factors, func(i, j int) bool {
+		if factors[i].Type != factors[j].Type {
+			return factors[i].Type < factors[j].Type
+		}
+		return factors[i].Index < factors[j].Index
+	})
+	return factors
+}
+
+func countEnabledFactors(factors []proto.EnrolledFactor) int {
+	var count int
+	for _, factor := range factors {
+		if factor.Enabled {
+			count++
+		}
+	}
+	return count
+}
+
+// checkEnabledFactors returns a notEnoughFactorsError if username has fewer
+// enabled devices than required to get certificates.
+func (state *RuntimeState) checkEnabledFactors(username string) error {
+	required := state.Config.Base.MinEnabledSecondFactors
+	if required < 1 {
+		return nil
+	}
+	isAutomationUser, err := state.isAutomationUser(username)
+	if err != nil {
+		return err
+	}
+	if isAutomationUser {
+		return nil
+	}
+	profile, _, _, err := state.LoadUserProfile(username)
+	if err != nil {
+		return err
+	}
+	enabled := countEnabledFactors(listEnrolledFactors(profile))
+	if enabled < required {
+		return notEnoughFactorsError{enabled: enabled, required: required}
+	}
+	return nil
+}
+
+func (state *RuntimeState) factorsHandler(w http.ResponseWriter,
+	r *http.Request) {
+	if state.sendFailureToClientIfLocked(w, r) {
+		return
+	}
+	if r.Method != "GET" {
+		state.writeFailureResponse(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	authUser, _, err := state.checkAuth(w, r,
+		state.getRequiredWebUIAuthLevel())
+	if err != nil {
+		logger.Debugf(1, "%v", err)
+		return
+	}
+	w.(*instrumentedwriter.LoggingWriter).SetUsername(authUser)
+	username := r.URL.Query().Get("username")
+	if username == "" {
+		username = authUser
+	} else if username != authUser && !state.IsAdminUser(authUser) {
+		state.writeFailureResponse(w, r, http.StatusUnauthorized, "")
+		return
+	}
+	profile, _, _, err := state.LoadUserProfile(username)
+	if err != nil {
+		logger.Printf("loading profile error: %v", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	response := proto.FactorsResponse{
+		Username:          username,
+		Factors:           listEnrolledFactors(profile),
+		MinEnabledFactors: state.Config.Base.MinEnabledSecondFactors,
+	}
+	if response.Factors == nil {
+		response.Factors = []proto.EnrolledFactor{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+func setupFactorsTestState(t *testing.T) (*RuntimeState, *http.Cookie) {
+	var state RuntimeState
+	signer, err := getSignerFromPEMBytes([]byte(testSignerPrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.Signer = signer
+	state.signerPublicKeyToKeymasterKeys()
+	dir, err := ioutil.TempDir("", "factors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	state.Config.Base.DataDirectory = dir
+	state.Config.Base.AllowedAuthBackendsForWebUI = []string{"password"}
+	if err := initDB(&state); err != nil {
+		t.Fatal(err)
+	}
+	profile := &userProfile{
+		U2fAuthData: map[int64]*u2fAuthData{
+			0: {Name: "u2f", Enabled: true},
+		},
+		TOTPAuthData: map[int64]*totpAuthData{
+			0: {Name: "totp", Enabled: false},
+		},
+		WebauthnData: map[int64]*webauthnAuthData{
+			3: {Name: "webauthn", Enabled: true},
+		},
+	}
+	if err := state.SaveUserProfile("username", profile); err != nil {
+		t.Fatal(err)
+	}
+	cookieVal, err := state.setNewAuthCookie(nil, nil, "username", AuthTypeAny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &state, &http.Cookie{Name: authCookieName, Value: cookieVal}
+}
+
+func TestFactorsHandler(t *testing.T) {
+	state, authCookie := setupFactorsTestState(t)
+	state.Config.Base.MinEnabledSecondFactors = 2
+	req, err := http.NewRequest("GET", proto.FactorsPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(authCookie)
+	rr, err := checkRequestHandlerCode(req, state.factorsHandler,
+		http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response proto.FactorsResponse
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Username != "username" || response.MinEnabledFactors != 2 {
+		t.Fatalf("bad response: %+v", response)
+	}
+	expected := []proto.EnrolledFactor{
+		{Type: proto.AuthTypeTOTP, Index: 0, Name: "totp"},
+		{Type: proto.AuthTypeU2F, Index: 0, Name: "u2f", Enabled: true},
+		{Type: proto.AuthTypeWebAuthn, Index: 3, Name: "webauthn",
+			Enabled: true},
+	}
+	if len(response.Factors) != len(expected) {
+		t.Fatalf("expected %d factors, got %+v", len(expected),
+			response.Factors)
+	}
+	for i, factor := range response.Factors {
+		factor.CreatedAt = expected[i].CreatedAt
+		if factor != expected[i] {
+			t.Fatalf("expected %+v, got %+v", expected[i], factor)
+		}
+	}
+	// Only admins may list the factors of others.
+	req, err = http.NewRequest("GET", proto.FactorsPath+"?username=other",
+		nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(authCookie)
+	_, err = checkRequestHandlerCode(req, state.factorsHandler,
+		http.StatusUnauthorized)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckEnabledFactors(t *testing.T) {
+	state, _ := setupFactorsTestState(t)
+	if err := state.checkEnabledFactors("username"); err != nil {
+		t.Fatal(err)
+	}
+	state.Config.Base.MinEnabledSecondFactors = 2
+	if err := state.checkEnabledFactors("username"); err != nil {
+		t.Fatal(err)
+	}
+	state.Config.Base.MinEnabledSecondFactors = 3
+	err := state.checkEnabledFactors("username")
+	if _, ok := err.(notEnoughFactorsError); !ok {
+		t.Fatalf("expected notEnoughFactorsError, got %v", err)
+	}
+	state.Config.Base.AutomationUsers = []string{"username"}
+	if err := state.checkEnabledFactors("username"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebAuthnTokenManagerHandler(t *testing.T) {
+	state, authCookie := setupFactorsTestState(t)
+	for _, action := range []string{"Update", "Disable", "Delete"} {
+		form := url.Values{}
+		form.Add("username", "username")
+		form.Add("index", "3")
+		form.Add("name", "New name")
+		form.Add("action", action)
+		req, err := http.NewRequest("POST", webauthnTokenManagementPath,
+			strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.AddCookie(authCookie)
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		_, err = checkRequestHandlerCode(req,
+			state.webauthnTokenManagerHandler, http.StatusOK)
+		if err != nil {
+			t.Fatal(err)
+		}
+		profile, _, _, err := state.LoadUserProfile("username")
+		if err != nil {
+			t.Fatal(err)
+		}
+		credential := profile.WebauthnData[3]
+		switch action {
+		case "Update":
+			if credential.Name != "New name" {
+				t.Fatal("update not successful")
+			}
+		case "Disable":
+			if credential.Enabled {
+				t.Fatal("disable not successful")
+			}
+		case "Delete":
+			if credential != nil {
+				t.Fatal("delete not successful")
+			}
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/auditlog"
+	"github.com/Cloud-Foundations/keymaster/lib/geoip"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+const (
+	geoActionLog    = "log"
+	geoActionStepUp = "step_up"
+	geoActionBlock  = "block"
+
+	defaultLoginLocationHistory = 20
+)
+
+func checkGeoAction(name, action string) error {
+	switch action {
+	case "", geoActionLog, geoActionStepUp, geoActionBlock:
+		return nil
+	}
+	return fmt.Errorf("%s must be %s, %s or %s", name, geoActionLog,
+		geoActionStepUp, geoActionBlock)
+}
+
+func (state *RuntimeState) setupGeoIP() error {
+	config := state.Config.GeoIP
+	if err := checkGeoAction("new_country_action",
+		config.NewCountryAction); err != nil {
+		return err
+	}
+	if err := checkGeoAction("impossible_travel_action",
+		config.ImpossibleTravelAction); err != nil {
+		return err
+	}
+	locator, err := geoip.Open(config.DatabaseFilename)
+	if err != nil {
+		return err
+	}
+	state.geoLocator = locator
+	return nil
+}
+
+// needsStepUp returns true if a session with authLevel came from a login
+// with an unusual location and did not use a second factor since.
+func needsStepUp(authLevel int) bool {
+	return authLevel&AuthTypeStepUpRequired != 0 &&
+		authLevel&^(AuthTypePassword|AuthTypeStepUpRequired) == 0
+}
+
+// getStepUpAuthFlags returns the session auth flags of a password login
+// which needs a step up if stepUp.
+func getStepUpAuthFlags(stepUp bool) int {
+	if stepUp {
+		return AuthTypeStepUpRequired
+	}
+	return 0
+}
+
+// getGeoAction returns the strictest action configured for anomaly.
+func (state *RuntimeState) getGeoAction(anomaly geoip.Anomaly) string {
+	var actions []string
+	if anomaly.NewCountry {
+		actions = append(actions, state.Config.GeoIP.NewCountryAction)
+	}
+	if anomaly.ImpossibleTravel {
+		actions = append(actions, state.Config.GeoIP.ImpossibleTravelAction)
+	}
+	action := geoActionLog
+	for _, candidate := range actions {
+		switch candidate {
+		case geoActionBlock:
+			return geoActionBlock
+		case geoActionStepUp:
+			action = geoActionStepUp
+		}
+	}
+	return action
+}
+
+// checkLoginLocation locates the password login of username from r and
+// records it in the profile of the user. It returns true if the login may
+// proceed and whether it needs a second factor. If it is refused a denial
+// is written.
+func (state *RuntimeState) checkLoginLocation(w http.ResponseWriter,
+	r *http.Request, username string) (bool, bool) {
+	if state.geoLocator == nil {
+		return false, true
+	}
+	address := getClientAddress(r)
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false, true
+	}
+	location, err := state.geoLocator.Locate(ip)
+	if err != nil {
+		logger.Printf("cannot locate %s: %s", address, err)
+		return false, true
+	}
+	if location == nil {
+		return false, true
+	}
+	login := geoip.Login{Time: time.Now(), Address: address,
+		Location: *location}
+	historyLength := state.Config.GeoIP.HistoryLength
+	if historyLength < 1 {
+		historyLength = defaultLoginLocationHistory
+	}
+	var anomaly geoip.Anomaly
+	action := geoActionLog
+	err = state.UpdateUserProfile(username,
+		func(profile *userProfile) (bool, error) {
+			anomaly = geoip.Check(profile.LoginLocations, login,
+				state.Config.GeoIP.Config)
+			action = state.getGeoAction(anomaly)
+			// Logins which need more than a password are not trusted to
+			// make their location usual.
+			if anomaly.Anomalous() && action != geoActionLog {
+				return false, nil
+			}
+			profile.LoginLocations = append(profile.LoginLocations, login)
+			if excess := len(profile.LoginLocations) - historyLength; excess > 0 {
+				profile.LoginLocations = profile.LoginLocations[excess:]
+			}
+			return true, nil
+		})
+	if err != nil {
+		// Locations are advisory, so storage problems do not stop logins.
+		logger.Printf("cannot record login location of %s: %s", username,
+			err)
+		return false, true
+	}
+	if !anomaly.Anomalous() {
+		return false, true
+	}
+	details := map[string]string{
+		"action":  action,
+		"country": location.Country,
+		"city":    location.City,
+	}
+	if anomaly.NewCountry {
+		details["new_country"] = "true"
+	}
+	if anomaly.ImpossibleTravel {
+		details["previous_address"] = anomaly.Previous.Address
+		details["previous_country"] = anomaly.Previous.Location.Country
+		details["previous_city"] = anomaly.Previous.Location.City
+		details["previous_time"] = anomaly.Previous.Time.Format(time.RFC3339)
+		details["distance_km"] = strconv.FormatFloat(anomaly.Distance, 'f',
+			0, 64)
+		details["speed_kmh"] = strconv.FormatFloat(anomaly.Speed, 'f', 0, 64)
+	}
+	logger.Printf("anomalous login of %s from %s (%s %s): %s", username,
+		address, location.Country, location.City, action)
+	state.logAuditEvent(r, auditlog.Event{
+		Type:     auditlog.EventTypeLoginAnomaly,
+		Username: username,
+		Success:  action != geoActionBlock,
+		Method:   proto.AuthTypePassword,
+		Details:  details,
+	})
+	if action == geoActionBlock {
+		state.writeDenialResponse(w, r, http.StatusForbidden,
+			proto.DenialReasonAnomalousLogin,
+			"login from an unusual location refused")
+		return false, false
+	}
+	return action == geoActionStepUp, true
+}
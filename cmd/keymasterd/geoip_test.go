@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/Cloud-Foundations/keymaster/lib/geoip"
+)
+
+func TestGetGeoAction(t *testing.T) {
+	state := &RuntimeState{}
+	state.Config.GeoIP.NewCountryAction = geoActionStepUp
+	anomaly := geoip.Anomaly{NewCountry: true}
+	if action := state.getGeoAction(anomaly); action != geoActionStepUp {
+		t.Fatalf("new country: %s", action)
+	}
+	anomaly.ImpossibleTravel = true
+	if action := state.getGeoAction(anomaly); action != geoActionStepUp {
+		t.Fatalf("new country with default travel action: %s", action)
+	}
+	state.Config.GeoIP.ImpossibleTravelAction = geoActionBlock
+	if action := state.getGeoAction(anomaly); action != geoActionBlock {
+		t.Fatalf("impossible travel: %s", action)
+	}
+	if action := state.getGeoAction(geoip.Anomaly{}); action != geoActionLog {
+		t.Fatalf("usual login: %s", action)
+	}
+	if err := checkGeoAction("new_country_action", "deny"); err == nil {
+		t.Fatal("invalid action accepted")
+	}
+}
+
+func TestNeedsStepUp(t *testing.T) {
+	if needsStepUp(AuthTypePassword) {
+		t.Fatal("usual password session needs step up")
+	}
+	if !needsStepUp(AuthTypePassword | AuthTypeStepUpRequired) {
+		t.Fatal("password session from an unusual location does not")
+	}
+	if needsStepUp(AuthTypePassword | AuthTypeStepUpRequired | AuthTypeTOTP) {
+		t.Fatal("session with a second factor needs step up")
+	}
+}
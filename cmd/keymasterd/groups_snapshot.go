@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// maxUserGroupsSnapshots is the number of users whose groups are kept for
+// lookupGroupsWithSnapshotFallback.
+const maxUserGroupsSnapshots = 10000
+
+type userGroupsSnapshot struct {
+	Groups    []string
+	FetchedAt time.Time
+}
+
+type groupsLookupResult struct {
+	Configured bool
+	Groups     []string
+	Err        error
+}
+
+var errNoFreshGroupsSnapshot = errors.New(
+	"live group lookup too slow and no fresh snapshot available")
+
+// saveUserGroupsSnapshot saves the groups of username. If there are
+// already maxUserGroupsSnapshots, snapshots older than maxAge are removed
+// first and then the oldest.
+func (state *RuntimeState) saveUserGroupsSnapshot(username string,
+	groups []string, maxAge time.Duration) {
+	state.userGroupsSnapshotMutex.Lock()
+	defer state.userGroupsSnapshotMutex.Unlock()
+	if state.userGroupsSnapshot == nil {
+		state.userGroupsSnapshot = make(map[string]userGroupsSnapshot)
+	}
+	if _, ok := state.userGroupsSnapshot[username]; !ok &&
+		len(state.userGroupsSnapshot) >= maxUserGroupsSnapshots {
+		for name, snapshot := range state.userGroupsSnapshot {
+			if time.Since(snapshot.FetchedAt) > maxAge {
+				delete(state.userGroupsSnapshot, name)
+			}
+		}
+		for len(state.userGroupsSnapshot) >= maxUserGroupsSnapshots {
+			var oldestName string
+			var oldest time.Time
+			for name, snapshot := range state.userGroupsSnapshot {
+				if oldestName == "" || snapshot.FetchedAt.Before(oldest) {
+					oldestName = name
+					oldest = snapshot.FetchedAt
+				}
+			}
+			delete(state.userGroupsSnapshot, oldestName)
+		}
+	}
+	state.userGroupsSnapshot[username] = userGroupsSnapshot{
+		Groups:    groups,
+		FetchedAt: time.Now(),
+	}
+}
+
+// getFreshUserGroupsSnapshot returns the snapshot for username if it is not
+// older than maxAge. Older snapshots are removed.
+func (state *RuntimeState) getFreshUserGroupsSnapshot(username string,
+	maxAge time.Duration) ([]string, bool) {
+	state.userGroupsSnapshotMutex.Lock()
+	defer state.userGroupsSnapshotMutex.Unlock()
+	snapshot, ok := state.userGroupsSnapshot[username]
+	if !ok {
+		return nil, false
+	}
+	if time.Since(snapshot.FetchedAt) > maxAge {
+		delete(state.userGroupsSnapshot, username)
+		return nil, false
+	}
+	return snapshot.Groups, true
+}
+
+// lookupGroupsWithSnapshotFallback runs lookup and, if it does not complete
+// within latencyBudget, authorizes against a snapshot no older than maxAge.
+// If no such snapshot exists it fails closed. The returned fromSnapshot
+// value is true when the groups came from the snapshot. A zero
+// latencyBudget disables the fallback.
+func (state *RuntimeState) lookupGroupsWithSnapshotFallback(username string,
+	latencyBudget time.Duration, maxAge time.Duration,
+	lookup func(string) (bool, []string, error)) (
+	configured bool, groups []string, fromSnapshot bool, err error) {
+	if latencyBudget <= 0 {
+		configured, groups, err = lookup(username)
+		return configured, groups, false, err
+	}
+	ch := make(chan groupsLookupResult, 1)
+	go func(username string) {
+		configured, groups, err := lookup(username)
+		if configured && err == nil {
+			state.saveUserGroupsSnapshot(username, groups, maxAge)
+		}
+		ch <- groupsLookupResult{
+			Configured: configured,
+			Groups:     groups,
+			Err:        err,
+		}
+	}(username)
+	select {
+	case result := <-ch:
+		return result.Configured, result.Groups, false, result.Err
+	case <-time.After(latencyBudget):
+		groups, ok := state.getFreshUserGroupsSnapshot(username, maxAge)
+		if !ok {
+			logger.Printf("group lookup for %s exceeded %s, no snapshot newer than %s",
+				username, latencyBudget, maxAge)
+			return true, nil, false, errNoFreshGroupsSnapshot
+		}
+		logger.Printf("group lookup for %s exceeded %s, using cached snapshot",
+			username, latencyBudget)
+		return true, groups, true, nil
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newSlowGroupsLookup(delay time.Duration, groups []string) func(string) (
+	bool, []string, error) {
+	return func(username string) (bool, []string, error) {
+		time.Sleep(delay)
+		return true, groups, nil
+	}
+}
+
+func TestLookupGroupsWithSnapshotFallbackFreshSnapshot(t *testing.T) {
+	state := RuntimeState{}
+	expectedGroups := []string{"group1", "group2"}
+	// Seed the snapshot with a fast lookup.
+	_, groups, fromSnapshot, err := state.lookupGroupsWithSnapshotFallback(
+		"username", time.Second, time.Minute,
+		newSlowGroupsLookup(0, expectedGroups))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fromSnapshot {
+		t.Fatal("fast lookup should not use snapshot")
+	}
+	if len(groups) != len(expectedGroups) {
+		t.Fatalf("unexpected groups %v", groups)
+	}
+	_, groups, fromSnapshot, err = state.lookupGroupsWithSnapshotFallback(
+		"username", 10*time.Millisecond, time.Minute,
+		newSlowGroupsLookup(time.Second, []string{"other"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fromSnapshot {
+		t.Fatal("slow lookup should have used snapshot")
+	}
+	if len(groups) != len(expectedGroups) || groups[0] != expectedGroups[0] {
+		t.Fatalf("unexpected groups %v", groups)
+	}
+}
+
+func TestLookupGroupsWithSnapshotFallbackStaleSnapshot(t *testing.T) {
+	state := RuntimeState{}
+	state.userGroupsSnapshot = map[string]userGroupsSnapshot{
+		"username": {
+			Groups:    []string{"group1"},
+			FetchedAt: time.Now().Add(-time.Hour),
+		},
+	}
+	_, groups, fromSnapshot, err := state.lookupGroupsWithSnapshotFallback(
+		"username", 10*time.Millisecond, time.Minute,
+		newSlowGroupsLookup(time.Second, []string{"group1"}))
+	if err == nil {
+		t.Fatal("stale snapshot should fail closed")
+	}
+	if fromSnapshot || groups != nil {
+		t.Fatalf("stale snapshot should not be used, groups=%v", groups)
+	}
+	// Missing snapshot should also fail closed.
+	_, _, _, err = state.lookupGroupsWithSnapshotFallback(
+		"otheruser", 10*time.Millisecond, time.Minute,
+		newSlowGroupsLookup(time.Second, []string{"group1"}))
+	if err == nil {
+		t.Fatal("missing snapshot should fail closed")
+	}
+}
+
+func TestSaveUserGroupsSnapshotLimit(t *testing.T) {
+	state := RuntimeState{}
+	state.userGroupsSnapshot = make(map[string]userGroupsSnapshot)
+	now := time.Now()
+	for i := 0; i < maxUserGroupsSnapshots; i++ {
+		state.userGroupsSnapshot[strconv.Itoa(i)] = userGroupsSnapshot{
+			FetchedAt: now.Add(time.Duration(i-maxUserGroupsSnapshots) *
+				time.Millisecond),
+		}
+	}
+	state.userGroupsSnapshot["stale"] = userGroupsSnapshot{
+		FetchedAt: now.Add(-time.Hour),
+	}
+	delete(state.userGroupsSnapshot, "1")
+	// The stale snapshot makes room.
+	state.saveUserGroupsSnapshot("username", []string{"group1"}, time.Minute)
+	if _, ok := state.userGroupsSnapshot["stale"]; ok {
+		t.Fatal("stale snapshot not removed")
+	}
+	if len(state.userGroupsSnapshot) != maxUserGroupsSnapshots {
+		t.Fatalf("%d snapshots kept", len(state.userGroupsSnapshot))
+	}
+	// Otherwise the oldest one does.
+	state.saveUserGroupsSnapshot("otheruser", []string{"group1"}, time.Minute)
+	if _, ok := state.userGroupsSnapshot["0"]; ok {
+		t.Fatal("oldest snapshot not removed")
+	}
+	if len(state.userGroupsSnapshot) != maxUserGroupsSnapshots {
+		t.Fatalf("%d snapshots kept", len(state.userGroupsSnapshot))
+	}
+	if _, ok := state.getFreshUserGroupsSnapshot("username",
+		time.Minute); !ok {
+		t.Fatal("new snapshot not saved")
+	}
+}
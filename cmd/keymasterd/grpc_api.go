@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/pb"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	grpcSessionMetadataKey      = "keymaster-session"
+	grpcDenialReasonMetadataKey = "keymaster-denial-reason"
+	grpcPushPollInterval        = 2 * time.Second
+	maxGRPCErrorBodySize        = 4096
+)
+
+// grpcForwardedHeaders are the HTTP headers taken from the metadata of the
+// same name.
+var grpcForwardedHeaders = []string{
+	proto.DeviceHeader,
+	proto.PIVAttestationHeader,
+	proto.TPMAttestationHeader,
+}
+
+// grpcOTPPaths are the web API paths checking the one time passwords of the
+// auth types VerifyOTP accepts.
+var grpcOTPPaths = map[string]string{
+	proto.AuthTypeTOTP:         proto.TOTPAuthPath,
+	proto.AuthTypeSymantecVIP:  vipAuthPath,
+	proto.AuthTypeRADIUS:       proto.RADIUSAuthPath,
+	proto.AuthTypeDuo:          proto.DuoAuthPath,
+	proto.AuthTypeRecoveryCode: proto.RecoveryCodeAuthPath,
+}
+
+// grpcAPIServer implements the gRPC API by passing each call to the handler
+// of the matching web API request, so that both APIs make the same checks.
+type grpcAPIServer struct {
+	pb.UnimplementedAuthServer
+	pb.UnimplementedIssuanceServer
+	handler http.Handler
+}
+
+// newGRPCServer returns a gRPC server of the API, calling handler for the
+// web API requests.
+func newGRPCServer(handler http.Handler, tlsConfig *tls.Config) *grpc.Server {
+	server := grpc.NewServer(grpc.Creds(credentials.NewTLS(tlsConfig)))
+	apiServer := &grpcAPIServer{handler: handler}
+	pb.RegisterAuthServer(server, apiServer)
+	pb.RegisterIssuanceServer(server, apiServer)
+	return server
+}
+
+// serveGRPC serves the gRPC API at the configured address with the service
+// certificate and a copy of tlsConfig.
+func (state *RuntimeState) serveGRPC(handler http.Handler,
+	tlsConfig *tls.Config) error {
+	cert, err := tls.LoadX509KeyPair(state.Config.Base.TLSCertFilename,
+		state.Config.Base.TLSKeyFilename)
+	if err != nil {
+		return err
+	}
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.Certificates = []tls.Certificate{cert}
+	tlsConfig.NextProtos = []string{"h2"}
+	listener, err := net.Listen("tcp", state.Config.Base.GRPCAddress)
+	if err != nil {
+		return err
+	}
+	logger.Printf("Serving the gRPC API at %s", state.Config.Base.GRPCAddress)
+	return newGRPCServer(handler, tlsConfig).Serve(listener)
+}
+
+// getGRPCCode returns the gRPC status code matching an HTTP status code.
+func getGRPCCode(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusMethodNotAllowed:
+		return codes.Unimplemented
+	case http.StatusPreconditionFailed:
+		return codes.FailedPrecondition
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	}
+	return codes.Internal
+}
+
+// getGRPCError returns the error of a failed web API response, and the
+// trailer holding its denial reason code if it has one.
+func getGRPCError(response *http.Response) (metadata.MD, error) {
+	body, _ := ioutil.ReadAll(io.LimitReader(response.Body,
+		maxGRPCErrorBodySize))
+	message := strings.TrimSpace(string(body))
+	var trailer metadata.MD
+	var denial proto.DenialResponse
+	if err := json.Unmarshal(body, &denial); err == nil &&
+		denial.ReasonCode != "" {
+		message = denial.Message
+		trailer = metadata.Pairs(grpcDenialReasonMetadataKey,
+			denial.ReasonCode)
+	}
+	return trailer, status.Error(getGRPCCode(response.StatusCode), message)
+}
+
+// getUnaryGRPCError is getGRPCError for unary calls.
+func getUnaryGRPCError(ctx context.Context, response *http.Response) error {
+	trailer, err := getGRPCError(response)
+	if trailer != nil {
+		grpc.SetTrailer(ctx, trailer)
+	}
+	return err
+}
+
+// getSessionToken returns the session token of the call.
+func getSessionToken(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get(grpcSessionMetadataKey); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// getResponseSessionToken returns the session token set by response, or
+// sessionToken if it sets none.
+func getResponseSessionToken(response *http.Response,
+	sessionToken string) string {
+	for _, cookie := range response.Cookies() {
+		if cookie.Name == authCookieName {
+			return cookie.Value
+		}
+	}
+	return sessionToken
+}
+
+// newWebAPIRequest returns a web API request for a call, with the client
+// address, TLS connection state, session and forwarded headers of ctx.
+func newWebAPIRequest(ctx context.Context, path string, contentType string,
+	body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", contentType)
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get(":authority"); len(values) > 0 {
+		req.Host = values[0]
+	}
+	if values := md.Get("user-agent"); len(values) > 0 {
+		req.Header.Set("User-Agent", values[0])
+	}
+	for _, header := range grpcForwardedHeaders {
+		for _, value := range md.Get(header) {
+			req.Header.Add(header, value)
+		}
+	}
+	if sessionToken := getSessionToken(ctx); sessionToken != "" {
+		req.AddCookie(&http.Cookie{Name: authCookieName, Value: sessionToken})
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		req.RemoteAddr = p.Addr.String()
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			req.TLS = &tlsInfo.State
+		}
+	}
+	return req, nil
+}
+
+// do makes a web API request posting form and returns the response.
+func (s *grpcAPIServer) do(ctx context.Context, path string,
+	form url.Values) (*http.Response, error) {
+	req, err := newWebAPIRequest(ctx, path,
+		"application/x-www-form-urlencoded",
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	return s.serve(req), nil
+}
+
+// grpcResponseWriter is the http.ResponseWriter of the web API requests of
+// calls, which keeps the response to convert to the result of the call.
+type grpcResponseWriter struct {
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (w *grpcResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *grpcResponseWriter) Write(data []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.body.Write(data)
+}
+
+func (w *grpcResponseWriter) WriteHeader(statusCode int) {
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
+	}
+}
+
+// serve passes req to the web API handler and returns its response.
+func (s *grpcAPIServer) serve(req *http.Request) *http.Response {
+	writer := &grpcResponseWriter{header: make(http.Header)}
+	s.handler.ServeHTTP(writer, req)
+	if writer.statusCode == 0 {
+		writer.statusCode = http.StatusOK
+	}
+	return &http.Response{
+		StatusCode: writer.statusCode,
+		Header:     writer.header,
+		Body:       ioutil.NopCloser(&writer.body),
+		Request:    req,
+	}
+}
+
+func (s *grpcAPIServer) Login(ctx context.Context,
+	request *pb.LoginRequest) (*pb.LoginResponse, error) {
+	response, err := s.do(ctx, proto.LoginPath, url.Values{
+		"username": {request.Username},
+		"password": {request.Password},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, getUnaryGRPCError(ctx, response)
+	}
+	var loginResponse proto.LoginResponse
+	if err := json.NewDecoder(response.Body).Decode(&loginResponse); err != nil {
+		return nil, status.Errorf(codes.Internal, "bad login response: %s",
+			err)
+	}
+	return &pb.LoginResponse{
+		SessionToken:      getResponseSessionToken(response, ""),
+		AuthBackends:      loginResponse.CertAuthBackend,
+		SupportedKeyTypes: loginResponse.SupportedKeyTypes,
+		PasswordExpiresIn: loginResponse.PasswordExpiresIn,
+	}, nil
+}
+
+func (s *grpcAPIServer) VerifyOTP(ctx context.Context,
+	request *pb.VerifyOTPRequest) (*pb.VerifyOTPResponse, error) {
+	path, ok := grpcOTPPaths[request.AuthType]
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"unsupported auth type: %q", request.AuthType)
+	}
+	form := url.Values{"OTP": {request.Otp}}
+	if request.State != "" {
+		form.Set("state", request.State)
+	}
+	response, err := s.do(ctx, path, form)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, getUnaryGRPCError(ctx, response)
+	}
+	if request.AuthType == proto.AuthTypeRADIUS {
+		var challenge proto.RADIUSChallenge
+		err := json.NewDecoder(response.Body).Decode(&challenge)
+		if err == nil && challenge.State != "" {
+			return &pb.VerifyOTPResponse{
+				ChallengeMessage: challenge.Message,
+				State:            challenge.State,
+			}, nil
+		}
+	}
+	return &pb.VerifyOTPResponse{
+		SessionToken: getResponseSessionToken(response, getSessionToken(ctx)),
+	}, nil
+}
+
+// Push makes the web API push request of the auth type again every
+// grpcPushPollInterval, as a browser or the command line client would, and
+// sends the status to the stream whenever it changes.
+func (s *grpcAPIServer) Push(request *pb.PushRequest,
+	stream pb.Auth_PushServer) error {
+	ctx := stream.Context()
+	var form url.Values
+	var path string
+	switch request.AuthType {
+	case proto.AuthTypeDuo:
+		path = proto.DuoPushPath
+	case proto.AuthTypeWebhook:
+		path = proto.WebhookAuthPath
+	default:
+		return status.Errorf(codes.InvalidArgument,
+			"unsupported auth type: %q", request.AuthType)
+	}
+	var lastStatus *pb.PushStatus
+	for {
+		response, err := s.do(ctx, path, form)
+		if err != nil {
+			return err
+		}
+		pushStatus := &pb.PushStatus{State: pb.PushStatus_PENDING}
+		switch response.StatusCode {
+		case http.StatusOK:
+			if request.AuthType == proto.AuthTypeWebhook {
+				var challenge proto.WebhookChallenge
+				err := json.NewDecoder(response.Body).Decode(&challenge)
+				if err != nil {
+					return status.Errorf(codes.Internal,
+						"bad webhook response: %s", err)
+				}
+				if challenge.State != "" && !challenge.Pending {
+					return status.Error(codes.FailedPrecondition,
+						"the webhook asks for a response: "+challenge.Message)
+				}
+				if challenge.State != "" {
+					form = url.Values{"state": {challenge.State}}
+					pushStatus.Message = challenge.Message
+					break
+				}
+			}
+			pushStatus.State = pb.PushStatus_APPROVED
+			pushStatus.SessionToken = getResponseSessionToken(response,
+				getSessionToken(ctx))
+		case http.StatusPreconditionFailed:
+			if request.AuthType != proto.AuthTypeDuo {
+				trailer, err := getGRPCError(response)
+				stream.SetTrailer(trailer)
+				return err
+			}
+		case http.StatusUnauthorized:
+			if lastStatus == nil {
+				trailer, err := getGRPCError(response)
+				stream.SetTrailer(trailer)
+				return err
+			}
+			pushStatus.State = pb.PushStatus_DENIED
+		default:
+			trailer, err := getGRPCError(response)
+			stream.SetTrailer(trailer)
+			return err
+		}
+		if lastStatus == nil || pushStatus.State != lastStatus.State ||
+			pushStatus.Message != lastStatus.Message {
+			if err := stream.Send(pushStatus); err != nil {
+				return err
+			}
+			lastStatus = pushStatus
+		}
+		if pushStatus.State != pb.PushStatus_PENDING {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-time.After(grpcPushPollInterval):
+		}
+	}
+}
+
+func (s *grpcAPIServer) GetCertificate(ctx context.Context,
+	request *pb.CertificateRequest) (*pb.CertificateResponse, error) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	fileWriter, err := writer.CreateFormFile("pubkeyfile", "key.pub")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(fileWriter, request.PublicKey); err != nil {
+		return nil, err
+	}
+	fields := [][2]string{{"type", request.Type}}
+	if request.Duration != "" {
+		fields = append(fields, [2]string{"duration", request.Duration})
+	}
+	if request.Profile != "" {
+		fields = append(fields, [2]string{"profile", request.Profile})
+	}
+	if len(request.SshPrincipals) > 0 {
+		fields = append(fields, [2]string{"principals",
+			strings.Join(request.SshPrincipals, ",")})
+	}
+	for _, san := range request.X509Sans {
+		fields = append(fields, [2]string{"san", san})
+	}
+	if request.AddGroups {
+		fields = append(fields, [2]string{"addGroups", "true"})
+	}
+	for _, field := range fields {
+		if err := writer.WriteField(field[0], field[1]); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	req, err := newWebAPIRequest(ctx,
+		certgenPath+url.PathEscape(request.Username),
+		writer.FormDataContentType(), body)
+	if err != nil {
+		return nil, err
+	}
+	response := s.serve(req)
+	if response.StatusCode != http.StatusOK {
+		return nil, getUnaryGRPCError(ctx, response)
+	}
+	certificate, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.CertificateResponse{Certificate: certificate}, nil
+}
+
+func (s *grpcAPIServer) GetBearerToken(ctx context.Context,
+	request *pb.BearerTokenRequest) (*pb.BearerTokenResponse, error) {
+	form := make(url.Values)
+	if request.Audience != "" {
+		form.Set("audience", request.Audience)
+	}
+	if request.Duration != "" {
+		form.Set("duration", request.Duration)
+	}
+	response, err := s.do(ctx, proto.BearerTokenPath, form)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, getUnaryGRPCError(ctx, response)
+	}
+	var tokenResponse proto.BearerTokenResponse
+	err = json.NewDecoder(response.Body).Decode(&tokenResponse)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"bad bearer token response: %s", err)
+	}
+	return &pb.BearerTokenResponse{
+		AccessToken: tokenResponse.AccessToken,
+		ExpiresIn:   int64(tokenResponse.ExpiresIn),
+	}, nil
+}
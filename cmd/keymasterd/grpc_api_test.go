@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/pb"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestGetGRPCError(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	recorder.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(recorder).Encode(proto.DenialResponse{
+		ReasonCode: proto.DenialReasonPolicy,
+		Message:    "profile not allowed",
+	})
+	trailer, err := getGRPCError(recorder.Result())
+	if s := status.Convert(err); s.Code() != codes.PermissionDenied ||
+		s.Message() != "profile not allowed" {
+		t.Fatalf("unexpected status: %v", s)
+	}
+	if values := trailer.Get(grpcDenialReasonMetadataKey); len(values) != 1 ||
+		values[0] != proto.DenialReasonPolicy {
+		t.Fatalf("unexpected trailer: %v", trailer)
+	}
+	recorder = httptest.NewRecorder()
+	http.Error(recorder, "Bad Request", http.StatusBadRequest)
+	trailer, err = getGRPCError(recorder.Result())
+	if s := status.Convert(err); s.Code() != codes.InvalidArgument ||
+		s.Message() != "Bad Request" || trailer != nil {
+		t.Fatalf("unexpected status: %v %v", s, trailer)
+	}
+}
+
+func TestGRPCBearerToken(t *testing.T) {
+	server := &grpcAPIServer{handler: http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != proto.BearerTokenPath ||
+				r.Header.Get(proto.DeviceHeader) != "signature" ||
+				r.FormValue("audience") != "https://api.example.com" {
+				http.Error(w, "Bad Request", http.StatusBadRequest)
+				return
+			}
+			if cookie, err := r.Cookie(authCookieName); err != nil ||
+				cookie.Value != "session" {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			json.NewEncoder(w).Encode(proto.BearerTokenResponse{
+				AccessToken: "token",
+				TokenType:   "Bearer",
+				ExpiresIn:   900,
+			})
+		})}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		grpcSessionMetadataKey, "session",
+		proto.DeviceHeader, "signature"))
+	response, err := server.GetBearerToken(ctx,
+		&pb.BearerTokenRequest{Audience: "https://api.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.AccessToken != "token" || response.ExpiresIn != 900 {
+		t.Fatalf("unexpected response: %v", response)
+	}
+	_, err = server.GetBearerToken(context.Background(),
+		&pb.BearerTokenRequest{Audience: "https://api.example.com"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/Cloud-Foundations/keymaster/lib/certpolicy"
+	"github.com/Cloud-Foundations/keymaster/lib/pivattest"
+	"github.com/Cloud-Foundations/keymaster/lib/tpmattest"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+	"golang.org/x/crypto/ssh"
+)
+
+func loadCertPool(filename string, description string) (
+	*x509.CertPool, error) {
+	if filename == "" {
+		return nil, nil
+	}
+	buffer, err := exitsAndCanRead(filename, description)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(buffer) {
+		return nil, fmt.Errorf("cannot append any certs from %s", description)
+	}
+	return pool, nil
+}
+
+// loadHardwareKeyConfig loads the attestation CAs of the hardware keys.
+func (state *RuntimeState) loadHardwareKeyConfig() error {
+	config := state.Config.HardwareKeys
+	var err error
+	state.pivAttestationRoots, err = loadCertPool(
+		config.AttestationCAFilename, "attestation CA file")
+	if err != nil {
+		return err
+	}
+	state.tpmAttestationRoots, err = loadCertPool(
+		config.TPMAttestationCAFilename, "TPM attestation CA file")
+	if err != nil {
+		return err
+	}
+	state.webAuthnRoots, err = loadCertPool(
+		config.WebAuthnAttestationCAFilename, "WebAuthn attestation CA file")
+	if err != nil {
+		return err
+	}
+	if (len(config.RequireForGroups) > 0 ||
+		len(config.RequireForPrincipals) > 0) &&
+		state.pivAttestationRoots == nil && state.tpmAttestationRoots == nil {
+		return errors.New(
+			"require_for_groups and require_for_principals need attestation_ca_filename or tpm_attestation_ca_filename")
+	}
+	return nil
+}
+
+// parseRequestPublicKey parses the public key of a certificate request,
+// which is PEM encoded for X.509 certificates and in the authorized_keys
+// format for SSH certificates.
+func parseRequestPublicKey(data []byte) (crypto.PublicKey, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	sshKey, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, err
+	}
+	cryptoKey, ok := sshKey.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %s", sshKey.Type())
+	}
+	return cryptoKey.CryptoPublicKey(), nil
+}
+
+// getAttestedKey returns the key attested by the PIV or TPM attestation of
+// the cert request r, and a description of the hardware key.
+func (state *RuntimeState) getAttestedKey(r *http.Request) (
+	crypto.PublicKey, string, error) {
+	if header := r.Header.Get(proto.PIVAttestationHeader); header != "" {
+		if state.pivAttestationRoots == nil {
+			return nil, "", errors.New("PIV keys are not configured")
+		}
+		attestation, err := pivattest.Verify(header, state.pivAttestationRoots)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid PIV key attestation: %s", err)
+		}
+		return attestation.PublicKey, fmt.Sprintf(
+			"YubiKey %d (firmware %s) slot %s", attestation.Serial,
+			attestation.Version, attestation.Slot), nil
+	}
+	if header := r.Header.Get(proto.TPMAttestationHeader); header != "" {
+		if state.tpmAttestationRoots == nil {
+			return nil, "", errors.New("TPM keys are not configured")
+		}
+		attestation, err := tpmattest.Verify(header, state.tpmAttestationRoots)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid TPM key attestation: %s", err)
+		}
+		return attestation.PublicKey, "TPM of " +
+			attestation.AKCertificate.Subject.CommonName, nil
+	}
+	return nil, "", errors.New("the client did not attest its key")
+}
+
+// checkCertRequestHardwareKey returns true if the key of the cert request
+// r, which must have been parsed, was attested to be generated in a
+// hardware key. Otherwise the error explains why not.
+func (state *RuntimeState) checkCertRequestHardwareKey(
+	r *http.Request) (bool, error) {
+	attestedKey, description, err := state.getAttestedKey(r)
+	if err != nil {
+		return false, err
+	}
+	publicKeyData := getRequestPublicKey(r)
+	if publicKeyData == nil {
+		return false, errors.New("no public key to certify")
+	}
+	publicKey, err := parseRequestPublicKey(publicKeyData)
+	if err != nil {
+		return false, fmt.Errorf("cannot parse public key: %s", err)
+	}
+	requestedDER, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return false, err
+	}
+	attestedDER, err := x509.MarshalPKIXPublicKey(attestedKey)
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(requestedDER, attestedDER) {
+		return false, errors.New("the attested key is not the key to certify")
+	}
+	logger.Debugf(1, "key attested by %s", description)
+	return true, nil
+}
+
+// getHardwareKeyPrincipal returns the first of the SSH principals (for SSH
+// certificates) or X.509 SANs of decision which may only be issued for
+// hardware keys, or "" if there is none.
+func (state *RuntimeState) getHardwareKeyPrincipal(certType string,
+	decision *certpolicy.Decision) string {
+	principals := decision.X509SANs
+	if certType == "ssh" {
+		principals = decision.SSHPrincipals
+	}
+	for _, principal := range principals {
+		for _, sensitive := range state.Config.HardwareKeys.RequireForPrincipals {
+			if principal == sensitive {
+				return principal
+			}
+		}
+	}
+	return ""
+}
+
+// requiresHardwareKey returns true if username is in one of the groups
+// which may only get certificates for hardware keys.
+func (state *RuntimeState) requiresHardwareKey(username string) (bool, error) {
+	requiredGroups := state.Config.HardwareKeys.RequireForGroups
+	if len(requiredGroups) < 1 {
+		return false, nil
+	}
+	groups, err := state.getUserGroups(username)
+	if err != nil {
+		return false, err
+	}
+	for _, group := range groups {
+		for _, requiredGroup := range requiredGroups {
+			if group == requiredGroup {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// verifyWebAuthnAttestation checks that the attestation statement of a
+// WebAuthn registration, whose signature the webauthn library verified, is
+// by an authenticator certified by one of roots. Self attestations and
+// registrations without attestation have no certificates and are refused.
+func verifyWebAuthnAttestation(statement map[string]interface{},
+	roots *x509.CertPool) error {
+	x5c, ok := statement["x5c"].([]interface{})
+	if !ok || len(x5c) < 1 {
+		return errors.New("the authenticator has no attestation certificate")
+	}
+	var certs []*x509.Certificate
+	for _, value := range x5c {
+		der, ok := value.([]byte)
+		if !ok {
+			return errors.New("malformed attestation certificate")
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fmt.Errorf("cannot parse attestation certificate: %s", err)
+		}
+		certs = append(certs, cert)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return fmt.Errorf("attestation certificate: %s", err)
+	}
+	return nil
+}
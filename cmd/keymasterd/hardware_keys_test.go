@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/certpolicy"
+	"github.com/Cloud-Foundations/keymaster/lib/pivattest"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+	"golang.org/x/crypto/ssh"
+)
+
+func createTestCert(t *testing.T, subject string, isCA bool,
+	parent *x509.Certificate, publicKey crypto.PublicKey,
+	signer crypto.Signer) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: subject},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: isCA,
+	}
+	if parent == nil {
+		parent = template
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent,
+		publicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func newTestHardwareKeyRequest(t *testing.T, pubKey []byte,
+	attestation string) *http.Request {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("pubkeyfile", "keymaster.pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(pubKey)
+	writer.Close()
+	r := httptest.NewRequest("POST", "/certgen/username", body)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	if attestation != "" {
+		r.Header.Set(proto.PIVAttestationHeader, attestation)
+	}
+	if err := r.ParseMultipartForm(1e7); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestCheckCertRequestHardwareKey(t *testing.T) {
+	var keys []*ecdsa.PrivateKey
+	for i := 0; i < 3; i++ {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	rootKey, attestationKey, slotKey := keys[0], keys[1], keys[2]
+	root := createTestCert(t, "Test PIV Root CA", true, nil,
+		rootKey.Public(), rootKey)
+	attestationCert := createTestCert(t, "Yubico PIV Attestation", false,
+		root, attestationKey.Public(), rootKey)
+	slotCert := createTestCert(t, "YubiKey PIV Attestation 9a", false,
+		attestationCert, slotKey.Public(), attestationKey)
+	attestation := pivattest.Header(slotCert.Raw, attestationCert.Raw)
+	pkixKey, err := x509.MarshalPKIXPublicKey(slotKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY",
+		Bytes: pkixKey})
+	sshKey, err := ssh.NewPublicKey(slotKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ssh.NewPublicKey(attestationKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := &RuntimeState{}
+	if ok, _ := state.checkCertRequestHardwareKey(
+		newTestHardwareKeyRequest(t, pemKey, attestation)); ok {
+		t.Fatal("attested without attestation roots")
+	}
+	state.pivAttestationRoots = x509.NewCertPool()
+	state.pivAttestationRoots.AddCert(root)
+	for _, test := range []struct {
+		name        string
+		pubKey      []byte
+		attestation string
+		attested    bool
+	}{
+		{"x509", pemKey, attestation, true},
+		{"ssh", ssh.MarshalAuthorizedKey(sshKey), attestation, true},
+		{"no attestation", pemKey, "", false},
+		{"other key", ssh.MarshalAuthorizedKey(otherKey), attestation, false},
+		{"invalid", pemKey, pivattest.Header(slotCert.Raw, root.Raw), false},
+	} {
+		ok, err := state.checkCertRequestHardwareKey(
+			newTestHardwareKeyRequest(t, test.pubKey, test.attestation))
+		if ok != test.attested {
+			t.Errorf("%s: attested=%v, expected %v (%v)", test.name, ok,
+				test.attested, err)
+		}
+		if !ok && err == nil {
+			t.Errorf("%s: no reason", test.name)
+		}
+	}
+}
+
+func TestGetHardwareKeyPrincipal(t *testing.T) {
+	state := &RuntimeState{}
+	state.Config.HardwareKeys.RequireForPrincipals = []string{"root",
+		"db.example.com"}
+	decision := &certpolicy.Decision{
+		SSHPrincipals: []string{"alice", "root"},
+		X509SANs:      []string{"alice@example.com"},
+	}
+	if principal := state.getHardwareKeyPrincipal("ssh",
+		decision); principal != "root" {
+		t.Fatalf("unexpected principal %q", principal)
+	}
+	if principal := state.getHardwareKeyPrincipal("x509",
+		decision); principal != "" {
+		t.Fatalf("unexpected principal %q", principal)
+	}
+	decision.X509SANs = append(decision.X509SANs, "db.example.com")
+	if principal := state.getHardwareKeyPrincipal("x509",
+		decision); principal != "db.example.com" {
+		t.Fatalf("unexpected principal %q", principal)
+	}
+}
+
+func TestVerifyWebAuthnAttestation(t *testing.T) {
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticatorKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := createTestCert(t, "Test Authenticator CA", true, nil,
+		rootKey.Public(), rootKey)
+	authenticatorCert := createTestCert(t, "Test Authenticator", false, root,
+		authenticatorKey.Public(), rootKey)
+	selfSigned := createTestCert(t, "Software Authenticator", false, nil,
+		authenticatorKey.Public(), authenticatorKey)
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	err = verifyWebAuthnAttestation(map[string]interface{}{
+		"alg": -7,
+		"x5c": []interface{}{authenticatorCert.Raw},
+	}, roots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, statement := range map[string]map[string]interface{}{
+		"none":        {},
+		"self":        {"alg": -7, "sig": []byte("signature")},
+		"other CA":    {"x5c": []interface{}{selfSigned.Raw}},
+		"malformed":   {"x5c": []interface{}{"junk"}},
+		"unparseable": {"x5c": []interface{}{[]byte("junk")}},
+	} {
+		if err := verifyWebAuthnAttestation(statement, roots); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestLoadHardwareKeyConfig(t *testing.T) {
+	state := &RuntimeState{}
+	if err := state.loadHardwareKeyConfig(); err != nil {
+		t.Fatal(err)
+	}
+	state.Config.HardwareKeys.RequireForGroups = []string{"finance"}
+	if err := state.loadHardwareKeyConfig(); err == nil {
+		t.Fatal("require_for_groups accepted without attestation CAs")
+	}
+	state.Config.HardwareKeys = HardwareKeyConfig{
+		RequireForPrincipals: []string{"root"},
+	}
+	if err := state.loadHardwareKeyConfig(); err == nil {
+		t.Fatal("require_for_principals accepted without attestation CAs")
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/Cloud-Foundations/keymaster/lib/healthcheck"
+)
+
+// The health endpoints are served on the service port for load balancers.
+// /healthz reports that keymasterd is serving; /readyz fails while the
+// signer is sealed or a configured dependency is down, so that the
+// instance is drained.
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+)
+
+// Probe errors are only logged, since the endpoints are public.
+type healthCheckStatus struct {
+	Name string `json:"name"`
+	OK   bool   `json:"ok"`
+}
+
+type healthResponse struct {
+	Status string              `json:"status"`
+	Sealed bool                `json:"sealed,omitempty"`
+	Checks []healthCheckStatus `json:"checks,omitempty"`
+}
+
+// checkHTTPHealth returns nil if a GET of url succeeds.
+func checkHTTPHealth(client *http.Client, url string) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+}
+
+// newHealthChecker returns the checker of the configured dependencies: the
+// password and user info LDAP servers, Okta, the PKCS#11 token and storage.
+func (state *RuntimeState) newHealthChecker() *healthcheck.Checker {
+	config := state.Config
+	healthConfig := healthcheck.Config{
+		Timeout:  config.HealthCheck.Timeout,
+		CacheTTL: config.HealthCheck.CacheTTL,
+	}
+	var probes []healthcheck.Probe
+	if ldapConfig := config.Ldap; ldapConfig.LDAPTargetURLs != "" {
+		probes = append(probes, healthcheck.Probe{
+			Name: "ldap-password",
+			Check: func() error {
+				return checkLDAPURLs(ldapConfig.LDAPTargetURLs,
+					ldapConfig.AllowStartTLS, "passwd", nil)
+			},
+		})
+	}
+	if ldapConfig := config.UserInfo.Ldap; ldapConfig.LDAPTargetURLs != "" {
+		probes = append(probes, healthcheck.Probe{
+			Name: "ldap-userinfo",
+			Check: func() error {
+				return checkLDAPURLs(ldapConfig.LDAPTargetURLs,
+					ldapConfig.AllowStartTLS, "userinfo", nil)
+			},
+		})
+	}
+	if domain := config.Okta.Domain; domain != "" {
+		timeout := healthConfig.Timeout
+		if timeout <= 0 {
+			timeout = healthcheck.DefaultTimeout
+		}
+		client := &http.Client{Timeout: timeout}
+		url := "https://" + domain + "/.well-known/openid-configuration"
+		probes = append(probes, healthcheck.Probe{
+			Name:  "okta",
+			Check: func() error { return checkHTTPHealth(client, url) },
+		})
+	}
+	if state.pkcs11Signer != nil {
+		probes = append(probes, healthcheck.Probe{
+			Name:  "pkcs11",
+			Check: state.pkcs11Signer.Check,
+		})
+	}
+	probes = append(probes, healthcheck.Probe{
+		Name:  "storage",
+		Check: state.checkStorageHealth,
+	})
+	return healthcheck.New(healthConfig, probes)
+}
+
+// checkStorageHealth returns nil if the storage database answers.
+func (state *RuntimeState) checkStorageHealth() error {
+	if state.dynamoStore != nil {
+		_, _, err := state.dynamoStore.GetSigned("keymaster-health-check", 0)
+		return err
+	}
+	if state.db == nil {
+		return errors.New("storage is not initialized")
+	}
+	timeout := state.Config.HealthCheck.Timeout
+	if timeout <= 0 {
+		timeout = healthcheck.DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return state.db.PingContext(ctx)
+}
+
+func (state *RuntimeState) checkHealth() ([]healthCheckStatus, bool) {
+	if state.healthChecker == nil {
+		return nil, true
+	}
+	results := state.healthChecker.Check()
+	statuses := make([]healthCheckStatus, 0, len(results))
+	for _, result := range results {
+		if !result.OK {
+			logger.Printf("health check %s failed: %s", result.Name,
+				result.Error)
+		}
+		statuses = append(statuses, healthCheckStatus{
+			Name: result.Name,
+			OK:   result.OK,
+		})
+	}
+	return statuses, healthcheck.Healthy(results)
+}
+
+func writeHealthResponse(w http.ResponseWriter, code int,
+	response healthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(response)
+}
+
+// healthzHandler reports the dependencies, but only fails if keymasterd
+// cannot answer at all, so that it is not restarted when they are down.
+func (state *RuntimeState) healthzHandler(w http.ResponseWriter,
+	r *http.Request) {
+	checks, _ := state.checkHealth()
+	writeHealthResponse(w, http.StatusOK,
+		healthResponse{Status: "ok", Checks: checks})
+}
+
+func (state *RuntimeState) readyzHandler(w http.ResponseWriter,
+	r *http.Request) {
+	state.Mutex.Lock()
+	sealed := state.Signer == nil
+	state.Mutex.Unlock()
+	checks, healthy := state.checkHealth()
+	response := healthResponse{Status: "ok", Sealed: sealed, Checks: checks}
+	code := http.StatusOK
+	if sealed || !healthy {
+		response.Status = "unavailable"
+		code = http.StatusServiceUnavailable
+	}
+	writeHealthResponse(w, code, response)
+}
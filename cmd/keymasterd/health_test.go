@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/Cloud-Foundations/keymaster/lib/healthcheck"
+)
+
+func TestCheckHTTPHealth(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/.well-known/openid-configuration" {
+				http.NotFound(w, r)
+			}
+		}))
+	defer server.Close()
+	err := checkHTTPHealth(server.Client(),
+		server.URL+"/.well-known/openid-configuration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkHTTPHealth(server.Client(), server.URL+"/x"); err == nil {
+		t.Fatal("not found should fail")
+	}
+}
+
+func TestCheckStorageHealth(t *testing.T) {
+	var state RuntimeState
+	if err := state.checkStorageHealth(); err == nil {
+		t.Fatal("missing storage should fail")
+	}
+	dir, err := ioutil.TempDir("", "health_testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	state.Config.Base.DataDirectory = dir
+	if err := initDB(&state); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.checkStorageHealth(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadyzHandler(t *testing.T) {
+	state, passwdFile, err := setupValidRuntimeStateSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(passwdFile.Name())
+	var ldapErr error
+	state.healthChecker = healthcheck.New(healthcheck.Config{CacheTTL: 1},
+		[]healthcheck.Probe{
+			{Name: "ldap-password", Check: func() error { return ldapErr }},
+		})
+	req := httptest.NewRequest("GET", readyzPath, nil)
+	if _, err := checkRequestHandlerCode(req, state.readyzHandler,
+		http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	ldapErr = errors.New("connection refused")
+	if _, err := checkRequestHandlerCode(req, state.readyzHandler,
+		http.StatusServiceUnavailable); err != nil {
+		t.Fatal(err)
+	}
+	// Down dependencies do not fail the liveness check.
+	req = httptest.NewRequest("GET", healthzPath, nil)
+	if _, err := checkRequestHandlerCode(req, state.healthzHandler,
+		http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+	ldapErr = nil
+	state.Signer = nil
+	req = httptest.NewRequest("GET", readyzPath, nil)
+	if _, err := checkRequestHandlerCode(req, state.readyzHandler,
+		http.StatusServiceUnavailable); err != nil {
+		t.Fatal("a sealed instance should not be ready")
+	}
+}
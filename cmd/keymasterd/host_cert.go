@@ -0,0 +1,360 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/auditlog"
+	"github.com/Cloud-Foundations/keymaster/lib/authenticators/cloudidentity"
+	"github.com/Cloud-Foundations/keymaster/lib/certgen"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	hostCertType             = "ssh-host"
+	defaultHostCertDuration  = 30 * 24 * time.Hour
+	maxHostCertRequestSize   = 64 << 10
+	maxHostCertRenewalSkew   = 5 * time.Minute
+	hostBootstrapKeyIDPrefix = "bootstrap/"
+	hostAWSKeyIDPrefix       = "aws/"
+	hostAuthMethodBootstrap  = "host-bootstrap-token"
+	hostAuthMethodAWS        = "host-aws-identity"
+	hostAuthMethodRenewal    = "host-certificate"
+)
+
+func (state *RuntimeState) setupHostCerts() error {
+	config := state.Config.HostCerts
+	if config.Duration < 0 {
+		return errors.New("negative duration")
+	}
+	for _, token := range config.BootstrapTokens {
+		if token.Name == "" || strings.Contains(token.Name, "/") {
+			return fmt.Errorf("invalid bootstrap token name: %q", token.Name)
+		}
+		hash, err := hex.DecodeString(token.TokenSHA256)
+		if err != nil || len(hash) != sha256.Size {
+			return fmt.Errorf("bootstrap token %s: invalid token_sha256",
+				token.Name)
+		}
+	}
+	if len(config.AWS.Accounts) < 1 {
+		return nil
+	}
+	if config.AWS.CertificateFilename == "" {
+		return errors.New("aws accounts need a certificate_filename")
+	}
+	var err error
+	state.hostAWSAuthenticator, err = cloudidentity.New(
+		cloudidentity.Config{
+			AWSCertificateFilename: config.AWS.CertificateFilename,
+			AWSAudiences:           config.AWS.Audiences,
+			AWSSTSURL:              awsSTSURL,
+		}, logger)
+	return err
+}
+
+// hostPrincipalAllowed returns true if principal is one of patterns or is
+// under a domain given as "*.<domain>".
+func hostPrincipalAllowed(principal string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(principal, pattern[1:]) &&
+				!strings.HasPrefix(principal, ".") {
+				return true
+			}
+		} else if principal == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func getHostAWSKeyID(identity *cloudidentity.Identity) string {
+	return hostAWSKeyIDPrefix + identity.Account + "/" + identity.Region +
+		"/" + identity.InstanceID
+}
+
+// getHostAllowedPrincipals returns the principals the host identified by
+// keyID may obtain under the current configuration.
+func (state *RuntimeState) getHostAllowedPrincipals(keyID string) []string {
+	config := state.Config.HostCerts
+	if strings.HasPrefix(keyID, hostBootstrapKeyIDPrefix) {
+		name := strings.TrimPrefix(keyID, hostBootstrapKeyIDPrefix)
+		for _, token := range config.BootstrapTokens {
+			if token.Name == name {
+				return token.AllowedPrincipals
+			}
+		}
+		return nil
+	}
+	fields := strings.Split(strings.TrimPrefix(keyID, hostAWSKeyIDPrefix), "/")
+	if !strings.HasPrefix(keyID, hostAWSKeyIDPrefix) || len(fields) != 3 {
+		return nil
+	}
+	replacer := strings.NewReplacer("$ACCOUNT_ID", fields[0],
+		"$REGION", fields[1], "$INSTANCE_ID", fields[2])
+	for _, account := range config.AWS.Accounts {
+		if account.AccountID != fields[0] {
+			continue
+		}
+		principals := make([]string, 0, len(account.AllowedPrincipals))
+		for _, principal := range account.AllowedPrincipals {
+			principals = append(principals, replacer.Replace(principal))
+		}
+		return principals
+	}
+	return nil
+}
+
+func (state *RuntimeState) authenticateHostBootstrapToken(token string) (
+	string, error) {
+	hash := sha256.Sum256([]byte(token))
+	for _, bootstrapToken := range state.Config.HostCerts.BootstrapTokens {
+		expected, err := hex.DecodeString(bootstrapToken.TokenSHA256)
+		if err != nil {
+			continue
+		}
+		if subtle.ConstantTimeCompare(hash[:], expected) == 1 {
+			return hostBootstrapKeyIDPrefix + bootstrapToken.Name, nil
+		}
+	}
+	return "", errors.New("unknown bootstrap token")
+}
+
+func (state *RuntimeState) authenticateHostAWS(
+	request *proto.HostCertRequest) (string, error) {
+	identity, err := state.hostAWSAuthenticator.Authenticate(
+		cloudidentity.Credential{
+			Provider:   cloudidentity.ProviderAWS,
+			Document:   request.AWSIdentityDocument,
+			Signature:  request.AWSIdentitySignature,
+			STSRequest: request.AWSSTSRequest,
+		})
+	if err != nil {
+		return "", err
+	}
+	if strings.Contains(identity.Region+identity.InstanceID, "/") {
+		return "", errors.New("invalid identity document")
+	}
+	for _, account := range state.Config.HostCerts.AWS.Accounts {
+		if account.AccountID == identity.Account {
+			return getHostAWSKeyID(identity), nil
+		}
+	}
+	return "", fmt.Errorf("AWS account %s is not allowed", identity.Account)
+}
+
+// isSSHCertRevoked returns true if cert or its key has been revoked.
+func (state *RuntimeState) isSSHCertRevoked(cert *ssh.Certificate) (
+	bool, error) {
+	revokedCerts, _, err := state.GetRevokedCertificates(revokedSSHCertType)
+	if err != nil {
+		return false, err
+	}
+	serial := strconv.FormatUint(cert.Serial, 10)
+	for _, entry := range revokedCerts {
+		if entry.Serial == serial {
+			return true, nil
+		}
+	}
+	revokedKeys, _, err := state.GetRevokedCertificates(revokedSSHKeyType)
+	if err != nil {
+		return false, err
+	}
+	key := base64.StdEncoding.EncodeToString(cert.Key.Marshal())
+	for _, entry := range revokedKeys {
+		if entry.Serial == key {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// authenticateHostRenewal checks that the certificate of request was issued
+// by signer and is still valid, and that its key signed the request.
+func (state *RuntimeState) authenticateHostRenewal(
+	request *proto.HostCertRequest, signer ssh.Signer, now time.Time) (
+	string, error) {
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(request.Certificate))
+	if err != nil {
+		return "", fmt.Errorf("cannot parse certificate: %s", err)
+	}
+	cert, ok := pubKey.(*ssh.Certificate)
+	if !ok || cert.CertType != ssh.HostCert || len(cert.ValidPrincipals) < 1 {
+		return "", errors.New("not a host certificate")
+	}
+	if skew := now.Sub(request.Time); skew > maxHostCertRenewalSkew ||
+		skew < -maxHostCertRenewalSkew {
+		return "", fmt.Errorf("request time %s is too far from now",
+			request.Time.Format(time.RFC3339))
+	}
+	caKey := signer.PublicKey().Marshal()
+	checker := ssh.CertChecker{
+		IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
+			return subtle.ConstantTimeCompare(auth.Marshal(), caKey) == 1
+		},
+		Clock: func() time.Time { return now },
+	}
+	if err := checker.CheckCert(cert.ValidPrincipals[0], cert); err != nil {
+		return "", err
+	}
+	var signature ssh.Signature
+	if err := ssh.Unmarshal(request.Signature, &signature); err != nil {
+		return "", fmt.Errorf("cannot parse signature: %s", err)
+	}
+	if err := cert.Key.Verify(request.RenewalMessage(), &signature); err != nil {
+		return "", fmt.Errorf("invalid signature: %s", err)
+	}
+	revoked, err := state.isSSHCertRevoked(cert)
+	if err != nil {
+		return "", err
+	}
+	if revoked {
+		return "", fmt.Errorf("certificate %d is revoked", cert.Serial)
+	}
+	return cert.KeyId, nil
+}
+
+// authenticateHost returns the key ID identifying the host which made
+// request and the authentication method it used.
+func (state *RuntimeState) authenticateHost(request *proto.HostCertRequest,
+	signer ssh.Signer, now time.Time) (string, string, error) {
+	switch {
+	case request.Certificate != "":
+		keyID, err := state.authenticateHostRenewal(request, signer, now)
+		return keyID, hostAuthMethodRenewal, err
+	case request.BootstrapToken != "":
+		keyID, err := state.authenticateHostBootstrapToken(
+			request.BootstrapToken)
+		return keyID, hostAuthMethodBootstrap, err
+	case request.AWSIdentityDocument != "" &&
+		state.hostAWSAuthenticator != nil:
+		keyID, err := state.authenticateHostAWS(request)
+		return keyID, hostAuthMethodAWS, err
+	}
+	return "", "", errors.New("no supported host credentials")
+}
+
+// hostCertHandler issues SSH host certificates to hosts authenticated as
+// described for proto.HostCertRequest.
+func (state *RuntimeState) hostCertHandler(w http.ResponseWriter,
+	r *http.Request) {
+	if r.Method != "POST" {
+		state.writeFailureResponse(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	state.Mutex.Lock()
+	keySigner := state.Signer
+	state.Mutex.Unlock()
+	if keySigner == nil {
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		logger.Printf("Signer not loaded")
+		return
+	}
+	signer, err := newSSHSigner(keySigner)
+	if err != nil {
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		logger.Printf("Signer failed to load")
+		return
+	}
+	var request proto.HostCertRequest
+	err = json.NewDecoder(io.LimitReader(r.Body,
+		maxHostCertRequestSize)).Decode(&request)
+	if err != nil {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Cannot parse request")
+		return
+	}
+	hostKey, userErr, err := getValidSSHPublicKey(request.PublicKey)
+	if err != nil {
+		logger.Println(err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	if userErr != nil {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			userErr.Error())
+		return
+	}
+	keyID, method, err := state.authenticateHost(&request, signer, time.Now())
+	event := auditlog.Event{
+		Type:     auditlog.EventTypeLogin,
+		Username: keyID,
+		Success:  err == nil,
+		Method:   method,
+	}
+	if err != nil {
+		event.Details = map[string]string{"error": err.Error()}
+	}
+	state.logAuditEvent(r, event)
+	if err != nil {
+		logger.Printf("Host authentication from %s failed: %s", r.RemoteAddr,
+			err)
+		state.writeFailureResponse(w, r, http.StatusUnauthorized,
+			"Host authentication failed")
+		return
+	}
+	if len(request.Principals) < 1 {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"No principals requested")
+		return
+	}
+	allowedPrincipals := state.getHostAllowedPrincipals(keyID)
+	for _, principal := range request.Principals {
+		if !hostPrincipalAllowed(principal, allowedPrincipals) {
+			state.writeFailureResponse(w, r, http.StatusForbidden,
+				fmt.Sprintf("%s may not be issued to %s", principal, keyID))
+			return
+		}
+	}
+	duration := state.Config.HostCerts.Duration
+	if duration == 0 {
+		duration = defaultHostCertDuration
+	}
+	cert, certBytes, err := certgen.GenSSHHostCert(hostKey,
+		request.Principals, signer, keyID, duration)
+	if err != nil {
+		logger.Printf("Cannot generate SSH host certificate: %s", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	err = state.logSSHCertIssuance(keyID, hostCertType, 0, certBytes)
+	if err != nil {
+		logger.Printf("cannot record SSH host certificate issuance: %s", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	eventNotifier.PublishSSH(certBytes)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(proto.HostCertResponse{Certificate: cert})
+	logger.Printf("Generated SSH host certificate for %s (%s)", keyID,
+		strings.Join(request.Principals, ","))
+}
+
+// writeSSHCAPublicKey writes the public key of the SSH CA in authorized_keys
+// format, as used in @cert-authority lines of known_hosts files.
+func (state *RuntimeState) writeSSHCAPublicKey(w http.ResponseWriter,
+	r *http.Request) {
+	state.Mutex.Lock()
+	keySigner := state.Signer
+	state.Mutex.Unlock()
+	publicKey, err := ssh.NewPublicKey(keySigner.Public())
+	if err != nil {
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		logger.Printf("cannot convert CA public key: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(ssh.MarshalAuthorizedKey(publicKey))
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+	"golang.org/x/crypto/ssh"
+)
+
+const testHostBootstrapToken = "a-long-random-bootstrap-token"
+
+func TestHostPrincipalAllowed(t *testing.T) {
+	patterns := []string{"db.example.com", "*.web.example.com"}
+	for principal, allowed := range map[string]bool{
+		"db.example.com":    true,
+		"a.web.example.com": true,
+		".web.example.com":  false,
+		"web.example.com":   false,
+		"a.db.example.com":  false,
+	} {
+		if hostPrincipalAllowed(principal, patterns) != allowed {
+			t.Errorf("hostPrincipalAllowed(%s) != %v", principal, allowed)
+		}
+	}
+}
+
+// writeTestAWSCertificate writes a self-signed certificate standing in for
+// the AWS certificate of a region and returns its key.
+func writeTestAWSCertificate(t *testing.T, filename string) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Amazon Web Services LLC"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	derCert, err := x509.CreateCertificate(rand.Reader, &template, &template,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filename, pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: derCert}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+const testAWSAudience = "https://keymaster.example.com"
+
+// startTestAWSSTS starts a server standing in for AWS STS, which answers
+// GetCallerIdentity with the role session of instance i-0123456789abcdef0,
+// and points awsSTSURL at it. The returned function stops it.
+func startTestAWSSTS(t *testing.T) func() {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") == "" {
+				http.Error(w, "missing signature", http.StatusForbidden)
+				return
+			}
+			w.Write([]byte(`<GetCallerIdentityResponse><GetCallerIdentityResult><Arn>arn:aws:sts::123456789012:assumed-role/web/i-0123456789abcdef0</Arn><Account>123456789012</Account></GetCallerIdentityResult></GetCallerIdentityResponse>`))
+		}))
+	awsSTSURL = server.URL
+	return func() {
+		awsSTSURL = ""
+		server.Close()
+	}
+}
+
+// newTestAWSSTSRequest returns a JSON encoded GetCallerIdentity request for
+// testAWSAudience, as sent by instances.
+func newTestAWSSTSRequest(t *testing.T) string {
+	now := time.Now().UTC()
+	data, err := json.Marshal(proto.AWSSTSRequest{
+		Headers: map[string]string{
+			"Authorization": "AWS4-HMAC-SHA256 Credential=ASIAEXAMPLE/" +
+				now.Format("20060102") + "/us-east-1/sts/aws4_request, " +
+				"SignedHeaders=host;x-amz-date;x-keymaster-audience, " +
+				"Signature=0123",
+			"X-Amz-Date":            now.Format("20060102T150405Z"),
+			proto.AWSAudienceHeader: testAWSAudience,
+		},
+		Body: "Action=GetCallerIdentity&Version=2011-06-15",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func requestHostCert(t *testing.T, state *RuntimeState,
+	request proto.HostCertRequest, expectedStatus int) *ssh.Certificate {
+	body, err := json.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", proto.HostCertPath,
+		bytes.NewReader(body))
+	rr := httptest.NewRecorder()
+	state.hostCertHandler(rr, req)
+	if rr.Code != expectedStatus {
+		t.Fatalf("expected status %d, got %d: %s", expectedStatus, rr.Code,
+			rr.Body.String())
+	}
+	if expectedStatus != http.StatusOK {
+		return nil
+	}
+	var response proto.HostCertResponse
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey(
+		[]byte(response.Certificate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, ok := pubKey.(*ssh.Certificate)
+	if !ok || cert.CertType != ssh.HostCert {
+		t.Fatal("response is not a host certificate")
+	}
+	return cert
+}
+
+func TestHostCertHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "host_cert_testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var state RuntimeState
+	state.Config.Base.DataDirectory = dir
+	if err := initDB(&state); err != nil {
+		t.Fatal(err)
+	}
+	_, _, caPriv := setupX509Generator(t)
+	state.Signer = caPriv
+	tokenHash := sha256.Sum256([]byte(testHostBootstrapToken))
+	awsCertFilename := filepath.Join(dir, "aws.pem")
+	awsKey := writeTestAWSCertificate(t, awsCertFilename)
+	defer startTestAWSSTS(t)()
+	state.Config.HostCerts = HostCertConfig{
+		Enabled: true,
+		BootstrapTokens: []HostBootstrapToken{{
+			Name:              "web",
+			TokenSHA256:       hex.EncodeToString(tokenHash[:]),
+			AllowedPrincipals: []string{"*.web.example.com"},
+		}},
+		AWS: HostAWSConfig{
+			CertificateFilename: awsCertFilename,
+			Audiences:           []string{testAWSAudience},
+			Accounts: []HostAWSAccount{{
+				AccountID:         "123456789012",
+				AllowedPrincipals: []string{"$INSTANCE_ID.$REGION.compute.internal"},
+			}},
+		},
+	}
+	if err := state.setupHostCerts(); err != nil {
+		t.Fatal(err)
+	}
+	_, hostPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := string(ssh.MarshalAuthorizedKey(hostSigner.PublicKey()))
+	request := proto.HostCertRequest{
+		PublicKey:      publicKey,
+		Principals:     []string{"www1.web.example.com"},
+		BootstrapToken: testHostBootstrapToken,
+	}
+	cert := requestHostCert(t, &state, request, http.StatusOK)
+	if cert.KeyId != "bootstrap/web" ||
+		cert.ValidPrincipals[0] != "www1.web.example.com" {
+		t.Fatalf("unexpected certificate %s %v", cert.KeyId,
+			cert.ValidPrincipals)
+	}
+	request.Principals = []string{"db.example.com"}
+	requestHostCert(t, &state, request, http.StatusForbidden)
+	request.BootstrapToken = "wrong-token"
+	requestHostCert(t, &state, request, http.StatusUnauthorized)
+
+	// Renew with the certificate.
+	request = proto.HostCertRequest{
+		PublicKey:   publicKey,
+		Principals:  []string{"www1.web.example.com"},
+		Certificate: string(ssh.MarshalAuthorizedKey(cert)),
+		Time:        time.Now(),
+	}
+	signature, err := hostSigner.Sign(rand.Reader, request.RenewalMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Signature = ssh.Marshal(signature)
+	renewedCert := requestHostCert(t, &state, request, http.StatusOK)
+	if renewedCert.KeyId != cert.KeyId || renewedCert.Serial == cert.Serial {
+		t.Fatal("unexpected renewed certificate")
+	}
+	request.Principals = []string{"www2.web.example.com"}
+	requestHostCert(t, &state, request, http.StatusUnauthorized)
+
+	// Authenticate with an instance identity document.
+	document := `{"accountId":"123456789012","instanceId":"i-0123456789abcdef0","region":"us-west-2"}`
+	digest := sha256.Sum256([]byte(document))
+	rawSignature, err := rsa.SignPKCS1v15(rand.Reader, awsKey, crypto.SHA256,
+		digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	request = proto.HostCertRequest{
+		PublicKey:            publicKey,
+		Principals:           []string{"i-0123456789abcdef0.us-west-2.compute.internal"},
+		AWSIdentityDocument:  document,
+		AWSIdentitySignature: base64.StdEncoding.EncodeToString(rawSignature),
+		AWSSTSRequest:        newTestAWSSTSRequest(t),
+	}
+	cert = requestHostCert(t, &state, request, http.StatusOK)
+	if cert.KeyId != "aws/123456789012/us-west-2/i-0123456789abcdef0" {
+		t.Fatalf("unexpected key ID %s", cert.KeyId)
+	}
+	// The document alone is not enough.
+	stsRequest := request.AWSSTSRequest
+	request.AWSSTSRequest = ""
+	requestHostCert(t, &state, request, http.StatusUnauthorized)
+	request.AWSSTSRequest = stsRequest
+	request.AWSIdentityDocument = `{"accountId":"123456789012","instanceId":"i-1","region":"us-west-2"}`
+	requestHostCert(t, &state, request, http.StatusUnauthorized)
+}
+
+func TestSSHCAPublicKey(t *testing.T) {
+	state, passwdFile, err := setupValidRuntimeStateSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(passwdFile.Name())
+	req, err := http.NewRequest("GET", proto.SSHCAPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr, err := checkRequestHandlerCode(req, state.publicPathHandler,
+		http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(rr.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := ssh.NewPublicKey(state.Signer.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(publicKey.Marshal(), expected.Marshal()) {
+		t.Fatal("unexpected CA public key")
+	}
+}
@@ -12,7 +12,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/Cloud-Foundations/keymaster/lib/authutil"
 	"github.com/Cloud-Foundations/keymaster/lib/instrumentedwriter"
 	"github.com/mendsley/gojwk"
 	"gopkg.in/square/go-jose.v2"
@@ -35,18 +34,29 @@ const idpOpenIDCUserinfoPath = "/idp/oauth2/userinfo"
 // From: https://openid.net/specs/openid-connect-discovery-1_0.html
 // We only put required OR implemented fields here
 type openIDProviderMetadata struct {
-	Issuer                 string   `json:"issuer"`
-	AuthorizationEndpoint  string   `json:"authorization_endpoint"`
-	TokenEndoint           string   `json:"token_endpoint"`
-	UserInfoEndpoint       string   `json:"userinfo_endpoint"`
-	JWKSURI                string   `json:"jwks_uri"`
-	ResponseTypesSupported []string `json:"response_types_supported"`
-	SubjectTypesSupported  []string `json:"subject_types_supported"`
-	IDTokenSigningAlgValue []string `json:"id_token_signing_alg_values_supported"`
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndoint                      string   `json:"token_endpoint"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValue            []string `json:"id_token_signing_alg_values_supported"`
+	ScopesSupported                   []string `json:"scopes_supported,omitempty"`
+	ClaimsSupported                   []string `json:"claims_supported,omitempty"`
+	GrantTypesSupported               []string `json:"grant_types_supported,omitempty"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported,omitempty"`
 }
 
 func (state *RuntimeState) idpOpenIDCDiscoveryHandler(w http.ResponseWriter, r *http.Request) {
 	issuer := state.idpGetIssuer()
+	signingAlgorithm := jose.RS256
+	if state.Signer != nil {
+		algorithm, err := getJWTSigningAlgorithm(state.Signer.Public())
+		if err == nil {
+			signingAlgorithm = algorithm
+		}
+	}
 	metadata := openIDProviderMetadata{
 		Issuer:                 issuer,
 		AuthorizationEndpoint:  issuer + idpOpenIDCAuthorizationPath,
@@ -55,8 +65,14 @@ func (state *RuntimeState) idpOpenIDCDiscoveryHandler(w http.ResponseWriter, r *
 		JWKSURI:                issuer + idpOpenIDCJWKSPath,
 		ResponseTypesSupported: []string{"code"},               // We only support authorization code flow
 		SubjectTypesSupported:  []string{"pairwise", "public"}, // WHAT is THIS?
-		IDTokenSigningAlgValue: []string{"RS256"}}
-	// need to agree on what scopes we will support
+		IDTokenSigningAlgValue: []string{string(signingAlgorithm)},
+		ScopesSupported:        []string{"openid", "email", "profile", "groups"},
+		ClaimsSupported: []string{"iss", "sub", "aud", "exp", "iat", "nonce",
+			"email", "preferred_username", "groups"},
+		GrantTypesSupported: []string{"authorization_code"},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic",
+			"client_secret_post"},
+	}
 
 	b, err := json.Marshal(metadata)
 	if err != nil {
@@ -209,7 +225,7 @@ func (state *RuntimeState) idpOpenIDCAuthorizationHandler(w http.ResponseWriter,
 	//Dont check for now
 	signerOptions := (&jose.SignerOptions{}).WithType("JWT")
 	//signerOptions.EmbedJWK = true
-	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: state.Signer}, signerOptions)
+	signer, err := state.newJWTSigner(signerOptions)
 	if err != nil {
 		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
 		return
@@ -242,13 +258,18 @@ func (state *RuntimeState) idpOpenIDCAuthorizationHandler(w http.ResponseWriter,
 }
 
 type openIDConnectIDToken struct {
-	Issuer     string   `json:"iss"`
-	Subject    string   `json:"sub"`
-	Audience   []string `json:"aud"`
-	Expiration int64    `json:"exp"`
-	IssuedAt   int64    `json:"iat"`
-	AuthTime   int64    `json:"auth_time,omitempty"` //Time of Auth
-	Nonce      string   `json:"nonce,omitempty"`
+	Issuer            string   `json:"iss"`
+	Subject           string   `json:"sub"`
+	Audience          []string `json:"aud"`
+	Expiration        int64    `json:"exp"`
+	IssuedAt          int64    `json:"iat"`
+	AuthTime          int64    `json:"auth_time,omitempty"` //Time of Auth
+	Nonce             string   `json:"nonce,omitempty"`
+	Email             string   `json:"email,omitempty"`
+	PreferredUsername string   `json:"preferred_username,omitempty"`
+	// Groups is only set if the groups scope was requested, since the group
+	// list of a user may be large.
+	Groups []string `json:"groups,omitempty"`
 }
 
 type accessToken struct {
@@ -396,7 +417,7 @@ func (state *RuntimeState) idpOpenIDCTokenHandler(w http.ResponseWriter, r *http
 	}
 
 	signerOptions = signerOptions.WithHeader("kid", kid)
-	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: state.Signer}, signerOptions)
+	signer, err := state.newJWTSigner(signerOptions)
 	if err != nil {
 		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
 		return
@@ -406,6 +427,22 @@ func (state *RuntimeState) idpOpenIDCTokenHandler(w http.ResponseWriter, r *http
 	idToken.Nonce = keymasterToken.Nonce
 	idToken.Expiration = keymasterToken.Expiration
 	idToken.IssuedAt = time.Now().Unix()
+	requestedScopes := strings.Split(keymasterToken.Scope, " ")
+	wantEmail := scopeRequested(requestedScopes, "email")
+	wantGroups := scopeRequested(requestedScopes, "groups")
+	if wantEmail || wantGroups {
+		email, groups := state.getOpenIDConnectUserClaims(
+			keymasterToken.Username)
+		if wantEmail {
+			idToken.Email = email
+		}
+		if wantGroups {
+			idToken.Groups = groups
+		}
+	}
+	if scopeRequested(requestedScopes, "profile") {
+		idToken.PreferredUsername = keymasterToken.Username
+	}
 
 	signedIdToken, err := jwt.Signed(signer).Claims(idToken).CompactSerialize()
 	if err != nil {
@@ -465,42 +502,25 @@ func (state *RuntimeState) getLdapUserAttributes(username string,
 	if ldapConfig.LDAPTargetURLs == "" {
 		return false, nil, nil
 	}
-	var timeoutSecs uint
-	timeoutSecs = 2
-	for _, ldapUrl := range strings.Split(ldapConfig.LDAPTargetURLs, ",") {
-		if len(ldapUrl) < 1 {
-			continue
-		}
-		u, err := authutil.ParseLDAPURL(ldapUrl)
-		if err != nil {
-			logger.Printf("Failed to parse ldapurl '%s'", ldapUrl)
-			continue
-		}
-		attributeMap, err := authutil.GetLDAPUserAttributes(*u,
-			ldapConfig.BindUsername, ldapConfig.BindPassword,
-			timeoutSecs, nil, username,
-			ldapConfig.UserSearchBaseDNs, ldapConfig.UserSearchFilter,
-			attributes)
-		if err != nil {
-			continue
-		}
-		userGroups, err := authutil.GetLDAPUserGroups(*u,
-			ldapConfig.BindUsername, ldapConfig.BindPassword,
-			timeoutSecs, nil, username,
-			ldapConfig.UserSearchBaseDNs, ldapConfig.UserSearchFilter,
-			ldapConfig.GroupSearchBaseDNs, ldapConfig.GroupSearchFilter)
-		if err != nil {
-			// TODO: We actually need to check the error, right now we are
-			// assuming the user does not exists and go with that.
-			logger.Printf("Failed get userGroups for user '%s'", username)
-		} else {
-			logger.Debugf(1, "Got groups for username %s: %s",
-				username, userGroups)
-			attributeMap["groups"] = userGroups
-		}
-		return true, attributeMap, nil
+	pool := state.getLdapPool()
+	attributeMap, err := pool.GetUserAttributes(username,
+		ldapConfig.UserSearchFilter, attributes)
+	if err != nil {
+		return true, nil, errors.New("error getting the groups")
 	}
-	return true, nil, errors.New("error getting the groups")
+	userGroups, _, err := pool.GetUserGroupsWithLimit(username,
+		ldapConfig.UserSearchFilter, ldapConfig.GroupSearchFilter,
+		ldapConfig.MaxGroups, state.ldapRelevantGroupsRE)
+	if err != nil {
+		// TODO: We actually need to check the error, right now we are
+		// assuming the user does not exists and go with that.
+		logger.Printf("Failed get userGroups for user '%s'", username)
+	} else {
+		logger.Debugf(1, "Got groups for username %s: %s",
+			username, userGroups)
+		attributeMap["groups"] = userGroups
+	}
+	return true, attributeMap, nil
 }
 
 func (state *RuntimeState) getUserAttributes(username string,
@@ -516,6 +536,46 @@ func (state *RuntimeState) getUserAttributes(username string,
 	return nil, nil
 }
 
+func scopeRequested(scopes []string, scope string) bool {
+	for _, requestedScope := range scopes {
+		if requestedScope == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// getOpenIDConnectUserClaims returns the email address and groups of
+// username. The email address is taken from the mail attribute in LDAP and
+// defaults to username at the default email domain.
+func (state *RuntimeState) getOpenIDConnectUserClaims(username string) (
+	string, []string) {
+	defaultEmailDomain := state.HostIdentity
+	if len(state.Config.OpenIDConnectIDP.DefaultEmailDomain) > 3 {
+		defaultEmailDomain = state.Config.OpenIDConnectIDP.DefaultEmailDomain
+	}
+	email := fmt.Sprintf("%s@%s", username, defaultEmailDomain)
+	userAttributeMap, err := state.getUserAttributes(username,
+		[]string{"mail"})
+	if err != nil {
+		logger.Printf("warn: failed to get user attributes for %s, %s",
+			username, err)
+	}
+	var userGroups []string
+	if userAttributeMap != nil {
+		logger.Debugf(2, "useMa=%+v", userAttributeMap)
+		mailList, ok := userAttributeMap["mail"]
+		if ok && len(mailList) > 0 {
+			email = mailList[0]
+		}
+		groupList, ok := userAttributeMap["groups"]
+		if ok {
+			userGroups = groupList
+		}
+	}
+	return email, userGroups
+}
+
 type openidConnectUserInfo struct {
 	Subject           string   `json:"sub"`
 	Name              string   `json:"name"`
@@ -586,31 +646,8 @@ func (state *RuntimeState) idpOpenIDCUserinfoHandler(w http.ResponseWriter,
 		state.writeFailureResponse(w, r, http.StatusUnauthorized, "")
 		return
 	}
-	// Get email from LDAP if available.
-	defaultEmailDomain := state.HostIdentity
-	if len(state.Config.OpenIDConnectIDP.DefaultEmailDomain) > 3 {
-		defaultEmailDomain = state.Config.OpenIDConnectIDP.DefaultEmailDomain
-	}
-	email := fmt.Sprintf("%s@%s", parsedAccessToken.Username,
-		defaultEmailDomain)
-	userAttributeMap, err := state.getUserAttributes(parsedAccessToken.Username,
-		[]string{"mail"})
-	if err != nil {
-		logger.Printf("warn: failed to get user attributes for %s, %s",
-			parsedAccessToken.Username, err)
-	}
-	var userGroups []string
-	if userAttributeMap != nil {
-		logger.Debugf(2, "useMa=%+v", userAttributeMap)
-		mailList, ok := userAttributeMap["mail"]
-		if ok {
-			email = mailList[0]
-		}
-		groupList, ok := userAttributeMap["groups"]
-		if ok {
-			userGroups = groupList
-		}
-	}
+	email, userGroups := state.getOpenIDConnectUserClaims(
+		parsedAccessToken.Username)
 	userInfo := openidConnectUserInfo{
 		Subject:  parsedAccessToken.Username,
 		Username: parsedAccessToken.Username,
@@ -10,9 +10,10 @@ import (
 	"strconv"
 	"strings"
 	"testing"
-	//"time"
+	"time"
 
 	"github.com/Cloud-Foundations/Dominator/lib/log/debuglogger"
+	"gopkg.in/square/go-jose.v2"
 	"gopkg.in/square/go-jose.v2/jwt"
 	//"golang.org/x/net/context"
 	//"golang.org/x/oauth2"
@@ -104,7 +105,7 @@ func TestIDPOpenIDCAuthorizationHandlerSuccess(t *testing.T) {
 		t.Fatal(err)
 	}
 	// now we add a cookie for auth
-	cookieVal, err := state.setNewAuthCookie(nil, "username", AuthTypePassword)
+	cookieVal, err := state.setNewAuthCookie(nil, nil, "username", AuthTypePassword)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -202,3 +203,80 @@ func TestIDPOpenIDCAuthorizationHandlerSuccess(t *testing.T) {
 	}
 
 }
+
+func TestIDPOpenIDCTokenHandlerScopeClaims(t *testing.T) {
+	state, passwdFile, err := setupValidRuntimeStateSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(passwdFile.Name()) // clean up
+	state.signerPublicKeyToKeymasterKeys()
+	state.HostIdentity = "localhost"
+	clientConfig := OpenIDConnectClientConfig{ClientID: "valid_client_id",
+		ClientSecret: "secret_password", AllowedRedirectURLRE: []string{"localhost"}}
+	state.Config.OpenIDConnectIDP.Client = append(
+		state.Config.OpenIDConnectIDP.Client, clientConfig)
+	signer, err := state.newJWTSigner((&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		scope             string
+		email             string
+		preferredUsername string
+	}{
+		{"openid", "", ""},
+		{"openid email", "username@localhost", ""},
+		{"openid email profile", "username@localhost", "username"},
+	} {
+		codeToken := keymasterdCodeToken{
+			Issuer:      state.idpGetIssuer(),
+			Subject:     clientConfig.ClientID,
+			IssuedAt:    time.Now().Unix(),
+			Expiration:  time.Now().Unix() + maxAgeSecondsAuthCookie,
+			Username:    "username",
+			RedirectURI: "https://localhost:12345",
+			Scope:       test.scope,
+			Type:        "token_endpoint",
+		}
+		code, err := jwt.Signed(signer).Claims(codeToken).CompactSerialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokenForm := url.Values{}
+		tokenForm.Add("grant_type", "authorization_code")
+		tokenForm.Add("redirect_uri", codeToken.RedirectURI)
+		tokenForm.Add("code", code)
+		tokenReq, err := http.NewRequest("POST", idpOpenIDCTokenPath,
+			strings.NewReader(tokenForm.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokenReq.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		tokenReq.SetBasicAuth(clientConfig.ClientID, clientConfig.ClientSecret)
+		tokenRR, err := checkRequestHandlerCode(tokenReq,
+			state.idpOpenIDCTokenHandler, http.StatusOK)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resultAccessToken := accessToken{}
+		err = json.NewDecoder(tokenRR.Result().Body).Decode(&resultAccessToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsedIDToken, err := jwt.ParseSigned(resultAccessToken.IDToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		idToken := openIDConnectIDToken{}
+		err = parsedIDToken.Claims(state.Signer.Public(), &idToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if idToken.Subject != "username" || idToken.Email != test.email ||
+			idToken.PreferredUsername != test.preferredUsername ||
+			idToken.Groups != nil {
+			t.Fatalf("%s: unexpected id token claims: %+v", test.scope, idToken)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/auditlog"
+	"github.com/Cloud-Foundations/keymaster/lib/instrumentedwriter"
+	"github.com/Cloud-Foundations/keymaster/lib/issuancelog"
+	"golang.org/x/crypto/ssh"
+)
+
+const issuanceLogPath = "/v1/issuance-log"
+
+const defaultIssuanceLogFilename = "issuance-log.jsonl"
+
+// maxIssuanceLogEntries limits the entries returned by one query.
+const maxIssuanceLogEntries = 10000
+
+var errNotSSHCertificate = errors.New("not an SSH certificate")
+
+type issuanceLogResponse struct {
+	Entries []issuancelog.Entry `json:"entries"`
+}
+
+// appendIssuanceLog records entry in the issuance log, if there is one, and
+// in the audit log.
+func (state *RuntimeState) appendIssuanceLog(entry issuancelog.Entry) error {
+	if state.issuanceLog != nil {
+		var err error
+		entry, err = state.issuanceLog.Append(entry)
+		if err != nil {
+			return err
+		}
+		logger.Debugf(1, "recorded %s certificate %s for %s in issuance log",
+			entry.CertType, entry.Serial, entry.Username)
+	}
+	details := map[string]string{
+		"serial":       entry.Serial,
+		"not_after":    entry.NotAfter.Format(time.RFC3339),
+		"auth_methods": strings.Join(entry.AuthMethods, ","),
+	}
+	if len(entry.SSHPrincipals) > 0 {
+		details["ssh_principals"] = strings.Join(entry.SSHPrincipals, ",")
+	}
+	if len(entry.X509SANs) > 0 {
+		details["x509_sans"] = strings.Join(entry.X509SANs, ",")
+	}
+	state.logAuditEvent(nil, auditlog.Event{
+		Type:     auditlog.EventTypeIssue,
+		Username: entry.Username,
+		Success:  true,
+		Method:   entry.CertType,
+		Details:  details,
+	})
+	return nil
+}
+
+func (state *RuntimeState) logSSHIssuance(username string, authLevel int,
+	certBytes []byte) error {
+	return state.logSSHCertIssuance(username, "ssh", authLevel, certBytes)
+}
+
+func (state *RuntimeState) logSSHCertIssuance(username string,
+	certType string, authLevel int, certBytes []byte) error {
+	pubKey, err := ssh.ParsePublicKey(certBytes)
+	if err != nil {
+		return err
+	}
+	sshCert, ok := pubKey.(*ssh.Certificate)
+	if !ok {
+		return errNotSSHCertificate
+	}
+	return state.appendIssuanceLog(issuancelog.Entry{
+		Username:      username,
+		CertType:      certType,
+		Serial:        strconv.FormatUint(sshCert.Serial, 10),
+		NotBefore:     time.Unix(int64(sshCert.ValidAfter), 0),
+		NotAfter:      time.Unix(int64(sshCert.ValidBefore), 0),
+		SSHPrincipals: sshCert.ValidPrincipals,
+		AuthMethods:   getAuthMethodNames(authLevel),
+	})
+}
+
+func (state *RuntimeState) logX509Issuance(username string, certType string,
+	authLevel int, derCert []byte) error {
+	cert, err := x509.ParseCertificate(derCert)
+	if err != nil {
+		return err
+	}
+	sans := append(append([]string{}, cert.DNSNames...),
+		cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	err = state.appendIssuanceLog(issuancelog.Entry{
+		Username:    username,
+		CertType:    certType,
+		Serial:      cert.SerialNumber.String(),
+		NotBefore:   cert.NotBefore,
+		NotAfter:    cert.NotAfter,
+		X509SANs:    sans,
+		AuthMethods: getAuthMethodNames(authLevel),
+	})
+	if err != nil {
+		return err
+	}
+	state.recordIssuedX509Serial(cert.SerialNumber.String(), cert.NotAfter)
+	return nil
+}
+
+// getIssuanceLogFilter returns the filter given by the "user", "since" and
+// "until" (RFC 3339 times) and "limit" query parameters.
+func getIssuanceLogFilter(r *http.Request) (issuancelog.Filter, error) {
+	filter := issuancelog.Filter{
+		Username: r.Form.Get("user"),
+		Limit:    maxIssuanceLogEntries,
+	}
+	var err error
+	if value := r.Form.Get("since"); value != "" {
+		filter.Since, err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			return filter, err
+		}
+	}
+	if value := r.Form.Get("until"); value != "" {
+		filter.Until, err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			return filter, err
+		}
+	}
+	if value := r.Form.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil {
+			return filter, err
+		}
+		if limit > 0 && limit < filter.Limit {
+			filter.Limit = limit
+		}
+	}
+	return filter, nil
+}
+
+// issuanceLogHandler returns the issuance log entries selected by the query
+// parameters. Only admins may read the log.
+func (state *RuntimeState) issuanceLogHandler(w http.ResponseWriter,
+	r *http.Request) {
+	if state.sendFailureToClientIfLocked(w, r) {
+		return
+	}
+	authUser, _, err := state.checkAuth(w, r, state.getRequiredWebUIAuthLevel())
+	if err != nil {
+		logger.Debugf(1, "%v", err)
+		return
+	}
+	w.(*instrumentedwriter.LoggingWriter).SetUsername(authUser)
+	if r.Method != "GET" {
+		state.writeFailureResponse(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	if !state.IsAdminUser(authUser) {
+		state.writeFailureResponse(w, r, http.StatusForbidden,
+			"Only admins may read the issuance log")
+		return
+	}
+	if state.issuanceLog == nil {
+		state.writeFailureResponse(w, r, http.StatusNotFound, "")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Error parsing form")
+		return
+	}
+	filter, err := getIssuanceLogFilter(r)
+	if err != nil {
+		state.writeFailureResponse(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	entries, err := state.issuanceLog.Query(filter)
+	if err != nil {
+		logger.Printf("cannot query issuance log: %s", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(issuanceLogResponse{Entries: entries})
+}
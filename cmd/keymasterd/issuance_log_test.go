@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log/testlogger"
+	"github.com/Cloud-Foundations/keymaster/lib/certgen"
+	"github.com/Cloud-Foundations/keymaster/lib/issuancelog"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestIssuanceLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "issuance_log_testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var state RuntimeState
+	state.issuanceLog, err = issuancelog.Open(
+		filepath.Join(dir, defaultIssuanceLogFilename), testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.issuanceLog.Close()
+	userPub, caCert, caPriv := setupX509Generator(t)
+	derCert, err := certgen.GenUserX509CertWithSANs("username", userPub,
+		caCert, caPriv, nil, testDuration, nil, nil,
+		[]string{"host.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	authLevel := AuthTypePassword | AuthTypeU2F
+	err = state.logX509Issuance("username", "x509", authLevel, derCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromSigner(caPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, certBytes, err := certgen.GenSSHCertFileString("otheruser",
+		testUserSSHPublicKey, signer, "host", testDuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = state.logSSHIssuance("otheruser", AuthTypePassword, certBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := state.issuanceLog.Query(issuancelog.Filter{
+		Username: "username"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(entries))
+	}
+	entry := entries[0]
+	if entry.CertType != "x509" || len(entry.X509SANs) != 1 ||
+		entry.X509SANs[0] != "host.example.com" ||
+		len(entry.AuthMethods) != 2 {
+		t.Fatalf("unexpected entry: %+v", entry)
+	}
+	entries, err = state.issuanceLog.Query(issuancelog.Filter{
+		Username: "otheruser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || len(entries[0].SSHPrincipals) != 1 ||
+		entries[0].SSHPrincipals[0] != "otheruser" {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+}
+
+func TestGetIssuanceLogFilter(t *testing.T) {
+	req, err := http.NewRequest("GET", issuanceLogPath+
+		"?user=username&since=2020-01-01T00:00:00Z&limit=5", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := req.ParseForm(); err != nil {
+		t.Fatal(err)
+	}
+	filter, err := getIssuanceLogFilter(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter.Username != "username" || filter.Limit != 5 ||
+		!filter.Since.Equal(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)) ||
+		!filter.Until.IsZero() {
+		t.Fatalf("unexpected filter: %+v", filter)
+	}
+	req, err = http.NewRequest("GET", issuanceLogPath+"?until=yesterday", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := req.ParseForm(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getIssuanceLogFilter(req); err == nil {
+		t.Fatal("invalid time should fail")
+	}
+}
@@ -2,6 +2,10 @@ package main
 
 import (
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
 	"crypto/sha256"
 	"errors"
 	"fmt"
@@ -9,6 +13,7 @@ import (
 
 	"golang.org/x/crypto/ssh"
 	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/cryptosigner"
 	"gopkg.in/square/go-jose.v2/jwt"
 )
 
@@ -24,6 +29,40 @@ func getKeyFingerprint(key crypto.PublicKey) (string, error) {
 	return fp, nil
 }
 
+// getJWTSigningAlgorithm returns the JWS algorithm used to sign with the
+// private key of publicKey.
+func getJWTSigningAlgorithm(publicKey crypto.PublicKey) (
+	jose.SignatureAlgorithm, error) {
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		return jose.RS256, nil
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return jose.ES256, nil
+		case elliptic.P384():
+			return jose.ES384, nil
+		case elliptic.P521():
+			return jose.ES512, nil
+		}
+	case ed25519.PublicKey:
+		return jose.EdDSA, nil
+	}
+	return "", fmt.Errorf("cannot sign JWTs with key type %T", publicKey)
+}
+
+// newJWTSigner returns a signer for JWTs using the CA key. The key is wrapped
+// so that keys held in tokens or KMS can be used.
+func (state *RuntimeState) newJWTSigner(options *jose.SignerOptions) (
+	jose.Signer, error) {
+	algorithm, err := getJWTSigningAlgorithm(state.Signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	return jose.NewSigner(jose.SigningKey{Algorithm: algorithm,
+		Key: cryptosigner.Opaque(state.Signer)}, options)
+}
+
 func (state *RuntimeState) idpGetIssuer() string {
 	issuer := "https://" + state.HostIdentity
 	if state.Config.Base.HttpAddress != ":443" {
@@ -47,74 +86,58 @@ func (state *RuntimeState) JWTClaims(t *jwt.JSONWebToken, dest ...interface{}) (
 }
 
 func (state *RuntimeState) genNewSerializedAuthJWT(username string, authLevel int) (string, error) {
-	signerOptions := (&jose.SignerOptions{}).WithType("JWT")
-	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: state.Signer}, signerOptions)
-	if err != nil {
-		return "", err
-	}
+	return state.genNewSerializedSessionAuthJWT(username, authLevel, "",
+		time.Time{})
+}
+
+// genNewSerializedSessionAuthJWT is like genNewSerializedAuthJWT, with the
+// ID of the web session, if any, as the JWT ID and authTime, if not zero, as
+// the time at which the user logged in with credentials.
+func (state *RuntimeState) genNewSerializedSessionAuthJWT(username string,
+	authLevel int, sessionID string, authTime time.Time) (string, error) {
 	issuer := state.idpGetIssuer()
 	authToken := authInfoJWT{Issuer: issuer, Subject: username,
-		Audience: []string{issuer}, AuthType: authLevel, TokenType: "keymaster_auth"}
+		Audience: []string{issuer}, AuthType: authLevel, TokenType: "keymaster_auth",
+		SessionID: sessionID}
 	authToken.NotBefore = time.Now().Unix()
 	authToken.IssuedAt = authToken.NotBefore
+	if !authTime.IsZero() {
+		authToken.AuthTime = authTime.Unix()
+	}
 	authToken.Expiration = authToken.IssuedAt + maxAgeSecondsAuthCookie // TODO seek the actual duration
 
-	return jwt.Signed(signer).Claims(authToken).CompactSerialize()
+	return state.serializeAuthJWT(authToken)
 }
 
 func (state *RuntimeState) getAuthInfoFromAuthJWT(serializedToken string) (rvalue authInfo, err error) {
-	tok, err := jwt.ParseSigned(serializedToken)
+	inboundJWT, err := state.parseAuthJWT(serializedToken)
 	if err != nil {
 		return rvalue, err
 	}
-	inboundJWT := authInfoJWT{}
-	if err := state.JWTClaims(tok, &inboundJWT); err != nil {
-		logger.Printf("err=%s", err)
-		return rvalue, err
-	}
-	//At this stage is now crypto verified, now is time to verify sane values
-	issuer := state.idpGetIssuer()
-	if inboundJWT.Issuer != issuer || inboundJWT.TokenType != "keymaster_auth" ||
-		inboundJWT.NotBefore > time.Now().Unix() {
-		err = errors.New("invalid JWT values")
-		return rvalue, err
-	}
-
 	rvalue.Username = inboundJWT.Subject
 	rvalue.AuthType = inboundJWT.AuthType
 	rvalue.ExpiresAt = time.Unix(inboundJWT.Expiration, 0)
+	rvalue.IssuedAt = time.Unix(inboundJWT.IssuedAt, 0)
+	rvalue.AuthTime = rvalue.IssuedAt
+	if inboundJWT.AuthTime != 0 {
+		rvalue.AuthTime = time.Unix(inboundJWT.AuthTime, 0)
+	}
+	rvalue.SessionID = inboundJWT.SessionID
 	return rvalue, nil
 }
 
 func (state *RuntimeState) updateAuthJWTWithNewAuthLevel(intoken string, newAuthLevel int) (string, error) {
-	signerOptions := (&jose.SignerOptions{}).WithType("JWT")
-	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: state.Signer}, signerOptions)
+	parsedJWT, err := state.parseAuthJWT(intoken)
 	if err != nil {
 		return "", err
 	}
-
-	tok, err := jwt.ParseSigned(intoken)
-	if err != nil {
-		return "", err
-	}
-	parsedJWT := authInfoJWT{}
-	if err := state.JWTClaims(tok, &parsedJWT); err != nil {
-		logger.Printf("err=%s", err)
-		return "", err
-	}
-	issuer := state.idpGetIssuer()
-	if parsedJWT.Issuer != issuer || parsedJWT.TokenType != "keymaster_auth" ||
-		parsedJWT.NotBefore > time.Now().Unix() {
-		err = errors.New("invalid JWT values")
-		return "", err
-	}
 	parsedJWT.AuthType = newAuthLevel
-	return jwt.Signed(signer).Claims(parsedJWT).CompactSerialize()
+	return state.serializeAuthJWT(parsedJWT)
 }
 
 func (state *RuntimeState) genNewSerializedStorageStringDataJWT(username string, dataType int, data string, expiration int64) (string, error) {
 	signerOptions := (&jose.SignerOptions{}).WithType("JWT")
-	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: state.Signer}, signerOptions)
+	signer, err := state.newJWTSigner(signerOptions)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+const (
+	adminAPIEnrollmentTokenPath = "/admin/api/v1/enrollment-token"
+
+	defaultEnrollmentTokenLifetime = 24 * time.Hour
+	enrollmentTokenParam           = "enrollment_token"
+
+	// secondFactorAuthTypes are the auth types which prove a second factor.
+	secondFactorAuthTypes = AuthTypeU2F | AuthTypeSymantecVIP | AuthTypeTOTP |
+		AuthTypeWebAuthn | AuthTypeOkta2FA | AuthTypeRADIUS | AuthTypeDuo |
+		AuthTypeWebhook | AuthTypeRecoveryCode
+)
+
+var errEnrollmentStepUpRequired = errors.New(
+	"enrolling a second factor requires logging in with one or an enrollment token issued by an admin")
+
+// enrollmentToken lets a user register a security key without a second
+// factor. Only the hash of the secret is stored.
+type enrollmentToken struct {
+	SecretSHA256 []byte
+	CreatedBy    string
+	ExpiresAt    time.Time
+}
+
+type adminEnrollmentTokenResponse struct {
+	User      string    `json:"user"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (state *RuntimeState) getEnrollmentTokenLifetime() time.Duration {
+	if lifetime := state.Config.KeyEnrollment.TokenLifetime; lifetime > 0 {
+		return lifetime
+	}
+	return defaultEnrollmentTokenLifetime
+}
+
+// newEnrollmentToken sets a new enrollment token, replacing any previous
+// one, in profile and returns it.
+func newEnrollmentToken(profile *userProfile, admin string,
+	lifetime time.Duration, now time.Time) (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(secret)
+	profile.EnrollmentToken = &enrollmentToken{
+		SecretSHA256: hash[:],
+		CreatedBy:    admin,
+		ExpiresAt:    now.Add(lifetime),
+	}
+	return base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// checkEnrollmentToken checks token against the enrollment token of
+// profile.
+func checkEnrollmentToken(profile *userProfile, token string,
+	now time.Time) error {
+	storedToken := profile.EnrollmentToken
+	if storedToken == nil {
+		return errEnrollmentStepUpRequired
+	}
+	secret, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return errors.New("malformed enrollment token")
+	}
+	hash := sha256.Sum256(secret)
+	if subtle.ConstantTimeCompare(hash[:], storedToken.SecretSHA256) != 1 {
+		return errors.New("invalid enrollment token")
+	}
+	if now.After(storedToken.ExpiresAt) {
+		return fmt.Errorf("enrollment token expired at %s",
+			storedToken.ExpiresAt.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// checkKeyEnrollment returns an error if a session with loginLevel may not
+// register a security key, a TOTP device or recovery codes in profile. With
+// security_key_enrollment
+// require_step_up the session needs a second factor or the enrollment_token
+// query parameter must match the enrollment token of the profile. The bool
+// is true if the token was used, it must then be removed once the factor is
+// registered.
+func (state *RuntimeState) checkKeyEnrollment(r *http.Request,
+	loginLevel int, profile *userProfile, now time.Time) (bool, error) {
+	if !state.Config.KeyEnrollment.RequireStepUp ||
+		loginLevel&secondFactorAuthTypes != 0 {
+		return false, nil
+	}
+	// Not r.Form: it would consume the body of registration responses.
+	token := r.URL.Query().Get(enrollmentTokenParam)
+	if token == "" {
+		return false, errEnrollmentStepUpRequired
+	}
+	if err := checkEnrollmentToken(profile, token, now); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// writeKeyEnrollmentDenial writes the response for a denied second factor
+// registration.
+func (state *RuntimeState) writeKeyEnrollmentDenial(w http.ResponseWriter,
+	r *http.Request, authUser string, assumedUser string, err error) {
+	logger.Printf("second factor registration of %s by %s denied: %s",
+		assumedUser, authUser, err)
+	state.writeDenialResponse(w, r, http.StatusForbidden,
+		proto.DenialReasonInsufficientAuthLevel, err.Error())
+}
+
+// adminAPIEnrollmentTokenHandler issues an enrollment token for the user of
+// the "user" form value, which lets them register a security key without a
+// second factor until it expires. It replaces any previous token.
+func (state *RuntimeState) adminAPIEnrollmentTokenHandler(
+	w http.ResponseWriter, r *http.Request) {
+	authUser, ok := state.checkAdminAPIAuth(w, r, "POST")
+	if !ok {
+		return
+	}
+	username := state.reprocessUsername(r.Form.Get("user"))
+	if username == "" {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Missing user")
+		return
+	}
+	profile, _, fromCache, err := state.LoadUserProfile(username)
+	if err != nil {
+		logger.Printf("loading profile error: %v", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	if fromCache {
+		state.writeFailureResponse(w, r, http.StatusServiceUnavailable,
+			"db backend is offline for writes")
+		return
+	}
+	token, err := newEnrollmentToken(profile, authUser,
+		state.getEnrollmentTokenLifetime(), time.Now())
+	if err != nil {
+		logger.Println(err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	if err := state.SaveUserProfile(username, profile); err != nil {
+		logger.Printf("saving profile error: %v", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	logger.Printf("%s issued an enrollment token for %s", authUser, username)
+	state.logAuditAdminAction(r, authUser, "issue-enrollment-token", true,
+		map[string]string{"user": username})
+	writeAdminAPIResponse(w, adminEnrollmentTokenResponse{
+		User:      username,
+		Token:     token,
+		ExpiresAt: profile.EnrollmentToken.ExpiresAt,
+	})
+}
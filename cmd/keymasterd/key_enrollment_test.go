@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+func TestCheckKeyEnrollment(t *testing.T) {
+	state := &RuntimeState{}
+	profile := &userProfile{}
+	now := time.Now()
+	request := httptest.NewRequest("GET", "/u2f/RegisterRequest/alice", nil)
+	if _, err := state.checkKeyEnrollment(request, AuthTypePassword, profile,
+		now); err != nil {
+		t.Fatalf("enrollment denied without require_step_up: %s", err)
+	}
+	state.Config.KeyEnrollment.RequireStepUp = true
+	if _, err := state.checkKeyEnrollment(request, AuthTypePassword, profile,
+		now); err == nil {
+		t.Fatal("enrollment allowed with a password only")
+	}
+	usedToken, err := state.checkKeyEnrollment(request,
+		AuthTypePassword|AuthTypeTOTP, profile, now)
+	if err != nil {
+		t.Fatalf("enrollment denied with a second factor: %s", err)
+	}
+	if usedToken {
+		t.Fatal("token used with a second factor")
+	}
+	token, err := newEnrollmentToken(profile, "admin", time.Hour, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request = httptest.NewRequest("GET",
+		"/u2f/RegisterRequest/alice?enrollment_token="+token, nil)
+	usedToken, err = state.checkKeyEnrollment(request, AuthTypePassword,
+		profile, now)
+	if err != nil {
+		t.Fatalf("enrollment denied with a valid token: %s", err)
+	}
+	if !usedToken {
+		t.Fatal("token not used")
+	}
+	if _, err := state.checkKeyEnrollment(request, AuthTypePassword, profile,
+		now.Add(2*time.Hour)); err == nil {
+		t.Fatal("enrollment allowed with an expired token")
+	}
+	request = httptest.NewRequest("GET",
+		"/u2f/RegisterRequest/alice?enrollment_token=AAAA", nil)
+	if _, err := state.checkKeyEnrollment(request, AuthTypePassword, profile,
+		now); err == nil {
+		t.Fatal("enrollment allowed with an invalid token")
+	}
+}
+
+// TestKeyEnrollmentRequiredForOtherFactors checks that TOTP devices and
+// recovery codes, which are second factors too, cannot be added with a
+// password only.
+func TestKeyEnrollmentRequiredForOtherFactors(t *testing.T) {
+	state, authCookie := setupRecoveryCodesTestState(t)
+	state.Config.Base.EnableLocalTOTP = true
+	state.Config.KeyEnrollment.RequireStepUp = true
+	for path, handler := range map[string]http.HandlerFunc{
+		proto.TOTPEnrollPath:       state.totpEnrollHandler,
+		totpGeneratNewPath:         state.GenerateNewTOTP,
+		proto.TOTPEnrollVerifyPath: state.totpEnrollVerifyHandler,
+		proto.RecoveryCodesPath:    state.recoveryCodesHandler,
+	} {
+		req, err := http.NewRequest("POST", path,
+			strings.NewReader("OTP=123456"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(authCookie)
+		if _, err := checkRequestHandlerCode(req, handler,
+			http.StatusForbidden); err != nil {
+			t.Fatalf("%s: %s", path, err)
+		}
+	}
+	profile, _, _, err := state.LoadUserProfile("username")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := newEnrollmentToken(profile, "admin", time.Hour, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := state.SaveUserProfile("username", profile); err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST",
+		proto.RecoveryCodesPath+"?enrollment_token="+token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(authCookie)
+	_, err = checkRequestHandlerCode(req, state.recoveryCodesHandler,
+		http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile, _, _, err = state.LoadUserProfile("username")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profile.RecoveryCodes) < 1 || profile.EnrollmentToken != nil {
+		t.Fatal("recovery codes not created with the enrollment token")
+	}
+}
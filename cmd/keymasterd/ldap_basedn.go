@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/authutil"
+)
+
+const ldapDiscoveryTimeoutSecs = 2
+
+// ldapDiscoveryRetryInterval is how long a failure to discover the base DNs
+// of a server is cached.
+const ldapDiscoveryRetryInterval = time.Minute
+
+// discoveredLdapBaseDNs are the naming contexts of a server. If retryAt is
+// set, discovery failed and is tried again after it.
+type discoveredLdapBaseDNs struct {
+	baseDNs []string
+	retryAt time.Time
+}
+
+// suggestLdapBaseDNs queries the RootDSE of the server at ldapUrl for its
+// naming contexts. It is used by the config wizard to propose search bases.
+func suggestLdapBaseDNs(ldapUrl string, bindDN string,
+	bindPassword string) ([]string, error) {
+	u, err := authutil.ParseLDAPURL(ldapUrl)
+	if err != nil {
+		return nil, err
+	}
+	return authutil.GetLDAPNamingContexts(*u, bindDN, bindPassword,
+		ldapDiscoveryTimeoutSecs, nil)
+}
+
+// getLdapSearchBaseDNs returns the configured user and group search bases.
+// If either is not configured, the naming contexts of the server at u are
+// discovered and used as the default. Discovered bases are cached per server.
+func (state *RuntimeState) getLdapSearchBaseDNs(u url.URL) (
+	userBaseDNs []string, groupBaseDNs []string) {
+	ldapConfig := state.Config.UserInfo.Ldap
+	userBaseDNs = ldapConfig.UserSearchBaseDNs
+	groupBaseDNs = ldapConfig.GroupSearchBaseDNs
+	needGroupBase := len(groupBaseDNs) < 1 && ldapConfig.GroupSearchFilter != ""
+	if len(userBaseDNs) > 0 && !needGroupBase {
+		return userBaseDNs, groupBaseDNs
+	}
+	discovered := state.getDiscoveredLdapBaseDNs(u)
+	if len(discovered) < 1 {
+		return userBaseDNs, groupBaseDNs
+	}
+	if len(userBaseDNs) < 1 {
+		userBaseDNs = discovered
+	}
+	if needGroupBase {
+		groupBaseDNs = discovered
+	}
+	return userBaseDNs, groupBaseDNs
+}
+
+// getDiscoveredLdapBaseDNs returns the naming contexts of the server at u.
+// The lock is not held while the server is queried, so a slow server does
+// not hold up lookups for others. Failures are cached for a short time.
+func (state *RuntimeState) getDiscoveredLdapBaseDNs(u url.URL) []string {
+	state.ldapBaseDNsMutex.Lock()
+	discovered, ok := state.ldapDiscoveredBaseDNs[u.Host]
+	state.ldapBaseDNsMutex.Unlock()
+	if ok && (discovered.retryAt.IsZero() ||
+		time.Now().Before(discovered.retryAt)) {
+		return discovered.baseDNs
+	}
+	ldapConfig := state.Config.UserInfo.Ldap
+	baseDNs, err := authutil.GetLDAPNamingContexts(u, ldapConfig.BindUsername,
+		ldapConfig.BindPassword, ldapDiscoveryTimeoutSecs, nil)
+	if err != nil {
+		logger.Printf("Failed to discover LDAP base DNs for %s: %s",
+			u.Host, err)
+		discovered = discoveredLdapBaseDNs{
+			retryAt: time.Now().Add(ldapDiscoveryRetryInterval),
+		}
+	} else {
+		logger.Printf("Using discovered LDAP base DNs for %s: %s", u.Host,
+			strings.Join(baseDNs, "; "))
+		discovered = discoveredLdapBaseDNs{baseDNs: baseDNs}
+	}
+	state.ldapBaseDNsMutex.Lock()
+	defer state.ldapBaseDNsMutex.Unlock()
+	if state.ldapDiscoveredBaseDNs == nil {
+		state.ldapDiscoveredBaseDNs = make(map[string]discoveredLdapBaseDNs)
+	}
+	state.ldapDiscoveredBaseDNs[u.Host] = discovered
+	return discovered.baseDNs
+}
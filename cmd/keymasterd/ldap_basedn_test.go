@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestGetDiscoveredLdapBaseDNsCachesFailure(t *testing.T) {
+	var state RuntimeState
+	u := url.URL{Scheme: "ldap", Host: "127.0.0.1:1"}
+	if baseDNs := state.getDiscoveredLdapBaseDNs(u); baseDNs != nil {
+		t.Fatalf("unexpected base DNs: %v", baseDNs)
+	}
+	discovered, ok := state.ldapDiscoveredBaseDNs[u.Host]
+	if !ok || discovered.retryAt.Before(time.Now()) {
+		t.Fatalf("failure not cached: %+v", discovered)
+	}
+	// A success cached meanwhile is used until the next restart.
+	state.ldapDiscoveredBaseDNs[u.Host] = discoveredLdapBaseDNs{
+		baseDNs: []string{"dc=example,dc=com"},
+	}
+	baseDNs := state.getDiscoveredLdapBaseDNs(u)
+	if len(baseDNs) != 1 || baseDNs[0] != "dc=example,dc=com" {
+		t.Fatalf("cached base DNs not used: %v", baseDNs)
+	}
+	// An expired failure is retried.
+	state.ldapDiscoveredBaseDNs[u.Host] = discoveredLdapBaseDNs{
+		retryAt: time.Now().Add(-time.Second),
+	}
+	state.getDiscoveredLdapBaseDNs(u)
+	if !state.ldapDiscoveredBaseDNs[u.Host].retryAt.After(time.Now()) {
+		t.Fatal("expired failure not retried")
+	}
+}
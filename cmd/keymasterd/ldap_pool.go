@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/Cloud-Foundations/keymaster/lib/authutil"
+)
+
+const ldapUserInfoTimeoutSecs = 2
+
+// getLdapPool returns the pool of connections to the LDAP user info
+// servers, creating it on first use.
+func (state *RuntimeState) getLdapPool() *authutil.LDAPPool {
+	state.ldapPoolMutex.Lock()
+	defer state.ldapPoolMutex.Unlock()
+	if state.ldapPool != nil {
+		return state.ldapPool
+	}
+	ldapConfig := state.Config.UserInfo.Ldap
+	var urls []url.URL
+	for _, ldapUrl := range strings.Split(ldapConfig.LDAPTargetURLs, ",") {
+		if len(ldapUrl) < 1 {
+			continue
+		}
+		u, err := authutil.ParseLDAPURLWithStartTLS(ldapUrl,
+			ldapConfig.AllowStartTLS)
+		if err != nil {
+			logger.Printf("Failed to parse ldapurl '%s'", ldapUrl)
+			continue
+		}
+		urls = append(urls, *u)
+	}
+	state.ldapPool = authutil.NewLDAPPool(authutil.LDAPPoolConfig{
+		URLs:          urls,
+		BindDN:        ldapConfig.BindUsername,
+		BindPassword:  ldapConfig.BindPassword,
+		TimeoutSecs:   ldapUserInfoTimeoutSecs,
+		SearchBaseDNs: state.getLdapSearchBaseDNs,
+		Groups: authutil.LDAPGroupConfig{
+			Attribute: ldapConfig.GroupAttribute,
+			Lowercase: ldapConfig.LowercaseGroups,
+			FilterRE:  state.ldapGroupFilterRE,
+		},
+		MaxIdleConnections:  ldapConfig.MaxIdleConnections,
+		HealthCheckInterval: ldapConfig.HealthCheckInterval,
+		NestedGroupDepth:    ldapConfig.NestedGroupDepth,
+	})
+	return state.ldapPool
+}
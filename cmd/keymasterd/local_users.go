@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/pwauth/localusers"
+)
+
+const (
+	adminAPILocalUsersPath         = "/admin/api/v1/local-users"
+	adminAPILocalUserPasswordPath  = "/admin/api/v1/local-user-password"
+	adminAPILocalUserDisabledPath  = "/admin/api/v1/local-user-disabled"
+	adminAPILocalUserGroupsPath    = "/admin/api/v1/local-user-groups"
+	adminAPIDeleteLocalUserPath    = "/admin/api/v1/delete-local-user"
+	generatedLocalUserPasswordSize = 18
+)
+
+type adminLocalUser struct {
+	User      string    `json:"user"`
+	Groups    []string  `json:"groups,omitempty"`
+	Disabled  bool      `json:"disabled,omitempty"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedBy string    `json:"updated_by"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Password is only set if it was generated for the request.
+	Password string `json:"password,omitempty"`
+}
+
+func getAdminLocalUser(user *localusers.User) adminLocalUser {
+	return adminLocalUser{
+		User:      user.Username,
+		Groups:    user.Groups,
+		Disabled:  user.Disabled,
+		CreatedBy: user.CreatedBy,
+		CreatedAt: user.CreatedAt,
+		UpdatedBy: user.UpdatedBy,
+		UpdatedAt: user.UpdatedAt,
+	}
+}
+
+// getLocalUserGroups returns the groups of the local user username. The
+// bool is false if username is not a local user.
+func (state *RuntimeState) getLocalUserGroups(username string) (
+	bool, []string, error) {
+	if state.localUsers == nil {
+		return false, nil, nil
+	}
+	ok, groups, err := state.localUsers.GetUserGroups(username)
+	if err != nil {
+		logger.Printf("cannot load local user %s: %s", username, err)
+		return false, nil, nil
+	}
+	return ok, groups, nil
+}
+
+// getLocalUserPassword returns the "password" form value or, if it is
+// empty, a new random password. The bool is true for generated passwords.
+func getLocalUserPassword(r *http.Request) ([]byte, bool, error) {
+	if password := r.Form.Get("password"); password != "" {
+		return []byte(password), false, nil
+	}
+	randomBytes := make([]byte, generatedLocalUserPasswordSize)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return nil, false, err
+	}
+	return []byte(base64.RawURLEncoding.EncodeToString(randomBytes)), true,
+		nil
+}
+
+// writeLocalUserError writes the response for errors of the local user
+// database.
+func (state *RuntimeState) writeLocalUserError(w http.ResponseWriter,
+	r *http.Request, err error) {
+	switch err {
+	case localusers.ErrUnknownUser:
+		state.writeFailureResponse(w, r, http.StatusNotFound,
+			"Unknown local user")
+	case localusers.ErrUserExists:
+		state.writeFailureResponse(w, r, http.StatusConflict,
+			"Local user exists")
+	default:
+		logger.Printf("Local user database error: %v", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+	}
+}
+
+// adminAPILocalUsersHandler shows the local user of the "user" form value
+// (GET) or creates it (POST) with the "group" form values and the
+// "password" form value. If no password is given one is generated and
+// returned.
+func (state *RuntimeState) adminAPILocalUsersHandler(
+	w http.ResponseWriter, r *http.Request) {
+	method := "GET"
+	if r.Method == "POST" {
+		method = "POST"
+	}
+	authUser, ok := state.checkAdminAPIAuth(w, r, method)
+	if !ok {
+		return
+	}
+	username := state.reprocessUsername(r.Form.Get("user"))
+	if username == "" {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Missing user")
+		return
+	}
+	if method == "GET" {
+		user, ok, err := state.localUsers.GetUser(username)
+		if err == nil && !ok {
+			err = localusers.ErrUnknownUser
+		}
+		if err != nil {
+			state.writeLocalUserError(w, r, err)
+			return
+		}
+		writeAdminAPIResponse(w, getAdminLocalUser(user))
+		return
+	}
+	password, generated, err := getLocalUserPassword(r)
+	if err != nil {
+		logger.Println(err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	user, err := state.localUsers.CreateUser(username, password,
+		r.Form["group"], authUser)
+	if err != nil {
+		state.writeLocalUserError(w, r, err)
+		return
+	}
+	logger.Printf("%s created local user %s", authUser, username)
+	state.logAuditAdminAction(r, authUser, "create-local-user", true,
+		map[string]string{
+			"user":   username,
+			"groups": strings.Join(user.Groups, ","),
+		})
+	response := getAdminLocalUser(user)
+	if generated {
+		response.Password = string(password)
+	}
+	writeAdminAPIResponse(w, response)
+}
+
+// adminAPILocalUserPasswordHandler sets the password of the local user of
+// the "user" form value to the "password" form value, or to a generated
+// password which is returned.
+func (state *RuntimeState) adminAPILocalUserPasswordHandler(
+	w http.ResponseWriter, r *http.Request) {
+	authUser, ok := state.checkAdminAPIAuth(w, r, "POST")
+	if !ok {
+		return
+	}
+	username := state.reprocessUsername(r.Form.Get("user"))
+	password, generated, err := getLocalUserPassword(r)
+	if err != nil {
+		logger.Println(err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	user, err := state.localUsers.SetPassword(username, password, authUser)
+	if err != nil {
+		state.writeLocalUserError(w, r, err)
+		return
+	}
+	logger.Printf("%s set the password of local user %s", authUser, username)
+	state.logAuditAdminAction(r, authUser, "set-local-user-password", true,
+		map[string]string{"user": username})
+	response := getAdminLocalUser(user)
+	if generated {
+		response.Password = string(password)
+	}
+	writeAdminAPIResponse(w, response)
+}
+
+// adminAPILocalUserDisabledHandler disables or enables the local user of
+// the "user" form value as given by the boolean "disabled" form value.
+func (state *RuntimeState) adminAPILocalUserDisabledHandler(
+	w http.ResponseWriter, r *http.Request) {
+	authUser, ok := state.checkAdminAPIAuth(w, r, "POST")
+	if !ok {
+		return
+	}
+	username := state.reprocessUsername(r.Form.Get("user"))
+	disabled, err := strconv.ParseBool(r.Form.Get("disabled"))
+	if err != nil {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Invalid disabled value")
+		return
+	}
+	user, err := state.localUsers.SetDisabled(username, disabled, authUser)
+	if err != nil {
+		state.writeLocalUserError(w, r, err)
+		return
+	}
+	logger.Printf("%s set disabled of local user %s to %v", authUser,
+		username, disabled)
+	state.logAuditAdminAction(r, authUser, "set-local-user-disabled", true,
+		map[string]string{
+			"user":     username,
+			"disabled": strconv.FormatBool(disabled),
+		})
+	writeAdminAPIResponse(w, getAdminLocalUser(user))
+}
+
+// adminAPILocalUserGroupsHandler replaces the groups of the local user of
+// the "user" form value with the "group" form values.
+func (state *RuntimeState) adminAPILocalUserGroupsHandler(
+	w http.ResponseWriter, r *http.Request) {
+	authUser, ok := state.checkAdminAPIAuth(w, r, "POST")
+	if !ok {
+		return
+	}
+	username := state.reprocessUsername(r.Form.Get("user"))
+	user, err := state.localUsers.SetGroups(username, r.Form["group"],
+		authUser)
+	if err != nil {
+		state.writeLocalUserError(w, r, err)
+		return
+	}
+	logger.Printf("%s set the groups of local user %s", authUser, username)
+	state.logAuditAdminAction(r, authUser, "set-local-user-groups", true,
+		map[string]string{
+			"user":   username,
+			"groups": strings.Join(user.Groups, ","),
+		})
+	writeAdminAPIResponse(w, getAdminLocalUser(user))
+}
+
+// adminAPIDeleteLocalUserHandler deletes the local user of the "user" form
+// value.
+func (state *RuntimeState) adminAPIDeleteLocalUserHandler(
+	w http.ResponseWriter, r *http.Request) {
+	authUser, ok := state.checkAdminAPIAuth(w, r, "POST")
+	if !ok {
+		return
+	}
+	username := state.reprocessUsername(r.Form.Get("user"))
+	user, ok, err := state.localUsers.GetUser(username)
+	if err == nil && !ok {
+		err = localusers.ErrUnknownUser
+	}
+	if err == nil {
+		err = state.localUsers.DeleteUser(username)
+	}
+	if err != nil {
+		state.writeLocalUserError(w, r, err)
+		return
+	}
+	logger.Printf("%s deleted local user %s", authUser, username)
+	state.logAuditAdminAction(r, authUser, "delete-local-user", true,
+		map[string]string{"user": username})
+	writeAdminAPIResponse(w, getAdminLocalUser(user))
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/Cloud-Foundations/keymaster/lib/pwauth/localusers"
+	"github.com/Cloud-Foundations/keymaster/lib/simplestorage/memstore"
+)
+
+func TestLocalUserGroupsAndPassword(t *testing.T) {
+	state, passwdFile, err := setupValidRuntimeStateSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(passwdFile.Name())
+	state.localUsers, err = localusers.New(memstore.New(), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.passwordChecker, err = state.newPasswordChecker(state.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = state.localUsers.CreateUser("alice", []byte("secret"),
+		[]string{"ops"}, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups, err := state.getUserGroups("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 || groups[0] != "ops" {
+		t.Fatalf("unexpected groups: %v", groups)
+	}
+	valid, err := checkUserPassword("alice", "secret", state.Config,
+		state.passwordChecker, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !valid {
+		t.Fatal("local user password not accepted")
+	}
+	if _, err := state.localUsers.SetDisabled("alice", true,
+		"admin"); err != nil {
+		t.Fatal(err)
+	}
+	valid, err = checkUserPassword("alice", "secret", state.Config,
+		state.passwordChecker, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valid {
+		t.Fatal("disabled local user accepted")
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"github.com/Cloud-Foundations/Dominator/lib/log/debuglogger"
 	"github.com/Cloud-Foundations/keymaster/keymasterd/eventnotifier"
 	"github.com/Cloud-Foundations/keymaster/lib/instrumentedwriter"
+	"github.com/Cloud-Foundations/keymaster/lib/sharedstate"
 	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
 )
 
@@ -228,6 +229,7 @@ func setupValidRuntimeStateSigner() (*RuntimeState, *os.File, error) {
 	state.Config.Base.HtpasswdFilename = passwdFile.Name()
 
 	state.totpLocalRateLimit = make(map[string]totpRateLimitInfo)
+	state.sharedState = sharedstate.NewMemoryStore()
 	return &state, passwdFile, nil
 }
 
@@ -256,7 +258,7 @@ func TestSuccessFullSigningSSH(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	cookieVal, err := state.setNewAuthCookie(nil, "username", AuthTypeU2F)
+	cookieVal, err := state.setNewAuthCookie(nil, nil, "username", AuthTypeU2F)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -294,7 +296,7 @@ func TestSuccessFullSigningX509(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	cookieVal, err := state.setNewAuthCookie(nil, "username", AuthTypeU2F)
+	cookieVal, err := state.setNewAuthCookie(nil, nil, "username", AuthTypeU2F)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -332,7 +334,7 @@ func TestSuccessFullSigningX509BadLDAPNoGroups(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	cookieVal, err := state.setNewAuthCookie(nil, "username", AuthTypeU2F)
+	cookieVal, err := state.setNewAuthCookie(nil, nil, "username", AuthTypeU2F)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -370,7 +372,7 @@ func TestFailFullSigningX509GroupsBadLDAPNoGroups(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	cookieVal, err := state.setNewAuthCookie(nil, "username", AuthTypeU2F)
+	cookieVal, err := state.setNewAuthCookie(nil, nil, "username", AuthTypeU2F)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -408,7 +410,7 @@ func TestFailCertgenDurationTooLong(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	cookieVal, err := state.setNewAuthCookie(nil, "username", AuthTypeU2F)
+	cookieVal, err := state.setNewAuthCookie(nil, nil, "username", AuthTypeU2F)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -458,7 +460,7 @@ func TestFailSingingExpiredCookie(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	cookieVal, err := state.setNewAuthCookie(nil, "username", AuthTypeU2F)
+	cookieVal, err := state.setNewAuthCookie(nil, nil, "username", AuthTypeU2F)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -494,7 +496,7 @@ func TestFailSinginUnexpectedCookie(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	_, err = state.setNewAuthCookie(nil, "username", AuthTypeU2F)
+	_, err = state.setNewAuthCookie(nil, nil, "username", AuthTypeU2F)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -543,7 +545,7 @@ func TestInjectingSecret(t *testing.T) {
 		t.Fatal(err)
 	}
 	/*
-		cookieVal, err := state.setNewAuthCookie(nil, "username", AuthTypeU2F)
+		cookieVal, err := state.setNewAuthCookie(nil, nil, "username", AuthTypeU2F)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -594,7 +596,7 @@ func TestInjectingSecret(t *testing.T) {
 		t.Errorf("The signer should now be loaded")
 	}
 
-	cookieVal, err = state.setNewAuthCookie(nil, "username", AuthTypeU2F)
+	cookieVal, err = state.setNewAuthCookie(nil, nil, "username", AuthTypeU2F)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -785,6 +787,10 @@ func TestLoginAPIFormAuth(t *testing.T) {
 		t.Fatal(err)
 	}
 	t.Logf("loginResponse='%+v'", loginResponse)
+	if len(loginResponse.SupportedKeyTypes) != len(supportedKeyTypes) {
+		t.Fatalf("unexpected supported key types: %v",
+			loginResponse.SupportedKeyTypes)
+	}
 
 	// now we check for failed auth
 	for _, testVector := range loginFailValues {
@@ -810,6 +816,30 @@ func TestLoginAPIFormAuth(t *testing.T) {
 	}
 }
 
+func TestAuthJWTCAKeyTypes(t *testing.T) {
+	for _, keyType := range supportedKeyTypes {
+		var state RuntimeState
+		signer, _, err := generateCAKey(keyType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		state.Signer = signer
+		state.signerPublicKeyToKeymasterKeys()
+		token, err := state.genNewSerializedAuthJWT(validUsernameConst,
+			AuthTypePassword)
+		if err != nil {
+			t.Fatalf("%s: %s", keyType, err)
+		}
+		info, err := state.getAuthInfoFromAuthJWT(token)
+		if err != nil {
+			t.Fatalf("%s: %s", keyType, err)
+		}
+		if info.Username != validUsernameConst {
+			t.Fatalf("%s: unexpected username %s", keyType, info.Username)
+		}
+	}
+}
+
 func TestProfileHandlerTemplate(t *testing.T) {
 	var state RuntimeState
 	//load signer
@@ -841,7 +871,7 @@ func TestProfileHandlerTemplate(t *testing.T) {
 		t.Fatal(err)
 		//return nil, err
 	}
-	cookieVal, err := state.setNewAuthCookie(nil, "username", AuthTypeAny)
+	cookieVal, err := state.setNewAuthCookie(nil, nil, "username", AuthTypeAny)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -877,7 +907,7 @@ func TestU2fTokenManagerHandlerUpdateSuccess(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	cookieVal, err := state.setNewAuthCookie(nil, "username", AuthTypeAny)
+	cookieVal, err := state.setNewAuthCookie(nil, nil, "username", AuthTypeAny)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -934,7 +964,7 @@ func TestU2fTokenManagerHandlerDeleteNotAdmin(t *testing.T) {
 	state.Signer = signer
 
 	// login as user username
-	cookieVal, err := state.setNewAuthCookie(nil, "username", AuthTypeAny)
+	cookieVal, err := state.setNewAuthCookie(nil, nil, "username", AuthTypeAny)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1001,7 +1031,7 @@ func TestU2fTokenManagerHandlerDeleteSuccess(t *testing.T) {
 	state.Signer = signer
 	state.signerPublicKeyToKeymasterKeys()
 
-	cookieVal, err := state.setNewAuthCookie(nil, "username", AuthTypeAny)
+	cookieVal, err := state.setNewAuthCookie(nil, nil, "username", AuthTypeAny)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/pwauth"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricsPath serves the Prometheus metrics on the admin port. It is the
+// conventional name for /prometheus_metrics, which is kept for existing
+// scrape configurations.
+const metricsPath = "/metrics"
+
+var (
+	passwordLoginCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "keymaster_password_login_counter",
+			Help: "Password login attempts per backend.",
+		},
+		[]string{"backend", "result"},
+	)
+	certIssuanceDurationHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "keymaster_certificate_issuance_duration_seconds",
+			Help:    "Time to sign and record a certificate in seconds.",
+			Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		},
+		[]string{"type"},
+	)
+	storageErrorCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "keymaster_storage_error_counter",
+			Help: "Storage errors and primary DB timeouts.",
+		},
+		[]string{"operation"},
+	)
+	lockoutCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "keymaster_lockout_counter",
+			Help: "Lockouts after failed password and OTP attempts.",
+		},
+		[]string{"type"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(passwordLoginCounter)
+	prometheus.MustRegister(certIssuanceDurationHistogram)
+	prometheus.MustRegister(storageErrorCounter)
+	prometheus.MustRegister(lockoutCounter)
+}
+
+// metricLogPasswordLogin records a password login attempt to backend. The
+// result is "true", "false" or "error".
+func metricLogPasswordLogin(backend string, result string) {
+	passwordLoginCounter.WithLabelValues(backend, result).Inc()
+}
+
+func metricLogCertIssuanceDuration(certType string, duration time.Duration) {
+	certIssuanceDurationHistogram.WithLabelValues(certType).Observe(
+		duration.Seconds())
+}
+
+// metricLogStorageError records a failed storage operation. The operation
+// is "read", "save" or "timeout" (the primary DB was too slow and the
+// cache DB was used).
+func metricLogStorageError(operation string) {
+	storageErrorCounter.WithLabelValues(operation).Inc()
+}
+
+// metricLogLockout records a lockout of a "user" or "address".
+func metricLogLockout(lockoutType string) {
+	lockoutCounter.WithLabelValues(lockoutType).Inc()
+}
+
+// instrumentedPasswordAuthenticator records the login attempts and round
+// trip times of a password backend.
+type instrumentedPasswordAuthenticator struct {
+	pwauth.PasswordAuthenticator
+	name string
+}
+
+func newInstrumentedPasswordAuthenticator(name string,
+	authenticator pwauth.PasswordAuthenticator) pwauth.PasswordAuthenticator {
+	return &instrumentedPasswordAuthenticator{
+		PasswordAuthenticator: authenticator,
+		name:                  name,
+	}
+}
+
+func (pa *instrumentedPasswordAuthenticator) PasswordAuthenticate(
+	username string, password []byte) (bool, error) {
+	valid, _, err := pa.PasswordAuthenticateWithStatus(username, password)
+	return valid, err
+}
+
+func (pa *instrumentedPasswordAuthenticator) PasswordAuthenticateWithStatus(
+	username string, password []byte) (bool, pwauth.PasswordStatus, error) {
+	start := time.Now()
+	valid, status, err := pwauth.PasswordAuthenticateWithStatus(
+		pa.PasswordAuthenticator, username, password)
+	if err != nil {
+		metricLogPasswordLogin(pa.name, "error")
+		return false, pwauth.PasswordStatus{}, err
+	}
+	metricLogExternalServiceDuration(pa.name, time.Since(start))
+	metricLogPasswordLogin(pa.name, strconv.FormatBool(valid))
+	return valid, status, nil
+}
+
+func (pa *instrumentedPasswordAuthenticator) ChangePassword(username string,
+	oldPassword []byte, newPassword []byte) error {
+	return pwauth.ChangePassword(pa.PasswordAuthenticator, username,
+		oldPassword, newPassword)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Cloud-Foundations/keymaster/lib/simplestorage"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type testPasswordAuthenticator struct {
+	valid bool
+	err   error
+}
+
+func (pa *testPasswordAuthenticator) PasswordAuthenticate(username string,
+	password []byte) (bool, error) {
+	return pa.valid, pa.err
+}
+
+func (pa *testPasswordAuthenticator) UpdateStorage(
+	storage simplestorage.SimpleStore) error {
+	return nil
+}
+
+func TestInstrumentedPasswordAuthenticator(t *testing.T) {
+	for _, test := range []struct {
+		authenticator *testPasswordAuthenticator
+		result        string
+	}{
+		{&testPasswordAuthenticator{valid: true}, "true"},
+		{&testPasswordAuthenticator{}, "false"},
+		{&testPasswordAuthenticator{err: errors.New("unreachable")}, "error"},
+	} {
+		counter := passwordLoginCounter.WithLabelValues("test", test.result)
+		before := testutil.ToFloat64(counter)
+		pa := newInstrumentedPasswordAuthenticator("test", test.authenticator)
+		valid, err := pa.PasswordAuthenticate("user", []byte("password"))
+		if valid != test.authenticator.valid || err != test.authenticator.err {
+			t.Fatalf("unexpected result: %v, %v", valid, err)
+		}
+		if after := testutil.ToFloat64(counter); after != before+1 {
+			t.Fatalf("%s: counter is %v, expected %v", test.result, after,
+				before+1)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/auditlog"
+	"github.com/Cloud-Foundations/keymaster/lib/notify"
+)
+
+// maxLoginAddresses limits the addresses remembered per user for new
+// address notifications. The least recently seen one is forgotten first.
+const maxLoginAddresses = 32
+
+// formatAuditEventText returns the fields of event, one per line.
+func formatAuditEventText(event auditlog.Event) string {
+	lines := []string{"User: " + event.Username}
+	if event.Method != "" {
+		lines = append(lines, "Method: "+event.Method)
+	}
+	if event.RemoteAddr != "" {
+		lines = append(lines, "Address: "+event.RemoteAddr)
+	}
+	if !event.Time.IsZero() {
+		lines = append(lines, "Time: "+event.Time.Format(time.RFC3339))
+	}
+	keys := make([]string, 0, len(event.Details))
+	for key := range event.Details {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		lines = append(lines, key+": "+event.Details[key])
+	}
+	return strings.Join(lines, "\n")
+}
+
+// hasUnusualPrincipals returns true if the issue event is for a certificate
+// with SSH principals other than the username, or with X.509 SANs.
+func hasUnusualPrincipals(event auditlog.Event) bool {
+	if event.Details["x509_sans"] != "" {
+		return true
+	}
+	principals := event.Details["ssh_principals"]
+	if principals == "" {
+		return false
+	}
+	for _, principal := range strings.Split(principals, ",") {
+		if principal != event.Username {
+			return true
+		}
+	}
+	return false
+}
+
+// getAuditEventNotification returns the notification of event, or nil if
+// it is not notified.
+func getAuditEventNotification(event auditlog.Event) *notify.Notification {
+	notification := &notify.Notification{
+		Time:     event.Time,
+		Username: event.Username,
+	}
+	switch event.Type {
+	case auditlog.EventTypeEnrollment:
+		notification.Event = notify.EventEnrollment
+		notification.Subject = fmt.Sprintf("%s registered a %s second factor",
+			event.Username, event.Method)
+	case auditlog.EventTypeLoginAnomaly:
+		notification.Event = notify.EventNewLocation
+		notification.Subject = fmt.Sprintf(
+			"Login of %s from an unusual location", event.Username)
+	case auditlog.EventTypeIssue:
+		if !hasUnusualPrincipals(event) {
+			return nil
+		}
+		principals := event.Details["ssh_principals"]
+		if principals == "" {
+			principals = event.Details["x509_sans"]
+		}
+		notification.Event = notify.EventUnusualPrincipals
+		notification.Subject = fmt.Sprintf("%s certificate of %s for %s",
+			event.Method, event.Username, principals)
+	case auditlog.EventTypeCertApproval:
+		notification.Event = notify.EventCertApproval
+		requester := event.Details["requester"]
+		switch event.Method {
+		case "request":
+			notification.Subject = fmt.Sprintf(
+				"Approval needed: %s certificate of %s for %s",
+				event.Details["cert_type"], requester,
+				event.Details["needs_approval"])
+		case "approve":
+			notification.Subject = fmt.Sprintf(
+				"%s approved the certificate request of %s", event.Username,
+				requester)
+		case "deny":
+			notification.Subject = fmt.Sprintf(
+				"%s denied the certificate request of %s", event.Username,
+				requester)
+		default:
+			return nil
+		}
+	case auditlog.EventTypeBreakGlass:
+		notification.Event = notify.EventBreakGlass
+		switch event.Method {
+		case "vote":
+			notification.Subject = fmt.Sprintf(
+				"%s voted for break glass issuance", event.Username)
+		case "activate":
+			notification.Subject = fmt.Sprintf(
+				"Break glass issuance active until %s",
+				event.Details["active_until"])
+		case "deactivate":
+			notification.Subject = fmt.Sprintf(
+				"%s ended break glass issuance", event.Username)
+		case "expire":
+			notification.Subject = "Break glass issuance ended"
+		case "login":
+			notification.Subject = fmt.Sprintf("Break glass login of %s",
+				event.Username)
+		default:
+			return nil
+		}
+	case auditlog.EventTypeAdmin:
+		notification.Event = notify.EventAdmin
+		notification.Subject = fmt.Sprintf("Admin %s: %s", event.Username,
+			event.Method)
+		if !event.Success {
+			notification.Subject += " (failed)"
+		}
+	default:
+		return nil
+	}
+	notification.Text = formatAuditEventText(event)
+	return notification
+}
+
+// notifyAuditEvent sends the notification of event, if any.
+func (state *RuntimeState) notifyAuditEvent(event auditlog.Event) {
+	if state.notifier == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if notification := getAuditEventNotification(event); notification != nil {
+		state.notifier.Notify(*notification)
+	}
+}
+
+// checkLoginAddress sends a new location notification if username did not
+// log in from the client address of r before, and remembers the address.
+// The first login of a user is not notified.
+func (state *RuntimeState) checkLoginAddress(r *http.Request,
+	username string) {
+	if state.notifier == nil {
+		return
+	}
+	address := getClientAddress(r)
+	now := time.Now()
+	var isNew bool
+	err := state.UpdateUserProfile(username,
+		func(profile *userProfile) (bool, error) {
+			lastSeen, ok := profile.LoginAddresses[address]
+			if ok && now.Sub(lastSeen) < time.Hour {
+				return false, nil
+			}
+			isNew = !ok && len(profile.LoginAddresses) > 0
+			if profile.LoginAddresses == nil {
+				profile.LoginAddresses = make(map[string]time.Time)
+			}
+			profile.LoginAddresses[address] = now
+			for len(profile.LoginAddresses) > maxLoginAddresses {
+				var oldest string
+				for address, lastSeen := range profile.LoginAddresses {
+					if oldest == "" ||
+						lastSeen.Before(profile.LoginAddresses[oldest]) {
+						oldest = address
+					}
+				}
+				delete(profile.LoginAddresses, oldest)
+			}
+			return true, nil
+		})
+	if err != nil {
+		logger.Printf("cannot record login address of %s: %s", username, err)
+		return
+	}
+	if !isNew {
+		return
+	}
+	state.notifier.Notify(notify.Notification{
+		Time:     now,
+		Event:    notify.EventNewLocation,
+		Username: username,
+		Subject:  fmt.Sprintf("Login of %s from %s", username, address),
+		Text: formatAuditEventText(auditlog.Event{
+			Time:       now,
+			Username:   username,
+			RemoteAddr: r.RemoteAddr,
+			Details:    map[string]string{"new_address": address},
+		}),
+	})
+}
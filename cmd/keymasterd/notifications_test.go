@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Cloud-Foundations/keymaster/lib/auditlog"
+	"github.com/Cloud-Foundations/keymaster/lib/notify"
+)
+
+func TestGetAuditEventNotification(t *testing.T) {
+	for _, test := range []struct {
+		event   auditlog.Event
+		notify  string // Empty if not notified.
+		subject string
+	}{
+		{auditlog.Event{Type: auditlog.EventTypeEnrollment, Username: "alice",
+			Success: true, Method: "U2F"}, notify.EventEnrollment,
+			"alice registered a U2F second factor"},
+		{auditlog.Event{Type: auditlog.EventTypeLoginAnomaly,
+			Username: "alice", Success: true,
+			Details: map[string]string{"country": "JP"}},
+			notify.EventNewLocation, "Login of alice from an unusual location"},
+		{auditlog.Event{Type: auditlog.EventTypeIssue, Username: "alice",
+			Success: true, Method: "ssh",
+			Details: map[string]string{"ssh_principals": "alice"}}, "", ""},
+		{auditlog.Event{Type: auditlog.EventTypeIssue, Username: "alice",
+			Success: true, Method: "ssh",
+			Details: map[string]string{"ssh_principals": "alice,root"}},
+			notify.EventUnusualPrincipals,
+			"ssh certificate of alice for alice,root"},
+		{auditlog.Event{Type: auditlog.EventTypeIssue, Username: "alice",
+			Success: true, Method: "x509",
+			Details: map[string]string{"x509_sans": "db.example.com"}},
+			notify.EventUnusualPrincipals,
+			"x509 certificate of alice for db.example.com"},
+		{auditlog.Event{Type: auditlog.EventTypeAdmin, Username: "admin",
+			Method: "reset-tokens"}, notify.EventAdmin,
+			"Admin admin: reset-tokens (failed)"},
+		{auditlog.Event{Type: auditlog.EventTypeCertApproval,
+			Username: "alice", Success: true, Method: "request",
+			Details: map[string]string{"requester": "alice",
+				"cert_type": "ssh", "needs_approval": "root"}},
+			notify.EventCertApproval,
+			"Approval needed: ssh certificate of alice for root"},
+		{auditlog.Event{Type: auditlog.EventTypeCertApproval,
+			Username: "alice", Success: true, Method: "use",
+			Details: map[string]string{"requester": "alice"}}, "", ""},
+		{auditlog.Event{Type: auditlog.EventTypeBreakGlass,
+			Username: "oncall", Success: true, Method: "login"},
+			notify.EventBreakGlass, "Break glass login of oncall"},
+		{auditlog.Event{Type: auditlog.EventTypeLogin, Username: "alice",
+			Success: true, Method: "password"}, "", ""},
+	} {
+		notification := getAuditEventNotification(test.event)
+		if test.notify == "" {
+			if notification != nil {
+				t.Fatalf("%+v notified: %+v", test.event, notification)
+			}
+			continue
+		}
+		if notification == nil {
+			t.Fatalf("%+v not notified", test.event)
+		}
+		if notification.Event != test.notify ||
+			notification.Subject != test.subject {
+			t.Fatalf("%+v: unexpected notification %+v", test.event,
+				notification)
+		}
+		if !strings.HasPrefix(notification.Text,
+			"User: "+test.event.Username+"\n") {
+			t.Fatalf("unexpected text: %q", notification.Text)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/auditlog"
+	"github.com/Cloud-Foundations/keymaster/lib/pwauth"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+	"github.com/Cloud-Foundations/keymaster/proto/eventmon"
+)
+
+// passwordExpiryWarning returns the warning shown to users whose password
+// expires soon, or "" if there is nothing to warn about.
+func passwordExpiryWarning(status pwauth.PasswordStatus) string {
+	if status.ExpiresIn <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("Your password expires in %s, please change it.",
+		status.ExpiresIn.Truncate(time.Minute))
+}
+
+// writePasswordMustChangeResponse tells a user who gave the right password
+// that it must be changed before logging in.
+func (state *RuntimeState) writePasswordMustChangeResponse(
+	w http.ResponseWriter, r *http.Request, username string) {
+	message := "Password expired or must be changed"
+	if getPreferredAcceptType(r) != "text/html" {
+		state.writeDenialResponse(w, r, http.StatusUnauthorized,
+			proto.DenialReasonPasswordMustChange, message)
+		return
+	}
+	setSecurityHeaders(w)
+	w.WriteHeader(http.StatusUnauthorized)
+	displayData := loginPageTemplateData{
+		Title:              "Keymaster Login",
+		HideStdLogin:       state.Config.Base.HideStandardLogin,
+		LoginDestination:   getLoginDestination(r),
+		ErrorMessage:       message,
+		ShowPasswordChange: state.getConfig().Ldap.AllowPasswordChange,
+		PasswordUsername:   username,
+	}
+	err := state.htmlTemplate.ExecuteTemplate(w, "loginPage", displayData)
+	if err != nil {
+		logger.Printf("Failed to execute %v", err)
+	}
+}
+
+// changePasswordHandler changes the password of a user as described for
+// proto.ChangePasswordPath.
+func (state *RuntimeState) changePasswordHandler(w http.ResponseWriter,
+	r *http.Request) {
+	if state.sendFailureToClientIfLocked(w, r) {
+		return
+	}
+	state.Mutex.Lock()
+	allowPasswordChange := state.getConfig().Ldap.AllowPasswordChange
+	passwordChecker := state.passwordChecker
+	state.Mutex.Unlock()
+	// Checked per request, so that reloading the configuration applies.
+	if !allowPasswordChange {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		state.writeFailureResponse(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		logger.Println(err)
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Error parsing form")
+		return
+	}
+	username := r.Form.Get("username")
+	oldPassword := r.Form.Get("password")
+	newPassword := r.Form.Get("new_password")
+	if username == "" || oldPassword == "" || newPassword == "" {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"username, password and new_password are required")
+		return
+	}
+	if confirm, ok := r.Form["new_password_confirm"]; ok &&
+		(len(confirm) != 1 || confirm[0] != newPassword) {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"New passwords do not match")
+		return
+	}
+	username = state.reprocessUsername(username)
+	attempt := state.checkRateLimit(w, r, username, proto.AuthTypePassword)
+	if attempt == nil {
+		return
+	}
+	defer attempt.release()
+	err := pwauth.ErrPasswordChangeNotSupported
+	if passwordChecker != nil {
+		err = pwauth.ChangePassword(passwordChecker, username,
+			[]byte(oldPassword), []byte(newPassword))
+	}
+	event := auditlog.Event{
+		Type:     auditlog.EventTypePasswordChange,
+		Username: username,
+		Success:  err == nil,
+	}
+	if err != nil {
+		event.Details = map[string]string{"error": err.Error()}
+	}
+	state.logAuditEvent(r, event)
+	if err == pwauth.ErrPasswordChangeNotSupported {
+		state.writeFailureResponse(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	state.recordRateLimitResult(r, attempt, err == nil)
+	if err != nil {
+		logger.Printf("Password change for %s failed: %s", username, err)
+		state.writeFailureResponse(w, r, http.StatusUnauthorized,
+			"Password change failed")
+		return
+	}
+	logger.Printf("Changed password of %s", username)
+	stepUp, ok := state.checkLoginLocation(w, r, username)
+	if !ok {
+		return
+	}
+	state.writeLoginResponseWithPasswordStatus(w, r, username,
+		eventmon.AuthTypePassword, pwauth.PasswordStatus{},
+		getStepUpAuthFlags(stepUp))
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/pwauth"
+	"github.com/Cloud-Foundations/keymaster/lib/simplestorage"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+type testExpiringPasswordChecker struct {
+	password   string
+	mustChange bool
+	expiresIn  time.Duration
+}
+
+func (pc *testExpiringPasswordChecker) PasswordAuthenticate(username string,
+	password []byte) (bool, error) {
+	valid, _, err := pc.PasswordAuthenticateWithStatus(username, password)
+	return valid, err
+}
+
+func (pc *testExpiringPasswordChecker) PasswordAuthenticateWithStatus(
+	username string, password []byte) (bool, pwauth.PasswordStatus, error) {
+	if string(password) != pc.password {
+		return false, pwauth.PasswordStatus{}, nil
+	}
+	if pc.mustChange {
+		return false, pwauth.PasswordStatus{MustChange: true}, nil
+	}
+	return true, pwauth.PasswordStatus{ExpiresIn: pc.expiresIn}, nil
+}
+
+func (pc *testExpiringPasswordChecker) ChangePassword(username string,
+	oldPassword []byte, newPassword []byte) error {
+	if string(oldPassword) != pc.password {
+		return errors.New("invalid credentials")
+	}
+	pc.password = string(newPassword)
+	pc.mustChange = false
+	return nil
+}
+
+func (pc *testExpiringPasswordChecker) UpdateStorage(
+	storage simplestorage.SimpleStore) error {
+	return nil
+}
+
+func TestPasswordMustChange(t *testing.T) {
+	state, passwdFile, err := setupValidRuntimeStateSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(passwdFile.Name())
+	dir, err := ioutil.TempDir("", "password_change_testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	state.Config.Base.DataDirectory = dir
+	if err := initDB(state); err != nil {
+		t.Fatal(err)
+	}
+	checker := &testExpiringPasswordChecker{password: "old", mustChange: true}
+	state.passwordChecker = checker
+	state.Config.Ldap.AllowPasswordChange = true
+	newLoginRequest := func(password string) *http.Request {
+		req := httptest.NewRequest("POST", proto.LoginPath, nil)
+		req.Header.Set("Accept", "application/json")
+		req.SetBasicAuth("username", password)
+		return req
+	}
+	rr, err := checkRequestHandlerCode(newLoginRequest("old"),
+		state.loginHandler, http.StatusUnauthorized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var denial proto.DenialResponse
+	if err := json.NewDecoder(rr.Body).Decode(&denial); err != nil {
+		t.Fatal(err)
+	}
+	if denial.ReasonCode != proto.DenialReasonPasswordMustChange {
+		t.Fatalf("unexpected denial: %+v", denial)
+	}
+	newChangeRequest := func(form url.Values) *http.Request {
+		req := httptest.NewRequest("POST", proto.ChangePasswordPath,
+			strings.NewReader(form.Encode()))
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req
+	}
+	_, err = checkRequestHandlerCode(newChangeRequest(url.Values{
+		"username":             {"username"},
+		"password":             {"old"},
+		"new_password":         {"new"},
+		"new_password_confirm": {"other"},
+	}), state.changePasswordHandler, http.StatusBadRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr, err = checkRequestHandlerCode(newChangeRequest(url.Values{
+		"username":     {"username"},
+		"password":     {"old"},
+		"new_password": {"new"},
+	}), state.changePasswordHandler, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !checkValidLoginResponse(rr.Result(), state, "username") {
+		t.Fatal("invalid login response")
+	}
+	checker.expiresIn = 48 * time.Hour
+	rr, err = checkRequestHandlerCode(newLoginRequest("new"),
+		state.loginHandler, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response proto.LoginResponse
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.PasswordExpiresIn != int64(48*time.Hour/time.Second) {
+		t.Fatalf("unexpected expiry: %d", response.PasswordExpiresIn)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/Cloud-Foundations/keymaster/lib/principalmap"
+)
+
+const adminAPIPrincipalsPath = "/admin/api/v1/principals"
+
+type adminPrincipalsResponse struct {
+	User   string   `json:"user"`
+	Groups []string `json:"groups"`
+	// Principals are the principals put in SSH certificates of User when
+	// no others are requested.
+	Principals []string             `json:"principals"`
+	Mapped     []principalmap.Match `json:"mapped"`
+}
+
+// newPrincipalMapper returns the mapper for ssh_principal_mappings, or nil
+// if there are none.
+func newPrincipalMapper(mappings []principalmap.Mapping) (
+	*principalmap.Mapper, error) {
+	if len(mappings) < 1 {
+		return nil, nil
+	}
+	return principalmap.New(mappings)
+}
+
+func (state *RuntimeState) getPrincipalMapper() *principalmap.Mapper {
+	state.Mutex.Lock()
+	defer state.Mutex.Unlock()
+	return state.principalMapper
+}
+
+// addSSHPrincipals returns principals with the additional principals it
+// does not already have appended.
+func addSSHPrincipals(principals, additional []string) []string {
+	for _, principal := range additional {
+		found := false
+		for _, existing := range principals {
+			if existing == principal {
+				found = true
+				break
+			}
+		}
+		if !found {
+			principals = append(principals, principal)
+		}
+	}
+	return principals
+}
+
+// removeSSHPrincipals returns the principals which are not in remove.
+func removeSSHPrincipals(principals, remove []string) []string {
+	if len(remove) < 1 {
+		return principals
+	}
+	var remaining []string
+	for _, principal := range principals {
+		found := false
+		for _, removed := range remove {
+			if removed == principal {
+				found = true
+				break
+			}
+		}
+		if !found {
+			remaining = append(remaining, principal)
+		}
+	}
+	return remaining
+}
+
+// adminAPIPrincipalsHandler previews the SSH principals the "user" form
+// value gets from ssh_principal_mappings, without issuing a certificate.
+func (state *RuntimeState) adminAPIPrincipalsHandler(w http.ResponseWriter,
+	r *http.Request) {
+	if _, ok := state.checkAdminAPIAuth(w, r, "GET"); !ok {
+		return
+	}
+	username := r.Form.Get("user")
+	if username == "" {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Missing user")
+		return
+	}
+	groups, err := state.getUserGroups(username)
+	if err != nil {
+		logger.Printf("cannot get groups of %s: %s", username, err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	mapped := state.getPrincipalMapper().Explain(username, groups)
+	principals := []string{username}
+	for _, match := range mapped {
+		principals = addSSHPrincipals(principals, []string{match.Principal})
+	}
+	writeAdminAPIResponse(w, adminPrincipalsResponse{
+		User:       username,
+		Groups:     groups,
+		Principals: principals,
+		Mapped:     mapped,
+	})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/principalmap"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestAddRemoveSSHPrincipals(t *testing.T) {
+	principals := addSSHPrincipals([]string{"alice"},
+		[]string{"alice", "dbadmin", "root"})
+	if !reflect.DeepEqual(principals, []string{"alice", "dbadmin", "root"}) {
+		t.Fatalf("unexpected principals: %v", principals)
+	}
+	principals = removeSSHPrincipals(principals, []string{"dbadmin"})
+	if !reflect.DeepEqual(principals, []string{"alice", "root"}) {
+		t.Fatalf("unexpected principals: %v", principals)
+	}
+}
+
+func TestCheckCertPolicyMappedPrincipals(t *testing.T) {
+	state, cleanup := setupServiceAccountState(t)
+	defer cleanup()
+	err := state.SaveServiceAccount(&serviceAccount{Name: "deploy-bot",
+		Groups: []string{"team-web"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.principalMapper, err = newPrincipalMapper([]principalmap.Mapping{
+		{Group: "team-*", Principals: []string{"$1-deploy"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPolicy := func(principals string, expectedStatus int) []string {
+		r := httptest.NewRequest("POST",
+			"/certgen/deploy-bot?principals="+principals, nil)
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		decision, ok := state.checkCertPolicy(w, r, "deploy-bot",
+			AuthTypeServiceAccount, time.Hour, false, false,
+			sshPermissionsRequest{},
+			ssh.Permissions{})
+		if w.Code != expectedStatus {
+			t.Fatalf("%s: expected %d, got %d", principals, expectedStatus,
+				w.Code)
+		}
+		if !ok {
+			return nil
+		}
+		return decision.SSHPrincipals
+	}
+	// Without a certificate policy mapped principals are granted, whether
+	// or not they are requested, but others are denied.
+	expected := []string{"deploy-bot", "web-deploy"}
+	for _, principals := range []string{"", "web-deploy"} {
+		granted := checkPolicy(principals, http.StatusOK)
+		if !reflect.DeepEqual(granted, expected) {
+			t.Fatalf("%q: expected %v, got %v", principals, expected, granted)
+		}
+	}
+	checkPolicy("root", http.StatusForbidden)
+}
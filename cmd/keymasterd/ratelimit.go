@@ -0,0 +1,87 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/auditlog"
+	"github.com/Cloud-Foundations/keymaster/lib/ratelimit"
+)
+
+// getClientAddress returns the IP address of the client of r.
+func getClientAddress(r *http.Request) string {
+	address, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return address
+}
+
+// rateLimitAttempt is an attempt of username by method allowed by the rate
+// limiter.
+type rateLimitAttempt struct {
+	attempt  *ratelimit.Attempt
+	username string
+	method   string
+}
+
+// release ends the attempt if its result was not recorded. It is deferred
+// after checkRateLimit, so that attempts which end in errors or challenges
+// do not count.
+func (a *rateLimitAttempt) release() {
+	a.attempt.Release()
+}
+
+// checkRateLimit returns an attempt if username may attempt a password or
+// one time password check by method from the client of r. The failures of
+// each method are counted separately. Otherwise it answers with 429 and
+// returns nil.
+func (state *RuntimeState) checkRateLimit(w http.ResponseWriter,
+	r *http.Request, username string, method string) *rateLimitAttempt {
+	attempt, err := state.rateLimiter.Allow(username, method,
+		getClientAddress(r))
+	if err == nil {
+		return &rateLimitAttempt{attempt, username, method}
+	}
+	logger.Printf("Refusing %s attempt of %s from %s: %s", method, username,
+		r.RemoteAddr, err)
+	if lockout, ok := err.(*ratelimit.Lockout); ok {
+		retryAfter := math.Ceil(time.Until(lockout.Until).Seconds())
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter)))
+	}
+	state.writeFailureResponse(w, r, http.StatusTooManyRequests,
+		"Too many failed attempts, try again later")
+	return nil
+}
+
+// recordRateLimitResult records the result of attempt for the rate limiter.
+// Only a valid attempt forgets the failures of its method. Lockouts it
+// starts are logged and recorded in the metrics and audit log.
+func (state *RuntimeState) recordRateLimitResult(r *http.Request,
+	attempt *rateLimitAttempt, valid bool) {
+	if valid {
+		attempt.attempt.RecordSuccess()
+		return
+	}
+	username, method := attempt.username, attempt.method
+	for _, lockout := range attempt.attempt.RecordFailure() {
+		event := auditlog.Event{
+			Type:     auditlog.EventTypeLockout,
+			Username: username,
+			Method:   method,
+			Details:  map[string]string{"until": lockout.Until.Format(time.RFC3339)},
+		}
+		if lockout.Username != "" {
+			metricLogLockout("user")
+			event.Details["locked_out"] = "user"
+		} else {
+			metricLogLockout("address")
+			event.Details["locked_out"] = "address"
+		}
+		logger.Printf("%s after failed %s attempt", lockout.Error(), method)
+		state.logAuditEvent(r, event)
+	}
+}
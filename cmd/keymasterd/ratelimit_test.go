@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Cloud-Foundations/keymaster/lib/ratelimit"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRateLimit(t *testing.T) {
+	var state RuntimeState
+	req := httptest.NewRequest("POST", proto.LoginPath, nil)
+	// Without a limiter everything is allowed.
+	attempt := state.checkRateLimit(httptest.NewRecorder(), req, "username",
+		proto.AuthTypePassword)
+	if attempt == nil {
+		t.Fatal("attempt should be allowed without a limiter")
+	}
+	state.recordRateLimitResult(req, attempt, false)
+	var err error
+	state.rateLimiter, err = ratelimit.New(ratelimit.Config{
+		MaxUserFailures: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter := lockoutCounter.WithLabelValues("user")
+	before := testutil.ToFloat64(counter)
+	for i := 0; i < 2; i++ {
+		attempt := state.checkRateLimit(httptest.NewRecorder(), req,
+			"username", proto.AuthTypeTOTP)
+		if attempt == nil {
+			t.Fatalf("attempt %d should be allowed", i)
+		}
+		state.recordRateLimitResult(req, attempt, false)
+	}
+	if after := testutil.ToFloat64(counter); after != before+1 {
+		t.Fatalf("lockout counter is %v, expected %v", after, before+1)
+	}
+	rr := httptest.NewRecorder()
+	if state.checkRateLimit(rr, req, "username", proto.AuthTypeTOTP) != nil {
+		t.Fatal("locked out user should not be allowed")
+	}
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected %d, got %d", http.StatusTooManyRequests, rr.Code)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Fatal("missing Retry-After header")
+	}
+	if state.checkRateLimit(httptest.NewRecorder(), req, "other",
+		proto.AuthTypeTOTP) == nil {
+		t.Fatal("other users should not be locked out")
+	}
+	// A password login does not forget failed one time passwords.
+	attempt = state.checkRateLimit(httptest.NewRecorder(), req, "username",
+		proto.AuthTypePassword)
+	if attempt == nil {
+		t.Fatal("password attempt should be allowed")
+	}
+	state.recordRateLimitResult(req, attempt, true)
+	if state.checkRateLimit(httptest.NewRecorder(), req, "username",
+		proto.AuthTypeTOTP) != nil {
+		t.Fatal("locked out user should not be allowed")
+	}
+}
@@ -0,0 +1,564 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/auditlog"
+	"github.com/Cloud-Foundations/keymaster/lib/instrumentedwriter"
+	"github.com/Cloud-Foundations/keymaster/lib/issuancelog"
+	"github.com/Cloud-Foundations/keymaster/lib/sshkrl"
+	"golang.org/x/crypto/ocsp"
+	"golang.org/x/crypto/ssh"
+)
+
+const revokePath = "/v1/revoke"
+const crlPath = "/v1/crl"
+const ocspPath = "/v1/ocsp"
+const sshKRLPath = "/v1/ssh-krl"
+
+// Types of revocations. The serial of an SSH key revocation is the base64
+// encoded public key.
+const (
+	revokedX509CertType = "x509"
+	revokedSSHCertType  = "ssh"
+	revokedSSHKeyType   = "ssh-key"
+)
+
+// crlValidity is the time between the thisUpdate and nextUpdate of a CRL. A
+// new CRL is made after half of this, or when a certificate is revoked.
+const crlValidity = 24 * time.Hour
+
+const maxOCSPRequestSize = 10 << 10
+
+// x509IssuanceTypes are the types of X.509 certificates in the issuance log.
+var x509IssuanceTypes = map[string]bool{
+	"x509":            true,
+	"x509-kubernetes": true,
+	acmeCertType:      true,
+}
+
+var revocationReasons = map[string]int{
+	"unspecified":          ocsp.Unspecified,
+	"keyCompromise":        ocsp.KeyCompromise,
+	"affiliationChanged":   ocsp.AffiliationChanged,
+	"superseded":           ocsp.Superseded,
+	"cessationOfOperation": ocsp.CessationOfOperation,
+	"privilegeWithdrawn":   ocsp.PrivilegeWithdrawn,
+}
+
+// revocationSnapshot holds a CRL and the revocations it was made from, so
+// that OCSP responses agree with the CRL.
+type revocationSnapshot struct {
+	crl         []byte
+	revoked     map[string]revokedCertificate
+	thisUpdate  time.Time
+	nextUpdate  time.Time
+	refreshTime time.Time
+}
+
+// checkRevocationBaseURL returns an error if baseURL is set but is not an
+// HTTP or HTTPS URL.
+func checkRevocationBaseURL(baseURL string) error {
+	if baseURL == "" {
+		return nil
+	}
+	parsedURL, err := url.Parse(baseURL)
+	if err != nil {
+		return err
+	}
+	if (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") ||
+		parsedURL.Host == "" {
+		return fmt.Errorf("not an HTTP URL: %s", baseURL)
+	}
+	return nil
+}
+
+// getRevocationURLs returns the URLs of the CRL and the OCSP responder
+// which user certificates name, none if no revocation base URL is set.
+func (state *RuntimeState) getRevocationURLs() ([]string, []string) {
+	baseURL := strings.TrimSuffix(state.Config.Base.RevocationBaseURL, "/")
+	if baseURL == "" {
+		return nil, nil
+	}
+	return []string{baseURL + ocspPath}, []string{baseURL + crlPath}
+}
+
+// parseSerial parses a decimal serial number, or a hexadecimal one with a
+// "0x" prefix.
+func parseSerial(value string) (*big.Int, error) {
+	base := 10
+	if strings.HasPrefix(value, "0x") || strings.HasPrefix(value, "0X") {
+		value = value[2:]
+		base = 16
+	}
+	serial, ok := new(big.Int).SetString(value, base)
+	if !ok || serial.Sign() <= 0 {
+		return nil, errors.New("invalid serial number")
+	}
+	return serial, nil
+}
+
+// parseRevocationReason returns the CRL reason code for a name from
+// revocationReasons or a reason code number. An empty value is unspecified.
+func parseRevocationReason(value string) (int, error) {
+	if value == "" {
+		return ocsp.Unspecified, nil
+	}
+	if reason, ok := revocationReasons[value]; ok {
+		return reason, nil
+	}
+	reason, err := strconv.Atoi(value)
+	if err != nil || reason < ocsp.Unspecified ||
+		reason > ocsp.AACompromise || reason == 7 {
+		return 0, fmt.Errorf("invalid revocation reason: %s", value)
+	}
+	return reason, nil
+}
+
+// getRevocationFromForm returns the revocation given by the "type" form
+// value ("x509", the default, "ssh" or "ssh-key"), the "serial" form value
+// for certificates or the "key" form value (in authorized_keys format) for
+// SSH keys and the optional "reason" form value.
+func getRevocationFromForm(r *http.Request, authUser string) (
+	revokedCertificate, error) {
+	entry := revokedCertificate{
+		CertType:       r.Form.Get("type"),
+		RevokedBy:      authUser,
+		RevocationTime: time.Now().Truncate(time.Second),
+	}
+	var err error
+	entry.Reason, err = parseRevocationReason(r.Form.Get("reason"))
+	if err != nil {
+		return entry, err
+	}
+	switch entry.CertType {
+	case "", revokedX509CertType:
+		entry.CertType = revokedX509CertType
+		serial, err := parseSerial(r.Form.Get("serial"))
+		if err != nil {
+			return entry, err
+		}
+		entry.Serial = serial.String()
+	case revokedSSHCertType:
+		serial, err := parseSerial(r.Form.Get("serial"))
+		if err != nil {
+			return entry, err
+		}
+		if !serial.IsUint64() {
+			return entry, errors.New("SSH serial number out of range")
+		}
+		entry.Serial = serial.String()
+	case revokedSSHKeyType:
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(r.Form.Get("key")))
+		if err != nil {
+			return entry, err
+		}
+		if _, ok := key.(*ssh.Certificate); ok {
+			return entry, errors.New(
+				"revoke SSH certificates with type=ssh and their serial")
+		}
+		entry.Serial = base64.StdEncoding.EncodeToString(key.Marshal())
+	default:
+		return entry, fmt.Errorf("invalid revocation type: %s", entry.CertType)
+	}
+	return entry, nil
+}
+
+func (state *RuntimeState) invalidateRevocationSnapshot() {
+	state.revocationMutex.Lock()
+	defer state.revocationMutex.Unlock()
+	state.revocationSnapshot = nil
+}
+
+// revoke records the revocation requested in r and makes the next CRL
+// include it.
+func (state *RuntimeState) revoke(r *http.Request,
+	entry revokedCertificate) error {
+	event := auditlog.Event{
+		Type:     auditlog.EventTypeRevoke,
+		Username: entry.RevokedBy,
+		Method:   entry.CertType,
+		Details: map[string]string{
+			"serial": entry.Serial,
+			"reason": strconv.Itoa(entry.Reason),
+		},
+	}
+	if err := state.RevokeCertificate(entry); err != nil {
+		event.Details["error"] = err.Error()
+		state.logAuditEvent(r, event)
+		return err
+	}
+	event.Success = true
+	state.logAuditEvent(r, event)
+	if entry.CertType == revokedX509CertType {
+		state.invalidateRevocationSnapshot()
+	}
+	logger.Printf("%s revoked %s %s, reason %d", entry.RevokedBy,
+		entry.CertType, entry.Serial, entry.Reason)
+	return nil
+}
+
+// getIssuedX509Serials returns the serials of the unexpired X.509
+// certificates in the issuance log, mapped to their expiry. They are read
+// from the log on first use and then kept by recordIssuedX509Serial. The
+// revocationMutex must be held.
+func (state *RuntimeState) getIssuedX509Serials() (map[string]time.Time,
+	error) {
+	if state.issuedX509Serials != nil {
+		return state.issuedX509Serials, nil
+	}
+	entries, err := state.issuanceLog.Query(issuancelog.Filter{})
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	serials := make(map[string]time.Time)
+	for _, entry := range entries {
+		if x509IssuanceTypes[entry.CertType] && now.Before(entry.NotAfter) {
+			serials[entry.Serial] = entry.NotAfter
+		}
+	}
+	state.issuedX509Serials = serials
+	return serials, nil
+}
+
+// recordIssuedX509Serial adds a certificate which has been recorded in the
+// issuance log to the issued serials, if they have been read.
+func (state *RuntimeState) recordIssuedX509Serial(serial string,
+	notAfter time.Time) {
+	state.revocationMutex.Lock()
+	defer state.revocationMutex.Unlock()
+	if state.issuedX509Serials != nil {
+		state.issuedX509Serials[serial] = notAfter
+	}
+}
+
+// isIssuedX509Serial returns true if the unexpired certificate with serial
+// is in the issuance log. Without an issuance log every certificate is
+// assumed to be issued.
+func (state *RuntimeState) isIssuedX509Serial(serial string) (bool, error) {
+	if state.issuanceLog == nil {
+		return true, nil
+	}
+	state.revocationMutex.Lock()
+	defer state.revocationMutex.Unlock()
+	serials, err := state.getIssuedX509Serials()
+	if err != nil {
+		return false, err
+	}
+	notAfter, ok := serials[serial]
+	return ok && time.Now().Before(notAfter), nil
+}
+
+// getRevocationSnapshot returns the current revocation snapshot, making a
+// new one if it is due for refresh. The signer must be unlocked.
+func (state *RuntimeState) getRevocationSnapshot() (*revocationSnapshot, error) {
+	state.revocationMutex.Lock()
+	defer state.revocationMutex.Unlock()
+	now := time.Now()
+	if snapshot := state.revocationSnapshot; snapshot != nil &&
+		now.Before(snapshot.refreshTime) {
+		return snapshot, nil
+	}
+	for serial, notAfter := range state.issuedX509Serials {
+		if !now.Before(notAfter) {
+			delete(state.issuedX509Serials, serial)
+		}
+	}
+	revoked, _, err := state.GetRevokedCertificates(revokedX509CertType)
+	if err != nil {
+		return nil, err
+	}
+	caCert, err := x509.ParseCertificate(state.caCertDer)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &revocationSnapshot{
+		revoked:     make(map[string]revokedCertificate, len(revoked)),
+		thisUpdate:  now,
+		nextUpdate:  now.Add(crlValidity),
+		refreshTime: now.Add(crlValidity / 2),
+	}
+	entries := make([]x509.RevocationListEntry, 0, len(revoked))
+	for _, entry := range revoked {
+		serial, err := parseSerial(entry.Serial)
+		if err != nil {
+			logger.Printf("ignoring revoked certificate with serial %q: %s",
+				entry.Serial, err)
+			continue
+		}
+		snapshot.revoked[serial.String()] = entry
+		entries = append(entries, x509.RevocationListEntry{
+			SerialNumber:   serial,
+			RevocationTime: entry.RevocationTime,
+			ReasonCode:     entry.Reason,
+		})
+	}
+	template := &x509.RevocationList{
+		RevokedCertificateEntries: entries,
+		Number:                    big.NewInt(now.UnixNano()),
+		ThisUpdate:                snapshot.thisUpdate,
+		NextUpdate:                snapshot.nextUpdate,
+	}
+	snapshot.crl, err = x509.CreateRevocationList(rand.Reader, template,
+		caCert, state.Signer)
+	if err != nil {
+		return nil, err
+	}
+	logger.Debugf(1, "made CRL with %d entries", len(entries))
+	state.revocationSnapshot = snapshot
+	return snapshot, nil
+}
+
+// revokeHandler revokes the certificate or key given by the form values, as
+// described for getRevocationFromForm. Only admins may revoke certificates.
+func (state *RuntimeState) revokeHandler(w http.ResponseWriter,
+	r *http.Request) {
+	if state.sendFailureToClientIfLocked(w, r) {
+		return
+	}
+	authUser, _, err := state.checkAuth(w, r, state.getRequiredWebUIAuthLevel())
+	if err != nil {
+		logger.Debugf(1, "%v", err)
+		return
+	}
+	w.(*instrumentedwriter.LoggingWriter).SetUsername(authUser)
+	if r.Method != "POST" {
+		state.writeFailureResponse(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	if !state.IsAdminUser(authUser) {
+		state.writeFailureResponse(w, r, http.StatusForbidden,
+			"Only admins may revoke certificates")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Error parsing form")
+		return
+	}
+	entry, err := getRevocationFromForm(r, authUser)
+	if err != nil {
+		state.writeFailureResponse(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := state.revoke(r, entry); err != nil {
+		logger.Printf("cannot revoke %s %s: %s", entry.CertType, entry.Serial,
+			err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entry)
+}
+
+// crlHandler serves the DER encoded CRL of the X.509 CA.
+func (state *RuntimeState) crlHandler(w http.ResponseWriter, r *http.Request) {
+	if state.sendFailureToClientIfLocked(w, r) {
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		state.writeFailureResponse(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	snapshot, err := state.getRevocationSnapshot()
+	if err != nil {
+		logger.Printf("cannot make CRL: %s", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	w.Header().Set("Content-Type", "application/pkix-crl")
+	w.Header().Set("Last-Modified",
+		snapshot.thisUpdate.UTC().Format(http.TimeFormat))
+	w.Header().Set("Expires",
+		snapshot.nextUpdate.UTC().Format(http.TimeFormat))
+	w.Write(snapshot.crl)
+}
+
+// getSSHKRL returns the KRL of the revoked SSH certificates and keys. The
+// signer must be unlocked.
+func (state *RuntimeState) getSSHKRL() ([]byte, error) {
+	signer, err := newSSHSigner(state.Signer)
+	if err != nil {
+		return nil, err
+	}
+	revokedCerts, _, err := state.GetRevokedCertificates(revokedSSHCertType)
+	if err != nil {
+		return nil, err
+	}
+	revokedKeys, _, err := state.GetRevokedCertificates(revokedSSHKeyType)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	krl := sshkrl.KRL{
+		Version:       uint64(now.Unix()),
+		GeneratedDate: now,
+		Comment:       "keymaster " + state.HostIdentity,
+	}
+	revoked := sshkrl.RevokedCertificates{CAKey: signer.PublicKey()}
+	for _, entry := range revokedCerts {
+		serial, err := strconv.ParseUint(entry.Serial, 10, 64)
+		if err != nil {
+			logger.Printf("ignoring revoked SSH certificate with serial %q: %s",
+				entry.Serial, err)
+			continue
+		}
+		revoked.Serials = append(revoked.Serials, serial)
+	}
+	krl.Certificates = []sshkrl.RevokedCertificates{revoked}
+	for _, entry := range revokedKeys {
+		keyBytes, err := base64.StdEncoding.DecodeString(entry.Serial)
+		if err == nil {
+			var key ssh.PublicKey
+			key, err = ssh.ParsePublicKey(keyBytes)
+			if err == nil {
+				krl.Keys = append(krl.Keys, key)
+				continue
+			}
+		}
+		logger.Printf("ignoring revoked SSH key %q: %s", entry.Serial, err)
+	}
+	return krl.Marshal(), nil
+}
+
+// sshKRLHandler serves the KRL of the SSH CA, for use with the RevokedKeys
+// option of sshd.
+func (state *RuntimeState) sshKRLHandler(w http.ResponseWriter,
+	r *http.Request) {
+	if state.sendFailureToClientIfLocked(w, r) {
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		state.writeFailureResponse(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	krl, err := state.getSSHKRL()
+	if err != nil {
+		logger.Printf("cannot make SSH KRL: %s", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(krl)
+}
+
+// issuerKeyHashMatches returns true if the OCSP request is for a
+// certificate issued by the CA with certificate caCert.
+func issuerKeyHashMatches(request *ocsp.Request, caCert *x509.Certificate) bool {
+	if !request.HashAlgorithm.Available() {
+		return false
+	}
+	var publicKeyInfo struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	_, err := asn1.Unmarshal(caCert.RawSubjectPublicKeyInfo, &publicKeyInfo)
+	if err != nil {
+		return false
+	}
+	hash := request.HashAlgorithm.New()
+	hash.Write(publicKeyInfo.PublicKey.RightAlign())
+	return bytes.Equal(hash.Sum(nil), request.IssuerKeyHash)
+}
+
+// getOCSPResponse returns the DER encoded OCSP response to the DER encoded
+// requestBytes. Certificates are good unless they have been revoked, or are
+// unknown if they are not in the issuance log.
+func (state *RuntimeState) getOCSPResponse(requestBytes []byte) []byte {
+	request, err := ocsp.ParseRequest(requestBytes)
+	if err != nil {
+		logger.Debugf(1, "bad OCSP request: %s", err)
+		return ocsp.MalformedRequestErrorResponse
+	}
+	caCert, err := x509.ParseCertificate(state.caCertDer)
+	if err != nil {
+		logger.Printf("cannot parse CA certificate: %s", err)
+		return ocsp.InternalErrorErrorResponse
+	}
+	if !issuerKeyHashMatches(request, caCert) {
+		return ocsp.UnauthorizedErrorResponse
+	}
+	snapshot, err := state.getRevocationSnapshot()
+	if err != nil {
+		logger.Printf("cannot load revocations: %s", err)
+		return ocsp.TryLaterErrorResponse
+	}
+	template := ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: request.SerialNumber,
+		ThisUpdate:   snapshot.thisUpdate,
+		NextUpdate:   snapshot.nextUpdate,
+		IssuerHash:   request.HashAlgorithm,
+	}
+	serial := request.SerialNumber.String()
+	if entry, ok := snapshot.revoked[serial]; ok {
+		template.Status = ocsp.Revoked
+		template.RevokedAt = entry.RevocationTime
+		template.RevocationReason = entry.Reason
+	} else if issued, err := state.isIssuedX509Serial(serial); err != nil {
+		logger.Printf("cannot read issued certificates: %s", err)
+		return ocsp.TryLaterErrorResponse
+	} else if !issued {
+		template.Status = ocsp.Unknown
+	}
+	response, err := ocsp.CreateResponse(caCert, caCert, template,
+		state.Signer)
+	if err != nil {
+		logger.Printf("cannot make OCSP response: %s", err)
+		return ocsp.InternalErrorErrorResponse
+	}
+	return response
+}
+
+// ocspHandler is an OCSP responder (RFC 6960) for the X.509 CA. Requests may
+// be POSTed or sent with GET as the base64 encoded path after ocspPath.
+func (state *RuntimeState) ocspHandler(w http.ResponseWriter, r *http.Request) {
+	setSecurityHeaders(w)
+	var requestBytes []byte
+	var err error
+	switch r.Method {
+	case "GET":
+		var encoded string
+		encoded, err = url.PathUnescape(
+			strings.TrimPrefix(r.URL.EscapedPath(), ocspPath+"/"))
+		if err == nil {
+			requestBytes, err = base64.StdEncoding.DecodeString(encoded)
+		}
+	case "POST":
+		requestBytes, err = ioutil.ReadAll(
+			io.LimitReader(r.Body, maxOCSPRequestSize))
+	default:
+		state.writeFailureResponse(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	var response []byte
+	state.Mutex.Lock()
+	signerIsNull := state.Signer == nil
+	state.Mutex.Unlock()
+	if err != nil {
+		response = ocsp.MalformedRequestErrorResponse
+	} else if signerIsNull {
+		response = ocsp.TryLaterErrorResponse
+	} else {
+		response = state.getOCSPResponse(requestBytes)
+	}
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.Write(response)
+}
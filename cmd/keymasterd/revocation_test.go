@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log/testlogger"
+	"github.com/Cloud-Foundations/keymaster/lib/certgen"
+	"github.com/Cloud-Foundations/keymaster/lib/issuancelog"
+	"golang.org/x/crypto/ocsp"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseSerial(t *testing.T) {
+	for value, expected := range map[string]string{
+		"12345": "12345",
+		"0x1f":  "31",
+		"0XFF":  "255",
+	} {
+		serial, err := parseSerial(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if serial.String() != expected {
+			t.Fatalf("%s: expected %s, got %s", value, expected, serial)
+		}
+	}
+	for _, value := range []string{"", "0", "-1", "abc", "0xzz"} {
+		if _, err := parseSerial(value); err == nil {
+			t.Fatalf("%q should fail", value)
+		}
+	}
+}
+
+func TestParseRevocationReason(t *testing.T) {
+	for value, expected := range map[string]int{
+		"":              ocsp.Unspecified,
+		"keyCompromise": ocsp.KeyCompromise,
+		"4":             ocsp.Superseded,
+	} {
+		reason, err := parseRevocationReason(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reason != expected {
+			t.Fatalf("%q: expected %d, got %d", value, expected, reason)
+		}
+	}
+	for _, value := range []string{"7", "11", "-1", "lost"} {
+		if _, err := parseRevocationReason(value); err == nil {
+			t.Fatalf("%q should fail", value)
+		}
+	}
+}
+
+func TestGetRevocationFromForm(t *testing.T) {
+	for _, test := range []struct {
+		form     url.Values
+		certType string
+		serial   string
+	}{
+		{url.Values{"serial": {"0x10"}}, revokedX509CertType, "16"},
+		{url.Values{"type": {"ssh"}, "serial": {"42"}}, revokedSSHCertType,
+			"42"},
+		{url.Values{"type": {"ssh-key"}, "key": {testUserSSHPublicKey}},
+			revokedSSHKeyType, "AAAAB3NzaC1yc2E"},
+	} {
+		r := &http.Request{Form: test.form}
+		entry, err := getRevocationFromForm(r, "admin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.CertType != test.certType ||
+			entry.Serial[:len(test.serial)] != test.serial ||
+			entry.RevokedBy != "admin" {
+			t.Fatalf("unexpected revocation: %+v", entry)
+		}
+	}
+	for _, form := range []url.Values{
+		{"type": {"ssh"}, "serial": {"18446744073709551616"}},
+		{"type": {"ssh-key"}, "key": {"bad key"}},
+		{"type": {"unknown"}, "serial": {"1"}},
+		{"serial": {"1"}, "reason": {"lost"}},
+	} {
+		r := &http.Request{Form: form}
+		if _, err := getRevocationFromForm(r, "admin"); err == nil {
+			t.Fatalf("%v should fail", form)
+		}
+	}
+}
+
+func TestGetRevocationURLs(t *testing.T) {
+	var state RuntimeState
+	ocspServers, crlURLs := state.getRevocationURLs()
+	if ocspServers != nil || crlURLs != nil {
+		t.Fatal("no revocation URLs should be named without a base URL")
+	}
+	state.Config.Base.RevocationBaseURL = "https://keymaster.example.com/"
+	err := checkRevocationBaseURL(state.Config.Base.RevocationBaseURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ocspServers, crlURLs = state.getRevocationURLs()
+	if len(ocspServers) != 1 ||
+		ocspServers[0] != "https://keymaster.example.com"+ocspPath ||
+		len(crlURLs) != 1 ||
+		crlURLs[0] != "https://keymaster.example.com"+crlPath {
+		t.Fatalf("unexpected revocation URLs: %v %v", ocspServers, crlURLs)
+	}
+	for _, baseURL := range []string{"keymaster.example.com", "ldap://host"} {
+		if err := checkRevocationBaseURL(baseURL); err == nil {
+			t.Fatalf("%s should be invalid", baseURL)
+		}
+	}
+}
+
+func getTestOCSPStatus(t *testing.T, state *RuntimeState,
+	cert, caCert *x509.Certificate) *ocsp.Response {
+	request, err := ocsp.CreateRequest(cert, caCert, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", ocspPath, bytes.NewReader(request))
+	rr := httptest.NewRecorder()
+	state.ocspHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("OCSP request failed with status %d", rr.Code)
+	}
+	response, err := ocsp.ParseResponseForCert(rr.Body.Bytes(), cert, caCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestRevocation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "revocation_testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var state RuntimeState
+	state.Config.Base.DataDirectory = dir
+	if err := initDB(&state); err != nil {
+		t.Fatal(err)
+	}
+	state.issuanceLog, err = issuancelog.Open(
+		filepath.Join(dir, defaultIssuanceLogFilename), testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.issuanceLog.Close()
+	userPub, _, caPriv := setupX509Generator(t)
+	state.Signer = caPriv
+	state.HostIdentity = "keymaster.example.com"
+	state.caCertDer, err = generateCADer(&state, caPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(state.caCertDer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	derCert, err := certgen.GenUserX509Cert("username", userPub, caCert,
+		caPriv, nil, testDuration, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(derCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := getTestOCSPStatus(t, &state, cert, caCert); status.Status != ocsp.Unknown {
+		t.Fatalf("expected unknown status before issuance, got %d",
+			status.Status)
+	}
+	err = state.logX509Issuance("username", "x509", AuthTypePassword, derCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := getTestOCSPStatus(t, &state, cert, caCert); status.Status != ocsp.Good {
+		t.Fatalf("expected good status, got %d", status.Status)
+	}
+	err = state.RevokeCertificate(revokedCertificate{
+		CertType:       revokedX509CertType,
+		Serial:         cert.SerialNumber.String(),
+		RevokedBy:      "admin",
+		Reason:         ocsp.KeyCompromise,
+		RevocationTime: time.Now().Truncate(time.Second),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.invalidateRevocationSnapshot()
+	status := getTestOCSPStatus(t, &state, cert, caCert)
+	if status.Status != ocsp.Revoked ||
+		status.RevocationReason != ocsp.KeyCompromise {
+		t.Fatalf("expected revoked status, got %+v", status)
+	}
+	req := httptest.NewRequest("GET", crlPath, nil)
+	rr := httptest.NewRecorder()
+	state.crlHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("CRL request failed with status %d", rr.Code)
+	}
+	crl, err := x509.ParseRevocationList(rr.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := crl.CheckSignatureFrom(caCert); err != nil {
+		t.Fatal(err)
+	}
+	if len(crl.RevokedCertificateEntries) != 1 ||
+		crl.RevokedCertificateEntries[0].SerialNumber.Cmp(
+			cert.SerialNumber) != 0 {
+		t.Fatalf("unexpected CRL entries: %+v", crl.RevokedCertificateEntries)
+	}
+	// Revocations from the primary DB reach the cache DB.
+	if err := copyDBIntoSQLite(state.db, state.cacheDB, "sqlite"); err != nil {
+		t.Fatal(err)
+	}
+	state.remoteDBQueryTimeout = 0
+	revoked, fromCache, err := state.GetRevokedCertificates(
+		revokedX509CertType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fromCache || len(revoked) != 1 {
+		t.Fatalf("expected 1 cached revocation, got %d (fromCache=%v)",
+			len(revoked), fromCache)
+	}
+}
+
+func TestSSHKRL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssh_krl_testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var state RuntimeState
+	state.Config.Base.DataDirectory = dir
+	if err := initDB(&state); err != nil {
+		t.Fatal(err)
+	}
+	_, _, caPriv := setupX509Generator(t)
+	state.Signer = caPriv
+	signer, err := ssh.NewSignerFromSigner(caPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, certBytes, err := certgen.GenSSHCertFileString("username",
+		testUserSSHPublicKey, signer, "host", testDuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, err := ssh.ParsePublicKey(certBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := pubKey.(*ssh.Certificate)
+	userKey, _, _, _, err := ssh.ParseAuthorizedKey(
+		[]byte(testUserSSHPublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, form := range []url.Values{
+		{"type": {"ssh"}, "serial": {strconv.FormatUint(cert.Serial, 10)}},
+		{"type": {"ssh-key"}, "key": {testUserSSHPublicKey}},
+	} {
+		entry, err := getRevocationFromForm(&http.Request{Form: form}, "admin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := state.RevokeCertificate(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest("GET", sshKRLPath, nil)
+	rr := httptest.NewRecorder()
+	state.sshKRLHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("KRL request failed with status %d", rr.Code)
+	}
+	krl := rr.Body.Bytes()
+	if !bytes.HasPrefix(krl, []byte("SSHKRL\n\x00")) {
+		t.Fatal("missing KRL magic")
+	}
+	serial := binary.BigEndian.AppendUint64(nil, cert.Serial)
+	if !bytes.Contains(krl, signer.PublicKey().Marshal()) ||
+		!bytes.Contains(krl, serial) {
+		t.Fatal("certificate serial is not revoked")
+	}
+	if !bytes.Contains(krl, userKey.Marshal()) {
+		t.Fatal("key is not revoked")
+	}
+}
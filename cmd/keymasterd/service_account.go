@@ -0,0 +1,443 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+	"github.com/Cloud-Foundations/keymaster/proto/eventmon"
+)
+
+const (
+	adminAPIServiceAccountsPath      = "/admin/api/v1/service-accounts"
+	adminAPIServiceAccountTokenPath  = "/admin/api/v1/service-account-token"
+	adminAPIDeleteServiceAccountPath = "/admin/api/v1/delete-service-account"
+
+	defaultServiceAccountTokenLifetime = 90 * 24 * time.Hour
+)
+
+var serviceAccountNameRE = regexp.MustCompile("^[a-z0-9][a-z0-9_-]{0,63}$")
+
+// serviceAccountToken is a refresh token of a service account. Only the
+// hash of the secret is stored.
+type serviceAccountToken struct {
+	SecretSHA256 []byte
+	CreatedAt    time.Time
+	ExpiresAt    time.Time
+	// RotatedAt is set once the token was used to log in and replaced.
+	// Rotated tokens are kept until they expire so that their reuse, which
+	// means the token was copied, can be detected.
+	RotatedAt time.Time
+}
+
+type serviceAccount struct {
+	Name   string
+	Groups []string
+	// CertPolicyRule is the name of the certificate policy rule which
+	// applies to the account.
+	CertPolicyRule string
+	CreatedBy      string
+	CreatedAt      time.Time
+	Tokens         map[string]*serviceAccountToken // Key: token ID.
+}
+
+type adminServiceAccount struct {
+	Name           string    `json:"name"`
+	Groups         []string  `json:"groups,omitempty"`
+	CertPolicyRule string    `json:"cert_policy_rule,omitempty"`
+	CreatedBy      string    `json:"created_by"`
+	CreatedAt      time.Time `json:"created_at"`
+	// TokenExpiresAt is the expiry of the current refresh token, if any.
+	TokenExpiresAt *time.Time `json:"token_expires_at,omitempty"`
+}
+
+type adminServiceAccountsResponse struct {
+	ServiceAccounts []adminServiceAccount `json:"service_accounts"`
+}
+
+type adminServiceAccountTokenResponse struct {
+	Name      string    `json:"name"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// parseServiceAccountToken splits a refresh token of the form
+// <name>.<token ID>.<secret>.
+func parseServiceAccountToken(token string) (string, string, []byte, error) {
+	fields := strings.Split(strings.TrimSpace(token), ".")
+	if len(fields) != 3 || !serviceAccountNameRE.MatchString(fields[0]) {
+		return "", "", nil, errors.New("malformed service account token")
+	}
+	secret, err := base64.RawURLEncoding.DecodeString(fields[2])
+	if err != nil {
+		return "", "", nil, errors.New("malformed service account token")
+	}
+	return fields[0], fields[1], secret, nil
+}
+
+func (state *RuntimeState) getServiceAccountTokenLifetime() time.Duration {
+	if lifetime := state.Config.ServiceAccounts.TokenLifetime; lifetime > 0 {
+		return lifetime
+	}
+	return defaultServiceAccountTokenLifetime
+}
+
+// addToken adds a new refresh token to account, removing expired tokens,
+// and returns it.
+func (account *serviceAccount) addToken(lifetime time.Duration,
+	now time.Time) (string, *serviceAccountToken, error) {
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", nil, err
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+	for id, token := range account.Tokens {
+		if now.After(token.ExpiresAt) {
+			delete(account.Tokens, id)
+		}
+	}
+	if account.Tokens == nil {
+		account.Tokens = make(map[string]*serviceAccountToken)
+	}
+	id := hex.EncodeToString(idBytes)
+	hash := sha256.Sum256(secret)
+	token := &serviceAccountToken{
+		SecretSHA256: hash[:],
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(lifetime),
+	}
+	account.Tokens[id] = token
+	return account.Name + "." + id + "." +
+		base64.RawURLEncoding.EncodeToString(secret), token, nil
+}
+
+// currentToken returns the refresh token of account which has not been
+// rotated, if any.
+func (account *serviceAccount) currentToken(
+	now time.Time) *serviceAccountToken {
+	for _, token := range account.Tokens {
+		if token.RotatedAt.IsZero() && now.Before(token.ExpiresAt) {
+			return token
+		}
+	}
+	return nil
+}
+
+// rotateServiceAccountToken checks the refresh token and returns the
+// service account and the token which replaces it. Presenting a token which
+// was already rotated revokes all tokens of the account.
+func (state *RuntimeState) rotateServiceAccountToken(token string,
+	now time.Time) (*serviceAccount, string, error) {
+	name, id, secret, err := parseServiceAccountToken(token)
+	if err != nil {
+		return nil, "", err
+	}
+	state.serviceAccountMutex.Lock()
+	defer state.serviceAccountMutex.Unlock()
+	account, ok, err := state.LoadServiceAccount(name)
+	if err != nil {
+		return nil, "", err
+	}
+	if !ok {
+		return nil, "", fmt.Errorf("unknown service account: %s", name)
+	}
+	storedToken := account.Tokens[id]
+	hash := sha256.Sum256(secret)
+	if storedToken == nil ||
+		subtle.ConstantTimeCompare(hash[:], storedToken.SecretSHA256) != 1 {
+		return nil, "", errors.New("invalid service account token")
+	}
+	if now.After(storedToken.ExpiresAt) {
+		return nil, "", fmt.Errorf("service account token expired at %s",
+			storedToken.ExpiresAt.Format(time.RFC3339))
+	}
+	if !storedToken.RotatedAt.IsZero() {
+		account.Tokens = nil
+		if err := state.SaveServiceAccount(account); err != nil {
+			return nil, "", err
+		}
+		return nil, "", fmt.Errorf(
+			"token rotated at %s was reused, all tokens of %s are revoked",
+			storedToken.RotatedAt.Format(time.RFC3339), name)
+	}
+	storedToken.RotatedAt = now
+	newToken, _, err := account.addToken(
+		state.getServiceAccountTokenLifetime(), now)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := state.SaveServiceAccount(account); err != nil {
+		return nil, "", err
+	}
+	return account, newToken, nil
+}
+
+// getServiceAccountGroups returns the groups of the service account
+// username. The bool is false if username is not a service account.
+func (state *RuntimeState) getServiceAccountGroups(username string) (
+	bool, []string, error) {
+	if !state.Config.ServiceAccounts.Enabled ||
+		!serviceAccountNameRE.MatchString(username) {
+		return false, nil, nil
+	}
+	account, ok, err := state.LoadServiceAccount(username)
+	if err != nil {
+		logger.Printf("cannot load service account %s: %s", username, err)
+		return false, nil, nil
+	}
+	if !ok {
+		return false, nil, nil
+	}
+	return true, account.Groups, nil
+}
+
+// serviceAccountLoginHandler logs in service accounts with a refresh token,
+// as described for proto.ServiceAccountLoginPath.
+func (state *RuntimeState) serviceAccountLoginHandler(w http.ResponseWriter,
+	r *http.Request) {
+	if state.sendFailureToClientIfLocked(w, r) {
+		return
+	}
+	if r.Method != "POST" {
+		state.writeFailureResponse(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		logger.Println(err)
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Error parsing form")
+		return
+	}
+	token := r.Form.Get("token")
+	name, _, _, err := parseServiceAccountToken(token)
+	if err != nil {
+		state.writeFailureResponse(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	attempt := state.checkRateLimit(w, r, name, proto.AuthTypeServiceAccount)
+	if attempt == nil {
+		return
+	}
+	defer attempt.release()
+	_, newToken, err := state.rotateServiceAccountToken(token, time.Now())
+	state.logAuditLogin(r, name, proto.AuthTypeServiceAccount, err == nil, err)
+	state.recordRateLimitResult(r, attempt, err == nil)
+	if err != nil {
+		logger.Printf("service account login as %s failed: %s", name, err)
+		state.writeFailureResponse(w, r, http.StatusUnauthorized,
+			"Invalid service account token")
+		return
+	}
+	_, err = state.setNewAuthCookie(w, r, name, AuthTypeServiceAccount)
+	if err != nil {
+		state.writeFailureResponse(w, r, http.StatusInternalServerError,
+			"error internal")
+		logger.Println(err)
+		return
+	}
+	eventNotifier.PublishAuthEvent(eventmon.AuthTypeServiceAccount, name)
+	logger.Debugf(1, "Valid service account login for %s", name)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(proto.LoginResponse{
+		Message:           "success",
+		CertAuthBackend:   []string{proto.AuthTypeServiceAccount},
+		SupportedKeyTypes: supportedKeyTypes,
+		RefreshToken:      newToken,
+	})
+}
+
+func getAdminServiceAccount(account *serviceAccount,
+	now time.Time) adminServiceAccount {
+	result := adminServiceAccount{
+		Name:           account.Name,
+		Groups:         account.Groups,
+		CertPolicyRule: account.CertPolicyRule,
+		CreatedBy:      account.CreatedBy,
+		CreatedAt:      account.CreatedAt,
+	}
+	if token := account.currentToken(now); token != nil {
+		expiresAt := token.ExpiresAt
+		result.TokenExpiresAt = &expiresAt
+	}
+	return result
+}
+
+// adminAPIServiceAccountsHandler lists the service accounts (GET) or
+// creates the service account of the "name" form value (POST) with the
+// "group" form values and the "cert_policy_rule" form value, answering with
+// its first refresh token.
+func (state *RuntimeState) adminAPIServiceAccountsHandler(
+	w http.ResponseWriter, r *http.Request) {
+	method := "GET"
+	if r.Method == "POST" {
+		method = "POST"
+	}
+	authUser, ok := state.checkAdminAPIAuth(w, r, method)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	if method == "GET" {
+		accounts, err := state.GetServiceAccounts()
+		if err != nil {
+			logger.Printf("Getting service accounts error: %v", err)
+			state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+			return
+		}
+		response := adminServiceAccountsResponse{
+			ServiceAccounts: make([]adminServiceAccount, 0, len(accounts)),
+		}
+		for _, account := range accounts {
+			response.ServiceAccounts = append(response.ServiceAccounts,
+				getAdminServiceAccount(account, now))
+		}
+		writeAdminAPIResponse(w, response)
+		return
+	}
+	name := r.Form.Get("name")
+	if !serviceAccountNameRE.MatchString(name) {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Invalid service account name")
+		return
+	}
+	account := &serviceAccount{
+		Name:           name,
+		Groups:         r.Form["group"],
+		CertPolicyRule: r.Form.Get("cert_policy_rule"),
+		CreatedBy:      authUser,
+		CreatedAt:      now,
+	}
+	sort.Strings(account.Groups)
+	if account.CertPolicyRule != "" && state.certPolicy == nil {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"cert_policy_rule requires a certificate policy")
+		return
+	}
+	token, storedToken, err := account.addToken(
+		state.getServiceAccountTokenLifetime(), now)
+	if err != nil {
+		logger.Println(err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	state.serviceAccountMutex.Lock()
+	defer state.serviceAccountMutex.Unlock()
+	if _, exists, err := state.LoadServiceAccount(name); err != nil {
+		logger.Printf("Loading service account error: %v", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	} else if exists {
+		state.writeFailureResponse(w, r, http.StatusConflict,
+			"Service account exists")
+		return
+	}
+	if err := state.SaveServiceAccount(account); err != nil {
+		logger.Printf("Saving service account error: %v", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	logger.Printf("%s created service account %s", authUser, name)
+	state.logAuditAdminAction(r, authUser, "create-service-account", true,
+		map[string]string{
+			"name":             name,
+			"groups":           strings.Join(account.Groups, ","),
+			"cert_policy_rule": account.CertPolicyRule,
+		})
+	writeAdminAPIResponse(w, adminServiceAccountTokenResponse{
+		Name:      name,
+		Token:     token,
+		ExpiresAt: storedToken.ExpiresAt,
+	})
+}
+
+// adminAPIServiceAccountTokenHandler revokes the refresh tokens of the
+// service account of the "name" form value and answers with a new one.
+func (state *RuntimeState) adminAPIServiceAccountTokenHandler(
+	w http.ResponseWriter, r *http.Request) {
+	authUser, ok := state.checkAdminAPIAuth(w, r, "POST")
+	if !ok {
+		return
+	}
+	name := r.Form.Get("name")
+	state.serviceAccountMutex.Lock()
+	defer state.serviceAccountMutex.Unlock()
+	account, ok, err := state.LoadServiceAccount(name)
+	if err != nil {
+		logger.Printf("Loading service account error: %v", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	if !ok {
+		state.writeFailureResponse(w, r, http.StatusNotFound,
+			"Unknown service account")
+		return
+	}
+	account.Tokens = nil
+	token, storedToken, err := account.addToken(
+		state.getServiceAccountTokenLifetime(), time.Now())
+	if err != nil {
+		logger.Println(err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	if err := state.SaveServiceAccount(account); err != nil {
+		logger.Printf("Saving service account error: %v", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	logger.Printf("%s issued a token for service account %s", authUser, name)
+	state.logAuditAdminAction(r, authUser, "issue-service-account-token",
+		true, map[string]string{"name": name})
+	writeAdminAPIResponse(w, adminServiceAccountTokenResponse{
+		Name:      name,
+		Token:     token,
+		ExpiresAt: storedToken.ExpiresAt,
+	})
+}
+
+// adminAPIDeleteServiceAccountHandler deletes the service account of the
+// "name" form value. Certificates are no longer issued with its sessions.
+func (state *RuntimeState) adminAPIDeleteServiceAccountHandler(
+	w http.ResponseWriter, r *http.Request) {
+	authUser, ok := state.checkAdminAPIAuth(w, r, "POST")
+	if !ok {
+		return
+	}
+	name := r.Form.Get("name")
+	state.serviceAccountMutex.Lock()
+	defer state.serviceAccountMutex.Unlock()
+	account, ok, err := state.LoadServiceAccount(name)
+	if err != nil {
+		logger.Printf("Loading service account error: %v", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	if !ok {
+		state.writeFailureResponse(w, r, http.StatusNotFound,
+			"Unknown service account")
+		return
+	}
+	if err := state.DeleteServiceAccount(name); err != nil {
+		logger.Printf("Deleting service account error: %v", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	logger.Printf("%s deleted service account %s", authUser, name)
+	state.logAuditAdminAction(r, authUser, "delete-service-account", true,
+		map[string]string{"name": name})
+	writeAdminAPIResponse(w, getAdminServiceAccount(account, time.Now()))
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+func setupServiceAccountState(t *testing.T) (*RuntimeState, func()) {
+	state, passwdFile, err := setupValidRuntimeStateSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "service_account_testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.Config.Base.DataDirectory = dir
+	if err := initDB(state); err != nil {
+		t.Fatal(err)
+	}
+	state.Config.ServiceAccounts = ServiceAccountConfig{
+		Enabled:       true,
+		TokenLifetime: time.Hour,
+	}
+	return state, func() {
+		os.Remove(passwdFile.Name())
+		os.RemoveAll(dir)
+	}
+}
+
+func TestParseServiceAccountToken(t *testing.T) {
+	account := &serviceAccount{Name: "deploy-bot"}
+	token, _, err := account.addToken(time.Hour, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, id, secret, err := parseServiceAccountToken(token + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "deploy-bot" || account.Tokens[id] == nil || len(secret) != 32 {
+		t.Fatalf("unexpected token %s: %s %s", token, name, id)
+	}
+	for _, token := range []string{
+		"",
+		"deploy-bot.1234",
+		"Deploy.1234.c2VjcmV0",
+		"deploy-bot.1234.!!",
+	} {
+		if _, _, _, err := parseServiceAccountToken(token); err == nil {
+			t.Errorf("%q should be rejected", token)
+		}
+	}
+}
+
+func TestRotateServiceAccountToken(t *testing.T) {
+	state, cleanup := setupServiceAccountState(t)
+	defer cleanup()
+	now := time.Now()
+	account := &serviceAccount{Name: "deploy-bot", Groups: []string{"ci"}}
+	token, _, err := account.addToken(time.Hour, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := state.SaveServiceAccount(account); err != nil {
+		t.Fatal(err)
+	}
+	_, newToken, err := state.rotateServiceAccountToken(token, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newToken == token {
+		t.Fatal("token was not replaced")
+	}
+	if _, _, err := state.rotateServiceAccountToken(newToken,
+		now.Add(2*time.Hour)); err == nil {
+		t.Fatal("expired token should fail")
+	}
+	_, nextToken, err := state.rotateServiceAccountToken(newToken, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Reusing a rotated token revokes all tokens.
+	if _, _, err := state.rotateServiceAccountToken(token, now); err == nil {
+		t.Fatal("reused token should fail")
+	}
+	if _, _, err := state.rotateServiceAccountToken(nextToken,
+		now); err == nil {
+		t.Fatal("tokens should be revoked after reuse")
+	}
+	ok, groups, err := state.getServiceAccountGroups("deploy-bot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || len(groups) != 1 || groups[0] != "ci" {
+		t.Fatalf("unexpected groups: %v", groups)
+	}
+	if ok, _, _ := state.getServiceAccountGroups("other-bot"); ok {
+		t.Fatal("unknown service account should not have groups")
+	}
+}
+
+func TestServiceAccountLogin(t *testing.T) {
+	state, cleanup := setupServiceAccountState(t)
+	defer cleanup()
+	account := &serviceAccount{Name: "deploy-bot"}
+	token, _, err := account.addToken(time.Hour, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := state.SaveServiceAccount(account); err != nil {
+		t.Fatal(err)
+	}
+	newRequest := func(token string) *http.Request {
+		form := url.Values{"token": {token}}
+		req, err := http.NewRequest("POST", proto.ServiceAccountLoginPath,
+			strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req
+	}
+	rr, err := checkRequestHandlerCode(newRequest(token),
+		state.serviceAccountLoginHandler, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !checkValidLoginResponse(rr.Result(), state, "deploy-bot") {
+		t.Fatal("invalid login response")
+	}
+	var response proto.LoginResponse
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.RefreshToken == "" || response.RefreshToken == token ||
+		response.CertAuthBackend[0] != proto.AuthTypeServiceAccount {
+		t.Fatalf("unexpected login response: %+v", response)
+	}
+	_, err = checkRequestHandlerCode(newRequest(response.RefreshToken),
+		state.serviceAccountLoginHandler, http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = checkRequestHandlerCode(newRequest("not-a-token"),
+		state.serviceAccountLoginHandler, http.StatusBadRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = checkRequestHandlerCode(newRequest(token),
+		state.serviceAccountLoginHandler, http.StatusUnauthorized)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
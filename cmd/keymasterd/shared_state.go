@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/sharedstate"
+	"github.com/Cloud-Foundations/keymaster/lib/simplestorage"
+)
+
+// Kinds of shared state. Keys are prefixed with them.
+const (
+	sharedStateAuthCache = "auth-cache"
+	sharedStateDuoPush   = "duo-push"
+	sharedStateLocalAuth = "local-auth"
+	sharedStateRADIUS    = "radius"
+	sharedStateVIPPush   = "vip-push"
+	sharedStateWebhook   = "webhook"
+)
+
+// newSharedState returns the store of config, in memory if no Redis URL is
+// configured.
+func newSharedState(config SharedStateConfig) (sharedstate.Store, error) {
+	if config.RedisURL == "" {
+		return sharedstate.NewMemoryStore(), nil
+	}
+	var password string
+	if config.RedisPasswordFile != "" {
+		buffer, err := ioutil.ReadFile(config.RedisPasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		password = strings.TrimSpace(string(buffer))
+	}
+	logger.Printf("keeping shared state in Redis")
+	return sharedstate.NewRedisStore(config.RedisURL, password, logger)
+}
+
+func sharedStateKey(kind string, key string) string {
+	return "keymaster/" + kind + "/" + key
+}
+
+// putSharedState stores value, JSON encoded, under kind and key until
+// expiresAt.
+func (state *RuntimeState) putSharedState(kind string, key string,
+	value interface{}, expiresAt time.Time) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return state.sharedState.Put(sharedStateKey(kind, key), data,
+		time.Until(expiresAt))
+}
+
+// getSharedState decodes the value of kind and key into value. The bool is
+// false if there is none.
+func (state *RuntimeState) getSharedState(kind string, key string,
+	value interface{}) (bool, error) {
+	data, ok, err := state.sharedState.Get(sharedStateKey(kind, key))
+	if err != nil || !ok {
+		return false, err
+	}
+	return true, json.Unmarshal(data, value)
+}
+
+// takeSharedState is like getSharedState, but also deletes the value, so
+// that only one instance gets it.
+func (state *RuntimeState) takeSharedState(kind string, key string,
+	value interface{}) (bool, error) {
+	data, ok, err := state.sharedState.Take(sharedStateKey(kind, key))
+	if err != nil || !ok {
+		return false, err
+	}
+	return true, json.Unmarshal(data, value)
+}
+
+func (state *RuntimeState) deleteSharedState(kind string, key string) error {
+	return state.sharedState.Delete(sharedStateKey(kind, key))
+}
+
+// pendingChallenge holds the state of a challenge of a second factor backend,
+// such as a RADIUS Access-Challenge, which is kept here so that clients only
+// see an opaque key bound to their username.
+type pendingChallenge struct {
+	ExpiresAt time.Time
+	Username  string
+	State     []byte
+}
+
+// putPendingChallenge saves the challenge state of username for maxAge under
+// a new key of kind, which it returns.
+func (state *RuntimeState) putPendingChallenge(kind string, username string,
+	challengeState []byte, maxAge time.Duration) (string, error) {
+	key, err := genRandomString()
+	if err != nil {
+		return "", err
+	}
+	expiresAt := time.Now().Add(maxAge)
+	err = state.putSharedState(kind, key, pendingChallenge{
+		ExpiresAt: expiresAt,
+		Username:  username,
+		State:     challengeState,
+	}, expiresAt)
+	if err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// takePendingChallenge returns and forgets the challenge state of kind for
+// key, which must belong to username.
+func (state *RuntimeState) takePendingChallenge(kind string, key string,
+	username string) ([]byte, bool) {
+	var pending pendingChallenge
+	ok, err := state.takeSharedState(kind, key, &pending)
+	if err != nil {
+		logger.Printf("cannot get pending %s challenge: %s", kind, err)
+		return nil, false
+	}
+	if !ok || pending.Username != username ||
+		pending.ExpiresAt.Before(time.Now()) {
+		return nil, false
+	}
+	return pending.State, true
+}
+
+// authCacheStorage returns the storage for cached authentications shared
+// by all instances: Redis if it is configured, else the database.
+func (state *RuntimeState) authCacheStorage() simplestorage.SimpleStore {
+	if state.Config.SharedState.RedisURL == "" {
+		return state
+	}
+	return &sharedSignedStore{state: state}
+}
+
+// sharedSignedStorage returns the storage of signed data which all instances
+// must see: Redis if it is configured, else the database. It is nil if there
+// is neither.
+func (state *RuntimeState) sharedSignedStorage() simplestorage.SimpleStore {
+	if state.Config.SharedState.RedisURL != "" && state.sharedState != nil {
+		return &sharedSignedStore{state: state}
+	}
+	if state.db == nil && state.dynamoStore == nil {
+		return nil
+	}
+	return state
+}
+
+// putSignedJSON stores value JSON encoded as the signed data of key and
+// dataType until expiresAt.
+func putSignedJSON(storage simplestorage.SimpleStore, key string,
+	dataType int, value interface{}, expiresAt time.Time) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return storage.UpsertSigned(key, dataType, expiresAt.Unix(), string(data))
+}
+
+// getSignedJSON decodes the data of key and dataType into value. The
+// bool is false if there is none.
+func getSignedJSON(storage simplestorage.SimpleStore, key string,
+	dataType int, value interface{}) (bool, error) {
+	ok, data, err := storage.GetSigned(key, dataType)
+	if err != nil || !ok {
+		return false, err
+	}
+	return true, json.Unmarshal([]byte(data), value)
+}
+
+// sharedSignedStore keeps signed data in the shared state.
+type sharedSignedStore struct {
+	state *RuntimeState
+}
+
+func sharedSignedKey(key string, dataType int) string {
+	return strconv.Itoa(dataType) + "/" + key
+}
+
+func (s *sharedSignedStore) UpsertSigned(key string, dataType int,
+	expiration int64, data string) error {
+	jwsData, err := s.state.genNewSerializedStorageStringDataJWT(key,
+		dataType, data, expiration)
+	if err != nil {
+		return err
+	}
+	return s.state.sharedState.Put(
+		sharedStateKey(sharedStateAuthCache, sharedSignedKey(key, dataType)),
+		[]byte(jwsData), time.Until(time.Unix(expiration, 0)))
+}
+
+func (s *sharedSignedStore) DeleteSigned(key string, dataType int) error {
+	return s.state.deleteSharedState(sharedStateAuthCache,
+		sharedSignedKey(key, dataType))
+}
+
+func (s *sharedSignedStore) GetSigned(key string, dataType int) (
+	bool, string, error) {
+	jwsData, ok, err := s.state.sharedState.Get(
+		sharedStateKey(sharedStateAuthCache, sharedSignedKey(key, dataType)))
+	if err != nil || !ok {
+		return false, "", err
+	}
+	return s.state.decodeSignedData(key, string(jwsData))
+}
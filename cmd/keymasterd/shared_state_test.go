@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// setupSharedStateInstances returns two instances with the same signer and
+// shared state, as behind a load balancer.
+func setupSharedStateInstances(t *testing.T) (*RuntimeState, *RuntimeState) {
+	state, passwdFile, err := setupValidRuntimeStateSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(passwdFile.Name())
+	other, otherPasswdFile, err := setupValidRuntimeStateSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(otherPasswdFile.Name())
+	other.sharedState = state.sharedState
+	return state, other
+}
+
+func TestSharedPendingChallenge(t *testing.T) {
+	state, other := setupSharedStateInstances(t)
+	key, err := state.putPendingChallenge(sharedStateRADIUS, "username",
+		[]byte("radius state"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ok := other.takePendingChallenge(sharedStateRADIUS, key, "otheruser")
+	if ok {
+		t.Fatal("challenge of another user should not be returned")
+	}
+	key, err = state.putPendingChallenge(sharedStateRADIUS, "username",
+		[]byte("radius state"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	radiusState, ok := other.takePendingChallenge(sharedStateRADIUS, key,
+		"username")
+	if !ok || string(radiusState) != "radius state" {
+		t.Fatalf("challenge was not shared: %v %q", ok, radiusState)
+	}
+	_, ok = state.takePendingChallenge(sharedStateRADIUS, key, "username")
+	if ok {
+		t.Fatal("challenge should be used once")
+	}
+}
+
+func TestSharedSignedStore(t *testing.T) {
+	state, other := setupSharedStateInstances(t)
+	state.Config.SharedState.RedisURL = "redis://localhost"
+	other.Config.SharedState.RedisURL = "redis://localhost"
+	expiration := time.Now().Add(time.Minute).Unix()
+	err := state.authCacheStorage().UpsertSigned("username", 2, expiration,
+		"cached auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, data, err := other.authCacheStorage().GetSigned("username", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || data != "cached auth" {
+		t.Fatalf("unexpected data: %v %q", ok, data)
+	}
+	if ok, _, err := other.authCacheStorage().GetSigned("username",
+		3); err != nil || ok {
+		t.Fatalf("other data type should not be found: %v %v", ok, err)
+	}
+	if err := other.authCacheStorage().DeleteSigned("username", 2); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _, err := state.authCacheStorage().GetSigned("username",
+		2); err != nil || ok {
+		t.Fatalf("deleted data should not be found: %v %v", ok, err)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+const (
+	spiffeBundleTarget      = "spiffe-bundle"
+	spiffeBundleRefreshHint = 3600
+)
+
+var (
+	spiffeTrustDomainRegexp = regexp.MustCompile(`^[a-z0-9._-]+$`)
+	spiffePathSegmentRegexp = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+)
+
+// spiffeBundle is a SPIFFE trust bundle in the JWK Set format of the
+// SPIFFE bundle endpoint.
+type spiffeBundle struct {
+	Keys        []jose.JSONWebKey `json:"keys"`
+	Sequence    int64             `json:"spiffe_sequence"`
+	RefreshHint int               `json:"spiffe_refresh_hint"`
+}
+
+func checkSPIFFETrustDomain(trustDomain string) error {
+	if trustDomain == "" {
+		return nil
+	}
+	if !spiffeTrustDomainRegexp.MatchString(trustDomain) {
+		return fmt.Errorf("invalid SPIFFE trust domain: %s", trustDomain)
+	}
+	return nil
+}
+
+// getSPIFFEID returns the SPIFFE ID of username in trustDomain. User names
+// which are not valid path segments of a SPIFFE ID have none.
+func getSPIFFEID(trustDomain string, username string) (string, error) {
+	if !spiffePathSegmentRegexp.MatchString(username) ||
+		username == "." || username == ".." {
+		return "", fmt.Errorf("%s is not valid in a SPIFFE ID", username)
+	}
+	return "spiffe://" + trustDomain + "/user/" + username, nil
+}
+
+// addSPIFFEID returns sans with the SPIFFE ID of username added if a trust
+// domain is configured.
+func (state *RuntimeState) addSPIFFEID(sans []string,
+	username string) []string {
+	trustDomain := state.Config.Base.SPIFFETrustDomain
+	if trustDomain == "" {
+		return sans
+	}
+	spiffeID, err := getSPIFFEID(trustDomain, username)
+	if err != nil {
+		logger.Printf("Not adding SPIFFE ID: %s", err)
+		return sans
+	}
+	return append(append([]string{}, sans...), spiffeID)
+}
+
+func (state *RuntimeState) getSPIFFEBundle() ([]byte, error) {
+	if len(state.caCertDer) < 1 {
+		return nil, errors.New("no CA certificate")
+	}
+	caCert, err := x509.ParseCertificate(state.caCertDer)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(spiffeBundle{
+		Keys: []jose.JSONWebKey{{
+			Key:          caCert.PublicKey,
+			Certificates: []*x509.Certificate{caCert},
+			Use:          "x509-svid",
+		}},
+		// A new CA certificate starts later than the one it replaces.
+		Sequence:    caCert.NotBefore.Unix(),
+		RefreshHint: spiffeBundleRefreshHint,
+	})
+}
+
+func (state *RuntimeState) writeSPIFFEBundle(w http.ResponseWriter,
+	r *http.Request) {
+	if state.Config.Base.SPIFFETrustDomain == "" {
+		state.writeFailureResponse(w, r, http.StatusNotFound, "")
+		return
+	}
+	bundle, err := state.getSPIFFEBundle()
+	if err != nil {
+		logger.Printf("Cannot make SPIFFE bundle: %s", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bundle)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestGetSPIFFEID(t *testing.T) {
+	spiffeID, err := getSPIFFEID("example.org", "user.name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spiffeID != "spiffe://example.org/user/user.name" {
+		t.Fatalf("unexpected SPIFFE ID %s", spiffeID)
+	}
+	for _, username := range []string{"", "..", "user/name", "user@example"} {
+		if _, err := getSPIFFEID("example.org", username); err == nil {
+			t.Fatalf("%q should not be valid", username)
+		}
+	}
+	if err := checkSPIFFETrustDomain("Example.org"); err == nil {
+		t.Fatal("upper case trust domain should be invalid")
+	}
+}
+
+func TestSPIFFEX509Cert(t *testing.T) {
+	state, passwdFile, err := setupValidRuntimeStateSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(passwdFile.Name())
+	req, err := http.NewRequest("GET", publicPath+spiffeBundleTarget, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = checkRequestHandlerCode(req, state.publicPathHandler,
+		http.StatusNotFound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.Config.Base.SPIFFETrustDomain = "example.org"
+	rr, err := checkRequestHandlerCode(req, state.publicPathHandler,
+		http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bundle struct {
+		Keys []struct {
+			Use string   `json:"use"`
+			X5c [][]byte `json:"x5c"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&bundle); err != nil {
+		t.Fatal(err)
+	}
+	if len(bundle.Keys) != 1 || bundle.Keys[0].Use != "x509-svid" ||
+		len(bundle.Keys[0].X5c) != 1 ||
+		!bytes.Equal(bundle.Keys[0].X5c[0], state.caCertDer) {
+		t.Fatalf("unexpected bundle %+v", bundle)
+	}
+	cookieReq, err := createKeyBodyRequest("POST",
+		"/certgen/username?type=x509", testUserPEMPublicKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookieVal, err := state.setNewAuthCookie(nil, nil, "username", AuthTypeU2F)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookieReq.AddCookie(&http.Cookie{Name: authCookieName, Value: cookieVal})
+	rr, err = checkRequestHandlerCode(cookieReq, state.certGenHandler,
+		http.StatusOK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(rr.Body.Bytes())
+	if block == nil {
+		t.Fatal("no PEM encoded certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cert.URIs) != 1 ||
+		cert.URIs[0].String() != "spiffe://example.org/user/username" {
+		t.Fatalf("unexpected URIs %v", cert.URIs)
+	}
+}
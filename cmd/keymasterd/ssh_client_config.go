@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+// checkSSHClientConfig rejects values which would break the ssh_config
+// written by the clients.
+func checkSSHClientConfig(config SSHClientConfig) error {
+	for _, domain := range config.Domains {
+		if len(domain.HostPatterns) < 1 {
+			return errors.New("a domain has no host_patterns")
+		}
+		for _, pattern := range domain.HostPatterns {
+			if pattern == "" || strings.ContainsAny(pattern, " \t\",") {
+				return fmt.Errorf("invalid host pattern %q", pattern)
+			}
+		}
+		if strings.ContainsAny(domain.ProxyJump, " \t\"") {
+			return fmt.Errorf("invalid proxy_jump %q", domain.ProxyJump)
+		}
+		if domain.Port < 0 || domain.Port > 65535 {
+			return fmt.Errorf("invalid port %d", domain.Port)
+		}
+	}
+	return nil
+}
+
+// getSSHClientDomains returns the configured host domains for keymaster
+// ssh-setup.
+func (state *RuntimeState) getSSHClientDomains() []proto.SSHClientDomain {
+	domains := make([]proto.SSHClientDomain, 0,
+		len(state.Config.SSHClientConfig.Domains))
+	for _, domain := range state.Config.SSHClientConfig.Domains {
+		domains = append(domains, proto.SSHClientDomain{
+			HostPatterns:         domain.HostPatterns,
+			UseKeymasterUsername: domain.UseKeymasterUsername,
+			ProxyJump:            domain.ProxyJump,
+			Port:                 domain.Port,
+		})
+	}
+	return domains
+}
+
+// writeSSHClientConfig writes the configured host domains.
+func (state *RuntimeState) writeSSHClientConfig(w http.ResponseWriter,
+	r *http.Request) {
+	response := proto.SSHClientConfigResponse{
+		Domains: state.getSSHClientDomains(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+func TestCheckSSHClientConfig(t *testing.T) {
+	for _, test := range []struct {
+		domain SSHClientDomain
+		valid  bool
+	}{
+		{SSHClientDomain{HostPatterns: []string{"*.example.com"},
+			ProxyJump: "bastion.example.com", Port: 2222}, true},
+		{SSHClientDomain{}, false},
+		{SSHClientDomain{HostPatterns: []string{"a b"}}, false},
+		{SSHClientDomain{HostPatterns: []string{"a,b"}}, false},
+		{SSHClientDomain{HostPatterns: []string{"*"},
+			ProxyJump: "a b"}, false},
+		{SSHClientDomain{HostPatterns: []string{"*"}, Port: 65536}, false},
+	} {
+		err := checkSSHClientConfig(SSHClientConfig{
+			Domains: []SSHClientDomain{test.domain}})
+		if test.valid && err != nil {
+			t.Errorf("%+v: %s", test.domain, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%+v should be invalid", test.domain)
+		}
+	}
+}
+
+func TestWriteSSHClientConfig(t *testing.T) {
+	var state RuntimeState
+	state.Config.SSHClientConfig.Domains = []SSHClientDomain{{
+		HostPatterns:         []string{"*.example.com"},
+		UseKeymasterUsername: true,
+		ProxyJump:            "bastion.example.com",
+	}}
+	rr := httptest.NewRecorder()
+	state.writeSSHClientConfig(rr,
+		httptest.NewRequest("GET", proto.SSHClientConfigPath, nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rr.Code)
+	}
+	var response proto.SSHClientConfigResponse
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Domains) != 1 ||
+		response.Domains[0].HostPatterns[0] != "*.example.com" ||
+		!response.Domains[0].UseKeymasterUsername ||
+		response.Domains[0].ProxyJump != "bastion.example.com" {
+		t.Fatalf("unexpected response %+v", response)
+	}
+}
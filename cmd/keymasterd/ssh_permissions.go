@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Cloud-Foundations/keymaster/lib/certgen"
+	"github.com/Cloud-Foundations/keymaster/lib/certpolicy"
+	"golang.org/x/crypto/ssh"
+)
+
+// sshPermissionsRequest holds the SSH certificate critical options and
+// extensions asked for by a client.
+type sshPermissionsRequest struct {
+	criticalOptions map[string]string
+	// extensions replace the configured extensions if not nil.
+	extensions []string
+}
+
+// parseSSHPermissionsRequest reads the "critical_option" form values, each
+// of the form name=value, and the comma separated "extensions" form value.
+func parseSSHPermissionsRequest(r *http.Request) (
+	sshPermissionsRequest, error) {
+	var request sshPermissionsRequest
+	for _, value := range r.Form["critical_option"] {
+		splitValue := strings.SplitN(value, "=", 2)
+		if len(splitValue) != 2 || splitValue[0] == "" {
+			return sshPermissionsRequest{}, fmt.Errorf(
+				"invalid critical option %q", value)
+		}
+		if request.criticalOptions == nil {
+			request.criticalOptions = make(map[string]string)
+		}
+		request.criticalOptions[splitValue[0]] = splitValue[1]
+	}
+	if values, ok := r.Form["extensions"]; ok {
+		request.extensions = []string{}
+		for _, value := range values {
+			for _, extension := range strings.Split(value, ",") {
+				if extension = strings.TrimSpace(extension); extension != "" {
+					request.extensions = append(request.extensions, extension)
+				}
+			}
+		}
+	}
+	return request, nil
+}
+
+// getDefaultSSHPermissions returns the permissions set by ssh_cert_options,
+// using the ssh-keygen default extensions if none are configured.
+func (state *RuntimeState) getDefaultSSHPermissions() ssh.Permissions {
+	config := state.getConfig().Base.SSHCertOptions
+	permissions := certgen.DefaultSSHPermissions()
+	if len(config.Extensions) > 0 {
+		permissions.Extensions = make(map[string]string)
+		for _, extension := range config.Extensions {
+			permissions.Extensions[extension] = ""
+		}
+	}
+	if len(config.CriticalOptions) > 0 {
+		permissions.CriticalOptions = make(map[string]string)
+		for name, value := range config.CriticalOptions {
+			permissions.CriticalOptions[name] = value
+		}
+	}
+	return permissions
+}
+
+// addToPolicyRequest adds the requested critical options and the requested
+// extensions which are not granted by default to policyRequest. Critical
+// options set by the server may not be overridden.
+func (request sshPermissionsRequest) addToPolicyRequest(
+	policyRequest *certpolicy.Request, defaults ssh.Permissions) error {
+	for name := range request.criticalOptions {
+		if _, ok := defaults.CriticalOptions[name]; ok {
+			return fmt.Errorf("SSH critical option %q is set by the server",
+				name)
+		}
+	}
+	policyRequest.SSHCriticalOptions = request.criticalOptions
+	for _, extension := range request.extensions {
+		if _, ok := defaults.Extensions[extension]; !ok {
+			policyRequest.SSHExtensions = append(policyRequest.SSHExtensions,
+				extension)
+		}
+	}
+	return nil
+}
+
+// getSSHPermissions returns the permissions for an SSH certificate given the
+// configured defaults and what the policy decision permits.
+func (request sshPermissionsRequest) getSSHPermissions(
+	defaults ssh.Permissions,
+	decision *certpolicy.Decision) ssh.Permissions {
+	permissions := defaults
+	if len(decision.SSHCriticalOptions) > 0 {
+		permissions.CriticalOptions = make(map[string]string)
+		for name, value := range defaults.CriticalOptions {
+			permissions.CriticalOptions[name] = value
+		}
+		for name, value := range decision.SSHCriticalOptions {
+			permissions.CriticalOptions[name] = value
+		}
+	}
+	if request.extensions != nil {
+		permissions.Extensions = make(map[string]string)
+		for _, extension := range request.extensions {
+			permissions.Extensions[extension] = ""
+		}
+	}
+	return permissions
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/Cloud-Foundations/keymaster/lib/certpolicy"
+)
+
+func TestSSHPermissionsRequest(t *testing.T) {
+	var state RuntimeState
+	state.Config.Base.SSHCertOptions = SSHCertOptionsConfig{
+		CriticalOptions: map[string]string{"source-address": "10.0.0.0/8"},
+		Extensions:      []string{"permit-pty"},
+	}
+	defaults := state.getDefaultSSHPermissions()
+	r := &http.Request{Form: url.Values{
+		"critical_option": {"force-command=/bin/true"},
+		"extensions":      {"permit-pty,permit-port-forwarding"},
+	}}
+	request, err := parseSSHPermissionsRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var policyRequest certpolicy.Request
+	if err := request.addToPolicyRequest(&policyRequest, defaults); err != nil {
+		t.Fatal(err)
+	}
+	if len(policyRequest.SSHExtensions) != 1 ||
+		policyRequest.SSHExtensions[0] != "permit-port-forwarding" {
+		t.Fatalf("unexpected additional extensions: %v",
+			policyRequest.SSHExtensions)
+	}
+	permissions := request.getSSHPermissions(defaults, &certpolicy.Decision{
+		SSHCriticalOptions: policyRequest.SSHCriticalOptions,
+		SSHExtensions:      policyRequest.SSHExtensions,
+	})
+	if len(permissions.CriticalOptions) != 2 ||
+		permissions.CriticalOptions["force-command"] != "/bin/true" ||
+		permissions.CriticalOptions["source-address"] != "10.0.0.0/8" {
+		t.Fatalf("unexpected critical options: %v",
+			permissions.CriticalOptions)
+	}
+	if len(permissions.Extensions) != 2 {
+		t.Fatalf("unexpected extensions: %v", permissions.Extensions)
+	}
+	if len(defaults.CriticalOptions) != 1 {
+		t.Fatal("defaults were modified")
+	}
+	// Server set critical options cannot be overridden.
+	r.Form.Set("critical_option", "source-address=0.0.0.0/0")
+	request, err = parseSSHPermissionsRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = request.addToPolicyRequest(&certpolicy.Request{}, defaults)
+	if err == nil {
+		t.Fatal("overriding source-address should fail")
+	}
+	r.Form.Set("critical_option", "missing-value")
+	if _, err := parseSSHPermissionsRequest(r); err == nil {
+		t.Fatal("invalid critical option should fail")
+	}
+}
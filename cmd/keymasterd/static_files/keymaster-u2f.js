@@ -25,13 +25,22 @@ function checkError(resp) {
     alert(msg);
     return true;
   }
+  // u2fEnrollmentQuery returns the query string with the enrollment token
+  // entered on the profile page, if any.
+  function u2fEnrollmentQuery() {
+    var input = document.getElementById('enrollment_token');
+    if (!input || !input.value) {
+      return '';
+    }
+    return '?enrollment_token=' + encodeURIComponent(input.value.trim());
+  }
   function u2fRegistered(resp) {
     var username = document.getElementById('username').textContent;
     console.log(resp);
     if (checkError(resp)) {
       return;
     }
-    $.post('/u2f/RegisterResponse/' + username, JSON.stringify(resp)).done(function() {
+    $.post('/u2f/RegisterResponse/' + username + u2fEnrollmentQuery(), JSON.stringify(resp)).done(function() {
       alert('Success');
       location.reload();
     }).fail(serverError);
@@ -39,7 +48,7 @@ function checkError(resp) {
   function register() {
     var username = document.getElementById('username').textContent;
     document.getElementById('register_action_text').style.display="block";
-    $.getJSON('/u2f/RegisterRequest/' + username).done(function(req) {
+    $.getJSON('/u2f/RegisterRequest/' + username + u2fEnrollmentQuery()).done(function(req) {
       console.log(req);
       if (req.registeredKeys == null) {
 	      req.registeredKeys = [];
@@ -0,0 +1,66 @@
+function webauthnServerError(data) {
+    console.log(data);
+    alert('Server error code ' + data.status + ': ' + data.responseText);
+  }
+
+function bufferDecode(value) {
+    value = value.replace(/-/g, '+').replace(/_/g, '/');
+    return Uint8Array.from(atob(value), function(c) { return c.charCodeAt(0); });
+  }
+
+function bufferEncode(value) {
+    return btoa(String.fromCharCode.apply(null, new Uint8Array(value)))
+      .replace(/\+/g, '-').replace(/\//g, '_').replace(/=/g, '');
+  }
+
+  // webauthnEnrollmentQuery returns the query string with the enrollment
+  // token entered on the profile page, if any.
+  function webauthnEnrollmentQuery() {
+    var input = document.getElementById('enrollment_token');
+    if (!input || !input.value) {
+      return '';
+    }
+    return '?enrollment_token=' + encodeURIComponent(input.value.trim());
+  }
+  function webauthnRegister() {
+    var username = document.getElementById('username').textContent;
+    document.getElementById('webauthn_register_action_text').style.display="block";
+    $.getJSON('/webauthn/RegisterBegin/' + username + webauthnEnrollmentQuery()).done(function(options) {
+      console.log(options);
+      options.publicKey.challenge = bufferDecode(options.publicKey.challenge);
+      options.publicKey.user.id = bufferDecode(options.publicKey.user.id);
+      if (options.publicKey.excludeCredentials) {
+        for (var i = 0; i < options.publicKey.excludeCredentials.length; i++) {
+          options.publicKey.excludeCredentials[i].id =
+            bufferDecode(options.publicKey.excludeCredentials[i].id);
+        }
+      }
+      navigator.credentials.create({publicKey: options.publicKey}).then(function(credential) {
+        document.getElementById('webauthn_register_action_text').style.display="none";
+        var body = {
+          id: credential.id,
+          rawId: bufferEncode(credential.rawId),
+          type: credential.type,
+          response: {
+            attestationObject: bufferEncode(credential.response.attestationObject),
+            clientDataJSON: bufferEncode(credential.response.clientDataJSON)
+          }
+        };
+        $.post('/webauthn/RegisterFinish/' + username + webauthnEnrollmentQuery(), JSON.stringify(body)).done(function() {
+          alert('Success');
+          location.reload();
+        }).fail(webauthnServerError);
+      }, function(err) {
+        document.getElementById('webauthn_register_action_text').style.display="none";
+        console.log(err);
+        alert('WebAuthn registration failed: ' + err);
+      });
+    }).fail(webauthnServerError);
+  }
+
+document.addEventListener('DOMContentLoaded', function () {
+	  var registerButton = document.getElementById('webauthn_register_button');
+	  if (registerButton) {
+		  registerButton.addEventListener('click', webauthnRegister);
+	  }
+});
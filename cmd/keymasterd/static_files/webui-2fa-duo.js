@@ -0,0 +1,40 @@
+  var duoPoller;
+
+  function setDuoStatus(text) {
+      document.getElementById("duo_push_status").innerHTML = text;
+  }
+
+  function stopDuoPoll() {
+      clearInterval(duoPoller);
+      document.getElementById("duo_push_button").disabled = false;
+  }
+
+  function singleDuoPoll() {
+      var xhr = new XMLHttpRequest();
+      xhr.onreadystatechange = function() {
+          if (this.readyState != 4) {
+              return;
+          }
+          if (this.status == 200) {
+              var destination = document.getElementById("duo_login_destination").innerHTML;
+              window.location.href = destination;
+          } else if (this.status != 412) {
+              stopDuoPoll();
+              setDuoStatus("Duo push failed");
+          }
+      };
+      xhr.open("POST", "/api/v0/duoPush", true);
+      xhr.send();
+  }
+
+  function startDuoPush() {
+      document.getElementById("duo_push_button").disabled = true;
+      setDuoStatus("Waiting for approval");
+      singleDuoPoll();
+      duoPoller = setInterval(singleDuoPoll, 2000);
+      setTimeout(stopDuoPoll, 60000);
+  }
+
+document.addEventListener('DOMContentLoaded', function () {
+      document.getElementById("duo_push_button").addEventListener('click', startDuoPush, false);
+});
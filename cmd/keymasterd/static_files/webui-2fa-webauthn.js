@@ -0,0 +1,59 @@
+function webauthnServerError(data) {
+    console.log(data);
+    alert('Server error code ' + data.status + ': ' + data.responseText);
+  }
+
+function bufferDecode(value) {
+    value = value.replace(/-/g, '+').replace(/_/g, '/');
+    return Uint8Array.from(atob(value), function(c) { return c.charCodeAt(0); });
+  }
+
+function bufferEncode(value) {
+    return btoa(String.fromCharCode.apply(null, new Uint8Array(value)))
+      .replace(/\+/g, '-').replace(/\//g, '_').replace(/=/g, '');
+  }
+
+  function webauthnSign() {
+    document.getElementById('webauthn_action_text').style.display="block";
+    $.getJSON('/webauthn/AuthBegin').done(function(options) {
+      console.log(options);
+      options.publicKey.challenge = bufferDecode(options.publicKey.challenge);
+      for (var i = 0; i < options.publicKey.allowCredentials.length; i++) {
+        options.publicKey.allowCredentials[i].id =
+          bufferDecode(options.publicKey.allowCredentials[i].id);
+      }
+      navigator.credentials.get({publicKey: options.publicKey}).then(function(assertion) {
+        document.getElementById('webauthn_action_text').style.display="none";
+        var body = {
+          id: assertion.id,
+          rawId: bufferEncode(assertion.rawId),
+          type: assertion.type,
+          response: {
+            authenticatorData: bufferEncode(assertion.response.authenticatorData),
+            clientDataJSON: bufferEncode(assertion.response.clientDataJSON),
+            signature: bufferEncode(assertion.response.signature),
+            userHandle: bufferEncode(assertion.response.userHandle || new ArrayBuffer(0))
+          }
+        };
+        $.ajax({
+          url: '/webauthn/AuthFinish',
+          type: 'POST',
+          data: JSON.stringify(body),
+          headers: {'X-Requested-With': 'XMLHttpRequest'}
+        }).done(function() {
+          var destination = document.getElementById("webauthn_login_destination").innerHTML;
+          window.location.href = destination;
+        }).fail(webauthnServerError);
+      }, function(err) {
+        document.getElementById('webauthn_action_text').style.display="none";
+        console.log(err);
+      });
+    }).fail(webauthnServerError);
+  }
+
+document.addEventListener('DOMContentLoaded', function () {
+	  if (!window.PublicKeyCredential) {
+		  return;
+	  }
+	  document.getElementById('webauthn_auth_button').addEventListener('click', webauthnSign);
+});
@@ -0,0 +1,154 @@
+  // Generates an ECDSA P-256 key pair with WebCrypto and asks the server to
+  // sign its public key, so that certificates can be obtained without the
+  // keymaster client. The private key never leaves the browser.
+
+  function setCertRequestStatus(text) {
+      document.getElementById("cert_request_status").textContent = text;
+  }
+
+  function arrayToBase64(array) {
+      var binary = "";
+      var bytes = new Uint8Array(array);
+      for (var i = 0; i < bytes.length; i++) {
+          binary += String.fromCharCode(bytes[i]);
+      }
+      return window.btoa(binary);
+  }
+
+  function toPEM(type, der) {
+      var lines = arrayToBase64(der).match(/.{1,64}/g);
+      return "-----BEGIN " + type + "-----\n" + lines.join("\n") +
+          "\n-----END " + type + "-----\n";
+  }
+
+  // sshString encodes value as an SSH wire format string.
+  function sshString(value) {
+      var length = value.length;
+      var out = new Uint8Array(4 + length);
+      out[0] = (length >>> 24) & 0xff;
+      out[1] = (length >>> 16) & 0xff;
+      out[2] = (length >>> 8) & 0xff;
+      out[3] = length & 0xff;
+      out.set(value, 4);
+      return out;
+  }
+
+  function asciiBytes(text) {
+      var out = new Uint8Array(text.length);
+      for (var i = 0; i < text.length; i++) {
+          out[i] = text.charCodeAt(i);
+      }
+      return out;
+  }
+
+  // toSSHPublicKey returns the raw P-256 point in authorized_keys format.
+  function toSSHPublicKey(rawPoint, comment) {
+      var parts = [sshString(asciiBytes("ecdsa-sha2-nistp256")),
+                   sshString(asciiBytes("nistp256")),
+                   sshString(new Uint8Array(rawPoint))];
+      var length = 0;
+      parts.forEach(function(part) { length += part.length; });
+      var blob = new Uint8Array(length);
+      var offset = 0;
+      parts.forEach(function(part) {
+          blob.set(part, offset);
+          offset += part.length;
+      });
+      return "ecdsa-sha2-nistp256 " + arrayToBase64(blob) + " " + comment +
+          "\n";
+  }
+
+  function requestCert(certType, publicKey) {
+      var username = document.getElementById("cert_request").dataset.username;
+      var form = new FormData();
+      form.append("pubkeyfile", new Blob([publicKey]), "pubkeyfile");
+      return fetch("/certgen/" + encodeURIComponent(username) + "?type=" +
+                   certType, {
+          method: "POST",
+          credentials: "same-origin",
+          headers: {"Accept": "application/json"},
+          body: form,
+      }).then(function(response) {
+          if (response.ok) {
+              return response.text();
+          }
+          return response.text().then(function(text) {
+              var message = text;
+              try {
+                  message = JSON.parse(text).message;
+              } catch (e) {
+              }
+              throw new Error(certType + " certificate refused: " + message);
+          });
+      });
+  }
+
+  function addDownload(filename, contents) {
+      var link = document.createElement("a");
+      link.href = URL.createObjectURL(new Blob([contents],
+                                               {type: "application/octet-stream"}));
+      link.download = filename;
+      link.textContent = filename;
+      var item = document.createElement("li");
+      item.appendChild(link);
+      document.getElementById("cert_request_downloads").appendChild(item);
+  }
+
+  function startCertRequest() {
+      var button = document.getElementById("cert_request_button");
+      var wantSSH = document.getElementById("cert_request_ssh").checked;
+      var wantX509 = document.getElementById("cert_request_x509").checked;
+      if (!wantSSH && !wantX509) {
+          setCertRequestStatus("Select at least one certificate type");
+          return;
+      }
+      if (!window.crypto || !window.crypto.subtle) {
+          setCertRequestStatus("This browser cannot generate keys");
+          return;
+      }
+      button.disabled = true;
+      document.getElementById("cert_request_downloads").textContent = "";
+      setCertRequestStatus("Generating key");
+      var keyPair;
+      var files = [];
+      window.crypto.subtle.generateKey({name: "ECDSA", namedCurve: "P-256"},
+                                       true, ["sign", "verify"])
+      .then(function(generated) {
+          keyPair = generated;
+          return window.crypto.subtle.exportKey("pkcs8", keyPair.privateKey);
+      }).then(function(pkcs8) {
+          files.push(["keymaster", toPEM("PRIVATE KEY", pkcs8)]);
+          setCertRequestStatus("Requesting certificates");
+          if (!wantSSH) {
+              return;
+          }
+          return window.crypto.subtle.exportKey("raw", keyPair.publicKey)
+          .then(function(rawPoint) {
+              return requestCert("ssh", toSSHPublicKey(rawPoint,
+                                                       "keymaster-web"));
+          }).then(function(cert) {
+              files.push(["keymaster-cert.pub", cert]);
+          });
+      }).then(function() {
+          if (!wantX509) {
+              return;
+          }
+          return window.crypto.subtle.exportKey("spki", keyPair.publicKey)
+          .then(function(spki) {
+              return requestCert("x509", toPEM("PUBLIC KEY", spki));
+          }).then(function(cert) {
+              files.push(["keymaster.cert", cert]);
+          });
+      }).then(function() {
+          files.forEach(function(file) { addDownload(file[0], file[1]); });
+          setCertRequestStatus("Done. Save the files below; the key is not kept anywhere else.");
+      }).catch(function(err) {
+          setCertRequestStatus(err.message);
+      }).finally(function() {
+          button.disabled = false;
+      });
+  }
+
+document.addEventListener('DOMContentLoaded', function () {
+      document.getElementById("cert_request_button").addEventListener('click', startCertRequest, false);
+});
@@ -11,7 +11,7 @@ import (
 	"strings"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/Cloud-Foundations/keymaster/lib/simplestorage/pgstore"
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -22,6 +22,11 @@ const cachedDBFilename = "cachedDB.sqlite3"
 
 func initDB(state *RuntimeState) (err error) {
 	logger.Debugf(3, "Top of initDB")
+	state.profileKeyring, err = newStorageKeyring(
+		state.Config.ProfileStorage.Encryption)
+	if err != nil {
+		return err
+	}
 	//open/create cache DB first
 	cacheDBFilename := filepath.Join(state.Config.Base.DataDirectory, cachedDBFilename)
 	state.cacheDB, err = initFileDBSQLite(cacheDBFilename, state.cacheDB)
@@ -41,6 +46,12 @@ func initDB(state *RuntimeState) (err error) {
 		err := errors.New("Bad storage url string")
 		return err
 	}
+	if splitString[0] == "dynamodb" {
+		// DynamoDB is replicated by AWS, so it is not copied into the cache
+		// DB.
+		logger.Printf("doing dynamodb")
+		return initDBDynamoDB(state)
+	}
 	state.remoteDBQueryTimeout = time.Second * 2
 	initialSleep := time.Second * 3
 	go state.BackgroundDBCopy(initialSleep)
@@ -61,26 +72,13 @@ func initDB(state *RuntimeState) (err error) {
 
 func initDBPostgres(state *RuntimeState) (err error) {
 	state.dbType = "postgres"
-	state.db, err = sql.Open("postgres", state.Config.ProfileStorage.StorageUrl)
+	state.pgStore, err = pgstore.Open(state.Config.ProfileStorage.StorageUrl,
+		state.Config.ProfileStorage.PoolConfig, logger)
 	if err != nil {
+		logger.Printf("init postgres err: %s", err)
 		return err
 	}
-	/// This should be changed to take care of DB schema
-	if true {
-		sqlStmt := `create table if not exists user_profile (id serial not null primary key, username text unique, profile_data bytea);`
-		_, err = state.db.Exec(sqlStmt)
-		if err != nil {
-			logger.Printf("init postgres err: %s: %q\n", err, sqlStmt)
-			return err
-		}
-		sqlStmt = `create table if not exists expiring_signed_user_data(id serial not null primary key, username text not null, jws_data text not null, type integer not null, expiration_epoch integer not null, update_epoch integer not null, UNIQUE(username,type));`
-		_, err = state.db.Exec(sqlStmt)
-		if err != nil {
-			logger.Printf("init postgres err: %s: %q\n", err, sqlStmt)
-			return err
-		}
-	}
-
+	state.db = state.pgStore.DB()
 	return nil
 }
 
@@ -95,6 +93,8 @@ func initDBSQlite(state *RuntimeState) (err error) {
 var sqliteinitializationStatements = []string{
 	`create table if not exists user_profile (id integer not null primary key, username text unique, profile_data blob);`,
 	`create table if not exists expiring_signed_user_data(id integer not null primary key, username text not null, jws_data text not null, type integer not null, expiration_epoch integer not null, update_epoch integer no null, UNIQUE(username,type));`,
+	`create table if not exists revoked_certificate(id integer not null primary key, cert_type text not null, serial text not null, revoked_by text not null, reason integer not null, revocation_epoch integer not null, UNIQUE(cert_type,serial));`,
+	`create table if not exists service_account(id integer not null primary key, name text unique, account_data blob);`,
 }
 
 func initializeSQLitetables(db *sql.DB) error {
@@ -256,6 +256,10 @@ func copyDBIntoSQLite(source, destination *sql.DB, destinationType string) error
 			return err
 		}
 	}
+	if err := copyRevokedCertificates(source, tx, destinationType); err != nil {
+		logger.Printf("err='%s'", err)
+		return err
+	}
 
 	err = tx.Commit()
 	if err != nil {
@@ -296,6 +300,9 @@ func gatherUsers(stmt *sql.Stmt) ([]string, error) {
 }
 
 func (state *RuntimeState) GetUsers() ([]string, bool, error) {
+	if state.dynamoStore != nil {
+		return state.getUsersDynamoDB()
+	}
 	ch := make(chan getUsersData, 1)
 	start := time.Now()
 	go func() {
@@ -317,12 +324,14 @@ func (state *RuntimeState) GetUsers() ([]string, bool, error) {
 	case dbMessage := <-ch:
 		if dbMessage.Err != nil {
 			logger.Printf("Problem with db ='%s'", dbMessage.Err)
+			metricLogStorageError("read")
 		} else {
 			metricLogExternalServiceDuration("storage-read", time.Since(start))
 		}
 		return dbMessage.Names, false, dbMessage.Err
 	case <-time.After(state.remoteDBQueryTimeout):
 		logger.Printf("GOT a timeout")
+		metricLogStorageError("timeout")
 		stmtText := getUsersStmt["sqlite"]
 		stmt, err := state.cacheDB.Prepare(stmtText)
 		if err != nil {
@@ -362,6 +371,14 @@ func (state *RuntimeState) LoadUserProfile(username string) (profile *userProfil
 	var defaultProfile userProfile
 	defaultProfile.U2fAuthData = make(map[int64]*u2fAuthData)
 	defaultProfile.TOTPAuthData = make(map[int64]*totpAuthData)
+	defaultProfile.WebauthnData = make(map[int64]*webauthnAuthData)
+	if state.dynamoStore != nil {
+		ok, err := state.loadUserProfileDynamoDB(username, &defaultProfile)
+		if err != nil {
+			return nil, false, false, err
+		}
+		return &defaultProfile, ok, false, nil
+	}
 
 	ch := make(chan loadUserProfileData, 1)
 	start := time.Now()
@@ -396,6 +413,7 @@ func (state *RuntimeState) LoadUserProfile(username string) (profile *userProfil
 				return &defaultProfile, false, fromCache, nil
 			} else {
 				logger.Printf("Problem with db ='%s'", err)
+				metricLogStorageError("read")
 				return nil, false, fromCache, err
 			}
 
@@ -404,6 +422,7 @@ func (state *RuntimeState) LoadUserProfile(username string) (profile *userProfil
 		profileBytes = dbMessage.ProfileBytes
 	case <-time.After(state.remoteDBQueryTimeout):
 		logger.Printf("GOT a timeout")
+		metricLogStorageError("timeout")
 		fromCache = true
 		// load from cache
 		stmtText := loadUserProfileStmt["sqlite"]
@@ -429,6 +448,10 @@ func (state *RuntimeState) LoadUserProfile(username string) (profile *userProfil
 
 	}
 	logger.Debugf(10, "profile bytes len=%d", len(profileBytes))
+	profileBytes, err = state.openProfileData(profileBytes)
+	if err != nil {
+		return nil, false, fromCache, err
+	}
 	//gobReader := bytes.NewReader(fileBytes)
 	gobReader := bytes.NewReader(profileBytes)
 	decoder := gob.NewDecoder(gobReader)
@@ -445,15 +468,32 @@ var saveUserProfileStmt = map[string]string{
 	"postgres": "insert into user_profile(username, profile_data) values ($1,$2) on CONFLICT(username) DO UPDATE set  profile_data = excluded.profile_data",
 }
 
-func (state *RuntimeState) SaveUserProfile(username string, profile *userProfile) error {
+func (state *RuntimeState) SaveUserProfile(username string, profile *userProfile) (err error) {
+	defer func() {
+		if err != nil {
+			metricLogStorageError("save")
+		}
+	}()
 	var gobBuffer bytes.Buffer
 
 	encoder := gob.NewEncoder(&gobBuffer)
 	if err := encoder.Encode(profile); err != nil {
 		return err
 	}
+	profileData, err := state.sealProfileData(gobBuffer.Bytes())
+	if err != nil {
+		return err
+	}
 
 	start := time.Now()
+	if state.dynamoStore != nil {
+		err := state.dynamoStore.PutProfile(username, profileData)
+		if err != nil {
+			return err
+		}
+		metricLogExternalServiceDuration("storage-save", time.Since(start))
+		return nil
+	}
 	//insert into DB
 	tx, err := state.db.Begin()
 	if err != nil {
@@ -465,7 +505,7 @@ func (state *RuntimeState) SaveUserProfile(username string, profile *userProfile
 		return err
 	}
 	defer stmt.Close()
-	_, err = stmt.Exec(username, gobBuffer.Bytes())
+	_, err = stmt.Exec(username, profileData)
 	if err != nil {
 		return err
 	}
@@ -477,12 +517,107 @@ func (state *RuntimeState) SaveUserProfile(username string, profile *userProfile
 	return nil
 }
 
+// UpdateUserProfile loads the profile of username from the primary DB,
+// calls update with it and saves it if update returns true, all in one
+// transaction. Concurrent updates of a profile are serialized, with
+// PostgreSQL and DynamoDB also across keymasterd instances, so update always
+// sees the latest profile. With DynamoDB update is called again if the
+// profile changed meanwhile. This is needed where a stale profile must not be saved,
+// such as when a one-time code is used.
+func (state *RuntimeState) UpdateUserProfile(username string,
+	update func(profile *userProfile) (bool, error)) (err error) {
+	defer func() {
+		if err != nil {
+			metricLogStorageError("save")
+		}
+	}()
+	updateData := func(data []byte) ([]byte, error) {
+		profile := &userProfile{
+			U2fAuthData:  make(map[int64]*u2fAuthData),
+			TOTPAuthData: make(map[int64]*totpAuthData),
+			WebauthnData: make(map[int64]*webauthnAuthData),
+		}
+		if data != nil {
+			data, err := state.openProfileData(data)
+			if err != nil {
+				return nil, err
+			}
+			err = gob.NewDecoder(bytes.NewReader(data)).Decode(profile)
+			if err != nil {
+				return nil, err
+			}
+		}
+		changed, err := update(profile)
+		if err != nil || !changed {
+			return nil, err
+		}
+		var gobBuffer bytes.Buffer
+		if err := gob.NewEncoder(&gobBuffer).Encode(profile); err != nil {
+			return nil, err
+		}
+		return state.sealProfileData(gobBuffer.Bytes())
+	}
+	start := time.Now()
+	if err := state.updateUserProfileData(username, updateData); err != nil {
+		return err
+	}
+	metricLogExternalServiceDuration("storage-save", time.Since(start))
+	return nil
+}
+
+// updateUserProfileData is UpdateUserProfile for the stored profile data.
+func (state *RuntimeState) updateUserProfileData(username string,
+	update func(data []byte) ([]byte, error)) error {
+	if state.pgStore != nil {
+		return state.pgStore.UpdateProfile(username, update)
+	}
+	if state.dynamoStore != nil {
+		return state.dynamoStore.UpdateProfile(username, update)
+	}
+	return state.updateSQLiteUserProfile(username, update)
+}
+
+// updateSQLiteUserProfile is UpdateUserProfile for SQLite, which only this
+// instance uses.
+func (state *RuntimeState) updateSQLiteUserProfile(username string,
+	update func(data []byte) ([]byte, error)) error {
+	state.profileUpdateMutex.Lock()
+	defer state.profileUpdateMutex.Unlock()
+	tx, err := state.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var data []byte
+	err = tx.QueryRow(loadUserProfileStmt["sqlite"], username).Scan(&data)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	newData, err := update(data)
+	if err != nil || newData == nil {
+		return err
+	}
+	_, err = tx.Exec(saveUserProfileStmt["sqlite"], username, newData)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 var deleteSignedUserDataStmt = map[string]string{
 	"sqlite":   "delete from expiring_signed_user_data where username = ? and type = ?",
 	"postgres": "delete from expiring_signed_user_data where username = $1 and type = $2",
 }
 
-func (state *RuntimeState) DeleteSigned(username string, dataType int) error {
+func (state *RuntimeState) DeleteSigned(username string, dataType int) (err error) {
+	defer func() {
+		if err != nil {
+			metricLogStorageError("save")
+		}
+	}()
+	if state.dynamoStore != nil {
+		return state.dynamoStore.DeleteSigned(username, dataType)
+	}
 
 	//insert into DB
 	tx, err := state.db.Begin()
@@ -518,7 +653,19 @@ var getSignedUserDataStmt = map[string]string{
 }
 
 func (state *RuntimeState) GetSigned(username string, dataType int) (bool, string, error) {
-	logger.Printf("top of GetSigned")
+	logger.Debugf(2, "top of GetSigned")
+	if state.dynamoStore != nil {
+		ok, jwsData, err := state.dynamoStore.GetSigned(username, dataType)
+		if err != nil {
+			logger.Printf("Problem with db ='%s'", err)
+			metricLogStorageError("read")
+			return false, "", err
+		}
+		if !ok {
+			return false, "", nil
+		}
+		return state.decodeSignedData(username, jwsData)
+	}
 
 	//var jwsData string
 	ch := make(chan getSignedData, 1)
@@ -549,10 +696,11 @@ func (state *RuntimeState) GetSigned(username string, dataType int) (bool, strin
 		if err != nil {
 			err = dbMessage.Err
 			if err.Error() == "sql: no rows in result set" {
-				logger.Printf("err='%s'", err)
+				logger.Debugf(2, "err='%s'", err)
 				return false, "", nil
 			} else {
 				logger.Printf("Problem with db ='%s'", err)
+				metricLogStorageError("read")
 				return false, "", err
 			}
 		}
@@ -560,6 +708,7 @@ func (state *RuntimeState) GetSigned(username string, dataType int) (bool, strin
 
 	case <-time.After(state.remoteDBQueryTimeout):
 		logger.Printf("GOT a timeout")
+		metricLogStorageError("timeout")
 		// load from cache
 		stmtText := getSignedUserDataStmt["sqlite"]
 		stmt, err := state.cacheDB.Prepare(stmtText)
@@ -573,7 +722,7 @@ func (state *RuntimeState) GetSigned(username string, dataType int) (bool, strin
 		err = stmt.QueryRow(username, dataType, time.Now().Unix()).Scan(&jwsData)
 		if err != nil {
 			if err.Error() == "sql: no rows in result set" {
-				logger.Printf("err='%s'", err)
+				logger.Debugf(2, "err='%s'", err)
 				return false, "", nil
 			} else {
 				logger.Printf("Problem with db ='%s'", err)
@@ -584,7 +733,14 @@ func (state *RuntimeState) GetSigned(username string, dataType int) (bool, strin
 		logger.Printf("GOT data from db cache")
 
 	}
-	logger.Printf("GOT some jwsdata data")
+	logger.Debugf(2, "GOT some jwsdata data")
+	return state.decodeSignedData(username, jwsData)
+}
+
+// decodeSignedData returns the data of jwsData, which must be signed data
+// of username.
+func (state *RuntimeState) decodeSignedData(username string,
+	jwsData string) (bool, string, error) {
 	storageJWT, err := state.getStorageDataFromStorageStringDataJWT(jwsData)
 	if err != nil {
 		logger.Debugf(2, "failed to get storage data %s data=%s", err, jwsData)
@@ -603,7 +759,12 @@ var saveSignedUserDataStmt = map[string]string{
 	"postgres": "insert into expiring_signed_user_data(username, type, jws_data, expiration_epoch, update_epoch) values ($1,$2,$3,$4, $5) ON CONFLICT(username,type) DO UPDATE SET  jws_data = excluded.jws_data, expiration_epoch = excluded.expiration_epoch",
 }
 
-func (state *RuntimeState) UpsertSigned(username string, dataType int, expirationEpoch int64, data string) error {
+func (state *RuntimeState) UpsertSigned(username string, dataType int, expirationEpoch int64, data string) (err error) {
+	defer func() {
+		if err != nil {
+			metricLogStorageError("save")
+		}
+	}()
 	logger.Debugf(2, "top of UpsertSigned")
 	//expirationEpoch := expiration.Unix()
 	stringData, err := state.genNewSerializedStorageStringDataJWT(username, dataType, data, expirationEpoch)
@@ -611,6 +772,15 @@ func (state *RuntimeState) UpsertSigned(username string, dataType int, expiratio
 		return err
 	}
 	start := time.Now()
+	if state.dynamoStore != nil {
+		err := state.dynamoStore.UpsertSigned(username, dataType,
+			expirationEpoch, stringData)
+		if err != nil {
+			return err
+		}
+		metricLogExternalServiceDuration("storage-save", time.Since(start))
+		return nil
+	}
 	//insert into DB
 	tx, err := state.db.Begin()
 	if err != nil {
@@ -634,3 +804,293 @@ func (state *RuntimeState) UpsertSigned(username string, dataType int, expiratio
 
 	return nil
 }
+
+/// Revoked certificates
+
+type revokedCertificate struct {
+	CertType       string    `json:"cert_type"`
+	Serial         string    `json:"serial"`
+	RevokedBy      string    `json:"revoked_by"`
+	Reason         int       `json:"reason"`
+	RevocationTime time.Time `json:"revocation_time"`
+}
+
+type getRevokedCertificatesData struct {
+	Revoked []revokedCertificate
+	Err     error
+}
+
+var revokeCertificateStmt = map[string]string{
+	"sqlite":   "insert or ignore into revoked_certificate(cert_type, serial, revoked_by, reason, revocation_epoch) values(?, ?, ?, ?, ?)",
+	"postgres": "insert into revoked_certificate(cert_type, serial, revoked_by, reason, revocation_epoch) values ($1, $2, $3, $4, $5) on CONFLICT(cert_type, serial) DO NOTHING",
+}
+
+var getRevokedCertificatesStmt = map[string]string{
+	"sqlite":   "select cert_type, serial, revoked_by, reason, revocation_epoch from revoked_certificate where cert_type = ? order by revocation_epoch",
+	"postgres": "select cert_type, serial, revoked_by, reason, revocation_epoch from revoked_certificate where cert_type = $1 order by revocation_epoch",
+}
+
+var getAllRevokedCertificatesStmt = "select cert_type, serial, revoked_by, reason, revocation_epoch from revoked_certificate"
+
+func gatherRevokedCertificates(rows *sql.Rows) ([]revokedCertificate, error) {
+	defer rows.Close()
+	var revoked []revokedCertificate
+	for rows.Next() {
+		var (
+			entry           revokedCertificate
+			revocationEpoch int64
+		)
+		err := rows.Scan(&entry.CertType, &entry.Serial, &entry.RevokedBy,
+			&entry.Reason, &revocationEpoch)
+		if err != nil {
+			return nil, err
+		}
+		entry.RevocationTime = time.Unix(revocationEpoch, 0)
+		revoked = append(revoked, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return revoked, nil
+}
+
+func copyRevokedCertificates(source *sql.DB, tx *sql.Tx,
+	destinationType string) error {
+	rows, err := source.Query(getAllRevokedCertificatesStmt)
+	if err != nil {
+		return err
+	}
+	revoked, err := gatherRevokedCertificates(rows)
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(revokeCertificateStmt[destinationType])
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, entry := range revoked {
+		_, err := stmt.Exec(entry.CertType, entry.Serial, entry.RevokedBy,
+			entry.Reason, entry.RevocationTime.Unix())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RevokeCertificate records the revocation of a certificate. Revoking a
+// certificate again keeps the original record.
+func (state *RuntimeState) RevokeCertificate(entry revokedCertificate) (err error) {
+	defer func() {
+		if err != nil {
+			metricLogStorageError("save")
+		}
+	}()
+	start := time.Now()
+	if state.dynamoStore != nil {
+		if err := state.revokeCertificateDynamoDB(entry); err != nil {
+			return err
+		}
+		metricLogExternalServiceDuration("storage-save", time.Since(start))
+		return nil
+	}
+	tx, err := state.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmtText := revokeCertificateStmt[state.dbType]
+	stmt, err := tx.Prepare(stmtText)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(entry.CertType, entry.Serial, entry.RevokedBy,
+		entry.Reason, entry.RevocationTime.Unix())
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	metricLogExternalServiceDuration("storage-save", time.Since(start))
+	return nil
+}
+
+// GetRevokedCertificates returns the revoked certificates of type certType,
+// falling back to the cache DB if the primary DB is slow. The bool is true
+// if the data came from the cache.
+func (state *RuntimeState) GetRevokedCertificates(certType string) (
+	[]revokedCertificate, bool, error) {
+	if state.dynamoStore != nil {
+		return state.getRevokedCertificatesDynamoDB(certType)
+	}
+	ch := make(chan getRevokedCertificatesData, 1)
+	start := time.Now()
+	go func() {
+		if state.remoteDBQueryTimeout == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		rows, err := state.db.Query(getRevokedCertificatesStmt[state.dbType],
+			certType)
+		if err != nil {
+			ch <- getRevokedCertificatesData{Err: err}
+			return
+		}
+		revoked, err := gatherRevokedCertificates(rows)
+		ch <- getRevokedCertificatesData{Revoked: revoked, Err: err}
+	}()
+	select {
+	case dbMessage := <-ch:
+		if dbMessage.Err != nil {
+			logger.Printf("Problem with db ='%s'", dbMessage.Err)
+			metricLogStorageError("read")
+		} else {
+			metricLogExternalServiceDuration("storage-read", time.Since(start))
+		}
+		return dbMessage.Revoked, false, dbMessage.Err
+	case <-time.After(state.remoteDBQueryTimeout):
+		logger.Printf("GOT a timeout")
+		metricLogStorageError("timeout")
+		rows, err := state.cacheDB.Query(getRevokedCertificatesStmt["sqlite"],
+			certType)
+		if err != nil {
+			logger.Printf("Problem with db = '%s'", err)
+			return nil, true, err
+		}
+		revoked, err := gatherRevokedCertificates(rows)
+		if err != nil {
+			logger.Printf("Problem with db = '%s'", err)
+		} else {
+			logger.Println("GOT data from db cache")
+		}
+		return revoked, true, err
+	}
+}
+
+// Service accounts are only read from the primary DB: logins rotate the
+// refresh token, which cannot be saved while it is offline.
+var loadServiceAccountStmt = map[string]string{
+	"sqlite":   "select account_data from service_account where name = ?",
+	"postgres": "select account_data from service_account where name = $1",
+}
+
+var saveServiceAccountStmt = map[string]string{
+	"sqlite":   "insert or replace into service_account(name, account_data) values(?, ?)",
+	"postgres": "insert into service_account(name, account_data) values ($1,$2) on CONFLICT(name) DO UPDATE set account_data = excluded.account_data",
+}
+
+var deleteServiceAccountStmt = map[string]string{
+	"sqlite":   "delete from service_account where name = ?",
+	"postgres": "delete from service_account where name = $1",
+}
+
+var getServiceAccountsStmt = "select account_data from service_account order by name"
+
+func decodeServiceAccount(data []byte) (*serviceAccount, error) {
+	var account serviceAccount
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&account); err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// LoadServiceAccount returns the service account name. The bool is false
+// if there is no such account.
+func (state *RuntimeState) LoadServiceAccount(name string) (
+	*serviceAccount, bool, error) {
+	start := time.Now()
+	var data []byte
+	var err error
+	if state.dynamoStore != nil {
+		var ok bool
+		data, ok, err = state.dynamoStore.GetRecord(serviceAccountRecordKind,
+			name)
+		if err == nil && !ok {
+			return nil, false, nil
+		}
+	} else {
+		err = state.db.QueryRow(loadServiceAccountStmt[state.dbType],
+			name).Scan(&data)
+	}
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		metricLogStorageError("read")
+		return nil, false, err
+	}
+	metricLogExternalServiceDuration("storage-read", time.Since(start))
+	account, err := decodeServiceAccount(data)
+	if err != nil {
+		return nil, false, err
+	}
+	return account, true, nil
+}
+
+// GetServiceAccounts returns all service accounts ordered by name.
+func (state *RuntimeState) GetServiceAccounts() ([]*serviceAccount, error) {
+	if state.dynamoStore != nil {
+		return state.getServiceAccountsDynamoDB()
+	}
+	rows, err := state.db.Query(getServiceAccountsStmt)
+	if err != nil {
+		metricLogStorageError("read")
+		return nil, err
+	}
+	defer rows.Close()
+	var accounts []*serviceAccount
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		account, err := decodeServiceAccount(data)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts, rows.Err()
+}
+
+func (state *RuntimeState) SaveServiceAccount(account *serviceAccount) (err error) {
+	defer func() {
+		if err != nil {
+			metricLogStorageError("save")
+		}
+	}()
+	var gobBuffer bytes.Buffer
+	if err := gob.NewEncoder(&gobBuffer).Encode(account); err != nil {
+		return err
+	}
+	start := time.Now()
+	if state.dynamoStore != nil {
+		err = state.dynamoStore.PutRecord(serviceAccountRecordKind,
+			account.Name, gobBuffer.Bytes())
+	} else {
+		_, err = state.db.Exec(saveServiceAccountStmt[state.dbType],
+			account.Name, gobBuffer.Bytes())
+	}
+	if err != nil {
+		return err
+	}
+	metricLogExternalServiceDuration("storage-save", time.Since(start))
+	return nil
+}
+
+func (state *RuntimeState) DeleteServiceAccount(name string) (err error) {
+	defer func() {
+		if err != nil {
+			metricLogStorageError("save")
+		}
+	}()
+	if state.dynamoStore != nil {
+		return state.dynamoStore.DeleteRecord(serviceAccountRecordKind, name)
+	}
+	_, err = state.db.Exec(deleteServiceAccountStmt[state.dbType], name)
+	return err
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/simplestorage/dynamostore"
+)
+
+// Revoked certificates and service accounts are DynamoDB records of these
+// kinds.
+const (
+	revokedCertificateRecordKind = "revoked_certificate"
+	serviceAccountRecordKind     = "service_account"
+)
+
+// parseDynamoDBStorageURL parses a storage URL like
+// dynamodb://table?region=us-west-2&endpoint=http://localhost:8000.
+func parseDynamoDBStorageURL(storageURL string) (dynamostore.Config, error) {
+	u, err := url.Parse(storageURL)
+	if err != nil {
+		return dynamostore.Config{}, err
+	}
+	if u.Host == "" {
+		return dynamostore.Config{}, errors.New("no DynamoDB table in storage url")
+	}
+	return dynamostore.Config{
+		Table:    u.Host,
+		Region:   u.Query().Get("region"),
+		Endpoint: u.Query().Get("endpoint"),
+	}, nil
+}
+
+func initDBDynamoDB(state *RuntimeState) (err error) {
+	config, err := parseDynamoDBStorageURL(
+		state.Config.ProfileStorage.StorageUrl)
+	if err != nil {
+		return err
+	}
+	state.dbType = "dynamodb"
+	state.dynamoStore, err = dynamostore.New(config, logger)
+	if err != nil {
+		logger.Printf("init dynamodb err: %s", err)
+		return err
+	}
+	return nil
+}
+
+func (state *RuntimeState) getUsersDynamoDB() ([]string, bool, error) {
+	start := time.Now()
+	names, err := state.dynamoStore.ListProfiles()
+	if err != nil {
+		logger.Printf("Problem with db ='%s'", err)
+		metricLogStorageError("read")
+		return nil, false, err
+	}
+	metricLogExternalServiceDuration("storage-read", time.Since(start))
+	return names, false, nil
+}
+
+func (state *RuntimeState) loadUserProfileDynamoDB(username string,
+	profile *userProfile) (bool, error) {
+	start := time.Now()
+	data, ok, err := state.dynamoStore.GetProfile(username)
+	if err != nil {
+		logger.Printf("Problem with db ='%s'", err)
+		metricLogStorageError("read")
+		return false, err
+	}
+	metricLogExternalServiceDuration("storage-read", time.Since(start))
+	if !ok {
+		return false, nil
+	}
+	data, err = state.openProfileData(data)
+	if err != nil {
+		return false, err
+	}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(profile); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (state *RuntimeState) getRevokedCertificatesDynamoDB(certType string) (
+	[]revokedCertificate, bool, error) {
+	start := time.Now()
+	records, err := state.dynamoStore.ListRecords(revokedCertificateRecordKind)
+	if err != nil {
+		logger.Printf("Problem with db ='%s'", err)
+		metricLogStorageError("read")
+		return nil, false, err
+	}
+	metricLogExternalServiceDuration("storage-read", time.Since(start))
+	var revoked []revokedCertificate
+	for _, data := range records {
+		var entry revokedCertificate
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return nil, false, err
+		}
+		if entry.CertType == certType {
+			revoked = append(revoked, entry)
+		}
+	}
+	sort.SliceStable(revoked, func(i, j int) bool {
+		return revoked[i].RevocationTime.Before(revoked[j].RevocationTime)
+	})
+	return revoked, false, nil
+}
+
+func (state *RuntimeState) revokeCertificateDynamoDB(
+	entry revokedCertificate) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = state.dynamoStore.InsertRecord(revokedCertificateRecordKind,
+		entry.CertType+"/"+entry.Serial, data)
+	return err
+}
+
+func (state *RuntimeState) getServiceAccountsDynamoDB() (
+	[]*serviceAccount, error) {
+	records, err := state.dynamoStore.ListRecords(serviceAccountRecordKind)
+	if err != nil {
+		metricLogStorageError("read")
+		return nil, err
+	}
+	var accounts []*serviceAccount
+	for _, data := range records {
+		account, err := decodeServiceAccount(data)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts, nil
+}
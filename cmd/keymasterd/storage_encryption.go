@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/Cloud-Foundations/keymaster/lib/simplestorage/envelope"
+)
+
+const adminAPIReencryptStoragePath = "/admin/api/v1/reencrypt-storage"
+
+type adminReencryptStorageResponse struct {
+	CurrentKey string   `json:"current_key"`
+	Users      int      `json:"users"`
+	Resealed   int      `json:"resealed"`
+	Failed     []string `json:"failed,omitempty"`
+}
+
+// newStorageKeyring returns the keyring of config, or nil if storage
+// encryption is not configured.
+func newStorageKeyring(config StorageEncryptionConfig) (
+	*envelope.Keyring, error) {
+	if len(config.Keys) < 1 {
+		if config.CurrentKey != "" {
+			return nil, errors.New("storage encryption current_key without keys")
+		}
+		return nil, nil
+	}
+	var current envelope.MasterKey
+	var old []envelope.MasterKey
+	for _, keyConfig := range config.Keys {
+		var key envelope.MasterKey
+		var err error
+		switch {
+		case keyConfig.PassphraseFile != "" && keyConfig.AWSKMSKeyID != "":
+			return nil, fmt.Errorf(
+				"storage encryption key %s: both passphrase_file and aws_kms_key_id",
+				keyConfig.ID)
+		case keyConfig.PassphraseFile != "":
+			var passphrase []byte
+			passphrase, err = ioutil.ReadFile(keyConfig.PassphraseFile)
+			if err == nil {
+				key, err = envelope.NewPassphraseKey(keyConfig.ID,
+					[]byte(strings.TrimSpace(string(passphrase))))
+			}
+		case keyConfig.AWSKMSKeyID != "":
+			key, err = envelope.NewAWSKMSKey(keyConfig.ID,
+				keyConfig.AWSKMSKeyID, keyConfig.AWSRegion)
+		default:
+			err = errors.New("no passphrase_file or aws_kms_key_id")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("storage encryption key %s: %s",
+				keyConfig.ID, err)
+		}
+		if keyConfig.ID == config.CurrentKey {
+			current = key
+		} else {
+			old = append(old, key)
+		}
+	}
+	if current == nil {
+		return nil, fmt.Errorf("storage encryption current_key %q not in keys",
+			config.CurrentKey)
+	}
+	return envelope.NewKeyring(current, old...)
+}
+
+// openProfileData returns the gob encoding of a profile as stored in the
+// DB.
+func (state *RuntimeState) openProfileData(data []byte) ([]byte, error) {
+	if state.profileKeyring == nil {
+		if envelope.IsSealed(data) {
+			return nil, errors.New(
+				"profile is encrypted, but storage encryption is not configured")
+		}
+		return data, nil
+	}
+	return state.profileKeyring.Open(data)
+}
+
+// sealProfileData returns the gob encoding of a profile as it is stored in
+// the DB.
+func (state *RuntimeState) sealProfileData(data []byte) ([]byte, error) {
+	if state.profileKeyring == nil {
+		return data, nil
+	}
+	return state.profileKeyring.Seal(data)
+}
+
+// resealUserProfile seals the profile of username with the current storage
+// encryption key, if it is not already. The bool is true if the profile was
+// saved.
+func (state *RuntimeState) resealUserProfile(username string) (bool, error) {
+	resealed := false
+	err := state.updateUserProfileData(username,
+		func(data []byte) ([]byte, error) {
+			if data == nil {
+				return nil, nil
+			}
+			newData, changed, err := state.profileKeyring.Reseal(data)
+			if err != nil || !changed {
+				return nil, err
+			}
+			resealed = true
+			return newData, nil
+		})
+	return resealed, err
+}
+
+// adminAPIReencryptStorageHandler seals all user profiles which are not
+// encrypted or encrypted with an old key with the current key, so that old
+// keys can be removed after a rotation.
+func (state *RuntimeState) adminAPIReencryptStorageHandler(
+	w http.ResponseWriter, r *http.Request) {
+	authUser, ok := state.checkAdminAPIAuth(w, r, "POST")
+	if !ok {
+		return
+	}
+	if state.profileKeyring == nil {
+		state.writeFailureResponse(w, r, http.StatusPreconditionFailed,
+			"Storage encryption is not configured")
+		return
+	}
+	users, fromCache, err := state.GetUsers()
+	if err != nil {
+		logger.Printf("Getting users error: %v", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	if fromCache {
+		state.writeFailureResponse(w, r, http.StatusServiceUnavailable,
+			"db backend is offline for writes")
+		return
+	}
+	response := adminReencryptStorageResponse{
+		CurrentKey: state.profileKeyring.CurrentKeyID(),
+		Users:      len(users),
+	}
+	for _, username := range users {
+		resealed, err := state.resealUserProfile(username)
+		if err != nil {
+			logger.Printf("cannot re-encrypt profile of %s: %s", username, err)
+			response.Failed = append(response.Failed, username)
+			continue
+		}
+		if resealed {
+			response.Resealed++
+		}
+	}
+	logger.Printf("%s re-encrypted %d of %d profiles with %s, %d failed",
+		authUser, response.Resealed, response.Users, response.CurrentKey,
+		len(response.Failed))
+	state.logAuditAdminAction(r, authUser, "reencrypt-storage",
+		len(response.Failed) < 1, map[string]string{
+			"current_key": response.CurrentKey,
+			"resealed":    fmt.Sprintf("%d", response.Resealed),
+		})
+	writeAdminAPIResponse(w, response)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Cloud-Foundations/keymaster/lib/simplestorage/envelope"
+)
+
+func TestNewStorageKeyring(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage_encryption_testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	passphraseFile := filepath.Join(dir, "passphrase")
+	err = ioutil.WriteFile(passphraseFile, []byte("a long passphrase\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring, err := newStorageKeyring(StorageEncryptionConfig{})
+	if err != nil || keyring != nil {
+		t.Fatalf("no keys should give no keyring: %v", err)
+	}
+	keyring, err = newStorageKeyring(StorageEncryptionConfig{
+		CurrentKey: "k2",
+		Keys: []StorageEncryptionKeyConfig{
+			{ID: "k1", PassphraseFile: passphraseFile},
+			{ID: "k2", PassphraseFile: passphraseFile},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyring.CurrentKeyID() != "k2" {
+		t.Fatalf("unexpected current key: %s", keyring.CurrentKeyID())
+	}
+	for _, config := range []StorageEncryptionConfig{
+		{CurrentKey: "k1"},
+		{CurrentKey: "k3", Keys: []StorageEncryptionKeyConfig{
+			{ID: "k1", PassphraseFile: passphraseFile}}},
+		{CurrentKey: "k1", Keys: []StorageEncryptionKeyConfig{{ID: "k1"}}},
+		{CurrentKey: "k1", Keys: []StorageEncryptionKeyConfig{
+			{ID: "k1", PassphraseFile: filepath.Join(dir, "missing")}}},
+	} {
+		if _, err := newStorageKeyring(config); err == nil {
+			t.Errorf("%+v should fail", config)
+		}
+	}
+}
+
+func TestEncryptedUserProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage_encryption_testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var state RuntimeState
+	state.Config.Base.DataDirectory = dir
+	if err := initDB(&state); err != nil {
+		t.Fatal(err)
+	}
+	profile, _, _, err := state.LoadUserProfile("username")
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile.LastSuccessfullTOTPCounter = 42
+	// Saved before encryption was enabled.
+	if err := state.SaveUserProfile("username", profile); err != nil {
+		t.Fatal(err)
+	}
+	key, err := envelope.NewPassphraseKey("k1", []byte("a long passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.profileKeyring, err = envelope.NewKeyring(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loadStoredData := func() []byte {
+		var data []byte
+		err := state.db.QueryRow(loadUserProfileStmt["sqlite"],
+			"username").Scan(&data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	if envelope.IsSealed(loadStoredData()) {
+		t.Fatal("profile should not be sealed yet")
+	}
+	resealed, err := state.resealUserProfile("username")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resealed || !envelope.IsSealed(loadStoredData()) {
+		t.Fatal("profile was not sealed")
+	}
+	if resealed, err := state.resealUserProfile("username"); err != nil ||
+		resealed {
+		t.Fatalf("sealed profile should not change: %v %v", resealed, err)
+	}
+	profile, ok, _, err := state.LoadUserProfile("username")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || profile.LastSuccessfullTOTPCounter != 42 {
+		t.Fatalf("unexpected profile: %+v", profile)
+	}
+	// Without the keys the profile cannot be read.
+	state.profileKeyring = nil
+	if _, _, _, err := state.LoadUserProfile("username"); err == nil {
+		t.Fatal("loading a sealed profile without keys should fail")
+	}
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"io/ioutil"
 	stdlog "log"
 	"os"
+	"sync"
 	"testing"
 	//"time"
 
@@ -83,3 +85,64 @@ func TestFetchFromCache(t *testing.T) {
 		t.Fatal("This should have failed for invalid user")
 	}
 }
+
+func TestUpdateUserProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "update_profile_testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var state RuntimeState
+	state.Config.Base.DataDirectory = dir
+	if err := initDB(&state); err != nil {
+		t.Fatal(err)
+	}
+	// Concurrent updates must not lose any increment.
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := state.UpdateUserProfile("username",
+				func(profile *userProfile) (bool, error) {
+					profile.LastSuccessfullTOTPCounter++
+					return true, nil
+				})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	err = state.UpdateUserProfile("username",
+		func(profile *userProfile) (bool, error) {
+			profile.LastSuccessfullTOTPCounter = 100
+			return false, nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile, ok, _, err := state.LoadUserProfile("username")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || profile.LastSuccessfullTOTPCounter != 20 {
+		t.Fatalf("expected counter 20, got %d",
+			profile.LastSuccessfullTOTPCounter)
+	}
+}
+
+func TestParseDynamoDBStorageURL(t *testing.T) {
+	config, err := parseDynamoDBStorageURL(
+		"dynamodb://keymaster?region=us-west-2&endpoint=http://localhost:8000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Table != "keymaster" || config.Region != "us-west-2" ||
+		config.Endpoint != "http://localhost:8000" {
+		t.Fatalf("unexpected config: %+v", config)
+	}
+	if _, err := parseDynamoDBStorageURL("dynamodb:"); err == nil {
+		t.Fatal("storage url without table should fail")
+	}
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"html/template"
 	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
 )
 
 const headerTemplateText = `
@@ -36,9 +38,14 @@ type loginPageTemplateData struct {
 	AuthUsername     string
 	JSSources        []string
 	ShowOauth2       bool
+	ShowSAML         bool
 	HideStdLogin     bool
 	LoginDestination string
 	ErrorMessage     string
+	// ShowPasswordChange replaces the login form with the form to change
+	// the expired password of PasswordUsername.
+	ShowPasswordChange bool
+	PasswordUsername   string
 }
 
 //Should be a template
@@ -66,7 +73,22 @@ const loginFormText = `
 	<a href="/auth/oauth2/login"> Oauth2 Login </a>
 	</p>
         {{end}}
-	{{if not .HideStdLogin}}
+	{{if .ShowSAML}}
+	<p>
+	<a href="/auth/saml/login"> SAML Login </a>
+	</p>
+	{{end}}
+	{{if .ShowPasswordChange}}
+	<p>Your password has expired or must be changed.</p>
+        <form enctype="application/x-www-form-urlencoded" action="/api/v0/changePassword" method="post">
+            <INPUT TYPE="hidden" NAME="username" VALUE={{.PasswordUsername}}>
+            <p>Current Password: <INPUT TYPE="password" NAME="password" SIZE=18  autocomplete="off"></p>
+            <p>New Password: <INPUT TYPE="password" NAME="new_password" SIZE=18  autocomplete="off"></p>
+            <p>Confirm New Password: <INPUT TYPE="password" NAME="new_password_confirm" SIZE=18  autocomplete="off"></p>
+	    <INPUT TYPE="hidden" NAME="login_destination" VALUE={{.LoginDestination}}>
+            <p><input type="submit" value="Change Password" /></p>
+        </form>
+	{{else if not .HideStdLogin}}
 	{{template "login_pre_password" .}}
         <form enctype="application/x-www-form-urlencoded" action="/api/v0/login" method="post">
             <p>Username: <INPUT TYPE="text" NAME="username" SIZE=18></p>
@@ -91,7 +113,27 @@ type secondFactorAuthTemplateData struct {
 	ShowVIP          bool
 	ShowU2F          bool
 	ShowTOTP         bool
+	ShowWebAuthn     bool
+	ShowRADIUS       bool
+	RADIUSMessage    string
+	RADIUSState      string
+	ShowDuo          bool
+	ShowDuoPush      bool
+	ShowWebhook      bool
+	WebhookName      string
+	WebhookMessage   string
+	WebhookState     string
+	WebhookPending   bool
+	ShowRecoveryCode bool
+	OktaFactors      []oktaFactorDisplayInfo
 	LoginDestination string
+	PasswordWarning  string
+}
+
+type oktaFactorDisplayInfo struct {
+	FactorType string
+	Provider   string
+	Status     string
 }
 
 const secondFactorAuthFormText = `
@@ -115,6 +157,9 @@ const secondFactorAuthFormText = `
 	{{template "header" .}}
 	<div style="padding-bottom:60px; margin:1em auto; max-width:80em; padding-left:20px ">
         <h2> Keymaster second factor authentication </h2>
+	{{if .PasswordWarning}}
+	<p style="color:red;">{{.PasswordWarning}} </p>
+	{{end}}
 	{{if .ShowVIP}}
 	<div id="vip_login_destination" style="display: none;">{{.LoginDestination}}</div>
         <form enctype="application/x-www-form-urlencoded" action="/api/v0/vipAuth" method="post">
@@ -150,6 +195,26 @@ const secondFactorAuthFormText = `
 	{{end}}
 	{{end}}
 
+	{{if .ShowWebAuthn}}
+	<p>
+	       <div id="webauthn_login_destination" style="display: none;">{{.LoginDestination}}</div>
+	       <button id="webauthn_auth_button">Authenticate with a security key or platform authenticator</button>
+	       <div id="webauthn_action_text" style="display: none;"> Follow your browser's prompt to authenticate</div>
+	</p>
+	{{end}}
+
+	{{if .OktaFactors}}
+	<div id="okta_factors">
+	<p>Your Okta factors:</p>
+	<ul>
+	{{- range .OktaFactors }}
+	<li>{{.FactorType}} ({{.Provider}}){{if .Status}} {{.Status}}{{end}}</li>
+	{{- end}}
+	</ul>
+	<p>Security keys registered with Okta can be used with the keymaster command line client.</p>
+	</div>
+	{{end}}
+
         {{if .ShowTOTP}}
         <form enctype="application/x-www-form-urlencoded" action="/api/v0/TOTPAuth" method="post">
             <p>
@@ -159,6 +224,57 @@ const secondFactorAuthFormText = `
             </p>
         </form>
 	{{end}}
+        {{if .ShowDuo}}
+        {{if .ShowDuoPush}}
+        <div id="duo_login_destination" style="display: none;">{{.LoginDestination}}</div>
+        <p>
+        <button type="button" id="duo_push_button">Send Duo Push</button>
+        <span id="duo_push_status"></span>
+        </p>
+        {{end}}
+        <form enctype="application/x-www-form-urlencoded" action="/api/v0/duoAuth" method="post">
+            <p>
+            Enter Duo passcode: <INPUT TYPE="text" NAME="OTP" SIZE=18  autocomplete="off">
+            <INPUT TYPE="hidden" NAME="login_destination" VALUE={{.LoginDestination}}>
+            <input type="submit" value="Submit" />
+            </p>
+        </form>
+	{{end}}
+        {{if .ShowRADIUS}}
+        <form enctype="application/x-www-form-urlencoded" action="/api/v0/radiusAuth" method="post">
+            <p>
+            {{if .RADIUSMessage}}{{.RADIUSMessage}}{{else}}Enter passcode:{{end}} <INPUT TYPE="password" NAME="OTP" SIZE=18  autocomplete="off">
+            {{if .RADIUSState}}<INPUT TYPE="hidden" NAME="state" VALUE="{{.RADIUSState}}">{{end}}
+            <INPUT TYPE="hidden" NAME="login_destination" VALUE={{.LoginDestination}}>
+            <input type="submit" value="Submit" />
+            </p>
+        </form>
+	{{end}}
+        {{if .ShowWebhook}}
+        <form enctype="application/x-www-form-urlencoded" action="/api/v0/webhookAuth" method="post">
+            <p>
+            {{if .WebhookState}}
+            {{.WebhookMessage}}
+            {{if not .WebhookPending}}<INPUT TYPE="password" NAME="OTP" SIZE=18  autocomplete="off">{{end}}
+            <INPUT TYPE="hidden" NAME="state" VALUE="{{.WebhookState}}">
+            <INPUT TYPE="hidden" NAME="login_destination" VALUE={{.LoginDestination}}>
+            <input type="submit" value="{{if .WebhookPending}}Continue{{else}}Submit{{end}}" />
+            {{else}}
+            <INPUT TYPE="hidden" NAME="login_destination" VALUE={{.LoginDestination}}>
+            <input type="submit" value="Authenticate with {{.WebhookName}}" />
+            {{end}}
+            </p>
+        </form>
+	{{end}}
+        {{if .ShowRecoveryCode}}
+        <form enctype="application/x-www-form-urlencoded" action="/api/v0/recoveryCodeAuth" method="post">
+            <p>
+            Lost your device? Enter a recovery code: <INPUT TYPE="password" NAME="OTP" SIZE=18  autocomplete="off">
+            <INPUT TYPE="hidden" NAME="login_destination" VALUE={{.LoginDestination}}>
+            <input type="submit" value="Submit" />
+            </p>
+        </form>
+	{{end}}
 
 	<form enctype="application/x-www-form-urlencoded" action="/api/v0/logout" method="post">
             <br>
@@ -233,6 +349,22 @@ type registeredTOTPTDeviceDisplayInfo struct {
 	Index            int64
 	Enabled          bool
 }
+type registeredWebAuthnCredentialDisplayInfo struct {
+	RegistrationDate time.Time
+	DeviceData       string
+	Name             string
+	Index            int64
+	Enabled          bool
+}
+type webSessionDisplayInfo struct {
+	ID          string
+	RemoteAddr  string
+	UserAgent   string
+	AuthMethods string
+	CreatedAt   time.Time
+	Current     bool
+}
+
 type profilePageTemplateData struct {
 	Title                string
 	AuthUsername         string
@@ -244,6 +376,17 @@ type profilePageTemplateData struct {
 	UsersLink            bool
 	RegisteredU2FToken   []registeredU2FTokenDisplayInfo
 	RegisteredTOTPDevice []registeredTOTPTDeviceDisplayInfo
+	ShowWebAuthn         bool
+	RegisteredWebAuthn   []registeredWebAuthnCredentialDisplayInfo
+	FactorPolicyMsg      string
+	ShowRecoveryCodes    bool
+	RecoveryCodesLeft    int
+
+	// EnrollmentTokenRequired is set if security keys can only be
+	// registered with an enrollment token in this session.
+	EnrollmentTokenRequired bool
+	ShowSessions            bool
+	Sessions                []webSessionDisplayInfo
 }
 
 //{{ .Date | formatAsDate}} {{ printf "%-20s" .Description }} {{.AmountInCents | formatAsDollars -}}
@@ -274,12 +417,23 @@ const profileHTML = `
     <h1>Keymaster User Profile</h1>
     <h2 id="username">{{.Username}}</h2>
     {{.ReadOnlyMsg}}
+    {{if .FactorPolicyMsg}}<p style="color: red;">{{.FactorPolicyMsg}}</p>{{end}}
     <ul>
       <li><a href="/api/v0/logout" >Logout </a></li>
+    {{if eq .Username .AuthUsername}}
+      <li><a href="/certRequest/">Get certificates in this browser</a></li>
+    {{end}}
     {{if .UsersLink}}
       <li><a href="/users/">Users</a></li>
     {{end}}
     </ul>
+    {{if and .EnrollmentTokenRequired (not .ReadOnlyMsg)}}
+    <p>
+    Registering a security key requires a second factor. Log in with one, or
+    enter the enrollment token your administrator gave you:
+    <input type="text" id="enrollment_token" SIZE=48 autocomplete="off">
+    </p>
+    {{end}}
     <div id="u2f-tokens">
     <h3>U2F</h3>
     <ul>
@@ -333,6 +487,56 @@ const profileHTML = `
     {{- end}}
     </div>
     </div> <!-- end of u2f div -->
+    {{if .ShowWebAuthn}}
+    <div id="webauthn-credentials">
+    <h3>WebAuthn</h3>
+    <ul>
+       {{if not .ReadOnlyMsg}}
+      <li>
+         <a id="webauthn_register_button" href="#">Register security key or platform authenticator</a>
+         <div id="webauthn_register_action_text" style="color: blue;background-color: yellow; display: none;"> Follow your browser's prompt to register </div>
+      </li>
+      {{end}}
+    </ul>
+    <div style="margin-left: 40px">
+    {{if .RegisteredWebAuthn -}}
+        <p>Your WebAuthn credential(s):</p>
+        <table>
+	    <tr>
+	    <th>Name</th>
+	    <th>Registered</th>
+	    <th>Attestation</th>
+	    <th>Actions</th>
+	    </tr>
+	    {{- range .RegisteredWebAuthn }}
+            <tr>
+	     <form enctype="application/x-www-form-urlencoded" action="/api/v0/manageWebAuthnToken" method="post">
+	     <input type="hidden" name="index" value="{{.Index}}">
+	     <input type="hidden" name="username" value="{{$top.Username}}">
+	     <td> <input type="text" name="name" value="{{ .Name}}" SIZE=18  {{if $top.ReadOnlyMsg}} readonly{{end}} > </td>
+	     <td> {{ .RegistrationDate}} </td>
+	     <td> {{ .DeviceData}} </td>
+	     <td>
+	         {{if not $top.ReadOnlyMsg}}
+	         <input type="submit" name="action" value="Update" {{if not .Enabled}} disabled {{end}}/>
+		 {{if .Enabled}}
+		 <input type="submit" name="action" value="Disable"/>
+		 {{ else }}
+		 <input type="submit" name="action" value="Enable"/>
+		 <input type="submit" name="action" value="Delete"/>
+		 {{ end }}
+		 {{end}}
+	     </td>
+	     </form>
+	     </tr>
+	    {{- end}}
+	</table>
+    {{- else}}
+	You Dont have any registered WebAuthn credentials.
+    {{- end}}
+    </div>
+    </div> <!-- end of webauthn div -->
+    {{end}}
     <div id="totp-tokens">
     {{if .ShowTOTP}}
        <h3>TOTP</h3>
@@ -381,6 +585,61 @@ const profileHTML = `
        {{end}}
     {{end}}
     </div> <!-- end of totp div -->
+    {{if .ShowRecoveryCodes}}
+    <div id="recovery-codes">
+       <h3>Recovery codes</h3>
+       <p>You have {{.RecoveryCodesLeft}} unused recovery code(s). Each code can be used once as second factor if you lose your devices.</p>
+       {{if and (not .ReadOnlyMsg) (eq .Username .AuthUsername)}}
+       <form enctype="application/x-www-form-urlencoded" action="/api/v0/recoveryCodes" method="post">
+          <p>
+          <input type="submit" value="Generate new recovery codes" />
+          Codes generated before stop working.
+          </p>
+       </form>
+       {{end}}
+    </div> <!-- end of recovery codes div -->
+    {{end}}
+    {{if .ShowSessions}}
+    <div id="sessions">
+       <h3>Active sessions</h3>
+       <table>
+          <tr>
+             <th>Address</th>
+             <th>Browser</th>
+             <th>Authentication</th>
+             <th>Started</th>
+             <th>Actions</th>
+          </tr>
+	  {{- range .Sessions }}
+	  <tr>
+	     <form enctype="application/x-www-form-urlencoded" action="/api/v0/sessions" method="post">
+	     <input type="hidden" name="session_id" value="{{.ID}}">
+	     <input type="hidden" name="username" value="{{$top.Username}}">
+	     <td> {{.RemoteAddr}} </td>
+	     <td> {{.UserAgent}} </td>
+	     <td> {{.AuthMethods}} </td>
+	     <td> {{.CreatedAt}}{{if .Current}} (this session){{end}} </td>
+	     <td>
+	         {{if not $top.ReadOnlyMsg}}
+	         <input type="submit" value="Revoke"/>
+	         {{end}}
+	     </td>
+	     </form>
+	  </tr>
+	  {{- end}}
+       </table>
+       {{if and .Sessions (not .ReadOnlyMsg)}}
+       <form enctype="application/x-www-form-urlencoded" action="/api/v0/sessions" method="post">
+          <p>
+          <input type="hidden" name="all" value="true">
+          <input type="hidden" name="username" value="{{.Username}}">
+          <input type="submit" value="Revoke all sessions" />
+          This also ends the current session.
+          </p>
+       </form>
+       {{end}}
+    </div> <!-- end of sessions div -->
+    {{end}}
     {{end}}
     </div>
     {{template "footer" . }}
@@ -448,3 +707,172 @@ const newTOTPHTML = `
 </html>
 {{end}}
 `
+
+type recoveryCodesPageTemplateData struct {
+	Title        string
+	AuthUsername string
+	JSSources    []string
+	Codes        []string
+}
+
+const recoveryCodesHTML = `
+{{define "recoveryCodesPage"}}
+<!DOCTYPE html>
+<html style="height:100%; padding:0;border:0;margin:0">
+  <head>
+    <title>{{.Title}}</title>
+    {{if .JSSources -}}
+    {{- range .JSSources }}
+    <script type="text/javascript" src="{{.}}"></script>
+    {{- end}}
+    {{- end}}
+    <link rel="stylesheet" type="text/css" href="//fonts.googleapis.com/css?family=Droid+Sans" />
+    <link rel="stylesheet" type="text/css" href="/custom_static/customization.css">
+    <link rel="stylesheet" type="text/css" href="/static/keymaster.css">
+  </head>
+  <body>
+    <div style="min-height:100%;position:relative;">
+    {{template "header" .}}
+    <div style="padding-bottom:60px; margin:1em auto; max-width:80em; padding-left:20px ">
+
+    <h1>{{.Title}}</h1>
+
+    <p>Print or write down these codes and keep them in a safe place. They
+    are shown only once. Each code can be used once as second factor if you
+    lose your devices. Your previous recovery codes no longer work.</p>
+    <pre>
+    {{- range .Codes}}
+{{.}}
+    {{- end}}
+    </pre>
+    <p><a href="/profile/">Back to your profile</a></p>
+    </div>
+    {{template "footer" . }}
+    </div>
+  </body>
+</html>
+{{end}}
+`
+
+type certApprovalDisplayInfo struct {
+	proto.CertApproval
+	CanDecide bool
+}
+
+type certApprovalsPageTemplateData struct {
+	Title        string
+	AuthUsername string
+	JSSources    []string
+	Requests     []certApprovalDisplayInfo
+}
+
+const certApprovalsHTML = `
+{{define "certApprovalsPage"}}
+<!DOCTYPE html>
+<html style="height:100%; padding:0;border:0;margin:0">
+  <head>
+    <title>{{.Title}}</title>
+    <link rel="stylesheet" type="text/css" href="//fonts.googleapis.com/css?family=Droid+Sans" />
+    <link rel="stylesheet" type="text/css" href="/custom_static/customization.css">
+    <link rel="stylesheet" type="text/css" href="/static/keymaster.css">
+  </head>
+  <body>
+    <div style="min-height:100%;position:relative;">
+    {{template "header" .}}
+    <div style="padding-bottom:60px; margin:1em auto; max-width:80em; padding-left:20px ">
+
+    <h1>{{.Title}}</h1>
+    {{if .Requests}}
+    <table>
+       <tr>
+          <th>User</th>
+          <th>Certificate</th>
+          <th>Needs approval</th>
+          <th>Address</th>
+          <th>Requested</th>
+          <th>State</th>
+          <th>Actions</th>
+       </tr>
+       {{- range .Requests }}
+       <tr>
+          <td> {{.Username}} </td>
+          <td> {{.CertType}} </td>
+          <td> {{range .NeedsApproval}}{{.}} {{end}}</td>
+          <td> {{.RemoteAddr}} </td>
+          <td> {{.CreatedAt}} </td>
+          <td> {{.State}}{{if .DecidedBy}} by {{.DecidedBy}}{{end}} (until {{.ExpiresAt}}) </td>
+          <td>
+             {{if .CanDecide}}
+             <form enctype="application/x-www-form-urlencoded" action="/api/v0/certApprovals" method="post">
+                <input type="hidden" name="id" value="{{.ID}}">
+                <button type="submit" name="action" value="approve">Approve</button>
+                <button type="submit" name="action" value="deny">Deny</button>
+             </form>
+             {{end}}
+          </td>
+       </tr>
+       {{- end}}
+    </table>
+    {{else}}
+    <p>There are no certificate requests waiting for an approval.</p>
+    {{end}}
+    <p><a href="/profile/">Back to your profile</a></p>
+    </div>
+    {{template "footer" . }}
+    </div>
+  </body>
+</html>
+{{end}}
+`
+
+type certRequestPageTemplateData struct {
+	Title        string
+	AuthUsername string
+	JSSources    []string
+}
+
+const certRequestHTML = `
+{{define "certRequestPage"}}
+<!DOCTYPE html>
+<html style="height:100%; padding:0;border:0;margin:0">
+  <head>
+    <title>{{.Title}}</title>
+    {{if .JSSources -}}
+    {{- range .JSSources }}
+    <script type="text/javascript" src="{{.}}"></script>
+    {{- end}}
+    {{- end}}
+    <link rel="stylesheet" type="text/css" href="//fonts.googleapis.com/css?family=Droid+Sans" />
+    <link rel="stylesheet" type="text/css" href="/custom_static/customization.css">
+    <link rel="stylesheet" type="text/css" href="/static/keymaster.css">
+  </head>
+  <body>
+    <div style="min-height:100%;position:relative;">
+    {{template "header" .}}
+    <div style="padding-bottom:60px; margin:1em auto; max-width:80em; padding-left:20px ">
+
+    <h1>{{.Title}}</h1>
+    <div id="cert_request" data-username="{{.AuthUsername}}">
+    <p>
+    A new key is generated in this browser and only its public key is sent to
+    Keymaster. Save the key and the certificates in <code>~/.ssh</code> (SSH)
+    or <code>~/.ssl</code> (X.509).
+    </p>
+    <p>
+    <label><input type="checkbox" id="cert_request_ssh" checked> SSH certificate</label>
+    <label><input type="checkbox" id="cert_request_x509" checked> X.509 certificate</label>
+    </p>
+    <p>
+    <button type="button" id="cert_request_button">Generate key and request certificates</button>
+    </p>
+    <p id="cert_request_status"></p>
+    <ul id="cert_request_downloads"></ul>
+    </div>
+    <p><a href="/profile/">Back to your profile</a></p>
+    </div>
+    {{template "footer" . }}
+    </div>
+  </body>
+</html>
+{{end}}
+`
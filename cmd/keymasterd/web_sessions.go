@@ -0,0 +1,507 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/auditlog"
+	"github.com/Cloud-Foundations/keymaster/lib/instrumentedwriter"
+	"github.com/Cloud-Foundations/keymaster/lib/simplestorage"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+const (
+	adminAPISessionsPath       = "/admin/api/v1/sessions"
+	adminAPIRevokeSessionsPath = "/admin/api/v1/revoke-sessions"
+
+	maxWebSessionUserAgentLength = 256
+)
+
+// Web sessions are kept with the signed user data, so that a session
+// revoked on one instance is rejected by all. They are keyed by session ID
+// and the sessions of a user are listed in an index keyed by the username.
+// The data types must differ from the other users of the storage (1 for the
+// LDAP password cache, 2 for the Okta cache and 3 for local users).
+const (
+	webSessionDataType      = 4
+	userWebSessionsDataType = 5
+	// Concurrent logins on different instances may drop entries from the
+	// index, so revoking all sessions of a user also records the time,
+	// which rejects the sessions which are not listed as well as cookies
+	// issued before sessions were tracked.
+	webSessionsRevocationDataType = 6
+)
+
+var errWebSessionRevoked = errors.New("web session revoked")
+
+type webSession struct {
+	ID         string
+	Username   string
+	RemoteAddr string
+	UserAgent  string
+	AuthType   int
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+}
+
+// userWebSessions is the index of the sessions of a user. Key: session ID.
+type userWebSessions map[string]time.Time
+
+// webSessionsRevocation records that all sessions of a user which were
+// created before RevokedAt are revoked.
+type webSessionsRevocation struct {
+	RevokedAt time.Time
+}
+
+// webSessionStorage returns the storage of web sessions, or nil if sessions
+// are not tracked.
+func (state *RuntimeState) webSessionStorage() simplestorage.SimpleStore {
+	return state.sharedSignedStorage()
+}
+
+func getUserWebSessionIndex(storage simplestorage.SimpleStore,
+	username string) (userWebSessions, error) {
+	index := make(userWebSessions)
+	_, err := getSignedJSON(storage, username, userWebSessionsDataType,
+		&index)
+	if err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// saveUserWebSessionIndex saves index without its expired sessions, or
+// deletes it if none are left.
+func saveUserWebSessionIndex(storage simplestorage.SimpleStore,
+	username string, index userWebSessions, now time.Time) error {
+	var expiresAt time.Time
+	for id, sessionExpiresAt := range index {
+		if now.After(sessionExpiresAt) {
+			delete(index, id)
+		} else if sessionExpiresAt.After(expiresAt) {
+			expiresAt = sessionExpiresAt
+		}
+	}
+	if len(index) < 1 {
+		return storage.DeleteSigned(username, userWebSessionsDataType)
+	}
+	return putSignedJSON(storage, username, userWebSessionsDataType,
+		index, expiresAt)
+}
+
+func newWebSessionID() (string, error) {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(idBytes), nil
+}
+
+// newWebSession records a new session of username authenticated with
+// authType by r, which may be nil, and returns its ID. The ID is empty if
+// sessions are not tracked.
+func (state *RuntimeState) newWebSession(r *http.Request, username string,
+	authType int, expiresAt time.Time) (string, error) {
+	storage := state.webSessionStorage()
+	if storage == nil {
+		return "", nil
+	}
+	id, err := newWebSessionID()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	session := webSession{
+		ID:        id,
+		Username:  username,
+		AuthType:  authType,
+		CreatedAt: now,
+		ExpiresAt: expiresAt,
+	}
+	if r != nil {
+		session.RemoteAddr = r.RemoteAddr
+		session.UserAgent = r.UserAgent()
+		if len(session.UserAgent) > maxWebSessionUserAgentLength {
+			session.UserAgent = session.UserAgent[:maxWebSessionUserAgentLength]
+		}
+	}
+	err = putSignedJSON(storage, id, webSessionDataType, session,
+		expiresAt)
+	if err != nil {
+		return "", err
+	}
+	state.webSessionsMutex.Lock()
+	defer state.webSessionsMutex.Unlock()
+	index, err := getUserWebSessionIndex(storage, username)
+	if err != nil {
+		return "", err
+	}
+	index[id] = expiresAt
+	if err := saveUserWebSessionIndex(storage, username, index,
+		now); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// checkWebSession returns errWebSessionRevoked if the session of info was
+// revoked.
+func (state *RuntimeState) checkWebSession(info authInfo) error {
+	storage := state.webSessionStorage()
+	if storage == nil {
+		return nil
+	}
+	createdAt := info.IssuedAt
+	if info.SessionID != "" {
+		var session webSession
+		ok, err := getSignedJSON(storage, info.SessionID,
+			webSessionDataType, &session)
+		if err != nil {
+			return err
+		}
+		if !ok || session.Username != info.Username {
+			return errWebSessionRevoked
+		}
+		createdAt = session.CreatedAt
+	}
+	var revocation webSessionsRevocation
+	revoked, err := getSignedJSON(storage, info.Username,
+		webSessionsRevocationDataType, &revocation)
+	if err != nil {
+		return err
+	}
+	// IssuedAt only has seconds, so cookies issued in the second of the
+	// revocation are revoked too.
+	if revoked && (createdAt.Before(revocation.RevokedAt) ||
+		info.SessionID == "" && !createdAt.After(revocation.RevokedAt)) {
+		return errWebSessionRevoked
+	}
+	return nil
+}
+
+// updateWebSessionAuthType records that the session sessionID is now
+// authenticated with authType.
+func (state *RuntimeState) updateWebSessionAuthType(sessionID string,
+	authType int) {
+	storage := state.webSessionStorage()
+	if storage == nil || sessionID == "" {
+		return
+	}
+	var session webSession
+	ok, err := getSignedJSON(storage, sessionID, webSessionDataType,
+		&session)
+	if err == nil && ok {
+		session.AuthType = authType
+		err = putSignedJSON(storage, sessionID, webSessionDataType,
+			session, session.ExpiresAt)
+	}
+	if err != nil {
+		logger.Printf("cannot update session %s: %s", sessionID, err)
+	}
+}
+
+// getWebSessions returns the sessions of username, newest first.
+func (state *RuntimeState) getWebSessions(username string) (
+	[]webSession, error) {
+	storage := state.webSessionStorage()
+	if storage == nil {
+		return nil, nil
+	}
+	index, err := getUserWebSessionIndex(storage, username)
+	if err != nil {
+		return nil, err
+	}
+	var revocation webSessionsRevocation
+	revoked, err := getSignedJSON(storage, username,
+		webSessionsRevocationDataType, &revocation)
+	if err != nil {
+		return nil, err
+	}
+	var sessions []webSession
+	for id := range index {
+		var session webSession
+		ok, err := getSignedJSON(storage, id, webSessionDataType,
+			&session)
+		if err != nil {
+			return nil, err
+		}
+		if !ok || session.Username != username ||
+			revoked && session.CreatedAt.Before(revocation.RevokedAt) {
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt.After(sessions[j].CreatedAt)
+	})
+	return sessions, nil
+}
+
+// revokeWebSession revokes the session sessionID of username. The bool is
+// false if username has no such session.
+func (state *RuntimeState) revokeWebSession(username string,
+	sessionID string) (bool, error) {
+	storage := state.webSessionStorage()
+	if storage == nil {
+		return false, nil
+	}
+	var session webSession
+	ok, err := getSignedJSON(storage, sessionID, webSessionDataType,
+		&session)
+	if err != nil || !ok || session.Username != username {
+		return false, err
+	}
+	if err := storage.DeleteSigned(sessionID,
+		webSessionDataType); err != nil {
+		return false, err
+	}
+	state.webSessionsMutex.Lock()
+	defer state.webSessionsMutex.Unlock()
+	index, err := getUserWebSessionIndex(storage, username)
+	if err != nil {
+		return true, err
+	}
+	if _, ok := index[sessionID]; !ok {
+		return true, nil
+	}
+	delete(index, sessionID)
+	return true, saveUserWebSessionIndex(storage, username, index, time.Now())
+}
+
+// revokeAllWebSessions revokes all sessions of username, including those
+// which are not listed, and returns how many listed sessions were revoked.
+func (state *RuntimeState) revokeAllWebSessions(username string) (int,
+	error) {
+	storage := state.webSessionStorage()
+	if storage == nil {
+		return 0, nil
+	}
+	now := time.Now()
+	// Cookies live no longer than this, nor need the revocation.
+	expiresAt := now.Add(time.Duration(maxAgeSecondsAuthCookie) * time.Second)
+	err := putSignedJSON(storage, username, webSessionsRevocationDataType,
+		webSessionsRevocation{RevokedAt: now}, expiresAt)
+	if err != nil {
+		return 0, err
+	}
+	state.webSessionsMutex.Lock()
+	defer state.webSessionsMutex.Unlock()
+	index, err := getUserWebSessionIndex(storage, username)
+	if err != nil {
+		return 0, err
+	}
+	var revoked int
+	for id, sessionExpiresAt := range index {
+		if now.After(sessionExpiresAt) {
+			continue
+		}
+		if err := storage.DeleteSigned(id, webSessionDataType); err != nil {
+			return revoked, err
+		}
+		revoked++
+	}
+	return revoked, storage.DeleteSigned(username, userWebSessionsDataType)
+}
+
+// getRequestWebSessionID returns the session ID of the auth cookie of r, if
+// any.
+func (state *RuntimeState) getRequestWebSessionID(r *http.Request) string {
+	for _, cookie := range r.Cookies() {
+		if cookie.Name != authCookieName {
+			continue
+		}
+		info, err := state.getAuthInfoFromAuthJWT(cookie.Value)
+		if err == nil {
+			return info.SessionID
+		}
+	}
+	return ""
+}
+
+func getWebSessionsResponse(username string, sessions []webSession,
+	currentID string) proto.SessionsResponse {
+	response := proto.SessionsResponse{
+		Username: username,
+		Sessions: []proto.WebSession{},
+	}
+	for _, session := range sessions {
+		response.Sessions = append(response.Sessions, proto.WebSession{
+			ID:          session.ID,
+			RemoteAddr:  session.RemoteAddr,
+			UserAgent:   session.UserAgent,
+			AuthMethods: getAuthMethodNames(session.AuthType),
+			CreatedAt:   session.CreatedAt,
+			ExpiresAt:   session.ExpiresAt,
+			Current:     currentID != "" && session.ID == currentID,
+		})
+	}
+	return response
+}
+
+// logWebSessionsRevoked records the revocation of the sessions of username
+// by revokedBy. sessionID is empty if all sessions were revoked.
+func (state *RuntimeState) logWebSessionsRevoked(r *http.Request,
+	revokedBy string, username string, sessionID string) {
+	details := map[string]string{"user": username}
+	if sessionID == "" {
+		details["session"] = "all"
+	} else {
+		details["session"] = sessionID
+	}
+	logger.Printf("%s revoked session %s of %s", revokedBy, details["session"],
+		username)
+	state.logAuditEvent(r, auditlog.Event{
+		Type:     auditlog.EventTypeRevoke,
+		Username: revokedBy,
+		Success:  true,
+		Method:   "session",
+		Details:  details,
+	})
+}
+
+// sessionsHandler lists (GET) or revokes (POST) the web sessions of the
+// authenticated user or, for admins, of another user.
+func (state *RuntimeState) sessionsHandler(w http.ResponseWriter,
+	r *http.Request) {
+	if state.sendFailureToClientIfLocked(w, r) {
+		return
+	}
+	if r.Method != "GET" && r.Method != "POST" {
+		state.writeFailureResponse(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	authUser, loginLevel, err := state.checkAuth(w, r,
+		state.getRequiredWebUIAuthLevel())
+	if err != nil {
+		logger.Debugf(1, "%v", err)
+		return
+	}
+	w.(*instrumentedwriter.LoggingWriter).SetUsername(authUser)
+	if err := r.ParseForm(); err != nil {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Error parsing form")
+		return
+	}
+	username := r.Form.Get("username")
+	if username == "" {
+		username = authUser
+	} else if username != authUser {
+		// Changes to other users need an admin with U2F, as for profiles.
+		if (r.Method == "GET" && !state.IsAdminUser(authUser)) ||
+			(r.Method == "POST" &&
+				!state.IsAdminUserAndU2F(authUser, loginLevel)) {
+			state.writeFailureResponse(w, r, http.StatusUnauthorized, "")
+			return
+		}
+	}
+	if r.Method == "POST" {
+		sessionID := r.Form.Get("session_id")
+		all, _ := strconv.ParseBool(r.Form.Get("all"))
+		switch {
+		case all:
+			_, err = state.revokeAllWebSessions(username)
+			sessionID = ""
+		case sessionID != "":
+			var ok bool
+			ok, err = state.revokeWebSession(username, sessionID)
+			if err == nil && !ok {
+				state.writeFailureResponse(w, r, http.StatusNotFound,
+					"Unknown session")
+				return
+			}
+		default:
+			state.writeFailureResponse(w, r, http.StatusBadRequest,
+				"Missing session_id")
+			return
+		}
+		if err != nil {
+			logger.Printf("revoking sessions error: %v", err)
+			state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+			return
+		}
+		state.logWebSessionsRevoked(r, authUser, username, sessionID)
+		if getPreferredAcceptType(r) == "text/html" {
+			http.Redirect(w, r, profileURI(authUser, username), 302)
+			return
+		}
+	}
+	sessions, err := state.getWebSessions(username)
+	if err != nil {
+		logger.Printf("listing sessions error: %v", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(getWebSessionsResponse(username, sessions,
+		state.getRequestWebSessionID(r)))
+}
+
+// adminAPISessionsHandler lists the web sessions of the user of the "user"
+// form value.
+func (state *RuntimeState) adminAPISessionsHandler(w http.ResponseWriter,
+	r *http.Request) {
+	if _, ok := state.checkAdminAPIAuth(w, r, "GET"); !ok {
+		return
+	}
+	username := r.Form.Get("user")
+	if username == "" {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Missing user")
+		return
+	}
+	sessions, err := state.getWebSessions(username)
+	if err != nil {
+		logger.Printf("listing sessions error: %v", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	writeAdminAPIResponse(w, getWebSessionsResponse(username, sessions, ""))
+}
+
+// adminAPIRevokeSessionsHandler revokes the web session of the
+// "session_id" form value, or all sessions if it is empty, of the user of
+// the "user" form value.
+func (state *RuntimeState) adminAPIRevokeSessionsHandler(
+	w http.ResponseWriter, r *http.Request) {
+	authUser, ok := state.checkAdminAPIAuth(w, r, "POST")
+	if !ok {
+		return
+	}
+	username := r.Form.Get("user")
+	if username == "" {
+		state.writeFailureResponse(w, r, http.StatusBadRequest,
+			"Missing user")
+		return
+	}
+	sessionID := r.Form.Get("session_id")
+	var err error
+	if sessionID == "" {
+		_, err = state.revokeAllWebSessions(username)
+	} else {
+		ok, err = state.revokeWebSession(username, sessionID)
+		if err == nil && !ok {
+			state.writeFailureResponse(w, r, http.StatusNotFound,
+				"Unknown session")
+			return
+		}
+	}
+	if err != nil {
+		logger.Printf("revoking sessions error: %v", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	state.logWebSessionsRevoked(r, authUser, username, sessionID)
+	sessions, err := state.getWebSessions(username)
+	if err != nil {
+		logger.Printf("listing sessions error: %v", err)
+		state.writeFailureResponse(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	writeAdminAPIResponse(w, getWebSessionsResponse(username, sessions, ""))
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+func getTestSessions(t *testing.T, state *RuntimeState,
+	authCookie *http.Cookie, expectedStatus int) proto.SessionsResponse {
+	req, err := http.NewRequest("GET", proto.SessionsPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(authCookie)
+	rr, err := checkRequestHandlerCode(req, state.sessionsHandler,
+		expectedStatus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response proto.SessionsResponse
+	if expectedStatus == http.StatusOK {
+		if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return response
+}
+
+func postTestSessions(t *testing.T, state *RuntimeState,
+	authCookie *http.Cookie, form url.Values) {
+	req, err := http.NewRequest("POST", proto.SessionsPath,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(authCookie)
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	if _, err := checkRequestHandlerCode(req, state.sessionsHandler,
+		http.StatusOK); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebSessions(t *testing.T) {
+	state, passwdFile, err := setupValidRuntimeStateSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(passwdFile.Name())
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	state.Config.Base.DataDirectory = dir
+	if err := initDB(state); err != nil {
+		t.Fatal(err)
+	}
+	state.Config.Base.AllowedAuthBackendsForWebUI = []string{"password"}
+	var cookies []*http.Cookie
+	for i := 0; i < 3; i++ {
+		cookieVal, err := state.setNewAuthCookie(nil, nil, "username",
+			AuthTypePassword)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cookies = append(cookies,
+			&http.Cookie{Name: authCookieName, Value: cookieVal})
+	}
+	response := getTestSessions(t, state, cookies[0], http.StatusOK)
+	if len(response.Sessions) != 3 {
+		t.Fatalf("expected 3 sessions, got %d", len(response.Sessions))
+	}
+	var current int
+	for _, session := range response.Sessions {
+		if session.Current {
+			current++
+		}
+	}
+	if current != 1 {
+		t.Fatalf("%d sessions marked current", current)
+	}
+	info, err := state.getAuthInfoFromAuthJWT(cookies[1].Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	postTestSessions(t, state, cookies[0],
+		url.Values{"session_id": {info.SessionID}})
+	getTestSessions(t, state, cookies[1], http.StatusUnauthorized)
+	response = getTestSessions(t, state, cookies[2], http.StatusOK)
+	if len(response.Sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got %d", len(response.Sessions))
+	}
+	// Cookies issued before sessions were tracked are also revoked.
+	cookieVal, err := state.genNewSerializedAuthJWT("username",
+		AuthTypePassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	untrackedCookie := &http.Cookie{Name: authCookieName, Value: cookieVal}
+	getTestSessions(t, state, untrackedCookie, http.StatusOK)
+	postTestSessions(t, state, cookies[2], url.Values{"all": {"true"}})
+	getTestSessions(t, state, cookies[0], http.StatusUnauthorized)
+	getTestSessions(t, state, cookies[2], http.StatusUnauthorized)
+	getTestSessions(t, state, untrackedCookie, http.StatusUnauthorized)
+	cookieVal, err = state.setNewAuthCookie(nil, nil, "username",
+		AuthTypePassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response = getTestSessions(t, state,
+		&http.Cookie{Name: authCookieName, Value: cookieVal}, http.StatusOK)
+	if len(response.Sessions) != 1 || !response.Sessions[0].Current {
+		t.Fatalf("unexpected sessions after new login: %+v",
+			response.Sessions)
+	}
+}
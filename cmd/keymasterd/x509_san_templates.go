@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/Cloud-Foundations/keymaster/lib/certgen"
+)
+
+var x509SANAttributeRegexp = regexp.MustCompile(`\$\{([A-Za-z][A-Za-z0-9-]*)\}`)
+
+func checkX509SANTemplates(templates []X509SANTemplate) error {
+	for index, template := range templates {
+		switch template.Type {
+		case "email", "upn", "uri", "dns":
+		default:
+			return fmt.Errorf("template %d: invalid type: %q", index,
+				template.Type)
+		}
+		if template.Value == "" {
+			return fmt.Errorf("template %d: missing value", index)
+		}
+	}
+	return nil
+}
+
+// getX509SANTemplateAttributes returns the LDAP attributes used by
+// templates.
+func getX509SANTemplateAttributes(templates []X509SANTemplate) []string {
+	var attributes []string
+	seen := make(map[string]struct{})
+	for _, template := range templates {
+		for _, match := range x509SANAttributeRegexp.FindAllStringSubmatch(
+			template.Value, -1) {
+			if _, ok := seen[match[1]]; !ok {
+				seen[match[1]] = struct{}{}
+				attributes = append(attributes, match[1])
+			}
+		}
+	}
+	return attributes
+}
+
+// expandX509SANTemplate returns the SAN of template for username, in the
+// form taken by certgen.GenUserX509CertWithSANs. An error is returned if an
+// attribute is missing or the result is not a SAN of the template type.
+func expandX509SANTemplate(template X509SANTemplate, username string,
+	attributes map[string][]string) (string, error) {
+	var missing string
+	value := x509SANAttributeRegexp.ReplaceAllStringFunc(template.Value,
+		func(variable string) string {
+			name := variable[2 : len(variable)-1]
+			if values := attributes[name]; len(values) > 0 &&
+				values[0] != "" {
+				return values[0]
+			}
+			missing = name
+			return ""
+		})
+	if missing != "" {
+		return "", fmt.Errorf("no %s attribute", missing)
+	}
+	value = strings.Replace(value, "$USER", username, -1)
+	isEmail := strings.Contains(value, "@")
+	isURI := strings.Contains(value, "://")
+	valid := false
+	switch template.Type {
+	case "email":
+		valid = isEmail && !isURI
+	case "upn":
+		valid = isEmail && !isURI
+		value = certgen.UPNSANPrefix + value
+	case "uri":
+		valid = isURI
+	case "dns":
+		valid = !isEmail && !isURI
+	}
+	if !valid || strings.ContainsAny(value, " \t\r\n") {
+		return "", fmt.Errorf("%q is not a valid %s SAN", value, template.Type)
+	}
+	return value, nil
+}
+
+// getTemplatedX509SANs returns the SANs x509_san_templates give username,
+// looking up the attributes it uses in the directory.
+func (state *RuntimeState) getTemplatedX509SANs(username string) (
+	[]string, error) {
+	return state.expandX509SANTemplates(username,
+		state.Config.Base.X509SANTemplates)
+}
+
+// expandX509SANTemplates returns the SANs templates give username, looking
+// up the attributes they use in the directory.
+func (state *RuntimeState) expandX509SANTemplates(username string,
+	templates []X509SANTemplate) ([]string, error) {
+	if len(templates) < 1 {
+		return nil, nil
+	}
+	var attributes map[string][]string
+	if names := getX509SANTemplateAttributes(templates); len(names) > 0 {
+		var err error
+		attributes, err = state.getUserAttributes(username, names)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var sans []string
+	for _, template := range templates {
+		san, err := expandX509SANTemplate(template, username, attributes)
+		if err != nil {
+			logger.Debugf(1, "skipping %s SAN template for %s: %s",
+				template.Type, username, err)
+			continue
+		}
+		sans = append(sans, san)
+	}
+	return sans, nil
+}
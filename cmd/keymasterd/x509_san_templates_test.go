@@ -0,0 +1,88 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Cloud-Foundations/keymaster/lib/certgen"
+)
+
+func TestCheckX509SANTemplates(t *testing.T) {
+	err := checkX509SANTemplates([]X509SANTemplate{
+		{Type: "upn", Value: "${userPrincipalName}"},
+		{Type: "dns", Value: "$USER.users.example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, template := range []X509SANTemplate{
+		{Type: "ip", Value: "10.0.0.1"},
+		{Type: "email"},
+	} {
+		err := checkX509SANTemplates([]X509SANTemplate{template})
+		if err == nil {
+			t.Errorf("%+v should be rejected", template)
+		}
+	}
+}
+
+func TestExpandX509SANTemplate(t *testing.T) {
+	attributes := map[string][]string{
+		"mail":              {"alice@example.com", "a@example.com"},
+		"userPrincipalName": {"alice@corp.example.com"},
+		"employeeNumber":    {"1234"},
+		"displayName":       {"Alice Smith"},
+	}
+	for _, test := range []struct {
+		template X509SANTemplate
+		expected string
+	}{
+		{X509SANTemplate{"email", "${mail}"}, "alice@example.com"},
+		{X509SANTemplate{"upn", "${userPrincipalName}"},
+			certgen.UPNSANPrefix + "alice@corp.example.com"},
+		{X509SANTemplate{"uri", "https://id.example.com/${employeeNumber}/$USER"},
+			"https://id.example.com/1234/alice"},
+		{X509SANTemplate{"dns", "$USER.users.example.com"},
+			"alice.users.example.com"},
+	} {
+		san, err := expandX509SANTemplate(test.template, "alice", attributes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if san != test.expected {
+			t.Errorf("%+v: expected %s, got %s", test.template,
+				test.expected, san)
+		}
+	}
+	for _, template := range []X509SANTemplate{
+		{"email", "${proxyAddresses}"},
+		{"upn", "$USER"},
+		{"dns", "${mail}"},
+		{"uri", "${employeeNumber}"},
+		{"dns", "${displayName}.example.com"},
+	} {
+		if _, err := expandX509SANTemplate(template, "alice",
+			attributes); err == nil {
+			t.Errorf("%+v should fail", template)
+		}
+	}
+}
+
+func TestGetTemplatedX509SANsWithoutDirectory(t *testing.T) {
+	state := &RuntimeState{}
+	if sans, err := state.getTemplatedX509SANs("alice"); err != nil ||
+		sans != nil {
+		t.Fatalf("unexpected SANs: %v %v", sans, err)
+	}
+	state.Config.Base.X509SANTemplates = []X509SANTemplate{
+		{Type: "upn", Value: "${userPrincipalName}"},
+		{Type: "email", Value: "$USER@example.com"},
+	}
+	sans, err := state.getTemplatedX509SANs("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sans, []string{"alice@example.com"}) {
+		t.Fatalf("unexpected SANs: %v", sans)
+	}
+}
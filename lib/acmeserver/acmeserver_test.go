@@ -0,0 +1,247 @@
+package acmeserver
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log/testlogger"
+	"github.com/Cloud-Foundations/keymaster/lib/certgen"
+	"golang.org/x/crypto/acme"
+)
+
+// testHMACKey is "0123456789abcdef0123456789abcdef" base64url encoded.
+const testHMACKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY"
+
+type testIssuer struct {
+	caCert *x509.Certificate
+	caKey  crypto.Signer
+	keyIDs []string
+}
+
+func (i *testIssuer) IssueHostCertificate(keyID string, dnsNames []string,
+	pub interface{}, duration time.Duration) ([][]byte, error) {
+	i.keyIDs = append(i.keyIDs, keyID)
+	derCert, err := certgen.GenHostX509Cert(dnsNames, pub, i.caCert, i.caKey,
+		duration)
+	if err != nil {
+		return nil, err
+	}
+	return [][]byte{derCert, i.caCert.Raw}, nil
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	derCert, err := x509.CreateCertificate(rand.Reader, &template, &template,
+		&caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(derCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testIssuer{caCert: caCert, caKey: caKey}
+}
+
+func newTestClient(t *testing.T, server *httptest.Server) *acme.Client {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &acme.Client{
+		Key:          key,
+		HTTPClient:   server.Client(),
+		DirectoryURL: server.URL + "/acme" + directoryPath,
+	}
+}
+
+func newTestCSR(t *testing.T, names ...string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader,
+		&x509.CertificateRequest{DNSNames: names}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return csr
+}
+
+func checkProblemType(t *testing.T, err error, problemType string) {
+	var acmeError *acme.Error
+	if !errors.As(err, &acmeError) {
+		t.Fatalf("expected ACME error %s, got: %v", problemType, err)
+	}
+	if acmeError.ProblemType != problemPrefix+problemType {
+		t.Fatalf("expected ACME error %s, got: %s", problemType,
+			acmeError.ProblemType)
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	config := Config{
+		AllowedDomains: []string{"internal.example.com"},
+		ExternalAccounts: []ExternalAccount{{
+			KeyID:        "web",
+			HMACKey:      testHMACKey,
+			AllowedNames: []string{"*.web.internal.example.com"},
+		}},
+	}
+	if _, err := checkConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	config.ExternalAccounts[0].AllowedNames = []string{"www.example.com"}
+	if _, err := checkConfig(config); err == nil {
+		t.Fatal("name outside allowed_domains should fail")
+	}
+	config.ExternalAccounts[0].AllowedNames = nil
+	config.ExternalAccounts[0].HMACKey = "c2hvcnQ"
+	if _, err := checkConfig(config); err == nil {
+		t.Fatal("short hmac_key should fail")
+	}
+}
+
+func TestNameAllowed(t *testing.T) {
+	patterns := []string{"db.example.com", "*.web.example.com"}
+	for name, allowed := range map[string]bool{
+		"db.example.com":      true,
+		"a.web.example.com":   true,
+		"a.b.web.example.com": true,
+		"web.example.com":     false,
+		"a.db.example.com":    false,
+		"xweb.example.com":    false,
+	} {
+		if nameAllowed(name, patterns) != allowed {
+			t.Errorf("nameAllowed(%s) != %v", name, allowed)
+		}
+	}
+}
+
+func TestIssue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acmeserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := Config{
+		AllowedDomains: []string{"internal.example.com"},
+		ExternalAccounts: []ExternalAccount{{
+			KeyID:   "web",
+			HMACKey: testHMACKey,
+			AllowedNames: []string{"web.internal.example.com",
+				"*.web.internal.example.com"},
+		}},
+		AccountsFilename: filepath.Join(dir, "accounts.json"),
+	}
+	issuer := newTestIssuer(t)
+	var handler http.Handler
+	httpServer := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			handler.ServeHTTP(w, r)
+		}))
+	defer httpServer.Close()
+	acmeServer, err := New(httpServer.URL+"/acme", config, issuer,
+		testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler = http.StripPrefix("/acme", acmeServer)
+	ctx := context.Background()
+	client := newTestClient(t, httpServer)
+	_, err = client.Register(ctx, &acme.Account{}, acme.AcceptTOS)
+	checkProblemType(t, err, "externalAccountRequired")
+	_, err = client.Register(ctx, &acme.Account{
+		ExternalAccountBinding: &acme.ExternalAccountBinding{
+			KID: "web", Key: []byte("wrong key for the web account")},
+	}, acme.AcceptTOS)
+	checkProblemType(t, err, "unauthorized")
+	eab := &acme.ExternalAccountBinding{
+		KID: "web", Key: []byte("0123456789abcdef0123456789abcdef")}
+	if _, err := client.Register(ctx,
+		&acme.Account{ExternalAccountBinding: eab}, acme.AcceptTOS); err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.AuthorizeOrder(ctx,
+		acme.DomainIDs("db.internal.example.com"))
+	checkProblemType(t, err, "rejectedIdentifier")
+	names := []string{"web.internal.example.com",
+		"a.web.internal.example.com"}
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(names...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.Status != acme.StatusReady || len(order.AuthzURLs) != 2 {
+		t.Fatalf("unexpected order %+v", order)
+	}
+	authz, err := client.GetAuthorization(ctx, order.AuthzURLs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authz.Status != acme.StatusValid || authz.Identifier.Value != names[1] {
+		t.Fatalf("unexpected authorization %+v", authz)
+	}
+	_, _, err = client.CreateOrderCert(ctx, order.FinalizeURL,
+		newTestCSR(t, names[0]), true)
+	checkProblemType(t, err, "badCSR")
+	derCerts, _, err := client.CreateOrderCert(ctx, order.FinalizeURL,
+		newTestCSR(t, names...), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(derCerts) != 2 {
+		t.Fatalf("expected 2 certificates, got %d", len(derCerts))
+	}
+	cert, err := x509.ParseCertificate(derCerts[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cert.DNSNames) != 2 || cert.DNSNames[1] != names[1] ||
+		cert.NotAfter.Sub(cert.NotBefore) != defaultCertDuration {
+		t.Fatalf("unexpected certificate %v %s", cert.DNSNames, cert.NotAfter)
+	}
+	if len(issuer.keyIDs) != 1 || issuer.keyIDs[0] != "web" {
+		t.Fatalf("unexpected issuer calls %v", issuer.keyIDs)
+	}
+	// Accounts survive a restart.
+	acmeServer, err = New(httpServer.URL+"/acme", config, issuer,
+		testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler = http.StripPrefix("/acme", acmeServer)
+	restartedClient := &acme.Client{
+		Key:          client.Key,
+		HTTPClient:   httpServer.Client(),
+		DirectoryURL: client.DirectoryURL,
+	}
+	if _, err := restartedClient.GetReg(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
+}
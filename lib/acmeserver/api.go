@@ -0,0 +1,75 @@
+// Package acmeserver implements the subset of the ACME protocol (RFC 8555)
+// needed to issue host certificates for internal DNS names to clients such
+// as certbot and lego. Accounts must be bound to a configured external
+// account (RFC 8555 section 7.3.4), which determines the names the account
+// may obtain. Since names are granted by configuration rather than proven
+// with challenges, authorizations are valid when orders are created.
+package acmeserver
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+)
+
+// ExternalAccount is a host or user which is given the key ID and MAC key
+// to register ACME accounts with.
+type ExternalAccount struct {
+	KeyID string `yaml:"key_id"`
+	// HMACKey is the base64url encoded MAC key, at least 16 bytes long.
+	HMACKey string `yaml:"hmac_key"`
+	// AllowedNames are the DNS names the account may obtain. A name of the
+	// form "*.example.com" allows any name under example.com, but not a
+	// wildcard certificate.
+	AllowedNames []string `yaml:"allowed_names"`
+}
+
+// Config configures a Server.
+type Config struct {
+	// AllowedDomains restricts every name to one of these domains or their
+	// subdomains.
+	AllowedDomains   []string          `yaml:"allowed_domains"`
+	ExternalAccounts []ExternalAccount `yaml:"external_accounts"`
+	// AccountsFilename is the file registered accounts are kept in.
+	AccountsFilename string `yaml:"accounts_filename"`
+	// CertDuration is the lifetime of issued certificates, 90 days by
+	// default.
+	CertDuration time.Duration `yaml:"cert_duration"`
+}
+
+// Issuer signs host certificates for a Server.
+type Issuer interface {
+	// IssueHostCertificate returns the DER encoded certificate chain, leaf
+	// first, of a server certificate for dnsNames with the public key pub.
+	// keyID is the external account the request was made with.
+	IssueHostCertificate(keyID string, dnsNames []string, pub interface{},
+		duration time.Duration) ([][]byte, error)
+}
+
+// Server is an http.Handler serving an ACME directory at baseURL. Request
+// paths are relative to baseURL, so it should be mounted with
+// http.StripPrefix if baseURL has a path. Orders are only kept in memory.
+type Server struct {
+	baseURL          string
+	config           Config
+	externalAccounts map[string]externalAccount
+	issuer           Issuer
+	logger           log.DebugLogger
+	mutex            sync.Mutex // Protect everything below.
+	accounts         map[string]*account
+	nonces           map[string]time.Time
+	orders           map[string]*order
+}
+
+// New returns a Server with the ACME directory at baseURL. Registered
+// accounts are read from config.AccountsFilename if it exists.
+func New(baseURL string, config Config, issuer Issuer,
+	logger log.DebugLogger) (*Server, error) {
+	return newServer(baseURL, config, issuer, logger)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.serveHTTP(w, r)
+}
@@ -0,0 +1,606 @@
+package acmeserver
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	directoryPath  = "/directory"
+	newNoncePath   = "/new-nonce"
+	newAccountPath = "/new-account"
+	newOrderPath   = "/new-order"
+	accountPath    = "/account/"
+	ordersSuffix   = "/orders"
+	orderPath      = "/order/"
+	authzPath      = "/authz/"
+	finalizePath   = "/finalize/"
+	certPath       = "/cert/"
+
+	minRSAKeyBits = 2048
+	orderLifetime = 24 * time.Hour
+
+	statusDeactivated = "deactivated"
+	statusInvalid     = "invalid"
+	statusProcessing  = "processing"
+	statusReady       = "ready"
+	statusValid       = "valid"
+)
+
+type identifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type directoryObject struct {
+	NewNonce   string        `json:"newNonce"`
+	NewAccount string        `json:"newAccount"`
+	NewOrder   string        `json:"newOrder"`
+	Meta       directoryMeta `json:"meta"`
+}
+
+type directoryMeta struct {
+	ExternalAccountRequired bool `json:"externalAccountRequired"`
+}
+
+type accountRequest struct {
+	Contact                []string        `json:"contact"`
+	OnlyReturnExisting     bool            `json:"onlyReturnExisting"`
+	ExternalAccountBinding json.RawMessage `json:"externalAccountBinding"`
+	Status                 string          `json:"status"`
+}
+
+type accountObject struct {
+	Status  string   `json:"status"`
+	Contact []string `json:"contact,omitempty"`
+	Orders  string   `json:"orders"`
+}
+
+type ordersObject struct {
+	Orders []string `json:"orders"`
+}
+
+type orderRequest struct {
+	Identifiers []identifier `json:"identifiers"`
+	NotBefore   string       `json:"notBefore"`
+	NotAfter    string       `json:"notAfter"`
+}
+
+type orderObject struct {
+	Status         string       `json:"status"`
+	Expires        string       `json:"expires"`
+	Identifiers    []identifier `json:"identifiers"`
+	Authorizations []string     `json:"authorizations"`
+	Finalize       string       `json:"finalize"`
+	Certificate    string       `json:"certificate,omitempty"`
+	Error          *problem     `json:"error,omitempty"`
+}
+
+type authorizationObject struct {
+	Identifier identifier        `json:"identifier"`
+	Status     string            `json:"status"`
+	Expires    string            `json:"expires"`
+	Challenges []json.RawMessage `json:"challenges"`
+}
+
+type finalizeRequest struct {
+	CSR string `json:"csr"`
+}
+
+type postHandlerFunc func(w http.ResponseWriter, req *request,
+	id string) error
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Link", "<"+s.baseURL+directoryPath+`>;rel="index"`)
+	err := s.route(w, r)
+	if err != nil {
+		s.writeProblem(w, err)
+	}
+}
+
+func (s *Server) route(w http.ResponseWriter, r *http.Request) error {
+	path := r.URL.Path
+	if r.Method == "POST" {
+		if err := s.setNonce(w); err != nil {
+			return err
+		}
+	}
+	switch {
+	case path == directoryPath:
+		return s.directoryHandler(w, r)
+	case path == newNoncePath:
+		return s.newNonceHandler(w, r)
+	case path == newAccountPath:
+		return s.newAccountHandler(w, r)
+	case path == newOrderPath:
+		return s.postHandler(w, r, "", s.newOrderHandler)
+	case strings.HasPrefix(path, accountPath):
+		return s.postHandler(w, r, path[len(accountPath):], s.accountHandler)
+	case strings.HasPrefix(path, orderPath):
+		return s.postHandler(w, r, path[len(orderPath):], s.orderHandler)
+	case strings.HasPrefix(path, authzPath):
+		return s.postHandler(w, r, path[len(authzPath):], s.authzHandler)
+	case strings.HasPrefix(path, finalizePath):
+		return s.postHandler(w, r, path[len(finalizePath):],
+			s.finalizeHandler)
+	case strings.HasPrefix(path, certPath):
+		return s.postHandler(w, r, path[len(certPath):], s.certHandler)
+	}
+	return newProblem(http.StatusNotFound, "malformed", "%s not found", path)
+}
+
+func (s *Server) setNonce(w http.ResponseWriter) error {
+	nonce, err := s.newNonce()
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Replay-Nonce", nonce)
+	return nil
+}
+
+func (s *Server) writeProblem(w http.ResponseWriter, err error) {
+	p, ok := err.(*problem)
+	if !ok {
+		s.logger.Printf("ACME request failed: %s", err)
+		p = newProblem(http.StatusInternalServerError, "serverInternal",
+			"internal error")
+	}
+	if w.Header().Get("Replay-Nonce") == "" {
+		s.setNonce(w)
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+func writeJSON(w http.ResponseWriter, status int, location string,
+	value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	if location != "" {
+		w.Header().Set("Location", location)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(data)
+	return err
+}
+
+func (s *Server) directoryHandler(w http.ResponseWriter,
+	r *http.Request) error {
+	if r.Method != "GET" {
+		return newProblem(http.StatusMethodNotAllowed, "malformed",
+			"method %s not allowed", r.Method)
+	}
+	return writeJSON(w, http.StatusOK, "", directoryObject{
+		NewNonce:   s.baseURL + newNoncePath,
+		NewAccount: s.baseURL + newAccountPath,
+		NewOrder:   s.baseURL + newOrderPath,
+		Meta:       directoryMeta{ExternalAccountRequired: true},
+	})
+}
+
+func (s *Server) newNonceHandler(w http.ResponseWriter,
+	r *http.Request) error {
+	if r.Method != "HEAD" && r.Method != "GET" {
+		return newProblem(http.StatusMethodNotAllowed, "malformed",
+			"method %s not allowed", r.Method)
+	}
+	if err := s.setNonce(w); err != nil {
+		return err
+	}
+	if r.Method == "GET" {
+		w.WriteHeader(http.StatusNoContent)
+	}
+	return nil
+}
+
+func (s *Server) postHandler(w http.ResponseWriter, r *http.Request,
+	id string, handler postHandlerFunc) error {
+	req, p := s.parseRequest(r, false)
+	if p != nil {
+		return p
+	}
+	return handler(w, req, id)
+}
+
+// checkPostAsGet returns a problem if req is not a POST-as-GET request.
+func checkPostAsGet(req *request) error {
+	if len(req.payload) > 0 {
+		return newProblem(http.StatusBadRequest, "malformed",
+			"payload must be empty")
+	}
+	return nil
+}
+
+func (s *Server) accountURL(acct *account) string {
+	return s.baseURL + accountPath + acct.ID
+}
+
+// writeAccount writes acct. s.mutex must not be held.
+func (s *Server) writeAccount(w http.ResponseWriter, status int,
+	acct *account) error {
+	s.mutex.Lock()
+	object := accountObject{
+		Status:  acct.Status,
+		Contact: acct.Contact,
+		Orders:  s.accountURL(acct) + ordersSuffix,
+	}
+	s.mutex.Unlock()
+	return writeJSON(w, status, s.accountURL(acct), object)
+}
+
+// findAccount returns the account with the key thumbprint thumbprint.
+// s.mutex must be held.
+func (s *Server) findAccount(thumbprint string) *account {
+	for _, acct := range s.accounts {
+		if acct.Thumbprint == thumbprint {
+			return acct
+		}
+	}
+	return nil
+}
+
+func (s *Server) newAccountHandler(w http.ResponseWriter,
+	r *http.Request) error {
+	req, p := s.parseRequest(r, true)
+	if p != nil {
+		return p
+	}
+	var request accountRequest
+	if err := json.Unmarshal(req.payload, &request); err != nil {
+		return newProblem(http.StatusBadRequest, "malformed",
+			"cannot parse account request: %s", err)
+	}
+	s.mutex.Lock()
+	existing := s.findAccount(req.thumbprint)
+	s.mutex.Unlock()
+	if existing != nil {
+		if existing.Status != statusValid {
+			return newProblem(http.StatusUnauthorized, "unauthorized",
+				"account is %s", existing.Status)
+		}
+		return s.writeAccount(w, http.StatusOK, existing)
+	}
+	if request.OnlyReturnExisting {
+		return newProblem(http.StatusBadRequest, "accountDoesNotExist",
+			"no account exists for this key")
+	}
+	keyID, p := s.verifyExternalAccountBinding(request.ExternalAccountBinding,
+		req.url, req.thumbprint)
+	if p != nil {
+		return p
+	}
+	id, err := randomID()
+	if err != nil {
+		return err
+	}
+	acct := &account{
+		ID:         id,
+		KeyID:      keyID,
+		Key:        *req.jwk,
+		Thumbprint: req.thumbprint,
+		Contact:    request.Contact,
+		Status:     statusValid,
+		Created:    time.Now(),
+	}
+	s.mutex.Lock()
+	if existing = s.findAccount(req.thumbprint); existing == nil {
+		s.accounts[id] = acct
+		if err = s.saveAccounts(); err != nil {
+			delete(s.accounts, id)
+		}
+	}
+	s.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return s.writeAccount(w, http.StatusOK, existing)
+	}
+	s.logger.Printf("registered ACME account %s for external account %s",
+		id, keyID)
+	return s.writeAccount(w, http.StatusCreated, acct)
+}
+
+func (s *Server) accountHandler(w http.ResponseWriter, req *request,
+	id string) error {
+	if strings.TrimSuffix(id, ordersSuffix) != req.account.ID {
+		return newProblem(http.StatusUnauthorized, "unauthorized",
+			"request not signed by this account")
+	}
+	if strings.HasSuffix(id, ordersSuffix) {
+		if err := checkPostAsGet(req); err != nil {
+			return err
+		}
+		return s.writeOrders(w, req.account)
+	}
+	if len(req.payload) < 1 {
+		return s.writeAccount(w, http.StatusOK, req.account)
+	}
+	var request accountRequest
+	if err := json.Unmarshal(req.payload, &request); err != nil {
+		return newProblem(http.StatusBadRequest, "malformed",
+			"cannot parse account request: %s", err)
+	}
+	if request.Status != "" && request.Status != statusValid &&
+		request.Status != statusDeactivated {
+		return newProblem(http.StatusBadRequest, "malformed",
+			"invalid account status: %s", request.Status)
+	}
+	s.mutex.Lock()
+	if request.Contact != nil {
+		req.account.Contact = request.Contact
+	}
+	if request.Status == statusDeactivated {
+		req.account.Status = statusDeactivated
+	}
+	err := s.saveAccounts()
+	s.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if request.Status == statusDeactivated {
+		s.logger.Printf("deactivated ACME account %s", req.account.ID)
+	}
+	return s.writeAccount(w, http.StatusOK, req.account)
+}
+
+func (s *Server) writeOrders(w http.ResponseWriter, acct *account) error {
+	now := time.Now()
+	object := ordersObject{Orders: []string{}}
+	s.mutex.Lock()
+	for _, o := range s.orders {
+		if o.accountID == acct.ID && now.Before(o.expires) {
+			object.Orders = append(object.Orders, s.baseURL+orderPath+o.id)
+		}
+	}
+	s.mutex.Unlock()
+	sort.Strings(object.Orders)
+	return writeJSON(w, http.StatusOK, "", object)
+}
+
+// writeOrder writes o. s.mutex must not be held.
+func (s *Server) writeOrder(w http.ResponseWriter, status int,
+	o *order) error {
+	object := orderObject{
+		Expires:  o.expires.UTC().Format(time.RFC3339),
+		Finalize: s.baseURL + finalizePath + o.id,
+	}
+	for index, name := range o.names {
+		object.Identifiers = append(object.Identifiers,
+			identifier{Type: "dns", Value: name})
+		object.Authorizations = append(object.Authorizations,
+			s.baseURL+authzPath+o.id+"-"+strconv.Itoa(index))
+	}
+	s.mutex.Lock()
+	object.Status = o.status
+	object.Error = o.err
+	if o.status == statusValid {
+		object.Certificate = s.baseURL + certPath + o.id
+	}
+	s.mutex.Unlock()
+	return writeJSON(w, status, s.baseURL+orderPath+o.id, object)
+}
+
+func (s *Server) newOrderHandler(w http.ResponseWriter, req *request,
+	id string) error {
+	var request orderRequest
+	if err := json.Unmarshal(req.payload, &request); err != nil {
+		return newProblem(http.StatusBadRequest, "malformed",
+			"cannot parse order: %s", err)
+	}
+	if request.NotBefore != "" || request.NotAfter != "" {
+		return newProblem(http.StatusBadRequest, "malformed",
+			"notBefore and notAfter are not supported")
+	}
+	names, p := s.checkNames(req.account.KeyID, request.Identifiers)
+	if p != nil {
+		return p
+	}
+	orderID, err := randomID()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	o := &order{
+		id:        orderID,
+		accountID: req.account.ID,
+		status:    statusReady,
+		expires:   now.Add(orderLifetime),
+		names:     names,
+	}
+	s.mutex.Lock()
+	for id, oldOrder := range s.orders {
+		if now.After(oldOrder.expires) {
+			delete(s.orders, id)
+		}
+	}
+	s.orders[orderID] = o
+	s.mutex.Unlock()
+	return s.writeOrder(w, http.StatusCreated, o)
+}
+
+// getOrder returns the unexpired order id of acct.
+func (s *Server) getOrder(id string, acct *account) (*order, error) {
+	s.mutex.Lock()
+	o, ok := s.orders[id]
+	s.mutex.Unlock()
+	if !ok || o.accountID != acct.ID || time.Now().After(o.expires) {
+		return nil, newProblem(http.StatusNotFound, "malformed",
+			"unknown order: %s", id)
+	}
+	return o, nil
+}
+
+func (s *Server) orderHandler(w http.ResponseWriter, req *request,
+	id string) error {
+	if err := checkPostAsGet(req); err != nil {
+		return err
+	}
+	o, err := s.getOrder(id, req.account)
+	if err != nil {
+		return err
+	}
+	return s.writeOrder(w, http.StatusOK, o)
+}
+
+func (s *Server) authzHandler(w http.ResponseWriter, req *request,
+	id string) error {
+	if err := checkPostAsGet(req); err != nil {
+		return err
+	}
+	separator := strings.LastIndexByte(id, '-')
+	if separator < 0 {
+		return newProblem(http.StatusNotFound, "malformed",
+			"unknown authorization: %s", id)
+	}
+	o, err := s.getOrder(id[:separator], req.account)
+	if err != nil {
+		return err
+	}
+	index, err := strconv.Atoi(id[separator+1:])
+	if err != nil || index < 0 || index >= len(o.names) {
+		return newProblem(http.StatusNotFound, "malformed",
+			"unknown authorization: %s", id)
+	}
+	return writeJSON(w, http.StatusOK, "", authorizationObject{
+		Identifier: identifier{Type: "dns", Value: o.names[index]},
+		Status:     statusValid,
+		Expires:    o.expires.UTC().Format(time.RFC3339),
+		Challenges: []json.RawMessage{},
+	})
+}
+
+// checkCSR returns a problem if csr does not request exactly names.
+func checkCSR(csr *x509.CertificateRequest, names []string) error {
+	if err := csr.CheckSignature(); err != nil {
+		return newProblem(http.StatusBadRequest, "badCSR",
+			"bad CSR signature: %s", err)
+	}
+	if len(csr.EmailAddresses) > 0 || len(csr.IPAddresses) > 0 ||
+		len(csr.URIs) > 0 {
+		return newProblem(http.StatusBadRequest, "badCSR",
+			"only DNS names may be requested")
+	}
+	if key, ok := csr.PublicKey.(*rsa.PublicKey); ok &&
+		key.N.BitLen() < minRSAKeyBits {
+		return newProblem(http.StatusBadRequest, "badCSR",
+			"RSA keys must have at least %d bits", minRSAKeyBits)
+	}
+	wanted := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		wanted[name] = struct{}{}
+	}
+	requested := make(map[string]struct{}, len(csr.DNSNames)+1)
+	for _, name := range csr.DNSNames {
+		requested[strings.ToLower(name)] = struct{}{}
+	}
+	if cn := csr.Subject.CommonName; cn != "" {
+		requested[strings.ToLower(cn)] = struct{}{}
+	}
+	if len(requested) != len(wanted) {
+		return newProblem(http.StatusBadRequest, "badCSR",
+			"CSR names do not match the order")
+	}
+	for name := range requested {
+		if _, ok := wanted[name]; !ok {
+			return newProblem(http.StatusBadRequest, "badCSR",
+				"CSR name %s is not in the order", name)
+		}
+	}
+	return nil
+}
+
+func (s *Server) finalizeHandler(w http.ResponseWriter, req *request,
+	id string) error {
+	o, err := s.getOrder(id, req.account)
+	if err != nil {
+		return err
+	}
+	var request finalizeRequest
+	if err := json.Unmarshal(req.payload, &request); err != nil {
+		return newProblem(http.StatusBadRequest, "malformed",
+			"cannot parse finalize request: %s", err)
+	}
+	derCSR, err := base64.RawURLEncoding.DecodeString(request.CSR)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "badCSR",
+			"cannot decode CSR: %s", err)
+	}
+	csr, err := x509.ParseCertificateRequest(derCSR)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "badCSR",
+			"cannot parse CSR: %s", err)
+	}
+	if err := checkCSR(csr, o.names); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	status := o.status
+	if status == statusReady {
+		o.status = statusProcessing
+	}
+	s.mutex.Unlock()
+	if status != statusReady {
+		return newProblem(http.StatusForbidden, "orderNotReady",
+			"order is %s", status)
+	}
+	certs, err := s.issuer.IssueHostCertificate(req.account.KeyID, o.names,
+		csr.PublicKey, s.config.CertDuration)
+	s.mutex.Lock()
+	if err != nil {
+		o.status = statusInvalid
+		o.err = newProblem(http.StatusInternalServerError, "serverInternal",
+			"cannot issue certificate")
+	} else {
+		o.status = statusValid
+		o.certificate = certs
+	}
+	s.mutex.Unlock()
+	if err != nil {
+		s.logger.Printf("cannot issue ACME certificate for %v: %s", o.names,
+			err)
+		return o.err
+	}
+	s.logger.Printf("issued ACME certificate for %v to external account %s",
+		o.names, req.account.KeyID)
+	return s.writeOrder(w, http.StatusOK, o)
+}
+
+func (s *Server) certHandler(w http.ResponseWriter, req *request,
+	id string) error {
+	if err := checkPostAsGet(req); err != nil {
+		return err
+	}
+	o, err := s.getOrder(id, req.account)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	certs := o.certificate
+	s.mutex.Unlock()
+	if len(certs) < 1 {
+		return newProblem(http.StatusNotFound, "malformed",
+			"order %s has no certificate", id)
+	}
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	for _, cert := range certs {
+		err := pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: cert})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,268 @@
+package acmeserver
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"gopkg.in/square/go-jose.v2"
+)
+
+const (
+	defaultCertDuration = 90 * 24 * time.Hour
+	minHMACKeyLength    = 16
+)
+
+type externalAccount struct {
+	hmacKey      []byte
+	allowedNames []string
+}
+
+// account is a registered ACME account, as stored in the accounts file.
+type account struct {
+	ID         string          `json:"id"`
+	KeyID      string          `json:"key_id"`
+	Key        jose.JSONWebKey `json:"key"`
+	Thumbprint string          `json:"thumbprint"`
+	Contact    []string        `json:"contact,omitempty"`
+	Status     string          `json:"status"`
+	Created    time.Time       `json:"created"`
+}
+
+type order struct {
+	id          string
+	accountID   string
+	status      string
+	expires     time.Time
+	names       []string
+	certificate [][]byte
+	err         *problem
+}
+
+// checkDNSName returns an error if name is not a lower case DNS name.
+func checkDNSName(name string) error {
+	if len(name) < 1 || len(name) > 253 {
+		return fmt.Errorf("invalid DNS name length: %d", len(name))
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) < 1 || len(label) > 63 {
+			return fmt.Errorf("invalid DNS name: %q", name)
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("invalid DNS name: %q", name)
+		}
+		for _, char := range label {
+			if (char < 'a' || char > 'z') && (char < '0' || char > '9') &&
+				char != '-' {
+				return fmt.Errorf("invalid DNS name: %q", name)
+			}
+		}
+	}
+	return nil
+}
+
+// inDomains returns true if name is one of domains or under one of them.
+func inDomains(name string, domains []string) bool {
+	for _, domain := range domains {
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// nameAllowed returns true if name matches one of patterns.
+func nameAllowed(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(name, pattern[1:]) {
+				return true
+			}
+		} else if name == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func checkConfig(config Config) (map[string]externalAccount, error) {
+	if len(config.AllowedDomains) < 1 {
+		return nil, errors.New("no allowed_domains")
+	}
+	for _, domain := range config.AllowedDomains {
+		if err := checkDNSName(domain); err != nil {
+			return nil, fmt.Errorf("allowed_domains: %s", err)
+		}
+	}
+	if config.CertDuration < 0 {
+		return nil, errors.New("negative cert_duration")
+	}
+	externalAccounts := make(map[string]externalAccount,
+		len(config.ExternalAccounts))
+	for _, ea := range config.ExternalAccounts {
+		if ea.KeyID == "" {
+			return nil, errors.New("external account with empty key_id")
+		}
+		if _, ok := externalAccounts[ea.KeyID]; ok {
+			return nil, fmt.Errorf("duplicate external account: %s", ea.KeyID)
+		}
+		hmacKey, err := base64.RawURLEncoding.DecodeString(
+			strings.TrimRight(ea.HMACKey, "="))
+		if err != nil {
+			return nil, fmt.Errorf("external account %s: bad hmac_key: %s",
+				ea.KeyID, err)
+		}
+		if len(hmacKey) < minHMACKeyLength {
+			return nil, fmt.Errorf(
+				"external account %s: hmac_key shorter than %d bytes",
+				ea.KeyID, minHMACKeyLength)
+		}
+		for _, pattern := range ea.AllowedNames {
+			name := strings.TrimPrefix(pattern, "*.")
+			if err := checkDNSName(name); err != nil {
+				return nil, fmt.Errorf("external account %s: %s", ea.KeyID, err)
+			}
+			if !inDomains(name, config.AllowedDomains) {
+				return nil, fmt.Errorf(
+					"external account %s: %s is not in allowed_domains",
+					ea.KeyID, pattern)
+			}
+		}
+		externalAccounts[ea.KeyID] = externalAccount{
+			hmacKey:      hmacKey,
+			allowedNames: ea.AllowedNames,
+		}
+	}
+	return externalAccounts, nil
+}
+
+func newServer(baseURL string, config Config, issuer Issuer,
+	logger log.DebugLogger) (*Server, error) {
+	externalAccounts, err := checkConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if config.AccountsFilename == "" {
+		return nil, errors.New("no accounts_filename")
+	}
+	if config.CertDuration == 0 {
+		config.CertDuration = defaultCertDuration
+	}
+	s := &Server{
+		baseURL:          strings.TrimRight(baseURL, "/"),
+		config:           config,
+		externalAccounts: externalAccounts,
+		issuer:           issuer,
+		logger:           logger,
+		accounts:         make(map[string]*account),
+		nonces:           make(map[string]time.Time),
+		orders:           make(map[string]*order),
+	}
+	if err := s.loadAccounts(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Server) loadAccounts() error {
+	data, err := ioutil.ReadFile(s.config.AccountsFilename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var accounts []*account
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		return fmt.Errorf("cannot parse %s: %s", s.config.AccountsFilename,
+			err)
+	}
+	for _, acct := range accounts {
+		s.accounts[acct.ID] = acct
+	}
+	s.logger.Debugf(0, "loaded %d ACME accounts", len(accounts))
+	return nil
+}
+
+// saveAccounts writes the accounts file. s.mutex must be held.
+func (s *Server) saveAccounts() error {
+	accounts := make([]*account, 0, len(s.accounts))
+	for _, acct := range s.accounts {
+		accounts = append(accounts, acct)
+	}
+	data, err := json.MarshalIndent(accounts, "", "    ")
+	if err != nil {
+		return err
+	}
+	filename := s.config.AccountsFilename
+	tmpFile, err := ioutil.TempFile(filepath.Dir(filename),
+		filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(append(data, '\n')); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), filename)
+}
+
+// checkNames returns the normalised names of identifiers, or a problem if
+// the external account keyID may not obtain them.
+func (s *Server) checkNames(keyID string, identifiers []identifier) (
+	[]string, *problem) {
+	ea, ok := s.externalAccounts[keyID]
+	if !ok {
+		return nil, newProblem(403, "unauthorized",
+			"external account %s no longer exists", keyID)
+	}
+	if len(identifiers) < 1 {
+		return nil, newProblem(400, "malformed", "no identifiers")
+	}
+	names := make([]string, 0, len(identifiers))
+	seen := make(map[string]struct{}, len(identifiers))
+	for _, id := range identifiers {
+		if id.Type != "dns" {
+			return nil, newProblem(400, "unsupportedIdentifier",
+				"unsupported identifier type: %s", id.Type)
+		}
+		name := strings.ToLower(strings.TrimSuffix(id.Value, "."))
+		if strings.HasPrefix(name, "*.") {
+			return nil, newProblem(400, "rejectedIdentifier",
+				"wildcard names are not issued: %s", id.Value)
+		}
+		if err := checkDNSName(name); err != nil {
+			return nil, newProblem(400, "rejectedIdentifier", "%s", err)
+		}
+		if !inDomains(name, s.config.AllowedDomains) ||
+			!nameAllowed(name, ea.allowedNames) {
+			return nil, newProblem(400, "rejectedIdentifier",
+				"%s may not be issued to external account %s", name, keyID)
+		}
+		if _, ok := seen[name]; !ok {
+			seen[name] = struct{}{}
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func randomID() (string, error) {
+	buffer := make([]byte, 16)
+	if _, err := rand.Read(buffer); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buffer), nil
+}
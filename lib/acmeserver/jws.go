@@ -0,0 +1,250 @@
+package acmeserver
+
+import (
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+const (
+	maxNonces      = 10000
+	maxRequestSize = 64 << 10
+	nonceLifetime  = time.Hour
+	problemPrefix  = "urn:ietf:params:acme:error:"
+)
+
+var (
+	accountKeyAlgorithms = map[string]struct{}{
+		string(jose.RS256): {},
+		string(jose.ES256): {},
+		string(jose.ES384): {},
+		string(jose.ES512): {},
+		string(jose.EdDSA): {},
+	}
+	macAlgorithms = map[string]struct{}{
+		string(jose.HS256): {},
+		string(jose.HS384): {},
+		string(jose.HS512): {},
+	}
+)
+
+// problem is an ACME error document (RFC 7807).
+type problem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+// request is a verified JWS request.
+type request struct {
+	url     string
+	payload []byte
+	account *account // Nil for new-account requests.
+	// jwk and its thumbprint are only set for new-account requests.
+	jwk        *jose.JSONWebKey
+	thumbprint string
+}
+
+func newProblem(status int, problemType string, format string,
+	args ...interface{}) *problem {
+	return &problem{
+		Type:   problemPrefix + problemType,
+		Detail: fmt.Sprintf(format, args...),
+		Status: status,
+	}
+}
+
+func (p *problem) Error() string {
+	return p.Detail
+}
+
+// newNonce returns a nonce to be used once in a later request.
+func (s *Server) newNonce() (string, error) {
+	nonce, err := randomID()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.nonces) >= maxNonces {
+		for oldNonce, expires := range s.nonces {
+			if now.After(expires) || len(s.nonces) >= maxNonces {
+				delete(s.nonces, oldNonce)
+			}
+		}
+	}
+	s.nonces[nonce] = now.Add(nonceLifetime)
+	return nonce, nil
+}
+
+// useNonce returns true if nonce was issued and not yet used.
+func (s *Server) useNonce(nonce string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	expires, ok := s.nonces[nonce]
+	if !ok {
+		return false
+	}
+	delete(s.nonces, nonce)
+	return time.Now().Before(expires)
+}
+
+// parseRequest verifies the JWS in the body of r. New account requests are
+// signed with the key in the jwk header, others by the key of the account
+// in the kid header.
+func (s *Server) parseRequest(r *http.Request, newAccount bool) (
+	*request, *problem) {
+	if r.Method != "POST" {
+		return nil, newProblem(http.StatusMethodNotAllowed, "malformed",
+			"method %s not allowed", r.Method)
+	}
+	if r.Header.Get("Content-Type") != "application/jose+json" {
+		return nil, newProblem(http.StatusUnsupportedMediaType, "malformed",
+			"content type must be application/jose+json")
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxRequestSize+1))
+	if err != nil {
+		return nil, newProblem(400, "malformed", "cannot read request: %s",
+			err)
+	}
+	if len(body) > maxRequestSize {
+		return nil, newProblem(400, "malformed", "request too large")
+	}
+	jws, err := jose.ParseSigned(string(body))
+	if err != nil {
+		return nil, newProblem(400, "malformed", "cannot parse JWS: %s", err)
+	}
+	if len(jws.Signatures) != 1 {
+		return nil, newProblem(400, "malformed", "JWS must have one signature")
+	}
+	header := jws.Signatures[0].Protected
+	if _, ok := accountKeyAlgorithms[header.Algorithm]; !ok {
+		return nil, newProblem(400, "badSignatureAlgorithm",
+			"unsupported signature algorithm: %s", header.Algorithm)
+	}
+	if !s.useNonce(header.Nonce) {
+		return nil, newProblem(400, "badNonce", "invalid or reused nonce")
+	}
+	req := &request{url: s.baseURL + r.URL.Path}
+	if url, _ := header.ExtraHeaders["url"].(string); url != req.url {
+		return nil, newProblem(401, "unauthorized",
+			"JWS url %q does not match request URL", url)
+	}
+	var key *jose.JSONWebKey
+	if newAccount {
+		if header.JSONWebKey == nil || header.KeyID != "" {
+			return nil, newProblem(400, "malformed",
+				"new account requests must have a jwk and no kid")
+		}
+		if !header.JSONWebKey.Valid() || !header.JSONWebKey.IsPublic() {
+			return nil, newProblem(400, "badPublicKey", "invalid account key")
+		}
+		key = header.JSONWebKey
+		req.jwk = key
+		if req.thumbprint, err = getThumbprint(key); err != nil {
+			return nil, newProblem(400, "badPublicKey",
+				"invalid account key: %s", err)
+		}
+	} else {
+		if header.JSONWebKey != nil || header.KeyID == "" {
+			return nil, newProblem(400, "malformed",
+				"requests must have a kid and no jwk")
+		}
+		acct, p := s.getAccount(header.KeyID)
+		if p != nil {
+			return nil, p
+		}
+		key = &acct.Key
+		req.account = acct
+	}
+	req.payload, err = jws.Verify(key)
+	if err != nil {
+		return nil, newProblem(400, "malformed", "bad JWS signature: %s", err)
+	}
+	return req, nil
+}
+
+// getAccount returns the valid account with the URL accountURL.
+func (s *Server) getAccount(accountURL string) (*account, *problem) {
+	prefix := s.baseURL + accountPath
+	if !strings.HasPrefix(accountURL, prefix) {
+		return nil, newProblem(400, "accountDoesNotExist",
+			"unknown account: %s", accountURL)
+	}
+	s.mutex.Lock()
+	acct, ok := s.accounts[strings.TrimPrefix(accountURL, prefix)]
+	s.mutex.Unlock()
+	if !ok {
+		return nil, newProblem(400, "accountDoesNotExist",
+			"unknown account: %s", accountURL)
+	}
+	if acct.Status != statusValid {
+		return nil, newProblem(401, "unauthorized", "account is %s",
+			acct.Status)
+	}
+	return acct, nil
+}
+
+// verifyExternalAccountBinding returns the key ID of the external account
+// binding eab of a request to register the key with the thumbprint
+// thumbprint.
+func (s *Server) verifyExternalAccountBinding(eab json.RawMessage,
+	url string, thumbprint string) (string, *problem) {
+	if len(eab) < 1 {
+		return "", newProblem(400, "externalAccountRequired",
+			"an external account binding is required")
+	}
+	jws, err := jose.ParseSigned(string(eab))
+	if err != nil || len(jws.Signatures) != 1 {
+		return "", newProblem(400, "malformed",
+			"cannot parse external account binding")
+	}
+	header := jws.Signatures[0].Protected
+	if _, ok := macAlgorithms[header.Algorithm]; !ok {
+		return "", newProblem(400, "badSignatureAlgorithm",
+			"unsupported external account binding algorithm: %s",
+			header.Algorithm)
+	}
+	if ebURL, _ := header.ExtraHeaders["url"].(string); ebURL != url {
+		return "", newProblem(401, "unauthorized",
+			"external account binding url does not match request URL")
+	}
+	ea, ok := s.externalAccounts[header.KeyID]
+	if !ok || header.Nonce != "" {
+		return "", newProblem(401, "unauthorized",
+			"invalid external account binding")
+	}
+	payload, err := jws.Verify(ea.hmacKey)
+	if err != nil {
+		return "", newProblem(401, "unauthorized",
+			"invalid external account binding")
+	}
+	var boundKey jose.JSONWebKey
+	if err := json.Unmarshal(payload, &boundKey); err != nil {
+		return "", newProblem(400, "malformed",
+			"cannot parse external account binding key")
+	}
+	if boundThumbprint, err := getThumbprint(&boundKey); err != nil ||
+		boundThumbprint != thumbprint {
+		return "", newProblem(401, "unauthorized",
+			"external account binding is for a different key")
+	}
+	return header.KeyID, nil
+}
+
+func getThumbprint(jwk *jose.JSONWebKey) (string, error) {
+	thumbprint, err := jwk.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(thumbprint), nil
+}
@@ -0,0 +1,100 @@
+// Package auditlog writes audit events as JSON objects to files, syslog and
+// HTTP webhooks. Each sink selects the events it receives.
+package auditlog
+
+import (
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+)
+
+// Event types.
+const (
+	EventTypeLogin        = "login"
+	EventTypeSecondFactor = "2fa"
+	EventTypeIssue        = "issue"
+	EventTypeRevoke       = "revoke"
+	EventTypeAdmin        = "admin"
+	// EventTypeRecoveryCodes records the generation of recovery codes.
+	EventTypeRecoveryCodes = "recovery_codes"
+	// EventTypeLockout records a username or source address locked out
+	// after failed attempts.
+	EventTypeLockout = "lockout"
+	// EventTypePasswordChange records a user changing their password.
+	EventTypePasswordChange = "password_change"
+	// EventTypeDevice records the registration of a new client device.
+	EventTypeDevice = "device"
+	// EventTypeLoginAnomaly records a login from a new country or an
+	// impossible distance from the previous login.
+	EventTypeLoginAnomaly = "login_anomaly"
+	// EventTypeEnrollment records the registration of a second factor: a
+	// U2F or WebAuthn security key or a TOTP device.
+	EventTypeEnrollment = "enrollment"
+	// EventTypeCertApproval records a certificate request which needs an
+	// approval, and its approval, denial and use.
+	EventTypeCertApproval = "cert_approval"
+	// EventTypeBreakGlass records the votes for, the start and the end of
+	// emergency issuance, and the logins of emergency accounts.
+	EventTypeBreakGlass = "break_glass"
+)
+
+// Event is one audit event.
+type Event struct {
+	// Time is set by Log if it is zero.
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+	// Username is the user the event is about. For admin and revoke events
+	// it is the admin.
+	Username string `json:"username"`
+	// Success is false for failed logins, second factor checks and actions.
+	Success bool `json:"success"`
+	// Method is the authentication method of login and 2fa events, the
+	// certificate type of issue and revoke events and the action of admin
+	// events.
+	Method     string `json:"method,omitempty"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	// Details holds values specific to the event, such as the serial number
+	// of a certificate or an error message.
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// SinkConfig configures one destination of events.
+type SinkConfig struct {
+	// Type is "file", "syslog" or "webhook".
+	Type string `yaml:"type"`
+	// Filename is the file a file sink appends events to, one per line.
+	Filename string `yaml:"filename"`
+	// SyslogTag is the tag of a syslog sink, "keymaster" by default. Events
+	// are sent to the local syslog daemon with the auth facility.
+	SyslogTag string `yaml:"syslog_tag"`
+	// URL receives each event of a webhook sink in a POST request.
+	URL string `yaml:"url"`
+	// EventTypes selects the events of the sink by type. All events are
+	// selected if it is empty.
+	EventTypes []string `yaml:"event_types"`
+	// If FailuresOnly is true only unsuccessful events are selected.
+	FailuresOnly bool `yaml:"failures_only"`
+}
+
+// Logger writes events to its sinks.
+type Logger struct {
+	logger log.DebugLogger
+	sinks  []*sink
+}
+
+// New creates a Logger writing to the sinks in configs. Errors writing
+// events are logged to logger.
+func New(configs []SinkConfig, logger log.DebugLogger) (*Logger, error) {
+	return newLogger(configs, logger)
+}
+
+// Log writes event to the sinks which select it. Webhooks are called in the
+// background, so Log does not wait for them. A nil Logger discards events.
+func (l *Logger) Log(event Event) {
+	l.log(event)
+}
+
+// Close closes the sinks. Queued webhook calls are made first.
+func (l *Logger) Close() error {
+	return l.close()
+}
@@ -0,0 +1,150 @@
+package auditlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log/testlogger"
+)
+
+var testEvents = []Event{
+	{Type: EventTypeLogin, Username: "alice", Success: true,
+		Method: "password"},
+	{Type: EventTypeSecondFactor, Username: "alice", Method: "TOTP"},
+	{Type: EventTypeIssue, Username: "alice", Success: true, Method: "ssh",
+		Details: map[string]string{"serial": "1"}},
+	{Type: EventTypeAdmin, Username: "admin", Success: true,
+		Method: "reset-tokens"},
+}
+
+func readEvents(t *testing.T, filename string) []Event {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []Event
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	for decoder.More() {
+		var event Event
+		if err := decoder.Decode(&event); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestFileSinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auditlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	allFilename := filepath.Join(dir, "all.log")
+	authFilename := filepath.Join(dir, "auth.log")
+	failuresFilename := filepath.Join(dir, "failures.log")
+	l, err := New([]SinkConfig{
+		{Type: "file", Filename: allFilename},
+		{Type: "file", Filename: authFilename,
+			EventTypes: []string{EventTypeLogin, EventTypeSecondFactor}},
+		{Type: "file", Filename: failuresFilename, FailuresOnly: true},
+	}, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range testEvents {
+		l.Log(event)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if events := readEvents(t, allFilename); len(events) != len(testEvents) {
+		t.Fatalf("expected %d events, got %d", len(testEvents), len(events))
+	} else if events[0].Time.IsZero() {
+		t.Fatal("event time not set")
+	} else if events[2].Details["serial"] != "1" {
+		t.Fatalf("unexpected details: %v", events[2].Details)
+	}
+	events := readEvents(t, authFilename)
+	if len(events) != 2 || events[0].Type != EventTypeLogin ||
+		events[1].Type != EventTypeSecondFactor {
+		t.Fatalf("unexpected auth events: %+v", events)
+	}
+	events = readEvents(t, failuresFilename)
+	if len(events) != 1 || events[0].Success {
+		t.Fatalf("unexpected failure events: %+v", events)
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	received := make(chan Event, len(testEvents))
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			var event Event
+			if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+				t.Error(err)
+			}
+			received <- event
+		}))
+	defer server.Close()
+	l, err := New([]SinkConfig{{Type: "webhook", URL: server.URL,
+		EventTypes: []string{EventTypeAdmin}}}, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range testEvents {
+		l.Log(event)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	close(received)
+	var events []Event
+	for event := range received {
+		events = append(events, event)
+	}
+	if len(events) != 1 || events[0].Method != "reset-tokens" {
+		t.Fatalf("unexpected webhook events: %+v", events)
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	for _, config := range []SinkConfig{
+		{Type: "file"},
+		{Type: "webhook", URL: "ftp://example.com/"},
+		{Type: "email"},
+		{Type: "file", Filename: os.DevNull, EventTypes: []string{"logout"}},
+	} {
+		if _, err := New([]SinkConfig{config}, testlogger.New(t)); err == nil {
+			t.Fatalf("%+v should fail", config)
+		}
+	}
+}
+
+func TestAllEventTypesSelectable(t *testing.T) {
+	for _, eventType := range []string{EventTypeLogin, EventTypeSecondFactor,
+		EventTypeIssue, EventTypeRevoke, EventTypeAdmin,
+		EventTypeRecoveryCodes, EventTypeLockout, EventTypePasswordChange,
+		EventTypeDevice, EventTypeLoginAnomaly, EventTypeEnrollment} {
+		l, err := New([]SinkConfig{{Type: "file", Filename: os.DevNull,
+			EventTypes: []string{eventType}}}, testlogger.New(t))
+		if err != nil {
+			t.Fatalf("%s: %s", eventType, err)
+		}
+		l.Close()
+	}
+}
+
+func TestNilLogger(t *testing.T) {
+	var l *Logger
+	l.Log(testEvents[0])
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,265 @@
+package auditlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/syslog"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+)
+
+const (
+	defaultSyslogTag = "keymaster"
+	webhookQueueSize = 1024
+	webhookTimeout   = 10 * time.Second
+)
+
+var eventTypes = map[string]struct{}{
+	EventTypeLogin:          {},
+	EventTypeSecondFactor:   {},
+	EventTypeIssue:          {},
+	EventTypeRevoke:         {},
+	EventTypeAdmin:          {},
+	EventTypeRecoveryCodes:  {},
+	EventTypeLockout:        {},
+	EventTypePasswordChange: {},
+	EventTypeDevice:         {},
+	EventTypeLoginAnomaly:   {},
+	EventTypeEnrollment:     {},
+	EventTypeCertApproval:   {},
+	EventTypeBreakGlass:     {},
+}
+
+type sinkWriter interface {
+	write(event Event, data []byte) error
+	close() error
+}
+
+type sink struct {
+	name         string
+	eventTypes   map[string]struct{} // Empty means all.
+	failuresOnly bool
+	writer       sinkWriter
+}
+
+type fileWriter struct {
+	mutex sync.Mutex // Protect file.
+	file  *os.File
+}
+
+type syslogWriter struct {
+	writer *syslog.Writer
+}
+
+type webhookWriter struct {
+	url    string
+	client *http.Client
+	logger log.DebugLogger
+	queue  chan []byte
+	done   chan struct{}
+}
+
+func newLogger(configs []SinkConfig, logger log.DebugLogger) (*Logger, error) {
+	l := &Logger{logger: logger}
+	for index, config := range configs {
+		s, err := newSink(config, logger)
+		if err != nil {
+			l.close()
+			return nil, fmt.Errorf("audit log sink %d: %s", index, err)
+		}
+		l.sinks = append(l.sinks, s)
+	}
+	return l, nil
+}
+
+func newSink(config SinkConfig, logger log.DebugLogger) (*sink, error) {
+	s := &sink{
+		eventTypes:   make(map[string]struct{}, len(config.EventTypes)),
+		failuresOnly: config.FailuresOnly,
+	}
+	for _, eventType := range config.EventTypes {
+		if _, ok := eventTypes[eventType]; !ok {
+			return nil, fmt.Errorf("unknown event type: %s", eventType)
+		}
+		s.eventTypes[eventType] = struct{}{}
+	}
+	var err error
+	switch config.Type {
+	case "file":
+		s.name = config.Filename
+		s.writer, err = newFileWriter(config.Filename)
+	case "syslog":
+		s.name = "syslog"
+		s.writer, err = newSyslogWriter(config.SyslogTag)
+	case "webhook":
+		s.name = config.URL
+		s.writer, err = newWebhookWriter(config.URL, logger)
+	default:
+		err = fmt.Errorf("unknown sink type: %q", config.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *sink) selects(event Event) bool {
+	if s.failuresOnly && event.Success {
+		return false
+	}
+	if len(s.eventTypes) < 1 {
+		return true
+	}
+	_, ok := s.eventTypes[event.Type]
+	return ok
+}
+
+func (l *Logger) log(event Event) {
+	if l == nil || len(l.sinks) < 1 {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		l.logger.Printf("cannot encode audit event: %s", err)
+		return
+	}
+	for _, s := range l.sinks {
+		if !s.selects(event) {
+			continue
+		}
+		if err := s.writer.write(event, data); err != nil {
+			l.logger.Printf("cannot write audit event to %s: %s", s.name,
+				err)
+		}
+	}
+}
+
+func (l *Logger) close() error {
+	if l == nil {
+		return nil
+	}
+	var firstErr error
+	for _, s := range l.sinks {
+		if err := s.writer.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func newFileWriter(filename string) (*fileWriter, error) {
+	if filename == "" {
+		return nil, errors.New("missing filename")
+	}
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+		0600)
+	if err != nil {
+		return nil, err
+	}
+	return &fileWriter{file: file}, nil
+}
+
+func (w *fileWriter) write(event Event, data []byte) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	_, err := w.file.Write(append(data, '\n'))
+	return err
+}
+
+func (w *fileWriter) close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.file.Close()
+}
+
+func newSyslogWriter(tag string) (*syslogWriter, error) {
+	if tag == "" {
+		tag = defaultSyslogTag
+	}
+	writer, err := syslog.New(syslog.LOG_AUTH|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogWriter{writer: writer}, nil
+}
+
+// write sends unsuccessful events with the warning severity.
+func (w *syslogWriter) write(event Event, data []byte) error {
+	if event.Success {
+		return w.writer.Info(string(data))
+	}
+	return w.writer.Warning(string(data))
+}
+
+func (w *syslogWriter) close() error {
+	return w.writer.Close()
+}
+
+func newWebhookWriter(rawURL string, logger log.DebugLogger) (
+	*webhookWriter, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("webhook URL must be http or https: %s", rawURL)
+	}
+	w := &webhookWriter{
+		url:    rawURL,
+		client: &http.Client{Timeout: webhookTimeout},
+		logger: logger,
+		queue:  make(chan []byte, webhookQueueSize),
+		done:   make(chan struct{}),
+	}
+	go w.loop()
+	return w, nil
+}
+
+// write queues data for the webhook. If the webhook is too slow to keep up
+// the event is dropped rather than delaying the caller.
+func (w *webhookWriter) write(event Event, data []byte) error {
+	select {
+	case w.queue <- data:
+		return nil
+	default:
+		return errors.New("webhook queue is full, event dropped")
+	}
+}
+
+func (w *webhookWriter) close() error {
+	close(w.queue)
+	<-w.done
+	return nil
+}
+
+func (w *webhookWriter) loop() {
+	defer close(w.done)
+	for data := range w.queue {
+		if err := w.post(data); err != nil {
+			w.logger.Printf("cannot send audit event to %s: %s", w.url, err)
+		}
+	}
+}
+
+func (w *webhookWriter) post(data []byte) error {
+	resp, err := w.client.Post(w.url, "application/json",
+		bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+// Package cloudidentity verifies the identity credentials which cloud
+// providers give to their instances: AWS EC2 instance identity documents,
+// GCP instance identity tokens and Azure attested data. Automation running
+// on cloud instances can so authenticate without static secrets.
+package cloudidentity
+
+import (
+	"crypto/x509"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// Provider names.
+const (
+	ProviderAWS   = "aws"
+	ProviderGCP   = "gcp"
+	ProviderAzure = "azure"
+)
+
+// Config describes how credentials are verified. Only the providers which
+// are configured are accepted.
+type Config struct {
+	// AWSCertificateFilename holds the PEM encoded AWS certificates of the
+	// regions used, which verify the RSA signatures of instance identity
+	// documents (/latest/dynamic/instance-identity/signature).
+	AWSCertificateFilename string
+	// AWS instances must also send a GetCallerIdentity request for one of
+	// AWSAudiences signed with the credentials of their role, which proves
+	// that the credential is fresh. AWSSTSURL is where it is sent, by
+	// default https://sts.amazonaws.com/.
+	AWSAudiences []string
+	AWSSTSURL    string
+	// GCPAudiences are the accepted audiences of GCP identity tokens. Tokens
+	// must be requested in the full format.
+	GCPAudiences []string
+	// GCPCertsURL is the key set of the Google token signing keys. The
+	// default is https://www.googleapis.com/oauth2/v3/certs.
+	GCPCertsURL string
+	// If AzureEnabled is true Azure attested data is accepted. It must be
+	// signed by a certificate for metadata.azure.com (or a subdomain) which
+	// chains to one in AzureRootCAFilename, or to the system roots if it is
+	// empty. AzureIntermediateCAFilename may hold the intermediate
+	// certificates, which are not included in the attested data.
+	AzureEnabled                bool
+	AzureRootCAFilename         string
+	AzureIntermediateCAFilename string
+	// MaxAzureNonceAge is how old the Unix time used as nonce of attested
+	// data may be, 5 minutes by default.
+	MaxAzureNonceAge time.Duration
+}
+
+// Credential is the identity credential of an instance.
+type Credential struct {
+	Provider string
+	// Document is the AWS instance identity document.
+	Document string
+	// Signature is the signature of the AWS instance identity document or
+	// the base64 encoded PKCS #7 signature of the Azure attested data.
+	Signature string
+	// STSRequest is the JSON encoded AWS STS GetCallerIdentity request of
+	// the instance role (a proto.AWSSTSRequest).
+	STSRequest string
+	// Token is the GCP identity token.
+	Token string
+}
+
+// Identity is an authenticated instance.
+type Identity struct {
+	Provider string
+	// Account is the AWS account ID, the GCP project ID or the Azure
+	// subscription ID.
+	Account    string
+	InstanceID string
+	// Region is the AWS region or the GCP zone. It is empty for Azure.
+	Region string
+	// ServiceAccount is the email address of the GCP service account. It is
+	// empty for other providers.
+	ServiceAccount string
+}
+
+// Authenticator verifies credentials.
+type Authenticator struct {
+	config            Config
+	logger            log.DebugLogger
+	httpClient        *http.Client
+	awsCerts          []*x509.Certificate
+	azureRoots        *x509.CertPool
+	azureIntermediate *x509.CertPool
+	mutex             sync.Mutex // Protect everything below.
+	gcpKeys           jose.JSONWebKeySet
+	gcpKeysFetchedAt  time.Time
+}
+
+// New creates an Authenticator, reading the certificate files in config.
+func New(config Config, logger log.DebugLogger) (*Authenticator, error) {
+	return newAuthenticator(config, logger)
+}
+
+// Authenticate verifies credential and returns the identity of the instance.
+func (a *Authenticator) Authenticate(credential Credential) (
+	*Identity, error) {
+	return a.authenticate(credential, time.Now())
+}
@@ -0,0 +1,211 @@
+package cloudidentity
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	awsAmzDateFormat    = "20060102T150405Z"
+	awsAudienceHeader   = "X-Keymaster-Audience"
+	awsSTSBody          = "Action=GetCallerIdentity&Version=2011-06-15"
+	maxAWSRequestAge    = 5 * time.Minute
+	maxAWSRequestFuture = time.Minute
+)
+
+// The headers of STS requests which are passed on to STS.
+var awsSTSHeaders = []string{"Authorization", "Content-Type", "X-Amz-Date",
+	"X-Amz-Security-Token", awsAudienceHeader}
+
+type awsIdentityDocument struct {
+	AccountID  string `json:"accountId"`
+	InstanceID string `json:"instanceId"`
+	Region     string `json:"region"`
+}
+
+// awsSTSRequest is the JSON encoding of proto.AWSSTSRequest.
+type awsSTSRequest struct {
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+}
+
+type awsGetCallerIdentityResponse struct {
+	Arn     string `xml:"GetCallerIdentityResult>Arn"`
+	Account string `xml:"GetCallerIdentityResult>Account"`
+}
+
+// verifyAWSDocument verifies the RSA SHA-256 signature of the instance
+// identity document of credential and returns the document.
+func (a *Authenticator) verifyAWSDocument(credential Credential) (
+	*awsIdentityDocument, error) {
+	signature, err := base64.StdEncoding.DecodeString(
+		strings.Join(strings.Fields(credential.Signature), ""))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode identity signature: %s", err)
+	}
+	digest := sha256.Sum256([]byte(credential.Document))
+	verified := false
+	for _, cert := range a.awsCerts {
+		pub, ok := cert.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			continue
+		}
+		err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature)
+		if err == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("invalid identity document signature")
+	}
+	var document awsIdentityDocument
+	if err := json.Unmarshal([]byte(credential.Document), &document); err != nil {
+		return nil, fmt.Errorf("cannot parse identity document: %s", err)
+	}
+	if document.AccountID == "" || document.InstanceID == "" ||
+		document.Region == "" {
+		return nil, errors.New("incomplete identity document")
+	}
+	return &document, nil
+}
+
+// checkAWSSTSRequest returns an error if request is not a recent
+// GetCallerIdentity request signed for one of the audiences.
+func (a *Authenticator) checkAWSSTSRequest(request *awsSTSRequest,
+	now time.Time) error {
+	if request.Body != awsSTSBody {
+		return errors.New("STS request is not GetCallerIdentity")
+	}
+	authorization := request.Headers["Authorization"]
+	if !strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 ") {
+		return errors.New("STS request is not signed")
+	}
+	var signedHeaders []string
+	for _, field := range strings.Split(authorization, ",") {
+		field = strings.TrimSpace(field)
+		if strings.HasPrefix(field, "SignedHeaders=") {
+			signedHeaders = strings.Split(
+				strings.TrimPrefix(field, "SignedHeaders="), ";")
+		}
+	}
+	signed := false
+	for _, name := range signedHeaders {
+		if name == strings.ToLower(awsAudienceHeader) {
+			signed = true
+		}
+	}
+	if !signed {
+		return errors.New("STS request audience is not signed")
+	}
+	audience := request.Headers[awsAudienceHeader]
+	audienceValid := false
+	for _, allowed := range a.config.AWSAudiences {
+		if audience == allowed {
+			audienceValid = true
+			break
+		}
+	}
+	if !audienceValid {
+		return fmt.Errorf("STS request audience %q is not allowed", audience)
+	}
+	signedAt, err := time.Parse(awsAmzDateFormat, request.Headers["X-Amz-Date"])
+	if err != nil {
+		return fmt.Errorf("cannot parse STS request date: %s", err)
+	}
+	if signedAt.Before(now.Add(-maxAWSRequestAge)) ||
+		signedAt.After(now.Add(maxAWSRequestFuture)) {
+		return fmt.Errorf("STS request signed at %s is not recent", signedAt)
+	}
+	return nil
+}
+
+// getAWSCallerArn sends request to STS and returns the ARN and account of
+// the caller which signed it.
+func (a *Authenticator) getAWSCallerArn(request *awsSTSRequest) (
+	string, string, error) {
+	req, err := http.NewRequest("POST", a.config.AWSSTSURL,
+		strings.NewReader(request.Body))
+	if err != nil {
+		return "", "", err
+	}
+	for _, name := range awsSTSHeaders {
+		if value, ok := request.Headers[name]; ok {
+			req.Header.Set(name, value)
+		}
+	}
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body,
+		maxResponseBodyLength))
+	if err != nil {
+		return "", "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("STS denied GetCallerIdentity: %s",
+			resp.Status)
+	}
+	var response awsGetCallerIdentityResponse
+	if err := xml.Unmarshal(body, &response); err != nil {
+		return "", "", fmt.Errorf("cannot parse STS response: %s", err)
+	}
+	return response.Arn, response.Account, nil
+}
+
+// authenticateAWS verifies the RSA SHA-256 signature of the instance
+// identity document, which never changes, and that the credentials of the
+// role of the same instance recently signed the STS request.
+func (a *Authenticator) authenticateAWS(credential Credential,
+	now time.Time) (*Identity, error) {
+	document, err := a.verifyAWSDocument(credential)
+	if err != nil {
+		return nil, err
+	}
+	if credential.STSRequest == "" {
+		return nil, errors.New("missing STS request")
+	}
+	var request awsSTSRequest
+	if err := json.Unmarshal([]byte(credential.STSRequest), &request); err != nil {
+		return nil, fmt.Errorf("cannot parse STS request: %s", err)
+	}
+	if err := a.checkAWSSTSRequest(&request, now); err != nil {
+		return nil, err
+	}
+	arn, account, err := a.getAWSCallerArn(&request)
+	if err != nil {
+		return nil, err
+	}
+	// Instance roles are assumed with the instance ID as session name:
+	// arn:aws:sts::<account>:assumed-role/<role>/<instance ID>
+	fields := strings.Split(arn, ":")
+	if len(fields) != 6 || fields[0] != "arn" || fields[2] != "sts" {
+		return nil, fmt.Errorf("unexpected caller ARN %s", arn)
+	}
+	resource := strings.Split(fields[5], "/")
+	if account != document.AccountID || fields[4] != document.AccountID ||
+		len(resource) != 3 || resource[0] != "assumed-role" ||
+		resource[2] != document.InstanceID {
+		return nil, fmt.Errorf("caller %s is not instance %s of %s", arn,
+			document.InstanceID, document.AccountID)
+	}
+	return &Identity{
+		Provider:   ProviderAWS,
+		Account:    document.AccountID,
+		InstanceID: document.InstanceID,
+		Region:     document.Region,
+	}, nil
+}
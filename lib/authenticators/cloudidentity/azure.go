@@ -0,0 +1,285 @@
+package cloudidentity
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	azureMetadataName   = "metadata.azure.com"
+	azureTimeStampForm  = "01/02/06 15:04:05 -0700"
+	maxAzureNonceFuture = time.Minute
+)
+
+var (
+	oidData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidRSAEncryption = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidSHA256WithRSA = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidSHA384WithRSA = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}
+	oidSHA512WithRSA = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}
+	digestAlgorithms = map[string]crypto.Hash{
+		"2.16.840.1.101.3.4.2.1": crypto.SHA256,
+		"2.16.840.1.101.3.4.2.2": crypto.SHA384,
+		"2.16.840.1.101.3.4.2.3": crypto.SHA512,
+	}
+)
+
+// The PKCS #7 (RFC 2315) structures of signed data.
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      contentInfo
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+type issuerAndSerialNumber struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type signerInfo struct {
+	Version                   int
+	IssuerAndSerialNumber     issuerAndSerialNumber
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	AuthenticatedAttributes   asn1.RawValue `asn1:"optional,tag:0"`
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+	UnauthenticatedAttributes asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue `asn1:"set"`
+}
+
+type azureAttestedData struct {
+	Nonce     string `json:"nonce"`
+	TimeStamp struct {
+		CreatedOn string `json:"createdOn"`
+		ExpiresOn string `json:"expiresOn"`
+	} `json:"timeStamp"`
+	VMID           string `json:"vmId"`
+	SubscriptionID string `json:"subscriptionId"`
+}
+
+// getAttributeValue returns the single value of the attribute oid.
+func getAttributeValue(attributes []attribute, oid asn1.ObjectIdentifier,
+	value interface{}) error {
+	for _, attr := range attributes {
+		if !attr.Type.Equal(oid) {
+			continue
+		}
+		rest, err := asn1.Unmarshal(attr.Values.Bytes, value)
+		if err != nil {
+			return err
+		}
+		if len(rest) > 0 {
+			return fmt.Errorf("attribute %s has more than one value", oid)
+		}
+		return nil
+	}
+	return fmt.Errorf("no attribute %s", oid)
+}
+
+// verifySignedData verifies the single signature of the PKCS #7 signed data
+// in der and returns the content and the certificate which signed it.
+func verifySignedData(der []byte) ([]byte, *x509.Certificate,
+	[]*x509.Certificate, error) {
+	var outer contentInfo
+	if rest, err := asn1.Unmarshal(der, &outer); err != nil {
+		return nil, nil, nil, err
+	} else if len(rest) > 0 {
+		return nil, nil, nil, errors.New("trailing data after signed data")
+	}
+	if !outer.ContentType.Equal(oidSignedData) {
+		return nil, nil, nil, errors.New("not PKCS #7 signed data")
+	}
+	var sd signedData
+	if _, err := asn1.Unmarshal(outer.Content.Bytes, &sd); err != nil {
+		return nil, nil, nil, err
+	}
+	if !sd.ContentInfo.ContentType.Equal(oidData) {
+		return nil, nil, nil, errors.New("signed content is not data")
+	}
+	var content []byte
+	_, err := asn1.Unmarshal(sd.ContentInfo.Content.Bytes, &content)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("cannot decode content: %s", err)
+	}
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(sd.SignerInfos) != 1 {
+		return nil, nil, nil, errors.New("signed data must have one signer")
+	}
+	signer := sd.SignerInfos[0]
+	var signerCert *x509.Certificate
+	for _, cert := range certs {
+		if bytes.Equal(cert.RawIssuer, signer.IssuerAndSerialNumber.Issuer.FullBytes) &&
+			cert.SerialNumber.Cmp(signer.IssuerAndSerialNumber.SerialNumber) == 0 {
+			signerCert = cert
+			break
+		}
+	}
+	if signerCert == nil {
+		return nil, nil, nil, errors.New("no certificate of the signer")
+	}
+	hash, ok := digestAlgorithms[signer.DigestAlgorithm.Algorithm.String()]
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("digest algorithm %s is not allowed",
+			signer.DigestAlgorithm.Algorithm)
+	}
+	switch algorithm := signer.DigestEncryptionAlgorithm.Algorithm; {
+	case algorithm.Equal(oidRSAEncryption), algorithm.Equal(oidSHA256WithRSA),
+		algorithm.Equal(oidSHA384WithRSA), algorithm.Equal(oidSHA512WithRSA):
+	default:
+		return nil, nil, nil, fmt.Errorf(
+			"signature algorithm %s is not allowed", algorithm)
+	}
+	pub, ok := signerCert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, nil, nil, errors.New("signer key is not an RSA key")
+	}
+	h := hash.New()
+	h.Write(content)
+	contentDigest := h.Sum(nil)
+	signed := contentDigest
+	if len(signer.AuthenticatedAttributes.FullBytes) > 0 {
+		// The signature covers the DER encoding of the attributes as a SET
+		// rather than with the implicit tag.
+		attributesDER := append([]byte{}, signer.AuthenticatedAttributes.FullBytes...)
+		attributesDER[0] = 0x31
+		var attributes []attribute
+		_, err := asn1.UnmarshalWithParams(attributesDER, &attributes, "set")
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		var contentType asn1.ObjectIdentifier
+		if err := getAttributeValue(attributes, oidContentType,
+			&contentType); err != nil {
+			return nil, nil, nil, err
+		}
+		if !contentType.Equal(oidData) {
+			return nil, nil, nil, errors.New("content type attribute mismatch")
+		}
+		var messageDigest []byte
+		if err := getAttributeValue(attributes, oidMessageDigest,
+			&messageDigest); err != nil {
+			return nil, nil, nil, err
+		}
+		if !bytes.Equal(messageDigest, contentDigest) {
+			return nil, nil, nil, errors.New("message digest mismatch")
+		}
+		h := hash.New()
+		h.Write(attributesDER)
+		signed = h.Sum(nil)
+	}
+	err = rsa.VerifyPKCS1v15(pub, hash, signed, signer.EncryptedDigest)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid signature: %s", err)
+	}
+	return content, signerCert, certs, nil
+}
+
+func (a *Authenticator) verifyAzureSigner(cert *x509.Certificate,
+	certs []*x509.Certificate, now time.Time) error {
+	intermediates := x509.NewCertPool()
+	if a.azureIntermediate != nil {
+		intermediates = a.azureIntermediate.Clone()
+	}
+	for _, c := range certs {
+		if c != cert {
+			intermediates.AddCert(c)
+		}
+	}
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:         a.azureRoots,
+		Intermediates: intermediates,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return err
+	}
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	for _, name := range names {
+		if name == azureMetadataName ||
+			strings.HasSuffix(name, "."+azureMetadataName) {
+			return nil
+		}
+	}
+	return fmt.Errorf("attested data signed by %s", cert.Subject)
+}
+
+// authenticateAzure verifies attested data (of the IMDS
+// /metadata/attested/document endpoint). Its nonce must be a recent Unix
+// time, which limits replays.
+func (a *Authenticator) authenticateAzure(credential Credential,
+	now time.Time) (*Identity, error) {
+	der, err := base64.StdEncoding.DecodeString(
+		strings.Join(strings.Fields(credential.Signature), ""))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode attested data: %s", err)
+	}
+	content, signerCert, certs, err := verifySignedData(der)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.verifyAzureSigner(signerCert, certs, now); err != nil {
+		return nil, err
+	}
+	var data azureAttestedData
+	if err := json.Unmarshal(content, &data); err != nil {
+		return nil, fmt.Errorf("cannot parse attested data: %s", err)
+	}
+	if data.SubscriptionID == "" || data.VMID == "" {
+		return nil, errors.New("incomplete attested data")
+	}
+	expiresOn, err := time.Parse(azureTimeStampForm, data.TimeStamp.ExpiresOn)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse expiry: %s", err)
+	}
+	if now.After(expiresOn) {
+		return nil, fmt.Errorf("attested data expired at %s", expiresOn)
+	}
+	nonce, err := strconv.ParseInt(data.Nonce, 10, 64)
+	if err != nil {
+		return nil, errors.New("attested data nonce is not a Unix time")
+	}
+	nonceTime := time.Unix(nonce, 0)
+	if nonceTime.Before(now.Add(-a.config.MaxAzureNonceAge)) ||
+		nonceTime.After(now.Add(maxAzureNonceFuture)) {
+		return nil, fmt.Errorf("attested data nonce time %s is not recent",
+			nonceTime)
+	}
+	return &Identity{
+		Provider:   ProviderAzure,
+		Account:    data.SubscriptionID,
+		InstanceID: data.VMID,
+	}, nil
+}
@@ -0,0 +1,402 @@
+package cloudidentity
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log/testlogger"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const testAWSDocument = `{"accountId":"123456789012","instanceId":"i-0123456789abcdef0","region":"us-west-2"}`
+
+var oidSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+
+func newTestKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newTestCert(t *testing.T, template *x509.Certificate,
+	key *rsa.PrivateKey, parent *x509.Certificate,
+	parentKey *rsa.PrivateKey) *x509.Certificate {
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	derCert, err := x509.CreateCertificate(rand.Reader, template, parent,
+		&key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(derCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func writeTestCert(t *testing.T, filename string, cert *x509.Certificate) {
+	err := ioutil.WriteFile(filename, pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: cert.Raw}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustMarshal(t *testing.T, value interface{}, params string) []byte {
+	data, err := asn1.MarshalWithParams(value, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// explicitTag returns der wrapped in an explicit [0] tag, which Marshal
+// does not add to a RawValue.
+func explicitTag(der []byte) asn1.RawValue {
+	return asn1.RawValue{
+		Class:      asn1.ClassContextSpecific,
+		Tag:        0,
+		IsCompound: true,
+		Bytes:      der,
+	}
+}
+
+// newTestSignedData returns PKCS #7 signed data of content with
+// authenticated attributes, like the attested data of Azure.
+func newTestSignedData(t *testing.T, content []byte, cert *x509.Certificate,
+	key *rsa.PrivateKey) []byte {
+	digest := sha256.Sum256(content)
+	newAttribute := func(oid asn1.ObjectIdentifier,
+		value interface{}) attribute {
+		return attribute{Type: oid, Values: asn1.RawValue{
+			Class:      asn1.ClassUniversal,
+			Tag:        asn1.TagSet,
+			IsCompound: true,
+			Bytes:      mustMarshal(t, value, ""),
+		}}
+	}
+	attributesDER := mustMarshal(t, []attribute{
+		newAttribute(oidContentType, oidData),
+		newAttribute(oidMessageDigest, digest[:]),
+	}, "set")
+	attributesDigest := sha256.Sum256(attributesDER)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256,
+		attributesDigest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	attributesDER[0] = 0xa0
+	sd := signedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{{Algorithm: oidSHA256}},
+		ContentInfo: contentInfo{
+			ContentType: oidData,
+			Content:     explicitTag(mustMarshal(t, content, "")),
+		},
+		Certificates: asn1.RawValue{
+			Class:      asn1.ClassContextSpecific,
+			Tag:        0,
+			IsCompound: true,
+			Bytes:      cert.Raw,
+		},
+		SignerInfos: []signerInfo{{
+			Version: 1,
+			IssuerAndSerialNumber: issuerAndSerialNumber{
+				Issuer:       asn1.RawValue{FullBytes: cert.RawIssuer},
+				SerialNumber: cert.SerialNumber,
+			},
+			DigestAlgorithm:           pkix.AlgorithmIdentifier{Algorithm: oidSHA256},
+			AuthenticatedAttributes:   asn1.RawValue{FullBytes: attributesDER},
+			DigestEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption},
+			EncryptedDigest:           signature,
+		}},
+	}
+	return mustMarshal(t, contentInfo{
+		ContentType: oidSignedData,
+		Content:     explicitTag(mustMarshal(t, sd, "")),
+	}, "")
+}
+
+// newTestSTSRequest returns a JSON encoded GetCallerIdentity request for
+// audience signed at signedAt.
+func newTestSTSRequest(t *testing.T, audience string, signedAt time.Time,
+	signedHeaders string) string {
+	data, err := json.Marshal(awsSTSRequest{
+		Headers: map[string]string{
+			"Authorization": "AWS4-HMAC-SHA256 Credential=ASIAEXAMPLE/" +
+				signedAt.UTC().Format("20060102") +
+				"/us-east-1/sts/aws4_request, SignedHeaders=" + signedHeaders +
+				", Signature=0123",
+			"X-Amz-Date":      signedAt.UTC().Format(awsAmzDateFormat),
+			awsAudienceHeader: audience,
+		},
+		Body: awsSTSBody,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestAuthenticateAWS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudidentity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key := newTestKey(t)
+	cert := newTestCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Amazon Web Services LLC"},
+	}, key, nil, nil)
+	filename := filepath.Join(dir, "aws.pem")
+	writeTestCert(t, filename, cert)
+	callerArn := "arn:aws:sts::123456789012:assumed-role/web/i-0123456789abcdef0"
+	stsServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			if r.Method != "POST" || string(body) != awsSTSBody ||
+				r.Header.Get("Authorization") == "" {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(`<GetCallerIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <GetCallerIdentityResult>
+    <Arn>` + callerArn + `</Arn>
+    <UserId>AROAEXAMPLE:i-0123456789abcdef0</UserId>
+    <Account>123456789012</Account>
+  </GetCallerIdentityResult>
+</GetCallerIdentityResponse>`))
+		}))
+	defer stsServer.Close()
+	if _, err := New(Config{AWSCertificateFilename: filename},
+		testlogger.New(t)); err == nil {
+		t.Fatal("AWS identities without audiences should fail")
+	}
+	a, err := New(Config{
+		AWSCertificateFilename: filename,
+		AWSAudiences:           []string{"https://keymaster.example.com"},
+		AWSSTSURL:              stsServer.URL,
+	}, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte(testAWSDocument))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256,
+		digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	const signedHeaders = "content-type;host;x-amz-date;x-keymaster-audience"
+	credential := Credential{
+		Provider:  ProviderAWS,
+		Document:  testAWSDocument,
+		Signature: base64.StdEncoding.EncodeToString(signature),
+		STSRequest: newTestSTSRequest(t, "https://keymaster.example.com",
+			time.Now(), signedHeaders),
+	}
+	identity, err := a.Authenticate(credential)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Account != "123456789012" ||
+		identity.InstanceID != "i-0123456789abcdef0" ||
+		identity.Region != "us-west-2" {
+		t.Fatalf("unexpected identity %+v", identity)
+	}
+	for name, stsRequest := range map[string]string{
+		"missing STS request": "",
+		"other audience": newTestSTSRequest(t, "https://other.example.com",
+			time.Now(), signedHeaders),
+		"unsigned audience": newTestSTSRequest(t,
+			"https://keymaster.example.com", time.Now(),
+			"content-type;host;x-amz-date"),
+		"old STS request": newTestSTSRequest(t,
+			"https://keymaster.example.com", time.Now().Add(-time.Hour),
+			signedHeaders),
+	} {
+		credential := credential
+		credential.STSRequest = stsRequest
+		if _, err := a.Authenticate(credential); err == nil {
+			t.Errorf("%s should fail", name)
+		}
+	}
+	callerArn = "arn:aws:sts::123456789012:assumed-role/web/i-1"
+	if _, err := a.Authenticate(credential); err == nil {
+		t.Fatal("role of other instance should fail")
+	}
+	callerArn = "arn:aws:sts::123456789012:assumed-role/web/i-0123456789abcdef0"
+	credential.Document = `{"accountId":"210987654321","instanceId":"i-0123456789abcdef0","region":"us-west-2"}`
+	if _, err := a.Authenticate(credential); err == nil {
+		t.Fatal("modified document should fail")
+	}
+	credential.Provider = ProviderGCP
+	if _, err := a.Authenticate(credential); err == nil {
+		t.Fatal("unconfigured provider should fail")
+	}
+}
+
+func TestAuthenticateGCP(t *testing.T) {
+	key := newTestKey(t)
+	keySet := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{
+		Key: &key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"}}}
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(keySet)
+		}))
+	defer server.Close()
+	a, err := New(Config{
+		GCPAudiences: []string{"https://keymaster.example.com"},
+		GCPCertsURL:  server.URL,
+	}, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		(&jose.SignerOptions{}).WithHeader("kid", "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newToken := func(audience string, computeEngine bool) string {
+		claims := map[string]interface{}{
+			"iss":            gcpIssuer,
+			"aud":            audience,
+			"sub":            "1234567890",
+			"exp":            time.Now().Add(time.Hour).Unix(),
+			"iat":            time.Now().Unix(),
+			"email":          "deploy@project-1.iam.gserviceaccount.com",
+			"email_verified": true,
+		}
+		if computeEngine {
+			claims["google"] = map[string]interface{}{
+				"compute_engine": map[string]string{
+					"project_id":  "project-1",
+					"zone":        "us-central1-a",
+					"instance_id": "1234567890123456789",
+				},
+			}
+		}
+		token, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	identity, err := a.Authenticate(Credential{Provider: ProviderGCP,
+		Token: newToken("https://keymaster.example.com", true)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Account != "project-1" ||
+		identity.InstanceID != "1234567890123456789" ||
+		identity.Region != "us-central1-a" ||
+		identity.ServiceAccount != "deploy@project-1.iam.gserviceaccount.com" {
+		t.Fatalf("unexpected identity %+v", identity)
+	}
+	_, err = a.Authenticate(Credential{Provider: ProviderGCP,
+		Token: newToken("https://other.example.com", true)})
+	if err == nil {
+		t.Fatal("other audience should fail")
+	}
+	_, err = a.Authenticate(Credential{Provider: ProviderGCP,
+		Token: newToken("https://keymaster.example.com", false)})
+	if err == nil {
+		t.Fatal("token without instance should fail")
+	}
+}
+
+func TestAuthenticateAzure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudidentity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caKey := newTestKey(t)
+	caCert := newTestCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test root"},
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, caKey, nil, nil)
+	rootFilename := filepath.Join(dir, "roots.pem")
+	writeTestCert(t, rootFilename, caCert)
+	key := newTestKey(t)
+	newSignerCert := func(name string) *x509.Certificate {
+		return newTestCert(t, &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: name},
+			DNSNames:     []string{name},
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+		}, key, caCert, caKey)
+	}
+	cert := newSignerCert("metadata.azure.com")
+	a, err := New(Config{AzureEnabled: true, AzureRootCAFilename: rootFilename},
+		testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newCredential := func(nonce time.Time,
+		cert *x509.Certificate) Credential {
+		content, err := json.Marshal(map[string]interface{}{
+			"nonce": strconv.FormatInt(nonce.Unix(), 10),
+			"timeStamp": map[string]string{
+				"createdOn": time.Now().UTC().Format(azureTimeStampForm),
+				"expiresOn": time.Now().Add(6 * time.Hour).UTC().Format(
+					azureTimeStampForm),
+			},
+			"vmId":           "d3e0e374-fda6-4649-bbc9-7f20dc379f34",
+			"subscriptionId": "8d10da13-8125-4ba9-a717-bf7490507b3d",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return Credential{
+			Provider: ProviderAzure,
+			Signature: base64.StdEncoding.EncodeToString(
+				newTestSignedData(t, content, cert, key)),
+		}
+	}
+	identity, err := a.Authenticate(newCredential(time.Now(), cert))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Account != "8d10da13-8125-4ba9-a717-bf7490507b3d" ||
+		identity.InstanceID != "d3e0e374-fda6-4649-bbc9-7f20dc379f34" {
+		t.Fatalf("unexpected identity %+v", identity)
+	}
+	_, err = a.Authenticate(newCredential(time.Now().Add(-time.Hour), cert))
+	if err == nil {
+		t.Fatal("old nonce should fail")
+	}
+	_, err = a.Authenticate(newCredential(time.Now(),
+		newSignerCert("www.example.com")))
+	if err == nil {
+		t.Fatal("signer other than metadata.azure.com should fail")
+	}
+}
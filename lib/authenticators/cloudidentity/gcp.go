@@ -0,0 +1,139 @@
+package cloudidentity
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	gcpIssuer             = "https://accounts.google.com"
+	keysMinRefetchPeriod  = time.Minute
+	maxResponseBodyLength = 1 << 20
+)
+
+type gcpClaims struct {
+	jwt.Claims
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Google        struct {
+		ComputeEngine struct {
+			ProjectID  string `json:"project_id"`
+			Zone       string `json:"zone"`
+			InstanceID string `json:"instance_id"`
+		} `json:"compute_engine"`
+	} `json:"google"`
+}
+
+// getGCPKeys returns the keys with the ID keyID, fetching the Google key set
+// if it is not known. Key sets are fetched at most once every
+// keysMinRefetchPeriod. a.mutex must be held.
+func (a *Authenticator) getGCPKeys(keyID string) ([]jose.JSONWebKey, error) {
+	if keys := a.gcpKeys.Key(keyID); len(keys) > 0 {
+		return keys, nil
+	}
+	if time.Since(a.gcpKeysFetchedAt) < keysMinRefetchPeriod {
+		return nil, fmt.Errorf("unknown key ID: %s", keyID)
+	}
+	resp, err := a.httpClient.Get(a.config.GCPCertsURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body,
+		maxResponseBodyLength))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("GET %s: %s", a.config.GCPCertsURL, resp.Status)
+	}
+	var keySet jose.JSONWebKeySet
+	if err := json.Unmarshal(body, &keySet); err != nil {
+		return nil, fmt.Errorf("cannot read Google keys: %s", err)
+	}
+	a.gcpKeys = keySet
+	a.gcpKeysFetchedAt = time.Now()
+	a.logger.Debugf(1, "read %d Google keys", len(keySet.Keys))
+	if keys := a.gcpKeys.Key(keyID); len(keys) > 0 {
+		return keys, nil
+	}
+	return nil, fmt.Errorf("unknown key ID: %s", keyID)
+}
+
+// authenticateGCP verifies an instance identity token, which must have been
+// requested in the full format so that it names the instance.
+func (a *Authenticator) authenticateGCP(credential Credential,
+	now time.Time) (*Identity, error) {
+	tok, err := jwt.ParseSigned(credential.Token)
+	if err != nil {
+		return nil, err
+	}
+	if len(tok.Headers) != 1 {
+		return nil, errors.New("identity token must have one signature")
+	}
+	header := tok.Headers[0]
+	if header.Algorithm != string(jose.RS256) {
+		return nil, fmt.Errorf("identity token algorithm %s is not allowed",
+			header.Algorithm)
+	}
+	a.mutex.Lock()
+	keys, err := a.getGCPKeys(header.KeyID)
+	a.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	var claims gcpClaims
+	verified := false
+	for _, key := range keys {
+		if err := tok.Claims(key.Key, &claims); err == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("invalid identity token signature")
+	}
+	err = claims.Claims.ValidateWithLeeway(jwt.Expected{
+		Issuer: gcpIssuer,
+		Time:   now,
+	}, jwt.DefaultLeeway)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Expiry == nil {
+		return nil, errors.New("identity token has no expiry")
+	}
+	audienceValid := false
+	for _, audience := range a.config.GCPAudiences {
+		if claims.Audience.Contains(audience) {
+			audienceValid = true
+			break
+		}
+	}
+	if !audienceValid {
+		return nil, fmt.Errorf("identity token audience %v is not allowed",
+			[]string(claims.Audience))
+	}
+	computeEngine := claims.Google.ComputeEngine
+	if computeEngine.ProjectID == "" || computeEngine.InstanceID == "" {
+		return nil, errors.New(
+			"identity token does not name an instance (use format=full)")
+	}
+	identity := &Identity{
+		Provider:   ProviderGCP,
+		Account:    computeEngine.ProjectID,
+		InstanceID: computeEngine.InstanceID,
+		Region:     computeEngine.Zone,
+	}
+	if claims.EmailVerified {
+		identity.ServiceAccount = claims.Email
+	}
+	return identity, nil
+}
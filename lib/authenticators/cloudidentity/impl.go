@@ -0,0 +1,123 @@
+package cloudidentity
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+)
+
+const (
+	defaultAWSSTSURL        = "https://sts.amazonaws.com/"
+	defaultGCPCertsURL      = "https://www.googleapis.com/oauth2/v3/certs"
+	defaultMaxAzureNonceAge = 5 * time.Minute
+	httpTimeout             = 10 * time.Second
+)
+
+func loadCertificates(filename string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) < 1 {
+		return nil, fmt.Errorf("no certificates in %s", filename)
+	}
+	return certs, nil
+}
+
+func loadCertPool(filename string) (*x509.CertPool, error) {
+	certs, err := loadCertificates(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	for _, cert := range certs {
+		pool.AddCert(cert)
+	}
+	return pool, nil
+}
+
+func newAuthenticator(config Config, logger log.DebugLogger) (
+	*Authenticator, error) {
+	if config.AWSSTSURL == "" {
+		config.AWSSTSURL = defaultAWSSTSURL
+	}
+	if config.GCPCertsURL == "" {
+		config.GCPCertsURL = defaultGCPCertsURL
+	}
+	if config.MaxAzureNonceAge == 0 {
+		config.MaxAzureNonceAge = defaultMaxAzureNonceAge
+	}
+	a := &Authenticator{
+		config:     config,
+		logger:     logger,
+		httpClient: &http.Client{Timeout: httpTimeout},
+	}
+	if config.AWSCertificateFilename != "" {
+		if len(config.AWSAudiences) < 1 {
+			return nil, errors.New("AWS identities need audiences")
+		}
+		certs, err := loadCertificates(config.AWSCertificateFilename)
+		if err != nil {
+			return nil, err
+		}
+		a.awsCerts = certs
+	}
+	if config.AzureRootCAFilename != "" {
+		pool, err := loadCertPool(config.AzureRootCAFilename)
+		if err != nil {
+			return nil, err
+		}
+		a.azureRoots = pool
+	}
+	if config.AzureIntermediateCAFilename != "" {
+		pool, err := loadCertPool(config.AzureIntermediateCAFilename)
+		if err != nil {
+			return nil, err
+		}
+		a.azureIntermediate = pool
+	}
+	return a, nil
+}
+
+func (a *Authenticator) authenticate(credential Credential, now time.Time) (
+	*Identity, error) {
+	switch credential.Provider {
+	case ProviderAWS:
+		if len(a.awsCerts) < 1 {
+			break
+		}
+		return a.authenticateAWS(credential, now)
+	case ProviderGCP:
+		if len(a.config.GCPAudiences) < 1 {
+			break
+		}
+		return a.authenticateGCP(credential, now)
+	case ProviderAzure:
+		if !a.config.AzureEnabled {
+			break
+		}
+		return a.authenticateAzure(credential, now)
+	default:
+		return nil, fmt.Errorf("unknown provider: %q", credential.Provider)
+	}
+	return nil, errors.New(credential.Provider + " identities are not enabled")
+}
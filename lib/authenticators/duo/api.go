@@ -0,0 +1,140 @@
+// Package duo implements second factor authentication with the Duo Security
+// Auth API: passcodes and push notifications to the Duo Mobile app. Push
+// requests are asynchronous and are polled with repeated calls to
+// ValidateUserPush, like the Okta backend, or with StartPush and CheckPush by
+// callers which keep the transaction IDs themselves, such as in state shared
+// by several servers.
+package duo
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+)
+
+// Config holds the settings of a Duo Auth API application.
+type Config struct {
+	APIHostname    string // Such as api-XXXXXXXX.duosecurity.com.
+	IntegrationKey string
+	SecretKey      string
+}
+
+// Results of a preauth request.
+const (
+	PreauthResultAuth   = "auth"   // The user must authenticate.
+	PreauthResultAllow  = "allow"  // The user may skip the second factor.
+	PreauthResultDeny   = "deny"   // The user is not allowed to log in.
+	PreauthResultEnroll = "enroll" // The user has not enrolled a device.
+)
+
+// Device capabilities.
+const (
+	CapabilityPush      = "push"
+	CapabilityMobileOTP = "mobile_otp"
+)
+
+// Device is a device enrolled by a user.
+type Device struct {
+	ID           string
+	Type         string // Such as "phone" or "token".
+	DisplayName  string
+	Capabilities []string
+}
+
+// PreauthResponse describes how a user may authenticate.
+type PreauthResponse struct {
+	Result        string // One of the PreauthResult* constants.
+	StatusMessage string
+	Devices       []Device
+}
+
+// MaxPushAge is how long a push is waited for. Duo gives up on unanswered
+// pushes after 60 seconds.
+const MaxPushAge = 90 * time.Second
+
+type PushResponse int
+
+const (
+	PushResponseRejected PushResponse = iota
+	PushResponseApproved
+	PushResponseWaiting
+	PushResponseTimeout
+)
+
+type pushKey struct {
+	username  string
+	sessionID string
+}
+
+type pushTransaction struct {
+	txid    string
+	expires time.Time
+}
+
+// Authenticator checks second factors with Duo.
+type Authenticator struct {
+	config     Config
+	baseURL    string
+	httpClient *http.Client
+	logger     log.DebugLogger
+	mutex      sync.Mutex
+	pushes     map[pushKey]pushTransaction
+}
+
+// New creates an Authenticator for the Duo application in config. Log
+// messages are written to logger.
+func New(config Config, logger log.DebugLogger) (*Authenticator, error) {
+	return newAuthenticator(config, logger)
+}
+
+// NewTesting creates an Authenticator which sends its requests to apiURL
+// instead of the API hostname in config. Plaintext http URLs are permitted.
+func NewTesting(config Config, apiURL string, logger log.DebugLogger) (
+	*Authenticator, error) {
+	return newTestingAuthenticator(config, apiURL, logger)
+}
+
+// HasCapability returns true if any device of the user has capability.
+func (p *PreauthResponse) HasCapability(capability string) bool {
+	return p.hasCapability(capability)
+}
+
+// Preauth checks whether a user may authenticate and with which devices.
+func (a *Authenticator) Preauth(username string) (*PreauthResponse, error) {
+	return a.preauth(username)
+}
+
+// ValidateUserOTP validates a passcode generated by Duo Mobile, a hardware
+// token or sent by SMS. The passcode is passed to Duo as typed.
+// Returns true if the passcode is valid according to Duo, false otherwise.
+func (a *Authenticator) ValidateUserOTP(username string, passcode string) (bool, error) {
+	return a.validateUserOTP(username, passcode)
+}
+
+// ValidateUserPush sends a push notification to the devices of a user, or
+// checks the result of the notification sent by a previous call with the
+// same sessionID. sessionID identifies the login session waiting for the
+// push, so that a push approved for one session cannot complete another.
+// Returns one of PushResponse; PushResponseWaiting means the user has yet to
+// answer.
+func (a *Authenticator) ValidateUserPush(username string, sessionID string) (
+	PushResponse, error) {
+	return a.validateUserPush(username, sessionID)
+}
+
+// StartPush sends a push notification to the devices of username. If the
+// user must answer it PushResponseWaiting and the Duo transaction ID to pass
+// to CheckPush are returned, otherwise the outcome of the push.
+func (a *Authenticator) StartPush(username string) (PushResponse, string,
+	error) {
+	return a.sendPush(username)
+}
+
+// CheckPush returns the state of the push to username with the transaction
+// ID txid returned by StartPush.
+func (a *Authenticator) CheckPush(username string, txid string) (
+	PushResponse, error) {
+	return a.checkPush(username, txid)
+}
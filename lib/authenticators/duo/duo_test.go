@@ -0,0 +1,264 @@
+package duo
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log/testlogger"
+)
+
+var testConfig = Config{
+	APIHostname:    "api-test.duosecurity.com",
+	IntegrationKey: "DIXXXXXXXXXXXXXXXXXX",
+	SecretKey:      "secret-key",
+}
+
+type testServer struct {
+	t           *testing.T
+	pushResults []string // Results of auth_status calls.
+}
+
+func (s *testServer) writeResponse(w http.ResponseWriter,
+	response interface{}) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"stat":     "OK",
+		"response": response,
+	})
+}
+
+func (s *testServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		s.t.Error(err)
+		return
+	}
+	expected := sign(testConfig, r.Header.Get("Date"), r.Method, r.URL.Path,
+		encodeParams(r.Form))
+	if r.Header.Get("Authorization") != expected {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"stat": "FAIL", "code": 40103, "message": "Invalid signature",
+		})
+		return
+	}
+	username := r.Form.Get("username")
+	switch r.URL.Path {
+	case preauthPath:
+		switch username {
+		case "push-user":
+			s.writeResponse(w, apiPreauthResponse{Result: "auth",
+				Devices: []apiDevice{{Device: "DP1", Type: "phone",
+					Capabilities: []string{"auto", "push", "sms"}}}})
+		case "token-user":
+			s.writeResponse(w, apiPreauthResponse{Result: "auth",
+				Devices: []apiDevice{{Device: "DT1", Type: "token"}}})
+		case "bypass-user":
+			s.writeResponse(w, apiPreauthResponse{Result: "allow"})
+		default:
+			s.writeResponse(w, apiPreauthResponse{Result: "enroll",
+				StatusMsg: "Enroll an authentication device"})
+		}
+	case authPath:
+		switch r.Form.Get("factor") {
+		case "passcode":
+			if r.Form.Get("passcode") == "012345" {
+				s.writeResponse(w, apiAuthResponse{Result: "allow"})
+			} else {
+				s.writeResponse(w, apiAuthResponse{Result: "deny",
+					StatusMsg: "Incorrect passcode"})
+			}
+		case "push":
+			if r.Form.Get("async") != "1" {
+				s.t.Error("push is not async")
+			}
+			s.writeResponse(w, apiAuthResponse{Txid: "tx-" + username})
+		}
+	case authStatusPath:
+		if r.Method != "GET" || r.Form.Get("txid") != "tx-push-user" {
+			s.t.Errorf("bad auth_status request: %s %v", r.Method, r.Form)
+		}
+		result := s.pushResults[0]
+		s.pushResults = s.pushResults[1:]
+		status := result
+		if result == "timeout" {
+			result = "deny"
+		}
+		s.writeResponse(w, apiAuthResponse{Result: result, Status: status})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newTestAuthenticator(t *testing.T, handler http.Handler) *Authenticator {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	a, err := NewTesting(testConfig, server.URL, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestEncodeParams(t *testing.T) {
+	params := map[string][]string{
+		"username": {"a user~"},
+		"factor":   {"push"},
+		"device":   {"auto"},
+	}
+	encoded := encodeParams(params)
+	if encoded != "device=auto&factor=push&username=a%20user~" {
+		t.Fatalf("bad encoding: %s", encoded)
+	}
+}
+
+func TestPreauth(t *testing.T) {
+	a := newTestAuthenticator(t, &testServer{t: t})
+	response, err := a.Preauth("push-user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Result != PreauthResultAuth ||
+		!response.HasCapability(CapabilityPush) {
+		t.Fatalf("bad preauth response: %+v", response)
+	}
+	response, err = a.Preauth("token-user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.HasCapability(CapabilityPush) {
+		t.Fatal("token user should not be able to push")
+	}
+}
+
+func TestBadSignature(t *testing.T) {
+	a := newTestAuthenticator(t, &testServer{t: t})
+	a.config.SecretKey = "wrong-key"
+	if _, err := a.Preauth("push-user"); err == nil {
+		t.Fatal("should have failed with wrong secret key")
+	}
+}
+
+func TestValidateUserOTP(t *testing.T) {
+	a := newTestAuthenticator(t, &testServer{t: t})
+	// Leading zeros are part of the passcode.
+	valid, err := a.ValidateUserOTP("token-user", "012345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !valid {
+		t.Fatal("passcode should be valid")
+	}
+	valid, err = a.ValidateUserOTP("token-user", "12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valid {
+		t.Fatal("passcode should be invalid")
+	}
+}
+
+func TestValidateUserPush(t *testing.T) {
+	server := &testServer{t: t,
+		pushResults: []string{"waiting", "allow", "timeout", "deny"}}
+	a := newTestAuthenticator(t, server)
+	for _, expected := range []PushResponse{
+		PushResponseWaiting, // Push sent.
+		PushResponseWaiting,
+		PushResponseApproved,
+		PushResponseWaiting, // New push sent.
+		PushResponseTimeout,
+		PushResponseWaiting, // New push sent.
+		PushResponseRejected,
+	} {
+		response, err := a.ValidateUserPush("push-user", "session1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response != expected {
+			t.Fatalf("expected push response %d, got %d", expected, response)
+		}
+	}
+	for username, expected := range map[string]PushResponse{
+		"token-user":  PushResponseRejected,
+		"bypass-user": PushResponseApproved,
+		"new-user":    PushResponseRejected,
+	} {
+		response, err := a.ValidateUserPush(username, "session1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response != expected {
+			t.Fatalf("%s: expected push response %d, got %d",
+				username, expected, response)
+		}
+	}
+}
+
+func TestValidateUserPushSessions(t *testing.T) {
+	server := &testServer{t: t, pushResults: []string{"allow"}}
+	a := newTestAuthenticator(t, server)
+	for _, test := range []struct {
+		sessionID string
+		expected  PushResponse
+	}{
+		{"session1", PushResponseWaiting}, // Push sent.
+		// Another session gets its own push, not the result of the first.
+		{"session2", PushResponseWaiting},
+		{"session1", PushResponseApproved},
+	} {
+		response, err := a.ValidateUserPush("push-user", test.sessionID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response != test.expected {
+			t.Fatalf("%s: expected push response %d, got %d",
+				test.sessionID, test.expected, response)
+		}
+	}
+	if _, err := a.ValidateUserPush("push-user", ""); err == nil {
+		t.Fatal("push without a session should fail")
+	}
+}
+
+func TestStartPush(t *testing.T) {
+	server := &testServer{t: t, pushResults: []string{"waiting", "allow"}}
+	a := newTestAuthenticator(t, server)
+	response, txid, err := a.StartPush("push-user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response != PushResponseWaiting || txid != "tx-push-user" {
+		t.Fatalf("unexpected push: %d %s", response, txid)
+	}
+	for _, expected := range []PushResponse{
+		PushResponseWaiting,
+		PushResponseApproved,
+	} {
+		response, err := a.CheckPush("push-user", txid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response != expected {
+			t.Fatalf("expected push response %d, got %d", expected, response)
+		}
+	}
+	response, txid, err = a.StartPush("bypass-user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response != PushResponseApproved || txid != "" {
+		t.Fatalf("unexpected push: %d %s", response, txid)
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(Config{IntegrationKey: "i", SecretKey: "s"},
+		testlogger.New(t)); err == nil {
+		t.Fatal("should have failed without API hostname")
+	}
+	if _, err := New(Config{APIHostname: "api.example.com"},
+		testlogger.New(t)); err == nil {
+		t.Fatal("should have failed without keys")
+	}
+}
@@ -0,0 +1,317 @@
+package duo
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+)
+
+const (
+	preauthPath    = "/auth/v2/preauth"
+	authPath       = "/auth/v2/auth"
+	authStatusPath = "/auth/v2/auth_status"
+
+	requestTimeout = 15 * time.Second
+)
+
+type apiResponse struct {
+	Stat     string          `json:"stat"`
+	Code     int             `json:"code"`
+	Message  string          `json:"message"`
+	Response json.RawMessage `json:"response"`
+}
+
+type apiDevice struct {
+	Device       string   `json:"device"`
+	Type         string   `json:"type"`
+	DisplayName  string   `json:"display_name"`
+	Capabilities []string `json:"capabilities"`
+}
+
+type apiPreauthResponse struct {
+	Result    string      `json:"result"`
+	StatusMsg string      `json:"status_msg"`
+	Devices   []apiDevice `json:"devices"`
+}
+
+type apiAuthResponse struct {
+	Result    string `json:"result"`
+	Status    string `json:"status"`
+	StatusMsg string `json:"status_msg"`
+	Txid      string `json:"txid"`
+}
+
+func newAuthenticator(config Config, logger log.DebugLogger) (
+	*Authenticator, error) {
+	if config.APIHostname == "" {
+		return nil, errors.New("no Duo API hostname")
+	}
+	if config.IntegrationKey == "" || config.SecretKey == "" {
+		return nil, errors.New("no Duo integration or secret key")
+	}
+	return &Authenticator{
+		config:     config,
+		baseURL:    "https://" + config.APIHostname,
+		httpClient: &http.Client{Timeout: requestTimeout},
+		logger:     logger,
+		pushes:     make(map[pushKey]pushTransaction),
+	}, nil
+}
+
+func newTestingAuthenticator(config Config, apiURL string,
+	logger log.DebugLogger) (*Authenticator, error) {
+	a, err := newAuthenticator(config, logger)
+	if err != nil {
+		return nil, err
+	}
+	a.baseURL = apiURL
+	return a, nil
+}
+
+// encodeParams returns the parameters sorted by name and percent encoded as
+// in RFC 3986, as required for signing.
+func encodeParams(params url.Values) string {
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, key := range keys {
+		for _, value := range params[key] {
+			parts = append(parts, escape(key)+"="+escape(value))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func escape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+// sign returns the Authorization header value of a request.
+func sign(config Config, date, method, path, params string) string {
+	canonical := strings.Join([]string{date, strings.ToUpper(method),
+		strings.ToLower(config.APIHostname), path, params}, "\n")
+	mac := hmac.New(sha1.New, []byte(config.SecretKey))
+	mac.Write([]byte(canonical))
+	credentials := config.IntegrationKey + ":" + hex.EncodeToString(mac.Sum(nil))
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+}
+
+// call makes a signed request and decodes the response into result.
+func (a *Authenticator) call(method, path string, params url.Values,
+	result interface{}) error {
+	encodedParams := encodeParams(params)
+	targetURL := a.baseURL + path
+	var body *strings.Reader
+	if method == "GET" {
+		if encodedParams != "" {
+			targetURL += "?" + encodedParams
+		}
+		body = strings.NewReader("")
+	} else {
+		body = strings.NewReader(encodedParams)
+	}
+	req, err := http.NewRequest(method, targetURL, body)
+	if err != nil {
+		return err
+	}
+	date := time.Now().UTC().Format(time.RFC1123Z)
+	req.Header.Set("Date", date)
+	req.Header.Set("Authorization",
+		sign(a.config, date, method, path, encodedParams))
+	if method != "GET" {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var response apiResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return fmt.Errorf("cannot decode Duo response (%s): %s",
+			resp.Status, err)
+	}
+	if response.Stat != "OK" {
+		return fmt.Errorf("Duo error %d: %s", response.Code, response.Message)
+	}
+	return json.Unmarshal(response.Response, result)
+}
+
+func (p *PreauthResponse) hasCapability(capability string) bool {
+	for _, device := range p.Devices {
+		for _, deviceCapability := range device.Capabilities {
+			if deviceCapability == capability {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (a *Authenticator) preauth(username string) (*PreauthResponse, error) {
+	var response apiPreauthResponse
+	err := a.call("POST", preauthPath, url.Values{"username": {username}},
+		&response)
+	if err != nil {
+		return nil, err
+	}
+	result := &PreauthResponse{
+		Result:        response.Result,
+		StatusMessage: response.StatusMsg,
+	}
+	for _, device := range response.Devices {
+		result.Devices = append(result.Devices, Device{
+			ID:           device.Device,
+			Type:         device.Type,
+			DisplayName:  device.DisplayName,
+			Capabilities: device.Capabilities,
+		})
+	}
+	a.logger.Debugf(2, "Duo preauth for %s: %s", username, result.Result)
+	return result, nil
+}
+
+func (a *Authenticator) validateUserOTP(username string, passcode string) (bool, error) {
+	if passcode == "" {
+		return false, nil
+	}
+	var response apiAuthResponse
+	err := a.call("POST", authPath, url.Values{
+		"username": {username},
+		"factor":   {"passcode"},
+		"passcode": {passcode},
+	}, &response)
+	if err != nil {
+		return false, err
+	}
+	if response.Result != "allow" {
+		a.logger.Debugf(1, "Duo passcode for %s: %s", username,
+			response.StatusMsg)
+		return false, nil
+	}
+	return true, nil
+}
+
+// sendPush sends a push to username after checking with preauth that the
+// user has a device which can receive one, and returns its transaction ID.
+func (a *Authenticator) sendPush(username string) (
+	PushResponse, string, error) {
+	preauth, err := a.preauth(username)
+	if err != nil {
+		return PushResponseRejected, "", err
+	}
+	switch preauth.Result {
+	case PreauthResultAllow:
+		return PushResponseApproved, "", nil
+	case PreauthResultAuth:
+	default:
+		a.logger.Printf("Duo push for %s not possible: %s", username,
+			preauth.StatusMessage)
+		return PushResponseRejected, "", nil
+	}
+	if !preauth.hasCapability(CapabilityPush) {
+		a.logger.Debugf(1, "%s has no Duo push device", username)
+		return PushResponseRejected, "", nil
+	}
+	var response apiAuthResponse
+	err = a.call("POST", authPath, url.Values{
+		"username": {username},
+		"factor":   {"push"},
+		"device":   {"auto"},
+		"async":    {"1"},
+	}, &response)
+	if err != nil {
+		return PushResponseRejected, "", err
+	}
+	if response.Txid == "" {
+		return PushResponseRejected, "", errors.New("no Duo transaction ID")
+	}
+	return PushResponseWaiting, response.Txid, nil
+}
+
+// checkPush returns the state of the push of username with the transaction
+// ID txid.
+func (a *Authenticator) checkPush(username string, txid string) (
+	PushResponse, error) {
+	var response apiAuthResponse
+	err := a.call("GET", authStatusPath, url.Values{"txid": {txid}},
+		&response)
+	if err != nil {
+		return PushResponseRejected, err
+	}
+	switch {
+	case response.Result == "waiting":
+		return PushResponseWaiting, nil
+	case response.Result == "allow":
+		return PushResponseApproved, nil
+	case response.Status == "timeout":
+		return PushResponseTimeout, nil
+	default:
+		a.logger.Debugf(1, "Duo push for %s: %s", username,
+			response.StatusMsg)
+		return PushResponseRejected, nil
+	}
+}
+
+// startPush sends a push for key and remembers it.
+func (a *Authenticator) startPush(key pushKey) (PushResponse, error) {
+	pushResponse, txid, err := a.sendPush(key.username)
+	if pushResponse != PushResponseWaiting {
+		return pushResponse, err
+	}
+	now := time.Now()
+	a.mutex.Lock()
+	// Sessions which stopped polling leave their pushes behind.
+	for oldKey, push := range a.pushes {
+		if push.expires.Before(now) {
+			delete(a.pushes, oldKey)
+		}
+	}
+	a.pushes[key] = pushTransaction{
+		txid:    txid,
+		expires: now.Add(MaxPushAge),
+	}
+	a.mutex.Unlock()
+	return PushResponseWaiting, nil
+}
+
+func (a *Authenticator) validateUserPush(username string, sessionID string) (
+	PushResponse, error) {
+	if sessionID == "" {
+		return PushResponseRejected, errors.New("no session for Duo push")
+	}
+	key := pushKey{username: username, sessionID: sessionID}
+	a.mutex.Lock()
+	push, ok := a.pushes[key]
+	if ok && push.expires.Before(time.Now()) {
+		delete(a.pushes, key)
+		a.mutex.Unlock()
+		return PushResponseTimeout, nil
+	}
+	a.mutex.Unlock()
+	if !ok {
+		return a.startPush(key)
+	}
+	pushResponse, err := a.checkPush(username, push.txid)
+	if err != nil || pushResponse == PushResponseWaiting {
+		return pushResponse, err
+	}
+	a.mutex.Lock()
+	delete(a.pushes, key)
+	a.mutex.Unlock()
+	return pushResponse, nil
+}
@@ -0,0 +1,55 @@
+// Package kerberos authenticates HTTP requests with Kerberos service tickets
+// sent using SPNEGO (the Negotiate authorization scheme of RFC 4559), so that
+// users of domain-joined machines need not type a password.
+package kerberos
+
+import (
+	"net/http"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+)
+
+// NegotiateScheme is the authorization scheme of SPNEGO. Servers announce it
+// in the WWW-Authenticate header of a 401 response.
+const NegotiateScheme = "Negotiate"
+
+// Config describes the service and which users may authenticate.
+type Config struct {
+	// KeytabFilename is the keytab holding the keys of the service
+	// principal. It is read once by New.
+	KeytabFilename string
+	// ServicePrincipal is the principal in the keytab which tickets must be
+	// for, such as HTTP/keymaster.example.com. If it is empty tickets for
+	// any principal in the keytab are accepted.
+	ServicePrincipal string
+	// Realms are the realms of users which may authenticate. If it is empty
+	// users must be in the realm of the service principal.
+	Realms []string
+}
+
+// Authenticator verifies SPNEGO authorization headers.
+type Authenticator struct {
+	config Config
+	logger log.DebugLogger
+	keytab *keytab.Keytab
+	realms map[string]struct{}
+}
+
+// New creates an Authenticator with the keytab in config.
+func New(config Config, logger log.DebugLogger) (*Authenticator, error) {
+	return newAuthenticator(config, logger)
+}
+
+// HasNegotiateAuthorization returns true if r has an SPNEGO authorization
+// header.
+func HasNegotiateAuthorization(r *http.Request) bool {
+	return hasNegotiateAuthorization(r)
+}
+
+// Authenticate verifies the SPNEGO authorization header of r and returns the
+// name of the user principal, without the realm. Principals with more than
+// one component (such as host or admin principals) are rejected.
+func (a *Authenticator) Authenticate(r *http.Request) (string, error) {
+	return a.authenticate(r)
+}
@@ -0,0 +1,128 @@
+package kerberos
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/service"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+func newAuthenticator(config Config, logger log.DebugLogger) (
+	*Authenticator, error) {
+	kt, err := keytab.Load(config.KeytabFilename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load keytab: %s", err)
+	}
+	if len(kt.Entries) < 1 {
+		return nil, errors.New("keytab has no entries")
+	}
+	if config.ServicePrincipal != "" {
+		found := false
+		for _, entry := range kt.Entries {
+			if strings.Join(entry.Principal.Components, "/") ==
+				config.ServicePrincipal {
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("keytab has no entry for %s",
+				config.ServicePrincipal)
+		}
+	}
+	a := &Authenticator{config: config, logger: logger, keytab: kt}
+	if len(config.Realms) > 0 {
+		a.realms = make(map[string]struct{}, len(config.Realms))
+		for _, realm := range config.Realms {
+			a.realms[realm] = struct{}{}
+		}
+	}
+	return a, nil
+}
+
+func getNegotiateToken(r *http.Request) (string, bool) {
+	fields := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(fields) != 2 || !strings.EqualFold(fields[0], NegotiateScheme) {
+		return "", false
+	}
+	return strings.TrimSpace(fields[1]), true
+}
+
+func hasNegotiateAuthorization(r *http.Request) bool {
+	_, ok := getNegotiateToken(r)
+	return ok
+}
+
+// decodeAPReq extracts the AP-REQ from an SPNEGO token. Some clients send a
+// raw Kerberos token instead, which is also accepted.
+func decodeAPReq(data []byte) (*messages.APReq, error) {
+	var krb5Token spnego.KRB5Token
+	var spnegoToken spnego.SPNEGOToken
+	if err := spnegoToken.Unmarshal(data); err == nil {
+		if !spnegoToken.Init {
+			return nil, errors.New("not an SPNEGO initial token")
+		}
+		data = spnegoToken.NegTokenInit.MechTokenBytes
+	}
+	if err := krb5Token.Unmarshal(data); err != nil {
+		return nil, fmt.Errorf("cannot decode Kerberos token: %s", err)
+	}
+	if !krb5Token.IsAPReq() {
+		return nil, errors.New("Kerberos token is not an AP-REQ")
+	}
+	return &krb5Token.APReq, nil
+}
+
+func (a *Authenticator) authenticate(r *http.Request) (string, error) {
+	encodedToken, ok := getNegotiateToken(r)
+	if !ok {
+		return "", errors.New("no Negotiate authorization header")
+	}
+	data, err := base64.StdEncoding.DecodeString(encodedToken)
+	if err != nil {
+		return "", fmt.Errorf("cannot decode Negotiate token: %s", err)
+	}
+	apReq, err := decodeAPReq(data)
+	if err != nil {
+		return "", err
+	}
+	settings := []func(*service.Settings){service.DecodePAC(false)}
+	if a.config.ServicePrincipal != "" {
+		settings = append(settings,
+			service.KeytabPrincipal(a.config.ServicePrincipal))
+	}
+	if address, err := types.GetHostAddress(r.RemoteAddr); err == nil {
+		settings = append(settings, service.ClientAddress(address))
+	}
+	ok, creds, err := service.VerifyAPREQ(apReq,
+		service.NewSettings(a.keytab, settings...))
+	if err != nil {
+		return "", fmt.Errorf("invalid Kerberos ticket: %s", err)
+	}
+	if !ok {
+		return "", errors.New("invalid Kerberos ticket")
+	}
+	principal := creds.CName()
+	realm := creds.Domain()
+	if a.realms != nil {
+		if _, ok := a.realms[realm]; !ok {
+			return "", fmt.Errorf("realm %s is not allowed", realm)
+		}
+	} else if realm != apReq.Ticket.Realm {
+		return "", fmt.Errorf("realm %s is not the service realm", realm)
+	}
+	if len(principal.NameString) != 1 || principal.NameString[0] == "" {
+		return "", fmt.Errorf("%s@%s is not a user principal",
+			principal.PrincipalNameString(), realm)
+	}
+	a.logger.Debugf(1, "Kerberos authentication for %s@%s",
+		principal.NameString[0], realm)
+	return principal.NameString[0], nil
+}
@@ -0,0 +1,185 @@
+package kerberos
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log/testlogger"
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+const (
+	testRealm            = "EXAMPLE.COM"
+	testServicePrincipal = "HTTP/keymaster.example.com"
+)
+
+func newTestKeytab(t *testing.T, password string) *keytab.Keytab {
+	kt := keytab.New()
+	err := kt.AddEntry(testServicePrincipal, testRealm, password, time.Now(),
+		1, etypeID.AES256_CTS_HMAC_SHA1_96)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kt
+}
+
+func writeTestKeytab(t *testing.T, kt *keytab.Keytab) string {
+	data, err := kt.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := ioutil.TempFile("", "keytab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	return file.Name()
+}
+
+// newTestRequest returns a request with a Negotiate header holding a ticket
+// for username@realm encrypted with the key in kt, as a KDC would issue.
+func newTestRequest(t *testing.T, kt *keytab.Keytab,
+	username, realm string) *http.Request {
+	cl := client.NewWithPassword(username, realm, "unused", config.New())
+	sname := types.NewPrincipalName(nametype.KRB_NT_SRV_INST,
+		testServicePrincipal)
+	now := time.Now().UTC()
+	ticket, sessionKey, err := messages.NewTicket(cl.Credentials.CName(),
+		realm, sname, testRealm, types.NewKrbFlags(), kt,
+		etypeID.AES256_CTS_HMAC_SHA1_96, 1, now, now, now.Add(time.Hour),
+		now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	negTokenInit, err := spnego.NewNegTokenInitKRB5(cl, ticket, sessionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := spnego.SPNEGOToken{Init: true, NegTokenInit: negTokenInit}
+	data, err := token.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/api/v0/login", nil)
+	r.Header.Set("Authorization",
+		"Negotiate "+base64.StdEncoding.EncodeToString(data))
+	return r
+}
+
+func TestAuthenticate(t *testing.T) {
+	kt := newTestKeytab(t, "service-password")
+	keytabFilename := writeTestKeytab(t, kt)
+	defer os.Remove(keytabFilename)
+	authenticator, err := New(Config{
+		KeytabFilename:   keytabFilename,
+		ServicePrincipal: testServicePrincipal,
+	}, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newTestRequest(t, kt, "alice", testRealm)
+	if !HasNegotiateAuthorization(r) {
+		t.Fatal("Negotiate header not found")
+	}
+	username, err := authenticator.Authenticate(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username != "alice" {
+		t.Fatalf("unexpected username: %s", username)
+	}
+	// The same authenticator may not be used twice.
+	if _, err := authenticator.Authenticate(r); err == nil {
+		t.Fatal("replayed ticket accepted")
+	}
+}
+
+func TestAuthenticateFail(t *testing.T) {
+	kt := newTestKeytab(t, "service-password")
+	keytabFilename := writeTestKeytab(t, kt)
+	defer os.Remove(keytabFilename)
+	authenticator, err := New(Config{KeytabFilename: keytabFilename},
+		testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/api/v0/login", nil)
+	r.SetBasicAuth("alice", "password")
+	if HasNegotiateAuthorization(r) {
+		t.Fatal("Basic authorization taken for Negotiate")
+	}
+	if _, err := authenticator.Authenticate(r); err == nil {
+		t.Fatal("request without ticket accepted")
+	}
+	r.Header.Set("Authorization", "Negotiate bm90IGEgdG9rZW4=")
+	if _, err := authenticator.Authenticate(r); err == nil {
+		t.Fatal("invalid token accepted")
+	}
+	// A ticket encrypted with another key.
+	otherKeytab := newTestKeytab(t, "other-password")
+	r = newTestRequest(t, otherKeytab, "alice", testRealm)
+	if _, err := authenticator.Authenticate(r); err == nil {
+		t.Fatal("ticket with the wrong key accepted")
+	}
+	r = newTestRequest(t, kt, "alice", "OTHER.EXAMPLE.COM")
+	if _, err := authenticator.Authenticate(r); err == nil {
+		t.Fatal("user from another realm accepted")
+	}
+	r = newTestRequest(t, kt, "alice/admin", testRealm)
+	if _, err := authenticator.Authenticate(r); err == nil {
+		t.Fatal("admin principal accepted")
+	}
+}
+
+func TestRealms(t *testing.T) {
+	kt := newTestKeytab(t, "service-password")
+	keytabFilename := writeTestKeytab(t, kt)
+	defer os.Remove(keytabFilename)
+	authenticator, err := New(Config{
+		KeytabFilename: keytabFilename,
+		Realms:         []string{"USERS.EXAMPLE.COM"},
+	}, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newTestRequest(t, kt, "bob", "USERS.EXAMPLE.COM")
+	if username, err := authenticator.Authenticate(r); err != nil {
+		t.Fatal(err)
+	} else if username != "bob" {
+		t.Fatalf("unexpected username: %s", username)
+	}
+	r = newTestRequest(t, kt, "bob", testRealm)
+	if _, err := authenticator.Authenticate(r); err == nil {
+		t.Fatal("user from unlisted realm accepted")
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	if _, err := New(Config{KeytabFilename: "/nonexistent"},
+		testlogger.New(t)); err == nil {
+		t.Fatal("missing keytab accepted")
+	}
+	keytabFilename := writeTestKeytab(t, newTestKeytab(t, "password"))
+	defer os.Remove(keytabFilename)
+	if _, err := New(Config{
+		KeytabFilename:   keytabFilename,
+		ServicePrincipal: "HTTP/other.example.com",
+	}, testlogger.New(t)); err == nil {
+		t.Fatal("keytab without the service principal accepted")
+	}
+}
@@ -0,0 +1,99 @@
+// Package oidc implements an OpenID Connect relying party, which delegates
+// primary authentication to an upstream provider such as Azure AD or Google
+// Workspace using the authorization code flow.
+package oidc
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"golang.org/x/oauth2"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// Config describes the upstream provider and how its claims are mapped.
+type Config struct {
+	// IssuerURL is the issuer of the provider. The provider configuration is
+	// read from its /.well-known/openid-configuration document, which must
+	// name the same issuer. Multi-tenant issuers (such as the Azure AD
+	// "common" endpoint) are not supported.
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	// Scopes are requested in addition to "openid".
+	Scopes []string
+	// UsernameClaim is the claim holding the username. If it is empty
+	// preferred_username is used, falling back to email, which must be
+	// verified (email_verified). If the value is an email address the
+	// username is its lower case local part.
+	UsernameClaim string
+	// Email addresses are only mapped to usernames if their domain is one of
+	// AllowedDomains, and if AllowedDomains is not empty the value of the
+	// username claim must be such an address. Google accounts must also
+	// belong to the Workspace of the domain (the hd claim).
+	AllowedDomains []string
+	// GroupsClaim is the claim holding the groups of the user, as a list of
+	// strings or a single string. If it is empty no groups are returned.
+	GroupsClaim string
+}
+
+// Identity is a user authenticated by the provider.
+type Identity struct {
+	Subject  string
+	Username string
+	Email    string
+	Groups   []string
+}
+
+type providerMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// RelyingParty authenticates users with an OpenID Connect provider.
+type RelyingParty struct {
+	config        Config
+	logger        log.DebugLogger
+	httpClient    *http.Client
+	mutex         sync.Mutex // Protect everything below.
+	metadata      *providerMetadata
+	oauth2Config  *oauth2.Config
+	keys          jose.JSONWebKeySet
+	keysFetchedAt time.Time
+}
+
+// New creates a RelyingParty for the provider in config. The provider is
+// contacted when it is first needed, so New does not fail if it is
+// unreachable.
+func New(config Config, logger log.DebugLogger) (*RelyingParty, error) {
+	return newRelyingParty(config, logger)
+}
+
+// AuthCodeURL returns the URL of the provider to redirect the browser to.
+// state is returned to the redirect URL and nonce must be passed to
+// Exchange.
+func (rp *RelyingParty) AuthCodeURL(state, nonce string) (string, error) {
+	return rp.authCodeURL(state, nonce)
+}
+
+// Exchange redeems the authorization code returned to the redirect URL,
+// within ctx, and validates the ID token in the response: its signature, issuer, audience,
+// expiry and nonce. It returns the identity of the user in the token.
+func (rp *RelyingParty) Exchange(ctx context.Context, code string,
+	nonce string) (*Identity, error) {
+	return rp.exchange(ctx, code, nonce)
+}
+
+// VerifyToken validates an ID token which was obtained outside of the
+// authorization code flow, such as the workload identity token of a CI job:
+// its signature, issuer, audience (the client ID) and expiry. Only the
+// Subject and Email of the returned identity are set.
+func (rp *RelyingParty) VerifyToken(rawIDToken string) (*Identity, error) {
+	return rp.verifyToken(rawIDToken)
+}
@@ -0,0 +1,371 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"golang.org/x/oauth2"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	discoveryPath         = "/.well-known/openid-configuration"
+	googleIssuer          = "https://accounts.google.com"
+	httpTimeout           = 10 * time.Second
+	keysMinRefetchPeriod  = time.Minute
+	maxResponseBodyLength = 1 << 20
+)
+
+// Only asymmetric algorithms are accepted, so a client secret can never be
+// used to forge an ID token.
+var allowedAlgorithms = map[string]struct{}{
+	string(jose.RS256): {},
+	string(jose.RS384): {},
+	string(jose.RS512): {},
+	string(jose.PS256): {},
+	string(jose.PS384): {},
+	string(jose.PS512): {},
+	string(jose.ES256): {},
+	string(jose.ES384): {},
+	string(jose.ES512): {},
+	string(jose.EdDSA): {},
+}
+
+type idTokenClaims struct {
+	jwt.Claims
+	AuthorizedParty string `json:"azp,omitempty"`
+	Nonce           string `json:"nonce,omitempty"`
+	Email           string `json:"email,omitempty"`
+}
+
+func newRelyingParty(config Config, logger log.DebugLogger) (
+	*RelyingParty, error) {
+	if config.IssuerURL == "" {
+		return nil, errors.New("missing issuer URL")
+	}
+	if config.ClientID == "" {
+		return nil, errors.New("missing client ID")
+	}
+	if !strings.HasPrefix(config.IssuerURL, "https://") {
+		logger.Printf("warning: OpenID Connect issuer %s does not use HTTPS",
+			config.IssuerURL)
+	}
+	return &RelyingParty{
+		config:     config,
+		logger:     logger,
+		httpClient: &http.Client{Timeout: httpTimeout},
+	}, nil
+}
+
+func (rp *RelyingParty) getJSON(url string, value interface{}) error {
+	resp, err := rp.httpClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body,
+		maxResponseBodyLength))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.Unmarshal(body, value)
+}
+
+// getMetadata returns the provider configuration, reading it if it has not
+// been read yet. rp.mutex must be held.
+func (rp *RelyingParty) getMetadata() (*providerMetadata, error) {
+	if rp.metadata != nil {
+		return rp.metadata, nil
+	}
+	var metadata providerMetadata
+	err := rp.getJSON(strings.TrimSuffix(rp.config.IssuerURL, "/")+
+		discoveryPath, &metadata)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read provider configuration: %s", err)
+	}
+	if metadata.Issuer != rp.config.IssuerURL {
+		return nil, fmt.Errorf("provider configuration is for issuer %s",
+			metadata.Issuer)
+	}
+	if metadata.JWKSURI == "" {
+		return nil, errors.New("incomplete provider configuration")
+	}
+	rp.metadata = &metadata
+	rp.logger.Debugf(1, "read OpenID Connect configuration of %s",
+		rp.config.IssuerURL)
+	return rp.metadata, nil
+}
+
+// getOAuth2Config returns the OAuth2 configuration of the provider, reading
+// the provider configuration if it has not been read yet. rp.mutex must be
+// held.
+func (rp *RelyingParty) getOAuth2Config() (*oauth2.Config, error) {
+	if rp.oauth2Config != nil {
+		return rp.oauth2Config, nil
+	}
+	metadata, err := rp.getMetadata()
+	if err != nil {
+		return nil, err
+	}
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" {
+		return nil, errors.New("incomplete provider configuration")
+	}
+	rp.oauth2Config = &oauth2.Config{
+		ClientID:     rp.config.ClientID,
+		ClientSecret: rp.config.ClientSecret,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  metadata.AuthorizationEndpoint,
+			TokenURL: metadata.TokenEndpoint,
+		},
+		RedirectURL: rp.config.RedirectURL,
+		Scopes:      append([]string{"openid"}, rp.config.Scopes...),
+	}
+	return rp.oauth2Config, nil
+}
+
+func (rp *RelyingParty) authCodeURL(state, nonce string) (string, error) {
+	rp.mutex.Lock()
+	defer rp.mutex.Unlock()
+	oauth2Config, err := rp.getOAuth2Config()
+	if err != nil {
+		return "", err
+	}
+	return oauth2Config.AuthCodeURL(state,
+		oauth2.SetAuthURLParam("nonce", nonce)), nil
+}
+
+// getKeys returns the keys with the ID keyID, fetching the key set of the
+// provider if it is not known. Key sets are fetched at most once every
+// keysMinRefetchPeriod, so tokens with bogus key IDs cannot be used to flood
+// the provider. rp.mutex must be held.
+func (rp *RelyingParty) getKeys(keyID string) ([]jose.JSONWebKey, error) {
+	if keys := rp.keys.Key(keyID); len(keys) > 0 {
+		return keys, nil
+	}
+	if time.Since(rp.keysFetchedAt) < keysMinRefetchPeriod {
+		return nil, fmt.Errorf("unknown key ID: %s", keyID)
+	}
+	metadata, err := rp.getMetadata()
+	if err != nil {
+		return nil, err
+	}
+	var keySet jose.JSONWebKeySet
+	if err := rp.getJSON(metadata.JWKSURI, &keySet); err != nil {
+		return nil, fmt.Errorf("cannot read provider keys: %s", err)
+	}
+	rp.keys = keySet
+	rp.keysFetchedAt = time.Now()
+	if keys := rp.keys.Key(keyID); len(keys) > 0 {
+		return keys, nil
+	}
+	return nil, fmt.Errorf("unknown key ID: %s", keyID)
+}
+
+func (rp *RelyingParty) exchange(ctx context.Context, code string,
+	nonce string) (*Identity, error) {
+	rp.mutex.Lock()
+	oauth2Config, err := rp.getOAuth2Config()
+	rp.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, rp.httpClient)
+	token, err := oauth2Config.Exchange(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok || rawIDToken == "" {
+		return nil, errors.New("no ID token in token response")
+	}
+	return rp.validateIDToken(rawIDToken, nonce)
+}
+
+// verifyIDToken checks the signature, issuer, audience and expiry of
+// rawIDToken and returns its claims.
+func (rp *RelyingParty) verifyIDToken(rawIDToken string) (
+	*idTokenClaims, map[string]interface{}, error) {
+	tok, err := jwt.ParseSigned(rawIDToken)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(tok.Headers) != 1 {
+		return nil, nil, errors.New("ID token must have one signature")
+	}
+	header := tok.Headers[0]
+	if _, ok := allowedAlgorithms[header.Algorithm]; !ok {
+		return nil, nil, fmt.Errorf("ID token algorithm %s is not allowed",
+			header.Algorithm)
+	}
+	rp.mutex.Lock()
+	keys, err := rp.getKeys(header.KeyID)
+	rp.mutex.Unlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	var claims idTokenClaims
+	var allClaims map[string]interface{}
+	verified := false
+	for _, key := range keys {
+		if err := tok.Claims(key.Key, &claims, &allClaims); err == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, nil, errors.New("invalid ID token signature")
+	}
+	err = claims.Claims.ValidateWithLeeway(jwt.Expected{
+		Issuer:   rp.config.IssuerURL,
+		Audience: jwt.Audience{rp.config.ClientID},
+		Time:     time.Now(),
+	}, jwt.DefaultLeeway)
+	if err != nil {
+		return nil, nil, err
+	}
+	if claims.Expiry == nil {
+		return nil, nil, errors.New("ID token has no expiry")
+	}
+	if len(claims.Audience) > 1 &&
+		claims.AuthorizedParty != rp.config.ClientID {
+		return nil, nil,
+			errors.New("ID token is not authorized for this client")
+	}
+	return &claims, allClaims, nil
+}
+
+func (rp *RelyingParty) validateIDToken(rawIDToken string, nonce string) (
+	*Identity, error) {
+	claims, allClaims, err := rp.verifyIDToken(rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Nonce != nonce {
+		return nil, errors.New("ID token nonce does not match")
+	}
+	username, err := rp.getUsername(allClaims)
+	if err != nil {
+		return nil, err
+	}
+	identity := &Identity{
+		Subject:  claims.Subject,
+		Username: username,
+		Email:    claims.Email,
+	}
+	if rp.config.GroupsClaim != "" {
+		identity.Groups, err = getStringsClaim(allClaims,
+			rp.config.GroupsClaim)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return identity, nil
+}
+
+// isEmailVerified returns true if the email_verified claim is true. Some
+// providers send it as a string.
+func isEmailVerified(claims map[string]interface{}) bool {
+	switch value := claims["email_verified"].(type) {
+	case bool:
+		return value
+	case string:
+		return value == "true"
+	}
+	return false
+}
+
+func (rp *RelyingParty) getUsername(claims map[string]interface{}) (
+	string, error) {
+	claimName := rp.config.UsernameClaim
+	if claimName == "" {
+		claimName = "preferred_username"
+		if value, _ := claims[claimName].(string); value == "" {
+			claimName = "email"
+		}
+	}
+	value, _ := claims[claimName].(string)
+	if value == "" {
+		return "", errors.New("ID token has no username claim")
+	}
+	if claimName == "email" && !isEmailVerified(claims) {
+		return "", fmt.Errorf("email address %s is not verified", value)
+	}
+	atIndex := strings.LastIndex(value, "@")
+	if atIndex < 0 {
+		if len(rp.config.AllowedDomains) > 0 {
+			return "", fmt.Errorf("username %s has no domain", value)
+		}
+		return value, nil
+	}
+	// Users of other domains could have the same local part.
+	if len(rp.config.AllowedDomains) < 1 {
+		return "", fmt.Errorf(
+			"cannot map %s to a username without allowed domains", value)
+	}
+	domain := strings.ToLower(value[atIndex+1:])
+	allowed := false
+	for _, allowedDomain := range rp.config.AllowedDomains {
+		if domain == strings.ToLower(allowedDomain) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return "", fmt.Errorf("domain of %s is not allowed", value)
+	}
+	// Any Google account may have a verified address of the domain, but
+	// only those managed by its Workspace have it as hosted domain.
+	if rp.config.IssuerURL == googleIssuer {
+		if hd, _ := claims["hd"].(string); strings.ToLower(hd) != domain {
+			return "", fmt.Errorf("%s is not an account of the %s Workspace",
+				value, domain)
+		}
+	}
+	if atIndex < 1 {
+		return "", fmt.Errorf("invalid username: %s", value)
+	}
+	return strings.ToLower(value[:atIndex]), nil
+}
+
+func getStringsClaim(claims map[string]interface{}, name string) (
+	[]string, error) {
+	switch value := claims[name].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{value}, nil
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, element := range value {
+			s, ok := element.(string)
+			if !ok {
+				return nil, fmt.Errorf("claim %s is not a list of strings",
+					name)
+			}
+			values = append(values, s)
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("claim %s is not a list of strings", name)
+	}
+}
+
+func (rp *RelyingParty) verifyToken(rawIDToken string) (*Identity, error) {
+	claims, _, err := rp.verifyIDToken(rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{Subject: claims.Subject, Email: claims.Email}, nil
+}
@@ -0,0 +1,345 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log/testlogger"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	testClientID = "keymaster"
+	testKeyID    = "key1"
+	testNonce    = "nonce1"
+)
+
+type testProvider struct {
+	t       *testing.T
+	server  *httptest.Server
+	key     *rsa.PrivateKey
+	keyID   string
+	claims  map[string]interface{}
+	jwksGet int
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testProvider{t: t, key: key, keyID: testKeyID}
+	mux := http.NewServeMux()
+	mux.HandleFunc(discoveryPath, p.discoveryHandler)
+	mux.HandleFunc("/jwks", p.jwksHandler)
+	mux.HandleFunc("/token", p.tokenHandler)
+	p.server = httptest.NewServer(mux)
+	p.claims = map[string]interface{}{
+		"iss":                p.server.URL,
+		"sub":                "12345",
+		"aud":                testClientID,
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"iat":                time.Now().Unix(),
+		"nonce":              testNonce,
+		"preferred_username": "Alice@example.com",
+		"email":              "alice@example.com",
+		"groups":             []string{"admins", "users"},
+	}
+	return p
+}
+
+func (p *testProvider) discoveryHandler(w http.ResponseWriter,
+	r *http.Request) {
+	json.NewEncoder(w).Encode(providerMetadata{
+		Issuer:                p.server.URL,
+		AuthorizationEndpoint: p.server.URL + "/authorize",
+		TokenEndpoint:         p.server.URL + "/token",
+		JWKSURI:               p.server.URL + "/jwks",
+	})
+}
+
+func (p *testProvider) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	p.jwksGet++
+	json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{
+		Key:       p.key.Public(),
+		KeyID:     p.keyID,
+		Algorithm: string(jose.RS256),
+		Use:       "sig",
+	}}})
+}
+
+func (p *testProvider) signToken() string {
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.RS256, Key: p.key},
+		(&jose.SignerOptions{}).WithHeader("kid", p.keyID))
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	idToken, err := jwt.Signed(signer).Claims(p.claims).CompactSerialize()
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	return idToken
+}
+
+func (p *testProvider) tokenHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     p.signToken(),
+	})
+}
+
+func (p *testProvider) newRelyingParty(t *testing.T, config Config) (
+	*RelyingParty, error) {
+	config.IssuerURL = p.server.URL
+	config.ClientID = testClientID
+	config.ClientSecret = "secret"
+	config.RedirectURL = "https://keymaster.example.com/auth/oauth2/callback"
+	return New(config, testlogger.New(t))
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	p := newTestProvider(t)
+	defer p.server.Close()
+	rp, err := p.newRelyingParty(t, Config{Scopes: []string{"email"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawURL, err := rp.AuthCodeURL("state1", testNonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	if u.Path != "/authorize" || query.Get("state") != "state1" ||
+		query.Get("nonce") != testNonce ||
+		query.Get("scope") != "openid email" {
+		t.Fatalf("unexpected URL: %s", rawURL)
+	}
+}
+
+func TestExchange(t *testing.T) {
+	p := newTestProvider(t)
+	defer p.server.Close()
+	rp, err := p.newRelyingParty(t, Config{
+		AllowedDomains: []string{"example.com"},
+		GroupsClaim:    "groups",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := rp.Exchange(context.Background(), "code", testNonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Subject != "12345" || identity.Username != "alice" ||
+		identity.Email != "alice@example.com" ||
+		len(identity.Groups) != 2 || identity.Groups[0] != "admins" {
+		t.Fatalf("unexpected identity: %+v", identity)
+	}
+	// Key sets are cached.
+	if _, err := rp.Exchange(context.Background(), "code",
+		testNonce); err != nil {
+		t.Fatal(err)
+	}
+	if p.jwksGet != 1 {
+		t.Fatalf("key set fetched %d times", p.jwksGet)
+	}
+}
+
+func TestExchangeUsernameClaim(t *testing.T) {
+	p := newTestProvider(t)
+	defer p.server.Close()
+	p.claims["upn"] = "bob"
+	rp, err := p.newRelyingParty(t, Config{UsernameClaim: "upn"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := rp.Exchange(context.Background(), "code", testNonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Username != "bob" || identity.Groups != nil {
+		t.Fatalf("unexpected identity: %+v", identity)
+	}
+}
+
+func TestExchangeInvalidTokens(t *testing.T) {
+	for name, test := range map[string]struct {
+		claim string
+		value interface{}
+		nonce string
+	}{
+		"wrong nonce":    {nonce: "other"},
+		"wrong audience": {claim: "aud", value: "other"},
+		"wrong issuer":   {claim: "iss", value: "https://other.example.com"},
+		"expired": {claim: "exp",
+			value: time.Now().Add(-time.Hour).Unix()},
+		"no expiry":        {claim: "exp"},
+		"wrong domain":     {claim: "preferred_username", value: "a@evil.com"},
+		"no username":      {claim: "preferred_username", value: ""},
+		"unverified email": {claim: "preferred_username"},
+		"wrong azp": {claim: "aud",
+			value: []string{testClientID, "other"}},
+		"invalid groups": {claim: "groups", value: 1},
+	} {
+		p := newTestProvider(t)
+		if test.claim != "" {
+			if test.value == nil {
+				delete(p.claims, test.claim)
+			} else {
+				p.claims[test.claim] = test.value
+			}
+		}
+		if test.claim == "preferred_username" && test.value == "" {
+			delete(p.claims, "email")
+		}
+		nonce := testNonce
+		if test.nonce != "" {
+			nonce = test.nonce
+		}
+		rp, err := p.newRelyingParty(t, Config{
+			AllowedDomains: []string{"example.com"},
+			GroupsClaim:    "groups",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := rp.Exchange(context.Background(), "code",
+			nonce); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+		p.server.Close()
+	}
+}
+
+func TestExchangeUnknownKey(t *testing.T) {
+	p := newTestProvider(t)
+	defer p.server.Close()
+	rp, err := p.newRelyingParty(t, Config{
+		AllowedDomains: []string{"example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rp.Exchange(context.Background(), "code",
+		testNonce); err != nil {
+		t.Fatal(err)
+	}
+	// A rotated key is not refetched within keysMinRefetchPeriod.
+	p.keyID = "key2"
+	if _, err := rp.Exchange(context.Background(), "code",
+		testNonce); err == nil {
+		t.Fatal("expected error for unknown key")
+	}
+	rp.keysFetchedAt = time.Now().Add(-keysMinRefetchPeriod)
+	if _, err := rp.Exchange(context.Background(), "code",
+		testNonce); err != nil {
+		t.Fatal(err)
+	}
+	if p.jwksGet != 2 {
+		t.Fatalf("key set fetched %d times", p.jwksGet)
+	}
+}
+
+func TestGetUsername(t *testing.T) {
+	for _, test := range []struct {
+		config   Config
+		claims   map[string]interface{}
+		username string
+	}{
+		{Config{}, map[string]interface{}{"preferred_username": "bob"}, "bob"},
+		// Email addresses need allowed domains.
+		{Config{},
+			map[string]interface{}{"preferred_username": "bob@example.com"},
+			""},
+		{Config{AllowedDomains: []string{"example.com"}},
+			map[string]interface{}{"preferred_username": "bob"}, ""},
+		{Config{AllowedDomains: []string{"example.com"}},
+			map[string]interface{}{"email": "Bob@example.com"}, ""},
+		{Config{AllowedDomains: []string{"example.com"}},
+			map[string]interface{}{"email": "Bob@example.com",
+				"email_verified": true}, "bob"},
+		{Config{AllowedDomains: []string{"example.com"}},
+			map[string]interface{}{"email": "Bob@example.com",
+				"email_verified": "true"}, "bob"},
+		// Google accounts must be managed by the Workspace of the domain.
+		{Config{IssuerURL: googleIssuer,
+			AllowedDomains: []string{"example.com"}},
+			map[string]interface{}{"email": "bob@example.com",
+				"email_verified": true}, ""},
+		{Config{IssuerURL: googleIssuer,
+			AllowedDomains: []string{"example.com"}},
+			map[string]interface{}{"email": "bob@example.com",
+				"email_verified": true, "hd": "example.com"}, "bob"},
+	} {
+		rp := &RelyingParty{config: test.config}
+		username, err := rp.getUsername(test.claims)
+		if test.username == "" {
+			if err == nil {
+				t.Errorf("%v with %+v should fail", test.claims, test.config)
+			}
+		} else if err != nil {
+			t.Errorf("%v with %+v: %s", test.claims, test.config, err)
+		} else if username != test.username {
+			t.Errorf("%v with %+v: got %s, expected %s", test.claims,
+				test.config, username, test.username)
+		}
+	}
+}
+
+func TestVerifyToken(t *testing.T) {
+	p := newTestProvider(t)
+	defer p.server.Close()
+	// Workload tokens have no nonce and no username.
+	delete(p.claims, "nonce")
+	delete(p.claims, "preferred_username")
+	delete(p.claims, "email")
+	rp, err := p.newRelyingParty(t, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := rp.VerifyToken(p.signToken())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Subject != "12345" || identity.Username != "" {
+		t.Fatalf("unexpected identity: %+v", identity)
+	}
+	p.claims["aud"] = "other"
+	if _, err := rp.VerifyToken(p.signToken()); err == nil {
+		t.Fatal("expected error for wrong audience")
+	}
+	p.claims["aud"] = testClientID
+	p.claims["exp"] = time.Now().Add(-time.Hour).Unix()
+	if _, err := rp.VerifyToken(p.signToken()); err == nil {
+		t.Fatal("expected error for expired token")
+	}
+	if _, err := rp.VerifyToken("not a token"); err == nil {
+		t.Fatal("expected error for malformed token")
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	for _, config := range []Config{
+		{ClientID: testClientID},
+		{IssuerURL: "https://issuer.example.com"},
+	} {
+		if _, err := New(config, testlogger.New(t)); err == nil {
+			t.Fatalf("%+v should fail", config)
+		}
+	}
+}
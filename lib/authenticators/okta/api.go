@@ -14,13 +14,74 @@ import (
 type authCacheData struct {
 	response OktaApiPrimaryResponseType
 	expires  time.Time
+	checked  time.Time
+	lastUsed time.Time
 }
 
 type PasswordAuthenticator struct {
-	authnURL   string
-	logger     log.DebugLogger
-	mutex      sync.Mutex
-	recentAuth map[string]authCacheData
+	authnURL        string
+	requireHTTPS    bool
+	logger          log.DebugLogger
+	mutex           sync.Mutex
+	recentAuth      map[string]authCacheData
+	storage         simplestorage.SimpleStore
+	cacheTTL        time.Duration
+	maxCacheEntries int
+	revalidateStop  chan struct{}
+	revalidateDone  chan struct{}
+	sweepStop       chan struct{}
+	sweepDone       chan struct{}
+}
+
+// CacheConfig controls the cache of primary authentications, which later
+// second factor checks need.
+type CacheConfig struct {
+	// Entries expire after TTL, or earlier if Okta says so. Zero means the
+	// Okta expiry, or one minute if Okta gives none.
+	TTL time.Duration
+	// At most MaxEntries are kept in memory, evicting the least recently
+	// used. Zero means 10000.
+	MaxEntries int
+	// Expired entries are removed every SweepInterval. Zero means one
+	// minute.
+	SweepInterval time.Duration
+}
+
+// CacheRevalidationConfig controls the background revalidation of cached
+// primary authentications.
+type CacheRevalidationConfig struct {
+	APIToken        string        // Okta API token used to read user status.
+	Interval        time.Duration // Time between revalidation runs.
+	MaxChecksPerRun int           // Zero means check every cached user.
+}
+
+// UserFactor describes an MFA factor available to a user.
+type UserFactor struct {
+	Id         string
+	FactorType string // Such as "push", "token:software:totp" or "webauthn".
+	Provider   string
+	VendorName string
+	Status     string // Enrollment state such as "ACTIVE" or "NOT_SETUP".
+}
+
+// WebAuthnChallenge is a challenge issued by Okta for the WebAuthn
+// authenticators enrolled by a user. Challenge and CredentialIds are
+// base64url encoded, as provided by Okta. The authenticators are scoped to
+// the Okta organisation, so assertions must be made for RPID and the client
+// data must name Origin.
+type WebAuthnChallenge struct {
+	Challenge     string
+	CredentialIds []string
+	RPID          string
+	Origin        string
+}
+
+// WebAuthnAssertion is the response of a browser WebAuthn authenticator to a
+// WebAuthnChallenge. All fields are base64url encoded.
+type WebAuthnAssertion struct {
+	ClientData        string
+	AuthenticatorData string
+	SignatureData     string
 }
 
 type PushResponse int
@@ -34,7 +95,8 @@ const (
 
 // New creates a new PasswordAuthenticator using Okta as the backend. The Okta
 // Public Application API is used, so rate limits apply.
-// The Okta domain to check must be given by oktaDomain.
+// The Okta domain to check must be given by oktaDomain. Credentials are only
+// ever sent over HTTPS.
 // Log messages are written to logger. A new *PasswordAuthenticator is returned.
 func NewPublic(oktaDomain string, logger log.DebugLogger) (
 	*PasswordAuthenticator, error) {
@@ -43,15 +105,11 @@ func NewPublic(oktaDomain string, logger log.DebugLogger) (
 
 // NewPublicTesting creates a new public authenticator, but
 // pointing to an explicit authenticator url intead of okta urls.
+// Plaintext http URLs are permitted, but a warning is logged.
 // Log messages are written to logger. A new *PasswordAuthenticator is returned.
 func NewPublicTesting(authnURL string, logger log.DebugLogger) (
 	*PasswordAuthenticator, error) {
-	pa, err := newPublicAuthenticator("example.com", logger)
-	if err != nil {
-		return pa, err
-	}
-	pa.authnURL = authnURL
-	return pa, nil
+	return newPublicTestingAuthenticator(authnURL, logger)
 }
 
 // PasswordAuthenticate will authenticate a user using the provided username and
@@ -63,8 +121,12 @@ func (pa *PasswordAuthenticator) PasswordAuthenticate(username string,
 	return pa.passwordAuthenticate(username, password)
 }
 
+// UpdateStorage makes the authenticator also keep cached primary
+// authentications in storage, so that they are shared with the other
+// authenticators using it. Entries evicted from memory are then loaded from
+// storage.
 func (pa *PasswordAuthenticator) UpdateStorage(storage simplestorage.SimpleStore) error {
-	return nil
+	return pa.updateStorage(storage)
 }
 
 // ValidateUserOTP validates the otp value for an authenticated user.
@@ -74,6 +136,67 @@ func (pa *PasswordAuthenticator) ValidateUserOTP(username string, otpValue int)
 	return pa.validateUserOTP(username, otpValue)
 }
 
+// ValidateUserOTPWithProvider validates the otp value for an authenticated
+// user against the TOTP factor from the specified provider (such as "OKTA"
+// or "GOOGLE").
+// Assumes the user has a recent password authentication transaction.
+// Returns true if the OTP value is valid according to okta, false otherwise.
+func (pa *PasswordAuthenticator) ValidateUserOTPWithProvider(username string,
+	provider string, otpValue int) (bool, error) {
+	return pa.validateUserOTPWithProvider(username, provider, otpValue)
+}
+
+// GetUserFactors returns the MFA factors available to a user that has a
+// recent password authentication transaction. If there is no such
+// transaction, nil is returned. Users who have yet to enroll (Okta status
+// MFA_ENROLL) are returned the factors they may enroll, with their Status
+// set to NOT_SETUP.
+func (pa *PasswordAuthenticator) GetUserFactors(username string) (
+	[]UserFactor, error) {
+	return pa.getUserFactors(username)
+}
+
+// GetEnrolledFactors returns all the factors enrolled by a user, using the
+// Okta Factors API. Unlike GetUserFactors it does not require a recent
+// password authentication transaction, but it requires an Okta API token.
+func (pa *PasswordAuthenticator) GetEnrolledFactors(username string,
+	apiToken string) ([]UserFactor, error) {
+	return pa.getEnrolledFactors(username, apiToken)
+}
+
+// StartWebAuthnVerify requests a challenge for the Okta registered WebAuthn
+// authenticators of a user with a recent password authentication
+// transaction. If the user has no such transaction or no WebAuthn factors,
+// nil is returned.
+func (pa *PasswordAuthenticator) StartWebAuthnVerify(username string) (
+	*WebAuthnChallenge, error) {
+	return pa.startWebAuthnVerify(username)
+}
+
+// ValidateWebAuthnAssertion verifies an assertion made in response to the
+// challenge from StartWebAuthnVerify.
+// Returns true if Okta accepts the assertion, false otherwise.
+func (pa *PasswordAuthenticator) ValidateWebAuthnAssertion(username string,
+	assertion WebAuthnAssertion) (bool, error) {
+	return pa.validateWebAuthnAssertion(username, assertion)
+}
+
+// StartCacheRevalidation starts a background task which periodically checks
+// the Okta status of users with cached primary authentications and evicts
+// entries for users that are no longer active. Revalidation is disabled
+// unless this is called. The task runs for the life of the process.
+func (pa *PasswordAuthenticator) StartCacheRevalidation(
+	config CacheRevalidationConfig) error {
+	return pa.startCacheRevalidation(config)
+}
+
+// ConfigureCache sets the TTL and size of the cache of primary
+// authentications and starts a background task removing expired entries,
+// which runs for the life of the process.
+func (pa *PasswordAuthenticator) ConfigureCache(config CacheConfig) error {
+	return pa.configureCache(config)
+}
+
 // ValidateUserPush initializes or checks if a user MFA push has succeed for
 // a specific user. Returns one of PushRessponse.
 func (pa *PasswordAuthenticator) ValidateUserPush(username string) (PushResponse, error) {
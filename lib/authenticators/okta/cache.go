@@ -0,0 +1,213 @@
+package okta
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/simplestorage"
+)
+
+const (
+	// lib/pwauth/ldap stores password hashes with data type 1.
+	authCacheDataType         = 2
+	defaultCacheTTL           = time.Minute
+	defaultMaxCacheEntries    = 10000
+	defaultCacheSweepInterval = time.Minute
+)
+
+// storedAuthCacheData is the JSON encoded authCacheData kept in storage.
+type storedAuthCacheData struct {
+	Response OktaApiPrimaryResponseType `json:"response"`
+	Expires  time.Time                  `json:"expires"`
+}
+
+func (pa *PasswordAuthenticator) updateStorage(
+	storage simplestorage.SimpleStore) error {
+	pa.mutex.Lock()
+	defer pa.mutex.Unlock()
+	pa.storage = storage
+	return nil
+}
+
+func (pa *PasswordAuthenticator) configureCache(config CacheConfig) error {
+	if config.TTL < 0 || config.MaxEntries < 0 || config.SweepInterval < 0 {
+		return errors.New("negative cache setting")
+	}
+	sweepInterval := config.SweepInterval
+	if sweepInterval == 0 {
+		sweepInterval = defaultCacheSweepInterval
+	}
+	pa.mutex.Lock()
+	defer pa.mutex.Unlock()
+	if pa.sweepStop != nil {
+		return errors.New("cache already configured")
+	}
+	pa.cacheTTL = config.TTL
+	pa.maxCacheEntries = config.MaxEntries
+	pa.evictLeastRecentlyUsed()
+	pa.sweepStop = make(chan struct{})
+	pa.sweepDone = make(chan struct{})
+	go pa.sweepLoop(sweepInterval, pa.sweepStop, pa.sweepDone)
+	return nil
+}
+
+// getCacheExpiration returns when to expire an authentication which Okta
+// says expires at oktaExpires, which is zero if Okta gave no expiry.
+func (pa *PasswordAuthenticator) getCacheExpiration(
+	oktaExpires time.Time) time.Time {
+	pa.mutex.Lock()
+	ttl := pa.cacheTTL
+	pa.mutex.Unlock()
+	if ttl == 0 {
+		if oktaExpires.IsZero() {
+			return time.Now().Add(defaultCacheTTL)
+		}
+		return oktaExpires
+	}
+	expires := time.Now().Add(ttl)
+	if !oktaExpires.IsZero() && oktaExpires.Before(expires) {
+		return oktaExpires
+	}
+	return expires
+}
+
+// cacheAuth caches the authentication of username in memory and, if set,
+// in storage. Failures to write to storage are only logged.
+func (pa *PasswordAuthenticator) cacheAuth(username string,
+	userData authCacheData) {
+	userData.lastUsed = time.Now()
+	pa.mutex.Lock()
+	pa.recentAuth[username] = userData
+	pa.evictLeastRecentlyUsed()
+	storage := pa.storage
+	pa.mutex.Unlock()
+	if storage == nil {
+		return
+	}
+	encoded, err := json.Marshal(storedAuthCacheData{
+		Response: userData.response,
+		Expires:  userData.expires,
+	})
+	if err == nil {
+		err = storage.UpsertSigned(username, authCacheDataType,
+			userData.expires.Unix(), string(encoded))
+	}
+	if err != nil {
+		pa.logger.Printf("Okta Authenticator: cannot store authentication of %s: %s",
+			username, err)
+	}
+}
+
+// getCachedAuth returns the unexpired cached authentication of username,
+// loading it from storage if it is not in memory, or nil if there is none.
+func (pa *PasswordAuthenticator) getCachedAuth(username string) (
+	*authCacheData, error) {
+	now := time.Now()
+	pa.mutex.Lock()
+	userData, ok := pa.recentAuth[username]
+	if ok {
+		defer pa.mutex.Unlock()
+		if userData.expires.Before(now) {
+			delete(pa.recentAuth, username)
+			return nil, nil
+		}
+		userData.lastUsed = now
+		pa.recentAuth[username] = userData
+		return &userData, nil
+	}
+	storage := pa.storage
+	pa.mutex.Unlock()
+	if storage == nil {
+		return nil, nil
+	}
+	ok, encoded, err := storage.GetSigned(username, authCacheDataType)
+	if err != nil || !ok {
+		return nil, err
+	}
+	var stored storedAuthCacheData
+	if err := json.Unmarshal([]byte(encoded), &stored); err != nil {
+		return nil, err
+	}
+	if stored.Expires.Before(now) {
+		return nil, nil
+	}
+	userData = authCacheData{
+		response: stored.Response,
+		expires:  stored.Expires,
+		lastUsed: now,
+	}
+	pa.mutex.Lock()
+	pa.recentAuth[username] = userData
+	pa.evictLeastRecentlyUsed()
+	pa.mutex.Unlock()
+	return &userData, nil
+}
+
+// deleteCachedAuth removes the authentication of username from memory and
+// storage.
+func (pa *PasswordAuthenticator) deleteCachedAuth(username string) {
+	pa.mutex.Lock()
+	delete(pa.recentAuth, username)
+	storage := pa.storage
+	pa.mutex.Unlock()
+	if storage == nil {
+		return
+	}
+	if err := storage.DeleteSigned(username, authCacheDataType); err != nil {
+		pa.logger.Printf("Okta Authenticator: cannot delete authentication of %s: %s",
+			username, err)
+	}
+}
+
+// evictLeastRecentlyUsed removes entries from memory until there are at
+// most maxCacheEntries. The mutex must be held.
+func (pa *PasswordAuthenticator) evictLeastRecentlyUsed() {
+	maxEntries := pa.maxCacheEntries
+	if maxEntries < 1 {
+		maxEntries = defaultMaxCacheEntries
+	}
+	for len(pa.recentAuth) > maxEntries {
+		var oldestUsername string
+		var oldest time.Time
+		first := true
+		for username, userData := range pa.recentAuth {
+			if first || userData.lastUsed.Before(oldest) {
+				oldestUsername = username
+				oldest = userData.lastUsed
+				first = false
+			}
+		}
+		delete(pa.recentAuth, oldestUsername)
+		pa.logger.Debugf(1, "Okta Authenticator: evicted least recently used %s",
+			oldestUsername)
+	}
+}
+
+func (pa *PasswordAuthenticator) sweepLoop(interval time.Duration,
+	stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			pa.sweepCache()
+		}
+	}
+}
+
+// sweepCache removes the expired entries from memory. Storage expires its
+// entries itself.
+func (pa *PasswordAuthenticator) sweepCache() {
+	now := time.Now()
+	pa.mutex.Lock()
+	defer pa.mutex.Unlock()
+	for username, userData := range pa.recentAuth {
+		if userData.expires.Before(now) {
+			delete(pa.recentAuth, username)
+		}
+	}
+}
@@ -3,8 +3,12 @@ package okta
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/Cloud-Foundations/golib/pkg/log"
@@ -14,23 +18,54 @@ const (
 	authPath               = "/api/v1/authn"
 	authEndpointFormat     = "https://%s.okta.com" + authPath
 	factorsVerifyPathExtra = "/factors/%s/verify"
+	usersPath              = "/api/v1/users/"
+	userFactorsPathExtra   = "/factors"
+	webAuthnFactorType     = "webauthn"
+	userStatusTimeout      = 10 * time.Second
 )
 
+// statusClient is used by the background cache revalidation, where no
+// client request bounds how long Okta may take to answer.
+var statusClient = &http.Client{Timeout: userStatusTimeout}
+
 type OktaApiVerifyTOTPFactorDataType struct {
 	StateToken string `json:"stateToken,omitempty"`
 	PassCode   string `json:"passCode,omitempty"`
 }
 
+type OktaApiVerifyWebAuthnFactorDataType struct {
+	StateToken        string `json:"stateToken,omitempty"`
+	ClientData        string `json:"clientData,omitempty"`
+	AuthenticatorData string `json:"authenticatorData,omitempty"`
+	SignatureData     string `json:"signatureData,omitempty"`
+}
+
 type OktaApiLoginDataType struct {
 	Password string `json:"password,omitempty"`
 	Username string `json:"username,omitempty"`
 }
 
+type OktaApiFactorProfileType struct {
+	CredentialId      string `json:"credentialId,omitempty"`
+	AuthenticatorName string `json:"authenticatorName,omitempty"`
+}
+
+type OktaApiChallengeType struct {
+	Challenge string `json:"challenge,omitempty"`
+}
+
+type OktaApiFactorEmbeddedType struct {
+	Challenge OktaApiChallengeType `json:"challenge,omitempty"`
+}
+
 type OktaApiMFAFactorsType struct {
-	Id         string `json:"id,omitempty"`
-	FactorType string `json:"factorType,omitempty"`
-	Provider   string `json:"provider,omitempty"`
-	VendorName string `json:"vendorName,omitempty"`
+	Id         string                    `json:"id,omitempty"`
+	FactorType string                    `json:"factorType,omitempty"`
+	Provider   string                    `json:"provider,omitempty"`
+	VendorName string                    `json:"vendorName,omitempty"`
+	Status     string                    `json:"status,omitempty"`
+	Profile    OktaApiFactorProfileType  `json:"profile,omitempty"`
+	Embedded   OktaApiFactorEmbeddedType `json:"_embedded,omitempty"`
 }
 
 type OktaApiUserProfileType struct {
@@ -45,6 +80,9 @@ type OktaApiUserInfoType struct {
 type OktaApiEmbeddedDataResponseType struct {
 	User   OktaApiUserInfoType     `json:"user,omitempty"`
 	Factor []OktaApiMFAFactorsType `json:"factors,omitempty"`
+	// Challenge responses for a single factor embed it here.
+	ChallengeFactor OktaApiMFAFactorsType `json:"factor,omitempty"`
+	Challenge       OktaApiChallengeType  `json:"challenge,omitempty"`
 }
 
 type OktaApiPrimaryResponseType struct {
@@ -54,6 +92,11 @@ type OktaApiPrimaryResponseType struct {
 	Embedded        OktaApiEmbeddedDataResponseType `json:"_embedded,omitempty"`
 }
 
+type OktaApiUserStatusType struct {
+	Id     string `json:"id,omitempty"`
+	Status string `json:"status,omitempty"`
+}
+
 type OktaApiPushResponseType struct {
 	ExpiresAtString string                          `json:"expiresAt,omitempty"`
 	Status          string                          `json:"status,omitempty"`
@@ -63,13 +106,53 @@ type OktaApiPushResponseType struct {
 
 func newPublicAuthenticator(oktaDomain string, logger log.DebugLogger) (
 	*PasswordAuthenticator, error) {
+	if strings.Contains(oktaDomain, "/") {
+		return nil, fmt.Errorf("invalid okta domain: %s", oktaDomain)
+	}
+	pa := &PasswordAuthenticator{
+		authnURL:     fmt.Sprintf(authEndpointFormat, oktaDomain),
+		requireHTTPS: true,
+		logger:       logger,
+		recentAuth:   make(map[string]authCacheData),
+	}
+	if err := pa.checkURL(pa.authnURL); err != nil {
+		return nil, err
+	}
+	return pa, nil
+}
+
+func newPublicTestingAuthenticator(authnURL string,
+	logger log.DebugLogger) (*PasswordAuthenticator, error) {
+	parsedURL, err := url.Parse(authnURL)
+	if err != nil {
+		return nil, err
+	}
+	if parsedURL.Scheme != "https" {
+		logger.Printf("WARNING: Okta authnURL %s is not HTTPS, credentials will be sent in the clear",
+			authnURL)
+	}
 	return &PasswordAuthenticator{
-		authnURL:   fmt.Sprintf(authEndpointFormat, oktaDomain),
+		authnURL:   authnURL,
 		logger:     logger,
 		recentAuth: make(map[string]authCacheData),
 	}, nil
 }
 
+// checkURL returns an error if credentials must not be sent to targetURL.
+func (pa *PasswordAuthenticator) checkURL(targetURL string) error {
+	parsedURL, err := url.Parse(targetURL)
+	if err != nil {
+		return err
+	}
+	if parsedURL.Host == "" {
+		return fmt.Errorf("no host in URL: %s", targetURL)
+	}
+	if parsedURL.Scheme == "https" || !pa.requireHTTPS {
+		return nil
+	}
+	return fmt.Errorf("refusing to use non HTTPS URL: %s", targetURL)
+}
+
 func (pa *PasswordAuthenticator) passwordAuthenticate(username string,
 	password []byte) (bool, error) {
 	loginData := OktaApiLoginDataType{Password: string(password), Username: username}
@@ -79,6 +162,9 @@ func (pa *PasswordAuthenticator) passwordAuthenticate(username string,
 	if err := encoder.Encode(loginData); err != nil {
 		return false, err
 	}
+	if err := pa.checkURL(pa.authnURL); err != nil {
+		return false, err
+	}
 	req, err := http.NewRequest("POST", pa.authnURL, body)
 	if err != nil {
 		return false, err
@@ -103,15 +189,15 @@ func (pa *PasswordAuthenticator) passwordAuthenticate(username string,
 	}
 	pa.logger.Debugf(1, "Okta Authenticator: oktaresponse=%+v", response)
 	switch response.Status {
-	case "SUCCESS", "MFA_REQUIRED":
-		expires, err := time.Parse(time.RFC3339, response.ExpiresAtString)
+	case "SUCCESS", "MFA_REQUIRED", "MFA_ENROLL":
+		oktaExpires, err := time.Parse(time.RFC3339, response.ExpiresAtString)
 		if err != nil {
-			expires = time.Now().Add(time.Second * 60)
+			oktaExpires = time.Time{}
 		}
-		toCache := authCacheData{response: response, expires: expires}
-		pa.mutex.Lock()
-		pa.recentAuth[username] = toCache
-		pa.mutex.Unlock()
+		pa.cacheAuth(username, authCacheData{
+			response: response,
+			expires:  pa.getCacheExpiration(oktaExpires),
+		})
 		return true, nil
 	default:
 		return false, nil
@@ -119,21 +205,96 @@ func (pa *PasswordAuthenticator) passwordAuthenticate(username string,
 }
 
 func (pa *PasswordAuthenticator) getValidUserResponse(username string) (*OktaApiPrimaryResponseType, error) {
-	pa.mutex.Lock()
-	userData, ok := pa.recentAuth[username]
-	defer pa.mutex.Unlock()
-	if !ok {
-		return nil, nil
+	userData, err := pa.getCachedAuth(username)
+	if err != nil || userData == nil {
+		return nil, err
 	}
-	if userData.expires.Before(time.Now()) {
-		delete(pa.recentAuth, username)
+	return &userData.response, nil
+}
+
+// factorMatches returns true if factor is of factorType and comes from
+// provider. An empty provider selects factors whose vendor is OKTA.
+func factorMatches(factor OktaApiMFAFactorsType, factorType string,
+	provider string) bool {
+	if factor.FactorType != factorType {
+		return false
+	}
+	if provider == "" {
+		return factor.VendorName == "OKTA"
+	}
+	return factor.Provider == provider
+}
+
+func (pa *PasswordAuthenticator) getUserFactors(username string) (
+	[]UserFactor, error) {
+	userResponse, err := pa.getValidUserResponse(username)
+	if err != nil {
+		return nil, err
+	}
+	if userResponse == nil {
 		return nil, nil
+	}
+	return convertFactors(userResponse.Embedded.Factor), nil
+}
 
+func convertFactors(apiFactors []OktaApiMFAFactorsType) []UserFactor {
+	factors := make([]UserFactor, 0, len(apiFactors))
+	for _, factor := range apiFactors {
+		factors = append(factors, UserFactor{
+			Id:         factor.Id,
+			FactorType: factor.FactorType,
+			Provider:   factor.Provider,
+			VendorName: factor.VendorName,
+			Status:     factor.Status,
+		})
 	}
-	return &userData.response, nil
+	return factors
+}
+
+func (pa *PasswordAuthenticator) getEnrolledFactors(username string,
+	apiToken string) ([]UserFactor, error) {
+	if apiToken == "" {
+		return nil, errors.New("no API token for listing factors")
+	}
+	userId := username
+	pa.mutex.Lock()
+	if userData, ok := pa.recentAuth[username]; ok &&
+		userData.response.Embedded.User.Id != "" {
+		userId = userData.response.Embedded.User.Id
+	}
+	pa.mutex.Unlock()
+	factorsURL := strings.TrimSuffix(pa.authnURL, authPath) + usersPath +
+		url.PathEscape(userId) + userFactorsPathExtra
+	if err := pa.checkURL(factorsURL); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", factorsURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Authorization", "SSWS "+apiToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status: %s", resp.Status)
+	}
+	var response []OktaApiMFAFactorsType
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+	return convertFactors(response), nil
 }
 
 func (pa *PasswordAuthenticator) validateUserOTP(username string, otpValue int) (bool, error) {
+	return pa.validateUserOTPWithProvider(username, "", otpValue)
+}
+
+func (pa *PasswordAuthenticator) validateUserOTPWithProvider(username string,
+	provider string, otpValue int) (bool, error) {
 	userResponse, err := pa.getValidUserResponse(username)
 	if err != nil {
 		return false, err
@@ -143,7 +304,7 @@ func (pa *PasswordAuthenticator) validateUserOTP(username string, otpValue int)
 	}
 
 	for _, factor := range userResponse.Embedded.Factor {
-		if !(factor.FactorType == "token:software:totp" && factor.VendorName == "OKTA") {
+		if !factorMatches(factor, "token:software:totp", provider) {
 			continue
 		}
 		authURL := fmt.Sprintf(pa.authnURL+factorsVerifyPathExtra, factor.Id)
@@ -159,6 +320,9 @@ func (pa *PasswordAuthenticator) validateUserOTP(username string, otpValue int)
 		if err := encoder.Encode(verifyStruct); err != nil {
 			return false, err
 		}
+		if err := pa.checkURL(authURL); err != nil {
+			return false, err
+		}
 		req, err := http.NewRequest("POST", authURL, body)
 		if err != nil {
 			return false, err
@@ -199,7 +363,7 @@ func (pa *PasswordAuthenticator) validateUserPush(username string) (PushResponse
 		return PushResponseRejected, nil
 	}
 	for _, factor := range userResponse.Embedded.Factor {
-		if !(factor.FactorType == "push" && factor.VendorName == "OKTA") {
+		if !factorMatches(factor, "push", "") {
 			continue
 		}
 		authURL := fmt.Sprintf(pa.authnURL+factorsVerifyPathExtra, factor.Id)
@@ -214,6 +378,9 @@ func (pa *PasswordAuthenticator) validateUserPush(username string) (PushResponse
 		if err := encoder.Encode(verifyStruct); err != nil {
 			return PushResponseRejected, err
 		}
+		if err := pa.checkURL(authURL); err != nil {
+			return PushResponseRejected, err
+		}
 		req, err := http.NewRequest("POST", authURL, body)
 		if err != nil {
 			return PushResponseRejected, err
@@ -254,3 +421,280 @@ func (pa *PasswordAuthenticator) validateUserPush(username string) (PushResponse
 	}
 	return PushResponseRejected, nil
 }
+
+// postFactorVerify posts request to the verify endpoint of factorId and
+// decodes the response. A nil response means Okta rejected the request.
+func (pa *PasswordAuthenticator) postFactorVerify(factorId string,
+	request interface{}) (*OktaApiPushResponseType, error) {
+	authURL := fmt.Sprintf(pa.authnURL+factorsVerifyPathExtra, factorId)
+	pa.logger.Debugf(2, "AuthURL=%s", authURL)
+	body := &bytes.Buffer{}
+	encoder := json.NewEncoder(body)
+	encoder.SetIndent("", "    ") // Make life easier for debugging.
+	if err := encoder.Encode(request); err != nil {
+		return nil, err
+	}
+	if err := pa.checkURL(authURL); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", authURL, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusForbidden ||
+		resp.StatusCode == http.StatusUnauthorized {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status: %s", resp.Status)
+	}
+	var response OktaApiPushResponseType
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+func hasWebAuthnFactor(factors []OktaApiMFAFactorsType) bool {
+	for _, factor := range factors {
+		if factor.FactorType == webAuthnFactorType {
+			return true
+		}
+	}
+	return false
+}
+
+func (pa *PasswordAuthenticator) startWebAuthnVerify(username string) (
+	*WebAuthnChallenge, error) {
+	userResponse, err := pa.getValidUserResponse(username)
+	if err != nil {
+		return nil, err
+	}
+	if userResponse == nil || !hasWebAuthnFactor(userResponse.Embedded.Factor) {
+		return nil, nil
+	}
+	// Verifying by factor type gets a single challenge which any of the
+	// enrolled WebAuthn authenticators can sign.
+	response, err := pa.postFactorVerify(webAuthnFactorType,
+		OktaApiVerifyTOTPFactorDataType{StateToken: userResponse.StateToken})
+	if err != nil {
+		return nil, err
+	}
+	if response == nil || response.Status != "MFA_CHALLENGE" {
+		return nil, errors.New("okta did not issue a WebAuthn challenge")
+	}
+	parsedURL, err := url.Parse(pa.authnURL)
+	if err != nil {
+		return nil, err
+	}
+	embedded := response.Embedded
+	challenge := &WebAuthnChallenge{
+		Challenge: embedded.Challenge.Challenge,
+		RPID:      parsedURL.Hostname(),
+		Origin:    parsedURL.Scheme + "://" + parsedURL.Host,
+	}
+	if challenge.Challenge == "" {
+		challenge.Challenge = embedded.ChallengeFactor.Embedded.Challenge.Challenge
+	}
+	if challenge.Challenge == "" {
+		return nil, errors.New("no challenge in okta response")
+	}
+	factors := embedded.Factor
+	if embedded.ChallengeFactor.Id != "" {
+		factors = append(factors, embedded.ChallengeFactor)
+	}
+	if len(factors) < 1 {
+		factors = userResponse.Embedded.Factor
+	}
+	for _, factor := range factors {
+		if factor.FactorType == webAuthnFactorType &&
+			factor.Profile.CredentialId != "" {
+			challenge.CredentialIds = append(challenge.CredentialIds,
+				factor.Profile.CredentialId)
+		}
+	}
+	return challenge, nil
+}
+
+func (pa *PasswordAuthenticator) validateWebAuthnAssertion(username string,
+	assertion WebAuthnAssertion) (bool, error) {
+	userResponse, err := pa.getValidUserResponse(username)
+	if err != nil {
+		return false, err
+	}
+	if userResponse == nil || !hasWebAuthnFactor(userResponse.Embedded.Factor) {
+		return false, nil
+	}
+	response, err := pa.postFactorVerify(webAuthnFactorType,
+		OktaApiVerifyWebAuthnFactorDataType{
+			StateToken:        userResponse.StateToken,
+			ClientData:        assertion.ClientData,
+			AuthenticatorData: assertion.AuthenticatorData,
+			SignatureData:     assertion.SignatureData,
+		})
+	if err != nil {
+		return false, err
+	}
+	if response == nil || response.Status != "SUCCESS" {
+		return false, nil
+	}
+	return true, nil
+}
+
+func (pa *PasswordAuthenticator) startCacheRevalidation(
+	config CacheRevalidationConfig) error {
+	if config.APIToken == "" {
+		return errors.New("no API token for cache revalidation")
+	}
+	if config.Interval <= 0 {
+		return errors.New("cache revalidation interval must be positive")
+	}
+	if err := pa.checkURL(pa.authnURL); err != nil {
+		return err
+	}
+	pa.mutex.Lock()
+	defer pa.mutex.Unlock()
+	if pa.revalidateStop != nil {
+		return errors.New("cache revalidation already started")
+	}
+	pa.revalidateStop = make(chan struct{})
+	pa.revalidateDone = make(chan struct{})
+	go pa.revalidateLoop(config, pa.revalidateStop, pa.revalidateDone)
+	return nil
+}
+
+// close stops any background tasks, so that tests do not leak them. It is
+// safe to call if none were started.
+func (pa *PasswordAuthenticator) close() error {
+	pa.mutex.Lock()
+	stops := []chan struct{}{pa.revalidateStop, pa.sweepStop}
+	dones := []chan struct{}{pa.revalidateDone, pa.sweepDone}
+	pa.revalidateStop = nil
+	pa.revalidateDone = nil
+	pa.sweepStop = nil
+	pa.sweepDone = nil
+	pa.mutex.Unlock()
+	for i, stop := range stops {
+		if stop != nil {
+			close(stop)
+			<-dones[i]
+		}
+	}
+	return nil
+}
+
+func (pa *PasswordAuthenticator) revalidateLoop(
+	config CacheRevalidationConfig, stop <-chan struct{},
+	done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			pa.revalidateCache(config, stop)
+		}
+	}
+}
+
+// revalidateCache checks the least recently checked cache entries, up to
+// config.MaxChecksPerRun, and evicts those for inactive users.
+func (pa *PasswordAuthenticator) revalidateCache(
+	config CacheRevalidationConfig, stop <-chan struct{}) {
+	type candidate struct {
+		username string
+		userId   string
+		checked  time.Time
+	}
+	var candidates []candidate
+	pa.mutex.Lock()
+	for username, userData := range pa.recentAuth {
+		candidates = append(candidates, candidate{
+			username: username,
+			userId:   userData.response.Embedded.User.Id,
+			checked:  userData.checked,
+		})
+	}
+	pa.mutex.Unlock()
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].checked.Before(candidates[j].checked)
+	})
+	if config.MaxChecksPerRun > 0 && len(candidates) > config.MaxChecksPerRun {
+		candidates = candidates[:config.MaxChecksPerRun]
+	}
+	for _, c := range candidates {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		userId := c.userId
+		if userId == "" {
+			userId = c.username
+		}
+		active, err := pa.isUserActive(userId, config.APIToken)
+		if err != nil {
+			pa.logger.Printf("Okta Authenticator: cannot check status of %s: %s",
+				c.username, err)
+			continue
+		}
+		if !active {
+			pa.deleteCachedAuth(c.username)
+			pa.logger.Debugf(1,
+				"Okta Authenticator: evicted inactive user %s", c.username)
+			continue
+		}
+		pa.mutex.Lock()
+		if userData, ok := pa.recentAuth[c.username]; ok {
+			userData.checked = time.Now()
+			pa.recentAuth[c.username] = userData
+		}
+		pa.mutex.Unlock()
+	}
+}
+
+// isUserActive returns false if the user has been deleted, suspended,
+// deactivated or locked out since authenticating.
+func (pa *PasswordAuthenticator) isUserActive(userId string,
+	apiToken string) (bool, error) {
+	userURL := strings.TrimSuffix(pa.authnURL, authPath) + usersPath +
+		url.PathEscape(userId)
+	if err := pa.checkURL(userURL); err != nil {
+		return false, err
+	}
+	req, err := http.NewRequest("GET", userURL, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Authorization", "SSWS "+apiToken)
+	resp, err := statusClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("bad status: %s", resp.Status)
+	}
+	var response OktaApiUserStatusType
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return false, err
+	}
+	switch response.Status {
+	case "DEPROVISIONED", "SUSPENDED", "LOCKED_OUT":
+		return false, nil
+	}
+	return true, nil
+}
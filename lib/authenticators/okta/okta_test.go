@@ -2,8 +2,11 @@ package okta
 
 import (
 	"encoding/json"
+	"fmt"
 	"net"
 	"net/http"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -35,6 +38,9 @@ func authnHandler(w http.ResponseWriter, req *http.Request) {
 	case "needs-2FA":
 		writeStatus(w, "MFA_REQUIRED")
 		return
+	case "needs-enroll":
+		writeStatus(w, "MFA_ENROLL")
+		return
 	case "password-expired":
 		writeStatus(w, "PASSWORD_EXPIRED")
 		return
@@ -62,6 +68,10 @@ func factorAuthnHandler(w http.ResponseWriter, req *http.Request) {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
+	if strings.Contains(req.URL.Path, "/"+webAuthnFactorType+"/") {
+		webauthnFactorHandler(w, req)
+		return
+	}
 	// For now we do TOTP only verifyTOTPFactorDataType
 	var otpData OktaApiVerifyTOTPFactorDataType
 	decoder := json.NewDecoder(req.Body)
@@ -73,6 +83,14 @@ func factorAuthnHandler(w http.ResponseWriter, req *http.Request) {
 	case "valid-otp":
 		writeStatus(w, "SUCCESS")
 		return
+	case "valid-google-otp":
+		if !strings.Contains(req.URL.Path, "/google-factor-id/") {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(invalidOTPStringFromDoc))
+			return
+		}
+		writeStatus(w, "SUCCESS")
+		return
 	case "invalid-otp":
 		w.WriteHeader(http.StatusForbidden)
 		w.Write([]byte(invalidOTPStringFromDoc))
@@ -114,6 +132,97 @@ func factorAuthnHandler(w http.ResponseWriter, req *http.Request) {
 
 }
 
+func webauthnFactorHandler(w http.ResponseWriter, req *http.Request) {
+	var verifyData OktaApiVerifyWebAuthnFactorDataType
+	decoder := json.NewDecoder(req.Body)
+	if err := decoder.Decode(&verifyData); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if verifyData.StateToken != "webauthn-state" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	var response OktaApiPushResponseType
+	switch verifyData.SignatureData {
+	case "":
+		response.Status = "MFA_CHALLENGE"
+		response.FactorResult = "CHALLENGE"
+		response.Embedded.Challenge.Challenge = "okta-challenge"
+		response.Embedded.Factor = []OktaApiMFAFactorsType{
+			{Id: "key1", FactorType: webAuthnFactorType,
+				Profile: OktaApiFactorProfileType{CredentialId: "cred1"}},
+			{Id: "key2", FactorType: webAuthnFactorType,
+				Profile: OktaApiFactorProfileType{CredentialId: "cred2"}},
+		}
+	case "good-signature":
+		response.Status = "SUCCESS"
+	default:
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+const testAPIToken = "test-api-token"
+
+var (
+	userStatusMutex sync.Mutex
+	userStatus      = map[string]string{}
+)
+
+func setUserStatus(userId string, status string) {
+	userStatusMutex.Lock()
+	defer userStatusMutex.Unlock()
+	userStatus[userId] = status
+}
+
+func usersHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if req.Header.Get("Authorization") != "SSWS "+testAPIToken {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	userId := strings.TrimPrefix(req.URL.Path, usersPath)
+	if strings.HasSuffix(userId, userFactorsPathExtra) {
+		userFactorsHandler(w, strings.TrimSuffix(userId, userFactorsPathExtra))
+		return
+	}
+	userStatusMutex.Lock()
+	status, ok := userStatus[userId]
+	userStatusMutex.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(OktaApiUserStatusType{
+		Id: userId, Status: status}); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func userFactorsHandler(w http.ResponseWriter, userId string) {
+	if userId != "okta-user-id" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	factors := []OktaApiMFAFactorsType{
+		{Id: "push-id", FactorType: "push", Provider: "OKTA",
+			VendorName: "OKTA", Status: "ACTIVE"},
+		{Id: "webauthn-id", FactorType: webAuthnFactorType, Provider: "FIDO",
+			VendorName: "FIDO", Status: "PENDING_ACTIVATION"},
+	}
+	if err := json.NewEncoder(w).Encode(factors); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
 func setupServer() {
 	if authnURL != "" {
 		return
@@ -126,6 +235,7 @@ func setupServer() {
 		serveMux := http.NewServeMux()
 		serveMux.HandleFunc(authPath, authnHandler)
 		serveMux.HandleFunc(authPath+"/factors/", factorAuthnHandler)
+		serveMux.HandleFunc(usersPath, usersHandler)
 		go http.Serve(listener, serveMux)
 		for {
 			if conn, err := net.Dial("tcp", addr); err == nil {
@@ -169,6 +279,128 @@ func TestBaseAPI(t *testing.T) {
 	}
 }
 
+type warningRecorderLogger struct {
+	*testlogger.Logger
+	messages []string
+}
+
+func (l *warningRecorderLogger) Printf(format string, v ...interface{}) {
+	l.messages = append(l.messages, fmt.Sprintf(format, v...))
+	l.Logger.Printf(format, v...)
+}
+
+func TestNewPublicRejectsPlaintextURL(t *testing.T) {
+	pa, err := NewPublic("somedomain", testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pa.checkURL(pa.authnURL); err != nil {
+		t.Fatal(err)
+	}
+	// Only the scheme differs from the accepted URL.
+	plaintextURL := "http://" + strings.TrimPrefix(pa.authnURL, "https://")
+	if err := pa.checkURL(plaintextURL); err == nil {
+		t.Fatal("should have rejected http URL")
+	}
+}
+
+func TestNewPublicTestingWarnsOnPlaintextURL(t *testing.T) {
+	logger := &warningRecorderLogger{Logger: testlogger.New(t)}
+	_, err := NewPublicTesting("http://localhost.localnet", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logger.messages) < 1 {
+		t.Fatal("NewPublicTesting should have warned on http URL")
+	}
+	logger.messages = nil
+	_, err = NewPublicTesting("https://localhost.localnet", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logger.messages) > 0 {
+		t.Fatal("NewPublicTesting should not warn on https URL")
+	}
+}
+
+func TestRequireHTTPSRefusesPlaintextCredentials(t *testing.T) {
+	setupServer()
+	pa, err := NewPublic("somedomain", testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pa.authnURL = authnURL
+	ok, err := pa.PasswordAuthenticate("a-user", []byte("good-password"))
+	if err == nil {
+		t.Fatal("should have refused to send credentials over http")
+	}
+	if ok {
+		t.Fatal("should not have authenticated")
+	}
+}
+
+func isUserCached(pa *PasswordAuthenticator, username string) bool {
+	pa.mutex.Lock()
+	defer pa.mutex.Unlock()
+	_, ok := pa.recentAuth[username]
+	return ok
+}
+
+func TestCacheRevalidationEvictsDisabledUser(t *testing.T) {
+	setupServer()
+	pa, err := NewPublicTesting(authnURL, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pa.close()
+	setUserStatus("a-user", "ACTIVE")
+	ok, err := pa.PasswordAuthenticate("a-user", []byte("good-password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("should have authenticated")
+	}
+	err = pa.StartCacheRevalidation(CacheRevalidationConfig{
+		APIToken: testAPIToken,
+		Interval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if !isUserCached(pa, "a-user") {
+		t.Fatal("active user should remain cached")
+	}
+	setUserStatus("a-user", "SUSPENDED")
+	for i := 0; i < 100 && isUserCached(pa, "a-user"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if isUserCached(pa, "a-user") {
+		t.Fatal("suspended user should have been evicted")
+	}
+	if err := pa.close(); err != nil {
+		t.Fatal(err)
+	}
+	// close must be idempotent.
+	if err := pa.close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCacheRevalidationRequiresToken(t *testing.T) {
+	pa, err := NewPublicTesting("http://localhost.localnet",
+		testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pa.StartCacheRevalidation(CacheRevalidationConfig{
+		Interval: time.Second})
+	if err == nil {
+		t.Fatal("should have failed without an API token")
+	}
+}
+
 func TestNonExistantUser(t *testing.T) {
 	setupServer()
 	pa, err := NewPublicTesting(authnURL, testlogger.New(t))
@@ -371,6 +603,69 @@ func TestMfaOTPSuccess(t *testing.T) {
 	}
 }
 
+func TestMfaOTPSelectByProvider(t *testing.T) {
+	setupServer()
+	pa := &PasswordAuthenticator{authnURL: authnURL,
+		recentAuth: make(map[string]authCacheData),
+		logger:     testlogger.New(t),
+	}
+	response := OktaApiPrimaryResponseType{
+		StateToken: "valid-google-otp",
+		Status:     "MFA_REQUIRED",
+		Embedded: OktaApiEmbeddedDataResponseType{
+			Factor: []OktaApiMFAFactorsType{
+				OktaApiMFAFactorsType{
+					Id:         "okta-factor-id",
+					FactorType: "token:software:totp",
+					Provider:   "OKTA",
+					VendorName: "OKTA"},
+				OktaApiMFAFactorsType{
+					Id:         "google-factor-id",
+					FactorType: "token:software:totp",
+					Provider:   "GOOGLE",
+					VendorName: "GOOGLE"},
+			}},
+	}
+	userCachedData := authCacheData{expires: time.Now().Add(60 * time.Second),
+		response: response,
+	}
+	twoFactorUser := "twoFactorUser"
+	pa.recentAuth[twoFactorUser] = userCachedData
+	factors, err := pa.GetUserFactors(twoFactorUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(factors) != 2 {
+		t.Fatalf("expected 2 factors, got %d", len(factors))
+	}
+	if factors[0].Provider != "OKTA" || factors[1].Provider != "GOOGLE" {
+		t.Fatalf("providers not surfaced: %+v", factors)
+	}
+	// The OKTA factor is verified, which the server rejects.
+	valid, err := pa.ValidateUserOTPWithProvider(twoFactorUser, "OKTA", 123456)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valid {
+		t.Fatal("should NOT have verified against the OKTA factor")
+	}
+	valid, err = pa.ValidateUserOTPWithProvider(twoFactorUser, "GOOGLE", 123456)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !valid {
+		t.Fatal("should have verified against the GOOGLE factor")
+	}
+	// Without a provider the default OKTA vendor factor is used.
+	valid, err = pa.ValidateUserOTP(twoFactorUser, 123456)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valid {
+		t.Fatal("default selection should have used the OKTA factor")
+	}
+}
+
 func TestMfaPushNonExisting(t *testing.T) {
 	setupServer()
 	pa := &PasswordAuthenticator{authnURL: authnURL,
@@ -531,3 +826,239 @@ func TestMfaPushInvalidWrapper(t *testing.T) {
 		t.Fatal("Was supposed to be rejected")
 	}
 }
+
+func TestMfaEnroll(t *testing.T) {
+	setupServer()
+	pa, err := NewPublicTesting(authnURL, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err := pa.PasswordAuthenticate("a-user", []byte("needs-enroll"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatalf("should have authenticated")
+	}
+}
+
+func TestGetEnrolledFactors(t *testing.T) {
+	setupServer()
+	pa := &PasswordAuthenticator{authnURL: authnURL,
+		recentAuth: make(map[string]authCacheData),
+		logger:     testlogger.New(t),
+	}
+	if _, err := pa.GetEnrolledFactors("a-user", ""); err == nil {
+		t.Fatal("should have failed without an API token")
+	}
+	if _, err := pa.GetEnrolledFactors("a-user", testAPIToken); err == nil {
+		t.Fatal("should have failed for an unknown user")
+	}
+	pa.recentAuth["a-user"] = authCacheData{
+		expires: time.Now().Add(60 * time.Second),
+		response: OktaApiPrimaryResponseType{
+			Embedded: OktaApiEmbeddedDataResponseType{
+				User: OktaApiUserInfoType{Id: "okta-user-id"}}},
+	}
+	factors, err := pa.GetEnrolledFactors("a-user", testAPIToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(factors) != 2 {
+		t.Fatalf("expected 2 factors, got %d", len(factors))
+	}
+	if factors[1].FactorType != webAuthnFactorType ||
+		factors[1].Status != "PENDING_ACTIVATION" {
+		t.Fatalf("enrollment state not surfaced: %+v", factors[1])
+	}
+}
+
+func webauthnTestAuthenticator(t *testing.T,
+	factorType string) *PasswordAuthenticator {
+	pa := &PasswordAuthenticator{authnURL: authnURL,
+		recentAuth: make(map[string]authCacheData),
+		logger:     testlogger.New(t),
+	}
+	pa.recentAuth["webauthnUser"] = authCacheData{
+		expires: time.Now().Add(60 * time.Second),
+		response: OktaApiPrimaryResponseType{
+			StateToken: "webauthn-state",
+			Status:     "MFA_REQUIRED",
+			Embedded: OktaApiEmbeddedDataResponseType{
+				Factor: []OktaApiMFAFactorsType{
+					{Id: "someid", FactorType: factorType},
+				}},
+		},
+	}
+	return pa
+}
+
+func TestMfaWebAuthnNoFactor(t *testing.T) {
+	setupServer()
+	pa := webauthnTestAuthenticator(t, "push")
+	challenge, err := pa.StartWebAuthnVerify("webauthnUser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if challenge != nil {
+		t.Fatal("should not get a challenge without a WebAuthn factor")
+	}
+	challenge, err = pa.StartWebAuthnVerify("unknownUser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if challenge != nil {
+		t.Fatal("should not get a challenge for an unknown user")
+	}
+}
+
+func TestMfaWebAuthnSuccess(t *testing.T) {
+	setupServer()
+	pa := webauthnTestAuthenticator(t, webAuthnFactorType)
+	challenge, err := pa.StartWebAuthnVerify("webauthnUser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if challenge == nil {
+		t.Fatal("expected a challenge")
+	}
+	if challenge.Challenge != "okta-challenge" {
+		t.Fatalf("bad challenge: %s", challenge.Challenge)
+	}
+	if len(challenge.CredentialIds) != 2 {
+		t.Fatalf("expected 2 credentials, got %v", challenge.CredentialIds)
+	}
+	if challenge.RPID != "127.0.0.1" ||
+		challenge.Origin != strings.TrimSuffix(authnURL, authPath) {
+		t.Fatalf("bad RP: %s %s", challenge.RPID, challenge.Origin)
+	}
+	valid, err := pa.ValidateWebAuthnAssertion("webauthnUser",
+		WebAuthnAssertion{SignatureData: "bad-signature"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valid {
+		t.Fatal("should NOT have succeeded with a bad signature")
+	}
+	valid, err = pa.ValidateWebAuthnAssertion("webauthnUser",
+		WebAuthnAssertion{SignatureData: "good-signature"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !valid {
+		t.Fatal("should have succeeded with a good signature")
+	}
+}
+
+func TestCacheLRUEviction(t *testing.T) {
+	pa := &PasswordAuthenticator{authnURL: authnURL,
+		recentAuth:      make(map[string]authCacheData),
+		logger:          testlogger.New(t),
+		maxCacheEntries: 2,
+	}
+	expires := time.Now().Add(time.Minute)
+	pa.cacheAuth("user1", authCacheData{expires: expires})
+	pa.cacheAuth("user2", authCacheData{expires: expires})
+	time.Sleep(time.Millisecond)
+	// Using user1 makes user2 the least recently used.
+	if userData, err := pa.getCachedAuth("user1"); err != nil {
+		t.Fatal(err)
+	} else if userData == nil {
+		t.Fatal("user1 should be cached")
+	}
+	pa.cacheAuth("user3", authCacheData{expires: expires})
+	if isUserCached(pa, "user2") {
+		t.Fatal("user2 should have been evicted")
+	}
+	if !isUserCached(pa, "user1") || !isUserCached(pa, "user3") {
+		t.Fatal("user1 and user3 should be cached")
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	pa, err := NewPublicTesting(authnURL, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pa.close()
+	oktaExpires := time.Now().Add(time.Hour)
+	if expires := pa.getCacheExpiration(oktaExpires); expires != oktaExpires {
+		t.Fatalf("expected Okta expiry %v, got %v", oktaExpires, expires)
+	}
+	if err := pa.ConfigureCache(CacheConfig{TTL: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	if expires := pa.getCacheExpiration(oktaExpires); !expires.Before(
+		time.Now().Add(2 * time.Minute)) {
+		t.Fatalf("expiry %v should be limited by TTL", expires)
+	}
+	soon := time.Now().Add(time.Second)
+	if expires := pa.getCacheExpiration(soon); expires != soon {
+		t.Fatalf("expected earlier Okta expiry %v, got %v", soon, expires)
+	}
+	if err := pa.ConfigureCache(CacheConfig{}); err == nil {
+		t.Fatal("configuring the cache twice should fail")
+	}
+}
+
+func TestCacheSweeper(t *testing.T) {
+	pa, err := NewPublicTesting(authnURL, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pa.close()
+	pa.cacheAuth("expiredUser",
+		authCacheData{expires: time.Now().Add(-time.Second)})
+	err = pa.ConfigureCache(CacheConfig{SweepInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && isUserCached(pa, "expiredUser"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if isUserCached(pa, "expiredUser") {
+		t.Fatal("expired user should have been swept")
+	}
+}
+
+func TestCacheSharedStorage(t *testing.T) {
+	setupServer()
+	memStore := memstore.New()
+	var authenticators []*PasswordAuthenticator
+	for i := 0; i < 2; i++ {
+		pa, err := NewPublicTesting(authnURL, testlogger.New(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pa.UpdateStorage(memStore); err != nil {
+			t.Fatal(err)
+		}
+		authenticators = append(authenticators, pa)
+	}
+	ok, err := authenticators[0].PasswordAuthenticate("a-user",
+		[]byte("needs-2FA"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("should have authenticated")
+	}
+	response, err := authenticators[1].getValidUserResponse("a-user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response == nil || response.Status != "MFA_REQUIRED" {
+		t.Fatalf("authentication not shared through storage: %+v", response)
+	}
+	authenticators[1].deleteCachedAuth("a-user")
+	authenticators[0].mutex.Lock()
+	delete(authenticators[0].recentAuth, "a-user")
+	authenticators[0].mutex.Unlock()
+	response, err = authenticators[0].getValidUserResponse("a-user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response != nil {
+		t.Fatal("deleted authentication should not be loaded from storage")
+	}
+}
@@ -0,0 +1,57 @@
+// Package radius implements a RADIUS (RFC 2865) client which checks one time
+// passwords, such as RSA SecurID passcodes, with Access-Request packets and
+// supports Access-Challenge exchanges (next token code, new PIN).
+package radius
+
+import (
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+)
+
+// Config describes the RADIUS servers.
+type Config struct {
+	// ServerAddresses are the host:port addresses of the RADIUS servers,
+	// which are tried in turn. If no port is given 1812 is used.
+	ServerAddresses []string
+	SharedSecret    string
+	// NASIdentifier is sent in the NAS-Identifier attribute if not empty.
+	NASIdentifier string
+	// Timeout is how long to wait for each server. The default is 5 seconds.
+	Timeout time.Duration
+	// If RequireMessageAuthenticator is true responses without a
+	// Message-Authenticator attribute are rejected. Message-Authenticator
+	// attributes which are present are always checked.
+	RequireMessageAuthenticator bool
+}
+
+// Response is the answer of a RADIUS server to an Access-Request.
+type Response struct {
+	Accepted bool
+	// Challenge is true if the server asks for another response. Message is
+	// the prompt to show to the user and State must be passed to the next
+	// call to Authenticate.
+	Challenge bool
+	Message   string
+	State     []byte
+}
+
+// Authenticator sends Access-Requests to RADIUS servers.
+type Authenticator struct {
+	config  Config
+	logger  log.DebugLogger
+	servers []string
+}
+
+// New creates an Authenticator for the servers in config.
+func New(config Config, logger log.DebugLogger) (*Authenticator, error) {
+	return newAuthenticator(config, logger)
+}
+
+// Authenticate sends an Access-Request for username with password. state is
+// the State from a previous challenge, or nil. Rejected requests are not an
+// error: an error is returned only if no server gave a valid answer.
+func (a *Authenticator) Authenticate(username, password string,
+	state []byte) (*Response, error) {
+	return a.authenticate(username, password, state)
+}
@@ -0,0 +1,334 @@
+package radius
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+)
+
+const (
+	codeAccessRequest   = 1
+	codeAccessAccept    = 2
+	codeAccessReject    = 3
+	codeAccessChallenge = 11
+
+	attributeUserName             = 1
+	attributeUserPassword         = 2
+	attributeReplyMessage         = 18
+	attributeState                = 24
+	attributeNASIdentifier        = 32
+	attributeMessageAuthenticator = 80
+
+	authenticatorLength = 16
+	headerLength        = 4 + authenticatorLength
+	maxPacketLength     = 4096
+	maxAttributeLength  = 253
+	maxPasswordLength   = 128
+
+	defaultPort    = "1812"
+	defaultTimeout = 5 * time.Second
+)
+
+type attribute struct {
+	attributeType byte
+	value         []byte
+}
+
+type packet struct {
+	code          byte
+	identifier    byte
+	authenticator [authenticatorLength]byte
+	attributes    []attribute
+}
+
+func newAuthenticator(config Config, logger log.DebugLogger) (
+	*Authenticator, error) {
+	if len(config.ServerAddresses) < 1 {
+		return nil, errors.New("no RADIUS servers")
+	}
+	if config.SharedSecret == "" {
+		return nil, errors.New("no RADIUS shared secret")
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultTimeout
+	}
+	a := &Authenticator{config: config, logger: logger}
+	for _, address := range config.ServerAddresses {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			address = net.JoinHostPort(address, defaultPort)
+		}
+		a.servers = append(a.servers, address)
+	}
+	return a, nil
+}
+
+func (p *packet) getAttribute(attributeType byte) ([]byte, bool) {
+	for _, attr := range p.attributes {
+		if attr.attributeType == attributeType {
+			return attr.value, true
+		}
+	}
+	return nil, false
+}
+
+// getReplyMessage returns the Reply-Message attributes, which may be split
+// over several attributes, joined together.
+func (p *packet) getReplyMessage() string {
+	var message []byte
+	for _, attr := range p.attributes {
+		if attr.attributeType == attributeReplyMessage {
+			message = append(message, attr.value...)
+		}
+	}
+	return strings.TrimSpace(string(message))
+}
+
+func (p *packet) marshal() ([]byte, error) {
+	data := make([]byte, headerLength, maxPacketLength)
+	data[0] = p.code
+	data[1] = p.identifier
+	copy(data[4:headerLength], p.authenticator[:])
+	for _, attr := range p.attributes {
+		if len(attr.value) > maxAttributeLength {
+			return nil, fmt.Errorf("attribute %d too long", attr.attributeType)
+		}
+		data = append(data, attr.attributeType, byte(len(attr.value)+2))
+		data = append(data, attr.value...)
+	}
+	if len(data) > maxPacketLength {
+		return nil, errors.New("packet too long")
+	}
+	binary.BigEndian.PutUint16(data[2:4], uint16(len(data)))
+	return data, nil
+}
+
+func parsePacket(data []byte) (*packet, error) {
+	if len(data) < headerLength {
+		return nil, errors.New("short packet")
+	}
+	length := int(binary.BigEndian.Uint16(data[2:4]))
+	if length < headerLength || length > len(data) {
+		return nil, errors.New("invalid packet length")
+	}
+	p := &packet{code: data[0], identifier: data[1]}
+	copy(p.authenticator[:], data[4:headerLength])
+	for offset := headerLength; offset < length; {
+		if offset+2 > length {
+			return nil, errors.New("truncated attribute")
+		}
+		attrLength := int(data[offset+1])
+		if attrLength < 2 || offset+attrLength > length {
+			return nil, errors.New("invalid attribute length")
+		}
+		p.attributes = append(p.attributes, attribute{
+			attributeType: data[offset],
+			value:         data[offset+2 : offset+attrLength],
+		})
+		offset += attrLength
+	}
+	return p, nil
+}
+
+// findMessageAuthenticator returns the offset of the value of the
+// Message-Authenticator attribute in the marshaled packet data.
+func findMessageAuthenticator(data []byte) (int, bool) {
+	for offset := headerLength; offset+2 <= len(data); {
+		attrLength := int(data[offset+1])
+		if attrLength < 2 {
+			return 0, false
+		}
+		if data[offset] == attributeMessageAuthenticator &&
+			attrLength == 2+md5.Size {
+			return offset + 2, true
+		}
+		offset += attrLength
+	}
+	return 0, false
+}
+
+// computeMessageAuthenticator returns the HMAC-MD5 of data with the
+// Message-Authenticator value at offset zeroed and, for responses, the
+// authenticator replaced by requestAuthenticator.
+func computeMessageAuthenticator(data []byte, offset int,
+	requestAuthenticator []byte, secret []byte) []byte {
+	buffer := make([]byte, len(data))
+	copy(buffer, data)
+	if requestAuthenticator != nil {
+		copy(buffer[4:headerLength], requestAuthenticator)
+	}
+	for index := offset; index < offset+md5.Size; index++ {
+		buffer[index] = 0
+	}
+	mac := hmac.New(md5.New, secret)
+	mac.Write(buffer)
+	return mac.Sum(nil)
+}
+
+// encryptPassword hides password as described in RFC 2865 section 5.2.
+func encryptPassword(password []byte, secret []byte,
+	requestAuthenticator []byte) ([]byte, error) {
+	if len(password) > maxPasswordLength {
+		return nil, errors.New("password too long")
+	}
+	length := (len(password) + md5.Size - 1) / md5.Size * md5.Size
+	if length == 0 {
+		length = md5.Size
+	}
+	result := make([]byte, length)
+	copy(result, password)
+	previous := requestAuthenticator
+	for offset := 0; offset < length; offset += md5.Size {
+		hash := md5.New()
+		hash.Write(secret)
+		hash.Write(previous)
+		sum := hash.Sum(nil)
+		for index := range sum {
+			result[offset+index] ^= sum[index]
+		}
+		previous = result[offset : offset+md5.Size]
+	}
+	return result, nil
+}
+
+func (a *Authenticator) makeRequest(username, password string,
+	state []byte) (*packet, []byte, error) {
+	request := &packet{code: codeAccessRequest}
+	random := make([]byte, 1+authenticatorLength)
+	if _, err := rand.Read(random); err != nil {
+		return nil, nil, err
+	}
+	request.identifier = random[0]
+	copy(request.authenticator[:], random[1:])
+	secret := []byte(a.config.SharedSecret)
+	encryptedPassword, err := encryptPassword([]byte(password), secret,
+		request.authenticator[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	request.attributes = []attribute{
+		{attributeUserName, []byte(username)},
+		{attributeUserPassword, encryptedPassword},
+	}
+	if a.config.NASIdentifier != "" {
+		request.attributes = append(request.attributes,
+			attribute{attributeNASIdentifier, []byte(a.config.NASIdentifier)})
+	}
+	if len(state) > 0 {
+		request.attributes = append(request.attributes,
+			attribute{attributeState, state})
+	}
+	request.attributes = append(request.attributes,
+		attribute{attributeMessageAuthenticator, make([]byte, md5.Size)})
+	data, err := request.marshal()
+	if err != nil {
+		return nil, nil, err
+	}
+	offset, _ := findMessageAuthenticator(data)
+	copy(data[offset:], computeMessageAuthenticator(data, offset, nil, secret))
+	return request, data, nil
+}
+
+// verifyResponse checks the Response Authenticator and any
+// Message-Authenticator of the response data to request.
+func (a *Authenticator) verifyResponse(data []byte, request *packet) error {
+	secret := []byte(a.config.SharedSecret)
+	length := binary.BigEndian.Uint16(data[2:4])
+	hash := md5.New()
+	hash.Write(data[:4])
+	hash.Write(request.authenticator[:])
+	hash.Write(data[headerLength:length])
+	hash.Write(secret)
+	if !hmac.Equal(hash.Sum(nil), data[4:headerLength]) {
+		return errors.New("invalid response authenticator")
+	}
+	offset, ok := findMessageAuthenticator(data[:length])
+	if !ok {
+		if a.config.RequireMessageAuthenticator {
+			return errors.New("response has no Message-Authenticator")
+		}
+		return nil
+	}
+	expected := computeMessageAuthenticator(data[:length], offset,
+		request.authenticator[:], secret)
+	if !hmac.Equal(expected, data[offset:offset+md5.Size]) {
+		return errors.New("invalid Message-Authenticator")
+	}
+	return nil
+}
+
+func (a *Authenticator) exchange(server string, request *packet,
+	data []byte) (*packet, error) {
+	conn, err := net.DialTimeout("udp", server, a.config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(a.config.Timeout)); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(data); err != nil {
+		return nil, err
+	}
+	buffer := make([]byte, maxPacketLength)
+	for {
+		nRead, err := conn.Read(buffer)
+		if err != nil {
+			return nil, err
+		}
+		response, err := parsePacket(buffer[:nRead])
+		if err != nil {
+			a.logger.Debugf(1, "invalid RADIUS packet from %s: %s", server, err)
+			continue
+		}
+		if response.identifier != request.identifier {
+			continue
+		}
+		if err := a.verifyResponse(buffer[:nRead], request); err != nil {
+			return nil, err
+		}
+		return response, nil
+	}
+}
+
+func (a *Authenticator) authenticate(username, password string,
+	state []byte) (*Response, error) {
+	request, data, err := a.makeRequest(username, password, state)
+	if err != nil {
+		return nil, err
+	}
+	var lastError error
+	for _, server := range a.servers {
+		response, err := a.exchange(server, request, data)
+		if err != nil {
+			a.logger.Printf("RADIUS server %s: %s", server, err)
+			lastError = err
+			continue
+		}
+		switch response.code {
+		case codeAccessAccept:
+			return &Response{Accepted: true,
+				Message: response.getReplyMessage()}, nil
+		case codeAccessReject:
+			return &Response{Message: response.getReplyMessage()}, nil
+		case codeAccessChallenge:
+			state, _ := response.getAttribute(attributeState)
+			return &Response{
+				Challenge: true,
+				Message:   response.getReplyMessage(),
+				State:     append([]byte(nil), state...),
+			}, nil
+		default:
+			lastError = fmt.Errorf("unexpected RADIUS code %d from %s",
+				response.code, server)
+		}
+	}
+	return nil, fmt.Errorf("no valid RADIUS response: %s", lastError)
+}
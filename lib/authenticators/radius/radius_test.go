@@ -0,0 +1,276 @@
+package radius
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log/testlogger"
+)
+
+const (
+	testSecret   = "shared-secret"
+	testUsername = "a-user"
+	testState    = "challenge-state"
+)
+
+func decryptPassword(encrypted []byte, secret []byte,
+	requestAuthenticator []byte) []byte {
+	result := make([]byte, len(encrypted))
+	previous := requestAuthenticator
+	for offset := 0; offset+md5.Size <= len(encrypted); offset += md5.Size {
+		hash := md5.New()
+		hash.Write(secret)
+		hash.Write(previous)
+		sum := hash.Sum(nil)
+		for index := range sum {
+			result[offset+index] = encrypted[offset+index] ^ sum[index]
+		}
+		previous = encrypted[offset : offset+md5.Size]
+	}
+	return bytes.TrimRight(result, "\x00")
+}
+
+// makeResponse returns a signed response to request, as a server with secret
+// would send it.
+func makeResponse(t *testing.T, request *packet, code byte,
+	attributes []attribute, secret string) []byte {
+	response := &packet{
+		code:          code,
+		identifier:    request.identifier,
+		authenticator: request.authenticator,
+		attributes: append(attributes, attribute{
+			attributeMessageAuthenticator, make([]byte, md5.Size)}),
+	}
+	data, err := response.marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset, _ := findMessageAuthenticator(data)
+	copy(data[offset:], computeMessageAuthenticator(data, offset, nil,
+		[]byte(secret)))
+	length := binary.BigEndian.Uint16(data[2:4])
+	hash := md5.New()
+	hash.Write(data[:length])
+	hash.Write([]byte(secret))
+	copy(data[4:headerLength], hash.Sum(nil))
+	return data
+}
+
+// startServer runs a fake RADIUS server which accepts the password "123456",
+// and "987654" after challenging the password "challenge".
+func startServer(t *testing.T, secret string) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buffer := make([]byte, maxPacketLength)
+		for {
+			nRead, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			request, err := parsePacket(buffer[:nRead])
+			if err != nil || request.code != codeAccessRequest {
+				continue
+			}
+			offset, ok := findMessageAuthenticator(buffer[:nRead])
+			if !ok || !bytes.Equal(buffer[offset:offset+md5.Size],
+				computeMessageAuthenticator(buffer[:nRead], offset, nil,
+					[]byte(secret))) {
+				continue
+			}
+			username, _ := request.getAttribute(attributeUserName)
+			encrypted, _ := request.getAttribute(attributeUserPassword)
+			state, _ := request.getAttribute(attributeState)
+			password := string(decryptPassword(encrypted, []byte(secret),
+				request.authenticator[:]))
+			code := byte(codeAccessReject)
+			var attributes []attribute
+			if string(username) == testUsername {
+				switch {
+				case password == "123456" && state == nil:
+					code = codeAccessAccept
+				case password == "challenge" && state == nil:
+					code = codeAccessChallenge
+					attributes = []attribute{
+						{attributeReplyMessage, []byte("Enter next code")},
+						{attributeState, []byte(testState)},
+					}
+				case password == "987654" && string(state) == testState:
+					code = codeAccessAccept
+				}
+			}
+			conn.WriteTo(makeResponse(t, request, code, attributes, secret),
+				addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func newTestAuthenticator(t *testing.T, servers ...string) *Authenticator {
+	a, err := New(Config{
+		ServerAddresses:             servers,
+		SharedSecret:                testSecret,
+		NASIdentifier:               "keymaster",
+		Timeout:                     time.Second,
+		RequireMessageAuthenticator: true,
+	}, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestEncryptPassword(t *testing.T) {
+	authenticator := []byte("0123456789abcdef")
+	for _, password := range []string{"", "123456", "a-password-longer-than-16"} {
+		encrypted, err := encryptPassword([]byte(password),
+			[]byte(testSecret), authenticator)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(encrypted) == 0 || len(encrypted)%md5.Size != 0 {
+			t.Fatalf("bad encrypted length: %d", len(encrypted))
+		}
+		decrypted := decryptPassword(encrypted, []byte(testSecret),
+			authenticator)
+		if string(decrypted) != password {
+			t.Fatalf("decrypted %q != %q", decrypted, password)
+		}
+	}
+	if _, err := encryptPassword(make([]byte, maxPasswordLength+1),
+		[]byte(testSecret), authenticator); err == nil {
+		t.Fatal("should have failed with long password")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	a := newTestAuthenticator(t, startServer(t, testSecret))
+	response, err := a.Authenticate(testUsername, "123456", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !response.Accepted || response.Challenge {
+		t.Fatalf("should have been accepted: %+v", response)
+	}
+	response, err = a.Authenticate(testUsername, "bad-code", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Accepted || response.Challenge {
+		t.Fatalf("should have been rejected: %+v", response)
+	}
+	response, err = a.Authenticate("other-user", "123456", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Accepted {
+		t.Fatal("other user should have been rejected")
+	}
+}
+
+func TestAuthenticateChallenge(t *testing.T) {
+	a := newTestAuthenticator(t, startServer(t, testSecret))
+	response, err := a.Authenticate(testUsername, "challenge", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !response.Challenge || response.Accepted {
+		t.Fatalf("should have been challenged: %+v", response)
+	}
+	if response.Message != "Enter next code" {
+		t.Fatalf("bad challenge message: %q", response.Message)
+	}
+	if string(response.State) != testState {
+		t.Fatalf("bad challenge state: %q", response.State)
+	}
+	response, err = a.Authenticate(testUsername, "987654", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Accepted {
+		t.Fatal("should have been rejected without state")
+	}
+	response, err = a.Authenticate(testUsername, "987654", []byte(testState))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !response.Accepted {
+		t.Fatalf("should have been accepted: %+v", response)
+	}
+}
+
+func TestAuthenticateWrongSecret(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Answers signed with another secret must not be trusted.
+	go func() {
+		buffer := make([]byte, maxPacketLength)
+		nRead, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		request, err := parsePacket(buffer[:nRead])
+		if err != nil {
+			return
+		}
+		conn.WriteTo(makeResponse(t, request, codeAccessAccept, nil,
+			"wrong-secret"), addr)
+	}()
+	a := newTestAuthenticator(t, conn.LocalAddr().String())
+	if _, err := a.Authenticate(testUsername, "123456", nil); err == nil {
+		t.Fatal("should have failed with wrong secret")
+	}
+}
+
+func TestAuthenticateFailover(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadServer := conn.LocalAddr().String()
+	conn.Close()
+	a := newTestAuthenticator(t, deadServer, startServer(t, testSecret))
+	a.config.Timeout = 200 * time.Millisecond
+	response, err := a.Authenticate(testUsername, "123456", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !response.Accepted {
+		t.Fatalf("should have been accepted: %+v", response)
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(Config{SharedSecret: testSecret},
+		testlogger.New(t)); err == nil {
+		t.Fatal("should have failed without servers")
+	}
+	if _, err := New(Config{ServerAddresses: []string{"localhost"}},
+		testlogger.New(t)); err == nil {
+		t.Fatal("should have failed without secret")
+	}
+	a, err := New(Config{
+		ServerAddresses: []string{"radius.example.com", "10.0.0.1:1645"},
+		SharedSecret:    testSecret,
+	}, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.servers[0] != "radius.example.com:1812" ||
+		a.servers[1] != "10.0.0.1:1645" {
+		t.Fatalf("bad servers: %v", a.servers)
+	}
+	if a.config.Timeout != defaultTimeout {
+		t.Fatalf("bad default timeout: %s", a.config.Timeout)
+	}
+}
@@ -0,0 +1,83 @@
+// Package saml implements a SAML 2.0 service provider, which delegates
+// primary authentication to an enterprise identity provider using the
+// HTTP-Redirect binding for requests and the HTTP-POST binding for
+// responses.
+package saml
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"net/http"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	crewjamsaml "github.com/crewjam/saml"
+)
+
+// Config describes the service provider and how assertion attributes are
+// mapped.
+type Config struct {
+	// EntityID identifies the service provider to the identity provider. If
+	// it is empty MetadataURL is used.
+	EntityID string
+	// MetadataURL is where the service provider metadata is served.
+	MetadataURL string
+	// ACSURL is the assertion consumer service, which receives responses.
+	ACSURL string
+	// IDPMetadata is the metadata of the identity provider. If it is nil
+	// the metadata is read from IDPMetadataURL.
+	IDPMetadata    []byte
+	IDPMetadataURL string
+	// Certificate and Key sign requests and decrypt encrypted assertions.
+	Certificate *x509.Certificate
+	Key         *rsa.PrivateKey
+	// UsernameAttribute is the name or friendly name of the attribute
+	// holding the username. If it is empty the subject NameID is used. If
+	// the value is an email address the username is its lower case local
+	// part.
+	UsernameAttribute string
+	// GroupsAttribute is the name or friendly name of the attribute holding
+	// the groups of the user. If it is empty no groups are returned.
+	GroupsAttribute string
+}
+
+// Identity is a user authenticated by the identity provider.
+type Identity struct {
+	NameID   string
+	Username string
+	Groups   []string
+}
+
+// ServiceProvider authenticates users with a SAML identity provider.
+type ServiceProvider struct {
+	config Config
+	logger log.DebugLogger
+	sp     crewjamsaml.ServiceProvider
+}
+
+// New creates a ServiceProvider for the identity provider in config.
+func New(config Config, logger log.DebugLogger) (*ServiceProvider, error) {
+	return newServiceProvider(config, logger)
+}
+
+// Metadata returns the XML metadata of the service provider, to be
+// registered with the identity provider.
+func (sp *ServiceProvider) Metadata() ([]byte, error) {
+	return sp.metadata()
+}
+
+// AuthnRequestURL returns the URL of the identity provider to redirect the
+// browser to and the ID of the request, which must be passed to
+// ParseResponse. relayState is returned to the assertion consumer service.
+func (sp *ServiceProvider) AuthnRequestURL(relayState string) (
+	string, string, error) {
+	return sp.authnRequestURL(relayState)
+}
+
+// ParseResponse validates the response posted to the assertion consumer
+// service: its signature, issuer, audience, validity period and that it is
+// a response to the request with the ID requestID. It returns the identity
+// of the user in the assertion.
+func (sp *ServiceProvider) ParseResponse(r *http.Request, requestID string) (
+	*Identity, error) {
+	return sp.parseResponse(r, requestID)
+}
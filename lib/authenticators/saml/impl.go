@@ -0,0 +1,197 @@
+package saml
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	crewjamsaml "github.com/crewjam/saml"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+const (
+	httpTimeout              = 10 * time.Second
+	maxMetadataLength        = 1 << 20
+	entitiesDescriptorErrMsg = "expected element type <EntityDescriptor> but have <EntitiesDescriptor>"
+)
+
+func newServiceProvider(config Config, logger log.DebugLogger) (
+	*ServiceProvider, error) {
+	if config.Certificate == nil || config.Key == nil {
+		return nil, errors.New("missing service provider certificate or key")
+	}
+	metadataURL, err := url.Parse(config.MetadataURL)
+	if err != nil {
+		return nil, err
+	}
+	acsURL, err := url.Parse(config.ACSURL)
+	if err != nil {
+		return nil, err
+	}
+	idpMetadata := config.IDPMetadata
+	if idpMetadata == nil {
+		if config.IDPMetadataURL == "" {
+			return nil, errors.New("missing identity provider metadata")
+		}
+		idpMetadata, err = fetchMetadata(config.IDPMetadataURL)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read identity provider metadata: %s",
+				err)
+		}
+	}
+	idpDescriptor, err := parseMetadata(idpMetadata)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse identity provider metadata: %s",
+			err)
+	}
+	sp := &ServiceProvider{
+		config: config,
+		logger: logger,
+		sp: crewjamsaml.ServiceProvider{
+			EntityID:          config.EntityID,
+			Key:               config.Key,
+			Certificate:       config.Certificate,
+			HTTPClient:        &http.Client{Timeout: httpTimeout},
+			MetadataURL:       *metadataURL,
+			AcsURL:            *acsURL,
+			IDPMetadata:       idpDescriptor,
+			AuthnNameIDFormat: crewjamsaml.UnspecifiedNameIDFormat,
+			SignatureMethod:   dsig.RSASHA256SignatureMethod,
+		},
+	}
+	if sp.sp.GetSSOBindingLocation(crewjamsaml.HTTPRedirectBinding) == "" {
+		return nil, errors.New(
+			"identity provider does not support the HTTP-Redirect binding")
+	}
+	logger.Debugf(1, "SAML identity provider: %s", idpDescriptor.EntityID)
+	return sp, nil
+}
+
+func fetchMetadata(rawURL string) ([]byte, error) {
+	client := &http.Client{Timeout: httpTimeout}
+	resp, err := client.Get(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", rawURL, resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, maxMetadataLength))
+}
+
+// parseMetadata parses identity provider metadata, which may be an
+// EntityDescriptor or an EntitiesDescriptor containing one.
+func parseMetadata(data []byte) (*crewjamsaml.EntityDescriptor, error) {
+	var entity crewjamsaml.EntityDescriptor
+	err := xml.Unmarshal(data, &entity)
+	if err == nil {
+		return &entity, nil
+	}
+	if err.Error() != entitiesDescriptorErrMsg {
+		return nil, err
+	}
+	var entities crewjamsaml.EntitiesDescriptor
+	if err := xml.Unmarshal(data, &entities); err != nil {
+		return nil, err
+	}
+	for index, entity := range entities.EntityDescriptors {
+		if len(entity.IDPSSODescriptors) > 0 {
+			return &entities.EntityDescriptors[index], nil
+		}
+	}
+	return nil, errors.New("no entity with an IDPSSODescriptor")
+}
+
+func (sp *ServiceProvider) metadata() ([]byte, error) {
+	return xml.MarshalIndent(sp.sp.Metadata(), "", "  ")
+}
+
+func (sp *ServiceProvider) authnRequestURL(relayState string) (
+	string, string, error) {
+	req, err := sp.sp.MakeAuthenticationRequest(
+		sp.sp.GetSSOBindingLocation(crewjamsaml.HTTPRedirectBinding),
+		crewjamsaml.HTTPRedirectBinding, crewjamsaml.HTTPPostBinding)
+	if err != nil {
+		return "", "", err
+	}
+	redirectURL, err := req.Redirect(relayState, &sp.sp)
+	if err != nil {
+		return "", "", err
+	}
+	return redirectURL.String(), req.ID, nil
+}
+
+func (sp *ServiceProvider) parseResponse(r *http.Request, requestID string) (
+	*Identity, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	assertion, err := sp.sp.ParseResponse(r, []string{requestID})
+	if err != nil {
+		// The details are hidden by the Error method.
+		if ire, ok := err.(*crewjamsaml.InvalidResponseError); ok {
+			return nil, ire.PrivateErr
+		}
+		return nil, err
+	}
+	identity := &Identity{}
+	if assertion.Subject != nil && assertion.Subject.NameID != nil {
+		identity.NameID = assertion.Subject.NameID.Value
+	}
+	value := identity.NameID
+	if sp.config.UsernameAttribute != "" {
+		values := getAttributeValues(assertion, sp.config.UsernameAttribute)
+		if len(values) < 1 {
+			return nil, fmt.Errorf("assertion has no %s attribute",
+				sp.config.UsernameAttribute)
+		}
+		value = values[0]
+	}
+	identity.Username, err = getUsername(value)
+	if err != nil {
+		return nil, err
+	}
+	if sp.config.GroupsAttribute != "" {
+		identity.Groups = getAttributeValues(assertion,
+			sp.config.GroupsAttribute)
+	}
+	return identity, nil
+}
+
+func getAttributeValues(assertion *crewjamsaml.Assertion,
+	name string) []string {
+	var values []string
+	for _, statement := range assertion.AttributeStatements {
+		for _, attribute := range statement.Attributes {
+			if attribute.Name != name && attribute.FriendlyName != name {
+				continue
+			}
+			for _, value := range attribute.Values {
+				values = append(values, value.Value)
+			}
+		}
+	}
+	return values
+}
+
+func getUsername(value string) (string, error) {
+	if value == "" {
+		return "", errors.New("assertion has no username")
+	}
+	atIndex := strings.LastIndex(value, "@")
+	if atIndex < 0 {
+		return value, nil
+	}
+	if atIndex < 1 {
+		return "", fmt.Errorf("invalid username: %s", value)
+	}
+	return strings.ToLower(value[:atIndex]), nil
+}
@@ -0,0 +1,243 @@
+package saml
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/xml"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log/testlogger"
+	crewjamsaml "github.com/crewjam/saml"
+)
+
+const (
+	testACSURL      = "https://keymaster.example.com/auth/saml/acs"
+	testMetadataURL = "https://keymaster.example.com/auth/saml/metadata"
+)
+
+type testServiceProviderProvider struct {
+	metadata *crewjamsaml.EntityDescriptor
+}
+
+func (p *testServiceProviderProvider) GetServiceProvider(r *http.Request,
+	serviceProviderID string) (*crewjamsaml.EntityDescriptor, error) {
+	if p.metadata == nil || serviceProviderID != p.metadata.EntityID {
+		return nil, os.ErrNotExist
+	}
+	return p.metadata, nil
+}
+
+func newTestKeyPair(t *testing.T, commonName string) (
+	*rsa.PrivateKey, *x509.Certificate) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template,
+		key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, cert
+}
+
+func mustParseURL(t *testing.T, rawURL string) url.URL {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *u
+}
+
+func newTestIdentityProvider(t *testing.T) (*crewjamsaml.IdentityProvider,
+	*testServiceProviderProvider) {
+	key, cert := newTestKeyPair(t, "idp.example.com")
+	spProvider := &testServiceProviderProvider{}
+	return &crewjamsaml.IdentityProvider{
+		Key:                     key,
+		Certificate:             cert,
+		MetadataURL:             mustParseURL(t, "https://idp.example.com/metadata"),
+		SSOURL:                  mustParseURL(t, "https://idp.example.com/sso"),
+		ServiceProviderProvider: spProvider,
+	}, spProvider
+}
+
+func newTestServiceProvider(t *testing.T, idp *crewjamsaml.IdentityProvider,
+	spProvider *testServiceProviderProvider, config Config) *ServiceProvider {
+	idpMetadata, err := xml.Marshal(idp.Metadata())
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.MetadataURL = testMetadataURL
+	config.ACSURL = testACSURL
+	config.IDPMetadata = idpMetadata
+	config.Key, config.Certificate = newTestKeyPair(t, "keymaster.example.com")
+	sp, err := New(config, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	spProvider.metadata = sp.sp.Metadata()
+	return sp
+}
+
+// login makes an authentication request with sp, has idp respond to it for
+// session and returns the response posted to the assertion consumer
+// service along with the request ID.
+func login(t *testing.T, idp *crewjamsaml.IdentityProvider,
+	sp *ServiceProvider, session *crewjamsaml.Session) (url.Values, string) {
+	redirectURL, requestID, err := sp.AuthnRequestURL("relay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idpRequest, err := crewjamsaml.NewIdpAuthnRequest(idp,
+		httptest.NewRequest("GET", redirectURL, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := idpRequest.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	err = crewjamsaml.DefaultAssertionMaker{}.MakeAssertion(idpRequest,
+		session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	form, err := idpRequest.PostBinding()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if form.URL != testACSURL || form.RelayState != "relay" {
+		t.Fatalf("unexpected form: %+v", form)
+	}
+	return url.Values{
+		"SAMLResponse": {form.SAMLResponse},
+		"RelayState":   {form.RelayState},
+	}, requestID
+}
+
+func newACSRequest(values url.Values) *http.Request {
+	r := httptest.NewRequest("POST", testACSURL,
+		strings.NewReader(values.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+func TestParseResponse(t *testing.T) {
+	idp, spProvider := newTestIdentityProvider(t)
+	sp := newTestServiceProvider(t, idp, spProvider,
+		Config{GroupsAttribute: "eduPersonAffiliation"})
+	values, requestID := login(t, idp, sp, &crewjamsaml.Session{
+		ID:       "session1",
+		NameID:   "Alice@example.com",
+		UserName: "alice",
+		Groups:   []string{"admins", "users"},
+	})
+	identity, err := sp.ParseResponse(newACSRequest(values), requestID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.NameID != "Alice@example.com" ||
+		identity.Username != "alice" || len(identity.Groups) != 2 ||
+		identity.Groups[0] != "admins" {
+		t.Fatalf("unexpected identity: %+v", identity)
+	}
+}
+
+func TestParseResponseUsernameAttribute(t *testing.T) {
+	idp, spProvider := newTestIdentityProvider(t)
+	sp := newTestServiceProvider(t, idp, spProvider,
+		Config{UsernameAttribute: "uid"})
+	values, requestID := login(t, idp, sp, &crewjamsaml.Session{
+		ID:       "session1",
+		NameID:   "12345",
+		UserName: "bob",
+		Groups:   []string{"admins"},
+	})
+	identity, err := sp.ParseResponse(newACSRequest(values), requestID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Username != "bob" || identity.Groups != nil {
+		t.Fatalf("unexpected identity: %+v", identity)
+	}
+}
+
+func TestParseResponseInvalid(t *testing.T) {
+	idp, spProvider := newTestIdentityProvider(t)
+	sp := newTestServiceProvider(t, idp, spProvider, Config{})
+	session := &crewjamsaml.Session{ID: "session1", NameID: "alice"}
+	values, _ := login(t, idp, sp, session)
+	if _, err := sp.ParseResponse(newACSRequest(values),
+		"other-request"); err == nil {
+		t.Fatal("response to another request accepted")
+	}
+	// A response signed by another identity provider is rejected.
+	otherIDP, otherSPProvider := newTestIdentityProvider(t)
+	otherSPProvider.metadata = spProvider.metadata
+	values, requestID := login(t, otherIDP, sp, session)
+	if _, err := sp.ParseResponse(newACSRequest(values),
+		requestID); err == nil {
+		t.Fatal("response from another identity provider accepted")
+	}
+	values, requestID = login(t, idp, sp, session)
+	values.Set("SAMLResponse",
+		base64.StdEncoding.EncodeToString([]byte("<Response/>")))
+	if _, err := sp.ParseResponse(newACSRequest(values),
+		requestID); err == nil {
+		t.Fatal("invalid response accepted")
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	idp, spProvider := newTestIdentityProvider(t)
+	sp := newTestServiceProvider(t, idp, spProvider, Config{})
+	data, err := sp.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var metadata crewjamsaml.EntityDescriptor
+	if err := xml.Unmarshal(data, &metadata); err != nil {
+		t.Fatal(err)
+	}
+	if metadata.EntityID != testMetadataURL ||
+		len(metadata.SPSSODescriptors) != 1 ||
+		metadata.SPSSODescriptors[0].AssertionConsumerServices[0].Location !=
+			testACSURL {
+		t.Fatalf("unexpected metadata: %s", data)
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	key, cert := newTestKeyPair(t, "keymaster.example.com")
+	for _, config := range []Config{
+		{MetadataURL: testMetadataURL, ACSURL: testACSURL},
+		{MetadataURL: testMetadataURL, ACSURL: testACSURL,
+			Certificate: cert, Key: key},
+		{MetadataURL: testMetadataURL, ACSURL: testACSURL,
+			Certificate: cert, Key: key, IDPMetadata: []byte("<bad")},
+	} {
+		if _, err := New(config, testlogger.New(t)); err == nil {
+			t.Fatalf("%+v should fail", config)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+// Package totp implements RFC 6238 time-based one-time passwords using
+// HMAC-SHA1, 6 digits and a 30 second period, which is what common
+// authenticator apps expect.
+package totp
+
+import (
+	"time"
+)
+
+const (
+	Digits = 6
+	Period = 30
+)
+
+// Key is a TOTP shared secret for one account.
+type Key struct {
+	Issuer      string
+	AccountName string
+	Secret      string // Base32 encoded without padding.
+}
+
+// GenerateKey returns a new Key with a random secret.
+func GenerateKey(issuer, accountName string) (*Key, error) {
+	return generateKey(issuer, accountName)
+}
+
+// URI returns the otpauth:// URI for the key. It is meant to be rendered as
+// a QR code for authenticator apps to scan.
+func (k *Key) URI() string {
+	return k.uri()
+}
+
+// GenerateCode returns the code for secret at time t.
+func GenerateCode(secret string, t time.Time) (string, error) {
+	return generateCode(secret, counterAt(t))
+}
+
+// Validate checks code against secret at time t, accepting codes up to skew
+// periods before or after t to allow for clock drift. If valid, the time
+// step counter of the matching code is returned so that callers can reject
+// reuse of the same or an earlier code.
+func Validate(secret string, code string, t time.Time, skew uint) (
+	int64, bool, error) {
+	return validate(secret, code, t, skew)
+}
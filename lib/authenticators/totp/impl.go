@@ -0,0 +1,110 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const secretSize = 20
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func generateKey(issuer, accountName string) (*Key, error) {
+	if accountName == "" {
+		return nil, errors.New("empty account name")
+	}
+	secret := make([]byte, secretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return &Key{
+		Issuer:      issuer,
+		AccountName: accountName,
+		Secret:      encoding.EncodeToString(secret),
+	}, nil
+}
+
+func (k *Key) uri() string {
+	label := k.AccountName
+	if k.Issuer != "" {
+		label = k.Issuer + ":" + k.AccountName
+	}
+	values := url.Values{}
+	values.Set("secret", k.Secret)
+	if k.Issuer != "" {
+		values.Set("issuer", k.Issuer)
+	}
+	values.Set("algorithm", "SHA1")
+	values.Set("digits", fmt.Sprintf("%d", Digits))
+	values.Set("period", fmt.Sprintf("%d", Period))
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + label,
+		RawQuery: values.Encode(),
+	}
+	return u.String()
+}
+
+func decodeSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.TrimRight(
+		strings.Replace(secret, " ", "", -1), "="))
+	return encoding.DecodeString(secret)
+}
+
+func counterAt(t time.Time) int64 {
+	return t.Unix() / Period
+}
+
+func generateCode(secret string, counter int64) (string, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return computeCode(key, counter), nil
+}
+
+// computeCode implements the HOTP dynamic truncation of RFC 4226.
+func computeCode(key []byte, counter int64) string {
+	var message [8]byte
+	binary.BigEndian.PutUint64(message[:], uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulus := uint32(1)
+	for i := 0; i < Digits; i++ {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", Digits, value%modulus)
+}
+
+func validate(secret string, code string, t time.Time, skew uint) (
+	int64, bool, error) {
+	code = strings.TrimSpace(code)
+	if len(code) != Digits {
+		return 0, false, nil
+	}
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return 0, false, err
+	}
+	counter := counterAt(t)
+	for offset := -int64(skew); offset <= int64(skew); offset++ {
+		expected := computeCode(key, counter+offset)
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return counter + offset, true, nil
+		}
+	}
+	return 0, false, nil
+}
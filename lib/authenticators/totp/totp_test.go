@@ -0,0 +1,86 @@
+package totp
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA1 test secret of RFC 6238 appendix B.
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestGenerateCodeRFC6238Vectors(t *testing.T) {
+	// The RFC lists 8 digit codes; 6 digit codes are their last 6 digits.
+	vectors := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+	for unixTime, expected := range vectors {
+		code, err := GenerateCode(rfc6238Secret, time.Unix(unixTime, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != expected {
+			t.Errorf("at %d: expected %s, got %s", unixTime, expected, code)
+		}
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	code, err := GenerateCode(rfc6238Secret, now.Add(-Period*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := Validate(rfc6238Secret, code, now, 0); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("previous period accepted without skew")
+	}
+	counter, ok, err := Validate(rfc6238Secret, code, now, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("previous period rejected with skew")
+	}
+	if counter != counterAt(now)-1 {
+		t.Fatalf("unexpected counter %d", counter)
+	}
+	if _, ok, _ := Validate(rfc6238Secret, "12345", now, 1); ok {
+		t.Fatal("short code accepted")
+	}
+}
+
+func TestKeyURI(t *testing.T) {
+	key, err := GenerateKey("keymaster.example.com", "username")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(key.URI())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" {
+		t.Fatalf("unexpected URI %s", key.URI())
+	}
+	if u.Path != "/keymaster.example.com:username" {
+		t.Fatalf("unexpected label %s", u.Path)
+	}
+	if u.Query().Get("secret") != key.Secret {
+		t.Fatal("secret missing from URI")
+	}
+	code, err := GenerateCode(key.Secret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := Validate(key.Secret, code, time.Now(), 1); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("generated code rejected")
+	}
+}
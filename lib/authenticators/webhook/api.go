@@ -0,0 +1,97 @@
+// Package webhook implements a second factor which is checked by an external
+// HTTPS service, so that bespoke MFA systems can approve Keymaster logins.
+//
+// For each step of a login a JSON Request is POSTed to the webhook URL. The
+// request is signed: the X-Keymaster-Timestamp header holds the time in
+// seconds since the epoch and the X-Keymaster-Signature header holds "v1="
+// followed by the hex encoded HMAC-SHA256, keyed with the signing key, of the
+// timestamp, a "." and the request body. The webhook answers with a JSON
+// Response. The first request of a login has no Response or State; the
+// webhook may then approve or deny the login, ask the user for a response
+// (such as a code) or report that approval is pending (such as a push to a
+// phone), in which case the request is repeated until it is decided.
+package webhook
+
+import (
+	"crypto/x509"
+	"net/http"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+)
+
+// Names of the request headers carrying the signature.
+const (
+	SignatureHeader = "X-Keymaster-Signature"
+	TimestampHeader = "X-Keymaster-Timestamp"
+)
+
+// Results in a Response.
+const (
+	ResultAllow     = "allow"     // The login is approved.
+	ResultDeny      = "deny"      // The login is denied.
+	ResultChallenge = "challenge" // The user must answer Message.
+	ResultPending   = "pending"   // Approval is pending, ask again later.
+)
+
+// Config describes the webhook.
+type Config struct {
+	URL        string // Must be https.
+	SigningKey string
+	// Timeout limits each request. The default is 10 seconds.
+	Timeout time.Duration
+	// RootCAs verifies the certificate of the webhook. If nil the system
+	// roots are used.
+	RootCAs *x509.CertPool
+}
+
+// Request is the body of a request to the webhook.
+type Request struct {
+	Version       int    `json:"version"`
+	RequestID     string `json:"request_id"` // Unique for every request.
+	Timestamp     int64  `json:"timestamp"`  // Same as TimestampHeader.
+	Username      string `json:"username"`
+	RemoteAddress string `json:"remote_address,omitempty"`
+	// Response is the answer of the user to a challenge.
+	Response string `json:"response,omitempty"`
+	// State is the State of the previous Response of this login.
+	State string `json:"state,omitempty"`
+}
+
+// Response is the answer of the webhook.
+type Response struct {
+	Result string `json:"result"` // One of the Result* constants.
+	// Message is shown to the user: the question for a challenge or the
+	// reason for a denial or pending approval.
+	Message string `json:"message,omitempty"`
+	// State is opaque to Keymaster and passed in the next Request of a
+	// challenge or pending login.
+	State string `json:"state,omitempty"`
+}
+
+// Authenticator sends signed requests to the webhook.
+type Authenticator struct {
+	config     Config
+	httpClient *http.Client
+	logger     log.DebugLogger
+}
+
+// New creates an Authenticator for the webhook in config.
+func New(config Config, logger log.DebugLogger) (*Authenticator, error) {
+	return newAuthenticator(config, logger)
+}
+
+// Authenticate sends a signed request for username. remoteAddress is the
+// address of the user, response and state are empty for the first request of
+// a login. A denial is not an error: an error is returned if the webhook gave
+// no valid answer.
+func (a *Authenticator) Authenticate(username, remoteAddress, response,
+	state string) (*Response, error) {
+	return a.authenticate(username, remoteAddress, response, state)
+}
+
+// Sign returns the value of the SignatureHeader for a request with body sent
+// at timestamp. Webhooks written in Go may use it to check requests.
+func Sign(signingKey string, timestamp string, body []byte) string {
+	return sign(signingKey, timestamp, body)
+}
@@ -0,0 +1,135 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+)
+
+const (
+	defaultTimeout  = 10 * time.Second
+	protocolVersion = 1
+	// maxResponseSize limits the response body read from the webhook.
+	maxResponseSize = 64 << 10
+)
+
+func newAuthenticator(config Config, logger log.DebugLogger) (
+	*Authenticator, error) {
+	webhookURL, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, err
+	}
+	if webhookURL.Scheme != "https" || webhookURL.Host == "" {
+		return nil, errors.New("webhook URL must be https")
+	}
+	if config.SigningKey == "" {
+		return nil, errors.New("no webhook signing key")
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultTimeout
+	}
+	return &Authenticator{
+		config: config,
+		httpClient: &http.Client{
+			Timeout: config.Timeout,
+			Transport: &http.Transport{
+				Proxy: http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{
+					RootCAs:    config.RootCAs,
+					MinVersion: tls.VersionTLS12,
+				},
+			},
+			// The signature covers a single destination.
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		logger: logger,
+	}, nil
+}
+
+func sign(signingKey string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(signingKey))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newRequestID() (string, error) {
+	buffer := make([]byte, 16)
+	if _, err := rand.Read(buffer); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buffer), nil
+}
+
+func (a *Authenticator) authenticate(username, remoteAddress, response,
+	state string) (*Response, error) {
+	requestID, err := newRequestID()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	body, err := json.Marshal(Request{
+		Version:       protocolVersion,
+		RequestID:     requestID,
+		Timestamp:     now,
+		Username:      username,
+		RemoteAddress: remoteAddress,
+		Response:      response,
+		State:         state,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", a.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	timestamp := strconv.FormatInt(now, 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, sign(a.config.SigningKey, timestamp, body))
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	var result Response
+	decoder := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize))
+	if err := decoder.Decode(&result); err != nil {
+		return nil, fmt.Errorf("cannot decode webhook response: %s", err)
+	}
+	switch result.Result {
+	case ResultAllow, ResultDeny:
+	case ResultChallenge, ResultPending:
+		if result.State == "" {
+			return nil, fmt.Errorf("webhook %s without state", result.Result)
+		}
+	default:
+		return nil, fmt.Errorf("unknown webhook result: \"%s\"", result.Result)
+	}
+	a.logger.Debugf(1, "webhook %s for %s (request %s)", result.Result,
+		username, requestID)
+	return &result, nil
+}
@@ -0,0 +1,148 @@
+package webhook
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log/testlogger"
+)
+
+const testSigningKey = "signing-key"
+
+// testWebhook sends a push to "push-user", which is approved on the second
+// check, and asks other users for the code 424242.
+func testWebhook(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		signature := Sign(testSigningKey, r.Header.Get(TimestampHeader), body)
+		if r.Header.Get(SignatureHeader) != signature {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var request Request
+		if err := json.Unmarshal(body, &request); err != nil {
+			t.Error(err)
+			return
+		}
+		if request.Version != 1 || request.RequestID == "" {
+			t.Errorf("bad request: %+v", request)
+		}
+		var response Response
+		switch {
+		case request.Username == "push-user" && request.State == "":
+			response = Response{Result: ResultPending, State: "push-1"}
+		case request.State == "push-1":
+			response = Response{Result: ResultPending, State: "push-2"}
+		case request.State == "push-2":
+			response = Response{Result: ResultAllow}
+		case request.State == "":
+			response = Response{Result: ResultChallenge,
+				Message: "Enter code", State: "code"}
+		case request.Response == "424242":
+			response = Response{Result: ResultAllow}
+		default:
+			response = Response{Result: ResultDeny, Message: "Bad code"}
+		}
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+func newTestAuthenticator(t *testing.T, handler http.Handler,
+	signingKey string) *Authenticator {
+	server := httptest.NewTLSServer(handler)
+	t.Cleanup(server.Close)
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(server.Certificate())
+	a, err := New(Config{
+		URL:        server.URL + "/mfa",
+		SigningKey: signingKey,
+		RootCAs:    rootCAs,
+	}, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestAuthenticateChallenge(t *testing.T) {
+	a := newTestAuthenticator(t, testWebhook(t), testSigningKey)
+	response, err := a.Authenticate("username", "10.0.0.1", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Result != ResultChallenge || response.Message != "Enter code" {
+		t.Fatalf("expected challenge, got %+v", response)
+	}
+	for code, expected := range map[string]string{
+		"000000": ResultDeny,
+		"424242": ResultAllow,
+	} {
+		response, err := a.Authenticate("username", "10.0.0.1", code,
+			"code")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.Result != expected {
+			t.Fatalf("code %s: expected %s, got %+v", code, expected, response)
+		}
+	}
+}
+
+func TestAuthenticatePending(t *testing.T) {
+	a := newTestAuthenticator(t, testWebhook(t), testSigningKey)
+	var state string
+	for _, expected := range []string{ResultPending, ResultPending,
+		ResultAllow} {
+		response, err := a.Authenticate("push-user", "", "", state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.Result != expected {
+			t.Fatalf("expected %s, got %+v", expected, response)
+		}
+		state = response.State
+	}
+}
+
+func TestAuthenticateBadSignature(t *testing.T) {
+	a := newTestAuthenticator(t, testWebhook(t), "wrong-key")
+	if _, err := a.Authenticate("username", "", "", ""); err == nil {
+		t.Fatal("webhook should have rejected the signature")
+	}
+}
+
+func TestAuthenticateBadResponse(t *testing.T) {
+	for _, body := range []string{
+		`{"result":"maybe"}`,
+		`{"result":"challenge","message":"Enter code"}`,
+		`not json`,
+	} {
+		body := body
+		a := newTestAuthenticator(t, http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(body))
+			}), testSigningKey)
+		if _, err := a.Authenticate("username", "", "", ""); err == nil {
+			t.Fatalf("response %s should have failed", body)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(Config{URL: "http://mfa.example.com/",
+		SigningKey: testSigningKey}, testlogger.New(t)); err == nil {
+		t.Fatal("plain http URL should have been rejected")
+	}
+	if _, err := New(Config{URL: "https://mfa.example.com/"},
+		testlogger.New(t)); err == nil {
+		t.Fatal("missing signing key should have been rejected")
+	}
+}
@@ -11,12 +11,13 @@ import (
 	"net"
 	"net/url"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
+	"unicode/utf16"
 
 	"github.com/cviecco/argon2"
 	"github.com/foomo/htpasswd"
-	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/ldap.v2"
 )
 
@@ -37,6 +38,11 @@ const argon2dPrefix = "$argon2d$"
 
 const randomStringEntropyBytes = 32
 
+// ErrUserNotFound is returned by the LDAP group lookups when the user search
+// does not find exactly one entry.
+var ErrUserNotFound = errors.New(
+	"User does not exist or too many entries returned")
+
 func genRandomString() (string, error) {
 	size := randomStringEntropyBytes
 	rb := make([]byte, size)
@@ -85,6 +91,9 @@ func Argon2CompareHashAndPassword(hash string, password []byte) error {
 	//return nil
 }
 
+// CheckHtpasswdUserPassword returns true if the htpasswd file contents in
+// htpasswdBytes have a bcrypt, argon2id or scrypt hash for username which
+// matches password.
 func CheckHtpasswdUserPassword(username string, password string, htpasswdBytes []byte) (bool, error) {
 	//	secrets := HtdigestFileProvider(htpasswdFilename)
 	passwords, err := htpasswd.ParseHtpasswd(htpasswdBytes)
@@ -95,27 +104,24 @@ func CheckHtpasswdUserPassword(username string, password string, htpasswdBytes [
 	if !ok {
 		return false, nil
 	}
-	// only understand bcrypt
-	if !strings.HasPrefix(hash, "$2y$") {
-		err := errors.New("Can only use bcrypt for htpasswd")
-		return false, err
-	}
-	err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	if err != nil {
-		return false, nil
-	}
-	return true, nil
-
+	return checkPasswordHash(hash, []byte(password))
 }
 
+// getLDAPConnection returns a started connection to the server at u. For
+// ldap:// URLs the connection is upgraded with StartTLS and it fails closed
+// if the server refuses the upgrade.
 func getLDAPConnection(u url.URL, timeoutSecs uint, rootCAs *x509.CertPool) (*ldap.Conn, string, error) {
-	if u.Scheme != "ldaps" {
-		err := errors.New("Invalid ldap scheme (we only support ldaps")
+	var port string
+	switch u.Scheme {
+	case "ldaps":
+		port = "636"
+	case "ldap":
+		port = "389"
+	default:
+		err := errors.New("Invalid ldap scheme (we only support ldaps or ldap with StartTLS)")
 		return nil, "", err
 	}
-	//hostnamePort := server + ":636"
 	serverPort := strings.Split(u.Host, ":")
-	port := "636"
 	if len(serverPort) == 2 {
 		port = serverPort[1]
 	}
@@ -123,9 +129,28 @@ func getLDAPConnection(u url.URL, timeoutSecs uint, rootCAs *x509.CertPool) (*ld
 	hostnamePort := server + ":" + port
 
 	timeout := time.Duration(time.Duration(timeoutSecs) * time.Second)
+	tlsConfig := &tls.Config{ServerName: server, RootCAs: rootCAs}
+	dialer := &net.Dialer{Timeout: timeout}
 	start := time.Now()
-	tlsConn, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", hostnamePort,
-		&tls.Config{ServerName: server, RootCAs: rootCAs})
+	if u.Scheme == "ldap" {
+		rawConn, err := dialer.Dial("tcp", hostnamePort)
+		if err != nil {
+			errorTime := time.Since(start).Seconds() * 1000
+			log.Printf("connction failure for:%s (%s)(time(ms)=%v)", server, err.Error(), errorTime)
+			return nil, "", err
+		}
+		conn := ldap.NewConn(rawConn, false)
+		conn.SetTimeout(timeout)
+		conn.Start()
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			log.Printf("StartTLS failure for:%s (%s)", server, err.Error())
+			return nil, "", fmt.Errorf("StartTLS upgrade failed for %s: %s",
+				server, err)
+		}
+		return conn, server, nil
+	}
+	tlsConn, err := tls.DialWithDialer(dialer, "tcp", hostnamePort, tlsConfig)
 	if err != nil {
 		errorTime := time.Since(start).Seconds() * 1000
 		log.Printf("connction failure for:%s (%s)(time(ms)=%v)", server, err.Error(), errorTime)
@@ -134,6 +159,8 @@ func getLDAPConnection(u url.URL, timeoutSecs uint, rootCAs *x509.CertPool) (*ld
 
 	// we dont close the tls connection directly  close defer to the new ldap connection
 	conn := ldap.NewConn(tlsConn, true)
+	conn.SetTimeout(timeout)
+	conn.Start()
 	return conn, server, nil
 }
 
@@ -143,40 +170,180 @@ func CheckLDAPConnection(u url.URL, timeoutSecs uint, rootCAs *x509.CertPool) er
 		return err
 	}
 	defer conn.Close()
-	timeout := time.Duration(time.Duration(timeoutSecs) * time.Second)
-	conn.SetTimeout(timeout)
-	conn.Start()
 	return nil
 }
 
 func CheckLDAPUserPassword(u url.URL, bindDN string, bindPassword string, timeoutSecs uint, rootCAs *x509.CertPool) (bool, error) {
-	timeout := time.Duration(time.Duration(timeoutSecs) * time.Second)
+	valid, _, err := CheckLDAPUserPasswordWithStatus(u, bindDN, bindPassword,
+		timeoutSecs, rootCAs)
+	return valid, err
+}
+
+// LDAPPasswordStatus is the state of a password reported by an LDAP server
+// when binding with it.
+type LDAPPasswordStatus struct {
+	// MustChange is true if the password is correct but has expired or was
+	// reset, so that it must be changed before it can be used.
+	MustChange bool
+	// ExpiresIn is the time until the password expires, or zero if the
+	// server did not say.
+	ExpiresIn time.Duration
+}
+
+// Active Directory reports correct but unusable passwords in the diagnostic
+// message of the bind error: data 532 means expired and data 773 means the
+// password must be reset.
+var adMustChangeRE = regexp.MustCompile(`data (532|773),`)
+
+// getLDAPPasswordStatus extracts the password state from the response
+// controls of a bind and its error.
+func getLDAPPasswordStatus(controls []ldap.Control,
+	bindErr error) LDAPPasswordStatus {
+	var status LDAPPasswordStatus
+	if bindErr != nil && adMustChangeRE.MatchString(bindErr.Error()) {
+		status.MustChange = true
+	}
+	for _, control := range controls {
+		switch control := control.(type) {
+		case *ldap.ControlBeheraPasswordPolicy:
+			switch control.Error {
+			case ldap.BeheraPasswordExpired, ldap.BeheraChangeAfterReset:
+				status.MustChange = true
+			}
+			if control.Expire > 0 {
+				status.ExpiresIn = time.Duration(control.Expire) * time.Second
+			}
+		case *ldap.ControlVChuPasswordMustChange:
+			status.MustChange = status.MustChange || control.MustChange
+		case *ldap.ControlVChuPasswordWarning:
+			if control.Expire > 0 {
+				status.ExpiresIn = time.Duration(control.Expire) * time.Second
+			}
+		}
+	}
+	return status
+}
+
+// CheckLDAPUserPasswordWithStatus is like CheckLDAPUserPassword, but also
+// returns the password state reported by the server, using the password
+// policy controls (draft-behera-ldap-password-policy and
+// draft-vchu-ldap-pwd-policy) and the bind errors of Active Directory. A
+// password which must be changed is reported as valid only if the server
+// accepted the bind.
+func CheckLDAPUserPasswordWithStatus(u url.URL, bindDN string,
+	bindPassword string, timeoutSecs uint, rootCAs *x509.CertPool) (
+	bool, LDAPPasswordStatus, error) {
 	conn, server, err := getLDAPConnection(u, timeoutSecs, rootCAs)
 	if err != nil {
-		return false, err
+		return false, LDAPPasswordStatus{}, err
 	}
 	defer conn.Close()
 
 	//connectionTime := time.Since(start).Seconds() * 1000
 
-	conn.SetTimeout(timeout)
-	conn.Start()
-	err = conn.Bind(bindDN, bindPassword)
+	result, err := conn.SimpleBind(ldap.NewSimpleBindRequest(bindDN,
+		bindPassword,
+		[]ldap.Control{ldap.NewControlBeheraPasswordPolicy()}))
+	var controls []ldap.Control
+	if result != nil {
+		controls = result.Controls
+	}
+	status := getLDAPPasswordStatus(controls, err)
 	if err != nil {
-		log.Printf("Bind failure for server:%s bindDN:'%s' (%s)", server, bindDN, err.Error())
+		// Rejected passwords are recorded by the audit log of the caller.
 		if strings.Contains(err.Error(), "Invalid Credentials") {
-			return false, nil
+			return false, status, nil
 		}
-		return false, err
+		log.Printf("Bind failure for server:%s bindDN:'%s' (%s)", server, bindDN, err.Error())
+		return false, LDAPPasswordStatus{}, err
 	}
-	return true, nil
+	return true, status, nil
+}
+
+// encodeADPassword returns the value of the unicodePwd attribute of Active
+// Directory for password: quoted and in UTF-16LE.
+func encodeADPassword(password string) string {
+	quoted := []rune("\"" + password + "\"")
+	encoded := make([]byte, 0, len(quoted)*2)
+	for _, r := range utf16.Encode(quoted) {
+		encoded = append(encoded, byte(r), byte(r>>8))
+	}
+	return string(encoded)
+}
+
+// ChangeLDAPUserPassword binds as bindDN with oldPassword and replaces it
+// with newPassword, using the password modify extended operation (RFC 3062)
+// or, for Active Directory which does not support it, a modify of
+// unicodePwd. The server must accept the bind, so expired passwords can
+// only be changed while the password policy grants grace logins.
+func ChangeLDAPUserPassword(u url.URL, bindDN string, oldPassword string,
+	newPassword string, timeoutSecs uint, rootCAs *x509.CertPool) error {
+	return ChangeLDAPUserPasswordWithAccount(u, bindDN, oldPassword,
+		newPassword, "", "", timeoutSecs, rootCAs)
+}
+
+// ChangeLDAPUserPasswordWithAccount is like ChangeLDAPUserPassword, but if
+// Active Directory refuses the bind because the old password has expired or
+// must be changed, which it only reports for correct passwords, it binds as
+// accountDN with accountPassword instead to modify unicodePwd. The modify
+// deletes the old password, so Active Directory checks it again and applies
+// its password policy as for a change by the user. The account only needs
+// the "Change Password" right, which Active Directory grants to everyone by
+// default. If accountDN is empty this is ChangeLDAPUserPassword.
+func ChangeLDAPUserPasswordWithAccount(u url.URL, bindDN string,
+	oldPassword string, newPassword string, accountDN string,
+	accountPassword string, timeoutSecs uint, rootCAs *x509.CertPool) error {
+	conn, server, err := getLDAPConnection(u, timeoutSecs, rootCAs)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.Bind(bindDN, oldPassword); err != nil {
+		if accountDN == "" || !adMustChangeRE.MatchString(err.Error()) {
+			log.Printf("Bind failure for server:%s bindDN:'%s' (%s)", server, bindDN, err.Error())
+			return err
+		}
+		if err := conn.Bind(accountDN, accountPassword); err != nil {
+			log.Printf("Bind failure for server:%s bindDN:'%s' (%s)", server, accountDN, err.Error())
+			return err
+		}
+		return modifyADPassword(conn, bindDN, oldPassword, newPassword)
+	}
+	_, err = conn.PasswordModify(ldap.NewPasswordModifyRequest("",
+		oldPassword, newPassword))
+	if !ldap.IsErrorWithCode(err, ldap.LDAPResultProtocolError) {
+		return err
+	}
+	return modifyADPassword(conn, bindDN, oldPassword, newPassword)
+}
+
+// modifyADPassword replaces oldPassword of the Active Directory user userDN
+// with newPassword. Deleting the old value makes this a password change,
+// not a reset.
+func modifyADPassword(conn *ldap.Conn, userDN string, oldPassword string,
+	newPassword string) error {
+	modifyRequest := ldap.NewModifyRequest(userDN)
+	modifyRequest.Delete("unicodePwd", []string{encodeADPassword(oldPassword)})
+	modifyRequest.Add("unicodePwd", []string{encodeADPassword(newPassword)})
+	return conn.Modify(modifyRequest)
 }
 
 func ParseLDAPURL(ldapUrl string) (*url.URL, error) {
+	return ParseLDAPURLWithStartTLS(ldapUrl, false)
+}
+
+// ParseLDAPURLWithStartTLS parses ldapUrl. If allowStartTLS is true ldap://
+// URLs are accepted in addition to ldaps:// URLs. Connections to ldap:// URLs
+// are always upgraded with StartTLS and fail if the upgrade is refused.
+func ParseLDAPURLWithStartTLS(ldapUrl string, allowStartTLS bool) (
+	*url.URL, error) {
 	u, err := url.Parse(ldapUrl)
 	if err != nil {
 		return nil, err
 	}
+	if u.Scheme == "ldap" && allowStartTLS {
+		return u, nil
+	}
 	if u.Scheme != "ldaps" {
 		err := errors.New("Invalid ldap scheme (we only support ldaps")
 		return nil, err
@@ -185,14 +352,14 @@ func ParseLDAPURL(ldapUrl string) (*url.URL, error) {
 	return u, nil
 }
 
-func getUserDNAndSimpleGroups(conn *ldap.Conn, UserSearchBaseDNs []string, UserSearchFilter string, username string) (string, []string, error) {
+func getUserDNAndSimpleGroups(conn *ldap.Conn, UserSearchBaseDNs []string, UserSearchFilter string, username string, groupAttribute string) (string, []string, error) {
 	for _, searchDN := range UserSearchBaseDNs {
 		searchRequest := ldap.NewSearchRequest(
 			searchDN,
 			ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
 			//fmt.Sprintf("(&(objectClass=organizationalPerson)&(uid=%s))", username),
 			fmt.Sprintf(UserSearchFilter, username),
-			[]string{"dn", "memberOf"},
+			[]string{"dn", groupAttribute},
 			nil,
 		)
 		sr, err := conn.Search(searchRequest)
@@ -204,7 +371,7 @@ func getUserDNAndSimpleGroups(conn *ldap.Conn, UserSearchBaseDNs []string, UserS
 			continue
 		}
 		userDN := sr.Entries[0].DN
-		userGroups := sr.Entries[0].GetAttributeValues("memberOf")
+		userGroups := sr.Entries[0].GetAttributeValues(groupAttribute)
 		return userDN, userGroups, nil
 	}
 	return "", nil, nil
@@ -240,7 +407,7 @@ func getSimpleUserAttributes(conn *ldap.Conn, UserSearchBaseDNs []string,
 }
 
 func extractCNFromDNString(input []string) (output []string, err error) {
-	re := regexp.MustCompile("^cn=([^,]+),.*")
+	re := regexp.MustCompile("(?i)^cn=([^,]+),.*")
 	for _, dn := range input {
 		matches := re.FindStringSubmatch(dn)
 		if len(matches) == 2 {
@@ -253,24 +420,41 @@ func extractCNFromDNString(input []string) (output []string, err error) {
 	return output, nil
 }
 
+// getUserGroupsRFC2307bis returns the groups listed in the group attribute
+// of the user, the DN of the user and the DNs of the groups.
 func getUserGroupsRFC2307bis(conn *ldap.Conn, UserSearchBaseDNs []string,
-	UserSearchFilter string, username string) ([]string, error) {
-	dn, groupDNs, err := getUserDNAndSimpleGroups(conn, UserSearchBaseDNs, UserSearchFilter, username)
+	UserSearchFilter string, username string, GroupSearchBaseDNs []string,
+	groupConfig LDAPGroupConfig) ([]string, string, []string, error) {
+	groupAttribute := groupConfig.attribute()
+	dn, values, err := getUserDNAndSimpleGroups(conn, UserSearchBaseDNs,
+		UserSearchFilter, username, groupAttribute)
 	if err != nil {
-		return nil, err
+		return nil, "", nil, err
 	}
 	if dn == "" {
-		return nil, errors.New("User does not exist or too many entries returned")
+		return nil, "", nil, ErrUserNotFound
 	}
-	groupCNs, err := extractCNFromDNString(groupDNs)
-	if err != nil {
-		return nil, err
+	if strings.EqualFold(groupAttribute, "gidNumber") {
+		searchBaseDNs := GroupSearchBaseDNs
+		if len(searchBaseDNs) < 1 {
+			searchBaseDNs = UserSearchBaseDNs
+		}
+		groupCNs, groupDNs, err := getGroupsByGIDNumber(conn, searchBaseDNs,
+			values)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		return groupCNs, dn, groupDNs, nil
 	}
-	return groupCNs, nil
+	groupCNs, groupDNs := splitGroupValues(values)
+	return groupCNs, dn, groupDNs, nil
 }
 
+// getUserGroupsRFC2307 returns the CNs and the DNs of the groups matching
+// groupSearchFilter for the user.
 func getUserGroupsRFC2307(conn *ldap.Conn, GroupSearchBaseDNs []string,
-	groupSearchFilter string, username string) (userGroups []string, err error) {
+	groupSearchFilter string, username string) (userGroups []string,
+	groupDNs []string, err error) {
 	for _, searchDN := range GroupSearchBaseDNs {
 		searchRequest := ldap.NewSearchRequest(
 			searchDN,
@@ -282,13 +466,14 @@ func getUserGroupsRFC2307(conn *ldap.Conn, GroupSearchBaseDNs []string,
 		sr, err := conn.Search(searchRequest)
 		if err != nil {
 			log.Printf("error on search request err:%s", err)
-			return nil, err
+			return nil, nil, err
 		}
 		for _, entry := range sr.Entries {
 			userGroups = append(userGroups, entry.GetAttributeValues("cn")...)
+			groupDNs = append(groupDNs, entry.DN)
 		}
 	}
-	return userGroups, nil
+	return userGroups, groupDNs, nil
 }
 
 func GetLDAPUserGroups(u url.URL, bindDN string, bindPassword string,
@@ -296,26 +481,55 @@ func GetLDAPUserGroups(u url.URL, bindDN string, bindPassword string,
 	username string,
 	UserSearchBaseDNs []string, UserSearchFilter string,
 	GroupSearchBaseDNs []string, GroupSearchFilter string) ([]string, error) {
-	timeout := time.Duration(time.Duration(timeoutSecs) * time.Second)
+	userGroups, _, err := GetLDAPUserGroupsWithLimit(u, bindDN, bindPassword,
+		timeoutSecs, rootCAs, username,
+		UserSearchBaseDNs, UserSearchFilter,
+		GroupSearchBaseDNs, GroupSearchFilter, 0, nil)
+	return userGroups, err
+}
+
+// GetLDAPUserGroupsWithLimit is like GetLDAPUserGroups but returns at most
+// maxGroups groups. Groups matching relevantGroupsRE (if not nil) are kept
+// first, then the rest in lexical order. The returned boolean is true if
+// groups were dropped. A maxGroups value of zero means no limit.
+func GetLDAPUserGroupsWithLimit(u url.URL, bindDN string, bindPassword string,
+	timeoutSecs uint, rootCAs *x509.CertPool,
+	username string,
+	UserSearchBaseDNs []string, UserSearchFilter string,
+	GroupSearchBaseDNs []string, GroupSearchFilter string,
+	maxGroups int, relevantGroupsRE *regexp.Regexp) ([]string, bool, error) {
 	conn, _, err := getLDAPConnection(u, timeoutSecs, rootCAs)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	defer conn.Close()
 
-	conn.SetTimeout(timeout)
-	conn.Start()
 	err = conn.Bind(bindDN, bindPassword)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
-	rfcGroups, err := getUserGroupsRFC2307(conn, GroupSearchBaseDNs, GroupSearchFilter, username)
+	return getUserGroupsWithLimit(conn, username,
+		UserSearchBaseDNs, UserSearchFilter,
+		GroupSearchBaseDNs, GroupSearchFilter, maxGroups, relevantGroupsRE,
+		LDAPGroupConfig{}, nestedGroupOptions{})
+}
+
+func getUserGroupsWithLimit(conn *ldap.Conn, username string,
+	UserSearchBaseDNs []string, UserSearchFilter string,
+	GroupSearchBaseDNs []string, GroupSearchFilter string,
+	maxGroups int, relevantGroupsRE *regexp.Regexp,
+	groupConfig LDAPGroupConfig,
+	nested nestedGroupOptions) ([]string, bool, error) {
+	rfcGroups, rfcGroupDNs, err := getUserGroupsRFC2307(conn,
+		GroupSearchBaseDNs, GroupSearchFilter, username)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
-	memberGroups, err := getUserGroupsRFC2307bis(conn, UserSearchBaseDNs, UserSearchFilter, username)
+	memberGroups, userDN, memberGroupDNs, err := getUserGroupsRFC2307bis(
+		conn, UserSearchBaseDNs, UserSearchFilter, username,
+		GroupSearchBaseDNs, groupConfig)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	groupMap := make(map[string]struct{})
 	for _, group := range rfcGroups {
@@ -324,11 +538,103 @@ func GetLDAPUserGroups(u url.URL, bindDN string, bindPassword string,
 	for _, group := range memberGroups {
 		groupMap[group] = struct{}{}
 	}
+	if nested.maxDepth > 0 {
+		nestedSearchBaseDNs := GroupSearchBaseDNs
+		if len(nestedSearchBaseDNs) < 1 {
+			nestedSearchBaseDNs = UserSearchBaseDNs
+		}
+		nestedGroups, err := getNestedUserGroups(conn, nestedSearchBaseDNs,
+			userDN, append(rfcGroupDNs, memberGroupDNs...), nested)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, group := range nestedGroups {
+			groupMap[group] = struct{}{}
+		}
+	}
 	var userGroups []string
 	for group := range groupMap {
 		userGroups = append(userGroups, group)
 	}
-	return userGroups, nil
+	userGroups = groupConfig.filterGroups(userGroups)
+	numGroups := len(userGroups)
+	userGroups, truncated := limitGroups(userGroups, maxGroups,
+		relevantGroupsRE)
+	if truncated {
+		log.Printf("groups for user %s truncated from %d to %d",
+			username, numGroups, len(userGroups))
+	}
+	return userGroups, truncated, nil
+}
+
+func limitGroups(groups []string, maxGroups int,
+	relevantGroupsRE *regexp.Regexp) ([]string, bool) {
+	if maxGroups < 1 || len(groups) <= maxGroups {
+		return groups, false
+	}
+	var relevantGroups, otherGroups []string
+	for _, group := range groups {
+		if relevantGroupsRE != nil && relevantGroupsRE.MatchString(group) {
+			relevantGroups = append(relevantGroups, group)
+		} else {
+			otherGroups = append(otherGroups, group)
+		}
+	}
+	sort.Strings(relevantGroups)
+	sort.Strings(otherGroups)
+	return append(relevantGroups, otherGroups...)[:maxGroups], true
+}
+
+// GetLDAPNamingContexts queries the RootDSE of the LDAP server at u and
+// returns the defaultNamingContext (if present) followed by the remaining
+// namingContexts. If bindDN is empty the query is made anonymously.
+func GetLDAPNamingContexts(u url.URL, bindDN string, bindPassword string,
+	timeoutSecs uint, rootCAs *x509.CertPool) ([]string, error) {
+	conn, _, err := getLDAPConnection(u, timeoutSecs, rootCAs)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if bindDN != "" {
+		err = conn.Bind(bindDN, bindPassword)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return getNamingContexts(conn)
+}
+
+func getNamingContexts(conn *ldap.Conn) ([]string, error) {
+	searchRequest := ldap.NewSearchRequest(
+		"",
+		ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)",
+		[]string{"defaultNamingContext", "namingContexts"},
+		nil,
+	)
+	sr, err := conn.Search(searchRequest)
+	if err != nil {
+		return nil, err
+	}
+	if len(sr.Entries) != 1 {
+		return nil, errors.New("unexpected number of RootDSE entries")
+	}
+	entry := sr.Entries[0]
+	var namingContexts []string
+	seen := make(map[string]struct{})
+	for _, dn := range append(entry.GetAttributeValues("defaultNamingContext"),
+		entry.GetAttributeValues("namingContexts")...) {
+		if _, ok := seen[dn]; ok || dn == "" {
+			continue
+		}
+		seen[dn] = struct{}{}
+		namingContexts = append(namingContexts, dn)
+	}
+	if len(namingContexts) < 1 {
+		return nil, errors.New("no naming contexts found in RootDSE")
+	}
+	return namingContexts, nil
 }
 
 func GetLDAPUserAttributes(u url.URL, bindDN string, bindPassword string,
@@ -337,15 +643,12 @@ func GetLDAPUserAttributes(u url.URL, bindDN string, bindPassword string,
 	UserSearchBaseDNs []string, UserSearchFilter string,
 	attributes []string) (map[string][]string, error) {
 
-	timeout := time.Duration(time.Duration(timeoutSecs) * time.Second)
 	conn, _, err := getLDAPConnection(u, timeoutSecs, rootCAs)
 	if err != nil {
 		return nil, err
 	}
 	defer conn.Close()
 
-	conn.SetTimeout(timeout)
-	conn.Start()
 	err = conn.Bind(bindDN, bindPassword)
 	if err != nil {
 		return nil, err
@@ -3,14 +3,18 @@ package authutil
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"log"
 	"net"
 	"net/url"
+	"regexp"
 	"sort"
+	"sync"
 	"testing"
 	"time"
 
 	ldap "github.com/vjeantet/ldapserver"
+	goldap "gopkg.in/ldap.v2"
 )
 
 /* To generate certs, I used all data here should expire around Jan 1 2037:
@@ -166,8 +170,23 @@ func handleSearchGroup(w ldap.ResponseWriter, m *ldap.Message) {
 	w.Write(res)
 }
 
+func handleSearchRootDSE(w ldap.ResponseWriter, m *ldap.Message) {
+	e := ldap.NewSearchResultEntry("")
+	e.AddAttribute("defaultNamingContext", "dc=example,dc=com")
+	e.AddAttribute("namingContexts", "dc=example,dc=com",
+		"cn=Configuration,dc=example,dc=com")
+	w.Write(e)
+
+	res := ldap.NewSearchResultDoneResponse(ldap.LDAPResultSuccess)
+	w.Write(res)
+}
+
 func handleSearch(w ldap.ResponseWriter, m *ldap.Message) {
 	r := m.GetSearchRequest()
+	if string(r.BaseObject()) == "" {
+		handleSearchRootDSE(w, m)
+		return
+	}
 	log.Printf("Request BaseDn=%s", r.BaseObject())
 	log.Printf("Request Filter=%s", r.Filter())
 	log.Printf("Request FilterString=%s", r.FilterString())
@@ -198,6 +217,91 @@ func handleSearch(w ldap.ResponseWriter, m *ldap.Message) {
 
 }
 
+// handleStartTLS upgrades the client connection to TLS.
+func handleStartTLS(w ldap.ResponseWriter, m *ldap.Message) {
+	tlsconfig, _ := getTLSconfig()
+	tlsConn := tls.Server(m.Client.GetConn(), tlsconfig)
+	res := ldap.NewExtendedResponse(ldap.LDAPResultSuccess)
+	res.SetResponseName(ldap.NoticeOfStartTLS)
+	w.Write(res)
+	if err := tlsConn.Handshake(); err != nil {
+		log.Printf("StartTLS Handshake error %v", err)
+		return
+	}
+	m.Client.SetConn(tlsConn)
+}
+
+const (
+	adUserDN          = "cn=expired,dc=example,dc=com"
+	adOldPassword     = "old-password"
+	adAccountDN       = "cn=keymaster,dc=example,dc=com"
+	adAccountPassword = "account-password"
+)
+
+var (
+	adMutex       sync.Mutex
+	adBoundDN     string // DN of the last successful bind.
+	adNewPassword string // Last unicodePwd added.
+)
+
+// handleADBind binds like Active Directory: adUserDN has the expired
+// password adOldPassword, which it is refused with data 532.
+func handleADBind(w ldap.ResponseWriter, m *ldap.Message) {
+	r := m.GetBindRequest()
+	res := ldap.NewBindResponse(ldap.LDAPResultSuccess)
+	name := string(r.Name())
+	password := string(r.AuthenticationSimple())
+	if name == adAccountDN && password == adAccountPassword {
+		adMutex.Lock()
+		adBoundDN = name
+		adMutex.Unlock()
+		w.Write(res)
+		return
+	}
+	res.SetResultCode(ldap.LDAPResultInvalidCredentials)
+	if name == adUserDN && password == adOldPassword {
+		res.SetDiagnosticMessage("80090308: LdapErr: DSID-0C09042F, comment: AcceptSecurityContext error, data 532, v2580")
+	} else {
+		res.SetDiagnosticMessage("80090308: LdapErr: DSID-0C09042F, comment: AcceptSecurityContext error, data 52e, v2580")
+	}
+	w.Write(res)
+}
+
+// handleADPasswordModify refuses the password modify extended operation,
+// like Active Directory.
+func handleADPasswordModify(w ldap.ResponseWriter, m *ldap.Message) {
+	w.Write(ldap.NewExtendedResponse(ldap.LDAPResultProtocolError))
+}
+
+// handleADModify changes the password of adUserDN if the old one is deleted.
+func handleADModify(w ldap.ResponseWriter, m *ldap.Message) {
+	r := m.GetModifyRequest()
+	var oldPassword, newPassword string
+	for _, change := range r.Changes() {
+		modification := change.Modification()
+		if string(modification.Type_()) != "unicodePwd" ||
+			len(modification.Vals()) != 1 {
+			continue
+		}
+		value := string(modification.Vals()[0])
+		switch change.Operation() {
+		case ldap.ModifyRequestChangeOperationDelete:
+			oldPassword = value
+		case ldap.ModifyRequestChangeOperationAdd:
+			newPassword = value
+		}
+	}
+	if string(r.Object()) != adUserDN ||
+		oldPassword != encodeADPassword(adOldPassword) || newPassword == "" {
+		w.Write(ldap.NewModifyResponse(ldap.LDAPResultConstraintViolation))
+		return
+	}
+	adMutex.Lock()
+	adNewPassword = newPassword
+	adMutex.Unlock()
+	w.Write(ldap.NewModifyResponse(ldap.LDAPResultSuccess))
+}
+
 func init() {
 	//Create a new LDAP Server
 	server := ldap.NewServer()
@@ -205,6 +309,8 @@ func init() {
 	//Set routes, here, we only serve bindRequest
 	routes := ldap.NewRouteMux()
 	routes.Bind(handleBind)
+	routes.Extended(handleStartTLS).RequestName(ldap.NoticeOfStartTLS).
+		Label("StartTLS")
 	routes.Search(handleSearchGroup).
 		BaseDn("o=group,o=My Company,c=US").
 		//Scope(ldap.SearchRequestScopeBaseObject).
@@ -219,6 +325,21 @@ func init() {
 	}
 	go server.ListenAndServe("127.0.0.1:10636", secureConn)
 
+	//plain listener for StartTLS
+	startTLSServer := ldap.NewServer()
+	startTLSServer.Handle(routes)
+	go startTLSServer.ListenAndServe("127.0.0.1:10389")
+
+	//Active Directory
+	adServer := ldap.NewServer()
+	adRoutes := ldap.NewRouteMux()
+	adRoutes.Bind(handleADBind)
+	adRoutes.Extended(handleADPasswordModify).
+		RequestName("1.3.6.1.4.1.4203.1.11.1").Label("PasswordModify")
+	adRoutes.Modify(handleADModify)
+	adServer.Handle(adRoutes)
+	go adServer.ListenAndServe("127.0.0.1:10638", secureConn)
+
 	//we also make a simple tls listener
 	//
 	config, _ := getTLSconfig()
@@ -284,6 +405,42 @@ func TestCheckHtpasswdUserPasswordFailInvalidNonBcryptHashes(t *testing.T) {
 	}
 }
 
+func TestCheckHtpasswdUserPasswordOtherHashes(t *testing.T) {
+	hashes := []string{
+		"$2a$04$YjR/tHAUx0RyaH0EZvtoKuUHczLYYDR7saVzTWroBnblEkYuN2Dz2",
+		"$2b$04$YjR/tHAUx0RyaH0EZvtoKuUHczLYYDR7saVzTWroBnblEkYuN2Dz2",
+		"$argon2id$v=19$m=64,t=1,p=1$c29tZXNhbHRzb21lc2FsdA$55PWTvddWPUD1GMbKxSff4ASfF85k9ibHJt4HlHQtBM",
+		"$scrypt$ln=4,r=8,p=1$c29tZXNhbHRzb21lc2FsdA$rjCGpPW8r+9XVz9RqXtAszWzNTGPgzIyDDbKAQjn6LU",
+		"$scrypt$ln=4,r=8,p=1$c29tZXNhbHRzb21lc2FsdA$rjCGpPW8r.9XVz9RqXtAszWzNTGPgzIyDDbKAQjn6LU",
+	}
+	for _, hash := range hashes {
+		userDB := []byte("username:" + hash)
+		ok, err := CheckHtpasswdUserPassword("username", "password", userDB)
+		if err != nil {
+			t.Fatalf("%s: %s", hash, err)
+		}
+		if !ok {
+			t.Fatalf("password not accepted for %s", hash)
+		}
+		ok, err = CheckHtpasswdUserPassword("username", "Incorrectpassword",
+			userDB)
+		if err != nil {
+			t.Fatalf("%s: %s", hash, err)
+		}
+		if ok {
+			t.Fatalf("bad password accepted for %s", hash)
+		}
+	}
+}
+
+func TestCheckHtpasswdUserPasswordFailExcessiveCost(t *testing.T) {
+	_, err := CheckHtpasswdUserPassword("username", "password",
+		[]byte("username:$scrypt$ln=40,r=8,p=1$c29tZXNhbHQ$c29tZWhhc2g"))
+	if err == nil {
+		t.Fatal("scrypt hash with excessive cost accepted")
+	}
+}
+
 func TestParseLDAPURLSuccess(t *testing.T) {
 	_, err := ParseLDAPURL(testLdapsURL)
 	if err != nil {
@@ -305,6 +462,21 @@ func TestParseLDAPURLFail(t *testing.T) {
 	}
 }
 
+func TestParseLDAPURLWithStartTLS(t *testing.T) {
+	if _, err := ParseLDAPURLWithStartTLS(testLdapURL, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseLDAPURLWithStartTLS(testLdapsURL, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseLDAPURLWithStartTLS(testLdapURL, false); err == nil {
+		t.Fatalf("Failed to fail '%s'", testLdapURL)
+	}
+	if _, err := ParseLDAPURLWithStartTLS(testHttpURL, true); err == nil {
+		t.Fatalf("Failed to fail '%s'", testHttpURL)
+	}
+}
+
 func TestCheckLDAPConnectionSuccess(t *testing.T) {
 	certPool := x509.NewCertPool()
 	ok := certPool.AppendCertsFromPEM([]byte(rootCAPem))
@@ -375,6 +547,79 @@ func TestCheckLDAPGetLDAPUserGroupsSuccess(t *testing.T) {
 	}
 }
 
+func TestGetLDAPUserGroupsWithLimitTruncates(t *testing.T) {
+	certPool := x509.NewCertPool()
+	ok := certPool.AppendCertsFromPEM([]byte(rootCAPem))
+	if !ok {
+		t.Fatal("cannot add certs to certpool")
+	}
+	ldapURL, err := ParseLDAPURL("ldaps://localhost:10636")
+	if err != nil {
+		t.Fatal(err)
+	}
+	userGroups, truncated, err := GetLDAPUserGroupsWithLimit(*ldapURL,
+		"username", "password", 2, certPool, "username-to-search",
+		[]string{"some user endpoint"}, "(uid=%s)",
+		[]string{"o=group,o=My Company,c=US"}, "(member=%s)",
+		2, regexp.MustCompile("^group3$"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !truncated {
+		t.Fatal("truncation not reported")
+	}
+	expectedUserGroups := []string{"group3", "group1"}
+	if len(userGroups) != len(expectedUserGroups) {
+		t.Fatalf("unexpected groups: %v", userGroups)
+	}
+	for i, expectedGroup := range expectedUserGroups {
+		if expectedGroup != userGroups[i] {
+			t.Fatalf("unexpected groups: %v", userGroups)
+		}
+	}
+	// Under the limit nothing is dropped.
+	userGroups, truncated, err = GetLDAPUserGroupsWithLimit(*ldapURL,
+		"username", "password", 2, certPool, "username-to-search",
+		[]string{"some user endpoint"}, "(uid=%s)",
+		[]string{"o=group,o=My Company,c=US"}, "(member=%s)",
+		3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if truncated || len(userGroups) != 3 {
+		t.Fatalf("unexpected truncation: %v", userGroups)
+	}
+}
+
+func TestGetLDAPNamingContextsSuccess(t *testing.T) {
+	certPool := x509.NewCertPool()
+	ok := certPool.AppendCertsFromPEM([]byte(rootCAPem))
+	if !ok {
+		t.Fatal("cannot add certs to certpool")
+	}
+	ldapURL, err := ParseLDAPURL("ldaps://localhost:10636")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedContexts := []string{"dc=example,dc=com",
+		"cn=Configuration,dc=example,dc=com"}
+	for _, bindDN := range []string{"", "username"} {
+		namingContexts, err := GetLDAPNamingContexts(*ldapURL, bindDN,
+			"password", 2, certPool)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(namingContexts) != len(expectedContexts) {
+			t.Fatalf("unexpected naming contexts: %v", namingContexts)
+		}
+		for i, expected := range expectedContexts {
+			if namingContexts[i] != expected {
+				t.Fatalf("unexpected naming contexts: %v", namingContexts)
+			}
+		}
+	}
+}
+
 func TestCheckLDAPUserPasswordFailUntrustedHost(t *testing.T) {
 	ldapURL, err := ParseLDAPURL("ldaps://localhost:10636")
 	if err != nil {
@@ -428,6 +673,53 @@ func TestCheckLDAPUserPasswordFailNonLDAPEndpoint(t *testing.T) {
 	}
 }
 
+func TestCheckLDAPUserPasswordStartTLSSuccess(t *testing.T) {
+	certPool := x509.NewCertPool()
+	ok := certPool.AppendCertsFromPEM([]byte(rootCAPem))
+	if !ok {
+		t.Fatal("cannot add certs to certpool")
+	}
+	ldapURL, err := ParseLDAPURLWithStartTLS("ldap://localhost:10389", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err = CheckLDAPUserPassword(*ldapURL, "username", "password", 2, certPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("userame not accepted")
+	}
+}
+
+func TestCheckLDAPUserPasswordStartTLSFailUntrustedHost(t *testing.T) {
+	ldapURL, err := ParseLDAPURLWithStartTLS("ldap://localhost:10389", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = CheckLDAPUserPassword(*ldapURL, "username", "password", 2, nil)
+	if err == nil {
+		t.Fatal("Should have failed to upgrade to an untrusted host")
+	}
+}
+
+func TestCheckLDAPUserPasswordStartTLSFailNotSupported(t *testing.T) {
+	certPool := x509.NewCertPool()
+	ok := certPool.AppendCertsFromPEM([]byte(rootCAPem))
+	if !ok {
+		t.Fatal("cannot add certs to certpool")
+	}
+	// The ldaps port expects a TLS handshake, so the StartTLS request fails.
+	ldapURL, err := ParseLDAPURLWithStartTLS("ldap://localhost:10636", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = CheckLDAPUserPassword(*ldapURL, "username", "password", 2, certPool)
+	if err == nil {
+		t.Fatal("Should have failed without a StartTLS upgrade")
+	}
+}
+
 func TestCheckLDAPUserPasswordFailInvalidScheme(t *testing.T) {
 	u, err := url.Parse(testHttpURL)
 	if err != nil {
@@ -466,3 +758,234 @@ func TestArgon2RoundTripFailure(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestGetLDAPPasswordStatus(t *testing.T) {
+	expiring := goldap.NewControlBeheraPasswordPolicy()
+	expiring.Expire = 3600
+	expired := goldap.NewControlBeheraPasswordPolicy()
+	expired.Error = goldap.BeheraPasswordExpired
+	reset := goldap.NewControlBeheraPasswordPolicy()
+	reset.Error = goldap.BeheraChangeAfterReset
+	adExpired := goldap.NewError(goldap.LDAPResultInvalidCredentials,
+		errors.New("80090308: LdapErr: DSID-0C09042F, comment: AcceptSecurityContext error, data 532, v2580"))
+	adInvalid := goldap.NewError(goldap.LDAPResultInvalidCredentials,
+		errors.New("80090308: LdapErr: DSID-0C09042F, comment: AcceptSecurityContext error, data 52e, v2580"))
+	for _, test := range []struct {
+		controls []goldap.Control
+		bindErr  error
+		expected LDAPPasswordStatus
+	}{
+		{nil, nil, LDAPPasswordStatus{}},
+		{[]goldap.Control{expiring}, nil,
+			LDAPPasswordStatus{ExpiresIn: time.Hour}},
+		{[]goldap.Control{expired}, adInvalid,
+			LDAPPasswordStatus{MustChange: true}},
+		{[]goldap.Control{reset}, nil, LDAPPasswordStatus{MustChange: true}},
+		{[]goldap.Control{&goldap.ControlVChuPasswordMustChange{
+			MustChange: true}}, nil, LDAPPasswordStatus{MustChange: true}},
+		{[]goldap.Control{&goldap.ControlVChuPasswordWarning{Expire: 60}},
+			nil, LDAPPasswordStatus{ExpiresIn: time.Minute}},
+		{nil, adExpired, LDAPPasswordStatus{MustChange: true}},
+		{nil, adInvalid, LDAPPasswordStatus{}},
+	} {
+		status := getLDAPPasswordStatus(test.controls, test.bindErr)
+		if status != test.expected {
+			t.Errorf("%v, %v: got %+v, expected %+v", test.controls,
+				test.bindErr, status, test.expected)
+		}
+	}
+}
+
+func TestEncodeADPassword(t *testing.T) {
+	if encoded := encodeADPassword("pw"); encoded != "\"\x00p\x00w\x00\"\x00" {
+		t.Fatalf("unexpected encoding: %q", encoded)
+	}
+}
+
+func TestChangeLDAPUserPasswordExpiredAD(t *testing.T) {
+	certPool := x509.NewCertPool()
+	ok := certPool.AppendCertsFromPEM([]byte(rootCAPem))
+	if !ok {
+		t.Fatal("cannot add certs to certpool")
+	}
+	ldapURL, err := ParseLDAPURL("ldaps://localhost:10638")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The user cannot bind with the expired password.
+	err = ChangeLDAPUserPassword(*ldapURL, adUserDN, adOldPassword,
+		"new-password", 2, certPool)
+	if err == nil {
+		t.Fatal("expired password changed without an account")
+	}
+	err = ChangeLDAPUserPasswordWithAccount(*ldapURL, adUserDN,
+		"wrong-password", "new-password", adAccountDN, adAccountPassword, 2,
+		certPool)
+	if err == nil {
+		t.Fatal("password changed with a wrong old password")
+	}
+	err = ChangeLDAPUserPasswordWithAccount(*ldapURL, adUserDN,
+		adOldPassword, "new-password", adAccountDN, "wrong-password", 2,
+		certPool)
+	if err == nil {
+		t.Fatal("password changed with a wrong account password")
+	}
+	adMutex.Lock()
+	if adNewPassword != "" {
+		t.Fatal("password modified")
+	}
+	adMutex.Unlock()
+	err = ChangeLDAPUserPasswordWithAccount(*ldapURL, adUserDN,
+		adOldPassword, "new-password", adAccountDN, adAccountPassword, 2,
+		certPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adMutex.Lock()
+	defer adMutex.Unlock()
+	if adBoundDN != adAccountDN {
+		t.Fatalf("bound as %s", adBoundDN)
+	}
+	if adNewPassword != encodeADPassword("new-password") {
+		t.Fatalf("unexpected new password: %q", adNewPassword)
+	}
+}
+
+func TestLDAPPoolFailover(t *testing.T) {
+	certPool := x509.NewCertPool()
+	ok := certPool.AppendCertsFromPEM([]byte(rootCAPem))
+	if !ok {
+		t.Fatal("cannot add certs to certpool")
+	}
+	var urls []url.URL
+	for _, ldapUrl := range []string{"ldaps://localhost:10639",
+		"ldaps://localhost:10636"} {
+		u, err := ParseLDAPURL(ldapUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		urls = append(urls, *u)
+	}
+	pool := NewLDAPPool(LDAPPoolConfig{
+		URLs:         urls,
+		BindDN:       "username",
+		BindPassword: "password",
+		TimeoutSecs:  2,
+		RootCAs:      certPool,
+		SearchBaseDNs: func(u url.URL) ([]string, []string) {
+			return []string{"some user endpoint"},
+				[]string{"o=group,o=My Company,c=US"}
+		},
+	})
+	defer pool.Close()
+	for i := 0; i < 2; i++ {
+		userGroups, _, err := pool.GetUserGroupsWithLimit(
+			"username-to-search", "(uid=%s)", "(member=%s)", 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(userGroups) != 3 {
+			t.Fatalf("unexpected groups: %v", userGroups)
+		}
+	}
+	servers := pool.orderedServers()
+	if servers[0].url.Host != "localhost:10636" || servers[1].healthy {
+		t.Fatal("unreachable server not marked unhealthy")
+	}
+	if len(servers[0].idle) != 1 {
+		t.Fatalf("connection not reused: %d idle", len(servers[0].idle))
+	}
+	attributes, err := pool.GetUserAttributes("username-to-search",
+		"(uid=%s)", []string{"mail"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attributes["mail"]) != 2 {
+		t.Fatalf("unexpected attributes: %v", attributes)
+	}
+}
+
+func TestExtractCNFromDNStringIgnoresCase(t *testing.T) {
+	cns, err := extractCNFromDNString([]string{"CN=Admins,OU=Groups,DC=example",
+		"cn=users,dc=example", "uid=other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"Admins", "users", "uid=other"}
+	for i, cn := range expected {
+		if cns[i] != cn {
+			t.Fatalf("unexpected CNs: %v", cns)
+		}
+	}
+}
+
+func TestLDAPPoolNestedGroups(t *testing.T) {
+	certPool := x509.NewCertPool()
+	ok := certPool.AppendCertsFromPEM([]byte(rootCAPem))
+	if !ok {
+		t.Fatal("cannot add certs to certpool")
+	}
+	ldapURL, err := ParseLDAPURL("ldaps://localhost:10636")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := NewLDAPPool(LDAPPoolConfig{
+		URLs:         []url.URL{*ldapURL},
+		BindDN:       "username",
+		BindPassword: "password",
+		TimeoutSecs:  2,
+		RootCAs:      certPool,
+		SearchBaseDNs: func(u url.URL) ([]string, []string) {
+			return []string{"some user endpoint"},
+				[]string{"o=group,o=My Company,c=US"}
+		},
+		NestedGroupDepth: 3,
+	})
+	defer pool.Close()
+	// The test server is no Active Directory and answers every parent
+	// search with group1 and group2, so the expansion has to stop at the
+	// groups already seen.
+	userGroups, _, err := pool.GetUserGroupsWithLimit("username-to-search",
+		"(uid=%s)", "(member=%s)", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(userGroups)
+	expectedUserGroups := []string{"group1", "group2", "group3"}
+	if len(userGroups) != len(expectedUserGroups) {
+		t.Fatalf("unexpected groups: %v", userGroups)
+	}
+	for i, expectedGroup := range expectedUserGroups {
+		if expectedGroup != userGroups[i] {
+			t.Fatalf("unexpected groups: %v", userGroups)
+		}
+	}
+	if inChain := pool.servers[0].inChain; inChain == nil || *inChain {
+		t.Fatal("server wrongly detected as Active Directory")
+	}
+}
+
+func TestLDAPGroupConfigFilterGroups(t *testing.T) {
+	names, dns := splitGroupValues([]string{"CN=Team-A,OU=Groups,DC=example",
+		"team-b", "cn=Other,dc=example"})
+	if len(dns) != 2 {
+		t.Fatalf("unexpected DNs: %v", dns)
+	}
+	config := LDAPGroupConfig{
+		Lowercase: true,
+		FilterRE:  regexp.MustCompile("^team-"),
+	}
+	groups := config.filterGroups(append(names, "TEAM-B"))
+	expectedGroups := []string{"team-b", "team-a"}
+	if len(groups) != len(expectedGroups) {
+		t.Fatalf("unexpected groups: %v", groups)
+	}
+	for i, expectedGroup := range expectedGroups {
+		if expectedGroup != groups[i] {
+			t.Fatalf("unexpected groups: %v", groups)
+		}
+	}
+	if attribute := (LDAPGroupConfig{}).attribute(); attribute != "memberOf" {
+		t.Fatalf("unexpected default attribute: %s", attribute)
+	}
+}
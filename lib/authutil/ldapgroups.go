@@ -0,0 +1,100 @@
+package authutil
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"gopkg.in/ldap.v2"
+)
+
+const defaultLDAPGroupAttribute = "memberOf"
+
+// LDAPGroupConfig selects where the groups of a user come from and which of
+// them are returned.
+type LDAPGroupConfig struct {
+	// Attribute is the attribute of the user entry listing its groups,
+	// memberOf by default. Values which are DNs are reduced to their CN.
+	// For gidNumber the cn of the posixGroup with that gidNumber is used.
+	Attribute string
+	// If Lowercase is true group names are converted to lower case.
+	Lowercase bool
+	// If FilterRE is not nil only the groups (after any lower casing) which
+	// match it are returned.
+	FilterRE *regexp.Regexp
+}
+
+func (c LDAPGroupConfig) attribute() string {
+	if c.Attribute == "" {
+		return defaultLDAPGroupAttribute
+	}
+	return c.Attribute
+}
+
+// filterGroups returns groups normalised and filtered as configured. The
+// order of groups is kept and duplicates created by lower casing dropped.
+func (c LDAPGroupConfig) filterGroups(groups []string) []string {
+	if !c.Lowercase && c.FilterRE == nil {
+		return groups
+	}
+	filtered := make([]string, 0, len(groups))
+	seen := make(map[string]struct{}, len(groups))
+	for _, group := range groups {
+		if c.Lowercase {
+			group = strings.ToLower(group)
+		}
+		if c.FilterRE != nil && !c.FilterRE.MatchString(group) {
+			continue
+		}
+		if _, ok := seen[group]; ok {
+			continue
+		}
+		seen[group] = struct{}{}
+		filtered = append(filtered, group)
+	}
+	return filtered
+}
+
+// splitGroupValues returns the group names for the values of a group
+// attribute and the values which are DNs.
+func splitGroupValues(values []string) ([]string, []string) {
+	var names, dns []string
+	for _, value := range values {
+		if strings.Contains(value, "=") {
+			dns = append(dns, value)
+		} else {
+			names = append(names, value)
+		}
+	}
+	cns, _ := extractCNFromDNString(dns)
+	return append(names, cns...), dns
+}
+
+// getGroupsByGIDNumber returns the CNs and DNs of the posixGroups below
+// searchBaseDNs with any of gidNumbers.
+func getGroupsByGIDNumber(conn *ldap.Conn, searchBaseDNs []string,
+	gidNumbers []string) ([]string, []string, error) {
+	var cns, dns []string
+	for _, gidNumber := range gidNumbers {
+		filter := fmt.Sprintf("(&(objectClass=posixGroup)(gidNumber=%s))",
+			ldap.EscapeFilter(gidNumber))
+		for _, searchDN := range searchBaseDNs {
+			searchRequest := ldap.NewSearchRequest(
+				searchDN,
+				ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+				filter,
+				[]string{"cn"},
+				nil,
+			)
+			sr, err := conn.Search(searchRequest)
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, entry := range sr.Entries {
+				cns = append(cns, entry.GetAttributeValues("cn")...)
+				dns = append(dns, entry.DN)
+			}
+		}
+	}
+	return cns, dns, nil
+}
@@ -0,0 +1,364 @@
+package authutil
+
+import (
+	"crypto/x509"
+	"errors"
+	"log"
+	"net/url"
+	"regexp"
+	"sync"
+	"time"
+
+	"gopkg.in/ldap.v2"
+)
+
+const (
+	defaultLDAPPoolMaxIdleConnections  = 2
+	defaultLDAPPoolIdleTimeout         = time.Minute
+	defaultLDAPPoolHealthCheckInterval = 30 * time.Second
+)
+
+var errNoLDAPServers = errors.New("no LDAP servers configured")
+
+// LDAPSearchBaseDNsFunc returns the user and group search base DNs to use
+// on the server at u.
+type LDAPSearchBaseDNsFunc func(u url.URL) (userBaseDNs []string,
+	groupBaseDNs []string)
+
+// LDAPPoolConfig configures an LDAPPool.
+type LDAPPoolConfig struct {
+	// URLs are the servers, in order of preference.
+	URLs         []url.URL
+	BindDN       string
+	BindPassword string
+	TimeoutSecs  uint
+	RootCAs      *x509.CertPool
+	// SearchBaseDNs gives the search bases of each server. If nil, searches
+	// use no base DNs.
+	SearchBaseDNs LDAPSearchBaseDNsFunc
+	// Groups selects the groups returned by GetUserGroupsWithLimit.
+	Groups LDAPGroupConfig
+	// If NestedGroupDepth is positive, groups the user is an indirect
+	// member of are included. Active Directory servers resolve all levels
+	// with LDAP_MATCHING_RULE_IN_CHAIN, otherwise at most NestedGroupDepth
+	// levels of parent groups are followed.
+	NestedGroupDepth int
+	// At most MaxIdleConnections bound connections are kept per server
+	// (default 2). They are closed after being idle for IdleTimeout
+	// (default 1 minute).
+	MaxIdleConnections int
+	IdleTimeout        time.Duration
+	// Servers which failed are probed every HealthCheckInterval (default 30
+	// seconds) and are only tried after the healthy ones until a probe
+	// succeeds.
+	HealthCheckInterval time.Duration
+}
+
+// LDAPPool keeps bound connections to a set of LDAP servers for searches,
+// failing over to the next server when one cannot be reached.
+type LDAPPool struct {
+	config  LDAPPoolConfig
+	servers []*ldapPoolServer
+	stop    chan struct{}
+	once    sync.Once
+}
+
+type ldapPoolServer struct {
+	url     url.URL
+	mutex   sync.Mutex
+	idle    []idleLDAPConn // Most recently used last.
+	healthy bool
+	// inChain is nil until it is known whether the server supports
+	// LDAP_MATCHING_RULE_IN_CHAIN.
+	inChain *bool
+}
+
+type idleLDAPConn struct {
+	conn  *ldap.Conn
+	since time.Time
+}
+
+// NewLDAPPool returns a pool for the servers in config and starts checking
+// their health. Close stops it.
+func NewLDAPPool(config LDAPPoolConfig) *LDAPPool {
+	if config.MaxIdleConnections < 1 {
+		config.MaxIdleConnections = defaultLDAPPoolMaxIdleConnections
+	}
+	if config.IdleTimeout <= 0 {
+		config.IdleTimeout = defaultLDAPPoolIdleTimeout
+	}
+	if config.HealthCheckInterval <= 0 {
+		config.HealthCheckInterval = defaultLDAPPoolHealthCheckInterval
+	}
+	pool := &LDAPPool{config: config, stop: make(chan struct{})}
+	for _, u := range config.URLs {
+		pool.servers = append(pool.servers,
+			&ldapPoolServer{url: u, healthy: true})
+	}
+	go pool.healthCheckLoop()
+	return pool
+}
+
+// Close closes the idle connections and stops the health checks.
+func (p *LDAPPool) Close() {
+	p.once.Do(func() { close(p.stop) })
+	for _, server := range p.servers {
+		server.mutex.Lock()
+		for _, idle := range server.idle {
+			idle.conn.Close()
+		}
+		server.idle = nil
+		server.mutex.Unlock()
+	}
+}
+
+// GetUserGroupsWithLimit is like GetLDAPUserGroupsWithLimit, but uses the
+// servers and bind credentials of the pool.
+func (p *LDAPPool) GetUserGroupsWithLimit(username string,
+	UserSearchFilter string, GroupSearchFilter string,
+	maxGroups int, relevantGroupsRE *regexp.Regexp) ([]string, bool, error) {
+	var userGroups []string
+	var truncated bool
+	err := p.do(func(server *ldapPoolServer, conn *ldap.Conn) error {
+		userBaseDNs, groupBaseDNs := p.getSearchBaseDNs(server.url)
+		nested := nestedGroupOptions{maxDepth: p.config.NestedGroupDepth}
+		if nested.maxDepth > 0 {
+			var err error
+			nested.inChain, err = server.supportsMatchingRuleInChain(conn)
+			if err != nil {
+				return err
+			}
+		}
+		var err error
+		userGroups, truncated, err = getUserGroupsWithLimit(conn, username,
+			userBaseDNs, UserSearchFilter, groupBaseDNs, GroupSearchFilter,
+			maxGroups, relevantGroupsRE, p.config.Groups, nested)
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return userGroups, truncated, nil
+}
+
+// GetUserAttributes is like GetLDAPUserAttributes, but uses the servers and
+// bind credentials of the pool.
+func (p *LDAPPool) GetUserAttributes(username string,
+	UserSearchFilter string, attributes []string) (map[string][]string, error) {
+	var attributeMap map[string][]string
+	err := p.do(func(server *ldapPoolServer, conn *ldap.Conn) error {
+		userBaseDNs, _ := p.getSearchBaseDNs(server.url)
+		var err error
+		attributeMap, err = getSimpleUserAttributes(conn, userBaseDNs,
+			UserSearchFilter, username, attributes)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return attributeMap, nil
+}
+
+func (p *LDAPPool) getSearchBaseDNs(u url.URL) ([]string, []string) {
+	if p.config.SearchBaseDNs == nil {
+		return nil, nil
+	}
+	return p.config.SearchBaseDNs(u)
+}
+
+// isLDAPConnectionError returns true if err means the connection can no
+// longer be used.
+func isLDAPConnectionError(err error) bool {
+	return ldap.IsErrorWithCode(err, ldap.ErrorNetwork)
+}
+
+// orderedServers returns the healthy servers followed by the unhealthy ones,
+// each in the configured order.
+func (p *LDAPPool) orderedServers() []*ldapPoolServer {
+	servers := make([]*ldapPoolServer, 0, len(p.servers))
+	var unhealthy []*ldapPoolServer
+	for _, server := range p.servers {
+		server.mutex.Lock()
+		healthy := server.healthy
+		server.mutex.Unlock()
+		if healthy {
+			servers = append(servers, server)
+		} else {
+			unhealthy = append(unhealthy, server)
+		}
+	}
+	return append(servers, unhealthy...)
+}
+
+// do calls fn with a bound connection to each server in turn until fn
+// succeeds. If any server did not find the user ErrUserNotFound is
+// returned, otherwise the last error.
+func (p *LDAPPool) do(
+	fn func(server *ldapPoolServer, conn *ldap.Conn) error) error {
+	if len(p.servers) < 1 {
+		return errNoLDAPServers
+	}
+	userNotFound := false
+	var lastError error
+	for _, server := range p.orderedServers() {
+		err := p.doWithServer(server, fn)
+		if err == nil {
+			return nil
+		}
+		if err == ErrUserNotFound {
+			userNotFound = true
+		}
+		lastError = err
+	}
+	if userNotFound {
+		return ErrUserNotFound
+	}
+	return lastError
+}
+
+// doWithServer calls fn with a bound connection to server. If a reused
+// connection turns out to be broken, fn is retried once with a new one.
+func (p *LDAPPool) doWithServer(server *ldapPoolServer,
+	fn func(server *ldapPoolServer, conn *ldap.Conn) error) error {
+	for {
+		conn, reused, err := p.getConnection(server)
+		if err != nil {
+			return err
+		}
+		err = fn(server, conn)
+		if err == nil || !isLDAPConnectionError(err) {
+			p.putConnection(server, conn)
+			return err
+		}
+		conn.Close()
+		if !reused {
+			server.markUnhealthy(err)
+			return err
+		}
+	}
+}
+
+// getConnection returns an idle connection to server or a new bound one.
+// The returned boolean is true for idle connections.
+func (p *LDAPPool) getConnection(server *ldapPoolServer) (
+	*ldap.Conn, bool, error) {
+	server.mutex.Lock()
+	for len(server.idle) > 0 {
+		last := len(server.idle) - 1
+		idle := server.idle[last]
+		server.idle = server.idle[:last]
+		if time.Since(idle.since) < p.config.IdleTimeout {
+			server.mutex.Unlock()
+			return idle.conn, true, nil
+		}
+		idle.conn.Close()
+	}
+	server.mutex.Unlock()
+	conn, _, err := getLDAPConnection(server.url, p.config.TimeoutSecs,
+		p.config.RootCAs)
+	if err != nil {
+		server.markUnhealthy(err)
+		return nil, false, err
+	}
+	if err := conn.Bind(p.config.BindDN, p.config.BindPassword); err != nil {
+		conn.Close()
+		if isLDAPConnectionError(err) {
+			server.markUnhealthy(err)
+		}
+		return nil, false, err
+	}
+	server.markHealthy()
+	return conn, false, nil
+}
+
+func (p *LDAPPool) putConnection(server *ldapPoolServer, conn *ldap.Conn) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if len(server.idle) >= p.config.MaxIdleConnections {
+		conn.Close()
+		return
+	}
+	server.idle = append(server.idle, idleLDAPConn{conn, time.Now()})
+}
+
+// supportsMatchingRuleInChain returns whether the server supports
+// LDAP_MATCHING_RULE_IN_CHAIN, asking it with conn the first time.
+func (s *ldapPoolServer) supportsMatchingRuleInChain(conn *ldap.Conn) (
+	bool, error) {
+	s.mutex.Lock()
+	inChain := s.inChain
+	s.mutex.Unlock()
+	if inChain != nil {
+		return *inChain, nil
+	}
+	supported, err := ldapSupportsMatchingRuleInChain(conn)
+	if err != nil {
+		return false, err
+	}
+	s.mutex.Lock()
+	s.inChain = &supported
+	s.mutex.Unlock()
+	return supported, nil
+}
+
+func (s *ldapPoolServer) markHealthy() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.healthy {
+		log.Printf("LDAP server %s is reachable again", s.url.Host)
+	}
+	s.healthy = true
+}
+
+func (s *ldapPoolServer) markUnhealthy(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.healthy {
+		log.Printf("LDAP server %s failed: %s", s.url.Host, err)
+	}
+	s.healthy = false
+	for _, idle := range s.idle {
+		idle.conn.Close()
+	}
+	s.idle = nil
+}
+
+func (p *LDAPPool) healthCheckLoop() {
+	ticker := time.NewTicker(p.config.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.checkHealth()
+		}
+	}
+}
+
+// checkHealth probes the unhealthy servers and closes expired idle
+// connections.
+func (p *LDAPPool) checkHealth() {
+	for _, server := range p.servers {
+		server.mutex.Lock()
+		healthy := server.healthy
+		idle := server.idle[:0]
+		for _, idleConn := range server.idle {
+			if time.Since(idleConn.since) < p.config.IdleTimeout {
+				idle = append(idle, idleConn)
+			} else {
+				idleConn.conn.Close()
+			}
+		}
+		server.idle = idle
+		server.mutex.Unlock()
+		if healthy {
+			continue
+		}
+		err := CheckLDAPConnection(server.url, p.config.TimeoutSecs,
+			p.config.RootCAs)
+		if err == nil {
+			server.markHealthy()
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package authutil
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"gopkg.in/ldap.v2"
+)
+
+const (
+	// ldapCapActiveDirectory is advertised in the supportedCapabilities of
+	// the RootDSE of Active Directory servers.
+	ldapCapActiveDirectory = "1.2.840.113556.1.4.800"
+	// ldapMatchingRuleInChain (LDAP_MATCHING_RULE_IN_CHAIN) makes Active
+	// Directory follow member links transitively within one search.
+	ldapMatchingRuleInChain = "1.2.840.113556.1.4.1941"
+)
+
+// nestedGroupOptions controls the expansion of nested groups. Groups are
+// only expanded if maxDepth is positive.
+type nestedGroupOptions struct {
+	// maxDepth is the number of parent group levels followed without
+	// LDAP_MATCHING_RULE_IN_CHAIN.
+	maxDepth int
+	// inChain is true if the server supports LDAP_MATCHING_RULE_IN_CHAIN.
+	inChain bool
+}
+
+// ldapSupportsMatchingRuleInChain returns true if the server of conn is an
+// Active Directory server, which supports LDAP_MATCHING_RULE_IN_CHAIN.
+func ldapSupportsMatchingRuleInChain(conn *ldap.Conn) (bool, error) {
+	searchRequest := ldap.NewSearchRequest(
+		"",
+		ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)",
+		[]string{"supportedCapabilities"},
+		nil,
+	)
+	sr, err := conn.Search(searchRequest)
+	if err != nil {
+		return false, err
+	}
+	if len(sr.Entries) != 1 {
+		return false, nil
+	}
+	for _, capability := range sr.Entries[0].GetAttributeValues(
+		"supportedCapabilities") {
+		if capability == ldapCapActiveDirectory {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// getNestedUserGroups returns the CNs of the groups below searchBaseDNs which
+// the user with userDN is an indirect member of, through the groups with
+// groupDNs.
+func getNestedUserGroups(conn *ldap.Conn, searchBaseDNs []string,
+	userDN string, groupDNs []string,
+	options nestedGroupOptions) ([]string, error) {
+	if options.inChain {
+		groups, err := getGroupsInChain(conn, searchBaseDNs, userDN)
+		if err == nil {
+			return groups, nil
+		}
+		log.Printf("nested group search for %s failed, following parents: %s",
+			userDN, err)
+	}
+	return getParentGroups(conn, searchBaseDNs, groupDNs, options.maxDepth)
+}
+
+// getGroupsInChain returns the CNs of all the groups userDN is a direct or
+// indirect member of, with one search per base DN.
+func getGroupsInChain(conn *ldap.Conn, searchBaseDNs []string,
+	userDN string) ([]string, error) {
+	filter := fmt.Sprintf("(member:%s:=%s)", ldapMatchingRuleInChain,
+		ldap.EscapeFilter(userDN))
+	var groups []string
+	for _, searchDN := range searchBaseDNs {
+		searchRequest := ldap.NewSearchRequest(
+			searchDN,
+			ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+			filter,
+			[]string{"cn"},
+			nil,
+		)
+		sr, err := conn.Search(searchRequest)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range sr.Entries {
+			groups = append(groups, entry.GetAttributeValues("cn")...)
+		}
+	}
+	return groups, nil
+}
+
+// getParentGroups returns the CNs of the groups which have any of groupDNs
+// as a member, and of their parents, for at most maxDepth levels. Cycles
+// are followed only once.
+func getParentGroups(conn *ldap.Conn, searchBaseDNs []string,
+	groupDNs []string, maxDepth int) ([]string, error) {
+	seen := make(map[string]struct{}, len(groupDNs))
+	for _, dn := range groupDNs {
+		seen[strings.ToLower(dn)] = struct{}{}
+	}
+	var groups []string
+	pending := groupDNs
+	for depth := 0; depth < maxDepth && len(pending) > 0; depth++ {
+		var parents []string
+		for _, dn := range pending {
+			for _, searchDN := range searchBaseDNs {
+				searchRequest := ldap.NewSearchRequest(
+					searchDN,
+					ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0,
+					false,
+					fmt.Sprintf("(member=%s)", ldap.EscapeFilter(dn)),
+					[]string{"cn"},
+					nil,
+				)
+				sr, err := conn.Search(searchRequest)
+				if err != nil {
+					return nil, err
+				}
+				for _, entry := range sr.Entries {
+					key := strings.ToLower(entry.DN)
+					if _, ok := seen[key]; ok {
+						continue
+					}
+					seen[key] = struct{}{}
+					parents = append(parents, entry.DN)
+					groups = append(groups, entry.GetAttributeValues("cn")...)
+				}
+			}
+		}
+		pending = parents
+	}
+	if len(pending) > 0 {
+		log.Printf("nested groups more than %d levels up not followed", maxDepth)
+	}
+	return groups, nil
+}
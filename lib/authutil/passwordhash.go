@@ -0,0 +1,154 @@
+package authutil
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	argon2idPrefix = "$argon2id$"
+	scryptPrefix   = "$scrypt$"
+	// Cost parameters above these limits are refused, so that a bad entry
+	// cannot make every login take all memory.
+	maxArgon2idMemoryKiB = 4 * 1024 * 1024
+	maxScryptLogN        = 24
+	// Parameters of new argon2id hashes, as recommended by RFC 9106 for
+	// memory constrained systems.
+	newArgon2idMemoryKiB = 64 * 1024
+	newArgon2idTime      = 3
+	newArgon2idThreads   = 4
+	newArgon2idKeyLength = 32
+	newArgon2idSaltBytes = 16
+)
+
+var bcryptPrefixes = []string{"$2a$", "$2b$", "$2y$"}
+
+var errUnsupportedHash = errors.New(
+	"htpasswd hashes must be bcrypt, argon2id or scrypt")
+
+// Argon2idMakeNewHash returns an argon2id hash of password with a random
+// salt, in the format accepted by CheckPasswordHash.
+func Argon2idMakeNewHash(password []byte) (string, error) {
+	salt := make([]byte, newArgon2idSaltBytes)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey(password, salt, newArgon2idTime, newArgon2idMemoryKiB,
+		newArgon2idThreads, newArgon2idKeyLength)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix,
+		argon2.Version, newArgon2idMemoryKiB, newArgon2idTime,
+		newArgon2idThreads, base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// CheckPasswordHash returns true if password matches hash, which may be any
+// of the hashes accepted in htpasswd files.
+func CheckPasswordHash(hash string, password []byte) (bool, error) {
+	return checkPasswordHash(hash, password)
+}
+
+// checkPasswordHash returns true if password matches hash, which is a bcrypt
+// ($2a$, $2b$ or $2y$), argon2id ($argon2id$v=19$m=M,t=T,p=P$SALT$HASH) or
+// scrypt ($scrypt$ln=N,r=R,p=P$SALT$HASH) hash. Salts and hashes are
+// unpadded base64, where "." may replace "+" as written by passlib.
+func checkPasswordHash(hash string, password []byte) (bool, error) {
+	for _, prefix := range bcryptPrefixes {
+		if strings.HasPrefix(hash, prefix) {
+			err := bcrypt.CompareHashAndPassword([]byte(hash), password)
+			if err == bcrypt.ErrMismatchedHashAndPassword {
+				return false, nil
+			}
+			return err == nil, err
+		}
+	}
+	if strings.HasPrefix(hash, argon2idPrefix) {
+		return checkArgon2idHash(hash, password)
+	}
+	if strings.HasPrefix(hash, scryptPrefix) {
+		return checkScryptHash(hash, password)
+	}
+	return false, errUnsupportedHash
+}
+
+// splitPHCHash splits a hash of the form $ID$[v=V$]PARAMS$SALT$HASH into
+// its version (empty if missing), parameters, salt and key.
+func splitPHCHash(hash string) (string, string, []byte, []byte, error) {
+	fields := strings.Split(hash, "$")
+	var version string
+	switch len(fields) {
+	case 5:
+	case 6:
+		version = fields[2]
+		fields = append(fields[:2], fields[3:]...)
+	default:
+		return "", "", nil, nil, fmt.Errorf("malformed %s hash", fields[1])
+	}
+	salt, err := decodeHashBase64(fields[3])
+	if err != nil {
+		return "", "", nil, nil, err
+	}
+	key, err := decodeHashBase64(fields[4])
+	if err != nil {
+		return "", "", nil, nil, err
+	}
+	if len(key) < 1 {
+		return "", "", nil, nil, fmt.Errorf("empty %s hash", fields[1])
+	}
+	return version, fields[2], salt, key, nil
+}
+
+func decodeHashBase64(value string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(
+		strings.TrimRight(strings.Replace(value, ".", "+", -1), "="))
+}
+
+func checkArgon2idHash(hash string, password []byte) (bool, error) {
+	version, params, salt, key, err := splitPHCHash(hash)
+	if err != nil {
+		return false, err
+	}
+	if version != "" && version != fmt.Sprintf("v=%d", argon2.Version) {
+		return false, fmt.Errorf("unsupported argon2id version: %s", version)
+	}
+	var memory, iterations uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(params, "m=%d,t=%d,p=%d", &memory, &iterations,
+		&threads); err != nil {
+		return false, fmt.Errorf("bad argon2id parameters: %s", params)
+	}
+	if memory > maxArgon2idMemoryKiB || iterations < 1 || threads < 1 {
+		return false, fmt.Errorf("unsupported argon2id parameters: %s", params)
+	}
+	computed := argon2.IDKey(password, salt, iterations, memory, threads,
+		uint32(len(key)))
+	return subtle.ConstantTimeCompare(computed, key) == 1, nil
+}
+
+func checkScryptHash(hash string, password []byte) (bool, error) {
+	_, params, salt, key, err := splitPHCHash(hash)
+	if err != nil {
+		return false, err
+	}
+	var logN uint
+	var r, p int
+	if _, err := fmt.Sscanf(params, "ln=%d,r=%d,p=%d", &logN, &r,
+		&p); err != nil {
+		return false, fmt.Errorf("bad scrypt parameters: %s", params)
+	}
+	if logN < 1 || logN > maxScryptLogN {
+		return false, fmt.Errorf("unsupported scrypt parameters: %s", params)
+	}
+	computed, err := scrypt.Key(password, salt, 1<<logN, r, p, len(key))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(computed, key) == 1, nil
+}
@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"math/big"
 	"os/exec"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/ssh"
@@ -46,6 +47,39 @@ func goCertToFileString(c ssh.Certificate, username string) (string, error) {
 
 // gen_user_cert a username and key, returns a short lived cert for that user
 func GenSSHCertFileString(username string, userPubKey string, signer ssh.Signer, host_identity string, duration time.Duration) (string, []byte, error) {
+	return GenSSHCertFileStringWithPrincipals(username, []string{username},
+		userPubKey, signer, host_identity, duration)
+}
+
+// GenSSHCertFileStringWithPrincipals is like GenSSHCertFileString, but the
+// certificate is valid for principals instead of only for username.
+func GenSSHCertFileStringWithPrincipals(username string, principals []string,
+	userPubKey string, signer ssh.Signer, host_identity string,
+	duration time.Duration) (string, []byte, error) {
+	return GenSSHCertFileStringWithPermissions(username, principals,
+		DefaultSSHPermissions(), userPubKey, signer, host_identity, duration)
+}
+
+// DefaultSSHPermissions returns the extensions granted by ssh-keygen by
+// default and no critical options.
+func DefaultSSHPermissions() ssh.Permissions {
+	return ssh.Permissions{Extensions: map[string]string{
+		"permit-X11-forwarding":   "",
+		"permit-agent-forwarding": "",
+		"permit-port-forwarding":  "",
+		"permit-pty":              "",
+		"permit-user-rc":          ""}}
+}
+
+// GenSSHCertFileStringWithPermissions is like
+// GenSSHCertFileStringWithPrincipals, but the certificate has the critical
+// options and extensions in permissions.
+func GenSSHCertFileStringWithPermissions(username string, principals []string,
+	permissions ssh.Permissions, userPubKey string, signer ssh.Signer,
+	host_identity string, duration time.Duration) (string, []byte, error) {
+	if len(principals) < 1 {
+		return "", nil, errors.New("no principals given")
+	}
 	userKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(userPubKey))
 	if err != nil {
 		return "", nil, err
@@ -61,23 +95,16 @@ func GenSSHCertFileString(username string, userPubKey string, signer ssh.Signer,
 	}
 	serial := (currentEpoch << 32) | nBig.Uint64()
 
-	// The values of the permissions are taken from the default values used
-	// by ssh-keygen
 	cert := ssh.Certificate{
 		Key:             userKey,
 		CertType:        ssh.UserCert,
 		SignatureKey:    signer.PublicKey(),
-		ValidPrincipals: []string{username},
+		ValidPrincipals: principals,
 		KeyId:           keyIdentity,
 		ValidAfter:      currentEpoch,
 		ValidBefore:     expireEpoch,
 		Serial:          serial,
-		Permissions: ssh.Permissions{Extensions: map[string]string{
-			"permit-X11-forwarding":   "",
-			"permit-agent-forwarding": "",
-			"permit-port-forwarding":  "",
-			"permit-pty":              "",
-			"permit-user-rc":          ""}}}
+		Permissions:     permissions}
 
 	err = cert.SignCert(bytes.NewReader(cert.Marshal()), signer)
 	if err != nil {
@@ -137,6 +164,8 @@ func GetSignerFromPEMBytes(privateKey []byte) (crypto.Signer, error) {
 			return v, nil
 		case *ecdsa.PrivateKey:
 			return v, nil
+		case ed25519.PrivateKey:
+			return v, nil
 		default:
 			return nil, fmt.Errorf("Type not recognized  %T!\n", v)
 		}
@@ -146,16 +175,18 @@ func GetSignerFromPEMBytes(privateKey []byte) (crypto.Signer, error) {
 	}
 }
 
-//copied from https://golang.org/src/crypto/tls/generate_cert.go
-func publicKey(priv interface{}) interface{} {
-	switch k := priv.(type) {
-	case *rsa.PrivateKey:
-		return &k.PublicKey
-	// TODO: eventaully we need to suport ecdsa for CA
-	// case *ecdsa.PrivateKey:
-	//	return &k.PublicKey
+// getUserKeyUsage returns the key usage of a user certificate for userPub.
+// Key encipherment is only possible with RSA keys and key agreement is not
+// possible with Ed25519 keys.
+func getUserKeyUsage(userPub interface{}) x509.KeyUsage {
+	switch userPub.(type) {
+	case *rsa.PublicKey:
+		return x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment |
+			x509.KeyUsageKeyAgreement
+	case *ecdsa.PublicKey:
+		return x509.KeyUsageDigitalSignature | x509.KeyUsageKeyAgreement
 	default:
-		return nil
+		return x509.KeyUsageDigitalSignature
 	}
 }
 
@@ -211,7 +242,12 @@ func GenSelfSignedCACert(commonName string, organization string, caPriv crypto.S
 		return nil, err
 	}
 	sum := sha256.Sum256([]byte(commonName))
-	signedCN, err := caPriv.Sign(rand.Reader, sum[:], crypto.SHA256)
+	var signerOpts crypto.SignerOpts = crypto.SHA256
+	if _, ok := caPriv.Public().(ed25519.PublicKey); ok {
+		// Ed25519 signs messages, not digests.
+		signerOpts = crypto.Hash(0)
+	}
+	signedCN, err := caPriv.Sign(rand.Reader, sum[:], signerOpts)
 	if err != nil {
 		return nil, err
 	}
@@ -226,13 +262,13 @@ func GenSelfSignedCACert(commonName string, organization string, caPriv crypto.S
 		},
 		NotBefore: notBefore,
 		NotAfter:  notAfter,
-		KeyUsage:  x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageCertSign,
+		KeyUsage:  x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
 		//ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
 		IsCA:                  true,
 	}
 
-	return x509.CreateCertificate(rand.Reader, &template, &template, publicKey(caPriv), caPriv)
+	return x509.CreateCertificate(rand.Reader, &template, &template, caPriv.Public(), caPriv)
 }
 
 // From RFC 4120 section 5.2.2 (https://tools.ietf.org/html/rfc4120)
@@ -264,11 +300,88 @@ func changePrintableStringToGeneralString(kerberosRealm string, inString []byte)
 	return inString
 }
 
-func genSANExtension(userName string, kerberosRealm *string) (*pkix.Extension, error) {
-	if kerberosRealm == nil {
+// Context specific tags of the GeneralName choices in RFC 5280.
+const (
+	generalNameTagEmail = 1
+	generalNameTagDNS   = 2
+	generalNameTagURI   = 6
+)
+
+// UPNSANPrefix marks a SAN which is a Microsoft user principal name, as
+// used for smartcard logon to Active Directory.
+const UPNSANPrefix = "upn:"
+
+type upnOtherName struct {
+	Id    asn1.ObjectIdentifier
+	Value string `asn1:"explicit,tag:0,utf8"`
+}
+
+// genUPNSAN returns the otherName GeneralName holding upn.
+func genUPNSAN(upn string) ([]byte, error) {
+	upnDer, err := asn1.Marshal(upnOtherName{
+		Id:    []int{1, 3, 6, 1, 4, 1, 311, 20, 2, 3},
+		Value: upn,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// The otherName choice is [0] IMPLICIT.
+	upnDer[0] = 0xA0
+	return upnDer, nil
+}
+
+// getGeneralName encodes san as an email address if it contains "@", as a
+// URI if it contains "://" and as a DNS name otherwise.
+func getGeneralName(san string) asn1.RawValue {
+	tag := generalNameTagDNS
+	if strings.Contains(san, "://") {
+		tag = generalNameTagURI
+	} else if strings.Contains(san, "@") {
+		tag = generalNameTagEmail
+	}
+	return asn1.RawValue{Tag: tag, Class: asn1.ClassContextSpecific,
+		Bytes: []byte(san)}
+}
+
+func genSANExtension(userName string, kerberosRealm *string,
+	sans []string) (*pkix.Extension, error) {
+	var rawValues []asn1.RawValue
+	if kerberosRealm != nil {
+		krbSanAnotherNameDer, err := genKerberosSAN(userName, *kerberosRealm)
+		if err != nil {
+			return nil, err
+		}
+		rawValues = append(rawValues,
+			asn1.RawValue{FullBytes: krbSanAnotherNameDer})
+	}
+	for _, san := range sans {
+		if strings.HasPrefix(san, UPNSANPrefix) {
+			upnDer, err := genUPNSAN(san[len(UPNSANPrefix):])
+			if err != nil {
+				return nil, err
+			}
+			rawValues = append(rawValues, asn1.RawValue{FullBytes: upnDer})
+			continue
+		}
+		rawValues = append(rawValues, getGeneralName(san))
+	}
+	if len(rawValues) < 1 {
 		return nil, nil
 	}
-	krbRealm := *kerberosRealm
+	rawSan, err := asn1.Marshal(rawValues)
+	if err != nil {
+		return nil, err
+	}
+
+	sanExtension := pkix.Extension{
+		Id:    []int{2, 5, 29, 17},
+		Value: rawSan,
+	}
+
+	return &sanExtension, nil
+}
+
+func genKerberosSAN(userName string, krbRealm string) ([]byte, error) {
 
 	//1.3.6.1.5.2.2
 	krbSanAnotherName := PKInitSANAnotherName{
@@ -286,22 +399,7 @@ func genSANExtension(userName string, kerberosRealm *string) (*pkix.Extension, e
 	krbSanAnotherNameDer = changePrintableStringToGeneralString(krbRealm, krbSanAnotherNameDer)
 	krbSanAnotherNameDer[0] = 0xA0
 	//fmt.Printf("ext: %+x\n", krbSanAnotherNameDer)
-
-	// inspired by marshalSANs in x509.go
-	var rawValues []asn1.RawValue
-	rawValues = append(rawValues, asn1.RawValue{FullBytes: krbSanAnotherNameDer})
-
-	rawSan, err := asn1.Marshal(rawValues)
-	if err != nil {
-		return nil, err
-	}
-
-	sanExtension := pkix.Extension{
-		Id:    []int{2, 5, 29, 17},
-		Value: rawSan,
-	}
-
-	return &sanExtension, nil
+	return krbSanAnotherNameDer, nil
 }
 
 func getGroupListExtension(groups []string) (*pkix.Extension, error) {
@@ -320,6 +418,40 @@ func getGroupListExtension(groups []string) (*pkix.Extension, error) {
 	return &groupListExtension, nil
 }
 
+// oidAuthTime is the extension holding the time at which the user of a
+// certificate authenticated, next to the group list extension.
+var oidAuthTime = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 9586, 100, 8, 1}
+
+func getAuthTimeExtension(authTime time.Time) (*pkix.Extension, error) {
+	encodedValue, err := asn1.MarshalWithParams(authTime.UTC(), "generalized")
+	if err != nil {
+		return nil, err
+	}
+	return &pkix.Extension{Id: oidAuthTime, Value: encodedValue}, nil
+}
+
+// GetAuthTime returns the time at which the user of cert authenticated, as
+// recorded by GenUserX509CertWithOptions, or the zero time if cert does not
+// record it.
+func GetAuthTime(cert *x509.Certificate) (time.Time, error) {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidAuthTime) {
+			continue
+		}
+		var authTime time.Time
+		rest, err := asn1.UnmarshalWithParams(ext.Value, &authTime,
+			"generalized")
+		if err != nil {
+			return time.Time{}, err
+		}
+		if len(rest) > 0 {
+			return time.Time{}, errors.New("trailing data after auth time")
+		}
+		return authTime, nil
+	}
+	return time.Time{}, nil
+}
+
 // returns an x509 cert that has the username in the common name,
 // optionally if a kerberos Realm is present it will also add a kerberos
 // SAN exention for pkinit
@@ -327,6 +459,64 @@ func GenUserX509Cert(userName string, userPub interface{},
 	caCert *x509.Certificate, caPriv crypto.Signer,
 	kerberosRealm *string, duration time.Duration,
 	groups []string, organizations []string) ([]byte, error) {
+	return GenUserX509CertWithSANs(userName, userPub, caCert, caPriv,
+		kerberosRealm, duration, groups, organizations, nil)
+}
+
+// GenUserX509CertWithSANs is like GenUserX509Cert, but also adds sans to the
+// subject alternative names. Entries starting with UPNSANPrefix are added as
+// user principal names, entries containing "@" as email addresses, entries
+// containing "://" as URIs and others as DNS names.
+func GenUserX509CertWithSANs(userName string, userPub interface{},
+	caCert *x509.Certificate, caPriv crypto.Signer,
+	kerberosRealm *string, duration time.Duration,
+	groups []string, organizations []string, sans []string) ([]byte, error) {
+	return GenUserX509CertWithExtKeyUsages(userName, userPub, caCert, caPriv,
+		kerberosRealm, duration, groups, organizations, sans, nil)
+}
+
+// GenUserX509CertWithExtKeyUsages is like GenUserX509CertWithSANs, but if
+// extKeyUsages is not empty the certificate has those extended key usages
+// instead of client and Kerberos client authentication.
+func GenUserX509CertWithExtKeyUsages(userName string, userPub interface{},
+	caCert *x509.Certificate, caPriv crypto.Signer,
+	kerberosRealm *string, duration time.Duration,
+	groups []string, organizations []string, sans []string,
+	extKeyUsages []x509.ExtKeyUsage) ([]byte, error) {
+	return GenUserX509CertWithOptions(userName, userPub, caCert, caPriv,
+		duration, UserX509CertOptions{
+			KerberosRealm: kerberosRealm,
+			Groups:        groups,
+			Organizations: organizations,
+			SANs:          sans,
+			ExtKeyUsages:  extKeyUsages,
+		})
+}
+
+// UserX509CertOptions holds the optional contents of the certificates made
+// by GenUserX509CertWithOptions.
+type UserX509CertOptions struct {
+	KerberosRealm *string
+	Groups        []string
+	Organizations []string
+	SANs          []string
+	// ExtKeyUsages, if not empty, replace client and Kerberos client
+	// authentication.
+	ExtKeyUsages []x509.ExtKeyUsage
+	// OCSPServers and CRLDistributionPoints are the URLs at which relying
+	// parties check whether the certificate has been revoked.
+	OCSPServers           []string
+	CRLDistributionPoints []string
+	// AuthTime, if not zero, is recorded as the time at which the user
+	// authenticated (see GetAuthTime).
+	AuthTime time.Time
+}
+
+// GenUserX509CertWithOptions returns a user certificate like GenUserX509Cert
+// with the contents of options.
+func GenUserX509CertWithOptions(userName string, userPub interface{},
+	caCert *x509.Certificate, caPriv crypto.Signer, duration time.Duration,
+	options UserX509CertOptions) ([]byte, error) {
 	//// Now do the actual work...
 	notBefore := time.Now()
 	notAfter := notBefore.Add(duration)
@@ -337,7 +527,8 @@ func GenUserX509Cert(userName string, userPub interface{},
 		return nil, err
 	}
 
-	sanExtension, err := genSANExtension(userName, kerberosRealm)
+	sanExtension, err := genSANExtension(userName, options.KerberosRealm,
+		options.SANs)
 	if err != nil {
 		return nil, err
 	}
@@ -347,9 +538,9 @@ func GenUserX509Cert(userName string, userPub interface{},
 	kerberosClientExtKeyUsage := []int{1, 3, 6, 1, 5, 2, 3, 4}
 	subject := pkix.Name{
 		CommonName:   userName,
-		Organization: organizations,
+		Organization: options.Organizations,
 	}
-	groupListExtension, err := getGroupListExtension(groups)
+	groupListExtension, err := getGroupListExtension(options.Groups)
 	if err != nil {
 		return nil, err
 	}
@@ -358,11 +549,17 @@ func GenUserX509Cert(userName string, userPub interface{},
 		Subject:               subject,
 		NotBefore:             notBefore,
 		NotAfter:              notAfter,
-		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageKeyAgreement,
+		KeyUsage:              getUserKeyUsage(userPub),
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
 		UnknownExtKeyUsage:    []asn1.ObjectIdentifier{kerberosClientExtKeyUsage},
 		BasicConstraintsValid: true,
 		IsCA:                  false,
+		OCSPServer:            options.OCSPServers,
+		CRLDistributionPoints: options.CRLDistributionPoints,
+	}
+	if len(options.ExtKeyUsages) > 0 {
+		template.ExtKeyUsage = options.ExtKeyUsages
+		template.UnknownExtKeyUsage = nil
 	}
 	if groupListExtension != nil {
 		template.ExtraExtensions = append(template.ExtraExtensions,
@@ -372,6 +569,14 @@ func GenUserX509Cert(userName string, userPub interface{},
 		template.ExtraExtensions = append(template.ExtraExtensions,
 			*sanExtension)
 	}
+	if !options.AuthTime.IsZero() {
+		authTimeExtension, err := getAuthTimeExtension(options.AuthTime)
+		if err != nil {
+			return nil, err
+		}
+		template.ExtraExtensions = append(template.ExtraExtensions,
+			*authTimeExtension)
+	}
 
 	return x509.CreateCertificate(rand.Reader, &template, caCert, userPub, caPriv)
 }
@@ -1,9 +1,15 @@
 package certgen
 
 import (
+	"bytes"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/sha256"
 	"crypto/x509"
+	"encoding/asn1"
 	"encoding/base64"
 	"encoding/pem"
 	"os"
@@ -243,6 +249,70 @@ func TestGenSSHCertFileStringGenerateSuccess(t *testing.T) {
 	t.Logf("got '%s'", c)
 }
 
+func TestGenSSHCertFileStringWithPrincipals(t *testing.T) {
+	goodSigner, err := ssh.ParsePrivateKey([]byte(testSignerPrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	principals := []string{"foo", "foo-admin"}
+	_, certBytes, err := GenSSHCertFileStringWithPrincipals("foo", principals,
+		testUserPublicKey, goodSigner, "bar", testDuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, err := ssh.ParsePublicKey(certBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, ok := pubKey.(*ssh.Certificate)
+	if !ok {
+		t.Fatal("not a certificate")
+	}
+	if len(cert.ValidPrincipals) != len(principals) {
+		t.Fatalf("principals: %v != %v", cert.ValidPrincipals, principals)
+	}
+	for i, principal := range principals {
+		if cert.ValidPrincipals[i] != principal {
+			t.Fatalf("principals: %v != %v", cert.ValidPrincipals, principals)
+		}
+	}
+	_, _, err = GenSSHCertFileStringWithPrincipals("foo", nil,
+		testUserPublicKey, goodSigner, "bar", testDuration)
+	if err == nil {
+		t.Fatal("should have failed with no principals")
+	}
+}
+
+func TestGenSSHCertFileStringWithPermissions(t *testing.T) {
+	goodSigner, err := ssh.ParsePrivateKey([]byte(testSignerPrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	permissions := ssh.Permissions{
+		CriticalOptions: map[string]string{"force-command": "/bin/true"},
+		Extensions:      map[string]string{"permit-pty": ""},
+	}
+	_, certBytes, err := GenSSHCertFileStringWithPermissions("foo",
+		[]string{"foo"}, permissions, testUserPublicKey, goodSigner, "bar",
+		testDuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, err := ssh.ParsePublicKey(certBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := pubKey.(*ssh.Certificate)
+	if cert.CriticalOptions["force-command"] != "/bin/true" ||
+		len(cert.CriticalOptions) != 1 {
+		t.Fatalf("unexpected critical options: %v", cert.CriticalOptions)
+	}
+	if _, ok := cert.Extensions["permit-pty"]; !ok ||
+		len(cert.Extensions) != 1 {
+		t.Fatalf("unexpected extensions: %v", cert.Extensions)
+	}
+}
+
 func TestGenSSHCertFileStringGenerateFailBadPublicKey(t *testing.T) {
 	username := "foo"
 	hostIdentity := "bar"
@@ -472,6 +542,165 @@ func TestGenx509CertGoodWithRealm(t *testing.T) {
 	// 6. kerberos realm info!
 }
 
+func TestGenUserX509CertWithSANs(t *testing.T) {
+	userPub, caCert, caPriv := setupX509Generator(t)
+	realm := "EXAMPLE.COM"
+	sans := []string{"host.example.com", "username@example.com",
+		"spiffe://example.com/username"}
+	derCert, err := GenUserX509CertWithSANs("username", userPub, caCert,
+		caPriv, &realm, testDuration, nil, nil, sans)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(derCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cert.DNSNames) != 1 || cert.DNSNames[0] != sans[0] {
+		t.Fatalf("DNSNames: %v", cert.DNSNames)
+	}
+	if len(cert.EmailAddresses) != 1 || cert.EmailAddresses[0] != sans[1] {
+		t.Fatalf("EmailAddresses: %v", cert.EmailAddresses)
+	}
+	if len(cert.URIs) != 1 || cert.URIs[0].String() != sans[2] {
+		t.Fatalf("URIs: %v", cert.URIs)
+	}
+	foundKerberos := false
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal([]int{2, 5, 29, 17}) &&
+			bytes.Contains(ext.Value, []byte(realm)) {
+			foundKerberos = true
+		}
+	}
+	if !foundKerberos {
+		t.Fatal("kerberos SAN missing")
+	}
+}
+
+func TestGenUserX509CertWithExtKeyUsages(t *testing.T) {
+	userPub, caCert, caPriv := setupX509Generator(t)
+	derCert, err := GenUserX509CertWithExtKeyUsages("username", userPub,
+		caCert, caPriv, nil, testDuration, nil, nil, nil,
+		[]x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth,
+			x509.ExtKeyUsageIPSECUser})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(derCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cert.ExtKeyUsage) != 2 ||
+		cert.ExtKeyUsage[1] != x509.ExtKeyUsageIPSECUser {
+		t.Fatalf("unexpected extended key usages: %v", cert.ExtKeyUsage)
+	}
+	if len(cert.UnknownExtKeyUsage) != 0 {
+		t.Fatalf("unexpected Kerberos key usage: %v",
+			cert.UnknownExtKeyUsage)
+	}
+}
+
+func TestGenUserX509CertWithAuthTime(t *testing.T) {
+	userPub, caCert, caPriv := setupX509Generator(t)
+	derCert, err := GenUserX509Cert("username", userPub, caCert, caPriv, nil,
+		testDuration, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(derCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authTime, err := GetAuthTime(cert); err != nil || !authTime.IsZero() {
+		t.Fatalf("unexpected auth time: %s %v", authTime, err)
+	}
+	loginTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	derCert, err = GenUserX509CertWithOptions("username", userPub, caCert,
+		caPriv, testDuration, UserX509CertOptions{AuthTime: loginTime})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err = x509.ParseCertificate(derCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authTime, err := GetAuthTime(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !authTime.Equal(loginTime) {
+		t.Fatalf("auth time %s != %s", authTime, loginTime)
+	}
+}
+
+func TestGenUserX509CertWithRevocationURLs(t *testing.T) {
+	userPub, caCert, caPriv := setupX509Generator(t)
+	derCert, err := GenUserX509CertWithOptions("username", userPub, caCert,
+		caPriv, testDuration, UserX509CertOptions{
+			OCSPServers:           []string{"https://ca.example.com/v1/ocsp"},
+			CRLDistributionPoints: []string{"https://ca.example.com/v1/crl"},
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(derCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cert.OCSPServer) != 1 ||
+		cert.OCSPServer[0] != "https://ca.example.com/v1/ocsp" {
+		t.Fatalf("unexpected OCSP servers: %v", cert.OCSPServer)
+	}
+	if len(cert.CRLDistributionPoints) != 1 ||
+		cert.CRLDistributionPoints[0] != "https://ca.example.com/v1/crl" {
+		t.Fatalf("unexpected CRL distribution points: %v",
+			cert.CRLDistributionPoints)
+	}
+}
+
+func TestGenUserX509CertWithUPN(t *testing.T) {
+	userPub, caCert, caPriv := setupX509Generator(t)
+	derCert, err := GenUserX509CertWithSANs("username", userPub, caCert,
+		caPriv, nil, testDuration, nil, nil,
+		[]string{UPNSANPrefix + "username@corp.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(derCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cert.EmailAddresses) != 0 || len(cert.DNSNames) != 0 {
+		t.Fatalf("UPN encoded as another name type: %v %v",
+			cert.EmailAddresses, cert.DNSNames)
+	}
+	var rawValues []asn1.RawValue
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal([]int{2, 5, 29, 17}) {
+			if _, err := asn1.Unmarshal(ext.Value, &rawValues); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if len(rawValues) != 1 || rawValues[0].Tag != 0 ||
+		rawValues[0].Class != asn1.ClassContextSpecific {
+		t.Fatalf("unexpected SANs: %+v", rawValues)
+	}
+	var otherName struct {
+		Id    asn1.ObjectIdentifier
+		Value string `asn1:"explicit,tag:0,utf8"`
+	}
+	_, err = asn1.UnmarshalWithParams(rawValues[0].FullBytes, &otherName,
+		"tag:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !otherName.Id.Equal([]int{1, 3, 6, 1, 4, 1, 311, 20, 2, 3}) ||
+		otherName.Value != "username@corp.example.com" {
+		t.Fatalf("unexpected UPN: %+v", otherName)
+	}
+}
+
 //GenSelfSignedCACert
 func TestGenSelfSignedCACertGood(t *testing.T) {
 	caPriv, err := GetSignerFromPEMBytes([]byte(testSignerPrivateKey))
@@ -502,6 +731,90 @@ func TestGenSelfSignedCACertGood(t *testing.T) {
 
 }
 
+// TestGenCertsKeyTypes checks that certificates for ECDSA and Ed25519 user
+// keys can be created with CAs of every supported key type.
+func TestGenCertsKeyTypes(t *testing.T) {
+	rsaCA, err := GetSignerFromPEMBytes([]byte(testSignerPrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaCA, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed25519CA, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaUser, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed25519UserPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userPubs := map[string]crypto.PublicKey{
+		"ecdsa":   &ecdsaUser.PublicKey,
+		"ed25519": ed25519UserPub,
+	}
+	for caName, caPriv := range map[string]crypto.Signer{
+		"rsa":     rsaCA,
+		"ecdsa":   ecdsaCA,
+		"ed25519": ed25519CA,
+	} {
+		derCACert, err := GenSelfSignedCACert("some hostname",
+			"some organization", caPriv)
+		if err != nil {
+			t.Fatalf("%s CA: %s", caName, err)
+		}
+		caCert, err := x509.ParseCertificate(derCACert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sshSigner, err := ssh.NewSignerFromSigner(caPriv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for userName, userPub := range userPubs {
+			derCert, err := GenUserX509Cert("username", userPub, caCert,
+				caPriv, nil, testDuration, nil, nil)
+			if err != nil {
+				t.Fatalf("%s CA, %s user: %s", caName, userName, err)
+			}
+			cert, err := x509.ParseCertificate(derCert)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := cert.CheckSignatureFrom(caCert); err != nil {
+				t.Fatalf("%s CA, %s user: %s", caName, userName, err)
+			}
+			if cert.KeyUsage&x509.KeyUsageKeyEncipherment != 0 {
+				t.Fatalf("%s user cert allows key encipherment", userName)
+			}
+			sshPub, err := ssh.NewPublicKey(userPub)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, certBytes, err := GenSSHCertFileString("username",
+				string(ssh.MarshalAuthorizedKey(sshPub)), sshSigner,
+				"host", testDuration)
+			if err != nil {
+				t.Fatalf("%s CA, %s user: %s", caName, userName, err)
+			}
+			sshCert, err := ssh.ParsePublicKey(certBytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checker := ssh.CertChecker{}
+			err = checker.CheckCert("username", sshCert.(*ssh.Certificate))
+			if err != nil {
+				t.Fatalf("%s CA, %s user: %s", caName, userName, err)
+			}
+		}
+	}
+}
+
 func TestGetSignerFromPEMBytesFail(t *testing.T) {
 	_, err := GetSignerFromPEMBytes([]byte("not pem data"))
 	if err == nil {
@@ -527,6 +840,19 @@ func TestGetSignerFromPEMBytesSuccess(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	derKey, err := x509.MarshalPKCS8PrivateKey(ed25519Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = GetSignerFromPEMBytes(pem.EncodeToMemory(
+		&pem.Block{Type: "PRIVATE KEY", Bytes: derKey}))
+	if err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestGetPubKeyFromPem(t *testing.T) {
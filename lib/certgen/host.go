@@ -0,0 +1,83 @@
+package certgen
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// GenHostX509Cert returns an x509 server cert for the DNS names dnsNames,
+// the first of which is also the common name.
+func GenHostX509Cert(dnsNames []string, hostPub interface{},
+	caCert *x509.Certificate, caPriv crypto.Signer,
+	duration time.Duration) ([]byte, error) {
+	if len(dnsNames) < 1 {
+		return nil, errors.New("no DNS names")
+	}
+	notBefore := time.Now()
+	notAfter := notBefore.Add(duration)
+
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		return nil, err
+	}
+	template := x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:              dnsNames,
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              getUserKeyUsage(hostPub),
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  false,
+	}
+	return x509.CreateCertificate(rand.Reader, &template, caCert, hostPub,
+		caPriv)
+}
+
+// GenSSHHostCert returns an SSH host cert for hostKey valid for the host
+// names principals, in authorized_keys format and in wire format.
+func GenSSHHostCert(hostKey ssh.PublicKey, principals []string,
+	signer ssh.Signer, keyID string, duration time.Duration) (
+	string, []byte, error) {
+	if len(principals) < 1 {
+		return "", nil, errors.New("no principals given")
+	}
+	if _, ok := hostKey.(*ssh.Certificate); ok {
+		return "", nil, errors.New("host key is a certificate")
+	}
+	currentEpoch := uint64(time.Now().Unix())
+	expireEpoch := currentEpoch + uint64(duration.Seconds())
+
+	nBig, err := rand.Int(rand.Reader, big.NewInt(0xFFFFFFFF))
+	if err != nil {
+		return "", nil, err
+	}
+	cert := ssh.Certificate{
+		Key:             hostKey,
+		CertType:        ssh.HostCert,
+		SignatureKey:    signer.PublicKey(),
+		ValidPrincipals: principals,
+		KeyId:           keyID,
+		ValidAfter:      currentEpoch,
+		ValidBefore:     expireEpoch,
+		Serial:          (currentEpoch << 32) | nBig.Uint64(),
+	}
+	err = cert.SignCert(bytes.NewReader(cert.Marshal()), signer)
+	if err != nil {
+		return "", nil, err
+	}
+	certString := strings.TrimSuffix(string(ssh.MarshalAuthorizedKey(&cert)),
+		"\n")
+	return certString, cert.Marshal(), nil
+}
@@ -0,0 +1,74 @@
+package certgen
+
+import (
+	"crypto/x509"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestGenHostX509Cert(t *testing.T) {
+	hostPub, caCert, caPriv := setupX509Generator(t)
+	dnsNames := []string{"host.example.com", "alias.example.com"}
+	derCert, err := GenHostX509Cert(dnsNames, hostPub, caCert, caPriv,
+		testDuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(derCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Subject.CommonName != dnsNames[0] || len(cert.DNSNames) != 2 ||
+		cert.DNSNames[1] != dnsNames[1] {
+		t.Fatalf("unexpected names %s %v", cert.Subject.CommonName,
+			cert.DNSNames)
+	}
+	if len(cert.ExtKeyUsage) != 1 ||
+		cert.ExtKeyUsage[0] != x509.ExtKeyUsageServerAuth {
+		t.Fatalf("unexpected extended key usage %v", cert.ExtKeyUsage)
+	}
+	if _, err := GenHostX509Cert(nil, hostPub, caCert, caPriv,
+		testDuration); err == nil {
+		t.Fatal("no DNS names should fail")
+	}
+}
+
+func TestGenSSHHostCert(t *testing.T) {
+	signer, err := ssh.ParsePrivateKey([]byte(testSignerPrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(testUserPublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certString, certBytes, err := GenSSHHostCert(hostKey,
+		[]string{"host.example.com"}, signer, "bootstrap/web", testDuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(certString))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, ok := pubKey.(*ssh.Certificate)
+	if !ok || string(cert.Marshal()) != string(certBytes) {
+		t.Fatal("unexpected certificate encoding")
+	}
+	checker := ssh.CertChecker{
+		IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
+			return string(auth.Marshal()) == string(signer.PublicKey().Marshal())
+		},
+	}
+	if err := checker.CheckHostKey("host.example.com:22", nil, cert); err != nil {
+		t.Fatal(err)
+	}
+	if cert.KeyId != "bootstrap/web" {
+		t.Fatalf("unexpected key ID %s", cert.KeyId)
+	}
+	if _, _, err := GenSSHHostCert(cert, []string{"host.example.com"},
+		signer, "bootstrap/web", testDuration); err == nil {
+		t.Fatal("certificate as host key should fail")
+	}
+}
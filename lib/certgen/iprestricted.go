@@ -140,7 +140,7 @@ func GenIPRestrictedX509Cert(userName string, userPub interface{},
 		Subject:               subject,
 		NotBefore:             notBefore,
 		NotAfter:              notAfter,
-		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageKeyAgreement,
+		KeyUsage:              getUserKeyUsage(userPub),
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
 		IssuingCertificateURL: crlURL,
 		OCSPServer:            OCPServer,
@@ -154,6 +154,17 @@ func GenIPRestrictedX509Cert(userName string, userPub interface{},
 	return x509.CreateCertificate(rand.Reader, &template, caCert, userPub, caPriv)
 }
 
+// IsIPRestrictedX509Cert returns true if userCert has an IP address
+// delegation extension, as added by GenIPRestrictedX509Cert.
+func IsIPRestrictedX509Cert(userCert *x509.Certificate) bool {
+	for _, certExtension := range userCert.Extensions {
+		if certExtension.Id.Equal(oidIPAddressDelegation) {
+			return true
+		}
+	}
+	return false
+}
+
 // VerifyIPRestrictedX509CertIP takes a x509 cert and verifies that it is valid given
 // an incoming remote address. If the cert does not contain an IP restriction extension
 // the verification is considered failed.
@@ -103,4 +103,7 @@ func TestGenIPRestrictedX509Cert(t *testing.T) {
 	if ok {
 		t.Fatal("should have failed extension not found")
 	}
+	if !IsIPRestrictedX509Cert(cert) || IsIPRestrictedX509Cert(caCert) {
+		t.Fatal("IP restriction not detected")
+	}
 }
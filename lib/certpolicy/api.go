@@ -0,0 +1,166 @@
+// Package certpolicy evaluates per-user and per-group certificate issuance
+// rules loaded from a YAML file.
+package certpolicy
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+)
+
+// ErrNoMatchingRule is matched by a *DeniedError when no rule applies to
+// the request.
+var ErrNoMatchingRule = errors.New("no certificate policy rule matches")
+
+// Rule restricts the certificates issued to the users it matches. A rule
+// with neither Users nor Groups matches everyone. Empty restrictions are
+// not enforced.
+type Rule struct {
+	Name   string   `yaml:"name"`
+	Users  []string `yaml:"users"`
+	Groups []string `yaml:"groups"`
+	// MaxDuration caps the lifetime of issued certificates. Longer
+	// requests are shortened.
+	MaxDuration time.Duration `yaml:"max_duration"`
+	// AllowedSSHPrincipals may be requested as SSH principals in addition to
+	// the username. "$USER" is replaced by the username.
+	AllowedSSHPrincipals []string `yaml:"allowed_ssh_principals"`
+	// AllowedX509SANs may be requested as X.509 subject alternative names
+	// (DNS names, email addresses or URIs). "$USER" is replaced by the
+	// username.
+	AllowedX509SANs []string `yaml:"allowed_x509_sans"`
+	// AllowedSSHCriticalOptions are the names of the SSH critical options
+	// (such as force-command and source-address) which may be requested.
+	AllowedSSHCriticalOptions []string `yaml:"allowed_ssh_critical_options"`
+	// AllowedSSHExtensions are the SSH extensions which may be requested in
+	// addition to those the server grants by default.
+	AllowedSSHExtensions []string `yaml:"allowed_ssh_extensions"`
+	// RequiredAuth lists authentication methods (as named in
+	// allowed_auth_backends_for_certs), one of which must have been used.
+	RequiredAuth []string `yaml:"required_auth"`
+	// RequireApprovedDevice only permits requests from a device an admin
+	// approved in the device registry.
+	RequireApprovedDevice bool `yaml:"require_approved_device"`
+	// RequireHardwareKey only permits requests for keys attested to be
+	// generated in a hardware key, such as the PIV applet of a YubiKey.
+	RequireHardwareKey bool `yaml:"require_hardware_key"`
+	// ApprovalSSHPrincipals and ApprovalX509SANs are allowed principals
+	// and SANs which are only issued once another user approves the
+	// request. "$USER" is replaced by the username.
+	ApprovalSSHPrincipals []string `yaml:"approval_ssh_principals"`
+	ApprovalX509SANs      []string `yaml:"approval_x509_sans"`
+	// Approvers and ApproverGroups may approve the requests of the rule.
+	// If both are empty the server decides, such as letting admins approve.
+	Approvers      []string `yaml:"approvers"`
+	ApproverGroups []string `yaml:"approver_groups"`
+}
+
+// Config is the content of a policy file. The first rule matching a
+// request applies; requests matched by no rule are denied.
+type Config struct {
+	Rules []Rule `yaml:"rules"`
+}
+
+// Request describes a certificate request.
+type Request struct {
+	Username string
+	Groups   []string
+	// AuthMethods are the authentication methods the user has completed.
+	AuthMethods   []string
+	Duration      time.Duration
+	SSHPrincipals []string
+	X509SANs      []string
+	// SSHCriticalOptions maps requested option names to their values.
+	SSHCriticalOptions map[string]string
+	// SSHExtensions are requested extensions not granted by default.
+	SSHExtensions []string
+	// DeviceApproved is true if the request came from an approved device.
+	DeviceApproved bool
+	// HardwareKey is true if the key to certify was attested to be held in
+	// a hardware key.
+	HardwareKey bool
+	// Rule, if set, is the name of the rule which applies, whether or not
+	// it matches Username and Groups, such as the rule a service account is
+	// bound to.
+	Rule string
+}
+
+// Decision is the result of a permitted request.
+type Decision struct {
+	Rule     string
+	Duration time.Duration
+	// SSHPrincipals are the principals to put in an SSH certificate. The
+	// username is always included.
+	SSHPrincipals      []string
+	X509SANs           []string
+	SSHCriticalOptions map[string]string
+	SSHExtensions      []string
+	// NeedsApproval lists the SSH principals and X.509 SANs of the decision
+	// which need an approval before the certificate is issued.
+	NeedsApproval  []string
+	Approvers      []string
+	ApproverGroups []string
+}
+
+// DeniedError is returned when a request is not permitted. Message
+// explains why and is safe to show to the user.
+type DeniedError struct {
+	Rule    string
+	Message string
+	noMatch bool
+}
+
+func (e *DeniedError) Error() string {
+	return e.error()
+}
+
+// Is allows errors.Is(err, ErrNoMatchingRule).
+func (e *DeniedError) Is(target error) bool {
+	return e.noMatch && target == ErrNoMatchingRule
+}
+
+// Policy holds a policy Config which may be replaced while in use.
+type Policy struct {
+	filename string
+	logger   log.DebugLogger
+	mutex    sync.RWMutex
+	config   Config
+	modTime  time.Time
+	size     int64
+}
+
+// New returns a Policy enforcing config.
+func New(config Config) (*Policy, error) {
+	return newPolicy(config)
+}
+
+// LoadFile returns a Policy read from the YAML file filename. If
+// reloadInterval is non-zero the file is checked for changes that often and
+// reloaded in the background. A file which fails to load leaves the
+// previous policy in place.
+func LoadFile(filename string, reloadInterval time.Duration,
+	logger log.DebugLogger) (*Policy, error) {
+	return loadFile(filename, reloadInterval, logger)
+}
+
+// Reload reads the policy file again now if it changed, rather than waiting
+// for the reload interval. The bool is true if it was reloaded. A file which
+// fails to load leaves the policy unchanged. Policies made by New are not
+// reloaded.
+func (p *Policy) Reload() (bool, error) {
+	return p.reload()
+}
+
+// Evaluate checks request against the policy. A *DeniedError is returned if
+// the request is not permitted.
+func (p *Policy) Evaluate(request Request) (*Decision, error) {
+	return p.evaluate(request)
+}
+
+// NeedsGroups returns true if any rule matches on groups, so callers can
+// skip group lookups otherwise.
+func (p *Policy) NeedsGroups() bool {
+	return p.needsGroups()
+}
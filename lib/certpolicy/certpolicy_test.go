@@ -0,0 +1,291 @@
+package certpolicy
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log/testlogger"
+)
+
+var testConfig = Config{Rules: []Rule{
+	{
+		Name:                      "admins",
+		Groups:                    []string{"admins"},
+		MaxDuration:               4 * time.Hour,
+		AllowedSSHPrincipals:      []string{"root", "$USER-admin"},
+		RequiredAuth:              []string{"U2F", "WebAuthn"},
+		AllowedSSHCriticalOptions: []string{"source-address"},
+		AllowedSSHExtensions:      []string{"permit-user-rc"},
+	},
+	{
+		Name:            "alice",
+		Users:           []string{"alice"},
+		AllowedX509SANs: []string{"$USER@example.com", "alice.example.com"},
+	},
+	{
+		Name:                  "contractors",
+		Groups:                []string{"contractors"},
+		RequireApprovedDevice: true,
+	},
+	{
+		Name:               "finance",
+		Groups:             []string{"finance"},
+		RequireHardwareKey: true,
+	},
+	{
+		Name:                  "oncall",
+		Users:                 []string{"erin"},
+		AllowedSSHPrincipals:  []string{"root", "deploy"},
+		AllowedX509SANs:       []string{"db.example.com"},
+		ApprovalSSHPrincipals: []string{"root"},
+		ApprovalX509SANs:      []string{"db.example.com"},
+		ApproverGroups:        []string{"sre"},
+	},
+}}
+
+func TestEvaluate(t *testing.T) {
+	policy, err := New(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !policy.NeedsGroups() {
+		t.Fatal("policy has group rules")
+	}
+	decision, err := policy.Evaluate(Request{
+		Username:      "bob",
+		Groups:        []string{"users", "admins"},
+		AuthMethods:   []string{"Password", "WebAuthn"},
+		Duration:      16 * time.Hour,
+		SSHPrincipals: []string{"bob", "bob-admin", "root", "bob-admin", "bob"},
+		SSHCriticalOptions: map[string]string{
+			"source-address": "10.0.0.0/8"},
+		SSHExtensions: []string{"permit-user-rc"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decision.Rule != "admins" || decision.Duration != 4*time.Hour {
+		t.Fatalf("unexpected decision: %+v", decision)
+	}
+	if len(decision.SSHPrincipals) != 3 ||
+		decision.SSHPrincipals[0] != "bob" ||
+		decision.SSHPrincipals[1] != "bob-admin" {
+		t.Fatalf("unexpected principals: %v", decision.SSHPrincipals)
+	}
+	if decision.SSHCriticalOptions["source-address"] != "10.0.0.0/8" ||
+		len(decision.SSHExtensions) != 1 {
+		t.Fatalf("unexpected SSH permissions: %+v", decision)
+	}
+	decision, err = policy.Evaluate(Request{
+		Username: "alice",
+		Duration: 16 * time.Hour,
+		X509SANs: []string{"alice@example.com", "alice@example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decision.Rule != "alice" || decision.Duration != 16*time.Hour ||
+		len(decision.X509SANs) != 1 {
+		t.Fatalf("unexpected decision: %+v", decision)
+	}
+	decision, err = policy.Evaluate(Request{
+		Username:       "dave",
+		Groups:         []string{"contractors"},
+		DeviceApproved: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decision.Rule != "contractors" {
+		t.Fatalf("unexpected decision: %+v", decision)
+	}
+	decision, err = policy.Evaluate(Request{
+		Username:    "frank",
+		Groups:      []string{"finance"},
+		HardwareKey: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decision.Rule != "finance" {
+		t.Fatalf("unexpected decision: %+v", decision)
+	}
+}
+
+func TestEvaluateDenied(t *testing.T) {
+	policy, err := New(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, request := range []Request{
+		// Missing the required second factor.
+		{Username: "bob", Groups: []string{"admins"},
+			AuthMethods: []string{"Password"}},
+		// Principal not allowed.
+		{Username: "bob", Groups: []string{"admins"},
+			AuthMethods: []string{"U2F"}, SSHPrincipals: []string{"alice"}},
+		// Critical option not allowed.
+		{Username: "bob", Groups: []string{"admins"},
+			AuthMethods:        []string{"U2F"},
+			SSHCriticalOptions: map[string]string{"force-command": "true"}},
+		// Extension not allowed.
+		{Username: "bob", Groups: []string{"admins"},
+			AuthMethods:   []string{"U2F"},
+			SSHExtensions: []string{"permit-X11-forwarding"}},
+		// SAN not allowed.
+		{Username: "alice", X509SANs: []string{"bob@example.com"}},
+		// Device not approved.
+		{Username: "dave", Groups: []string{"contractors"}},
+		// Key not attested.
+		{Username: "frank", Groups: []string{"finance"}},
+	} {
+		_, err := policy.Evaluate(request)
+		var deniedError *DeniedError
+		if !errors.As(err, &deniedError) {
+			t.Errorf("%+v: expected *DeniedError, got %v", request, err)
+			continue
+		}
+		if errors.Is(err, ErrNoMatchingRule) {
+			t.Errorf("%+v: unexpected ErrNoMatchingRule", request)
+		}
+	}
+	_, err = policy.Evaluate(Request{Username: "carol"})
+	if !errors.Is(err, ErrNoMatchingRule) {
+		t.Fatalf("expected ErrNoMatchingRule, got %v", err)
+	}
+	// Bound to a rule which does not exist.
+	_, err = policy.Evaluate(Request{Username: "alice", Rule: "missing"})
+	if !errors.Is(err, ErrNoMatchingRule) {
+		t.Fatalf("expected ErrNoMatchingRule, got %v", err)
+	}
+}
+
+func TestEvaluateApproval(t *testing.T) {
+	policy, err := New(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decision, err := policy.Evaluate(Request{
+		Username:      "erin",
+		SSHPrincipals: []string{"deploy"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decision.NeedsApproval) != 0 || len(decision.ApproverGroups) != 0 {
+		t.Fatalf("unexpected approval: %+v", decision)
+	}
+	decision, err = policy.Evaluate(Request{
+		Username:      "erin",
+		SSHPrincipals: []string{"deploy", "root"},
+		X509SANs:      []string{"db.example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decision.NeedsApproval) != 2 ||
+		decision.NeedsApproval[0] != "root" ||
+		decision.NeedsApproval[1] != "db.example.com" ||
+		len(decision.ApproverGroups) != 1 {
+		t.Fatalf("unexpected approval: %+v", decision)
+	}
+}
+
+func TestEvaluateRule(t *testing.T) {
+	policy, err := New(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The admins rule would apply first.
+	decision, err := policy.Evaluate(Request{
+		Username: "alice",
+		Groups:   []string{"admins"},
+		Duration: 16 * time.Hour,
+		Rule:     "alice",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decision.Rule != "alice" || decision.Duration != 16*time.Hour {
+		t.Fatalf("unexpected decision: %+v", decision)
+	}
+	// The bound rule applies without matching users or groups.
+	decision, err = policy.Evaluate(Request{
+		Username:    "deploy-bot",
+		AuthMethods: []string{"U2F"},
+		Duration:    16 * time.Hour,
+		Rule:        "admins",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decision.Rule != "admins" || decision.Duration != 4*time.Hour {
+		t.Fatalf("unexpected decision: %+v", decision)
+	}
+}
+
+func TestLoadFileReload(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "certpolicy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	filename := filepath.Join(tmpDir, "policy.yml")
+	writeFile := func(data string, modTime time.Time) {
+		if err := ioutil.WriteFile(filename, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filename, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	writeFile("rules:\n  - name: everyone\n    max_duration: 1h\n",
+		now.Add(-time.Hour))
+	policy, err := LoadFile(filename, 0, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decision, err := policy.Evaluate(Request{Username: "bob",
+		Duration: 8 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decision.Duration != time.Hour {
+		t.Fatalf("unexpected duration %s", decision.Duration)
+	}
+	// A broken file keeps the previous policy.
+	writeFile("rules: [", now.Add(-time.Minute))
+	if _, err := policy.reloadIfChanged(); err == nil {
+		t.Fatal("expected parse error")
+	}
+	if _, err := policy.Evaluate(Request{Username: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	writeFile("rules:\n  - name: alice\n    users: [alice]\n", now)
+	reloaded, err := policy.reloadIfChanged()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reloaded {
+		t.Fatal("policy not reloaded")
+	}
+	if reloaded, err := policy.Reload(); err != nil || reloaded {
+		t.Fatalf("unchanged policy should not be reloaded: %v %v", reloaded, err)
+	}
+	if _, err := policy.Evaluate(Request{Username: "bob"}); err == nil {
+		t.Fatal("expected bob to be denied after reload")
+	}
+	if _, err := LoadFile(filepath.Join(tmpDir, "missing.yml"), 0,
+		testlogger.New(t)); err == nil {
+		t.Fatal("expected error for a missing file")
+	}
+	writeFile("rules:\n  - unknown_field: 1\n", now.Add(time.Minute))
+	if _, err := policy.reloadIfChanged(); err == nil {
+		t.Fatal("expected error for an unknown field")
+	}
+}
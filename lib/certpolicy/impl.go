@@ -0,0 +1,295 @@
+package certpolicy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"gopkg.in/yaml.v2"
+)
+
+const usernameVariable = "$USER"
+
+func (e *DeniedError) error() string {
+	if e.Rule == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%s (policy rule %q)", e.Message, e.Rule)
+}
+
+func checkConfig(config Config) error {
+	for index, rule := range config.Rules {
+		if rule.MaxDuration < 0 {
+			return fmt.Errorf("rule %d: negative max_duration", index)
+		}
+		for _, name := range rule.RequiredAuth {
+			if name == "" {
+				return fmt.Errorf("rule %d: empty required_auth entry", index)
+			}
+		}
+	}
+	return nil
+}
+
+func newPolicy(config Config) (*Policy, error) {
+	if err := checkConfig(config); err != nil {
+		return nil, err
+	}
+	return &Policy{config: config}, nil
+}
+
+func readConfig(filename string) (Config, error) {
+	var config Config
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return config, err
+	}
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return config, fmt.Errorf("cannot parse %s: %s", filename, err)
+	}
+	if err := checkConfig(config); err != nil {
+		return config, fmt.Errorf("%s: %s", filename, err)
+	}
+	return config, nil
+}
+
+func loadFile(filename string, reloadInterval time.Duration,
+	logger log.DebugLogger) (*Policy, error) {
+	p := &Policy{filename: filename, logger: logger}
+	if _, err := p.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+	if reloadInterval > 0 {
+		go p.reloadLoop(reloadInterval)
+	}
+	return p, nil
+}
+
+func (p *Policy) reloadLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		reloaded, err := p.reloadIfChanged()
+		if err != nil {
+			p.logger.Printf("keeping previous certificate policy: %s", err)
+		} else if reloaded {
+			p.logger.Printf("reloaded certificate policy from %s", p.filename)
+		}
+	}
+}
+
+func (p *Policy) reload() (bool, error) {
+	if p.filename == "" {
+		return false, nil
+	}
+	return p.reloadIfChanged()
+}
+
+// reloadIfChanged reads the policy file if its size or modification time
+// changed since it was last read.
+func (p *Policy) reloadIfChanged() (bool, error) {
+	fi, err := os.Stat(p.filename)
+	if err != nil {
+		return false, err
+	}
+	p.mutex.RLock()
+	unchanged := fi.ModTime().Equal(p.modTime) && fi.Size() == p.size
+	p.mutex.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	config, err := readConfig(p.filename)
+	if err != nil {
+		return false, err
+	}
+	p.mutex.Lock()
+	p.config = config
+	p.modTime = fi.ModTime()
+	p.size = fi.Size()
+	p.mutex.Unlock()
+	return true, nil
+}
+
+func (rule *Rule) getName(index int) string {
+	if rule.Name != "" {
+		return rule.Name
+	}
+	return fmt.Sprintf("#%d", index)
+}
+
+func (rule *Rule) matches(request Request) bool {
+	if len(rule.Users) < 1 && len(rule.Groups) < 1 {
+		return true
+	}
+	for _, user := range rule.Users {
+		if user == request.Username {
+			return true
+		}
+	}
+	for _, group := range rule.Groups {
+		for _, userGroup := range request.Groups {
+			if group == userGroup {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// getAllowed returns the set of allowed values with $USER expanded.
+func getAllowed(patterns []string, username string) map[string]struct{} {
+	allowed := make(map[string]struct{}, len(patterns))
+	for _, pattern := range patterns {
+		allowed[strings.Replace(pattern, usernameVariable, username, -1)] =
+			struct{}{}
+	}
+	return allowed
+}
+
+func (p *Policy) evaluate(request Request) (*Decision, error) {
+	p.mutex.RLock()
+	rules := p.config.Rules
+	p.mutex.RUnlock()
+	for index := range rules {
+		rule := &rules[index]
+		name := rule.getName(index)
+		if request.Rule != "" {
+			if name != request.Rule {
+				continue
+			}
+		} else if !rule.matches(request) {
+			continue
+		}
+		return rule.evaluate(name, request)
+	}
+	return nil, &DeniedError{
+		Message: fmt.Sprintf("no certificate policy applies to %s",
+			request.Username),
+		noMatch: true,
+	}
+}
+
+func (rule *Rule) evaluate(name string, request Request) (*Decision, error) {
+	if len(rule.RequiredAuth) > 0 {
+		authOK := false
+		for _, required := range rule.RequiredAuth {
+			for _, method := range request.AuthMethods {
+				if method == required {
+					authOK = true
+				}
+			}
+		}
+		if !authOK {
+			return nil, &DeniedError{
+				Rule: name,
+				Message: fmt.Sprintf("one of %s authentication is required",
+					strings.Join(rule.RequiredAuth, ", ")),
+			}
+		}
+	}
+	if rule.RequireApprovedDevice && !request.DeviceApproved {
+		return nil, &DeniedError{
+			Rule:    name,
+			Message: "an approved device is required",
+		}
+	}
+	if rule.RequireHardwareKey && !request.HardwareKey {
+		return nil, &DeniedError{
+			Rule:    name,
+			Message: "a hardware attested key is required",
+		}
+	}
+	decision := &Decision{
+		Rule:          name,
+		Duration:      request.Duration,
+		SSHPrincipals: []string{request.Username},
+	}
+	if rule.MaxDuration > 0 && decision.Duration > rule.MaxDuration {
+		decision.Duration = rule.MaxDuration
+	}
+	allowedPrincipals := getAllowed(rule.AllowedSSHPrincipals,
+		request.Username)
+	approvalPrincipals := getAllowed(rule.ApprovalSSHPrincipals,
+		request.Username)
+	// Certificates list each principal and SAN once.
+	seenPrincipals := map[string]struct{}{request.Username: {}}
+	for _, principal := range request.SSHPrincipals {
+		if _, ok := seenPrincipals[principal]; ok {
+			continue
+		}
+		seenPrincipals[principal] = struct{}{}
+		if _, ok := allowedPrincipals[principal]; !ok {
+			return nil, &DeniedError{
+				Rule:    name,
+				Message: fmt.Sprintf("SSH principal %q is not allowed", principal),
+			}
+		}
+		decision.SSHPrincipals = append(decision.SSHPrincipals, principal)
+		if _, ok := approvalPrincipals[principal]; ok {
+			decision.NeedsApproval = append(decision.NeedsApproval, principal)
+		}
+	}
+	allowedSANs := getAllowed(rule.AllowedX509SANs, request.Username)
+	approvalSANs := getAllowed(rule.ApprovalX509SANs, request.Username)
+	seenSANs := make(map[string]struct{}, len(request.X509SANs))
+	for _, san := range request.X509SANs {
+		if _, ok := seenSANs[san]; ok {
+			continue
+		}
+		seenSANs[san] = struct{}{}
+		if _, ok := allowedSANs[san]; !ok {
+			return nil, &DeniedError{
+				Rule:    name,
+				Message: fmt.Sprintf("X.509 SAN %q is not allowed", san),
+			}
+		}
+		decision.X509SANs = append(decision.X509SANs, san)
+		if _, ok := approvalSANs[san]; ok {
+			decision.NeedsApproval = append(decision.NeedsApproval, san)
+		}
+	}
+	allowedOptions := getAllowed(rule.AllowedSSHCriticalOptions,
+		request.Username)
+	for option, value := range request.SSHCriticalOptions {
+		if _, ok := allowedOptions[option]; !ok {
+			return nil, &DeniedError{
+				Rule: name,
+				Message: fmt.Sprintf("SSH critical option %q is not allowed",
+					option),
+			}
+		}
+		if decision.SSHCriticalOptions == nil {
+			decision.SSHCriticalOptions = make(map[string]string)
+		}
+		decision.SSHCriticalOptions[option] = value
+	}
+	allowedExtensions := getAllowed(rule.AllowedSSHExtensions,
+		request.Username)
+	for _, extension := range request.SSHExtensions {
+		if _, ok := allowedExtensions[extension]; !ok {
+			return nil, &DeniedError{
+				Rule: name,
+				Message: fmt.Sprintf("SSH extension %q is not allowed",
+					extension),
+			}
+		}
+		decision.SSHExtensions = append(decision.SSHExtensions, extension)
+	}
+	if len(decision.NeedsApproval) > 0 {
+		decision.Approvers = rule.Approvers
+		decision.ApproverGroups = rule.ApproverGroups
+	}
+	return decision, nil
+}
+
+func (p *Policy) needsGroups() bool {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	for _, rule := range p.config.Rules {
+		if len(rule.Groups) > 0 {
+			return true
+		}
+	}
+	return false
+}
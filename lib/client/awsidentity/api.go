@@ -0,0 +1,32 @@
+// Package awsidentity reads the identity credential of the EC2 instance it
+// runs on from the instance metadata service (IMDSv2). Besides the instance
+// identity document, which never changes, the credential holds an STS
+// GetCallerIdentity request signed with the credentials of the instance role
+// at the time, so that a keymaster can check that it is fresh.
+package awsidentity
+
+import (
+	"net/http"
+	"time"
+)
+
+// DefaultMetadataURL is the instance metadata service of EC2.
+const DefaultMetadataURL = "http://169.254.169.254/latest"
+
+// Identity is the identity credential of an instance.
+type Identity struct {
+	// Document and Signature are the instance identity document and its
+	// signature.
+	Document  string
+	Signature string
+	// STSRequest is the JSON encoded proto.AWSSTSRequest for audience.
+	STSRequest string
+}
+
+// GetIdentity reads the identity credential of the instance from the
+// metadata service at metadataURL with client, which must not use a proxy.
+// audience is the URL of the keymaster the credential is for.
+func GetIdentity(client *http.Client, metadataURL string,
+	audience string) (*Identity, error) {
+	return getIdentity(client, metadataURL, audience, time.Now())
+}
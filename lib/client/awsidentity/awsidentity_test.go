@@ -0,0 +1,88 @@
+package awsidentity
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+// The get-vanilla case of the AWS Signature Version 4 test suite.
+func TestSignRequest(t *testing.T) {
+	req, err := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now, err := time.Parse(amzDateFormat, "20150830T123600Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signRequest(req, nil, &roleCredentials{
+		AccessKeyId:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}, "us-east-1", "service", now)
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if authorization := req.Header.Get("Authorization"); authorization != expected {
+		t.Fatalf("unexpected Authorization: %s", authorization)
+	}
+}
+
+func TestGetIdentity(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/latest/api/token" {
+				if r.Method != "PUT" ||
+					r.Header.Get(metadataTokenTTLHeader) == "" {
+					http.Error(w, "bad token request", http.StatusBadRequest)
+					return
+				}
+				w.Write([]byte("session"))
+				return
+			}
+			if r.Header.Get(metadataTokenHeader) != "session" {
+				http.Error(w, "no token", http.StatusUnauthorized)
+				return
+			}
+			switch r.URL.Path {
+			case "/latest/dynamic/instance-identity/document":
+				w.Write([]byte(`{"accountId":"123456789012"}`))
+			case "/latest/dynamic/instance-identity/signature":
+				w.Write([]byte("c2lnbmF0dXJl"))
+			case "/latest/meta-data/iam/security-credentials/":
+				w.Write([]byte("web-role"))
+			case "/latest/meta-data/iam/security-credentials/web-role":
+				w.Write([]byte(`{"Code":"Success","AccessKeyId":"ASIAEXAMPLE","SecretAccessKey":"secret","Token":"role-token"}`))
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+	defer server.Close()
+	identity, err := GetIdentity(server.Client(), server.URL+"/latest",
+		"https://keymaster.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Document != `{"accountId":"123456789012"}` ||
+		identity.Signature != "c2lnbmF0dXJl" {
+		t.Fatalf("unexpected identity %s %s", identity.Document,
+			identity.Signature)
+	}
+	var request proto.AWSSTSRequest
+	if err := json.Unmarshal([]byte(identity.STSRequest), &request); err != nil {
+		t.Fatal(err)
+	}
+	authorization := request.Headers["Authorization"]
+	if request.Body != stsBody ||
+		request.Headers[proto.AWSAudienceHeader] !=
+			"https://keymaster.example.com" ||
+		request.Headers["X-Amz-Security-Token"] != "role-token" ||
+		!strings.HasPrefix(authorization,
+			"AWS4-HMAC-SHA256 Credential=ASIAEXAMPLE/") ||
+		!strings.Contains(authorization, "x-keymaster-audience") {
+		t.Fatalf("unexpected STS request %+v", request)
+	}
+}
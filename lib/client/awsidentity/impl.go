@@ -0,0 +1,144 @@
+package awsidentity
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+const (
+	metadataTokenHeader    = "X-aws-ec2-metadata-token"
+	metadataTokenTTLHeader = "X-aws-ec2-metadata-token-ttl-seconds"
+	maxResponseLength      = 1 << 20
+	stsBody                = "Action=GetCallerIdentity&Version=2011-06-15"
+	stsRegion              = "us-east-1"
+	stsURL                 = "https://sts.amazonaws.com/"
+)
+
+type roleCredentials struct {
+	Code            string `json:"Code"`
+	AccessKeyId     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	Token           string `json:"Token"`
+}
+
+// getMetadata returns the metadata at path, using the session token if it
+// is not empty and otherwise requesting one.
+func getMetadata(client *http.Client, method, metadataURL, path,
+	token string) (string, error) {
+	req, err := http.NewRequest(method, metadataURL+path, nil)
+	if err != nil {
+		return "", err
+	}
+	if token == "" {
+		req.Header.Set(metadataTokenTTLHeader, "60")
+	} else {
+		req.Header.Set(metadataTokenHeader, token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseLength))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s %s%s: %s", method, metadataURL, path,
+			resp.Status)
+	}
+	return string(body), nil
+}
+
+// getRoleCredentials returns the credentials of the role of the instance.
+func getRoleCredentials(client *http.Client, metadataURL, token string) (
+	*roleCredentials, error) {
+	const path = "/meta-data/iam/security-credentials/"
+	roles, err := getMetadata(client, "GET", metadataURL, path, token)
+	if err != nil {
+		return nil, err
+	}
+	role := strings.TrimSpace(strings.SplitN(roles, "\n", 2)[0])
+	if role == "" {
+		return nil, errors.New("instance has no role")
+	}
+	body, err := getMetadata(client, "GET", metadataURL, path+role, token)
+	if err != nil {
+		return nil, err
+	}
+	var credentials roleCredentials
+	if err := json.Unmarshal([]byte(body), &credentials); err != nil {
+		return nil, fmt.Errorf("cannot parse role credentials: %s", err)
+	}
+	if credentials.Code != "Success" || credentials.AccessKeyId == "" ||
+		credentials.SecretAccessKey == "" {
+		return nil, fmt.Errorf("no credentials for role %s: %s", role,
+			credentials.Code)
+	}
+	return &credentials, nil
+}
+
+// newSTSRequest returns the JSON encoded GetCallerIdentity request for
+// audience signed with credentials.
+func newSTSRequest(credentials *roleCredentials, audience string,
+	now time.Time) (string, error) {
+	req, err := http.NewRequest("POST", stsURL, strings.NewReader(stsBody))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type",
+		"application/x-www-form-urlencoded; charset=utf-8")
+	req.Header.Set(proto.AWSAudienceHeader, audience)
+	signRequest(req, []byte(stsBody), credentials, stsRegion, "sts", now)
+	request := proto.AWSSTSRequest{
+		Headers: make(map[string]string, len(req.Header)),
+		Body:    stsBody,
+	}
+	for name := range req.Header {
+		request.Headers[name] = req.Header.Get(name)
+	}
+	data, err := json.Marshal(request)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func getIdentity(client *http.Client, metadataURL string, audience string,
+	now time.Time) (*Identity, error) {
+	token, err := getMetadata(client, "PUT", metadataURL, "/api/token", "")
+	if err != nil {
+		return nil, err
+	}
+	document, err := getMetadata(client, "GET", metadataURL,
+		"/dynamic/instance-identity/document", token)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := getMetadata(client, "GET", metadataURL,
+		"/dynamic/instance-identity/signature", token)
+	if err != nil {
+		return nil, err
+	}
+	credentials, err := getRoleCredentials(client, metadataURL, token)
+	if err != nil {
+		return nil, err
+	}
+	stsRequest, err := newSTSRequest(credentials, audience, now)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{
+		Document:   document,
+		Signature:  signature,
+		STSRequest: stsRequest,
+	}, nil
+}
@@ -0,0 +1,84 @@
+package awsidentity
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	amzDateFormat = "20060102T150405Z"
+	algorithm     = "AWS4-HMAC-SHA256"
+)
+
+func hashHex(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// getCanonicalRequest returns the canonical request of req with body and
+// the names of the signed headers, which are all headers of req and Host.
+func getCanonicalRequest(req *http.Request, body []byte) (string, string) {
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(
+			strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	return strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hashHex(body),
+	}, "\n"), signedHeaders
+}
+
+// signRequest adds the Signature Version 4 headers signing req with
+// credentials for service in region to it.
+func signRequest(req *http.Request, body []byte, credentials *roleCredentials,
+	region, service string, now time.Time) {
+	amzDate := now.UTC().Format(amzDateFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	if credentials.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", credentials.Token)
+	}
+	canonicalRequest, signedHeaders := getCanonicalRequest(req, body)
+	scopeParts := []string{amzDate[:8], region, service, "aws4_request"}
+	scope := strings.Join(scopeParts, "/")
+	stringToSign := strings.Join([]string{algorithm, amzDate, scope,
+		hashHex([]byte(canonicalRequest))}, "\n")
+	key := []byte("AWS4" + credentials.SecretAccessKey)
+	for _, part := range scopeParts {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"%s Credential=%s/%s, SignedHeaders=%s, Signature=%s", algorithm,
+		credentials.AccessKeyId, scope, signedHeaders,
+		hex.EncodeToString(hmacSHA256(key, stringToSign))))
+}
@@ -0,0 +1,27 @@
+// Package certstore imports client certificates into the certificate store
+// of the operating system, so that browsers and other native programs can
+// use them. The Windows certificate store and the macOS keychain are
+// supported.
+package certstore
+
+import (
+	"crypto"
+	"errors"
+)
+
+// ErrNotSupported is returned on systems without a supported certificate
+// store.
+var ErrNotSupported = errors.New(
+	"certificate store not supported on this system")
+
+// ImportCertificate imports the PEM encoded X.509 certificate certPEM and
+// its private key into the personal store of the current user, removing
+// the earlier certificates with the same subject and issuer. On Windows the
+// key is kept by the Microsoft Software Key Storage Provider under keyName,
+// replacing the earlier key of that name. On macOS the certificate and key
+// are imported into the default keychain with the security command, and
+// the key cannot be exported again. RSA and P-256 ECDSA keys are supported.
+func ImportCertificate(certPEM []byte, privateKey crypto.Signer,
+	keyName string) error {
+	return importCertificate(certPEM, privateKey, keyName)
+}
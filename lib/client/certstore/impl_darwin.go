@@ -0,0 +1,71 @@
+package certstore
+
+import (
+	"crypto"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+func importCertificate(certPEM []byte, privateKey crypto.Signer,
+	keyName string) error {
+	cert, err := parseCertificatePEM(certPEM)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := marshalKeychainPrivateKey(privateKey)
+	if err != nil {
+		return err
+	}
+	deleteKeychainIdentities(cert)
+	dir, err := ioutil.TempDir("", "keymaster-keychain")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	keyFilename := filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(keyFilename, keyPEM, 0600); err != nil {
+		return err
+	}
+	certFilename := filepath.Join(dir, "cert.pem")
+	if err := ioutil.WriteFile(certFilename, certPEM, 0600); err != nil {
+		return err
+	}
+	// The keychain pairs the certificate with its key into an identity.
+	// The key cannot be exported again.
+	err = runSecurity("import", keyFilename, "-t", "priv", "-f", "openssl",
+		"-x")
+	if err != nil {
+		return err
+	}
+	return runSecurity("import", certFilename, "-t", "cert")
+}
+
+// deleteKeychainIdentities removes the identities with the subject and
+// issuer of cert from the default keychain.
+func deleteKeychainIdentities(cert *x509.Certificate) {
+	output, err := exec.Command("security", "find-certificate", "-a", "-c",
+		cert.Subject.CommonName, "-p").Output()
+	if err != nil {
+		// None found.
+		return
+	}
+	for _, hash := range getKeychainCertificateHashes(output, cert) {
+		if runSecurity("delete-identity", "-Z", hash) != nil {
+			runSecurity("delete-certificate", "-Z", hash)
+		}
+	}
+}
+
+func runSecurity(args ...string) error {
+	output, err := exec.Command("security", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("security %s: %s: %s", args[0], err,
+			strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !windows && !darwin
+
+package certstore
+
+import (
+	"crypto"
+)
+
+func importCertificate(certPEM []byte, privateKey crypto.Signer,
+	keyName string) error {
+	return ErrNotSupported
+}
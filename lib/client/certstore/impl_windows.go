@@ -0,0 +1,203 @@
+package certstore
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	msKeyStorageProvider        = "Microsoft Software Key Storage Provider"
+	ncryptOverwriteKeyFlag      = 0x80
+	ncryptBufferPKCSKeyName     = 45
+	x509ASNEncoding             = 0x1
+	pkcs7ASNEncoding            = 0x10000
+	certStoreAddReplaceExisting = 3
+	certKeyProvInfoPropID       = 2
+)
+
+var (
+	ncrypt  = syscall.NewLazyDLL("ncrypt.dll")
+	crypt32 = syscall.NewLazyDLL("crypt32.dll")
+
+	procNCryptOpenStorageProvider = ncrypt.NewProc(
+		"NCryptOpenStorageProvider")
+	procNCryptImportKey  = ncrypt.NewProc("NCryptImportKey")
+	procNCryptFreeObject = ncrypt.NewProc("NCryptFreeObject")
+
+	procCertOpenSystemStore         = crypt32.NewProc("CertOpenSystemStoreW")
+	procCertCloseStore              = crypt32.NewProc("CertCloseStore")
+	procCertEnumCertificatesInStore = crypt32.NewProc(
+		"CertEnumCertificatesInStore")
+	procCertDuplicateCertificateContext = crypt32.NewProc(
+		"CertDuplicateCertificateContext")
+	procCertDeleteCertificateFromStore = crypt32.NewProc(
+		"CertDeleteCertificateFromStore")
+	procCertAddEncodedCertificateToStore = crypt32.NewProc(
+		"CertAddEncodedCertificateToStore")
+	procCertSetCertificateContextProperty = crypt32.NewProc(
+		"CertSetCertificateContextProperty")
+	procCertFreeCertificateContext = crypt32.NewProc(
+		"CertFreeCertificateContext")
+)
+
+// ncryptBuffer and ncryptBufferDesc are NCryptBuffer and NCryptBufferDesc.
+type ncryptBuffer struct {
+	length     uint32
+	bufferType uint32
+	buffer     *uint16
+}
+
+type ncryptBufferDesc struct {
+	version     uint32
+	bufferCount uint32
+	buffers     *ncryptBuffer
+}
+
+// cryptKeyProvInfo is CRYPT_KEY_PROV_INFO.
+type cryptKeyProvInfo struct {
+	containerName  *uint16
+	providerName   *uint16
+	providerType   uint32
+	flags          uint32
+	provParamCount uint32
+	provParams     uintptr
+	keySpec        uint32
+}
+
+// certContext is CERT_CONTEXT.
+type certContext struct {
+	encodingType  uint32
+	encoded       *byte
+	encodedLength uint32
+	certInfo      uintptr
+	store         uintptr
+}
+
+func importCertificate(certPEM []byte, privateKey crypto.Signer,
+	keyName string) error {
+	cert, err := parseCertificatePEM(certPEM)
+	if err != nil {
+		return err
+	}
+	if err := importKey(privateKey, keyName); err != nil {
+		return err
+	}
+	myStore, err := syscall.UTF16PtrFromString("MY")
+	if err != nil {
+		return err
+	}
+	store, _, err := procCertOpenSystemStore.Call(0,
+		uintptr(unsafe.Pointer(myStore)))
+	if store == 0 {
+		return fmt.Errorf("CertOpenSystemStore: %s", err)
+	}
+	defer procCertCloseStore.Call(store, 0)
+	deleteCertificates(store, cert)
+	var context uintptr
+	ret, _, err := procCertAddEncodedCertificateToStore.Call(store,
+		x509ASNEncoding|pkcs7ASNEncoding, uintptr(unsafe.Pointer(&cert.Raw[0])),
+		uintptr(len(cert.Raw)), certStoreAddReplaceExisting,
+		uintptr(unsafe.Pointer(&context)))
+	if ret == 0 {
+		return fmt.Errorf("CertAddEncodedCertificateToStore: %s", err)
+	}
+	defer procCertFreeCertificateContext.Call(context)
+	containerName, err := syscall.UTF16PtrFromString(keyName)
+	if err != nil {
+		return err
+	}
+	providerName, err := syscall.UTF16PtrFromString(msKeyStorageProvider)
+	if err != nil {
+		return err
+	}
+	// The certificate refers to the key by its name in the provider.
+	keyProvInfo := cryptKeyProvInfo{
+		containerName: containerName,
+		providerName:  providerName,
+	}
+	ret, _, err = procCertSetCertificateContextProperty.Call(context,
+		certKeyProvInfoPropID, 0, uintptr(unsafe.Pointer(&keyProvInfo)))
+	runtime.KeepAlive(keyProvInfo)
+	if ret == 0 {
+		return fmt.Errorf("CertSetCertificateContextProperty: %s", err)
+	}
+	return nil
+}
+
+// importKey stores privateKey in the software key storage provider under
+// keyName.
+func importKey(privateKey crypto.Signer, keyName string) error {
+	blobType, blob, err := getKeyBlob(privateKey)
+	if err != nil {
+		return err
+	}
+	providerName, err := syscall.UTF16PtrFromString(msKeyStorageProvider)
+	if err != nil {
+		return err
+	}
+	var provider uintptr
+	status, _, _ := procNCryptOpenStorageProvider.Call(
+		uintptr(unsafe.Pointer(&provider)),
+		uintptr(unsafe.Pointer(providerName)), 0)
+	if status != 0 {
+		return fmt.Errorf("NCryptOpenStorageProvider: 0x%x", status)
+	}
+	defer procNCryptFreeObject.Call(provider)
+	blobTypeName, err := syscall.UTF16PtrFromString(blobType)
+	if err != nil {
+		return err
+	}
+	name, err := syscall.UTF16FromString(keyName)
+	if err != nil {
+		return err
+	}
+	nameBuffer := ncryptBuffer{
+		length:     uint32(len(name) * 2),
+		bufferType: ncryptBufferPKCSKeyName,
+		buffer:     &name[0],
+	}
+	parameters := ncryptBufferDesc{bufferCount: 1, buffers: &nameBuffer}
+	var key uintptr
+	status, _, _ = procNCryptImportKey.Call(provider, 0,
+		uintptr(unsafe.Pointer(blobTypeName)),
+		uintptr(unsafe.Pointer(&parameters)), uintptr(unsafe.Pointer(&key)),
+		uintptr(unsafe.Pointer(&blob[0])), uintptr(len(blob)),
+		ncryptOverwriteKeyFlag)
+	runtime.KeepAlive(name)
+	runtime.KeepAlive(nameBuffer)
+	if status != 0 {
+		return fmt.Errorf("NCryptImportKey: 0x%x", status)
+	}
+	procNCryptFreeObject.Call(key)
+	return nil
+}
+
+// deleteCertificates removes the certificates in store with the subject and
+// issuer of cert.
+func deleteCertificates(store uintptr, cert *x509.Certificate) {
+	var context uintptr
+	for {
+		context, _, _ = procCertEnumCertificatesInStore.Call(store, context)
+		if context == 0 {
+			return
+		}
+		certContext := *(**certContext)(unsafe.Pointer(&context))
+		encoded := unsafe.Slice(certContext.encoded,
+			certContext.encodedLength)
+		oldCert, err := x509.ParseCertificate(encoded)
+		if err != nil ||
+			!bytes.Equal(oldCert.RawSubject, cert.RawSubject) ||
+			!bytes.Equal(oldCert.RawIssuer, cert.RawIssuer) {
+			continue
+		}
+		// Deleting frees the context, so delete a duplicate and
+		// continue the enumeration with the original.
+		duplicate, _, _ := procCertDuplicateCertificateContext.Call(context)
+		procCertDeleteCertificateFromStore.Call(duplicate)
+	}
+}
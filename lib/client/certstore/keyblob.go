@@ -0,0 +1,90 @@
+package certstore
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+// CNG key blob types and magic numbers from bcrypt.h.
+const (
+	bcryptRSAPrivateBlob        = "RSAPRIVATEBLOB"
+	bcryptECCPrivateBlob        = "ECCPRIVATEBLOB"
+	bcryptRSAPrivateMagic       = 0x32415352 // RSA2
+	bcryptECDSAPrivateP256Magic = 0x32534345 // ECS2
+)
+
+func parseCertificatePEM(certPEM []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no PEM encoded certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// getKeyBlob returns the CNG blob type and key blob of privateKey.
+func getKeyBlob(privateKey crypto.Signer) (string, []byte, error) {
+	switch key := privateKey.(type) {
+	case *rsa.PrivateKey:
+		return getRSAKeyBlob(key)
+	case *ecdsa.PrivateKey:
+		return getECDSAKeyBlob(key)
+	}
+	return "", nil, fmt.Errorf("unsupported key type %T", privateKey)
+}
+
+// getRSAKeyBlob encodes key as a BCRYPT_RSAKEY_BLOB header followed by the
+// big-endian public exponent, modulus and primes.
+func getRSAKeyBlob(key *rsa.PrivateKey) (string, []byte, error) {
+	if len(key.Primes) != 2 {
+		return "", nil, errors.New("multi-prime RSA keys are not supported")
+	}
+	publicExponent := bytes.TrimLeft(
+		[]byte{byte(key.E >> 24), byte(key.E >> 16), byte(key.E >> 8),
+			byte(key.E)}, "\x00")
+	modulus := key.N.Bytes()
+	prime1 := key.Primes[0].Bytes()
+	prime2 := key.Primes[1].Bytes()
+	buffer := &bytes.Buffer{}
+	for _, value := range []uint32{
+		bcryptRSAPrivateMagic,
+		uint32(key.N.BitLen()),
+		uint32(len(publicExponent)),
+		uint32(len(modulus)),
+		uint32(len(prime1)),
+		uint32(len(prime2)),
+	} {
+		binary.Write(buffer, binary.LittleEndian, value)
+	}
+	buffer.Write(publicExponent)
+	buffer.Write(modulus)
+	buffer.Write(prime1)
+	buffer.Write(prime2)
+	return bcryptRSAPrivateBlob, buffer.Bytes(), nil
+}
+
+// getECDSAKeyBlob encodes key as a BCRYPT_ECCKEY_BLOB header followed by
+// the X and Y coordinates and the private value, each padded to the size of
+// the curve.
+func getECDSAKeyBlob(key *ecdsa.PrivateKey) (string, []byte, error) {
+	if key.Curve != elliptic.P256() {
+		return "", nil, errors.New("only P-256 ECDSA keys are supported")
+	}
+	const size = 32
+	buffer := &bytes.Buffer{}
+	binary.Write(buffer, binary.LittleEndian, uint32(bcryptECDSAPrivateP256Magic))
+	binary.Write(buffer, binary.LittleEndian, uint32(size))
+	for _, value := range [][]byte{key.X.Bytes(), key.Y.Bytes(),
+		key.D.Bytes()} {
+		buffer.Write(make([]byte, size-len(value)))
+		buffer.Write(value)
+	}
+	return bcryptECCPrivateBlob, buffer.Bytes(), nil
+}
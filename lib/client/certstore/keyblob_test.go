@@ -0,0 +1,75 @@
+package certstore
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"math/big"
+	"testing"
+)
+
+func TestGetRSAKeyBlob(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobType, blob, err := getKeyBlob(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blobType != bcryptRSAPrivateBlob {
+		t.Fatalf("unexpected blob type %s", blobType)
+	}
+	header := make([]uint32, 6)
+	for i := range header {
+		header[i] = binary.LittleEndian.Uint32(blob[i*4:])
+	}
+	if header[0] != bcryptRSAPrivateMagic || header[1] != 2048 ||
+		header[2] != 3 || header[3] != 256 {
+		t.Fatalf("unexpected header %v", header)
+	}
+	if len(blob) != 24+int(header[2]+header[3]+header[4]+header[5]) {
+		t.Fatalf("unexpected blob length %d", len(blob))
+	}
+	modulus := blob[24+header[2] : 24+header[2]+header[3]]
+	if new(big.Int).SetBytes(modulus).Cmp(key.N) != 0 {
+		t.Fatal("modulus does not match")
+	}
+}
+
+func TestGetECDSAKeyBlob(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobType, blob, err := getKeyBlob(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blobType != bcryptECCPrivateBlob || len(blob) != 8+3*32 {
+		t.Fatalf("unexpected blob %s of %d bytes", blobType, len(blob))
+	}
+	if binary.LittleEndian.Uint32(blob) != bcryptECDSAPrivateP256Magic {
+		t.Fatal("unexpected magic")
+	}
+	if new(big.Int).SetBytes(blob[8+64:]).Cmp(key.D) != 0 {
+		t.Fatal("private value does not match")
+	}
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := getKeyBlob(p384Key); err == nil {
+		t.Fatal("P-384 keys should not be supported")
+	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := getKeyBlob(ed25519Key); err == nil {
+		t.Fatal("Ed25519 keys should not be supported")
+	}
+}
@@ -0,0 +1,55 @@
+package certstore
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+)
+
+// getKeychainCertificateHashes returns the upper case hex SHA-1 hashes, as
+// taken by "security delete-identity -Z", of the PEM encoded certificates in
+// findOutput with the subject and issuer of cert.
+func getKeychainCertificateHashes(findOutput []byte,
+	cert *x509.Certificate) []string {
+	var hashes []string
+	for {
+		var block *pem.Block
+		block, findOutput = pem.Decode(findOutput)
+		if block == nil {
+			return hashes
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		oldCert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil ||
+			!bytes.Equal(oldCert.RawSubject, cert.RawSubject) ||
+			!bytes.Equal(oldCert.RawIssuer, cert.RawIssuer) {
+			continue
+		}
+		hashes = append(hashes, fmt.Sprintf("%X", sha1.Sum(oldCert.Raw)))
+	}
+}
+
+// marshalKeychainPrivateKey returns privateKey PEM encoded in the OpenSSL
+// format "security import" reads.
+func marshalKeychainPrivateKey(privateKey crypto.Signer) ([]byte, error) {
+	switch key := privateKey.(type) {
+	case *rsa.PrivateKey:
+		return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(key)}), nil
+	case *ecdsa.PrivateKey:
+		derKey, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY",
+			Bytes: derKey}), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %T", privateKey)
+}
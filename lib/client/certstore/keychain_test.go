@@ -0,0 +1,88 @@
+package certstore
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func makeTestCertificate(t *testing.T, commonName string,
+	serial int64) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	derCert, err := x509.CreateCertificate(rand.Reader, &template, &template,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(derCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestGetKeychainCertificateHashes(t *testing.T) {
+	cert := makeTestCertificate(t, "username", 1)
+	oldCert := makeTestCertificate(t, "username", 2)
+	otherCert := makeTestCertificate(t, "username2", 3)
+	var findOutput []byte
+	for _, c := range []*x509.Certificate{oldCert, otherCert} {
+		findOutput = append(findOutput, pem.EncodeToMemory(
+			&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+	}
+	hashes := getKeychainCertificateHashes(findOutput, cert)
+	expected := fmt.Sprintf("%X", sha1.Sum(oldCert.Raw))
+	if len(hashes) != 1 || hashes[0] != expected {
+		t.Fatalf("expected [%s], got %v", expected, hashes)
+	}
+	if hashes := getKeychainCertificateHashes(nil, cert); len(hashes) > 0 {
+		t.Fatalf("expected no hashes, got %v", hashes)
+	}
+}
+
+func TestMarshalKeychainPrivateKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM, err := marshalKeychainPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil || block.Type != "EC PRIVATE KEY" {
+		t.Fatal("no PEM encoded EC key")
+	}
+	parsedKey, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsedKey.D.Cmp(key.D) != 0 {
+		t.Fatal("private value does not match")
+	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := marshalKeychainPrivateKey(ed25519Key); err == nil {
+		t.Fatal("Ed25519 keys should not be supported")
+	}
+}
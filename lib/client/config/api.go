@@ -2,8 +2,10 @@ package config
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
 )
 
 type BaseConfig struct {
@@ -11,11 +13,30 @@ type BaseConfig struct {
 	Username      string `yaml:"username"`
 	FilePrefix    string `yaml:"file_prefix"`
 	AddGroups     bool   `yaml:"add_groups"`
+	// KeyType is rsa, ecdsa or ed25519, optionally with a size such as
+	// rsa-4096 or ecdsa-p256. KeyBits sets the size of RSA keys.
+	KeyType string `yaml:"key_type"`
+	KeyBits int    `yaml:"key_bits"`
+	// Proxy is the URL of an HTTP or SOCKS5 proxy, replacing the one in
+	// $HTTPS_PROXY. NoProxy lists the hosts reached directly, as $NO_PROXY.
+	Proxy   string `yaml:"proxy"`
+	NoProxy string `yaml:"no_proxy"`
+	// With UseServerConfig the settings served by the server for
+	// Environment (or the default ones) are merged in, see GetServerConfig.
+	UseServerConfig bool   `yaml:"use_server_config"`
+	Environment     string `yaml:"environment"`
+	// AgentRenewBefore and AgentRetryInterval are the defaults of the
+	// -renew-before and -retry-interval flags of the agent commands.
+	AgentRenewBefore   time.Duration `yaml:"agent_renew_before"`
+	AgentRetryInterval time.Duration `yaml:"agent_retry_interval"`
 }
 
 // AppConfigFile represents a keymaster client configuration file
 type AppConfigFile struct {
 	Base BaseConfig
+	// SSHDomains are the host domains sent by the server. They are only set
+	// by MergeServerConfig.
+	SSHDomains []proto.SSHClientDomain `yaml:"-"`
 }
 
 // LoadVerifyConfigFile reads, verifies, and returns the contents of
@@ -34,3 +55,19 @@ func GetConfigFromHost(
 	logger log.Logger) error {
 	return getConfigFromHost(configFilename, hostname, client, logger)
 }
+
+// MergeServerConfig returns local with the settings sent by the server
+// added. The certificate URLs of the server replace the local ones, while
+// the other settings only apply where local leaves them unset.
+func MergeServerConfig(local AppConfigFile,
+	server proto.ClientConfigResponse) AppConfigFile {
+	return mergeServerConfig(local, server)
+}
+
+// GetServerConfig gets the client settings from the servers in local and
+// merges them with MergeServerConfig. The settings are cached in
+// cacheFilename, and the cached ones are used if no server answers.
+func GetServerConfig(local AppConfigFile, cacheFilename string,
+	client *http.Client, logger log.DebugLogger) (AppConfigFile, error) {
+	return getServerConfig(local, cacheFilename, client, logger)
+}
@@ -6,10 +6,13 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/Cloud-Foundations/Dominator/lib/log/testlogger"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
 )
 
 const simpleValidConfigFile = `base:
@@ -118,3 +121,71 @@ func TestGetConfigFromHost(t *testing.T) {
 	//server.netClient = ts.Client()
 	//server.staticConfig.OpenID.TokenURL = ts.URL
 }
+
+func TestMergeServerConfig(t *testing.T) {
+	local := AppConfigFile{Base: BaseConfig{
+		Gen_Cert_URLS:    "https://old.example.com",
+		KeyType:          "rsa-4096",
+		AgentRenewBefore: time.Hour,
+	}}
+	merged := MergeServerConfig(local, proto.ClientConfigResponse{
+		GenCertURLs:               "https://new.example.com",
+		KeyType:                   proto.KeyTypeEd25519,
+		AgentRenewBeforeSeconds:   7200,
+		AgentRetryIntervalSeconds: 60,
+		SSHDomains: []proto.SSHClientDomain{
+			{HostPatterns: []string{"*.example.com"}},
+		},
+	})
+	if merged.Base.Gen_Cert_URLS != "https://new.example.com" ||
+		merged.Base.KeyType != "rsa-4096" ||
+		merged.Base.AgentRenewBefore != time.Hour ||
+		merged.Base.AgentRetryInterval != time.Minute ||
+		len(merged.SSHDomains) != 1 {
+		t.Fatalf("unexpected config %+v", merged)
+	}
+}
+
+func TestGetServerConfig(t *testing.T) {
+	var available bool
+	ts := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if !available || r.URL.Path != proto.ClientConfigPath ||
+				r.URL.Query().Get("environment") != "staging" {
+				http.NotFound(w, r)
+				return
+			}
+			fmt.Fprint(w, `{"key_type": "ed25519"}`)
+		}))
+	defer ts.Close()
+	dir, err := ioutil.TempDir("", "test_getServerConfig_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cacheFilename := filepath.Join(dir, "server-config.json")
+	local := AppConfigFile{Base: BaseConfig{Gen_Cert_URLS: ts.URL,
+		Environment: "staging"}}
+	logger := testlogger.New(t)
+	if _, err := GetServerConfig(local, cacheFilename, ts.Client(),
+		logger); err == nil {
+		t.Fatal("no settings expected")
+	}
+	available = true
+	merged, err := GetServerConfig(local, cacheFilename, ts.Client(), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged.Base.KeyType != proto.KeyTypeEd25519 {
+		t.Fatalf("unexpected config %+v", merged)
+	}
+	// The cached settings are used while the server has none.
+	available = false
+	merged, err = GetServerConfig(local, cacheFilename, ts.Client(), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged.Base.KeyType != proto.KeyTypeEd25519 {
+		t.Fatalf("unexpected config %+v", merged)
+	}
+}
@@ -0,0 +1,105 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+const maxServerConfigSize = 64 << 10
+
+func mergeServerConfig(local AppConfigFile,
+	server proto.ClientConfigResponse) AppConfigFile {
+	merged := local
+	if server.GenCertURLs != "" {
+		merged.Base.Gen_Cert_URLS = server.GenCertURLs
+	}
+	if merged.Base.KeyType == "" && merged.Base.KeyBits == 0 {
+		merged.Base.KeyType = server.KeyType
+		merged.Base.KeyBits = server.KeyBits
+	}
+	if server.AddGroups {
+		merged.Base.AddGroups = true
+	}
+	if merged.Base.AgentRenewBefore == 0 {
+		merged.Base.AgentRenewBefore =
+			time.Duration(server.AgentRenewBeforeSeconds) * time.Second
+	}
+	if merged.Base.AgentRetryInterval == 0 {
+		merged.Base.AgentRetryInterval =
+			time.Duration(server.AgentRetryIntervalSeconds) * time.Second
+	}
+	merged.SSHDomains = server.SSHDomains
+	return merged
+}
+
+func fetchServerConfig(baseURL string, environment string,
+	client *http.Client) ([]byte, error) {
+	target := strings.TrimSuffix(baseURL, "/") + proto.ClientConfigPath
+	if environment != "" {
+		target += "?" + url.Values{"environment": {environment}}.Encode()
+	}
+	resp, err := client.Get(target)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", target, resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body,
+		maxServerConfigSize))
+	if err != nil {
+		return nil, err
+	}
+	var response proto.ClientConfigResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("%s: %s", target, err)
+	}
+	return body, nil
+}
+
+func getServerConfig(local AppConfigFile, cacheFilename string,
+	client *http.Client, logger log.DebugLogger) (AppConfigFile, error) {
+	var data []byte
+	var err error
+	for _, baseURL := range strings.Split(local.Base.Gen_Cert_URLS, ",") {
+		data, err = fetchServerConfig(baseURL, local.Base.Environment,
+			client)
+		if err == nil {
+			break
+		}
+		logger.Debugf(1, "cannot get client settings from %s: %s", baseURL,
+			err)
+	}
+	if err == nil {
+		if err := ioutil.WriteFile(cacheFilename, data, 0644); err != nil {
+			logger.Printf("cannot cache client settings: %s", err)
+		}
+	} else {
+		var cacheErr error
+		data, cacheErr = ioutil.ReadFile(cacheFilename)
+		if cacheErr != nil {
+			if os.IsNotExist(cacheErr) {
+				return local, err
+			}
+			return local, cacheErr
+		}
+		logger.Debugf(0, "using the cached client settings in %s",
+			cacheFilename)
+	}
+	var response proto.ClientConfigResponse
+	if err := json.Unmarshal(data, &response); err != nil {
+		return local, fmt.Errorf("%s: %s", cacheFilename, err)
+	}
+	return mergeServerConfig(local, response), nil
+}
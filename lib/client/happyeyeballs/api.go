@@ -0,0 +1,59 @@
+// Package happyeyeballs implements a dialer which races connection attempts
+// to the addresses of a host, as described in RFC 8305, so that a server
+// address which does not answer only delays the connection by the attempt
+// delay.
+package happyeyeballs
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+)
+
+const (
+	// DefaultAttemptDelay is the default delay before the next address is
+	// tried while earlier attempts are still running.
+	DefaultAttemptDelay = 250 * time.Millisecond
+	// DefaultAttemptTimeout is the default timeout of each attempt.
+	DefaultAttemptTimeout = 2 * time.Second
+)
+
+// Config sets the timing of connection attempts. Zero values select the
+// defaults.
+type Config struct {
+	AttemptDelay   time.Duration
+	AttemptTimeout time.Duration
+}
+
+// Dialer implements the lib/client/net.Dialer interface. The Timeout of the
+// underlying dialer limits the whole dial, including the DNS lookup.
+type Dialer struct {
+	dialer *net.Dialer
+	config Config
+	logger log.DebugLogger
+	// Replaced by tests.
+	dial         func(ctx context.Context, network, address string) (net.Conn, error)
+	lookupIPAddr func(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// New returns a Dialer making its attempts with dialer.
+func New(dialer *net.Dialer, config Config, logger log.DebugLogger) *Dialer {
+	return newDialer(dialer, config, logger)
+}
+
+// Dial connects to address on the named network.
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.dialContext(context.Background(), network, address)
+}
+
+// DialContext connects to address on the named network using ctx. Host
+// names are resolved and their addresses are tried alternating between
+// the address families, starting with the first address returned. The
+// next address is tried once the previous attempt fails or after the
+// attempt delay, and the first connection made is returned.
+func (d *Dialer) DialContext(ctx context.Context, network,
+	address string) (net.Conn, error) {
+	return d.dialContext(ctx, network, address)
+}
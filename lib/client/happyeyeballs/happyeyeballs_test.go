@@ -0,0 +1,139 @@
+package happyeyeballs
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log/testlogger"
+)
+
+func parseAddrs(addresses ...string) []net.IPAddr {
+	addrs := make([]net.IPAddr, 0, len(addresses))
+	for _, address := range addresses {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(address)})
+	}
+	return addrs
+}
+
+func TestSortAddresses(t *testing.T) {
+	addrs := parseAddrs("2001:db8::1", "2001:db8::2", "192.0.2.1",
+		"2001:db8::3", "192.0.2.2")
+	var sorted []string
+	for _, ip := range sortAddresses(addrs, "tcp") {
+		sorted = append(sorted, ip.String())
+	}
+	expected := []string{"2001:db8::1", "192.0.2.1", "2001:db8::2",
+		"192.0.2.2", "2001:db8::3"}
+	if !reflect.DeepEqual(sorted, expected) {
+		t.Fatalf("got %v, expected %v", sorted, expected)
+	}
+	if ips := sortAddresses(addrs, "tcp4"); len(ips) != 2 ||
+		!isIPv4(ips[0]) || !isIPv4(ips[1]) {
+		t.Fatalf("unexpected tcp4 addresses: %v", ips)
+	}
+}
+
+// testDialer returns a Dialer for a host with addresses. Attempts to
+// blackholed addresses hang until they are cancelled, and the others
+// connect to listener. The attempted addresses are recorded.
+func testDialer(t *testing.T, listener net.Listener, addresses []string,
+	blackholed map[string]bool) (*Dialer, *[]string) {
+	dialer := New(&net.Dialer{}, Config{
+		AttemptDelay:   20 * time.Millisecond,
+		AttemptTimeout: time.Second,
+	}, testlogger.New(t))
+	dialer.lookupIPAddr = func(ctx context.Context,
+		host string) ([]net.IPAddr, error) {
+		return parseAddrs(addresses...), nil
+	}
+	var mutex sync.Mutex
+	var attempts []string
+	dialer.dial = func(ctx context.Context, network,
+		address string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		mutex.Lock()
+		attempts = append(attempts, host)
+		mutex.Unlock()
+		if blackholed[host] {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		if listener == nil {
+			return nil, errors.New("connection refused")
+		}
+		return net.Dial("tcp", listener.Addr().String())
+	}
+	return dialer, &attempts
+}
+
+func TestDialSkipsBlackholedAddress(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	dialer, attempts := testDialer(t, listener,
+		[]string{"192.0.2.1", "192.0.2.2"}, map[string]bool{"192.0.2.1": true})
+	start := time.Now()
+	conn, err := dialer.DialContext(context.Background(), "tcp",
+		"keymaster.example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("dial took %s", elapsed)
+	}
+	if len(*attempts) != 2 {
+		t.Fatalf("unexpected attempts: %v", *attempts)
+	}
+}
+
+func TestDialNextAfterFailure(t *testing.T) {
+	dialer, attempts := testDialer(t, nil,
+		[]string{"192.0.2.1", "192.0.2.2", "192.0.2.3"},
+		map[string]bool{"192.0.2.3": true})
+	dialer.config.AttemptDelay = time.Hour
+	dialer.config.AttemptTimeout = 50 * time.Millisecond
+	start := time.Now()
+	if _, err := dialer.Dial("tcp", "keymaster.example.com:443"); err == nil {
+		t.Fatal("dial should fail")
+	} else if err.Error() != "connection refused" {
+		t.Fatalf("first error not returned: %s", err)
+	}
+	// Failed attempts start the next one without waiting for the delay and
+	// the hung attempt is given up after the attempt timeout.
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("dial took %s", elapsed)
+	}
+	if len(*attempts) != 3 {
+		t.Fatalf("unexpected attempts: %v", *attempts)
+	}
+}
+
+func TestDialAddress(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	dialer := New(&net.Dialer{}, Config{}, testlogger.New(t))
+	dialer.lookupIPAddr = func(ctx context.Context,
+		host string) ([]net.IPAddr, error) {
+		t.Fatal("addresses should not be looked up")
+		return nil, nil
+	}
+	conn, err := dialer.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,174 @@
+package happyeyeballs
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+)
+
+type dialResult struct {
+	conn    net.Conn
+	address string
+	err     error
+}
+
+func newDialer(dialer *net.Dialer, config Config,
+	logger log.DebugLogger) *Dialer {
+	if config.AttemptDelay <= 0 {
+		config.AttemptDelay = DefaultAttemptDelay
+	}
+	if config.AttemptTimeout <= 0 {
+		config.AttemptTimeout = DefaultAttemptTimeout
+	}
+	resolver := dialer.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return &Dialer{
+		dialer:       dialer,
+		config:       config,
+		logger:       logger,
+		dial:         dialer.DialContext,
+		lookupIPAddr: resolver.LookupIPAddr,
+	}
+}
+
+func isIPv4(ip net.IP) bool {
+	return ip.To4() != nil
+}
+
+// sortAddresses returns the addresses usable on network, alternating between
+// the families and starting with the family of the first one (RFC 8305,
+// section 4).
+func sortAddresses(addrs []net.IPAddr, network string) []net.IP {
+	var first, second []net.IP
+	for _, addr := range addrs {
+		switch {
+		case network == "tcp4" && !isIPv4(addr.IP):
+			continue
+		case network == "tcp6" && isIPv4(addr.IP):
+			continue
+		}
+		if len(first) == 0 || isIPv4(addr.IP) == isIPv4(first[0]) {
+			first = append(first, addr.IP)
+		} else {
+			second = append(second, addr.IP)
+		}
+	}
+	ips := make([]net.IP, 0, len(first)+len(second))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			ips = append(ips, first[i])
+		}
+		if i < len(second) {
+			ips = append(ips, second[i])
+		}
+	}
+	return ips
+}
+
+func (d *Dialer) dialContext(ctx context.Context, network,
+	address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return d.dial(ctx, network, address)
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return d.dial(ctx, network, address)
+	}
+	if d.dialer.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.dialer.Timeout)
+		defer cancel()
+	}
+	addrs, err := d.lookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := sortAddresses(addrs, network)
+	if len(ips) == 0 {
+		return nil, &net.AddrError{Err: "no suitable address found",
+			Addr: host}
+	}
+	conn, err := d.race(ctx, network, ips, port)
+	if err != nil {
+		return nil, err
+	}
+	d.logger.Debugf(1, "connected to %s (%s)\n", address,
+		conn.RemoteAddr())
+	return conn, nil
+}
+
+// race starts an attempt for each of ips in turn and returns the first
+// connection made. Later connections are closed.
+func (d *Dialer) race(ctx context.Context, network string, ips []net.IP,
+	port string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialResult, len(ips))
+	timer := time.NewTimer(d.config.AttemptDelay)
+	defer timer.Stop()
+	next, running := 0, 0
+	startNext := func() {
+		address := net.JoinHostPort(ips[next].String(), port)
+		next++
+		running++
+		go func() {
+			attemptCtx, attemptCancel := context.WithTimeout(ctx,
+				d.config.AttemptTimeout)
+			defer attemptCancel()
+			conn, err := d.dial(attemptCtx, network, address)
+			results <- dialResult{conn: conn, address: address, err: err}
+		}()
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(d.config.AttemptDelay)
+	}
+	startNext()
+	var firstErr error
+	for running > 0 {
+		var timerChannel <-chan time.Time
+		if next < len(ips) {
+			timerChannel = timer.C
+		}
+		select {
+		case <-timerChannel:
+			startNext()
+		case result := <-results:
+			running--
+			if result.err == nil {
+				go closeConnections(results, running)
+				return result.conn, nil
+			}
+			d.logger.Debugf(2, "error connecting to %s: %s\n",
+				result.address, result.err)
+			if firstErr == nil {
+				firstErr = result.err
+			}
+			if next < len(ips) {
+				startNext()
+			}
+		}
+	}
+	return nil, firstErr
+}
+
+// closeConnections closes the connections of the count remaining attempts.
+func closeConnections(results <-chan dialResult, count int) {
+	for ; count > 0; count-- {
+		if result := <-results; result.conn != nil {
+			result.conn.Close()
+		}
+	}
+}
@@ -0,0 +1,42 @@
+// Package keypool pre-generates RSA keys using a bounded pool of workers so
+// that callers issuing many certificates do not wait on serial key
+// generation.
+package keypool
+
+import (
+	"crypto/rsa"
+	"errors"
+	"sync"
+)
+
+// ErrClosed is returned by Get once the Pool has been closed.
+var ErrClosed = errors.New("key pool closed")
+
+// Pool holds keys generated ahead of use. Each key is handed out only once.
+type Pool struct {
+	generate func() (*rsa.PrivateKey, error)
+	keys     chan keyResult
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// New starts numWorkers workers generating RSA keys of keySize bits. Up to
+// bufferSize keys are kept ready. Close must be called to stop the workers.
+func New(numWorkers int, bufferSize int, keySize int) *Pool {
+	return newPool(numWorkers, bufferSize, func() (*rsa.PrivateKey, error) {
+		return generateKey(keySize)
+	})
+}
+
+// Get returns a ready key, waiting for one to be generated if necessary.
+// It returns ErrClosed if the Pool is closed.
+func (p *Pool) Get() (*rsa.PrivateKey, error) {
+	return p.get()
+}
+
+// Close stops the workers and waits for them to exit. Keys not yet handed
+// out are discarded. It is safe to call Close more than once.
+func (p *Pool) Close() {
+	p.close()
+}
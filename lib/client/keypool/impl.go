@@ -0,0 +1,71 @@
+package keypool
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+)
+
+type keyResult struct {
+	key *rsa.PrivateKey
+	err error
+}
+
+func generateKey(keySize int) (*rsa.PrivateKey, error) {
+	return rsa.GenerateKey(rand.Reader, keySize)
+}
+
+func newPool(numWorkers int, bufferSize int,
+	generate func() (*rsa.PrivateKey, error)) *Pool {
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+	if bufferSize < 0 {
+		bufferSize = 0
+	}
+	p := &Pool{
+		generate: generate,
+		keys:     make(chan keyResult, bufferSize),
+		stop:     make(chan struct{}),
+	}
+	p.wg.Add(numWorkers)
+	for i := 0; i < numWorkers; i++ {
+		go p.worker()
+	}
+	return p
+}
+
+func (p *Pool) worker() {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-p.stop:
+			return
+		default:
+		}
+		key, err := p.generate()
+		select {
+		case p.keys <- keyResult{key: key, err: err}:
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+func (p *Pool) get() (*rsa.PrivateKey, error) {
+	select {
+	case <-p.stop:
+		return nil, ErrClosed
+	default:
+	}
+	select {
+	case result := <-p.keys:
+		return result.key, result.err
+	case <-p.stop:
+		return nil, ErrClosed
+	}
+}
+
+func (p *Pool) close() {
+	p.stopOnce.Do(func() { close(p.stop) })
+	p.wg.Wait()
+}
@@ -0,0 +1,94 @@
+package keypool
+
+import (
+	"crypto/rsa"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testKeySize = 1024
+
+func TestKeysAreDistinct(t *testing.T) {
+	pool := New(4, 4, testKeySize)
+	defer pool.Close()
+	const numKeys = 16
+	seen := make(map[string]struct{})
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	wg.Add(numKeys)
+	for i := 0; i < numKeys; i++ {
+		go func() {
+			defer wg.Done()
+			key, err := pool.Get()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			modulus := key.N.String()
+			if _, ok := seen[modulus]; ok {
+				t.Error("duplicate key issued")
+			}
+			seen[modulus] = struct{}{}
+		}()
+	}
+	wg.Wait()
+	if len(seen) != numKeys {
+		t.Fatalf("expected %d keys, got %d", numKeys, len(seen))
+	}
+}
+
+func slowGenerator(delay time.Duration) func() (*rsa.PrivateKey, error) {
+	return func() (*rsa.PrivateKey, error) {
+		time.Sleep(delay)
+		return &rsa.PrivateKey{}, nil
+	}
+}
+
+func timeKeys(t *testing.T, numWorkers int, numKeys int,
+	delay time.Duration) time.Duration {
+	pool := newPool(numWorkers, 0, slowGenerator(delay))
+	defer pool.Close()
+	startTime := time.Now()
+	for i := 0; i < numKeys; i++ {
+		if _, err := pool.Get(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return time.Since(startTime)
+}
+
+func TestConcurrentGenerationIncreasesThroughput(t *testing.T) {
+	const numKeys = 16
+	const delay = 20 * time.Millisecond
+	serial := timeKeys(t, 1, numKeys, delay)
+	concurrent := timeKeys(t, 4, numKeys, delay)
+	t.Logf("serial=%s concurrent=%s", serial, concurrent)
+	if concurrent*2 > serial {
+		t.Fatalf("concurrent generation not faster: serial=%s concurrent=%s",
+			serial, concurrent)
+	}
+}
+
+func TestCloseStopsWorkers(t *testing.T) {
+	pool := newPool(2, 1, slowGenerator(time.Millisecond))
+	if _, err := pool.Get(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		pool.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Close did not return")
+	}
+	if _, err := pool.Get(); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+	pool.Close()
+}
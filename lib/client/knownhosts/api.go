@@ -0,0 +1,29 @@
+// Package knownhosts maintains @cert-authority lines in OpenSSH known_hosts
+// files.
+package knownhosts
+
+import (
+	"golang.org/x/crypto/ssh"
+)
+
+// CertAuthorityLine returns a known_hosts line which trusts key to sign the
+// host certificates of the hosts matching hostPattern (a comma separated list
+// of patterns as understood by ssh). The comment identifies the line, so it
+// must be a single word.
+func CertAuthorityLine(hostPattern string, key ssh.PublicKey,
+	comment string) string {
+	return certAuthorityLine(hostPattern, key, comment)
+}
+
+// Upsert replaces the @cert-authority lines of contents with the comment of
+// line by line, or appends line if there are none. Other lines are kept. It
+// returns the new contents and whether they differ from contents.
+func Upsert(contents []byte, line string) ([]byte, bool) {
+	return upsert(contents, line)
+}
+
+// UpsertFile is like Upsert, but updates the file filename, which is created
+// with mode 0644 if it does not exist. The file is replaced atomically.
+func UpsertFile(filename string, line string) (bool, error) {
+	return upsertFile(filename, line)
+}
@@ -0,0 +1,92 @@
+package knownhosts
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const certAuthorityMarker = "@cert-authority"
+
+func certAuthorityLine(hostPattern string, key ssh.PublicKey,
+	comment string) string {
+	return strings.Join([]string{certAuthorityMarker, hostPattern,
+		strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))), comment},
+		" ")
+}
+
+// getCertAuthorityComment returns the comment of line if it is an
+// @cert-authority line, and otherwise "".
+func getCertAuthorityComment(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) < 5 || fields[0] != certAuthorityMarker {
+		return ""
+	}
+	return fields[len(fields)-1]
+}
+
+func upsert(contents []byte, line string) ([]byte, bool) {
+	comment := getCertAuthorityComment(line)
+	var output bytes.Buffer
+	found := false
+	for _, oldLine := range strings.SplitAfter(string(contents), "\n") {
+		if oldLine == "" {
+			continue
+		}
+		if comment == "" || getCertAuthorityComment(oldLine) != comment {
+			output.WriteString(oldLine)
+			if !strings.HasSuffix(oldLine, "\n") {
+				output.WriteString("\n")
+			}
+			continue
+		}
+		if !found {
+			output.WriteString(line + "\n")
+			found = true
+		}
+	}
+	if !found {
+		output.WriteString(line + "\n")
+	}
+	return output.Bytes(), !bytes.Equal(output.Bytes(), contents)
+}
+
+func upsertFile(filename string, line string) (bool, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(filename); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	newContents, changed := upsert(contents, line)
+	if !changed {
+		return false, nil
+	}
+	dir := filepath.Dir(filename)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return false, err
+	}
+	file, err := ioutil.TempFile(dir, filepath.Base(filename)+".tmp")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(newContents); err != nil {
+		file.Close()
+		return false, err
+	}
+	if err := file.Chmod(mode); err != nil {
+		file.Close()
+		return false, err
+	}
+	if err := file.Close(); err != nil {
+		return false, err
+	}
+	return true, os.Rename(file.Name(), filename)
+}
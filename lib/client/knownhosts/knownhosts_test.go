@@ -0,0 +1,83 @@
+package knownhosts
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestKey(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestUpsert(t *testing.T) {
+	oldLine := CertAuthorityLine("*", newTestKey(t), "keymaster:example.com")
+	newLine := CertAuthorityLine("*.example.com", newTestKey(t),
+		"keymaster:example.com")
+	otherLine := CertAuthorityLine("*", newTestKey(t), "keymaster:other.com")
+	hostLine := "host.example.com ssh-ed25519 AAAA"
+	contents, changed := Upsert([]byte(hostLine), oldLine)
+	if !changed {
+		t.Fatal("appending did not change the contents")
+	}
+	if string(contents) != hostLine+"\n"+oldLine+"\n" {
+		t.Fatalf("unexpected contents: %q", contents)
+	}
+	if _, changed := Upsert(contents, oldLine); changed {
+		t.Fatal("the same line changed the contents")
+	}
+	contents = append(contents, otherLine+"\n"...)
+	contents, changed = Upsert(contents, newLine)
+	if !changed {
+		t.Fatal("replacing did not change the contents")
+	}
+	expected := hostLine + "\n" + newLine + "\n" + otherLine + "\n"
+	if string(contents) != expected {
+		t.Fatalf("unexpected contents: %q", contents)
+	}
+	// Duplicates are dropped.
+	contents, _ = Upsert([]byte(oldLine+"\n"+oldLine+"\n"), newLine)
+	if string(contents) != newLine+"\n" {
+		t.Fatalf("unexpected contents: %q", contents)
+	}
+}
+
+func TestUpsertFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "knownhosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, ".ssh", "known_hosts")
+	line := CertAuthorityLine("*", newTestKey(t), "keymaster:example.com")
+	if changed, err := UpsertFile(filename, line); err != nil {
+		t.Fatal(err)
+	} else if !changed {
+		t.Fatal("new file not changed")
+	}
+	if changed, err := UpsertFile(filename, line); err != nil {
+		t.Fatal(err)
+	} else if changed {
+		t.Fatal("file changed again")
+	}
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != line+"\n" {
+		t.Fatalf("unexpected contents: %q", contents)
+	}
+}
@@ -0,0 +1,79 @@
+// Package piv uses a key in the PIV applet of a YubiKey as the key to
+// certify. The key never leaves the YubiKey, which attests that it
+// generated it; the attestation is sent with the certificate requests so
+// that servers can require hardware keys.
+package piv
+
+import (
+	"crypto"
+	"io"
+	"sync"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"github.com/go-piv/piv-go/piv"
+)
+
+// Slots which may hold the key.
+const (
+	SlotAuthentication     = "9a"
+	SlotCardAuthentication = "9e"
+)
+
+type Config struct {
+	// Card selects the smart card whose name contains it. If empty, the
+	// first YubiKey is used.
+	Card string
+	// Slot is SlotAuthentication or SlotCardAuthentication.
+	Slot string
+	// If Generate is true a P-256 ECDSA key is generated in Slot if it
+	// holds no attestable key.
+	Generate bool
+	// TouchPolicy of generated keys: "never", "always" or "cached" (the
+	// default).
+	TouchPolicy string
+	// ManagementKey is the hex encoded management key, needed to generate
+	// keys. If empty, the default key is used.
+	ManagementKey string
+	// PIN unlocks the key. If empty, it is asked for when needed.
+	PIN string
+}
+
+// Key is a key in a PIV slot. It is safe for concurrent use.
+type Key struct {
+	logger      log.DebugLogger
+	slot        piv.Slot
+	pin         string
+	mutex       sync.Mutex
+	yubikey     *piv.YubiKey
+	publicKey   crypto.PublicKey
+	attestation string
+	privateKey  crypto.Signer // Opened when first needed.
+}
+
+// Open opens the YubiKey and the key in the slot of config, generating it
+// if requested.
+func Open(config Config, logger log.DebugLogger) (*Key, error) {
+	return openKey(config, logger)
+}
+
+// AttestationHeader returns the proto.PIVAttestationHeader value attesting
+// the key.
+func (k *Key) AttestationHeader() string {
+	return k.attestation
+}
+
+// Close releases the YubiKey.
+func (k *Key) Close() error {
+	return k.close()
+}
+
+// Public returns the public key.
+func (k *Key) Public() crypto.PublicKey {
+	return k.publicKey
+}
+
+// Sign signs digest with the key, asking for the PIN if needed.
+func (k *Key) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) (
+	[]byte, error) {
+	return k.sign(rand, digest, opts)
+}
@@ -0,0 +1,195 @@
+package piv
+
+import (
+	"crypto"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"github.com/Cloud-Foundations/keymaster/lib/pivattest"
+	"github.com/go-piv/piv-go/piv"
+	"github.com/howeyc/gopass"
+)
+
+var (
+	slots = map[string]piv.Slot{
+		SlotAuthentication:     piv.SlotAuthentication,
+		SlotCardAuthentication: piv.SlotCardAuthentication,
+	}
+	touchPolicies = map[string]piv.TouchPolicy{
+		"":       piv.TouchPolicyCached,
+		"never":  piv.TouchPolicyNever,
+		"always": piv.TouchPolicyAlways,
+		"cached": piv.TouchPolicyCached,
+	}
+)
+
+// readPIN is replaced in tests.
+var readPIN = func() (string, error) {
+	fmt.Printf("YubiKey PIN: ")
+	pin, err := gopass.GetPasswd()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(pin)), nil
+}
+
+// findCard returns the first card whose name contains name, or the first
+// YubiKey if name is empty.
+func findCard(name string) (string, error) {
+	cards, err := piv.Cards()
+	if err != nil {
+		return "", err
+	}
+	for _, card := range cards {
+		if name != "" && strings.Contains(card, name) {
+			return card, nil
+		}
+		if name == "" && strings.Contains(strings.ToLower(card), "yubikey") {
+			return card, nil
+		}
+	}
+	if name == "" {
+		return "", errors.New("no YubiKey found")
+	}
+	return "", fmt.Errorf("no smart card matching %q found", name)
+}
+
+func parseManagementKey(value string) ([24]byte, error) {
+	if value == "" {
+		return piv.DefaultManagementKey, nil
+	}
+	var key [24]byte
+	decoded, err := hex.DecodeString(value)
+	if err != nil {
+		return key, fmt.Errorf("cannot decode management key: %s", err)
+	}
+	if len(decoded) != len(key) {
+		return key, fmt.Errorf("management key must be %d bytes", len(key))
+	}
+	copy(key[:], decoded)
+	return key, nil
+}
+
+// generate generates the key of slot. The card authentication slot is
+// meant to be used without a PIN.
+func generate(yubikey *piv.YubiKey, slot piv.Slot, config Config) error {
+	touchPolicy, ok := touchPolicies[config.TouchPolicy]
+	if !ok {
+		return fmt.Errorf("unknown touch policy: %s", config.TouchPolicy)
+	}
+	managementKey, err := parseManagementKey(config.ManagementKey)
+	if err != nil {
+		return err
+	}
+	pinPolicy := piv.PINPolicyOnce
+	if slot == piv.SlotCardAuthentication {
+		pinPolicy = piv.PINPolicyNever
+	}
+	_, err = yubikey.GenerateKey(managementKey, slot, piv.Key{
+		Algorithm:   piv.AlgorithmEC256,
+		PINPolicy:   pinPolicy,
+		TouchPolicy: touchPolicy,
+	})
+	return err
+}
+
+func openKey(config Config, logger log.DebugLogger) (*Key, error) {
+	slot, ok := slots[config.Slot]
+	if !ok {
+		return nil, fmt.Errorf("unsupported PIV slot: %s (use %s or %s)",
+			config.Slot, SlotAuthentication, SlotCardAuthentication)
+	}
+	card, err := findCard(config.Card)
+	if err != nil {
+		return nil, err
+	}
+	yubikey, err := piv.Open(card)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %s: %s", card, err)
+	}
+	key, err := loadKey(yubikey, slot, config, logger)
+	if err != nil {
+		yubikey.Close()
+		return nil, err
+	}
+	logger.Debugf(0, "using key in slot %s of %s", config.Slot, card)
+	return key, nil
+}
+
+func loadKey(yubikey *piv.YubiKey, slot piv.Slot, config Config,
+	logger log.DebugLogger) (*Key, error) {
+	// Only keys generated in the YubiKey can be attested, which also
+	// returns their public key.
+	slotCert, err := yubikey.Attest(slot)
+	if err != nil {
+		if !config.Generate {
+			return nil, fmt.Errorf("cannot attest the key in slot %s: %s",
+				config.Slot, err)
+		}
+		logger.Printf("Generating a key in PIV slot %s", config.Slot)
+		if err := generate(yubikey, slot, config); err != nil {
+			return nil, fmt.Errorf("cannot generate key: %s", err)
+		}
+		if slotCert, err = yubikey.Attest(slot); err != nil {
+			return nil, fmt.Errorf("cannot attest the generated key: %s",
+				err)
+		}
+	}
+	attestationCert, err := yubikey.AttestationCertificate()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read attestation certificate: %s",
+			err)
+	}
+	return &Key{
+		logger:      logger,
+		slot:        slot,
+		pin:         config.PIN,
+		yubikey:     yubikey,
+		publicKey:   slotCert.PublicKey,
+		attestation: pivattest.Header(slotCert.Raw, attestationCert.Raw),
+	}, nil
+}
+
+func (k *Key) close() error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.yubikey == nil {
+		return nil
+	}
+	err := k.yubikey.Close()
+	k.yubikey = nil
+	return err
+}
+
+func (k *Key) getPIN() (string, error) {
+	if k.pin != "" {
+		return k.pin, nil
+	}
+	return readPIN()
+}
+
+func (k *Key) sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) (
+	[]byte, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.yubikey == nil {
+		return nil, errors.New("YubiKey is closed")
+	}
+	if k.privateKey == nil {
+		privateKey, err := k.yubikey.PrivateKey(k.slot, k.publicKey,
+			piv.KeyAuth{PINPrompt: k.getPIN})
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := privateKey.(crypto.Signer)
+		if !ok {
+			return nil, errors.New("PIV key cannot sign")
+		}
+		k.privateKey = signer
+	}
+	return k.privateKey.Sign(rand, digest, opts)
+}
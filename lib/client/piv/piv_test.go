@@ -0,0 +1,38 @@
+package piv
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log/testlogger"
+	"github.com/go-piv/piv-go/piv"
+)
+
+func TestParseManagementKey(t *testing.T) {
+	key, err := parseManagementKey("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != piv.DefaultManagementKey {
+		t.Fatal("empty management key is not the default key")
+	}
+	hexKey := strings.Repeat("0102030405060708", 3)
+	key, err = parseManagementKey(hexKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key[0] != 1 || key[23] != 8 {
+		t.Fatalf("unexpected key %x", key)
+	}
+	for _, value := range []string{"010203", "junk", hexKey + "00"} {
+		if _, err := parseManagementKey(value); err == nil {
+			t.Errorf("%s accepted", value)
+		}
+	}
+}
+
+func TestOpenUnsupportedSlot(t *testing.T) {
+	if _, err := Open(Config{Slot: "9c"}, testlogger.New(t)); err == nil {
+		t.Fatal("signature slot accepted")
+	}
+}
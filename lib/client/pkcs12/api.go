@@ -0,0 +1,18 @@
+// Package pkcs12 encodes client certificates and their keys as PKCS#12
+// files, which browsers and VPN clients can import.
+package pkcs12
+
+import (
+	"crypto"
+)
+
+// Encode returns a PKCS#12 file holding privateKey and the PEM encoded
+// certificates in certPEM, the first of which must be the certificate of
+// privateKey and the rest its chain. The key and certificates are encrypted
+// with AES-256-CBC keyed from password with PBKDF2 (PBES2) and the file is
+// authenticated with HMAC-SHA256, which OpenSSL 1.1.1, Java 12, Windows
+// Server 2019 and later versions import.
+func Encode(certPEM []byte, privateKey crypto.Signer,
+	password string) ([]byte, error) {
+	return encode(certPEM, privateKey, password)
+}
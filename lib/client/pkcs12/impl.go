@@ -0,0 +1,42 @@
+package pkcs12
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+
+	gopkcs12 "software.sslmate.com/src/go-pkcs12"
+)
+
+func parseCertificates(certPEM []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, certPEM = pem.Decode(certPEM)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) < 1 {
+		return nil, errors.New("no PEM encoded certificate")
+	}
+	return certs, nil
+}
+
+func encode(certPEM []byte, privateKey crypto.Signer,
+	password string) ([]byte, error) {
+	certs, err := parseCertificates(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	return gopkcs12.Modern.Encode(privateKey, certs[0], certs[1:], password)
+}
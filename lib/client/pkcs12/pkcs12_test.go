@@ -0,0 +1,108 @@
+package pkcs12
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	gopkcs12 "software.sslmate.com/src/go-pkcs12"
+)
+
+func makeTestCertificate(t *testing.T, commonName string,
+	publicKey interface{}, parent *x509.Certificate,
+	parentKey interface{}) *x509.Certificate {
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	if parent == nil {
+		parent = &template
+	}
+	derCert, err := x509.CreateCertificate(rand.Reader, &template, parent,
+		publicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(derCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func encodeCertificates(certs ...*x509.Certificate) []byte {
+	var certPEM []byte
+	for _, cert := range certs {
+		certPEM = append(certPEM, pem.EncodeToMemory(
+			&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return certPEM
+}
+
+func TestEncode(t *testing.T) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert := makeTestCertificate(t, "ca", &caKey.PublicKey, nil, caKey)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := makeTestCertificate(t, "username", &key.PublicKey, caCert, caKey)
+	pfxData, err := Encode(encodeCertificates(cert), key, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	decodedKey, decodedCert, err := gopkcs12.Decode(pfxData, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decodedCert.Raw, cert.Raw) {
+		t.Fatal("certificate does not match")
+	}
+	if rsaKey, ok := decodedKey.(*rsa.PrivateKey); !ok || !rsaKey.Equal(key) {
+		t.Fatal("key does not match")
+	}
+	if _, _, err := gopkcs12.Decode(pfxData, "wrong"); err == nil {
+		t.Fatal("decoding with the wrong password should fail")
+	}
+	// The chain is kept.
+	pfxData, err = Encode(encodeCertificates(cert, caCert), key, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, caCerts, err := gopkcs12.DecodeChain(pfxData, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(caCerts) != 1 || !bytes.Equal(caCerts[0].Raw, caCert.Raw) {
+		t.Fatal("CA certificate does not match")
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Encode(nil, key, "secret"); err == nil {
+		t.Fatal("encoding without a certificate should fail")
+	}
+	cert := makeTestCertificate(t, "username", &key.PublicKey, nil, key)
+	if _, err := Encode(encodeCertificates(cert), key, "\U0001f511"); err == nil {
+		t.Fatal("passwords outside the BMP should be refused")
+	}
+}
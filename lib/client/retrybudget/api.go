@@ -0,0 +1,53 @@
+// Package retrybudget bounds the combined effort spent retrying requests
+// across all keymaster servers and authentication backends.
+package retrybudget
+
+import (
+	"sync"
+	"time"
+)
+
+// Budget is a retry budget shared between callers. A nil *Budget is
+// unlimited.
+type Budget struct {
+	maxAttempts int
+	maxElapsed  time.Duration
+	start       time.Time
+	mutex       sync.Mutex
+	attempts    int
+	errors      []error
+}
+
+// ExhaustedError is returned once a Budget has been used up. It aggregates
+// the errors recorded for every attempt.
+type ExhaustedError struct {
+	Attempts int
+	Elapsed  time.Duration
+	Errors   []error
+}
+
+func (e *ExhaustedError) Error() string {
+	return e.error()
+}
+
+// New returns a Budget allowing at most maxAttempts attempts within
+// maxElapsed of its creation. A zero value for either limit disables it.
+func New(maxAttempts int, maxElapsed time.Duration) *Budget {
+	return newBudget(maxAttempts, maxElapsed)
+}
+
+// Acquire reserves one attempt. It returns an *ExhaustedError if the budget
+// has been used up, in which case the attempt must not be made.
+func (b *Budget) Acquire() error {
+	return b.acquire()
+}
+
+// Record records the result of an attempt. Nil errors are ignored.
+func (b *Budget) Record(err error) {
+	b.record(err)
+}
+
+// Attempts returns the number of attempts made so far.
+func (b *Budget) Attempts() int {
+	return b.getAttempts()
+}
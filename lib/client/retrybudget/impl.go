@@ -0,0 +1,64 @@
+package retrybudget
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+func newBudget(maxAttempts int, maxElapsed time.Duration) *Budget {
+	return &Budget{
+		maxAttempts: maxAttempts,
+		maxElapsed:  maxElapsed,
+		start:       time.Now(),
+	}
+}
+
+func (b *Budget) acquire() error {
+	if b == nil {
+		return nil
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	elapsed := time.Since(b.start)
+	if (b.maxAttempts > 0 && b.attempts >= b.maxAttempts) ||
+		(b.maxElapsed > 0 && elapsed >= b.maxElapsed) {
+		errors := make([]error, len(b.errors))
+		copy(errors, b.errors)
+		return &ExhaustedError{
+			Attempts: b.attempts,
+			Elapsed:  elapsed,
+			Errors:   errors,
+		}
+	}
+	b.attempts++
+	return nil
+}
+
+func (b *Budget) record(err error) {
+	if b == nil || err == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.errors = append(b.errors, err)
+}
+
+func (b *Budget) getAttempts() int {
+	if b == nil {
+		return 0
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.attempts
+}
+
+func (e *ExhaustedError) error() string {
+	errorStrings := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		errorStrings = append(errorStrings, err.Error())
+	}
+	return fmt.Sprintf("retry budget exhausted after %d attempts in %s: [%s]",
+		e.Attempts, e.Elapsed.Round(time.Millisecond),
+		strings.Join(errorStrings, "; "))
+}
@@ -0,0 +1,55 @@
+package retrybudget
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNilBudgetIsUnlimited(t *testing.T) {
+	var budget *Budget
+	for i := 0; i < 100; i++ {
+		if err := budget.Acquire(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	budget.Record(errors.New("ignored"))
+	if budget.Attempts() != 0 {
+		t.Fatal("nil budget should not count attempts")
+	}
+}
+
+func TestMaxAttempts(t *testing.T) {
+	budget := New(3, 0)
+	for i := 0; i < 3; i++ {
+		if err := budget.Acquire(); err != nil {
+			t.Fatal(err)
+		}
+		budget.Record(errors.New("failed"))
+	}
+	err := budget.Acquire()
+	if err == nil {
+		t.Fatal("budget should have been exhausted")
+	}
+	exhaustedErr, ok := err.(*ExhaustedError)
+	if !ok {
+		t.Fatalf("unexpected error type %T", err)
+	}
+	if exhaustedErr.Attempts != 3 || len(exhaustedErr.Errors) != 3 {
+		t.Fatalf("bad aggregated error: %s", err)
+	}
+	if budget.Attempts() != 3 {
+		t.Fatalf("attempts=%d", budget.Attempts())
+	}
+}
+
+func TestMaxElapsed(t *testing.T) {
+	budget := New(0, 10*time.Millisecond)
+	if err := budget.Acquire(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err := budget.Acquire(); err == nil {
+		t.Fatal("budget should have expired")
+	}
+}
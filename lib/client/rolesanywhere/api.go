@@ -0,0 +1,39 @@
+// Package rolesanywhere obtains temporary AWS credentials from IAM Roles
+// Anywhere by signing CreateSession requests with an X.509 certificate.
+package rolesanywhere
+
+import (
+	"crypto"
+	"net/http"
+	"time"
+)
+
+// SessionRequest describes the role to assume.
+type SessionRequest struct {
+	ProfileArn     string
+	RoleArn        string
+	TrustAnchorArn string
+	// Region defaults to the region of TrustAnchorArn.
+	Region string
+	// Duration defaults to an hour.
+	Duration time.Duration
+	// Endpoint overrides https://rolesanywhere.<region>.amazonaws.com.
+	Endpoint string
+}
+
+// Credentials are temporary AWS credentials.
+type Credentials struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      time.Time
+}
+
+// CreateSession calls the CreateSession API of IAM Roles Anywhere with
+// client, signing the request with the DER encoded certificate chain certs
+// (the first being the certificate of signer) as the Signature Version 4
+// X.509 scheme requires. RSA and ECDSA keys are supported.
+func CreateSession(client *http.Client, certs [][]byte, signer crypto.Signer,
+	request SessionRequest) (*Credentials, error) {
+	return createSession(client, certs, signer, request, time.Now())
+}
@@ -0,0 +1,116 @@
+package rolesanywhere
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const defaultDuration = time.Hour
+
+type createSessionRequest struct {
+	DurationSeconds int    `json:"durationSeconds"`
+	ProfileArn      string `json:"profileArn"`
+	RoleArn         string `json:"roleArn"`
+	TrustAnchorArn  string `json:"trustAnchorArn"`
+}
+
+type createSessionResponse struct {
+	CredentialSet []struct {
+		Credentials struct {
+			AccessKeyId     string    `json:"accessKeyId"`
+			Expiration      time.Time `json:"expiration"`
+			SecretAccessKey string    `json:"secretAccessKey"`
+			SessionToken    string    `json:"sessionToken"`
+		} `json:"credentials"`
+	} `json:"credentialSet"`
+}
+
+// getRegion returns the region field of the ARN arn.
+func getRegion(arn string) (string, error) {
+	fields := strings.SplitN(arn, ":", 6)
+	if len(fields) < 6 || fields[0] != "arn" || fields[3] == "" {
+		return "", fmt.Errorf("no region in ARN %s", arn)
+	}
+	return fields[3], nil
+}
+
+func createSession(client *http.Client, certs [][]byte, signer crypto.Signer,
+	request SessionRequest, now time.Time) (*Credentials, error) {
+	if len(certs) < 1 {
+		return nil, errors.New("no certificate")
+	}
+	if request.ProfileArn == "" || request.RoleArn == "" ||
+		request.TrustAnchorArn == "" {
+		return nil, errors.New(
+			"profile, role and trust anchor ARNs are all needed")
+	}
+	region := request.Region
+	if region == "" {
+		var err error
+		region, err = getRegion(request.TrustAnchorArn)
+		if err != nil {
+			return nil, err
+		}
+	}
+	duration := request.Duration
+	if duration == 0 {
+		duration = defaultDuration
+	}
+	endpoint := request.Endpoint
+	if endpoint == "" {
+		endpoint = "https://" + serviceName + "." + region + ".amazonaws.com"
+	}
+	body, err := json.Marshal(createSessionRequest{
+		DurationSeconds: int(duration.Seconds()),
+		ProfileArn:      request.ProfileArn,
+		RoleArn:         request.RoleArn,
+		TrustAnchorArn:  request.TrustAnchorArn,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST",
+		strings.TrimRight(endpoint, "/")+"/sessions", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := signRequest(req, body, certs, signer, region, now); err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusCreated &&
+		resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CreateSession failed (%s): %s", resp.Status,
+			strings.TrimSpace(string(respBody)))
+	}
+	var response createSessionResponse
+	if err := json.Unmarshal(respBody, &response); err != nil {
+		return nil, err
+	}
+	if len(response.CredentialSet) < 1 {
+		return nil, errors.New("CreateSession returned no credentials")
+	}
+	credentials := response.CredentialSet[0].Credentials
+	return &Credentials{
+		AccessKeyId:     credentials.AccessKeyId,
+		SecretAccessKey: credentials.SecretAccessKey,
+		SessionToken:    credentials.SessionToken,
+		Expiration:      credentials.Expiration,
+	}, nil
+}
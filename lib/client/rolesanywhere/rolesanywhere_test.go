@@ -0,0 +1,165 @@
+package rolesanywhere
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testProfileArn     = "arn:aws:rolesanywhere:us-west-2:123456789012:profile/p"
+	testRoleArn        = "arn:aws:iam::123456789012:role/r"
+	testTrustAnchorArn = "arn:aws:rolesanywhere:us-west-2:123456789012:trust-anchor/t"
+)
+
+var authorizationRegexp = regexp.MustCompile(
+	`^(AWS4-X509-[A-Z]+-SHA256) Credential=(\d+)/([^,]+), SignedHeaders=([^,]+), Signature=([0-9a-f]+)$`)
+
+func makeTestCertificate(t *testing.T, signer crypto.Signer) []byte {
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(4242),
+		Subject:      pkix.Name{CommonName: "username"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	derCert, err := x509.CreateCertificate(rand.Reader, &template, &template,
+		signer.Public(), signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return derCert
+}
+
+// verifyRequest checks the signature of r as IAM Roles Anywhere would.
+func verifyRequest(r *http.Request, body []byte) error {
+	match := authorizationRegexp.FindStringSubmatch(
+		r.Header.Get("Authorization"))
+	if match == nil {
+		return fmt.Errorf("bad Authorization: %s",
+			r.Header.Get("Authorization"))
+	}
+	derCert, err := base64.StdEncoding.DecodeString(r.Header.Get("X-Amz-X509"))
+	if err != nil {
+		return err
+	}
+	cert, err := x509.ParseCertificate(derCert)
+	if err != nil {
+		return err
+	}
+	if match[2] != cert.SerialNumber.String() {
+		return fmt.Errorf("bad serial number %s", match[2])
+	}
+	var canonicalHeaders string
+	for _, name := range strings.Split(match[4], ";") {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		canonicalHeaders += name + ":" + value + "\n"
+	}
+	canonicalRequest := strings.Join([]string{r.Method, r.URL.Path, "",
+		canonicalHeaders, match[4], hashHex(body)}, "\n")
+	stringToSign := strings.Join([]string{match[1],
+		r.Header.Get("X-Amz-Date"), match[3],
+		hashHex([]byte(canonicalRequest))}, "\n")
+	digest := sha256.Sum256([]byte(stringToSign))
+	signature, err := hex.DecodeString(match[5])
+	if err != nil {
+		return err
+	}
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, digest[:], signature) {
+			return fmt.Errorf("bad signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unexpected key type")
+}
+
+func TestCreateSession(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			var request createSessionRequest
+			json.Unmarshal(body, &request)
+			if r.URL.Path != "/sessions" || request.RoleArn != testRoleArn ||
+				request.DurationSeconds != 900 {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+			if err := verifyRequest(r, body); err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"credentialSet":[{"credentials":{"accessKeyId":"AKID","expiration":"2030-01-02T03:04:05Z","secretAccessKey":"secret","sessionToken":"token"}}]}`))
+		}))
+	defer server.Close()
+	request := SessionRequest{
+		ProfileArn:     testProfileArn,
+		RoleArn:        testRoleArn,
+		TrustAnchorArn: testTrustAnchorArn,
+		Duration:       15 * time.Minute,
+		Endpoint:       server.URL,
+	}
+	for _, signer := range []crypto.Signer{rsaKey, ecdsaKey} {
+		certs := [][]byte{makeTestCertificate(t, signer)}
+		credentials, err := CreateSession(server.Client(), certs, signer,
+			request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if credentials.AccessKeyId != "AKID" ||
+			credentials.SessionToken != "token" ||
+			credentials.Expiration.Year() != 2030 {
+			t.Fatalf("unexpected credentials %+v", credentials)
+		}
+	}
+	// Signatures by a key not matching the certificate are refused.
+	certs := [][]byte{makeTestCertificate(t, rsaKey)}
+	if _, err := CreateSession(server.Client(), certs, ecdsaKey,
+		request); err == nil {
+		t.Fatal("request signed with another key should fail")
+	}
+}
+
+func TestGetRegion(t *testing.T) {
+	region, err := getRegion(testTrustAnchorArn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if region != "us-west-2" {
+		t.Fatalf("unexpected region %s", region)
+	}
+	if _, err := getRegion("trust-anchor/t"); err == nil {
+		t.Fatal("missing region should fail")
+	}
+}
@@ -0,0 +1,107 @@
+package rolesanywhere
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	amzDateFormat = "20060102T150405Z"
+	serviceName   = "rolesanywhere"
+)
+
+func getAlgorithm(signer crypto.Signer) (string, error) {
+	switch signer.Public().(type) {
+	case *rsa.PublicKey:
+		return "AWS4-X509-RSA-SHA256", nil
+	case *ecdsa.PublicKey:
+		return "AWS4-X509-ECDSA-SHA256", nil
+	}
+	return "", fmt.Errorf("unsupported key type %T", signer.Public())
+}
+
+func hashHex(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// getCanonicalRequest returns the canonical request of req with body and
+// the names of the signed headers, which are all headers of req and Host.
+func getCanonicalRequest(req *http.Request, body []byte) (string, string) {
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(
+			strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	return strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hashHex(body),
+	}, "\n"), signedHeaders
+}
+
+// signRequest adds the X.509 Signature Version 4 headers to req.
+func signRequest(req *http.Request, body []byte, certs [][]byte,
+	signer crypto.Signer, region string, now time.Time) error {
+	algorithm, err := getAlgorithm(signer)
+	if err != nil {
+		return err
+	}
+	cert, err := x509.ParseCertificate(certs[0])
+	if err != nil {
+		return err
+	}
+	amzDate := now.UTC().Format(amzDateFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-X509", base64.StdEncoding.EncodeToString(certs[0]))
+	if len(certs) > 1 {
+		var chain []string
+		for _, derCert := range certs[1:] {
+			chain = append(chain, base64.StdEncoding.EncodeToString(derCert))
+		}
+		req.Header.Set("X-Amz-X509-Chain", strings.Join(chain, ","))
+	}
+	canonicalRequest, signedHeaders := getCanonicalRequest(req, body)
+	scope := strings.Join([]string{amzDate[:8], region, serviceName,
+		"aws4_request"}, "/")
+	stringToSign := strings.Join([]string{algorithm, amzDate, scope,
+		hashHex([]byte(canonicalRequest))}, "\n")
+	digest := sha256.Sum256([]byte(stringToSign))
+	signature, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"%s Credential=%s/%s, SignedHeaders=%s, Signature=%s", algorithm,
+		cert.SerialNumber.String(), scope, signedHeaders,
+		hex.EncodeToString(signature)))
+	return nil
+}
@@ -0,0 +1,46 @@
+// Package serverlatency records how fast keymaster servers answer so that
+// the fastest healthy servers can be tried first.
+package serverlatency
+
+import (
+	"sync"
+	"time"
+)
+
+// Latencies holds the latency of each server, keyed by base URL, and is
+// safe for concurrent use. A nil *Latencies records nothing and keeps the
+// configured order.
+type Latencies struct {
+	filename string
+	mutex    sync.Mutex
+	servers  map[string]serverStats
+}
+
+// Load returns the Latencies saved in filename. A missing file yields empty
+// Latencies which will be saved to filename.
+func Load(filename string) (*Latencies, error) {
+	return load(filename)
+}
+
+// Record records that the server at baseUrl answered in latency. The
+// latency is averaged with the earlier ones and the server is healthy again.
+func (l *Latencies) Record(baseUrl string, latency time.Duration) {
+	l.record(baseUrl, latency)
+}
+
+// RecordFailure records that a request to the server at baseUrl failed.
+func (l *Latencies) RecordFailure(baseUrl string) {
+	l.recordFailure(baseUrl)
+}
+
+// Order returns baseUrls sorted with the healthy servers first, fastest
+// first, followed by the servers without a recorded latency and then the
+// failing servers. The order of baseUrls is kept between equal servers.
+func (l *Latencies) Order(baseUrls []string) []string {
+	return l.order(baseUrls)
+}
+
+// Save writes the latencies to the file they were loaded from.
+func (l *Latencies) Save() error {
+	return l.save()
+}
@@ -0,0 +1,133 @@
+package serverlatency
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Weight of a new latency in the moving average.
+const newLatencyWeight = 0.3
+
+type serverStats struct {
+	Latency  time.Duration `json:"latency"`
+	Failures int           `json:"failures,omitempty"`
+	Updated  time.Time     `json:"updated"`
+}
+
+func load(filename string) (*Latencies, error) {
+	l := &Latencies{
+		filename: filename,
+		servers:  make(map[string]serverStats),
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return l, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &l.servers); err != nil {
+		return nil, err
+	}
+	if l.servers == nil {
+		l.servers = make(map[string]serverStats)
+	}
+	return l, nil
+}
+
+func (l *Latencies) record(baseUrl string, latency time.Duration) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	stats, ok := l.servers[baseUrl]
+	if ok && stats.Latency > 0 {
+		stats.Latency = time.Duration(newLatencyWeight*float64(latency) +
+			(1-newLatencyWeight)*float64(stats.Latency))
+	} else {
+		stats.Latency = latency
+	}
+	stats.Failures = 0
+	stats.Updated = time.Now()
+	l.servers[baseUrl] = stats
+}
+
+func (l *Latencies) recordFailure(baseUrl string) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	stats := l.servers[baseUrl]
+	stats.Failures++
+	stats.Updated = time.Now()
+	l.servers[baseUrl] = stats
+}
+
+// rank returns the group of the server at baseUrl in the order: 0 for
+// healthy, 1 for unknown and 2 for failing servers. The mutex must be held.
+func (l *Latencies) rank(baseUrl string) int {
+	stats, ok := l.servers[baseUrl]
+	if !ok || (stats.Latency <= 0 && stats.Failures < 1) {
+		return 1
+	}
+	if stats.Failures > 0 {
+		return 2
+	}
+	return 0
+}
+
+func (l *Latencies) order(baseUrls []string) []string {
+	ordered := make([]string, len(baseUrls))
+	copy(ordered, baseUrls)
+	if l == nil {
+		return ordered
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	sort.SliceStable(ordered, func(i, j int) bool {
+		rankI := l.rank(ordered[i])
+		rankJ := l.rank(ordered[j])
+		if rankI != rankJ {
+			return rankI < rankJ
+		}
+		statsI := l.servers[ordered[i]]
+		statsJ := l.servers[ordered[j]]
+		if rankI == 2 {
+			return statsI.Failures < statsJ.Failures
+		}
+		return statsI.Latency < statsJ.Latency
+	})
+	return ordered
+}
+
+func (l *Latencies) save() error {
+	if l == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	data, err := json.MarshalIndent(l.servers, "", "    ")
+	l.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(l.filename),
+		filepath.Base(l.filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(append(data, '\n')); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), l.filename)
+}
@@ -0,0 +1,88 @@
+package serverlatency
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNilLatenciesKeepOrder(t *testing.T) {
+	var latencies *Latencies
+	latencies.Record("https://a", time.Second)
+	latencies.RecordFailure("https://b")
+	urls := []string{"https://b", "https://a"}
+	if ordered := latencies.Order(urls); !reflect.DeepEqual(ordered, urls) {
+		t.Fatalf("unexpected order: %v", ordered)
+	}
+	if err := latencies.Save(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOrder(t *testing.T) {
+	latencies, err := Load(filepath.Join(t.TempDir(), "latency.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	latencies.Record("https://slow", 300*time.Millisecond)
+	latencies.Record("https://fast", 100*time.Millisecond)
+	latencies.Record("https://down", 50*time.Millisecond)
+	latencies.RecordFailure("https://down")
+	ordered := latencies.Order([]string{"https://down", "https://unknown",
+		"https://slow", "https://fast"})
+	expected := []string{"https://fast", "https://slow", "https://unknown",
+		"https://down"}
+	if !reflect.DeepEqual(ordered, expected) {
+		t.Fatalf("expected %v, got %v", expected, ordered)
+	}
+	// A success makes a failing server healthy again.
+	latencies.Record("https://down", 50*time.Millisecond)
+	ordered = latencies.Order([]string{"https://fast", "https://down"})
+	if ordered[0] != "https://down" {
+		t.Fatalf("unexpected order: %v", ordered)
+	}
+}
+
+func TestMovingAverage(t *testing.T) {
+	latencies, err := Load(filepath.Join(t.TempDir(), "latency.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	latencies.Record("https://a", 100*time.Millisecond)
+	latencies.Record("https://b", 200*time.Millisecond)
+	// One slow answer does not make a fast server slower than b.
+	latencies.Record("https://a", 400*time.Millisecond)
+	ordered := latencies.Order([]string{"https://b", "https://a"})
+	if ordered[0] != "https://a" {
+		t.Fatalf("unexpected order: %v", ordered)
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "latency.json")
+	latencies, err := Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	latencies.Record("https://slow", 300*time.Millisecond)
+	latencies.Record("https://fast", 100*time.Millisecond)
+	if err := latencies.Save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ordered := loaded.Order([]string{"https://slow", "https://fast"})
+	if ordered[0] != "https://fast" {
+		t.Fatalf("unexpected order: %v", ordered)
+	}
+	if err := ioutil.WriteFile(filename, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(filename); err == nil {
+		t.Fatal("loading a corrupt file should fail")
+	}
+}
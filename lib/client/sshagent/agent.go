@@ -5,20 +5,23 @@ import (
 	"net"
 	"os"
 	"runtime"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 
 	"github.com/Cloud-Foundations/golib/pkg/log"
-	"github.com/Cloud-Foundations/npipe"
 )
 
 func connectToDefaultSSHAgentLocation() (net.Conn, error) {
 	if runtime.GOOS == "windows" {
-		return npipe.Dial(`\\.\pipe\openssh-ssh-agent`)
+		return connectToWindowsAgent()
 	}
 	// Here we assume that all other os support unix sockets
 	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, ErrNoAgent
+	}
 	return net.Dial("unix", socket)
 }
 
@@ -92,3 +95,37 @@ func upsertCertIntoAgent(
 
 	return agentClient.Add(keyToAdd)
 }
+
+// getLifetimeSecs returns the number of seconds from now until sshCert
+// expires, rounded up.
+func getLifetimeSecs(sshCert *ssh.Certificate, now time.Time) (uint32, error) {
+	if sshCert.ValidBefore == ssh.CertTimeInfinity {
+		return 0, nil
+	}
+	expiresAt := time.Unix(int64(sshCert.ValidBefore), 0)
+	if !expiresAt.After(now) {
+		return 0, fmt.Errorf("certificate expired at %s", expiresAt)
+	}
+	return uint32((expiresAt.Sub(now) + time.Second - 1) / time.Second), nil
+}
+
+func upsertCertIntoAgentUntilExpiry(
+	certText []byte,
+	privateKey interface{},
+	comment string,
+	logger log.Logger) error {
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey(certText)
+	if err != nil {
+		return err
+	}
+	sshCert, ok := pubKey.(*ssh.Certificate)
+	if !ok {
+		return fmt.Errorf("It is not a certificate")
+	}
+	lifeTimeSecs, err := getLifetimeSecs(sshCert, time.Now())
+	if err != nil {
+		return err
+	}
+	return upsertCertIntoAgent(certText, privateKey, comment, lifeTimeSecs,
+		logger)
+}
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/Cloud-Foundations/Dominator/lib/log/testlogger"
 	"github.com/Cloud-Foundations/npipe"
@@ -154,3 +156,53 @@ func TestDeleteDuplicateEntries(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestGetLifetimeSecs(t *testing.T) {
+	now := time.Now()
+	cert := &ssh.Certificate{ValidBefore: uint64(now.Add(time.Hour).Unix())}
+	lifeTimeSecs, err := getLifetimeSecs(cert, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lifeTimeSecs < 3599 || lifeTimeSecs > 3600 {
+		t.Fatalf("unexpected lifetime %d", lifeTimeSecs)
+	}
+	cert.ValidBefore = uint64(now.Add(-time.Minute).Unix())
+	if _, err := getLifetimeSecs(cert, now); err == nil {
+		t.Fatal("expected error for an expired certificate")
+	}
+	cert.ValidBefore = ssh.CertTimeInfinity
+	lifeTimeSecs, err = getLifetimeSecs(cert, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lifeTimeSecs != 0 {
+		t.Fatalf("expected no lifetime, got %d", lifeTimeSecs)
+	}
+}
+
+func TestGetWindowsAgentPipes(t *testing.T) {
+	pipes := getWindowsAgentPipes(`\\.\pipe\custom-agent`,
+		`\\.\pipe\pageant.user.0123`)
+	expected := []string{`\\.\pipe\custom-agent`, openSSHAgentPipe,
+		`\\.\pipe\pageant.user.0123`}
+	if fmt.Sprint(pipes) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, pipes)
+	}
+	// Unix socket paths and a missing Pageant are skipped.
+	pipes = getWindowsAgentPipes("/tmp/agent.sock", "")
+	if len(pipes) != 1 || pipes[0] != openSSHAgentPipe {
+		t.Fatalf("unexpected pipes: %v", pipes)
+	}
+}
+
+func TestGetPageantPipeName(t *testing.T) {
+	name := getPageantPipeName("user", make([]byte, 16))
+	prefix := `\\.\pipe\pageant.user.`
+	if !strings.HasPrefix(name, prefix) || len(name) != len(prefix)+64 {
+		t.Fatalf("unexpected pipe name %s", name)
+	}
+	if name == getPageantPipeName("user", []byte("0123456789abcdef")) {
+		t.Fatal("pipe name should depend on the protected name")
+	}
+}
@@ -1,9 +1,17 @@
 package sshagent
 
 import (
+	"errors"
+
 	"github.com/Cloud-Foundations/golib/pkg/log"
 )
 
+// ErrNoAgent is returned when no ssh-agent is running ($SSH_AUTH_SOCK is
+// not set). On Windows the agent is reached through the named pipe in
+// $SSH_AUTH_SOCK, the pipe of the OpenSSH agent service or the pipe of
+// Pageant, and ErrNoAgent is returned if none of them answers.
+var ErrNoAgent = errors.New("no ssh-agent running")
+
 func UpsertCertIntoAgent(
 	certText []byte,
 	privateKey interface{},
@@ -12,3 +20,14 @@ func UpsertCertIntoAgent(
 	logger log.Logger) error {
 	return upsertCertIntoAgent(certText, privateKey, comment, lifeTimeSecs, logger)
 }
+
+// UpsertCertIntoAgentUntilExpiry is like UpsertCertIntoAgent, but the agent
+// is told to drop the key when the certificate expires.
+func UpsertCertIntoAgentUntilExpiry(
+	certText []byte,
+	privateKey interface{},
+	comment string,
+	logger log.Logger) error {
+	return upsertCertIntoAgentUntilExpiry(certText, privateKey, comment,
+		logger)
+}
@@ -0,0 +1,7 @@
+//go:build !windows
+
+package sshagent
+
+func findPageantPipe() string {
+	return ""
+}
@@ -0,0 +1,44 @@
+package sshagent
+
+import (
+	"os/user"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	cryptProtectMemoryBlockSize    = 16
+	cryptProtectMemoryCrossProcess = 1
+)
+
+var procCryptProtectMemory = syscall.NewLazyDLL("crypt32.dll").NewProc(
+	"CryptProtectMemory")
+
+// findPageantPipe returns the named pipe of Pageant (0.75 and later) for
+// the current user, or "" if it cannot be computed.
+func findPageantPipe() string {
+	if procCryptProtectMemory.Find() != nil {
+		return ""
+	}
+	usr, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	username := usr.Username
+	if index := strings.LastIndex(username, `\`); index >= 0 {
+		username = username[index+1:]
+	}
+	// The encrypted data is the name with its NUL padded to a whole block.
+	name := "Pageant"
+	length := (len(name) + cryptProtectMemoryBlockSize) /
+		cryptProtectMemoryBlockSize * cryptProtectMemoryBlockSize
+	data := make([]byte, length)
+	copy(data, name)
+	ret, _, _ := procCryptProtectMemory.Call(uintptr(unsafe.Pointer(&data[0])),
+		uintptr(len(data)), cryptProtectMemoryCrossProcess)
+	if ret == 0 {
+		return ""
+	}
+	return getPageantPipeName(username, data)
+}
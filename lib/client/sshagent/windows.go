@@ -0,0 +1,54 @@
+package sshagent
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/Cloud-Foundations/npipe"
+)
+
+const openSSHAgentPipe = `\\.\pipe\openssh-ssh-agent`
+
+// getWindowsAgentPipes returns the named pipes to try for an agent on
+// Windows: authSock if it names a pipe, then the OpenSSH agent and then
+// pageantPipe unless it is empty.
+func getWindowsAgentPipes(authSock string, pageantPipe string) []string {
+	var pipes []string
+	if strings.HasPrefix(authSock, `\\.\pipe\`) {
+		pipes = append(pipes, authSock)
+	}
+	pipes = append(pipes, openSSHAgentPipe)
+	if pageantPipe != "" {
+		pipes = append(pipes, pageantPipe)
+	}
+	return pipes
+}
+
+// getPageantPipeName returns the pipe Pageant serves for username, where
+// protectedName is "Pageant" encrypted with CryptProtectMemory. Pageant
+// names the pipe after the SHA-256 hash of the SSH string encoding of
+// protectedName so that it differs between logon sessions.
+func getPageantPipeName(username string, protectedName []byte) string {
+	hash := sha256.New()
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(protectedName)))
+	hash.Write(length[:])
+	hash.Write(protectedName)
+	return fmt.Sprintf(`\\.\pipe\pageant.%s.%x`, username, hash.Sum(nil))
+}
+
+func connectToWindowsAgent() (net.Conn, error) {
+	pipes := getWindowsAgentPipes(os.Getenv("SSH_AUTH_SOCK"),
+		findPageantPipe())
+	for _, pipe := range pipes {
+		conn, err := npipe.Dial(pipe)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, ErrNoAgent
+}
@@ -3,22 +3,131 @@ package twofa
 
 import (
 	"crypto"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"net/http"
 	"time"
 
 	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"github.com/Cloud-Foundations/keymaster/lib/client/retrybudget"
+	"github.com/Cloud-Foundations/keymaster/lib/client/serverlatency"
+	"github.com/Cloud-Foundations/keymaster/lib/devicekey"
 )
 
 var (
 	// Duration of generated cert. Default 16 hours.
 	Duration = flag.Duration("duration", 16*time.Hour, "Duration of the requested certificates in golang duration format (ex: 30s, 5m, 12h)")
+	// Name of the certificate profile to request. The server default if
+	// empty.
+	profile = flag.String("profile", "",
+		"Name of the certificate profile to request (ex: admin, vpn)")
 	// If set, Do not use U2F as second factor
 	noU2F = flag.Bool("noU2F", false, "Don't use U2F as second factor")
 	// If set, Do not use VIPAccess as second factor.
 	noVIPAccess = flag.Bool("noVIPAccess", false, "Don't use VIPAccess as second factor")
+	// If set, Do not use TOTP as second factor.
+	noTOTP = flag.Bool("noTOTP", false, "Don't use TOTP as second factor")
+	// If set, Do not use RADIUS as second factor.
+	noRADIUS = flag.Bool("noRADIUS", false, "Don't use RADIUS as second factor")
+	// If set, Do not use Duo as second factor.
+	noDuo = flag.Bool("noDuo", false, "Don't use Duo as second factor")
+	// If set, Do not use the webhook second factor.
+	noWebhook = flag.Bool("noWebhook", false,
+		"Don't use the webhook second factor")
+	// If set, use a recovery code instead of the other second factors.
+	useRecoveryCode = flag.Bool("useRecoveryCode", false,
+		"Use a one-time recovery code as second factor, for when a device is lost")
+	// If set, Do not use WebAuthn as second factor.
+	noWebAuthn = flag.Bool("noWebAuthn", false, "Don't use WebAuthn as second factor")
+	// If set, second factors which prompt on stdin are not used.
+	nonInteractive bool
+	// If set, cert requests are raced across all servers after a login.
+	raceServers     bool
+	serverLatencies *serverlatency.Latencies
+	// If set, logins and cert requests are signed with this device key.
+	deviceKey *devicekey.Key
+	// If set, cert requests carry this proto.PIVAttestationHeader value.
+	keyAttestation string
+	// SSH certificate critical options and extensions to request. The
+	// server policy decides which ones may be requested.
+	sshForceCommand = flag.String("sshForceCommand", "",
+		"Request SSH certificates which can only run this command")
+	sshSourceAddress = flag.String("sshSourceAddress", "",
+		"Request SSH certificates only usable from these comma separated addresses or CIDR blocks")
+	sshExtensions = flag.String("sshExtensions", "",
+		"Comma separated SSH certificate extensions (ex: permit-pty) to request instead of the server defaults")
 )
 
+// ErrNoUsableFactor is matched by a *NoUsableFactorError.
+var ErrNoUsableFactor = errors.New("no usable second factor")
+
+// NoUsableFactorError is returned when the server requires a second factor
+// but none of the factors it advertises can be used from this client.
+// Required lists the factors the server advertised and Unusable explains
+// why each one could not be used.
+type NoUsableFactorError struct {
+	Required []string
+	Unusable map[string]string
+}
+
+func (e *NoUsableFactorError) Error() string {
+	return e.error()
+}
+
+// Is allows errors.Is(err, ErrNoUsableFactor).
+func (e *NoUsableFactorError) Is(target error) bool {
+	return target == ErrNoUsableFactor
+}
+
+// DeniedError is returned when a keymaster server refuses a request. The
+// ReasonCode and Message are taken from the server response when present.
+type DeniedError struct {
+	Status     string
+	URL        string
+	ReasonCode string
+	Message    string
+}
+
+func (e *DeniedError) Error() string {
+	return e.error()
+}
+
+// SetNonInteractive controls whether second factors which read a code from
+// stdin (VIP and TOTP) may be used. In non-interactive mode a server which
+// requires only those factors fails with a *NoUsableFactorError instead of
+// blocking on a prompt.
+func SetNonInteractive(enable bool) {
+	nonInteractive = enable
+}
+
+// SetServerRacing controls whether GetCertFromTargetUrls and
+// GetCertFromTargetUrlsWithBudget, once logged in to a server, request the
+// certs from all target URLs concurrently and use the server which answers
+// first. The session cookies of the login are sent to every target URL, so
+// the servers must share their CA key and hostname identity. If latencies
+// is not nil the target URLs are tried in its order and the latencies of
+// the servers are recorded in it.
+func SetServerRacing(enable bool, latencies *serverlatency.Latencies) {
+	raceServers = enable
+	serverLatencies = latencies
+}
+
+// SetDeviceKey sets the key which identifies this device to the servers.
+// Password logins and cert requests are then signed with it, so servers
+// with device trust can register the device and limit certs to approved
+// devices. A nil key disables this.
+func SetDeviceKey(key *devicekey.Key) {
+	deviceKey = key
+}
+
+// SetKeyAttestation sets the proto.PIVAttestationHeader value sent with cert
+// requests, attesting that the key to certify is held in a hardware key
+// (see lib/client/piv). An empty value disables this.
+func SetKeyAttestation(attestation string) {
+	keyAttestation = attestation
+}
+
 // GetCertFromTargetUrls gets a signed cert from the given target URLs.
 func GetCertFromTargetUrls(
 	signer crypto.Signer,
@@ -32,5 +141,145 @@ func GetCertFromTargetUrls(
 	logger log.DebugLogger) (sshCert []byte, x509Cert []byte, kubernetesCert []byte, err error) {
 	return getCertFromTargetUrls(
 		signer, userName, password, targetUrls, skipu2f, addGroups,
-		client, userAgentString, logger)
+		client, userAgentString, nil, logger)
+}
+
+// GetCertFromTargetUrlsWithOIDCToken is like GetCertFromTargetUrlsWithBudget,
+// but authenticates non-interactively using a pre-obtained OIDC token (such
+// as a CI workload identity token) instead of a password and second factor.
+// The token is checked to be a well-formed, unexpired JWT before it is sent.
+// Servers which do not advertise the OIDC token backend are skipped.
+func GetCertFromTargetUrlsWithOIDCToken(
+	signer crypto.Signer,
+	userName string,
+	oidcToken []byte,
+	targetUrls []string,
+	addGroups bool,
+	client *http.Client,
+	userAgentString string,
+	budget *retrybudget.Budget,
+	logger log.DebugLogger) (sshCert []byte, x509Cert []byte, kubernetesCert []byte, err error) {
+	return getCertFromTargetUrlsWithOIDCToken(
+		signer, userName, oidcToken, targetUrls, addGroups,
+		client, userAgentString, budget, logger)
+}
+
+// GetCertFromTargetUrlsWithCloudIdentity is like
+// GetCertFromTargetUrlsWithBudget, but authenticates non-interactively with
+// the identity of the cloud instance it runs on, read from the metadata
+// service of provider ("aws", "gcp" or "azure"). The server must map the
+// instance to userName, which must be an automation user.
+func GetCertFromTargetUrlsWithCloudIdentity(
+	signer crypto.Signer,
+	userName string,
+	provider string,
+	targetUrls []string,
+	addGroups bool,
+	client *http.Client,
+	userAgentString string,
+	budget *retrybudget.Budget,
+	logger log.DebugLogger) (sshCert []byte, x509Cert []byte, kubernetesCert []byte, err error) {
+	return getCertFromTargetUrlsWithCloudIdentity(
+		signer, userName, provider, targetUrls, addGroups,
+		client, userAgentString, budget, logger)
+}
+
+// GetCertFromTargetUrlsWithServiceAccountToken is like
+// GetCertFromTargetUrlsWithBudget, but authenticates non-interactively as the
+// service account userName with the refresh token in tokenFilename. Every
+// login rotates the token, and the new token replaces the contents of
+// tokenFilename, so the file must be writable.
+func GetCertFromTargetUrlsWithServiceAccountToken(
+	signer crypto.Signer,
+	userName string,
+	tokenFilename string,
+	targetUrls []string,
+	addGroups bool,
+	client *http.Client,
+	userAgentString string,
+	budget *retrybudget.Budget,
+	logger log.DebugLogger) (sshCert []byte, x509Cert []byte, kubernetesCert []byte, err error) {
+	return getCertFromTargetUrlsWithServiceAccountToken(
+		signer, userName, tokenFilename, targetUrls, addGroups,
+		client, userAgentString, budget, logger)
+}
+
+// GetCertFromTargetUrlsWithCertificate is like
+// GetCertFromTargetUrlsWithBudget, but the password is replaced by
+// certificate, a still valid X.509 certificate issued by the keymaster to
+// userName, which is presented over mutual TLS. Second factors are still
+// used if required by the server. The server must have certificate renewal
+// enabled.
+func GetCertFromTargetUrlsWithCertificate(
+	signer crypto.Signer,
+	userName string,
+	certificate tls.Certificate,
+	targetUrls []string,
+	skipu2f bool,
+	addGroups bool,
+	client *http.Client,
+	userAgentString string,
+	budget *retrybudget.Budget,
+	logger log.DebugLogger) (sshCert []byte, x509Cert []byte, kubernetesCert []byte, err error) {
+	return getCertFromTargetUrlsWithCertificate(
+		signer, userName, certificate, targetUrls, skipu2f, addGroups,
+		client, userAgentString, budget, logger)
+}
+
+// GetCertFromTargetUrlsWithKerberos is like GetCertFromTargetUrlsWithBudget,
+// but the password is replaced by Kerberos (SPNEGO) authentication using the
+// tickets in the credential cache of the user ($KRB5CCNAME or the default
+// file cache) and the configuration in $KRB5_CONFIG or /etc/krb5.conf.
+// Second factors are still used as required by the server. An error is
+// returned if there are no tickets for userName, so that the caller can
+// fall back to a password.
+func GetCertFromTargetUrlsWithKerberos(
+	signer crypto.Signer,
+	userName string,
+	targetUrls []string,
+	skipu2f bool,
+	addGroups bool,
+	client *http.Client,
+	userAgentString string,
+	budget *retrybudget.Budget,
+	logger log.DebugLogger) (sshCert []byte, x509Cert []byte, kubernetesCert []byte, err error) {
+	return getCertFromTargetUrlsWithKerberos(
+		signer, userName, targetUrls, skipu2f, addGroups,
+		client, userAgentString, budget, logger)
+}
+
+// GetCertFromTargetUrlsWithBudget is like GetCertFromTargetUrls, but every
+// server attempt consumes one attempt from budget. Once budget is exhausted
+// an aggregated *retrybudget.ExhaustedError is returned.
+func GetCertFromTargetUrlsWithBudget(
+	signer crypto.Signer,
+	userName string,
+	password []byte,
+	targetUrls []string,
+	skipu2f bool,
+	addGroups bool,
+	client *http.Client,
+	userAgentString string,
+	budget *retrybudget.Budget,
+	logger log.DebugLogger) (sshCert []byte, x509Cert []byte, kubernetesCert []byte, err error) {
+	return getCertFromTargetUrls(
+		signer, userName, password, targetUrls, skipu2f, addGroups,
+		client, userAgentString, budget, logger)
+}
+
+// GetCertsWithCookies gets a signed cert from baseUrl using the session
+// cookies of an earlier login instead of authenticating again. If
+// authCookies is nil the cookies are taken from the cookie jar of client.
+// A *DeniedError is returned once the session is no longer accepted.
+func GetCertsWithCookies(
+	signer crypto.Signer,
+	userName string,
+	baseUrl string,
+	authCookies []*http.Cookie,
+	addGroups bool,
+	client *http.Client,
+	userAgentString string,
+	logger log.DebugLogger) (sshCert []byte, x509Cert []byte, kubernetesCert []byte, err error) {
+	return getCertsWithCookies(signer, userName, baseUrl, authCookies,
+		addGroups, client, userAgentString, logger)
 }
@@ -0,0 +1,91 @@
+package twofa
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"github.com/Cloud-Foundations/keymaster/lib/client/retrybudget"
+	"github.com/Cloud-Foundations/keymaster/lib/client/util"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+func getCertsFromServerWithCertificate(
+	signer crypto.Signer,
+	userName string,
+	baseUrl string,
+	skip2fa bool,
+	addGroups bool,
+	loginClient *http.Client,
+	client *http.Client,
+	userAgentString string,
+	logger log.DebugLogger) (sshCert []byte, x509Cert []byte, kubernetesCert []byte, err error) {
+	req, err := http.NewRequest("POST",
+		baseUrl+proto.CertificateRenewalLoginPath, nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	req.Header.Add("Accept", "application/json")
+	req.Header.Set("User-Agent", userAgentString)
+	authCookies, err := doLoginRequestWithLoginClient(signer, req, baseUrl,
+		skip2fa, loginClient, client, userAgentString, logger)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return getCertsWithCookies(signer, userName, baseUrl, authCookies,
+		addGroups, client, userAgentString, logger)
+}
+
+func getCertFromTargetUrlsWithCertificate(
+	signer crypto.Signer,
+	userName string,
+	certificate tls.Certificate,
+	targetUrls []string,
+	skipu2f bool,
+	addGroups bool,
+	client *http.Client,
+	userAgentString string,
+	budget *retrybudget.Budget,
+	logger log.DebugLogger) (sshCert []byte, x509Cert []byte, kubernetesCert []byte, err error) {
+	if len(certificate.Certificate) < 1 {
+		return nil, nil, nil, errors.New("no certificate to renew")
+	}
+	cert, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if cert.Subject.CommonName != userName {
+		return nil, nil, nil, fmt.Errorf("certificate is for %s, not %s",
+			cert.Subject.CommonName, userName)
+	}
+	// Only the login presents the certificate, so that the other requests
+	// are authenticated by the session alone.
+	loginClient, err := util.GetHttpClientWithCertificate(client, certificate)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var lastError error
+	for _, baseUrl := range targetUrls {
+		if err := budget.Acquire(); err != nil {
+			return nil, nil, nil, err
+		}
+		logger.Printf("attempting to target '%s' for '%s' with certificate\n",
+			baseUrl, userName)
+		sshCert, x509Cert, kubernetesCert, err =
+			getCertsFromServerWithCertificate(signer, userName, baseUrl,
+				skipu2f, addGroups, loginClient, client, userAgentString,
+				logger)
+		if err != nil {
+			logger.Println(err)
+			budget.Record(err)
+			lastError = err
+			continue
+		}
+		return sshCert, x509Cert, kubernetesCert, nil
+	}
+	return nil, nil, nil, &getCredsError{cause: lastError}
+}
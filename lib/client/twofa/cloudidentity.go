@@ -0,0 +1,202 @@
+package twofa
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"github.com/Cloud-Foundations/keymaster/lib/client/awsidentity"
+	"github.com/Cloud-Foundations/keymaster/lib/client/retrybudget"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+const maxMetadataResponseLength = 1 << 20
+
+var (
+	awsMetadataURL   = awsidentity.DefaultMetadataURL
+	gcpMetadataURL   = "http://metadata.google.internal/computeMetadata/v1"
+	azureMetadataURL = "http://169.254.169.254/metadata"
+
+	// The metadata services are link-local, so never use a proxy.
+	metadataClient = &http.Client{
+		Transport: &http.Transport{},
+		Timeout:   10 * time.Second,
+	}
+)
+
+type azureAttestedDocument struct {
+	Signature string `json:"signature"`
+}
+
+func getMetadata(method, metadataUrl string, headers map[string]string) (
+	string, error) {
+	req, err := http.NewRequest(method, metadataUrl, nil)
+	if err != nil {
+		return "", err
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := metadataClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body,
+		maxMetadataResponseLength))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s %s: %s", method, metadataUrl, resp.Status)
+	}
+	return string(body), nil
+}
+
+// getCloudIdentityForm returns the login form fields holding the instance
+// identity of provider, read from its metadata service. baseUrl is the
+// audience of AWS STS requests and GCP identity tokens.
+func getCloudIdentityForm(provider string, baseUrl string) (
+	url.Values, error) {
+	form := url.Values{}
+	form.Add("provider", provider)
+	switch provider {
+	case "aws":
+		identity, err := awsidentity.GetIdentity(metadataClient,
+			awsMetadataURL, baseUrl)
+		if err != nil {
+			return nil, err
+		}
+		form.Add("document", identity.Document)
+		form.Add("signature", identity.Signature)
+		form.Add("sts_request", identity.STSRequest)
+	case "gcp":
+		token, err := getMetadata("GET", gcpMetadataURL+
+			"/instance/service-accounts/default/identity?format=full&audience="+
+			url.QueryEscape(baseUrl),
+			map[string]string{"Metadata-Flavor": "Google"})
+		if err != nil {
+			return nil, err
+		}
+		form.Add("token", strings.TrimSpace(token))
+	case "azure":
+		// The nonce is the current time, which the server requires to be
+		// recent.
+		body, err := getMetadata("GET", azureMetadataURL+
+			"/attested/document?api-version=2020-09-01&nonce="+
+			strconv.FormatInt(time.Now().Unix(), 10),
+			map[string]string{"Metadata": "true"})
+		if err != nil {
+			return nil, err
+		}
+		var document azureAttestedDocument
+		if err := json.Unmarshal([]byte(body), &document); err != nil {
+			return nil, fmt.Errorf("cannot parse attested document: %s", err)
+		}
+		form.Add("signature", document.Signature)
+	default:
+		return nil, fmt.Errorf("unknown cloud provider: %s", provider)
+	}
+	return form, nil
+}
+
+func getCertsFromServerWithCloudIdentity(
+	signer crypto.Signer,
+	userName string,
+	provider string,
+	baseUrl string,
+	addGroups bool,
+	client *http.Client,
+	userAgentString string,
+	logger log.DebugLogger) (sshCert []byte, x509Cert []byte, kubernetesCert []byte, err error) {
+	form, err := getCloudIdentityForm(provider, baseUrl)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	form.Add("username", userName)
+	loginUrl := baseUrl + proto.CloudIdentityLoginPath
+	req, err := http.NewRequest("POST", loginUrl,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	req.Header.Add("Content-Length", strconv.Itoa(len(form.Encode())))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Accept", "application/json")
+	req.Header.Set("User-Agent", userAgentString)
+
+	logger.Debugf(1, "About to start cloud identity login request\n")
+	loginResp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer loginResp.Body.Close()
+	if loginResp.StatusCode == http.StatusNotFound {
+		return nil, nil, nil, fmt.Errorf(
+			"%s does not support cloud identity authentication", baseUrl)
+	}
+	if loginResp.StatusCode != 200 {
+		return nil, nil, nil, parseDeniedResponse(loginResp, loginUrl)
+	}
+	if len(loginResp.Cookies()) < 1 {
+		return nil, nil, nil, errors.New("No cookies from login")
+	}
+	loginJSONResponse := proto.LoginResponse{}
+	err = json.NewDecoder(loginResp.Body).Decode(&loginJSONResponse)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	io.Copy(ioutil.Discard, loginResp.Body)
+	loginResp.Body.Close()
+	advertised := false
+	for _, backend := range loginJSONResponse.CertAuthBackend {
+		if backend == proto.AuthTypeCloudIdentity {
+			advertised = true
+		}
+	}
+	if !advertised {
+		return nil, nil, nil, fmt.Errorf(
+			"%s does not advertise cloud identity authentication", baseUrl)
+	}
+	logger.Debugf(1, "Authentication Phase complete")
+	return getCertsWithCookies(signer, userName, baseUrl, loginResp.Cookies(),
+		addGroups, client, userAgentString, logger)
+}
+
+func getCertFromTargetUrlsWithCloudIdentity(
+	signer crypto.Signer,
+	userName string,
+	provider string,
+	targetUrls []string,
+	addGroups bool,
+	client *http.Client,
+	userAgentString string,
+	budget *retrybudget.Budget,
+	logger log.DebugLogger) (sshCert []byte, x509Cert []byte, kubernetesCert []byte, err error) {
+	for _, baseUrl := range targetUrls {
+		if err := budget.Acquire(); err != nil {
+			return nil, nil, nil, err
+		}
+		logger.Printf("attempting to target '%s' for '%s' with %s identity\n",
+			baseUrl, userName, provider)
+		sshCert, x509Cert, kubernetesCert, err =
+			getCertsFromServerWithCloudIdentity(signer, userName, provider,
+				baseUrl, addGroups, client, userAgentString, logger)
+		if err != nil {
+			logger.Println(err)
+			budget.Record(err)
+			continue
+		}
+		return sshCert, x509Cert, kubernetesCert, nil
+	}
+	return nil, nil, nil, errors.New("Failed to get creds")
+}
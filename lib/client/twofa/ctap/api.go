@@ -0,0 +1,58 @@
+// Package ctap gets assertions from FIDO security keys through libfido2,
+// which speaks CTAP2 to current keys and CTAP1 (U2F) to older ones. All
+// attached keys which may hold one of the credentials are asked at once, so
+// users touch whichever blinks, and PINs are asked for when a key needs
+// one. Progress is reported on the logger. libfido2 is a C library, so
+// builds without cgo find no security keys.
+package ctap
+
+import (
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+)
+
+// Device describes an attached security key.
+type Device struct {
+	Path         string
+	Manufacturer string
+	Product      string
+}
+
+// AssertionRequest asks for an assertion over ClientDataHash by one of
+// CredentialIDs for the relying party RPID. For U2F credentials RPID is the
+// AppID. With UserVerification the user must also be verified, usually with
+// the PIN of the key.
+type AssertionRequest struct {
+	RPID             string
+	ClientDataHash   []byte
+	CredentialIDs    [][]byte
+	UserVerification bool
+}
+
+// Assertion is the answer of the security key Device. AuthData is the
+// authenticator data (not CBOR encoded), which for U2F keys starts with
+// the same hash of the AppID, flags and counter as U2F signature data.
+type Assertion struct {
+	Device       Device
+	CredentialID []byte
+	AuthData     []byte
+	Signature    []byte
+	UserID       []byte
+}
+
+// Devices returns the attached security keys.
+func Devices() ([]Device, error) {
+	return listDevices()
+}
+
+// String returns the name of the key shown to users.
+func (d Device) String() string {
+	return d.string()
+}
+
+// Assert gets an assertion for request from one of the attached security
+// keys. Keys without any of the credentials are skipped; if several keys
+// may hold one, the first touched answers.
+func Assert(request AssertionRequest, logger log.DebugLogger) (
+	*Assertion, error) {
+	return assert(request, logger)
+}
@@ -0,0 +1,162 @@
+package ctap
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log/testlogger"
+)
+
+type fakeAuthenticator struct {
+	credentialID []byte
+	pin          string
+	pinAttempts  int
+}
+
+func (f *fakeAuthenticator) assertion(rpID string, clientDataHash []byte,
+	credentialIDs [][]byte, pin string, opts assertionOptions) (
+	*rawAssertion, error) {
+	var found bool
+	for _, credentialID := range credentialIDs {
+		if bytes.Equal(credentialID, f.credentialID) {
+			found = true
+		}
+	}
+	if !found {
+		return nil, errNoCredentials
+	}
+	if f.pin != "" {
+		if pin == "" {
+			return nil, errPINRequired
+		}
+		if opts.userPresence {
+			f.pinAttempts++
+		}
+		if pin != f.pin {
+			return nil, errPINInvalid
+		}
+	}
+	if !opts.userPresence {
+		return &rawAssertion{}, nil
+	}
+	return &rawAssertion{
+		// A CBOR byte string of length 3.
+		authDataCBOR: []byte{0x43, 1, 2, 3},
+		signature:    []byte("signature"),
+		credentialID: f.credentialID,
+	}, nil
+}
+
+func setupFakes(t *testing.T, authenticators map[string]*fakeAuthenticator,
+	pins ...string) {
+	oldListDevices, oldOpenDevice, oldReadPIN := listDevices, openDevice,
+		readPIN
+	t.Cleanup(func() {
+		listDevices, openDevice, readPIN = oldListDevices, oldOpenDevice,
+			oldReadPIN
+	})
+	listDevices = func() ([]Device, error) {
+		var devices []Device
+		for path := range authenticators {
+			devices = append(devices, Device{Path: path, Product: path})
+		}
+		return devices, nil
+	}
+	openDevice = func(device Device) (authenticator, error) {
+		return authenticators[device.Path], nil
+	}
+	readPIN = func(prompt string) (string, error) {
+		if len(pins) < 1 {
+			t.Fatalf("unexpected PIN prompt: %s", prompt)
+		}
+		pin := pins[0]
+		pins = pins[1:]
+		return pin, nil
+	}
+}
+
+func TestAssert(t *testing.T) {
+	setupFakes(t, map[string]*fakeAuthenticator{
+		"other": {credentialID: []byte("other")},
+		"mine":  {credentialID: []byte("mine")},
+	})
+	assertion, err := Assert(AssertionRequest{
+		RPID:          "keymaster.example.com",
+		CredentialIDs: [][]byte{[]byte("mine")},
+	}, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assertion.Device.Path != "mine" ||
+		!bytes.Equal(assertion.AuthData, []byte{1, 2, 3}) ||
+		string(assertion.Signature) != "signature" {
+		t.Fatalf("unexpected assertion: %+v", assertion)
+	}
+}
+
+func TestAssertNoCredentials(t *testing.T) {
+	setupFakes(t, map[string]*fakeAuthenticator{
+		"other": {credentialID: []byte("other")},
+	})
+	_, err := Assert(AssertionRequest{
+		CredentialIDs: [][]byte{[]byte("mine")},
+	}, testlogger.New(t))
+	if err == nil {
+		t.Fatal("assertion without a registered credential")
+	}
+	setupFakes(t, map[string]*fakeAuthenticator{})
+	if _, err := Assert(AssertionRequest{}, testlogger.New(t)); err == nil {
+		t.Fatal("assertion without security keys")
+	}
+}
+
+func TestAssertPIN(t *testing.T) {
+	mine := &fakeAuthenticator{credentialID: []byte("mine"), pin: "1234"}
+	setupFakes(t, map[string]*fakeAuthenticator{"mine": mine},
+		"4321", "1234")
+	assertion, err := Assert(AssertionRequest{
+		CredentialIDs: [][]byte{[]byte("mine")},
+	}, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assertion.Device.Path != "mine" || mine.pinAttempts != 2 {
+		t.Fatalf("unexpected assertion after %d PIN attempts: %+v",
+			mine.pinAttempts, assertion)
+	}
+	mine.pinAttempts = 0
+	setupFakes(t, map[string]*fakeAuthenticator{"mine": mine},
+		"1", "2", "3")
+	if _, err := Assert(AssertionRequest{
+		CredentialIDs: [][]byte{[]byte("mine")},
+	}, testlogger.New(t)); err == nil {
+		t.Fatal("assertion with wrong PINs")
+	}
+	if mine.pinAttempts != maxPINAttempts {
+		t.Fatalf("%d PIN attempts", mine.pinAttempts)
+	}
+}
+
+func TestDecodeCBORByteString(t *testing.T) {
+	long := make([]byte, 300)
+	for _, test := range []struct {
+		data  []byte
+		value []byte
+		valid bool
+	}{
+		{[]byte{0x43, 1, 2, 3}, []byte{1, 2, 3}, true},
+		{append([]byte{0x59, 1, 44}, long...), long, true},
+		{[]byte{0x44, 1, 2, 3}, nil, false},
+		{[]byte{0x63, 'a', 'b', 'c'}, nil, false},
+		{nil, nil, false},
+	} {
+		value, err := decodeCBORByteString(test.data)
+		if test.valid && err != nil {
+			t.Errorf("%x: %s", test.data, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%x should be invalid", test.data)
+		} else if !bytes.Equal(value, test.value) {
+			t.Errorf("%x: got %x", test.data, value)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package ctap
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"github.com/howeyc/gopass"
+)
+
+// maxPINAttempts limits the PINs asked for each key, so that a key is not
+// blocked by guessing.
+const maxPINAttempts = 3
+
+var (
+	errNoCredentials = errors.New("no credentials")
+	errPINRequired   = errors.New("pin required")
+	errPINInvalid    = errors.New("pin invalid")
+)
+
+// assertionOptions are the options of an assertion request sent to a key.
+type assertionOptions struct {
+	userPresence     bool
+	userVerification bool
+}
+
+// rawAssertion is an assertion as returned by a key.
+type rawAssertion struct {
+	authDataCBOR []byte
+	signature    []byte
+	credentialID []byte
+	userID       []byte
+}
+
+// authenticator is an attached key. It is implemented with libfido2 and
+// replaced in tests.
+type authenticator interface {
+	assertion(rpID string, clientDataHash []byte, credentialIDs [][]byte,
+		pin string, opts assertionOptions) (*rawAssertion, error)
+}
+
+var (
+	// listDevices and openDevice are replaced in tests.
+	listDevices = listLibfido2Devices
+	openDevice  = openLibfido2Device
+	// readPIN is replaced in tests.
+	readPIN = func(prompt string) (string, error) {
+		fmt.Printf("%s: ", prompt)
+		pin, err := gopass.GetPasswd()
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(pin)), nil
+	}
+)
+
+// candidate is a key which may hold one of the credentials.
+type candidate struct {
+	device        Device
+	authenticator authenticator
+	pin           string
+	needsPIN      bool
+	pinAttempts   int
+}
+
+type assertionResult struct {
+	candidate *candidate
+	assertion *rawAssertion
+	err       error
+}
+
+func (d Device) string() string {
+	name := strings.TrimSpace(d.Manufacturer + " " + d.Product)
+	if name == "" {
+		return d.Path
+	}
+	return name
+}
+
+func isPINError(err error) bool {
+	return err == errPINRequired || err == errPINInvalid
+}
+
+// findCandidates returns the keys which may hold one of the credentials.
+// Keys are asked without user presence, so that they do not blink; a key
+// which answers that it holds none is skipped.
+func findCandidates(request AssertionRequest, devices []Device,
+	logger log.DebugLogger) []*candidate {
+	var candidates []*candidate
+	for _, device := range devices {
+		authenticator, err := openDevice(device)
+		if err != nil {
+			logger.Debugf(1, "cannot open %s: %s", device, err)
+			continue
+		}
+		_, err = authenticator.assertion(request.RPID,
+			request.ClientDataHash, request.CredentialIDs, "",
+			assertionOptions{})
+		if err == errNoCredentials {
+			logger.Debugf(0, "%s holds no registered credential", device)
+			continue
+		}
+		candidates = append(candidates, &candidate{
+			device:        device,
+			authenticator: authenticator,
+			needsPIN:      isPINError(err),
+		})
+	}
+	return candidates
+}
+
+// askPIN reads the PIN of c. The message of the previous error, if any, is
+// shown first.
+func askPIN(c *candidate, lastErr error, logger log.DebugLogger) error {
+	if c.pinAttempts >= maxPINAttempts {
+		return fmt.Errorf("%s: too many PIN attempts", c.device)
+	}
+	if lastErr == errPINInvalid {
+		logger.Printf("Wrong PIN for %s", c.device)
+	}
+	c.pinAttempts++
+	pin, err := readPIN(fmt.Sprintf("Enter the PIN of %s", c.device))
+	if err != nil {
+		return err
+	}
+	c.pin = pin
+	c.needsPIN = false
+	return nil
+}
+
+func (c *candidate) getAssertion(request AssertionRequest,
+	results chan<- assertionResult) {
+	opts := assertionOptions{
+		userPresence:     true,
+		userVerification: request.UserVerification && c.pin == "",
+	}
+	assertion, err := c.authenticator.assertion(request.RPID,
+		request.ClientDataHash, request.CredentialIDs, c.pin, opts)
+	results <- assertionResult{candidate: c, assertion: assertion, err: err}
+}
+
+func assert(request AssertionRequest, logger log.DebugLogger) (
+	*Assertion, error) {
+	devices, err := listDevices()
+	if err != nil {
+		return nil, err
+	}
+	if len(devices) < 1 {
+		return nil, errors.New("no security key found")
+	}
+	logger.Debugf(0, "found %d security key(s)", len(devices))
+	candidates := findCandidates(request, devices, logger)
+	if len(candidates) < 1 {
+		return nil, fmt.Errorf(
+			"none of the %d security key(s) holds a registered credential",
+			len(devices))
+	}
+	var lastErr error
+	for len(candidates) > 0 {
+		var active []*candidate
+		for _, c := range candidates {
+			if c.needsPIN {
+				if err := askPIN(c, lastErr, logger); err != nil {
+					lastErr = err
+					continue
+				}
+			}
+			active = append(active, c)
+		}
+		if len(active) < 1 {
+			break
+		}
+		names := make([]string, 0, len(active))
+		for _, c := range active {
+			names = append(names, c.device.String())
+		}
+		if len(active) == 1 {
+			logger.Printf("Touch your security key (%s)", names[0])
+		} else {
+			logger.Printf("Touch whichever security key blinks (%s)",
+				strings.Join(names, ", "))
+		}
+		// The channel is buffered, so that the keys which are not touched
+		// do not block once an assertion is returned.
+		results := make(chan assertionResult, len(active))
+		for _, c := range active {
+			go c.getAssertion(request, results)
+		}
+		candidates = nil
+		for range active {
+			result := <-results
+			if result.err == nil {
+				return makeAssertion(result)
+			}
+			lastErr = fmt.Errorf("%s: %s", result.candidate.device,
+				result.err)
+			if isPINError(result.err) {
+				result.candidate.needsPIN = true
+				candidates = append(candidates, result.candidate)
+				lastErr = result.err
+				continue
+			}
+			logger.Debugf(0, "no assertion from %s: %s",
+				result.candidate.device, result.err)
+		}
+	}
+	return nil, lastErr
+}
+
+func makeAssertion(result assertionResult) (*Assertion, error) {
+	authData, err := decodeCBORByteString(result.assertion.authDataCBOR)
+	if err != nil {
+		return nil, err
+	}
+	return &Assertion{
+		Device:       result.candidate.device,
+		CredentialID: result.assertion.credentialID,
+		AuthData:     authData,
+		Signature:    result.assertion.signature,
+		UserID:       result.assertion.userID,
+	}, nil
+}
+
+// decodeCBORByteString returns the contents of a CBOR encoded byte string.
+// libfido2 returns the authenticator data in this form.
+func decodeCBORByteString(data []byte) ([]byte, error) {
+	if len(data) < 1 {
+		return nil, errors.New("empty CBOR data")
+	}
+	if data[0]>>5 != 2 {
+		return nil, errors.New("CBOR data is not a byte string")
+	}
+	var length uint64
+	var headerLength int
+	switch info := data[0] & 0x1f; {
+	case info < 24:
+		length = uint64(info)
+		headerLength = 1
+	case info <= 27:
+		headerLength = 1 + 1<<(info-24)
+		if len(data) < headerLength {
+			return nil, errors.New("truncated CBOR header")
+		}
+		for _, b := range data[1:headerLength] {
+			length = length<<8 | uint64(b)
+		}
+	default:
+		return nil, errors.New("unsupported CBOR byte string length")
+	}
+	if uint64(len(data)-headerLength) != length {
+		return nil, errors.New("CBOR byte string length mismatch")
+	}
+	return data[headerLength:], nil
+}
@@ -0,0 +1,72 @@
+//go:build cgo
+
+package ctap
+
+import (
+	"github.com/keys-pub/go-libfido2"
+)
+
+type libfido2Device struct {
+	device *libfido2.Device
+}
+
+func listLibfido2Devices() ([]Device, error) {
+	locations, err := libfido2.DeviceLocations()
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]Device, 0, len(locations))
+	for _, location := range locations {
+		devices = append(devices, Device{
+			Path:         location.Path,
+			Manufacturer: location.Manufacturer,
+			Product:      location.Product,
+		})
+	}
+	return devices, nil
+}
+
+func openLibfido2Device(device Device) (authenticator, error) {
+	d, err := libfido2.NewDevice(device.Path)
+	if err != nil {
+		return nil, err
+	}
+	return &libfido2Device{d}, nil
+}
+
+func getLibfido2Option(value bool) libfido2.OptionValue {
+	if value {
+		return libfido2.True
+	}
+	return libfido2.False
+}
+
+func (d *libfido2Device) assertion(rpID string, clientDataHash []byte,
+	credentialIDs [][]byte, pin string, opts assertionOptions) (
+	*rawAssertion, error) {
+	libfido2Opts := &libfido2.AssertionOpts{
+		UP: getLibfido2Option(opts.userPresence),
+	}
+	if opts.userVerification {
+		libfido2Opts.UV = libfido2.True
+	}
+	assertion, err := d.device.Assertion(rpID, clientDataHash, credentialIDs,
+		pin, libfido2Opts)
+	switch err {
+	case nil:
+	case libfido2.ErrNoCredentials:
+		return nil, errNoCredentials
+	case libfido2.ErrPinRequired:
+		return nil, errPINRequired
+	case libfido2.ErrPinInvalid:
+		return nil, errPINInvalid
+	default:
+		return nil, err
+	}
+	return &rawAssertion{
+		authDataCBOR: assertion.AuthDataCBOR,
+		signature:    assertion.Sig,
+		credentialID: assertion.CredentialID,
+		userID:       assertion.User.ID,
+	}, nil
+}
@@ -0,0 +1,18 @@
+//go:build !cgo
+
+package ctap
+
+import (
+	"errors"
+)
+
+var errNotSupported = errors.New(
+	"security keys are not supported by builds without cgo")
+
+func listLibfido2Devices() ([]Device, error) {
+	return nil, errNotSupported
+}
+
+func openLibfido2Device(device Device) (authenticator, error) {
+	return nil, errNotSupported
+}
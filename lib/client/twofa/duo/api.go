@@ -0,0 +1,19 @@
+// Package duo does two factor authentication with Duo Security: a push to
+// the Duo Mobile app or, if that fails, a passcode.
+package duo
+
+import (
+	"net/http"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+)
+
+// DoDuoAuthenticate sends a Duo push and waits for the user to approve it.
+// If the push fails it prompts for a Duo passcode.
+func DoDuoAuthenticate(
+	client *http.Client,
+	baseURL string,
+	userAgentString string,
+	logger log.DebugLogger) error {
+	return doDuoAuthenticate(client, baseURL, userAgentString, logger)
+}
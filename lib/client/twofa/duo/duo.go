@@ -0,0 +1,123 @@
+package duo
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+const (
+	maxAttempts = 3
+	maxPushWait = 60 * time.Second
+)
+
+// pollInterval is replaced in tests.
+var pollInterval = 2 * time.Second
+
+// readCode is replaced in tests.
+var readCode = func() (string, error) {
+	reader := bufio.NewReader(os.Stdin)
+	fmt.Print("Enter Duo passcode: ")
+	codeText, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(codeText), nil
+}
+
+// post posts form to path and returns the response status code.
+func post(client *http.Client, baseURL string, path string, form url.Values,
+	userAgentString string) (int, error) {
+	req, err := http.NewRequest("POST", baseURL+path,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Add("Content-Length", strconv.Itoa(len(form.Encode())))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Accept", "application/json")
+	req.Header.Set("User-Agent", userAgentString)
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	return resp.StatusCode, nil
+}
+
+// doPush returns true if the user approved a push, false if the push failed.
+func doPush(client *http.Client, baseURL string, userAgentString string,
+	logger log.DebugLogger) (bool, error) {
+	deadline := time.Now().Add(maxPushWait)
+	for time.Now().Before(deadline) {
+		status, err := post(client, baseURL, proto.DuoPushPath, url.Values{},
+			userAgentString)
+		if err != nil {
+			return false, err
+		}
+		switch status {
+		case http.StatusOK:
+			return true, nil
+		case http.StatusPreconditionFailed:
+			logger.Debugf(1, "waiting for Duo push approval")
+			time.Sleep(pollInterval)
+		case http.StatusUnauthorized:
+			return false, nil
+		default:
+			return false, fmt.Errorf("got error from Duo push call %d", status)
+		}
+	}
+	return false, nil
+}
+
+func doDuoAuthenticate(
+	client *http.Client,
+	baseURL string,
+	userAgentString string,
+	logger log.DebugLogger) error {
+	logger.Println("Sending Duo push, approve it on your device")
+	ok, err := doPush(client, baseURL, userAgentString, logger)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return nil
+	}
+	logger.Println("Duo push not approved")
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		code, err := readCode()
+		if err != nil {
+			return err
+		}
+		if _, err := strconv.Atoi(code); err != nil {
+			logger.Println("Duo passcode must be numeric")
+			continue
+		}
+		status, err := post(client, baseURL, proto.DuoAuthPath,
+			url.Values{"OTP": {code}}, userAgentString)
+		if err != nil {
+			return err
+		}
+		switch status {
+		case http.StatusOK:
+			return nil
+		case http.StatusUnauthorized:
+			logger.Println("Invalid Duo passcode, please try again")
+		default:
+			return fmt.Errorf("got error from Duo call %d", status)
+		}
+	}
+	return errors.New("Duo authentication failed")
+}
@@ -0,0 +1,75 @@
+package duo
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log/testlogger"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+func TestDoDuoAuthenticatePush(t *testing.T) {
+	origPollInterval := pollInterval
+	defer func() { pollInterval = origPollInterval }()
+	pollInterval = 0
+	polls := 0
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != proto.DuoPushPath {
+				t.Errorf("unexpected request for %s", r.URL.Path)
+			}
+			polls++
+			if polls < 3 {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+			w.Write([]byte(`{"message":"success"}`))
+		}))
+	defer server.Close()
+	err := DoDuoAuthenticate(server.Client(), server.URL, "test-agent",
+		testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if polls != 3 {
+		t.Fatalf("expected 3 push requests, got %d", polls)
+	}
+}
+
+func TestDoDuoAuthenticatePasscode(t *testing.T) {
+	codes := []string{"not-a-code", "111111", "222222"}
+	origReadCode := readCode
+	defer func() { readCode = origReadCode }()
+	readCode = func() (string, error) {
+		code := codes[0]
+		codes = codes[1:]
+		return code, nil
+	}
+	var submitted []string
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case proto.DuoPushPath:
+				w.WriteHeader(http.StatusUnauthorized)
+			case proto.DuoAuthPath:
+				submitted = append(submitted, r.FormValue("OTP"))
+				if r.FormValue("OTP") != "222222" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				w.Write([]byte(`{"message":"success"}`))
+			default:
+				t.Errorf("unexpected request for %s", r.URL.Path)
+			}
+		}))
+	defer server.Close()
+	err := DoDuoAuthenticate(server.Client(), server.URL, "test-agent",
+		testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(submitted) != 2 {
+		t.Fatalf("expected 2 submitted codes, got %v", submitted)
+	}
+}
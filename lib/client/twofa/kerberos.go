@@ -0,0 +1,140 @@
+package twofa
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"github.com/Cloud-Foundations/keymaster/lib/client/retrybudget"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+	krbclient "github.com/jcmturner/gokrb5/v8/client"
+	krbconfig "github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+)
+
+const defaultKrb5ConfigFilename = "/etc/krb5.conf"
+
+// getCCacheFilename returns the credential cache named by $KRB5CCNAME or
+// the default cache of the current user. Only file caches are supported.
+func getCCacheFilename() (string, error) {
+	name := os.Getenv("KRB5CCNAME")
+	if name == "" {
+		uid := os.Getuid()
+		if uid < 0 {
+			return "", errors.New("no default Kerberos credential cache")
+		}
+		return "/tmp/krb5cc_" + strconv.Itoa(uid), nil
+	}
+	if strings.HasPrefix(name, "FILE:") {
+		return name[len("FILE:"):], nil
+	}
+	if index := strings.Index(name, ":"); index > 0 &&
+		!strings.Contains(name[:index], "/") {
+		return "", fmt.Errorf("unsupported Kerberos credential cache: %s",
+			name)
+	}
+	return name, nil
+}
+
+// newKerberosClient returns a Kerberos client using the tickets in the
+// credential cache of the user.
+func newKerberosClient() (*krbclient.Client, error) {
+	configFilename := os.Getenv("KRB5_CONFIG")
+	if configFilename == "" {
+		configFilename = defaultKrb5ConfigFilename
+	}
+	krb5Config, err := krbconfig.Load(configFilename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load Kerberos configuration: %s", err)
+	}
+	ccacheFilename, err := getCCacheFilename()
+	if err != nil {
+		return nil, err
+	}
+	ccache, err := credentials.LoadCCache(ccacheFilename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load Kerberos credential cache: %s",
+			err)
+	}
+	return krbclient.NewFromCCache(ccache, krb5Config,
+		krbclient.DisablePAFXFAST(true))
+}
+
+func getCertsFromServerWithKerberos(
+	signer crypto.Signer,
+	userName string,
+	krb5Client *krbclient.Client,
+	baseUrl string,
+	skip2fa bool,
+	addGroups bool,
+	client *http.Client,
+	userAgentString string,
+	logger log.DebugLogger) (sshCert []byte, x509Cert []byte, kubernetesCert []byte, err error) {
+	loginUrl := baseUrl + proto.LoginPath
+	form := url.Values{}
+	form.Add("username", userName)
+	req, err := http.NewRequest("POST", loginUrl,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	req.Header.Add("Content-Length", strconv.Itoa(len(form.Encode())))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Accept", "application/json")
+	req.Header.Set("User-Agent", userAgentString)
+	// The service principal is HTTP/<host> of the server.
+	if err := spnego.SetSPNEGOHeader(krb5Client, req, ""); err != nil {
+		return nil, nil, nil, err
+	}
+	return getCertsWithLoginRequest(signer, userName, req, baseUrl, skip2fa,
+		addGroups, client, userAgentString, logger)
+}
+
+func getCertFromTargetUrlsWithKerberos(
+	signer crypto.Signer,
+	userName string,
+	targetUrls []string,
+	skipu2f bool,
+	addGroups bool,
+	client *http.Client,
+	userAgentString string,
+	budget *retrybudget.Budget,
+	logger log.DebugLogger) (sshCert []byte, x509Cert []byte, kubernetesCert []byte, err error) {
+	krb5Client, err := newKerberosClient()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer krb5Client.Destroy()
+	principal := krb5Client.Credentials.UserName()
+	if !strings.EqualFold(principal, userName) {
+		return nil, nil, nil, fmt.Errorf(
+			"Kerberos principal %s@%s is not user %s",
+			principal, krb5Client.Credentials.Domain(), userName)
+	}
+	var lastError error
+	for _, baseUrl := range targetUrls {
+		if err := budget.Acquire(); err != nil {
+			return nil, nil, nil, err
+		}
+		logger.Printf("attempting to target '%s' for '%s' with Kerberos\n",
+			baseUrl, userName)
+		sshCert, x509Cert, kubernetesCert, err = getCertsFromServerWithKerberos(
+			signer, userName, krb5Client, baseUrl, skipu2f, addGroups,
+			client, userAgentString, logger)
+		if err != nil {
+			logger.Println(err)
+			budget.Record(err)
+			lastError = err
+			continue
+		}
+		return sshCert, x509Cert, kubernetesCert, nil
+	}
+	return nil, nil, nil, &getCredsError{cause: lastError}
+}
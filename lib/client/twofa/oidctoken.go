@@ -0,0 +1,189 @@
+package twofa
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"github.com/Cloud-Foundations/keymaster/lib/client/retrybudget"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+type oidcTokenHeader struct {
+	Algorithm string `json:"alg"`
+}
+
+type oidcTokenClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+func decodeTokenSegment(segment string, value interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(
+		strings.TrimRight(segment, "="))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
+
+// checkOIDCTokenFormat verifies that token is a signed, unexpired JWT with an
+// issuer and subject. The signature itself is verified by the server.
+func checkOIDCTokenFormat(token []byte) error {
+	segments := strings.Split(string(bytes.TrimSpace(token)), ".")
+	if len(segments) != 3 {
+		return errors.New("OIDC token is not a JWT")
+	}
+	var header oidcTokenHeader
+	if err := decodeTokenSegment(segments[0], &header); err != nil {
+		return fmt.Errorf("cannot decode OIDC token header: %s", err)
+	}
+	if header.Algorithm == "" || strings.EqualFold(header.Algorithm, "none") {
+		return errors.New("OIDC token is not signed")
+	}
+	var claims oidcTokenClaims
+	if err := decodeTokenSegment(segments[1], &claims); err != nil {
+		return fmt.Errorf("cannot decode OIDC token claims: %s", err)
+	}
+	if claims.Issuer == "" || claims.Subject == "" {
+		return errors.New("OIDC token has no issuer or subject")
+	}
+	if claims.ExpiresAt == 0 {
+		return errors.New("OIDC token has no expiry")
+	}
+	if expires := time.Unix(claims.ExpiresAt, 0); time.Now().After(expires) {
+		return fmt.Errorf("OIDC token expired at %s", expires)
+	}
+	if len(segments[2]) < 1 {
+		return errors.New("OIDC token has no signature")
+	}
+	return nil
+}
+
+// checkOIDCTokenAdvertised returns an error if the server at baseUrl does not
+// advertise OIDC token logins, so that tokens are only sent to servers which
+// accept them.
+func checkOIDCTokenAdvertised(baseUrl string, client *http.Client,
+	userAgentString string) error {
+	loginUrl := baseUrl + proto.OIDCTokenLoginPath
+	req, err := http.NewRequest("GET", loginUrl, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Accept", "application/json")
+	req.Header.Set("User-Agent", userAgentString)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%s does not support OIDC token authentication",
+			baseUrl)
+	}
+	if resp.StatusCode != 200 {
+		return parseDeniedResponse(resp, loginUrl)
+	}
+	var loginJSONResponse proto.LoginResponse
+	if err := json.NewDecoder(resp.Body).Decode(&loginJSONResponse); err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	for _, backend := range loginJSONResponse.CertAuthBackend {
+		if backend == proto.AuthTypeOIDCToken {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s does not advertise OIDC token authentication",
+		baseUrl)
+}
+
+func getCertsFromServerWithOIDCToken(
+	signer crypto.Signer,
+	userName string,
+	oidcToken []byte,
+	baseUrl string,
+	addGroups bool,
+	client *http.Client,
+	userAgentString string,
+	logger log.DebugLogger) (sshCert []byte, x509Cert []byte, kubernetesCert []byte, err error) {
+	if err := checkOIDCTokenAdvertised(baseUrl, client,
+		userAgentString); err != nil {
+		return nil, nil, nil, err
+	}
+	loginUrl := baseUrl + proto.OIDCTokenLoginPath
+	form := url.Values{}
+	form.Add("username", userName)
+	form.Add("token", string(bytes.TrimSpace(oidcToken)))
+	req, err := http.NewRequest("POST", loginUrl,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	req.Header.Add("Content-Length", strconv.Itoa(len(form.Encode())))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Accept", "application/json")
+	req.Header.Set("User-Agent", userAgentString)
+
+	logger.Debugf(1, "About to start OIDC token login request\n")
+	loginResp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer loginResp.Body.Close()
+	if loginResp.StatusCode != 200 {
+		return nil, nil, nil, parseDeniedResponse(loginResp, loginUrl)
+	}
+	if len(loginResp.Cookies()) < 1 {
+		return nil, nil, nil, errors.New("No cookies from login")
+	}
+	io.Copy(ioutil.Discard, loginResp.Body)
+	loginResp.Body.Close()
+	logger.Debugf(1, "Authentication Phase complete")
+	return getCertsWithCookies(signer, userName, baseUrl, loginResp.Cookies(),
+		addGroups, client, userAgentString, logger)
+}
+
+func getCertFromTargetUrlsWithOIDCToken(
+	signer crypto.Signer,
+	userName string,
+	oidcToken []byte,
+	targetUrls []string,
+	addGroups bool,
+	client *http.Client,
+	userAgentString string,
+	budget *retrybudget.Budget,
+	logger log.DebugLogger) (sshCert []byte, x509Cert []byte, kubernetesCert []byte, err error) {
+	if err := checkOIDCTokenFormat(oidcToken); err != nil {
+		return nil, nil, nil, err
+	}
+	for _, baseUrl := range targetUrls {
+		if err := budget.Acquire(); err != nil {
+			return nil, nil, nil, err
+		}
+		logger.Printf("attempting to target '%s' for '%s' with OIDC token\n",
+			baseUrl, userName)
+		sshCert, x509Cert, kubernetesCert, err = getCertsFromServerWithOIDCToken(
+			signer, userName, oidcToken, baseUrl, addGroups,
+			client, userAgentString, logger)
+		if err != nil {
+			logger.Println(err)
+			budget.Record(err)
+			continue
+		}
+		return sshCert, x509Cert, kubernetesCert, nil
+	}
+	return nil, nil, nil, errors.New("Failed to get creds")
+}
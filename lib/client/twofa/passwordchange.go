@@ -0,0 +1,98 @@
+package twofa
+
+import (
+	"bytes"
+	"crypto"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+	"github.com/howeyc/gopass"
+)
+
+// readNewPassword is replaced in tests.
+var readNewPassword = func(userName string) ([]byte, error) {
+	fmt.Printf("Password for %s has expired or must be changed\n", userName)
+	fmt.Print("New password: ")
+	password, err := gopass.GetPasswd()
+	if err != nil {
+		return nil, err
+	}
+	fmt.Print("Confirm new password: ")
+	confirmation, err := gopass.GetPasswd()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(password, confirmation) {
+		return nil, errors.New("new passwords do not match")
+	}
+	if len(password) < 1 {
+		return nil, errors.New("empty new password")
+	}
+	return password, nil
+}
+
+func newPasswordChangeRequest(userName string, oldPassword []byte,
+	newPassword []byte, baseUrl string,
+	userAgentString string) (*http.Request, error) {
+	form := url.Values{}
+	form.Add("username", userName)
+	form.Add("password", string(oldPassword))
+	form.Add("new_password", string(newPassword))
+	req, err := http.NewRequest("POST", baseUrl+proto.ChangePasswordPath,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Length", strconv.Itoa(len(form.Encode())))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Accept", "application/json")
+	req.Header.Set("User-Agent", userAgentString)
+	return req, nil
+}
+
+// doPasswordLoginRequest logs in to baseUrl with password. If the server
+// requires the password to be changed first, the user is asked for a new
+// password, which replaces password for the login.
+func doPasswordLoginRequest(
+	signer crypto.Signer,
+	userName string,
+	password []byte,
+	baseUrl string,
+	skip2fa bool,
+	client *http.Client,
+	userAgentString string,
+	logger log.DebugLogger) ([]*http.Cookie, error) {
+	req, err := newPasswordLoginRequest(userName, password, baseUrl,
+		userAgentString)
+	if err != nil {
+		return nil, err
+	}
+	authCookies, err := doLoginRequest(signer, req, baseUrl, skip2fa, client,
+		userAgentString, logger)
+	denied, ok := err.(*DeniedError)
+	if !ok || denied.ReasonCode != proto.DenialReasonPasswordMustChange {
+		return authCookies, err
+	}
+	newPassword, err := readNewPassword(userName)
+	if err != nil {
+		return nil, err
+	}
+	req, err = newPasswordChangeRequest(userName, password, newPassword,
+		baseUrl, userAgentString)
+	if err != nil {
+		return nil, err
+	}
+	authCookies, err = doLoginRequest(signer, req, baseUrl, skip2fa, client,
+		userAgentString, logger)
+	if err != nil {
+		return nil, err
+	}
+	logger.Printf("Changed password of %s", userName)
+	return authCookies, nil
+}
@@ -0,0 +1,111 @@
+package twofa
+
+import (
+	"context"
+	"crypto"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"github.com/Cloud-Foundations/keymaster/lib/client/serverlatency"
+)
+
+// raceResult is the answer of one server to a raced x509 cert request.
+type raceResult struct {
+	baseUrl  string
+	x509Cert []byte
+	latency  time.Duration
+	err      error
+}
+
+// getSessionCookies returns the cookies of the session with baseUrl for
+// sending to the other servers. After a second factor the upgraded cookies
+// are only in the cookie jar of client.
+func getSessionCookies(client *http.Client, baseUrl string,
+	loginCookies []*http.Cookie) []*http.Cookie {
+	if client.Jar == nil {
+		return loginCookies
+	}
+	parsedUrl, err := url.Parse(baseUrl)
+	if err != nil {
+		return loginCookies
+	}
+	if cookies := client.Jar.Cookies(parsedUrl); len(cookies) > 0 {
+		return cookies
+	}
+	return loginCookies
+}
+
+// raceCertsFromServers logs in to baseUrl and then requests the x509 cert
+// from all targetUrls concurrently with the session of the login. The other
+// certs are requested from the server which answered first. The latency of
+// every server which answered before it, or failed, is recorded in
+// latencies.
+func raceCertsFromServers(
+	signer crypto.Signer,
+	userName string,
+	password []byte,
+	baseUrl string,
+	targetUrls []string,
+	skip2fa bool,
+	addGroups bool,
+	client *http.Client,
+	userAgentString string,
+	latencies *serverlatency.Latencies,
+	logger log.DebugLogger) (sshCert []byte, x509Cert []byte, kubernetesCert []byte, err error) {
+	loginCookies, err := doPasswordLoginRequest(signer, userName, password,
+		baseUrl, skip2fa, client, userAgentString, logger)
+	if err != nil {
+		if _, ok := err.(*DeniedError); !ok {
+			latencies.RecordFailure(baseUrl)
+		}
+		return nil, nil, nil, err
+	}
+	authCookies := getSessionCookies(client, baseUrl, loginCookies)
+	pemKey, err := getPEMPublicKey(signer)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := make(chan raceResult, len(targetUrls))
+	for _, targetUrl := range targetUrls {
+		go func(targetUrl string) {
+			startTime := time.Now()
+			x509Cert, err := doCertRequestWithContext(ctx, client, authCookies,
+				getX509CertURL(targetUrl, userName, addGroups), pemKey,
+				userAgentString, logger)
+			results <- raceResult{
+				baseUrl:  targetUrl,
+				x509Cert: x509Cert,
+				latency:  time.Since(startTime),
+				err:      err,
+			}
+		}(targetUrl)
+	}
+	var lastError error
+	for range targetUrls {
+		result := <-results
+		if result.err != nil {
+			logger.Debugf(1, "x509 cert request to %s failed: %s",
+				result.baseUrl, result.err)
+			latencies.RecordFailure(result.baseUrl)
+			lastError = result.err
+			continue
+		}
+		// The slower requests are abandoned.
+		cancel()
+		latencies.Record(result.baseUrl, result.latency)
+		logger.Debugf(1, "using %s, which answered first in %s",
+			result.baseUrl, result.latency)
+		sshCert, kubernetesCert, err := getRemainingCertsWithCookies(signer,
+			userName, result.baseUrl, pemKey, authCookies, client,
+			userAgentString, logger)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return sshCert, result.x509Cert, kubernetesCert, nil
+	}
+	return nil, nil, nil, lastError
+}
@@ -0,0 +1,20 @@
+// Package radius does two factor authentication with a one time password,
+// such as an RSA SecurID passcode, which the server checks with RADIUS.
+package radius
+
+import (
+	"net/http"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+)
+
+// DoRADIUSAuthenticate prompts for a passcode and submits it as second
+// factor, answering any challenges (next token code, new PIN) from the
+// RADIUS server.
+func DoRADIUSAuthenticate(
+	client *http.Client,
+	baseURL string,
+	userAgentString string,
+	logger log.DebugLogger) error {
+	return doRADIUSAuthenticate(client, baseURL, userAgentString, logger)
+}
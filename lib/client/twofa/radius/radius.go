@@ -0,0 +1,113 @@
+package radius
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+	"github.com/howeyc/gopass"
+)
+
+const (
+	defaultPrompt = "Enter passcode"
+	maxAttempts   = 3
+	// maxChallenges limits the challenges answered for one passcode.
+	maxChallenges = 5
+)
+
+// readCode is replaced in tests.
+var readCode = func(prompt string) (string, error) {
+	fmt.Printf("%s: ", strings.TrimRight(prompt, ": "))
+	code, err := gopass.GetPasswd()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(code)), nil
+}
+
+// submitCode posts code and returns the challenge of the server, which has
+// an empty State on success, or nil if the code was rejected.
+func submitCode(client *http.Client, baseURL string, code string,
+	state string, userAgentString string) (*proto.RADIUSChallenge, error) {
+	form := url.Values{}
+	form.Add("OTP", code)
+	if state != "" {
+		form.Add("state", state)
+	}
+	req, err := http.NewRequest("POST", baseURL+proto.RADIUSAuthPath,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Length", strconv.Itoa(len(form.Encode())))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Accept", "application/json")
+	req.Header.Set("User-Agent", userAgentString)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	defer io.Copy(ioutil.Discard, resp.Body)
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var challenge proto.RADIUSChallenge
+		if err := json.NewDecoder(resp.Body).Decode(&challenge); err != nil {
+			return nil, err
+		}
+		return &challenge, nil
+	case http.StatusUnauthorized:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("got error from RADIUS call %s", resp.Status)
+}
+
+func doRADIUSAuthenticate(
+	client *http.Client,
+	baseURL string,
+	userAgentString string,
+	logger log.DebugLogger) error {
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		prompt := defaultPrompt
+		var state string
+		for challenges := 0; ; challenges++ {
+			code, err := readCode(prompt)
+			if err != nil {
+				return err
+			}
+			if code == "" {
+				logger.Println("Empty passcode")
+				break
+			}
+			challenge, err := submitCode(client, baseURL, code, state,
+				userAgentString)
+			if err != nil {
+				return err
+			}
+			if challenge == nil {
+				logger.Println("Invalid passcode, please try again")
+				break
+			}
+			if challenge.State == "" {
+				return nil
+			}
+			if challenges >= maxChallenges {
+				return errors.New("too many RADIUS challenges")
+			}
+			prompt = challenge.Message
+			if prompt == "" {
+				prompt = defaultPrompt
+			}
+			state = challenge.State
+		}
+	}
+	return errors.New("RADIUS authentication failed")
+}
@@ -0,0 +1,80 @@
+package radius
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log/testlogger"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+func TestDoRADIUSAuthenticateChallenge(t *testing.T) {
+	codes := []string{"bad-code", "challenge", "987654"}
+	var prompts []string
+	origReadCode := readCode
+	defer func() { readCode = origReadCode }()
+	readCode = func(prompt string) (string, error) {
+		prompts = append(prompts, prompt)
+		code := codes[0]
+		codes = codes[1:]
+		return code, nil
+	}
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != proto.RADIUSAuthPath {
+				t.Errorf("unexpected request for %s", r.URL.Path)
+			}
+			switch {
+			case r.FormValue("OTP") == "challenge":
+				json.NewEncoder(w).Encode(proto.RADIUSChallenge{
+					Message: "Enter next code",
+					State:   "state-key",
+				})
+			case r.FormValue("OTP") == "987654" &&
+				r.FormValue("state") == "state-key":
+				json.NewEncoder(w).Encode(proto.RADIUSChallenge{
+					Message: "success",
+				})
+			default:
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+		}))
+	defer server.Close()
+	err := DoRADIUSAuthenticate(server.Client(), server.URL, "test-agent",
+		testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != 0 {
+		t.Fatalf("unused codes: %v", codes)
+	}
+	if len(prompts) != 3 || prompts[1] != defaultPrompt ||
+		prompts[2] != "Enter next code" {
+		t.Fatalf("unexpected prompts: %v", prompts)
+	}
+}
+
+func TestDoRADIUSAuthenticateFails(t *testing.T) {
+	origReadCode := readCode
+	defer func() { readCode = origReadCode }()
+	attempts := 0
+	readCode = func(prompt string) (string, error) {
+		attempts++
+		return "000000", nil
+	}
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+		}))
+	defer server.Close()
+	err := DoRADIUSAuthenticate(server.Client(), server.URL, "test-agent",
+		testlogger.New(t))
+	if err == nil {
+		t.Fatal("should have failed")
+	}
+	if attempts != maxAttempts {
+		t.Fatalf("expected %d attempts, got %d", maxAttempts, attempts)
+	}
+}
@@ -0,0 +1,19 @@
+// Package recovery does two factor authentication with a one-time recovery
+// code, for users who lost their devices.
+package recovery
+
+import (
+	"net/http"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+)
+
+// DoRecoveryCodeAuthenticate prompts for a recovery code and submits it as
+// second factor. The server invalidates an accepted code.
+func DoRecoveryCodeAuthenticate(
+	client *http.Client,
+	baseURL string,
+	userAgentString string,
+	logger log.DebugLogger) error {
+	return doRecoveryCodeAuthenticate(client, baseURL, userAgentString, logger)
+}
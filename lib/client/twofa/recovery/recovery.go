@@ -0,0 +1,82 @@
+package recovery
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+	"github.com/howeyc/gopass"
+)
+
+const maxAttempts = 3
+
+// readCode is replaced in tests.
+var readCode = func() (string, error) {
+	fmt.Print("Enter recovery code: ")
+	code, err := gopass.GetPasswd()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(code)), nil
+}
+
+// submitCode posts code and returns the response status code.
+func submitCode(client *http.Client, baseURL string, code string,
+	userAgentString string) (int, error) {
+	form := url.Values{}
+	form.Add("OTP", code)
+	req, err := http.NewRequest("POST", baseURL+proto.RecoveryCodeAuthPath,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Add("Content-Length", strconv.Itoa(len(form.Encode())))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Accept", "application/json")
+	req.Header.Set("User-Agent", userAgentString)
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	return resp.StatusCode, nil
+}
+
+func doRecoveryCodeAuthenticate(
+	client *http.Client,
+	baseURL string,
+	userAgentString string,
+	logger log.DebugLogger) error {
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		code, err := readCode()
+		if err != nil {
+			return err
+		}
+		if code == "" {
+			continue
+		}
+		status, err := submitCode(client, baseURL, code, userAgentString)
+		if err != nil {
+			return err
+		}
+		switch status {
+		case http.StatusOK:
+			logger.Println(
+				"Recovery code accepted, it cannot be used again")
+			return nil
+		case http.StatusUnauthorized:
+			logger.Println("Invalid recovery code, please try again")
+		default:
+			return fmt.Errorf("got error from recovery code call %d", status)
+		}
+	}
+	return errors.New("recovery code authentication failed")
+}
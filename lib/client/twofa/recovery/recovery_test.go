@@ -0,0 +1,66 @@
+package recovery
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log/testlogger"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+func setReadCode(t *testing.T, codes []string) {
+	origReadCode := readCode
+	t.Cleanup(func() { readCode = origReadCode })
+	readCode = func() (string, error) {
+		code := codes[0]
+		codes = codes[1:]
+		return code, nil
+	}
+}
+
+func newTestServer(t *testing.T, submitted *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != proto.RecoveryCodeAuthPath {
+				t.Errorf("unexpected request for %s", r.URL.Path)
+			}
+			*submitted = append(*submitted, r.FormValue("OTP"))
+			if r.FormValue("OTP") != "abcde-fghjk" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"message":"success"}`))
+		}))
+}
+
+func TestDoRecoveryCodeAuthenticate(t *testing.T) {
+	setReadCode(t, []string{"", "wrong", "abcde-fghjk"})
+	var submitted []string
+	server := newTestServer(t, &submitted)
+	defer server.Close()
+	err := DoRecoveryCodeAuthenticate(server.Client(), server.URL,
+		"test-agent", testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(submitted) != 2 {
+		t.Fatalf("expected 2 submitted codes, got %v", submitted)
+	}
+}
+
+func TestDoRecoveryCodeAuthenticateFailure(t *testing.T) {
+	setReadCode(t, []string{"wrong1", "wrong2", "wrong3"})
+	var submitted []string
+	server := newTestServer(t, &submitted)
+	defer server.Close()
+	err := DoRecoveryCodeAuthenticate(server.Client(), server.URL,
+		"test-agent", testlogger.New(t))
+	if err == nil {
+		t.Fatal("expected authentication to fail")
+	}
+	if len(submitted) != maxAttempts {
+		t.Fatalf("expected %d submitted codes, got %v", maxAttempts,
+			submitted)
+	}
+}
@@ -0,0 +1,177 @@
+package twofa
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"github.com/Cloud-Foundations/keymaster/lib/client/retrybudget"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+// readServiceAccountToken returns the refresh token in filename and the name
+// of the service account it belongs to.
+func readServiceAccountToken(filename string) (string, string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", "", err
+	}
+	token := strings.TrimSpace(string(data))
+	fields := strings.Split(token, ".")
+	if len(fields) != 3 || fields[0] == "" {
+		return "", "", fmt.Errorf("%s: malformed service account token",
+			filename)
+	}
+	return token, fields[0], nil
+}
+
+// writeServiceAccountToken atomically replaces the token in filename,
+// keeping the permissions of the file.
+func writeServiceAccountToken(filename string, token string) error {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(filename),
+		filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if err := tmpFile.Chmod(fi.Mode().Perm()); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if _, err := tmpFile.Write([]byte(token + "\n")); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), filename)
+}
+
+func getCertsFromServerWithServiceAccountToken(
+	signer crypto.Signer,
+	userName string,
+	tokenFilename string,
+	baseUrl string,
+	addGroups bool,
+	client *http.Client,
+	userAgentString string,
+	logger log.DebugLogger) (sshCert []byte, x509Cert []byte, kubernetesCert []byte, err error) {
+	// The token is read again for every server, since a login elsewhere
+	// rotates it.
+	token, _, err := readServiceAccountToken(tokenFilename)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	form := url.Values{}
+	form.Add("token", token)
+	loginUrl := baseUrl + proto.ServiceAccountLoginPath
+	req, err := http.NewRequest("POST", loginUrl,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	req.Header.Add("Content-Length", strconv.Itoa(len(form.Encode())))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Accept", "application/json")
+	req.Header.Set("User-Agent", userAgentString)
+
+	logger.Debugf(1, "About to start service account login request\n")
+	loginResp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer loginResp.Body.Close()
+	if loginResp.StatusCode == http.StatusNotFound {
+		return nil, nil, nil, fmt.Errorf(
+			"%s does not support service account authentication", baseUrl)
+	}
+	if loginResp.StatusCode != 200 {
+		return nil, nil, nil, parseDeniedResponse(loginResp, loginUrl)
+	}
+	if len(loginResp.Cookies()) < 1 {
+		return nil, nil, nil, errors.New("No cookies from login")
+	}
+	loginJSONResponse := proto.LoginResponse{}
+	err = json.NewDecoder(loginResp.Body).Decode(&loginJSONResponse)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	io.Copy(ioutil.Discard, loginResp.Body)
+	loginResp.Body.Close()
+	// The old token is no longer valid, so save the new one before anything
+	// else can fail.
+	if loginJSONResponse.RefreshToken != "" {
+		err := writeServiceAccountToken(tokenFilename,
+			loginJSONResponse.RefreshToken)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf(
+				"cannot save rotated service account token: %s", err)
+		}
+	}
+	advertised := false
+	for _, backend := range loginJSONResponse.CertAuthBackend {
+		if backend == proto.AuthTypeServiceAccount {
+			advertised = true
+		}
+	}
+	if !advertised {
+		return nil, nil, nil, fmt.Errorf(
+			"%s does not advertise service account authentication", baseUrl)
+	}
+	logger.Debugf(1, "Authentication Phase complete")
+	return getCertsWithCookies(signer, userName, baseUrl, loginResp.Cookies(),
+		addGroups, client, userAgentString, logger)
+}
+
+func getCertFromTargetUrlsWithServiceAccountToken(
+	signer crypto.Signer,
+	userName string,
+	tokenFilename string,
+	targetUrls []string,
+	addGroups bool,
+	client *http.Client,
+	userAgentString string,
+	budget *retrybudget.Budget,
+	logger log.DebugLogger) (sshCert []byte, x509Cert []byte, kubernetesCert []byte, err error) {
+	_, accountName, err := readServiceAccountToken(tokenFilename)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if accountName != userName {
+		return nil, nil, nil, fmt.Errorf(
+			"token is for service account %s, not %s", accountName, userName)
+	}
+	for _, baseUrl := range targetUrls {
+		if err := budget.Acquire(); err != nil {
+			return nil, nil, nil, err
+		}
+		logger.Printf("attempting to target '%s' for service account '%s'\n",
+			baseUrl, userName)
+		sshCert, x509Cert, kubernetesCert, err =
+			getCertsFromServerWithServiceAccountToken(signer, userName,
+				tokenFilename, baseUrl, addGroups, client, userAgentString,
+				logger)
+		if err != nil {
+			logger.Println(err)
+			budget.Record(err)
+			continue
+		}
+		return sshCert, x509Cert, kubernetesCert, nil
+	}
+	return nil, nil, nil, errors.New("Failed to get creds")
+}
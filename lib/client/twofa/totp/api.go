@@ -0,0 +1,18 @@
+// Package totp does two factor authentication with a TOTP code.
+package totp
+
+import (
+	"net/http"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+)
+
+// DoTOTPAuthenticate prompts for a TOTP code and submits it as second
+// factor.
+func DoTOTPAuthenticate(
+	client *http.Client,
+	baseURL string,
+	userAgentString string,
+	logger log.DebugLogger) error {
+	return doTOTPAuthenticate(client, baseURL, userAgentString, logger)
+}
@@ -0,0 +1,94 @@
+package totp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+const maxAttempts = 3
+
+// readCode is replaced in tests.
+var readCode = func() (string, error) {
+	reader := bufio.NewReader(os.Stdin)
+	fmt.Print("Enter TOTP code: ")
+	codeText, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(codeText), nil
+}
+
+func checkCodeFormat(code string) error {
+	if len(code) != 6 {
+		return errors.New("TOTP code must be 6 digits")
+	}
+	if _, err := strconv.Atoi(code); err != nil {
+		return errors.New("TOTP code must be 6 digits")
+	}
+	return nil
+}
+
+func submitCode(client *http.Client, baseURL string, code string,
+	userAgentString string) (bool, error) {
+	form := url.Values{}
+	form.Add("OTP", code)
+	req, err := http.NewRequest("POST", baseURL+proto.TOTPAuthPath,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Add("Content-Length", strconv.Itoa(len(form.Encode())))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Accept", "application/json")
+	req.Header.Set("User-Agent", userAgentString)
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusUnauthorized:
+		return false, nil
+	}
+	return false, fmt.Errorf("got error from TOTP call %s", resp.Status)
+}
+
+func doTOTPAuthenticate(
+	client *http.Client,
+	baseURL string,
+	userAgentString string,
+	logger log.DebugLogger) error {
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		code, err := readCode()
+		if err != nil {
+			return err
+		}
+		if err := checkCodeFormat(code); err != nil {
+			logger.Println(err)
+			continue
+		}
+		ok, err := submitCode(client, baseURL, code, userAgentString)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		logger.Println("Invalid TOTP code, please try again")
+	}
+	return errors.New("TOTP authentication failed")
+}
@@ -0,0 +1,43 @@
+package totp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log/testlogger"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+func TestDoTOTPAuthenticateRetriesInvalidCode(t *testing.T) {
+	codes := []string{"12345", "111111", "222222"}
+	origReadCode := readCode
+	defer func() { readCode = origReadCode }()
+	readCode = func() (string, error) {
+		code := codes[0]
+		codes = codes[1:]
+		return code, nil
+	}
+	var submitted []string
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != proto.TOTPAuthPath {
+				t.Errorf("unexpected request for %s", r.URL.Path)
+			}
+			submitted = append(submitted, r.FormValue("OTP"))
+			if r.FormValue("OTP") != "222222" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"message":"success"}`))
+		}))
+	defer server.Close()
+	err := DoTOTPAuthenticate(server.Client(), server.URL, "test-agent",
+		testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(submitted) != 2 {
+		t.Fatalf("expected 2 submitted codes, got %v", submitted)
+	}
+}
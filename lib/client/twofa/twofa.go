@@ -2,7 +2,12 @@ package twofa
 
 import (
 	"bytes"
+	"context"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
@@ -17,12 +22,20 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"github.com/Cloud-Foundations/keymaster/lib/client/retrybudget"
+	"github.com/Cloud-Foundations/keymaster/lib/client/twofa/ctap"
+	"github.com/Cloud-Foundations/keymaster/lib/client/twofa/duo"
+	"github.com/Cloud-Foundations/keymaster/lib/client/twofa/radius"
+	"github.com/Cloud-Foundations/keymaster/lib/client/twofa/recovery"
+	"github.com/Cloud-Foundations/keymaster/lib/client/twofa/totp"
 	"github.com/Cloud-Foundations/keymaster/lib/client/twofa/u2f"
 	"github.com/Cloud-Foundations/keymaster/lib/client/twofa/vip"
+	"github.com/Cloud-Foundations/keymaster/lib/client/twofa/webauthn"
+	"github.com/Cloud-Foundations/keymaster/lib/client/twofa/webhook"
 	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
-	"github.com/flynn/u2f/u2fhid" // client side (interface with hardware)
 	"golang.org/x/crypto/ssh"
 )
 
@@ -52,6 +65,11 @@ func createKeyBodyRequest(method, urlStr, filedata string) (*http.Request, error
 	if err != nil {
 		return nil, err
 	}
+	if *profile != "" {
+		if err := bodyWriter.WriteField("profile", *profile); err != nil {
+			return nil, err
+		}
+	}
 
 	contentType := bodyWriter.FormDataContentType()
 	bodyWriter.Close()
@@ -65,18 +83,235 @@ func createKeyBodyRequest(method, urlStr, filedata string) (*http.Request, error
 	return req, nil
 }
 
+const maxDenialBodySize = 4096
+
+// secondFactorBackends are the advertised backends which satisfy the second
+// factor requirement.
+var secondFactorBackends = []string{
+	proto.AuthTypeU2F,
+	proto.AuthTypeWebAuthn,
+	proto.AuthTypeOkta2FA,
+	proto.AuthTypeSymantecVIP,
+	proto.AuthTypeTOTP,
+	proto.AuthTypeRADIUS,
+	proto.AuthTypeDuo,
+	proto.AuthTypeWebhook,
+	proto.AuthTypeRecoveryCode,
+}
+
+// u2fDeviceCount is replaced in tests.
+var u2fDeviceCount = func() (int, error) {
+	devices, err := ctap.Devices()
+	return len(devices), err
+}
+
+// webauthnDeviceCount is replaced in tests.
+var webauthnDeviceCount = webauthn.DeviceCount
+
+func (e *NoUsableFactorError) error() string {
+	if len(e.Required) < 1 {
+		return "server requires a second factor but advertised none"
+	}
+	reasons := make([]string, 0, len(e.Required))
+	for _, factor := range e.Required {
+		reasons = append(reasons, factor+": "+e.Unusable[factor])
+	}
+	return fmt.Sprintf(
+		"server requires one of %s as second factor, none usable here (%s)",
+		strings.Join(e.Required, ", "), strings.Join(reasons, "; "))
+}
+
+// getCredsError is returned when no server issued certificates. The text is
+// kept short for display while cause (the *DeniedError if any server denied
+// the request, otherwise the last failure) remains available to errors.Is
+// and errors.As.
+type getCredsError struct {
+	message string
+	cause   error
+}
+
+func (e *getCredsError) Error() string {
+	return "Failed to get creds" + e.message
+}
+
+func (e *getCredsError) Unwrap() error {
+	return e.cause
+}
+
+// getUsableSecondFactors returns the advertised second factors this client
+// can use. If there are none a *NoUsableFactorError is returned.
+func getUsableSecondFactors(backends []string) (map[string]bool, error) {
+	advertised := make(map[string]bool)
+	for _, backend := range backends {
+		advertised[backend] = true
+	}
+	usable := make(map[string]bool)
+	noUsableFactorError := &NoUsableFactorError{
+		Unusable: make(map[string]string),
+	}
+	for _, factor := range secondFactorBackends {
+		if !advertised[factor] {
+			continue
+		}
+		noUsableFactorError.Required = append(noUsableFactorError.Required,
+			factor)
+		var reason string
+		switch factor {
+		case proto.AuthTypeU2F:
+			reason = u2fUnusableReason()
+		case proto.AuthTypeWebAuthn, proto.AuthTypeOkta2FA:
+			reason = webauthnUnusableReason()
+		case proto.AuthTypeSymantecVIP:
+			if *noVIPAccess {
+				reason = "disabled by -noVIPAccess"
+			} else if nonInteractive {
+				reason = "requires a prompt in non-interactive mode"
+			}
+		case proto.AuthTypeTOTP:
+			if *noTOTP {
+				reason = "disabled by -noTOTP"
+			} else if nonInteractive {
+				reason = "requires a prompt in non-interactive mode"
+			}
+		case proto.AuthTypeRADIUS:
+			if *noRADIUS {
+				reason = "disabled by -noRADIUS"
+			} else if nonInteractive {
+				reason = "requires a prompt in non-interactive mode"
+			}
+		case proto.AuthTypeDuo:
+			if *noDuo {
+				reason = "disabled by -noDuo"
+			} else if nonInteractive {
+				reason = "requires a prompt in non-interactive mode"
+			}
+		case proto.AuthTypeWebhook:
+			if *noWebhook {
+				reason = "disabled by -noWebhook"
+			} else if nonInteractive {
+				reason = "may require a prompt in non-interactive mode"
+			}
+		case proto.AuthTypeRecoveryCode:
+			if !*useRecoveryCode {
+				reason = "not requested with -useRecoveryCode"
+			} else if nonInteractive {
+				reason = "requires a prompt in non-interactive mode"
+			}
+		default:
+			reason = "not supported by this client"
+		}
+		if reason != "" {
+			noUsableFactorError.Unusable[factor] = reason
+			continue
+		}
+		usable[factor] = true
+	}
+	if len(usable) < 1 {
+		return nil, noUsableFactorError
+	}
+	return usable, nil
+}
+
+// u2fUnusableReason returns why U2F cannot be used, or "" if it can.
+func u2fUnusableReason() string {
+	if *noU2F {
+		return "disabled by -noU2F"
+	}
+	// on linux disable U2F is the /sys/class/hidraw is missing
+	if runtime.GOOS == "linux" {
+		if _, err := os.Stat("/sys/class/hidraw"); os.IsNotExist(err) {
+			return "no hidraw support on this host"
+		}
+	}
+	numDevices, err := u2fDeviceCount()
+	if err != nil {
+		return fmt.Sprintf("cannot list security keys: %s", err)
+	}
+	if numDevices < 1 {
+		return "no security key found"
+	}
+	return ""
+}
+
+// webauthnUnusableReason returns why WebAuthn cannot be used, or "" if it
+// can.
+func webauthnUnusableReason() string {
+	if *noWebAuthn {
+		return "disabled by -noWebAuthn"
+	}
+	numDevices, err := webauthnDeviceCount()
+	if err != nil {
+		return fmt.Sprintf("cannot list FIDO2 authenticators: %s", err)
+	}
+	if numDevices < 1 {
+		return "no FIDO2 authenticator found"
+	}
+	return ""
+}
+
+func (e *DeniedError) error() string {
+	message := fmt.Sprintf("got error from call %s, url='%s'", e.Status, e.URL)
+	if e.Message != "" {
+		message += ": " + e.Message
+	}
+	if e.ReasonCode != "" {
+		message += " (" + e.ReasonCode + ")"
+	}
+	return message
+}
+
+// parseDeniedResponse builds a *DeniedError from a failed response. Servers
+// that do not send a proto.DenialResponse may still include a plain text
+// message after the status.
+func parseDeniedResponse(resp *http.Response, url string) *DeniedError {
+	deniedError := &DeniedError{Status: resp.Status, URL: url}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxDenialBodySize))
+	if err != nil || len(body) < 1 {
+		return deniedError
+	}
+	if strings.Contains(resp.Header.Get("Content-Type"), "application/json") {
+		var denial proto.DenialResponse
+		if err := json.Unmarshal(body, &denial); err == nil {
+			deniedError.ReasonCode = denial.ReasonCode
+			deniedError.Message = denial.Message
+			return deniedError
+		}
+	}
+	message := strings.TrimSpace(string(body))
+	message = strings.TrimSpace(strings.TrimPrefix(message, resp.Status))
+	if index := strings.IndexAny(message, "\r\n"); index >= 0 {
+		message = message[:index]
+	}
+	deniedError.Message = message
+	return deniedError
+}
+
 func doCertRequest(client *http.Client, authCookies []*http.Cookie, url, filedata string,
 	userAgentString string, logger log.Logger) ([]byte, error) {
+	return doCertRequestWithContext(context.Background(), client, authCookies,
+		url, filedata, userAgentString, logger)
+}
 
+func doCertRequestWithContext(ctx context.Context, client *http.Client,
+	authCookies []*http.Cookie, url, filedata string,
+	userAgentString string, logger log.Logger) ([]byte, error) {
 	req, err := createKeyBodyRequest("POST", url, filedata)
 	if err != nil {
 		return nil, err
 	}
+	req = req.WithContext(ctx)
 	// Add the login cookies
 	for _, cookie := range authCookies {
 		req.AddCookie(cookie)
 	}
 	req.Header.Set("User-Agent", userAgentString)
+	req.Header.Set("Accept", "application/json")
+	if err := addDeviceHeader(req, []byte(filedata)); err != nil {
+		return nil, err
+	}
+	if keyAttestation != "" {
+		req.Header.Set(proto.PIVAttestationHeader, keyAttestation)
+	}
 	resp, err := client.Do(req) // Client.Get(targetUrl)
 	if err != nil {
 		logger.Printf("Failure to do cert request %s", err)
@@ -85,12 +320,48 @@ func doCertRequest(client *http.Client, authCookies []*http.Cookie, url, filedat
 
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("got error from call %s, url='%s'\n", resp.Status, url)
+		return nil, parseDeniedResponse(resp, url)
 	}
 	return ioutil.ReadAll(resp.Body)
 
 }
 
+// getKeyType returns the proto.KeyType* constant for publicKey.
+func getKeyType(publicKey crypto.PublicKey) (string, error) {
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		return proto.KeyTypeRSA, nil
+	case *ecdsa.PublicKey:
+		if key.Curve == elliptic.P256() {
+			return proto.KeyTypeECDSA, nil
+		}
+	case ed25519.PublicKey:
+		return proto.KeyTypeEd25519, nil
+	}
+	return "", fmt.Errorf("unsupported public key type %T", publicKey)
+}
+
+// checkKeyTypeSupported returns an error if the type of publicKey is not in
+// the key types supported by the server. Servers which do not advertise key
+// types only support RSA.
+func checkKeyTypeSupported(publicKey crypto.PublicKey,
+	supported []string) error {
+	keyType, err := getKeyType(publicKey)
+	if err != nil {
+		return err
+	}
+	if len(supported) < 1 {
+		supported = []string{proto.KeyTypeRSA}
+	}
+	for _, supportedType := range supported {
+		if supportedType == keyType {
+			return nil
+		}
+	}
+	return fmt.Errorf("server does not support %s keys (supported: %s)",
+		keyType, strings.Join(supported, ","))
+}
+
 func getCertsFromServer(
 	signer crypto.Signer,
 	userName string,
@@ -101,7 +372,17 @@ func getCertsFromServer(
 	client *http.Client,
 	userAgentString string,
 	logger log.DebugLogger) (sshCert []byte, x509Cert []byte, kubernetesCert []byte, err error) {
+	authCookies, err := doPasswordLoginRequest(signer, userName, password,
+		baseUrl, skip2fa, client, userAgentString, logger)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return getCertsWithCookies(signer, userName, baseUrl, authCookies,
+		addGroups, client, userAgentString, logger)
+}
 
+func newPasswordLoginRequest(userName string, password []byte, baseUrl string,
+	userAgentString string) (*http.Request, error) {
 	loginUrl := baseUrl + proto.LoginPath
 	form := url.Values{}
 	form.Add("username", userName)
@@ -109,143 +390,317 @@ func getCertsFromServer(
 	req, err := http.NewRequest("POST", loginUrl,
 		strings.NewReader(form.Encode()))
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, err
 	}
 	req.Header.Add("Content-Length", strconv.Itoa(len(form.Encode())))
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 	req.Header.Add("Accept", "application/json")
 	req.Header.Set("User-Agent", userAgentString)
+	if err := addDeviceHeader(req, []byte(userName)); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
 
+// addDeviceHeader adds the signature of binding with the device key, if
+// any, to req.
+func addDeviceHeader(req *http.Request, binding []byte) error {
+	if deviceKey == nil {
+		return nil
+	}
+	header, err := deviceKey.Header(binding, time.Now())
+	if err != nil {
+		return err
+	}
+	req.Header.Set(proto.DeviceHeader, header)
+	return nil
+}
+
+// getCertsWithLoginRequest sends the primary authentication request req,
+// performs the second factor authentication required by the server and
+// requests all certs.
+func getCertsWithLoginRequest(
+	signer crypto.Signer,
+	userName string,
+	req *http.Request,
+	baseUrl string,
+	skip2fa bool,
+	addGroups bool,
+	client *http.Client,
+	userAgentString string,
+	logger log.DebugLogger) (sshCert []byte, x509Cert []byte, kubernetesCert []byte, err error) {
+	authCookies, err := doLoginRequest(signer, req, baseUrl, skip2fa, client,
+		userAgentString, logger)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return getCertsWithCookies(signer, userName, baseUrl, authCookies,
+		addGroups, client, userAgentString, logger)
+}
+
+// doLoginRequest sends the primary authentication request req and performs
+// the second factor authentication required by the server. The cookies of
+// the login are returned.
+func doLoginRequest(
+	signer crypto.Signer,
+	req *http.Request,
+	baseUrl string,
+	skip2fa bool,
+	client *http.Client,
+	userAgentString string,
+	logger log.DebugLogger) ([]*http.Cookie, error) {
+	return doLoginRequestWithLoginClient(signer, req, baseUrl, skip2fa,
+		client, client, userAgentString, logger)
+}
+
+// doLoginRequestWithLoginClient is like doLoginRequest, but req is sent
+// with loginClient, which must share the cookie jar of client.
+func doLoginRequestWithLoginClient(
+	signer crypto.Signer,
+	req *http.Request,
+	baseUrl string,
+	skip2fa bool,
+	loginClient *http.Client,
+	client *http.Client,
+	userAgentString string,
+	logger log.DebugLogger) ([]*http.Cookie, error) {
 	logger.Debugf(1, "About to start login request\n")
-	loginResp, err := client.Do(req) //client.Get(targetUrl)
+	loginResp, err := loginClient.Do(req) //client.Get(targetUrl)
 	if err != nil {
 		logger.Printf("got error from req")
 		logger.Println(err)
 		// TODO: differentiate between 400 and 500 errors
 		// is OK to fail.. try next
-		return nil, nil, nil, err
+		return nil, err
 	}
 	defer loginResp.Body.Close()
 	if loginResp.StatusCode != 200 {
 		logger.Printf("got error from login call %s", loginResp.Status)
-		return nil, nil, nil, err
+		return nil, parseDeniedResponse(loginResp, req.URL.String())
 	}
 	//Enusre we have at least one cookie
 	if len(loginResp.Cookies()) < 1 {
 		err = errors.New("No cookies from login")
-		return nil, nil, nil, err
+		return nil, err
 	}
 
 	loginJSONResponse := proto.LoginResponse{}
 	//body := jsonrr.Result().Body
 	err = json.NewDecoder(loginResp.Body).Decode(&loginJSONResponse)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, err
 	}
 	io.Copy(ioutil.Discard, loginResp.Body) // We also need to read ALL of the body
 	loginResp.Body.Close()                  //so that we can reuse the channel
 	logger.Debugf(1, "This the login response=%v\n", loginJSONResponse)
-
-	allowVIP := false
-	allowU2F := false
-	for _, backend := range loginJSONResponse.CertAuthBackend {
-		if backend == proto.AuthTypePassword {
-			skip2fa = true
-		}
-		if backend == proto.AuthTypeSymantecVIP {
-			allowVIP = true
-			//remote next statemente later
-			//skipu2f = true
-		}
-		if backend == proto.AuthTypeU2F {
-			allowU2F = true
-		}
+	if loginJSONResponse.PasswordExpiresIn > 0 {
+		logger.Printf("Warning: your password expires in %s",
+			time.Duration(loginJSONResponse.PasswordExpiresIn)*time.Second)
 	}
-
-	// Dont try U2F if chosen by user
-	if *noU2F {
-		allowU2F = false
-	}
-	if *noVIPAccess {
-		allowVIP = false
+	err = checkKeyTypeSupported(signer.Public(),
+		loginJSONResponse.SupportedKeyTypes)
+	if err != nil {
+		return nil, err
 	}
 
-	// on linux disable U2F is the /sys/class/hidraw is missing
-	if runtime.GOOS == "linux" && allowU2F {
-		if _, err := os.Stat("/sys/class/hidraw"); os.IsNotExist(err) {
-			allowU2F = false
+	for _, backend := range loginJSONResponse.CertAuthBackend {
+		switch backend {
+		case proto.AuthTypePassword, proto.AuthTypeCertificateRenewal:
+			skip2fa = true
 		}
-
 	}
 
 	// upgrade to u2f
 	successful2fa := false
 	if !skip2fa {
-		if allowU2F {
-			devices, err := u2fhid.Devices()
+		usable, err := getUsableSecondFactors(
+			loginJSONResponse.CertAuthBackend)
+		if err != nil {
+			return nil, err
+		}
+		if usable[proto.AuthTypeRecoveryCode] {
+			err = recovery.DoRecoveryCodeAuthenticate(
+				client, baseUrl, userAgentString, logger)
+			if err != nil {
+				return nil, err
+			}
+			successful2fa = true
+		}
+		if usable[proto.AuthTypeWebAuthn] && !successful2fa {
+			err = webauthn.DoWebAuthnAuthenticate(
+				client, baseUrl, userAgentString, logger)
+			if err != nil {
+				logger.Printf("WebAuthn authentication failed: %s", err)
+			} else {
+				successful2fa = true
+			}
+		}
+		if usable[proto.AuthTypeOkta2FA] && !successful2fa {
+			err = webauthn.DoOktaWebAuthnAuthenticate(
+				client, baseUrl, userAgentString, logger)
 			if err != nil {
-				logger.Fatal(err)
-				return nil, nil, nil, err
+				logger.Printf("Okta WebAuthn authentication failed: %s", err)
+			} else {
+				successful2fa = true
 			}
-			if len(devices) > 0 {
+		}
 
-				err = u2f.DoU2FAuthenticate(
-					client, baseUrl, userAgentString, logger)
-				if err != nil {
+		if usable[proto.AuthTypeU2F] && !successful2fa {
+			err = u2f.DoU2FAuthenticate(
+				client, baseUrl, userAgentString, logger)
+			if err != nil {
 
-					return nil, nil, nil, err
-				}
-				successful2fa = true
+				return nil, err
 			}
+			successful2fa = true
 		}
 
-		if allowVIP && !successful2fa {
+		if usable[proto.AuthTypeSymantecVIP] && !successful2fa {
 			err = vip.DoVIPAuthenticate(
 				client, baseUrl, userAgentString, logger)
 			if err != nil {
 
-				return nil, nil, nil, err
+				return nil, err
+			}
+			successful2fa = true
+		}
+
+		if usable[proto.AuthTypeTOTP] && !successful2fa {
+			err = totp.DoTOTPAuthenticate(
+				client, baseUrl, userAgentString, logger)
+			if err != nil {
+
+				return nil, err
+			}
+			successful2fa = true
+		}
+
+		if usable[proto.AuthTypeRADIUS] && !successful2fa {
+			err = radius.DoRADIUSAuthenticate(
+				client, baseUrl, userAgentString, logger)
+			if err != nil {
+				return nil, err
+			}
+			successful2fa = true
+		}
+
+		if usable[proto.AuthTypeDuo] && !successful2fa {
+			err = duo.DoDuoAuthenticate(
+				client, baseUrl, userAgentString, logger)
+			if err != nil {
+				return nil, err
+			}
+			successful2fa = true
+		}
+
+		if usable[proto.AuthTypeWebhook] && !successful2fa {
+			err = webhook.DoWebhookAuthenticate(
+				client, baseUrl, userAgentString, logger)
+			if err != nil {
+				return nil, err
 			}
 			successful2fa = true
 		}
 
 		if !successful2fa {
 			err = errors.New("Failed to Pefrom 2FA (as requested from server)")
-			return nil, nil, nil, err
+			return nil, err
 		}
 
 	}
 
 	logger.Debugf(1, "Authentication Phase complete")
+	return loginResp.Cookies(), nil
+}
 
-	//now get x509 cert
-	pubKey := signer.Public()
-	derKey, err := x509.MarshalPKIXPublicKey(pubKey)
+// getSSHPermissionsQuery returns the query parameters requesting the SSH
+// critical options and extensions set with flags.
+func getSSHPermissionsQuery() string {
+	values := make(url.Values)
+	if *sshForceCommand != "" {
+		values.Add("critical_option", "force-command="+*sshForceCommand)
+	}
+	if *sshSourceAddress != "" {
+		values.Add("critical_option", "source-address="+*sshSourceAddress)
+	}
+	if *sshExtensions != "" {
+		values.Set("extensions", *sshExtensions)
+	}
+	if len(values) < 1 {
+		return ""
+	}
+	return "&" + values.Encode()
+}
+
+// getCertsWithCookies requests all certs using the cookies from a completed
+// authentication.
+func getCertsWithCookies(
+	signer crypto.Signer,
+	userName string,
+	baseUrl string,
+	authCookies []*http.Cookie,
+	addGroups bool,
+	client *http.Client,
+	userAgentString string,
+	logger log.DebugLogger) (sshCert []byte, x509Cert []byte, kubernetesCert []byte, err error) {
+	pemKey, err := getPEMPublicKey(signer)
 	if err != nil {
 		return nil, nil, nil, err
 	}
-	pemKey := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: derKey}))
-
-	var urlPostfix string
 	if addGroups {
-		urlPostfix = "&addGroups=true"
 		logger.Debugln(0, "adding \"addGroups\" to request")
 	}
-	// TODO: urlencode the userName
 	x509Cert, err = doCertRequest(
 		client,
-		loginResp.Cookies(),
-		baseUrl+"/certgen/"+userName+"?type=x509"+urlPostfix,
+		authCookies,
+		getX509CertURL(baseUrl, userName, addGroups),
 		pemKey,
 		userAgentString,
 		logger)
 	if err != nil {
 		return nil, nil, nil, err
 	}
+	sshCert, kubernetesCert, err = getRemainingCertsWithCookies(signer,
+		userName, baseUrl, pemKey, authCookies, client, userAgentString,
+		logger)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return sshCert, x509Cert, kubernetesCert, nil
+}
 
+func getPEMPublicKey(signer crypto.Signer) (string, error) {
+	derKey, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(
+		&pem.Block{Type: "PUBLIC KEY", Bytes: derKey})), nil
+}
+
+func getX509CertURL(baseUrl string, userName string, addGroups bool) string {
+	var urlPostfix string
+	if addGroups {
+		urlPostfix = "&addGroups=true"
+	}
+	// TODO: urlencode the userName
+	return baseUrl + "/certgen/" + userName + "?type=x509" + urlPostfix
+}
+
+// getRemainingCertsWithCookies requests the kubernetes and SSH certs after
+// the x509 cert was issued.
+func getRemainingCertsWithCookies(
+	signer crypto.Signer,
+	userName string,
+	baseUrl string,
+	pemKey string,
+	authCookies []*http.Cookie,
+	client *http.Client,
+	userAgentString string,
+	logger log.DebugLogger) (sshCert []byte, kubernetesCert []byte, err error) {
 	kubernetesCert, err = doCertRequest(
 		client,
-		loginResp.Cookies(),
+		authCookies,
 		baseUrl+"/certgen/"+userName+"?type=x509-kubernetes",
 		pemKey,
 		userAgentString,
@@ -258,23 +713,22 @@ func getCertsFromServer(
 
 	//// Now we do sshCert!
 	// generate and write public key
-	sshPub, err := ssh.NewPublicKey(pubKey)
+	sshPub, err := ssh.NewPublicKey(signer.Public())
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, err
 	}
 	sshAuthFile := string(ssh.MarshalAuthorizedKey(sshPub))
 	sshCert, err = doCertRequest(
 		client,
-		loginResp.Cookies(),
-		baseUrl+"/certgen/"+userName+"?type=ssh",
+		authCookies,
+		baseUrl+"/certgen/"+userName+"?type=ssh"+getSSHPermissionsQuery(),
 		sshAuthFile,
 		userAgentString,
 		logger)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, err
 	}
-
-	return sshCert, x509Cert, kubernetesCert, nil
+	return sshCert, kubernetesCert, nil
 }
 
 func getCertFromTargetUrls(
@@ -286,16 +740,36 @@ func getCertFromTargetUrls(
 	addGroups bool,
 	client *http.Client,
 	userAgentString string,
+	budget *retrybudget.Budget,
 	logger log.DebugLogger) (sshCert []byte, x509Cert []byte, kubernetesCert []byte, err error) {
 	success := false
+	var deniedError *DeniedError
+	var lastError error
 
+	if raceServers {
+		targetUrls = serverLatencies.Order(targetUrls)
+	}
 	for _, baseUrl := range targetUrls {
+		if err := budget.Acquire(); err != nil {
+			return nil, nil, nil, err
+		}
 		logger.Printf("attempting to target '%s' for '%s'\n", baseUrl, userName)
-		sshCert, x509Cert, kubernetesCert, err = getCertsFromServer(
-			signer, userName, password, baseUrl, skipu2f, addGroups,
-			client, userAgentString, logger)
+		if raceServers {
+			sshCert, x509Cert, kubernetesCert, err = raceCertsFromServers(
+				signer, userName, password, baseUrl, targetUrls, skipu2f,
+				addGroups, client, userAgentString, serverLatencies, logger)
+		} else {
+			sshCert, x509Cert, kubernetesCert, err = getCertsFromServer(
+				signer, userName, password, baseUrl, skipu2f, addGroups,
+				client, userAgentString, logger)
+		}
 		if err != nil {
 			logger.Println(err)
+			budget.Record(err)
+			lastError = err
+			if denied, ok := err.(*DeniedError); ok {
+				deniedError = denied
+			}
 			continue
 		}
 		success = true
@@ -303,8 +777,14 @@ func getCertFromTargetUrls(
 
 	}
 	if !success {
-		err := errors.New("Failed to get creds")
-		return nil, nil, nil, err
+		if deniedError != nil {
+			err := &getCredsError{cause: deniedError}
+			if deniedError.Message != "" {
+				err.message = ": " + deniedError.Message
+			}
+			return nil, nil, nil, err
+		}
+		return nil, nil, nil, &getCredsError{cause: lastError}
 	}
 
 	return sshCert, x509Cert, kubernetesCert, nil
@@ -1,16 +1,33 @@
 package twofa
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"math/big"
 	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/Cloud-Foundations/Dominator/lib/log/testlogger"
+	"github.com/Cloud-Foundations/keymaster/lib/client/serverlatency"
 	"github.com/Cloud-Foundations/keymaster/lib/client/util"
+	"github.com/Cloud-Foundations/keymaster/lib/devicekey"
 	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
 )
 
@@ -199,3 +216,828 @@ func TestGetCertFromTargetUrlsFailUntrustedCA(t *testing.T) {
 		t.Fatal("Should have failed to connect untrusted CA")
 	}
 }
+
+func TestDoCertRequestShowsDenialReason(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Accept") != "application/json" {
+				t.Errorf("unexpected Accept header: %s", r.Header.Get("Accept"))
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(proto.DenialResponse{
+				ReasonCode: "not_in_allowed_group",
+				Message:    "user is not in an allowed group",
+			})
+		}))
+	defer server.Close()
+	_, err := doCertRequest(server.Client(), nil, server.URL+"/certgen/user",
+		"somedata", "test-agent", testlogger.New(t))
+	if err == nil {
+		t.Fatal("expected denial")
+	}
+	deniedError, ok := err.(*DeniedError)
+	if !ok {
+		t.Fatalf("expected *DeniedError, got %T", err)
+	}
+	if deniedError.ReasonCode != "not_in_allowed_group" ||
+		deniedError.Message != "user is not in an allowed group" {
+		t.Fatalf("unexpected denial: %+v", deniedError)
+	}
+	if !strings.Contains(err.Error(), "user is not in an allowed group") {
+		t.Fatalf("reason not displayed: %s", err)
+	}
+}
+
+func TestDoCertRequestDenialFromOldServer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "403 Forbidden \n")
+		}))
+	defer server.Close()
+	_, err := doCertRequest(server.Client(), nil, server.URL+"/certgen/user",
+		"somedata", "test-agent", testlogger.New(t))
+	deniedError, ok := err.(*DeniedError)
+	if !ok {
+		t.Fatalf("expected *DeniedError, got %T", err)
+	}
+	if deniedError.Message != "" || deniedError.ReasonCode != "" {
+		t.Fatalf("unexpected denial: %+v", deniedError)
+	}
+	if !strings.Contains(err.Error(), "403 Forbidden") {
+		t.Fatalf("status not displayed: %s", err)
+	}
+}
+
+func TestDoCertRequestSignsWithDeviceKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "twofa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, err := devicekey.LoadOrCreate(filepath.Join(dir, "device_key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetDeviceKey(key)
+	defer SetDeviceKey(nil)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			id, _, err := devicekey.Verify(r.Header.Get(proto.DeviceHeader),
+				[]byte("somedata"), time.Now(), time.Minute)
+			if err != nil {
+				t.Errorf("device header: %s", err)
+			} else if id != key.ID() {
+				t.Errorf("device %s, expected %s", id, key.ID())
+			}
+			fmt.Fprintf(w, "cert")
+		}))
+	defer server.Close()
+	_, err = doCertRequest(server.Client(), nil, server.URL+"/certgen/user",
+		"somedata", "test-agent", testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetCertFromTargetUrlsShowsLoginDenialReason(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(proto.DenialResponse{
+				ReasonCode: "account_disabled",
+				Message:    "account is disabled",
+			})
+		}))
+	defer server.Close()
+	privateKey, err := util.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, _, err = GetCertFromTargetUrls(privateKey, "username",
+		[]byte("password"), []string{server.URL}, false, false,
+		server.Client(), "test-agent", testlogger.New(t))
+	if err == nil {
+		t.Fatal("expected failure")
+	}
+	if !strings.Contains(err.Error(), "account is disabled") {
+		t.Fatalf("reason not displayed: %s", err)
+	}
+}
+
+func makeTestOIDCToken(header string, claims string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(header)) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte(claims)) + ".c2lnbmF0dXJl"
+}
+
+func TestCheckOIDCTokenFormat(t *testing.T) {
+	expires := time.Now().Add(time.Hour).Unix()
+	validClaims := fmt.Sprintf(
+		`{"iss":"https://token.actions.example.com","sub":"repo:org/repo","exp":%d}`,
+		expires)
+	if err := checkOIDCTokenFormat([]byte(makeTestOIDCToken(
+		`{"alg":"RS256"}`, validClaims))); err != nil {
+		t.Fatal(err)
+	}
+	for name, token := range map[string]string{
+		"not a JWT":  "not-a-token",
+		"unsigned":   makeTestOIDCToken(`{"alg":"none"}`, validClaims),
+		"bad header": "!!." + makeTestOIDCToken(`{"alg":"RS256"}`, validClaims)[3:],
+		"no issuer":  makeTestOIDCToken(`{"alg":"RS256"}`, `{"sub":"s","exp":9999999999}`),
+		"expired": makeTestOIDCToken(`{"alg":"RS256"}`,
+			`{"iss":"i","sub":"s","exp":1}`),
+	} {
+		if err := checkOIDCTokenFormat([]byte(token)); err == nil {
+			t.Errorf("%s: token should have been rejected", name)
+		}
+	}
+}
+
+func TestGetCCacheFilename(t *testing.T) {
+	oldName := os.Getenv("KRB5CCNAME")
+	defer os.Setenv("KRB5CCNAME", oldName)
+	for name, expected := range map[string]string{
+		"FILE:/tmp/krb5cc_1000": "/tmp/krb5cc_1000",
+		"/tmp/krb5cc_test":      "/tmp/krb5cc_test",
+	} {
+		os.Setenv("KRB5CCNAME", name)
+		filename, err := getCCacheFilename()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filename != expected {
+			t.Errorf("%s: got %s, expected %s", name, filename, expected)
+		}
+	}
+	os.Setenv("KRB5CCNAME", "KEYRING:persistent:1000")
+	if _, err := getCCacheFilename(); err == nil {
+		t.Fatal("keyring credential cache accepted")
+	}
+}
+
+func TestGetCertFromTargetUrlsWithKerberosNoCCache(t *testing.T) {
+	oldName := os.Getenv("KRB5CCNAME")
+	defer os.Setenv("KRB5CCNAME", oldName)
+	oldConfig := os.Getenv("KRB5_CONFIG")
+	defer os.Setenv("KRB5_CONFIG", oldConfig)
+	configFile, err := ioutil.TempFile("", "krb5.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(configFile.Name())
+	configFile.Close()
+	os.Setenv("KRB5_CONFIG", configFile.Name())
+	os.Setenv("KRB5CCNAME", "FILE:/nonexistent/krb5cc")
+	loginCalled := false
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			loginCalled = true
+		}))
+	defer server.Close()
+	privateKey, err := util.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, _, err = GetCertFromTargetUrlsWithKerberos(privateKey, "username",
+		[]string{server.URL}, false, false, server.Client(), "test-agent",
+		nil, testlogger.New(t))
+	if err == nil {
+		t.Fatal("login without a credential cache succeeded")
+	}
+	if loginCalled {
+		t.Fatal("server contacted without Kerberos tickets")
+	}
+}
+
+func TestGetCertFromTargetUrlsWithOIDCToken(t *testing.T) {
+	token := makeTestOIDCToken(`{"alg":"RS256"}`, fmt.Sprintf(
+		`{"iss":"https://token.actions.example.com","sub":"repo:org/repo","exp":%d}`,
+		time.Now().Add(time.Hour).Unix()))
+	var passwordLogins, tokenLogins int
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			http.SetCookie(w, &http.Cookie{Name: "auth", Value: "value"})
+			switch r.URL.Path {
+			case proto.LoginPath:
+				passwordLogins++
+				w.WriteHeader(http.StatusUnauthorized)
+			case proto.OIDCTokenLoginPath:
+				if r.Method == "GET" {
+					json.NewEncoder(w).Encode(proto.LoginResponse{
+						CertAuthBackend: []string{proto.AuthTypeOIDCToken},
+					})
+					return
+				}
+				tokenLogins++
+				if r.FormValue("token") != token {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				json.NewEncoder(w).Encode(proto.LoginResponse{
+					Message:         "success",
+					CertAuthBackend: []string{proto.AuthTypeOIDCToken},
+				})
+			default:
+				fmt.Fprintf(w, "cert for %s", r.URL.Query().Get("type"))
+			}
+		}))
+	defer server.Close()
+	privateKey, err := util.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshCert, x509Cert, _, err := GetCertFromTargetUrlsWithOIDCToken(
+		privateKey, "username", []byte(token), []string{server.URL}, false,
+		server.Client(), "test-agent", nil, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(sshCert) != "cert for ssh" || string(x509Cert) != "cert for x509" {
+		t.Fatalf("unexpected certs: %s %s", sshCert, x509Cert)
+	}
+	if tokenLogins != 1 || passwordLogins != 0 {
+		t.Fatalf("unexpected logins: token=%d password=%d",
+			tokenLogins, passwordLogins)
+	}
+	// Malformed tokens are never sent.
+	_, _, _, err = GetCertFromTargetUrlsWithOIDCToken(
+		privateKey, "username", []byte("not-a-token"), []string{server.URL},
+		false, server.Client(), "test-agent", nil, testlogger.New(t))
+	if err == nil {
+		t.Fatal("malformed token should have been rejected")
+	}
+	if tokenLogins != 1 {
+		t.Fatal("malformed token was sent to the server")
+	}
+}
+
+func TestGetCertFromTargetUrlsWithOIDCTokenNotAdvertised(t *testing.T) {
+	token := makeTestOIDCToken(`{"alg":"RS256"}`, fmt.Sprintf(
+		`{"iss":"https://issuer.example.com","sub":"subject","exp":%d}`,
+		time.Now().Add(time.Hour).Unix()))
+	tokenSent := false
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.FormValue("token") != "" {
+				tokenSent = true
+			}
+			http.SetCookie(w, &http.Cookie{Name: "auth", Value: "value"})
+			json.NewEncoder(w).Encode(proto.LoginResponse{
+				Message:         "success",
+				CertAuthBackend: []string{proto.AuthTypePassword},
+			})
+		}))
+	defer server.Close()
+	privateKey, err := util.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, _, err = GetCertFromTargetUrlsWithOIDCToken(
+		privateKey, "username", []byte(token), []string{server.URL}, false,
+		server.Client(), "test-agent", nil, testlogger.New(t))
+	if err == nil {
+		t.Fatal("should fail when the backend is not advertised")
+	}
+	if tokenSent {
+		t.Fatal("token sent to a server which does not advertise it")
+	}
+}
+
+func TestGetCertsFromServerNoUsableFactor(t *testing.T) {
+	origDeviceCount := u2fDeviceCount
+	defer func() { u2fDeviceCount = origDeviceCount }()
+	u2fDeviceCount = func() (int, error) { return 0, nil }
+	origNoTOTP := *noTOTP
+	defer func() { *noTOTP = origNoTOTP }()
+	*noTOTP = true
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			http.SetCookie(w, &http.Cookie{Name: "auth", Value: "value"})
+			switch r.URL.Path {
+			case proto.LoginPath:
+				json.NewEncoder(w).Encode(proto.LoginResponse{
+					Message: "success",
+					CertAuthBackend: []string{proto.AuthTypeU2F,
+						proto.AuthTypeTOTP},
+				})
+			default:
+				t.Errorf("unexpected request for %s", r.URL.Path)
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}))
+	defer server.Close()
+	privateKey, err := util.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, _, err = getCertsFromServer(privateKey, "username",
+		[]byte("password"), server.URL, false, false, server.Client(),
+		"test-agent", testlogger.New(t))
+	if !errors.Is(err, ErrNoUsableFactor) {
+		t.Fatalf("expected ErrNoUsableFactor, got %v", err)
+	}
+	noUsableFactorError := err.(*NoUsableFactorError)
+	if len(noUsableFactorError.Required) != 2 ||
+		noUsableFactorError.Required[0] != proto.AuthTypeU2F ||
+		noUsableFactorError.Required[1] != proto.AuthTypeTOTP {
+		t.Fatalf("unexpected required factors: %v",
+			noUsableFactorError.Required)
+	}
+	for _, factor := range noUsableFactorError.Required {
+		if noUsableFactorError.Unusable[factor] == "" {
+			t.Fatalf("no reason given for %s", factor)
+		}
+	}
+	t.Log(err)
+}
+
+func TestGetUsableSecondFactorsOkta2FA(t *testing.T) {
+	origDeviceCount := webauthnDeviceCount
+	defer func() { webauthnDeviceCount = origDeviceCount }()
+	webauthnDeviceCount = func() (int, error) { return 1, nil }
+	usable, err := getUsableSecondFactors([]string{proto.AuthTypeOkta2FA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !usable[proto.AuthTypeOkta2FA] {
+		t.Fatal("Okta2FA should be usable with a FIDO2 authenticator")
+	}
+	webauthnDeviceCount = func() (int, error) { return 0, nil }
+	_, err = getUsableSecondFactors([]string{proto.AuthTypeOkta2FA})
+	if !errors.Is(err, ErrNoUsableFactor) {
+		t.Fatalf("expected ErrNoUsableFactor, got %v", err)
+	}
+}
+
+func TestGetUsableSecondFactorsRADIUS(t *testing.T) {
+	usable, err := getUsableSecondFactors([]string{proto.AuthTypeRADIUS})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !usable[proto.AuthTypeRADIUS] {
+		t.Fatal("RADIUS should be usable")
+	}
+	origNoRADIUS := *noRADIUS
+	defer func() { *noRADIUS = origNoRADIUS }()
+	*noRADIUS = true
+	_, err = getUsableSecondFactors([]string{proto.AuthTypeRADIUS})
+	if !errors.Is(err, ErrNoUsableFactor) {
+		t.Fatalf("expected ErrNoUsableFactor, got %v", err)
+	}
+}
+
+func TestGetUsableSecondFactorsRecoveryCode(t *testing.T) {
+	_, err := getUsableSecondFactors([]string{proto.AuthTypeRecoveryCode})
+	if !errors.Is(err, ErrNoUsableFactor) {
+		t.Fatalf("expected ErrNoUsableFactor, got %v", err)
+	}
+	origUseRecoveryCode := *useRecoveryCode
+	defer func() { *useRecoveryCode = origUseRecoveryCode }()
+	*useRecoveryCode = true
+	usable, err := getUsableSecondFactors([]string{proto.AuthTypeRecoveryCode})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !usable[proto.AuthTypeRecoveryCode] {
+		t.Fatal("RecoveryCode should be usable")
+	}
+}
+
+func TestGetUsableSecondFactorsNonInteractive(t *testing.T) {
+	defer SetNonInteractive(false)
+	SetNonInteractive(true)
+	backends := []string{proto.AuthTypeSymantecVIP, proto.AuthTypeTOTP}
+	_, err := getUsableSecondFactors(backends)
+	if !errors.Is(err, ErrNoUsableFactor) {
+		t.Fatalf("expected ErrNoUsableFactor, got %v", err)
+	}
+	SetNonInteractive(false)
+	usable, err := getUsableSecondFactors(backends)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !usable[proto.AuthTypeSymantecVIP] || !usable[proto.AuthTypeTOTP] {
+		t.Fatalf("VIP and TOTP should be usable interactively: %v", usable)
+	}
+}
+
+func TestGetSSHPermissionsQuery(t *testing.T) {
+	if query := getSSHPermissionsQuery(); query != "" {
+		t.Fatalf("query without flags: %q", query)
+	}
+	defer func() {
+		*sshForceCommand = ""
+		*sshSourceAddress = ""
+		*sshExtensions = ""
+	}()
+	*sshForceCommand = "/usr/bin/rsync --server"
+	*sshSourceAddress = "10.0.0.0/8,192.168.1.1"
+	*sshExtensions = "permit-pty"
+	values, err := url.ParseQuery(getSSHPermissionsQuery()[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := values["critical_option"]
+	if len(options) != 2 ||
+		options[0] != "force-command=/usr/bin/rsync --server" ||
+		options[1] != "source-address=10.0.0.0/8,192.168.1.1" {
+		t.Fatalf("unexpected critical options: %v", options)
+	}
+	if values.Get("extensions") != "permit-pty" {
+		t.Fatalf("unexpected extensions: %v", values["extensions"])
+	}
+}
+
+func TestCreateKeyBodyRequestProfile(t *testing.T) {
+	req, err := createKeyBodyRequest("POST", "https://localhost/certgen/a",
+		"key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := req.ParseMultipartForm(1e6); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := req.MultipartForm.Value["profile"]; ok {
+		t.Fatal("profile sent without flag")
+	}
+	defer func() { *profile = "" }()
+	*profile = "vpn"
+	req, err = createKeyBodyRequest("POST", "https://localhost/certgen/a",
+		"key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := req.ParseMultipartForm(1e6); err != nil {
+		t.Fatal(err)
+	}
+	if req.FormValue("profile") != "vpn" {
+		t.Fatalf("unexpected profile: %v", req.MultipartForm.Value)
+	}
+}
+
+func TestCheckKeyTypeSupported(t *testing.T) {
+	rsaKey, err := util.GenerateKeyWithType(proto.KeyTypeRSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed25519Key, err := util.GenerateKeyWithType(proto.KeyTypeEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Servers which do not advertise key types only sign RSA keys.
+	if err := checkKeyTypeSupported(rsaKey.Public(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkKeyTypeSupported(ed25519Key.Public(), nil); err == nil {
+		t.Fatal("Ed25519 key should not be supported by old servers")
+	}
+	supported := []string{proto.KeyTypeRSA, proto.KeyTypeEd25519}
+	if err := checkKeyTypeSupported(ed25519Key.Public(), supported); err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := util.GenerateKeyWithType(proto.KeyTypeECDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkKeyTypeSupported(ecdsaKey.Public(), supported); err == nil {
+		t.Fatal("ECDSA key should not be supported")
+	}
+}
+
+func TestGetCertFromTargetUrlsRacing(t *testing.T) {
+	newServer := func(name string, delay time.Duration,
+		certStatus int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == proto.LoginPath {
+					http.SetCookie(w, &http.Cookie{Name: "auth", Value: "value"})
+					json.NewEncoder(w).Encode(proto.LoginResponse{
+						Message:         "success",
+						CertAuthBackend: []string{proto.AuthTypePassword},
+					})
+					return
+				}
+				if cookie, err := r.Cookie("auth"); err != nil ||
+					cookie.Value != "value" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				select {
+				case <-time.After(delay):
+				case <-r.Context().Done():
+					return
+				}
+				w.WriteHeader(certStatus)
+				fmt.Fprintf(w, "%s cert from %s", r.URL.Query().Get("type"),
+					name)
+			}))
+	}
+	loginServer := newServer("login", 500*time.Millisecond, http.StatusOK)
+	defer loginServer.Close()
+	fastServer := newServer("fast", 0, http.StatusOK)
+	defer fastServer.Close()
+	brokenServer := newServer("broken", 0, http.StatusInternalServerError)
+	defer brokenServer.Close()
+	latencies, err := serverlatency.Load(
+		filepath.Join(t.TempDir(), "latency.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetServerRacing(true, latencies)
+	defer SetServerRacing(false, nil)
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey, err := util.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	targetUrls := []string{loginServer.URL, brokenServer.URL, fastServer.URL}
+	sshCert, x509Cert, _, err := GetCertFromTargetUrls(
+		privateKey, "username", []byte("password"), targetUrls, false, false,
+		&http.Client{Jar: jar}, "test-agent", testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(x509Cert) != "x509 cert from fast" ||
+		string(sshCert) != "ssh cert from fast" {
+		t.Fatalf("unexpected certs: %s %s", x509Cert, sshCert)
+	}
+	ordered := latencies.Order(targetUrls)
+	if ordered[0] != fastServer.URL || ordered[2] != brokenServer.URL {
+		t.Fatalf("unexpected order: %v", ordered)
+	}
+}
+
+func TestGetCertFromTargetUrlsWithCloudIdentity(t *testing.T) {
+	const document = `{"accountId":"123456789012"}`
+	metadataServer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/latest/api/token" {
+				if r.Method != "PUT" ||
+					r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds") == "" {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				w.Write([]byte("imds-token"))
+				return
+			}
+			if r.Header.Get("X-aws-ec2-metadata-token") != "imds-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			switch r.URL.Path {
+			case "/latest/dynamic/instance-identity/document":
+				w.Write([]byte(document))
+			case "/latest/dynamic/instance-identity/signature":
+				w.Write([]byte("c2lnbmF0dXJl"))
+			case "/latest/meta-data/iam/security-credentials/":
+				w.Write([]byte("deploy"))
+			case "/latest/meta-data/iam/security-credentials/deploy":
+				w.Write([]byte(`{"Code":"Success","AccessKeyId":"ASIAEXAMPLE","SecretAccessKey":"secret","Token":"token"}`))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+	defer metadataServer.Close()
+	oldAWSMetadataURL := awsMetadataURL
+	defer func() { awsMetadataURL = oldAWSMetadataURL }()
+	awsMetadataURL = metadataServer.URL + "/latest"
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			http.SetCookie(w, &http.Cookie{Name: "auth", Value: "value"})
+			switch r.URL.Path {
+			case proto.CloudIdentityLoginPath:
+				if r.FormValue("provider") != "aws" ||
+					r.FormValue("document") != document ||
+					!strings.Contains(r.FormValue("sts_request"),
+						"http://"+r.Host) ||
+					r.FormValue("signature") != "c2lnbmF0dXJl" ||
+					r.FormValue("username") != "svc-deploy" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				json.NewEncoder(w).Encode(proto.LoginResponse{
+					Message:         "success",
+					CertAuthBackend: []string{proto.AuthTypeCloudIdentity},
+				})
+			default:
+				fmt.Fprintf(w, "cert for %s", r.URL.Query().Get("type"))
+			}
+		}))
+	defer server.Close()
+	privateKey, err := util.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshCert, x509Cert, _, err := GetCertFromTargetUrlsWithCloudIdentity(
+		privateKey, "svc-deploy", "aws", []string{server.URL}, false,
+		server.Client(), "test-agent", nil, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(sshCert) != "cert for ssh" || string(x509Cert) != "cert for x509" {
+		t.Fatalf("unexpected certs: %s %s", sshCert, x509Cert)
+	}
+	_, _, _, err = GetCertFromTargetUrlsWithCloudIdentity(
+		privateKey, "svc-deploy", "openstack", []string{server.URL}, false,
+		server.Client(), "test-agent", nil, testlogger.New(t))
+	if err == nil {
+		t.Fatal("unknown provider should have been rejected")
+	}
+}
+
+func TestGetCertFromTargetUrlsWithServiceAccountToken(t *testing.T) {
+	tokens := map[string]string{"deploy-bot.01.b2xk": "deploy-bot.02.bmV3"}
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			http.SetCookie(w, &http.Cookie{Name: "auth", Value: "value"})
+			switch r.URL.Path {
+			case proto.ServiceAccountLoginPath:
+				newToken, ok := tokens[r.FormValue("token")]
+				if !ok {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				delete(tokens, r.FormValue("token"))
+				json.NewEncoder(w).Encode(proto.LoginResponse{
+					Message:         "success",
+					CertAuthBackend: []string{proto.AuthTypeServiceAccount},
+					RefreshToken:    newToken,
+				})
+			default:
+				fmt.Fprintf(w, "cert for %s", r.URL.Query().Get("type"))
+			}
+		}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "twofa_testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFilename := filepath.Join(dir, "token")
+	err = ioutil.WriteFile(tokenFilename, []byte("deploy-bot.01.b2xk\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey, err := util.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshCert, _, _, err := GetCertFromTargetUrlsWithServiceAccountToken(
+		privateKey, "deploy-bot", tokenFilename, []string{server.URL}, false,
+		server.Client(), "test-agent", nil, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(sshCert) != "cert for ssh" {
+		t.Fatalf("unexpected cert: %s", sshCert)
+	}
+	fi, err := os.Stat(tokenFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(tokenFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "deploy-bot.02.bmV3\n" || fi.Mode().Perm() != 0600 {
+		t.Fatalf("token file not rotated: %q %s", data, fi.Mode())
+	}
+	_, _, _, err = GetCertFromTargetUrlsWithServiceAccountToken(
+		privateKey, "other-bot", tokenFilename, []string{server.URL}, false,
+		server.Client(), "test-agent", nil, testlogger.New(t))
+	if err == nil {
+		t.Fatal("token for another service account should be rejected")
+	}
+}
+
+func TestGetCertFromTargetUrlsWithCertificate(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "username"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	derCert, err := x509.CreateCertificate(rand.Reader, template, template,
+		key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate := tls.Certificate{
+		Certificate: [][]byte{derCert},
+		PrivateKey:  key,
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			http.SetCookie(w, &http.Cookie{Name: "auth", Value: "value"})
+			hasCert := len(r.TLS.PeerCertificates) > 0
+			switch r.URL.Path {
+			case proto.CertificateRenewalLoginPath:
+				if !hasCert || r.Method != "POST" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				json.NewEncoder(w).Encode(proto.LoginResponse{
+					Message: "success",
+					CertAuthBackend: []string{
+						proto.AuthTypeCertificateRenewal},
+				})
+			default:
+				if hasCert {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				fmt.Fprintf(w, "cert for %s", r.URL.Query().Get("type"))
+			}
+		}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	server.StartTLS()
+	defer server.Close()
+	privateKey, err := util.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshCert, _, _, err := GetCertFromTargetUrlsWithCertificate(privateKey,
+		"username", certificate, []string{server.URL}, false, false,
+		server.Client(), "test-agent", nil, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(sshCert) != "cert for ssh" {
+		t.Fatalf("unexpected cert: %s", sshCert)
+	}
+	_, _, _, err = GetCertFromTargetUrlsWithCertificate(privateKey,
+		"otheruser", certificate, []string{server.URL}, false, false,
+		server.Client(), "test-agent", nil, testlogger.New(t))
+	if err == nil {
+		t.Fatal("certificate for another user should be rejected")
+	}
+}
+
+func TestGetCertsFromServerPasswordMustChange(t *testing.T) {
+	password := "old"
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case proto.LoginPath:
+				if r.FormValue("password") != password {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				if password == "old" {
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(http.StatusUnauthorized)
+					json.NewEncoder(w).Encode(proto.DenialResponse{
+						ReasonCode: proto.DenialReasonPasswordMustChange,
+					})
+					return
+				}
+			case proto.ChangePasswordPath:
+				if r.FormValue("password") != password {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				password = r.FormValue("new_password")
+			default:
+				fmt.Fprintf(w, "cert for %s", r.URL.Query().Get("type"))
+				return
+			}
+			http.SetCookie(w, &http.Cookie{Name: "auth", Value: "value"})
+			json.NewEncoder(w).Encode(proto.LoginResponse{
+				Message:           "success",
+				CertAuthBackend:   []string{proto.AuthTypePassword},
+				PasswordExpiresIn: 3600,
+			})
+		}))
+	defer server.Close()
+	oldReadNewPassword := readNewPassword
+	defer func() { readNewPassword = oldReadNewPassword }()
+	readNewPassword = func(userName string) ([]byte, error) {
+		return []byte("new"), nil
+	}
+	privateKey, err := util.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshCert, _, _, err := getCertsFromServer(privateKey, "username",
+		[]byte("old"), server.URL, false, false, server.Client(), "test-agent",
+		testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(sshCert) != "cert for ssh" {
+		t.Fatalf("unexpected cert: %s", sshCert)
+	}
+	if password != "new" {
+		t.Fatalf("password not changed: %s", password)
+	}
+}
@@ -9,39 +9,36 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
-	"time"
 
 	"github.com/Cloud-Foundations/Dominator/lib/log"
-	"github.com/flynn/u2f/u2fhid"
-	"github.com/flynn/u2f/u2ftoken"
+	"github.com/Cloud-Foundations/keymaster/lib/client/twofa/ctap"
 	"github.com/tstranex/u2f"
 )
 
 const clientDataAuthenticationTypeValue = "navigator.id.getAssertion"
 
 func checkU2FDevices(logger log.Logger) {
-	// TODO: move this to initialization code, ans pass the device list to this function?
-	// or maybe pass the token?...
-	devices, err := u2fhid.Devices()
+	devices, err := ctap.Devices()
 	if err != nil {
 		logger.Fatal(err)
 	}
 	if len(devices) == 0 {
 		logger.Fatal("no U2F tokens found")
 	}
-
-	// TODO: transform this into an iteration over all found devices
 	for _, d := range devices {
-		//d := devices[0]
-		logger.Printf("manufacturer = %q, product = %q, vid = 0x%04x, pid = 0x%04x", d.Manufacturer, d.Product, d.ProductID, d.VendorID)
-
-		dev, err := u2fhid.Open(d)
-		if err != nil {
-			logger.Fatal(err)
-		}
-		defer dev.Close()
+		logger.Printf("manufacturer = %q, product = %q, path = %s",
+			d.Manufacturer, d.Product, d.Path)
 	}
+}
 
+// makeSignatureData returns the U2F signature data: the user presence flags
+// and counter of the authenticator data, followed by the signature.
+func makeSignatureData(assertion *ctap.Assertion) ([]byte, error) {
+	if len(assertion.AuthData) < 37 {
+		return nil, errors.New("authenticator data too short")
+	}
+	signatureData := append([]byte{}, assertion.AuthData[32:37]...)
+	return append(signatureData, assertion.Signature...), nil
 }
 
 func doU2FAuthenticate(
@@ -49,11 +46,11 @@ func doU2FAuthenticate(
 	baseURL string,
 	userAgentString string,
 	logger log.DebugLogger) error {
-	logger.Printf("top of doU2fAuthenticate")
+	logger.Debugf(1, "top of doU2fAuthenticate")
 	url := baseURL + "/u2f/SignRequest"
 	signRequest, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		logger.Fatal(err)
+		return err
 	}
 	signRequest.Header.Set("User-Agent", userAgentString)
 
@@ -74,117 +71,58 @@ func doU2FAuthenticate(
 	}
 
 	var webSignRequest u2f.WebSignRequest
-	if err := json.NewDecoder(signRequestResp.Body).Decode(&webSignRequest); err != nil {
-		//http.Error(w, "invalid response: "+err.Error(), http.StatusBadRequest)
-		//        return
-		logger.Fatal(err)
-	}
+	err = json.NewDecoder(signRequestResp.Body).Decode(&webSignRequest)
 	io.Copy(ioutil.Discard, signRequestResp.Body)
 	signRequestResp.Body.Close()
-
-	// TODO: move this to initialization code, ans pass the device list to this function?
-	// or maybe pass the token?...
-	devices, err := u2fhid.Devices()
 	if err != nil {
-		logger.Fatal(err)
 		return err
 	}
-	if len(devices) == 0 {
-		err = errors.New("no U2F tokens found")
-		logger.Println(err)
-		return err
-	}
-
-	// TODO: transform this into an iteration over all found devices
-	d := devices[0]
-	logger.Printf("manufacturer = %q, product = %q, vid = 0x%04x, pid = 0x%04x", d.Manufacturer, d.Product, d.ProductID, d.VendorID)
-
-	dev, err := u2fhid.Open(d)
-	if err != nil {
-		logger.Fatal(err)
-	}
-	defer dev.Close()
-	t := u2ftoken.NewToken(dev)
 
-	version, err := t.Version()
-	if err != nil {
-		logger.Fatal(err)
-	}
-	// TODO: Maybe use Debugf()?
-	logger.Println("version:", version)
-
-	///////
 	tokenAuthenticationClientData := u2f.ClientData{Typ: clientDataAuthenticationTypeValue, Challenge: webSignRequest.Challenge, Origin: webSignRequest.AppID}
 	tokenAuthenticationBuf := new(bytes.Buffer)
 	err = json.NewEncoder(tokenAuthenticationBuf).Encode(tokenAuthenticationClientData)
 	if err != nil {
-		logger.Fatal(err)
+		return err
 	}
 	reqSignChallenge := sha256.Sum256(tokenAuthenticationBuf.Bytes())
 
-	// TODO: update creation to silence linter
-	challenge := make([]byte, 32)
-	app := make([]byte, 32)
-
-	challenge = reqSignChallenge[:]
-	reqSingApp := sha256.Sum256([]byte(webSignRequest.AppID))
-	app = reqSingApp[:]
-
-	// We find out what key is associated to the currently inserted device.
-	keyIsKnown := false
-	var req u2ftoken.AuthenticateRequest
-	var keyHandle []byte
+	// U2F key handles are CTAP credential IDs and the AppID is the relying
+	// party, so keys speaking either CTAP2 or CTAP1 can answer.
+	var keyHandles [][]byte
 	for _, registeredKey := range webSignRequest.RegisteredKeys {
 		decodedHandle, err := base64.RawURLEncoding.DecodeString(registeredKey.KeyHandle)
 		if err != nil {
-			logger.Fatal(err)
-		}
-		keyHandle = decodedHandle
-
-		req = u2ftoken.AuthenticateRequest{
-			Challenge:   challenge,
-			Application: app,
-			KeyHandle:   keyHandle,
-		}
-
-		//logger.Printf("%+v", req)
-		if err := t.CheckAuthenticate(req); err == nil {
-			keyIsKnown = true
-			break
+			return err
 		}
+		keyHandles = append(keyHandles, decodedHandle)
+	}
+	if len(keyHandles) < 1 {
+		return errors.New("no U2F key registered")
 	}
-	if !keyIsKnown {
-		err = errors.New("key is not known")
+	assertion, err := ctap.Assert(ctap.AssertionRequest{
+		RPID:           webSignRequest.AppID,
+		ClientDataHash: reqSignChallenge[:],
+		CredentialIDs:  keyHandles,
+	}, logger)
+	if err != nil {
 		return err
 	}
-
-	// Now we ask the token to sign/authenticate
-	logger.Println("authenticating, provide user presence")
-	var rawBytes []byte
-	for {
-		res, err := t.Authenticate(req)
-		if err == u2ftoken.ErrPresenceRequired {
-			time.Sleep(200 * time.Millisecond)
-			continue
-		} else if err != nil {
-			logger.Fatal(err)
-		}
-		rawBytes = res.RawResponse
-		logger.Printf("counter = %d, signature = %x", res.Counter, res.Signature)
-		break
+	logger.Debugf(0, "authenticated with %s", assertion.Device)
+	signatureData, err := makeSignatureData(assertion)
+	if err != nil {
+		return err
 	}
 
 	// now we do the last request
 	var signRequestResponse u2f.SignResponse
-	signRequestResponse.KeyHandle = base64.RawURLEncoding.EncodeToString(keyHandle)
-	signRequestResponse.SignatureData = base64.RawURLEncoding.EncodeToString(rawBytes)
+	signRequestResponse.KeyHandle = base64.RawURLEncoding.EncodeToString(assertion.CredentialID)
+	signRequestResponse.SignatureData = base64.RawURLEncoding.EncodeToString(signatureData)
 	signRequestResponse.ClientData = base64.RawURLEncoding.EncodeToString(tokenAuthenticationBuf.Bytes())
 
-	//
 	webSignRequestBuf := &bytes.Buffer{}
 	err = json.NewEncoder(webSignRequestBuf).Encode(signRequestResponse)
 	if err != nil {
-		logger.Fatal(err)
+		return err
 	}
 
 	url = baseURL + "/u2f/SignResponse"
@@ -204,7 +142,7 @@ func doU2FAuthenticate(
 	defer signRequestResp2.Body.Close()
 	if signRequestResp2.StatusCode != 200 {
 		logger.Printf("got error from call %s, url='%s'\n", signRequestResp2.Status, url)
-		return err
+		return errors.New("failed response from sign response")
 	}
 	io.Copy(ioutil.Discard, signRequestResp2.Body)
 	return nil
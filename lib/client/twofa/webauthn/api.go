@@ -0,0 +1,36 @@
+// Package webauthn does WebAuthn authentication against keymaster using a
+// FIDO2 (CTAP2) authenticator such as a security key or, where libfido2
+// supports it, a platform authenticator like Windows Hello.
+package webauthn
+
+import (
+	"net/http"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+)
+
+// DeviceCount returns the number of FIDO2 authenticators attached.
+func DeviceCount() (int, error) {
+	return deviceCount()
+}
+
+// DoWebAuthnAuthenticate does WebAuthn authentication. An authenticated
+// session cookie for baseURL must already be present in client.
+func DoWebAuthnAuthenticate(
+	client *http.Client,
+	baseURL string,
+	userAgentString string,
+	logger log.DebugLogger) error {
+	return doWebAuthnAuthenticate(client, baseURL, userAgentString, logger)
+}
+
+// DoOktaWebAuthnAuthenticate does WebAuthn authentication with an
+// authenticator registered with Okta, relayed through keymaster. An
+// authenticated session cookie for baseURL must already be present in client.
+func DoOktaWebAuthnAuthenticate(
+	client *http.Client,
+	baseURL string,
+	userAgentString string,
+	logger log.DebugLogger) error {
+	return doOktaWebAuthnAuthenticate(client, baseURL, userAgentString, logger)
+}
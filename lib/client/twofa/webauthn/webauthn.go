@@ -0,0 +1,217 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"github.com/Cloud-Foundations/keymaster/lib/client/twofa/ctap"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+const clientDataTypeGet = "webauthn.get"
+
+type credentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+type credentialRequestOptions struct {
+	Challenge        string                 `json:"challenge"`
+	RPID             string                 `json:"rpId"`
+	AllowCredentials []credentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+type credentialAssertion struct {
+	PublicKey credentialRequestOptions `json:"publicKey"`
+	// Origin is set when the credentials belong to another relying party,
+	// such as Okta, whose origin the client data must name.
+	Origin string `json:"origin,omitempty"`
+}
+
+type collectedClientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+type assertionResponse struct {
+	AuthenticatorData string `json:"authenticatorData"`
+	ClientDataJSON    string `json:"clientDataJSON"`
+	Signature         string `json:"signature"`
+	UserHandle        string `json:"userHandle,omitempty"`
+}
+
+type credentialAssertionResponse struct {
+	ID       string            `json:"id"`
+	RawID    string            `json:"rawId"`
+	Type     string            `json:"type"`
+	Response assertionResponse `json:"response"`
+}
+
+func encode(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decode(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(value)
+}
+
+func deviceCount() (int, error) {
+	devices, err := ctap.Devices()
+	return len(devices), err
+}
+
+// getOrigin returns the WebAuthn origin for baseURL, which omits the default
+// port.
+func getOrigin(baseURL string) (string, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "https" {
+		return "", fmt.Errorf("WebAuthn requires https, got %s", baseURL)
+	}
+	host := u.Host
+	if u.Port() == "443" {
+		host = u.Hostname()
+	}
+	return u.Scheme + "://" + host, nil
+}
+
+// makeClientDataJSON returns the client data the authenticator signs over.
+func makeClientDataJSON(challenge, origin string) ([]byte, error) {
+	return json.Marshal(collectedClientData{
+		Type:      clientDataTypeGet,
+		Challenge: challenge,
+		Origin:    origin,
+	})
+}
+
+func getAssertion(options credentialRequestOptions,
+	clientDataHash []byte, logger log.DebugLogger) (*ctap.Assertion, error) {
+	var credentialIDs [][]byte
+	for _, credential := range options.AllowCredentials {
+		credentialID, err := decode(credential.ID)
+		if err != nil {
+			return nil, err
+		}
+		credentialIDs = append(credentialIDs, credentialID)
+	}
+	return ctap.Assert(ctap.AssertionRequest{
+		RPID:             options.RPID,
+		ClientDataHash:   clientDataHash,
+		CredentialIDs:    credentialIDs,
+		UserVerification: options.UserVerification == "required",
+	}, logger)
+}
+
+func doWebAuthnAuthenticate(
+	client *http.Client,
+	baseURL string,
+	userAgentString string,
+	logger log.DebugLogger) error {
+	return doAuthenticate(client, baseURL, proto.WebAuthnAuthBeginPath,
+		proto.WebAuthnAuthFinishPath, userAgentString, logger)
+}
+
+func doOktaWebAuthnAuthenticate(
+	client *http.Client,
+	baseURL string,
+	userAgentString string,
+	logger log.DebugLogger) error {
+	return doAuthenticate(client, baseURL, proto.OktaWebAuthnAuthBeginPath,
+		proto.OktaWebAuthnAuthFinishPath, userAgentString, logger)
+}
+
+func doAuthenticate(
+	client *http.Client,
+	baseURL string,
+	beginPath string,
+	finishPath string,
+	userAgentString string,
+	logger log.DebugLogger) error {
+	origin, err := getOrigin(baseURL)
+	if err != nil {
+		return err
+	}
+	beginURL := baseURL + beginPath
+	req, err := http.NewRequest("GET", beginURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", userAgentString)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return fmt.Errorf("got error from call %s, url='%s'",
+			resp.Status, beginURL)
+	}
+	var options credentialAssertion
+	err = json.NewDecoder(resp.Body).Decode(&options)
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if options.Origin != "" {
+		origin = options.Origin
+	}
+	clientDataJSON, err := makeClientDataJSON(options.PublicKey.Challenge,
+		origin)
+	if err != nil {
+		return err
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	assertion, err := getAssertion(options.PublicKey, clientDataHash[:],
+		logger)
+	if err != nil {
+		return err
+	}
+	response := credentialAssertionResponse{
+		ID:    encode(assertion.CredentialID),
+		RawID: encode(assertion.CredentialID),
+		Type:  "public-key",
+		Response: assertionResponse{
+			AuthenticatorData: encode(assertion.AuthData),
+			ClientDataJSON:    encode(clientDataJSON),
+			Signature:         encode(assertion.Signature),
+			UserHandle:        encode(assertion.UserID),
+		},
+	}
+	body, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	finishURL := baseURL + finishPath
+	req, err = http.NewRequest("POST", finishURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgentString)
+	resp, err = client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("got error from call %s, url='%s'",
+			resp.Status, finishURL)
+	}
+	logger.Debugf(1, "WebAuthn authentication complete")
+	return nil
+}
@@ -0,0 +1,51 @@
+package webauthn
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestGetOrigin(t *testing.T) {
+	for _, test := range []struct {
+		baseURL string
+		origin  string
+		valid   bool
+	}{
+		{"https://keymaster.example.com", "https://keymaster.example.com",
+			true},
+		{"https://keymaster.example.com:443",
+			"https://keymaster.example.com", true},
+		{"https://keymaster.example.com:8443/",
+			"https://keymaster.example.com:8443", true},
+		{"http://keymaster.example.com", "", false},
+		{"://keymaster.example.com", "", false},
+	} {
+		origin, err := getOrigin(test.baseURL)
+		if test.valid && err != nil {
+			t.Errorf("%s: %s", test.baseURL, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s should be invalid", test.baseURL)
+		} else if origin != test.origin {
+			t.Errorf("%s: got %s", test.baseURL, origin)
+		}
+	}
+}
+
+func TestMakeClientDataJSON(t *testing.T) {
+	clientDataJSON, err := makeClientDataJSON("Y2hhbGxlbmdl",
+		"https://keymaster.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var clientData collectedClientData
+	if err := json.Unmarshal(clientDataJSON, &clientData); err != nil {
+		t.Fatal(err)
+	}
+	if clientData != (collectedClientData{
+		Type:      clientDataTypeGet,
+		Challenge: "Y2hhbGxlbmdl",
+		Origin:    "https://keymaster.example.com",
+	}) {
+		t.Fatalf("unexpected client data: %+v", clientData)
+	}
+}
@@ -0,0 +1,20 @@
+// Package webhook does two factor authentication with a second factor which
+// the server checks with a webhook: the webhook may ask for a response, such
+// as a code, or approve the login out of band, such as with a push.
+package webhook
+
+import (
+	"net/http"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+)
+
+// DoWebhookAuthenticate starts a webhook login, prompts for the responses
+// the webhook asks for and waits for pending approvals.
+func DoWebhookAuthenticate(
+	client *http.Client,
+	baseURL string,
+	userAgentString string,
+	logger log.DebugLogger) error {
+	return doWebhookAuthenticate(client, baseURL, userAgentString, logger)
+}
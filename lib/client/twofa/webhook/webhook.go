@@ -0,0 +1,128 @@
+package webhook
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+	"github.com/howeyc/gopass"
+)
+
+const (
+	defaultPrompt = "Enter code"
+	// maxChallenges limits the challenges answered for one login.
+	maxChallenges  = 5
+	maxPendingWait = 60 * time.Second
+)
+
+// pollInterval is replaced in tests.
+var pollInterval = 2 * time.Second
+
+// readCode is replaced in tests.
+var readCode = func(prompt string) (string, error) {
+	fmt.Printf("%s: ", strings.TrimRight(prompt, ": "))
+	code, err := gopass.GetPasswd()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(code)), nil
+}
+
+// submitResponse posts response and state and returns the challenge of the
+// server, which has an empty State on success, or nil if the login was
+// denied.
+func submitResponse(client *http.Client, baseURL string, response string,
+	state string, userAgentString string) (*proto.WebhookChallenge, error) {
+	form := url.Values{}
+	if response != "" {
+		form.Add("OTP", response)
+	}
+	if state != "" {
+		form.Add("state", state)
+	}
+	req, err := http.NewRequest("POST", baseURL+proto.WebhookAuthPath,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Length", strconv.Itoa(len(form.Encode())))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Add("Accept", "application/json")
+	req.Header.Set("User-Agent", userAgentString)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	defer io.Copy(ioutil.Discard, resp.Body)
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var challenge proto.WebhookChallenge
+		if err := json.NewDecoder(resp.Body).Decode(&challenge); err != nil {
+			return nil, err
+		}
+		return &challenge, nil
+	case http.StatusUnauthorized:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("got error from webhook call %s", resp.Status)
+}
+
+func doWebhookAuthenticate(
+	client *http.Client,
+	baseURL string,
+	userAgentString string,
+	logger log.DebugLogger) error {
+	var response, state, lastMessage string
+	var pendingSince time.Time
+	for challenges := 0; ; {
+		challenge, err := submitResponse(client, baseURL, response, state,
+			userAgentString)
+		if err != nil {
+			return err
+		}
+		if challenge == nil {
+			return errors.New("second factor denied by webhook")
+		}
+		if challenge.State == "" {
+			return nil
+		}
+		state = challenge.State
+		response = ""
+		if challenge.Pending {
+			if pendingSince.IsZero() {
+				pendingSince = time.Now()
+			} else if time.Since(pendingSince) > maxPendingWait {
+				return errors.New("timed out waiting for webhook approval")
+			}
+			if challenge.Message != "" && challenge.Message != lastMessage {
+				logger.Println(challenge.Message)
+			}
+			lastMessage = challenge.Message
+			time.Sleep(pollInterval)
+			continue
+		}
+		pendingSince = time.Time{}
+		if challenges >= maxChallenges {
+			return errors.New("too many webhook challenges")
+		}
+		challenges++
+		prompt := challenge.Message
+		if prompt == "" {
+			prompt = defaultPrompt
+		}
+		response, err = readCode(prompt)
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package webhook
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log/testlogger"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+)
+
+// testHandler asks for a code, then approves after two pending checks.
+func testHandler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != proto.WebhookAuthPath {
+			t.Errorf("unexpected request for %s", r.URL.Path)
+		}
+		var challenge proto.WebhookChallenge
+		switch r.FormValue("state") {
+		case "":
+			challenge = proto.WebhookChallenge{Message: "Enter PIN",
+				State: "pin"}
+		case "pin":
+			if r.FormValue("OTP") != "4711" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			challenge = proto.WebhookChallenge{Message: "Approve on phone",
+				State: "push-1", Pending: true}
+		case "push-1":
+			challenge = proto.WebhookChallenge{Message: "Approve on phone",
+				State: "push-2", Pending: true}
+		case "push-2":
+			challenge = proto.WebhookChallenge{Message: "success"}
+		}
+		json.NewEncoder(w).Encode(challenge)
+	}
+}
+
+func testAuthenticate(t *testing.T, code string) error {
+	origPollInterval := pollInterval
+	origReadCode := readCode
+	defer func() {
+		pollInterval = origPollInterval
+		readCode = origReadCode
+	}()
+	pollInterval = 0
+	readCode = func(prompt string) (string, error) {
+		if prompt != "Enter PIN" {
+			t.Errorf("unexpected prompt: %s", prompt)
+		}
+		return code, nil
+	}
+	server := httptest.NewServer(testHandler(t))
+	defer server.Close()
+	return DoWebhookAuthenticate(server.Client(), server.URL, "test-agent",
+		testlogger.New(t))
+}
+
+func TestDoWebhookAuthenticate(t *testing.T) {
+	if err := testAuthenticate(t, "4711"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDoWebhookAuthenticateDenied(t *testing.T) {
+	if err := testAuthenticate(t, "1234"); err == nil {
+		t.Fatal("wrong PIN should have failed")
+	}
+}
@@ -6,11 +6,17 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
+	"crypto/x509"
 	"net/http"
+	"net/url"
+	"os"
 	"os/user"
+	"runtime"
+	"time"
 
 	"github.com/Cloud-Foundations/Dominator/lib/log"
 	"github.com/Cloud-Foundations/keymaster/lib/client/net"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
 )
 
 // GetUserCreds prompts the user for thier password and returns it.
@@ -18,27 +24,172 @@ func GetUserCreds(userName string) (password []byte, err error) {
 	return getUserCreds(userName)
 }
 
-// GetUserHomeDir returns the user's home directory.
+// GetUserHomeDir returns the user's home directory. On Windows this is the
+// profile directory in %USERPROFILE% (or %HOMEDRIVE%%HOMEPATH%) when set.
 func GetUserHomeDir(usr *user.User) (string, error) {
-	// TODO: verify on Windows... see: http://stackoverflow.com/questions/7922270/obtain-users-home-directory
-	return usr.HomeDir, nil
+	return getUserHomeDir(usr, runtime.GOOS, os.Getenv)
 }
 
 // GenKeyPair uses internal golang functions to be portable
 func GenKeyPair(
 	privateKeyPath string, identity string, logger log.Logger) (
 	privateKey crypto.Signer, publicKeyPath string, err error) {
-	return genKeyPair(privateKeyPath, identity, logger)
+	return genKeyPair(privateKeyPath, identity, proto.KeyTypeRSA, 0, logger)
+}
+
+// GenKeyPairWithType is like GenKeyPair, but generates a key of keyType,
+// which is one of the proto.KeyType* constants.
+func GenKeyPairWithType(
+	privateKeyPath string, identity string, keyType string,
+	logger log.Logger) (
+	privateKey crypto.Signer, publicKeyPath string, err error) {
+	return genKeyPair(privateKeyPath, identity, keyType, 0, logger)
+}
+
+// GenKeyPairWithTypeAndBits is like GenKeyPairWithType, but the key has
+// bits bits. Zero selects the default size of keyType (2048 bits for RSA).
+func GenKeyPairWithTypeAndBits(
+	privateKeyPath string, identity string, keyType string, bits int,
+	logger log.Logger) (
+	privateKey crypto.Signer, publicKeyPath string, err error) {
+	return genKeyPair(privateKeyPath, identity, keyType, bits, logger)
+}
+
+// ParseKeyType parses spec, which is one of the proto.KeyType* constants
+// or a type with a size such as "rsa-4096" or "ecdsa-p256". The key type
+// and its size are returned; the size is zero if spec does not give one.
+func ParseKeyType(spec string) (keyType string, bits int, err error) {
+	return parseKeyType(spec)
+}
+
+// CheckKeySize returns an error if keys of keyType cannot have bits bits.
+// RSA keys may have 2048, 3072 or 4096 bits and ECDSA keys 256. Zero is
+// always accepted and selects the default size.
+func CheckKeySize(keyType string, bits int) error {
+	return checkKeySize(keyType, bits)
 }
 
 // GetHttpClient returns an http client instance to use given a
-// particular TLS configuration.
+// particular TLS configuration. The proxy is taken from the environment.
 func GetHttpClient(tlsConfig *tls.Config,
 	dialer net.Dialer) (*http.Client, error) {
 	return getHttpClient(tlsConfig, dialer)
 }
 
+// ProxyAuthenticator supplies credentials for an authenticating HTTP proxy.
+// It may be used to plug in schemes such as NTLM or Negotiate.
+type ProxyAuthenticator interface {
+	// ProxyAuthorization returns the value of the Proxy-Authorization
+	// header to send to proxyURL. The challenges contain the
+	// Proxy-Authenticate values of the last 407 response from the proxy, if
+	// any. An empty value means no header is sent.
+	ProxyAuthorization(proxyURL *url.URL, challenges []string) (string, error)
+}
+
+// NewBasicProxyAuthenticator returns a ProxyAuthenticator using the Basic
+// scheme with the given credentials.
+func NewBasicProxyAuthenticator(username string,
+	password []byte) ProxyAuthenticator {
+	return &basicProxyAuthenticator{
+		username: username,
+		password: string(password),
+	}
+}
+
+// GetHttpClientWithProxyAuth is like GetHttpClient, but authenticates to
+// the proxy using proxyAuthenticator. A 407 Proxy Authentication Required
+// response is answered once with the challenges it contains.
+func GetHttpClientWithProxyAuth(tlsConfig *tls.Config,
+	dialer net.Dialer,
+	proxyAuthenticator ProxyAuthenticator) (*http.Client, error) {
+	return getHttpClientWithProxyAuth(tlsConfig, dialer, proxyAuthenticator)
+}
+
+// ProxyConfig selects the proxy used by an http client.
+type ProxyConfig struct {
+	// URL is the http://, https://, socks5:// or socks5h:// URL of the
+	// proxy, with the http scheme as default. If empty, the proxy is taken
+	// from $HTTPS_PROXY, $HTTP_PROXY and $ALL_PROXY.
+	URL string
+	// NoProxy lists the hosts, domains and CIDRs which are reached
+	// directly, in the format of $NO_PROXY, which is used if it is empty.
+	NoProxy string
+	// Authenticator, if not nil, authenticates to HTTP proxies.
+	Authenticator ProxyAuthenticator
+}
+
+// GetHttpClientWithProxyConfig is like GetHttpClient, but uses the proxy
+// given by proxyConfig. Proxies are reached with dialer.
+func GetHttpClientWithProxyConfig(tlsConfig *tls.Config,
+	dialer net.Dialer, proxyConfig ProxyConfig) (*http.Client, error) {
+	return getHttpClientWithProxyConfig(tlsConfig, dialer, proxyConfig)
+}
+
+// GetHttpClientWithCertificate returns a copy of client, as returned by
+// GetHttpClient and friends, which presents certificate to servers asking for
+// a client certificate. The cookie jar is shared with client.
+func GetHttpClientWithCertificate(client *http.Client,
+	certificate tls.Certificate) (*http.Client, error) {
+	return getHttpClientWithCertificate(client, certificate)
+}
+
+// DefaultRSAKeySize is the size in bits of generated RSA keys unless another
+// size is requested.
+const DefaultRSAKeySize = rsaKeySize
+
 // GenerateKey generates a random 2048 byte rsa key
 func GenerateKey() (*rsa.PrivateKey, error) {
 	return rsa.GenerateKey(rand.Reader, rsaKeySize)
 }
+
+// GenerateKeyWithType generates a random key of keyType, which is one of
+// the proto.KeyType* constants. ECDSA keys use the P-256 curve.
+func GenerateKeyWithType(keyType string) (crypto.Signer, error) {
+	return generateKey(keyType)
+}
+
+// GenerateKeyWithTypeAndBits is like GenerateKeyWithType, but the key has
+// bits bits. Zero selects the default size of keyType.
+func GenerateKeyWithTypeAndBits(keyType string, bits int) (crypto.Signer,
+	error) {
+	return generateKeyWithBits(keyType, bits)
+}
+
+// CheckChainExpiry inspects every non-leaf certificate in the PEM encoded
+// chain given by pemData and logs a warning for each one that expires
+// within window. The expiring certificates are returned.
+func CheckChainExpiry(pemData []byte, window time.Duration,
+	logger log.Logger) ([]*x509.Certificate, error) {
+	return checkChainExpiry(pemData, window, logger)
+}
+
+// LifetimeError is returned by CheckGrantedLifetime when a certificate was
+// granted for much less time than requested.
+type LifetimeError struct {
+	CertType  string
+	Requested time.Duration
+	Granted   time.Duration
+}
+
+func (e *LifetimeError) Error() string {
+	return e.error()
+}
+
+// CheckGrantedLifetime compares the lifetime of the SSH certificate (in
+// authorized_keys format) and of the PEM encoded x509 certificate with the
+// requested lifetime. A *LifetimeError is returned if either was granted
+// less than minFraction of requested. Nil certificates are skipped.
+func CheckGrantedLifetime(requested time.Duration, minFraction float64,
+	sshCert []byte, x509Cert []byte) error {
+	return checkGrantedLifetime(requested, minFraction, sshCert, x509Cert)
+}
+
+// GetRenewalTime returns when the SSH certificate (in authorized_keys format)
+// and the PEM encoded x509 certificate should be renewed: renewFraction of
+// the way through the validity window of whichever expires first. The
+// difference between their expiry times is also returned. Nil certificates
+// are skipped.
+func GetRenewalTime(renewFraction float64, sshCert []byte,
+	x509Cert []byte) (renewAt time.Time, divergence time.Duration, err error) {
+	return getRenewalTime(renewFraction, sshCert, x509Cert)
+}
@@ -0,0 +1,53 @@
+package util
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+)
+
+func parsePEMCertificates(pemData []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, pemData = pem.Decode(pemData)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) < 1 {
+		return nil, errors.New("no certificates found")
+	}
+	return certs, nil
+}
+
+func checkChainExpiry(pemData []byte, window time.Duration,
+	logger log.Logger) ([]*x509.Certificate, error) {
+	certs, err := parsePEMCertificates(pemData)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(window)
+	var expiring []*x509.Certificate
+	// The first certificate is the leaf, the rest make up the chain.
+	for _, cert := range certs[1:] {
+		if cert.NotAfter.After(deadline) {
+			continue
+		}
+		logger.Printf("WARNING: intermediate CA %q expires at %s",
+			cert.Subject.CommonName, cert.NotAfter.Format(time.RFC3339))
+		expiring = append(expiring, cert)
+	}
+	return expiring, nil
+}
@@ -0,0 +1,106 @@
+package util
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log/testlogger"
+)
+
+type testChainCert struct {
+	cert   *x509.Certificate
+	signer crypto.Signer
+	der    []byte
+}
+
+func genTestChainCert(t *testing.T, commonName string, notAfter time.Time,
+	isCA bool, parent *testChainCert) *testChainCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		template.KeyUsage = x509.KeyUsageCertSign
+	}
+	issuer, issuerKey := template, crypto.Signer(key)
+	if parent != nil {
+		issuer, issuerKey = parent.cert, parent.signer
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer,
+		key.Public(), issuerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testChainCert{cert: cert, signer: key, der: der}
+}
+
+func genTestChainPEM(t *testing.T, intermediateNotAfter time.Time) []byte {
+	now := time.Now()
+	root := genTestChainCert(t, "root", now.Add(10*365*24*time.Hour), true,
+		nil)
+	intermediate := genTestChainCert(t, "intermediate", intermediateNotAfter,
+		true, root)
+	leaf := genTestChainCert(t, "leaf", now.Add(time.Hour), false,
+		intermediate)
+	var buffer bytes.Buffer
+	for _, cert := range []*testChainCert{leaf, intermediate} {
+		pem.Encode(&buffer, &pem.Block{Type: "CERTIFICATE", Bytes: cert.der})
+	}
+	return buffer.Bytes()
+}
+
+func TestCheckChainExpiryNearExpiryIntermediate(t *testing.T) {
+	pemData := genTestChainPEM(t, time.Now().Add(24*time.Hour))
+	expiring, err := CheckChainExpiry(pemData, 7*24*time.Hour,
+		testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expiring) != 1 {
+		t.Fatalf("expected one expiring intermediate, got %d", len(expiring))
+	}
+	if expiring[0].Subject.CommonName != "intermediate" {
+		t.Fatalf("unexpected cert %s", expiring[0].Subject.CommonName)
+	}
+}
+
+func TestCheckChainExpiryHealthyChain(t *testing.T) {
+	pemData := genTestChainPEM(t, time.Now().Add(365*24*time.Hour))
+	expiring, err := CheckChainExpiry(pemData, 7*24*time.Hour,
+		testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expiring) != 0 {
+		t.Fatalf("expected no expiring intermediates, got %d", len(expiring))
+	}
+}
+
+func TestCheckChainExpiryNoCerts(t *testing.T) {
+	_, err := CheckChainExpiry([]byte("garbage"), time.Hour,
+		testlogger.New(t))
+	if err == nil {
+		t.Fatal("should have failed with no certificates")
+	}
+}
@@ -0,0 +1,122 @@
+package util
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func getSSHCertValidity(sshCert []byte) (time.Time, time.Time, error) {
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey(sshCert)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	cert, ok := pubKey.(*ssh.Certificate)
+	if !ok {
+		return time.Time{}, time.Time{}, fmt.Errorf("not an SSH certificate")
+	}
+	if cert.ValidBefore < cert.ValidAfter {
+		return time.Time{}, time.Time{},
+			fmt.Errorf("invalid SSH certificate validity")
+	}
+	return time.Unix(int64(cert.ValidAfter), 0),
+		time.Unix(int64(cert.ValidBefore), 0), nil
+}
+
+func getX509CertValidity(x509Cert []byte) (time.Time, time.Time, error) {
+	certs, err := parsePEMCertificates(x509Cert)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return certs[0].NotBefore, certs[0].NotAfter, nil
+}
+
+func getSSHCertLifetime(sshCert []byte) (time.Duration, error) {
+	notBefore, notAfter, err := getSSHCertValidity(sshCert)
+	if err != nil {
+		return 0, err
+	}
+	return notAfter.Sub(notBefore), nil
+}
+
+func getX509CertLifetime(x509Cert []byte) (time.Duration, error) {
+	notBefore, notAfter, err := getX509CertValidity(x509Cert)
+	if err != nil {
+		return 0, err
+	}
+	return notAfter.Sub(notBefore), nil
+}
+
+func getRenewalTime(renewFraction float64, sshCert []byte,
+	x509Cert []byte) (time.Time, time.Duration, error) {
+	var expiries []time.Time
+	var renewAt, earliest time.Time
+	for _, cert := range []struct {
+		validity func([]byte) (time.Time, time.Time, error)
+		data     []byte
+	}{
+		{getSSHCertValidity, sshCert},
+		{getX509CertValidity, x509Cert},
+	} {
+		if cert.data == nil {
+			continue
+		}
+		notBefore, notAfter, err := cert.validity(cert.data)
+		if err != nil {
+			return time.Time{}, 0, err
+		}
+		expiries = append(expiries, notAfter)
+		if earliest.IsZero() || notAfter.Before(earliest) {
+			earliest = notAfter
+			renewAt = notBefore.Add(
+				time.Duration(float64(notAfter.Sub(notBefore)) * renewFraction))
+		}
+	}
+	if len(expiries) < 1 {
+		return time.Time{}, 0, fmt.Errorf("no certificates given")
+	}
+	var divergence time.Duration
+	if len(expiries) == 2 {
+		divergence = expiries[0].Sub(expiries[1])
+		if divergence < 0 {
+			divergence = -divergence
+		}
+	}
+	return renewAt, divergence, nil
+}
+
+func checkGrantedLifetime(requested time.Duration, minFraction float64,
+	sshCert []byte, x509Cert []byte) error {
+	minimum := time.Duration(float64(requested) * minFraction)
+	type certLifetime struct {
+		name     string
+		lifetime func([]byte) (time.Duration, error)
+		data     []byte
+	}
+	for _, cert := range []certLifetime{
+		{"SSH", getSSHCertLifetime, sshCert},
+		{"X509", getX509CertLifetime, x509Cert},
+	} {
+		if cert.data == nil {
+			continue
+		}
+		granted, err := cert.lifetime(cert.data)
+		if err != nil {
+			return err
+		}
+		if granted < minimum {
+			return &LifetimeError{
+				CertType:  cert.name,
+				Requested: requested,
+				Granted:   granted,
+			}
+		}
+	}
+	return nil
+}
+
+func (e *LifetimeError) error() string {
+	return fmt.Sprintf("%s cert lifetime %s is much shorter than requested %s",
+		e.CertType, e.Granted.Round(time.Second), e.Requested)
+}
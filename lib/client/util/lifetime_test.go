@@ -0,0 +1,117 @@
+package util
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func genTestSSHCert(t *testing.T, lifetime time.Duration) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             signer.PublicKey(),
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"username"},
+		ValidAfter:      uint64(now.Unix()),
+		ValidBefore:     uint64(now.Add(lifetime).Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, signer); err != nil {
+		t.Fatal(err)
+	}
+	return ssh.MarshalAuthorizedKey(cert)
+}
+
+func TestCheckGrantedLifetimeShortSSH(t *testing.T) {
+	sshCert := genTestSSHCert(t, time.Hour)
+	err := CheckGrantedLifetime(16*time.Hour, 0.5, sshCert, nil)
+	if err == nil {
+		t.Fatal("should have detected short lifetime")
+	}
+	lifetimeErr, ok := err.(*LifetimeError)
+	if !ok {
+		t.Fatalf("unexpected error type %T", err)
+	}
+	if lifetimeErr.CertType != "SSH" || lifetimeErr.Granted != time.Hour {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func TestCheckGrantedLifetimeShortX509(t *testing.T) {
+	// The chain helpers produce a leaf valid for about two hours.
+	x509Cert := genTestChainPEM(t, time.Now().Add(365*24*time.Hour))
+	err := CheckGrantedLifetime(16*time.Hour, 0.5, nil, x509Cert)
+	if err == nil {
+		t.Fatal("should have detected short lifetime")
+	}
+	if err := CheckGrantedLifetime(2*time.Hour, 0.5, nil,
+		x509Cert); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckGrantedLifetimeSufficient(t *testing.T) {
+	sshCert := genTestSSHCert(t, 15*time.Hour)
+	if err := CheckGrantedLifetime(16*time.Hour, 0.5, sshCert,
+		nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetRenewalTimeUsesEarliestExpiry(t *testing.T) {
+	// The chain helpers produce a leaf valid from one hour ago to one hour
+	// from now.
+	x509Cert := genTestChainPEM(t, time.Now().Add(365*24*time.Hour))
+	now := time.Now()
+	sshCert := genTestSSHCert(t, 30*time.Minute)
+	renewAt, divergence, err := GetRenewalTime(0.5, sshCert, x509Cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := now.Add(15 * time.Minute)
+	if diff := renewAt.Sub(expected); diff > 2*time.Second ||
+		diff < -2*time.Second {
+		t.Fatalf("expected renewal near %s, got %s", expected, renewAt)
+	}
+	if divergence < 29*time.Minute || divergence > 31*time.Minute {
+		t.Fatalf("unexpected divergence %s", divergence)
+	}
+	// Now the x509 cert expires first.
+	sshCert = genTestSSHCert(t, 3*time.Hour)
+	renewAt, divergence, err = GetRenewalTime(0.5, sshCert, x509Cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := renewAt.Sub(now); diff > 2*time.Second ||
+		diff < -2*time.Second {
+		t.Fatalf("expected renewal near %s, got %s", now, renewAt)
+	}
+	if divergence < 119*time.Minute || divergence > 121*time.Minute {
+		t.Fatalf("unexpected divergence %s", divergence)
+	}
+}
+
+func TestGetRenewalTimeSingleCert(t *testing.T) {
+	sshCert := genTestSSHCert(t, time.Hour)
+	_, divergence, err := GetRenewalTime(0.5, sshCert, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if divergence != 0 {
+		t.Fatalf("unexpected divergence %s", divergence)
+	}
+	if _, _, err := GetRenewalTime(0.5, nil, nil); err == nil {
+		t.Fatal("should fail without certificates")
+	}
+}
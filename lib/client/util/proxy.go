@@ -0,0 +1,201 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Proxy schemes supported by http.Transport. SOCKS5 credentials are taken
+// from the user information of the URL.
+var proxySchemes = map[string]bool{
+	"http":    true,
+	"https":   true,
+	"socks5":  true,
+	"socks5h": true,
+}
+
+type noProxyEntry struct {
+	all    bool
+	ipNet  *net.IPNet
+	ip     net.IP
+	domain string // Without leading dot.
+	port   string // Empty: any port.
+}
+
+type proxySelector struct {
+	httpProxy  *url.URL
+	httpsProxy *url.URL
+	noProxy    []noProxyEntry
+}
+
+func getenvFirst(getenv func(string) string, names ...string) (string,
+	string) {
+	for _, name := range names {
+		if value := getenv(name); value != "" {
+			return name, value
+		}
+	}
+	return "", ""
+}
+
+// parseProxyURL parses rawURL, which defaults to the http scheme.
+func parseProxyURL(rawURL string) (*url.URL, error) {
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "http://" + rawURL
+	}
+	proxyURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if !proxySchemes[proxyURL.Scheme] {
+		return nil, fmt.Errorf("unsupported proxy scheme: %s", proxyURL.Scheme)
+	}
+	if proxyURL.Hostname() == "" {
+		return nil, fmt.Errorf("no host in proxy URL: %s", rawURL)
+	}
+	return proxyURL, nil
+}
+
+func parseEnvProxyURL(getenv func(string) string,
+	names ...string) (*url.URL, error) {
+	name, value := getenvFirst(getenv, names...)
+	if value == "" {
+		return nil, nil
+	}
+	proxyURL, err := parseProxyURL(value)
+	if err != nil {
+		return nil, fmt.Errorf("$%s: %s", name, err)
+	}
+	return proxyURL, nil
+}
+
+// parseNoProxy parses a comma or space separated list of hosts, domains,
+// IP addresses and CIDRs, optionally with a port, in the format of
+// $NO_PROXY. "*" matches every host.
+func parseNoProxy(noProxy string) []noProxyEntry {
+	var entries []noProxyEntry
+	for _, field := range strings.FieldsFunc(noProxy, func(r rune) bool {
+		return r == ',' || r == ' '
+	}) {
+		field = strings.ToLower(field)
+		if field == "*" {
+			return []noProxyEntry{{all: true}}
+		}
+		if _, ipNet, err := net.ParseCIDR(field); err == nil {
+			entries = append(entries, noProxyEntry{ipNet: ipNet})
+			continue
+		}
+		var entry noProxyEntry
+		if host, port, err := net.SplitHostPort(field); err == nil {
+			field, entry.port = host, port
+		}
+		field = strings.Trim(field, "[]")
+		if ip := net.ParseIP(field); ip != nil {
+			entry.ip = ip
+		} else {
+			entry.domain = strings.TrimPrefix(strings.TrimPrefix(field, "*"),
+				".")
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func (e noProxyEntry) match(host, port string) bool {
+	if e.all {
+		return true
+	}
+	if e.port != "" && e.port != port {
+		return false
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case e.ipNet != nil:
+		return ip != nil && e.ipNet.Contains(ip)
+	case e.ip != nil:
+		return ip != nil && e.ip.Equal(ip)
+	case e.domain == "":
+		return false
+	}
+	return host == e.domain || strings.HasSuffix(host, "."+e.domain)
+}
+
+// newProxySelector returns the proxies given by config or, if it has no
+// URL, by the environment. HTTPS requests use $HTTPS_PROXY and plain requests
+// $HTTP_PROXY (lower case names win). Each falls back to the other, as
+// earlier versions used either for all requests, and then to $ALL_PROXY.
+func newProxySelector(config ProxyConfig,
+	getenv func(string) string) (*proxySelector, error) {
+	var selector proxySelector
+	if config.URL != "" {
+		proxyURL, err := parseProxyURL(config.URL)
+		if err != nil {
+			return nil, err
+		}
+		selector.httpProxy = proxyURL
+		selector.httpsProxy = proxyURL
+	} else {
+		var err error
+		selector.httpProxy, err = parseEnvProxyURL(getenv, "http_proxy",
+			"HTTP_PROXY")
+		if err != nil {
+			return nil, err
+		}
+		selector.httpsProxy, err = parseEnvProxyURL(getenv, "https_proxy",
+			"HTTPS_PROXY")
+		if err != nil {
+			return nil, err
+		}
+		allProxy, err := parseEnvProxyURL(getenv, "all_proxy", "ALL_PROXY")
+		if err != nil {
+			return nil, err
+		}
+		if selector.httpProxy == nil {
+			selector.httpProxy = selector.httpsProxy
+		}
+		if selector.httpsProxy == nil {
+			selector.httpsProxy = selector.httpProxy
+		}
+		if selector.httpProxy == nil {
+			selector.httpProxy = allProxy
+			selector.httpsProxy = allProxy
+		}
+	}
+	noProxy := config.NoProxy
+	if noProxy == "" {
+		_, noProxy = getenvFirst(getenv, "no_proxy", "NO_PROXY")
+	}
+	selector.noProxy = parseNoProxy(noProxy)
+	return &selector, nil
+}
+
+func (s *proxySelector) empty() bool {
+	return s.httpProxy == nil && s.httpsProxy == nil
+}
+
+// proxy implements http.Transport.Proxy.
+func (s *proxySelector) proxy(req *http.Request) (*url.URL, error) {
+	proxyURL := s.httpProxy
+	port := req.URL.Port()
+	if req.URL.Scheme == "https" {
+		proxyURL = s.httpsProxy
+		if port == "" {
+			port = "443"
+		}
+	} else if port == "" {
+		port = "80"
+	}
+	if proxyURL == nil {
+		return nil, nil
+	}
+	host := strings.ToLower(req.URL.Hostname())
+	for _, entry := range s.noProxy {
+		if entry.match(host, port) {
+			return nil, nil
+		}
+	}
+	return proxyURL, nil
+}
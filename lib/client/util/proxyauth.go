@@ -0,0 +1,160 @@
+package util
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+const proxyAuthorizationHeader = "Proxy-Authorization"
+const proxyAuthenticateHeader = "Proxy-Authenticate"
+
+var errProxyAuthRequired = errors.New("proxy authentication required")
+
+type basicProxyAuthenticator struct {
+	username string
+	password string
+}
+
+func (a *basicProxyAuthenticator) ProxyAuthorization(proxyURL *url.URL,
+	challenges []string) (string, error) {
+	credentials := a.username + ":" + a.password
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials)),
+		nil
+}
+
+type proxyAuthTransport struct {
+	transport     *http.Transport
+	authenticator ProxyAuthenticator
+	mutex         sync.Mutex
+	challenges    map[string][]string // Key: proxy host.
+}
+
+func newProxyAuthTransport(transport *http.Transport,
+	authenticator ProxyAuthenticator) *proxyAuthTransport {
+	t := &proxyAuthTransport{
+		transport:     transport,
+		authenticator: authenticator,
+		challenges:    make(map[string][]string),
+	}
+	transport.GetProxyConnectHeader = t.getProxyConnectHeader
+	transport.OnProxyConnectResponse = t.onProxyConnectResponse
+	return t
+}
+
+func (t *proxyAuthTransport) getChallenges(proxyURL *url.URL) []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.challenges[proxyURL.Host]
+}
+
+func (t *proxyAuthTransport) setChallenges(proxyURL *url.URL,
+	challenges []string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.challenges[proxyURL.Host] = challenges
+}
+
+func (t *proxyAuthTransport) authorization(proxyURL *url.URL) (
+	string, error) {
+	return t.authenticator.ProxyAuthorization(proxyURL,
+		t.getChallenges(proxyURL))
+}
+
+// getProxyConnectHeader supplies credentials for CONNECT (https) requests.
+func (t *proxyAuthTransport) getProxyConnectHeader(ctx context.Context,
+	proxyURL *url.URL, target string) (http.Header, error) {
+	authorization, err := t.authorization(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	header := make(http.Header)
+	if authorization != "" {
+		header.Set(proxyAuthorizationHeader, authorization)
+	}
+	return header, nil
+}
+
+// onProxyConnectResponse records the challenges of a rejected CONNECT so
+// that the retry made by RoundTrip can answer them.
+func (t *proxyAuthTransport) onProxyConnectResponse(ctx context.Context,
+	proxyURL *url.URL, connectReq *http.Request,
+	connectRes *http.Response) error {
+	if connectRes.StatusCode != http.StatusProxyAuthRequired {
+		return nil
+	}
+	t.setChallenges(proxyURL, connectRes.Header.Values(proxyAuthenticateHeader))
+	return errProxyAuthRequired
+}
+
+func (t *proxyAuthTransport) roundTrip(req *http.Request,
+	proxyURL *url.URL) (*http.Response, error) {
+	if req.URL.Scheme == "https" {
+		// Credentials travel in the CONNECT request.
+		return t.transport.RoundTrip(req)
+	}
+	authorization, err := t.authorization(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	if authorization == "" {
+		return t.transport.RoundTrip(req)
+	}
+	outReq := req.Clone(req.Context())
+	outReq.Header.Set(proxyAuthorizationHeader, authorization)
+	return t.transport.RoundTrip(outReq)
+}
+
+func (t *proxyAuthTransport) RoundTrip(req *http.Request) (
+	*http.Response, error) {
+	if t.transport.Proxy == nil {
+		return t.transport.RoundTrip(req)
+	}
+	proxyURL, err := t.transport.Proxy(req)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL == nil {
+		return t.transport.RoundTrip(req)
+	}
+	resp, err := t.roundTrip(req, proxyURL)
+	if err == nil && resp.StatusCode == http.StatusProxyAuthRequired {
+		t.setChallenges(proxyURL, resp.Header.Values(proxyAuthenticateHeader))
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	} else if !errors.Is(err, errProxyAuthRequired) {
+		return resp, err
+	}
+	// Retry once, answering the challenge.
+	retryReq, err := rewindRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err = t.roundTrip(retryReq, proxyURL)
+	if errors.Is(err, errProxyAuthRequired) {
+		return nil, fmt.Errorf("%s: %s", proxyURL.Host, errProxyAuthRequired)
+	}
+	return resp, err
+}
+
+func rewindRequest(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, nil
+	}
+	if req.GetBody == nil {
+		return nil, errors.New("cannot retry request with consumed body")
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	newReq := req.Clone(req.Context())
+	newReq.Body = body
+	return newReq, nil
+}
@@ -3,21 +3,28 @@ package util
 import (
 	"bytes"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
 	"os"
+	"os/user"
+	"strings"
 	"time"
 
 	"github.com/Cloud-Foundations/Dominator/lib/log"
 	"github.com/Cloud-Foundations/keymaster/lib/client/net"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
 	"github.com/howeyc/gopass"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/net/publicsuffix"
@@ -35,11 +42,115 @@ func getUserCreds(userName string) (password []byte, err error) {
 	return password, nil
 }
 
+// Key types with an explicit size accepted by parseKeyType.
+var keyTypeSizes = map[string]struct {
+	keyType string
+	bits    int
+}{
+	"rsa-2048":   {proto.KeyTypeRSA, 2048},
+	"rsa-3072":   {proto.KeyTypeRSA, 3072},
+	"rsa-4096":   {proto.KeyTypeRSA, 4096},
+	"ecdsa-p256": {proto.KeyTypeECDSA, 256},
+}
+
+func parseKeyType(spec string) (string, int, error) {
+	spec = strings.ToLower(spec)
+	switch spec {
+	case proto.KeyTypeRSA, proto.KeyTypeECDSA, proto.KeyTypeEd25519:
+		return spec, 0, nil
+	}
+	if keyTypeSize, ok := keyTypeSizes[spec]; ok {
+		return keyTypeSize.keyType, keyTypeSize.bits, nil
+	}
+	return "", 0, fmt.Errorf("unsupported key type: %s", spec)
+}
+
+func checkKeySize(keyType string, bits int) error {
+	if bits == 0 {
+		return nil
+	}
+	switch keyType {
+	case proto.KeyTypeRSA:
+		if bits == 2048 || bits == 3072 || bits == 4096 {
+			return nil
+		}
+	case proto.KeyTypeECDSA:
+		if bits == 256 {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported size for %s keys: %d bits", keyType, bits)
+}
+
+func getUserHomeDir(usr *user.User, goos string,
+	getenv func(string) string) (string, error) {
+	if goos == "windows" {
+		if profile := getenv("USERPROFILE"); profile != "" {
+			return profile, nil
+		}
+		drive, path := getenv("HOMEDRIVE"), getenv("HOMEPATH")
+		if drive != "" && path != "" {
+			return drive + path, nil
+		}
+	}
+	return usr.HomeDir, nil
+}
+
+func generateKey(keyType string) (crypto.Signer, error) {
+	return generateKeyWithBits(keyType, 0)
+}
+
+func generateKeyWithBits(keyType string, bits int) (crypto.Signer, error) {
+	if err := checkKeySize(keyType, bits); err != nil {
+		return nil, err
+	}
+	switch keyType {
+	case proto.KeyTypeRSA:
+		if bits == 0 {
+			bits = rsaKeySize
+		}
+		return rsa.GenerateKey(rand.Reader, bits)
+	case proto.KeyTypeECDSA:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case proto.KeyTypeEd25519:
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		return privateKey, err
+	default:
+		return nil, fmt.Errorf("unsupported key type: %s", keyType)
+	}
+}
+
+// marshalPrivateKeyPEM encodes privateKey in a form both OpenSSH and TLS
+// libraries can read.
+func marshalPrivateKeyPEM(privateKey crypto.Signer) (*pem.Block, error) {
+	switch key := privateKey.(type) {
+	case *rsa.PrivateKey:
+		return &pem.Block{Type: "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(key)}, nil
+	case *ecdsa.PrivateKey:
+		derKey, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return &pem.Block{Type: "EC PRIVATE KEY", Bytes: derKey}, nil
+	default:
+		derKey, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return &pem.Block{Type: "PRIVATE KEY", Bytes: derKey}, nil
+	}
+}
+
 // mostly comes from: http://stackoverflow.com/questions/21151714/go-generate-an-ssh-public-key
 func genKeyPair(
-	privateKeyPath string, identity string, logger log.Logger) (
-	crypto.Signer, string, error) {
-	privateKey, err := rsa.GenerateKey(rand.Reader, rsaKeySize)
+	privateKeyPath string, identity string, keyType string, bits int,
+	logger log.Logger) (crypto.Signer, string, error) {
+	privateKey, err := generateKeyWithBits(keyType, bits)
+	if err != nil {
+		return nil, "", err
+	}
+	privateKeyPEM, err := marshalPrivateKeyPEM(privateKey)
 	if err != nil {
 		return nil, "", err
 	}
@@ -48,7 +159,7 @@ func genKeyPair(
 
 	err = ioutil.WriteFile(
 		privateKeyPath,
-		pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)}),
+		pem.EncodeToMemory(privateKeyPEM),
 		0600)
 	if err != nil {
 		logger.Printf("Failed to save privkey")
@@ -56,7 +167,7 @@ func genKeyPair(
 	}
 
 	// generate and write public key
-	pub, err := ssh.NewPublicKey(&privateKey.PublicKey)
+	pub, err := ssh.NewPublicKey(privateKey.Public())
 	if err != nil {
 		return nil, "", err
 	}
@@ -76,30 +187,76 @@ func genKeyPair(
 
 func getHttpClient(tlsConfig *tls.Config,
 	dialer net.Dialer) (*http.Client, error) {
+	return getHttpClientWithProxyConfig(tlsConfig, dialer, ProxyConfig{})
+}
+
+func getHttpClientWithProxyAuth(tlsConfig *tls.Config,
+	dialer net.Dialer,
+	proxyAuthenticator ProxyAuthenticator) (*http.Client, error) {
+	return getHttpClientWithProxyConfig(tlsConfig, dialer,
+		ProxyConfig{Authenticator: proxyAuthenticator})
+}
+
+func getHttpClientWithProxyConfig(tlsConfig *tls.Config,
+	dialer net.Dialer, proxyConfig ProxyConfig) (*http.Client, error) {
 	clientTransport := &http.Transport{
 		TLSClientConfig: tlsConfig,
 		DialContext:     dialer.DialContext,
 	}
-
-	// proxy env variables in ascending order of preference, lower case 'http_proxy' dominates
-	// just like curl
-	proxyEnvVariables := []string{"HTTP_PROXY", "HTTPS_PROXY", "http_proxy"}
-	for _, proxyVar := range proxyEnvVariables {
-		httpProxy, err := getParseURLEnvVariable(proxyVar)
-		if err == nil && httpProxy != nil {
-			clientTransport.Proxy = http.ProxyURL(httpProxy)
-		}
+	// The proxy is reached with dialer, so the round-robin dialer also
+	// applies to it.
+	selector, err := newProxySelector(proxyConfig, os.Getenv)
+	if err != nil {
+		return nil, err
+	}
+	if !selector.empty() {
+		clientTransport.Proxy = selector.proxy
 	}
 	jar, err := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
 	if err != nil {
 		return nil, err
 	}
 
+	var transport http.RoundTripper = clientTransport
+	if proxyConfig.Authenticator != nil {
+		transport = newProxyAuthTransport(clientTransport,
+			proxyConfig.Authenticator)
+	}
 	// TODO: change timeout const for a flag
-	client := &http.Client{Transport: clientTransport, Jar: jar, Timeout: 25 * time.Second}
+	client := &http.Client{Transport: transport, Jar: jar, Timeout: 25 * time.Second}
 	return client, nil
 }
 
+func getHttpClientWithCertificate(client *http.Client,
+	certificate tls.Certificate) (*http.Client, error) {
+	var transport *http.Transport
+	var authTransport *proxyAuthTransport
+	switch t := client.Transport.(type) {
+	case *http.Transport:
+		transport = t
+	case *proxyAuthTransport:
+		authTransport = t
+		transport = t.transport
+	default:
+		return nil, errors.New("unsupported http client transport")
+	}
+	transport = transport.Clone()
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	transport.TLSClientConfig.Certificates = []tls.Certificate{certificate}
+	var roundTripper http.RoundTripper = transport
+	if authTransport != nil {
+		roundTripper = newProxyAuthTransport(transport,
+			authTransport.authenticator)
+	}
+	return &http.Client{
+		Transport: roundTripper,
+		Jar:       client.Jar,
+		Timeout:   client.Timeout,
+	}, nil
+}
+
 func getParseURLEnvVariable(name string) (*url.URL, error) {
 	envVariable := os.Getenv(name)
 	if len(envVariable) < 1 {
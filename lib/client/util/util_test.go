@@ -1,6 +1,8 @@
 package util
 
 import (
+	"crypto"
+	"crypto/rsa"
 	"crypto/tls"
 	"fmt"
 	"io/ioutil"
@@ -11,6 +13,8 @@ import (
 
 	"github.com/Cloud-Foundations/Dominator/lib/log/testlogger"
 	"github.com/Cloud-Foundations/keymaster/lib/certgen"
+	"github.com/Cloud-Foundations/keymaster/lib/webapi/v0/proto"
+	"golang.org/x/crypto/ssh"
 )
 
 func TestGenKeyPairSuccess(t *testing.T) {
@@ -36,6 +40,121 @@ func TestGenKeyPairSuccess(t *testing.T) {
 	//TODO: verify written signer matches our signer.
 }
 
+func TestGenKeyPairWithType(t *testing.T) {
+	for _, keyType := range []string{proto.KeyTypeRSA, proto.KeyTypeECDSA,
+		proto.KeyTypeEd25519} {
+		tmpfile, err := ioutil.TempFile("", "test_genKeyPair_")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(tmpfile.Name())
+		signer, pubKeyPath, err := GenKeyPairWithType(tmpfile.Name(), "test",
+			keyType, testlogger.New(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(pubKeyPath)
+		fileBytes, err := ioutil.ReadFile(tmpfile.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fileSigner, err := certgen.GetSignerFromPEMBytes(fileBytes)
+		if err != nil {
+			t.Fatalf("%s: %s", keyType, err)
+		}
+		if _, err := ssh.ParseRawPrivateKey(fileBytes); err != nil {
+			t.Fatalf("%s: %s", keyType, err)
+		}
+		publicKey, ok := signer.Public().(interface {
+			Equal(crypto.PublicKey) bool
+		})
+		if !ok || !publicKey.Equal(fileSigner.Public()) {
+			t.Fatalf("%s: written key does not match", keyType)
+		}
+	}
+	if _, err := GenerateKeyWithType("dsa"); err == nil {
+		t.Fatal("unsupported key type should fail")
+	}
+}
+
+func TestGetUserHomeDir(t *testing.T) {
+	usr := &user.User{HomeDir: "/home/user"}
+	environment := map[string]string{
+		"USERPROFILE": `C:\Users\user`,
+		"HOMEDRIVE":   "H:",
+		"HOMEPATH":    `\user`,
+	}
+	getenv := func(key string) string { return environment[key] }
+	for goos, expected := range map[string]string{
+		"linux":   "/home/user",
+		"windows": `C:\Users\user`,
+	} {
+		homeDir, err := getUserHomeDir(usr, goos, getenv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if homeDir != expected {
+			t.Fatalf("%s: expected %s, got %s", goos, expected, homeDir)
+		}
+	}
+	delete(environment, "USERPROFILE")
+	homeDir, err := getUserHomeDir(usr, "windows", getenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if homeDir != `H:\user` {
+		t.Fatalf("unexpected home directory %s", homeDir)
+	}
+}
+
+func TestParseKeyType(t *testing.T) {
+	tests := []struct {
+		spec    string
+		keyType string
+		bits    int
+	}{
+		{"rsa", proto.KeyTypeRSA, 0},
+		{"RSA-4096", proto.KeyTypeRSA, 4096},
+		{"ecdsa-p256", proto.KeyTypeECDSA, 256},
+		{"ed25519", proto.KeyTypeEd25519, 0},
+	}
+	for _, test := range tests {
+		keyType, bits, err := ParseKeyType(test.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keyType != test.keyType || bits != test.bits {
+			t.Fatalf("%s: got %s %d", test.spec, keyType, bits)
+		}
+	}
+	if _, _, err := ParseKeyType("rsa-1024"); err == nil {
+		t.Fatal("rsa-1024 should fail")
+	}
+}
+
+func TestGenerateKeyWithTypeAndBits(t *testing.T) {
+	signer, err := GenerateKeyWithTypeAndBits(proto.KeyTypeRSA, 3072)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bits := signer.Public().(*rsa.PublicKey).N.BitLen(); bits != 3072 {
+		t.Fatalf("expected 3072 bits, got %d", bits)
+	}
+	for _, test := range []struct {
+		keyType string
+		bits    int
+	}{
+		{proto.KeyTypeRSA, 1024},
+		{proto.KeyTypeECDSA, 384},
+		{proto.KeyTypeEd25519, 2048},
+	} {
+		if _, err := GenerateKeyWithTypeAndBits(test.keyType,
+			test.bits); err == nil {
+			t.Fatalf("%s with %d bits should fail", test.keyType, test.bits)
+		}
+	}
+}
+
 func TestGenKeyPairFailNoPerms(t *testing.T) {
 	_, _, err := GenKeyPair("/proc/something", "test", testlogger.New(t))
 	if err == nil {
@@ -131,3 +250,33 @@ func TestGetHttpClientMinimal(t *testing.T) {
 	}
 
 }
+
+func TestGetHttpClientWithCertificate(t *testing.T) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	client, err := GetHttpClientWithProxyAuth(tlsConfig, &net.Dialer{},
+		NewBasicProxyAuthenticator("user", []byte("password")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certClient, err := GetHttpClientWithCertificate(client,
+		tls.Certificate{Certificate: [][]byte{{1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if certClient.Jar != client.Jar {
+		t.Fatal("cookie jar not shared")
+	}
+	transport, ok := certClient.Transport.(*proxyAuthTransport)
+	if !ok {
+		t.Fatalf("unexpected transport: %T", certClient.Transport)
+	}
+	if len(transport.transport.TLSClientConfig.Certificates) != 1 {
+		t.Fatal("certificate not set")
+	}
+	if transport.transport.TLSClientConfig.MinVersion != tls.VersionTLS12 {
+		t.Fatal("TLS configuration not kept")
+	}
+	if len(tlsConfig.Certificates) != 0 {
+		t.Fatal("TLS configuration of client modified")
+	}
+}
@@ -0,0 +1,67 @@
+// Package devicekey identifies the device a client runs on with a key pair
+// which stays on the device. Clients sign their requests with the key;
+// servers keep a registry of the public keys and their approval state.
+//
+// A signature is sent in the proto.DeviceHeader header as
+// "v1 <public key> <time> <signature>": the base64url encoded PKIX public
+// key, the time in seconds since the epoch and the base64url encoded
+// signature of Message(time, binding). The binding ties the signature to
+// the request, such as the public key to certify, so it cannot be replayed
+// for another.
+package devicekey
+
+import (
+	"crypto"
+	"time"
+)
+
+// Key is the key of a device.
+type Key struct {
+	signer       crypto.Signer
+	publicKeyDER []byte
+	id           string
+}
+
+// New returns the device key of signer, such as a key held in a TPM or a
+// smart card through lib/pkcs11signer. ECDSA, Ed25519 and RSA keys are
+// supported.
+func New(signer crypto.Signer) (*Key, error) {
+	return newKey(signer)
+}
+
+// LoadOrCreate returns the device key in the PEM encoded PKCS#8 file
+// filename. If the file does not exist a P-256 ECDSA key is generated and
+// written to it, only readable by the user.
+func LoadOrCreate(filename string) (*Key, error) {
+	return loadOrCreate(filename)
+}
+
+// ID returns the identifier of the device, derived from its public key.
+func (k *Key) ID() string {
+	return k.id
+}
+
+// Header returns the proto.DeviceHeader header value signing binding at
+// time now.
+func (k *Key) Header(binding []byte, now time.Time) (string, error) {
+	return k.header(binding, now)
+}
+
+// ID returns the identifier of the device with the PKIX encoded public key
+// publicKeyDER.
+func ID(publicKeyDER []byte) string {
+	return getID(publicKeyDER)
+}
+
+// Message returns the data signed for binding at time t.
+func Message(t time.Time, binding []byte) []byte {
+	return message(t.Unix(), binding)
+}
+
+// Verify checks the proto.DeviceHeader header value header, which must
+// sign binding at a time no further than maxSkew from now, and returns the
+// ID and the PKIX encoded public key of the device.
+func Verify(header string, binding []byte, now time.Time,
+	maxSkew time.Duration) (string, []byte, error) {
+	return verify(header, binding, now, maxSkew)
+}
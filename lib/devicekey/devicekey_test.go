@@ -0,0 +1,113 @@
+package devicekey
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadOrCreate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "devicekey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "keymaster", "device_key.pem")
+	key, err := LoadOrCreate(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("key file mode %o", fi.Mode().Perm())
+	}
+	loadedKey, err := LoadOrCreate(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loadedKey.ID() != key.ID() {
+		t.Fatalf("loaded key %s, created %s", loadedKey.ID(), key.ID())
+	}
+	if err := ioutil.WriteFile(filename, []byte("junk"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadOrCreate(filename); err == nil {
+		t.Fatal("invalid key file loaded")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "devicekey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ecdsaKey, err := LoadOrCreate(filepath.Join(dir, "device_key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed25519Signer, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed25519Key, err := New(ed25519Signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaSigner, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := New(rsaSigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	binding := []byte("ssh-ed25519 AAAA user@host\n")
+	for _, key := range []*Key{ecdsaKey, ed25519Key, rsaKey} {
+		header, err := key.Header(binding, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, publicKeyDER, err := Verify(header, binding, now, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != key.ID() || ID(publicKeyDER) != id {
+			t.Fatalf("verified device %s, expected %s", id, key.ID())
+		}
+		if _, _, err := Verify(header, []byte("other"), now,
+			time.Minute); err == nil {
+			t.Fatal("signature verified for another binding")
+		}
+		if _, _, err := Verify(header, binding, now.Add(2*time.Minute),
+			time.Minute); err == nil {
+			t.Fatal("stale signature verified")
+		}
+		fields := strings.Fields(header)
+		otherHeader, err := ed25519Key.Header(binding, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key != ed25519Key {
+			// A signature with another key.
+			fields[3] = strings.Fields(otherHeader)[3]
+			if _, _, err := Verify(strings.Join(fields, " "), binding, now,
+				time.Minute); err == nil {
+				t.Fatal("signature of another key verified")
+			}
+		}
+	}
+	if _, _, err := Verify("v1 junk", binding, now, time.Minute); err == nil {
+		t.Fatal("malformed header verified")
+	}
+}
@@ -0,0 +1,174 @@
+package devicekey
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const headerVersion = "v1"
+
+func newKey(signer crypto.Signer) (*Key, error) {
+	switch signer.Public().(type) {
+	case *ecdsa.PublicKey, ed25519.PublicKey, *rsa.PublicKey:
+	default:
+		return nil, fmt.Errorf("unsupported device key type %T",
+			signer.Public())
+	}
+	publicKeyDER, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	return &Key{
+		signer:       signer,
+		publicKeyDER: publicKeyDER,
+		id:           getID(publicKeyDER),
+	}, nil
+}
+
+func loadOrCreate(filename string) (*Key, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil || block.Type != "PRIVATE KEY" {
+			return nil, fmt.Errorf("%s: no PEM private key", filename)
+		}
+		privateKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", filename, err)
+		}
+		signer, ok := privateKey.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("%s: not a signing key", filename)
+		}
+		return newKey(signer)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return nil, err
+	}
+	// O_EXCL, so that concurrent clients do not replace each other's key.
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL,
+		0600)
+	if err != nil {
+		if os.IsExist(err) {
+			return loadOrCreate(filename)
+		}
+		return nil, err
+	}
+	err = pem.Encode(file, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(filename)
+		return nil, err
+	}
+	return newKey(privateKey)
+}
+
+func getID(publicKeyDER []byte) string {
+	hash := sha256.Sum256(publicKeyDER)
+	return hex.EncodeToString(hash[:16])
+}
+
+func message(t int64, binding []byte) []byte {
+	bindingHash := sha256.Sum256(binding)
+	return []byte("keymaster-device-v1\n" + strconv.FormatInt(t, 10) + "\n" +
+		hex.EncodeToString(bindingHash[:]))
+}
+
+// signOptions returns the data to sign message with a key of the type of
+// publicKey and the options to sign or verify it with.
+func signOptions(publicKey crypto.PublicKey, message []byte) (
+	[]byte, crypto.SignerOpts) {
+	if _, ok := publicKey.(ed25519.PublicKey); ok {
+		return message, crypto.Hash(0)
+	}
+	hash := sha256.Sum256(message)
+	return hash[:], crypto.SHA256
+}
+
+func (k *Key) header(binding []byte, now time.Time) (string, error) {
+	t := now.Unix()
+	data, opts := signOptions(k.signer.Public(), message(t, binding))
+	signature, err := k.signer.Sign(rand.Reader, data, opts)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join([]string{
+		headerVersion,
+		base64.RawURLEncoding.EncodeToString(k.publicKeyDER),
+		strconv.FormatInt(t, 10),
+		base64.RawURLEncoding.EncodeToString(signature),
+	}, " "), nil
+}
+
+func verify(header string, binding []byte, now time.Time,
+	maxSkew time.Duration) (string, []byte, error) {
+	fields := strings.Fields(header)
+	if len(fields) != 4 || fields[0] != headerVersion {
+		return "", nil, errors.New("malformed device header")
+	}
+	publicKeyDER, err := base64.RawURLEncoding.DecodeString(fields[1])
+	if err != nil {
+		return "", nil, errors.New("malformed device public key")
+	}
+	t, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return "", nil, errors.New("malformed device signature time")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(fields[3])
+	if err != nil {
+		return "", nil, errors.New("malformed device signature")
+	}
+	if skew := now.Sub(time.Unix(t, 0)); skew > maxSkew || -skew > maxSkew {
+		return "", nil, errors.New("device signature time is too far off")
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(publicKeyDER)
+	if err != nil {
+		return "", nil, err
+	}
+	data, _ := signOptions(publicKey, message(t, binding))
+	var ok bool
+	switch key := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		ok = ecdsa.VerifyASN1(key, data, signature)
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(key, data, signature)
+	case *rsa.PublicKey:
+		ok = rsa.VerifyPKCS1v15(key, crypto.SHA256, data, signature) == nil
+	default:
+		return "", nil, fmt.Errorf("unsupported device key type %T", key)
+	}
+	if !ok {
+		return "", nil, errors.New("invalid device signature")
+	}
+	return getID(publicKeyDER), publicKeyDER, nil
+}
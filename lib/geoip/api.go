@@ -0,0 +1,93 @@
+// Package geoip locates the source addresses of logins with a MaxMind
+// GeoIP2 or GeoLite2 database and detects anomalous logins: logins from a
+// country the user did not log in from before, and logins too far from the
+// previous one for the user to have travelled between them.
+package geoip
+
+import (
+	"net"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Location is where an address is located.
+type Location struct {
+	Country string // ISO 3166-1 code, empty if unknown.
+	City    string // English name, empty if unknown.
+	// The coordinates are only set if HasCoordinates, which country
+	// databases do not provide. Radius is their accuracy in km.
+	HasCoordinates bool
+	Latitude       float64
+	Longitude      float64
+	Radius         float64
+}
+
+// Login is a login of a user from Address.
+type Login struct {
+	Time     time.Time
+	Address  string
+	Location Location
+}
+
+// Config configures the detection of impossible travel. Zero values select
+// the defaults.
+type Config struct {
+	// MaxSpeed is the fastest a user may travel between logins in km/h,
+	// 1000 by default.
+	MaxSpeed float64 `yaml:"max_travel_speed"`
+	// Logins less than MinDistance km apart, after deducting the accuracy
+	// of their locations, are never impossible travel. 100 by default.
+	MinDistance float64 `yaml:"min_travel_distance"`
+}
+
+// Anomaly describes what is unusual about a login.
+type Anomaly struct {
+	// NewCountry is set if no earlier login was from the country.
+	NewCountry bool
+	// ImpossibleTravel is set if the user would have had to travel Distance
+	// km at Speed km/h since the Previous login.
+	ImpossibleTravel bool
+	Previous         *Login
+	Distance         float64
+	Speed            float64
+}
+
+// Anomalous returns true if anything is unusual about the login.
+func (a Anomaly) Anomalous() bool {
+	return a.NewCountry || a.ImpossibleTravel
+}
+
+// Locator looks up addresses in a database.
+type Locator struct {
+	reader *maxminddb.Reader
+}
+
+// Open opens the MaxMind database file filename, of the City or Country
+// type.
+func Open(filename string) (*Locator, error) {
+	return open(filename)
+}
+
+// Close closes the database.
+func (l *Locator) Close() error {
+	return l.reader.Close()
+}
+
+// Locate returns the location of ip, or nil if the database does not have
+// it, such as for private addresses.
+func (l *Locator) Locate(ip net.IP) (*Location, error) {
+	return l.locate(ip)
+}
+
+// Check returns what is unusual about login, given the earlier logins of
+// the user in history, oldest first. The first login of a user is never
+// anomalous.
+func Check(history []Login, login Login, config Config) Anomaly {
+	return check(history, login, config)
+}
+
+// Distance returns the distance between the coordinates of a and b in km.
+func Distance(a, b Location) float64 {
+	return distance(a, b)
+}
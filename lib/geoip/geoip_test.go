@@ -0,0 +1,59 @@
+package geoip
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+var (
+	berlin = Location{Country: "DE", City: "Berlin", HasCoordinates: true,
+		Latitude: 52.52, Longitude: 13.405, Radius: 20}
+	munich = Location{Country: "DE", City: "Munich", HasCoordinates: true,
+		Latitude: 48.137, Longitude: 11.575, Radius: 20}
+	sanFrancisco = Location{Country: "US", City: "San Francisco",
+		HasCoordinates: true, Latitude: 37.775, Longitude: -122.419,
+		Radius: 20}
+)
+
+func TestDistance(t *testing.T) {
+	if d := Distance(berlin, sanFrancisco); math.Abs(d-9100) > 50 {
+		t.Fatalf("Berlin to San Francisco: %.0f km", d)
+	}
+	if d := Distance(berlin, berlin); d != 0 {
+		t.Fatalf("Berlin to Berlin: %f km", d)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	now := time.Now()
+	history := []Login{
+		{Time: now.Add(-48 * time.Hour), Location: sanFrancisco},
+		{Time: now.Add(-2 * time.Hour), Location: berlin},
+	}
+	if Check(nil, Login{Time: now, Location: berlin}, Config{}).Anomalous() {
+		t.Fatal("first login anomalous")
+	}
+	if anomaly := Check(history, Login{Time: now, Location: munich},
+		Config{}); anomaly.Anomalous() {
+		t.Fatalf("Berlin to Munich in 2 hours anomalous: %+v", anomaly)
+	}
+	anomaly := Check(history, Login{Time: now, Location: sanFrancisco},
+		Config{})
+	if !anomaly.ImpossibleTravel || anomaly.NewCountry {
+		t.Fatalf("Berlin to San Francisco in 2 hours: %+v", anomaly)
+	}
+	if anomaly.Previous.Location.City != "Berlin" || anomaly.Speed < 4000 {
+		t.Fatalf("unexpected travel: %+v", anomaly)
+	}
+	if anomaly := Check(history, Login{Time: now, Location: sanFrancisco},
+		Config{MaxSpeed: 5000}); anomaly.Anomalous() {
+		t.Fatalf("travel within max_travel_speed anomalous: %+v", anomaly)
+	}
+	tokyo := Location{Country: "JP"}
+	anomaly = Check(history, Login{Time: now, Location: tokyo}, Config{})
+	if !anomaly.NewCountry || anomaly.ImpossibleTravel {
+		t.Fatalf("login without coordinates from a new country: %+v",
+			anomaly)
+	}
+}
@@ -0,0 +1,122 @@
+package geoip
+
+import (
+	"math"
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+const (
+	defaultMaxSpeed    = 1000
+	defaultMinDistance = 100
+	earthRadius        = 6371 // km
+)
+
+// record holds the fields used of City and Country database records.
+type record struct {
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Location struct {
+		AccuracyRadius uint16   `maxminddb:"accuracy_radius"`
+		Latitude       *float64 `maxminddb:"latitude"`
+		Longitude      *float64 `maxminddb:"longitude"`
+	} `maxminddb:"location"`
+}
+
+func open(filename string) (*Locator, error) {
+	reader, err := maxminddb.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &Locator{reader: reader}, nil
+}
+
+func (l *Locator) locate(ip net.IP) (*Location, error) {
+	var result record
+	_, ok, err := l.reader.LookupNetwork(ip, &result)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, nil
+	}
+	location := &Location{
+		Country: result.Country.ISOCode,
+		City:    result.City.Names["en"],
+	}
+	if result.Location.Latitude != nil && result.Location.Longitude != nil {
+		location.HasCoordinates = true
+		location.Latitude = *result.Location.Latitude
+		location.Longitude = *result.Location.Longitude
+		location.Radius = float64(result.Location.AccuracyRadius)
+	}
+	if location.Country == "" && !location.HasCoordinates {
+		return nil, nil
+	}
+	return location, nil
+}
+
+func check(history []Login, login Login, config Config) Anomaly {
+	var anomaly Anomaly
+	if len(history) < 1 {
+		return anomaly
+	}
+	if country := login.Location.Country; country != "" {
+		anomaly.NewCountry = true
+		for _, previous := range history {
+			if previous.Location.Country == country {
+				anomaly.NewCountry = false
+				break
+			}
+		}
+	}
+	previous := history[len(history)-1]
+	if !login.Location.HasCoordinates || !previous.Location.HasCoordinates {
+		return anomaly
+	}
+	maxSpeed := config.MaxSpeed
+	if maxSpeed <= 0 {
+		maxSpeed = defaultMaxSpeed
+	}
+	minDistance := config.MinDistance
+	if minDistance <= 0 {
+		minDistance = defaultMinDistance
+	}
+	// Only count the distance the locations are certainly apart.
+	dist := distance(previous.Location, login.Location) -
+		previous.Location.Radius - login.Location.Radius
+	if dist < minDistance {
+		return anomaly
+	}
+	hours := login.Time.Sub(previous.Time).Hours()
+	speed := math.Inf(1)
+	if hours > 0 {
+		speed = dist / hours
+	}
+	if speed > maxSpeed {
+		anomaly.ImpossibleTravel = true
+		anomaly.Previous = &previous
+		anomaly.Distance = dist
+		anomaly.Speed = speed
+	}
+	return anomaly
+}
+
+// distance uses the haversine formula.
+func distance(a, b Location) float64 {
+	toRadians := func(degrees float64) float64 {
+		return degrees * math.Pi / 180
+	}
+	lat1 := toRadians(a.Latitude)
+	lat2 := toRadians(b.Latitude)
+	dLat := lat2 - lat1
+	dLon := toRadians(b.Longitude - a.Longitude)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
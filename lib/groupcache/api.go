@@ -0,0 +1,69 @@
+// Package groupcache caches user group lookups from a slow directory such as
+// LDAP.
+package groupcache
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+)
+
+// LookupFunc returns the groups of username from the backing directory.
+type LookupFunc func(username string) ([]string, error)
+
+type Config struct {
+	// TTL is how long a successful lookup is used without checking the
+	// directory.
+	TTL time.Duration
+	// StaleTTL is how long after TTL a result is still returned while it is
+	// refreshed in the background. Zero means results are refreshed
+	// synchronously once TTL has passed.
+	StaleTTL time.Duration
+	// NegativeTTL is how long errors for which IsNegative returns true (such
+	// as the user not existing) are cached. Zero disables negative caching.
+	NegativeTTL time.Duration
+	IsNegative  func(err error) bool
+	// At most MaxEntries results are kept. When it is full, expired
+	// results are removed first and then the oldest. Zero means 10000.
+	MaxEntries int
+}
+
+type entry struct {
+	groups    []string
+	err       error // Only set for negative entries.
+	fetchedAt time.Time
+}
+
+type inflightLookup struct {
+	done   chan struct{}
+	groups []string
+	err    error
+}
+
+type Cache struct {
+	lookup   LookupFunc
+	config   Config
+	logger   log.DebugLogger
+	mutex    sync.Mutex
+	entries  map[string]entry
+	inflight map[string]*inflightLookup
+}
+
+// New returns a Cache in front of lookup.
+func New(lookup LookupFunc, config Config, logger log.DebugLogger) *Cache {
+	return newCache(lookup, config, logger)
+}
+
+// GetUserGroups returns the groups of username. Fresh results come from the
+// cache, stale results are returned while a background refresh runs, and
+// anything older causes a synchronous lookup. Concurrent lookups for the
+// same user share one directory query.
+func (c *Cache) GetUserGroups(username string) ([]string, error) {
+	return c.getUserGroups(username)
+}
+
+// Invalidate removes any cached result for username.
+func (c *Cache) Invalidate(username string) {
+	c.invalidate(username)
+}
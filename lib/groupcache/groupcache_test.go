@@ -0,0 +1,243 @@
+package groupcache
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log/testlogger"
+)
+
+var errNotFound = errors.New("not found")
+
+type testDirectory struct {
+	mutex  sync.Mutex
+	calls  int
+	groups []string
+	err    error
+	delay  time.Duration
+}
+
+func (td *testDirectory) lookup(username string) ([]string, error) {
+	td.mutex.Lock()
+	td.calls++
+	groups, err, delay := td.groups, td.err, td.delay
+	td.mutex.Unlock()
+	time.Sleep(delay)
+	return groups, err
+}
+
+func (td *testDirectory) set(groups []string, err error) {
+	td.mutex.Lock()
+	defer td.mutex.Unlock()
+	td.groups = groups
+	td.err = err
+}
+
+func (td *testDirectory) getCalls() int {
+	td.mutex.Lock()
+	defer td.mutex.Unlock()
+	return td.calls
+}
+
+func (c *Cache) age(username string, by time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	e := c.entries[username]
+	e.fetchedAt = e.fetchedAt.Add(-by)
+	c.entries[username] = e
+}
+
+func (c *Cache) waitForRefresh(t *testing.T, username string) {
+	for i := 0; i < 200; i++ {
+		c.mutex.Lock()
+		_, pending := c.inflight[username]
+		c.mutex.Unlock()
+		if !pending {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("background refresh did not finish")
+}
+
+func TestFreshHit(t *testing.T) {
+	dir := &testDirectory{groups: []string{"group1"}}
+	c := New(dir.lookup, Config{TTL: time.Minute}, testlogger.New(t))
+	for i := 0; i < 3; i++ {
+		groups, err := c.GetUserGroups("user")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(groups) != 1 || groups[0] != "group1" {
+			t.Fatalf("unexpected groups: %v", groups)
+		}
+	}
+	if calls := dir.getCalls(); calls != 1 {
+		t.Fatalf("expected 1 lookup, got %d", calls)
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	dir := &testDirectory{groups: []string{"old"}}
+	c := New(dir.lookup, Config{TTL: time.Minute, StaleTTL: time.Hour},
+		testlogger.New(t))
+	if _, err := c.GetUserGroups("user"); err != nil {
+		t.Fatal(err)
+	}
+	dir.set([]string{"new"}, nil)
+	c.age("user", 2*time.Minute)
+	groups, err := c.GetUserGroups("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if groups[0] != "old" {
+		t.Fatalf("expected stale groups, got %v", groups)
+	}
+	c.waitForRefresh(t, "user")
+	groups, err = c.GetUserGroups("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if groups[0] != "new" {
+		t.Fatalf("expected refreshed groups, got %v", groups)
+	}
+	if calls := dir.getCalls(); calls != 2 {
+		t.Fatalf("expected 2 lookups, got %d", calls)
+	}
+}
+
+func TestStaleSurvivesOutage(t *testing.T) {
+	dir := &testDirectory{groups: []string{"group1"}}
+	c := New(dir.lookup, Config{TTL: time.Minute, StaleTTL: time.Hour},
+		testlogger.New(t))
+	if _, err := c.GetUserGroups("user"); err != nil {
+		t.Fatal(err)
+	}
+	dir.set(nil, errors.New("connection refused"))
+	c.age("user", 2*time.Minute)
+	if _, err := c.GetUserGroups("user"); err != nil {
+		t.Fatal(err)
+	}
+	c.waitForRefresh(t, "user")
+	groups, err := c.GetUserGroups("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if groups[0] != "group1" {
+		t.Fatalf("expected stale groups, got %v", groups)
+	}
+}
+
+func TestExpiredLookupIsSynchronous(t *testing.T) {
+	dir := &testDirectory{groups: []string{"old"}}
+	c := New(dir.lookup, Config{TTL: time.Minute, StaleTTL: time.Minute},
+		testlogger.New(t))
+	if _, err := c.GetUserGroups("user"); err != nil {
+		t.Fatal(err)
+	}
+	dir.set(nil, errors.New("connection refused"))
+	c.age("user", 3*time.Minute)
+	if _, err := c.GetUserGroups("user"); err == nil {
+		t.Fatal("expected error once stale period has passed")
+	}
+}
+
+func TestNegativeCaching(t *testing.T) {
+	dir := &testDirectory{err: errNotFound}
+	c := New(dir.lookup, Config{
+		TTL:         time.Minute,
+		NegativeTTL: time.Minute,
+		IsNegative:  func(err error) bool { return err == errNotFound },
+	}, testlogger.New(t))
+	for i := 0; i < 3; i++ {
+		if _, err := c.GetUserGroups("user"); err != errNotFound {
+			t.Fatalf("expected errNotFound, got %v", err)
+		}
+	}
+	if calls := dir.getCalls(); calls != 1 {
+		t.Fatalf("expected 1 lookup, got %d", calls)
+	}
+	c.age("user", 2*time.Minute)
+	dir.set([]string{"group1"}, nil)
+	groups, err := c.GetUserGroups("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if groups[0] != "group1" {
+		t.Fatalf("unexpected groups: %v", groups)
+	}
+}
+
+func TestTransientErrorsNotCached(t *testing.T) {
+	dir := &testDirectory{err: errors.New("timeout")}
+	c := New(dir.lookup, Config{
+		TTL:         time.Minute,
+		NegativeTTL: time.Minute,
+		IsNegative:  func(err error) bool { return err == errNotFound },
+	}, testlogger.New(t))
+	c.GetUserGroups("user")
+	c.GetUserGroups("user")
+	if calls := dir.getCalls(); calls != 2 {
+		t.Fatalf("expected 2 lookups, got %d", calls)
+	}
+}
+
+func TestConcurrentMissesShareLookup(t *testing.T) {
+	dir := &testDirectory{groups: []string{"group1"},
+		delay: 50 * time.Millisecond}
+	c := New(dir.lookup, Config{TTL: time.Minute}, testlogger.New(t))
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.GetUserGroups("user"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if calls := dir.getCalls(); calls != 1 {
+		t.Fatalf("expected 1 lookup, got %d", calls)
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	dir := &testDirectory{groups: []string{"group1"}}
+	c := New(dir.lookup, Config{TTL: time.Minute}, testlogger.New(t))
+	c.GetUserGroups("user")
+	c.Invalidate("user")
+	c.GetUserGroups("user")
+	if calls := dir.getCalls(); calls != 2 {
+		t.Fatalf("expected 2 lookups, got %d", calls)
+	}
+}
+
+func TestMaxEntries(t *testing.T) {
+	td := &testDirectory{groups: []string{"group"}}
+	c := New(td.lookup, Config{TTL: time.Minute, MaxEntries: 2},
+		testlogger.New(t))
+	for _, username := range []string{"user1", "user2"} {
+		if _, err := c.GetUserGroups(username); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// An expired result is removed before any unexpired one.
+	c.age("user2", 2*time.Minute)
+	if _, err := c.GetUserGroups("user3"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.entries["user2"]; ok || len(c.entries) != 2 {
+		t.Fatalf("expired entry not removed: %v", c.entries)
+	}
+	// Otherwise the oldest result is removed.
+	c.age("user1", time.Second)
+	if _, err := c.GetUserGroups("user4"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.entries["user1"]; ok || len(c.entries) != 2 {
+		t.Fatalf("oldest entry not removed: %v", c.entries)
+	}
+}
@@ -0,0 +1,127 @@
+package groupcache
+
+import (
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+)
+
+const defaultMaxEntries = 10000
+
+func newCache(lookup LookupFunc, config Config, logger log.DebugLogger) *Cache {
+	if config.MaxEntries < 1 {
+		config.MaxEntries = defaultMaxEntries
+	}
+	return &Cache{
+		lookup:   lookup,
+		config:   config,
+		logger:   logger,
+		entries:  make(map[string]entry),
+		inflight: make(map[string]*inflightLookup),
+	}
+}
+
+func (c *Cache) isNegative(err error) bool {
+	return c.config.NegativeTTL > 0 && c.config.IsNegative != nil &&
+		c.config.IsNegative(err)
+}
+
+func (c *Cache) getUserGroups(username string) ([]string, error) {
+	now := time.Now()
+	c.mutex.Lock()
+	if cached, ok := c.entries[username]; ok {
+		age := now.Sub(cached.fetchedAt)
+		if cached.err != nil {
+			if age < c.config.NegativeTTL {
+				c.mutex.Unlock()
+				return nil, cached.err
+			}
+		} else if age < c.config.TTL {
+			c.mutex.Unlock()
+			return cached.groups, nil
+		} else if age < c.config.TTL+c.config.StaleTTL {
+			if _, ok := c.inflight[username]; !ok {
+				c.startLookup(username)
+			}
+			c.mutex.Unlock()
+			c.logger.Debugf(1, "returning stale groups for %s", username)
+			return cached.groups, nil
+		}
+	}
+	pending, ok := c.inflight[username]
+	if !ok {
+		pending = c.startLookup(username)
+	}
+	c.mutex.Unlock()
+	<-pending.done
+	return pending.groups, pending.err
+}
+
+// startLookup starts a directory lookup for username. The mutex must be held.
+func (c *Cache) startLookup(username string) *inflightLookup {
+	pending := &inflightLookup{done: make(chan struct{})}
+	c.inflight[username] = pending
+	go c.runLookup(username, pending)
+	return pending
+}
+
+func (c *Cache) runLookup(username string, pending *inflightLookup) {
+	groups, err := c.lookup(username)
+	c.mutex.Lock()
+	delete(c.inflight, username)
+	switch {
+	case err == nil:
+		c.storeEntry(username, entry{groups: groups, fetchedAt: time.Now()})
+	case c.isNegative(err):
+		c.storeEntry(username, entry{err: err, fetchedAt: time.Now()})
+	default:
+		// Keep any existing entry so a stale result survives a directory
+		// outage until it expires.
+		c.logger.Debugf(1, "group lookup for %s failed: %s", username, err)
+	}
+	c.mutex.Unlock()
+	pending.groups = groups
+	pending.err = err
+	close(pending.done)
+}
+
+// isExpired returns true if cached may no longer be returned at now.
+func (c *Cache) isExpired(cached entry, now time.Time) bool {
+	age := now.Sub(cached.fetchedAt)
+	if cached.err != nil {
+		return age >= c.config.NegativeTTL
+	}
+	return age >= c.config.TTL+c.config.StaleTTL
+}
+
+// storeEntry caches the result for username, making room for it if the
+// cache is full. The mutex must be held.
+func (c *Cache) storeEntry(username string, cached entry) {
+	if _, ok := c.entries[username]; !ok &&
+		len(c.entries) >= c.config.MaxEntries {
+		now := time.Now()
+		for name, other := range c.entries {
+			if c.isExpired(other, now) {
+				delete(c.entries, name)
+			}
+		}
+		for len(c.entries) >= c.config.MaxEntries {
+			var oldestName string
+			var oldest time.Time
+			for name, other := range c.entries {
+				if oldestName == "" || other.fetchedAt.Before(oldest) {
+					oldestName = name
+					oldest = other.fetchedAt
+				}
+			}
+			delete(c.entries, oldestName)
+		}
+	}
+	c.entries[username] = cached
+}
+
+func (c *Cache) invalidate(username string) {
+	c.mutex.Lock()
+	delete(c.entries, username)
+	c.mutex.Unlock()
+}
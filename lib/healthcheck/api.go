@@ -0,0 +1,76 @@
+// Package healthcheck probes the dependencies of a server, such as
+// authentication backends and storage, for health and readiness endpoints.
+// Each probe has a timeout and its result is cached, so that frequent
+// requests from load balancers do not load the dependencies.
+package healthcheck
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultTimeout is the timeout of probes if none is configured.
+	DefaultTimeout = 5 * time.Second
+	// DefaultCacheTTL is how long results are cached if not configured.
+	DefaultCacheTTL = 10 * time.Second
+)
+
+// Probe checks one dependency.
+type Probe struct {
+	Name string
+	// Check returns nil if the dependency works. It should give up soon
+	// after the probe timeout; its result is not waited for after that.
+	Check func() error
+}
+
+// Config sets the timeout of probes and how long their results are cached.
+// Zero values select the defaults.
+type Config struct {
+	Timeout  time.Duration
+	CacheTTL time.Duration
+}
+
+// Result is the outcome of the last run of a probe.
+type Result struct {
+	Name      string        `json:"name"`
+	OK        bool          `json:"ok"`
+	Error     string        `json:"error,omitempty"`
+	CheckedAt time.Time     `json:"checked_at"`
+	Duration  time.Duration `json:"duration"`
+}
+
+// Checker runs probes. It is safe for concurrent use.
+type Checker struct {
+	config Config
+	probes []*probeState
+}
+
+type probeState struct {
+	Probe
+	mutex   sync.Mutex
+	result  Result        // Protected by mutex.
+	running chan struct{} // Closed when the running check ends.
+}
+
+// New returns a Checker for probes.
+func New(config Config, probes []Probe) *Checker {
+	return newChecker(config, probes)
+}
+
+// Check returns the results of all probes, running those whose cached
+// result has expired. Probes run concurrently and a probe which is still
+// running from an earlier call is not started again.
+func (c *Checker) Check() []Result {
+	return c.check()
+}
+
+// Healthy returns true if all results are OK.
+func Healthy(results []Result) bool {
+	for _, result := range results {
+		if !result.OK {
+			return false
+		}
+	}
+	return true
+}
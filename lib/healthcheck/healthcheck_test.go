@@ -0,0 +1,78 @@
+package healthcheck
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCheckCachesResults(t *testing.T) {
+	var calls int32
+	var failing atomic.Value
+	failing.Store(false)
+	checker := New(Config{CacheTTL: 50 * time.Millisecond}, []Probe{
+		{Name: "storage", Check: func() error { return nil }},
+		{Name: "ldap", Check: func() error {
+			atomic.AddInt32(&calls, 1)
+			if failing.Load().(bool) {
+				return errors.New("connection refused")
+			}
+			return nil
+		}},
+	})
+	results := checker.Check()
+	if len(results) != 2 || !Healthy(results) {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+	if results[0].Name != "storage" || results[1].Name != "ldap" {
+		t.Fatalf("results not in probe order: %+v", results)
+	}
+	failing.Store(true)
+	if !Healthy(checker.Check()) {
+		t.Fatal("cached result should be returned")
+	}
+	if calls := atomic.LoadInt32(&calls); calls != 1 {
+		t.Fatalf("probe ran %d times", calls)
+	}
+	time.Sleep(100 * time.Millisecond)
+	results = checker.Check()
+	if Healthy(results) {
+		t.Fatal("failure not reported")
+	}
+	if results[1].OK || results[1].Error != "connection refused" {
+		t.Fatalf("unexpected result: %+v", results[1])
+	}
+}
+
+func TestCheckTimeout(t *testing.T) {
+	release := make(chan struct{})
+	var calls int32
+	checker := New(Config{Timeout: 20 * time.Millisecond,
+		CacheTTL: time.Millisecond}, []Probe{
+		{Name: "okta", Check: func() error {
+			atomic.AddInt32(&calls, 1)
+			<-release
+			return nil
+		}},
+	})
+	start := time.Now()
+	results := checker.Check()
+	if time.Since(start) > time.Second {
+		t.Fatal("probe timeout not applied")
+	}
+	if results[0].OK || results[0].Error != errTimeout.Error() {
+		t.Fatalf("unexpected result: %+v", results[0])
+	}
+	time.Sleep(5 * time.Millisecond)
+	// The hung probe is not started again.
+	checker.Check()
+	if calls := atomic.LoadInt32(&calls); calls != 1 {
+		t.Fatalf("probe started %d times", calls)
+	}
+	close(release)
+	time.Sleep(20 * time.Millisecond)
+	if results := checker.Check(); !Healthy(results) {
+		t.Fatalf("probe should have recovered: %+v", results)
+	}
+}
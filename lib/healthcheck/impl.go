@@ -0,0 +1,96 @@
+package healthcheck
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var errTimeout = errors.New("timed out")
+
+func newChecker(config Config, probes []Probe) *Checker {
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+	if config.CacheTTL <= 0 {
+		config.CacheTTL = DefaultCacheTTL
+	}
+	c := &Checker{config: config}
+	for _, probe := range probes {
+		c.probes = append(c.probes, &probeState{Probe: probe})
+	}
+	return c
+}
+
+func (c *Checker) check() []Result {
+	results := make([]Result, len(c.probes))
+	var wg sync.WaitGroup
+	for i, probe := range c.probes {
+		wg.Add(1)
+		go func(i int, probe *probeState) {
+			defer wg.Done()
+			results[i] = c.probe(probe)
+		}(i, probe)
+	}
+	wg.Wait()
+	return results
+}
+
+// probe returns the cached result of probe, or runs it and waits at most
+// for the timeout if the result is too old.
+func (c *Checker) probe(probe *probeState) Result {
+	probe.mutex.Lock()
+	if !probe.result.CheckedAt.IsZero() &&
+		time.Since(probe.result.CheckedAt) < c.config.CacheTTL {
+		result := probe.result
+		probe.mutex.Unlock()
+		return result
+	}
+	running := probe.running
+	if running == nil {
+		running = make(chan struct{})
+		probe.running = running
+		go c.run(probe, running)
+	}
+	probe.mutex.Unlock()
+	timer := time.NewTimer(c.config.Timeout)
+	defer timer.Stop()
+	select {
+	case <-running:
+	case <-timer.C:
+		probe.mutex.Lock()
+		defer probe.mutex.Unlock()
+		if probe.running == running {
+			// Still running: fail until it returns.
+			probe.result = Result{
+				Name:      probe.Name,
+				Error:     errTimeout.Error(),
+				CheckedAt: time.Now(),
+				Duration:  c.config.Timeout,
+			}
+		}
+		return probe.result
+	}
+	probe.mutex.Lock()
+	defer probe.mutex.Unlock()
+	return probe.result
+}
+
+func (c *Checker) run(probe *probeState, running chan struct{}) {
+	start := time.Now()
+	err := probe.Check()
+	result := Result{
+		Name:      probe.Name,
+		OK:        err == nil,
+		CheckedAt: time.Now(),
+		Duration:  time.Since(start),
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	probe.mutex.Lock()
+	probe.result = result
+	probe.running = nil
+	probe.mutex.Unlock()
+	close(running)
+}
@@ -0,0 +1,95 @@
+// Package issuancelog implements an append-only log of issued certificates.
+// Each entry records the hash of the previous entry, so that modifying,
+// reordering or removing earlier entries is detected.
+package issuancelog
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+)
+
+// ErrBrokenChain is matched by the error returned when the log fails
+// verification.
+var ErrBrokenChain = errors.New("issuance log hash chain is broken")
+
+// Entry records one issued certificate.
+type Entry struct {
+	// Sequence, PrevHash and Hash are set by Append. Sequence starts at 1.
+	Sequence uint64    `json:"sequence"`
+	Time     time.Time `json:"time"`
+	Username string    `json:"username"`
+	CertType string    `json:"cert_type"`
+	// Serial is the decimal serial number of the certificate.
+	Serial    string    `json:"serial"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	// SSHPrincipals are the principals of an SSH certificate.
+	SSHPrincipals []string `json:"ssh_principals,omitempty"`
+	// X509SANs are the DNS, email and URI subject alternative names of an
+	// X.509 certificate.
+	X509SANs []string `json:"x509_sans,omitempty"`
+	// AuthMethods are the authentication methods the user completed.
+	AuthMethods []string `json:"auth_methods"`
+	// PrevHash is the Hash of the previous entry, empty for the first one.
+	PrevHash string `json:"prev_hash"`
+	// Hash is the hex encoded SHA-256 digest of the JSON encoding of the
+	// entry with an empty Hash.
+	Hash string `json:"hash"`
+}
+
+// Filter selects entries in Query. Zero fields are not used.
+type Filter struct {
+	Username string
+	// Since and Until bound the issuance time: Since <= Time < Until.
+	Since time.Time
+	Until time.Time
+	// Limit is the maximum number of entries returned. The newest ones are
+	// kept.
+	Limit int
+}
+
+// Log is an issuance log stored in a file with one JSON entry per line.
+type Log struct {
+	filename     string
+	logger       log.DebugLogger
+	mutex        sync.RWMutex // Protect everything below.
+	file         *os.File
+	lastHash     string
+	lastSequence uint64
+	size         int64 // The end of the last entry in the file.
+}
+
+// Open opens the log in filename, creating it if it does not exist. The
+// existing entries are verified first. An incomplete entry at the end, left
+// by an append which was interrupted, is removed.
+func Open(filename string, logger log.DebugLogger) (*Log, error) {
+	return openLog(filename, logger)
+}
+
+// Append completes entry with its sequence number and hashes, and writes it
+// to stable storage before returning it. If entry.Time is zero the current
+// time is used.
+func (l *Log) Append(entry Entry) (Entry, error) {
+	return l.append(entry)
+}
+
+// Query returns the entries matching filter, oldest first. The log is
+// verified while it is read. Entries appended meanwhile are not returned
+// and do not wait for the query.
+func (l *Log) Query(filter Filter) ([]Entry, error) {
+	return l.query(filter)
+}
+
+// Verify checks the hash chain of every entry in the log.
+func (l *Log) Verify() error {
+	return l.verify()
+}
+
+// Close closes the log file.
+func (l *Log) Close() error {
+	return l.close()
+}
@@ -0,0 +1,223 @@
+package issuancelog
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+)
+
+const maxEntrySize = 1 << 20
+
+func computeHash(entry Entry) (string, error) {
+	entry.Hash = ""
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func openLog(filename string, logger log.DebugLogger) (*Log, error) {
+	l := &Log{filename: filename, logger: logger}
+	lastSequence, lastHash, size, err := l.scan(-1, nil)
+	if err != nil {
+		return nil, err
+	}
+	// An append which was interrupted may have left part of an entry.
+	if fi, err := os.Stat(filename); err == nil && fi.Size() > size {
+		logger.Printf("discarding incomplete entry at the end of %s",
+			filename)
+		if err := os.Truncate(filename, size); err != nil {
+			return nil, err
+		}
+	}
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+		0600)
+	if err != nil {
+		return nil, err
+	}
+	l.file = file
+	l.lastSequence = lastSequence
+	l.lastHash = lastHash
+	l.size = size
+	logger.Debugf(0, "opened issuance log %s with %d entries", filename,
+		lastSequence)
+	return l, nil
+}
+
+// scan reads and verifies the entries in the first size bytes of the log, or
+// in all of it if size is negative, calling fn for each one if fn is not nil.
+// The sequence number and hash of the last entry are returned, with the
+// offset after it. A trailing line without a newline is not an entry.
+func (l *Log) scan(size int64, fn func(Entry)) (uint64, string, int64, error) {
+	file, err := os.Open(l.filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, "", 0, nil
+		}
+		return 0, "", 0, err
+	}
+	defer file.Close()
+	var r io.Reader = file
+	if size >= 0 {
+		r = io.LimitReader(file, size)
+	}
+	reader := bufio.NewReaderSize(r, maxEntrySize)
+	var lastSequence uint64
+	var lastHash string
+	var offset int64
+	for {
+		line, err := reader.ReadSlice('\n')
+		if err == io.EOF {
+			break
+		}
+		if err == bufio.ErrBufferFull {
+			return 0, "", 0, fmt.Errorf("%w: entry %d is too long",
+				ErrBrokenChain, lastSequence+1)
+		}
+		if err != nil {
+			return 0, "", 0, err
+		}
+		var entry Entry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return 0, "", 0, fmt.Errorf("%w: entry %d: %s", ErrBrokenChain,
+				lastSequence+1, err)
+		}
+		if entry.Sequence != lastSequence+1 {
+			return 0, "", 0, fmt.Errorf("%w: entry %d has sequence %d",
+				ErrBrokenChain, lastSequence+1, entry.Sequence)
+		}
+		if entry.PrevHash != lastHash {
+			return 0, "", 0, fmt.Errorf(
+				"%w: entry %d does not follow entry %d",
+				ErrBrokenChain, entry.Sequence, lastSequence)
+		}
+		hash, err := computeHash(entry)
+		if err != nil {
+			return 0, "", 0, err
+		}
+		if entry.Hash != hash {
+			return 0, "", 0, fmt.Errorf("%w: entry %d was modified",
+				ErrBrokenChain, entry.Sequence)
+		}
+		if fn != nil {
+			fn(entry)
+		}
+		lastSequence = entry.Sequence
+		lastHash = entry.Hash
+		offset += int64(len(line))
+	}
+	return lastSequence, lastHash, offset, nil
+}
+
+func (l *Log) append(entry Entry) (Entry, error) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	entry.Time = entry.Time.UTC()
+	entry.NotBefore = entry.NotBefore.UTC()
+	entry.NotAfter = entry.NotAfter.UTC()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file == nil {
+		return Entry{}, os.ErrClosed
+	}
+	entry.Sequence = l.lastSequence + 1
+	entry.PrevHash = l.lastHash
+	hash, err := computeHash(entry)
+	if err != nil {
+		return Entry{}, err
+	}
+	entry.Hash = hash
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return Entry{}, err
+	}
+	data = append(data, '\n')
+	if _, err := l.file.Write(data); err != nil {
+		// Do not leave part of the entry for the next one to follow.
+		if err := l.file.Truncate(l.size); err != nil {
+			l.logger.Printf("cannot truncate %s: %s", l.filename, err)
+		}
+		return Entry{}, err
+	}
+	if err := l.file.Sync(); err != nil {
+		return Entry{}, err
+	}
+	l.lastSequence = entry.Sequence
+	l.lastHash = entry.Hash
+	l.size += int64(len(data))
+	return entry, nil
+}
+
+func (filter Filter) matches(entry Entry) bool {
+	if filter.Username != "" && entry.Username != filter.Username {
+		return false
+	}
+	if !filter.Since.IsZero() && entry.Time.Before(filter.Since) {
+		return false
+	}
+	if !filter.Until.IsZero() && !entry.Time.Before(filter.Until) {
+		return false
+	}
+	return true
+}
+
+// getEnd returns the sequence number and hash of the last entry, and the
+// size of the log up to it. Entries before it are not written to again, so
+// they may be read without holding the lock.
+func (l *Log) getEnd() (uint64, string, int64) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return l.lastSequence, l.lastHash, l.size
+}
+
+func (l *Log) query(filter Filter) ([]Entry, error) {
+	_, _, size := l.getEnd()
+	var entries []Entry
+	_, _, _, err := l.scan(size, func(entry Entry) {
+		if !filter.matches(entry) {
+			return
+		}
+		entries = append(entries, entry)
+		if filter.Limit > 0 && len(entries) > filter.Limit {
+			entries = entries[1:]
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (l *Log) verify() error {
+	expectedSequence, expectedHash, size := l.getEnd()
+	lastSequence, lastHash, _, err := l.scan(size, nil)
+	if err != nil {
+		return err
+	}
+	if lastSequence != expectedSequence || lastHash != expectedHash {
+		return fmt.Errorf("%w: log ends at entry %d, expected %d",
+			ErrBrokenChain, lastSequence, expectedSequence)
+	}
+	return nil
+}
+
+func (l *Log) close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
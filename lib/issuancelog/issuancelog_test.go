@@ -0,0 +1,190 @@
+package issuancelog
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log/testlogger"
+)
+
+func appendTestEntries(t *testing.T, l *Log, startTime time.Time) {
+	for i, username := range []string{"alice", "bob", "alice"} {
+		_, err := l.Append(Entry{
+			Time:        startTime.Add(time.Duration(i) * time.Hour),
+			Username:    username,
+			CertType:    "ssh",
+			Serial:      "1",
+			NotBefore:   startTime,
+			NotAfter:    startTime.Add(16 * time.Hour),
+			AuthMethods: []string{"password", "U2F"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAppendQuery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "issuancelog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "issuance.log")
+	l, err := Open(filename, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	appendTestEntries(t, l, startTime)
+	entries, err := l.Query(Filter{Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Sequence != 1 ||
+		entries[1].Sequence != 3 {
+		t.Fatalf("unexpected entries for alice: %+v", entries)
+	}
+	entries, err = l.Query(Filter{Since: startTime.Add(time.Hour),
+		Until: startTime.Add(2 * time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Username != "bob" {
+		t.Fatalf("unexpected entries in time range: %+v", entries)
+	}
+	entries, err = l.Query(Filter{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Sequence != 2 {
+		t.Fatalf("expected the 2 newest entries, got %+v", entries)
+	}
+	if entries[1].PrevHash != entries[0].Hash {
+		t.Fatal("entries are not chained")
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Reopening continues the chain.
+	l, err = Open(filename, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	entry, err := l.Append(Entry{Username: "carol", CertType: "x509"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Sequence != 4 {
+		t.Fatalf("expected sequence 4, got %d", entry.Sequence)
+	}
+	if err := l.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTamperingDetected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "issuancelog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "issuance.log")
+	l, err := Open(filename, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	appendTestEntries(t, l, time.Now())
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	for name, tampered := range map[string][]byte{
+		"modified": bytes.Replace(data, []byte(`"bob"`), []byte(`"eve"`), 1),
+		"removed":  append(append([]byte{}, lines[0]...), lines[2]...),
+	} {
+		if err := ioutil.WriteFile(filename, tampered, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Open(filename, testlogger.New(t)); err == nil {
+			t.Fatalf("%s log should fail to open", name)
+		}
+		if err := l.Verify(); !errors.Is(err, ErrBrokenChain) {
+			t.Fatalf("%s log: expected broken chain, got %v", name, err)
+		}
+	}
+	// Truncation keeps a valid chain, but not the one the Log wrote.
+	if err := ioutil.WriteFile(filename, lines[0], 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Verify(); !errors.Is(err, ErrBrokenChain) {
+		t.Fatalf("truncated log: expected broken chain, got %v", err)
+	}
+}
+
+func TestIncompleteEntry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "issuancelog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "issuance.log")
+	l, err := Open(filename, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendTestEntries(t, l, time.Now())
+	// Part of an entry which is still being written is not read.
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.Write([]byte(`{"sequence":4,"user`)); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := l.Query(Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+	if err := l.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Reopening after a crash discards it.
+	l, err = Open(filename, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := l.Append(Entry{Username: "carol", CertType: "x509"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Sequence != 4 {
+		t.Fatalf("expected sequence 4, got %d", entry.Sequence)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	l, err = Open(filename, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := l.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
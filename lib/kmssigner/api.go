@@ -0,0 +1,64 @@
+// Package kmssigner implements crypto.Signer with asymmetric keys held in
+// AWS KMS or GCP Cloud KMS.
+package kmssigner
+
+import (
+	"crypto"
+	"io"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+)
+
+// keyClient is implemented by each KMS.
+type keyClient interface {
+	// getPublicKey returns the DER encoded SubjectPublicKeyInfo of the key.
+	getPublicKey() ([]byte, error)
+	// sign returns a signature of digest in the form expected from a
+	// crypto.Signer for publicKey.
+	sign(publicKey crypto.PublicKey, digest []byte,
+		opts crypto.SignerOpts) ([]byte, error)
+	// sshAlgorithms returns the SSH signature algorithms the key can make,
+	// or nil if it can make all of them for its type.
+	sshAlgorithms(publicKey crypto.PublicKey) []string
+}
+
+// Signer signs with a KMS key. The public key is read once when the Signer
+// is created. RSA (PKCS #1 v1.5 and PSS) and ECDSA keys are supported.
+type Signer struct {
+	client    keyClient
+	logger    log.DebugLogger
+	publicKey crypto.PublicKey
+}
+
+// NewAWS returns a Signer for the AWS KMS key keyID, which may be a key ID,
+// key ARN or alias ARN. If region is empty the region is taken from the AWS
+// environment.
+func NewAWS(keyID string, region string, logger log.DebugLogger) (
+	*Signer, error) {
+	return newAWS(keyID, region, logger)
+}
+
+// NewGCP returns a Signer for the GCP Cloud KMS key version keyVersion
+// (projects/*/locations/*/keyRings/*/cryptoKeys/*/cryptoKeyVersions/*).
+func NewGCP(keyVersion string, logger log.DebugLogger) (*Signer, error) {
+	return newGCP(keyVersion, logger)
+}
+
+// Public returns the cached public key.
+func (s *Signer) Public() crypto.PublicKey {
+	return s.publicKey
+}
+
+// SSHAlgorithms returns the SSH signature algorithms the key can make, or nil
+// if it is not restricted to some of the algorithms for its type. Cloud KMS
+// RSA keys sign with a single hash, so SSH signers for them must be created
+// with ssh.NewSignerWithAlgorithms.
+func (s *Signer) SSHAlgorithms() []string {
+	return s.client.sshAlgorithms(s.publicKey)
+}
+
+// Sign signs digest with the KMS key. rand is not used.
+func (s *Signer) Sign(rand io.Reader, digest []byte,
+	opts crypto.SignerOpts) ([]byte, error) {
+	return s.sign(digest, opts)
+}
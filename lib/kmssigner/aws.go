@@ -0,0 +1,113 @@
+package kmssigner
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"fmt"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+type awsClient struct {
+	keyID string
+	kms   *kms.KMS
+}
+
+func newAWS(keyID string, region string, logger log.DebugLogger) (
+	*Signer, error) {
+	options := session.Options{SharedConfigState: session.SharedConfigEnable}
+	if region != "" {
+		options.Config.Region = aws.String(region)
+	}
+	awsSession, err := session.NewSessionWithOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	return newSigner(&awsClient{keyID: keyID, kms: kms.New(awsSession)},
+		logger)
+}
+
+func (c *awsClient) getPublicKey() ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	output, err := c.kms.GetPublicKeyWithContext(ctx,
+		&kms.GetPublicKeyInput{KeyId: aws.String(c.keyID)})
+	if err != nil {
+		return nil, err
+	}
+	if usage := aws.StringValue(output.KeyUsage); usage != kms.KeyUsageTypeSignVerify {
+		return nil, fmt.Errorf("key usage is %s, not %s", usage,
+			kms.KeyUsageTypeSignVerify)
+	}
+	return output.PublicKey, nil
+}
+
+// getAWSSigningAlgorithm returns the AWS KMS signing algorithm making the
+// signature requested by opts.
+func getAWSSigningAlgorithm(publicKey crypto.PublicKey,
+	opts crypto.SignerOpts) (string, error) {
+	_, isPSS := opts.(*rsa.PSSOptions)
+	switch publicKey.(type) {
+	case *rsa.PublicKey:
+		switch opts.HashFunc() {
+		case crypto.SHA256:
+			if isPSS {
+				return kms.SigningAlgorithmSpecRsassaPssSha256, nil
+			}
+			return kms.SigningAlgorithmSpecRsassaPkcs1V15Sha256, nil
+		case crypto.SHA384:
+			if isPSS {
+				return kms.SigningAlgorithmSpecRsassaPssSha384, nil
+			}
+			return kms.SigningAlgorithmSpecRsassaPkcs1V15Sha384, nil
+		case crypto.SHA512:
+			if isPSS {
+				return kms.SigningAlgorithmSpecRsassaPssSha512, nil
+			}
+			return kms.SigningAlgorithmSpecRsassaPkcs1V15Sha512, nil
+		}
+	case *ecdsa.PublicKey:
+		switch opts.HashFunc() {
+		case crypto.SHA256:
+			return kms.SigningAlgorithmSpecEcdsaSha256, nil
+		case crypto.SHA384:
+			return kms.SigningAlgorithmSpecEcdsaSha384, nil
+		case crypto.SHA512:
+			return kms.SigningAlgorithmSpecEcdsaSha512, nil
+		}
+	}
+	return "", fmt.Errorf("hash %v is not supported by AWS KMS",
+		opts.HashFunc())
+}
+
+// sshAlgorithms returns nil, since AWS KMS keys sign with any hash.
+func (c *awsClient) sshAlgorithms(publicKey crypto.PublicKey) []string {
+	return nil
+}
+
+// sign returns the signature from AWS KMS, which is already in the form
+// expected from a crypto.Signer (ASN.1 for ECDSA).
+func (c *awsClient) sign(publicKey crypto.PublicKey, digest []byte,
+	opts crypto.SignerOpts) ([]byte, error) {
+	algorithm, err := getAWSSigningAlgorithm(publicKey, opts)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	output, err := c.kms.SignWithContext(ctx, &kms.SignInput{
+		KeyId:            aws.String(c.keyID),
+		Message:          digest,
+		MessageType:      aws.String(kms.MessageTypeDigest),
+		SigningAlgorithm: aws.String(algorithm),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output.Signature, nil
+}
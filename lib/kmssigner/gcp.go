@@ -0,0 +1,142 @@
+package kmssigner
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+
+	kms "cloud.google.com/go/kms/apiv1"
+	"cloud.google.com/go/kms/apiv1/kmspb"
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"golang.org/x/crypto/ssh"
+)
+
+var gcpHashSuffixes = map[crypto.Hash]string{
+	crypto.SHA256: "_SHA256",
+	crypto.SHA384: "_SHA384",
+	crypto.SHA512: "_SHA512",
+}
+
+type gcpClient struct {
+	keyVersion string
+	client     *kms.KeyManagementClient
+	algorithm  string
+}
+
+func newGCP(keyVersion string, logger log.DebugLogger) (*Signer, error) {
+	client, err := kms.NewKeyManagementClient(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	signer, err := newSigner(&gcpClient{keyVersion: keyVersion,
+		client: client}, logger)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return signer, nil
+}
+
+func (c *gcpClient) getPublicKey() ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	response, err := c.client.GetPublicKey(ctx,
+		&kmspb.GetPublicKeyRequest{Name: c.keyVersion})
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode([]byte(response.Pem))
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.New("cannot decode public key PEM")
+	}
+	c.algorithm = response.Algorithm.String()
+	if _, ok := getGCPKeyHash(c.algorithm); !ok {
+		return nil, fmt.Errorf("unsupported key algorithm %s", c.algorithm)
+	}
+	return block.Bytes, nil
+}
+
+// getGCPKeyHash returns the hash a Cloud KMS key algorithm signs with.
+func getGCPKeyHash(algorithm string) (crypto.Hash, bool) {
+	for hash, suffix := range gcpHashSuffixes {
+		if strings.HasSuffix(algorithm, suffix) {
+			return hash, true
+		}
+	}
+	return 0, false
+}
+
+// checkGCPAlgorithm returns an error if a key with the Cloud KMS algorithm
+// cannot make the signature requested by opts. Cloud KMS keys are bound to
+// one padding scheme and hash.
+func checkGCPAlgorithm(algorithm string, publicKey crypto.PublicKey,
+	opts crypto.SignerOpts) error {
+	if hash, _ := getGCPKeyHash(algorithm); hash != opts.HashFunc() {
+		return fmt.Errorf("key algorithm %s cannot sign a %v digest",
+			algorithm, opts.HashFunc())
+	}
+	if _, ok := publicKey.(*rsa.PublicKey); ok {
+		_, wantPSS := opts.(*rsa.PSSOptions)
+		if isPSS := strings.Contains(algorithm, "_PSS_"); isPSS != wantPSS {
+			return fmt.Errorf("key algorithm %s cannot make this RSA signature",
+				algorithm)
+		}
+	}
+	return nil
+}
+
+// getGCPSSHAlgorithms returns the SSH signature algorithms a key with the
+// Cloud KMS algorithm can make. RSA keys make only the PKCS #1 v1.5
+// signatures with their hash, and ECDSA keys already hash with the SSH
+// algorithm of their curve.
+func getGCPSSHAlgorithms(algorithm string,
+	publicKey crypto.PublicKey) []string {
+	if _, ok := publicKey.(*rsa.PublicKey); !ok {
+		return nil
+	}
+	if strings.HasPrefix(algorithm, "RSA_SIGN_PKCS1_") {
+		switch hash, _ := getGCPKeyHash(algorithm); hash {
+		case crypto.SHA256:
+			return []string{ssh.KeyAlgoRSASHA256}
+		case crypto.SHA512:
+			return []string{ssh.KeyAlgoRSASHA512}
+		}
+	}
+	return []string{}
+}
+
+func (c *gcpClient) sshAlgorithms(publicKey crypto.PublicKey) []string {
+	return getGCPSSHAlgorithms(c.algorithm, publicKey)
+}
+
+// sign returns the signature from Cloud KMS, which is already in the form
+// expected from a crypto.Signer (ASN.1 for ECDSA).
+func (c *gcpClient) sign(publicKey crypto.PublicKey, digest []byte,
+	opts crypto.SignerOpts) ([]byte, error) {
+	if err := checkGCPAlgorithm(c.algorithm, publicKey, opts); err != nil {
+		return nil, err
+	}
+	request := &kmspb.AsymmetricSignRequest{Name: c.keyVersion}
+	switch opts.HashFunc() {
+	case crypto.SHA256:
+		request.Digest = &kmspb.Digest{
+			Digest: &kmspb.Digest_Sha256{Sha256: digest}}
+	case crypto.SHA384:
+		request.Digest = &kmspb.Digest{
+			Digest: &kmspb.Digest_Sha384{Sha384: digest}}
+	case crypto.SHA512:
+		request.Digest = &kmspb.Digest{
+			Digest: &kmspb.Digest_Sha512{Sha512: digest}}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	response, err := c.client.AsymmetricSign(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	return response.Signature, nil
+}
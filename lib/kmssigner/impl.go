@@ -0,0 +1,45 @@
+package kmssigner
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+)
+
+const requestTimeout = 10 * time.Second
+
+func newSigner(client keyClient, logger log.DebugLogger) (*Signer, error) {
+	derKey, err := client.getPublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get KMS public key: %s", err)
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(derKey)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse KMS public key: %s", err)
+	}
+	switch publicKey.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+	default:
+		return nil, fmt.Errorf("unsupported KMS key type %T", publicKey)
+	}
+	return &Signer{client: client, logger: logger, publicKey: publicKey}, nil
+}
+
+func (s *Signer) sign(digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if len(digest) != opts.HashFunc().Size() {
+		return nil, errors.New("digest length does not match hash")
+	}
+	startTime := time.Now()
+	signature, err := s.client.sign(s.publicKey, digest, opts)
+	if err != nil {
+		return nil, fmt.Errorf("KMS signing failed: %s", err)
+	}
+	s.logger.Debugf(2, "KMS signature took %s", time.Since(startTime))
+	return signature, nil
+}
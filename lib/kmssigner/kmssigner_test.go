@@ -0,0 +1,157 @@
+package kmssigner
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log/testlogger"
+	"golang.org/x/crypto/ssh"
+)
+
+// localClient is a keyClient signing with a local key.
+type localClient struct {
+	key        crypto.Signer
+	publicKeys int
+}
+
+func (c *localClient) getPublicKey() ([]byte, error) {
+	c.publicKeys++
+	return x509.MarshalPKIXPublicKey(c.key.Public())
+}
+
+func (c *localClient) sign(publicKey crypto.PublicKey, digest []byte,
+	opts crypto.SignerOpts) ([]byte, error) {
+	return c.key.Sign(rand.Reader, digest, opts)
+}
+
+func (c *localClient) sshAlgorithms(publicKey crypto.PublicKey) []string {
+	return nil
+}
+
+func TestSignerCreatesCertificate(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &localClient{key: key}
+	signer, err := newSigner(client, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	derCert, err := x509.CreateCertificate(rand.Reader, template, template,
+		signer.Public(), signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(derCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.CheckSignatureFrom(cert); err != nil {
+		t.Fatal(err)
+	}
+	if client.publicKeys != 1 {
+		t.Fatalf("public key fetched %d times", client.publicKeys)
+	}
+	digest := sha256.Sum256([]byte("message"))
+	if _, err := signer.Sign(nil, digest[:16], crypto.SHA256); err == nil {
+		t.Fatal("short digest should fail")
+	}
+}
+
+func TestGetAWSSigningAlgorithm(t *testing.T) {
+	rsaKey := &rsa.PublicKey{}
+	ecKey := &ecdsa.PublicKey{}
+	for _, test := range []struct {
+		publicKey crypto.PublicKey
+		opts      crypto.SignerOpts
+		algorithm string
+	}{
+		{rsaKey, crypto.SHA256, "RSASSA_PKCS1_V1_5_SHA_256"},
+		{rsaKey, &rsa.PSSOptions{Hash: crypto.SHA512}, "RSASSA_PSS_SHA_512"},
+		{ecKey, crypto.SHA384, "ECDSA_SHA_384"},
+		{rsaKey, crypto.SHA1, ""},
+	} {
+		algorithm, err := getAWSSigningAlgorithm(test.publicKey, test.opts)
+		if test.algorithm == "" {
+			if err == nil {
+				t.Errorf("%v: expected error", test.opts)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %s", test.opts, err)
+		} else if algorithm != test.algorithm {
+			t.Errorf("%v: %s != %s", test.opts, algorithm, test.algorithm)
+		}
+	}
+}
+
+func TestCheckGCPAlgorithm(t *testing.T) {
+	rsaKey := &rsa.PublicKey{}
+	ecKey := &ecdsa.PublicKey{}
+	err := checkGCPAlgorithm("RSA_SIGN_PKCS1_3072_SHA256", rsaKey,
+		crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkGCPAlgorithm("RSA_SIGN_PKCS1_3072_SHA256", rsaKey,
+		crypto.SHA512)
+	if err == nil {
+		t.Fatal("hash mismatch should fail")
+	}
+	err = checkGCPAlgorithm("RSA_SIGN_PSS_3072_SHA256", rsaKey, crypto.SHA256)
+	if err == nil {
+		t.Fatal("PSS key cannot make PKCS #1 v1.5 signatures")
+	}
+	err = checkGCPAlgorithm("EC_SIGN_P384_SHA384", ecKey, crypto.SHA384)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := getGCPKeyHash("RSA_SIGN_RAW_PKCS1_2048"); ok {
+		t.Fatal("raw PKCS1 keys are not supported")
+	}
+}
+
+func TestGetGCPSSHAlgorithms(t *testing.T) {
+	rsaKey := &rsa.PublicKey{}
+	ecKey := &ecdsa.PublicKey{}
+	for _, test := range []struct {
+		algorithm  string
+		publicKey  crypto.PublicKey
+		algorithms []string
+	}{
+		{"RSA_SIGN_PKCS1_2048_SHA256", rsaKey,
+			[]string{ssh.KeyAlgoRSASHA256}},
+		{"RSA_SIGN_PKCS1_4096_SHA512", rsaKey,
+			[]string{ssh.KeyAlgoRSASHA512}},
+		{"RSA_SIGN_PSS_2048_SHA256", rsaKey, []string{}},
+		{"EC_SIGN_P256_SHA256", ecKey, nil},
+	} {
+		algorithms := getGCPSSHAlgorithms(test.algorithm, test.publicKey)
+		if (algorithms == nil) != (test.algorithms == nil) ||
+			len(algorithms) != len(test.algorithms) ||
+			(len(algorithms) > 0 && algorithms[0] != test.algorithms[0]) {
+			t.Errorf("%s: got %v, expected %v", test.algorithm, algorithms,
+				test.algorithms)
+		}
+	}
+}
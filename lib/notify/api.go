@@ -0,0 +1,105 @@
+// Package notify sends notifications of security events by email and to
+// webhooks, such as Slack incoming webhooks. Each route selects the events
+// it is sent.
+package notify
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+)
+
+// The events notifications are sent for.
+const (
+	// EventEnrollment is the registration of a second factor.
+	EventEnrollment = "enrollment"
+	// EventNewLocation is a login from a new address or country, or from
+	// too far from the previous login.
+	EventNewLocation = "new_location"
+	// EventUnusualPrincipals is a certificate issued with SSH principals
+	// or X.509 SANs other than the username.
+	EventUnusualPrincipals = "unusual_principals"
+	// EventAdmin is an action of an admin.
+	EventAdmin = "admin"
+	// EventCertApproval is a certificate request waiting for an approval,
+	// or the decision on it.
+	EventCertApproval = "cert_approval"
+	// EventBreakGlass is a vote for, the start or the end of emergency
+	// issuance, or a login of an emergency account.
+	EventBreakGlass = "break_glass"
+)
+
+// SMTPConfig configures the mail server email routes are sent through.
+type SMTPConfig struct {
+	// Server is the host:port of the mail server. The connection is
+	// upgraded with STARTTLS if the server supports it.
+	Server string `yaml:"server"`
+	// Username and the password in PasswordFilename authenticate to the
+	// server, if set.
+	Username         string `yaml:"username"`
+	PasswordFilename string `yaml:"password_filename"`
+	// From is the sender address.
+	From string `yaml:"from"`
+}
+
+// Route sends the notifications of Events to its destinations.
+type Route struct {
+	// Events lists the events of the route. All events are selected if it
+	// is empty.
+	Events []string `yaml:"events"`
+	// Email lists the addresses notifications are mailed to.
+	Email []string `yaml:"email"`
+	// WebhookURL receives each notification as a JSON Notification in a
+	// POST request.
+	WebhookURL string `yaml:"webhook_url"`
+	// SlackWebhookURL is a Slack incoming webhook the notification text is
+	// posted to.
+	SlackWebhookURL string `yaml:"slack_webhook_url"`
+}
+
+// Config configures a Notifier.
+type Config struct {
+	SMTP   SMTPConfig `yaml:"smtp"`
+	Routes []Route    `yaml:"routes"`
+}
+
+// Notification is a notification of Event about Username.
+type Notification struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Username string    `json:"username"`
+	// Subject summarizes Text in a line.
+	Subject string `json:"subject"`
+	Text    string `json:"text"`
+}
+
+// Notifier sends notifications along its routes. A nil Notifier discards
+// notifications.
+type Notifier struct {
+	config   Config
+	password string
+	logger   log.DebugLogger
+	client   *http.Client
+	// sendMail is replaced in tests.
+	sendMail func(to []string, message []byte) error
+	queue    chan *Notification
+	done     chan struct{}
+}
+
+// New creates a Notifier for config. Errors sending notifications are
+// logged to logger.
+func New(config Config, logger log.DebugLogger) (*Notifier, error) {
+	return newNotifier(config, logger)
+}
+
+// Notify queues notification to be sent in the background to the routes
+// which select it. If the queue is full it is dropped.
+func (n *Notifier) Notify(notification Notification) {
+	n.notify(notification)
+}
+
+// Close sends the queued notifications and stops the Notifier.
+func (n *Notifier) Close() error {
+	return n.close()
+}
@@ -0,0 +1,209 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+)
+
+const (
+	queueSize      = 256
+	requestTimeout = 10 * time.Second
+)
+
+var events = map[string]struct{}{
+	EventEnrollment:        {},
+	EventNewLocation:       {},
+	EventUnusualPrincipals: {},
+	EventAdmin:             {},
+	EventCertApproval:      {},
+	EventBreakGlass:        {},
+}
+
+func checkWebhookURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("webhook URL must be http or https: %s", rawURL)
+	}
+	return nil
+}
+
+func newNotifier(config Config, logger log.DebugLogger) (*Notifier, error) {
+	n := &Notifier{
+		config: config,
+		logger: logger,
+		client: &http.Client{Timeout: requestTimeout},
+		queue:  make(chan *Notification, queueSize),
+		done:   make(chan struct{}),
+	}
+	n.sendMail = n.smtpSendMail
+	var needsSMTP bool
+	for index, route := range config.Routes {
+		for _, event := range route.Events {
+			if _, ok := events[event]; !ok {
+				return nil, fmt.Errorf("route %d: unknown event: %s", index,
+					event)
+			}
+		}
+		for _, rawURL := range []string{route.WebhookURL,
+			route.SlackWebhookURL} {
+			if rawURL == "" {
+				continue
+			}
+			if err := checkWebhookURL(rawURL); err != nil {
+				return nil, fmt.Errorf("route %d: %s", index, err)
+			}
+		}
+		if len(route.Email) > 0 {
+			needsSMTP = true
+		}
+	}
+	if needsSMTP {
+		if config.SMTP.Server == "" || config.SMTP.From == "" {
+			return nil, errors.New("email routes need an smtp server and from")
+		}
+		if config.SMTP.PasswordFilename != "" {
+			password, err := ioutil.ReadFile(config.SMTP.PasswordFilename)
+			if err != nil {
+				return nil, err
+			}
+			n.password = strings.TrimSpace(string(password))
+		}
+	}
+	go n.loop()
+	return n, nil
+}
+
+func (r Route) selects(event string) bool {
+	if len(r.Events) < 1 {
+		return true
+	}
+	for _, selected := range r.Events {
+		if selected == event {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *Notifier) notify(notification Notification) {
+	if n == nil || len(n.config.Routes) < 1 {
+		return
+	}
+	if notification.Time.IsZero() {
+		notification.Time = time.Now()
+	}
+	select {
+	case n.queue <- &notification:
+	default:
+		n.logger.Printf("notification queue is full, %s notification dropped",
+			notification.Event)
+	}
+}
+
+func (n *Notifier) close() error {
+	if n == nil {
+		return nil
+	}
+	close(n.queue)
+	<-n.done
+	return nil
+}
+
+func (n *Notifier) loop() {
+	defer close(n.done)
+	for notification := range n.queue {
+		n.send(notification)
+	}
+}
+
+func (n *Notifier) send(notification *Notification) {
+	for _, route := range n.config.Routes {
+		if !route.selects(notification.Event) {
+			continue
+		}
+		if len(route.Email) > 0 {
+			err := n.sendMail(route.Email, n.formatEmail(route.Email,
+				notification))
+			if err != nil {
+				n.logger.Printf("cannot mail %s notification to %s: %s",
+					notification.Event, strings.Join(route.Email, ","), err)
+			}
+		}
+		if route.WebhookURL != "" {
+			if err := n.post(route.WebhookURL, notification); err != nil {
+				n.logger.Printf("cannot send %s notification to %s: %s",
+					notification.Event, route.WebhookURL, err)
+			}
+		}
+		if route.SlackWebhookURL != "" {
+			err := n.post(route.SlackWebhookURL, map[string]string{
+				"text": notification.Subject + "\n" + notification.Text,
+			})
+			if err != nil {
+				n.logger.Printf("cannot send %s notification to Slack: %s",
+					notification.Event, err)
+			}
+		}
+	}
+}
+
+func (n *Notifier) formatEmail(to []string,
+	notification *Notification) []byte {
+	buffer := &bytes.Buffer{}
+	fmt.Fprintf(buffer, "From: %s\r\n", n.config.SMTP.From)
+	fmt.Fprintf(buffer, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(buffer, "Subject: %s\r\n",
+		mime.QEncoding.Encode("utf-8", notification.Subject))
+	fmt.Fprintf(buffer, "Date: %s\r\n",
+		notification.Time.Format(time.RFC1123Z))
+	buffer.WriteString("MIME-Version: 1.0\r\n")
+	buffer.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	for _, line := range strings.Split(notification.Text, "\n") {
+		buffer.WriteString(line + "\r\n")
+	}
+	return buffer.Bytes()
+}
+
+func (n *Notifier) smtpSendMail(to []string, message []byte) error {
+	var auth smtp.Auth
+	if n.config.SMTP.Username != "" {
+		host, _, err := net.SplitHostPort(n.config.SMTP.Server)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", n.config.SMTP.Username, n.password, host)
+	}
+	return smtp.SendMail(n.config.SMTP.Server, auth, n.config.SMTP.From, to,
+		message)
+}
+
+func (n *Notifier) post(url string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	resp, err := n.client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package notify
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log/testlogger"
+)
+
+var testNotifications = []Notification{
+	{Event: EventEnrollment, Username: "alice",
+		Subject: "alice registered a security key", Text: "U2F key"},
+	{Event: EventAdmin, Username: "admin", Subject: "admin reset tokens",
+		Text: "reset-tokens of alice"},
+}
+
+func TestRoutes(t *testing.T) {
+	var mutex sync.Mutex
+	var webhook []Notification
+	var slack []string
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if r.URL.Path == "/slack" {
+				var message struct {
+					Text string `json:"text"`
+				}
+				if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+					t.Error(err)
+				}
+				slack = append(slack, message.Text)
+				return
+			}
+			var notification Notification
+			if err := json.NewDecoder(r.Body).Decode(&notification); err != nil {
+				t.Error(err)
+			}
+			webhook = append(webhook, notification)
+		}))
+	defer server.Close()
+	n, err := New(Config{
+		SMTP: SMTPConfig{Server: "localhost:25", From: "keymaster@example.com"},
+		Routes: []Route{
+			{Events: []string{EventEnrollment},
+				Email:      []string{"security@example.com"},
+				WebhookURL: server.URL + "/hook"},
+			{Events: []string{EventAdmin},
+				SlackWebhookURL: server.URL + "/slack"},
+		},
+	}, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mails []string
+	n.sendMail = func(to []string, message []byte) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		mails = append(mails, strings.Join(to, ",")+"|"+string(message))
+		return nil
+	}
+	for _, notification := range testNotifications {
+		n.Notify(notification)
+	}
+	if err := n.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(mails) != 1 ||
+		!strings.HasPrefix(mails[0], "security@example.com|") ||
+		!strings.Contains(mails[0],
+			"Subject: alice registered a security key\r\n") ||
+		!strings.HasSuffix(mails[0], "\r\n\r\nU2F key\r\n") {
+		t.Fatalf("unexpected mails: %q", mails)
+	}
+	if len(webhook) != 1 || webhook[0].Username != "alice" ||
+		webhook[0].Time.IsZero() {
+		t.Fatalf("unexpected webhook notifications: %+v", webhook)
+	}
+	if len(slack) != 1 || slack[0] != "admin reset tokens\nreset-tokens of alice" {
+		t.Fatalf("unexpected Slack messages: %q", slack)
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	for _, config := range []Config{
+		{Routes: []Route{{Events: []string{"logout"}}}},
+		{Routes: []Route{{WebhookURL: "ftp://example.com/"}}},
+		{Routes: []Route{{Email: []string{"security@example.com"}}}},
+	} {
+		if _, err := New(config, testlogger.New(t)); err == nil {
+			t.Fatalf("%+v should fail", config)
+		}
+	}
+}
+
+func TestNilNotifier(t *testing.T) {
+	var n *Notifier
+	n.Notify(testNotifications[0])
+	if err := n.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,57 @@
+// Package pivattest verifies that a key was generated in the PIV applet of
+// a YubiKey. The YubiKey attests the key of a slot with a certificate
+// signed by its attestation key, whose certificate is in turn signed by the
+// Yubico PIV CA. Clients send both certificates with their certificate
+// requests, in the proto.PIVAttestationHeader header, as
+// "v1 <slot certificate> <attestation certificate>": the base64url encoded
+// DER certificates.
+package pivattest
+
+import (
+	"crypto"
+	"crypto/x509"
+)
+
+// Policies of a slot key for PINs and touches.
+const (
+	PolicyNever  = "never"
+	PolicyOnce   = "once"
+	PolicyAlways = "always"
+	PolicyCached = "cached"
+)
+
+// Attestation describes an attested key.
+type Attestation struct {
+	PublicKey crypto.PublicKey
+	// Slot is the PIV slot of the key, such as "9a".
+	Slot string
+	// Serial is the serial number of the YubiKey.
+	Serial uint32
+	// Version is the firmware version of the YubiKey.
+	Version string
+	// PINPolicy is PolicyNever, PolicyOnce or PolicyAlways; TouchPolicy is
+	// PolicyNever, PolicyAlways or PolicyCached. They are empty if the
+	// attestation does not say.
+	PINPolicy   string
+	TouchPolicy string
+}
+
+// Header returns the header value sending the DER encoded certificates
+// slotCert, attesting the key of a slot, and attestationCert, the
+// certificate of the attestation key of the YubiKey.
+func Header(slotCert, attestationCert []byte) string {
+	return header(slotCert, attestationCert)
+}
+
+// Verify checks the attestation in header against roots and returns what
+// it attests.
+func Verify(header string, roots *x509.CertPool) (*Attestation, error) {
+	return verify(header, roots)
+}
+
+// VerifyCertificates checks that slotCert was signed by attestationCert and
+// that attestationCert chains to roots, and returns what slotCert attests.
+func VerifyCertificates(slotCert, attestationCert *x509.Certificate,
+	roots *x509.CertPool) (*Attestation, error) {
+	return verifyCertificates(slotCert, attestationCert, roots)
+}
@@ -0,0 +1,121 @@
+package pivattest
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	headerVersion = "v1"
+	// The subject of slot certificates ends with the slot.
+	slotSubjectPrefix = "YubiKey PIV Attestation "
+)
+
+// Extensions of the Yubico attestation certificates.
+var (
+	oidFirmwareVersion = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 41482, 3, 3}
+	oidSerialNumber    = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 41482, 3, 7}
+	oidPolicy          = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 41482, 3, 8}
+)
+
+var (
+	pinPolicies = map[byte]string{
+		1: PolicyNever,
+		2: PolicyOnce,
+		3: PolicyAlways,
+	}
+	touchPolicies = map[byte]string{
+		1: PolicyNever,
+		2: PolicyAlways,
+		3: PolicyCached,
+	}
+)
+
+func header(slotCert, attestationCert []byte) string {
+	return strings.Join([]string{headerVersion,
+		base64.RawURLEncoding.EncodeToString(slotCert),
+		base64.RawURLEncoding.EncodeToString(attestationCert)}, " ")
+}
+
+func parseCertificate(value string) (*x509.Certificate, error) {
+	der, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+func verify(header string, roots *x509.CertPool) (*Attestation, error) {
+	fields := strings.Fields(header)
+	if len(fields) != 3 || fields[0] != headerVersion {
+		return nil, errors.New("malformed attestation")
+	}
+	slotCert, err := parseCertificate(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse slot certificate: %s", err)
+	}
+	attestationCert, err := parseCertificate(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse attestation certificate: %s",
+			err)
+	}
+	return verifyCertificates(slotCert, attestationCert, roots)
+}
+
+func verifyCertificates(slotCert, attestationCert *x509.Certificate,
+	roots *x509.CertPool) (*Attestation, error) {
+	if roots == nil {
+		return nil, errors.New("no attestation roots")
+	}
+	_, err := attestationCert.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("attestation certificate: %s", err)
+	}
+	// The attestation certificate is not marked as a CA, so the slot
+	// certificate cannot be verified as part of the chain.
+	err = attestationCert.CheckSignature(slotCert.SignatureAlgorithm,
+		slotCert.RawTBSCertificate, slotCert.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("slot certificate: %s", err)
+	}
+	if !strings.HasPrefix(slotCert.Subject.CommonName, slotSubjectPrefix) {
+		return nil, fmt.Errorf("not a slot certificate: %s",
+			slotCert.Subject.CommonName)
+	}
+	attestation := &Attestation{
+		PublicKey: slotCert.PublicKey,
+		Slot: strings.TrimPrefix(slotCert.Subject.CommonName,
+			slotSubjectPrefix),
+	}
+	for _, extension := range slotCert.Extensions {
+		switch {
+		case extension.Id.Equal(oidFirmwareVersion):
+			if len(extension.Value) != 3 {
+				return nil, errors.New("malformed firmware version")
+			}
+			attestation.Version = fmt.Sprintf("%d.%d.%d",
+				extension.Value[0], extension.Value[1], extension.Value[2])
+		case extension.Id.Equal(oidSerialNumber):
+			var serial int64
+			_, err := asn1.Unmarshal(extension.Value, &serial)
+			if err != nil || serial < 0 || serial > 1<<32-1 {
+				return nil, errors.New("malformed serial number")
+			}
+			attestation.Serial = uint32(serial)
+		case extension.Id.Equal(oidPolicy):
+			if len(extension.Value) != 2 {
+				return nil, errors.New("malformed policy")
+			}
+			attestation.PINPolicy = pinPolicies[extension.Value[0]]
+			attestation.TouchPolicy = touchPolicies[extension.Value[1]]
+		}
+	}
+	return attestation, nil
+}
@@ -0,0 +1,124 @@
+package pivattest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+func makeCert(t *testing.T, template *x509.Certificate,
+	parent *x509.Certificate, publicKey crypto.PublicKey,
+	signer crypto.Signer) []byte {
+	template.SerialNumber = big.NewInt(1)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent = template
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent,
+		publicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func generateKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// makeAttestation returns roots and the certificates of a slot key the way
+// a YubiKey attests it.
+func makeAttestation(t *testing.T, slotKey crypto.PublicKey) (
+	*x509.CertPool, []byte, []byte) {
+	rootKey := generateKey(t)
+	rootTemplate := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Test PIV Root CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	rootDER := makeCert(t, rootTemplate, nil, rootKey.Public(), rootKey)
+	root, err := x509.ParseCertificate(rootDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	attestationKey := generateKey(t)
+	attestationTemplate := &x509.Certificate{
+		Subject: pkix.Name{CommonName: "Yubico PIV Attestation"},
+	}
+	attestationDER := makeCert(t, attestationTemplate, root,
+		attestationKey.Public(), rootKey)
+	attestationCert, err := x509.ParseCertificate(attestationDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := asn1.Marshal(12345678)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slotTemplate := &x509.Certificate{
+		Subject: pkix.Name{CommonName: "YubiKey PIV Attestation 9a"},
+		ExtraExtensions: []pkix.Extension{
+			{Id: oidFirmwareVersion, Value: []byte{5, 4, 3}},
+			{Id: oidSerialNumber, Value: serial},
+			{Id: oidPolicy, Value: []byte{2, 3}},
+		},
+	}
+	slotDER := makeCert(t, slotTemplate, attestationCert, slotKey,
+		attestationKey)
+	return roots, slotDER, attestationDER
+}
+
+func TestVerify(t *testing.T) {
+	slotKey := generateKey(t)
+	roots, slotCert, attestationCert := makeAttestation(t, slotKey.Public())
+	attestation, err := Verify(Header(slotCert, attestationCert), roots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slotKey.PublicKey.Equal(attestation.PublicKey) ||
+		attestation.Slot != "9a" || attestation.Serial != 12345678 ||
+		attestation.Version != "5.4.3" ||
+		attestation.PINPolicy != PolicyOnce ||
+		attestation.TouchPolicy != PolicyCached {
+		t.Fatalf("unexpected attestation: %+v", attestation)
+	}
+}
+
+func TestVerifyInvalid(t *testing.T) {
+	slotKey := generateKey(t)
+	roots, slotCert, attestationCert := makeAttestation(t, slotKey.Public())
+	otherRoots, otherSlotCert, _ := makeAttestation(t, slotKey.Public())
+	for name, header := range map[string]string{
+		"malformed":       "v1 junk",
+		"wrong version":   strings.Replace(Header(slotCert, attestationCert), "v1", "v2", 1),
+		"swapped":         Header(attestationCert, slotCert),
+		"other slot cert": Header(otherSlotCert, attestationCert),
+	} {
+		if _, err := Verify(header, roots); err == nil {
+			t.Errorf("%s: verified", name)
+		}
+	}
+	if _, err := Verify(Header(slotCert, attestationCert),
+		otherRoots); err == nil {
+		t.Error("verified with other roots")
+	}
+	if _, err := Verify(Header(slotCert, attestationCert), nil); err == nil {
+		t.Error("verified without roots")
+	}
+}
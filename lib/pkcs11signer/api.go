@@ -0,0 +1,66 @@
+// Package pkcs11signer implements crypto.Signer with a private key which
+// never leaves a PKCS#11 token such as an HSM.
+package pkcs11signer
+
+import (
+	"crypto"
+	"io"
+	"sync"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"github.com/miekg/pkcs11"
+)
+
+type Config struct {
+	// ModulePath is the PKCS#11 library provided by the token vendor.
+	ModulePath string
+	// TokenLabel selects the token. If empty, the token in SlotID is used.
+	TokenLabel string
+	SlotID     uint
+	PIN        string
+	// KeyLabel is the label of the private key and its public key.
+	KeyLabel string
+}
+
+// Signer signs with a key held in a PKCS#11 token. It is safe for
+// concurrent use; signatures are serialised over one session which is
+// reopened if the token is reset or reconnected. RSA (PKCS #1 v1.5) and
+// ECDSA keys are supported.
+type Signer struct {
+	config     Config
+	logger     log.DebugLogger
+	ctx        *pkcs11.Ctx
+	slotID     uint
+	publicKey  crypto.PublicKey
+	mutex      sync.Mutex
+	hasSession bool
+	session    pkcs11.SessionHandle
+	privateKey pkcs11.ObjectHandle
+}
+
+// New loads the PKCS#11 module, logs in to the token and finds the key.
+func New(config Config, logger log.DebugLogger) (*Signer, error) {
+	return newSigner(config, logger)
+}
+
+// Public returns the public key of the token key.
+func (s *Signer) Public() crypto.PublicKey {
+	return s.publicKey
+}
+
+// Sign signs digest in the token. rand is not used.
+func (s *Signer) Sign(rand io.Reader, digest []byte,
+	opts crypto.SignerOpts) ([]byte, error) {
+	return s.sign(digest, opts)
+}
+
+// Check returns an error if the token cannot be used, reopening the session
+// if it was lost.
+func (s *Signer) Check() error {
+	return s.check()
+}
+
+// Close logs out and unloads the PKCS#11 module.
+func (s *Signer) Close() error {
+	return s.close()
+}
@@ -0,0 +1,360 @@
+package pkcs11signer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"github.com/miekg/pkcs11"
+)
+
+// DigestInfo prefixes from RFC 8017 section 9.2, needed because CKM_RSA_PKCS
+// signs its input as is.
+var rsaDigestInfoPrefixes = map[crypto.Hash][]byte{
+	crypto.SHA1: {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02,
+		0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA224: {0x30, 0x2d, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01,
+		0x65, 0x03, 0x04, 0x02, 0x04, 0x05, 0x00, 0x04, 0x1c},
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01,
+		0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01,
+		0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01,
+		0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+var namedCurveOIDs = map[string]elliptic.Curve{
+	"1.2.840.10045.3.1.7": elliptic.P256(),
+	"1.3.132.0.34":        elliptic.P384(),
+	"1.3.132.0.35":        elliptic.P521(),
+}
+
+// isSessionError returns true for errors after which the session has to be
+// reopened.
+func isSessionError(err error) bool {
+	switch err {
+	case pkcs11.Error(pkcs11.CKR_SESSION_HANDLE_INVALID),
+		pkcs11.Error(pkcs11.CKR_SESSION_CLOSED),
+		pkcs11.Error(pkcs11.CKR_DEVICE_REMOVED),
+		pkcs11.Error(pkcs11.CKR_TOKEN_NOT_PRESENT),
+		pkcs11.Error(pkcs11.CKR_USER_NOT_LOGGED_IN),
+		pkcs11.Error(pkcs11.CKR_OBJECT_HANDLE_INVALID),
+		pkcs11.Error(pkcs11.CKR_KEY_HANDLE_INVALID):
+		return true
+	}
+	return false
+}
+
+func newSigner(config Config, logger log.DebugLogger) (*Signer, error) {
+	if config.KeyLabel == "" {
+		return nil, errors.New("no PKCS#11 key label given")
+	}
+	ctx := pkcs11.New(config.ModulePath)
+	if ctx == nil {
+		return nil, fmt.Errorf("cannot load PKCS#11 module %s",
+			config.ModulePath)
+	}
+	if err := ctx.Initialize(); err != nil {
+		ctx.Destroy()
+		return nil, fmt.Errorf("cannot initialise PKCS#11 module: %s", err)
+	}
+	s := &Signer{config: config, logger: logger, ctx: ctx}
+	var err error
+	s.slotID, err = s.findSlot()
+	if err == nil {
+		err = s.openSession()
+	}
+	if err == nil {
+		s.publicKey, err = s.getPublicKey()
+	}
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	logger.Debugf(0, "using PKCS#11 key %s in slot %d", config.KeyLabel,
+		s.slotID)
+	return s, nil
+}
+
+func (s *Signer) findSlot() (uint, error) {
+	if s.config.TokenLabel == "" {
+		return s.config.SlotID, nil
+	}
+	slots, err := s.ctx.GetSlotList(true)
+	if err != nil {
+		return 0, err
+	}
+	for _, slot := range slots {
+		tokenInfo, err := s.ctx.GetTokenInfo(slot)
+		if err != nil {
+			s.logger.Debugf(1, "cannot get token info for slot %d: %s",
+				slot, err)
+			continue
+		}
+		if strings.TrimSpace(tokenInfo.Label) == s.config.TokenLabel {
+			return slot, nil
+		}
+	}
+	return 0, fmt.Errorf("PKCS#11 token %s not found", s.config.TokenLabel)
+}
+
+// openSession opens a session, logs in and finds the private key. The mutex
+// must be held or s not yet shared.
+func (s *Signer) openSession() error {
+	session, err := s.ctx.OpenSession(s.slotID, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return fmt.Errorf("cannot open PKCS#11 session: %s", err)
+	}
+	err = s.ctx.Login(session, pkcs11.CKU_USER, s.config.PIN)
+	if err != nil && err != pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+		s.ctx.CloseSession(session)
+		return fmt.Errorf("cannot log in to PKCS#11 token: %s", err)
+	}
+	privateKey, err := s.findObject(session, pkcs11.CKO_PRIVATE_KEY)
+	if err != nil {
+		s.ctx.CloseSession(session)
+		return err
+	}
+	s.session = session
+	s.privateKey = privateKey
+	s.hasSession = true
+	return nil
+}
+
+func (s *Signer) closeSession() {
+	if !s.hasSession {
+		return
+	}
+	s.hasSession = false
+	if err := s.ctx.CloseSession(s.session); err != nil {
+		s.logger.Debugf(1, "error closing PKCS#11 session: %s", err)
+	}
+}
+
+// findObject returns the one object of class labelled with the key label.
+func (s *Signer) findObject(session pkcs11.SessionHandle, class uint) (
+	pkcs11.ObjectHandle, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, s.config.KeyLabel),
+	}
+	return s.findObjectByTemplate(session, template)
+}
+
+func (s *Signer) findObjectByTemplate(session pkcs11.SessionHandle,
+	template []*pkcs11.Attribute) (pkcs11.ObjectHandle, error) {
+	if err := s.ctx.FindObjectsInit(session, template); err != nil {
+		return 0, err
+	}
+	objects, _, err := s.ctx.FindObjects(session, 2)
+	if finalErr := s.ctx.FindObjectsFinal(session); err == nil {
+		err = finalErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	switch len(objects) {
+	case 0:
+		return 0, fmt.Errorf("PKCS#11 key %s not found", s.config.KeyLabel)
+	case 1:
+		return objects[0], nil
+	}
+	return 0, fmt.Errorf("PKCS#11 key label %s is not unique",
+		s.config.KeyLabel)
+}
+
+// getPublicKey reads the public key object matching the private key.
+func (s *Signer) getPublicKey() (crypto.PublicKey, error) {
+	for _, keyType := range []uint{pkcs11.CKK_RSA, pkcs11.CKK_EC} {
+		object, err := s.findObjectByTemplate(s.session,
+			[]*pkcs11.Attribute{
+				pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+				pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, keyType),
+				pkcs11.NewAttribute(pkcs11.CKA_LABEL, s.config.KeyLabel),
+			})
+		if err != nil {
+			continue
+		}
+		if keyType == pkcs11.CKK_RSA {
+			return s.getRSAPublicKey(object)
+		}
+		return s.getECPublicKey(object)
+	}
+	return nil, fmt.Errorf("no RSA or EC public key labelled %s",
+		s.config.KeyLabel)
+}
+
+func (s *Signer) getRSAPublicKey(object pkcs11.ObjectHandle) (
+	*rsa.PublicKey, error) {
+	attributes, err := s.ctx.GetAttributeValue(s.session, object,
+		[]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+		})
+	if err != nil {
+		return nil, err
+	}
+	if len(attributes) != 2 {
+		return nil, errors.New("incomplete RSA public key")
+	}
+	exponent := new(big.Int).SetBytes(attributes[1].Value)
+	if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+		return nil, errors.New("unsupported RSA public exponent")
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(attributes[0].Value),
+		E: int(exponent.Int64()),
+	}, nil
+}
+
+func (s *Signer) getECPublicKey(object pkcs11.ObjectHandle) (
+	*ecdsa.PublicKey, error) {
+	attributes, err := s.ctx.GetAttributeValue(s.session, object,
+		[]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+		})
+	if err != nil {
+		return nil, err
+	}
+	if len(attributes) != 2 {
+		return nil, errors.New("incomplete EC public key")
+	}
+	return parseECPublicKey(attributes[0].Value, attributes[1].Value)
+}
+
+// parseECPublicKey decodes the DER encoded named curve OID in params and the
+// DER encoded OCTET STRING holding an uncompressed point in point.
+func parseECPublicKey(params []byte, point []byte) (*ecdsa.PublicKey, error) {
+	var oid asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(params, &oid); err != nil {
+		return nil, fmt.Errorf("cannot parse EC parameters: %s", err)
+	}
+	curve, ok := namedCurveOIDs[oid.String()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported EC curve %s", oid)
+	}
+	var rawPoint []byte
+	if _, err := asn1.Unmarshal(point, &rawPoint); err != nil {
+		return nil, fmt.Errorf("cannot parse EC point: %s", err)
+	}
+	x, y := elliptic.Unmarshal(curve, rawPoint)
+	if x == nil {
+		return nil, errors.New("invalid EC point")
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+// getSignInput returns the PKCS#11 mechanism and input for signing digest.
+func (s *Signer) getSignInput(digest []byte, opts crypto.SignerOpts) (
+	*pkcs11.Mechanism, []byte, error) {
+	switch s.publicKey.(type) {
+	case *rsa.PublicKey:
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			return nil, nil, errors.New("RSA-PSS signatures are not supported")
+		}
+		prefix, ok := rsaDigestInfoPrefixes[opts.HashFunc()]
+		if !ok {
+			return nil, nil, fmt.Errorf("unsupported hash %v",
+				opts.HashFunc())
+		}
+		if len(digest) != opts.HashFunc().Size() {
+			return nil, nil, errors.New("digest length does not match hash")
+		}
+		input := make([]byte, 0, len(prefix)+len(digest))
+		input = append(input, prefix...)
+		return pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil),
+			append(input, digest...), nil
+	case *ecdsa.PublicKey:
+		return pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil), digest, nil
+	}
+	return nil, nil, errors.New("unsupported key type")
+}
+
+// encodeECDSASignature converts the r || s signature returned by PKCS#11 to
+// the ASN.1 form expected from a crypto.Signer.
+func encodeECDSASignature(signature []byte) ([]byte, error) {
+	if len(signature) < 2 || len(signature)%2 != 0 {
+		return nil, errors.New("invalid ECDSA signature length")
+	}
+	half := len(signature) / 2
+	return asn1.Marshal(struct {
+		R, S *big.Int
+	}{
+		R: new(big.Int).SetBytes(signature[:half]),
+		S: new(big.Int).SetBytes(signature[half:]),
+	})
+}
+
+func (s *Signer) signWithSession(mechanism *pkcs11.Mechanism,
+	input []byte) ([]byte, error) {
+	if !s.hasSession {
+		if err := s.openSession(); err != nil {
+			return nil, err
+		}
+	}
+	err := s.ctx.SignInit(s.session, []*pkcs11.Mechanism{mechanism},
+		s.privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return s.ctx.Sign(s.session, input)
+}
+
+func (s *Signer) sign(digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	mechanism, input, err := s.getSignInput(digest, opts)
+	if err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	signature, err := s.signWithSession(mechanism, input)
+	if err != nil && isSessionError(err) {
+		s.logger.Printf("PKCS#11 session lost, reopening: %s", err)
+		s.closeSession()
+		signature, err = s.signWithSession(mechanism, input)
+	}
+	s.mutex.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("PKCS#11 signing failed: %s", err)
+	}
+	if _, ok := s.publicKey.(*ecdsa.PublicKey); ok {
+		return encodeECDSASignature(signature)
+	}
+	return signature, nil
+}
+
+func (s *Signer) check() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.hasSession {
+		_, err := s.ctx.GetSessionInfo(s.session)
+		if err == nil {
+			return nil
+		}
+		if !isSessionError(err) {
+			return err
+		}
+		s.logger.Printf("PKCS#11 session lost, reopening: %s", err)
+		s.closeSession()
+	}
+	return s.openSession()
+}
+
+func (s *Signer) close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.hasSession {
+		s.ctx.Logout(s.session)
+		s.closeSession()
+	}
+	err := s.ctx.Finalize()
+	s.ctx.Destroy()
+	return err
+}
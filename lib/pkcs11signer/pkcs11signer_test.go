@@ -0,0 +1,102 @@
+package pkcs11signer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+)
+
+func TestParseECPublicKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, err := asn1.Marshal(asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	point, err := asn1.Marshal(elliptic.Marshal(elliptic.P256(), key.X, key.Y))
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := parseECPublicKey(params, point)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if publicKey.X.Cmp(key.X) != 0 || publicKey.Y.Cmp(key.Y) != 0 {
+		t.Fatal("public key does not match")
+	}
+	params, err = asn1.Marshal(asn1.ObjectIdentifier{1, 3, 132, 0, 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseECPublicKey(params, point); err == nil {
+		t.Fatal("unsupported curve should fail")
+	}
+}
+
+func TestEncodeECDSASignature(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte("message"))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawSignature := make([]byte, 64)
+	r.FillBytes(rawSignature[:32])
+	s.FillBytes(rawSignature[32:])
+	signature, err := encodeECDSASignature(rawSignature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ecdsa.VerifyASN1(&key.PublicKey, digest[:], signature) {
+		t.Fatal("encoded signature does not verify")
+	}
+	if _, err := encodeECDSASignature(rawSignature[:63]); err == nil {
+		t.Fatal("odd length signature should fail")
+	}
+}
+
+// TestRSASignInput checks that signing the input for CKM_RSA_PKCS with a raw
+// RSA operation yields a valid PKCS #1 v1.5 signature.
+func TestRSASignInput(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Signer{publicKey: &key.PublicKey}
+	digest := sha256.Sum256([]byte("message"))
+	_, input, err := s.getSignInput(digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// EMSA-PKCS1-v1_5 padding followed by the private key operation, as
+	// done by the token.
+	k := key.Size()
+	padded := make([]byte, k)
+	padded[1] = 1
+	for i := 2; i < k-len(input)-1; i++ {
+		padded[i] = 0xff
+	}
+	copy(padded[k-len(input):], input)
+	m := new(big.Int).SetBytes(padded)
+	signature := new(big.Int).Exp(m, key.D, key.N).FillBytes(make([]byte, k))
+	err = rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:],
+		signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = s.getSignInput(digest[:], &rsa.PSSOptions{Hash: crypto.SHA256})
+	if err == nil {
+		t.Fatal("PSS should not be supported")
+	}
+}
@@ -0,0 +1,53 @@
+// Package principalmap translates group memberships into additional SSH
+// principals.
+package principalmap
+
+import (
+	"regexp"
+)
+
+// Mapping grants Principals to the members of the groups matching Group.
+// In Group "*" matches any sequence of characters. In Principals "$USER" is
+// replaced by the username, "$GROUP" by the matching group and "$1" to "$9"
+// by the text matched by the first to ninth "*" of Group.
+type Mapping struct {
+	Group      string   `yaml:"group"`
+	Principals []string `yaml:"principals"`
+}
+
+// Match is a principal granted by a mapping.
+type Match struct {
+	Group     string `json:"group"`
+	Mapping   string `json:"mapping"`
+	Principal string `json:"principal"`
+}
+
+// Mapper holds compiled mappings.
+type Mapper struct {
+	mappings []compiledMapping
+}
+
+type compiledMapping struct {
+	Mapping
+	groupRE *regexp.Regexp
+}
+
+// New returns a Mapper for mappings. An error is returned if a mapping has
+// no group or no principals or refers to a "*" its group does not have.
+func New(mappings []Mapping) (*Mapper, error) {
+	return newMapper(mappings)
+}
+
+// Map returns the principals the mappings grant to username as a member of
+// groups, in the order of the mappings and without duplicates. Principals
+// which are not valid (such as those containing spaces or commas after
+// templating) are skipped. A nil Mapper grants no principals.
+func (m *Mapper) Map(username string, groups []string) []string {
+	return m.mapPrincipals(username, groups)
+}
+
+// Explain is like Map, but also returns which group and mapping granted
+// each principal.
+func (m *Mapper) Explain(username string, groups []string) []Match {
+	return m.explain(username, groups)
+}
@@ -0,0 +1,108 @@
+package principalmap
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	captureVariableRE = regexp.MustCompile(`\$[1-9]`)
+	variableRE        = regexp.MustCompile(`\$(USER|GROUP|[1-9])`)
+	validPrincipalRE  = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._@+-]*$`)
+)
+
+func compileGroupPattern(pattern string) (*regexp.Regexp, int) {
+	parts := strings.Split(pattern, "*")
+	for index, part := range parts {
+		parts[index] = regexp.QuoteMeta(part)
+	}
+	return regexp.MustCompile("^" + strings.Join(parts, "(.*)") + "$"),
+		len(parts) - 1
+}
+
+func newMapper(mappings []Mapping) (*Mapper, error) {
+	m := &Mapper{}
+	for index, mapping := range mappings {
+		if mapping.Group == "" {
+			return nil, fmt.Errorf("mapping %d: missing group", index)
+		}
+		if len(mapping.Principals) < 1 {
+			return nil, fmt.Errorf("mapping %d: no principals", index)
+		}
+		groupRE, numWildcards := compileGroupPattern(mapping.Group)
+		for _, principal := range mapping.Principals {
+			if principal == "" {
+				return nil, fmt.Errorf("mapping %d: empty principal", index)
+			}
+			for _, variable := range captureVariableRE.FindAllString(
+				principal, -1) {
+				if n, _ := strconv.Atoi(variable[1:]); n > numWildcards {
+					return nil, fmt.Errorf("mapping %d: %s in %q but group %q has %d wildcards",
+						index, variable, principal, mapping.Group,
+						numWildcards)
+				}
+			}
+		}
+		m.mappings = append(m.mappings,
+			compiledMapping{Mapping: mapping, groupRE: groupRE})
+	}
+	return m, nil
+}
+
+func expandPrincipal(principal, username, group string,
+	captures []string) string {
+	return variableRE.ReplaceAllStringFunc(principal,
+		func(variable string) string {
+			switch variable {
+			case "$USER":
+				return username
+			case "$GROUP":
+				return group
+			}
+			n, _ := strconv.Atoi(variable[1:])
+			return captures[n]
+		})
+}
+
+func (m *Mapper) explain(username string, groups []string) []Match {
+	if m == nil {
+		return nil
+	}
+	var matches []Match
+	seen := make(map[string]struct{})
+	for _, mapping := range m.mappings {
+		for _, group := range groups {
+			captures := mapping.groupRE.FindStringSubmatch(group)
+			if captures == nil {
+				continue
+			}
+			for _, pattern := range mapping.Principals {
+				principal := expandPrincipal(pattern, username, group,
+					captures)
+				if !validPrincipalRE.MatchString(principal) {
+					continue
+				}
+				if _, ok := seen[principal]; ok {
+					continue
+				}
+				seen[principal] = struct{}{}
+				matches = append(matches, Match{
+					Group:     group,
+					Mapping:   mapping.Group,
+					Principal: principal,
+				})
+			}
+		}
+	}
+	return matches
+}
+
+func (m *Mapper) mapPrincipals(username string, groups []string) []string {
+	var principals []string
+	for _, match := range m.explain(username, groups) {
+		principals = append(principals, match.Principal)
+	}
+	return principals
+}
@@ -0,0 +1,50 @@
+package principalmap
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMap(t *testing.T) {
+	mapper, err := New([]Mapping{
+		{Group: "dba", Principals: []string{"dbadmin"}},
+		{Group: "team-*", Principals: []string{"$1-deploy", "$USER-$1"}},
+		{Group: "*-*-ops", Principals: []string{"$2-$1"}},
+		{Group: "Domain *", Principals: []string{"$GROUP"}},
+		{Group: "admins", Principals: []string{"dbadmin", "root"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	principals := mapper.Map("alice", []string{"users", "dba", "team-web",
+		"eu-db-ops", "Domain Users", "admins"})
+	expected := []string{"dbadmin", "web-deploy", "alice-web", "db-eu", "root"}
+	if !reflect.DeepEqual(principals, expected) {
+		t.Fatalf("expected %v, got %v", expected, principals)
+	}
+	matches := mapper.Explain("alice", []string{"team-web"})
+	if len(matches) != 2 || matches[0].Group != "team-web" ||
+		matches[0].Mapping != "team-*" || matches[0].Principal != "web-deploy" {
+		t.Fatalf("unexpected matches: %+v", matches)
+	}
+	if principals := mapper.Map("bob", []string{"users"}); principals != nil {
+		t.Fatalf("unexpected principals: %v", principals)
+	}
+	var nilMapper *Mapper
+	if principals := nilMapper.Map("bob", []string{"dba"}); principals != nil {
+		t.Fatalf("unexpected principals: %v", principals)
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	for _, mappings := range [][]Mapping{
+		{{Principals: []string{"root"}}},
+		{{Group: "dba"}},
+		{{Group: "dba", Principals: []string{""}}},
+		{{Group: "team-*", Principals: []string{"$2"}}},
+	} {
+		if _, err := New(mappings); err == nil {
+			t.Errorf("%+v should be rejected", mappings)
+		}
+	}
+}
@@ -1,9 +1,17 @@
 package pwauth
 
 import (
+	"errors"
+	"time"
+
 	"github.com/Cloud-Foundations/keymaster/lib/simplestorage"
 )
 
+// ErrPasswordChangeNotSupported is returned by ChangePassword if the
+// authenticator cannot change passwords.
+var ErrPasswordChangeNotSupported = errors.New(
+	"password change not supported")
+
 // PasswordAuthenticator is an interface type that defines how to authenticate a
 // user with a username and password.
 type PasswordAuthenticator interface {
@@ -13,3 +21,48 @@ type PasswordAuthenticator interface {
 	PasswordAuthenticate(username string, password []byte) (bool, error)
 	UpdateStorage(storage simplestorage.SimpleStore) error
 }
+
+// PasswordStatus is the state of a password reported by its backend.
+type PasswordStatus struct {
+	// MustChange is true if the password is correct but has expired or was
+	// reset, so that it must be changed before it is accepted.
+	MustChange bool
+	// ExpiresIn is the time until the password expires, or zero if unknown.
+	ExpiresIn time.Duration
+}
+
+// StatusAuthenticator is implemented by PasswordAuthenticators which report
+// the state of passwords.
+type StatusAuthenticator interface {
+	// PasswordAuthenticateWithStatus is like PasswordAuthenticate, but also
+	// returns the state of the password. Passwords which must be changed are
+	// not accepted.
+	PasswordAuthenticateWithStatus(username string, password []byte) (
+		bool, PasswordStatus, error)
+}
+
+// PasswordChanger is implemented by PasswordAuthenticators which can change
+// the passwords of users.
+type PasswordChanger interface {
+	// ChangePassword replaces oldPassword of username with newPassword. It
+	// returns ErrPasswordChangeNotSupported if this is not possible for the
+	// user.
+	ChangePassword(username string, oldPassword []byte,
+		newPassword []byte) error
+}
+
+// PasswordAuthenticateWithStatus authenticates a user with authenticator.
+// The password state is only returned if authenticator implements
+// StatusAuthenticator.
+func PasswordAuthenticateWithStatus(authenticator PasswordAuthenticator,
+	username string, password []byte) (bool, PasswordStatus, error) {
+	return passwordAuthenticateWithStatus(authenticator, username, password)
+}
+
+// ChangePassword changes the password of a user with authenticator. It
+// returns ErrPasswordChangeNotSupported unless authenticator implements
+// PasswordChanger.
+func ChangePassword(authenticator PasswordAuthenticator, username string,
+	oldPassword []byte, newPassword []byte) error {
+	return changePassword(authenticator, username, oldPassword, newPassword)
+}
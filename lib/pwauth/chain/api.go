@@ -0,0 +1,80 @@
+package chain
+
+import (
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"github.com/Cloud-Foundations/keymaster/lib/pwauth"
+	"github.com/Cloud-Foundations/keymaster/lib/simplestorage"
+)
+
+// Backend is one member of a chain.
+type Backend struct {
+	Name          string
+	Authenticator pwauth.PasswordAuthenticator
+	Timeout       time.Duration // Zero means no timeout.
+}
+
+type PasswordAuthenticator struct {
+	backends []Backend
+	logger   log.DebugLogger
+}
+
+// New creates a new PasswordAuthenticator which tries each of backends in
+// order. Log messages are written to logger.
+func New(backends []Backend, logger log.DebugLogger) (
+	*PasswordAuthenticator, error) {
+	return newAuthenticator(backends, logger)
+}
+
+// PasswordAuthenticate will authenticate a user using the provided username and
+// password. It is equivalent to PasswordAuthenticateWithBackend without the
+// backend name.
+func (pa *PasswordAuthenticator) PasswordAuthenticate(username string,
+	password []byte) (bool, error) {
+	_, valid, _, err := pa.passwordAuthenticate(username, password)
+	return valid, err
+}
+
+// PasswordAuthenticateWithStatus is like PasswordAuthenticate, but also
+// returns the password state reported by the backend which accepted the
+// credentials. A backend which reports that the password must be changed
+// ends the search.
+func (pa *PasswordAuthenticator) PasswordAuthenticateWithStatus(
+	username string, password []byte) (bool, pwauth.PasswordStatus, error) {
+	_, valid, status, err := pa.passwordAuthenticate(username, password)
+	return valid, status, err
+}
+
+// PasswordAuthenticateWithBackend will authenticate a user using the provided
+// username and password. Backends are tried in order and the first one to
+// accept the credentials ends the search. A backend which fails or times out
+// is skipped. It returns the name of the backend which accepted the
+// credentials, whether the user is authenticated and an error. The error is
+// only non-nil if no backend accepted or cleanly rejected the credentials.
+func (pa *PasswordAuthenticator) PasswordAuthenticateWithBackend(
+	username string, password []byte) (string, bool, error) {
+	backend, valid, _, err := pa.passwordAuthenticate(username, password)
+	return backend, valid, err
+}
+
+// PasswordAuthenticateWithBackendAndStatus is like
+// PasswordAuthenticateWithBackend, but also returns the password state as
+// PasswordAuthenticateWithStatus does.
+func (pa *PasswordAuthenticator) PasswordAuthenticateWithBackendAndStatus(
+	username string, password []byte) (
+	string, bool, pwauth.PasswordStatus, error) {
+	return pa.passwordAuthenticate(username, password)
+}
+
+// ChangePassword changes the password with the first backend which can
+// change passwords for username.
+func (pa *PasswordAuthenticator) ChangePassword(username string,
+	oldPassword []byte, newPassword []byte) error {
+	return pa.changePassword(username, oldPassword, newPassword)
+}
+
+// UpdateStorage passes storage to all backends.
+func (pa *PasswordAuthenticator) UpdateStorage(storage simplestorage.SimpleStore) error {
+	return pa.updateStorage(storage)
+}
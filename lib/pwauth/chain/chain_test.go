@@ -0,0 +1,170 @@
+package chain
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log/testlogger"
+	"github.com/Cloud-Foundations/keymaster/lib/pwauth"
+	"github.com/Cloud-Foundations/keymaster/lib/simplestorage"
+)
+
+type testAuthenticator struct {
+	valid bool
+	err   error
+	delay time.Duration
+	calls int
+}
+
+func (ta *testAuthenticator) PasswordAuthenticate(username string,
+	password []byte) (bool, error) {
+	ta.calls++
+	time.Sleep(ta.delay)
+	return ta.valid, ta.err
+}
+
+func (ta *testAuthenticator) UpdateStorage(storage simplestorage.SimpleStore) error {
+	return nil
+}
+
+func TestFirstSuccessShortCircuits(t *testing.T) {
+	first := &testAuthenticator{valid: false}
+	second := &testAuthenticator{valid: true}
+	third := &testAuthenticator{valid: true}
+	pa, err := New([]Backend{
+		{Name: "ldap", Authenticator: first},
+		{Name: "okta", Authenticator: second},
+		{Name: "htpasswd", Authenticator: third},
+	}, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend, valid, err := pa.PasswordAuthenticateWithBackend("u", []byte("p"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !valid || backend != "okta" {
+		t.Fatalf("expected success from okta, got %v from %q", valid, backend)
+	}
+	if third.calls != 0 {
+		t.Fatal("backend after the successful one was tried")
+	}
+}
+
+func TestFailingBackendIsSkipped(t *testing.T) {
+	pa, err := New([]Backend{
+		{Name: "ldap", Authenticator: &testAuthenticator{
+			err: errors.New("connection refused")}},
+		{Name: "slow", Timeout: 10 * time.Millisecond,
+			Authenticator: &testAuthenticator{valid: true,
+				delay: time.Second}},
+		{Name: "htpasswd", Authenticator: &testAuthenticator{valid: true}},
+	}, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend, valid, err := pa.PasswordAuthenticateWithBackend("u", []byte("p"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !valid || backend != "htpasswd" {
+		t.Fatalf("expected success from htpasswd, got %v from %q",
+			valid, backend)
+	}
+}
+
+func TestRejectionAndErrors(t *testing.T) {
+	pa, err := New([]Backend{
+		{Name: "ldap", Authenticator: &testAuthenticator{
+			err: errors.New("connection refused")}},
+		{Name: "htpasswd", Authenticator: &testAuthenticator{valid: false}},
+	}, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valid, err := pa.PasswordAuthenticate("u", []byte("p")); err != nil {
+		t.Fatalf("clean rejection should not be an error: %s", err)
+	} else if valid {
+		t.Fatal("rejected credentials accepted")
+	}
+	pa, err = New([]Backend{
+		{Name: "ldap", Authenticator: &testAuthenticator{
+			err: errors.New("connection refused")}},
+	}, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pa.PasswordAuthenticate("u", []byte("p")); err == nil {
+		t.Fatal("expected error when every backend fails")
+	}
+}
+
+func TestNewRejectsDuplicates(t *testing.T) {
+	_, err := New([]Backend{
+		{Name: "ldap", Authenticator: &testAuthenticator{}},
+		{Name: "ldap", Authenticator: &testAuthenticator{}},
+	}, testlogger.New(t))
+	if err == nil {
+		t.Fatal("duplicate backend accepted")
+	}
+}
+
+type testStatusAuthenticator struct {
+	testAuthenticator
+	status  pwauth.PasswordStatus
+	changed bool
+}
+
+func (ta *testStatusAuthenticator) PasswordAuthenticateWithStatus(
+	username string, password []byte) (bool, pwauth.PasswordStatus, error) {
+	valid, err := ta.PasswordAuthenticate(username, password)
+	return valid, ta.status, err
+}
+
+func (ta *testStatusAuthenticator) ChangePassword(username string,
+	oldPassword []byte, newPassword []byte) error {
+	ta.changed = true
+	return nil
+}
+
+func TestPasswordStatus(t *testing.T) {
+	expired := &testStatusAuthenticator{
+		status: pwauth.PasswordStatus{MustChange: true}}
+	other := &testAuthenticator{valid: true}
+	pa, err := New([]Backend{
+		{Name: "okta", Authenticator: &testAuthenticator{}},
+		{Name: "ldap", Authenticator: expired},
+		{Name: "htpasswd", Authenticator: other},
+	}, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend, valid, status, err := pa.PasswordAuthenticateWithBackendAndStatus(
+		"u", []byte("p"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valid || !status.MustChange || backend != "ldap" {
+		t.Fatalf("expected must change from ldap, got %v %+v from %q", valid,
+			status, backend)
+	}
+	if other.calls != 0 {
+		t.Fatal("backend after the one requiring a change was tried")
+	}
+	if err := pa.ChangePassword("u", []byte("p"), []byte("n")); err != nil {
+		t.Fatal(err)
+	}
+	if !expired.changed {
+		t.Fatal("password not changed by the backend supporting it")
+	}
+	pa, err = New([]Backend{{Name: "okta", Authenticator: other}},
+		testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pa.ChangePassword("u", []byte("p"), []byte("n"))
+	if err != pwauth.ErrPasswordChangeNotSupported {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+package chain
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"github.com/Cloud-Foundations/keymaster/lib/pwauth"
+	"github.com/Cloud-Foundations/keymaster/lib/simplestorage"
+)
+
+type authResult struct {
+	valid  bool
+	status pwauth.PasswordStatus
+	err    error
+}
+
+func newAuthenticator(backends []Backend, logger log.DebugLogger) (
+	*PasswordAuthenticator, error) {
+	if len(backends) < 1 {
+		return nil, errors.New("no password backends")
+	}
+	names := make(map[string]struct{}, len(backends))
+	for _, backend := range backends {
+		if backend.Authenticator == nil {
+			return nil, fmt.Errorf("password backend %s has no authenticator",
+				backend.Name)
+		}
+		if _, ok := names[backend.Name]; ok {
+			return nil, fmt.Errorf("duplicate password backend %s",
+				backend.Name)
+		}
+		names[backend.Name] = struct{}{}
+	}
+	return &PasswordAuthenticator{backends: backends, logger: logger}, nil
+}
+
+func authenticateWithTimeout(backend Backend, username string,
+	password []byte) (bool, pwauth.PasswordStatus, error) {
+	if backend.Timeout <= 0 {
+		return pwauth.PasswordAuthenticateWithStatus(backend.Authenticator,
+			username, password)
+	}
+	resultChannel := make(chan authResult, 1)
+	go func() {
+		valid, status, err := pwauth.PasswordAuthenticateWithStatus(
+			backend.Authenticator, username, password)
+		resultChannel <- authResult{valid, status, err}
+	}()
+	timer := time.NewTimer(backend.Timeout)
+	defer timer.Stop()
+	select {
+	case result := <-resultChannel:
+		return result.valid, result.status, result.err
+	case <-timer.C:
+		return false, pwauth.PasswordStatus{},
+			fmt.Errorf("timed out after %s", backend.Timeout)
+	}
+}
+
+func (pa *PasswordAuthenticator) passwordAuthenticate(username string,
+	password []byte) (string, bool, pwauth.PasswordStatus, error) {
+	rejected := false
+	var lastErr error
+	for _, backend := range pa.backends {
+		valid, status, err := authenticateWithTimeout(backend, username,
+			password)
+		if err != nil {
+			pa.logger.Printf("password backend %s failed for %s: %s",
+				backend.Name, username, err)
+			lastErr = fmt.Errorf("%s: %s", backend.Name, err)
+			continue
+		}
+		if valid {
+			pa.logger.Debugf(1, "password backend %s accepted %s",
+				backend.Name, username)
+			return backend.Name, true, status, nil
+		}
+		if status.MustChange {
+			// The password is right, but the user has to change it first.
+			pa.logger.Debugf(1, "password backend %s requires %s to change the password",
+				backend.Name, username)
+			return backend.Name, false, status, nil
+		}
+		pa.logger.Debugf(1, "password backend %s rejected %s",
+			backend.Name, username)
+		rejected = true
+	}
+	if rejected {
+		return "", false, pwauth.PasswordStatus{}, nil
+	}
+	return "", false, pwauth.PasswordStatus{}, lastErr
+}
+
+func (pa *PasswordAuthenticator) changePassword(username string,
+	oldPassword []byte, newPassword []byte) error {
+	for _, backend := range pa.backends {
+		err := pwauth.ChangePassword(backend.Authenticator, username,
+			oldPassword, newPassword)
+		if err == pwauth.ErrPasswordChangeNotSupported {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", backend.Name, err)
+		}
+		return nil
+	}
+	return pwauth.ErrPasswordChangeNotSupported
+}
+
+func (pa *PasswordAuthenticator) updateStorage(
+	storage simplestorage.SimpleStore) error {
+	for _, backend := range pa.backends {
+		if err := backend.Authenticator.UpdateStorage(storage); err != nil {
+			return fmt.Errorf("%s: %s", backend.Name, err)
+		}
+	}
+	return nil
+}
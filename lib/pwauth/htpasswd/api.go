@@ -0,0 +1,34 @@
+package htpasswd
+
+import (
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"github.com/Cloud-Foundations/keymaster/lib/simplestorage"
+)
+
+type PasswordAuthenticator struct {
+	filename string
+	logger   log.DebugLogger
+	file     *htpasswdFile
+}
+
+// New creates a new PasswordAuthenticator which checks passwords against the
+// Apache htpasswd file filename. Entries may be bcrypt, argon2id or scrypt
+// hashes. The file is reloaded when it changes, so that password changes take
+// effect without a restart.
+func New(filename string, logger log.DebugLogger) (
+	*PasswordAuthenticator, error) {
+	return newAuthenticator(filename, logger)
+}
+
+// PasswordAuthenticate will authenticate a user using the provided username and
+// password.
+// It returns true if the user is authenticated, else false (due to either
+// invalid username or incorrect password), and an error.
+func (pa *PasswordAuthenticator) PasswordAuthenticate(username string,
+	password []byte) (bool, error) {
+	return pa.passwordAuthenticate(username, password)
+}
+
+func (pa *PasswordAuthenticator) UpdateStorage(storage simplestorage.SimpleStore) error {
+	return nil
+}
@@ -0,0 +1,137 @@
+package htpasswd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"github.com/Cloud-Foundations/keymaster/lib/authutil"
+	"github.com/fsnotify/fsnotify"
+)
+
+// htpasswdFile holds the contents of an htpasswd file, reloaded whenever the
+// file changes.
+type htpasswdFile struct {
+	filename string
+	logger   log.DebugLogger
+	mutex    sync.RWMutex
+	contents []byte
+	watching bool // If false, the file is read on every authentication.
+}
+
+var (
+	filesMutex sync.Mutex
+	// Files are watched once per process, so that configuration reloads do
+	// not add watchers.
+	files = make(map[string]*htpasswdFile)
+)
+
+func newAuthenticator(filename string, logger log.DebugLogger) (
+	*PasswordAuthenticator, error) {
+	file, err := getFile(filename, logger)
+	if err != nil {
+		return nil, err
+	}
+	return &PasswordAuthenticator{filename: filename, logger: logger,
+		file: file}, nil
+}
+
+func getFile(filename string, logger log.DebugLogger) (*htpasswdFile, error) {
+	filename, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+	filesMutex.Lock()
+	defer filesMutex.Unlock()
+	if file, ok := files[filename]; ok {
+		return file, nil
+	}
+	if _, err := os.Stat(filename); err != nil {
+		return nil, err
+	}
+	file := &htpasswdFile{filename: filename, logger: logger}
+	if err := file.watch(); err != nil {
+		logger.Printf("cannot watch %s, reading it for every login: %s",
+			filename, err)
+	}
+	files[filename] = file
+	return file, nil
+}
+
+// watch loads the file and starts reloading it on changes. The directory is
+// watched so that files replaced by a rename are picked up.
+func (f *htpasswdFile) watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(f.filename)); err != nil {
+		watcher.Close()
+		return err
+	}
+	if err := f.load(); err != nil {
+		watcher.Close()
+		return err
+	}
+	f.watching = true
+	go f.watchLoop(watcher)
+	return nil
+}
+
+func (f *htpasswdFile) watchLoop(watcher *fsnotify.Watcher) {
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) != f.filename ||
+				event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+			if err := f.load(); err != nil {
+				f.logger.Printf("error reloading %s, keeping old contents: %s",
+					f.filename, err)
+				continue
+			}
+			f.logger.Debugf(0, "reloaded %s\n", f.filename)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			f.logger.Printf("error watching %s: %s", f.filename, err)
+		}
+	}
+}
+
+func (f *htpasswdFile) load() error {
+	contents, err := ioutil.ReadFile(f.filename)
+	if err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.contents = contents
+	return nil
+}
+
+func (f *htpasswdFile) getContents() ([]byte, error) {
+	if !f.watching {
+		return ioutil.ReadFile(f.filename)
+	}
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return f.contents, nil
+}
+
+func (pa *PasswordAuthenticator) passwordAuthenticate(username string,
+	password []byte) (bool, error) {
+	buffer, err := pa.file.getContents()
+	if err != nil {
+		return false, err
+	}
+	return authutil.CheckHtpasswdUserPassword(username, string(password),
+		buffer)
+}
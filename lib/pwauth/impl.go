@@ -0,0 +1,20 @@
+package pwauth
+
+func passwordAuthenticateWithStatus(authenticator PasswordAuthenticator,
+	username string, password []byte) (bool, PasswordStatus, error) {
+	if statusAuthenticator, ok := authenticator.(StatusAuthenticator); ok {
+		return statusAuthenticator.PasswordAuthenticateWithStatus(username,
+			password)
+	}
+	valid, err := authenticator.PasswordAuthenticate(username, password)
+	return valid, PasswordStatus{}, err
+}
+
+func changePassword(authenticator PasswordAuthenticator, username string,
+	oldPassword []byte, newPassword []byte) error {
+	changer, ok := authenticator.(PasswordChanger)
+	if !ok {
+		return ErrPasswordChangeNotSupported
+	}
+	return changer.ChangePassword(username, oldPassword, newPassword)
+}
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"github.com/Cloud-Foundations/keymaster/lib/pwauth"
 	"github.com/Cloud-Foundations/keymaster/lib/simplestorage"
 )
 
@@ -23,11 +24,23 @@ type PasswordAuthenticator struct {
 	expirationDuration time.Duration
 	storage            simplestorage.SimpleStore
 	cachedCredentials  map[string]cacheCredentialEntry
+	changeAccountDN    string
+	changeAccountPwd   string
 }
 
 func New(url []string, bindPattern []string, timeoutSecs uint, rootCAs *x509.CertPool, storage simplestorage.SimpleStore, logger log.DebugLogger) (
 	*PasswordAuthenticator, error) {
-	return newAuthenticator(url, bindPattern, timeoutSecs, rootCAs, storage, logger)
+	return newAuthenticator(url, bindPattern, timeoutSecs, rootCAs, false,
+		storage, logger)
+}
+
+// NewWithStartTLS is like New but also accepts ldap:// URLs. Connections to
+// them are upgraded with StartTLS and fail if the server refuses the upgrade.
+func NewWithStartTLS(url []string, bindPattern []string, timeoutSecs uint,
+	rootCAs *x509.CertPool, storage simplestorage.SimpleStore,
+	logger log.DebugLogger) (*PasswordAuthenticator, error) {
+	return newAuthenticator(url, bindPattern, timeoutSecs, rootCAs, true,
+		storage, logger)
 }
 
 func (pa *PasswordAuthenticator) UpdateStorage(storage simplestorage.SimpleStore) error {
@@ -44,3 +57,29 @@ func (pa *PasswordAuthenticator) PasswordAuthenticate(username string,
 	password []byte) (bool, error) {
 	return pa.passwordAuthenticate(username, password)
 }
+
+// PasswordAuthenticateWithStatus is like PasswordAuthenticate, but also
+// returns the expiry of the password reported by the LDAP server. Passwords
+// which have expired or must be changed after a reset are rejected with
+// MustChange set.
+func (pa *PasswordAuthenticator) PasswordAuthenticateWithStatus(
+	username string, password []byte) (bool, pwauth.PasswordStatus, error) {
+	return pa.passwordAuthenticateWithStatus(username, password)
+}
+
+// SetPasswordChangeAccount sets the account which ChangePassword binds as
+// to change expired Active Directory passwords, which users cannot bind
+// with.
+func (pa *PasswordAuthenticator) SetPasswordChangeAccount(bindDN string,
+	password string) {
+	pa.changeAccountDN = bindDN
+	pa.changeAccountPwd = password
+}
+
+// ChangePassword binds as username with oldPassword and replaces it with
+// newPassword. See SetPasswordChangeAccount for expired Active Directory
+// passwords.
+func (pa *PasswordAuthenticator) ChangePassword(username string,
+	oldPassword []byte, newPassword []byte) error {
+	return pa.changePassword(username, oldPassword, newPassword)
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/Cloud-Foundations/Dominator/lib/log"
 	"github.com/Cloud-Foundations/keymaster/lib/authutil"
+	"github.com/Cloud-Foundations/keymaster/lib/pwauth"
 	"github.com/Cloud-Foundations/keymaster/lib/simplestorage"
 )
 
@@ -16,12 +17,12 @@ const passwordDataType = 1
 const browserResponseTimeoutSeconds = 7
 
 func newAuthenticator(urllist []string, bindPattern []string,
-	timeoutSecs uint, rootCAs *x509.CertPool,
+	timeoutSecs uint, rootCAs *x509.CertPool, allowStartTLS bool,
 	storage simplestorage.SimpleStore, logger log.DebugLogger) (
 	*PasswordAuthenticator, error) {
 	var authenticator PasswordAuthenticator
 	for _, stringURL := range urllist {
-		url, err := authutil.ParseLDAPURL(stringURL)
+		url, err := authutil.ParseLDAPURLWithStartTLS(stringURL, allowStartTLS)
 		if err != nil {
 			return nil, err
 		}
@@ -80,23 +81,37 @@ func (pa *PasswordAuthenticator) updateOrDeletePasswordHash(valid bool, username
 }
 
 func (pa *PasswordAuthenticator) passwordAuthenticate(username string,
-	password []byte) (valid bool, err error) {
-	valid = false
+	password []byte) (bool, error) {
+	valid, _, err := pa.passwordAuthenticateWithStatus(username, password)
+	return valid, err
+}
+
+func (pa *PasswordAuthenticator) passwordAuthenticateWithStatus(
+	username string, password []byte) (bool, pwauth.PasswordStatus, error) {
 	for _, u := range pa.ldapURL {
 		for _, bindPattern := range pa.bindPattern {
 			bindDN := convertToBindDN(username, bindPattern)
-			valid, err = authutil.CheckLDAPUserPassword(*u, bindDN, string(password), pa.timeoutSecs, pa.rootCAs)
+			valid, ldapStatus, err := authutil.CheckLDAPUserPasswordWithStatus(
+				*u, bindDN, string(password), pa.timeoutSecs, pa.rootCAs)
 			if err != nil {
 				if pa.logger != nil {
 					pa.logger.Debugf(1, "Error checking LDAP user password url= %s", u)
 				}
 				continue
 			}
+			status := pwauth.PasswordStatus{
+				MustChange: ldapStatus.MustChange,
+				ExpiresIn:  ldapStatus.ExpiresIn,
+			}
+			if status.MustChange {
+				// The cached hash must not outlive the password.
+				valid = false
+			}
 			err = pa.updateOrDeletePasswordHash(valid, username, password)
 			if err != nil && pa.logger != nil {
 				pa.logger.Debugf(0, "Updating local password hash for user %s", username)
 			}
-			return valid, nil
+			return valid, status, nil
 
 		}
 	}
@@ -106,16 +121,49 @@ func (pa *PasswordAuthenticator) passwordAuthenticate(username string,
 		}
 		ok, hash, err := pa.storage.GetSigned(username, passwordDataType)
 		if err != nil {
-			return false, nil
+			return false, pwauth.PasswordStatus{}, nil
 		}
 		if ok {
 			err = authutil.Argon2CompareHashAndPassword(hash, password)
 			if err == nil {
-				return true, nil
+				return true, pwauth.PasswordStatus{}, nil
 			}
 		}
 
 	}
 
-	return false, nil
+	return false, pwauth.PasswordStatus{}, nil
+}
+
+func (pa *PasswordAuthenticator) changePassword(username string,
+	oldPassword []byte, newPassword []byte) error {
+	var lastErr error
+	for _, u := range pa.ldapURL {
+		for _, bindPattern := range pa.bindPattern {
+			bindDN := convertToBindDN(username, bindPattern)
+			err := authutil.ChangeLDAPUserPasswordWithAccount(*u, bindDN,
+				string(oldPassword), string(newPassword), pa.changeAccountDN,
+				pa.changeAccountPwd, pa.timeoutSecs, pa.rootCAs)
+			if err != nil {
+				if pa.logger != nil {
+					pa.logger.Debugf(1,
+						"Error changing LDAP user password url= %s: %s", u, err)
+				}
+				lastErr = err
+				continue
+			}
+			if pa.storage != nil {
+				err = pa.updateOrDeletePasswordHash(true, username,
+					newPassword)
+				if err != nil && pa.logger != nil {
+					pa.logger.Debugf(0, "Updating local password hash for user %s", username)
+				}
+			}
+			return nil
+		}
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no LDAP servers")
+	}
+	return lastErr
 }
@@ -200,7 +200,7 @@ func TestPasswordAuthetnicateSimple(t *testing.T) {
 	if !ok {
 		t.Fatal("cannot add certs to certpool")
 	}
-	authn, err := newAuthenticator([]string{localLDAPSURL}, []string{"%s"}, 0, certPool, nil, nil)
+	authn, err := newAuthenticator([]string{localLDAPSURL}, []string{"%s"}, 0, certPool, false, nil, nil)
 	//ok, err := CheckHtpasswdUserPassword("username", "password", []byte(userdbContent))
 	if err != nil {
 		t.Fatal(err)
@@ -236,7 +236,7 @@ func TestPasswordAuthetnicateCache(t *testing.T) {
 		t.Fatal("cannot add certs to certpool")
 	}
 	cache := memstore.New()
-	authn, err := newAuthenticator([]string{localLDAPSURL}, []string{"%s"}, 1, certPool, cache, nil)
+	authn, err := newAuthenticator([]string{localLDAPSURL}, []string{"%s"}, 1, certPool, false, cache, nil)
 	//ok, err := CheckHtpasswdUserPassword("username", "password", []byte(userdbContent))
 	if err != nil {
 		t.Fatal(err)
@@ -0,0 +1,120 @@
+package localusers
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"github.com/Cloud-Foundations/keymaster/lib/simplestorage"
+)
+
+var (
+	// ErrUserExists is returned by CreateUser if the user exists.
+	ErrUserExists = errors.New("user exists")
+	// ErrUnknownUser is returned if the user does not exist.
+	ErrUnknownUser = errors.New("unknown user")
+	// ErrNoStorage is returned if no storage was set.
+	ErrNoStorage = errors.New("no storage for local users")
+)
+
+// User is a user of the local user database.
+type User struct {
+	Username     string
+	PasswordHash string `json:",omitempty"`
+	Disabled     bool   `json:",omitempty"`
+	Groups       []string
+	CreatedBy    string
+	CreatedAt    time.Time
+	UpdatedBy    string
+	UpdatedAt    time.Time
+}
+
+// PasswordAuthenticator checks passwords against users kept in a
+// simplestorage.SimpleStore and manages these users. Passwords are stored as
+// argon2id hashes.
+type PasswordAuthenticator struct {
+	logger       log.DebugLogger
+	storageMutex sync.Mutex // Protects storage.
+	storage      simplestorage.SimpleStore
+	updateMutex  sync.Mutex // Serialises changes of users.
+}
+
+// New creates a PasswordAuthenticator for the users in storage.
+func New(storage simplestorage.SimpleStore, logger log.DebugLogger) (
+	*PasswordAuthenticator, error) {
+	return &PasswordAuthenticator{storage: storage, logger: logger}, nil
+}
+
+// PasswordAuthenticate will authenticate a user using the provided username
+// and password. Disabled users are not authenticated.
+func (pa *PasswordAuthenticator) PasswordAuthenticate(username string,
+	password []byte) (bool, error) {
+	return pa.passwordAuthenticate(username, password)
+}
+
+func (pa *PasswordAuthenticator) UpdateStorage(
+	storage simplestorage.SimpleStore) error {
+	pa.storageMutex.Lock()
+	defer pa.storageMutex.Unlock()
+	pa.storage = storage
+	return nil
+}
+
+// ChangePassword replaces oldPassword of username with newPassword. It
+// returns pwauth.ErrPasswordChangeNotSupported for unknown users.
+func (pa *PasswordAuthenticator) ChangePassword(username string,
+	oldPassword []byte, newPassword []byte) error {
+	return pa.changePassword(username, oldPassword, newPassword)
+}
+
+// CreateUser adds username with password and groups on behalf of admin. It
+// returns ErrUserExists if the user exists.
+func (pa *PasswordAuthenticator) CreateUser(username string, password []byte,
+	groups []string, admin string) (*User, error) {
+	return pa.createUser(username, password, groups, admin)
+}
+
+// DeleteUser removes username.
+func (pa *PasswordAuthenticator) DeleteUser(username string) error {
+	return pa.deleteUser(username)
+}
+
+// GetUser returns username. The bool is false if the user does not exist.
+func (pa *PasswordAuthenticator) GetUser(username string) (*User, bool,
+	error) {
+	return pa.getUser(username)
+}
+
+// GetUserGroups returns the groups of username. The bool is false if the
+// user does not exist.
+func (pa *PasswordAuthenticator) GetUserGroups(username string) (bool,
+	[]string, error) {
+	return pa.getUserGroups(username)
+}
+
+// SetDisabled disables or enables username on behalf of admin.
+func (pa *PasswordAuthenticator) SetDisabled(username string, disabled bool,
+	admin string) (*User, error) {
+	return pa.updateUser(username, admin, func(user *User) error {
+		user.Disabled = disabled
+		return nil
+	})
+}
+
+// SetGroups replaces the groups of username on behalf of admin.
+func (pa *PasswordAuthenticator) SetGroups(username string, groups []string,
+	admin string) (*User, error) {
+	return pa.updateUser(username, admin, func(user *User) error {
+		user.Groups = normaliseGroups(groups)
+		return nil
+	})
+}
+
+// SetPassword replaces the password of username on behalf of admin.
+func (pa *PasswordAuthenticator) SetPassword(username string, password []byte,
+	admin string) (*User, error) {
+	return pa.updateUser(username, admin, func(user *User) error {
+		return user.setPassword(password)
+	})
+}
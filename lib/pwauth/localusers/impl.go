@@ -0,0 +1,205 @@
+package localusers
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/authutil"
+	"github.com/Cloud-Foundations/keymaster/lib/pwauth"
+	"github.com/Cloud-Foundations/keymaster/lib/simplestorage"
+)
+
+// userDataType must differ from the data types of the other users of the
+// storage (1 for the LDAP password cache, 2 for the Okta cache).
+const userDataType = 3
+
+// Users do not expire, the expiration the storage requires is just far out.
+const userLifetimeYears = 100
+
+var errEmptyPassword = errors.New("empty password")
+
+func normaliseGroups(groups []string) []string {
+	var result []string
+	seen := make(map[string]struct{}, len(groups))
+	for _, group := range groups {
+		if _, ok := seen[group]; ok || group == "" {
+			continue
+		}
+		seen[group] = struct{}{}
+		result = append(result, group)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func (user *User) setPassword(password []byte) error {
+	if len(password) < 1 {
+		return errEmptyPassword
+	}
+	hash, err := authutil.Argon2idMakeNewHash(password)
+	if err != nil {
+		return err
+	}
+	user.PasswordHash = hash
+	return nil
+}
+
+func (pa *PasswordAuthenticator) getStorage() (simplestorage.SimpleStore,
+	error) {
+	pa.storageMutex.Lock()
+	defer pa.storageMutex.Unlock()
+	if pa.storage == nil {
+		return nil, ErrNoStorage
+	}
+	return pa.storage, nil
+}
+
+func (pa *PasswordAuthenticator) getUser(username string) (*User, bool,
+	error) {
+	storage, err := pa.getStorage()
+	if err != nil {
+		return nil, false, err
+	}
+	ok, data, err := storage.GetSigned(username, userDataType)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	var user User
+	if err := json.Unmarshal([]byte(data), &user); err != nil {
+		return nil, false, err
+	}
+	if user.Username != username {
+		return nil, false, errors.New("inconsistent local user data")
+	}
+	return &user, true, nil
+}
+
+func (pa *PasswordAuthenticator) saveUser(user *User) error {
+	storage, err := pa.getStorage()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	expiration := time.Now().AddDate(userLifetimeYears, 0, 0)
+	return storage.UpsertSigned(user.Username, userDataType,
+		expiration.Unix(), string(data))
+}
+
+func (pa *PasswordAuthenticator) passwordAuthenticate(username string,
+	password []byte) (bool, error) {
+	user, ok, err := pa.getUser(username)
+	if err != nil || !ok {
+		return false, err
+	}
+	if user.Disabled {
+		if pa.logger != nil {
+			pa.logger.Debugf(1, "local user %s is disabled\n", username)
+		}
+		return false, nil
+	}
+	return authutil.CheckPasswordHash(user.PasswordHash, password)
+}
+
+func (pa *PasswordAuthenticator) changePassword(username string,
+	oldPassword []byte, newPassword []byte) error {
+	// Other backends may know users which are not local.
+	if _, ok, err := pa.getUser(username); err != nil {
+		return err
+	} else if !ok {
+		return pwauth.ErrPasswordChangeNotSupported
+	}
+	valid, err := pa.passwordAuthenticate(username, oldPassword)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		return errors.New("invalid password")
+	}
+	_, err = pa.updateUser(username, username, func(user *User) error {
+		return user.setPassword(newPassword)
+	})
+	return err
+}
+
+func (pa *PasswordAuthenticator) createUser(username string, password []byte,
+	groups []string, admin string) (*User, error) {
+	if username == "" {
+		return nil, errors.New("empty username")
+	}
+	now := time.Now()
+	user := &User{
+		Username:  username,
+		Groups:    normaliseGroups(groups),
+		CreatedBy: admin,
+		CreatedAt: now,
+		UpdatedBy: admin,
+		UpdatedAt: now,
+	}
+	if err := user.setPassword(password); err != nil {
+		return nil, err
+	}
+	pa.updateMutex.Lock()
+	defer pa.updateMutex.Unlock()
+	if _, ok, err := pa.getUser(username); err != nil {
+		return nil, err
+	} else if ok {
+		return nil, ErrUserExists
+	}
+	if err := pa.saveUser(user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (pa *PasswordAuthenticator) deleteUser(username string) error {
+	pa.updateMutex.Lock()
+	defer pa.updateMutex.Unlock()
+	if _, ok, err := pa.getUser(username); err != nil {
+		return err
+	} else if !ok {
+		return ErrUnknownUser
+	}
+	storage, err := pa.getStorage()
+	if err != nil {
+		return err
+	}
+	return storage.DeleteSigned(username, userDataType)
+}
+
+func (pa *PasswordAuthenticator) getUserGroups(username string) (bool,
+	[]string, error) {
+	user, ok, err := pa.getUser(username)
+	if err != nil || !ok {
+		return false, nil, err
+	}
+	return true, user.Groups, nil
+}
+
+// updateUser applies update to username and saves it. Updates in this
+// process are serialised.
+func (pa *PasswordAuthenticator) updateUser(username string, admin string,
+	update func(user *User) error) (*User, error) {
+	pa.updateMutex.Lock()
+	defer pa.updateMutex.Unlock()
+	user, ok, err := pa.getUser(username)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrUnknownUser
+	}
+	if err := update(user); err != nil {
+		return nil, err
+	}
+	user.UpdatedBy = admin
+	user.UpdatedAt = time.Now()
+	if err := pa.saveUser(user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
@@ -0,0 +1,88 @@
+package localusers
+
+import (
+	"testing"
+
+	"github.com/Cloud-Foundations/keymaster/lib/pwauth"
+	"github.com/Cloud-Foundations/keymaster/lib/simplestorage/memstore"
+)
+
+func checkPassword(t *testing.T, pa *PasswordAuthenticator, username string,
+	password string, expected bool) {
+	valid, err := pa.PasswordAuthenticate(username, []byte(password))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valid != expected {
+		t.Fatalf("password %q of %s valid: %v, expected %v", password,
+			username, valid, expected)
+	}
+}
+
+func TestLocalUsers(t *testing.T) {
+	pa, err := New(memstore.New(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPassword(t, pa, "alice", "password", false)
+	user, err := pa.CreateUser("alice", []byte("password"),
+		[]string{"ops", "dev", "ops"}, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(user.Groups) != 2 || user.Groups[0] != "dev" {
+		t.Fatalf("unexpected groups: %v", user.Groups)
+	}
+	_, err = pa.CreateUser("alice", []byte("other"), nil, "admin")
+	if err != ErrUserExists {
+		t.Fatalf("unexpected error creating user twice: %v", err)
+	}
+	checkPassword(t, pa, "alice", "password", true)
+	checkPassword(t, pa, "alice", "wrong", false)
+	if _, err := pa.SetPassword("alice", []byte("new"), "admin"); err != nil {
+		t.Fatal(err)
+	}
+	checkPassword(t, pa, "alice", "password", false)
+	checkPassword(t, pa, "alice", "new", true)
+	if err := pa.ChangePassword("alice", []byte("wrong"),
+		[]byte("newer")); err == nil {
+		t.Fatal("password changed with wrong old password")
+	}
+	if err := pa.ChangePassword("alice", []byte("new"),
+		[]byte("newer")); err != nil {
+		t.Fatal(err)
+	}
+	checkPassword(t, pa, "alice", "newer", true)
+	err = pa.ChangePassword("bob", []byte("old"), []byte("new"))
+	if err != pwauth.ErrPasswordChangeNotSupported {
+		t.Fatalf("unexpected error changing password of unknown user: %v",
+			err)
+	}
+	if _, err := pa.SetDisabled("alice", true, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	checkPassword(t, pa, "alice", "newer", false)
+	if _, err := pa.SetDisabled("alice", false, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	checkPassword(t, pa, "alice", "newer", true)
+	if _, err := pa.SetGroups("alice", []string{"sre"}, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	ok, groups, err := pa.GetUserGroups("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || len(groups) != 1 || groups[0] != "sre" {
+		t.Fatalf("unexpected groups: %v", groups)
+	}
+	if _, err := pa.SetGroups("bob", nil, "admin"); err != ErrUnknownUser {
+		t.Fatalf("unexpected error updating unknown user: %v", err)
+	}
+	if err := pa.DeleteUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _, err := pa.GetUserGroups("alice"); err != nil || ok {
+		t.Fatalf("deleted user still exists: %v", err)
+	}
+}
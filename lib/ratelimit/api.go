@@ -0,0 +1,115 @@
+// Package ratelimit locks out usernames and source addresses after repeated
+// failed password or one time password attempts. The failures of a username
+// are counted separately for each authentication factor, so that logging in
+// with a password does not forget failed one time passwords.
+package ratelimit
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Config configures a Limiter. Zero values select the defaults.
+type Config struct {
+	// A username is locked out after MaxUserFailures failures, 5 by default.
+	MaxUserFailures int `yaml:"max_user_failures"`
+	// A source address is locked out after MaxAddressFailures failures, 20
+	// by default.
+	MaxAddressFailures int `yaml:"max_address_failures"`
+	// The first lockout lasts Lockout, one minute by default. Each further
+	// failure doubles it, up to MaxLockout (one hour by default).
+	Lockout    time.Duration `yaml:"lockout"`
+	MaxLockout time.Duration `yaml:"max_lockout"`
+	// Failures are forgotten after ResetAfter without failures, one day by
+	// default.
+	ResetAfter time.Duration `yaml:"reset_after"`
+	// Source addresses in TrustedCIDRs are never locked out, such as those
+	// of NAT gateways shared by many users. Their usernames still are.
+	TrustedCIDRs []string `yaml:"trusted_cidrs"`
+}
+
+// ErrTooManyInProgress is returned by Allow if the attempts in progress
+// could lock out the username or source address once they fail.
+var ErrTooManyInProgress = errors.New("too many attempts in progress")
+
+// Lockout is returned for a username or source address which may not make
+// attempts until Until.
+type Lockout struct {
+	Username string // Empty for source address lockouts.
+	Factor   string // The factor of username lockouts.
+	Address  string // Empty for username lockouts.
+	Until    time.Time
+}
+
+func (l *Lockout) Error() string {
+	return l.error()
+}
+
+// Limiter counts failed attempts. A nil Limiter allows all attempts.
+type Limiter struct {
+	config    Config
+	trusted   []*net.IPNet
+	now       func() time.Time // Replaced in tests.
+	mutex     sync.Mutex
+	users     map[userKey]*counter
+	addresses map[string]*counter
+	lastPurge time.Time
+}
+
+type userKey struct {
+	username string
+	factor   string
+}
+
+type counter struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+	pending     int // Attempts in progress.
+}
+
+// Attempt is an attempt in progress allowed by a Limiter. It counts towards
+// the lockouts until its result is recorded or it is released. A nil
+// Attempt ignores results.
+type Attempt struct {
+	limiter  *Limiter
+	username string
+	factor   string
+	address  string
+	done     bool
+}
+
+// New creates a Limiter. An error is returned if a trusted CIDR is invalid.
+func New(config Config) (*Limiter, error) {
+	return newLimiter(config)
+}
+
+// Allow returns an Attempt if username may attempt to authenticate with
+// factor from address, otherwise a *Lockout or ErrTooManyInProgress. Either
+// of username and address may be empty. The Attempt is reserved until its
+// result is recorded or it is released, so that concurrent attempts cannot
+// exceed the failures allowed before a lockout.
+func (l *Limiter) Allow(username string, factor string,
+	address string) (*Attempt, error) {
+	return l.allow(username, factor, address)
+}
+
+// RecordFailure records that the attempt failed and returns the lockouts it
+// starts.
+func (a *Attempt) RecordFailure() []Lockout {
+	return a.recordFailure()
+}
+
+// RecordSuccess records that the attempt succeeded, which forgets the
+// failures of the username with the factor of the attempt.
+func (a *Attempt) RecordSuccess() {
+	a.recordSuccess()
+}
+
+// Release ends the attempt without a result, if none was recorded. It is
+// safe to defer after Allow.
+func (a *Attempt) Release() {
+	a.release()
+}
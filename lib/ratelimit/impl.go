@@ -0,0 +1,274 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	defaultMaxUserFailures    = 5
+	defaultMaxAddressFailures = 20
+	defaultLockout            = time.Minute
+	defaultMaxLockout         = time.Hour
+	defaultResetAfter         = 24 * time.Hour
+	purgeInterval             = time.Minute
+)
+
+func newLimiter(config Config) (*Limiter, error) {
+	if config.MaxUserFailures < 1 {
+		config.MaxUserFailures = defaultMaxUserFailures
+	}
+	if config.MaxAddressFailures < 1 {
+		config.MaxAddressFailures = defaultMaxAddressFailures
+	}
+	if config.Lockout <= 0 {
+		config.Lockout = defaultLockout
+	}
+	if config.MaxLockout <= 0 {
+		config.MaxLockout = defaultMaxLockout
+	}
+	if config.MaxLockout < config.Lockout {
+		config.MaxLockout = config.Lockout
+	}
+	if config.ResetAfter <= 0 {
+		config.ResetAfter = defaultResetAfter
+	}
+	l := &Limiter{
+		config:    config,
+		now:       time.Now,
+		users:     make(map[userKey]*counter),
+		addresses: make(map[string]*counter),
+	}
+	for _, cidr := range config.TrustedCIDRs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		l.trusted = append(l.trusted, ipNet)
+	}
+	return l, nil
+}
+
+func (l *Lockout) error() string {
+	var what string
+	if l.Username != "" {
+		what = "user " + l.Username
+		if l.Factor != "" {
+			what += " (" + l.Factor + ")"
+		}
+	} else {
+		what = "address " + l.Address
+	}
+	return fmt.Sprintf("%s locked out until %s", what,
+		l.Until.Format(time.RFC3339))
+}
+
+func (l *Limiter) isTrusted(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range l.trusted {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isStale returns true if the failures of c are forgotten at now.
+func (l *Limiter) isStale(c *counter, now time.Time) bool {
+	return now.Sub(c.lastFailure) > l.config.ResetAfter
+}
+
+// reserve returns a nil error and counts an attempt in progress for c if c
+// is neither locked out nor could be by the attempts already in progress.
+func (l *Limiter) reserve(c *counter, maxFailures int, now time.Time,
+	lockout Lockout) error {
+	if c.lockedUntil.After(now) {
+		lockout.Until = c.lockedUntil
+		return &lockout
+	}
+	failures := c.failures
+	if l.isStale(c, now) {
+		failures = 0
+	}
+	// After a lockout ends, a single attempt at a time is allowed.
+	if c.pending > 0 && failures+c.pending >= maxFailures {
+		return ErrTooManyInProgress
+	}
+	c.pending++
+	return nil
+}
+
+func (l *Limiter) allow(username string, factor string,
+	address string) (*Attempt, error) {
+	if l == nil {
+		return nil, nil
+	}
+	now := l.now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	attempt := &Attempt{limiter: l, username: username, factor: factor}
+	if address != "" && !l.isTrusted(address) {
+		attempt.address = address
+	}
+	var userCounter *counter
+	if username != "" {
+		key := userKey{username, factor}
+		userCounter = l.users[key]
+		if userCounter == nil {
+			userCounter = &counter{}
+			l.users[key] = userCounter
+		}
+		err := l.reserve(userCounter, l.config.MaxUserFailures, now,
+			Lockout{Username: username, Factor: factor})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if attempt.address != "" {
+		c := l.addresses[address]
+		if c == nil {
+			c = &counter{}
+			l.addresses[address] = c
+		}
+		err := l.reserve(c, l.config.MaxAddressFailures, now,
+			Lockout{Address: address})
+		if err != nil {
+			if userCounter != nil {
+				userCounter.pending--
+			}
+			return nil, err
+		}
+	}
+	return attempt, nil
+}
+
+// lockoutDuration returns the duration of the lockout after extra failures
+// beyond the first lockout.
+func (l *Limiter) lockoutDuration(extra int) time.Duration {
+	duration := l.config.Lockout
+	for i := 0; i < extra && duration < l.config.MaxLockout; i++ {
+		duration *= 2
+	}
+	if duration > l.config.MaxLockout {
+		duration = l.config.MaxLockout
+	}
+	return duration
+}
+
+// countFailure increments the failures of c and returns the end of the
+// lockout it starts, or the zero time.
+func (l *Limiter) countFailure(c *counter, maxFailures int,
+	now time.Time) time.Time {
+	if l.isStale(c, now) {
+		c.failures = 0
+	}
+	c.failures++
+	c.lastFailure = now
+	if c.failures < maxFailures {
+		return time.Time{}
+	}
+	c.lockedUntil = now.Add(l.lockoutDuration(c.failures - maxFailures))
+	return c.lockedUntil
+}
+
+// finish ends the reservations of a and returns its counters, which are nil
+// if it has no username or address. The mutex must be held.
+func (a *Attempt) finish() (*counter, *counter) {
+	if a.done {
+		return nil, nil
+	}
+	a.done = true
+	l := a.limiter
+	var userCounter, addressCounter *counter
+	if a.username != "" {
+		userCounter = l.users[userKey{a.username, a.factor}]
+		userCounter.pending--
+	}
+	if a.address != "" {
+		addressCounter = l.addresses[a.address]
+		addressCounter.pending--
+	}
+	return userCounter, addressCounter
+}
+
+func (a *Attempt) recordFailure() []Lockout {
+	if a == nil {
+		return nil
+	}
+	l := a.limiter
+	now := l.now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	userCounter, addressCounter := a.finish()
+	var lockouts []Lockout
+	if userCounter != nil {
+		until := l.countFailure(userCounter, l.config.MaxUserFailures, now)
+		if !until.IsZero() {
+			lockouts = append(lockouts, Lockout{Username: a.username,
+				Factor: a.factor, Until: until})
+		}
+	}
+	if addressCounter != nil {
+		until := l.countFailure(addressCounter, l.config.MaxAddressFailures,
+			now)
+		if !until.IsZero() {
+			lockouts = append(lockouts, Lockout{Address: a.address,
+				Until: until})
+		}
+	}
+	l.purge(now)
+	return lockouts
+}
+
+func (a *Attempt) recordSuccess() {
+	if a == nil {
+		return
+	}
+	l := a.limiter
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if userCounter, _ := a.finish(); userCounter != nil {
+		userCounter.failures = 0
+		userCounter.lockedUntil = time.Time{}
+	}
+	l.purge(l.now())
+}
+
+func (a *Attempt) release() {
+	if a == nil {
+		return
+	}
+	a.limiter.mutex.Lock()
+	defer a.limiter.mutex.Unlock()
+	a.finish()
+}
+
+// purge forgets counters which are neither locked out, recently failed nor
+// have attempts in progress, at most every purgeInterval. The mutex must be
+// held.
+func (l *Limiter) purge(now time.Time) {
+	if now.Sub(l.lastPurge) < purgeInterval {
+		return
+	}
+	l.lastPurge = now
+	for key, c := range l.users {
+		if l.isIdle(c, now) {
+			delete(l.users, key)
+		}
+	}
+	for key, c := range l.addresses {
+		if l.isIdle(c, now) {
+			delete(l.addresses, key)
+		}
+	}
+}
+
+// isIdle returns true if c may be forgotten at now.
+func (l *Limiter) isIdle(c *counter, now time.Time) bool {
+	return c.pending < 1 && c.lockedUntil.Before(now) &&
+		(c.failures < 1 || l.isStale(c, now))
+}
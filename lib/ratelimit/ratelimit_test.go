@@ -0,0 +1,198 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func newTestLimiter(t *testing.T, config Config) (*Limiter, *testClock) {
+	l, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &testClock{now: time.Unix(1000000, 0)}
+	l.now = clock.Now
+	return l, clock
+}
+
+// fail makes a failed attempt of username with factor from address and
+// returns the lockouts it starts.
+func fail(t *testing.T, l *Limiter, username, factor,
+	address string) []Lockout {
+	attempt, err := l.Allow(username, factor, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return attempt.RecordFailure()
+}
+
+func TestUserLockoutBackoff(t *testing.T) {
+	l, clock := newTestLimiter(t, Config{MaxUserFailures: 3,
+		MaxAddressFailures: 100})
+	for i := 0; i < 2; i++ {
+		if lockouts := fail(t, l, "user", "otp", "10.0.0.1"); lockouts != nil {
+			t.Fatalf("unexpected lockouts: %v", lockouts)
+		}
+	}
+	lockouts := fail(t, l, "user", "otp", "10.0.0.2")
+	if len(lockouts) != 1 || lockouts[0].Username != "user" ||
+		lockouts[0].Factor != "otp" ||
+		!lockouts[0].Until.Equal(clock.now.Add(time.Minute)) {
+		t.Fatalf("expected one minute lockout of user, got %v", lockouts)
+	}
+	if _, err := l.Allow("user", "otp", "10.0.0.3"); err == nil {
+		t.Fatal("locked out user should not be allowed")
+	} else if _, ok := err.(*Lockout); !ok {
+		t.Fatalf("expected *Lockout, got %T", err)
+	}
+	if _, err := l.Allow("other", "otp", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	clock.now = clock.now.Add(time.Minute + time.Second)
+	// Each further failure doubles the lockout.
+	lockouts = fail(t, l, "user", "otp", "10.0.0.1")
+	if len(lockouts) != 1 ||
+		!lockouts[0].Until.Equal(clock.now.Add(2*time.Minute)) {
+		t.Fatalf("expected two minute lockout, got %v", lockouts)
+	}
+	clock.now = clock.now.Add(2*time.Minute + time.Second)
+	attempt, err := l.Allow("user", "otp", "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	attempt.RecordSuccess()
+	for i := 0; i < 2; i++ {
+		if lockouts := fail(t, l, "user", "otp", "10.0.0.1"); lockouts != nil {
+			t.Fatalf("failures should have been forgotten, got %v", lockouts)
+		}
+	}
+}
+
+func TestFactorsCountedSeparately(t *testing.T) {
+	l, _ := newTestLimiter(t, Config{MaxUserFailures: 2})
+	fail(t, l, "user", "otp", "")
+	attempt, err := l.Allow("user", "password", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Logging in with a password does not forget failed one time passwords.
+	attempt.RecordSuccess()
+	if lockouts := fail(t, l, "user", "otp", ""); len(lockouts) != 1 {
+		t.Fatalf("expected lockout, got %v", lockouts)
+	}
+	if _, err := l.Allow("user", "otp", ""); err == nil {
+		t.Fatal("locked out factor should not be allowed")
+	}
+	if _, err := l.Allow("user", "password", ""); err != nil {
+		t.Fatalf("other factors should not be locked out: %s", err)
+	}
+}
+
+func TestConcurrentAttempts(t *testing.T) {
+	l, _ := newTestLimiter(t, Config{MaxUserFailures: 2,
+		MaxAddressFailures: 100})
+	first, err := l.Allow("user", "otp", "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := l.Allow("user", "otp", "10.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both attempts in progress could fail.
+	if _, err := l.Allow("user", "otp", "10.0.0.3"); err != ErrTooManyInProgress {
+		t.Fatalf("expected ErrTooManyInProgress, got %v", err)
+	}
+	second.Release()
+	second.Release()
+	third, err := l.Allow("user", "otp", "10.0.0.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.RecordFailure()
+	first.Release()
+	if lockouts := third.RecordFailure(); len(lockouts) != 1 {
+		t.Fatalf("expected lockout, got %v", lockouts)
+	}
+	if lockouts := third.RecordFailure(); lockouts != nil {
+		t.Fatalf("attempt counted twice: %v", lockouts)
+	}
+	if c := l.users[userKey{"user", "otp"}]; c.pending != 0 {
+		t.Fatalf("%d attempts still pending", c.pending)
+	}
+}
+
+func TestMaxLockout(t *testing.T) {
+	l, clock := newTestLimiter(t, Config{MaxUserFailures: 1,
+		Lockout: time.Minute, MaxLockout: 5 * time.Minute})
+	for i := 0; i < 10; i++ {
+		fail(t, l, "user", "otp", "")
+		clock.now = clock.now.Add(5 * time.Minute)
+	}
+	lockouts := fail(t, l, "user", "otp", "")
+	if len(lockouts) != 1 ||
+		!lockouts[0].Until.Equal(clock.now.Add(5*time.Minute)) {
+		t.Fatalf("lockout %v exceeds maximum", lockouts)
+	}
+}
+
+func TestAddressLockoutAndTrustedCIDRs(t *testing.T) {
+	l, _ := newTestLimiter(t, Config{MaxUserFailures: 100,
+		MaxAddressFailures: 2, TrustedCIDRs: []string{"192.168.0.0/16"}})
+	for _, username := range []string{"user1", "user2"} {
+		fail(t, l, username, "otp", "10.0.0.1")
+		fail(t, l, username, "otp", "192.168.1.1")
+	}
+	_, err := l.Allow("user3", "password", "10.0.0.1")
+	if lockout, ok := err.(*Lockout); !ok || lockout.Address != "10.0.0.1" {
+		t.Fatalf("expected lockout of address, got %v", err)
+	}
+	if _, err := l.Allow("user3", "otp", "192.168.1.1"); err != nil {
+		t.Fatalf("trusted address should not be locked out: %s", err)
+	}
+}
+
+func TestResetAfter(t *testing.T) {
+	l, clock := newTestLimiter(t, Config{MaxUserFailures: 2,
+		ResetAfter: time.Hour})
+	fail(t, l, "user", "otp", "")
+	clock.now = clock.now.Add(2 * time.Hour)
+	if lockouts := fail(t, l, "user", "otp", ""); lockouts != nil {
+		t.Fatalf("old failures should be forgotten, got %v", lockouts)
+	}
+	if len(l.users) != 1 {
+		t.Fatalf("expected 1 counter, got %d", len(l.users))
+	}
+	clock.now = clock.now.Add(2 * time.Hour)
+	fail(t, l, "other", "otp", "")
+	if _, ok := l.users[userKey{"user", "otp"}]; ok {
+		t.Fatal("stale counter should have been purged")
+	}
+}
+
+func TestNilLimiter(t *testing.T) {
+	var l *Limiter
+	attempt, err := l.Allow("user", "otp", "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lockouts := attempt.RecordFailure(); lockouts != nil {
+		t.Fatal(lockouts)
+	}
+	attempt.RecordSuccess()
+	attempt.Release()
+}
+
+func TestBadCIDR(t *testing.T) {
+	if _, err := New(Config{TrustedCIDRs: []string{"10.0.0.0"}}); err == nil {
+		t.Fatal("invalid CIDR should be rejected")
+	}
+}
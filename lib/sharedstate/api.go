@@ -0,0 +1,39 @@
+// Package sharedstate keeps short-lived state, such as pending second factor
+// transactions, which every keymasterd instance of an active-active cluster
+// must see, so that a transaction started on one instance can be completed
+// on another. State is held in Redis, or in memory for a single instance.
+package sharedstate
+
+import (
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+)
+
+// Store holds values which expire. It is safe for concurrent use.
+type Store interface {
+	// Put stores value under key until ttl has passed.
+	Put(key string, value []byte, ttl time.Duration) error
+	// Get returns the value of key. The bool is false if there is no value
+	// or it has expired.
+	Get(key string) ([]byte, bool, error)
+	// Take returns and deletes the value of key, so that it is returned at
+	// most once even if instances race.
+	Take(key string) ([]byte, bool, error)
+	// Delete deletes the value of key, if any.
+	Delete(key string) error
+}
+
+// NewMemoryStore returns a Store which is only visible to this process.
+func NewMemoryStore() Store {
+	return newMemoryStore()
+}
+
+// NewRedisStore returns a Store in the Redis server at rawURL, which has
+// the form redis://[:password@]host[:port][/database], or rediss:// for TLS.
+// A non-empty password overrides the password of rawURL. Take requires
+// Redis 6.2 or later.
+func NewRedisStore(rawURL string, password string,
+	logger log.DebugLogger) (Store, error) {
+	return newRedisStore(rawURL, password, logger)
+}
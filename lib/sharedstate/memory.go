@@ -0,0 +1,80 @@
+package sharedstate
+
+import (
+	"sync"
+	"time"
+)
+
+const memoryPurgeInterval = time.Minute
+
+type memoryEntry struct {
+	value     []byte
+	expiresAt time.Time
+}
+
+type memoryStore struct {
+	mutex      sync.Mutex
+	entries    map[string]memoryEntry
+	lastPurged time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		entries:    make(map[string]memoryEntry),
+		lastPurged: time.Now(),
+	}
+}
+
+func (s *memoryStore) Put(key string, value []byte, ttl time.Duration) error {
+	now := time.Now()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if now.Sub(s.lastPurged) >= memoryPurgeInterval {
+		for key, entry := range s.entries {
+			if !entry.expiresAt.After(now) {
+				delete(s.entries, key)
+			}
+		}
+		s.lastPurged = now
+	}
+	s.entries[key] = memoryEntry{
+		value:     append([]byte{}, value...),
+		expiresAt: now.Add(ttl),
+	}
+	return nil
+}
+
+// get returns the value of key, which must be locked.
+func (s *memoryStore) get(key string) ([]byte, bool) {
+	entry, ok := s.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !entry.expiresAt.After(time.Now()) {
+		delete(s.entries, key)
+		return nil, false
+	}
+	return append([]byte{}, entry.value...), true
+}
+
+func (s *memoryStore) Get(key string) ([]byte, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	value, ok := s.get(key)
+	return value, ok, nil
+}
+
+func (s *memoryStore) Take(key string) ([]byte, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	value, ok := s.get(key)
+	delete(s.entries, key)
+	return value, ok, nil
+}
+
+func (s *memoryStore) Delete(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.entries, key)
+	return nil
+}
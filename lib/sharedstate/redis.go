@@ -0,0 +1,276 @@
+package sharedstate
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+)
+
+const (
+	redisDefaultPort     = "6379"
+	redisDialTimeout     = 5 * time.Second
+	redisIOTimeout       = 5 * time.Second
+	redisMaxIdleConns    = 8
+	redisMaxReplyArgSize = 64 << 20
+)
+
+// redisError is an error reply of the server. The connection is still
+// usable after one.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+type redisStore struct {
+	address   string
+	tlsConfig *tls.Config // Set for rediss URLs.
+	password  string
+	database  int
+	logger    log.DebugLogger
+	mutex     sync.Mutex
+	idle      []*redisConn // Protected by mutex.
+}
+
+func newRedisStore(rawURL string, password string,
+	logger log.DebugLogger) (*redisStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	s := &redisStore{logger: logger}
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		s.tlsConfig = &tls.Config{ServerName: u.Hostname()}
+	default:
+		return nil, fmt.Errorf("unsupported Redis URL scheme: %s", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("no host in Redis URL")
+	}
+	port := u.Port()
+	if port == "" {
+		port = redisDefaultPort
+	}
+	s.address = net.JoinHostPort(u.Hostname(), port)
+	if u.User != nil {
+		s.password, _ = u.User.Password()
+	}
+	if password != "" {
+		s.password = password
+	}
+	if path := strings.Trim(u.Path, "/"); path != "" {
+		s.database, err = strconv.Atoi(path)
+		if err != nil || s.database < 0 {
+			return nil, fmt.Errorf("invalid Redis database: %s", path)
+		}
+	}
+	// Fail early if the server cannot be used.
+	conn, err := s.dial()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.do("PING"); err != nil {
+		conn.conn.Close()
+		return nil, err
+	}
+	s.putConn(conn)
+	return s, nil
+}
+
+func (s *redisStore) dial() (*redisConn, error) {
+	dialer := &net.Dialer{Timeout: redisDialTimeout}
+	var conn net.Conn
+	var err error
+	if s.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.address, s.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", s.address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+	if s.password != "" {
+		if _, err := c.do("AUTH", s.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if s.database != 0 {
+		if _, err := c.do("SELECT", strconv.Itoa(s.database)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	s.logger.Debugf(1, "connected to Redis at %s", s.address)
+	return c, nil
+}
+
+func (s *redisStore) getConn() (*redisConn, error) {
+	s.mutex.Lock()
+	if length := len(s.idle); length > 0 {
+		conn := s.idle[length-1]
+		s.idle = s.idle[:length-1]
+		s.mutex.Unlock()
+		return conn, nil
+	}
+	s.mutex.Unlock()
+	return s.dial()
+}
+
+func (s *redisStore) putConn(conn *redisConn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.idle) >= redisMaxIdleConns {
+		conn.conn.Close()
+		return
+	}
+	s.idle = append(s.idle, conn)
+}
+
+// do runs a command on an idle connection. Connections with I/O or protocol
+// errors are closed.
+func (s *redisStore) do(args ...string) (interface{}, error) {
+	conn, err := s.getConn()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := conn.do(args...)
+	if err != nil {
+		if _, ok := err.(redisError); !ok {
+			conn.conn.Close()
+			return nil, err
+		}
+	}
+	s.putConn(conn)
+	return reply, err
+}
+
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(redisIOTimeout))
+	var request []byte
+	request = append(request, '*')
+	request = strconv.AppendInt(request, int64(len(args)), 10)
+	request = append(request, '\r', '\n')
+	for _, arg := range args {
+		request = append(request, '$')
+		request = strconv.AppendInt(request, int64(len(arg)), 10)
+		request = append(request, '\r', '\n')
+		request = append(request, arg...)
+		request = append(request, '\r', '\n')
+	}
+	if _, err := c.conn.Write(request); err != nil {
+		return nil, err
+	}
+	return readRedisReply(c.reader)
+}
+
+// readRedisReply reads a RESP reply: a string for status replies, []byte or
+// nil for bulk strings, int64 for integers and []interface{} for arrays.
+// Error replies are returned as a redisError.
+func readRedisReply(reader *bufio.Reader) (interface{}, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("malformed Redis reply")
+	}
+	kind, line := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, redisError(line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		length, err := strconv.Atoi(line)
+		if err != nil || length > redisMaxReplyArgSize {
+			return nil, errors.New("malformed Redis bulk string")
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		return data[:length], nil
+	case '*':
+		length, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, errors.New("malformed Redis array")
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		array := make([]interface{}, 0, length)
+		for i := 0; i < length; i++ {
+			element, err := readRedisReply(reader)
+			if err != nil {
+				if _, ok := err.(redisError); !ok {
+					return nil, err
+				}
+			}
+			array = append(array, element)
+		}
+		return array, nil
+	}
+	return nil, fmt.Errorf("unknown Redis reply type: %q", kind)
+}
+
+// bulkReply returns the value of a GET like reply.
+func bulkReply(reply interface{}, err error) ([]byte, bool, error) {
+	if err != nil {
+		return nil, false, err
+	}
+	if reply == nil {
+		return nil, false, nil
+	}
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, false, fmt.Errorf("unexpected Redis reply: %v", reply)
+	}
+	return value, true, nil
+}
+
+func (s *redisStore) Put(key string, value []byte, ttl time.Duration) error {
+	milliseconds := ttl.Milliseconds()
+	if milliseconds < 1 {
+		return s.Delete(key)
+	}
+	_, err := s.do("SET", key, string(value), "PX",
+		strconv.FormatInt(milliseconds, 10))
+	return err
+}
+
+func (s *redisStore) Get(key string) ([]byte, bool, error) {
+	return bulkReply(s.do("GET", key))
+}
+
+func (s *redisStore) Take(key string) ([]byte, bool, error) {
+	return bulkReply(s.do("GETDEL", key))
+}
+
+func (s *redisStore) Delete(key string) error {
+	_, err := s.do("DEL", key)
+	return err
+}
@@ -0,0 +1,206 @@
+package sharedstate
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log/testlogger"
+)
+
+// testRedisServer implements the commands used by redisStore.
+type testRedisServer struct {
+	password string
+	mutex    sync.Mutex
+	values   map[string]memoryEntry
+}
+
+func startTestRedisServer(t *testing.T, password string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	server := &testRedisServer{
+		password: password,
+		values:   make(map[string]memoryEntry),
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func (s *testRedisServer) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authenticated := s.password == ""
+	for {
+		request, err := readRedisReply(reader)
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, arg := range request.([]interface{}) {
+			args = append(args, string(arg.([]byte)))
+		}
+		var reply string
+		if !authenticated && args[0] != "AUTH" {
+			reply = "-NOAUTH Authentication required.\r\n"
+		} else {
+			reply = s.command(args)
+			if args[0] == "AUTH" && reply == "+OK\r\n" {
+				authenticated = true
+			}
+		}
+		if _, err := conn.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
+
+func (s *testRedisServer) command(args []string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	bulk := func(key string) string {
+		entry, ok := s.values[key]
+		if !ok || entry.expiresAt.Before(time.Now()) {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(entry.value), entry.value)
+	}
+	switch {
+	case args[0] == "AUTH" && len(args) == 2:
+		if args[1] != s.password {
+			return "-WRONGPASS invalid password\r\n"
+		}
+		return "+OK\r\n"
+	case args[0] == "PING" && len(args) == 1:
+		return "+PONG\r\n"
+	case args[0] == "SET" && len(args) == 5 && args[3] == "PX":
+		milliseconds, err := strconv.Atoi(args[4])
+		if err != nil {
+			return "-ERR value is not an integer\r\n"
+		}
+		s.values[args[1]] = memoryEntry{
+			value: []byte(args[2]),
+			expiresAt: time.Now().Add(
+				time.Duration(milliseconds) * time.Millisecond),
+		}
+		return "+OK\r\n"
+	case args[0] == "GET" && len(args) == 2:
+		return bulk(args[1])
+	case args[0] == "GETDEL" && len(args) == 2:
+		reply := bulk(args[1])
+		delete(s.values, args[1])
+		return reply
+	case args[0] == "DEL" && len(args) == 2:
+		_, ok := s.values[args[1]]
+		delete(s.values, args[1])
+		if ok {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func testStore(t *testing.T, store Store) {
+	if err := store.Put("key", []byte("value"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put("short", []byte("value"),
+		50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	value, ok, err := store.Get("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || string(value) != "value" {
+		t.Fatalf("unexpected value: %v %q", ok, value)
+	}
+	if _, ok, err := store.Get("missing"); err != nil || ok {
+		t.Fatalf("missing key should not be found: %v %v", ok, err)
+	}
+	value, ok, err = store.Take("key")
+	if err != nil || !ok || string(value) != "value" {
+		t.Fatalf("unexpected taken value: %v %q %v", ok, value, err)
+	}
+	if _, ok, err := store.Take("key"); err != nil || ok {
+		t.Fatalf("key should be taken once: %v %v", ok, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, ok, err := store.Get("short"); err != nil || ok {
+		t.Fatalf("expired key should not be found: %v %v", ok, err)
+	}
+	if err := store.Put("key", []byte("other"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := store.Get("key"); err != nil || ok {
+		t.Fatalf("deleted key should not be found: %v %v", ok, err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestRedisStore(t *testing.T) {
+	logger := testlogger.New(t)
+	address := startTestRedisServer(t, "secret")
+	if _, err := NewRedisStore("redis://"+address, "",
+		logger); err == nil {
+		t.Fatal("missing password should fail")
+	}
+	if _, err := NewRedisStore("redis://:wrong@"+address, "",
+		logger); err == nil {
+		t.Fatal("wrong password should fail")
+	}
+	store, err := NewRedisStore("redis://:wrong@"+address, "secret", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, store)
+	// Values are shared by stores of the same server.
+	other, err := NewRedisStore("redis://:secret@"+address, "", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put("shared", []byte("pending"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if value, ok, err := other.Take("shared"); err != nil || !ok ||
+		string(value) != "pending" {
+		t.Fatalf("value was not shared: %v %q %v", ok, value, err)
+	}
+	if _, ok, err := store.Get("shared"); err != nil || ok {
+		t.Fatalf("taken value should be gone: %v %v", ok, err)
+	}
+}
+
+func TestNewRedisStoreURL(t *testing.T) {
+	logger := testlogger.New(t)
+	for _, rawURL := range []string{
+		"http://localhost",
+		"redis://",
+		"redis://localhost/db",
+	} {
+		if _, err := NewRedisStore(rawURL, "", logger); err == nil {
+			t.Errorf("%s should fail", rawURL)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+// Package dynamostore implements simplestorage.SimpleStore with Amazon
+// DynamoDB, so that keymasterd instances in AWS can share their state
+// without running a SQL database. It also stores user profiles and other
+// records. Writes of profiles are conditional on the version read, so that
+// concurrent updates are not lost.
+//
+// All data is kept in one table with a string partition key named "id".
+// Expired signed data is ignored on reads; enabling Time To Live on the
+// "expiration" attribute of the table removes it.
+package dynamostore
+
+import (
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// Config selects the DynamoDB table.
+type Config struct {
+	Table string
+	// Region defaults to the region of the AWS shared configuration.
+	Region string
+	// Endpoint overrides the DynamoDB endpoint, such as for DynamoDB Local.
+	Endpoint string
+}
+
+// Store is a DynamoDB table with keymasterd data.
+type Store struct {
+	client dynamodbiface.DynamoDBAPI
+	table  string
+	logger log.DebugLogger
+}
+
+// New returns a Store for the table in config, using the AWS credentials
+// of the environment.
+func New(config Config, logger log.DebugLogger) (*Store, error) {
+	return newStore(config, logger)
+}
+
+// UpsertSigned inserts or replaces the data of key and dataType.
+func (s *Store) UpsertSigned(key string, dataType int, expiration int64,
+	data string) error {
+	return s.upsertSigned(key, dataType, expiration, data)
+}
+
+// DeleteSigned deletes the data of key and dataType.
+func (s *Store) DeleteSigned(key string, dataType int) error {
+	return s.deleteSigned(key, dataType)
+}
+
+// GetSigned returns true and the data of key and dataType if it exists and
+// has not expired, else false.
+func (s *Store) GetSigned(key string, dataType int) (bool, string, error) {
+	return s.getSigned(key, dataType)
+}
+
+// GetProfile returns the profile data of username. The bool is false if
+// there is no profile.
+func (s *Store) GetProfile(username string) ([]byte, bool, error) {
+	data, _, ok, err := s.getProfile(username)
+	return data, ok, err
+}
+
+// PutProfile replaces the profile data of username.
+func (s *Store) PutProfile(username string, data []byte) error {
+	return s.putProfile(username, data)
+}
+
+// UpdateProfile calls update with the stored profile data of username (nil
+// if there is none) and stores the data it returns. Nothing is stored if
+// update returns nil data or an error. If the profile is changed by another
+// writer in the meantime update is called again with the new data, so it
+// must not have other side effects.
+func (s *Store) UpdateProfile(username string,
+	update func(data []byte) ([]byte, error)) error {
+	return s.updateProfile(username, update)
+}
+
+// ListProfiles returns the usernames with a profile, sorted.
+func (s *Store) ListProfiles() ([]string, error) {
+	return s.listNames(profileKind)
+}
+
+// GetRecord returns the data of the record name of kind. The bool is false
+// if there is no such record.
+func (s *Store) GetRecord(kind, name string) ([]byte, bool, error) {
+	return s.getRecord(kind, name)
+}
+
+// PutRecord inserts or replaces the record name of kind.
+func (s *Store) PutRecord(kind, name string, data []byte) error {
+	return s.putRecord(kind, name, data)
+}
+
+// InsertRecord inserts the record name of kind unless it exists. The bool
+// is false if it exists.
+func (s *Store) InsertRecord(kind, name string, data []byte) (bool, error) {
+	return s.insertRecord(kind, name, data)
+}
+
+// DeleteRecord deletes the record name of kind.
+func (s *Store) DeleteRecord(kind, name string) error {
+	return s.deleteRecord(kind, name)
+}
+
+// ListRecords returns the data of all records of kind, sorted by name.
+func (s *Store) ListRecords(kind string) ([][]byte, error) {
+	return s.listRecords(kind)
+}
@@ -0,0 +1,299 @@
+package dynamostore
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log/testlogger"
+	"github.com/Cloud-Foundations/keymaster/lib/simplestorage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+var _ simplestorage.SimpleStore = (*Store)(nil)
+
+// testClient is an in-memory table which understands the expressions used
+// by Store.
+type testClient struct {
+	dynamodbiface.DynamoDBAPI
+	mutex sync.Mutex
+	items map[string]map[string]*dynamodb.AttributeValue
+	// pageSize limits the items in a scan page.
+	pageSize int
+}
+
+func newTestStore(t *testing.T) (*Store, *testClient) {
+	client := &testClient{
+		items:    make(map[string]map[string]*dynamodb.AttributeValue),
+		pageSize: 2,
+	}
+	return &Store{client: client, table: "keymaster",
+		logger: testlogger.New(t)}, client
+}
+
+func conditionFailed() error {
+	return awserr.New(dynamodb.ErrCodeConditionalCheckFailedException,
+		"The conditional request failed", nil)
+}
+
+func (c *testClient) checkCondition(expression *string,
+	item map[string]*dynamodb.AttributeValue,
+	values map[string]*dynamodb.AttributeValue) error {
+	switch aws.StringValue(expression) {
+	case "":
+		return nil
+	case notExistsCondition:
+		if item != nil {
+			return conditionFailed()
+		}
+	case noVersionCondition:
+		if item != nil && item[versionAttribute] != nil {
+			return conditionFailed()
+		}
+	case versionCondition:
+		if item == nil || item[versionAttribute] == nil ||
+			aws.StringValue(item[versionAttribute].N) !=
+				aws.StringValue(values[":v"].N) {
+			return conditionFailed()
+		}
+	default:
+		return fmt.Errorf("unsupported condition: %s",
+			aws.StringValue(expression))
+	}
+	return nil
+}
+
+func (c *testClient) GetItemWithContext(ctx aws.Context,
+	input *dynamodb.GetItemInput, opts ...request.Option) (
+	*dynamodb.GetItemOutput, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return &dynamodb.GetItemOutput{
+		Item: c.items[aws.StringValue(input.Key[idAttribute].S)],
+	}, nil
+}
+
+func (c *testClient) PutItemWithContext(ctx aws.Context,
+	input *dynamodb.PutItemInput, opts ...request.Option) (
+	*dynamodb.PutItemOutput, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	id := aws.StringValue(input.Item[idAttribute].S)
+	err := c.checkCondition(input.ConditionExpression, c.items[id],
+		input.ExpressionAttributeValues)
+	if err != nil {
+		return nil, err
+	}
+	c.items[id] = input.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (c *testClient) UpdateItemWithContext(ctx aws.Context,
+	input *dynamodb.UpdateItemInput, opts ...request.Option) (
+	*dynamodb.UpdateItemOutput, error) {
+	if expression := aws.StringValue(input.UpdateExpression); expression !=
+		putProfileUpdate {
+		return nil, fmt.Errorf("unsupported update: %s", expression)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	id := aws.StringValue(input.Key[idAttribute].S)
+	var version int64
+	if item := c.items[id]; item != nil && item[versionAttribute] != nil {
+		version, _ = strconv.ParseInt(
+			aws.StringValue(item[versionAttribute].N), 10, 64)
+	}
+	c.items[id] = map[string]*dynamodb.AttributeValue{
+		idAttribute:   {S: aws.String(id)},
+		dataAttribute: input.ExpressionAttributeValues[":d"],
+		versionAttribute: {
+			N: aws.String(strconv.FormatInt(version+1, 10)),
+		},
+	}
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func (c *testClient) DeleteItemWithContext(ctx aws.Context,
+	input *dynamodb.DeleteItemInput, opts ...request.Option) (
+	*dynamodb.DeleteItemOutput, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.items, aws.StringValue(input.Key[idAttribute].S))
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+func (c *testClient) ScanWithContext(ctx aws.Context,
+	input *dynamodb.ScanInput, opts ...request.Option) (
+	*dynamodb.ScanOutput, error) {
+	if expression := aws.StringValue(input.FilterExpression); expression !=
+		beginsWithIDFilter {
+		return nil, fmt.Errorf("unsupported filter: %s", expression)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var ids []string
+	for id := range c.items {
+		ids = append(ids, id)
+	}
+	// Return the pages in reverse order, since DynamoDB does not sort.
+	sort.Sort(sort.Reverse(sort.StringSlice(ids)))
+	if start := input.ExclusiveStartKey; start != nil {
+		startID := aws.StringValue(start[idAttribute].S)
+		for len(ids) > 0 && ids[0] >= startID {
+			ids = ids[1:]
+		}
+	}
+	prefix := aws.StringValue(input.ExpressionAttributeValues[":prefix"].S)
+	output := &dynamodb.ScanOutput{}
+	for index, id := range ids {
+		if index == c.pageSize {
+			output.LastEvaluatedKey = map[string]*dynamodb.AttributeValue{
+				idAttribute: {S: aws.String(ids[index-1])},
+			}
+			break
+		}
+		if strings.HasPrefix(id, prefix) {
+			output.Items = append(output.Items, c.items[id])
+		}
+	}
+	return output, nil
+}
+
+func TestSigned(t *testing.T) {
+	s, _ := newTestStore(t)
+	expiration := time.Now().Add(time.Hour).Unix()
+	if err := s.UpsertSigned("alice", 1, expiration, "data1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpsertSigned("alice", 2, time.Now().Unix()-1,
+		"expired"); err != nil {
+		t.Fatal(err)
+	}
+	ok, data, err := s.GetSigned("alice", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || data != "data1" {
+		t.Fatalf("unexpected data: %v %q", ok, data)
+	}
+	if ok, _, err := s.GetSigned("alice", 2); err != nil || ok {
+		t.Fatalf("expired data should not be returned: %v %v", ok, err)
+	}
+	if err := s.DeleteSigned("alice", 1); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _, err := s.GetSigned("alice", 1); err != nil || ok {
+		t.Fatalf("deleted data should not be returned: %v %v", ok, err)
+	}
+}
+
+func TestUpdateProfile(t *testing.T) {
+	s, _ := newTestStore(t)
+	// Concurrent updates must not lose any increment.
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := s.UpdateProfile("alice", func(data []byte) ([]byte, error) {
+				count, _ := strconv.Atoi(string(data))
+				return []byte(strconv.Itoa(count + 1)), nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	data, ok, err := s.GetProfile("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || string(data) != "5" {
+		t.Fatalf("expected 5, got %v %q", ok, data)
+	}
+	// A write between the read and the write of an update makes it retry.
+	calls := 0
+	err = s.UpdateProfile("alice", func(data []byte) ([]byte, error) {
+		calls++
+		if calls == 1 {
+			if err := s.PutProfile("alice", []byte("10")); err != nil {
+				return nil, err
+			}
+		}
+		count, _ := strconv.Atoi(string(data))
+		return []byte(strconv.Itoa(count + 1)), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _, _ := s.GetProfile("alice"); calls != 2 || string(data) != "11" {
+		t.Fatalf("expected 11 after 2 calls, got %q after %d", data, calls)
+	}
+	err = s.UpdateProfile("alice", func(data []byte) ([]byte, error) {
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _, _ := s.GetProfile("alice"); string(data) != "11" {
+		t.Fatalf("profile should not change, got %q", data)
+	}
+	if _, ok, err := s.GetProfile("bob"); err != nil || ok {
+		t.Fatalf("bob should have no profile: %v %v", ok, err)
+	}
+}
+
+func TestRecords(t *testing.T) {
+	s, _ := newTestStore(t)
+	for _, name := range []string{"carol", "alice", "bob"} {
+		if err := s.PutProfile(name, []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.PutRecord("account", name, []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	names, err := s.ListProfiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"alice", "bob", "carol"}) {
+		t.Fatalf("unexpected profiles: %v", names)
+	}
+	if err := s.DeleteRecord("account", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	records, err := s.ListRecords("account")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]byte{[]byte("alice"), []byte("carol")}
+	if !reflect.DeepEqual(records, expected) {
+		t.Fatalf("unexpected records: %q", records)
+	}
+	if ok, err := s.InsertRecord("account", "alice",
+		[]byte("other")); err != nil || ok {
+		t.Fatalf("existing record should not be replaced: %v %v", ok, err)
+	}
+	data, ok, err := s.GetRecord("account", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || string(data) != "alice" {
+		t.Fatalf("unexpected record: %v %q", ok, data)
+	}
+	if ok, err := s.InsertRecord("account", "dave",
+		[]byte("dave")); err != nil || !ok {
+		t.Fatalf("new record should be inserted: %v %v", ok, err)
+	}
+}
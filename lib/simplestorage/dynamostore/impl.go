@@ -0,0 +1,363 @@
+package dynamostore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	requestTimeout = 10 * time.Second
+	// maxUpdateAttempts bounds the retries of UpdateProfile when other
+	// writers keep changing the profile.
+	maxUpdateAttempts = 10
+
+	profileKind = "profile"
+
+	idAttribute         = "id"
+	dataAttribute       = "data"
+	versionAttribute    = "version"
+	expirationAttribute = "expiration"
+
+	// The expressions are constants so that the test client can recognize
+	// them.
+	notExistsCondition  = "attribute_not_exists(#id)"
+	noVersionCondition  = "attribute_not_exists(#v)"
+	versionCondition    = "#v = :v"
+	putProfileUpdate    = "SET #d = :d ADD #v :one"
+	beginsWithIDFilter  = "begins_with(#id, :prefix)"
+	idProjection        = "#id"
+	idAndDataProjection = "#id, #d"
+)
+
+var errTooManyConflicts = errors.New("too many concurrent profile updates")
+
+func newStore(config Config, logger log.DebugLogger) (*Store, error) {
+	if config.Table == "" {
+		return nil, errors.New("no DynamoDB table")
+	}
+	options := session.Options{SharedConfigState: session.SharedConfigEnable}
+	if config.Region != "" {
+		options.Config.Region = aws.String(config.Region)
+	}
+	if config.Endpoint != "" {
+		options.Config.Endpoint = aws.String(config.Endpoint)
+	}
+	awsSession, err := session.NewSessionWithOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{
+		client: dynamodb.New(awsSession),
+		table:  config.Table,
+		logger: logger,
+	}, nil
+}
+
+func itemID(kind, name string) string {
+	return kind + "#" + name
+}
+
+func signedKind(dataType int) string {
+	return "signed:" + strconv.Itoa(dataType)
+}
+
+func key(kind, name string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		idAttribute: {S: aws.String(itemID(kind, name))},
+	}
+}
+
+func isConditionFailed(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+	}
+	return false
+}
+
+func (s *Store) getItem(kind, name string) (
+	map[string]*dynamodb.AttributeValue, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	output, err := s.client.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.table),
+		Key:            key(kind, name),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output.Item, nil
+}
+
+func (s *Store) putItem(input *dynamodb.PutItemInput) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	input.TableName = aws.String(s.table)
+	_, err := s.client.PutItemWithContext(ctx, input)
+	return err
+}
+
+func (s *Store) deleteItem(kind, name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	_, err := s.client.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.table),
+		Key:       key(kind, name),
+	})
+	return err
+}
+
+// scan returns the items of kind, sorted by id.
+func (s *Store) scan(kind string, projection string) (
+	[]map[string]*dynamodb.AttributeValue, error) {
+	input := &dynamodb.ScanInput{
+		TableName:            aws.String(s.table),
+		FilterExpression:     aws.String(beginsWithIDFilter),
+		ProjectionExpression: aws.String(projection),
+		ExpressionAttributeNames: map[string]*string{
+			"#id": aws.String(idAttribute),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":prefix": {S: aws.String(itemID(kind, ""))},
+		},
+		ConsistentRead: aws.Bool(true),
+	}
+	if projection == idAndDataProjection {
+		input.ExpressionAttributeNames["#d"] = aws.String(dataAttribute)
+	}
+	var items []map[string]*dynamodb.AttributeValue
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(),
+			requestTimeout)
+		output, err := s.client.ScanWithContext(ctx, input)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, output.Items...)
+		if len(output.LastEvaluatedKey) < 1 {
+			break
+		}
+		input.ExclusiveStartKey = output.LastEvaluatedKey
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return aws.StringValue(items[i][idAttribute].S) <
+			aws.StringValue(items[j][idAttribute].S)
+	})
+	return items, nil
+}
+
+func (s *Store) upsertSigned(key string, dataType int, expiration int64,
+	data string) error {
+	return s.putItem(&dynamodb.PutItemInput{
+		Item: map[string]*dynamodb.AttributeValue{
+			idAttribute:   {S: aws.String(itemID(signedKind(dataType), key))},
+			dataAttribute: {S: aws.String(data)},
+			expirationAttribute: {
+				N: aws.String(strconv.FormatInt(expiration, 10)),
+			},
+		},
+	})
+}
+
+func (s *Store) deleteSigned(key string, dataType int) error {
+	return s.deleteItem(signedKind(dataType), key)
+}
+
+func (s *Store) getSigned(key string, dataType int) (bool, string, error) {
+	item, err := s.getItem(signedKind(dataType), key)
+	if err != nil {
+		return false, "", err
+	}
+	if item == nil || item[dataAttribute] == nil {
+		return false, "", nil
+	}
+	if attr := item[expirationAttribute]; attr != nil {
+		expiration, err := strconv.ParseInt(aws.StringValue(attr.N), 10, 64)
+		if err != nil {
+			return false, "", err
+		}
+		if expiration < time.Now().Unix() {
+			return false, "", nil
+		}
+	}
+	return true, aws.StringValue(item[dataAttribute].S), nil
+}
+
+// getProfile returns the profile data of username and its version.
+func (s *Store) getProfile(username string) ([]byte, string, bool, error) {
+	item, err := s.getItem(profileKind, username)
+	if err != nil {
+		return nil, "", false, err
+	}
+	if item == nil || item[dataAttribute] == nil {
+		return nil, "", false, nil
+	}
+	var version string
+	if attr := item[versionAttribute]; attr != nil {
+		version = aws.StringValue(attr.N)
+	}
+	return item[dataAttribute].B, version, true, nil
+}
+
+func (s *Store) putProfile(username string, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	// The version is incremented so that a concurrent UpdateProfile does not
+	// overwrite this.
+	_, err := s.client.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(s.table),
+		Key:              key(profileKind, username),
+		UpdateExpression: aws.String(putProfileUpdate),
+		ExpressionAttributeNames: map[string]*string{
+			"#d": aws.String(dataAttribute),
+			"#v": aws.String(versionAttribute),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":d":   {B: data},
+			":one": {N: aws.String("1")},
+		},
+	})
+	return err
+}
+
+func (s *Store) updateProfile(username string,
+	update func(data []byte) ([]byte, error)) error {
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		data, version, ok, err := s.getProfile(username)
+		if err != nil {
+			return err
+		}
+		newData, err := update(data)
+		if err != nil {
+			return err
+		}
+		if newData == nil {
+			return nil
+		}
+		input := &dynamodb.PutItemInput{
+			Item: map[string]*dynamodb.AttributeValue{
+				idAttribute:   {S: aws.String(itemID(profileKind, username))},
+				dataAttribute: {B: newData},
+			},
+			ExpressionAttributeNames: map[string]*string{},
+		}
+		if !ok {
+			input.ConditionExpression = aws.String(notExistsCondition)
+			input.ExpressionAttributeNames["#id"] = aws.String(idAttribute)
+			input.Item[versionAttribute] = &dynamodb.AttributeValue{
+				N: aws.String("1")}
+		} else if version == "" {
+			input.ConditionExpression = aws.String(noVersionCondition)
+			input.ExpressionAttributeNames["#v"] = aws.String(versionAttribute)
+			input.Item[versionAttribute] = &dynamodb.AttributeValue{
+				N: aws.String("1")}
+		} else {
+			oldVersion, err := strconv.ParseInt(version, 10, 64)
+			if err != nil {
+				return err
+			}
+			input.ConditionExpression = aws.String(versionCondition)
+			input.ExpressionAttributeNames["#v"] = aws.String(versionAttribute)
+			input.ExpressionAttributeValues =
+				map[string]*dynamodb.AttributeValue{
+					":v": {N: aws.String(version)},
+				}
+			input.Item[versionAttribute] = &dynamodb.AttributeValue{
+				N: aws.String(strconv.FormatInt(oldVersion+1, 10))}
+		}
+		err = s.putItem(input)
+		if err == nil {
+			return nil
+		}
+		if !isConditionFailed(err) {
+			return err
+		}
+		s.logger.Debugf(1, "profile of %s changed during update, retrying",
+			username)
+	}
+	return fmt.Errorf("%s: %s", username, errTooManyConflicts)
+}
+
+func (s *Store) listNames(kind string) ([]string, error) {
+	items, err := s.scan(kind, idProjection)
+	if err != nil {
+		return nil, err
+	}
+	prefix := itemID(kind, "")
+	names := make([]string, 0, len(items))
+	for _, item := range items {
+		names = append(names,
+			strings.TrimPrefix(aws.StringValue(item[idAttribute].S), prefix))
+	}
+	return names, nil
+}
+
+func (s *Store) getRecord(kind, name string) ([]byte, bool, error) {
+	item, err := s.getItem(kind, name)
+	if err != nil {
+		return nil, false, err
+	}
+	if item == nil || item[dataAttribute] == nil {
+		return nil, false, nil
+	}
+	return item[dataAttribute].B, true, nil
+}
+
+func (s *Store) putRecord(kind, name string, data []byte) error {
+	return s.putItem(&dynamodb.PutItemInput{
+		Item: map[string]*dynamodb.AttributeValue{
+			idAttribute:   {S: aws.String(itemID(kind, name))},
+			dataAttribute: {B: data},
+		},
+	})
+}
+
+func (s *Store) insertRecord(kind, name string, data []byte) (bool, error) {
+	err := s.putItem(&dynamodb.PutItemInput{
+		Item: map[string]*dynamodb.AttributeValue{
+			idAttribute:   {S: aws.String(itemID(kind, name))},
+			dataAttribute: {B: data},
+		},
+		ConditionExpression: aws.String(notExistsCondition),
+		ExpressionAttributeNames: map[string]*string{
+			"#id": aws.String(idAttribute),
+		},
+	})
+	if isConditionFailed(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *Store) deleteRecord(kind, name string) error {
+	return s.deleteItem(kind, name)
+}
+
+func (s *Store) listRecords(kind string) ([][]byte, error) {
+	items, err := s.scan(kind, idAndDataProjection)
+	if err != nil {
+		return nil, err
+	}
+	records := make([][]byte, 0, len(items))
+	for _, item := range items {
+		if attr := item[dataAttribute]; attr != nil {
+			records = append(records, attr.B)
+		}
+	}
+	return records, nil
+}
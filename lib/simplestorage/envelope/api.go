@@ -0,0 +1,89 @@
+// Package envelope encrypts data at rest with envelope encryption. Every
+// blob is encrypted with AES-256-GCM under a fresh data key, and the data
+// key is encrypted (wrapped) with a named master key, which is held in AWS
+// KMS or derived from a passphrase. The name of the master key is stored
+// with the blob, so that master keys can be rotated: blobs sealed with an
+// old key can still be opened, and can be re-sealed with the current key.
+package envelope
+
+import (
+	"github.com/Cloud-Foundations/keymaster/lib/simplestorage"
+)
+
+// MasterKey wraps and unwraps data keys.
+type MasterKey interface {
+	// ID names the key. It is stored in sealed blobs, so it must not change.
+	ID() string
+	WrapKey(dataKey []byte) ([]byte, error)
+	UnwrapKey(wrappedKey []byte) ([]byte, error)
+}
+
+// Keyring seals blobs with its current master key and opens blobs sealed
+// with any of its master keys.
+type Keyring struct {
+	current MasterKey
+	keys    map[string]MasterKey
+}
+
+// NewKeyring returns a Keyring which seals with current and also opens
+// blobs sealed with the old keys.
+func NewKeyring(current MasterKey, old ...MasterKey) (*Keyring, error) {
+	return newKeyring(current, old)
+}
+
+// IsSealed returns true if data is a sealed blob.
+func IsSealed(data []byte) bool {
+	return isSealed(data)
+}
+
+// CurrentKeyID returns the ID of the master key used to seal.
+func (k *Keyring) CurrentKeyID() string {
+	return k.current.ID()
+}
+
+// Seal encrypts plaintext with a new data key wrapped by the current
+// master key.
+func (k *Keyring) Seal(plaintext []byte) ([]byte, error) {
+	return k.seal(plaintext)
+}
+
+// Open decrypts a blob made by Seal. Data which is not sealed is returned
+// unchanged, so that storage written before encryption was enabled can
+// still be read.
+func (k *Keyring) Open(data []byte) ([]byte, error) {
+	return k.open(data)
+}
+
+// NeedsReseal returns true if data is not sealed or is sealed with a master
+// key other than the current one.
+func (k *Keyring) NeedsReseal(data []byte) bool {
+	return k.needsReseal(data)
+}
+
+// Reseal returns data sealed with the current master key, opening it first
+// if it is sealed with another key. The bool is false, and data is returned
+// unchanged, if it already is sealed with the current key.
+func (k *Keyring) Reseal(data []byte) ([]byte, bool, error) {
+	return k.reseal(data)
+}
+
+// NewPassphraseKey returns a master key named id derived from passphrase
+// with scrypt. Since the salt is derived from id, the passphrase should be
+// long and random.
+func NewPassphraseKey(id string, passphrase []byte) (MasterKey, error) {
+	return newPassphraseKey(id, passphrase)
+}
+
+// NewAWSKMSKey returns a master key named id which wraps data keys with the
+// symmetric AWS KMS key keyID (a key ID, ARN or alias) in region, using the
+// AWS credentials of the environment.
+func NewAWSKMSKey(id string, keyID string, region string) (MasterKey, error) {
+	return newAWSKMSKey(id, keyID, region)
+}
+
+// Wrap returns a SimpleStore which stores the data of store sealed by
+// keyring, base64 encoded. Data stored before is still returned.
+func Wrap(store simplestorage.SimpleStore,
+	keyring *Keyring) simplestorage.SimpleStore {
+	return &sealedStore{store: store, keyring: keyring}
+}
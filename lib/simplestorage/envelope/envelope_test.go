@@ -0,0 +1,138 @@
+package envelope
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/keymaster/lib/simplestorage/memstore"
+)
+
+func newTestKey(t *testing.T, id string) MasterKey {
+	key, err := NewPassphraseKey(id, []byte("passphrase of "+id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestSealOpen(t *testing.T) {
+	keyring, err := NewKeyring(newTestKey(t, "k1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := []byte("totp seed")
+	sealed, err := keyring.Seal(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsSealed(sealed) || bytes.Contains(sealed, plaintext) {
+		t.Fatal("data is not sealed")
+	}
+	opened, err := keyring.Open(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(opened, plaintext) {
+		t.Fatalf("expected %q, got %q", plaintext, opened)
+	}
+	// Data stored before encryption was enabled is returned unchanged.
+	if opened, err := keyring.Open(plaintext); err != nil ||
+		!bytes.Equal(opened, plaintext) {
+		t.Fatalf("plaintext should be returned unchanged: %q %v", opened, err)
+	}
+	for _, index := range []int{len(magic) + 1, len(sealed) - 1} {
+		tampered := append([]byte{}, sealed...)
+		tampered[index] ^= 1
+		if _, err := keyring.Open(tampered); err == nil {
+			t.Errorf("tampering with byte %d should be detected", index)
+		}
+	}
+	if _, err := keyring.Open(sealed[:len(magic)+2]); err == nil {
+		t.Error("truncated data should fail")
+	}
+	// The same ID with another passphrase cannot open it.
+	other, err := NewKeyring(&passphraseKey{id: "k1",
+		aead: newTestKey(t, "k2").(*passphraseKey).aead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Open(sealed); err == nil {
+		t.Error("wrong master key should fail")
+	}
+}
+
+func TestRotation(t *testing.T) {
+	k1 := newTestKey(t, "k1")
+	oldKeyring, err := NewKeyring(k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := oldKeyring.Seal([]byte("u2f key handle"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring, err := NewKeyring(newTestKey(t, "k2"), k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keyring.NeedsReseal(sealed) || !keyring.NeedsReseal([]byte("plain")) {
+		t.Fatal("data of the old key and plaintext should need resealing")
+	}
+	resealed, changed, err := keyring.Reseal(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed || keyring.NeedsReseal(resealed) {
+		t.Fatal("data was not resealed with the current key")
+	}
+	if _, err := oldKeyring.Open(resealed); err == nil {
+		t.Fatal("the old keyring should not know the new key")
+	}
+	opened, err := keyring.Open(resealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(opened) != "u2f key handle" {
+		t.Fatalf("unexpected data: %q", opened)
+	}
+	if _, changed, err := keyring.Reseal(resealed); err != nil || changed {
+		t.Fatalf("current data should not change: %v %v", changed, err)
+	}
+	if _, err := NewKeyring(k1, k1); err == nil {
+		t.Fatal("duplicate key IDs should fail")
+	}
+}
+
+func TestWrap(t *testing.T) {
+	backing := memstore.New()
+	keyring, err := NewKeyring(newTestKey(t, "k1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := Wrap(backing, keyring)
+	expiration := time.Now().Add(time.Hour).Unix()
+	if err := store.UpsertSigned("alice", 1, expiration, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	_, raw, err := backing.GetSigned("alice", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw == "secret" {
+		t.Fatal("data was stored in plaintext")
+	}
+	ok, data, err := store.GetSigned("alice", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || data != "secret" {
+		t.Fatalf("unexpected data: %v %q", ok, data)
+	}
+	if err := backing.UpsertSigned("bob", 1, expiration, "old"); err != nil {
+		t.Fatal(err)
+	}
+	if _, data, err := store.GetSigned("bob", 1); err != nil || data != "old" {
+		t.Fatalf("data stored before should be returned: %q %v", data, err)
+	}
+}
@@ -0,0 +1,236 @@
+package envelope
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/Cloud-Foundations/keymaster/lib/simplestorage"
+	"golang.org/x/crypto/scrypt"
+)
+
+const dataKeySize = 32
+
+// A sealed blob is the magic, the master key ID (length prefixed with a
+// byte), the wrapped data key (length prefixed with two bytes), the nonce
+// and the ciphertext. The header up to the nonce is authenticated.
+var magic = []byte("kmenv1:")
+
+func newKeyring(current MasterKey, old []MasterKey) (*Keyring, error) {
+	if current == nil {
+		return nil, errors.New("no current master key")
+	}
+	k := &Keyring{current: current, keys: make(map[string]MasterKey)}
+	for _, key := range append([]MasterKey{current}, old...) {
+		id := key.ID()
+		if id == "" || len(id) > 255 {
+			return nil, fmt.Errorf("invalid master key ID: %q", id)
+		}
+		if _, ok := k.keys[id]; ok {
+			return nil, fmt.Errorf("duplicate master key ID: %s", id)
+		}
+		k.keys[id] = key
+	}
+	return k, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func isSealed(data []byte) bool {
+	return bytes.HasPrefix(data, magic)
+}
+
+// parse returns the master key ID, wrapped data key, authenticated header,
+// nonce and ciphertext of a sealed blob.
+func parse(data []byte) (string, []byte, []byte, []byte, []byte, error) {
+	malformed := errors.New("malformed sealed data")
+	rest := data[len(magic):]
+	if len(rest) < 1 || len(rest) < 1+int(rest[0])+2 {
+		return "", nil, nil, nil, nil, malformed
+	}
+	idLength := int(rest[0])
+	id := string(rest[1 : 1+idLength])
+	rest = rest[1+idLength:]
+	wrappedLength := int(binary.BigEndian.Uint16(rest))
+	rest = rest[2:]
+	if len(rest) < wrappedLength {
+		return "", nil, nil, nil, nil, malformed
+	}
+	wrapped := rest[:wrappedLength]
+	rest = rest[wrappedLength:]
+	header := data[:len(data)-len(rest)]
+	// The nonce size of AES-GCM.
+	const nonceSize = 12
+	if len(rest) < nonceSize {
+		return "", nil, nil, nil, nil, malformed
+	}
+	return id, wrapped, header, rest[:nonceSize], rest[nonceSize:], nil
+}
+
+func (k *Keyring) seal(plaintext []byte) ([]byte, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	wrapped, err := k.current.WrapKey(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) > 0xffff {
+		return nil, errors.New("wrapped data key too long")
+	}
+	id := k.current.ID()
+	data := append([]byte{}, magic...)
+	data = append(data, byte(len(id)))
+	data = append(data, id...)
+	data = append(data, byte(len(wrapped)>>8), byte(len(wrapped)))
+	data = append(data, wrapped...)
+	header := len(data)
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	additionalData := append([]byte{}, data[:header]...)
+	data = append(data, nonce...)
+	return aead.Seal(data, nonce, plaintext, additionalData), nil
+}
+
+func (k *Keyring) open(data []byte) ([]byte, error) {
+	if !isSealed(data) {
+		return data, nil
+	}
+	id, wrapped, header, nonce, ciphertext, err := parse(data)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown master key: %s", id)
+	}
+	dataKey, err := key.UnwrapKey(wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("cannot unwrap data key with %s: %s", id, err)
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, nonce, ciphertext, header)
+}
+
+func (k *Keyring) needsReseal(data []byte) bool {
+	if !isSealed(data) {
+		return true
+	}
+	id, _, _, _, _, err := parse(data)
+	return err != nil || id != k.current.ID()
+}
+
+func (k *Keyring) reseal(data []byte) ([]byte, bool, error) {
+	if !k.needsReseal(data) {
+		return data, false, nil
+	}
+	plaintext, err := k.open(data)
+	if err != nil {
+		return nil, false, err
+	}
+	sealed, err := k.seal(plaintext)
+	if err != nil {
+		return nil, false, err
+	}
+	return sealed, true, nil
+}
+
+type passphraseKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+func newPassphraseKey(id string, passphrase []byte) (MasterKey, error) {
+	if len(passphrase) < 1 {
+		return nil, errors.New("empty passphrase")
+	}
+	salt := sha256.Sum256([]byte("keymaster envelope key " + id))
+	key, err := scrypt.Key(passphrase, salt[:], 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &passphraseKey{id: id, aead: aead}, nil
+}
+
+func (k *passphraseKey) ID() string {
+	return k.id
+}
+
+func (k *passphraseKey) WrapKey(dataKey []byte) ([]byte, error) {
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return k.aead.Seal(nonce, nonce, dataKey, []byte(k.id)), nil
+}
+
+func (k *passphraseKey) UnwrapKey(wrappedKey []byte) ([]byte, error) {
+	nonceSize := k.aead.NonceSize()
+	if len(wrappedKey) < nonceSize {
+		return nil, errors.New("wrapped key too short")
+	}
+	return k.aead.Open(nil, wrappedKey[:nonceSize], wrappedKey[nonceSize:],
+		[]byte(k.id))
+}
+
+type sealedStore struct {
+	store   simplestorage.SimpleStore
+	keyring *Keyring
+}
+
+func (s *sealedStore) UpsertSigned(key string, dataType int,
+	expiration int64, data string) error {
+	sealed, err := s.keyring.Seal([]byte(data))
+	if err != nil {
+		return err
+	}
+	return s.store.UpsertSigned(key, dataType, expiration,
+		base64.StdEncoding.EncodeToString(sealed))
+}
+
+func (s *sealedStore) DeleteSigned(key string, dataType int) error {
+	return s.store.DeleteSigned(key, dataType)
+}
+
+func (s *sealedStore) GetSigned(key string, dataType int) (
+	bool, string, error) {
+	ok, data, err := s.store.GetSigned(key, dataType)
+	if err != nil || !ok {
+		return ok, data, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(data)
+	if err != nil || !isSealed(sealed) {
+		return true, data, nil
+	}
+	plaintext, err := s.keyring.Open(sealed)
+	if err != nil {
+		return false, "", err
+	}
+	return true, string(plaintext), nil
+}
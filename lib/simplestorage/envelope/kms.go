@@ -0,0 +1,71 @@
+package envelope
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+const kmsRequestTimeout = 10 * time.Second
+
+// The encryption context binds wrapped data keys to keymaster storage.
+var kmsEncryptionContext = map[string]*string{
+	"purpose": aws.String("keymaster-storage"),
+}
+
+type awsKMSKey struct {
+	id    string
+	keyID string
+	kms   *kms.KMS
+}
+
+func newAWSKMSKey(id string, keyID string, region string) (MasterKey, error) {
+	if keyID == "" {
+		return nil, errors.New("no AWS KMS key ID")
+	}
+	options := session.Options{SharedConfigState: session.SharedConfigEnable}
+	if region != "" {
+		options.Config.Region = aws.String(region)
+	}
+	awsSession, err := session.NewSessionWithOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	return &awsKMSKey{id: id, keyID: keyID, kms: kms.New(awsSession)}, nil
+}
+
+func (k *awsKMSKey) ID() string {
+	return k.id
+}
+
+func (k *awsKMSKey) WrapKey(dataKey []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), kmsRequestTimeout)
+	defer cancel()
+	output, err := k.kms.EncryptWithContext(ctx, &kms.EncryptInput{
+		KeyId:             aws.String(k.keyID),
+		Plaintext:         dataKey,
+		EncryptionContext: kmsEncryptionContext,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output.CiphertextBlob, nil
+}
+
+func (k *awsKMSKey) UnwrapKey(wrappedKey []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), kmsRequestTimeout)
+	defer cancel()
+	output, err := k.kms.DecryptWithContext(ctx, &kms.DecryptInput{
+		KeyId:             aws.String(k.keyID),
+		CiphertextBlob:    wrappedKey,
+		EncryptionContext: kmsEncryptionContext,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output.Plaintext, nil
+}
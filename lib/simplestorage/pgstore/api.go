@@ -0,0 +1,78 @@
+// Package pgstore implements simplestorage.SimpleStore with PostgreSQL, so
+// that several keymasterd instances can share their state. It also manages
+// the schema of the keymasterd tables and provides transactional updates of
+// user profiles.
+package pgstore
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+)
+
+// PoolConfig configures the connection pool. Zero values keep the
+// database/sql defaults.
+type PoolConfig struct {
+	MaxOpenConns    int           `yaml:"max_open_conns"`
+	MaxIdleConns    int           `yaml:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime"`
+	ConnMaxIdleTime time.Duration `yaml:"conn_max_idle_time"`
+}
+
+// Store is a PostgreSQL database with the keymasterd schema.
+type Store struct {
+	db     *sql.DB
+	logger log.DebugLogger
+}
+
+// Open connects to the PostgreSQL database at url, configures the
+// connection pool and migrates the schema to the current version. Several
+// instances may migrate the same database concurrently.
+func Open(url string, pool PoolConfig, logger log.DebugLogger) (
+	*Store, error) {
+	return open(url, pool, logger)
+}
+
+// Close closes the database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// DB returns the database, for queries on tables the Store does not
+// provide methods for.
+func (s *Store) DB() *sql.DB {
+	return s.db
+}
+
+// SchemaVersion returns the version of the schema of the database.
+func (s *Store) SchemaVersion() (int, error) {
+	return s.schemaVersion()
+}
+
+// UpsertSigned inserts or replaces the data of key and dataType.
+func (s *Store) UpsertSigned(key string, dataType int, expiration int64,
+	data string) error {
+	return s.upsertSigned(key, dataType, expiration, data)
+}
+
+// DeleteSigned deletes the data of key and dataType.
+func (s *Store) DeleteSigned(key string, dataType int) error {
+	return s.deleteSigned(key, dataType)
+}
+
+// GetSigned returns true and the data of key and dataType if it exists and
+// has not expired, else false.
+func (s *Store) GetSigned(key string, dataType int) (bool, string, error) {
+	return s.getSigned(key, dataType)
+}
+
+// UpdateProfile calls update with the stored profile data of username (nil
+// if there is none) and stores the data it returns, in one transaction.
+// Nothing is stored if update returns nil data or an error. Updates of the
+// same profile, also from other instances, are serialized, so that update
+// always sees the latest data.
+func (s *Store) UpdateProfile(username string,
+	update func(data []byte) ([]byte, error)) error {
+	return s.updateProfile(username, update)
+}
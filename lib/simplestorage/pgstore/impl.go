@@ -0,0 +1,150 @@
+package pgstore
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log"
+	_ "github.com/lib/pq"
+)
+
+// migrationLockID is the advisory lock held while migrating, so that
+// instances starting together do not apply a migration twice.
+const migrationLockID = 0x6b6d7374
+
+func open(url string, pool PoolConfig, logger log.DebugLogger) (
+	*Store, error) {
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(pool.MaxOpenConns)
+	if pool.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(pool.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(pool.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(pool.ConnMaxIdleTime)
+	s := &Store{db: db, logger: logger}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) migrate() error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("select pg_advisory_xact_lock($1)", migrationLockID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`create table if not exists schema_migrations(version integer not null primary key, applied_epoch bigint not null);`)
+	if err != nil {
+		return err
+	}
+	var version int
+	err = tx.QueryRow(
+		"select coalesce(max(version), 0) from schema_migrations").Scan(
+		&version)
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("schema version %d is newer than supported version %d",
+			version, len(migrations))
+	}
+	for ; version < len(migrations); version++ {
+		if _, err := tx.Exec(migrations[version]); err != nil {
+			return fmt.Errorf("migration %d: %s", version+1, err)
+		}
+		_, err = tx.Exec(
+			"insert into schema_migrations(version, applied_epoch) values ($1, $2)",
+			version+1, time.Now().Unix())
+		if err != nil {
+			return err
+		}
+		s.logger.Printf("migrated storage schema to version %d", version+1)
+	}
+	return tx.Commit()
+}
+
+func (s *Store) schemaVersion() (int, error) {
+	var version int
+	err := s.db.QueryRow(
+		"select coalesce(max(version), 0) from schema_migrations").Scan(
+		&version)
+	return version, err
+}
+
+func (s *Store) upsertSigned(key string, dataType int, expiration int64,
+	data string) error {
+	_, err := s.db.Exec(`insert into expiring_signed_user_data(username, type, jws_data, expiration_epoch, update_epoch) values ($1,$2,$3,$4,$5) on CONFLICT(username,type) DO UPDATE set jws_data = excluded.jws_data, expiration_epoch = excluded.expiration_epoch, update_epoch = excluded.update_epoch`,
+		key, dataType, data, expiration, time.Now().Unix())
+	return err
+}
+
+func (s *Store) deleteSigned(key string, dataType int) error {
+	_, err := s.db.Exec(
+		"delete from expiring_signed_user_data where username = $1 and type = $2",
+		key, dataType)
+	return err
+}
+
+func (s *Store) getSigned(key string, dataType int) (bool, string, error) {
+	var data string
+	var expiration int64
+	err := s.db.QueryRow(
+		"select jws_data, expiration_epoch from expiring_signed_user_data where username = $1 and type = $2",
+		key, dataType).Scan(&data, &expiration)
+	if err == sql.ErrNoRows {
+		return false, "", nil
+	}
+	if err != nil {
+		return false, "", err
+	}
+	if expiration < time.Now().Unix() {
+		return false, "", nil
+	}
+	return true, data, nil
+}
+
+func (s *Store) updateProfile(username string,
+	update func(data []byte) ([]byte, error)) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// A row lock cannot serialize the creation of a profile, so lock the
+	// username instead.
+	_, err = tx.Exec("select pg_advisory_xact_lock(hashtext($1))",
+		"user_profile:"+username)
+	if err != nil {
+		return err
+	}
+	var data []byte
+	err = tx.QueryRow(
+		"select profile_data from user_profile where username = $1",
+		username).Scan(&data)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	newData, err := update(data)
+	if err != nil {
+		return err
+	}
+	if newData == nil {
+		return nil
+	}
+	_, err = tx.Exec("insert into user_profile(username, profile_data) values ($1,$2) on CONFLICT(username) DO UPDATE set profile_data = excluded.profile_data",
+		username, newData)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,14 @@
+package pgstore
+
+// migrations are applied in order, each in the transaction which records
+// its version in schema_migrations. Applied migrations must never change.
+var migrations = []string{
+	// 1: The tables keymasterd created before the schema was versioned.
+	`create table if not exists user_profile (id serial not null primary key, username text unique, profile_data bytea);
+create table if not exists expiring_signed_user_data(id serial not null primary key, username text not null, jws_data text not null, type integer not null, expiration_epoch integer not null, update_epoch integer not null, UNIQUE(username,type));
+create table if not exists revoked_certificate(id serial not null primary key, cert_type text not null, serial text not null, revoked_by text not null, reason integer not null, revocation_epoch bigint not null, UNIQUE(cert_type,serial));
+create table if not exists service_account(id serial not null primary key, name text unique, account_data bytea);`,
+	// 2: Epochs past 2038 and an index for the removal of expired data.
+	`alter table expiring_signed_user_data alter column expiration_epoch type bigint, alter column update_epoch type bigint;
+create index if not exists expiring_signed_user_data_expiration on expiring_signed_user_data(expiration_epoch);`,
+}
@@ -0,0 +1,111 @@
+package pgstore
+
+import (
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Cloud-Foundations/Dominator/lib/log/testlogger"
+	"github.com/Cloud-Foundations/keymaster/lib/simplestorage"
+)
+
+var _ simplestorage.SimpleStore = (*Store)(nil)
+
+// openTestStore opens the database in $KEYMASTER_TEST_POSTGRES_URL, which
+// must be a scratch database, or skips the test.
+func openTestStore(t *testing.T) *Store {
+	url := os.Getenv("KEYMASTER_TEST_POSTGRES_URL")
+	if url == "" {
+		t.Skip("KEYMASTER_TEST_POSTGRES_URL not set")
+	}
+	s, err := Open(url, PoolConfig{MaxOpenConns: 4}, testlogger.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestMigrate(t *testing.T) {
+	s := openTestStore(t)
+	defer s.Close()
+	// Migrating again is a no-op.
+	if err := s.migrate(); err != nil {
+		t.Fatal(err)
+	}
+	version, err := s.SchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != len(migrations) {
+		t.Fatalf("expected schema version %d, got %d", len(migrations),
+			version)
+	}
+	if max := s.DB().Stats().MaxOpenConnections; max != 4 {
+		t.Fatalf("pool not configured: %d", max)
+	}
+}
+
+func TestSigned(t *testing.T) {
+	s := openTestStore(t)
+	defer s.Close()
+	expiration := time.Now().Add(time.Hour).Unix()
+	if err := s.UpsertSigned("pgstore-test", 1, expiration, "one"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpsertSigned("pgstore-test", 1, expiration, "two"); err != nil {
+		t.Fatal(err)
+	}
+	ok, data, err := s.GetSigned("pgstore-test", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || data != "two" {
+		t.Fatalf("unexpected data: %v %s", ok, data)
+	}
+	err = s.UpsertSigned("pgstore-test", 2, time.Now().Unix()-1, "expired")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _, err := s.GetSigned("pgstore-test", 2); err != nil || ok {
+		t.Fatalf("expired data returned: %v %v", ok, err)
+	}
+	if err := s.DeleteSigned("pgstore-test", 1); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _, err := s.GetSigned("pgstore-test", 1); err != nil || ok {
+		t.Fatalf("deleted data returned: %v %v", ok, err)
+	}
+}
+
+func TestUpdateProfile(t *testing.T) {
+	s := openTestStore(t)
+	defer s.Close()
+	username := "pgstore-test-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	const numUpdates = 20
+	var wg sync.WaitGroup
+	for i := 0; i < numUpdates; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := s.UpdateProfile(username, func(data []byte) ([]byte, error) {
+				count, _ := strconv.Atoi(string(data))
+				return []byte(strconv.Itoa(count + 1)), nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	err := s.UpdateProfile(username, func(data []byte) ([]byte, error) {
+		if string(data) != strconv.Itoa(numUpdates) {
+			t.Errorf("lost updates: %s", data)
+		}
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
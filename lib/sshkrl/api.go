@@ -0,0 +1,34 @@
+// Package sshkrl generates OpenSSH Key Revocation Lists (KRLs), as described
+// in PROTOCOL.krl in the OpenSSH sources. A KRL is used with the
+// RevokedKeys option of sshd.
+package sshkrl
+
+import (
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// KRL holds the revocations to put in a KRL.
+type KRL struct {
+	// Version should increase with each new KRL.
+	Version       uint64
+	GeneratedDate time.Time
+	Comment       string
+	// Certificates lists the revoked certificate serial numbers of each CA.
+	Certificates []RevokedCertificates
+	// Keys are revoked public keys. Certificates for them are revoked too.
+	Keys []ssh.PublicKey
+}
+
+// RevokedCertificates lists the serial numbers of revoked certificates
+// signed by CAKey.
+type RevokedCertificates struct {
+	CAKey   ssh.PublicKey
+	Serials []uint64
+}
+
+// Marshal returns the binary encoding of the KRL. The KRL is not signed.
+func (krl *KRL) Marshal() []byte {
+	return krl.marshal()
+}
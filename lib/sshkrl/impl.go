@@ -0,0 +1,71 @@
+package sshkrl
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+const (
+	krlMagic         = 0x5353484b524c0a00 // "SSHKRL\n\0"
+	krlFormatVersion = 1
+
+	sectionCertificates = 1
+	sectionExplicitKey  = 2
+
+	certSectionSerialList = 0x20
+)
+
+func appendUint32(buffer []byte, value uint32) []byte {
+	return binary.BigEndian.AppendUint32(buffer, value)
+}
+
+func appendUint64(buffer []byte, value uint64) []byte {
+	return binary.BigEndian.AppendUint64(buffer, value)
+}
+
+func appendString(buffer []byte, value []byte) []byte {
+	return append(appendUint32(buffer, uint32(len(value))), value...)
+}
+
+func appendSection(buffer []byte, sectionType byte, data []byte) []byte {
+	return appendString(append(buffer, sectionType), data)
+}
+
+func (krl *KRL) marshal() []byte {
+	buffer := appendUint64(nil, krlMagic)
+	buffer = appendUint32(buffer, krlFormatVersion)
+	buffer = appendUint64(buffer, krl.Version)
+	var generatedDate uint64
+	if !krl.GeneratedDate.IsZero() {
+		generatedDate = uint64(krl.GeneratedDate.Unix())
+	}
+	buffer = appendUint64(buffer, generatedDate)
+	buffer = appendUint64(buffer, 0) // Flags.
+	buffer = appendString(buffer, nil)
+	buffer = appendString(buffer, []byte(krl.Comment))
+	for _, revoked := range krl.Certificates {
+		if len(revoked.Serials) < 1 {
+			continue
+		}
+		serials := append([]uint64{}, revoked.Serials...)
+		sort.Slice(serials, func(i, j int) bool {
+			return serials[i] < serials[j]
+		})
+		var serialList []byte
+		for _, serial := range serials {
+			serialList = appendUint64(serialList, serial)
+		}
+		data := appendString(nil, revoked.CAKey.Marshal())
+		data = appendString(data, nil)
+		data = appendSection(data, certSectionSerialList, serialList)
+		buffer = appendSection(buffer, sectionCertificates, data)
+	}
+	if len(krl.Keys) > 0 {
+		var data []byte
+		for _, key := range krl.Keys {
+			data = appendString(data, key.Marshal())
+		}
+		buffer = appendSection(buffer, sectionExplicitKey, data)
+	}
+	return buffer
+}
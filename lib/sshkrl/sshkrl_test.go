@@ -0,0 +1,113 @@
+package sshkrl
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestKey(t *testing.T) (ssh.PublicKey, ssh.Signer) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromSigner(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer.PublicKey(), signer
+}
+
+func newTestCert(t *testing.T, caSigner ssh.Signer, serial uint64) *ssh.Certificate {
+	userKey, _ := newTestKey(t)
+	cert := &ssh.Certificate{
+		Key:             userKey,
+		Serial:          serial,
+		CertType:        ssh.UserCert,
+		KeyId:           "test",
+		ValidPrincipals: []string{"username"},
+		ValidAfter:      uint64(time.Now().Unix()),
+		ValidBefore:     uint64(time.Now().Add(time.Hour).Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, caSigner); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestMarshalHeader(t *testing.T) {
+	krl := KRL{Version: 3, GeneratedDate: time.Unix(1000, 0)}
+	data := krl.Marshal()
+	expected := []byte("SSHKRL\n\x00\x00\x00\x00\x01" +
+		"\x00\x00\x00\x00\x00\x00\x00\x03" +
+		"\x00\x00\x00\x00\x00\x00\x03\xe8" +
+		"\x00\x00\x00\x00\x00\x00\x00\x00" +
+		"\x00\x00\x00\x00\x00\x00\x00\x00")
+	if !bytes.Equal(data, expected) {
+		t.Fatalf("unexpected KRL: %q", data)
+	}
+}
+
+// TestOpenSSH checks that ssh-keygen accepts the KRL and agrees on which keys
+// it revokes.
+func TestOpenSSH(t *testing.T) {
+	sshKeygen, err := exec.LookPath("ssh-keygen")
+	if err != nil {
+		t.Skip("ssh-keygen not found")
+	}
+	dir, err := ioutil.TempDir("", "sshkrl_testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caKey, caSigner := newTestKey(t)
+	revokedCert := newTestCert(t, caSigner, 1234)
+	goodCert := newTestCert(t, caSigner, 1235)
+	revokedKey, _ := newTestKey(t)
+	goodKey, _ := newTestKey(t)
+	krl := KRL{
+		Version:       1,
+		GeneratedDate: time.Now(),
+		Comment:       "test",
+		Certificates: []RevokedCertificates{
+			{CAKey: caKey, Serials: []uint64{99, 1234, 5}},
+		},
+		Keys: []ssh.PublicKey{revokedKey},
+	}
+	krlFilename := filepath.Join(dir, "krl")
+	if err := ioutil.WriteFile(krlFilename, krl.Marshal(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for name, test := range map[string]struct {
+		key     ssh.PublicKey
+		revoked bool
+	}{
+		"revokedCert": {revokedCert, true},
+		"goodCert":    {goodCert, false},
+		"revokedKey":  {revokedKey, true},
+		"goodKey":     {goodKey, false},
+	} {
+		keyFilename := filepath.Join(dir, name+".pub")
+		err := ioutil.WriteFile(keyFilename, ssh.MarshalAuthorizedKey(test.key),
+			0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := exec.Command(sshKeygen, "-Q", "-f", krlFilename,
+			keyFilename).CombinedOutput()
+		if _, ok := err.(*exec.ExitError); err != nil && !ok {
+			t.Fatal(err)
+		}
+		if revoked := err != nil; revoked != test.revoked {
+			t.Errorf("%s: expected revoked=%v: %s", name, test.revoked, output)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+// Package tpmattest verifies that a key was generated in a TPM. The TPM
+// certifies the key (with TPM2_Certify) with an attestation key (AK), whose
+// certificate is issued by a CA which checked that the AK is held in a TPM,
+// usually by activating a credential with the endorsement key. Clients send
+// the attestation with their certificate requests, in the
+// proto.TPMAttestationHeader header, as
+// "v1 <AK certificate> <public area> <certify info> <signature>": the
+// base64url encoded DER certificate, TPMT_PUBLIC of the key, TPMS_ATTEST
+// and TPMT_SIGNATURE.
+package tpmattest
+
+import (
+	"crypto"
+	"crypto/x509"
+)
+
+// Attestation describes an attested key.
+type Attestation struct {
+	PublicKey     crypto.PublicKey
+	AKCertificate *x509.Certificate
+}
+
+// Header returns the header value sending the DER encoded AK certificate
+// akCert and the public area, certify info and signature returned by
+// TPM2_Certify.
+func Header(akCert, public, certifyInfo, signature []byte) string {
+	return header(akCert, public, certifyInfo, signature)
+}
+
+// Verify checks the attestation in header against the AK CAs roots and
+// returns what it attests. Only keys which cannot leave the TPM, and which
+// it generated, are accepted.
+func Verify(header string, roots *x509.CertPool) (*Attestation, error) {
+	return verify(header, roots)
+}
@@ -0,0 +1,307 @@
+package tpmattest
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+const (
+	headerVersion = "v1"
+
+	algRSA    = 0x0001
+	algSHA1   = 0x0004
+	algSHA256 = 0x000b
+	algSHA384 = 0x000c
+	algSHA512 = 0x000d
+	algNull   = 0x0010
+	algRSASSA = 0x0014
+	algRSAPSS = 0x0016
+	algECDSA  = 0x0018
+	algECC    = 0x0023
+
+	curveNISTP256 = 0x0003
+	curveNISTP384 = 0x0004
+
+	attestMagic   = 0xff544347
+	attestCertify = 0x8017
+
+	attributeFixedTPM            = 0x00000002
+	attributeFixedParent         = 0x00000010
+	attributeSensitiveDataOrigin = 0x00000020
+	// Keys must not leave the TPM and must have been generated by it.
+	requiredAttributes = attributeFixedTPM | attributeFixedParent |
+		attributeSensitiveDataOrigin
+)
+
+var (
+	hashes = map[uint16]crypto.Hash{
+		algSHA1:   crypto.SHA1,
+		algSHA256: crypto.SHA256,
+		algSHA384: crypto.SHA384,
+		algSHA512: crypto.SHA512,
+	}
+	curves = map[uint16]elliptic.Curve{
+		curveNISTP256: elliptic.P256(),
+		curveNISTP384: elliptic.P384(),
+	}
+)
+
+var errTruncated = errors.New("truncated TPM structure")
+
+// reader decodes TPM structures, which are big endian.
+type reader struct {
+	data []byte
+	err  error
+}
+
+func (r *reader) bytes(length int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.data) < length {
+		r.err = errTruncated
+		return nil
+	}
+	value := r.data[:length]
+	r.data = r.data[length:]
+	return value
+}
+
+func (r *reader) uint16() uint16 {
+	if value := r.bytes(2); value != nil {
+		return binary.BigEndian.Uint16(value)
+	}
+	return 0
+}
+
+func (r *reader) uint32() uint32 {
+	if value := r.bytes(4); value != nil {
+		return binary.BigEndian.Uint32(value)
+	}
+	return 0
+}
+
+// sized reads a TPM2B structure: a 16 bit size and that many bytes.
+func (r *reader) sized() []byte {
+	return r.bytes(int(r.uint16()))
+}
+
+// scheme reads an algorithm which, unless it is TPM_ALG_NULL, is followed
+// by extra parameters of 16 bits each.
+func (r *reader) scheme(extraParameters int) {
+	if r.uint16() != algNull {
+		r.bytes(2 * extraParameters)
+	}
+}
+
+func header(akCert, public, certifyInfo, signature []byte) string {
+	fields := []string{headerVersion}
+	for _, value := range [][]byte{akCert, public, certifyInfo, signature} {
+		fields = append(fields, base64.RawURLEncoding.EncodeToString(value))
+	}
+	return strings.Join(fields, " ")
+}
+
+// parsePublic returns the key of the TPMT_PUBLIC public and its name.
+func parsePublic(public []byte) (crypto.PublicKey, []byte, error) {
+	r := &reader{data: public}
+	keyType := r.uint16()
+	nameAlg := r.uint16()
+	attributes := r.uint32()
+	r.sized() // The auth policy.
+	var publicKey crypto.PublicKey
+	switch keyType {
+	case algRSA:
+		r.scheme(2) // The symmetric algorithm, with key bits and mode.
+		r.scheme(1) // The signature scheme, with its hash.
+		keyBits := r.uint16()
+		exponent := r.uint32()
+		modulus := r.sized()
+		if r.err != nil {
+			return nil, nil, r.err
+		}
+		if exponent == 0 {
+			exponent = 65537
+		}
+		if len(modulus)*8 != int(keyBits) {
+			return nil, nil, errors.New("RSA modulus size mismatch")
+		}
+		publicKey = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(modulus),
+			E: int(exponent),
+		}
+	case algECC:
+		r.scheme(2)
+		r.scheme(1)
+		curveID := r.uint16()
+		r.scheme(1) // The KDF scheme, with its hash.
+		x := r.sized()
+		y := r.sized()
+		if r.err != nil {
+			return nil, nil, r.err
+		}
+		curve, ok := curves[curveID]
+		if !ok {
+			return nil, nil, fmt.Errorf("unsupported curve 0x%04x", curveID)
+		}
+		key := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, nil, errors.New("ECC point not on curve")
+		}
+		publicKey = key
+	default:
+		return nil, nil, fmt.Errorf("unsupported key type 0x%04x", keyType)
+	}
+	if len(r.data) > 0 {
+		return nil, nil, errors.New("trailing data after public area")
+	}
+	if attributes&requiredAttributes != requiredAttributes {
+		return nil, nil, fmt.Errorf(
+			"key may leave the TPM or was not generated by it (attributes 0x%08x)",
+			attributes)
+	}
+	hash, ok := hashes[nameAlg]
+	if !ok || !hash.Available() {
+		return nil, nil, fmt.Errorf("unsupported name algorithm 0x%04x",
+			nameAlg)
+	}
+	hasher := hash.New()
+	hasher.Write(public)
+	name := make([]byte, 2, 2+hash.Size())
+	binary.BigEndian.PutUint16(name, nameAlg)
+	return publicKey, hasher.Sum(name), nil
+}
+
+// parseCertifyInfo returns the name of the key certified by the TPMS_ATTEST
+// certifyInfo.
+func parseCertifyInfo(certifyInfo []byte) ([]byte, error) {
+	r := &reader{data: certifyInfo}
+	magic := r.uint32()
+	attestType := r.uint16()
+	r.sized()   // The qualified signer.
+	r.sized()   // The extra data.
+	r.bytes(17) // The clock info.
+	r.bytes(8)  // The firmware version.
+	name := r.sized()
+	r.sized() // The qualified name.
+	if r.err != nil {
+		return nil, r.err
+	}
+	if magic != attestMagic {
+		return nil, errors.New("not generated by a TPM")
+	}
+	if attestType != attestCertify {
+		return nil, fmt.Errorf("attestation type 0x%04x is not certify",
+			attestType)
+	}
+	return name, nil
+}
+
+// checkSignature checks the TPMT_SIGNATURE signature of data by publicKey.
+func checkSignature(publicKey crypto.PublicKey, data []byte,
+	signature []byte) error {
+	r := &reader{data: signature}
+	sigAlg := r.uint16()
+	hashAlg := r.uint16()
+	hash, ok := hashes[hashAlg]
+	if !ok || !hash.Available() {
+		return fmt.Errorf("unsupported signature hash 0x%04x", hashAlg)
+	}
+	hasher := hash.New()
+	hasher.Write(data)
+	digest := hasher.Sum(nil)
+	switch sigAlg {
+	case algRSASSA, algRSAPSS:
+		value := r.sized()
+		if r.err != nil {
+			return r.err
+		}
+		key, ok := publicKey.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("RSA signature by a non-RSA key")
+		}
+		if sigAlg == algRSASSA {
+			return rsa.VerifyPKCS1v15(key, hash, digest, value)
+		}
+		return rsa.VerifyPSS(key, hash, digest, value, nil)
+	case algECDSA:
+		rValue := r.sized()
+		sValue := r.sized()
+		if r.err != nil {
+			return r.err
+		}
+		key, ok := publicKey.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("ECDSA signature by a non-ECDSA key")
+		}
+		if !ecdsa.Verify(key, digest, new(big.Int).SetBytes(rValue),
+			new(big.Int).SetBytes(sValue)) {
+			return errors.New("invalid ECDSA signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported signature algorithm 0x%04x", sigAlg)
+}
+
+func verify(header string, roots *x509.CertPool) (*Attestation, error) {
+	if roots == nil {
+		return nil, errors.New("no attestation roots")
+	}
+	fields := strings.Fields(header)
+	if len(fields) != 5 || fields[0] != headerVersion {
+		return nil, errors.New("malformed attestation")
+	}
+	var values [][]byte
+	for _, field := range fields[1:] {
+		value, err := base64.RawURLEncoding.DecodeString(field)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	akCert, err := x509.ParseCertificate(values[0])
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse AK certificate: %s", err)
+	}
+	_, err = akCert.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("AK certificate: %s", err)
+	}
+	public, certifyInfo, signature := values[1], values[2], values[3]
+	if err := checkSignature(akCert.PublicKey, certifyInfo,
+		signature); err != nil {
+		return nil, fmt.Errorf("certify info: %s", err)
+	}
+	certifiedName, err := parseCertifyInfo(certifyInfo)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, name, err := parsePublic(public)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(name, certifiedName) {
+		return nil, errors.New("public area is not the certified key")
+	}
+	return &Attestation{PublicKey: publicKey, AKCertificate: akCert}, nil
+}
@@ -0,0 +1,200 @@
+package tpmattest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// writer encodes TPM structures.
+type writer struct {
+	data []byte
+}
+
+func (w *writer) uint16(value uint16) *writer {
+	buf := make([]byte, 2)
+	binary.BigEndian.PutUint16(buf, value)
+	w.data = append(w.data, buf...)
+	return w
+}
+
+func (w *writer) uint32(value uint32) *writer {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, value)
+	w.data = append(w.data, buf...)
+	return w
+}
+
+func (w *writer) sized(value []byte) *writer {
+	w.uint16(uint16(len(value)))
+	w.data = append(w.data, value...)
+	return w
+}
+
+func makeECCPublic(key *ecdsa.PublicKey, attributes uint32) []byte {
+	w := &writer{}
+	w.uint16(algECC).uint16(algSHA256).uint32(attributes).sized(nil)
+	w.uint16(algNull)                    // Symmetric.
+	w.uint16(algECDSA).uint16(algSHA256) // Scheme.
+	w.uint16(curveNISTP256)
+	w.uint16(algNull) // KDF.
+	w.sized(key.X.FillBytes(make([]byte, 32)))
+	w.sized(key.Y.FillBytes(make([]byte, 32)))
+	return w.data
+}
+
+func makeRSAPublic(key *rsa.PublicKey, attributes uint32) []byte {
+	w := &writer{}
+	w.uint16(algRSA).uint16(algSHA256).uint32(attributes).sized(nil)
+	w.uint16(algNull).uint16(algNull)
+	w.uint16(uint16(key.N.BitLen())).uint32(0)
+	w.sized(key.N.Bytes())
+	return w.data
+}
+
+func makeName(public []byte) []byte {
+	hash := sha256.Sum256(public)
+	return append([]byte{0, algSHA256}, hash[:]...)
+}
+
+func makeCertifyInfo(name []byte) []byte {
+	w := &writer{}
+	w.uint32(attestMagic).uint16(attestCertify)
+	w.sized([]byte("signer")).sized([]byte("nonce"))
+	w.data = append(w.data, make([]byte, 17+8)...)
+	w.sized(name).sized([]byte("qualified"))
+	return w.data
+}
+
+func sign(t *testing.T, key *ecdsa.PrivateKey, data []byte) []byte {
+	digest := sha256.Sum256(data)
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &writer{}
+	w.uint16(algECDSA).uint16(algSHA256).sized(r.Bytes()).sized(s.Bytes())
+	return w.data
+}
+
+func generateKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func makeAK(t *testing.T) (*x509.CertPool, *ecdsa.PrivateKey, []byte) {
+	rootKey := generateKey(t)
+	akKey := generateKey(t)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "AK CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	rootDER, err := x509.CreateCertificate(rand.Reader, template, template,
+		rootKey.Public(), rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := x509.ParseCertificate(rootDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	akTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "host.example.com AK"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	akDER, err := x509.CreateCertificate(rand.Reader, akTemplate, root,
+		akKey.Public(), rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	return roots, akKey, akDER
+}
+
+func TestVerify(t *testing.T) {
+	roots, akKey, akCert := makeAK(t)
+	key := generateKey(t)
+	public := makeECCPublic(&key.PublicKey, requiredAttributes)
+	certifyInfo := makeCertifyInfo(makeName(public))
+	attestation, err := Verify(Header(akCert, public, certifyInfo,
+		sign(t, akKey, certifyInfo)), roots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.PublicKey.Equal(attestation.PublicKey) ||
+		attestation.AKCertificate.Subject.CommonName != "host.example.com AK" {
+		t.Fatalf("unexpected attestation: %+v", attestation)
+	}
+}
+
+func TestVerifyInvalid(t *testing.T) {
+	roots, akKey, akCert := makeAK(t)
+	otherRoots, _, _ := makeAK(t)
+	key := generateKey(t)
+	public := makeECCPublic(&key.PublicKey, requiredAttributes)
+	certifyInfo := makeCertifyInfo(makeName(public))
+	signature := sign(t, akKey, certifyInfo)
+	exportable := makeECCPublic(&key.PublicKey, attributeFixedParent)
+	exportableInfo := makeCertifyInfo(makeName(exportable))
+	otherKey := generateKey(t)
+	otherPublic := makeECCPublic(&otherKey.PublicKey, requiredAttributes)
+	for name, test := range map[string]struct {
+		header string
+		roots  *x509.CertPool
+	}{
+		"malformed": {"v1 junk", roots},
+		"no roots":  {Header(akCert, public, certifyInfo, signature), nil},
+		"other roots": {Header(akCert, public, certifyInfo, signature),
+			otherRoots},
+		"bad signature": {Header(akCert, public, certifyInfo,
+			sign(t, otherKey, certifyInfo)), roots},
+		"other key": {Header(akCert, otherPublic, certifyInfo, signature),
+			roots},
+		"exportable": {Header(akCert, exportable, exportableInfo,
+			sign(t, akKey, exportableInfo)), roots},
+	} {
+		if _, err := Verify(test.header, test.roots); err == nil {
+			t.Errorf("%s: verified", name)
+		}
+	}
+}
+
+func TestParseRSAPublic(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := makeRSAPublic(&key.PublicKey, requiredAttributes)
+	publicKey, name, err := parsePublic(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.PublicKey.Equal(publicKey) {
+		t.Fatalf("unexpected key %v", publicKey)
+	}
+	if len(name) != 2+sha256.Size {
+		t.Fatalf("unexpected name %x", name)
+	}
+	if _, _, err := parsePublic(public[:len(public)-1]); err == nil {
+		t.Fatal("truncated public area parsed")
+	}
+}
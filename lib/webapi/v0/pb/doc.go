@@ -0,0 +1,6 @@
+// Package pb holds the messages and services of the keymaster gRPC API,
+// generated from keymaster.proto. See keymaster.proto for how calls are
+// authenticated.
+package pb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative keymaster.proto
@@ -0,0 +1,833 @@
+// The keymaster gRPC API offers the login, second factor and issuance
+// operations of the JSON web API (lib/webapi/v0/proto) to clients generated
+// from this file. Calls are handled like the matching web API requests, with
+// the same checks and denials.
+//
+// Login returns a session token, which the other calls send in the
+// "keymaster-session" metadata key. VerifyOTP and an approved Push return
+// the token to use after the second factor. The values of the
+// "x-keymaster-device", "x-keymaster-piv-attestation" and
+// "x-keymaster-tpm-attestation" metadata keys are passed on like the HTTP
+// headers of the same names. Denials carry their reason code (see
+// proto.DenialResponse) in the "keymaster-denial-reason" trailer.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
+// source: keymaster.proto
+
+package pb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type PushStatus_State int32
+
+const (
+	PushStatus_STATE_UNSPECIFIED PushStatus_State = 0
+	PushStatus_PENDING           PushStatus_State = 1
+	PushStatus_APPROVED          PushStatus_State = 2
+	PushStatus_DENIED            PushStatus_State = 3
+)
+
+// Enum value maps for PushStatus_State.
+var (
+	PushStatus_State_name = map[int32]string{
+		0: "STATE_UNSPECIFIED",
+		1: "PENDING",
+		2: "APPROVED",
+		3: "DENIED",
+	}
+	PushStatus_State_value = map[string]int32{
+		"STATE_UNSPECIFIED": 0,
+		"PENDING":           1,
+		"APPROVED":          2,
+		"DENIED":            3,
+	}
+)
+
+func (x PushStatus_State) Enum() *PushStatus_State {
+	p := new(PushStatus_State)
+	*p = x
+	return p
+}
+
+func (x PushStatus_State) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (PushStatus_State) Descriptor() protoreflect.EnumDescriptor {
+	return file_keymaster_proto_enumTypes[0].Descriptor()
+}
+
+func (PushStatus_State) Type() protoreflect.EnumType {
+	return &file_keymaster_proto_enumTypes[0]
+}
+
+func (x PushStatus_State) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use PushStatus_State.Descriptor instead.
+func (PushStatus_State) EnumDescriptor() ([]byte, []int) {
+	return file_keymaster_proto_rawDescGZIP(), []int{5, 0}
+}
+
+type LoginRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Username      string                 `protobuf:"bytes,1,opt,name=username,proto3" json:"username,omitempty"`
+	Password      string                 `protobuf:"bytes,2,opt,name=password,proto3" json:"password,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *LoginRequest) Reset() {
+	*x = LoginRequest{}
+	mi := &file_keymaster_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *LoginRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LoginRequest) ProtoMessage() {}
+
+func (x *LoginRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_keymaster_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LoginRequest.ProtoReflect.Descriptor instead.
+func (*LoginRequest) Descriptor() ([]byte, []int) {
+	return file_keymaster_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *LoginRequest) GetUsername() string {
+	if x != nil {
+		return x.Username
+	}
+	return ""
+}
+
+func (x *LoginRequest) GetPassword() string {
+	if x != nil {
+		return x.Password
+	}
+	return ""
+}
+
+type LoginResponse struct {
+	state        protoimpl.MessageState `protogen:"open.v1"`
+	SessionToken string                 `protobuf:"bytes,1,opt,name=session_token,json=sessionToken,proto3" json:"session_token,omitempty"`
+	// The auth types (such as "U2F" or "TOTP") one of which completes the
+	// login, or "password" if none is needed.
+	AuthBackends      []string `protobuf:"bytes,2,rep,name=auth_backends,json=authBackends,proto3" json:"auth_backends,omitempty"`
+	SupportedKeyTypes []string `protobuf:"bytes,3,rep,name=supported_key_types,json=supportedKeyTypes,proto3" json:"supported_key_types,omitempty"`
+	// Seconds until the password expires, if the password backend warns.
+	PasswordExpiresIn int64 `protobuf:"varint,4,opt,name=password_expires_in,json=passwordExpiresIn,proto3" json:"password_expires_in,omitempty"`
+	unknownFields     protoimpl.UnknownFields
+	sizeCache         protoimpl.SizeCache
+}
+
+func (x *LoginResponse) Reset() {
+	*x = LoginResponse{}
+	mi := &file_keymaster_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *LoginResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LoginResponse) ProtoMessage() {}
+
+func (x *LoginResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_keymaster_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LoginResponse.ProtoReflect.Descriptor instead.
+func (*LoginResponse) Descriptor() ([]byte, []int) {
+	return file_keymaster_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *LoginResponse) GetSessionToken() string {
+	if x != nil {
+		return x.SessionToken
+	}
+	return ""
+}
+
+func (x *LoginResponse) GetAuthBackends() []string {
+	if x != nil {
+		return x.AuthBackends
+	}
+	return nil
+}
+
+func (x *LoginResponse) GetSupportedKeyTypes() []string {
+	if x != nil {
+		return x.SupportedKeyTypes
+	}
+	return nil
+}
+
+func (x *LoginResponse) GetPasswordExpiresIn() int64 {
+	if x != nil {
+		return x.PasswordExpiresIn
+	}
+	return 0
+}
+
+type VerifyOTPRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// The auth type of the second factor: "TOTP", "SymantecVIP", "RADIUS",
+	// "Duo" or "RecoveryCode".
+	AuthType string `protobuf:"bytes,1,opt,name=auth_type,json=authType,proto3" json:"auth_type,omitempty"`
+	Otp      string `protobuf:"bytes,2,opt,name=otp,proto3" json:"otp,omitempty"`
+	// The state of a RADIUS challenge being answered.
+	State         string `protobuf:"bytes,3,opt,name=state,proto3" json:"state,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *VerifyOTPRequest) Reset() {
+	*x = VerifyOTPRequest{}
+	mi := &file_keymaster_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *VerifyOTPRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*VerifyOTPRequest) ProtoMessage() {}
+
+func (x *VerifyOTPRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_keymaster_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use VerifyOTPRequest.ProtoReflect.Descriptor instead.
+func (*VerifyOTPRequest) Descriptor() ([]byte, []int) {
+	return file_keymaster_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *VerifyOTPRequest) GetAuthType() string {
+	if x != nil {
+		return x.AuthType
+	}
+	return ""
+}
+
+func (x *VerifyOTPRequest) GetOtp() string {
+	if x != nil {
+		return x.Otp
+	}
+	return ""
+}
+
+func (x *VerifyOTPRequest) GetState() string {
+	if x != nil {
+		return x.State
+	}
+	return ""
+}
+
+type VerifyOTPResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Empty if the RADIUS server asked for another response.
+	SessionToken string `protobuf:"bytes,1,opt,name=session_token,json=sessionToken,proto3" json:"session_token,omitempty"`
+	// The RADIUS challenge to answer with another VerifyOTP of its state.
+	ChallengeMessage string `protobuf:"bytes,2,opt,name=challenge_message,json=challengeMessage,proto3" json:"challenge_message,omitempty"`
+	State            string `protobuf:"bytes,3,opt,name=state,proto3" json:"state,omitempty"`
+	unknownFields    protoimpl.UnknownFields
+	sizeCache        protoimpl.SizeCache
+}
+
+func (x *VerifyOTPResponse) Reset() {
+	*x = VerifyOTPResponse{}
+	mi := &file_keymaster_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *VerifyOTPResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*VerifyOTPResponse) ProtoMessage() {}
+
+func (x *VerifyOTPResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_keymaster_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use VerifyOTPResponse.ProtoReflect.Descriptor instead.
+func (*VerifyOTPResponse) Descriptor() ([]byte, []int) {
+	return file_keymaster_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *VerifyOTPResponse) GetSessionToken() string {
+	if x != nil {
+		return x.SessionToken
+	}
+	return ""
+}
+
+func (x *VerifyOTPResponse) GetChallengeMessage() string {
+	if x != nil {
+		return x.ChallengeMessage
+	}
+	return ""
+}
+
+func (x *VerifyOTPResponse) GetState() string {
+	if x != nil {
+		return x.State
+	}
+	return ""
+}
+
+type PushRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// The auth type of the push: "Duo" or "Webhook".
+	AuthType      string `protobuf:"bytes,1,opt,name=auth_type,json=authType,proto3" json:"auth_type,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PushRequest) Reset() {
+	*x = PushRequest{}
+	mi := &file_keymaster_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PushRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PushRequest) ProtoMessage() {}
+
+func (x *PushRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_keymaster_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PushRequest.ProtoReflect.Descriptor instead.
+func (*PushRequest) Descriptor() ([]byte, []int) {
+	return file_keymaster_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *PushRequest) GetAuthType() string {
+	if x != nil {
+		return x.AuthType
+	}
+	return ""
+}
+
+type PushStatus struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	State PushStatus_State       `protobuf:"varint,1,opt,name=state,proto3,enum=keymaster.v0.PushStatus_State" json:"state,omitempty"`
+	// What the user is asked, if the push sends a message.
+	Message string `protobuf:"bytes,2,opt,name=message,proto3" json:"message,omitempty"`
+	// Set once the push is approved.
+	SessionToken  string `protobuf:"bytes,3,opt,name=session_token,json=sessionToken,proto3" json:"session_token,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PushStatus) Reset() {
+	*x = PushStatus{}
+	mi := &file_keymaster_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PushStatus) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PushStatus) ProtoMessage() {}
+
+func (x *PushStatus) ProtoReflect() protoreflect.Message {
+	mi := &file_keymaster_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PushStatus.ProtoReflect.Descriptor instead.
+func (*PushStatus) Descriptor() ([]byte, []int) {
+	return file_keymaster_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *PushStatus) GetState() PushStatus_State {
+	if x != nil {
+		return x.State
+	}
+	return PushStatus_STATE_UNSPECIFIED
+}
+
+func (x *PushStatus) GetMessage() string {
+	if x != nil {
+		return x.Message
+	}
+	return ""
+}
+
+func (x *PushStatus) GetSessionToken() string {
+	if x != nil {
+		return x.SessionToken
+	}
+	return ""
+}
+
+type CertificateRequest struct {
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	Username string                 `protobuf:"bytes,1,opt,name=username,proto3" json:"username,omitempty"`
+	// "ssh", "x509" or "x509-kubernetes".
+	Type string `protobuf:"bytes,2,opt,name=type,proto3" json:"type,omitempty"`
+	// The PEM encoded PKIX public key or, for SSH certificates, the
+	// authorized_keys line of the key to certify.
+	PublicKey string `protobuf:"bytes,3,opt,name=public_key,json=publicKey,proto3" json:"public_key,omitempty"`
+	// The lifetime in Go duration format (such as "12h"); empty for the
+	// default.
+	Duration string `protobuf:"bytes,4,opt,name=duration,proto3" json:"duration,omitempty"`
+	// The certificate profile; empty for the default.
+	Profile       string   `protobuf:"bytes,5,opt,name=profile,proto3" json:"profile,omitempty"`
+	SshPrincipals []string `protobuf:"bytes,6,rep,name=ssh_principals,json=sshPrincipals,proto3" json:"ssh_principals,omitempty"`
+	X509Sans      []string `protobuf:"bytes,7,rep,name=x509_sans,json=x509Sans,proto3" json:"x509_sans,omitempty"`
+	AddGroups     bool     `protobuf:"varint,8,opt,name=add_groups,json=addGroups,proto3" json:"add_groups,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CertificateRequest) Reset() {
+	*x = CertificateRequest{}
+	mi := &file_keymaster_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CertificateRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CertificateRequest) ProtoMessage() {}
+
+func (x *CertificateRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_keymaster_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CertificateRequest.ProtoReflect.Descriptor instead.
+func (*CertificateRequest) Descriptor() ([]byte, []int) {
+	return file_keymaster_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *CertificateRequest) GetUsername() string {
+	if x != nil {
+		return x.Username
+	}
+	return ""
+}
+
+func (x *CertificateRequest) GetType() string {
+	if x != nil {
+		return x.Type
+	}
+	return ""
+}
+
+func (x *CertificateRequest) GetPublicKey() string {
+	if x != nil {
+		return x.PublicKey
+	}
+	return ""
+}
+
+func (x *CertificateRequest) GetDuration() string {
+	if x != nil {
+		return x.Duration
+	}
+	return ""
+}
+
+func (x *CertificateRequest) GetProfile() string {
+	if x != nil {
+		return x.Profile
+	}
+	return ""
+}
+
+func (x *CertificateRequest) GetSshPrincipals() []string {
+	if x != nil {
+		return x.SshPrincipals
+	}
+	return nil
+}
+
+func (x *CertificateRequest) GetX509Sans() []string {
+	if x != nil {
+		return x.X509Sans
+	}
+	return nil
+}
+
+func (x *CertificateRequest) GetAddGroups() bool {
+	if x != nil {
+		return x.AddGroups
+	}
+	return false
+}
+
+type CertificateResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// The authorized_keys line of an SSH certificate or the PEM encoding of
+	// an X.509 certificate.
+	Certificate   []byte `protobuf:"bytes,1,opt,name=certificate,proto3" json:"certificate,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CertificateResponse) Reset() {
+	*x = CertificateResponse{}
+	mi := &file_keymaster_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CertificateResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CertificateResponse) ProtoMessage() {}
+
+func (x *CertificateResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_keymaster_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CertificateResponse.ProtoReflect.Descriptor instead.
+func (*CertificateResponse) Descriptor() ([]byte, []int) {
+	return file_keymaster_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *CertificateResponse) GetCertificate() []byte {
+	if x != nil {
+		return x.Certificate
+	}
+	return nil
+}
+
+type BearerTokenRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Empty for the default audience.
+	Audience string `protobuf:"bytes,1,opt,name=audience,proto3" json:"audience,omitempty"`
+	// The lifetime in Go duration format; empty for the default.
+	Duration      string `protobuf:"bytes,2,opt,name=duration,proto3" json:"duration,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BearerTokenRequest) Reset() {
+	*x = BearerTokenRequest{}
+	mi := &file_keymaster_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BearerTokenRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BearerTokenRequest) ProtoMessage() {}
+
+func (x *BearerTokenRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_keymaster_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BearerTokenRequest.ProtoReflect.Descriptor instead.
+func (*BearerTokenRequest) Descriptor() ([]byte, []int) {
+	return file_keymaster_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *BearerTokenRequest) GetAudience() string {
+	if x != nil {
+		return x.Audience
+	}
+	return ""
+}
+
+func (x *BearerTokenRequest) GetDuration() string {
+	if x != nil {
+		return x.Duration
+	}
+	return ""
+}
+
+type BearerTokenResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	AccessToken   string                 `protobuf:"bytes,1,opt,name=access_token,json=accessToken,proto3" json:"access_token,omitempty"`
+	ExpiresIn     int64                  `protobuf:"varint,2,opt,name=expires_in,json=expiresIn,proto3" json:"expires_in,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BearerTokenResponse) Reset() {
+	*x = BearerTokenResponse{}
+	mi := &file_keymaster_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BearerTokenResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BearerTokenResponse) ProtoMessage() {}
+
+func (x *BearerTokenResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_keymaster_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BearerTokenResponse.ProtoReflect.Descriptor instead.
+func (*BearerTokenResponse) Descriptor() ([]byte, []int) {
+	return file_keymaster_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *BearerTokenResponse) GetAccessToken() string {
+	if x != nil {
+		return x.AccessToken
+	}
+	return ""
+}
+
+func (x *BearerTokenResponse) GetExpiresIn() int64 {
+	if x != nil {
+		return x.ExpiresIn
+	}
+	return 0
+}
+
+var File_keymaster_proto protoreflect.FileDescriptor
+
+const file_keymaster_proto_rawDesc = "" +
+	"\n" +
+	"\x0fkeymaster.proto\x12\fkeymaster.v0\"F\n" +
+	"\fLoginRequest\x12\x1a\n" +
+	"\busername\x18\x01 \x01(\tR\busername\x12\x1a\n" +
+	"\bpassword\x18\x02 \x01(\tR\bpassword\"\xb9\x01\n" +
+	"\rLoginResponse\x12#\n" +
+	"\rsession_token\x18\x01 \x01(\tR\fsessionToken\x12#\n" +
+	"\rauth_backends\x18\x02 \x03(\tR\fauthBackends\x12.\n" +
+	"\x13supported_key_types\x18\x03 \x03(\tR\x11supportedKeyTypes\x12.\n" +
+	"\x13password_expires_in\x18\x04 \x01(\x03R\x11passwordExpiresIn\"W\n" +
+	"\x10VerifyOTPRequest\x12\x1b\n" +
+	"\tauth_type\x18\x01 \x01(\tR\bauthType\x12\x10\n" +
+	"\x03otp\x18\x02 \x01(\tR\x03otp\x12\x14\n" +
+	"\x05state\x18\x03 \x01(\tR\x05state\"{\n" +
+	"\x11VerifyOTPResponse\x12#\n" +
+	"\rsession_token\x18\x01 \x01(\tR\fsessionToken\x12+\n" +
+	"\x11challenge_message\x18\x02 \x01(\tR\x10challengeMessage\x12\x14\n" +
+	"\x05state\x18\x03 \x01(\tR\x05state\"*\n" +
+	"\vPushRequest\x12\x1b\n" +
+	"\tauth_type\x18\x01 \x01(\tR\bauthType\"\xc8\x01\n" +
+	"\n" +
+	"PushStatus\x124\n" +
+	"\x05state\x18\x01 \x01(\x0e2\x1e.keymaster.v0.PushStatus.StateR\x05state\x12\x18\n" +
+	"\amessage\x18\x02 \x01(\tR\amessage\x12#\n" +
+	"\rsession_token\x18\x03 \x01(\tR\fsessionToken\"E\n" +
+	"\x05State\x12\x15\n" +
+	"\x11STATE_UNSPECIFIED\x10\x00\x12\v\n" +
+	"\aPENDING\x10\x01\x12\f\n" +
+	"\bAPPROVED\x10\x02\x12\n" +
+	"\n" +
+	"\x06DENIED\x10\x03\"\xfc\x01\n" +
+	"\x12CertificateRequest\x12\x1a\n" +
+	"\busername\x18\x01 \x01(\tR\busername\x12\x12\n" +
+	"\x04type\x18\x02 \x01(\tR\x04type\x12\x1d\n" +
+	"\n" +
+	"public_key\x18\x03 \x01(\tR\tpublicKey\x12\x1a\n" +
+	"\bduration\x18\x04 \x01(\tR\bduration\x12\x18\n" +
+	"\aprofile\x18\x05 \x01(\tR\aprofile\x12%\n" +
+	"\x0essh_principals\x18\x06 \x03(\tR\rsshPrincipals\x12\x1b\n" +
+	"\tx509_sans\x18\a \x03(\tR\bx509Sans\x12\x1d\n" +
+	"\n" +
+	"add_groups\x18\b \x01(\bR\taddGroups\"7\n" +
+	"\x13CertificateResponse\x12 \n" +
+	"\vcertificate\x18\x01 \x01(\fR\vcertificate\"L\n" +
+	"\x12BearerTokenRequest\x12\x1a\n" +
+	"\baudience\x18\x01 \x01(\tR\baudience\x12\x1a\n" +
+	"\bduration\x18\x02 \x01(\tR\bduration\"W\n" +
+	"\x13BearerTokenResponse\x12!\n" +
+	"\faccess_token\x18\x01 \x01(\tR\vaccessToken\x12\x1d\n" +
+	"\n" +
+	"expires_in\x18\x02 \x01(\x03R\texpiresIn2\xd5\x01\n" +
+	"\x04Auth\x12@\n" +
+	"\x05Login\x12\x1a.keymaster.v0.LoginRequest\x1a\x1b.keymaster.v0.LoginResponse\x12L\n" +
+	"\tVerifyOTP\x12\x1e.keymaster.v0.VerifyOTPRequest\x1a\x1f.keymaster.v0.VerifyOTPResponse\x12=\n" +
+	"\x04Push\x12\x19.keymaster.v0.PushRequest\x1a\x18.keymaster.v0.PushStatus0\x012\xb8\x01\n" +
+	"\bIssuance\x12U\n" +
+	"\x0eGetCertificate\x12 .keymaster.v0.CertificateRequest\x1a!.keymaster.v0.CertificateResponse\x12U\n" +
+	"\x0eGetBearerToken\x12 .keymaster.v0.BearerTokenRequest\x1a!.keymaster.v0.BearerTokenResponseB9Z7github.com/Cloud-Foundations/keymaster/lib/webapi/v0/pbb\x06proto3"
+
+var (
+	file_keymaster_proto_rawDescOnce sync.Once
+	file_keymaster_proto_rawDescData []byte
+)
+
+func file_keymaster_proto_rawDescGZIP() []byte {
+	file_keymaster_proto_rawDescOnce.Do(func() {
+		file_keymaster_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_keymaster_proto_rawDesc), len(file_keymaster_proto_rawDesc)))
+	})
+	return file_keymaster_proto_rawDescData
+}
+
+var file_keymaster_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_keymaster_proto_msgTypes = make([]protoimpl.MessageInfo, 10)
+var file_keymaster_proto_goTypes = []any{
+	(PushStatus_State)(0),       // 0: keymaster.v0.PushStatus.State
+	(*LoginRequest)(nil),        // 1: keymaster.v0.LoginRequest
+	(*LoginResponse)(nil),       // 2: keymaster.v0.LoginResponse
+	(*VerifyOTPRequest)(nil),    // 3: keymaster.v0.VerifyOTPRequest
+	(*VerifyOTPResponse)(nil),   // 4: keymaster.v0.VerifyOTPResponse
+	(*PushRequest)(nil),         // 5: keymaster.v0.PushRequest
+	(*PushStatus)(nil),          // 6: keymaster.v0.PushStatus
+	(*CertificateRequest)(nil),  // 7: keymaster.v0.CertificateRequest
+	(*CertificateResponse)(nil), // 8: keymaster.v0.CertificateResponse
+	(*BearerTokenRequest)(nil),  // 9: keymaster.v0.BearerTokenRequest
+	(*BearerTokenResponse)(nil), // 10: keymaster.v0.BearerTokenResponse
+}
+var file_keymaster_proto_depIdxs = []int32{
+	0,  // 0: keymaster.v0.PushStatus.state:type_name -> keymaster.v0.PushStatus.State
+	1,  // 1: keymaster.v0.Auth.Login:input_type -> keymaster.v0.LoginRequest
+	3,  // 2: keymaster.v0.Auth.VerifyOTP:input_type -> keymaster.v0.VerifyOTPRequest
+	5,  // 3: keymaster.v0.Auth.Push:input_type -> keymaster.v0.PushRequest
+	7,  // 4: keymaster.v0.Issuance.GetCertificate:input_type -> keymaster.v0.CertificateRequest
+	9,  // 5: keymaster.v0.Issuance.GetBearerToken:input_type -> keymaster.v0.BearerTokenRequest
+	2,  // 6: keymaster.v0.Auth.Login:output_type -> keymaster.v0.LoginResponse
+	4,  // 7: keymaster.v0.Auth.VerifyOTP:output_type -> keymaster.v0.VerifyOTPResponse
+	6,  // 8: keymaster.v0.Auth.Push:output_type -> keymaster.v0.PushStatus
+	8,  // 9: keymaster.v0.Issuance.GetCertificate:output_type -> keymaster.v0.CertificateResponse
+	10, // 10: keymaster.v0.Issuance.GetBearerToken:output_type -> keymaster.v0.BearerTokenResponse
+	6,  // [6:11] is the sub-list for method output_type
+	1,  // [1:6] is the sub-list for method input_type
+	1,  // [1:1] is the sub-list for extension type_name
+	1,  // [1:1] is the sub-list for extension extendee
+	0,  // [0:1] is the sub-list for field type_name
+}
+
+func init() { file_keymaster_proto_init() }
+func file_keymaster_proto_init() {
+	if File_keymaster_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_keymaster_proto_rawDesc), len(file_keymaster_proto_rawDesc)),
+			NumEnums:      1,
+			NumMessages:   10,
+			NumExtensions: 0,
+			NumServices:   2,
+		},
+		GoTypes:           file_keymaster_proto_goTypes,
+		DependencyIndexes: file_keymaster_proto_depIdxs,
+		EnumInfos:         file_keymaster_proto_enumTypes,
+		MessageInfos:      file_keymaster_proto_msgTypes,
+	}.Build()
+	File_keymaster_proto = out.File
+	file_keymaster_proto_goTypes = nil
+	file_keymaster_proto_depIdxs = nil
+}
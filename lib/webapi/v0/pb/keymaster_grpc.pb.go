@@ -0,0 +1,376 @@
+// The keymaster gRPC API offers the login, second factor and issuance
+// operations of the JSON web API (lib/webapi/v0/proto) to clients generated
+// from this file. Calls are handled like the matching web API requests, with
+// the same checks and denials.
+//
+// Login returns a session token, which the other calls send in the
+// "keymaster-session" metadata key. VerifyOTP and an approved Push return
+// the token to use after the second factor. The values of the
+// "x-keymaster-device", "x-keymaster-piv-attestation" and
+// "x-keymaster-tpm-attestation" metadata keys are passed on like the HTTP
+// headers of the same names. Denials carry their reason code (see
+// proto.DenialResponse) in the "keymaster-denial-reason" trailer.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: keymaster.proto
+
+package pb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Auth_Login_FullMethodName     = "/keymaster.v0.Auth/Login"
+	Auth_VerifyOTP_FullMethodName = "/keymaster.v0.Auth/VerifyOTP"
+	Auth_Push_FullMethodName      = "/keymaster.v0.Auth/Push"
+)
+
+// AuthClient is the client API for Auth service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Auth logs users in.
+type AuthClient interface {
+	// Login checks a username and password, like /api/v0/login.
+	Login(ctx context.Context, in *LoginRequest, opts ...grpc.CallOption) (*LoginResponse, error)
+	// VerifyOTP checks a one time password of a second factor.
+	VerifyOTP(ctx context.Context, in *VerifyOTPRequest, opts ...grpc.CallOption) (*VerifyOTPResponse, error)
+	// Push asks the user to approve the login out of band and streams its
+	// status until the user answers or the call is cancelled. The server
+	// checks the status every 2 seconds, and only sends it when it changes.
+	Push(ctx context.Context, in *PushRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[PushStatus], error)
+}
+
+type authClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAuthClient(cc grpc.ClientConnInterface) AuthClient {
+	return &authClient{cc}
+}
+
+func (c *authClient) Login(ctx context.Context, in *LoginRequest, opts ...grpc.CallOption) (*LoginResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(LoginResponse)
+	err := c.cc.Invoke(ctx, Auth_Login_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *authClient) VerifyOTP(ctx context.Context, in *VerifyOTPRequest, opts ...grpc.CallOption) (*VerifyOTPResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(VerifyOTPResponse)
+	err := c.cc.Invoke(ctx, Auth_VerifyOTP_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *authClient) Push(ctx context.Context, in *PushRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[PushStatus], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Auth_ServiceDesc.Streams[0], Auth_Push_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[PushRequest, PushStatus]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Auth_PushClient = grpc.ServerStreamingClient[PushStatus]
+
+// AuthServer is the server API for Auth service.
+// All implementations must embed UnimplementedAuthServer
+// for forward compatibility.
+//
+// Auth logs users in.
+type AuthServer interface {
+	// Login checks a username and password, like /api/v0/login.
+	Login(context.Context, *LoginRequest) (*LoginResponse, error)
+	// VerifyOTP checks a one time password of a second factor.
+	VerifyOTP(context.Context, *VerifyOTPRequest) (*VerifyOTPResponse, error)
+	// Push asks the user to approve the login out of band and streams its
+	// status until the user answers or the call is cancelled. The server
+	// checks the status every 2 seconds, and only sends it when it changes.
+	Push(*PushRequest, grpc.ServerStreamingServer[PushStatus]) error
+	mustEmbedUnimplementedAuthServer()
+}
+
+// UnimplementedAuthServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedAuthServer struct{}
+
+func (UnimplementedAuthServer) Login(context.Context, *LoginRequest) (*LoginResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Login not implemented")
+}
+func (UnimplementedAuthServer) VerifyOTP(context.Context, *VerifyOTPRequest) (*VerifyOTPResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method VerifyOTP not implemented")
+}
+func (UnimplementedAuthServer) Push(*PushRequest, grpc.ServerStreamingServer[PushStatus]) error {
+	return status.Errorf(codes.Unimplemented, "method Push not implemented")
+}
+func (UnimplementedAuthServer) mustEmbedUnimplementedAuthServer() {}
+func (UnimplementedAuthServer) testEmbeddedByValue()              {}
+
+// UnsafeAuthServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AuthServer will
+// result in compilation errors.
+type UnsafeAuthServer interface {
+	mustEmbedUnimplementedAuthServer()
+}
+
+func RegisterAuthServer(s grpc.ServiceRegistrar, srv AuthServer) {
+	// If the following call pancis, it indicates UnimplementedAuthServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Auth_ServiceDesc, srv)
+}
+
+func _Auth_Login_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LoginRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AuthServer).Login(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Auth_Login_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AuthServer).Login(ctx, req.(*LoginRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Auth_VerifyOTP_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(VerifyOTPRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AuthServer).VerifyOTP(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Auth_VerifyOTP_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AuthServer).VerifyOTP(ctx, req.(*VerifyOTPRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Auth_Push_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(PushRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(AuthServer).Push(m, &grpc.GenericServerStream[PushRequest, PushStatus]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Auth_PushServer = grpc.ServerStreamingServer[PushStatus]
+
+// Auth_ServiceDesc is the grpc.ServiceDesc for Auth service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Auth_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "keymaster.v0.Auth",
+	HandlerType: (*AuthServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Login",
+			Handler:    _Auth_Login_Handler,
+		},
+		{
+			MethodName: "VerifyOTP",
+			Handler:    _Auth_VerifyOTP_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Push",
+			Handler:       _Auth_Push_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "keymaster.proto",
+}
+
+const (
+	Issuance_GetCertificate_FullMethodName = "/keymaster.v0.Issuance/GetCertificate"
+	Issuance_GetBearerToken_FullMethodName = "/keymaster.v0.Issuance/GetBearerToken"
+)
+
+// IssuanceClient is the client API for Issuance service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Issuance issues credentials to logged in users.
+type IssuanceClient interface {
+	// GetCertificate issues a certificate, like /certgen/<username>.
+	GetCertificate(ctx context.Context, in *CertificateRequest, opts ...grpc.CallOption) (*CertificateResponse, error)
+	// GetBearerToken issues a JWT, like /api/v0/bearerToken.
+	GetBearerToken(ctx context.Context, in *BearerTokenRequest, opts ...grpc.CallOption) (*BearerTokenResponse, error)
+}
+
+type issuanceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewIssuanceClient(cc grpc.ClientConnInterface) IssuanceClient {
+	return &issuanceClient{cc}
+}
+
+func (c *issuanceClient) GetCertificate(ctx context.Context, in *CertificateRequest, opts ...grpc.CallOption) (*CertificateResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(CertificateResponse)
+	err := c.cc.Invoke(ctx, Issuance_GetCertificate_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *issuanceClient) GetBearerToken(ctx context.Context, in *BearerTokenRequest, opts ...grpc.CallOption) (*BearerTokenResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(BearerTokenResponse)
+	err := c.cc.Invoke(ctx, Issuance_GetBearerToken_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// IssuanceServer is the server API for Issuance service.
+// All implementations must embed UnimplementedIssuanceServer
+// for forward compatibility.
+//
+// Issuance issues credentials to logged in users.
+type IssuanceServer interface {
+	// GetCertificate issues a certificate, like /certgen/<username>.
+	GetCertificate(context.Context, *CertificateRequest) (*CertificateResponse, error)
+	// GetBearerToken issues a JWT, like /api/v0/bearerToken.
+	GetBearerToken(context.Context, *BearerTokenRequest) (*BearerTokenResponse, error)
+	mustEmbedUnimplementedIssuanceServer()
+}
+
+// UnimplementedIssuanceServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedIssuanceServer struct{}
+
+func (UnimplementedIssuanceServer) GetCertificate(context.Context, *CertificateRequest) (*CertificateResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetCertificate not implemented")
+}
+func (UnimplementedIssuanceServer) GetBearerToken(context.Context, *BearerTokenRequest) (*BearerTokenResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBearerToken not implemented")
+}
+func (UnimplementedIssuanceServer) mustEmbedUnimplementedIssuanceServer() {}
+func (UnimplementedIssuanceServer) testEmbeddedByValue()                  {}
+
+// UnsafeIssuanceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to IssuanceServer will
+// result in compilation errors.
+type UnsafeIssuanceServer interface {
+	mustEmbedUnimplementedIssuanceServer()
+}
+
+func RegisterIssuanceServer(s grpc.ServiceRegistrar, srv IssuanceServer) {
+	// If the following call pancis, it indicates UnimplementedIssuanceServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Issuance_ServiceDesc, srv)
+}
+
+func _Issuance_GetCertificate_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CertificateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IssuanceServer).GetCertificate(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Issuance_GetCertificate_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IssuanceServer).GetCertificate(ctx, req.(*CertificateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Issuance_GetBearerToken_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BearerTokenRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IssuanceServer).GetBearerToken(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Issuance_GetBearerToken_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IssuanceServer).GetBearerToken(ctx, req.(*BearerTokenRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Issuance_ServiceDesc is the grpc.ServiceDesc for Issuance service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Issuance_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "keymaster.v0.Issuance",
+	HandlerType: (*IssuanceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetCertificate",
+			Handler:    _Issuance_GetCertificate_Handler,
+		},
+		{
+			MethodName: "GetBearerToken",
+			Handler:    _Issuance_GetBearerToken_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "keymaster.proto",
+}
@@ -1,17 +1,432 @@
 package proto
 
+import (
+	"strings"
+	"time"
+)
+
 const LoginPath = "/api/v0/login"
 
+// OIDCTokenLoginPath accepts a POST with a pre-obtained OIDC token in the
+// "token" form field and answers with a LoginResponse. A GET answers with a
+// LoginResponse listing AuthTypeOIDCToken if the server accepts tokens, so
+// that clients can check before sending one.
+const OIDCTokenLoginPath = "/api/v0/oidcTokenLogin"
+
+// CloudIdentityLoginPath accepts the identity credential of a cloud instance
+// and answers with a LoginResponse. The "provider" form field is "aws",
+// "gcp" or "azure". AWS instances send their instance identity document and
+// its signature in the "document" and "signature" fields and the JSON
+// encoding of an AWSSTSRequest, which proves that the instance holds the
+// credentials of its role now, in the "sts_request" field. GCP instances
+// their identity token in the "token" field and Azure virtual machines the
+// signature of their attested data in the "signature" field.
+const CloudIdentityLoginPath = "/api/v0/cloudIdentityLogin"
+
+// ServiceAccountLoginPath accepts a service account refresh token in the
+// "token" form field and answers with a LoginResponse holding the refresh
+// token which replaces it.
+const ServiceAccountLoginPath = "/api/v0/serviceAccountLogin"
+
+// CertificateRenewalLoginPath accepts a POST over a TLS connection on which
+// the client presented a valid X.509 certificate issued by the keymaster,
+// and answers with a LoginResponse. Second factors are listed if the server
+// requires them for renewals.
+const CertificateRenewalLoginPath = "/api/v0/certificateRenewalLogin"
+
 const (
-	AuthTypePassword      = "password"
-	AuthTypeFederated     = "federated"
-	AuthTypeU2F           = "U2F"
-	AuthTypeSymantecVIP   = "SymantecVIP"
-	AuthTypeIPCertificate = "IPCertificate"
-	AuthTypeTOTP          = "TOTP"
+	AuthTypePassword           = "password"
+	AuthTypeFederated          = "federated"
+	AuthTypeU2F                = "U2F"
+	AuthTypeSymantecVIP        = "SymantecVIP"
+	AuthTypeIPCertificate      = "IPCertificate"
+	AuthTypeTOTP               = "TOTP"
+	AuthTypeOIDCToken          = "OIDCToken"
+	AuthTypeWebAuthn           = "WebAuthn"
+	AuthTypeOkta2FA            = "Okta2FA"
+	AuthTypeRADIUS             = "RADIUS"
+	AuthTypeDuo                = "Duo"
+	AuthTypeWebhook            = "Webhook"
+	AuthTypeRecoveryCode       = "RecoveryCode"
+	AuthTypeCloudIdentity      = "CloudIdentity"
+	AuthTypeServiceAccount     = "ServiceAccount"
+	AuthTypeCertificateRenewal = "CertificateRenewal"
 )
 
+// TOTPAuthPath accepts a TOTP code in the "OTP" form field as second factor.
+const TOTPAuthPath = "/api/v0/TOTPAuth"
+
+// TOTP enrollment endpoints. A POST to TOTPEnrollPath creates a pending
+// secret for the authenticated user and answers with a TOTPEnrollResponse.
+// The secret is activated by posting a current code in the "OTP" form field
+// to TOTPEnrollVerifyPath.
+const (
+	TOTPEnrollPath       = "/api/v0/totpEnroll"
+	TOTPEnrollVerifyPath = "/api/v0/totpEnrollVerify"
+)
+
+type TOTPEnrollResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+// RADIUSAuthPath accepts a one time password in the "OTP" form field as
+// second factor. If the RADIUS server asks for another response the answer
+// is a RADIUSChallenge; the response is then posted with its "state".
+const RADIUSAuthPath = "/api/v0/radiusAuth"
+
+// RADIUSChallenge is the answer to a RADIUSAuthPath request. An empty State
+// means the second factor was accepted.
+type RADIUSChallenge struct {
+	Message string `json:"message"`
+	State   string `json:"state,omitempty"`
+}
+
+// Duo endpoints. DuoAuthPath accepts a Duo passcode in the "OTP" form field.
+// Each POST to DuoPushPath sends a push to the devices of the user or checks
+// the result of the push sent before: it answers 200 when approved, 412
+// while the user has yet to answer and 401 if the push failed.
+const (
+	DuoAuthPath = "/api/v0/duoAuth"
+	DuoPushPath = "/api/v0/duoPush"
+)
+
+// WebhookAuthPath starts or continues a login checked by the second factor
+// webhook. The first POST has no form fields. The answer is a
+// WebhookChallenge: the user's answer to a challenge is then posted in the
+// "OTP" form field with its "state", and a pending login is checked again by
+// posting its "state" alone. A denied login is answered with 401.
+const WebhookAuthPath = "/api/v0/webhookAuth"
+
+// WebhookChallenge is the answer to a WebhookAuthPath request. An empty State
+// means the second factor was accepted. If Pending is true the user answers
+// out of band, otherwise Message asks for a response.
+type WebhookChallenge struct {
+	Message string `json:"message"`
+	State   string `json:"state,omitempty"`
+	Pending bool   `json:"pending,omitempty"`
+}
+
+// BearerTokenPath answers a GET or POST of an authenticated user, who could
+// get certificates, with a BearerTokenResponse holding a short lived JWT
+// signed with the CA key, for systems which take bearer tokens rather than
+// certificates. They verify it with the keys published at /idp/oauth2/jwks.
+// The optional "audience" form value selects one of the audiences the
+// server allows and "duration" a shorter lifetime. Besides the registered
+// claims the token has the email, groups and amr (the auth methods used) of
+// the user.
+const BearerTokenPath = "/api/v0/bearerToken"
+
+// BearerTokenResponse holds a JWT valid for ExpiresIn seconds.
+type BearerTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// FactorsPath answers a GET with the FactorsResponse of the authenticated
+// user, or for admins of the user named in the "username" query parameter.
+const FactorsPath = "/api/v0/factors"
+
+// EnrolledFactor is a U2F, WebAuthn or TOTP device registered by a user.
+// Index identifies it to the manage endpoint of its Type.
+type EnrolledFactor struct {
+	Type      string    `json:"type"`
+	Index     int64     `json:"index"`
+	Name      string    `json:"name"`
+	Enabled   bool      `json:"enabled"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// FactorsResponse lists the devices of a user. If MinEnabledFactors is not
+// zero the user needs that many enabled devices to get certificates.
+type FactorsResponse struct {
+	Username          string           `json:"username"`
+	Factors           []EnrolledFactor `json:"factors"`
+	MinEnabledFactors int              `json:"min_enabled_factors,omitempty"`
+}
+
+// SessionsPath answers a GET with the SessionsResponse of the authenticated
+// user, or for admins of the user named in the "username" query parameter.
+// A POST revokes the session of the "session_id" form value or, if the
+// "all" form value is true, all sessions of the user. Revoked sessions
+// cannot be used any more.
+const SessionsPath = "/api/v0/sessions"
+
+// WebSession is an active web session. AuthMethods are the auth types which
+// the session was authenticated with. Current is set for the session of the
+// request.
+type WebSession struct {
+	ID          string    `json:"id"`
+	RemoteAddr  string    `json:"remote_addr"`
+	UserAgent   string    `json:"user_agent,omitempty"`
+	AuthMethods []string  `json:"auth_methods"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	Current     bool      `json:"current,omitempty"`
+}
+
+// SessionsResponse lists the active web sessions of a user, newest first.
+type SessionsResponse struct {
+	Username string       `json:"username"`
+	Sessions []WebSession `json:"sessions"`
+}
+
+// CertApprovalsPath answers a GET with the CertApprovalsResponse of the
+// pending certificate requests the authenticated user may approve, and
+// their own requests. A POST of the "id" form value and the "action" form
+// value approve or deny decides on a pending request. Users may not decide
+// on their own requests.
+const CertApprovalsPath = "/api/v0/certApprovals"
+
+// States of a CertApproval.
+const (
+	CertApprovalPending  = "pending"
+	CertApprovalApproved = "approved"
+	CertApprovalDenied   = "denied"
+)
+
+// CertApproval is a certificate request which needs an approval of
+// NeedsApproval, the privileged principals and SANs among SSHPrincipals
+// and X509SANs. ExpiresAt is when a pending request or an unused approval
+// lapses.
+type CertApproval struct {
+	ID            string    `json:"id"`
+	Username      string    `json:"username"`
+	CertType      string    `json:"cert_type"`
+	SSHPrincipals []string  `json:"ssh_principals,omitempty"`
+	X509SANs      []string  `json:"x509_sans,omitempty"`
+	NeedsApproval []string  `json:"needs_approval"`
+	Rule          string    `json:"rule,omitempty"`
+	RemoteAddr    string    `json:"remote_addr"`
+	State         string    `json:"state"`
+	CreatedAt     time.Time `json:"created_at"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	DecidedBy     string    `json:"decided_by,omitempty"`
+	DecidedAt     time.Time `json:"decided_at,omitempty"`
+}
+
+// CertApprovalsResponse lists certificate approval requests, oldest first.
+type CertApprovalsResponse struct {
+	Requests []CertApproval `json:"requests"`
+}
+
+// BreakGlassPath answers a GET with the BreakGlassStatus. A POST of the
+// "action" form value activate and a "reason" votes for emergency issuance,
+// which starts once a quorum of the break glass admins voted, and
+// deactivate ends it. Only break glass admins logged in with a U2F or
+// WebAuthn security key may use it.
+const BreakGlassPath = "/api/v0/breakGlass"
+
+// BreakGlassVote is the vote of Admin for emergency issuance.
+type BreakGlassVote struct {
+	Admin  string    `json:"admin"`
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason"`
+}
+
+// BreakGlassStatus says whether emergency issuance is active, and until
+// when. Votes are the current votes for it while it is not.
+type BreakGlassStatus struct {
+	Active      bool             `json:"active"`
+	ActivatedAt time.Time        `json:"activated_at,omitempty"`
+	ActiveUntil time.Time        `json:"active_until,omitempty"`
+	ActivatedBy []string         `json:"activated_by,omitempty"`
+	Quorum      int              `json:"quorum"`
+	Votes       []BreakGlassVote `json:"votes,omitempty"`
+}
+
+// Recovery code endpoints. A POST to RecoveryCodesPath replaces the recovery
+// codes of the authenticated user and answers with a RecoveryCodesResponse.
+// RecoveryCodeAuthPath accepts an unused recovery code in the "OTP" form
+// field as second factor; the code is then invalidated.
+const (
+	RecoveryCodesPath    = "/api/v0/recoveryCodes"
+	RecoveryCodeAuthPath = "/api/v0/recoveryCodeAuth"
+)
+
+// RecoveryCodesResponse holds new recovery codes. They are shown only once.
+type RecoveryCodesResponse struct {
+	Codes []string `json:"codes"`
+}
+
+// WebAuthn endpoints. The begin endpoints answer with the JSON credential
+// creation or request options and the finish endpoints accept the JSON
+// encoded PublicKeyCredential produced by the authenticator. Registration
+// paths are followed by the username being registered.
+const (
+	WebAuthnRegisterBeginPath  = "/webauthn/RegisterBegin/"
+	WebAuthnRegisterFinishPath = "/webauthn/RegisterFinish/"
+	WebAuthnAuthBeginPath      = "/webauthn/AuthBegin"
+	WebAuthnAuthFinishPath     = "/webauthn/AuthFinish"
+)
+
+// Okta WebAuthn endpoints, for authenticators registered with Okta. The
+// begin endpoint answers with the JSON credential request options, which
+// also carry the "origin" the client data must name, and the finish endpoint
+// accepts the JSON encoded PublicKeyCredential.
+const (
+	OktaWebAuthnAuthBeginPath  = "/okta/webauthn/AuthBegin"
+	OktaWebAuthnAuthFinishPath = "/okta/webauthn/AuthFinish"
+)
+
+// Key types of user public keys which can be signed. ECDSA keys use the
+// P-256 curve.
+const (
+	KeyTypeRSA     = "rsa"
+	KeyTypeECDSA   = "ecdsa"
+	KeyTypeEd25519 = "ed25519"
+)
+
+// LoginResponse is sent after a successful first factor login.
+// SupportedKeyTypes lists the user key types the server signs; servers
+// which do not send it sign only RSA keys. RefreshToken is only sent after
+// a service account login; the token used to log in is no longer valid.
+// PasswordExpiresIn is the number of seconds until the password expires,
+// sent if the password backend warns about it.
 type LoginResponse struct {
-	Message         string   `json:"message"`
-	CertAuthBackend []string `json:"auth_backend"`
+	Message           string   `json:"message"`
+	CertAuthBackend   []string `json:"auth_backend"`
+	SupportedKeyTypes []string `json:"supported_key_types,omitempty"`
+	RefreshToken      string   `json:"refresh_token,omitempty"`
+	PasswordExpiresIn int64    `json:"password_expires_in,omitempty"`
+}
+
+// ChangePasswordPath changes the password of a user with the password
+// backend. A POST of the username, password and new_password form values
+// changes the password and is then answered like a password login with the
+// new password, so a user whose password must be changed can continue.
+const ChangePasswordPath = "/api/v0/changePassword"
+
+// Reason codes sent in a DenialResponse.
+const (
+	DenialReasonInsufficientAuthLevel = "insufficient_auth_level"
+	DenialReasonUserMismatch          = "user_mismatch"
+	DenialReasonPolicy                = "policy_denied"
+	DenialReasonNotEnoughFactors      = "not_enough_enrolled_factors"
+	// The password is correct but has expired or must be changed after a
+	// reset. It can be changed with ChangePasswordPath if the server allows.
+	DenialReasonPasswordMustChange = "password_must_change"
+	// The request did not come from a device approved by an admin.
+	DenialReasonDeviceNotApproved = "device_not_approved"
+	// The key to certify was not attested to be held in a hardware key.
+	DenialReasonHardwareKeyRequired = "hardware_key_required"
+	// The login came from an unusual location, such as a new country.
+	DenialReasonAnomalousLogin = "anomalous_login"
+	// The certificate needs an approval by another user. The message says
+	// where the pending request can be approved; the same request is
+	// issued once it is.
+	DenialReasonApprovalRequired = "approval_required"
+)
+
+// DeviceHeader holds the device key signature of a login or certificate
+// request, as made by lib/devicekey. Servers register the devices and may
+// only issue certificates to those an admin approved.
+const DeviceHeader = "X-Keymaster-Device"
+
+// PIVAttestationHeader holds the attestation of the key of a certificate
+// request, as made by lib/pivattest, when the key was generated in the PIV
+// applet of a YubiKey. Servers may only issue certificates to some users
+// for attested keys.
+const PIVAttestationHeader = "X-Keymaster-PIV-Attestation"
+
+// TPMAttestationHeader holds the attestation of the key of a certificate
+// request, as made by lib/tpmattest, when the key was generated in a TPM.
+const TPMAttestationHeader = "X-Keymaster-TPM-Attestation"
+
+// DenialResponse is sent as the body of a refused request when the client
+// accepts application/json. Older servers do not send it.
+type DenialResponse struct {
+	ReasonCode string `json:"reason_code"`
+	Message    string `json:"message"`
+}
+
+// HostCertPath issues SSH host certificates. A POST of a JSON encoded
+// HostCertRequest is answered with a HostCertResponse.
+const HostCertPath = "/api/v0/hostCert"
+
+// AWSAudienceHeader names the keymaster a signed AWSSTSRequest is meant for,
+// so that other services cannot replay it.
+const AWSAudienceHeader = "X-Keymaster-Audience"
+
+// AWSSTSRequest is an AWS STS GetCallerIdentity request signed (with
+// Signature Version 4) by an EC2 instance with the credentials of its role.
+// The keymaster sends it to STS, which answers with the role session of the
+// instance. AWSAudienceHeader must be among the signed Headers.
+type AWSSTSRequest struct {
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+}
+
+// HostCertRequest asks for a host certificate for PublicKey (in
+// authorized_keys format) valid for Principals. The host authenticates with
+// one of BootstrapToken, the AWS instance identity document, its signature
+// (as served by the instance metadata service) and the JSON encoded
+// AWSSTSRequest, or Certificate:
+// a host certificate issued before and Signature, the SSH signature of
+// RenewalMessage by its key made at Time.
+type HostCertRequest struct {
+	PublicKey            string    `json:"public_key"`
+	Principals           []string  `json:"principals"`
+	BootstrapToken       string    `json:"bootstrap_token,omitempty"`
+	AWSIdentityDocument  string    `json:"aws_identity_document,omitempty"`
+	AWSIdentitySignature string    `json:"aws_identity_signature,omitempty"`
+	AWSSTSRequest        string    `json:"aws_sts_request,omitempty"`
+	Certificate          string    `json:"certificate,omitempty"`
+	Signature            []byte    `json:"signature,omitempty"`
+	Time                 time.Time `json:"time,omitempty"`
+}
+
+// RenewalMessage returns the data signed by the key of the certificate of a
+// renewal request.
+func (r *HostCertRequest) RenewalMessage() []byte {
+	return []byte("keymaster-host-cert-renewal\n" +
+		r.Time.UTC().Format(time.RFC3339) + "\n" + r.PublicKey + "\n" +
+		strings.Join(r.Principals, ",") + "\n" + r.Certificate)
+}
+
+// HostCertResponse holds a host certificate in authorized_keys format.
+type HostCertResponse struct {
+	Certificate string `json:"certificate"`
+}
+
+// SSHCAPath serves the public key of the SSH CA, which signs both user and
+// host certificates, in authorized_keys format.
+const SSHCAPath = "/public/sshca"
+
+// SSHClientConfigPath serves a JSON encoded SSHClientConfigResponse, from
+// which keymaster ssh-setup writes ssh_config Match blocks.
+const SSHClientConfigPath = "/public/sshClientConfig"
+
+// SSHClientDomain holds the ssh_config options of the hosts matching
+// HostPatterns. With UseKeymasterUsername the keymaster username is the
+// remote user.
+type SSHClientDomain struct {
+	HostPatterns         []string `json:"host_patterns"`
+	UseKeymasterUsername bool     `json:"use_keymaster_username,omitempty"`
+	ProxyJump            string   `json:"proxy_jump,omitempty"`
+	Port                 int      `json:"port,omitempty"`
+}
+
+// SSHClientConfigResponse lists the host domains configured on the server.
+type SSHClientConfigResponse struct {
+	Domains []SSHClientDomain `json:"domains"`
+}
+
+// ClientConfigPath serves the settings of the clients of the environment in
+// the environment query parameter, or the default ones, as a JSON encoded
+// ClientConfigResponse.
+const ClientConfigPath = "/v1/client-config"
+
+// ClientConfigResponse holds client settings which clients merge with
+// their configuration file. Unset fields are omitted. SSHDomains are the
+// host domains served at SSHClientConfigPath.
+type ClientConfigResponse struct {
+	GenCertURLs               string            `json:"gen_cert_urls,omitempty"`
+	KeyType                   string            `json:"key_type,omitempty"`
+	KeyBits                   int               `json:"key_bits,omitempty"`
+	AddGroups                 bool              `json:"add_groups,omitempty"`
+	AgentRenewBeforeSeconds   int64             `json:"agent_renew_before_seconds,omitempty"`
+	AgentRetryIntervalSeconds int64             `json:"agent_retry_interval_seconds,omitempty"`
+	SSHDomains                []SSHClientDomain `json:"ssh_domains,omitempty"`
 }
@@ -4,9 +4,20 @@ const (
 	ConnectString = "200 Connected to keymaster eventmon service"
 	HttpPath      = "/eventmon/v0"
 
-	AuthTypePassword    = "Password"
-	AuthTypeSymantecVIP = "SymantecVIP"
-	AuthTypeU2F         = "U2F"
+	AuthTypeCertificateRenewal = "CertificateRenewal"
+	AuthTypeCloudIdentity      = "CloudIdentity"
+	AuthTypeKerberos           = "Kerberos"
+	AuthTypeOIDCToken          = "OIDCToken"
+	AuthTypePassword           = "Password"
+	AuthTypeSymantecVIP        = "SymantecVIP"
+	AuthTypeU2F                = "U2F"
+	AuthTypeWebAuthn           = "WebAuthn"
+	AuthTypeOkta2FA            = "Okta2FA"
+	AuthTypeRADIUS             = "RADIUS"
+	AuthTypeDuo                = "Duo"
+	AuthTypeWebhook            = "Webhook"
+	AuthTypeRecoveryCode       = "RecoveryCode"
+	AuthTypeServiceAccount     = "ServiceAccount"
 
 	EventTypeAuth                 = "Auth"
 	EventTypeServiceProviderLogin = "ServiceProviderLogin"